@@ -0,0 +1,286 @@
+// Package adapter runs protocol adapters on devices. An adapter reads
+// equipment over a protocol, like Modbus or OPC UA, and sends samples. Each
+// adapter is registered by name, and a Manager runs the adapters a device
+// is configured with and passes them each new device config, so apps don't
+// need to wire up every protocol themselves.
+//
+// The built-in adapters are sensors, oneWire, modbus, ble, opcua, snmp,
+// snmpTraps, dnp3, and can. Other adapters can be registered with Register, run as
+// subprocesses with Exec, or loaded from Go plugins with LoadPlugin.
+package adapter
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/logging"
+)
+
+var adapterLog = logging.Module("adapter")
+
+// Env is what adapters use to send data to the server
+type Env struct {
+	// ID is the device ID
+	ID string
+	// Send sends samples to the server
+	Send func([]data.Sample) error
+	// Upload sends log entries to the server, like SNMP traps. Adapters
+	// that need it fail to start if it is nil.
+	Upload func([]data.LogEntry) error
+}
+
+// Adapter is a protocol integration
+type Adapter interface {
+	// Start starts the adapter. Update is called with the device config
+	// after Start, and again each time the config changes.
+	Start() error
+	// Update applies a new device config. Adapters use the part of the
+	// config for their protocol, and should stop reading equipment that
+	// is no longer configured.
+	Update(config data.DeviceConfig) error
+	// Stop stops the adapter
+	Stop()
+}
+
+// Poller is implemented by adapters that can read equipment on demand
+type Poller interface {
+	// Poll reads the equipment that reports a sample type now, and sends
+	// the readings. If id is set, the sample ID must match too. An error
+	// is returned if the adapter has no equipment for the sample.
+	Poll(sampleType, id string) error
+}
+
+// Factory creates an adapter
+type Factory func(env Env) (Adapter, error)
+
+var (
+	registryLock sync.Mutex
+	registry     = builtin()
+)
+
+// Register registers an adapter, so it can be started by name. An error is
+// returned if the name is taken.
+func Register(name string, f Factory) error {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if name == "" {
+		return errors.New("adapter name is required")
+	}
+
+	if _, ok := registry[name]; ok {
+		return fmt.Errorf("adapter %v is already registered", name)
+	}
+
+	registry[name] = f
+	return nil
+}
+
+// Unregister removes a registered adapter, like one registered by a test.
+// Managers that already started the adapter keep running it.
+func Unregister(name string) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	delete(registry, name)
+}
+
+// Names returns the names of the registered adapters, sorted
+func Names() []string {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	var ret []string
+	for n := range registry {
+		ret = append(ret, n)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func factory(name string) (Factory, bool) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	f, ok := registry[name]
+	return f, ok
+}
+
+// Status is the status of an adapter in a manager
+type Status struct {
+	Name    string `json:"name"`
+	Running bool   `json:"running"`
+	// Error is the last error starting or updating the adapter
+	Error string `json:"error,omitempty"`
+	// Updated is when the adapter last got a config
+	Updated time.Time `json:"updated,omitempty"`
+}
+
+// Manager runs adapters and passes them the device config
+type Manager struct {
+	env Env
+
+	lock     sync.Mutex
+	names    []string
+	adapters map[string]Adapter
+	status   map[string]*Status
+	config   *data.DeviceConfig
+	stopped  bool
+}
+
+// NewManager creates a manager. Start starts adapters.
+func NewManager(env Env) *Manager {
+	return &Manager{
+		env:      env,
+		adapters: make(map[string]Adapter),
+		status:   make(map[string]*Status),
+	}
+}
+
+// Check returns an error if any of names are not registered
+func Check(names []string) error {
+	for _, n := range names {
+		if _, ok := factory(n); !ok {
+			return fmt.Errorf("unknown adapter: %v", n)
+		}
+	}
+	return nil
+}
+
+// Start starts adapters by name. Nothing is started if any of the names
+// are not registered. Adapters that fail to start are logged and shown
+// in Status, and the others are still started. If the manager already
+// has a config, the adapters are updated with it.
+func (m *Manager) Start(names ...string) error {
+	err := Check(names)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.stopped {
+		return errors.New("adapter manager is stopped")
+	}
+
+	for _, n := range names {
+		if _, ok := m.adapters[n]; ok {
+			continue
+		}
+
+		s := &Status{Name: n}
+		if _, ok := m.status[n]; !ok {
+			m.names = append(m.names, n)
+		}
+		m.status[n] = s
+
+		f, _ := factory(n)
+		a, err := f(m.env)
+		if err == nil {
+			err = a.Start()
+		}
+
+		if err != nil {
+			adapterLog.Error("error starting adapter", "adapter", n, "error", err)
+			s.Error = err.Error()
+			continue
+		}
+
+		m.adapters[n] = a
+		s.Running = true
+
+		if m.config != nil {
+			m.update(n, a, *m.config)
+		}
+	}
+
+	return nil
+}
+
+// update updates an adapter. Must be called with the lock held.
+func (m *Manager) update(name string, a Adapter, config data.DeviceConfig) {
+	s := m.status[name]
+	s.Updated = time.Now()
+	s.Error = ""
+
+	err := a.Update(config)
+	if err != nil {
+		adapterLog.Error("error updating adapter", "adapter", name, "error", err)
+		s.Error = err.Error()
+	}
+}
+
+// Update passes a new device config to the adapters. It can be used as
+// client.Config.OnConfig.
+func (m *Manager) Update(config data.DeviceConfig) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.config = &config
+
+	for _, n := range m.names {
+		if a, ok := m.adapters[n]; ok {
+			m.update(n, a, config)
+		}
+	}
+}
+
+// Poll asks the adapters that implement Poller to read a sample now. It
+// succeeds if any adapter reads the sample.
+func (m *Manager) Poll(sampleType, id string) error {
+	m.lock.Lock()
+	var pollers []Poller
+	for _, n := range m.names {
+		if p, ok := m.adapters[n].(Poller); ok {
+			pollers = append(pollers, p)
+		}
+	}
+	m.lock.Unlock()
+
+	err := fmt.Errorf("no adapter can poll %v %v", sampleType, id)
+	for _, p := range pollers {
+		perr := p.Poll(sampleType, id)
+		if perr == nil {
+			return nil
+		}
+
+		if perr != errNoPoll {
+			err = perr
+		}
+	}
+
+	return err
+}
+
+// Stop stops the adapters, in the reverse order they were started
+func (m *Manager) Stop() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.stopped = true
+
+	for i := len(m.names) - 1; i >= 0; i-- {
+		n := m.names[i]
+		if a, ok := m.adapters[n]; ok {
+			a.Stop()
+			delete(m.adapters, n)
+			m.status[n].Running = false
+		}
+	}
+}
+
+// Status returns the status of the adapters, in the order they were
+// started
+func (m *Manager) Status() []Status {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ret := make([]Status, 0, len(m.names))
+	for _, n := range m.names {
+		ret = append(ret, *m.status[n])
+	}
+	return ret
+}
@@ -0,0 +1,318 @@
+package adapter
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+type testAdapter struct {
+	startErr  error
+	updateErr error
+
+	lock    sync.Mutex
+	started bool
+	stopped bool
+	configs []data.DeviceConfig
+	stops   *[]string
+	name    string
+}
+
+func (a *testAdapter) Start() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.started = true
+	return a.startErr
+}
+
+func (a *testAdapter) Update(config data.DeviceConfig) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.configs = append(a.configs, config)
+	return a.updateErr
+}
+
+func (a *testAdapter) Stop() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.stopped = true
+	*a.stops = append(*a.stops, a.name)
+}
+
+func TestRegister(t *testing.T) {
+	for _, n := range []string{"modbus", "ble", "opcua", "snmp", "snmpTraps",
+		"dnp3", "can", "oneWire", "sensors"} {
+		if _, ok := factory(n); !ok {
+			t.Error("Built-in adapter not registered: ", n)
+		}
+	}
+
+	f := func(env Env) (Adapter, error) { return &testAdapter{}, nil }
+	defer Unregister("testRegister")
+
+	err := Register("testRegister", f)
+	if err != nil {
+		t.Fatal("Error registering adapter: ", err)
+	}
+
+	if Register("testRegister", f) == nil {
+		t.Error("Expected error registering name twice")
+	}
+
+	if Register("", f) == nil {
+		t.Error("Expected error registering blank name")
+	}
+
+	if Check([]string{"modbus", "testRegister"}) != nil {
+		t.Error("Registered adapters failed check")
+	}
+
+	if Check([]string{"modbus", "bogus"}) == nil {
+		t.Error("Expected error checking unknown adapter")
+	}
+}
+
+func TestManager(t *testing.T) {
+	var stops []string
+	adapters := map[string]*testAdapter{
+		"testA":     {name: "testA", stops: &stops},
+		"testB":     {name: "testB", stops: &stops, updateErr: errors.New("bad config")},
+		"testStart": {name: "testStart", stops: &stops, startErr: errors.New("no bus")},
+	}
+
+	for n, a := range adapters {
+		a := a
+		defer Unregister(n)
+		err := Register(n, func(env Env) (Adapter, error) {
+			if env.ID != "dev1" {
+				t.Error("Wrong env ID: ", env.ID)
+			}
+			return a, nil
+		})
+		if err != nil {
+			t.Fatal("Error registering adapter: ", err)
+		}
+	}
+
+	m := NewManager(Env{ID: "dev1"})
+
+	err := m.Start("testA", "bogus")
+	if err == nil {
+		t.Fatal("Expected error starting unknown adapter")
+	}
+
+	if adapters["testA"].started {
+		t.Fatal("Adapter started when another was unknown")
+	}
+
+	err = m.Start("testA", "testStart")
+	if err != nil {
+		t.Fatal("Error starting adapters: ", err)
+	}
+
+	config := data.DeviceConfig{Description: "pump house"}
+	m.Update(config)
+
+	// adapters started after a config get it right away
+	err = m.Start("testB")
+	if err != nil {
+		t.Fatal("Error starting adapter: ", err)
+	}
+
+	if len(adapters["testA"].configs) != 1 || len(adapters["testB"].configs) != 1 ||
+		adapters["testB"].configs[0].Description != "pump house" {
+		t.Error("Adapters did not get config")
+	}
+
+	if len(adapters["testStart"].configs) != 0 {
+		t.Error("Adapter that failed to start got config")
+	}
+
+	status := m.Status()
+	if len(status) != 3 {
+		t.Fatal("Wrong number of statuses: ", status)
+	}
+
+	if status[0].Name != "testA" || !status[0].Running || status[0].Error != "" ||
+		status[0].Updated.IsZero() {
+		t.Error("Wrong testA status: ", status[0])
+	}
+
+	if status[1].Name != "testStart" || status[1].Running || status[1].Error != "no bus" {
+		t.Error("Wrong testStart status: ", status[1])
+	}
+
+	if status[2].Name != "testB" || !status[2].Running || status[2].Error != "bad config" {
+		t.Error("Wrong testB status: ", status[2])
+	}
+
+	m.Stop()
+
+	if len(stops) != 2 || stops[0] != "testB" || stops[1] != "testA" {
+		t.Error("Adapters stopped in wrong order: ", stops)
+	}
+
+	for _, s := range m.Status() {
+		if s.Running {
+			t.Error("Adapter still running after stop: ", s.Name)
+		}
+	}
+
+	if m.Start("testA") == nil {
+		t.Error("Expected error starting adapter after stop")
+	}
+}
+
+type testPoller struct {
+	testAdapter
+	types []string
+	polls []string
+}
+
+func (a *testPoller) Poll(sampleType, id string) error {
+	for _, t := range a.types {
+		if t == sampleType {
+			a.polls = append(a.polls, sampleType+"/"+id)
+			return nil
+		}
+	}
+	return errors.New("unknown type")
+}
+
+func TestManagerPoll(t *testing.T) {
+	var stops []string
+	p := &testPoller{testAdapter: testAdapter{name: "testPoll", stops: &stops},
+		types: []string{"kwh"}}
+
+	defer Unregister("testPoll")
+	defer Unregister("testNoPoll")
+	Register("testPoll", func(env Env) (Adapter, error) { return p, nil })
+	Register("testNoPoll", func(env Env) (Adapter, error) {
+		return &testAdapter{name: "testNoPoll", stops: &stops}, nil
+	})
+
+	m := NewManager(Env{ID: "dev1"})
+	defer m.Stop()
+
+	err := m.Start("testNoPoll", "testPoll")
+	if err != nil {
+		t.Fatal("Error starting adapters: ", err)
+	}
+
+	err = m.Poll("kwh", "m1")
+	if err != nil {
+		t.Error("Error polling: ", err)
+	}
+
+	if len(p.polls) != 1 || p.polls[0] != "kwh/m1" {
+		t.Error("Wrong polls: ", p.polls)
+	}
+
+	if m.Poll("temp", "") == nil {
+		t.Error("Expected error polling a type no adapter has")
+	}
+}
+
+func TestExec(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+
+	dir, err := ioutil.TempDir("", "adapter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the script sends a sample for each config it gets, then exits after
+	// the second config to test restarts
+	script := filepath.Join(dir, "adapter.sh")
+	err = ioutil.WriteFile(script, []byte(`#!/bin/sh
+echo "starting" >&2
+n=0
+while read -r line; do
+	n=$((n+1))
+	echo '{"samples":[{"type":"config","value":'$n'}],"logs":[{"message":"got config"}]}'
+	echo 'not json'
+	if [ $n -eq 2 ]; then
+		exit 1
+	fi
+done
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delay := ExecRestartDelay
+	ExecRestartDelay = 10 * time.Millisecond
+	defer func() { ExecRestartDelay = delay }()
+
+	samples := make(chan data.Sample, 10)
+	logs := make(chan data.LogEntry, 10)
+
+	a, err := Exec(script)(Env{
+		Send: func(s []data.Sample) error {
+			for _, s := range s {
+				samples <- s
+			}
+			return nil
+		},
+		Upload: func(l []data.LogEntry) error {
+			for _, l := range l {
+				logs <- l
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal("Error creating adapter: ", err)
+	}
+
+	err = a.Start()
+	if err != nil {
+		t.Fatal("Error starting adapter: ", err)
+	}
+
+	wait := func(value float64) {
+		select {
+		case s := <-samples:
+			if s.Type != "config" || s.Value != value {
+				t.Errorf("Wrong sample, expected value %v: %+v", value, s)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for sample")
+		}
+
+		select {
+		case l := <-logs:
+			if l.Message != "got config" {
+				t.Error("Wrong log entry: ", l)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for log entry")
+		}
+	}
+
+	a.Update(data.DeviceConfig{Description: "one"})
+	wait(1)
+
+	a.Update(data.DeviceConfig{Description: "two"})
+	wait(2)
+
+	// the restarted process gets the last config
+	wait(1)
+
+	a.Stop()
+
+	_, err = Exec("")(Env{})
+	if err == nil {
+		t.Error("Expected error for blank command")
+	}
+}
@@ -0,0 +1,139 @@
+package adapter
+
+import (
+	"errors"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/system"
+)
+
+// funcAdapter is an adapter made of an update and stop function, which is
+// how the system readers and schedulers work
+type funcAdapter struct {
+	update func(data.DeviceConfig) error
+	stop   func()
+	// poll is set for adapters that can read equipment on demand
+	poll func(sampleType, id string) error
+}
+
+// errNoPoll is returned by adapters that can't poll
+var errNoPoll = errors.New("adapter can't poll")
+
+func (a *funcAdapter) Start() error {
+	return nil
+}
+
+func (a *funcAdapter) Update(config data.DeviceConfig) error {
+	return a.update(config)
+}
+
+func (a *funcAdapter) Stop() {
+	a.stop()
+}
+
+func (a *funcAdapter) Poll(sampleType, id string) error {
+	if a.poll == nil {
+		return errNoPoll
+	}
+	return a.poll(sampleType, id)
+}
+
+// builtin returns the built-in adapters
+func builtin() map[string]Factory {
+	return map[string]Factory{
+		"sensors": func(env Env) (Adapter, error) {
+			s := system.NewSensorScheduler(env.Send)
+			return &funcAdapter{
+				update: func(c data.DeviceConfig) error {
+					s.Update(c.Sensors)
+					return nil
+				},
+				stop: s.Stop,
+			}, nil
+		},
+		"oneWire": func(env Env) (Adapter, error) {
+			r := system.NewOneWireReader(env.Send)
+			return &funcAdapter{
+				update: func(c data.DeviceConfig) error {
+					r.Update(c.OneWire)
+					return nil
+				},
+				stop: r.Stop,
+			}, nil
+		},
+		"modbus": func(env Env) (Adapter, error) {
+			s := system.NewModbusScheduler(env.Send)
+			return &funcAdapter{
+				update: func(c data.DeviceConfig) error {
+					s.Update(c.Modbus)
+					return nil
+				},
+				stop: s.Stop,
+				poll: s.Poll,
+			}, nil
+		},
+		"ble": func(env Env) (Adapter, error) {
+			s := system.NewBleScanner("", env.Send)
+			return &funcAdapter{
+				update: func(c data.DeviceConfig) error {
+					s.Update(c.Ble)
+					return nil
+				},
+				stop: s.Stop,
+			}, nil
+		},
+		"opcua": func(env Env) (Adapter, error) {
+			s := system.NewOpcuaScheduler(env.Send)
+			return &funcAdapter{
+				update: func(c data.DeviceConfig) error {
+					s.Update(c.Opcua)
+					return nil
+				},
+				stop: s.Stop,
+				poll: s.Poll,
+			}, nil
+		},
+		"snmp": func(env Env) (Adapter, error) {
+			s := system.NewSnmpScheduler(env.Send)
+			return &funcAdapter{
+				update: func(c data.DeviceConfig) error {
+					s.Update(c.Snmp)
+					return nil
+				},
+				stop: s.Stop,
+			}, nil
+		},
+		"snmpTraps": func(env Env) (Adapter, error) {
+			if env.Upload == nil {
+				return nil, errors.New("snmpTraps adapter needs log upload")
+			}
+			r := system.NewSnmpTrapReceiver(env.Upload)
+			return &funcAdapter{
+				update: func(c data.DeviceConfig) error {
+					return r.Update(c.SnmpTraps)
+				},
+				stop: r.Stop,
+			}, nil
+		},
+		"dnp3": func(env Env) (Adapter, error) {
+			s := system.NewDnp3Scheduler(env.Send)
+			return &funcAdapter{
+				update: func(c data.DeviceConfig) error {
+					s.Update(c.Dnp3)
+					return nil
+				},
+				stop: s.Stop,
+			}, nil
+		},
+		"can": func(env Env) (Adapter, error) {
+			r := system.NewCanReader(env.Send)
+			return &funcAdapter{
+				update: func(c data.DeviceConfig) error {
+					r.Update(c.Can)
+					return nil
+				},
+				stop: r.Stop,
+			}, nil
+		},
+	}
+}
@@ -0,0 +1,254 @@
+package adapter
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// ExecRestartDelay is how long an exec adapter waits before it restarts a
+// process that exited
+var ExecRestartDelay = 5 * time.Second
+
+// ExecMessage is a line an exec adapter process writes to stdout
+type ExecMessage struct {
+	Samples []data.Sample   `json:"samples,omitempty"`
+	Logs    []data.LogEntry `json:"logs,omitempty"`
+}
+
+// Exec returns a factory for an adapter that runs in its own process, so
+// adapters can be written in any language. The device config is written
+// to stdin of the process as a line of JSON when it starts and each time
+// the config changes. The process writes an ExecMessage as a line of JSON
+// to stdout to send samples or log entries. Lines it writes to stderr are
+// logged. The process is restarted if it exits, until the adapter is
+// stopped.
+//
+//	adapter.Register("bacnet", adapter.Exec("/usr/bin/siot-bacnet", "-v"))
+func Exec(command string, args ...string) Factory {
+	return func(env Env) (Adapter, error) {
+		if command == "" {
+			return nil, errors.New("exec adapter command is required")
+		}
+
+		return &execAdapter{
+			env:     env,
+			command: command,
+			args:    args,
+			stop:    make(chan struct{}),
+			done:    make(chan struct{}),
+		}, nil
+	}
+}
+
+type execAdapter struct {
+	env     Env
+	command string
+	args    []string
+
+	lock   sync.Mutex
+	config []byte
+	stdin  io.WriteCloser
+	cmd    *exec.Cmd
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (a *execAdapter) Start() error {
+	cmd, output, err := a.startProcess()
+	if err != nil {
+		return err
+	}
+
+	go a.run(cmd, output)
+	return nil
+}
+
+// startProcess starts the process and writes the current config to it.
+// output is done when stdout and stderr are closed, which must happen
+// before Wait is called, or the last lines can be lost.
+func (a *execAdapter) startProcess() (cmd *exec.Cmd, output *sync.WaitGroup, err error) {
+	cmd = exec.Command(a.command, a.args...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	output = &sync.WaitGroup{}
+	output.Add(2)
+	go func() {
+		a.readStderr(stderr)
+		output.Done()
+	}()
+	go func() {
+		a.readStdout(stdout)
+		output.Done()
+	}()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.cmd = cmd
+	a.stdin = stdin
+
+	select {
+	case <-a.stop:
+		// stopped while the process was starting
+		cmd.Process.Kill()
+		return cmd, output, nil
+	default:
+	}
+
+	if a.config != nil {
+		stdin.Write(a.config)
+	}
+
+	return cmd, output, nil
+}
+
+// run waits for the process to exit and restarts it
+func (a *execAdapter) run(cmd *exec.Cmd, output *sync.WaitGroup) {
+	defer close(a.done)
+
+	for {
+		output.Wait()
+		err := cmd.Wait()
+
+		select {
+		case <-a.stop:
+			return
+		default:
+		}
+
+		adapterLog.Warn("adapter process exited", "command", a.command,
+			"error", err)
+
+		select {
+		case <-a.stop:
+			return
+		case <-time.After(ExecRestartDelay):
+		}
+
+		for {
+			cmd, output, err = a.startProcess()
+			if err == nil {
+				break
+			}
+
+			adapterLog.Error("error restarting adapter process",
+				"command", a.command, "error", err)
+
+			select {
+			case <-a.stop:
+				return
+			case <-time.After(ExecRestartDelay):
+			}
+		}
+	}
+}
+
+func (a *execAdapter) readStdout(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		var msg ExecMessage
+		err := json.Unmarshal(scanner.Bytes(), &msg)
+		if err != nil {
+			adapterLog.Warn("invalid message from adapter process",
+				"command", a.command, "error", err)
+			continue
+		}
+
+		if len(msg.Samples) > 0 {
+			err := a.env.Send(msg.Samples)
+			if err != nil {
+				adapterLog.Error("error sending samples", "command", a.command,
+					"error", err)
+			}
+		}
+
+		if len(msg.Logs) > 0 {
+			if a.env.Upload == nil {
+				adapterLog.Warn("log upload is not available, dropping logs",
+					"command", a.command)
+				continue
+			}
+
+			err := a.env.Upload(msg.Logs)
+			if err != nil {
+				adapterLog.Error("error uploading logs", "command", a.command,
+					"error", err)
+			}
+		}
+	}
+}
+
+func (a *execAdapter) readStderr(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		adapterLog.Info(scanner.Text(), "command", a.command)
+	}
+}
+
+func (a *execAdapter) Update(config data.DeviceConfig) error {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.config = b
+	if a.stdin == nil {
+		return nil
+	}
+
+	// if the process has exited, it gets the config when it restarts
+	_, err = a.stdin.Write(b)
+	if err != nil {
+		adapterLog.Debug("error writing config to adapter process",
+			"command", a.command, "error", err)
+	}
+	return nil
+}
+
+func (a *execAdapter) Stop() {
+	close(a.stop)
+
+	a.lock.Lock()
+	if a.stdin != nil {
+		a.stdin.Close()
+	}
+	if a.cmd != nil && a.cmd.Process != nil {
+		a.cmd.Process.Kill()
+	}
+	a.lock.Unlock()
+
+	<-a.done
+}
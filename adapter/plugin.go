@@ -0,0 +1,51 @@
+package adapter
+
+import (
+	"fmt"
+	"plugin"
+)
+
+// LoadPlugin loads an adapter from a Go plugin built with
+// -buildmode=plugin, and registers it. The name it is registered with is
+// returned. The plugin must export the name and a factory:
+//
+//	var Name = "bacnet"
+//
+//	func New(env adapter.Env) (adapter.Adapter, error)
+//
+// Plugins must be built with the same Go version and package versions as
+// the application.
+func LoadPlugin(path string) (string, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	sym, err := p.Lookup("Name")
+	if err != nil {
+		return "", err
+	}
+
+	name, ok := sym.(*string)
+	if !ok {
+		return "", fmt.Errorf("plugin %v: Name is %T, not string", path, sym)
+	}
+
+	sym, err = p.Lookup("New")
+	if err != nil {
+		return "", err
+	}
+
+	f, ok := sym.(func(Env) (Adapter, error))
+	if !ok {
+		return "", fmt.Errorf("plugin %v: New is %T, not func(adapter.Env) (adapter.Adapter, error)",
+			path, sym)
+	}
+
+	err = Register(*name, f)
+	if err != nil {
+		return "", err
+	}
+
+	return *name, nil
+}
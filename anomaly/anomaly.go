@@ -0,0 +1,384 @@
+// Package anomaly detects values of sample streams that deviate from the
+// baseline learned from the history of each point, which catches sensor
+// failures and process excursions that fixed rule thresholds miss.
+//
+// The baseline of a point is an exponentially weighted mean and standard
+// deviation of its values. With the rolling method there is one baseline
+// for each point, and with the seasonal method there is one for each hour
+// of the day, so daily cycles are not reported. A value is anomalous when
+// it is more than Threshold standard deviations from the mean. An anomaly
+// is recorded in the db and notified when the values of a point start
+// deviating, and is ended and notified again when they return to the
+// baseline. All values are learned, so a lasting change in a point
+// becomes the new baseline.
+package anomaly
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/logging"
+)
+
+var anomalyLog = logging.Module("anomaly")
+
+// Config describes how anomalies are detected
+type Config struct {
+	// Method is data.AnomalyRolling (the default) or data.AnomalySeasonal
+	Method string
+	// Window is about how many values the baseline is learned from
+	// (default 100). With the seasonal method, it is the number of values
+	// of each hour of the day.
+	Window int
+	// Threshold is how many standard deviations from the mean a value
+	// must be to be anomalous (default 4)
+	Threshold float64
+	// Warmup is how many values of a baseline are learned before values
+	// are checked against it (default 30)
+	Warmup int
+	// History is how far back the sample history of a device is read to
+	// learn its baselines when the detector sees it for the first time
+	// (default 24h, or 7 days with the seasonal method)
+	History time.Duration
+	// Types are the sample types that are checked. All types are checked
+	// if empty.
+	Types []string
+	// Location is the time zone of the hours of seasonal baselines (default
+	// UTC)
+	Location *time.Location
+	// Notify sends notifications. Notifications are logged if it is nil.
+	Notify func(n data.Notification) error
+}
+
+// stats is an exponentially weighted mean and variance
+type stats struct {
+	count    int
+	mean     float64
+	variance float64
+}
+
+// add learns a value. Until a window of values has been learned, the
+// weight of each value is 1/count, which gives the plain mean and
+// variance of the values so far.
+func (s *stats) add(v float64, window int) {
+	s.count++
+
+	alpha := 2 / float64(window+1)
+	if w := 1 / float64(s.count); w > alpha {
+		alpha = w
+	}
+
+	d := v - s.mean
+	incr := alpha * d
+	s.mean += incr
+	s.variance = (1 - alpha) * (s.variance + d*incr)
+}
+
+// stdDev returns the standard deviation. It is at least a millionth of the
+// mean, so a point that never changed is anomalous when it changes
+// without the score being infinite.
+func (s *stats) stdDev() float64 {
+	min := 1e-6 * math.Max(1, math.Abs(s.mean))
+	return math.Max(math.Sqrt(s.variance), min)
+}
+
+// point is the state of a point of a device
+type point struct {
+	baselines []stats
+	// active is the active anomaly of the point, if any
+	active *data.Anomaly
+}
+
+func pointKey(deviceID, typ, id string) string {
+	return deviceID + "/" + typ + "/" + id
+}
+
+// Detector checks the samples written to the db for anomalies
+type Detector struct {
+	db     *db.Db
+	config Config
+	lock   sync.Mutex
+	points map[string]*point
+	// learned are the devices whose history was learned
+	learned map[string]bool
+	events  <-chan db.Event
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewDetector creates an anomaly detector. Start starts checking samples.
+func NewDetector(dbInst *db.Db, config Config) *Detector {
+	if config.Method == "" {
+		config.Method = data.AnomalyRolling
+	}
+
+	if config.Window == 0 {
+		config.Window = 100
+	}
+
+	if config.Threshold == 0 {
+		config.Threshold = 4
+	}
+
+	if config.Warmup == 0 {
+		config.Warmup = 30
+	}
+
+	if config.History == 0 {
+		config.History = 24 * time.Hour
+		if config.Method == data.AnomalySeasonal {
+			config.History = 7 * 24 * time.Hour
+		}
+	}
+
+	if config.Location == nil {
+		config.Location = time.UTC
+	}
+
+	return &Detector{
+		db:      dbInst,
+		config:  config,
+		points:  make(map[string]*point),
+		learned: make(map[string]bool),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Start loads the active anomalies and checks samples as they are written
+func (d *Detector) Start() error {
+	err := data.ValidateAnomalyMethod(d.config.Method)
+	if err != nil {
+		return err
+	}
+
+	d.events = d.db.Subscribe(db.EventFilter{
+		Types: []db.EventType{db.EventSampleWritten, db.EventDeviceDeleted},
+	})
+
+	err = d.load()
+	if err != nil {
+		d.db.Unsubscribe(d.events)
+		return err
+	}
+
+	go d.run()
+
+	return nil
+}
+
+// Stop stops checking samples
+func (d *Detector) Stop() {
+	close(d.stop)
+	<-d.done
+	d.db.Unsubscribe(d.events)
+}
+
+// load reads the active anomalies from the db, so anomalies that were
+// active when the detector last ran are ended
+func (d *Detector) load() error {
+	active, err := d.db.Anomalies("", true)
+	if err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, a := range active {
+		a := a
+		d.pointLocked(pointKey(a.DeviceID, a.Type, a.SampleID)).active = &a
+	}
+
+	return nil
+}
+
+func (d *Detector) run() {
+	defer close(d.done)
+
+	for {
+		select {
+		case ev, ok := <-d.events:
+			if !ok {
+				return
+			}
+
+			if ev.Type == db.EventDeviceDeleted {
+				d.forget(ev.DeviceID)
+			} else if ev.Sample != nil {
+				err := d.Check(ev.DeviceID, *ev.Sample)
+				if err != nil {
+					anomalyLog.Error("error checking sample", "device", ev.DeviceID,
+						"type", ev.Sample.Type, "error", err)
+				}
+			}
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// forget discards the baselines of a device
+func (d *Detector) forget(deviceID string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	prefix := deviceID + "/"
+	for k := range d.points {
+		if len(k) > len(prefix) && k[:len(prefix)] == prefix {
+			delete(d.points, k)
+		}
+	}
+	delete(d.learned, deviceID)
+}
+
+// checked returns true if samples of a type are checked
+func (d *Detector) checked(typ string) bool {
+	if len(d.config.Types) <= 0 {
+		return true
+	}
+
+	for _, t := range d.config.Types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Detector) pointLocked(key string) *point {
+	p, ok := d.points[key]
+	if !ok {
+		n := 1
+		if d.config.Method == data.AnomalySeasonal {
+			n = 24
+		}
+		p = &point{baselines: make([]stats, n)}
+		d.points[key] = p
+	}
+	return p
+}
+
+// baseline returns the baseline of a point for a time
+func (d *Detector) baseline(p *point, t time.Time) *stats {
+	if len(p.baselines) == 1 {
+		return &p.baselines[0]
+	}
+	return &p.baselines[t.In(d.config.Location).Hour()]
+}
+
+// learn learns the baselines of a device from its sample history before t
+func (d *Detector) learn(deviceID string, t time.Time) error {
+	samples, err := d.db.SampleHistory(deviceID, t.Add(-d.config.History), t,
+		db.ResolutionRaw)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range samples {
+		if !s.Time.Before(t) || !d.checked(s.Type) || math.IsNaN(s.Value) {
+			continue
+		}
+
+		p := d.pointLocked(pointKey(deviceID, s.Type, s.ID))
+		d.baseline(p, s.Time).add(s.Value, d.config.Window)
+	}
+
+	return nil
+}
+
+// Check checks a sample of a device against the baseline of its point,
+// starts or ends an anomaly of the point, and learns the sample
+func (d *Detector) Check(deviceID string, s data.Sample) error {
+	if !d.checked(s.Type) || math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+		return nil
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if !d.learned[deviceID] {
+		d.learned[deviceID] = true
+		err := d.learn(deviceID, s.Time)
+		if err != nil {
+			return err
+		}
+	}
+
+	p := d.pointLocked(pointKey(deviceID, s.Type, s.ID))
+	b := d.baseline(p, s.Time)
+	defer b.add(s.Value, d.config.Window)
+
+	if b.count < d.config.Warmup {
+		return nil
+	}
+
+	sd := b.stdDev()
+	score := math.Abs(s.Value-b.mean) / sd
+	deviates := score > d.config.Threshold
+
+	switch {
+	case deviates && p.active == nil:
+		a, err := d.db.AnomalyStart(data.Anomaly{
+			DeviceID: deviceID,
+			Type:     s.Type,
+			SampleID: s.ID,
+			Value:    s.Value,
+			Mean:     b.mean,
+			StdDev:   sd,
+			Score:    score,
+			Start:    s.Time,
+		})
+		if err != nil {
+			return err
+		}
+		p.active = &a
+
+		return d.notify(a, true, s.Value)
+	case !deviates && p.active != nil:
+		a := *p.active
+		a.End = s.Time
+		err := d.db.AnomalyEnd(a.ID, s.Time)
+		if err != nil {
+			return err
+		}
+		p.active = nil
+
+		return d.notify(a, false, s.Value)
+	}
+
+	return nil
+}
+
+func (d *Detector) notify(a data.Anomaly, active bool, value float64) error {
+	var msg string
+	if active {
+		msg = fmt.Sprintf("%v of %v is anomalous: %v is %.1f standard deviations "+
+			"from the mean of %.4g", a.Point(), a.DeviceID, value, a.Score, a.Mean)
+	} else {
+		msg = fmt.Sprintf("%v of %v returned to normal: %v", a.Point(),
+			a.DeviceID, value)
+	}
+
+	n := data.Notification{
+		Description: fmt.Sprintf("%v anomaly", a.Point()),
+		DeviceID:    a.DeviceID,
+		Message:     msg,
+		Active:      active,
+		Time:        a.Start,
+	}
+	if !active {
+		n.Time = a.End
+	}
+
+	if d.config.Notify == nil {
+		anomalyLog.Info(msg)
+		return nil
+	}
+
+	return d.config.Notify(n)
+}
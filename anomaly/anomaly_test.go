@@ -0,0 +1,216 @@
+package anomaly
+
+import (
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db/dbtest"
+)
+
+var start = time.Date(2020, 3, 10, 0, 0, 0, 0, time.UTC)
+
+// normal returns a value that varies a little around 20
+func normal(i int) float64 {
+	return 19.5 + float64(i%3)*0.5
+}
+
+func TestStats(t *testing.T) {
+	var s stats
+	for _, v := range []float64{2, 4, 4, 4, 5, 5, 7, 9} {
+		s.add(v, 100)
+	}
+
+	if s.mean != 5 || s.variance < 3.999 || s.variance > 4.001 {
+		t.Errorf("Wrong stats: %+v", s)
+	}
+}
+
+func TestRolling(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	notifications := make(chan data.Notification, 10)
+	d := NewDetector(dbInst, Config{
+		Warmup: 10,
+		Notify: func(n data.Notification) error {
+			notifications <- n
+			return nil
+		},
+	})
+
+	check := func(i int, v float64) {
+		err := d.Check("dev1", data.Sample{Type: "temp", ID: "in", Value: v,
+			Time: start.Add(time.Duration(i) * time.Minute)})
+		if err != nil {
+			t.Fatal("Error checking sample: ", err)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		check(i, normal(i))
+	}
+
+	if len(notifications) != 0 {
+		t.Fatal("Normal values are anomalous")
+	}
+
+	check(50, 40)
+	check(51, 41)
+
+	if len(notifications) != 1 {
+		t.Fatal("Wrong number of notifications: ", len(notifications))
+	}
+
+	n := <-notifications
+	if !n.Active || n.DeviceID != "dev1" || n.Description != "temp.in anomaly" {
+		t.Errorf("Wrong notification: %+v", n)
+	}
+
+	active, err := dbInst.Anomalies("dev1", true)
+	if err != nil {
+		t.Fatal("Error getting anomalies: ", err)
+	}
+
+	if len(active) != 1 || active[0].Value != 40 || active[0].Score < 4 ||
+		active[0].Type != "temp" || active[0].SampleID != "in" {
+		t.Fatalf("Wrong anomalies: %+v", active)
+	}
+
+	check(52, 20)
+
+	n = <-notifications
+	if n.Active {
+		t.Errorf("Wrong notification: %+v", n)
+	}
+
+	all, _ := dbInst.Anomalies("", false)
+	if len(all) != 1 || all[0].Active() || !all[0].End.Equal(start.Add(52*time.Minute)) {
+		t.Errorf("Anomaly was not ended: %+v", all)
+	}
+
+	// other types are not checked
+	d.config.Types = []string{"flow"}
+	check(53, 100)
+	if len(notifications) != 0 {
+		t.Error("Unchecked type is anomalous")
+	}
+}
+
+func TestSeasonal(t *testing.T) {
+	for _, method := range []string{data.AnomalyRolling, data.AnomalySeasonal} {
+		dbInst, cleanup := dbtest.New(t)
+
+		d := NewDetector(dbInst, Config{Method: method, Warmup: 3})
+
+		// the value is higher every day from 12:00 to 13:00
+		for i := 0; i < 7*24*4; i++ {
+			tm := start.Add(time.Duration(i) * 15 * time.Minute)
+			v := normal(i)
+			if tm.Hour() == 12 {
+				v += 30
+			}
+
+			err := d.Check("dev1", data.Sample{Type: "temp", Value: v, Time: tm})
+			if err != nil {
+				t.Fatal("Error checking sample: ", err)
+			}
+		}
+
+		all, _ := dbInst.Anomalies("dev1", false)
+		if method == data.AnomalySeasonal && len(all) != 0 {
+			t.Errorf("Daily cycle is anomalous: %+v", all)
+		} else if method == data.AnomalyRolling && len(all) == 0 {
+			t.Error("Daily cycle is not anomalous without seasons")
+		}
+
+		cleanup()
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	for i := 0; i < 50; i++ {
+		err := dbInst.DeviceSample("dev1", data.Sample{Type: "temp", Value: normal(i),
+			Time: start.Add(time.Duration(i) * time.Minute)})
+		if err != nil {
+			t.Fatal("Error writing sample: ", err)
+		}
+	}
+
+	// an anomaly that was active when the detector last ran
+	old, err := dbInst.AnomalyStart(data.Anomaly{DeviceID: "dev1", Type: "temp",
+		Start: start})
+	if err != nil {
+		t.Fatal("Error starting anomaly: ", err)
+	}
+
+	d := NewDetector(dbInst, Config{Warmup: 10})
+	err = d.load()
+	if err != nil {
+		t.Fatal("Error loading anomalies: ", err)
+	}
+
+	// the baseline is learned from the history, so the old anomaly ends
+	// with the first normal value, and the next value is anomalous
+	err = d.Check("dev1", data.Sample{Type: "temp", Value: 20, Time: start.Add(time.Hour)})
+	if err != nil {
+		t.Fatal("Error checking sample: ", err)
+	}
+
+	err = d.Check("dev1", data.Sample{Type: "temp", Value: 50,
+		Time: start.Add(time.Hour + time.Minute)})
+	if err != nil {
+		t.Fatal("Error checking sample: ", err)
+	}
+
+	all, _ := dbInst.Anomalies("dev1", false)
+	if len(all) != 2 || all[1].ID != old.ID || all[1].Active() || !all[0].Active() {
+		t.Errorf("Wrong anomalies: %+v", all)
+	}
+}
+
+func TestDetector(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	notifications := make(chan data.Notification, 10)
+	d := NewDetector(dbInst, Config{
+		Warmup: 10,
+		Notify: func(n data.Notification) error {
+			notifications <- n
+			return nil
+		},
+	})
+
+	err := d.Start()
+	if err != nil {
+		t.Fatal("Error starting detector: ", err)
+	}
+	defer d.Stop()
+
+	for i := 0; i < 30; i++ {
+		err := dbInst.DeviceSample("dev1", data.Sample{Type: "temp", Value: normal(i),
+			Time: start.Add(time.Duration(i) * time.Minute)})
+		if err != nil {
+			t.Fatal("Error writing sample: ", err)
+		}
+	}
+
+	err = dbInst.DeviceSample("dev1", data.Sample{Type: "temp", Value: -10,
+		Time: start.Add(time.Hour)})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	select {
+	case n := <-notifications:
+		if !n.Active {
+			t.Errorf("Wrong notification: %+v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for anomaly")
+	}
+}
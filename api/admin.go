@@ -0,0 +1,511 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/logging"
+	"github.com/simpleiot/simpleiot/tunnel"
+	"github.com/timshannon/bolthold"
+)
+
+// Admin handles administrative requests. All admin requests must include
+// an "Authorization: Bearer <token>" header that matches the admin token,
+// or with local auth, the session token of an admin user. If neither is
+// configured, the admin API is disabled.
+type Admin struct {
+	db      *db.Db
+	influx  *db.Influx
+	ingest  *db.IngestQueue
+	token   string
+	tunnels *tunnel.Hub
+	tenants *db.Tenants
+	// sessionTTL is set if local auth is enabled
+	sessionTTL time.Duration
+}
+
+// adminTokenUser is the user recorded for requests authorized with the
+// admin token
+const adminTokenUser = "adminToken"
+
+// adminUser returns who sent an admin request: the name of an admin user,
+// or adminTokenUser. ok is false if the request is not authorized.
+func (h *Admin) adminUser(req *http.Request) (user string, ok bool) {
+	token := bearerToken(req)
+	if token == "" {
+		return "", false
+	}
+
+	if data.TokenEqual(token, h.token) {
+		return adminTokenUser, true
+	}
+
+	if h.sessionTTL <= 0 {
+		return "", false
+	}
+
+	u, _, err := h.db.SessionAuth(token, h.sessionTTL)
+	if err != nil || u.Role != data.UserRoleAdmin {
+		return "", false
+	}
+
+	return u.Username, true
+}
+
+func (h *Admin) backup(res http.ResponseWriter, req *http.Request) {
+	// the size is set from the same transaction the backup is written
+	// from, so it matches even if the db changes
+	started := false
+	err := h.db.BackupTo(res, func(size int64) {
+		started = true
+		res.Header().Set("Content-Type", "application/octet-stream")
+		res.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		res.Header().Set("Content-Disposition",
+			fmt.Sprintf(`attachment; filename="siot-backup-%v.db"`,
+				time.Now().UTC().Format("20060102T150405Z")))
+	})
+
+	if err != nil {
+		if !started {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// headers have already been sent, so all we can do is log it
+		fmt.Println("Error writing backup: ", err)
+	}
+}
+
+func (h *Admin) restore(res http.ResponseWriter, req *http.Request) {
+	err := h.db.Restore(req.Body)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(data.StandardResponse{Success: true})
+}
+
+func (h *Admin) export(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="siot-export-%v.json"`,
+			time.Now().UTC().Format("20060102T150405Z")))
+
+	err := h.db.Export(res)
+	if err != nil {
+		fmt.Println("Error writing export: ", err)
+	}
+}
+
+func (h *Admin) importArchive(res http.ResponseWriter, req *http.Request) {
+	conflict, err := db.ParseImportConflict(req.URL.Query().Get("conflict"))
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.Import(req.Body, conflict)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, db.ErrImportConflict) {
+			status = http.StatusConflict
+		}
+		http.Error(res, err.Error(), status)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(result)
+}
+
+// compactResponse is returned by the compact endpoint
+type compactResponse struct {
+	Fragmentation float64          `json:"fragmentation"`
+	Status        db.CompactStatus `json:"status"`
+}
+
+func (h *Admin) compactStatus(res http.ResponseWriter, req *http.Request) {
+	frag, err := h.db.Fragmentation()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(compactResponse{
+		Fragmentation: frag,
+		Status:        h.db.CompactStatus(),
+	})
+}
+
+func (h *Admin) compact(res http.ResponseWriter, req *http.Request) {
+	if h.db.CompactStatus().Running {
+		http.Error(res, db.ErrCompactRunning.Error(), http.StatusConflict)
+		return
+	}
+
+	// compaction can take a while, so run it in the background. Progress
+	// can be monitored with GET /admin/compact.
+	go func() {
+		err := h.db.Compact()
+		if err != nil {
+			fmt.Println("Error compacting db: ", err)
+		}
+	}()
+
+	res.WriteHeader(http.StatusAccepted)
+	en := json.NewEncoder(res)
+	en.Encode(data.StandardResponse{Success: true})
+}
+
+func (h *Admin) integrity(res http.ResponseWriter, req *http.Request) {
+	action := db.IntegrityCheck
+	if req.Method == http.MethodPost {
+		var err error
+		action, err = db.ParseIntegrityAction(req.URL.Query().Get("action"))
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := h.db.CheckIntegrity(action)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if result.Issues == nil {
+		result.Issues = []db.IntegrityIssue{}
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(result)
+}
+
+// keys handles /admin/keys/<device id>[/<key id>|/rotate]
+func (h *Admin) keys(res http.ResponseWriter, req *http.Request) {
+	var id, keyID string
+	id, req.URL.Path = ShiftPath(req.URL.Path)
+	keyID, _ = ShiftPath(req.URL.Path)
+
+	if id == "" {
+		http.Error(res, "device id is required", http.StatusBadRequest)
+		return
+	}
+
+	en := json.NewEncoder(res)
+
+	switch {
+	case keyID == "" && req.Method == http.MethodGet:
+		keys, err := h.db.DeviceKeys(id)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now()
+		ret := []data.KeyStatus{}
+		for _, k := range keys {
+			ret = append(ret, h.db.KeyStatus(k, now))
+		}
+
+		en.Encode(ret)
+	case keyID == "" && req.Method == http.MethodPost:
+		key, k, err := h.db.DeviceKeyCreate(id)
+		if err == bolthold.ErrNotFound {
+			http.Error(res, "device not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en.Encode(data.KeyResponse{DeviceKey: k, Key: key})
+	case keyID == "rotate" && req.Method == http.MethodPost:
+		overlap := h.db.KeyOverlap()
+		if o := req.URL.Query().Get("overlap"); o != "" {
+			var err error
+			overlap, err = time.ParseDuration(o)
+			if err != nil || overlap < 0 {
+				http.Error(res, "invalid overlap", http.StatusBadRequest)
+				return
+			}
+		}
+
+		err := h.db.DeviceKeysRotate(id, overlap)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en.Encode(data.StandardResponse{Success: true, ID: id})
+	case keyID != "" && req.Method == http.MethodDelete:
+		kid, err := strconv.ParseUint(keyID, 10, 64)
+		if err != nil {
+			http.Error(res, "invalid key id", http.StatusBadRequest)
+			return
+		}
+
+		err = h.db.DeviceKeyRevoke(kid)
+		if err == bolthold.ErrNotFound {
+			http.Error(res, "key not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en.Encode(data.StandardResponse{Success: true})
+	default:
+		http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+	}
+}
+
+// claimRequest is the body of a claim
+type claimRequest struct {
+	Code string `json:"code"`
+}
+
+// registrations handles /admin/registrations[/<device id>[/claim]]
+func (h *Admin) registrations(res http.ResponseWriter, req *http.Request) {
+	var id, op string
+	id, req.URL.Path = ShiftPath(req.URL.Path)
+	op, _ = ShiftPath(req.URL.Path)
+
+	en := json.NewEncoder(res)
+
+	switch {
+	case id == "" && req.Method == http.MethodGet:
+		regs, err := h.db.Registrations()
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if regs == nil {
+			regs = []data.Registration{}
+		}
+
+		en.Encode(regs)
+	case id != "" && op == "claim" && req.Method == http.MethodPost:
+		var c claimRequest
+		err := json.NewDecoder(req.Body).Decode(&c)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = h.db.RegistrationClaim(id, c.Code)
+		switch {
+		case err == bolthold.ErrNotFound:
+			http.Error(res, "registration not found", http.StatusNotFound)
+			return
+		case err == db.ErrInvalidCode:
+			http.Error(res, err.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en.Encode(data.StandardResponse{Success: true, ID: id})
+	case id != "" && op == "" && req.Method == http.MethodDelete:
+		err := h.db.RegistrationDelete(id)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en.Encode(data.StandardResponse{Success: true, ID: id})
+	default:
+		http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+	}
+}
+
+// usageResponse is returned by the usage endpoint
+type usageResponse struct {
+	db.UsageReport
+	Limits db.UsageLimits `json:"limits"`
+}
+
+func (h *Admin) usage(res http.ResponseWriter, req *http.Request) {
+	en := json.NewEncoder(res)
+	en.Encode(usageResponse{
+		UsageReport: h.db.Usage(),
+		Limits:      h.db.UsageLimits(),
+	})
+}
+
+// metricsResponse is returned by the metrics endpoint
+type metricsResponse struct {
+	Db     map[string]db.OpStats `json:"db"`
+	Influx map[string]db.OpStats `json:"influx,omitempty"`
+	// Duplicates is the number of duplicate samples that were dropped
+	Duplicates uint64 `json:"duplicates"`
+	// BusDropped is the number of event bus messages that were dropped
+	// because subscribers fell behind
+	BusDropped uint64 `json:"busDropped"`
+	// Ingest is set if the ingest queue is enabled
+	Ingest *db.IngestStats `json:"ingest,omitempty"`
+}
+
+func (h *Admin) metrics(res http.ResponseWriter, req *http.Request) {
+	ret := metricsResponse{
+		Db:         h.db.Metrics().Snapshot(),
+		Duplicates: h.db.Duplicates(),
+	}
+
+	if h.influx != nil {
+		ret.Influx = h.influx.Metrics().Snapshot()
+	}
+
+	if b := h.db.Bus(); b != nil {
+		ret.BusDropped = b.Dropped()
+	}
+
+	if h.ingest != nil {
+		stats := h.ingest.Stats()
+		ret.Ingest = &stats
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(ret)
+}
+
+// logSettings returns or changes the log settings, like to log one module
+// at debug level while troubleshooting it
+func (h *Admin) logSettings(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		var s logging.Settings
+		err := json.NewDecoder(req.Body).Decode(&s)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = logging.Apply(s)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(logging.Current())
+}
+
+// Top level handler for http requests to the admin API
+func (h *Admin) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if h.token == "" && h.sessionTTL <= 0 {
+		http.Error(res, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	user, ok := h.adminUser(req)
+	if !ok {
+		http.Error(res, "not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	var head string
+	head, req.URL.Path = ShiftPath(req.URL.Path)
+
+	switch head {
+	case "backup":
+		if req.Method == http.MethodGet {
+			h.backup(res, req)
+		} else {
+			http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+		}
+	case "compact":
+		switch req.Method {
+		case http.MethodGet:
+			h.compactStatus(res, req)
+		case http.MethodPost:
+			h.compact(res, req)
+		default:
+			http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+		}
+	case "export":
+		if req.Method == http.MethodGet {
+			h.export(res, req)
+		} else {
+			http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+		}
+	case "import":
+		if req.Method == http.MethodPost {
+			h.importArchive(res, req)
+		} else {
+			http.Error(res, "only POST allowed", http.StatusMethodNotAllowed)
+		}
+	case "integrity":
+		switch req.Method {
+		case http.MethodGet, http.MethodPost:
+			h.integrity(res, req)
+		default:
+			http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+		}
+	case "keys":
+		h.keys(res, req)
+	case "log":
+		h.logSettings(res, req)
+	case "metrics":
+		if req.Method == http.MethodGet {
+			h.metrics(res, req)
+		} else {
+			http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+		}
+	case "certs":
+		h.certRequests(res, req)
+	case "registrations":
+		h.registrations(res, req)
+	case "tenants":
+		h.tenantRequests(res, req)
+	case "tunnels":
+		h.tunnelSessions(res, req, user)
+	case "users":
+		h.userRequests(res, req)
+	case "usage":
+		if req.Method == http.MethodGet {
+			h.usage(res, req)
+		} else {
+			http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+		}
+	case "restore":
+		if req.Method == http.MethodPost {
+			h.restore(res, req)
+		} else {
+			http.Error(res, "only POST allowed", http.StatusMethodNotAllowed)
+		}
+	default:
+		http.Error(res, "Not Found", http.StatusNotFound)
+	}
+}
+
+// NewAdminHandler returns a new admin handler. If token is blank, the admin
+// API is only available to admin users, and it is disabled if local auth
+// is disabled too. sessionTTL is the session TTL of local auth, or 0 if it
+// is disabled. Tunnels are disabled if tunnels is nil, and tenants are
+// disabled if tenants is nil. ingest is optional, its stats are included in
+// the metrics if set.
+func NewAdminHandler(db *db.Db, influx *db.Influx, ingest *db.IngestQueue, token string,
+	tunnels *tunnel.Hub, tenants *db.Tenants, sessionTTL time.Duration) http.Handler {
+	return &Admin{db: db, influx: influx, ingest: ingest, token: token, tunnels: tunnels,
+		tenants: tenants, sessionTTL: sessionTTL}
+}
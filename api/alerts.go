@@ -0,0 +1,123 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/timshannon/bolthold"
+)
+
+// Alerts handles alert requests
+type Alerts struct {
+	db *db.Db
+}
+
+// alertAck is the optional body of an acknowledgment
+type alertAck struct {
+	By string `json:"by"`
+}
+
+func (h *Alerts) processList(res http.ResponseWriter, req *http.Request) {
+	state := req.URL.Query().Get("state")
+	if state != "" {
+		err := data.ValidateAlertState(state)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	alerts, err := h.db.Alerts(state)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if alerts == nil {
+		alerts = []data.Alert{}
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(alerts)
+}
+
+func (h *Alerts) processAck(res http.ResponseWriter, req *http.Request, id uint64) {
+	var ack alertAck
+	err := json.NewDecoder(req.Body).Decode(&ack)
+	if err != nil && err != io.EOF {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	alert, err := h.db.AlertAck(id, ack.By)
+	switch {
+	case err == bolthold.ErrNotFound:
+		http.Error(res, "alert not found", http.StatusNotFound)
+		return
+	case err == db.ErrAlertCleared:
+		http.Error(res, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(alert)
+}
+
+// Top level handler for http requests to /v1/alerts[/<id>[/ack]]
+func (h *Alerts) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && h.db.ReadOnly() {
+		http.Error(res, db.ErrReadOnly.Error(), http.StatusForbidden)
+		return
+	}
+
+	var idStr string
+	idStr, req.URL.Path = ShiftPath(req.URL.Path)
+
+	if idStr == "" {
+		if req.Method != http.MethodGet {
+			http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+			return
+		}
+		h.processList(res, req)
+		return
+	}
+
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		http.Error(res, "invalid alert id", http.StatusBadRequest)
+		return
+	}
+
+	var head string
+	head, req.URL.Path = ShiftPath(req.URL.Path)
+
+	switch {
+	case head == "" && req.Method == http.MethodGet:
+		alert, err := h.db.Alert(id)
+		if err != nil {
+			http.Error(res, "alert not found", http.StatusNotFound)
+			return
+		}
+
+		en := json.NewEncoder(res)
+		en.Encode(alert)
+	case head == "ack" && req.Method == http.MethodPost:
+		h.processAck(res, req, id)
+	case head == "" || head == "ack":
+		http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+	default:
+		http.Error(res, "Not Found", http.StatusNotFound)
+	}
+}
+
+// NewAlertsHandler returns a new alerts handler
+func NewAlertsHandler(db *db.Db) http.Handler {
+	return &Alerts{db: db}
+}
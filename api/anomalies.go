@@ -0,0 +1,49 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+// Anomalies handles requests for the anomalies found by anomaly detection
+type Anomalies struct {
+	db *db.Db
+}
+
+// Top level handler for http requests to
+// /v1/anomalies[?device=<id>][&active=true]
+func (h *Anomalies) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var head string
+	head, req.URL.Path = ShiftPath(req.URL.Path)
+	if head != "" {
+		http.Error(res, "not found", http.StatusNotFound)
+		return
+	}
+
+	query := req.URL.Query()
+	anomalies, err := h.db.Anomalies(query.Get("device"), query.Get("active") == "true")
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if anomalies == nil {
+		anomalies = []data.Anomaly{}
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(anomalies)
+}
+
+// NewAnomaliesHandler returns a new anomalies handler
+func NewAnomaliesHandler(db *db.Db) http.Handler {
+	return &Anomalies{db: db}
+}
@@ -0,0 +1,504 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/oidc"
+	"github.com/timshannon/bolthold"
+)
+
+// passwordResetTTL is how long a password reset token is valid
+const passwordResetTTL = time.Hour
+
+// oidcLoginTTL is how long a user has to log in at the identity provider,
+// and maxOIDCLogins limits the logins in progress
+const (
+	oidcLoginTTL  = 10 * time.Minute
+	maxOIDCLogins = 10000
+)
+
+// Auth requires v1 API requests to be authenticated with an
+// "Authorization: Bearer <token>" header. The token can be the session
+// token of a local user, the admin token, or a device key, which can only
+// access the device's own /v1/devices/<id> endpoints. Viewers can only
+// make GET requests. Users log in and out at /v1/auth, with a password or
+// an OpenID Connect provider.
+type Auth struct {
+	db     *db.Db
+	token  string
+	ttl    time.Duration
+	maxAge time.Duration
+	oidc   *oidc.Provider
+	v1     http.Handler
+
+	lock sync.Mutex
+	// logins are the OIDC logins in progress by state
+	logins map[string]oidcLogin
+}
+
+// oidcLogin is an OIDC login in progress
+type oidcLogin struct {
+	oidc.Login
+	expires time.Time
+}
+
+// NewAuthHandler returns a new auth handler that serves authenticated
+// requests with v1. Sessions expire after ttl if not used, and after
+// maxAge in any case. OIDC logins are disabled if provider is nil.
+func NewAuthHandler(dbInst *db.Db, token string, ttl, maxAge time.Duration,
+	provider *oidc.Provider, v1 http.Handler) http.Handler {
+	return &Auth{db: dbInst, token: token, ttl: ttl, maxAge: maxAge,
+		oidc: provider, v1: v1, logins: make(map[string]oidcLogin)}
+}
+
+// bearerToken returns the bearer token of a request
+func bearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+
+	return strings.TrimPrefix(auth, "Bearer ")
+}
+
+func (h *Auth) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	head, tail := ShiftPath(req.URL.Path)
+	switch head {
+	case "auth":
+		req.URL.Path = tail
+		h.auth(res, req)
+		return
+	case "register", "lorawan", "particle":
+		// devices register with a claim code, and LoRaWAN and Particle
+		// webhooks authenticate with their own token
+		h.v1.ServeHTTP(res, req)
+		return
+	}
+
+	token := bearerToken(req)
+	if token == "" {
+		http.Error(res, "not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	if data.TokenEqual(token, h.token) {
+		h.v1.ServeHTTP(res, req)
+		return
+	}
+
+	user, _, err := h.db.SessionAuth(token, h.ttl)
+	switch err {
+	case nil:
+		if req.Method != http.MethodGet && !user.CanWrite() {
+			http.Error(res, "read only user", http.StatusForbidden)
+			return
+		}
+
+		h.v1.ServeHTTP(res, req)
+		return
+	case db.ErrInvalidToken:
+	default:
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, err := h.db.DeviceKeyAuth(token)
+	if err == db.ErrInvalidKey {
+		http.Error(res, "not authorized", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	devices, tail := ShiftPath(req.URL.Path)
+	devID, _ := ShiftPath(tail)
+	if devices != "devices" || devID != id {
+		http.Error(res, "device key can only access its device",
+			http.StatusForbidden)
+		return
+	}
+
+	h.v1.ServeHTTP(res, req)
+}
+
+// loginRequest is posted to /v1/auth/login
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// sessionResponse is returned when a session is started or refreshed. It
+// is the only time the token is returned.
+type sessionResponse struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+	User    data.User `json:"user"`
+}
+
+// passwordRequest is posted to /v1/auth/password to change the password
+// of the logged in user, and to /v1/auth/reset with a reset token
+type passwordRequest struct {
+	Token       string `json:"token,omitempty"`
+	Password    string `json:"password,omitempty"`
+	NewPassword string `json:"newPassword"`
+}
+
+// auth handles /v1/auth/<op>
+func (h *Auth) auth(res http.ResponseWriter, req *http.Request) {
+	op, tail := ShiftPath(req.URL.Path)
+	en := json.NewEncoder(res)
+
+	if op == "oidc" {
+		req.URL.Path = tail
+		h.oidcLogin(res, req)
+		return
+	}
+
+	if req.Method != http.MethodPost && !(op == "user" && req.Method == http.MethodGet) {
+		http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch op {
+	case "login":
+		var r loginRequest
+		err := json.NewDecoder(req.Body).Decode(&r)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		token, session, err := h.db.UserLogin(r.Username, r.Password, h.ttl,
+			h.maxAge)
+		switch err {
+		case nil:
+		case db.ErrInvalidLogin:
+			http.Error(res, err.Error(), http.StatusUnauthorized)
+			return
+		case db.ErrUserLocked:
+			http.Error(res, err.Error(), http.StatusTooManyRequests)
+			return
+		default:
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, err := h.db.User(r.Username)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en.Encode(sessionResponse{Token: token, Expires: session.Expires,
+			User: user})
+	case "reset":
+		var r passwordRequest
+		err := json.NewDecoder(req.Body).Decode(&r)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = h.db.PasswordReset(r.Token, r.NewPassword)
+		if err == db.ErrInvalidToken {
+			http.Error(res, "invalid or expired reset token",
+				http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		en.Encode(data.StandardResponse{Success: true})
+	case "logout", "refresh", "user", "password":
+		h.session(op, res, req)
+	default:
+		http.Error(res, "Not Found", http.StatusNotFound)
+	}
+}
+
+// session handles the /v1/auth requests of a logged in user
+func (h *Auth) session(op string, res http.ResponseWriter, req *http.Request) {
+	token := bearerToken(req)
+	user, _, err := h.db.SessionAuth(token, h.ttl)
+	if err == db.ErrInvalidToken {
+		http.Error(res, "not authorized", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+
+	switch op {
+	case "logout":
+		err := h.db.SessionDelete(token)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en.Encode(data.StandardResponse{Success: true})
+	case "refresh":
+		token, session, err := h.db.SessionRefresh(token, h.ttl)
+		if err == db.ErrInvalidToken {
+			http.Error(res, "not authorized", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en.Encode(sessionResponse{Token: token, Expires: session.Expires,
+			User: user})
+	case "user":
+		en.Encode(user)
+	case "password":
+		var r passwordRequest
+		err := json.NewDecoder(req.Body).Decode(&r)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// check the current password, so a stolen session can't take
+		// over the account. This counts towards the lockout.
+		err = h.db.UserCheckPassword(user.Username, r.Password)
+		switch err {
+		case nil:
+		case db.ErrInvalidLogin:
+			http.Error(res, err.Error(), http.StatusUnauthorized)
+			return
+		case db.ErrUserLocked:
+			http.Error(res, err.Error(), http.StatusTooManyRequests)
+			return
+		default:
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// this ends all sessions of the user, including this one
+		err = h.db.UserSetPassword(user.Username, r.NewPassword)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		en.Encode(data.StandardResponse{Success: true})
+	}
+}
+
+// oidcLogin handles /v1/auth/oidc/login, which redirects the user to the
+// identity provider, and /v1/auth/oidc/callback, where the provider
+// redirects back to. The callback starts a session and redirects to the
+// portal with the session token in the URL fragment, so it is not sent to
+// servers.
+func (h *Auth) oidcLogin(res http.ResponseWriter, req *http.Request) {
+	if h.oidc == nil {
+		http.Error(res, "single sign-on is not enabled", http.StatusNotFound)
+		return
+	}
+
+	if req.Method != http.MethodGet {
+		http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	op, _ := ShiftPath(req.URL.Path)
+	now := time.Now()
+
+	switch op {
+	case "login":
+		login, err := h.oidc.Login()
+		if err != nil {
+			log.Println("Error starting OIDC login: ", err)
+			http.Error(res, "identity provider is not available",
+				http.StatusBadGateway)
+			return
+		}
+
+		h.lock.Lock()
+		for state, l := range h.logins {
+			if now.After(l.expires) {
+				delete(h.logins, state)
+			}
+		}
+
+		full := len(h.logins) >= maxOIDCLogins
+		if !full {
+			h.logins[login.State] = oidcLogin{Login: login,
+				expires: now.Add(oidcLoginTTL)}
+		}
+		h.lock.Unlock()
+
+		if full {
+			http.Error(res, "too many logins in progress",
+				http.StatusServiceUnavailable)
+			return
+		}
+
+		http.Redirect(res, req, login.URL, http.StatusFound)
+	case "callback":
+		q := req.URL.Query()
+		state := q.Get("state")
+
+		h.lock.Lock()
+		login, ok := h.logins[state]
+		delete(h.logins, state)
+		h.lock.Unlock()
+
+		if !ok || now.After(login.expires) {
+			http.Error(res, "login expired, try again", http.StatusBadRequest)
+			return
+		}
+
+		if e := q.Get("error"); e != "" {
+			http.Error(res, "login failed: "+e+" "+q.Get("error_description"),
+				http.StatusUnauthorized)
+			return
+		}
+
+		id, err := h.oidc.Exchange(login.Login, q.Get("code"))
+		if err == oidc.ErrNoRole {
+			http.Error(res, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			log.Println("OIDC login error: ", err)
+			http.Error(res, "login failed", http.StatusUnauthorized)
+			return
+		}
+
+		_, err = h.db.UserUpsertExternal(data.User{Username: id.Username,
+			Role: id.Role, Provider: "oidc"})
+		if err == db.ErrUserExists {
+			http.Error(res, "a local user with this name exists",
+				http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		token, _, err := h.db.SessionCreate(id.Username, h.ttl, h.maxAge)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(res, req, "/#token="+url.QueryEscape(token),
+			http.StatusFound)
+	default:
+		http.Error(res, "Not Found", http.StatusNotFound)
+	}
+}
+
+// userRequest is posted to /admin/users to create a user
+type userRequest struct {
+	data.User
+	Password string `json:"password"`
+}
+
+// resetResponse is returned when an admin creates a password reset token
+type resetResponse struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// userRequests handles /admin/users[/<username>[/reset|/unlock]]
+func (h *Admin) userRequests(res http.ResponseWriter, req *http.Request) {
+	var name, op string
+	name, req.URL.Path = ShiftPath(req.URL.Path)
+	op, _ = ShiftPath(req.URL.Path)
+
+	en := json.NewEncoder(res)
+
+	switch {
+	case name == "" && req.Method == http.MethodGet:
+		users, err := h.db.Users()
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if users == nil {
+			users = []data.User{}
+		}
+
+		en.Encode(users)
+	case name == "" && req.Method == http.MethodPost:
+		var r userRequest
+		err := json.NewDecoder(req.Body).Decode(&r)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user, err := h.db.UserInsert(r.User, r.Password)
+		if err == db.ErrUserExists {
+			http.Error(res, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		en.Encode(user)
+	case name != "" && op == "" && req.Method == http.MethodGet:
+		user, err := h.db.User(name)
+		if err == bolthold.ErrNotFound {
+			http.Error(res, "user not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en.Encode(user)
+	case name != "" && op == "" && req.Method == http.MethodDelete:
+		err := h.db.UserDelete(name)
+		if err == bolthold.ErrNotFound {
+			http.Error(res, "user not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en.Encode(data.StandardResponse{Success: true, ID: name})
+	case name != "" && op == "reset" && req.Method == http.MethodPost:
+		token, err := h.db.PasswordResetCreate(name, passwordResetTTL)
+		if err == bolthold.ErrNotFound {
+			http.Error(res, "user not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en.Encode(resetResponse{Token: token,
+			Expires: time.Now().Add(passwordResetTTL)})
+	case name != "" && op == "unlock" && req.Method == http.MethodPost:
+		err := h.db.UserUnlock(name)
+		if err == bolthold.ErrNotFound {
+			http.Error(res, "user not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en.Encode(data.StandardResponse{Success: true, ID: name})
+	default:
+		http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -15,10 +16,14 @@ import (
 // NewSendSamples returns a function that can be used to send samples
 // to a SimpleIoT portal instance
 func NewSendSamples(portalURL, deviceID string, timeout time.Duration, debug bool) func([]data.Sample) error {
-	var netClient = &http.Client{
+	return NewSendSamplesClient(portalURL, deviceID, &http.Client{
 		Timeout: timeout,
-	}
+	}, debug)
+}
 
+// NewSendSamplesClient is like NewSendSamples, but uses client for the
+// requests, which can be used to connect through a proxy
+func NewSendSamplesClient(portalURL, deviceID string, netClient *http.Client, debug bool) func([]data.Sample) error {
 	return func(samples []data.Sample) error {
 		sampleURL := portalURL + "/v1/devices/" + deviceID + "/samples"
 
@@ -49,3 +54,56 @@ func NewSendSamples(portalURL, deviceID string, timeout time.Duration, debug boo
 		return nil
 	}
 }
+
+// NewSendLogs returns a function that can be used to upload log entries
+// to a SimpleIoT portal instance
+func NewSendLogs(portalURL, deviceID string, netClient *http.Client) func([]data.LogEntry) error {
+	return func(entries []data.LogEntry) error {
+		logURL := portalURL + "/v1/devices/" + deviceID + "/logs"
+
+		j, err := json.Marshal(entries)
+		if err != nil {
+			return err
+		}
+
+		resp, err := netClient.Post(logURL, "application/json", bytes.NewBuffer(j))
+		if err != nil {
+			return err
+		}
+
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			errstring := "Server error: " + resp.Status + " " + logURL
+			body, _ := ioutil.ReadAll(resp.Body)
+			errstring += " " + string(body)
+			return errors.New(errstring)
+		}
+
+		return nil
+	}
+}
+
+// NewSendSupportArchive returns a function that can be used to upload a
+// support archive (gzipped tar) to a SimpleIoT portal instance
+func NewSendSupportArchive(portalURL, deviceID string, netClient *http.Client) func(io.Reader) error {
+	return func(archive io.Reader) error {
+		supportURL := portalURL + "/v1/devices/" + deviceID + "/support"
+
+		resp, err := netClient.Post(supportURL, "application/gzip", archive)
+		if err != nil {
+			return err
+		}
+
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			errstring := "Server error: " + resp.Status + " " + supportURL
+			body, _ := ioutil.ReadAll(resp.Body)
+			errstring += " " + string(body)
+			return errors.New(errstring)
+		}
+
+		return nil
+	}
+}
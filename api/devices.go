@@ -1,66 +1,1155 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/simpleiot/simpleiot/data"
 	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/script"
+	"github.com/simpleiot/simpleiot/trace"
+	"github.com/timshannon/bolthold"
 )
 
+var errDeviceNotFound = errors.New("device not found")
+
+// transformer applies device transforms to samples as they are written
+var transformer = script.NewTransformer()
+
+// define current value poll timeouts
+const (
+	currentPollTimeout    = 5 * time.Second
+	currentPollMaxTimeout = time.Minute
+)
+
+// currentResponse is returned by a current value request
+type currentResponse struct {
+	Sample data.Sample `json:"sample"`
+	// Fresh is true if the sample was read by the poll of the request,
+	// and false if it is the last value the device sent
+	Fresh bool `json:"fresh"`
+}
+
+// ingestRetryAfter is how long clients are asked to wait before posting
+// again when the ingest queue is full
+const ingestRetryAfter = 5 * time.Second
+
+// transform applies the transforms in the config of a device to its
+// samples
+func transform(dbInst *db.Db, id string, samples []data.Sample) []data.Sample {
+	dev, err := dbInst.Device(id)
+	if err != nil {
+		// new devices don't have transforms
+		return samples
+	}
+
+	return transformer.Apply(dev, samples)
+}
+
 // Devices handles device requests
 type Devices struct {
 	db     *db.Db
 	influx *db.Influx
+	ingest *db.IngestQueue
+}
+
+// WriteSamples writes samples for a device to the db, and influx if
+// configured. The transforms of the device are applied, and duplicate
+// samples are dropped.
+func WriteSamples(dbInst *db.Db, influx *db.Influx, id string, samples []data.Sample) error {
+	return WriteSamplesContext(context.Background(), dbInst, influx, id, samples)
+}
+
+// WriteSamplesContext is WriteSamples with a context, so the writes are
+// traced as part of the trace in ctx. It can be used as the db.IngestFunc
+// for an ingest queue.
+func WriteSamplesContext(ctx context.Context, dbInst *db.Db, influx *db.Influx, id string, samples []data.Sample) (err error) {
+	ctx, span := trace.Start(ctx, "WriteSamples", trace.KindInternal,
+		trace.Attr{Key: "device", Value: id},
+		trace.Attr{Key: "samples", Value: len(samples)})
+	defer span.End(&err)
+
+	samples, err = traceDb(ctx, "db.DeviceSamples", func() ([]data.Sample, error) {
+		return dbInst.DeviceSamples(id, traceTransform(ctx, dbInst, id, samples))
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeInflux(ctx, dbInst, influx, id, samples)
+}
+
+// WriteBatch writes a batch of samples from a device backlog to the db, and
+// influx if configured. Batches that were already written are skipped.
+func WriteBatch(dbInst *db.Db, influx *db.Influx, id string, batch data.SampleBatch) error {
+	return WriteBatchContext(context.Background(), dbInst, influx, id, batch)
+}
+
+// WriteBatchContext is WriteBatch with a context, so the writes are traced
+// as part of the trace in ctx
+func WriteBatchContext(ctx context.Context, dbInst *db.Db, influx *db.Influx, id string, batch data.SampleBatch) (err error) {
+	ctx, span := trace.Start(ctx, "WriteBatch", trace.KindInternal,
+		trace.Attr{Key: "device", Value: id},
+		trace.Attr{Key: "samples", Value: len(batch.Samples)})
+	defer span.End(&err)
+
+	batch.Samples = traceTransform(ctx, dbInst, id, batch.Samples)
+	samples, err := traceDb(ctx, "db.DeviceBatch", func() ([]data.Sample, error) {
+		return dbInst.DeviceBatch(id, batch)
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeInflux(ctx, dbInst, influx, id, samples)
+}
+
+// traceTransform applies device transforms in a span
+func traceTransform(ctx context.Context, dbInst *db.Db, id string, samples []data.Sample) []data.Sample {
+	_, span := trace.Start(ctx, "transform", trace.KindInternal)
+	defer span.End(nil)
+
+	return transform(dbInst, id, samples)
+}
+
+// traceDb runs a store write in a span
+func traceDb(ctx context.Context, name string, write func() ([]data.Sample, error)) (samples []data.Sample, err error) {
+	_, span := trace.Start(ctx, name, trace.KindInternal)
+	defer span.End(&err)
+
+	samples, err = write()
+	span.SetAttr("written", len(samples))
+	return samples, err
+}
+
+// writeInflux writes samples that were stored to influx, if configured
+func writeInflux(ctx context.Context, dbInst *db.Db, influx *db.Influx, id string, samples []data.Sample) (err error) {
+	if influx == nil || len(samples) == 0 {
+		return nil
+	}
+
+	_, span := trace.Start(ctx, "influx.WriteSamples", trace.KindClient,
+		trace.Attr{Key: "samples", Value: len(samples)})
+	defer span.End(&err)
+
+	dev, err := dbInst.Device(id)
+	if err != nil {
+		return err
+	}
+
+	return influx.WriteSamples(&dev, samples)
+}
+
+// ValidateConfig checks a device config is valid
+func ValidateConfig(c data.DeviceConfig) error {
+	if c.Cellular != nil {
+		err := c.Cellular.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Wifi != nil {
+		err := c.Wifi.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Ethernet != nil {
+		err := c.Ethernet.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Timezone != "" {
+		err := data.ValidateTimezone(c.Timezone)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Hostname != "" {
+		err := data.ValidateHostname(c.Hostname)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, s := range c.Sensors {
+		err := s.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, m := range c.Modbus {
+		err := m.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, b := range c.Ble {
+		err := b.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, o := range c.Opcua {
+		err := o.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, s := range c.Snmp {
+		err := s.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.SnmpTraps != nil {
+		err := c.SnmpTraps.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, d := range c.Dnp3 {
+		err := d.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.OneWire != nil {
+		err := c.OneWire.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, b := range c.Can {
+		err := b.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, t := range c.Transforms {
+		err := t.Validate()
+		if err != nil {
+			return err
+		}
+
+		if t.Expression != "" {
+			_, err = script.ParseExpression(t.Expression)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, p := range c.Virtual {
+		err := p.Validate()
+		if err != nil {
+			return err
+		}
+
+		if p.Expression != "" {
+			_, err = script.ParseExpression(p.Expression)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, w := range c.Maintenance {
+		err := w.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Location != nil {
+		err := c.Location.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, s := range c.Schedules {
+		err := s.Validate()
+		if err != nil {
+			return err
+		}
+
+		if s.Type != data.ScheduleCron && c.Location == nil {
+			return errors.New("location is required for sunrise and sunset schedules")
+		}
+	}
+
+	if c.Lorawan != nil {
+		err := c.Lorawan.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *Devices) processConfig(res http.ResponseWriter, req *http.Request, id string) {
+	decoder := json.NewDecoder(http.MaxBytesReader(res, req.Body, maxScriptRequest))
+	var c data.DeviceConfig
+	err := decoder.Decode(&c)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = ValidateConfig(c)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.db.Update(func(txn *db.Txn) error {
+		err := txn.DeviceUpdateConfig(id, c)
+		if err != nil {
+			return err
+		}
+
+		return txn.AuditAppend(data.AuditRecord{
+			DeviceID: id,
+			Action:   "updateConfig",
+		})
+	})
+
+	if err == db.ErrDeviceCycle {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(data.StandardResponse{Success: true, ID: id})
+}
+
+// processConfigSnapshots returns the config versions of a device
+func (h *Devices) processConfigSnapshots(res http.ResponseWriter, req *http.Request, id string) {
+	snaps, err := h.db.ConfigSnapshots(id)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if snaps == nil {
+		snaps = []data.ConfigSnapshot{}
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(snaps)
+}
+
+// processConfigDiff returns the fields that changed between the from and
+// to config versions of a device. to is the current config if it is not
+// set.
+func (h *Devices) processConfigDiff(res http.ResponseWriter, req *http.Request, id string) {
+	q := req.URL.Query()
+
+	version := func(name string) (data.DeviceConfig, bool) {
+		v, err := strconv.Atoi(q.Get(name))
+		if err != nil {
+			http.Error(res, "invalid "+name+" version", http.StatusBadRequest)
+			return data.DeviceConfig{}, false
+		}
+
+		snap, err := h.db.ConfigSnapshot(id, v)
+		if err == db.ErrConfigVersion {
+			http.Error(res, err.Error(), http.StatusNotFound)
+			return data.DeviceConfig{}, false
+		} else if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return data.DeviceConfig{}, false
+		}
+
+		return snap.Config, true
+	}
+
+	from, ok := version("from")
+	if !ok {
+		return
+	}
+
+	var to data.DeviceConfig
+	if q.Get("to") != "" {
+		to, ok = version("to")
+		if !ok {
+			return
+		}
+	} else {
+		dev, err := h.db.Device(id)
+		if err != nil {
+			http.Error(res, errDeviceNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		to = dev.Config
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(data.ConfigDiff(from, to))
+}
+
+// configRollback is posted to roll a device back to a config version
+type configRollback struct {
+	Version int `json:"version"`
+}
+
+// processConfigRollback sets the config of a device to an earlier version
+func (h *Devices) processConfigRollback(res http.ResponseWriter, req *http.Request, id string) {
+	var r configRollback
+	err := json.NewDecoder(req.Body).Decode(&r)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.db.Update(func(txn *db.Txn) error {
+		err := txn.ConfigRollback(id, r.Version)
+		if err != nil {
+			return err
+		}
+
+		return txn.AuditAppend(data.AuditRecord{
+			DeviceID: id,
+			Action:   "configRollback",
+			Message:  fmt.Sprintf("rolled back to version %v", r.Version),
+		})
+	})
+
+	switch err {
+	case nil:
+	case db.ErrConfigVersion, bolthold.ErrNotFound:
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	case db.ErrDeviceCycle:
+		http.Error(res, err.Error(), http.StatusConflict)
+		return
+	default:
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(data.StandardResponse{Success: true, ID: id})
+}
+
+// processConfigReport records the config a device applied
+func (h *Devices) processConfigReport(res http.ResponseWriter, req *http.Request, id string) {
+	var report data.ConfigReport
+	err := json.NewDecoder(req.Body).Decode(&report)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.db.DeviceReportConfig(id, report)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(data.StandardResponse{Success: true, ID: id})
+}
+
+// processFirmwareReport records the progress of a firmware install
+func (h *Devices) processFirmwareReport(res http.ResponseWriter, req *http.Request, id string) {
+	var report data.FirmwareReport
+	err := json.NewDecoder(req.Body).Decode(&report)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = report.Validate()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	install, err := h.db.FirmwareReport(id, report)
+	if err == bolthold.ErrNotFound {
+		http.Error(res, "firmware was not sent to the device by the rollout",
+			http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(install)
+}
+
+// processKey returns the rotation status of the device key in the
+// request, or rotates it. The new key is only returned once.
+func (h *Devices) processKey(res http.ResponseWriter, req *http.Request, id string) {
+	key := bearerToken(req)
+	status, err := h.db.DeviceKeyStatus(key)
+	if err == db.ErrInvalidKey || (err == nil && status.DeviceID != id) {
+		http.Error(res, "device key required", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+
+	if req.Method == http.MethodGet {
+		en.Encode(status)
+		return
+	}
+
+	newKey, k, err := h.db.DeviceKeyRotate(key)
+	if err == db.ErrInvalidKey {
+		http.Error(res, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en.Encode(data.KeyResponse{DeviceKey: k, Key: newKey})
+}
+
+func (h *Devices) processTwin(res http.ResponseWriter, req *http.Request, id string) {
+	dev, err := h.db.Device(id)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(dev.Twin())
+}
+
+// processCurrent returns the current value of a sample type of a device.
+// With poll=true, the device is asked to read it now, and the fresh reading
+// is returned if it arrives before the timeout. Otherwise the last value
+// the device sent is returned.
+func (h *Devices) processCurrent(res http.ResponseWriter, req *http.Request, id string) {
+	q := req.URL.Query()
+	sampleType := q.Get("type")
+	sampleID := q.Get("id")
+
+	if sampleType == "" {
+		http.Error(res, "type is required", http.StatusBadRequest)
+		return
+	}
+
+	timeout := currentPollTimeout
+	if v := q.Get("timeout"); v != "" {
+		var err error
+		timeout, err = time.ParseDuration(v)
+		if err != nil || timeout <= 0 || timeout > currentPollMaxTimeout {
+			http.Error(res, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var ret currentResponse
+
+	if q.Get("poll") == "true" {
+		if h.db.ReadOnly() {
+			http.Error(res, db.ErrReadOnly.Error(), http.StatusForbidden)
+			return
+		}
+
+		// subscribe before the poll is queued, so the reading can't be
+		// missed
+		events := h.db.Subscribe(db.EventFilter{
+			DeviceID: id,
+			Types:    []db.EventType{db.EventSampleWritten},
+		})
+		defer h.db.Unsubscribe(events)
+
+		err := h.db.Update(func(txn *db.Txn) error {
+			dev, err := txn.Device(id)
+			if err != nil {
+				return err
+			}
+
+			if dev == nil {
+				return errDeviceNotFound
+			}
+
+			args := map[string]string{"type": sampleType}
+			if sampleID != "" {
+				args["id"] = sampleID
+			}
+
+			// the poll is useless after the timeout
+			_, err = txn.CommandEnqueue(data.DeviceCommand{
+				DeviceID: id,
+				Command:  data.PollCommand,
+				Args:     args,
+				Expires:  time.Now().Add(timeout),
+			})
+			return err
+		})
+
+		if err == errDeviceNotFound {
+			http.Error(res, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+	wait:
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					break wait
+				}
+
+				s := e.Sample
+				if s != nil && s.Type == sampleType &&
+					(sampleID == "" || s.ID == sampleID) {
+					ret = currentResponse{Sample: *s, Fresh: true}
+					break wait
+				}
+			case <-timer.C:
+				break wait
+			case <-req.Context().Done():
+				return
+			}
+		}
+	}
+
+	if !ret.Fresh {
+		// without an ID, the newest value of any IO of the type is used
+		latest, _ := h.db.Latest(id)
+		found := false
+		for _, s := range latest {
+			if s.Type == sampleType && (sampleID == "" || s.ID == sampleID) &&
+				(!found || s.Time.After(ret.Sample.Time)) {
+				ret.Sample = s
+				found = true
+			}
+		}
+
+		if !found {
+			http.Error(res, "no value", http.StatusNotFound)
+			return
+		}
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(ret)
+}
+
+// processChildren returns the devices attached to a device
+func (h *Devices) processChildren(res http.ResponseWriter, req *http.Request, id string) {
+	children, err := h.db.DeviceChildren(id)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if children == nil {
+		children = []data.Device{}
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(children)
 }
 
-func (h *Devices) processConfig(res http.ResponseWriter, req *http.Request, id string) {
+// processTree returns a device and all the devices attached to it
+func (h *Devices) processTree(res http.ResponseWriter, req *http.Request, id string) {
+	tree, err := h.db.DeviceTree(id)
+	if err == bolthold.ErrNotFound {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(tree)
+}
+
+func (h *Devices) processSamples(res http.ResponseWriter, req *http.Request, id string) {
 	decoder := json.NewDecoder(req.Body)
-	var c data.DeviceConfig
-	err := decoder.Decode(&c)
+	var samples []data.Sample
+	err := decoder.Decode(&samples)
 	if err != nil {
 		http.Error(res, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	err = h.db.DeviceUpdateConfig(id, c)
+	if h.ingest != nil {
+		err = h.ingest.EnqueueContext(req.Context(), id, samples)
+	} else {
+		err = WriteSamplesContext(req.Context(), h.db, h.influx, id, samples)
+	}
+
+	if errors.Is(err, db.ErrUsageLimit) {
+		http.Error(res, err.Error(), http.StatusInsufficientStorage)
+		return
+	} else if errors.Is(err, db.ErrIngestFull) {
+		res.Header().Set("Retry-After", strconv.Itoa(int(ingestRetryAfter/time.Second)))
+		http.Error(res, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(data.StandardResponse{Success: true, ID: id})
+}
+
+// processBatch writes a backlog batch. Batches are written directly, not
+// queued, so the batch mark is only saved with the samples.
+func (h *Devices) processBatch(res http.ResponseWriter, req *http.Request, id string) {
+	var batch data.SampleBatch
+	err := json.NewDecoder(req.Body).Decode(&batch)
 	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = WriteBatchContext(req.Context(), h.db, h.influx, id, batch)
+	if errors.Is(err, db.ErrUsageLimit) {
+		http.Error(res, err.Error(), http.StatusInsufficientStorage)
+		return
+	} else if err != nil {
 		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	en := json.NewEncoder(res)
 	en.Encode(data.StandardResponse{Success: true, ID: id})
 }
 
-func (h *Devices) processSamples(res http.ResponseWriter, req *http.Request, id string) {
-	decoder := json.NewDecoder(req.Body)
-	var samples []data.Sample
-	err := decoder.Decode(&samples)
+func parseResolution(res string) (time.Duration, error) {
+	switch res {
+	case "", "raw":
+		return db.ResolutionRaw, nil
+	case "1m":
+		return db.ResolutionMinute, nil
+	case "1h":
+		return db.ResolutionHour, nil
+	default:
+		return 0, errors.New("invalid resolution, must be raw, 1m, or 1h")
+	}
+}
+
+func (h *Devices) processSampleHistory(res http.ResponseWriter, req *http.Request, id string) {
+	q := req.URL.Query()
+
+	end := time.Now()
+	if v := q.Get("end"); v != "" {
+		var err error
+		end, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	start := end.Add(-24 * time.Hour)
+	if v := q.Get("start"); v != "" {
+		var err error
+		start, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	resolution, err := parseResolution(q.Get("resolution"))
 	if err != nil {
 		http.Error(res, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	for _, s := range samples {
-		err = h.db.DeviceSample(id, s)
+	samples, err := h.db.SampleHistory(id, start, end, resolution)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(samples)
+}
+
+// historyDeleteResponse is returned when the history of a device is deleted
+type historyDeleteResponse struct {
+	// Samples is the number of samples deleted from the local store
+	Samples int `json:"samples"`
+	// Influx is true if the samples were also deleted from influx
+	Influx bool `json:"influx"`
+}
+
+// processHistoryDelete deletes the sample history of a device from the
+// local store and influx, for erasure requests. Only history from before
+// the before parameter is deleted if it is set.
+func (h *Devices) processHistoryDelete(res http.ResponseWriter, req *http.Request, id string) {
+	var before time.Time
+	if v := req.URL.Query().Get("before"); v != "" {
+		var err error
+		before, err = time.Parse(time.RFC3339, v)
 		if err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
 		}
 	}
 
+	_, err := h.db.Device(id)
+	if err != nil {
+		http.Error(res, errDeviceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	var ret historyDeleteResponse
+
+	// influx is cleared first, so a failed request can be retried. Samples
+	// in influx without a device ID tag can't be found by device.
 	if h.influx != nil {
-		err = h.influx.WriteSamples(samples)
+		err := h.influx.DeleteHistory(id, before)
+		if err != nil && err != db.ErrInfluxNoDeviceTag {
+			http.Error(res, "error deleting influx history: "+err.Error(),
+				http.StatusBadGateway)
+			return
+		}
+		ret.Influx = err == nil
+	}
+
+	reason := "erasure request"
+	if ret.Influx {
+		reason += ", influx cleared"
+	}
+
+	// erasure requests are always audited
+	err = h.db.Update(func(txn *db.Txn) error {
+		var err error
+		ret.Samples, err = txn.HistoryDelete(id, before)
+		if err != nil {
+			return err
+		}
+
+		return txn.AuditAppend(data.AuditRecord{
+			DeviceID: id,
+			Action:   "historyDelete",
+			Message:  db.HistoryDeleteMessage(reason, ret.Samples, before),
+		})
+	})
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(ret)
+}
+
+func (h *Devices) processCmd(res http.ResponseWriter, req *http.Request, id string) {
+	decoder := json.NewDecoder(req.Body)
+	var cmd data.DeviceCommand
+	err := decoder.Decode(&cmd)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if cmd.Command == "" {
+		http.Error(res, "command is required", http.StatusBadRequest)
+		return
+	}
+
+	// tunnels are only opened with the admin API, which audits them
+	if cmd.Command == data.TunnelCommand {
+		http.Error(res, "tunnels are opened with /admin/tunnels", http.StatusForbidden)
+		return
+	}
+
+	cmd.DeviceID = id
+
+	err = h.db.Update(func(txn *db.Txn) error {
+		dev, err := txn.Device(id)
+		if err != nil {
+			return err
+		}
+
+		if dev == nil {
+			return errDeviceNotFound
+		}
+
+		cmd, err = txn.CommandEnqueue(cmd)
+		if err != nil {
+			return err
+		}
+
+		return txn.AuditAppend(data.AuditRecord{
+			DeviceID: id,
+			Action:   "enqueueCommand",
+			Message:  cmd.Command,
+		})
+	})
+
+	if err == errDeviceNotFound {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(cmd)
+}
+
+func (h *Devices) processLogs(res http.ResponseWriter, req *http.Request, id string) {
+	decoder := json.NewDecoder(req.Body)
+	var entries []data.LogEntry
+	err := decoder.Decode(&entries)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.db.LogAppend(id, entries)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(data.StandardResponse{Success: true, ID: id})
+}
+
+// processLogList returns the log entries uploaded by a device since the
+// since query parameter (RFC3339, default 24h ago)
+func (h *Devices) processLogList(res http.ResponseWriter, req *http.Request, id string) {
+	since := time.Now().Add(-24 * time.Hour)
+	if v := req.URL.Query().Get("since"); v != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := h.db.Logs(id, since)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if entries == nil {
+		entries = []data.LogEntry{}
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(entries)
+}
+
+// processEvents returns the event timeline of a device since the since
+// parameter (default 24h ago), oldest first
+func (h *Devices) processEvents(res http.ResponseWriter, req *http.Request, id string) {
+	since := time.Now().Add(-24 * time.Hour)
+	if v := req.URL.Query().Get("since"); v != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := h.db.DeviceEvents(id, since)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if events == nil {
+		events = []data.Event{}
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(events)
+}
+
+// maxSupportArchive is the largest support archive a device can upload
+const maxSupportArchive = 20 * 1024 * 1024
+
+func (h *Devices) processSupportArchive(res http.ResponseWriter, req *http.Request, id string) {
+	archive, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body,
+		maxSupportArchive))
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a, err := h.db.SupportArchiveAdd(id, archive)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(a)
+}
+
+// processSupportArchiveGet returns the list of support archives for a
+// device, or an archive if the path has an archive id
+func (h *Devices) processSupportArchiveGet(res http.ResponseWriter, req *http.Request, id string) {
+	if req.URL.Path == "/" {
+		archives, err := h.db.SupportArchives(id)
 		if err != nil {
 			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if archives == nil {
+			archives = []data.SupportArchive{}
 		}
+
+		en := json.NewEncoder(res)
+		en.Encode(archives)
+		return
+	}
+
+	archiveID, err := strconv.ParseUint(req.URL.Path[1:], 10, 64)
+	if err != nil {
+		http.Error(res, "invalid archive id", http.StatusBadRequest)
+		return
+	}
+
+	a, err := h.db.SupportArchive(archiveID)
+	if err != nil || a.DeviceID != id {
+		http.Error(res, "archive not found", http.StatusNotFound)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/gzip")
+	res.Header().Set("Content-Disposition", fmt.Sprintf(
+		"attachment; filename=%v-%v.tar.gz", id, a.Time.Format("20060102-150405")))
+	res.Write(a.Data)
+}
+
+func (h *Devices) processCmdList(res http.ResponseWriter, req *http.Request, id string) {
+	cmds, err := h.db.DeviceCommands(id)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if cmds == nil {
+		cmds = []data.DeviceCommand{}
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(cmds)
+}
+
+func (h *Devices) processCmdDelete(res http.ResponseWriter, req *http.Request, id string) {
+	cmdID, err := strconv.ParseUint(req.URL.Path[1:], 10, 64)
+	if err != nil {
+		http.Error(res, "invalid command id", http.StatusBadRequest)
+		return
+	}
+
+	err = h.db.CommandDelete(cmdID)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
 	}
 
 	en := json.NewEncoder(res)
 	en.Encode(data.StandardResponse{Success: true, ID: id})
 }
 
+// processList returns a list of devices. Devices can be filtered by group,
+// parent, template type, tag, io type, config sync state, and a full text query (q), and the list paginated
+// with offset and limit query parameters. The total number of matching devices is returned in the
+// X-Total-Count header.
+func (h *Devices) processList(res http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+
+	filter := db.DeviceFilter{
+		Group:  q.Get("group"),
+		Parent: q.Get("parent"),
+		Type:   q.Get("type"),
+		Tag:    q.Get("tag"),
+		Io:     q.Get("io"),
+		State:  q.Get("state"),
+		Query:  q.Get("q"),
+	}
+
+	var err error
+	if v := q.Get("offset"); v != "" {
+		filter.Offset, err = strconv.Atoi(v)
+		if err != nil || filter.Offset < 0 {
+			http.Error(res, "invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if v := q.Get("limit"); v != "" {
+		filter.Limit, err = strconv.Atoi(v)
+		if err != nil || filter.Limit < 0 {
+			http.Error(res, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	devices, total, err := h.db.DevicesFiltered(filter)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if devices == nil {
+		devices = []data.Device{}
+	}
+
+	res.Header().Set("X-Total-Count", strconv.Itoa(total))
+	en := json.NewEncoder(res)
+	en.Encode(devices)
+}
+
 // Top level handler for http requests in the coap-server process
 func (h *Devices) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && h.db.ReadOnly() {
+		http.Error(res, db.ErrReadOnly.Error(), http.StatusForbidden)
+		return
+	}
+
 	var id string
 	id, req.URL.Path = ShiftPath(req.URL.Path)
 
@@ -69,28 +1158,143 @@ func (h *Devices) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 
 	switch head {
 	case "samples":
-		if req.Method == http.MethodPost {
+		switch req.Method {
+		case http.MethodPost:
 			h.processSamples(res, req, id)
+		case http.MethodGet:
+			h.processSampleHistory(res, req, id)
+		default:
+			http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+		}
+	case "history":
+		if req.Method == http.MethodDelete {
+			h.processHistoryDelete(res, req, id)
+		} else {
+			http.Error(res, "only DELETE allowed", http.StatusMethodNotAllowed)
+		}
+	case "batch":
+		if req.Method == http.MethodPost {
+			h.processBatch(res, req, id)
 		} else {
 			http.Error(res, "only POST allowed", http.StatusMethodNotAllowed)
 		}
+	case "cmd":
+		switch req.Method {
+		case http.MethodPost:
+			h.processCmd(res, req, id)
+		case http.MethodGet:
+			h.processCmdList(res, req, id)
+		case http.MethodDelete:
+			h.processCmdDelete(res, req, id)
+		default:
+			http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+		}
+	case "logs":
+		switch req.Method {
+		case http.MethodPost:
+			h.processLogs(res, req, id)
+		case http.MethodGet:
+			h.processLogList(res, req, id)
+		default:
+			http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+		}
+	case "events":
+		if req.Method == http.MethodGet {
+			h.processEvents(res, req, id)
+		} else {
+			http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+		}
+	case "support":
+		switch req.Method {
+		case http.MethodPost:
+			h.processSupportArchive(res, req, id)
+		case http.MethodGet:
+			h.processSupportArchiveGet(res, req, id)
+		default:
+			http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+		}
 	case "config":
-		if req.Method == http.MethodPost {
+		var sub string
+		sub, req.URL.Path = ShiftPath(req.URL.Path)
+
+		switch {
+		case sub == "snapshots" || sub == "diff":
+			if req.Method != http.MethodGet {
+				http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+			} else if sub == "snapshots" {
+				h.processConfigSnapshots(res, req, id)
+			} else {
+				h.processConfigDiff(res, req, id)
+			}
+		case req.Method != http.MethodPost:
+			http.Error(res, "only POST allowed", http.StatusMethodNotAllowed)
+		case sub == "":
 			h.processConfig(res, req, id)
+		case sub == "reported":
+			h.processConfigReport(res, req, id)
+		case sub == "rollback":
+			h.processConfigRollback(res, req, id)
+		default:
+			http.Error(res, "not found", http.StatusNotFound)
+		}
+	case "firmware":
+		switch req.Method {
+		case http.MethodPost:
+			h.processFirmwareReport(res, req, id)
+		case http.MethodGet:
+			installs, err := h.db.DeviceFirmwareInstalls(id)
+			if err != nil {
+				http.Error(res, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if installs == nil {
+				installs = []data.FirmwareInstall{}
+			}
+
+			en := json.NewEncoder(res)
+			en.Encode(installs)
+		default:
+			http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+		}
+	case "files":
+		h.processFiles(res, req, id)
+	case "key":
+		switch req.Method {
+		case http.MethodGet, http.MethodPost:
+			h.processKey(res, req, id)
+		default:
+			http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+		}
+	case "twin":
+		if req.Method == http.MethodGet {
+			h.processTwin(res, req, id)
 		} else {
-			http.Error(res, "only POST allowed", http.StatusMethodNotAllowed)
+			http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+		}
+	case "current":
+		if req.Method == http.MethodGet {
+			h.processCurrent(res, req, id)
+		} else {
+			http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+		}
+	case "children":
+		if req.Method == http.MethodGet {
+			h.processChildren(res, req, id)
+		} else {
+			http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+		}
+	case "tree":
+		if req.Method == http.MethodGet {
+			h.processTree(res, req, id)
+		} else {
+			http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
 		}
 	default:
 		if id == "" {
 			switch req.Method {
 			case http.MethodGet:
-				devices, err := h.db.Devices()
-				if err != nil {
-					http.Error(res, err.Error(), http.StatusNotFound)
-					return
-				}
-				en := json.NewEncoder(res)
-				en.Encode(devices)
+				h.processList(res, req)
 			default:
 				http.Error(res, "invalid method", http.StatusMethodNotAllowed)
 			}
@@ -120,7 +1324,8 @@ func (h *Devices) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// NewDevicesHandler returns a new device handler
-func NewDevicesHandler(db *db.Db, influx *db.Influx) http.Handler {
-	return &Devices{db, influx}
+// NewDevicesHandler returns a new device handler. If ingest is not nil,
+// posted samples are queued instead of being written directly.
+func NewDevicesHandler(db *db.Db, influx *db.Influx, ingest *db.IngestQueue) http.Handler {
+	return &Devices{db, influx, ingest}
 }
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/timshannon/bolthold"
+)
+
+// maxFile is the largest file that can be transferred
+const maxFile = 64 << 20
+
+// maxFileChunk is the largest chunk of a file that can be sent in one
+// request
+const maxFileChunk = 1 << 20
+
+func (h *Devices) processFileList(res http.ResponseWriter, req *http.Request, id string) {
+	files, err := h.db.Files(id)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ret := []data.DeviceFile{}
+	dir := req.URL.Query().Get("direction")
+	for _, f := range files {
+		if dir == "" || f.Direction == dir {
+			ret = append(ret, f)
+		}
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(ret)
+}
+
+func (h *Devices) processFileCreate(res http.ResponseWriter, req *http.Request, id string) {
+	f := data.DeviceFile{Direction: data.FileUpload}
+	err := json.NewDecoder(req.Body).Decode(&f)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.DeviceID = id
+	err = f.Validate()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if f.Size > maxFile {
+		http.Error(res, "file is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	f, err = h.db.FileCreate(f)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(f)
+}
+
+// processFileWrite adds the chunk in the body at the offset query
+// parameter. If the offset is not where the received data ends, 409 is
+// returned with the file, so the sender can continue at Received.
+func (h *Devices) processFileWrite(res http.ResponseWriter, req *http.Request, fileID uint64) {
+	offset, err := strconv.ParseInt(req.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(res, "invalid offset", http.StatusBadRequest)
+		return
+	}
+
+	chunk, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, maxFileChunk))
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f, err := h.db.FileWrite(fileID, offset, chunk)
+	if err == db.ErrFileOffset {
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(http.StatusConflict)
+		en := json.NewEncoder(res)
+		en.Encode(f)
+		return
+	} else if err == db.ErrFileDigest {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(f)
+}
+
+// processFileData serves the data of a complete file. Range requests are
+// supported, so downloads can be resumed.
+func (h *Devices) processFileData(res http.ResponseWriter, req *http.Request, f data.DeviceFile) {
+	if !f.Complete {
+		http.Error(res, "file is not complete", http.StatusConflict)
+		return
+	}
+
+	d, err := h.db.FileData(f.ID)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	contentType := f.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	res.Header().Set("Content-Type", contentType)
+	res.Header().Set("ETag", `"`+f.SHA256+`"`)
+	http.ServeContent(res, req, f.Name, f.Updated, bytes.NewReader(d))
+}
+
+// processFiles handles requests to /v1/devices/<id>/files[/<fileId>[/data]]
+func (h *Devices) processFiles(res http.ResponseWriter, req *http.Request, id string) {
+	var fileIDStr string
+	fileIDStr, req.URL.Path = ShiftPath(req.URL.Path)
+
+	if fileIDStr == "" {
+		switch req.Method {
+		case http.MethodGet:
+			h.processFileList(res, req, id)
+		case http.MethodPost:
+			h.processFileCreate(res, req, id)
+		default:
+			http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	fileID, err := strconv.ParseUint(fileIDStr, 10, 64)
+	if err != nil {
+		http.Error(res, "invalid file id", http.StatusBadRequest)
+		return
+	}
+
+	f, err := h.db.File(fileID)
+	if err == bolthold.ErrNotFound || (err == nil && f.DeviceID != id) {
+		http.Error(res, "file not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var head string
+	head, req.URL.Path = ShiftPath(req.URL.Path)
+
+	switch {
+	case head == "data" && req.Method == http.MethodGet:
+		h.processFileData(res, req, f)
+	case head != "":
+		http.Error(res, "not found", http.StatusNotFound)
+	case req.Method == http.MethodGet:
+		en := json.NewEncoder(res)
+		en.Encode(f)
+	case req.Method == http.MethodPut:
+		h.processFileWrite(res, req, fileID)
+	case req.Method == http.MethodDelete:
+		err := h.db.FileDelete(fileID)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en := json.NewEncoder(res)
+		en.Encode(data.StandardResponse{Success: true, ID: fileIDStr})
+	default:
+		http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,354 @@
+package api
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/timshannon/bolthold"
+)
+
+// maxFirmware is the largest firmware file that can be uploaded
+const maxFirmware = 64 << 20
+
+// Firmware handles firmware requests
+type Firmware struct {
+	db   *db.Db
+	keys []ed25519.PublicKey
+}
+
+// processUpload stores a firmware file. The name, version, and signature
+// are query parameters, and the body is the file.
+func (h *Firmware) processUpload(res http.ResponseWriter, req *http.Request) {
+	if len(h.keys) <= 0 {
+		http.Error(res, "firmware signing keys are not configured",
+			http.StatusForbidden)
+		return
+	}
+
+	q := req.URL.Query()
+	fw := data.Firmware{
+		Name:      q.Get("name"),
+		Version:   q.Get("version"),
+		Signature: q.Get("signature"),
+	}
+
+	if fw.Name == "" || fw.Version == "" || fw.Signature == "" {
+		http.Error(res, "name, version, and signature are required",
+			http.StatusBadRequest)
+		return
+	}
+
+	file, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, maxFirmware))
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sum := sha256.Sum256(file)
+	err = data.VerifyFirmware(h.keys, sum[:], fw.Signature)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fw, err = h.db.FirmwareAdd(fw, file)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(fw)
+}
+
+// processFile serves a firmware file. Range requests are supported, so
+// devices on slow links can resume downloads.
+func (h *Firmware) processFile(res http.ResponseWriter, req *http.Request, id uint64) {
+	fw, err := h.db.Firmware(id)
+	if err != nil {
+		http.Error(res, "firmware not found", http.StatusNotFound)
+		return
+	}
+
+	file, err := h.db.FirmwareFile(id)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/octet-stream")
+	res.Header().Set("ETag", `"`+fw.SHA256+`"`)
+	http.ServeContent(res, req, fmt.Sprintf("%v-%v", fw.Name, fw.Version),
+		fw.Created, bytes.NewReader(file))
+}
+
+// Top level handler for http requests to /v1/firmware[/<id>[/file]]
+func (h *Firmware) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && h.db.ReadOnly() {
+		http.Error(res, db.ErrReadOnly.Error(), http.StatusForbidden)
+		return
+	}
+
+	var idStr string
+	idStr, req.URL.Path = ShiftPath(req.URL.Path)
+
+	if idStr == "" {
+		switch req.Method {
+		case http.MethodGet:
+			firmware, err := h.db.Firmwares()
+			if err != nil {
+				http.Error(res, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if firmware == nil {
+				firmware = []data.Firmware{}
+			}
+
+			en := json.NewEncoder(res)
+			en.Encode(firmware)
+		case http.MethodPost:
+			h.processUpload(res, req)
+		default:
+			http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		http.Error(res, "invalid firmware id", http.StatusBadRequest)
+		return
+	}
+
+	var head string
+	head, req.URL.Path = ShiftPath(req.URL.Path)
+
+	switch {
+	case head == "file" && req.Method == http.MethodGet:
+		h.processFile(res, req, id)
+	case head != "":
+		http.Error(res, "not found", http.StatusNotFound)
+	case req.Method == http.MethodGet:
+		fw, err := h.db.Firmware(id)
+		if err != nil {
+			http.Error(res, "firmware not found", http.StatusNotFound)
+			return
+		}
+
+		en := json.NewEncoder(res)
+		en.Encode(fw)
+	case req.Method == http.MethodDelete:
+		err := h.db.FirmwareDelete(id)
+		if err == db.ErrFirmwareInUse {
+			http.Error(res, err.Error(), http.StatusConflict)
+			return
+		} else if err == bolthold.ErrNotFound {
+			http.Error(res, "firmware not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en := json.NewEncoder(res)
+		en.Encode(data.StandardResponse{Success: true, ID: idStr})
+	default:
+		http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+	}
+}
+
+// NewFirmwareHandler returns a new firmware handler. Uploaded firmware must
+// be signed by one of keys, and uploads are disabled if there are none.
+func NewFirmwareHandler(db *db.Db, keys []ed25519.PublicKey) http.Handler {
+	return &Firmware{db: db, keys: keys}
+}
+
+// Rollouts handles firmware rollout requests
+type Rollouts struct {
+	db *db.Db
+}
+
+// decodeRollout reads and validates a rollout from the request body
+func decodeRollout(res http.ResponseWriter, req *http.Request) (data.Rollout, bool) {
+	r := data.Rollout{State: data.RolloutActive}
+	err := json.NewDecoder(req.Body).Decode(&r)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return r, false
+	}
+
+	err = r.Validate()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return r, false
+	}
+
+	return r, true
+}
+
+func (h *Rollouts) processList(res http.ResponseWriter, req *http.Request) {
+	rollouts, err := h.db.Rollouts()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ret := []data.RolloutStatus{}
+	for _, r := range rollouts {
+		status, err := h.db.RolloutStatus(r)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ret = append(ret, status)
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(ret)
+}
+
+func (h *Rollouts) processCreate(res http.ResponseWriter, req *http.Request) {
+	r, ok := decodeRollout(res, req)
+	if !ok {
+		return
+	}
+
+	r, err := h.db.RolloutInsert(r)
+	if err == bolthold.ErrNotFound {
+		http.Error(res, "firmware not found", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(r)
+}
+
+func (h *Rollouts) processUpdate(res http.ResponseWriter, req *http.Request, id uint64) {
+	old, err := h.db.Rollout(id)
+	if err != nil {
+		http.Error(res, "rollout not found", http.StatusNotFound)
+		return
+	}
+
+	// the update only needs the fields that change
+	r := old
+	err = json.NewDecoder(req.Body).Decode(&r)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.ID = id
+	err = r.Validate()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.db.RolloutUpdate(r)
+	if err == bolthold.ErrNotFound {
+		http.Error(res, "rollout not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(data.StandardResponse{Success: true, ID: strconv.FormatUint(id, 10)})
+}
+
+// Top level handler for http requests to /v1/rollouts[/<id>[/installs]]
+func (h *Rollouts) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && h.db.ReadOnly() {
+		http.Error(res, db.ErrReadOnly.Error(), http.StatusForbidden)
+		return
+	}
+
+	var idStr string
+	idStr, req.URL.Path = ShiftPath(req.URL.Path)
+
+	if idStr == "" {
+		switch req.Method {
+		case http.MethodGet:
+			h.processList(res, req)
+		case http.MethodPost:
+			h.processCreate(res, req)
+		default:
+			http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		http.Error(res, "invalid rollout id", http.StatusBadRequest)
+		return
+	}
+
+	var head string
+	head, req.URL.Path = ShiftPath(req.URL.Path)
+
+	switch {
+	case head == "installs" && req.Method == http.MethodGet:
+		installs, err := h.db.FirmwareInstalls(id)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if installs == nil {
+			installs = []data.FirmwareInstall{}
+		}
+
+		en := json.NewEncoder(res)
+		en.Encode(installs)
+	case head != "":
+		http.Error(res, "not found", http.StatusNotFound)
+	case req.Method == http.MethodGet:
+		r, err := h.db.Rollout(id)
+		if err != nil {
+			http.Error(res, "rollout not found", http.StatusNotFound)
+			return
+		}
+
+		status, err := h.db.RolloutStatus(r)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en := json.NewEncoder(res)
+		en.Encode(status)
+	case req.Method == http.MethodPost, req.Method == http.MethodPut:
+		h.processUpdate(res, req, id)
+	case req.Method == http.MethodDelete:
+		err := h.db.RolloutDelete(id)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en := json.NewEncoder(res)
+		en.Encode(data.StandardResponse{Success: true, ID: idStr})
+	default:
+		http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+	}
+}
+
+// NewRolloutsHandler returns a new rollouts handler
+func NewRolloutsHandler(db *db.Db) http.Handler {
+	return &Rollouts{db: db}
+}
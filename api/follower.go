@@ -0,0 +1,167 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/simpleiot/simpleiot/db"
+)
+
+// Follower keeps a read only db in sync with a primary SIOT server. The
+// follower subscribes to the primary's change stream, restores a full
+// backup of the primary db, and then applies changes from the stream.
+// Events are dropped by the primary if a subscriber falls behind, so the
+// follower periodically does a full resync.
+type Follower struct {
+	db         *db.Db
+	primaryURL string
+	token      string
+	resync     time.Duration
+	client     *http.Client
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// NewFollower creates a new follower for the primary server at primaryURL.
+// token is the admin token of the primary, which is required to fetch
+// backups. A full resync is done every resync interval (0 disables
+// periodic resyncs).
+func NewFollower(dbInst *db.Db, primaryURL, token string, resync time.Duration) *Follower {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Follower{
+		db:         dbInst,
+		primaryURL: strings.TrimRight(primaryURL, "/"),
+		token:      token,
+		resync:     resync,
+		client:     &http.Client{},
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// SetClient sets the HTTP client used to connect to the primary, which can
+// be used to connect through a proxy. It must be called before Start.
+func (f *Follower) SetClient(client *http.Client) {
+	f.client = client
+}
+
+// Start runs the follower in a goroutine until Stop is called
+func (f *Follower) Start() {
+	go func() {
+		for {
+			err := f.sync()
+			if err != nil && f.ctx.Err() == nil {
+				log.Println("Follower error, retrying: ", err)
+			}
+
+			select {
+			case <-time.After(5 * time.Second):
+			case <-f.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the follower
+func (f *Follower) Stop() {
+	f.cancel()
+}
+
+func (f *Follower) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, f.primaryURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(ctx)
+	if f.token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.token)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, errors.New("Server error: " + resp.Status + " " +
+			path + " " + string(body))
+	}
+
+	return resp, nil
+}
+
+// sync does a full restore from the primary and then applies changes
+// until the stream fails or it is time to resync
+func (f *Follower) sync() error {
+	ctx := f.ctx
+	if f.resync > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(f.ctx, f.resync)
+		defer cancel()
+	}
+
+	// subscribe before fetching the backup to narrow the window where
+	// changes can be missed
+	stream, err := f.get(ctx, "/v1/stream")
+	if err != nil {
+		return err
+	}
+	defer stream.Body.Close()
+
+	backup, err := f.get(ctx, "/admin/backup")
+	if err != nil {
+		return err
+	}
+
+	err = f.db.Restore(backup.Body)
+	backup.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	log.Println("Follower synced with ", f.primaryURL)
+
+	scanner := bufio.NewScanner(stream.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+
+		var e db.Event
+		err := json.Unmarshal([]byte(line[len("data: "):]), &e)
+		if err != nil {
+			log.Println("Follower error decoding event: ", err)
+			continue
+		}
+
+		err = f.db.ApplyEvent(e)
+		if err != nil {
+			log.Println("Follower error applying event: ", err)
+		}
+	}
+
+	if ctx.Err() != nil {
+		// resync interval expired or follower stopped
+		return nil
+	}
+
+	err = scanner.Err()
+	if err == nil {
+		err = errors.New("stream closed by primary")
+	}
+
+	return err
+}
@@ -0,0 +1,389 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/graphql"
+	"github.com/timshannon/bolthold"
+)
+
+// maxGraphQLRequest is the largest GraphQL request body that is accepted
+const maxGraphQLRequest = 1 << 20
+
+// GraphQL handles read only GraphQL queries, so dashboards can fetch
+// devices, groups, latest values, and history in one request
+type GraphQL struct {
+	schema *graphql.Schema
+}
+
+// graphqlGroup is a group of devices
+type graphqlGroup struct {
+	Name string
+}
+
+// graphqlTag is a device tag. Tags are returned as a list because
+// GraphQL objects have fixed fields.
+type graphqlTag struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// graphqlDeviceField, graphqlSampleField, and graphqlAlertField return
+// scalar fields of a device, sample, or alert
+func graphqlDeviceField(fn func(d *data.Device) interface{}) *graphql.Field {
+	return &graphql.Field{Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+		return fn(source.(*data.Device)), nil
+	}}
+}
+
+func graphqlSampleField(fn func(s *data.Sample) interface{}) *graphql.Field {
+	return &graphql.Field{Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+		return fn(source.(*data.Sample)), nil
+	}}
+}
+
+func graphqlAlertField(fn func(a *data.Alert) interface{}) *graphql.Field {
+	return &graphql.Field{Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+		return fn(source.(*data.Alert)), nil
+	}}
+}
+
+// graphqlTime parses an optional RFC3339 time argument
+func graphqlTime(args graphql.Args, name string, def time.Time) (time.Time, error) {
+	v, err := args.String(name)
+	if err != nil || v == "" {
+		return def, err
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// devicePtrs returns pointers to devices, which is what the device
+// resolvers expect
+func devicePtrs(devices []data.Device) []*data.Device {
+	ret := make([]*data.Device, len(devices))
+	for i := range devices {
+		ret[i] = &devices[i]
+	}
+	return ret
+}
+
+// samplePtrs returns pointers to samples
+func samplePtrs(samples []data.Sample) []*data.Sample {
+	ret := make([]*data.Sample, len(samples))
+	for i := range samples {
+		ret[i] = &samples[i]
+	}
+	return ret
+}
+
+// graphqlAlerts returns the alerts in state for a device, or for all
+// devices if deviceID is blank
+func graphqlAlerts(dbInst *db.Db, deviceID string, args graphql.Args) (interface{}, error) {
+	state, err := args.String("state")
+	if err != nil {
+		return nil, err
+	}
+
+	if state != "" {
+		err := data.ValidateAlertState(state)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	alerts, err := dbInst.Alerts(state)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []*data.Alert{}
+	for i := range alerts {
+		if deviceID == "" || alerts[i].DeviceID == deviceID {
+			ret = append(ret, &alerts[i])
+		}
+	}
+	return ret, nil
+}
+
+// newGraphQLSchema returns the schema for SIOT data
+func newGraphQLSchema(dbInst *db.Db) *graphql.Schema {
+	sample := &graphql.Object{Name: "Sample", Fields: map[string]*graphql.Field{
+		"type":     graphqlSampleField(func(s *data.Sample) interface{} { return s.Type }),
+		"id":       graphqlSampleField(func(s *data.Sample) interface{} { return s.ID }),
+		"value":    graphqlSampleField(func(s *data.Sample) interface{} { return s.Value }),
+		"min":      graphqlSampleField(func(s *data.Sample) interface{} { return s.Min }),
+		"max":      graphqlSampleField(func(s *data.Sample) interface{} { return s.Max }),
+		"time":     graphqlSampleField(func(s *data.Sample) interface{} { return s.Time }),
+		"duration": graphqlSampleField(func(s *data.Sample) interface{} { return s.Duration }),
+	}}
+
+	tag := &graphql.Object{Name: "Tag", Fields: map[string]*graphql.Field{
+		"key": {Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+			return source.(graphqlTag).Key, nil
+		}},
+		"value": {Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+			return source.(graphqlTag).Value, nil
+		}},
+	}}
+
+	alert := &graphql.Object{Name: "Alert", Fields: map[string]*graphql.Field{
+		"id":          graphqlAlertField(func(a *data.Alert) interface{} { return a.ID }),
+		"deviceId":    graphqlAlertField(func(a *data.Alert) interface{} { return a.DeviceID }),
+		"description": graphqlAlertField(func(a *data.Alert) interface{} { return a.Description }),
+		"message":     graphqlAlertField(func(a *data.Alert) interface{} { return a.Message }),
+		"state":       graphqlAlertField(func(a *data.Alert) interface{} { return a.State }),
+		"raised":      graphqlAlertField(func(a *data.Alert) interface{} { return a.Raised }),
+	}}
+
+	device := &graphql.Object{Name: "Device"}
+	device.Fields = map[string]*graphql.Field{
+		"id":          graphqlDeviceField(func(d *data.Device) interface{} { return d.ID }),
+		"description": graphqlDeviceField(func(d *data.Device) interface{} { return d.Config.Description }),
+		"groups": graphqlDeviceField(func(d *data.Device) interface{} {
+			if d.Config.Groups == nil {
+				return []string{}
+			}
+			return d.Config.Groups
+		}),
+		"parent": graphqlDeviceField(func(d *data.Device) interface{} { return d.Config.Parent }),
+		"tags": {Type: tag, Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+			d := source.(*data.Device)
+			ret := []graphqlTag{}
+			for k, v := range d.Config.Tags {
+				ret = append(ret, graphqlTag{k, v})
+			}
+			sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+			return ret, nil
+		}},
+		"ios": {Type: sample, Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+			return samplePtrs(source.(*data.Device).State.Ios), nil
+		}},
+		"io": {Type: sample, Args: []string{"type", "id"},
+			Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+				typ, err := args.String("type")
+				if err != nil {
+					return nil, err
+				}
+				id, err := args.String("id")
+				if err != nil {
+					return nil, err
+				}
+
+				ios := source.(*data.Device).State.Ios
+				for i := range ios {
+					if ios[i].Type == typ && ios[i].ID == id {
+						return &ios[i], nil
+					}
+				}
+				return nil, nil
+			}},
+		"history": {Type: sample, Args: []string{"start", "end", "resolution", "type", "id"},
+			Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+				end, err := graphqlTime(args, "end", time.Now())
+				if err != nil {
+					return nil, err
+				}
+				start, err := graphqlTime(args, "start", end.Add(-24*time.Hour))
+				if err != nil {
+					return nil, err
+				}
+				res, err := args.String("resolution")
+				if err != nil {
+					return nil, err
+				}
+				resolution, err := parseResolution(res)
+				if err != nil {
+					return nil, err
+				}
+				typ, err := args.String("type")
+				if err != nil {
+					return nil, err
+				}
+				id, err := args.String("id")
+				if err != nil {
+					return nil, err
+				}
+
+				samples, err := dbInst.SampleHistory(source.(*data.Device).ID,
+					start, end, resolution)
+				if err != nil {
+					return nil, err
+				}
+
+				ret := []*data.Sample{}
+				for i := range samples {
+					if (typ == "" || samples[i].Type == typ) &&
+						(id == "" || samples[i].ID == id) {
+						ret = append(ret, &samples[i])
+					}
+				}
+				return ret, nil
+			}},
+		"alerts": {Type: alert, Args: []string{"state"},
+			Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+				return graphqlAlerts(dbInst, source.(*data.Device).ID, args)
+			}},
+	}
+
+	group := &graphql.Object{Name: "Group", Fields: map[string]*graphql.Field{
+		"name": {Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+			return source.(*graphqlGroup).Name, nil
+		}},
+		"devices": {Type: device, Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+			devices, _, err := dbInst.DevicesFiltered(db.DeviceFilter{
+				Group: source.(*graphqlGroup).Name,
+			})
+			return devicePtrs(devices), err
+		}},
+	}}
+
+	// groups returns all groups devices are a member of
+	groups := func() ([]*graphqlGroup, error) {
+		devices, _, err := dbInst.DevicesFiltered(db.DeviceFilter{})
+		if err != nil {
+			return nil, err
+		}
+
+		names := make(map[string]bool)
+		for _, d := range devices {
+			for _, g := range d.Groups() {
+				names[g] = true
+			}
+		}
+
+		ret := []*graphqlGroup{}
+		for n := range names {
+			ret = append(ret, &graphqlGroup{Name: n})
+		}
+		sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+		return ret, nil
+	}
+
+	return &graphql.Schema{Query: &graphql.Object{Name: "Query", Fields: map[string]*graphql.Field{
+		"devices": {Type: device, Args: []string{"group", "tag", "io", "query", "offset", "limit"},
+			Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+				var filter db.DeviceFilter
+				var err error
+				for _, a := range []struct {
+					name string
+					v    *string
+				}{
+					{"group", &filter.Group},
+					{"tag", &filter.Tag},
+					{"io", &filter.Io},
+					{"query", &filter.Query},
+				} {
+					*a.v, err = args.String(a.name)
+					if err != nil {
+						return nil, err
+					}
+				}
+
+				filter.Offset, err = args.Int("offset")
+				if err != nil {
+					return nil, err
+				}
+				filter.Limit, err = args.Int("limit")
+				if err != nil {
+					return nil, err
+				}
+
+				devices, _, err := dbInst.DevicesFiltered(filter)
+				return devicePtrs(devices), err
+			}},
+		"device": {Type: device, Args: []string{"id"},
+			Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+				id, err := args.String("id")
+				if err != nil {
+					return nil, err
+				}
+
+				d, err := dbInst.Device(id)
+				if err == bolthold.ErrNotFound {
+					return nil, nil
+				} else if err != nil {
+					return nil, err
+				}
+				return &d, nil
+			}},
+		"groups": {Type: group, Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+			return groups()
+		}},
+		"group": {Type: group, Args: []string{"name"},
+			Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+				name, err := args.String("name")
+				if err != nil {
+					return nil, err
+				}
+
+				all, err := groups()
+				if err != nil {
+					return nil, err
+				}
+
+				for _, g := range all {
+					if g.Name == name {
+						return g, nil
+					}
+				}
+				return nil, nil
+			}},
+		"alerts": {Type: alert, Args: []string{"state"},
+			Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+				return graphqlAlerts(dbInst, "", args)
+			}},
+	}}}
+}
+
+func (h *GraphQL) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	var r graphql.Request
+
+	switch req.Method {
+	case http.MethodGet:
+		q := req.URL.Query()
+		r.Query = q.Get("query")
+		r.OperationName = q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			err := json.Unmarshal([]byte(v), &r.Variables)
+			if err != nil {
+				http.Error(res, "invalid variables: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	case http.MethodPost:
+		err := json.NewDecoder(http.MaxBytesReader(res, req.Body, maxGraphQLRequest)).Decode(&r)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(res, "only GET and POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Query == "" {
+		http.Error(res, "query is required", http.StatusBadRequest)
+		return
+	}
+
+	ret := h.schema.Execute(r)
+
+	res.Header().Set("Content-Type", "application/json")
+	if ret.Data == nil {
+		// the query could not be run
+		res.WriteHeader(http.StatusBadRequest)
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(ret)
+}
+
+// NewGraphQLHandler returns a new GraphQL query handler
+func NewGraphQLHandler(db *db.Db) http.Handler {
+	return &GraphQL{schema: newGraphQLSchema(db)}
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+// Groups handles requests for device groups
+type Groups struct {
+	db *db.Db
+}
+
+// groupRollback is posted to roll a group back to the configs it had at a
+// time
+type groupRollback struct {
+	Time time.Time `json:"time"`
+}
+
+// groupRollbackResponse is returned by a group rollback
+type groupRollbackResponse struct {
+	// Devices are the devices that were rolled back
+	Devices []string `json:"devices"`
+}
+
+// Top level handler for http requests to /v1/groups/<group>/config/rollback
+func (h *Groups) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	var group, head, sub string
+	group, req.URL.Path = ShiftPath(req.URL.Path)
+	head, req.URL.Path = ShiftPath(req.URL.Path)
+	sub, req.URL.Path = ShiftPath(req.URL.Path)
+
+	if group == "" || head != "config" || sub != "rollback" {
+		http.Error(res, "not found", http.StatusNotFound)
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		http.Error(res, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var r groupRollback
+	err := json.NewDecoder(req.Body).Decode(&r)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Time.IsZero() {
+		http.Error(res, "time is required", http.StatusBadRequest)
+		return
+	}
+
+	var ret groupRollbackResponse
+	err = h.db.Update(func(txn *db.Txn) error {
+		var err error
+		ret.Devices, err = txn.GroupConfigRollback(group, r.Time)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ret.Devices {
+			err := txn.AuditAppend(data.AuditRecord{
+				DeviceID: id,
+				Action:   "configRollback",
+				Message: "group " + group + " rolled back to " +
+					r.Time.UTC().Format(time.RFC3339),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(ret)
+}
+
+// NewGroupsHandler returns a new groups handler
+func NewGroupsHandler(db *db.Db) http.Handler {
+	return &Groups{db: db}
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/lorawan"
+)
+
+// maxUplink is the largest webhook body that is accepted. Uplinks include
+// gateway metadata, so they are much larger than the payload.
+const maxUplink = 64 << 10
+
+// Lorawan handles uplink webhooks from a LoRaWAN network server
+type Lorawan struct {
+	lorawan *lorawan.Integration
+}
+
+// Top level handler for http requests to /v1/lorawan/uplink
+func (h *Lorawan) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	var head string
+	head, req.URL.Path = ShiftPath(req.URL.Path)
+
+	if head != "uplink" || req.URL.Path != "/" {
+		http.Error(res, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if h.lorawan == nil {
+		http.Error(res, "LoRaWAN is not configured", http.StatusNotFound)
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		http.Error(res, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.lorawan.ValidToken(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")) {
+		http.Error(res, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	// ChirpStack posts all events to the same URL
+	if e := req.URL.Query().Get("event"); e != "" && e != "up" {
+		en := json.NewEncoder(res)
+		en.Encode(data.StandardResponse{Success: true})
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, maxUplink))
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.lorawan.HandleUplink("", body)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(data.StandardResponse{Success: true})
+}
+
+// NewLorawanHandler returns a new LoRaWAN webhook handler. lorawan is
+// optional.
+func NewLorawanHandler(lorawan *lorawan.Integration) http.Handler {
+	return &Lorawan{lorawan: lorawan}
+}
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/pki"
+	"github.com/timshannon/bolthold"
+)
+
+// MTLS serves the v1 API to devices that authenticate with a client
+// certificate. It must be served by a TLS listener that verifies client
+// certificates (see pki.ServerTLSConfig). Certificates must also be
+// recorded in the db and not revoked, and a device can only access its
+// own /v1/devices/<id> endpoints. Devices register without a certificate,
+// and rotate their certificate by posting a new CSR to
+// /v1/devices/<id>/cert.
+type MTLS struct {
+	db     *db.Db
+	signer pki.Signer
+	v1     http.Handler
+}
+
+// NewMTLSHandler returns a new mutual TLS handler that serves
+// authenticated requests with v1
+func NewMTLSHandler(dbInst *db.Db, signer pki.Signer, v1 http.Handler) http.Handler {
+	return &MTLS{db: dbInst, signer: signer, v1: v1}
+}
+
+func (h *MTLS) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	head, tail := ShiftPath(req.URL.Path)
+	if head != "v1" {
+		http.Error(res, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	req.URL.Path = tail
+	head, tail = ShiftPath(tail)
+
+	if head == "register" {
+		h.v1.ServeHTTP(res, req)
+		return
+	}
+
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		http.Error(res, "client certificate required", http.StatusUnauthorized)
+		return
+	}
+
+	cert := req.TLS.PeerCertificates[0]
+	id := pki.DeviceID(cert)
+
+	// the TLS listener checked the certificate was signed by the CA, and
+	// the db has the revocations
+	err := h.db.DeviceCertAuth(pki.Serial(cert), id)
+	if err == db.ErrInvalidCert {
+		http.Error(res, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	devID, tail := ShiftPath(tail)
+	if head != "devices" || devID != id {
+		http.Error(res, "device can only access its own endpoints",
+			http.StatusForbidden)
+		return
+	}
+
+	op, _ := ShiftPath(tail)
+	if op == "cert" {
+		if req.Method != http.MethodPost {
+			http.Error(res, "only POST allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		h.rotate(res, req, id)
+		return
+	}
+
+	h.v1.ServeHTTP(res, req)
+}
+
+// rotate issues a new certificate to a device. The old certificate stays
+// valid until it expires or is revoked, so the device can keep using it
+// until the new one is stored.
+func (h *MTLS) rotate(res http.ResponseWriter, req *http.Request, id string) {
+	var r data.CertRequest
+	err := json.NewDecoder(req.Body).Decode(&r)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	csr, err := pki.ParseCSR([]byte(r.CSR))
+	if err != nil {
+		http.Error(res, "invalid CSR: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	der, err := h.signer.Sign(csr, id)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = h.db.DeviceCertInsert(data.DeviceCert{
+		Serial:   pki.Serial(cert),
+		DeviceID: id,
+		Expires:  cert.NotAfter,
+	})
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(res).Encode(data.CertResponse{
+		Cert:   string(pki.EncodeCert(der)),
+		CACert: string(h.signer.CACert()),
+	})
+}
+
+// certRequests handles /admin/certs/<device id>[/<serial>]
+func (h *Admin) certRequests(res http.ResponseWriter, req *http.Request) {
+	var id, serial string
+	id, req.URL.Path = ShiftPath(req.URL.Path)
+	serial, _ = ShiftPath(req.URL.Path)
+
+	switch {
+	case id != "" && serial == "" && req.Method == http.MethodGet:
+		certs, err := h.db.DeviceCerts(id)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if certs == nil {
+			certs = []data.DeviceCert{}
+		}
+
+		json.NewEncoder(res).Encode(certs)
+	case id != "" && serial != "" && req.Method == http.MethodDelete:
+		certs, err := h.db.DeviceCerts(id)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		found := false
+		for _, c := range certs {
+			if c.Serial == serial {
+				found = true
+			}
+		}
+
+		if !found {
+			http.Error(res, "certificate not found", http.StatusNotFound)
+			return
+		}
+
+		err = h.db.DeviceCertRevoke(serial)
+		if err == bolthold.ErrNotFound {
+			http.Error(res, "certificate not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(res).Encode(data.StandardResponse{Success: true, ID: serial})
+	default:
+		http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+	}
+}
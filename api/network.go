@@ -0,0 +1,33 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/simpleiot/simpleiot/network"
+)
+
+// Network serves the status of the server's network manager
+type Network struct {
+	manager *network.Manager
+}
+
+// Top level handler for http requests to /v1/network
+func (h *Network) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" && req.URL.Path != "" {
+		http.Error(res, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if h.manager == nil {
+		http.Error(res, "network manager is not configured", http.StatusNotFound)
+		return
+	}
+
+	h.manager.ServeHTTP(res, req)
+}
+
+// NewNetworkHandler returns a new network status handler. manager is
+// optional.
+func NewNetworkHandler(manager *network.Manager) http.Handler {
+	return &Network{manager: manager}
+}
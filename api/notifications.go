@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/notify"
+)
+
+// Notifications handles notification requests
+type Notifications struct {
+	sms *notify.SMS
+}
+
+// smsStatusUpdate is a delivery status callback from an http SMS gateway
+type smsStatusUpdate struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+// processSMSStatus handles delivery status callbacks, which are form posts
+// from Twilio or JSON from http gateways
+func (h *Notifications) processSMSStatus(res http.ResponseWriter, req *http.Request) {
+	var update smsStatusUpdate
+
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(req.Body).Decode(&update)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		err := req.ParseForm()
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !h.sms.ValidSignature(req.PostForm,
+			req.Header.Get("X-Twilio-Signature")) {
+			http.Error(res, "invalid signature", http.StatusForbidden)
+			return
+		}
+
+		update = smsStatusUpdate{
+			ID:     req.PostForm.Get("MessageSid"),
+			Status: req.PostForm.Get("MessageStatus"),
+			Error:  req.PostForm.Get("ErrorCode"),
+		}
+	}
+
+	if update.ID == "" || update.Status == "" {
+		http.Error(res, "message id and status are required",
+			http.StatusBadRequest)
+		return
+	}
+
+	if !h.sms.UpdateStatus(update.ID, update.Status, update.Error) {
+		http.Error(res, "message not found", http.StatusNotFound)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(data.StandardResponse{Success: true, ID: update.ID})
+}
+
+// Top level handler for http requests to /v1/notifications/sms[/status]
+func (h *Notifications) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	var head string
+	head, req.URL.Path = ShiftPath(req.URL.Path)
+
+	if head != "sms" {
+		http.Error(res, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if h.sms == nil {
+		http.Error(res, "SMS notifications are not configured",
+			http.StatusNotFound)
+		return
+	}
+
+	head, req.URL.Path = ShiftPath(req.URL.Path)
+
+	switch {
+	case head == "" && req.Method == http.MethodGet:
+		en := json.NewEncoder(res)
+		en.Encode(h.sms.Statuses())
+	case head == "status" && req.Method == http.MethodPost:
+		h.processSMSStatus(res, req)
+	case head == "" || head == "status":
+		http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+	default:
+		http.Error(res, "Not Found", http.StatusNotFound)
+	}
+}
+
+// NewNotificationsHandler returns a new notifications handler. sms is
+// optional.
+func NewNotificationsHandler(sms *notify.SMS) http.Handler {
+	return &Notifications{sms: sms}
+}
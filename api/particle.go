@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/particle"
+)
+
+// maxParticleEvent is the largest webhook body that is accepted. Particle
+// event data is at most 1KB.
+const maxParticleEvent = 16 << 10
+
+// Particle handles webhooks from the Particle cloud
+type Particle struct {
+	particle *particle.Integration
+}
+
+// Top level handler for http requests to /v1/particle
+func (h *Particle) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" && req.URL.Path != "" {
+		http.Error(res, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if h.particle == nil {
+		http.Error(res, "Particle is not configured", http.StatusNotFound)
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		http.Error(res, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.particle.ValidToken(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")) {
+		http.Error(res, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	req.Body = http.MaxBytesReader(res, req.Body, maxParticleEvent)
+
+	// webhooks post a form by default, or JSON with the same fields
+	var e particle.Event
+	ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if ct == "application/json" {
+		err := json.NewDecoder(req.Body).Decode(&e)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		err := req.ParseForm()
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		e = particle.Event{
+			Name:   req.PostForm.Get("event"),
+			Data:   req.PostForm.Get("data"),
+			CoreID: req.PostForm.Get("coreid"),
+		}
+		e.Timestamp, _ = time.Parse(time.RFC3339, req.PostForm.Get("published_at"))
+	}
+
+	err := h.particle.HandleEvent(e)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(data.StandardResponse{Success: true})
+}
+
+// NewParticleHandler returns a new Particle webhook handler. particle is
+// optional.
+func NewParticleHandler(particle *particle.Integration) http.Handler {
+	return &Particle{particle: particle}
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+// Prometheus serves the latest device sample values, how long ago devices
+// were last seen, and open alerts in the Prometheus text format, so
+// existing Prometheus and Grafana stacks can alert on SIOT data. Devices
+// are labeled with their ID and groups. A device in several groups has
+// them sorted and comma separated in one label, so its series aren't
+// counted more than once.
+type Prometheus struct {
+	db    *db.Db
+	token string
+	// types are the sample types exported, or all if empty
+	types map[string]bool
+}
+
+// NewPrometheusHandler returns a new Prometheus exporter. If token is not
+// blank, scrapes must send it as a bearer token. Only samples of types are
+// exported, or all samples if types is empty.
+func NewPrometheusHandler(dbInst *db.Db, token string, types []string) http.Handler {
+	h := &Prometheus{db: dbInst, token: token}
+	if len(types) > 0 {
+		h.types = make(map[string]bool)
+		for _, t := range types {
+			h.types[t] = true
+		}
+	}
+
+	return h
+}
+
+// escapeLabel escapes a label value for the text format
+var escapeLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats label pairs, which are name then value
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// deviceGroups returns the group label of a device
+func deviceGroups(dev data.Device) string {
+	return strings.Join(dev.Groups(), ",")
+}
+
+func (h *Prometheus) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.token != "" && !data.TokenEqual(bearerToken(req), h.token) {
+		http.Error(res, "not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	devices, err := h.db.Devices()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	alerts, err := h.db.Alerts("")
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+
+	groups := make(map[string]string)
+	for _, dev := range devices {
+		groups[dev.ID] = deviceGroups(dev)
+	}
+
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w := bufio.NewWriter(res)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "# HELP siot_sample_value Latest value of a device sample.")
+	fmt.Fprintln(w, "# TYPE siot_sample_value gauge")
+	for _, dev := range devices {
+		for _, s := range dev.State.Ios {
+			if h.types != nil && !h.types[s.Type] {
+				continue
+			}
+
+			fmt.Fprintf(w, "siot_sample_value%v %v\n",
+				labels("device", dev.ID, "group", groups[dev.ID],
+					"type", s.Type, "id", s.ID), formatValue(s.Value))
+		}
+	}
+
+	now := time.Now()
+	fmt.Fprintln(w, "# HELP siot_device_last_seen_seconds Time since the newest sample of a device.")
+	fmt.Fprintln(w, "# TYPE siot_device_last_seen_seconds gauge")
+	for _, dev := range devices {
+		last := dev.LastSeen()
+		if last.IsZero() {
+			continue
+		}
+
+		fmt.Fprintf(w, "siot_device_last_seen_seconds%v %v\n",
+			labels("device", dev.ID, "group", groups[dev.ID]),
+			formatValue(now.Sub(last).Seconds()))
+	}
+
+	fmt.Fprintln(w, "# HELP siot_alert_open Alerts that are active or acknowledged.")
+	fmt.Fprintln(w, "# TYPE siot_alert_open gauge")
+	for _, a := range alerts {
+		if !a.Open() {
+			continue
+		}
+
+		fmt.Fprintf(w, "siot_alert_open%v 1\n",
+			labels("device", a.DeviceID, "group", groups[a.DeviceID],
+				"id", strconv.FormatUint(a.ID, 10),
+				"rule", strconv.FormatUint(a.RuleID, 10),
+				"alert", a.Description, "state", a.State))
+	}
+}
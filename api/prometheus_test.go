@@ -0,0 +1,160 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/db/dbtest"
+)
+
+// newPrometheusTestDb returns a db with two devices and an open and a
+// cleared alert
+func newPrometheusTestDb(t *testing.T) (*db.Db, func()) {
+	dbInst, cleanup := dbtest.New(t)
+
+	samples := []struct {
+		id     string
+		sample data.Sample
+	}{
+		{"1234", data.Sample{Type: "temp", Value: 21.5}},
+		{"1234", data.Sample{Type: "volt", ID: "a\"b\\c\nd", Value: 12}},
+		{"5678", data.Sample{Type: "temp", Value: -3}},
+	}
+
+	for _, s := range samples {
+		err := dbInst.DeviceSample(s.id, s.sample)
+		if err != nil {
+			cleanup()
+			t.Fatal("Error writing sample: ", err)
+		}
+	}
+
+	err := dbInst.DeviceUpdateConfig("1234", data.DeviceConfig{
+		Groups: []string{"pumps", "north"},
+	})
+	if err != nil {
+		cleanup()
+		t.Fatal("Error updating config: ", err)
+	}
+
+	_, err = dbInst.AlertRaise(data.Alert{RuleID: 1, DeviceID: "1234",
+		Description: "high temp"})
+	if err != nil {
+		cleanup()
+		t.Fatal("Error raising alert: ", err)
+	}
+
+	_, err = dbInst.AlertRaise(data.Alert{RuleID: 2, DeviceID: "5678",
+		Description: "low temp"})
+	if err != nil {
+		cleanup()
+		t.Fatal("Error raising alert: ", err)
+	}
+
+	err = dbInst.AlertClear(2, time.Now())
+	if err != nil {
+		cleanup()
+		t.Fatal("Error clearing alert: ", err)
+	}
+
+	return dbInst, cleanup
+}
+
+// scrape gets the metrics with token, and returns the status and body
+func scrape(t *testing.T, h http.Handler, token string) (int, string) {
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	body, err := ioutil.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal("Error reading body: ", err)
+	}
+
+	return rec.Code, string(body)
+}
+
+func TestPrometheus(t *testing.T) {
+	dbInst, cleanup := newPrometheusTestDb(t)
+	defer cleanup()
+
+	h := NewPrometheusHandler(dbInst, "", nil)
+
+	code, body := scrape(t, h, "")
+	if code != http.StatusOK {
+		t.Fatal("scrape failed: ", code, body)
+	}
+
+	exp := []string{
+		"# TYPE siot_sample_value gauge",
+		`siot_sample_value{device="1234",group="north,pumps",type="temp",id=""} 21.5`,
+		`siot_sample_value{device="1234",group="north,pumps",type="volt",id="a\"b\\c\nd"} 12`,
+		`siot_sample_value{device="5678",group="",type="temp",id=""} -3`,
+		"# TYPE siot_device_last_seen_seconds gauge",
+		`siot_device_last_seen_seconds{device="1234",group="north,pumps"} `,
+		"# TYPE siot_alert_open gauge",
+		`siot_alert_open{device="1234",group="north,pumps",id="1",rule="1",alert="high temp",state="active"} 1`,
+	}
+
+	for _, e := range exp {
+		if !strings.Contains(body, e) {
+			t.Errorf("output does not contain %q:\n%v", e, body)
+		}
+	}
+
+	// cleared alerts are not exported
+	if strings.Contains(body, "low temp") {
+		t.Errorf("cleared alert was exported:\n%v", body)
+	}
+}
+
+func TestPrometheusTypes(t *testing.T) {
+	dbInst, cleanup := newPrometheusTestDb(t)
+	defer cleanup()
+
+	h := NewPrometheusHandler(dbInst, "", []string{"volt"})
+
+	_, body := scrape(t, h, "")
+
+	if !strings.Contains(body, `type="volt"`) {
+		t.Errorf("volt samples not exported:\n%v", body)
+	}
+
+	if strings.Contains(body, `type="temp"`) {
+		t.Errorf("temp samples should not be exported:\n%v", body)
+	}
+}
+
+func TestPrometheusToken(t *testing.T) {
+	dbInst, cleanup := newPrometheusTestDb(t)
+	defer cleanup()
+
+	h := NewPrometheusHandler(dbInst, "secret", nil)
+
+	tests := []struct {
+		token string
+		code  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"secret", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		code, _ := scrape(t, h, test.token)
+		if code != test.code {
+			t.Errorf("token %q: status is %v, expected %v", test.token, code,
+				test.code)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/pki"
+)
+
+// Register handles device registration requests. A new device posts its ID
+// and claim code until it is claimed with the admin API, and then gets its
+// device key. Devices that authenticate with mutual TLS post a CSR, and
+// get a certificate instead.
+type Register struct {
+	db     *db.Db
+	signer pki.Signer
+}
+
+// Top level handler for http requests to /v1/register
+func (h *Register) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(res, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.db.ReadOnly() {
+		http.Error(res, db.ErrReadOnly.Error(), http.StatusForbidden)
+		return
+	}
+
+	var r data.RegisterRequest
+	err := json.NewDecoder(req.Body).Decode(&r)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.ID == "" || r.Code == "" {
+		http.Error(res, "id and code are required", http.StatusBadRequest)
+		return
+	}
+
+	if r.CSR != "" {
+		h.registerCert(res, r)
+		return
+	}
+
+	key, err := h.db.Register(r.ID, r.Code, r.Type)
+	switch {
+	case err == db.ErrNotClaimed:
+		res.WriteHeader(http.StatusAccepted)
+	case err == db.ErrInvalidCode:
+		http.Error(res, err.Error(), http.StatusForbidden)
+		return
+	case err == db.ErrRegistered:
+		http.Error(res, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(data.RegisterResponse{ID: r.ID, Key: key})
+}
+
+// registerCert registers a device that sent a CSR. The certificate is
+// issued once the device is claimed.
+func (h *Register) registerCert(res http.ResponseWriter, r data.RegisterRequest) {
+	if h.signer == nil {
+		http.Error(res, "device certificates are not enabled",
+			http.StatusBadRequest)
+		return
+	}
+
+	csr, err := pki.ParseCSR([]byte(r.CSR))
+	if err != nil {
+		http.Error(res, "invalid CSR: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var der []byte
+	_, err = h.db.RegisterCert(r.ID, r.Code, r.Type, func() (data.DeviceCert, error) {
+		var err error
+		der, err = h.signer.Sign(csr, r.ID)
+		if err != nil {
+			return data.DeviceCert{}, err
+		}
+
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return data.DeviceCert{}, err
+		}
+
+		return data.DeviceCert{Serial: pki.Serial(cert), Expires: cert.NotAfter}, nil
+	})
+
+	ret := data.RegisterResponse{ID: r.ID}
+
+	switch {
+	case err == db.ErrNotClaimed:
+		res.WriteHeader(http.StatusAccepted)
+	case err == db.ErrInvalidCode:
+		http.Error(res, err.Error(), http.StatusForbidden)
+		return
+	case err == db.ErrRegistered:
+		http.Error(res, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	default:
+		ret.Cert = string(pki.EncodeCert(der))
+		ret.CACert = string(h.signer.CACert())
+	}
+
+	json.NewEncoder(res).Encode(ret)
+}
+
+// NewRegisterHandler returns a new registration handler. Devices can't
+// enroll for certificates if signer is nil.
+func NewRegisterHandler(db *db.Db, signer pki.Signer) http.Handler {
+	return &Register{db: db, signer: signer}
+}
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/report"
+	"github.com/timshannon/bolthold"
+)
+
+// Reports handles scheduled report requests
+type Reports struct {
+	db       *db.Db
+	reporter *report.Reporter
+}
+
+// decodeReport reads and validates a report from the request body
+func decodeReport(res http.ResponseWriter, req *http.Request) (data.Report, bool) {
+	var r data.Report
+	err := json.NewDecoder(req.Body).Decode(&r)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return r, false
+	}
+
+	err = r.Validate()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return r, false
+	}
+
+	return r, true
+}
+
+func (h *Reports) processList(res http.ResponseWriter, req *http.Request) {
+	reports, err := h.db.Reports()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if reports == nil {
+		reports = []data.Report{}
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(reports)
+}
+
+func (h *Reports) processCreate(res http.ResponseWriter, req *http.Request) {
+	r, ok := decodeReport(res, req)
+	if !ok {
+		return
+	}
+
+	r, err := h.db.ReportInsert(r)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(r)
+}
+
+func (h *Reports) processUpdate(res http.ResponseWriter, req *http.Request, id uint64) {
+	r, ok := decodeReport(res, req)
+	if !ok {
+		return
+	}
+
+	r.ID = id
+	err := h.db.ReportUpdate(r)
+	if err == bolthold.ErrNotFound {
+		http.Error(res, "report not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(data.StandardResponse{Success: true, ID: strconv.FormatUint(id, 10)})
+}
+
+// processRun runs a report now
+func (h *Reports) processRun(res http.ResponseWriter, req *http.Request, id uint64) {
+	if req.Method != http.MethodPost {
+		http.Error(res, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.reporter == nil {
+		http.Error(res, "reports are not running", http.StatusServiceUnavailable)
+		return
+	}
+
+	f, err := h.reporter.Run(id)
+	if err == bolthold.ErrNotFound {
+		http.Error(res, "report not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	if f != nil {
+		en.Encode(f)
+		return
+	}
+	en.Encode(data.StandardResponse{Success: true, ID: strconv.FormatUint(id, 10)})
+}
+
+// processFiles lists the stored files of a report, or downloads one
+func (h *Reports) processFiles(res http.ResponseWriter, req *http.Request, id uint64) {
+	if req.Method != http.MethodGet {
+		http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var fileIDStr string
+	fileIDStr, req.URL.Path = ShiftPath(req.URL.Path)
+
+	if fileIDStr == "" {
+		files, err := h.db.ReportFiles(id)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if files == nil {
+			files = []data.ReportFile{}
+		}
+
+		en := json.NewEncoder(res)
+		en.Encode(files)
+		return
+	}
+
+	fileID, err := strconv.ParseUint(fileIDStr, 10, 64)
+	if err != nil {
+		http.Error(res, "invalid file id", http.StatusBadRequest)
+		return
+	}
+
+	f, err := h.db.ReportFile(fileID)
+	if err != nil || f.ReportID != id {
+		http.Error(res, "file not found", http.StatusNotFound)
+		return
+	}
+
+	b, err := h.db.ReportFileData(fileID)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	contentType := "text/csv"
+	if f.Format == data.ReportPDF {
+		contentType = "application/pdf"
+	}
+
+	res.Header().Set("Content-Type", contentType)
+	res.Header().Set("Content-Disposition", `attachment; filename="`+f.Name+`"`)
+	res.Write(b)
+}
+
+// Top level handler for http requests to
+// /v1/reports[/<id>[/run|/files[/<file id>]]]
+func (h *Reports) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && h.db.ReadOnly() {
+		http.Error(res, db.ErrReadOnly.Error(), http.StatusForbidden)
+		return
+	}
+
+	var idStr string
+	idStr, req.URL.Path = ShiftPath(req.URL.Path)
+
+	if idStr == "" {
+		switch req.Method {
+		case http.MethodGet:
+			h.processList(res, req)
+		case http.MethodPost:
+			h.processCreate(res, req)
+		default:
+			http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		http.Error(res, "invalid report id", http.StatusBadRequest)
+		return
+	}
+
+	var head string
+	head, req.URL.Path = ShiftPath(req.URL.Path)
+
+	switch head {
+	case "":
+	case "run":
+		h.processRun(res, req, id)
+		return
+	case "files":
+		h.processFiles(res, req, id)
+		return
+	default:
+		http.Error(res, "not found", http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		r, err := h.db.Report(id)
+		if err != nil {
+			http.Error(res, "report not found", http.StatusNotFound)
+			return
+		}
+
+		en := json.NewEncoder(res)
+		en.Encode(r)
+	case http.MethodPost, http.MethodPut:
+		h.processUpdate(res, req, id)
+	case http.MethodDelete:
+		err := h.db.ReportDelete(id)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en := json.NewEncoder(res)
+		en.Encode(data.StandardResponse{Success: true, ID: idStr})
+	default:
+		http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+	}
+}
+
+// NewReportsHandler returns a new reports handler. Reports can't be run on
+// demand if reporter is nil.
+func NewReportsHandler(db *db.Db, reporter *report.Reporter) http.Handler {
+	return &Reports{db: db, reporter: reporter}
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/timshannon/bolthold"
+)
+
+// Rules handles rule requests
+type Rules struct {
+	db *db.Db
+}
+
+// decodeRule reads and validates a rule from the request body
+func decodeRule(res http.ResponseWriter, req *http.Request) (data.Rule, bool) {
+	var rule data.Rule
+	err := json.NewDecoder(req.Body).Decode(&rule)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return rule, false
+	}
+
+	err = rule.Validate()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return rule, false
+	}
+
+	return rule, true
+}
+
+func (h *Rules) processList(res http.ResponseWriter, req *http.Request) {
+	rules, err := h.db.Rules()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if rules == nil {
+		rules = []data.Rule{}
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(rules)
+}
+
+func (h *Rules) processCreate(res http.ResponseWriter, req *http.Request) {
+	rule, ok := decodeRule(res, req)
+	if !ok {
+		return
+	}
+
+	rule, err := h.db.RuleInsert(rule)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(rule)
+}
+
+func (h *Rules) processUpdate(res http.ResponseWriter, req *http.Request, id uint64) {
+	rule, ok := decodeRule(res, req)
+	if !ok {
+		return
+	}
+
+	rule.ID = id
+	err := h.db.RuleUpdate(rule)
+	if err == bolthold.ErrNotFound {
+		http.Error(res, "rule not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(data.StandardResponse{Success: true, ID: strconv.FormatUint(id, 10)})
+}
+
+// Top level handler for http requests to /v1/rules[/<id>]
+func (h *Rules) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && h.db.ReadOnly() {
+		http.Error(res, db.ErrReadOnly.Error(), http.StatusForbidden)
+		return
+	}
+
+	var idStr string
+	idStr, req.URL.Path = ShiftPath(req.URL.Path)
+
+	if idStr == "" {
+		switch req.Method {
+		case http.MethodGet:
+			h.processList(res, req)
+		case http.MethodPost:
+			h.processCreate(res, req)
+		default:
+			http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		http.Error(res, "invalid rule id", http.StatusBadRequest)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		rule, err := h.db.Rule(id)
+		if err != nil {
+			http.Error(res, "rule not found", http.StatusNotFound)
+			return
+		}
+
+		en := json.NewEncoder(res)
+		en.Encode(rule)
+	case http.MethodPost, http.MethodPut:
+		h.processUpdate(res, req, id)
+	case http.MethodDelete:
+		err := h.db.RuleDelete(id)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en := json.NewEncoder(res)
+		en.Encode(data.StandardResponse{Success: true, ID: idStr})
+	default:
+		http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+	}
+}
+
+// NewRulesHandler returns a new rules handler
+func NewRulesHandler(db *db.Db) http.Handler {
+	return &Rules{db: db}
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/script"
+	"github.com/timshannon/bolthold"
+)
+
+// maxScriptRequest is the largest script, device config, or template that
+// is accepted. Configs have transform and virtual point expressions, so
+// this also limits the size of the scripts that are parsed.
+const maxScriptRequest = 1 << 20
+
+// Scripts handles script requests
+type Scripts struct {
+	db *db.Db
+}
+
+// decodeScript reads and validates a script from the request body. Scripts
+// with syntax errors are rejected.
+func decodeScript(res http.ResponseWriter, req *http.Request) (data.Script, bool) {
+	var s data.Script
+	err := json.NewDecoder(http.MaxBytesReader(res, req.Body, maxScriptRequest)).Decode(&s)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return s, false
+	}
+
+	err = s.Validate()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return s, false
+	}
+
+	_, err = script.Parse("script", s.Source)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return s, false
+	}
+
+	return s, true
+}
+
+func (h *Scripts) processList(res http.ResponseWriter, req *http.Request) {
+	scripts, err := h.db.Scripts()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if scripts == nil {
+		scripts = []data.Script{}
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(scripts)
+}
+
+func (h *Scripts) processCreate(res http.ResponseWriter, req *http.Request) {
+	s, ok := decodeScript(res, req)
+	if !ok {
+		return
+	}
+
+	s, err := h.db.ScriptInsert(s)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(s)
+}
+
+func (h *Scripts) processUpdate(res http.ResponseWriter, req *http.Request, id uint64) {
+	s, ok := decodeScript(res, req)
+	if !ok {
+		return
+	}
+
+	s.ID = id
+	err := h.db.ScriptUpdate(s)
+	if err == bolthold.ErrNotFound {
+		http.Error(res, "script not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(data.StandardResponse{Success: true, ID: strconv.FormatUint(id, 10)})
+}
+
+// Top level handler for http requests to /v1/scripts[/<id>]
+func (h *Scripts) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && h.db.ReadOnly() {
+		http.Error(res, db.ErrReadOnly.Error(), http.StatusForbidden)
+		return
+	}
+
+	var idStr string
+	idStr, req.URL.Path = ShiftPath(req.URL.Path)
+
+	if idStr == "" {
+		switch req.Method {
+		case http.MethodGet:
+			h.processList(res, req)
+		case http.MethodPost:
+			h.processCreate(res, req)
+		default:
+			http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		http.Error(res, "invalid script id", http.StatusBadRequest)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		s, err := h.db.Script(id)
+		if err != nil {
+			http.Error(res, "script not found", http.StatusNotFound)
+			return
+		}
+
+		en := json.NewEncoder(res)
+		en.Encode(s)
+	case http.MethodPost, http.MethodPut:
+		h.processUpdate(res, req, id)
+	case http.MethodDelete:
+		err := h.db.ScriptDelete(id)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en := json.NewEncoder(res)
+		en.Encode(data.StandardResponse{Success: true, ID: idStr})
+	default:
+		http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+	}
+}
+
+// NewScriptsHandler returns a new scripts handler
+func NewScriptsHandler(db *db.Db) http.Handler {
+	return &Scripts{db: db}
+}
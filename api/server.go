@@ -2,12 +2,22 @@ package api
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/lorawan"
+	"github.com/simpleiot/simpleiot/network"
+	"github.com/simpleiot/simpleiot/notify"
+	"github.com/simpleiot/simpleiot/oidc"
+	"github.com/simpleiot/simpleiot/particle"
+	"github.com/simpleiot/simpleiot/pki"
+	"github.com/simpleiot/simpleiot/report"
+	"github.com/simpleiot/simpleiot/tunnel"
 )
 
 // IndexHandler is used to serve the index page
@@ -36,7 +46,10 @@ type App struct {
 	PublicHandler http.Handler
 	IndexHandler  http.Handler
 	V1ApiHandler  http.Handler
-	Debug         bool
+	AdminHandler  http.Handler
+	// MetricsHandler is optional. If set, it serves /metrics.
+	MetricsHandler http.Handler
+	Debug          bool
 }
 
 // Top level handler for http requests in the coap-server process
@@ -56,34 +69,145 @@ func (h *App) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 			h.PublicHandler.ServeHTTP(res, req)
 		case "v1":
 			h.V1ApiHandler.ServeHTTP(res, req)
+		case "admin":
+			h.AdminHandler.ServeHTTP(res, req)
+		case "metrics":
+			if h.MetricsHandler == nil {
+				http.Error(res, "Not Found", http.StatusNotFound)
+				return
+			}
+			h.MetricsHandler.ServeHTTP(res, req)
 		default:
 			http.Error(res, "Not Found", http.StatusNotFound)
 		}
 	}
 }
 
+// ServerArgs can be used to pass arguments to the server subsystem
+type ServerArgs struct {
+	Port   string
+	DbInst *db.Db
+	Influx *db.Influx
+	// Ingest is optional. If set, posted samples are queued and written
+	// by the ingest workers.
+	Ingest     *db.IngestQueue
+	GetAsset   func(string) []byte
+	Filesystem http.FileSystem
+	Debug      bool
+	// AdminToken is required to access the /admin API. The admin API is
+	// disabled if this is blank.
+	AdminToken string
+	// SMS is optional. If set, message delivery status is served and
+	// updated at /v1/notifications/sms.
+	SMS *notify.SMS
+	// FirmwareKeys are the keys uploaded firmware must be signed with.
+	// Firmware uploads are disabled if there are none.
+	FirmwareKeys []ed25519.PublicKey
+	// Tunnels is optional. If set, devices can open tunnel sessions for
+	// support engineers.
+	Tunnels *tunnel.Hub
+	// Lorawan is optional. If set, LoRaWAN network servers can post
+	// uplinks to /v1/lorawan/uplink.
+	Lorawan *lorawan.Integration
+	// Particle is optional. If set, Particle webhooks can post events to
+	// /v1/particle.
+	Particle *particle.Integration
+	// Network is optional. If set, the status of the server's network
+	// manager is served at /v1/network.
+	Network *network.Manager
+	// Tenants is optional. If set, v1 API requests are served from the db
+	// of the tenant whose user token is sent, see Tenancy.
+	Tenants *db.Tenants
+	// SessionTTL enables local auth if it is set. Users must then log in
+	// to use the v1 API, see Auth. Sessions last SessionTTL if not used,
+	// and SessionMaxAge in any case.
+	SessionTTL    time.Duration
+	SessionMaxAge time.Duration
+	// OIDC is optional. If set with local auth, users can log in with an
+	// OpenID Connect identity provider.
+	OIDC *oidc.Provider
+	// Signer is optional. If set, devices can enroll for client
+	// certificates when they register.
+	Signer pki.Signer
+	// MTLSListen is the address of the mutual TLS listener for devices
+	// with certificates, which is served with MTLSCert and MTLSKey. It
+	// requires a Signer.
+	MTLSListen string
+	MTLSCert   string
+	MTLSKey    string
+	// Prometheus serves device data as Prometheus metrics at /metrics.
+	// Scrapes must send PrometheusToken if it is set, and only samples of
+	// PrometheusTypes are exported, or all if it is empty.
+	Prometheus      bool
+	PrometheusToken string
+	PrometheusTypes []string
+	// Reporter is optional. If set, reports can be run on demand at
+	// /v1/reports/<id>/run.
+	Reporter *report.Reporter
+}
+
 // NewAppHandler returns a new application (root) http handler
-func NewAppHandler(db *db.Db, influx *db.Influx, getAsset func(string) []byte,
-	filesystem http.FileSystem, debug bool) http.Handler {
-	return &App{
-		PublicHandler: http.FileServer(filesystem),
-		IndexHandler:  NewIndexHandler(getAsset),
-		V1ApiHandler:  NewV1Handler(db, influx),
-		Debug:         debug,
+func NewAppHandler(args ServerArgs) http.Handler {
+	v1 := NewV1Handler(args)
+	admin := NewAdminHandler(args.DbInst, args.Influx, args.Ingest, args.AdminToken,
+		args.Tunnels, args.Tenants, args.SessionTTL)
+
+	if args.Tenants != nil {
+		// tenants don't share the server's ingest queue, influxdb,
+		// notifications, tunnels, LoRaWAN or Particle integrations, or
+		// reporter
+		v1 = NewTenancyHandler(args.DbInst, args.Tenants, args.AdminToken, v1,
+			func(tdb *db.Db) http.Handler {
+				return NewV1Handler(ServerArgs{DbInst: tdb,
+					FirmwareKeys: args.FirmwareKeys})
+			})
+	} else if args.SessionTTL > 0 {
+		v1 = NewAuthHandler(args.DbInst, args.AdminToken, args.SessionTTL,
+			args.SessionMaxAge, args.OIDC, v1)
 	}
+
+	var metrics http.Handler
+	if args.Prometheus {
+		metrics = NewPrometheusHandler(args.DbInst, args.PrometheusToken,
+			args.PrometheusTypes)
+	}
+
+	return traceHandler(&App{
+		PublicHandler:  http.FileServer(args.Filesystem),
+		IndexHandler:   NewIndexHandler(args.GetAsset),
+		V1ApiHandler:   v1,
+		AdminHandler:   admin,
+		MetricsHandler: metrics,
+		Debug:          args.Debug,
+	})
 }
 
 // Server starts a API server instance
-func Server(
-	port string,
-	dbInst *db.Db,
-	influx *db.Influx,
-	getAsset func(string) []byte,
-	filesystem http.FileSystem,
-	debug bool) error {
-
-	log.Println("Starting http server, debug: ", debug)
-	log.Println("Starting portal on port: ", port)
-	address := fmt.Sprintf(":%s", port)
-	return http.ListenAndServe(address, NewAppHandler(dbInst, influx, getAsset, filesystem, debug))
+func Server(args ServerArgs) error {
+	log.Println("Starting http server, debug: ", args.Debug)
+	log.Println("Starting portal on port: ", args.Port)
+	address := fmt.Sprintf(":%s", args.Port)
+
+	if args.MTLSListen != "" {
+		tlsConfig, err := pki.ServerTLSConfig(args.Signer)
+		if err != nil {
+			return err
+		}
+
+		server := &http.Server{
+			Addr: args.MTLSListen,
+			Handler: traceHandler(NewMTLSHandler(args.DbInst, args.Signer,
+				NewV1Handler(args))),
+			TLSConfig: tlsConfig,
+		}
+
+		log.Println("Starting device mTLS listener on: ", args.MTLSListen)
+
+		go func() {
+			err := server.ListenAndServeTLS(args.MTLSCert, args.MTLSKey)
+			log.Println("Device mTLS listener stopped: ", err)
+		}()
+	}
+
+	return http.ListenAndServe(address, NewAppHandler(args))
 }
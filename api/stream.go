@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/simpleiot/simpleiot/db"
+)
+
+// Stream sends db change events to clients as server-sent events
+type Stream struct {
+	db *db.Db
+}
+
+func (h *Stream) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		http.Error(res, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events := h.db.Subscribe(db.EventFilter{
+		DeviceID: req.URL.Query().Get("device"),
+	})
+	defer h.db.Unsubscribe(events)
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+
+	for {
+		select {
+		case e := <-events:
+			d, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+
+			_, err = fmt.Fprintf(res, "event: %v\ndata: %s\n\n", e.Type, d)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// NewStreamHandler returns a new server-sent events handler for db changes
+func NewStreamHandler(db *db.Db) http.Handler {
+	return &Stream{db: db}
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/timshannon/bolthold"
+)
+
+// Templates handles device template requests
+type Templates struct {
+	db *db.Db
+}
+
+// templateRolloutResponse is returned by a template rollout
+type templateRolloutResponse struct {
+	// Devices are the devices whose config changed
+	Devices []string `json:"devices"`
+}
+
+func (h *Templates) processList(res http.ResponseWriter, req *http.Request) {
+	templates, err := h.db.Templates()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if templates == nil {
+		templates = []data.DeviceTemplate{}
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(templates)
+}
+
+func (h *Templates) processSet(res http.ResponseWriter, req *http.Request, typ string) {
+	var t data.DeviceTemplate
+	err := json.NewDecoder(http.MaxBytesReader(res, req.Body, maxScriptRequest)).Decode(&t)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t.Type = typ
+
+	err = t.Validate()
+	if err == nil {
+		err = ValidateConfig(t.Config)
+	}
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t, err = h.db.TemplateSet(t)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(t)
+}
+
+// processRollout applies a template to the devices of its type
+func (h *Templates) processRollout(res http.ResponseWriter, req *http.Request, typ string) {
+	var ret templateRolloutResponse
+	err := h.db.Update(func(txn *db.Txn) error {
+		var err error
+		ret.Devices, err = txn.TemplateRollout(typ)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ret.Devices {
+			err := txn.AuditAppend(data.AuditRecord{
+				DeviceID: id,
+				Action:   "templateRollout",
+				Message:  "applied template " + typ,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err == bolthold.ErrNotFound {
+		http.Error(res, "template not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(ret)
+}
+
+func (h *Templates) processInstances(res http.ResponseWriter, req *http.Request, typ string) {
+	instances, err := h.db.TemplateInstances(typ)
+	if err == bolthold.ErrNotFound {
+		http.Error(res, "template not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(instances)
+}
+
+// Top level handler for http requests to
+// /v1/templates[/<type>[/rollout|instances]]
+func (h *Templates) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && h.db.ReadOnly() {
+		http.Error(res, db.ErrReadOnly.Error(), http.StatusForbidden)
+		return
+	}
+
+	var typ, op string
+	typ, req.URL.Path = ShiftPath(req.URL.Path)
+	op, req.URL.Path = ShiftPath(req.URL.Path)
+
+	switch {
+	case typ == "" && req.Method == http.MethodGet:
+		h.processList(res, req)
+	case typ == "":
+		http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+	case op == "rollout" && req.Method == http.MethodPost:
+		h.processRollout(res, req, typ)
+	case op == "instances" && req.Method == http.MethodGet:
+		h.processInstances(res, req, typ)
+	case op != "":
+		http.Error(res, "not found", http.StatusNotFound)
+	case req.Method == http.MethodGet:
+		t, err := h.db.Template(typ)
+		if err != nil {
+			http.Error(res, "template not found", http.StatusNotFound)
+			return
+		}
+
+		en := json.NewEncoder(res)
+		en.Encode(t)
+	case req.Method == http.MethodPost || req.Method == http.MethodPut:
+		h.processSet(res, req, typ)
+	case req.Method == http.MethodDelete:
+		err := h.db.TemplateDelete(typ)
+		if err == bolthold.ErrNotFound {
+			http.Error(res, "template not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en := json.NewEncoder(res)
+		en.Encode(data.StandardResponse{Success: true, ID: typ})
+	default:
+		http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+	}
+}
+
+// NewTemplatesHandler returns a new device templates handler
+func NewTemplatesHandler(db *db.Db) http.Handler {
+	return &Templates{db: db}
+}
@@ -0,0 +1,267 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/timshannon/bolthold"
+)
+
+// Tenancy routes v1 API requests to the db of the tenant whose user token
+// is in the "Authorization: Bearer <token>" header. Requests with the
+// admin token are served from the server db, and all other requests are
+// rejected, so a tenant can only reach its own data.
+type Tenancy struct {
+	db      *db.Db
+	tenants *db.Tenants
+	token   string
+	server  http.Handler
+	newV1   func(*db.Db) http.Handler
+
+	lock     sync.Mutex
+	handlers map[string]tenantHandler
+}
+
+// tenantHandler is the v1 handler of an open tenant db
+type tenantHandler struct {
+	db      *db.Db
+	handler http.Handler
+}
+
+// NewTenancyHandler returns a new tenancy handler. server is the v1
+// handler of the server db, and newV1 creates the v1 handler of a tenant
+// db.
+func NewTenancyHandler(dbInst *db.Db, tenants *db.Tenants, token string,
+	server http.Handler, newV1 func(*db.Db) http.Handler) http.Handler {
+	return &Tenancy{
+		db:       dbInst,
+		tenants:  tenants,
+		token:    token,
+		server:   server,
+		newV1:    newV1,
+		handlers: make(map[string]tenantHandler),
+	}
+}
+
+// handler returns the v1 handler of a tenant. Tenant dbs are closed when
+// the tenant is deleted, so the handler is recreated if the db changed.
+func (h *Tenancy) handler(id string) (http.Handler, error) {
+	tdb, err := h.tenants.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	th, ok := h.handlers[id]
+	if !ok || th.db != tdb {
+		th = tenantHandler{db: tdb, handler: h.newV1(tdb)}
+		h.handlers[id] = th
+	}
+
+	return th.handler, nil
+}
+
+func (h *Tenancy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	auth := req.Header.Get("Authorization")
+
+	// LoRaWAN and Particle webhooks authenticate with their own tokens
+	head, _ := ShiftPath(req.URL.Path)
+	if head == "lorawan" || head == "particle" || data.TokenEqual(bearerToken(req), h.token) {
+		h.server.ServeHTTP(res, req)
+		return
+	}
+
+	if !strings.HasPrefix(auth, "Bearer ") {
+		http.Error(res, "not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.db.TenantAuth(strings.TrimPrefix(auth, "Bearer "))
+	if err == db.ErrInvalidToken {
+		http.Error(res, "not authorized", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if req.Method != http.MethodGet && !user.CanWrite() {
+		http.Error(res, "read only user", http.StatusForbidden)
+		return
+	}
+
+	handler, err := h.handler(user.TenantID)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	handler.ServeHTTP(res, req)
+}
+
+// tenantResponse is returned when reading a tenant
+type tenantResponse struct {
+	data.Tenant
+	Usage usageResponse `json:"usage"`
+}
+
+// tenantUserResponse is returned when a tenant user is created. It is
+// the only time the token is returned.
+type tenantUserResponse struct {
+	data.TenantUser
+	Token string `json:"token"`
+}
+
+// tenantRequests handles /admin/tenants[/<id>[/users[/<user id>]]]
+func (h *Admin) tenantRequests(res http.ResponseWriter, req *http.Request) {
+	if h.tenants == nil {
+		http.Error(res, "tenants are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var id, op, userID string
+	id, req.URL.Path = ShiftPath(req.URL.Path)
+	op, req.URL.Path = ShiftPath(req.URL.Path)
+	userID, _ = ShiftPath(req.URL.Path)
+
+	en := json.NewEncoder(res)
+
+	switch {
+	case id == "" && req.Method == http.MethodGet:
+		tenants, err := h.db.TenantList()
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if tenants == nil {
+			tenants = []data.Tenant{}
+		}
+
+		en.Encode(tenants)
+	case id == "" && req.Method == http.MethodPost:
+		var t data.Tenant
+		err := json.NewDecoder(req.Body).Decode(&t)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		t, err = h.db.TenantInsert(t)
+		switch err {
+		case nil:
+		case db.ErrInvalidTenant:
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		case db.ErrTenantExists:
+			http.Error(res, err.Error(), http.StatusConflict)
+			return
+		default:
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// create the tenant's storage
+		_, err = h.tenants.Get(t.ID)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en.Encode(t)
+	case id != "" && op == "" && req.Method == http.MethodGet:
+		t, err := h.db.Tenant(id)
+		if err == bolthold.ErrNotFound {
+			http.Error(res, "tenant not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		tdb, err := h.tenants.Get(id)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en.Encode(tenantResponse{Tenant: t, Usage: usageResponse{
+			UsageReport: tdb.Usage(),
+			Limits:      tdb.UsageLimits(),
+		}})
+	case id != "" && op == "" && req.Method == http.MethodDelete:
+		err := h.db.TenantDelete(id)
+		if err == bolthold.ErrNotFound {
+			http.Error(res, "tenant not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = h.tenants.Delete(id)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en.Encode(data.StandardResponse{Success: true, ID: id})
+	case id != "" && op == "users" && userID == "" && req.Method == http.MethodGet:
+		users, err := h.db.TenantUsers(id)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if users == nil {
+			users = []data.TenantUser{}
+		}
+
+		en.Encode(users)
+	case id != "" && op == "users" && userID == "" && req.Method == http.MethodPost:
+		var u data.TenantUser
+		err := json.NewDecoder(req.Body).Decode(&u)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		u.TenantID = id
+		token, u, err := h.db.TenantUserCreate(u)
+		if err == bolthold.ErrNotFound {
+			http.Error(res, "tenant not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		en.Encode(tenantUserResponse{TenantUser: u, Token: token})
+	case id != "" && op == "users" && userID != "" && req.Method == http.MethodDelete:
+		uid, err := strconv.ParseUint(userID, 10, 64)
+		if err != nil {
+			http.Error(res, "invalid user id", http.StatusBadRequest)
+			return
+		}
+
+		err = h.db.TenantUserDelete(id, uid)
+		if err == bolthold.ErrNotFound {
+			http.Error(res, "user not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en.Encode(data.StandardResponse{Success: true})
+	default:
+		http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/simpleiot/simpleiot/trace"
+)
+
+// statusRecorder records the status of a response for the request span.
+// Flush and Hijack are passed through for streams and websockets.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response can't be hijacked")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// spanName returns a span name with the method and the first two levels
+// of the path, like "HTTP POST /v1/devices", so device IDs don't make
+// every request name unique
+func spanName(req *http.Request) string {
+	parts := strings.SplitN(strings.Trim(req.URL.Path, "/"), "/", 3)
+	if len(parts) > 2 {
+		parts = parts[:2]
+	}
+	return "HTTP " + req.Method + " /" + strings.Join(parts, "/")
+}
+
+// traceHandler starts a span for each request. The trace of the client is
+// continued if it sends a traceparent header.
+func traceHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctx := trace.Extract(req.Context(), req.Header)
+		ctx, span := trace.Start(ctx, spanName(req), trace.KindServer,
+			trace.Attr{Key: "http.method", Value: req.Method},
+			trace.Attr{Key: "http.target", Value: req.URL.Path})
+		if span == nil {
+			h.ServeHTTP(res, req)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: res}
+		h.ServeHTTP(rec, req.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttr("http.status_code", rec.status)
+
+		var err error
+		if rec.status >= 500 {
+			err = errors.New(http.StatusText(rec.status))
+		}
+		span.End(&err)
+	})
+}
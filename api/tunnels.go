@@ -0,0 +1,190 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/tunnel"
+	"github.com/timshannon/bolthold"
+)
+
+// default and max tunnel session duration
+const (
+	defaultTunnelDuration = 30 * time.Minute
+	maxTunnelDuration     = 8 * time.Hour
+)
+
+// tunnelRequest is the body of a request to open a tunnel session
+type tunnelRequest struct {
+	DeviceID string `json:"deviceId"`
+	Port     int    `json:"port"`
+	Reason   string `json:"reason"`
+	// Duration is a Go duration (default 30m, max 8h)
+	Duration string `json:"duration"`
+}
+
+// tunnelCreate opens a tunnel session. user is the authenticated admin, who
+// is recorded as the user of the session.
+func (h *Admin) tunnelCreate(res http.ResponseWriter, req *http.Request, user string) {
+	var r tunnelRequest
+	err := json.NewDecoder(req.Body).Decode(&r)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	duration := defaultTunnelDuration
+	if r.Duration != "" {
+		duration, err = time.ParseDuration(r.Duration)
+		if err != nil || duration <= 0 || duration > maxTunnelDuration {
+			http.Error(res, "invalid duration, max is "+maxTunnelDuration.String(),
+				http.StatusBadRequest)
+			return
+		}
+	}
+
+	s := data.TunnelSession{
+		DeviceID: r.DeviceID,
+		Port:     r.Port,
+		User:     user,
+		Reason:   r.Reason,
+		Ends:     time.Now().Add(duration),
+	}
+
+	err = s.Validate()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = h.db.Device(s.DeviceID)
+	if err != nil {
+		http.Error(res, "device not found", http.StatusNotFound)
+		return
+	}
+
+	s, _, err = h.db.TunnelCreate(s)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	en := json.NewEncoder(res)
+	en.Encode(s)
+}
+
+// tunnelSessions handles /admin/tunnels[/<id>[/connect]]
+func (h *Admin) tunnelSessions(res http.ResponseWriter, req *http.Request, user string) {
+	if h.tunnels == nil {
+		http.Error(res, "tunnels are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var idStr, op string
+	idStr, req.URL.Path = ShiftPath(req.URL.Path)
+	op, _ = ShiftPath(req.URL.Path)
+
+	en := json.NewEncoder(res)
+
+	if idStr == "" {
+		switch req.Method {
+		case http.MethodGet:
+			sessions, err := h.db.Tunnels()
+			if err != nil {
+				http.Error(res, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			ret := []data.TunnelSession{}
+			device := req.URL.Query().Get("device")
+			for _, s := range sessions {
+				if device == "" || s.DeviceID == device {
+					ret = append(ret, s)
+				}
+			}
+
+			en.Encode(ret)
+		case http.MethodPost:
+			h.tunnelCreate(res, req, user)
+		default:
+			http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		http.Error(res, "invalid tunnel id", http.StatusBadRequest)
+		return
+	}
+
+	s, err := h.db.Tunnel(id)
+	if err == bolthold.ErrNotFound {
+		http.Error(res, "tunnel session not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case op == "connect" && req.Method == http.MethodGet:
+		if s.State == data.TunnelClosed {
+			http.Error(res, db.ErrTunnelClosed.Error(), http.StatusGone)
+			return
+		}
+
+		h.tunnels.ServeClient(res, req, id)
+	case op != "":
+		http.Error(res, "Not Found", http.StatusNotFound)
+	case req.Method == http.MethodGet:
+		en.Encode(s)
+	case req.Method == http.MethodDelete:
+		err := h.tunnels.Close(id, "closed by admin")
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		en.Encode(data.StandardResponse{Success: true, ID: idStr})
+	default:
+		http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+	}
+}
+
+// Tunnels handles the websocket devices open for tunnel sessions
+type Tunnels struct {
+	hub *tunnel.Hub
+}
+
+// Top level handler for http requests to /v1/tunnels/<id>
+func (h *Tunnels) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if h.hub == nil {
+		http.Error(res, "tunnels are not enabled", http.StatusNotFound)
+		return
+	}
+
+	idStr, _ := ShiftPath(req.URL.Path)
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		http.Error(res, "invalid tunnel id", http.StatusBadRequest)
+		return
+	}
+
+	if req.Method != http.MethodGet {
+		http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.hub.ServeDevice(res, req, id)
+}
+
+// NewTunnelsHandler returns a new tunnels handler. Tunnels are disabled
+// if hub is nil.
+func NewTunnelsHandler(hub *tunnel.Hub) http.Handler {
+	return &Tunnels{hub: hub}
+}
@@ -0,0 +1,326 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+// upstreamBatch is the most samples synced in one batch
+const upstreamBatch = 500
+
+// Upstream syncs an edge server to an upstream (cloud) server, so devices
+// connected to the edge show up on the upstream server. Samples are synced
+// in the order they were written, and the position is stored in the db,
+// so the backlog is uploaded after an outage. Config changes and commands
+// from the upstream server are applied to the edge devices, and the
+// config edge devices report is synced upstream.
+//
+// If the config of a device changes on both servers between syncs, the
+// upstream config wins. Devices that only exist upstream are not synced.
+type Upstream struct {
+	db       *db.Db
+	url      string
+	token    string
+	id       string
+	interval time.Duration
+	client   *http.Client
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// NewUpstream creates a new upstream sync to the server at url. token is
+// sent as a bearer token. id names this server in the SyncTag of synced
+// samples.
+func NewUpstream(dbInst *db.Db, url, token, id string, interval time.Duration) *Upstream {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Upstream{
+		db:       dbInst,
+		url:      strings.TrimRight(url, "/"),
+		token:    token,
+		id:       id,
+		interval: interval,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// SetClient sets the HTTP client used to connect to the upstream server,
+// which can be used to connect through a proxy. It must be called before
+// Start.
+func (u *Upstream) SetClient(client *http.Client) {
+	u.client = client
+}
+
+// Start syncs every interval in a goroutine until Stop is called
+func (u *Upstream) Start() {
+	go func() {
+		for {
+			err := u.Sync()
+			if err != nil && u.ctx.Err() == nil {
+				log.Println("Upstream sync error, retrying: ", err)
+			}
+
+			select {
+			case <-time.After(u.interval):
+			case <-u.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops syncing
+func (u *Upstream) Stop() {
+	u.cancel()
+}
+
+// Sync syncs the samples and devices once
+func (u *Upstream) Sync() error {
+	mark, err := u.db.UpstreamMark()
+	if err != nil {
+		return err
+	}
+
+	if mark.Store == "" {
+		b := make([]byte, 8)
+		_, err := rand.Read(b)
+		if err != nil {
+			return err
+		}
+		mark.Store = hex.EncodeToString(b)
+	}
+
+	err = u.syncSamples(&mark)
+	if err != nil {
+		return err
+	}
+
+	devices, err := u.db.Devices()
+	if err != nil {
+		return err
+	}
+
+	states := make(map[string]db.DeviceSyncState)
+	for _, dev := range devices {
+		state := mark.Devices[dev.ID]
+		err := u.syncDevice(dev, &state)
+		if err != nil {
+			log.Printf("Upstream error syncing device %v: %v\n", dev.ID, err)
+		}
+		states[dev.ID] = state
+	}
+
+	mark.Devices = states
+	return u.db.SetUpstreamMark(mark)
+}
+
+// syncSamples uploads the samples written since the mark. Batches are
+// numbered with the sequence of their last sample, so batches that are
+// sent again are skipped by the upstream server.
+func (u *Upstream) syncSamples(mark *db.UpstreamMark) error {
+	for u.ctx.Err() == nil {
+		samples, err := u.db.SamplesAfter(mark.Seq, upstreamBatch)
+		if err != nil {
+			return err
+		}
+
+		if len(samples) == 0 {
+			return nil
+		}
+
+		var ids []string
+		batches := make(map[string]*data.SampleBatch)
+		for _, w := range samples {
+			b, ok := batches[w.DeviceID]
+			if !ok {
+				b = &data.SampleBatch{Store: u.id + "-" + mark.Store}
+				batches[w.DeviceID] = b
+				ids = append(ids, w.DeviceID)
+			}
+
+			s := w.Sample
+			// samples synced from another edge keep their tag
+			if s.Tags[data.SyncTag] == "" {
+				tags := map[string]string{data.SyncTag: u.id}
+				for k, v := range s.Tags {
+					tags[k] = v
+				}
+				s.Tags = tags
+			}
+
+			b.Seq = w.Seq
+			b.Samples = append(b.Samples, s)
+		}
+
+		for _, id := range ids {
+			_, err := u.request(http.MethodPost, "/v1/devices/"+id+"/batch",
+				batches[id], nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		mark.Seq = samples[len(samples)-1].Seq
+		err = u.db.SetUpstreamMark(*mark)
+		if err != nil {
+			return err
+		}
+
+		if len(samples) < upstreamBatch {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// syncDevice syncs the config and commands of a device
+func (u *Upstream) syncDevice(dev data.Device, state *db.DeviceSyncState) error {
+	var up data.Device
+	status, err := u.request(http.MethodGet, "/v1/devices/"+dev.ID, nil, &up)
+	if status == http.StatusNotFound {
+		// the device is created upstream when its samples are synced
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if jsonEqual(dev.Config, up.Config) {
+		state.LocalConfig = dev.State.ConfigUpdated
+		state.UpstreamConfig = up.State.ConfigUpdated
+	} else {
+		localChanged := !dev.State.ConfigUpdated.Equal(state.LocalConfig)
+		upChanged := !up.State.ConfigUpdated.Equal(state.UpstreamConfig)
+
+		// the times are recorded on the next sync, when the configs match
+		switch {
+		case upChanged:
+			if localChanged {
+				log.Printf("Upstream config conflict for device %v, using upstream config\n",
+					dev.ID)
+			}
+
+			err := u.db.DeviceUpdateConfig(dev.ID, up.Config)
+			if err != nil {
+				return err
+			}
+		case localChanged:
+			_, err := u.request(http.MethodPost, "/v1/devices/"+dev.ID+"/config",
+				dev.Config, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if r := dev.State.Reported; r != nil && r.Time.After(state.Reported) {
+		_, err := u.request(http.MethodPost,
+			"/v1/devices/"+dev.ID+"/config/reported",
+			data.ConfigReport{Config: r.Config, Errors: r.Errors}, nil)
+		if err != nil {
+			return err
+		}
+		state.Reported = r.Time
+	}
+
+	var cmds []data.DeviceCommand
+	_, err = u.request(http.MethodGet, "/v1/devices/"+dev.ID+"/cmd", nil, &cmds)
+	if err != nil {
+		return err
+	}
+
+	for _, cmd := range cmds {
+		_, err := u.db.CommandEnqueue(data.DeviceCommand{
+			DeviceID: dev.ID,
+			Command:  cmd.Command,
+			Args:     cmd.Args,
+			Expires:  cmd.Expires,
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = u.request(http.MethodDelete,
+			fmt.Sprintf("/v1/devices/%v/cmd/%v", dev.ID, cmd.ID), nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// request does an HTTP request to the upstream server and decodes the
+// JSON response into ret, if it is not nil
+func (u *Upstream) request(method, path string, body interface{}, ret interface{}) (int, error) {
+	var r io.Reader
+	if body != nil {
+		j, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		r = bytes.NewBuffer(j)
+	}
+
+	req, err := http.NewRequest(method, u.url+path, r)
+	if err != nil {
+		return 0, err
+	}
+
+	req = req.WithContext(u.ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if u.token != "" {
+		req.Header.Set("Authorization", "Bearer "+u.token)
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, fmt.Errorf("Server error: %v %v %v",
+			resp.Status, path, strings.TrimSpace(string(b)))
+	}
+
+	if ret != nil {
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(ret)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// jsonEqual returns true if a and b encode to the same JSON, so values
+// that were sent over the API compare equal to the originals
+func jsonEqual(a, b interface{}) bool {
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+
+	jb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(ja, jb)
+}
@@ -2,13 +2,41 @@ package api
 
 import (
 	"net/http"
-
-	"github.com/simpleiot/simpleiot/db"
 )
 
 // V1 handles v1 api requests
 type V1 struct {
 	DevicesHandler http.Handler
+	StreamHandler  http.Handler
+	RulesHandler   http.Handler
+	AlertsHandler  http.Handler
+	// AnomaliesHandler lists the anomalies found in sample streams
+	AnomaliesHandler http.Handler
+	// GroupsHandler rolls back the configs of device groups
+	GroupsHandler http.Handler
+	// TemplatesHandler handles device type templates
+	TemplatesHandler http.Handler
+	// ScriptsHandler handles user scripts
+	ScriptsHandler http.Handler
+	// ReportsHandler handles scheduled reports
+	ReportsHandler http.Handler
+	// RegisterHandler handles device registration
+	RegisterHandler http.Handler
+	// NotificationsHandler handles notification delivery status
+	NotificationsHandler http.Handler
+	// FirmwareHandler and RolloutsHandler handle firmware updates
+	FirmwareHandler http.Handler
+	RolloutsHandler http.Handler
+	// TunnelsHandler handles device tunnel connections
+	TunnelsHandler http.Handler
+	// GraphQLHandler handles read only GraphQL queries
+	GraphQLHandler http.Handler
+	// LorawanHandler handles LoRaWAN uplink webhooks
+	LorawanHandler http.Handler
+	// ParticleHandler handles Particle webhooks
+	ParticleHandler http.Handler
+	// NetworkHandler serves the status of the server's network manager
+	NetworkHandler http.Handler
 }
 
 // Top level handler for http requests in the coap-server process
@@ -18,14 +46,68 @@ func (h *V1) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	switch head {
 	case "devices":
 		h.DevicesHandler.ServeHTTP(res, req)
+	case "stream":
+		h.StreamHandler.ServeHTTP(res, req)
+	case "rules":
+		h.RulesHandler.ServeHTTP(res, req)
+	case "alerts":
+		h.AlertsHandler.ServeHTTP(res, req)
+	case "anomalies":
+		h.AnomaliesHandler.ServeHTTP(res, req)
+	case "groups":
+		h.GroupsHandler.ServeHTTP(res, req)
+	case "templates":
+		h.TemplatesHandler.ServeHTTP(res, req)
+	case "scripts":
+		h.ScriptsHandler.ServeHTTP(res, req)
+	case "reports":
+		h.ReportsHandler.ServeHTTP(res, req)
+	case "register":
+		h.RegisterHandler.ServeHTTP(res, req)
+	case "notifications":
+		h.NotificationsHandler.ServeHTTP(res, req)
+	case "firmware":
+		h.FirmwareHandler.ServeHTTP(res, req)
+	case "rollouts":
+		h.RolloutsHandler.ServeHTTP(res, req)
+	case "tunnels":
+		h.TunnelsHandler.ServeHTTP(res, req)
+	case "graphql":
+		h.GraphQLHandler.ServeHTTP(res, req)
+	case "lorawan":
+		h.LorawanHandler.ServeHTTP(res, req)
+	case "particle":
+		h.ParticleHandler.ServeHTTP(res, req)
+	case "network":
+		h.NetworkHandler.ServeHTTP(res, req)
 	default:
 		http.Error(res, "Not Found", http.StatusNotFound)
 	}
 }
 
-// NewV1Handler returns a handle for V1 API
-func NewV1Handler(db *db.Db, influx *db.Influx) http.Handler {
+// NewV1Handler returns a handle for V1 API. Only DbInst is required, and
+// the features of the optional ServerArgs fields are disabled if they are
+// not set. The fields that are not used by the v1 API are ignored.
+func NewV1Handler(args ServerArgs) http.Handler {
+	db := args.DbInst
 	return &V1{
-		DevicesHandler: NewDevicesHandler(db, influx),
+		DevicesHandler:       NewDevicesHandler(db, args.Influx, args.Ingest),
+		StreamHandler:        NewStreamHandler(db),
+		RulesHandler:         NewRulesHandler(db),
+		AlertsHandler:        NewAlertsHandler(db),
+		AnomaliesHandler:     NewAnomaliesHandler(db),
+		GroupsHandler:        NewGroupsHandler(db),
+		TemplatesHandler:     NewTemplatesHandler(db),
+		ScriptsHandler:       NewScriptsHandler(db),
+		ReportsHandler:       NewReportsHandler(db, args.Reporter),
+		NotificationsHandler: NewNotificationsHandler(args.SMS),
+		RegisterHandler:      NewRegisterHandler(db, args.Signer),
+		FirmwareHandler:      NewFirmwareHandler(db, args.FirmwareKeys),
+		RolloutsHandler:      NewRolloutsHandler(db),
+		TunnelsHandler:       NewTunnelsHandler(args.Tunnels),
+		GraphQLHandler:       NewGraphQLHandler(db),
+		LorawanHandler:       NewLorawanHandler(args.Lorawan),
+		ParticleHandler:      NewParticleHandler(args.Particle),
+		NetworkHandler:       NewNetworkHandler(args.Network),
 	}
 }
@@ -0,0 +1,413 @@
+// Package awsiot mirrors devices to AWS IoT Core, so their data can be used
+// in AWS while SIOT runs at the edge. Samples are forwarded to a topic, and
+// the desired and reported config of each device is kept in the classic
+// shadow of a thing named after the device. Desired config changes made in
+// AWS are applied to the devices.
+package awsiot
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/logging"
+	"github.com/simpleiot/simpleiot/mqtt"
+)
+
+var awsLog = logging.Module("awsiot")
+
+// Config describes how devices are mirrored
+type Config struct {
+	// ThingPrefix is prepended to device IDs to get the thing names of
+	// devices
+	ThingPrefix string
+	// Topic is the topic samples are published to, where {device} and
+	// {type} are replaced with the device ID and sample type, like
+	// siot/{device}/samples. Samples are not forwarded if it is blank.
+	Topic string
+	// Types are the sample types that are forwarded, or all if empty
+	Types []string
+	// Shadow syncs the config of devices with their thing shadows
+	Shadow bool
+	// Validate checks config changes from AWS before they are applied,
+	// typically api.ValidateConfig. Changes are applied unchecked if it is
+	// nil.
+	Validate func(data.DeviceConfig) error
+}
+
+// TLSConfig returns the TLS config that connects to an AWS IoT Core
+// endpoint with the certificate of a thing. The system CAs are used if
+// caFile is blank.
+func TLSConfig(endpoint, certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		ServerName:   endpoint,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates found in " + caFile)
+		}
+	}
+
+	return config, nil
+}
+
+// shadowState is the state of a thing shadow
+type shadowState struct {
+	Desired  interface{} `json:"desired"`
+	Reported interface{} `json:"reported"`
+}
+
+// Bridge mirrors devices to AWS IoT Core over an MQTT connection to the
+// AWS IoT endpoint. Samples are published with QoS 0, so samples written
+// while the connection is down are not forwarded. Shadows are updated when
+// the config of a device changes, and are deleted with their device.
+type Bridge struct {
+	conn   mqtt.Conn
+	db     *db.Db
+	config Config
+	types  map[string]bool
+	lock   sync.Mutex
+	// shadows are the last states published to the shadow of each device,
+	// so shadows are only updated when the config changes
+	shadows map[string]shadowState
+	events  <-chan db.Event
+	stop    chan struct{}
+}
+
+// NewBridge creates a bridge that uses conn to connect to AWS IoT Core
+func NewBridge(conn mqtt.Conn, dbInst *db.Db, config Config) *Bridge {
+	types := make(map[string]bool)
+	for _, t := range config.Types {
+		types[t] = true
+	}
+
+	return &Bridge{
+		conn:    conn,
+		db:      dbInst,
+		config:  config,
+		types:   types,
+		shadows: make(map[string]shadowState),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start subscribes to shadow changes, syncs the shadows of all devices,
+// and forwards samples until Stop is called
+func (b *Bridge) Start() error {
+	types := []db.EventType{db.EventSampleWritten}
+
+	if b.config.Shadow {
+		err := b.conn.Subscribe("$aws/things/+/shadow/update/delta", 1, b.handleDelta)
+		if err != nil {
+			return err
+		}
+
+		types = append(types, db.EventDeviceCreated, db.EventDeviceUpdated,
+			db.EventDeviceDeleted)
+	}
+
+	b.events = b.db.Subscribe(db.EventFilter{Types: types})
+
+	go func() {
+		if b.config.Shadow {
+			b.syncShadows()
+		}
+
+		for {
+			select {
+			case e, ok := <-b.events:
+				if !ok {
+					return
+				}
+
+				switch e.Type {
+				case db.EventSampleWritten:
+					b.forward(e.DeviceID, *e.Sample)
+				case db.EventDeviceCreated, db.EventDeviceUpdated:
+					b.publishShadow(*e.Device)
+				case db.EventDeviceDeleted:
+					b.deleteShadow(e.DeviceID)
+				}
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the bridge
+func (b *Bridge) Stop() {
+	close(b.stop)
+	b.db.Unsubscribe(b.events)
+}
+
+// Thing returns the thing name of a device
+func (b *Bridge) Thing(id string) string {
+	return b.config.ThingPrefix + id
+}
+
+// deviceID returns the device of a thing, or false if it is not a device
+func (b *Bridge) deviceID(thing string) (string, bool) {
+	if !strings.HasPrefix(thing, b.config.ThingPrefix) {
+		return "", false
+	}
+
+	id := strings.TrimPrefix(thing, b.config.ThingPrefix)
+	return id, id != ""
+}
+
+func (b *Bridge) forward(id string, sample data.Sample) {
+	if b.config.Topic == "" || (len(b.types) > 0 && !b.types[sample.Type]) {
+		return
+	}
+
+	payload, err := json.Marshal(sample)
+	if err != nil {
+		awsLog.Error("error encoding sample", "err", err)
+		return
+	}
+
+	topic := strings.NewReplacer("{device}", id, "{type}", sample.Type).
+		Replace(b.config.Topic)
+
+	err = b.conn.Publish(topic, payload, 0, false)
+	if err != nil && err != mqtt.ErrNotConnected {
+		awsLog.Warn("error forwarding sample", "device", id, "err", err)
+	}
+}
+
+func (b *Bridge) syncShadows() {
+	devices, err := b.db.Devices()
+	if err != nil {
+		awsLog.Error("error reading devices", "err", err)
+		return
+	}
+
+	for _, dev := range devices {
+		b.publishShadow(dev)
+	}
+}
+
+// toJSONValue converts v to the generic value its JSON decodes to
+func toJSONValue(v interface{}) interface{} {
+	var ret interface{}
+	j, err := json.Marshal(v)
+	if err == nil {
+		json.Unmarshal(j, &ret)
+	}
+	return ret
+}
+
+// Patch returns the shadow update that changes old to new. Shadow updates
+// are merged into the shadow, so fields that were removed are set to null.
+func Patch(old, new interface{}) interface{} {
+	o, ok := old.(map[string]interface{})
+	n, ok2 := new.(map[string]interface{})
+	if !ok || !ok2 {
+		return new
+	}
+
+	ret := make(map[string]interface{})
+	for k, v := range n {
+		ret[k] = Patch(o[k], v)
+	}
+
+	for k := range o {
+		if _, ok := n[k]; !ok {
+			ret[k] = nil
+		}
+	}
+
+	return ret
+}
+
+// Merge applies a shadow delta to a value, like AWS does
+func Merge(v, delta interface{}) interface{} {
+	m, ok := v.(map[string]interface{})
+	d, ok2 := delta.(map[string]interface{})
+	if !ok || !ok2 {
+		return delta
+	}
+
+	ret := make(map[string]interface{})
+	for k, v := range m {
+		ret[k] = v
+	}
+
+	for k, dv := range d {
+		if dv == nil {
+			delete(ret, k)
+			continue
+		}
+		ret[k] = Merge(ret[k], dv)
+	}
+
+	return ret
+}
+
+func (b *Bridge) publish(topic string, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return b.conn.Publish(topic, payload, 1, false)
+}
+
+// publishShadow updates the shadow of a device if its config changed. The
+// first time a shadow is updated, the shadow state is replaced, as it may
+// have changed while the bridge was not running.
+func (b *Bridge) publishShadow(dev data.Device) {
+	state := shadowState{Desired: toJSONValue(dev.Config)}
+	if dev.State.Reported != nil {
+		state.Reported = toJSONValue(dev.State.Reported.Config)
+	}
+
+	b.lock.Lock()
+	old, ok := b.shadows[dev.ID]
+	b.lock.Unlock()
+
+	if ok && reflect.DeepEqual(old, state) {
+		return
+	}
+
+	topic := "$aws/things/" + b.Thing(dev.ID) + "/shadow/update"
+
+	update := state
+	if ok {
+		update.Desired = Patch(old.Desired, state.Desired)
+		update.Reported = Patch(old.Reported, state.Reported)
+	} else {
+		// a null state clears the shadow
+		err := b.publish(topic, map[string]interface{}{"state": nil})
+		if err != nil {
+			b.logPublishError(dev.ID, err)
+			return
+		}
+	}
+
+	err := b.publish(topic, map[string]interface{}{"state": update})
+	if err != nil {
+		b.logPublishError(dev.ID, err)
+		return
+	}
+
+	b.lock.Lock()
+	b.shadows[dev.ID] = state
+	b.lock.Unlock()
+}
+
+func (b *Bridge) deleteShadow(id string) {
+	b.lock.Lock()
+	delete(b.shadows, id)
+	b.lock.Unlock()
+
+	err := b.conn.Publish("$aws/things/"+b.Thing(id)+"/shadow/delete", nil, 1, false)
+	if err != nil {
+		b.logPublishError(id, err)
+	}
+}
+
+func (b *Bridge) logPublishError(id string, err error) {
+	if err != mqtt.ErrNotConnected && err != mqtt.ErrNoSubscribers {
+		awsLog.Warn("error updating shadow", "device", id, "err", err)
+	}
+}
+
+// shadowDelta is sent when the desired state of a shadow differs from the
+// reported state
+type shadowDelta struct {
+	State interface{} `json:"state"`
+}
+
+// handleDelta applies desired config changes made in AWS. Deltas are also
+// sent for config the bridge published that the device has not applied
+// yet, which don't change the config.
+func (b *Bridge) handleDelta(msg mqtt.Message) {
+	// topics are $aws/things/<thing>/shadow/update/delta
+	levels := strings.Split(msg.Topic, "/")
+	if len(levels) != 6 {
+		return
+	}
+
+	id, ok := b.deviceID(levels[2])
+	if !ok {
+		return
+	}
+
+	var delta shadowDelta
+	err := json.Unmarshal(msg.Payload, &delta)
+	if err != nil {
+		awsLog.Warn("invalid shadow delta", "device", id, "err", err)
+		return
+	}
+
+	dev, err := b.db.Device(id)
+	if err != nil {
+		awsLog.Warn("shadow delta for unknown device", "device", id)
+		return
+	}
+
+	j, err := json.Marshal(Merge(toJSONValue(dev.Config), delta.State))
+	if err != nil {
+		awsLog.Error("error encoding config", "device", id, "err", err)
+		return
+	}
+
+	var config data.DeviceConfig
+	err = json.Unmarshal(j, &config)
+	if err != nil {
+		awsLog.Warn("invalid config in shadow", "device", id, "err", err)
+		return
+	}
+
+	if reflect.DeepEqual(config, dev.Config) {
+		return
+	}
+
+	if b.config.Validate != nil {
+		err = b.config.Validate(config)
+		if err != nil {
+			awsLog.Warn("invalid config in shadow", "device", id, "err", err)
+			return
+		}
+	}
+
+	err = b.db.Update(func(txn *db.Txn) error {
+		err := txn.DeviceUpdateConfig(id, config)
+		if err != nil {
+			return err
+		}
+
+		return txn.AuditAppend(data.AuditRecord{
+			DeviceID: id,
+			Action:   "updateConfig",
+			Message:  "from AWS IoT shadow",
+		})
+	})
+	if err != nil {
+		awsLog.Error("error updating config", "device", id, "err", err)
+	}
+}
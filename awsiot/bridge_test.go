@@ -0,0 +1,169 @@
+package awsiot
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/mqtt"
+)
+
+func TestPatch(t *testing.T) {
+	var old, new, exp interface{}
+	json.Unmarshal([]byte(`{"description": "pump", "location": {"lat": 1, "long": 2}, "hostname": "a"}`), &old)
+	json.Unmarshal([]byte(`{"description": "pump 2", "location": {"lat": 1}}`), &new)
+	json.Unmarshal([]byte(`{"description": "pump 2", "location": {"lat": 1, "long": null}, "hostname": null}`), &exp)
+
+	patch := Patch(old, new)
+	if !reflect.DeepEqual(patch, exp) {
+		t.Errorf("wrong patch: %v", patch)
+	}
+
+	if merged := Merge(old, patch); !reflect.DeepEqual(merged, new) {
+		t.Errorf("wrong merge: %v", merged)
+	}
+}
+
+func TestBridge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-awsiot-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbInst, err := db.NewDb(dir, nil)
+	if err != nil {
+		t.Fatal("Error opening db: ", err)
+	}
+	defer dbInst.Close()
+
+	err = dbInst.DeviceUpdate(data.Device{ID: "1234", Config: data.DeviceConfig{Description: "pump"}})
+	if err != nil {
+		t.Fatal("Error creating device: ", err)
+	}
+
+	broker := mqtt.NewBroker(mqtt.BrokerConfig{})
+
+	messages := make(chan mqtt.Message, 20)
+	for _, filter := range []string{"$aws/things/+/shadow/#", "siot/#"} {
+		err = broker.Subscribe(filter, 1, func(msg mqtt.Message) {
+			messages <- msg
+		})
+		if err != nil {
+			t.Fatal("Error subscribing: ", err)
+		}
+	}
+
+	b := NewBridge(broker, dbInst, Config{
+		ThingPrefix: "siot-",
+		Topic:       "siot/{device}/{type}",
+		Types:       []string{"temp"},
+		Shadow:      true,
+		Validate: func(c data.DeviceConfig) error {
+			if c.Hostname == "bad" {
+				return errors.New("invalid hostname")
+			}
+			return nil
+		},
+	})
+
+	err = b.Start()
+	if err != nil {
+		t.Fatal("Error starting bridge: ", err)
+	}
+	defer b.Stop()
+
+	wait := func(topic string) map[string]interface{} {
+		for {
+			select {
+			case msg := <-messages:
+				if msg.Topic != topic {
+					continue
+				}
+
+				var ret map[string]interface{}
+				json.Unmarshal(msg.Payload, &ret)
+				return ret
+			case <-time.After(2 * time.Second):
+				t.Fatal("timeout waiting for message on ", topic)
+			}
+		}
+	}
+
+	// the shadow is cleared, then set
+	update := "$aws/things/siot-1234/shadow/update"
+	if msg := wait(update); msg["state"] != nil {
+		t.Errorf("shadow was not cleared: %v", msg)
+	}
+
+	msg := wait(update)
+	desired := msg["state"].(map[string]interface{})["desired"].(map[string]interface{})
+	if desired["description"] != "pump" {
+		t.Errorf("wrong shadow: %v", msg)
+	}
+
+	// samples of the forwarded types are published
+	dbInst.DeviceSample("1234", data.Sample{Type: "humidity", Value: 40})
+	dbInst.DeviceSample("1234", data.Sample{Type: "temp", Value: 21})
+
+	var sample data.Sample
+	select {
+	case m := <-messages:
+		if m.Topic != "siot/1234/temp" {
+			t.Fatal("wrong sample topic: ", m.Topic)
+		}
+		json.Unmarshal(m.Payload, &sample)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for sample")
+	}
+
+	if sample.Type != "temp" || sample.Value != 21 {
+		t.Errorf("wrong sample: %+v", sample)
+	}
+
+	// desired changes made in AWS are applied
+	err = broker.Publish("$aws/things/siot-1234/shadow/update/delta",
+		[]byte(`{"version": 3, "state": {"description": "pump 2", "hostname": "pump-2"}}`), 1, false)
+	if err != nil {
+		t.Fatal("Error publishing delta: ", err)
+	}
+
+	dev, _ := dbInst.Device("1234")
+	if dev.Config.Description != "pump 2" || dev.Config.Hostname != "pump-2" {
+		t.Errorf("delta was not applied: %+v", dev.Config)
+	}
+
+	audit, _ := dbInst.Audit("1234")
+	if len(audit) != 1 || audit[0].Message != "from AWS IoT shadow" {
+		t.Errorf("wrong audit records: %+v", audit)
+	}
+
+	// invalid changes are not
+	broker.Publish("$aws/things/siot-1234/shadow/update/delta",
+		[]byte(`{"state": {"hostname": "bad"}}`), 1, false)
+
+	dev, _ = dbInst.Device("1234")
+	if dev.Config.Hostname != "pump-2" {
+		t.Error("invalid delta was applied")
+	}
+
+	// the device is mirrored to the shadow
+	msg = wait(update)
+	desired = msg["state"].(map[string]interface{})["desired"].(map[string]interface{})
+	if desired["hostname"] != "pump-2" {
+		t.Errorf("wrong shadow update: %v", msg)
+	}
+
+	err = dbInst.DeviceDelete("1234")
+	if err != nil {
+		t.Fatal("Error deleting device: ", err)
+	}
+
+	wait("$aws/things/siot-1234/shadow/delete")
+}
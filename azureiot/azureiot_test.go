@@ -0,0 +1,225 @@
+package azureiot
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/mqtt"
+)
+
+func TestSASToken(t *testing.T) {
+	token, err := SASToken("myhub.azure-devices.net/devices/pump", "c2VjcmV0", "",
+		time.Unix(1600000000, 0))
+	if err != nil {
+		t.Fatal("Error creating token: ", err)
+	}
+
+	exp := "SharedAccessSignature sr=myhub.azure-devices.net%2Fdevices%2Fpump&" +
+		"sig=NUvaGVDy2c0ULeJzq30P5Uul6IEZ%2FOfxaKh2753ZXJM%3D&se=1600000000"
+	if token != exp {
+		t.Errorf("wrong token: %v", token)
+	}
+
+	if _, err := SASToken("a", "not base64!", "", time.Now()); err == nil {
+		t.Error("invalid key should fail")
+	}
+}
+
+func TestBridge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-azureiot-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbInst, err := db.NewDb(dir, nil)
+	if err != nil {
+		t.Fatal("Error opening db: ", err)
+	}
+	defer dbInst.Close()
+
+	err = dbInst.DeviceUpdate(data.Device{ID: "1234"})
+	if err != nil {
+		t.Fatal("Error creating device: ", err)
+	}
+
+	groupKey := "Z3JvdXAga2V5"
+	deviceKey, _ := DeriveKey(groupKey, "siot-1234")
+
+	// the provisioning service, which assigns the device to a hub
+	var hub string
+	dps := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		var expiry int64
+		fmt.Sscan(auth[strings.Index(auth, "&se=")+4:], &expiry)
+
+		token, _ := SASToken("0ne000/registrations/siot-1234", deviceKey,
+			"registration", time.Unix(expiry, 0))
+		if auth != token {
+			http.Error(res, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		switch req.Method + " " + req.URL.Path {
+		case "PUT /0ne000/registrations/siot-1234/register":
+			res.WriteHeader(http.StatusAccepted)
+			fmt.Fprint(res, `{"operationId": "op1", "status": "assigning"}`)
+		case "GET /0ne000/registrations/siot-1234/operations/op1":
+			fmt.Fprintf(res, `{"operationId": "op1", "status": "assigned",
+				"registrationState": {"assignedHub": %q, "deviceId": "az-1234"}}`, hub)
+		default:
+			http.NotFound(res, req)
+		}
+	}))
+	defer dps.Close()
+
+	tlsConfig := dps.Client().Transport.(*http.Transport).TLSClientConfig
+
+	// the hub
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: dps.TLS.Certificates,
+	})
+	if err != nil {
+		t.Fatal("Error listening: ", err)
+	}
+	hub = l.Addr().String()
+
+	connected := make(chan string, 1)
+	broker := mqtt.NewBroker(mqtt.BrokerConfig{
+		Auth: func(clientID, user, password string) (mqtt.Permissions, error) {
+			connected <- clientID + " " + user
+			// # does not match $iothub topics
+			return mqtt.Permissions{
+				Publish:   []string{"#", "$iothub/#"},
+				Subscribe: []string{"#", "$iothub/#"},
+			}, nil
+		},
+	})
+	go broker.Serve(l)
+	defer broker.Close()
+
+	messages := make(chan mqtt.Message, 10)
+	err = broker.Subscribe("devices/+/messages/events/#", 1, func(msg mqtt.Message) {
+		messages <- msg
+	})
+	if err != nil {
+		t.Fatal("Error subscribing: ", err)
+	}
+
+	methodResponses := make(chan mqtt.Message, 10)
+	err = broker.Subscribe("$iothub/methods/res/#", 0, func(msg mqtt.Message) {
+		methodResponses <- msg
+	})
+	if err != nil {
+		t.Fatal("Error subscribing: ", err)
+	}
+
+	b := NewBridge(dbInst, Config{
+		IDScope:            "0ne000",
+		GroupKey:           groupKey,
+		RegistrationPrefix: "siot-",
+		DPSURL:             dps.URL,
+		Types:              []string{"temp"},
+		PollInterval:       10 * time.Millisecond,
+		TLS:                tlsConfig,
+	})
+
+	err = b.Start()
+	if err != nil {
+		t.Fatal("Error starting bridge: ", err)
+	}
+	defer b.Stop()
+
+	select {
+	case c := <-connected:
+		if c != "az-1234 "+hub+"/az-1234/?api-version="+hubAPIVersion {
+			t.Errorf("wrong client: %v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for device to connect")
+	}
+
+	// cloud-to-device messages queue commands, once the bridge subscribed
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		err = broker.Publish("devices/az-1234/messages/devicebound/%24.mid=1",
+			[]byte(`{"command": "reboot", "args": {"delay": "5"}}`), 1, false)
+		if err != mqtt.ErrNoSubscribers {
+			break
+		}
+
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("timeout waiting for subscription")
+		}
+	}
+
+	var cmds []data.DeviceCommand
+	for start := time.Now(); len(cmds) == 0 && time.Since(start) < 2*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		cmds, _ = dbInst.DeviceCommands("1234")
+	}
+
+	if len(cmds) != 1 || cmds[0].Command != "reboot" || cmds[0].Args["delay"] != "5" {
+		t.Errorf("wrong commands: %+v", cmds)
+	}
+
+	// samples of the sent types are device-to-cloud messages
+	dbInst.DeviceSample("1234", data.Sample{Type: "humidity", Value: 40})
+	dbInst.DeviceSample("1234", data.Sample{Type: "temp", Value: 21})
+
+	select {
+	case msg := <-messages:
+		exp := "devices/az-1234/messages/events/$.ct=application%2Fjson&$.ce=utf-8&type=temp"
+		if msg.Topic != exp {
+			t.Fatal("wrong topic: ", msg.Topic)
+		}
+
+		var sample data.Sample
+		json.Unmarshal(msg.Payload, &sample)
+		if sample.Value != 21 {
+			t.Errorf("wrong sample: %+v", sample)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for sample")
+	}
+
+	// direct methods queue commands, and respond with the command ID
+	for _, tc := range []struct {
+		payload string
+		status  string
+	}{
+		{`{"state": "on"}`, "200"},
+		{``, "200"},
+		{`{"state": 1}`, "400"},
+	} {
+		broker.Publish("$iothub/methods/POST/led/?$rid=7", []byte(tc.payload), 0, false)
+
+		select {
+		case msg := <-methodResponses:
+			if msg.Topic != "$iothub/methods/res/"+tc.status+"/?$rid=7" {
+				t.Errorf("wrong response for %q: %v %s", tc.payload, msg.Topic, msg.Payload)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for method response")
+		}
+	}
+
+	cmds, _ = dbInst.DeviceCommands("1234")
+	if len(cmds) != 3 || cmds[1].Command != "led" || cmds[1].Args["state"] != "on" {
+		t.Errorf("wrong commands: %+v", cmds)
+	}
+
+	audit, _ := dbInst.Audit("1234")
+	if len(audit) != 3 || audit[0].Message != "reboot from Azure IoT Hub" {
+		t.Errorf("wrong audit records: %+v", audit)
+	}
+}
@@ -0,0 +1,438 @@
+// Package azureiot connects devices to Azure IoT Hub. Each device is
+// registered with the Device Provisioning Service (DPS) in a symmetric key
+// enrollment group, and connects to the hub it is assigned over MQTT.
+// Samples are sent as device-to-cloud messages, and cloud-to-device
+// messages and direct methods queue commands.
+package azureiot
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/logging"
+	"github.com/simpleiot/simpleiot/mqtt"
+)
+
+var azureLog = logging.Module("azureiot")
+
+// DefaultDPSURL is the global Device Provisioning Service endpoint
+const DefaultDPSURL = "https://global.azure-devices-provisioning.net"
+
+// hubAPIVersion is the IoT Hub API version devices connect with
+const hubAPIVersion = "2021-04-12"
+
+var errStopped = errors.New("bridge stopped")
+
+// Config describes how devices are connected to Azure IoT Hub
+type Config struct {
+	// IDScope is the ID scope of the provisioning service
+	IDScope string
+	// GroupKey is the base64 primary key of the symmetric key enrollment
+	// group, which device keys are derived from
+	GroupKey string
+	// RegistrationPrefix is prepended to device IDs to get their
+	// registration IDs
+	RegistrationPrefix string
+	// DPSURL is the provisioning service endpoint (default DefaultDPSURL)
+	DPSURL string
+	// Types are the sample types that are sent, or all if empty
+	Types []string
+	// TokenTTL is how long SAS tokens are valid (default 1h). Tokens are
+	// renewed at half their lifetime.
+	TokenTTL time.Duration
+	// PollInterval is how often registrations in progress are checked
+	// (default 2s)
+	PollInterval time.Duration
+	// RetryInterval is the delay before a failed registration is retried
+	// (default 1m)
+	RetryInterval time.Duration
+	// TLS is used to connect to the provisioning service and hubs. The
+	// default config is used if nil.
+	TLS *tls.Config
+}
+
+// device is a device connected to a hub
+type device struct {
+	id string
+	// key is the device key derived from the group key
+	key string
+	// hub and azureID are assigned by the provisioning service
+	hub     string
+	azureID string
+	client  *mqtt.Client
+}
+
+// token returns a SAS token the device connects to its hub with
+func (d *device) token(ttl time.Duration) (string, error) {
+	return SASToken(d.hub+"/devices/"+d.azureID, d.key, "", time.Now().Add(ttl))
+}
+
+// Bridge connects the devices in the database to Azure IoT Hub. A device is
+// registered with the provisioning service when it is created or sends its
+// first sample after the bridge starts, and samples are dropped until it
+// is connected. Samples are sent with QoS 0, so samples written while the
+// connection is down are not sent.
+type Bridge struct {
+	db     *db.Db
+	config Config
+	client *http.Client
+	types  map[string]bool
+	lock   sync.Mutex
+	// devices are the devices that are connected or being registered
+	devices map[string]*device
+	stopped bool
+	events  <-chan db.Event
+	stop    chan struct{}
+}
+
+// NewBridge creates a bridge
+func NewBridge(dbInst *db.Db, config Config) *Bridge {
+	if config.DPSURL == "" {
+		config.DPSURL = DefaultDPSURL
+	}
+
+	if config.TokenTTL == 0 {
+		config.TokenTTL = time.Hour
+	}
+
+	if config.PollInterval == 0 {
+		config.PollInterval = 2 * time.Second
+	}
+
+	if config.RetryInterval == 0 {
+		config.RetryInterval = time.Minute
+	}
+
+	types := make(map[string]bool)
+	for _, t := range config.Types {
+		types[t] = true
+	}
+
+	return &Bridge{
+		db:     dbInst,
+		config: config,
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: config.TLS},
+		},
+		types:   types,
+		devices: make(map[string]*device),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start connects all devices, and sends samples until Stop is called
+func (b *Bridge) Start() error {
+	_, err := DeriveKey(b.config.GroupKey, "")
+	if err != nil {
+		return err
+	}
+
+	b.events = b.db.Subscribe(db.EventFilter{
+		Types: []db.EventType{db.EventSampleWritten, db.EventDeviceCreated,
+			db.EventDeviceDeleted},
+	})
+
+	go func() {
+		devices, err := b.db.Devices()
+		if err != nil {
+			azureLog.Error("error reading devices", "err", err)
+		}
+
+		for _, dev := range devices {
+			b.device(dev.ID)
+		}
+
+		renew := time.NewTicker(b.config.TokenTTL / 2)
+		defer renew.Stop()
+
+		for {
+			select {
+			case e, ok := <-b.events:
+				if !ok {
+					return
+				}
+
+				switch e.Type {
+				case db.EventSampleWritten:
+					b.send(b.device(e.DeviceID), *e.Sample)
+				case db.EventDeviceCreated:
+					b.device(e.DeviceID)
+				case db.EventDeviceDeleted:
+					b.remove(e.DeviceID)
+				}
+			case <-renew.C:
+				b.renewTokens()
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop disconnects all devices
+func (b *Bridge) Stop() {
+	close(b.stop)
+	b.db.Unsubscribe(b.events)
+
+	b.lock.Lock()
+	b.stopped = true
+	devices := b.devices
+	b.devices = make(map[string]*device)
+	b.lock.Unlock()
+
+	for _, d := range devices {
+		if d.client != nil {
+			d.client.Stop()
+		}
+	}
+}
+
+// device returns a device, and starts connecting it if it is not
+// connected. The client of the device is nil until it is connected.
+func (b *Bridge) device(id string) device {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	d, ok := b.devices[id]
+	if !ok {
+		d = &device{id: id}
+		b.devices[id] = d
+		go b.connect(d)
+	}
+
+	return *d
+}
+
+func (b *Bridge) remove(id string) {
+	b.lock.Lock()
+	d, ok := b.devices[id]
+	delete(b.devices, id)
+	b.lock.Unlock()
+
+	if ok && d.client != nil {
+		d.client.Stop()
+	}
+}
+
+// connect registers a device until it succeeds, and connects it to its hub
+func (b *Bridge) connect(d *device) {
+	id := d.id
+	registrationID := b.config.RegistrationPrefix + id
+
+	key, err := DeriveKey(b.config.GroupKey, registrationID)
+	if err != nil {
+		azureLog.Error("error deriving device key", "device", id, "err", err)
+		return
+	}
+
+	var state registrationState
+	for {
+		state, err = b.register(registrationID, key)
+		if err == nil {
+			break
+		}
+
+		if err == errStopped {
+			return
+		}
+
+		azureLog.Warn("error registering device", "device", id, "err", err)
+
+		select {
+		case <-time.After(b.config.RetryInterval):
+		case <-b.stop:
+			return
+		}
+	}
+
+	connected := device{id: id, key: key, hub: state.AssignedHub,
+		azureID: state.DeviceID}
+
+	token, err := connected.token(b.config.TokenTTL)
+	if err != nil {
+		azureLog.Error("error creating token", "device", id, "err", err)
+		return
+	}
+
+	connected.client = mqtt.NewClient(mqtt.ClientConfig{
+		Broker:   "tls://" + state.AssignedHub,
+		ClientID: state.DeviceID,
+		User: state.AssignedHub + "/" + state.DeviceID + "/?api-version=" +
+			hubAPIVersion,
+		Password: token,
+		TLS:      b.config.TLS,
+	})
+
+	// subscriptions are made when the client connects
+	connected.client.Subscribe("devices/"+state.DeviceID+"/messages/devicebound/#", 1,
+		func(msg mqtt.Message) {
+			b.handleMessage(id, msg)
+		})
+	connected.client.Subscribe("$iothub/methods/POST/#", 0, func(msg mqtt.Message) {
+		b.handleMethod(id, connected.client, msg)
+	})
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// the device may have been deleted while it was registered
+	if b.stopped || b.devices[id] != d {
+		return
+	}
+
+	*d = connected
+	d.client.Start()
+
+	azureLog.Info("device registered", "device", id, "hub", state.AssignedHub,
+		"azureId", state.DeviceID)
+}
+
+func (b *Bridge) renewTokens() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, d := range b.devices {
+		if d.client == nil {
+			continue
+		}
+
+		token, err := d.token(b.config.TokenTTL)
+		if err != nil {
+			azureLog.Error("error creating token", "device", d.id, "err", err)
+			continue
+		}
+
+		// the hub disconnects the device when the old token expires, and
+		// it reconnects with the new token
+		d.client.SetPassword(token)
+	}
+}
+
+// send sends a sample as a device-to-cloud message. The sample type is a
+// property of the message, so messages can be routed by type.
+func (b *Bridge) send(d device, sample data.Sample) {
+	if d.client == nil || (len(b.types) > 0 && !b.types[sample.Type]) {
+		return
+	}
+
+	payload, err := json.Marshal(sample)
+	if err != nil {
+		azureLog.Error("error encoding sample", "err", err)
+		return
+	}
+
+	topic := "devices/" + d.azureID + "/messages/events/" +
+		"$.ct=application%2Fjson&$.ce=utf-8&type=" + url.QueryEscape(sample.Type)
+
+	err = d.client.Publish(topic, payload, 0, false)
+	if err != nil && err != mqtt.ErrNotConnected {
+		azureLog.Warn("error sending sample", "device", d.id, "err", err)
+	}
+}
+
+// enqueue queues a command and records it in the audit log
+func (b *Bridge) enqueue(cmd data.DeviceCommand) (data.DeviceCommand, error) {
+	if cmd.Command == "" {
+		return cmd, errors.New("command is required")
+	}
+
+	err := b.db.Update(func(txn *db.Txn) error {
+		var err error
+		cmd, err = txn.CommandEnqueue(cmd)
+		if err != nil {
+			return err
+		}
+
+		return txn.AuditAppend(data.AuditRecord{
+			DeviceID: cmd.DeviceID,
+			Action:   "enqueueCommand",
+			Message:  cmd.Command + " from Azure IoT Hub",
+		})
+	})
+
+	return cmd, err
+}
+
+// handleMessage queues the command in a cloud-to-device message, which is
+// a JSON command like {"command": "reboot", "args": {"delay": "5"}}
+func (b *Bridge) handleMessage(id string, msg mqtt.Message) {
+	var cmd data.DeviceCommand
+	err := json.Unmarshal(msg.Payload, &cmd)
+	if err == nil {
+		cmd = data.DeviceCommand{DeviceID: id, Command: cmd.Command,
+			Args: cmd.Args}
+		_, err = b.enqueue(cmd)
+	}
+
+	if err != nil {
+		azureLog.Warn("error queueing command from message", "device", id,
+			"err", err)
+	}
+}
+
+// methodResponse is the response to a direct method call
+type methodResponse struct {
+	ID    uint64 `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// handleMethod queues a command for a direct method call, where the method
+// name is the command and the payload is its args. The response has the ID
+// of the command.
+func (b *Bridge) handleMethod(id string, client *mqtt.Client, msg mqtt.Message) {
+	// topics are $iothub/methods/POST/<method>/?$rid=<request id>
+	levels := strings.Split(msg.Topic, "/")
+	if len(levels) != 5 {
+		return
+	}
+
+	query, err := url.ParseQuery(strings.TrimPrefix(levels[4], "?"))
+	if err != nil || query.Get("$rid") == "" {
+		azureLog.Warn("invalid direct method topic", "topic", msg.Topic)
+		return
+	}
+
+	status := 200
+	var res methodResponse
+
+	var args map[string]string
+	if len(msg.Payload) > 0 {
+		err = json.Unmarshal(msg.Payload, &args)
+	}
+	if err != nil {
+		status = 400
+		res.Error = "args must be an object of strings"
+	} else {
+		var cmd data.DeviceCommand
+		cmd, err = b.enqueue(data.DeviceCommand{DeviceID: id,
+			Command: levels[3], Args: args})
+		if err != nil {
+			status = 500
+			res.Error = err.Error()
+		}
+		res.ID = cmd.ID
+	}
+
+	payload, _ := json.Marshal(res)
+
+	// responses are sent with QoS 0, as acks are received by the loop
+	// that calls this handler
+	err = client.Publish("$iothub/methods/res/"+strconv.Itoa(status)+
+		"/?$rid="+query.Get("$rid"), payload, 0, false)
+	if err != nil {
+		azureLog.Warn("error responding to direct method", "device", id,
+			"err", err)
+	}
+}
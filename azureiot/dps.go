@@ -0,0 +1,157 @@
+package azureiot
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// dpsAPIVersion is the version of the Device Provisioning Service API
+const dpsAPIVersion = "2019-03-31"
+
+// SASToken returns a shared access signature for a resource URI, like
+// myhub.azure-devices.net/devices/pump, signed with a base64 key. policy is
+// the name of the key, which is blank for device keys.
+func SASToken(uri, key, policy string, expiry time.Time) (string, error) {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("invalid key: %v", err)
+	}
+
+	sr := url.QueryEscape(uri)
+	se := strconv.FormatInt(expiry.Unix(), 10)
+
+	mac := hmac.New(sha256.New, k)
+	mac.Write([]byte(sr + "\n" + se))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	token := "SharedAccessSignature sr=" + sr + "&sig=" + url.QueryEscape(sig) +
+		"&se=" + se
+	if policy != "" {
+		token += "&skn=" + url.QueryEscape(policy)
+	}
+
+	return token, nil
+}
+
+// DeriveKey returns the device key of a registration in a symmetric key
+// enrollment group
+func DeriveKey(groupKey, registrationID string) (string, error) {
+	k, err := base64.StdEncoding.DecodeString(groupKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid group key: %v", err)
+	}
+
+	mac := hmac.New(sha256.New, k)
+	mac.Write([]byte(registrationID))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// registrationState is the result of a registration
+type registrationState struct {
+	AssignedHub  string `json:"assignedHub"`
+	DeviceID     string `json:"deviceId"`
+	ErrorMessage string `json:"errorMessage"`
+}
+
+// registrationOperation is the state of a registration that is in progress
+type registrationOperation struct {
+	OperationID       string            `json:"operationId"`
+	Status            string            `json:"status"`
+	RegistrationState registrationState `json:"registrationState"`
+}
+
+// dpsRequest sends a request to the provisioning service and decodes the
+// operation in the response
+func (b *Bridge) dpsRequest(method, path string, body interface{}, token string) (registrationOperation, error) {
+	var ret registrationOperation
+
+	var r io.Reader
+	if body != nil {
+		j, err := json.Marshal(body)
+		if err != nil {
+			return ret, err
+		}
+		r = bytes.NewReader(j)
+	}
+
+	req, err := http.NewRequest(method, b.config.DPSURL+path+"?api-version="+
+		dpsAPIVersion, r)
+	if err != nil {
+		return ret, err
+	}
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := b.client.Do(req)
+	if err != nil {
+		return ret, err
+	}
+	defer res.Body.Close()
+
+	j, err := ioutil.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err != nil {
+		return ret, err
+	}
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusAccepted {
+		return ret, fmt.Errorf("provisioning service returned %v: %s",
+			res.StatusCode, bytes.TrimSpace(j))
+	}
+
+	err = json.Unmarshal(j, &ret)
+	return ret, err
+}
+
+// register registers a device with the provisioning service, and returns
+// the hub and device ID it was assigned
+func (b *Bridge) register(registrationID, key string) (registrationState, error) {
+	path := "/" + url.PathEscape(b.config.IDScope) + "/registrations/" +
+		url.PathEscape(registrationID)
+
+	token, err := SASToken(b.config.IDScope+"/registrations/"+registrationID,
+		key, "registration", time.Now().Add(b.config.TokenTTL))
+	if err != nil {
+		return registrationState{}, err
+	}
+
+	op, err := b.dpsRequest(http.MethodPut, path+"/register",
+		map[string]string{"registrationId": registrationID}, token)
+
+	// registration usually takes a few seconds
+	for tries := 0; err == nil && op.Status == "assigning"; tries++ {
+		if tries >= 30 {
+			return registrationState{}, errors.New("timeout waiting for registration")
+		}
+
+		select {
+		case <-time.After(b.config.PollInterval):
+		case <-b.stop:
+			return registrationState{}, errStopped
+		}
+
+		op, err = b.dpsRequest(http.MethodGet, path+"/operations/"+
+			url.PathEscape(op.OperationID), nil, token)
+	}
+
+	if err != nil {
+		return registrationState{}, err
+	}
+
+	if op.Status != "assigned" {
+		return registrationState{}, fmt.Errorf("registration %v: %v", op.Status,
+			op.RegistrationState.ErrorMessage)
+	}
+
+	return op.RegistrationState, nil
+}
@@ -0,0 +1,143 @@
+// Package bus is an in-process publish/subscribe event bus. Subsystems
+// publish what happens to typed topics, like samples written to the db or
+// network interfaces going down, and other subsystems subscribe to the
+// topics they need, so they don't have to call each other directly.
+//
+// Like the db change feed, the bus never blocks publishers. Subscribers
+// must read messages promptly, or messages are dropped.
+package bus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/logging"
+)
+
+var busLog = logging.Module("bus")
+
+// Topic is a category of messages
+type Topic string
+
+// define topics
+const (
+	// TopicSample messages are samples written to the db. The payload is
+	// a db.Event.
+	TopicSample Topic = "sample"
+	// TopicDevice messages are devices that were created, updated, or
+	// deleted. The payload is a db.Event.
+	TopicDevice Topic = "device"
+	// TopicCommand messages are device commands that were queued. The
+	// payload is a db.Event.
+	TopicCommand Topic = "command"
+	// TopicAlert messages are alerts that were raised, escalated,
+	// acknowledged, or cleared. The payload is a db.Event.
+	TopicAlert Topic = "alert"
+	// TopicConfig messages are devices that failed to apply their config.
+	// The payload is a db.Event.
+	TopicConfig Topic = "config"
+	// TopicChange messages are other changes to the db, like rules and
+	// scripts. The payload is a db.Event.
+	TopicChange Topic = "change"
+	// TopicNetwork messages are network interface events. The payload is
+	// a network.InterfaceEvent.
+	TopicNetwork Topic = "network"
+)
+
+// Message is published to a topic
+type Message struct {
+	Topic Topic
+	// Type is the kind of message in the topic, like deviceDeleted
+	Type     string
+	DeviceID string
+	Time     time.Time
+	Payload  interface{}
+}
+
+// bufferSize is the number of messages buffered for each subscriber
+const bufferSize = 100
+
+type subscriber struct {
+	topics map[Topic]bool
+	ch     chan Message
+}
+
+// Bus distributes messages to subscribers
+type Bus struct {
+	lock        sync.Mutex
+	subscribers []*subscriber
+	dropped     uint64
+}
+
+// New creates a new bus
+func New() *Bus {
+	return &Bus{}
+}
+
+// Subscribe returns a channel that receives the messages published to
+// topics, or to all topics if none are given. Call Unsubscribe when done.
+func (b *Bus) Subscribe(topics ...Topic) <-chan Message {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	s := &subscriber{
+		topics: make(map[Topic]bool),
+		ch:     make(chan Message, bufferSize),
+	}
+
+	for _, t := range topics {
+		s.topics[t] = true
+	}
+
+	b.subscribers = append(b.subscribers, s)
+	return s.ch
+}
+
+// Unsubscribe stops messages from being sent to a channel returned by
+// Subscribe and closes it
+func (b *Bus) Unsubscribe(ch <-chan Message) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for i, s := range b.subscribers {
+		if s.ch == ch {
+			close(s.ch)
+			b.subscribers = append(b.subscribers[:i], b.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Publish sends a message to the subscribers of its topic. The time is set
+// if it is zero. Publish does not block, messages are dropped for
+// subscribers that are full.
+func (b *Bus) Publish(msg Message) {
+	if msg.Time.IsZero() {
+		msg.Time = time.Now()
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, s := range b.subscribers {
+		if len(s.topics) > 0 && !s.topics[msg.Topic] {
+			continue
+		}
+
+		select {
+		case s.ch <- msg:
+		default:
+			b.dropped++
+			busLog.Warn("subscriber is full, dropping message", "topic", msg.Topic,
+				"type", msg.Type)
+		}
+	}
+}
+
+// Dropped returns the number of messages that were dropped because
+// subscribers were full
+func (b *Bus) Dropped() uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.dropped
+}
@@ -0,0 +1,52 @@
+package bus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBus(t *testing.T) {
+	b := New()
+
+	samples := b.Subscribe(TopicSample)
+	all := b.Subscribe()
+
+	b.Publish(Message{Topic: TopicDevice, Type: "deviceCreated", DeviceID: "1234"})
+	b.Publish(Message{Topic: TopicSample, Type: "sampleWritten", DeviceID: "1234",
+		Payload: 21.5})
+
+	select {
+	case msg := <-samples:
+		if msg.Topic != TopicSample || msg.Payload != 21.5 || msg.Time.IsZero() {
+			t.Errorf("wrong message: %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for sample")
+	}
+
+	for _, exp := range []Topic{TopicDevice, TopicSample} {
+		msg := <-all
+		if msg.Topic != exp {
+			t.Errorf("got %v, expected %v", msg.Topic, exp)
+		}
+	}
+
+	// full subscribers don't block publishers
+	for i := 0; i < bufferSize+5; i++ {
+		b.Publish(Message{Topic: TopicNetwork})
+	}
+
+	if b.Dropped() != 5 {
+		t.Error("wrong dropped count: ", b.Dropped())
+	}
+
+	b.Unsubscribe(all)
+	if _, ok := <-all; !ok {
+		t.Error("buffered messages should still be read")
+	}
+
+	b.Unsubscribe(samples)
+	if _, ok := <-samples; ok {
+		t.Error("channel not closed")
+	}
+}
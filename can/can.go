@@ -0,0 +1,19 @@
+// Package can reads CAN bus frames from Linux SocketCAN interfaces, and
+// decodes signals with DBC files. J1939 messages are matched by PGN, and
+// broadcast multi-packet messages are reassembled.
+package can
+
+import "errors"
+
+// ErrUnsupported is returned when SocketCAN is not supported on the
+// platform
+var ErrUnsupported = errors.New("socketcan is not supported")
+
+// Frame is a CAN frame
+type Frame struct {
+	// ID is the 11 bit standard or 29 bit extended ID
+	ID       uint32
+	Extended bool
+	// Data is up to 8 bytes, or more for reassembled J1939 messages
+	Data []byte
+}
@@ -0,0 +1,178 @@
+package can
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testDBC = `VERSION ""
+
+BU_: ECU
+
+BO_ 2364540158 EEC1: 8 ECU
+ SG_ EngineSpeed : 24|16@1+ (0.125,0) [0|8031.875] "rpm" Vector__XXX
+ SG_ EngineTorqueMode : 0|4@1+ (1,0) [0|15] "" Vector__XXX
+
+BO_ 256 Status: 8 ECU
+ SG_ Voltage : 7|16@0+ (0.01,0) [0|655.35] "V" Vector__XXX
+ SG_ Temperature : 16|8@1- (1,-10) [-138|117] "C" Vector__XXX
+
+BO_ 257 Muxed: 2 ECU
+ SG_ Select M : 0|8@1+ (1,0) [0|255] "" Vector__XXX
+ SG_ Oil m0 : 8|8@1+ (1,0) [0|255] "kPa" Vector__XXX
+ SG_ Fuel m1 : 8|8@1+ (1,0) [0|255] "kPa" Vector__XXX
+
+CM_ SG_ 256 Voltage "Battery voltage";
+`
+
+func TestParseDBC(t *testing.T) {
+	db, err := ParseDBC(strings.NewReader(testDBC))
+	if err != nil {
+		t.Fatal("Error parsing: ", err)
+	}
+
+	if len(db.Messages) != 3 {
+		t.Fatalf("wrong messages: %+v", db.Messages)
+	}
+
+	m := db.Messages[0]
+	if m.ID != 0x0cf004fe || !m.Extended || m.Name != "EEC1" || m.Size != 8 ||
+		len(m.Signals) != 2 {
+		t.Errorf("wrong message: %+v", m)
+	}
+
+	exp := Signal{Name: "EngineSpeed", Start: 24, Length: 16, Factor: 0.125,
+		Max: 8031.875, Unit: "rpm", MuxValue: -1}
+	if !reflect.DeepEqual(m.Signals[0], exp) {
+		t.Errorf("wrong signal: %+v", m.Signals[0])
+	}
+
+	sigs := db.Messages[2].Signals
+	if !sigs[0].Multiplexor || sigs[0].MuxValue != -1 || sigs[1].MuxValue != 0 ||
+		sigs[2].MuxValue != 1 {
+		t.Errorf("wrong mux signals: %+v", sigs)
+	}
+
+	_, err = ParseDBC(strings.NewReader(" SG_ Orphan : 0|8@1+ (1,0) [0|0] \"\" X"))
+	if err == nil {
+		t.Error("expected error for signal without a message")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	db, err := ParseDBC(strings.NewReader(testDBC))
+	if err != nil {
+		t.Fatal("Error parsing: ", err)
+	}
+
+	d := NewDecoder(db, false)
+
+	values := d.Decode(Frame{ID: 256, Data: []byte{0x04, 0xd2, 0xfe, 0, 0, 0, 0, 0}})
+	exp := []Value{
+		{Message: "Status", Signal: "Voltage", Unit: "V", Value: 12.34},
+		{Message: "Status", Signal: "Temperature", Unit: "C", Value: -12},
+	}
+	if !reflect.DeepEqual(values, exp) {
+		t.Errorf("wrong values: %+v", values)
+	}
+
+	values = d.Decode(Frame{ID: 257, Data: []byte{1, 50}})
+	if !reflect.DeepEqual(values, []Value{
+		{Message: "Muxed", Signal: "Select", Value: 1},
+		{Message: "Muxed", Signal: "Fuel", Unit: "kPa", Value: 50},
+	}) {
+		t.Errorf("wrong mux values: %+v", values)
+	}
+
+	// short frames don't have all signals
+	values = d.Decode(Frame{ID: 257, Data: []byte{0}})
+	if len(values) != 1 {
+		t.Errorf("wrong short frame values: %+v", values)
+	}
+
+	// without j1939 the full extended ID must match
+	values = d.Decode(Frame{ID: 0x18f00401, Extended: true, Data: make([]byte, 8)})
+	if len(values) != 0 {
+		t.Errorf("unexpected values: %+v", values)
+	}
+}
+
+func TestJ1939(t *testing.T) {
+	if PGN(0x0cf00400) != 61444 || PGN(0x18feec00) != 65260 ||
+		PGN(0x18ea0021) != 0xea00 {
+		t.Error("wrong pgn")
+	}
+
+	if !NotAvailable(0xffff, 16) || NotAvailable(0xfaff, 16) ||
+		!NotAvailable(0xf, 4) || NotAvailable(0xd, 4) || NotAvailable(1, 1) {
+		t.Error("wrong not available")
+	}
+
+	db, err := ParseDBC(strings.NewReader(testDBC))
+	if err != nil {
+		t.Fatal("Error parsing: ", err)
+	}
+
+	d := NewDecoder(db, true)
+
+	// EEC1 from a different source address and priority
+	values := d.Decode(Frame{ID: 0x18f00401, Extended: true,
+		Data: []byte{0xf3, 0, 0, 0x40, 0x1f, 0, 0, 0}})
+	exp := []Value{
+		{Message: "EEC1", Signal: "EngineSpeed", Unit: "rpm", Value: 1000},
+		{Message: "EEC1", Signal: "EngineTorqueMode", Value: 3},
+	}
+	if !reflect.DeepEqual(values, exp) {
+		t.Errorf("wrong values: %+v", values)
+	}
+
+	// not available values are skipped
+	values = d.Decode(Frame{ID: 0x0cf00400, Extended: true,
+		Data: []byte{0xff, 0, 0, 0xff, 0xff, 0, 0, 0}})
+	if len(values) != 0 {
+		t.Errorf("unexpected values: %+v", values)
+	}
+}
+
+func TestReassembler(t *testing.T) {
+	r := NewReassembler()
+
+	// vehicle identification, 10 bytes in 2 packets
+	frames := []Frame{
+		{ID: 0x18ecff00, Extended: true, Data: []byte{tpBAM, 10, 0, 2, 0xff, 0xec, 0xfe, 0}},
+		{ID: 0x18ebff00, Extended: true, Data: []byte{1, 'A', 'B', 'C', 'D', 'E', 'F', 'G'}},
+		{ID: 0x18ebff00, Extended: true, Data: []byte{2, 'H', 'I', '*', 0xff, 0xff, 0xff, 0xff}},
+	}
+
+	for i, f := range frames {
+		ret, ok := r.Add(f)
+		if i < 2 {
+			if ok {
+				t.Errorf("unexpected frame %v: %+v", i, ret)
+			}
+			continue
+		}
+
+		exp := Frame{ID: 0x18feec00, Extended: true, Data: []byte("ABCDEFGHI*")}
+		if !ok || !reflect.DeepEqual(ret, exp) {
+			t.Errorf("wrong reassembled frame: %+v", ret)
+		}
+	}
+
+	// a missed packet drops the message
+	r.Add(frames[0])
+	if _, ok := r.Add(frames[2]); ok {
+		t.Error("expected missed packet to drop message")
+	}
+	if _, ok := r.Add(frames[1]); ok {
+		t.Error("expected dropped message")
+	}
+
+	// other frames pass through
+	f := Frame{ID: 0x100, Data: []byte{1}}
+	ret, ok := r.Add(f)
+	if !ok || !reflect.DeepEqual(ret, f) {
+		t.Errorf("wrong frame: %+v", ret)
+	}
+}
@@ -0,0 +1,216 @@
+package can
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Database is the messages of a DBC file
+type Database struct {
+	Messages []Message
+}
+
+// Message is a CAN message
+type Message struct {
+	ID       uint32
+	Extended bool
+	Name     string
+	Size     int
+	Signals  []Signal
+}
+
+// Signal is a value in a message. Values are raw*Factor + Offset.
+type Signal struct {
+	Name   string
+	Start  int
+	Length int
+	// BigEndian signals are Motorola byte order, and Start is the most
+	// significant bit. Little endian (Intel) signals start at the least
+	// significant bit.
+	BigEndian bool
+	Signed    bool
+	Factor    float64
+	Offset    float64
+	Min       float64
+	Max       float64
+	Unit      string
+	// Multiplexor is set for the signal that selects which multiplexed
+	// signals are in a message. Multiplexed signals have a MuxValue of
+	// 0 or more, and other signals -1.
+	Multiplexor bool
+	MuxValue    int
+}
+
+var (
+	reMessage = regexp.MustCompile(`^BO_\s+(\d+)\s+(\w+)\s*:\s*(\d+)`)
+	reSignal  = regexp.MustCompile(`^SG_\s+(\w+)\s*(M|m\d+)?\s*:\s*(\d+)\|(\d+)@([01])([+-])\s*\(\s*([^,]+),\s*([^)]+)\)\s*\[\s*([^|]*)\|([^\]]*)\]\s*"([^"]*)"`)
+)
+
+// dbcExtended is set in the message IDs of extended frames in DBC files
+const dbcExtended = 0x80000000
+
+// ParseDBC parses the messages and signals of a DBC file. Other sections
+// are ignored.
+func ParseDBC(r io.Reader) (*Database, error) {
+	db := &Database{}
+	var msg *Message
+
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for s.Scan() {
+		line++
+		text := strings.TrimSpace(s.Text())
+
+		if strings.HasPrefix(text, "BO_ ") {
+			m := reMessage.FindStringSubmatch(text)
+			if m == nil {
+				return nil, fmt.Errorf("dbc line %v: invalid message", line)
+			}
+
+			id, err := strconv.ParseUint(m[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("dbc line %v: invalid message id", line)
+			}
+
+			size, _ := strconv.Atoi(m[3])
+			db.Messages = append(db.Messages, Message{
+				ID:       uint32(id) &^ dbcExtended,
+				Extended: id&dbcExtended != 0,
+				Name:     m[2],
+				Size:     size,
+			})
+			msg = &db.Messages[len(db.Messages)-1]
+			continue
+		}
+
+		if strings.HasPrefix(text, "SG_ ") {
+			if msg == nil {
+				return nil, fmt.Errorf("dbc line %v: signal without a message", line)
+			}
+
+			sig, err := parseSignal(text)
+			if err != nil {
+				return nil, fmt.Errorf("dbc line %v: %v", line, err)
+			}
+			msg.Signals = append(msg.Signals, sig)
+			continue
+		}
+
+		// signals follow their message, so anything else ends it
+		if text != "" {
+			msg = nil
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func parseSignal(text string) (Signal, error) {
+	m := reSignal.FindStringSubmatch(text)
+	if m == nil {
+		return Signal{}, fmt.Errorf("invalid signal")
+	}
+
+	sig := Signal{
+		Name:      m[1],
+		BigEndian: m[5] == "0",
+		Signed:    m[6] == "-",
+		Unit:      m[11],
+		MuxValue:  -1,
+	}
+
+	switch {
+	case m[2] == "M":
+		sig.Multiplexor = true
+	case m[2] != "":
+		sig.MuxValue, _ = strconv.Atoi(m[2][1:])
+	}
+
+	sig.Start, _ = strconv.Atoi(m[3])
+	sig.Length, _ = strconv.Atoi(m[4])
+	if sig.Length < 1 || sig.Length > 64 {
+		return sig, fmt.Errorf("invalid length for signal %v", sig.Name)
+	}
+
+	var err error
+	for _, f := range []struct {
+		v *float64
+		s string
+	}{{&sig.Factor, m[7]}, {&sig.Offset, m[8]}, {&sig.Min, m[9]}, {&sig.Max, m[10]}} {
+		*f.v, err = strconv.ParseFloat(strings.TrimSpace(f.s), 64)
+		if err != nil {
+			return sig, fmt.Errorf("invalid number for signal %v", sig.Name)
+		}
+	}
+
+	return sig, nil
+}
+
+// Raw returns the raw value of a signal in a message. ok is false if the
+// message is too short.
+func (s Signal) Raw(data []byte) (raw uint64, ok bool) {
+	bit := func(pos int) (uint64, bool) {
+		if pos < 0 || pos/8 >= len(data) {
+			return 0, false
+		}
+		return uint64(data[pos/8]>>(uint(pos)%8)) & 1, true
+	}
+
+	pos := s.Start
+	for i := 0; i < s.Length; i++ {
+		if s.BigEndian {
+			// bits are numbered from the LSB of each byte, and the value
+			// continues at the MSB of the next byte
+			b, ok := bit(pos)
+			if !ok {
+				return 0, false
+			}
+			raw = raw<<1 | b
+			if pos%8 == 0 {
+				pos += 15
+			} else {
+				pos--
+			}
+		} else {
+			b, ok := bit(pos + i)
+			if !ok {
+				return 0, false
+			}
+			raw |= b << uint(i)
+		}
+	}
+
+	return raw, true
+}
+
+// Value returns the scaled value of a signal raw value
+func (s Signal) Value(raw uint64) float64 {
+	if s.Signed && s.Length < 64 && raw&(1<<uint(s.Length-1)) != 0 {
+		// sign extend
+		raw |= ^uint64(0) << uint(s.Length)
+	}
+
+	if s.Signed {
+		return float64(int64(raw))*s.Factor + s.Offset
+	}
+	return float64(raw)*s.Factor + s.Offset
+}
+
+// Decode returns the value of a signal in a message. ok is false if the
+// message is too short.
+func (s Signal) Decode(data []byte) (v float64, ok bool) {
+	raw, ok := s.Raw(data)
+	if !ok {
+		return 0, false
+	}
+	return s.Value(raw), true
+}
@@ -0,0 +1,98 @@
+package can
+
+// Value is a decoded signal value
+type Value struct {
+	Message string
+	Signal  string
+	Unit    string
+	Value   float64
+}
+
+// Decoder decodes the signals in frames with a DBC database
+type Decoder struct {
+	j1939    bool
+	messages map[uint32][]*Message
+	tp       *Reassembler
+}
+
+// NewDecoder creates a decoder. If j1939 is set, extended frames are
+// matched to messages by PGN, broadcast multi-packet messages are
+// reassembled, and not available values are skipped.
+func NewDecoder(db *Database, j1939 bool) *Decoder {
+	d := &Decoder{
+		j1939:    j1939,
+		messages: make(map[uint32][]*Message),
+	}
+
+	if j1939 {
+		d.tp = NewReassembler()
+	}
+
+	for i := range db.Messages {
+		m := &db.Messages[i]
+		key := d.key(m.ID, m.Extended)
+		d.messages[key] = append(d.messages[key], m)
+	}
+
+	return d
+}
+
+// key returns the message map key of an ID
+func (d *Decoder) key(id uint32, extended bool) uint32 {
+	if !extended {
+		return id
+	}
+	if d.j1939 {
+		id = PGN(id)
+	}
+	return id | dbcExtended
+}
+
+// Decode returns the values of the signals in a frame. Frames that aren't
+// in the database return nothing.
+func (d *Decoder) Decode(f Frame) []Value {
+	if d.tp != nil {
+		var ok bool
+		f, ok = d.tp.Add(f)
+		if !ok {
+			return nil
+		}
+	}
+
+	var ret []Value
+	for _, m := range d.messages[d.key(f.ID, f.Extended)] {
+		mux := -1
+		for _, s := range m.Signals {
+			if s.Multiplexor {
+				raw, ok := s.Raw(f.Data)
+				if ok {
+					mux = int(raw)
+				}
+			}
+		}
+
+		for _, s := range m.Signals {
+			if s.MuxValue >= 0 && s.MuxValue != mux {
+				continue
+			}
+
+			raw, ok := s.Raw(f.Data)
+			if !ok {
+				continue
+			}
+
+			if d.j1939 && f.Extended && NotAvailable(raw, s.Length) {
+				continue
+			}
+
+			ret = append(ret, Value{
+				Message: m.Name,
+				Signal:  s.Name,
+				Unit:    s.Unit,
+				Value:   s.Value(raw),
+			})
+		}
+	}
+
+	return ret
+}
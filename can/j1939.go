@@ -0,0 +1,118 @@
+package can
+
+// J1939 transport protocol PGNs
+const (
+	pgnTPCM = 0xec00
+	pgnTPDT = 0xeb00
+)
+
+// tpBAM is the control byte of broadcast announce messages
+const tpBAM = 32
+
+// PGN returns the J1939 parameter group number of an extended ID. The
+// destination address of PDU1 messages is not part of the PGN.
+func PGN(id uint32) uint32 {
+	pf := (id >> 16) & 0xff
+	pgn := (id >> 8) & 0x3ffff
+	if pf < 240 {
+		pgn &^= 0xff
+	}
+	return pgn
+}
+
+// SourceAddress returns the J1939 source address of an extended ID
+func SourceAddress(id uint32) byte {
+	return byte(id)
+}
+
+// NotAvailable returns true if a raw J1939 value is in the error or not
+// available range
+func NotAvailable(raw uint64, length int) bool {
+	switch {
+	case length < 2:
+		return false
+	case length < 8:
+		return raw >= 1<<uint(length)-2
+	default:
+		return raw >= 0xfe<<uint(length-8)
+	}
+}
+
+// bam is a broadcast message being received
+type bam struct {
+	pgn     uint32
+	size    int
+	packets int
+	next    int
+	data    []byte
+}
+
+// Reassembler reassembles J1939 broadcast (BAM) multi-packet messages
+type Reassembler struct {
+	// messages by source address
+	messages map[byte]*bam
+}
+
+// NewReassembler creates a J1939 reassembler
+func NewReassembler() *Reassembler {
+	return &Reassembler{messages: make(map[byte]*bam)}
+}
+
+// Add adds a frame. It returns the reassembled message when the last
+// packet of a broadcast message is added. Other frames are returned
+// unchanged, and transport protocol frames that don't complete a message
+// return ok false.
+func (r *Reassembler) Add(f Frame) (ret Frame, ok bool) {
+	if !f.Extended {
+		return f, true
+	}
+
+	sa := SourceAddress(f.ID)
+
+	switch PGN(f.ID) {
+	case pgnTPCM:
+		if len(f.Data) < 8 || f.Data[0] != tpBAM {
+			// connection mode transfers are to other nodes
+			return f, false
+		}
+		size := int(f.Data[1]) | int(f.Data[2])<<8
+		packets := int(f.Data[3])
+		if packets == 0 || size > packets*7 {
+			delete(r.messages, sa)
+			return f, false
+		}
+		r.messages[sa] = &bam{
+			pgn:     uint32(f.Data[5]) | uint32(f.Data[6])<<8 | uint32(f.Data[7])<<16,
+			size:    size,
+			packets: packets,
+			next:    1,
+		}
+		return f, false
+
+	case pgnTPDT:
+		m, found := r.messages[sa]
+		if !found || len(f.Data) < 8 {
+			return f, false
+		}
+		if int(f.Data[0]) != m.next {
+			// missed a packet
+			delete(r.messages, sa)
+			return f, false
+		}
+		m.data = append(m.data, f.Data[1:8]...)
+		m.next++
+		if m.next <= m.packets {
+			return f, false
+		}
+		delete(r.messages, sa)
+
+		id := 6<<26 | m.pgn<<8 | uint32(sa)
+		if (m.pgn>>8)&0xff < 240 {
+			// global destination
+			id |= 0xff << 8
+		}
+		return Frame{ID: id, Extended: true, Data: m.data[:m.size]}, true
+	}
+
+	return f, true
+}
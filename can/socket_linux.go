@@ -0,0 +1,104 @@
+//go:build linux && !386
+// +build linux,!386
+
+package can
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// from linux/can.h
+const (
+	afCan      = 29
+	canRaw     = 1
+	canEffFlag = 0x80000000
+	canRtrFlag = 0x40000000
+	canErrFlag = 0x20000000
+	canEffMask = 0x1fffffff
+	canSffMask = 0x7ff
+	frameSize  = 16
+)
+
+// sockaddrCan is struct sockaddr_can
+type sockaddrCan struct {
+	family  uint16
+	_       uint16
+	ifindex int32
+	_       [16]byte
+}
+
+// Bus is a raw SocketCAN socket
+type Bus struct {
+	file *os.File
+}
+
+// Open opens a SocketCAN interface like can0, which must be up
+func Open(iface string) (*Bus, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := syscall.Socket(afCan, syscall.SOCK_RAW, canRaw)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	addr := sockaddrCan{family: afCan, ifindex: int32(ifi.Index)}
+	_, _, errno := syscall.Syscall(syscall.SYS_BIND, uintptr(fd),
+		uintptr(unsafe.Pointer(&addr)), unsafe.Sizeof(addr))
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", errno)
+	}
+
+	// non-blocking sockets use the runtime poller, so Close interrupts
+	// Read
+	err = syscall.SetNonblock(fd, true)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	return &Bus{file: os.NewFile(uintptr(fd), "can:"+iface)}, nil
+}
+
+// Read returns the next data frame. Error and remote frames are skipped.
+func (b *Bus) Read() (Frame, error) {
+	var buf [frameSize]byte
+	for {
+		_, err := b.file.Read(buf[:])
+		if err != nil {
+			return Frame{}, err
+		}
+
+		// can_id is in host byte order
+		id := *(*uint32)(unsafe.Pointer(&buf[0]))
+		if id&(canErrFlag|canRtrFlag) != 0 {
+			continue
+		}
+
+		n := int(buf[4])
+		if n > 8 {
+			n = 8
+		}
+
+		f := Frame{Extended: id&canEffFlag != 0,
+			Data: append([]byte{}, buf[8:8+n]...)}
+		if f.Extended {
+			f.ID = id & canEffMask
+		} else {
+			f.ID = id & canSffMask
+		}
+
+		return f, nil
+	}
+}
+
+// Close closes the socket
+func (b *Bus) Close() error {
+	return b.file.Close()
+}
@@ -0,0 +1,22 @@
+//go:build !linux || 386
+// +build !linux 386
+
+package can
+
+// Bus is a raw SocketCAN socket
+type Bus struct{}
+
+// Open opens a SocketCAN interface like can0, which must be up
+func Open(iface string) (*Bus, error) {
+	return nil, ErrUnsupported
+}
+
+// Read returns the next data frame. Error and remote frames are skipped.
+func (b *Bus) Read() (Frame, error) {
+	return Frame{}, ErrUnsupported
+}
+
+// Close closes the socket
+func (b *Bus) Close() error {
+	return nil
+}
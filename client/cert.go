@@ -0,0 +1,307 @@
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/pki"
+	"github.com/simpleiot/simpleiot/system"
+)
+
+// files in Config.CertDir. The key and certificate are stored in one file,
+// so they are replaced together when the certificate is rotated. With a
+// key store, the file only holds the certificate.
+const (
+	certFile   = "device.pem"
+	caCertFile = "ca.pem"
+)
+
+// deviceKey is the name of the device key in Config.KeyStore
+const deviceKey = "device"
+
+// certTransport returns a copy of the transport of client that presents
+// the device certificate
+func (c *Client) certTransport(client *http.Client) (*http.Client, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if client.Transport != nil {
+		ht, ok := client.Transport.(*http.Transport)
+		if !ok {
+			return nil, errors.New("HTTPClient transport must be an *http.Transport to use certificates")
+		}
+		t = ht.Clone()
+	}
+
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.GetClientCertificate = c.clientCert
+
+	ret := *client
+	ret.Transport = t
+	return &ret, nil
+}
+
+// clientCert returns the device certificate for TLS handshakes. No
+// certificate is sent before the device has one.
+func (c *Client) clientCert(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.cert == nil {
+		return &tls.Certificate{}, nil
+	}
+
+	return c.cert, nil
+}
+
+// Cert returns the device certificate, or nil if the device does not have
+// one yet
+func (c *Client) Cert() *x509.Certificate {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.cert == nil {
+		return nil
+	}
+
+	return c.cert.Leaf
+}
+
+// loadCert loads the device certificate from the cert dir, if there is one
+func (c *Client) loadCert() error {
+	b, err := ioutil.ReadFile(filepath.Join(c.config.CertDir, certFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return c.setCert(b)
+}
+
+// keyPair parses a PEM encoded certificate and key. With a key store, the
+// key is the key store key unless the PEM includes one, which is only the
+// case for certificates saved before the key store was used.
+func (c *Client) keyPair(pemBlocks []byte) (tls.Certificate, bool, error) {
+	if c.config.KeyStore == nil || hasPEMKey(pemBlocks) {
+		cert, err := tls.X509KeyPair(pemBlocks, pemBlocks)
+		if err == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		}
+		return cert, false, err
+	}
+
+	var cert tls.Certificate
+	signer, err := c.config.KeyStore.Signer(deviceKey)
+	if err != nil {
+		return cert, false, err
+	}
+
+	for b := pemBlocks; ; {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+
+	if len(cert.Certificate) <= 0 {
+		return cert, false, errors.New("no device certificate")
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return cert, false, err
+	}
+
+	certPub, err := x509.MarshalPKIXPublicKey(cert.Leaf.PublicKey)
+	if err != nil {
+		return cert, false, err
+	}
+
+	keyPub, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return cert, false, err
+	}
+
+	if !bytes.Equal(certPub, keyPub) {
+		return cert, false, errors.New("device certificate does not match the key store key")
+	}
+
+	cert.PrivateKey = signer
+	return cert, true, nil
+}
+
+// hasPEMKey returns true if pemBlocks includes a private key
+func hasPEMKey(pemBlocks []byte) bool {
+	for b := pemBlocks; ; {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return false
+		}
+
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			return true
+		}
+	}
+}
+
+// setCert parses and uses a PEM encoded certificate and key
+func (c *Client) setCert(pemBlocks []byte) error {
+	cert, stored, err := c.keyPair(pemBlocks)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	c.cert = &cert
+	c.certKeyStored = stored
+	c.lock.Unlock()
+	return nil
+}
+
+// saveCert stores a new certificate and its key in the cert dir, and uses
+// it. keyPEM is nil if the key is in the key store.
+func (c *Client) saveCert(keyPEM []byte, certPEM, caPEM string) error {
+	pemBlocks := append([]byte(certPEM), keyPEM...)
+
+	// check it before the old certificate is replaced
+	_, _, err := c.keyPair(pemBlocks)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(c.config.CertDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	if caPEM != "" {
+		err = writeFileAtomic(filepath.Join(c.config.CertDir, caCertFile),
+			[]byte(caPEM), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writeFileAtomic(filepath.Join(c.config.CertDir, certFile),
+		pemBlocks, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = c.setCert(pemBlocks)
+	if err != nil {
+		return err
+	}
+
+	// connections are authenticated when they are opened, so reconnect to
+	// use the new certificate
+	c.httpClient.CloseIdleConnections()
+	return nil
+}
+
+// writeFileAtomic writes a file with a temp file and a rename, so it is
+// never left partly written
+func writeFileAtomic(name string, b []byte, perm os.FileMode) error {
+	tmp := name + ".tmp"
+	err := ioutil.WriteFile(tmp, b, perm)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
+
+// newCSR returns a CSR for a new key. With a key store, the CSR is for the
+// key store key, which can't be read, so keyPEM is nil.
+func (c *Client) newCSR() (keyPEM, csrPEM []byte, err error) {
+	if c.config.KeyStore != nil {
+		csrPEM, err = system.CertificateRequest(c.config.KeyStore, deviceKey,
+			c.config.ID)
+		return nil, csrPEM, err
+	}
+
+	return pki.NewCSR(c.config.ID)
+}
+
+// csr returns the CSR to register with. The key is kept until
+// registration completes, so the certificate matches it.
+func (c *Client) csr() (string, error) {
+	if c.pendingCSR == nil {
+		key, csr, err := c.newCSR()
+		if err != nil {
+			return "", err
+		}
+		c.pendingKey, c.pendingCSR = key, csr
+	}
+
+	return string(c.pendingCSR), nil
+}
+
+// RotateCert gets a new certificate for a new key from the server. The
+// client rotates the certificate automatically when less than a third of
+// its lifetime is left. With a key store, the certificate is renewed for
+// the key store key.
+func (c *Client) RotateCert() error {
+	if c.config.CertDir == "" {
+		return errors.New("no cert dir")
+	}
+
+	keyPEM, csrPEM, err := c.newCSR()
+	if err != nil {
+		return err
+	}
+
+	var r data.CertResponse
+	_, err = c.request(http.MethodPost, "/v1/devices/"+c.config.ID+"/cert",
+		data.CertRequest{CSR: string(csrPEM)}, &r)
+	if err != nil {
+		return err
+	}
+
+	return c.saveCert(keyPEM, r.Cert, r.CACert)
+}
+
+// rotateCerts rotates the certificate when needed until the client is
+// stopped
+func (c *Client) rotateCerts() {
+	for {
+		// a key saved in the cert dir is moved to the key store
+		c.lock.Lock()
+		moveKey := c.cert != nil && c.config.KeyStore != nil && !c.certKeyStored
+		c.lock.Unlock()
+
+		cert := c.Cert()
+		if cert != nil && (moveKey || pki.NeedsRotation(cert, time.Now())) {
+			err := c.RotateCert()
+			if err != nil {
+				log.Println("Error rotating device certificate: ", err)
+			} else {
+				log.Println("Device certificate rotated: ", c.config.ID)
+			}
+		}
+
+		select {
+		case <-time.After(c.config.PollInterval):
+		case <-c.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,797 @@
+// Package client is the device side of SIOT. It registers the device, sends
+// samples, and receives config and commands over HTTP, NATS, or MQTT, so Go
+// devices don't each have to implement this against the raw API.
+//
+// Samples are buffered in memory and sent in batches using the first
+// transport in the configured order that is connected, so a device that
+// loses its NATS or MQTT connection falls back to HTTP. Samples that can't
+// be sent stay buffered until a transport works again. With a StoreDir,
+// they are stored on disk instead, and the backlog is uploaded in time
+// order after the device reconnects. Config and commands are pushed over
+// NATS and MQTT, and fetched over HTTP when neither is connected.
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/adapter"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/system"
+)
+
+// transport names
+const (
+	TransportHTTP = "http"
+	TransportNATS = "nats"
+	TransportMQTT = "mqtt"
+)
+
+// maxBatch is the most samples sent in one message
+const maxBatch = 500
+
+// Config describes how a device connects to a SIOT server
+type Config struct {
+	// ID is the device ID
+	ID string
+	// Key is the device key. If blank, the device registers with
+	// ClaimCode, and OnRegister is called with the new key once the device
+	// is claimed.
+	Key       string
+	ClaimCode string
+	// Type is the device template the device is created with when it is
+	// claimed, like the model of the device
+	Type string
+	// Server is the HTTP URL of the server, like https://siot.example.com.
+	// It is required to register.
+	Server string
+	// NATS is the NATS server URL, like tls://siot.example.com:4222
+	NATS string
+	// MQTT is the MQTT broker URL, like tls://siot.example.com:8883
+	MQTT string
+	// Prefix is the first token of NATS subjects and MQTT topics (default
+	// siot)
+	Prefix string
+	// Transports is the order transports are tried in (default nats, mqtt,
+	// http). Transports without a URL are skipped.
+	Transports []string
+	// BufferSize is the most samples kept in memory while they can't be
+	// sent (default 10000). The oldest samples are dropped when it is full.
+	BufferSize int
+	// StoreDir is where samples that can't be sent are stored, so they
+	// survive long outages and reboots. Samples are only kept in memory
+	// if it is blank.
+	StoreDir string
+	// BacklogBatch is the most stored samples uploaded in one batch
+	// (default 500)
+	BacklogBatch int
+	// BacklogInterval is the delay between backlog batches, which limits
+	// the bandwidth used to catch up after an outage (default 1s)
+	BacklogInterval time.Duration
+	// FlushInterval is how long samples are collected before they are
+	// sent (default 1s)
+	FlushInterval time.Duration
+	// PollInterval is how often config and commands are fetched over HTTP
+	// when NATS and MQTT are not connected (default 1m)
+	PollInterval time.Duration
+	// KeyInterval is how often the server is asked if the device key is
+	// due to be rotated (default 1h). Keys are rotated over HTTP.
+	KeyInterval time.Duration
+	// RetryInterval is the delay after a failed send or registration
+	// (default 10s)
+	RetryInterval time.Duration
+	// Timeout is used for requests (default 10s)
+	Timeout time.Duration
+	// HTTPClient is used for HTTP requests, like to connect through a
+	// proxy. A client with Timeout is used if nil.
+	HTTPClient *http.Client
+	// CertDir enables mutual TLS over HTTP. The device certificate and
+	// key are stored in it. A device without a certificate sends a CSR
+	// when it registers, so Key is not needed, and the certificate is
+	// rotated when less than a third of its lifetime is left. Server must
+	// be the mTLS listener of the server. NATS and MQTT still use Key.
+	CertDir string
+	// KeyStore keeps the device key used with CertDir, like in a TPM, so
+	// it is not stored in CertDir. The key never leaves the key store, so
+	// the certificate is renewed for the same key when it is rotated.
+	KeyStore system.KeyStore
+	// OnRegister is called with the device key when registration
+	// completes, and with the new key when the key is rotated. The key
+	// should be stored, as it is only sent once.
+	OnRegister func(key string)
+	// Adapters are the protocol adapters the client runs, by name, like
+	// modbus or ble. They are passed the device config before OnConfig,
+	// and their samples are sent with Send. See the adapter package.
+	Adapters []string
+	// OnConfig is called with the device config when it changes
+	OnConfig func(data.DeviceConfig)
+	// OnCommand runs a command from the server. The command is removed
+	// from the queue when OnCommand returns, even if it fails.
+	OnCommand func(data.DeviceCommand) error
+}
+
+// Validate checks the config is valid
+func (c Config) Validate() error {
+	if c.ID == "" {
+		return errors.New("device id is required")
+	}
+
+	if c.Key == "" && c.ClaimCode == "" && c.CertDir == "" {
+		return errors.New("device key, claim code, or cert dir is required")
+	}
+
+	if c.KeyStore != nil && c.CertDir == "" {
+		return errors.New("key store requires a cert dir")
+	}
+
+	if (c.Key == "" || c.CertDir != "") && c.Server == "" {
+		return errors.New("server url is required to register")
+	}
+
+	if c.Server == "" && c.NATS == "" && c.MQTT == "" {
+		return errors.New("server, NATS, or MQTT url is required")
+	}
+
+	if c.NATS != "" && strings.ContainsAny(c.ID, ".*> ") {
+		return fmt.Errorf("device id can't be used with NATS: %v", c.ID)
+	}
+
+	if c.MQTT != "" && strings.ContainsAny(c.ID, "/+#") {
+		return fmt.Errorf("device id can't be used with MQTT: %v", c.ID)
+	}
+
+	for _, t := range c.Transports {
+		switch t {
+		case TransportHTTP, TransportNATS, TransportMQTT:
+		default:
+			return fmt.Errorf("unknown transport: %v", t)
+		}
+	}
+
+	if c.BufferSize < 0 {
+		return errors.New("buffer size can't be negative")
+	}
+
+	if c.BacklogBatch < 0 {
+		return errors.New("backlog batch can't be negative")
+	}
+
+	return adapter.Check(c.Adapters)
+}
+
+// transport is a way of connecting to the server
+type transport interface {
+	name() string
+	start()
+	stop()
+	// connected returns true if the transport can be used
+	connected() bool
+	// push returns true if config and commands are pushed to the device
+	push() bool
+	send(samples []data.Sample) error
+	// sendBatch sends a backlog batch
+	sendBatch(batch data.SampleBatch) error
+	// report sends a config report
+	report(r data.ConfigReport) error
+	// sync fetches the config and queued commands that are not pushed
+	sync() error
+	// setKey sets the device key used when the transport reconnects
+	setKey(key string)
+}
+
+// Client connects a device to a SIOT server
+type Client struct {
+	config     Config
+	httpClient *http.Client
+	lock       sync.Mutex
+	key        string
+	// cert is the device certificate when CertDir is set
+	cert *tls.Certificate
+	// certKeyStored is true if the key of cert is in the key store
+	certKeyStored bool
+	// pendingKey and pendingCSR are used to register for a certificate
+	pendingKey []byte
+	pendingCSR []byte
+	buf        []data.Sample
+	store      *store
+	// report is the config report waiting to be sent
+	report     *data.ConfigReport
+	dropped    int
+	transports []transport
+	last       string
+	// devConfig is the last config passed to OnConfig
+	devConfig *data.DeviceConfig
+	adapters  *adapter.Manager
+	// commands are the IDs of recent commands, so commands that are
+	// delivered twice only run once
+	commands []uint64
+	events   chan func()
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// New creates a client. Start connects to the server.
+func New(config Config) (*Client, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Prefix == "" {
+		config.Prefix = "siot"
+	}
+
+	if len(config.Transports) <= 0 {
+		config.Transports = []string{TransportNATS, TransportMQTT,
+			TransportHTTP}
+	}
+
+	if config.BufferSize == 0 {
+		config.BufferSize = 10000
+	}
+
+	if config.BacklogBatch == 0 {
+		config.BacklogBatch = maxBatch
+	}
+
+	if config.BacklogInterval == 0 {
+		config.BacklogInterval = time.Second
+	}
+
+	if config.FlushInterval == 0 {
+		config.FlushInterval = time.Second
+	}
+
+	if config.PollInterval == 0 {
+		config.PollInterval = time.Minute
+	}
+
+	if config.KeyInterval == 0 {
+		config.KeyInterval = time.Hour
+	}
+
+	if config.RetryInterval == 0 {
+		config.RetryInterval = 10 * time.Second
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: config.Timeout}
+	}
+
+	var st *store
+	if config.StoreDir != "" {
+		var err error
+		st, err = openStore(config.StoreDir)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening sample store: %v", err)
+		}
+	}
+
+	c := &Client{
+		config:     config,
+		httpClient: httpClient,
+		key:        config.Key,
+		store:      st,
+		events:     make(chan func(), 100),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	if len(config.Adapters) > 0 {
+		env := adapter.Env{
+			ID: config.ID,
+			Send: func(samples []data.Sample) error {
+				c.Send(samples...)
+				return nil
+			},
+		}
+
+		if config.Server != "" {
+			env.Upload = c.UploadLogs
+		}
+
+		c.adapters = adapter.NewManager(env)
+	}
+
+	if config.CertDir != "" {
+		c.httpClient, err = c.certTransport(httpClient)
+		if err == nil {
+			err = c.loadCert()
+		}
+
+		if err != nil {
+			if st != nil {
+				st.close()
+			}
+			return nil, fmt.Errorf("Error loading device certificate: %v", err)
+		}
+	}
+
+	return c, nil
+}
+
+// Start registers the device if needed, and then connects and sends
+// samples in the background until Stop is called. The adapters are started
+// right away, so samples are buffered while the device registers.
+func (c *Client) Start() {
+	if c.adapters != nil {
+		// names were checked by Validate
+		c.adapters.Start(c.config.Adapters...)
+	}
+
+	go func() {
+		for {
+			select {
+			case fn := <-c.events:
+				fn()
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(c.done)
+
+		if !c.registered() && !c.register() {
+			return
+		}
+
+		if c.config.CertDir != "" {
+			go c.rotateCerts()
+		}
+
+		if c.config.Server != "" {
+			go c.rotateKeys()
+		}
+
+		c.startTransports()
+		c.run()
+
+		for _, t := range c.transports {
+			t.stop()
+		}
+	}()
+}
+
+// Stop disconnects from the server. Samples buffered in memory are stored
+// if there is a store, and dropped if not.
+func (c *Client) Stop() {
+	if c.adapters != nil {
+		c.adapters.Stop()
+	}
+
+	close(c.stop)
+	<-c.done
+
+	if c.store != nil {
+		c.spill(nil)
+		c.store.close()
+	}
+}
+
+// registered returns true if the device has a key, or a certificate when
+// CertDir is set
+func (c *Client) registered() bool {
+	if c.config.CertDir != "" {
+		return c.Cert() != nil
+	}
+
+	return c.Key() != ""
+}
+
+// register registers until the device is claimed. Returns false if the
+// client was stopped.
+func (c *Client) register() bool {
+	logged := false
+
+	for {
+		key, err := c.Register()
+		if err == nil {
+			if key != "" {
+				c.lock.Lock()
+				c.key = key
+				c.lock.Unlock()
+
+				if c.config.OnRegister != nil {
+					c.config.OnRegister(key)
+				}
+			}
+
+			log.Println("Device registered: ", c.config.ID)
+			return true
+		}
+
+		if err != ErrNotClaimed {
+			log.Println("Error registering device: ", err)
+		} else if !logged {
+			log.Println("Waiting for device to be claimed: ", c.config.ID)
+			logged = true
+		}
+
+		select {
+		case <-time.After(c.config.RetryInterval):
+		case <-c.stop:
+			return false
+		}
+	}
+}
+
+func (c *Client) startTransports() {
+	for _, name := range c.config.Transports {
+		var t transport
+		switch {
+		case name == TransportHTTP && c.config.Server != "":
+			t = newHTTPTransport(c)
+		case name == TransportNATS && c.config.NATS != "":
+			t = newNATSTransport(c)
+		case name == TransportMQTT && c.config.MQTT != "":
+			t = newMQTTTransport(c)
+		default:
+			continue
+		}
+
+		t.start()
+		c.transports = append(c.transports, t)
+	}
+}
+
+// run sends samples and syncs config and commands until the client is
+// stopped
+func (c *Client) run() {
+	ticker := time.NewTicker(c.config.FlushInterval)
+	defer ticker.Stop()
+
+	connected := make(map[string]bool)
+	var retry, poll, backlog time.Time
+
+	for {
+		now := time.Now()
+		pushed := false
+
+		for _, t := range c.transports {
+			conn := t.connected()
+			if t.push() && conn {
+				pushed = true
+				// the config may have changed while it was disconnected
+				if !connected[t.name()] {
+					err := t.sync()
+					if err != nil {
+						log.Printf("Error syncing over %v: %v", t.name(), err)
+						conn = false
+					}
+				}
+			}
+			connected[t.name()] = conn
+		}
+
+		if !pushed && now.After(poll) {
+			for _, t := range c.transports {
+				if !t.push() {
+					err := t.sync()
+					if err != nil {
+						log.Printf("Error syncing over %v: %v", t.name(), err)
+					}
+					break
+				}
+			}
+			poll = now.Add(c.config.PollInterval)
+		}
+
+		if now.After(retry) {
+			ok := c.flush() && c.sendReport()
+			if ok && c.store != nil && now.After(backlog) {
+				ok = c.upload()
+				backlog = now.Add(c.config.BacklogInterval)
+			}
+
+			if !ok {
+				retry = now.Add(c.config.RetryInterval)
+			}
+		} else if c.store != nil {
+			// the server can't be reached, so don't hold samples in
+			// memory
+			c.spill(nil)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// flush sends the buffered samples. Returns false if they could not be
+// sent.
+func (c *Client) flush() bool {
+	for {
+		c.lock.Lock()
+		n := len(c.buf)
+		if n > maxBatch {
+			n = maxBatch
+		}
+		batch := c.buf[:n:n]
+		c.buf = c.buf[n:]
+		dropped := c.dropped
+		c.dropped = 0
+		c.lock.Unlock()
+
+		if dropped > 0 {
+			log.Printf("Buffer full, dropped %v samples", dropped)
+		}
+
+		if len(batch) <= 0 {
+			return true
+		}
+
+		ok := c.send(func(t transport) error {
+			return t.send(batch)
+		})
+
+		if !ok {
+			if c.store != nil {
+				c.spill(batch)
+				return false
+			}
+
+			// put the samples back, in front of new samples
+			c.lock.Lock()
+			c.buf = append(batch, c.buf...)
+			c.trim()
+			c.lock.Unlock()
+			return false
+		}
+	}
+}
+
+// spill moves samples that could not be sent, and the samples buffered in
+// memory, to the store
+func (c *Client) spill(samples []data.Sample) {
+	c.lock.Lock()
+	samples = append(samples, c.buf...)
+	c.buf = nil
+	c.lock.Unlock()
+
+	if len(samples) <= 0 {
+		return
+	}
+
+	err := c.store.add(samples)
+	if err != nil {
+		log.Printf("Error storing samples, dropped %v samples: %v",
+			len(samples), err)
+	}
+}
+
+// upload sends the next backlog batch. Returns false if it could not be
+// sent.
+func (c *Client) upload() bool {
+	batch, err := c.store.pending(c.config.BacklogBatch)
+	if err != nil {
+		log.Println("Error reading sample backlog: ", err)
+		return false
+	}
+
+	if batch == nil {
+		return true
+	}
+
+	if !c.send(func(t transport) error { return t.sendBatch(*batch) }) {
+		return false
+	}
+
+	err = c.store.sent()
+	if err != nil {
+		log.Println("Error removing sent backlog batch: ", err)
+		return false
+	}
+
+	return true
+}
+
+// send tries each connected transport in order
+func (c *Client) send(fn func(t transport) error) bool {
+	for _, t := range c.transports {
+		if !t.connected() {
+			continue
+		}
+
+		err := fn(t)
+		if err != nil {
+			log.Printf("Error sending over %v: %v", t.name(), err)
+			continue
+		}
+
+		c.lock.Lock()
+		if c.last != t.name() {
+			log.Println("Sending samples over ", t.name())
+			c.last = t.name()
+		}
+		c.lock.Unlock()
+
+		return true
+	}
+
+	return false
+}
+
+// trim drops the oldest samples when the buffer is full. c.lock must be
+// held.
+func (c *Client) trim() {
+	if over := len(c.buf) - c.config.BufferSize; over > 0 {
+		c.buf = c.buf[over:]
+		c.dropped += over
+	}
+}
+
+// Send buffers samples to be sent. Samples without a time get the current
+// time.
+func (c *Client) Send(samples ...data.Sample) {
+	now := time.Now()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, s := range samples {
+		if s.Time.IsZero() {
+			s.Time = now
+		}
+		c.buf = append(c.buf, s)
+	}
+
+	c.trim()
+}
+
+// ReportConfig tells the server which config the device applied, and the
+// errors for config fields, by JSON field name, that the device failed to
+// apply. It is typically called after OnConfig applies a config. The report
+// is sent in the background, and only the latest report is sent if there
+// are several while the server can't be reached.
+func (c *Client) ReportConfig(config data.DeviceConfig, errs map[string]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.report = &data.ConfigReport{Config: config, Errors: errs}
+}
+
+// sendReport sends the pending config report. Returns false if it could
+// not be sent.
+func (c *Client) sendReport() bool {
+	c.lock.Lock()
+	report := c.report
+	c.lock.Unlock()
+
+	if report == nil {
+		return true
+	}
+
+	if !c.send(func(t transport) error { return t.report(*report) }) {
+		return false
+	}
+
+	c.lock.Lock()
+	if c.report == report {
+		c.report = nil
+	}
+	c.lock.Unlock()
+
+	return true
+}
+
+// Buffered returns the number of samples waiting to be sent, including
+// the stored backlog
+func (c *Client) Buffered() int {
+	c.lock.Lock()
+	n := len(c.buf)
+	c.lock.Unlock()
+
+	if c.store != nil {
+		n += c.store.count()
+	}
+
+	return n
+}
+
+// Transport returns the transport samples were last sent over, or blank if
+// none have been sent
+func (c *Client) Transport() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.last
+}
+
+// Adapters returns the status of the adapters
+func (c *Client) Adapters() []adapter.Status {
+	if c.adapters == nil {
+		return nil
+	}
+	return c.adapters.Status()
+}
+
+// Key returns the device key, which is blank until the device is
+// registered
+func (c *Client) Key() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.key
+}
+
+// queue runs fn in the event goroutine, so callbacks don't block the
+// transports
+func (c *Client) queue(fn func()) {
+	select {
+	case c.events <- fn:
+	default:
+		log.Println("Client event queue full, dropping event")
+	}
+}
+
+// handleConfig updates the adapters and calls OnConfig if the config
+// changed
+func (c *Client) handleConfig(config data.DeviceConfig) {
+	c.queue(func() {
+		if c.devConfig != nil && reflect.DeepEqual(*c.devConfig, config) {
+			return
+		}
+
+		c.devConfig = &config
+
+		if c.adapters != nil {
+			c.adapters.Update(config)
+		}
+
+		if c.config.OnConfig != nil {
+			c.config.OnConfig(config)
+		}
+	})
+}
+
+// handleCommand runs a command that has not already run, and then calls
+// ack so the server removes it from the queue
+func (c *Client) handleCommand(cmd data.DeviceCommand, ack func()) {
+	c.queue(func() {
+		seen := false
+		for _, id := range c.commands {
+			if id == cmd.ID {
+				seen = true
+				break
+			}
+		}
+
+		if !seen {
+			c.commands = append(c.commands, cmd.ID)
+			if len(c.commands) > 100 {
+				c.commands = c.commands[1:]
+			}
+
+			// polls are run by the adapters if there are any
+			if cmd.Command == data.PollCommand && c.adapters != nil {
+				err := c.adapters.Poll(cmd.Args["type"], cmd.Args["id"])
+				if err != nil {
+					log.Printf("Error polling %v: %v", cmd.Args["type"], err)
+				}
+			} else if c.config.OnCommand != nil {
+				err := c.config.OnCommand(cmd)
+				if err != nil {
+					log.Printf("Error running command %v: %v", cmd.Command, err)
+				}
+			}
+		}
+
+		if ack != nil {
+			ack()
+		}
+	})
+}
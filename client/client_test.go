@@ -0,0 +1,909 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/adapter"
+	"github.com/simpleiot/simpleiot/api"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/db/dbtest"
+	"github.com/simpleiot/simpleiot/nats"
+	"github.com/simpleiot/simpleiot/pki"
+	"github.com/simpleiot/simpleiot/system"
+)
+
+// wait waits for cond to be true
+func wait(t *testing.T, what string, cond func() bool) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("timeout waiting for ", what)
+}
+
+// testHandler records the config and commands a client receives
+type testHandler struct {
+	keys     chan string
+	configs  chan data.DeviceConfig
+	commands chan data.DeviceCommand
+}
+
+func newTestHandler() *testHandler {
+	return &testHandler{
+		keys:     make(chan string, 10),
+		configs:  make(chan data.DeviceConfig, 10),
+		commands: make(chan data.DeviceCommand, 10),
+	}
+}
+
+func (h *testHandler) config(c Config) Config {
+	c.OnRegister = func(key string) { h.keys <- key }
+	c.OnConfig = func(config data.DeviceConfig) { h.configs <- config }
+	c.OnCommand = func(cmd data.DeviceCommand) error {
+		h.commands <- cmd
+		return nil
+	}
+	return c
+}
+
+func testSync(t *testing.T, c *Client, dbInst *db.Db, h *testHandler, id string) {
+	err := dbInst.DeviceUpdateConfig(id, data.DeviceConfig{Description: "pump"})
+	if err != nil {
+		t.Fatal("Error updating config: ", err)
+	}
+
+	for done := false; !done; {
+		select {
+		case config := <-h.configs:
+			done = config.Description == "pump"
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for config")
+		}
+	}
+
+	c.ReportConfig(data.DeviceConfig{Description: "pump"}, nil)
+
+	wait(t, "config report", func() bool {
+		dev, _ := dbInst.Device(id)
+		return dev.State.Reported != nil && dev.Twin().Status == data.SyncOK
+	})
+
+	_, err = dbInst.CommandEnqueue(data.DeviceCommand{DeviceID: id,
+		Command: "reboot"})
+	if err != nil {
+		t.Fatal("Error queuing command: ", err)
+	}
+
+	select {
+	case cmd := <-h.commands:
+		if cmd.Command != "reboot" {
+			t.Error("wrong command: ", cmd)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for command")
+	}
+
+	wait(t, "command to be removed", func() bool {
+		cmds, _ := dbInst.DeviceCommands(id)
+		return len(cmds) == 0
+	})
+}
+
+func TestHTTP(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	ts := httptest.NewServer(http.StripPrefix("/v1",
+		api.NewV1Handler(api.ServerArgs{DbInst: dbInst})))
+	defer ts.Close()
+
+	h := newTestHandler()
+	c, err := New(h.config(Config{
+		ID:            "dev1",
+		ClaimCode:     "code1",
+		Server:        ts.URL,
+		NATS:          "nats://127.0.0.1:1",
+		FlushInterval: 10 * time.Millisecond,
+		PollInterval:  10 * time.Millisecond,
+		RetryInterval: 10 * time.Millisecond,
+	}))
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+
+	// samples are buffered until the device is registered
+	c.Send(data.Sample{Type: "temp", Value: 21})
+
+	c.Start()
+	defer c.Stop()
+
+	wait(t, "registration", func() bool {
+		regs, _ := dbInst.Registrations()
+		return len(regs) == 1
+	})
+
+	err = dbInst.RegistrationClaim("dev1", "code1")
+	if err != nil {
+		t.Fatal("Error claiming device: ", err)
+	}
+
+	select {
+	case key := <-h.keys:
+		if id, err := dbInst.DeviceKeyAuth(key); err != nil || id != "dev1" {
+			t.Error("invalid key: ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for registration")
+	}
+
+	// NATS is not reachable, so samples are sent over HTTP
+	wait(t, "samples", func() bool {
+		dev, _ := dbInst.Device("dev1")
+		return len(dev.State.Ios) == 1 && dev.State.Ios[0].Value == 21
+	})
+
+	// the transport is set after the samples are written
+	wait(t, "HTTP transport", func() bool {
+		return c.Transport() == TransportHTTP && c.Buffered() == 0
+	})
+
+	testSync(t, c, dbInst, h, "dev1")
+}
+
+func TestNATS(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	server := nats.NewServer(nats.ServerConfig{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening: ", err)
+	}
+	go server.Serve(l)
+	defer server.Close()
+
+	bridge := nats.NewBridge(server, dbInst, nats.BridgeConfig{
+		Write: func(ctx context.Context, id string, samples []data.Sample) error {
+			return api.WriteSamplesContext(ctx, dbInst, nil, id, samples)
+		},
+	})
+	err = bridge.Start()
+	if err != nil {
+		t.Fatal("Error starting bridge: ", err)
+	}
+	defer bridge.Stop()
+
+	h := newTestHandler()
+	c, err := New(h.config(Config{
+		ID:            "dev1",
+		Key:           "key1",
+		NATS:          "nats://" + l.Addr().String(),
+		FlushInterval: 10 * time.Millisecond,
+		RetryInterval: 10 * time.Millisecond,
+	}))
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+
+	c.Start()
+	defer c.Stop()
+
+	c.Send(data.Sample{Type: "temp", Value: 21})
+
+	wait(t, "samples", func() bool {
+		dev, _ := dbInst.Device("dev1")
+		return len(dev.State.Ios) == 1
+	})
+
+	wait(t, "NATS transport", func() bool {
+		return c.Transport() == TransportNATS
+	})
+
+	testSync(t, c, dbInst, h, "dev1")
+}
+
+func TestBuffer(t *testing.T) {
+	c, err := New(Config{ID: "dev1", Key: "key1", Server: "http://127.0.0.1:1",
+		BufferSize: 3})
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		c.Send(data.Sample{Type: "count", Value: float64(i)})
+	}
+
+	c.startTransports()
+	if c.flush() {
+		t.Fatal("flush should fail")
+	}
+
+	if c.Buffered() != 3 || c.buf[0].Value != 2 || c.buf[0].Time.IsZero() {
+		t.Errorf("wrong buffer: %+v", c.buf)
+	}
+
+	for _, config := range []Config{
+		{Key: "key1", Server: "http://server"},
+		{ID: "dev1", Server: "http://server"},
+		{ID: "dev1", ClaimCode: "code", NATS: "nats://server"},
+		{ID: "dev.1", Key: "key1", NATS: "nats://server"},
+		{ID: "dev1", Key: "key1", Server: "http://server",
+			Transports: []string{"coap"}},
+	} {
+		_, err := New(config)
+		if err == nil {
+			t.Errorf("expected error for %+v", config)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-client-store")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := openStore(dir)
+	if err != nil {
+		t.Fatal("Error opening store: ", err)
+	}
+
+	start := time.Now()
+	// added out of order, read back in time order
+	err = s.add([]data.Sample{
+		{Type: "count", Value: 2, Time: start.Add(2 * time.Second)},
+		{Type: "count", Value: 0, Time: start},
+		{Type: "count", Value: 1, Time: start.Add(time.Second)},
+	})
+	if err != nil {
+		t.Fatal("Error adding samples: ", err)
+	}
+
+	b1, err := s.pending(2)
+	if err != nil {
+		t.Fatal("Error getting batch: ", err)
+	}
+
+	if b1.Seq != 1 || len(b1.Samples) != 2 || b1.Samples[0].Value != 0 ||
+		b1.Samples[1].Value != 1 {
+		t.Fatalf("wrong batch: %+v", b1)
+	}
+
+	// the pending batch does not change until it is sent, even after
+	// the store is reopened
+	s.close()
+	s, err = openStore(dir)
+	if err != nil {
+		t.Fatal("Error reopening store: ", err)
+	}
+	defer s.close()
+
+	b2, err := s.pending(2)
+	if err != nil {
+		t.Fatal("Error getting batch: ", err)
+	}
+
+	if b2.Store != b1.Store || b2.Seq != 1 || len(b2.Samples) != 2 {
+		t.Fatalf("pending batch changed: %+v", b2)
+	}
+
+	if s.count() != 3 {
+		t.Error("wrong count: ", s.count())
+	}
+
+	err = s.sent()
+	if err != nil {
+		t.Fatal("Error removing batch: ", err)
+	}
+
+	b3, err := s.pending(2)
+	if err != nil {
+		t.Fatal("Error getting batch: ", err)
+	}
+
+	if b3.Seq != 2 || len(b3.Samples) != 1 || b3.Samples[0].Value != 2 {
+		t.Fatalf("wrong batch: %+v", b3)
+	}
+
+	s.sent()
+	b4, err := s.pending(2)
+	if err != nil || b4 != nil || s.count() != 0 {
+		t.Fatalf("store should be empty: %+v, %v", b4, err)
+	}
+}
+
+func TestBacklog(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "siot-client-store")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the server is down until the handler is set
+	var handler http.Handler
+	var lock sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(res http.ResponseWriter, req *http.Request) {
+			lock.Lock()
+			h := handler
+			lock.Unlock()
+			if h == nil {
+				http.Error(res, "down", http.StatusServiceUnavailable)
+				return
+			}
+			h.ServeHTTP(res, req)
+		}))
+	defer ts.Close()
+
+	c, err := New(Config{
+		ID:              "dev1",
+		Key:             "key1",
+		Server:          ts.URL,
+		StoreDir:        dir,
+		BacklogBatch:    4,
+		BacklogInterval: 10 * time.Millisecond,
+		FlushInterval:   10 * time.Millisecond,
+		PollInterval:    time.Hour,
+		RetryInterval:   10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+
+	c.Start()
+
+	start := time.Now().Add(-time.Minute)
+	for i := 0; i < 10; i++ {
+		c.Send(data.Sample{Type: "count", Value: float64(i),
+			Time: start.Add(time.Duration(i) * time.Second)})
+	}
+
+	wait(t, "samples to be stored", func() bool {
+		return c.store.count() == 10
+	})
+
+	// samples stored before a restart are still sent
+	c.Stop()
+	c, err = New(Config{
+		ID:              "dev1",
+		Key:             "key1",
+		Server:          ts.URL,
+		StoreDir:        dir,
+		BacklogBatch:    4,
+		BacklogInterval: 10 * time.Millisecond,
+		FlushInterval:   10 * time.Millisecond,
+		PollInterval:    time.Hour,
+		RetryInterval:   10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+
+	c.Start()
+	defer c.Stop()
+
+	if c.Buffered() != 10 {
+		t.Fatal("wrong buffered: ", c.Buffered())
+	}
+
+	lock.Lock()
+	handler = http.StripPrefix("/v1", api.NewV1Handler(api.ServerArgs{DbInst: dbInst}))
+	lock.Unlock()
+
+	wait(t, "backlog upload", func() bool {
+		return c.Buffered() == 0
+	})
+
+	h, err := dbInst.SampleHistory("dev1", start.Add(-time.Second), time.Now(), db.ResolutionRaw)
+	if err != nil {
+		t.Fatal("Error getting history: ", err)
+	}
+
+	if len(h) != 10 {
+		t.Fatal("wrong history: ", h)
+	}
+
+	for i, s := range h {
+		if s.Value != float64(i) {
+			t.Errorf("wrong sample %v: %+v", i, s)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "siot-client-files")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the second chunk fails once, and downloads record their range
+	var lock sync.Mutex
+	var puts int
+	var ranges []string
+	handler := http.StripPrefix("/v1", api.NewV1Handler(api.ServerArgs{DbInst: dbInst}))
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		if req.Method == http.MethodPut {
+			puts++
+			if puts == 2 {
+				lock.Unlock()
+				http.Error(res, "link down", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		if strings.HasSuffix(req.URL.Path, "/data") {
+			ranges = append(ranges, req.Header.Get("Range"))
+		}
+		lock.Unlock()
+		handler.ServeHTTP(res, req)
+	}))
+	defer ts.Close()
+
+	c, err := New(Config{ID: "dev1", Key: "key1", Server: ts.URL})
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+
+	content := bytes.Repeat([]byte("log line\n"), fileChunk/4)
+	_, err = c.UploadFile("app.log", "text/plain", bytes.NewReader(content))
+	if err == nil {
+		t.Fatal("expected upload error")
+	}
+
+	// the upload continues after the first chunk
+	f, err := c.UploadFile("app.log", "text/plain", bytes.NewReader(content))
+	if err != nil || !f.Complete || puts != 4 {
+		t.Fatalf("upload failed: %+v, %v, %v puts", f, err, puts)
+	}
+
+	d, err := dbInst.FileData(f.ID)
+	if err != nil || !bytes.Equal(d, content) {
+		t.Fatal("wrong uploaded data: ", err)
+	}
+
+	blob := []byte("large config blob")
+	sum := sha256.Sum256(blob)
+	f, err = dbInst.FileCreate(data.DeviceFile{DeviceID: "dev1", Name: "blob",
+		Direction: data.FileDownload, Size: int64(len(blob)),
+		SHA256: hex.EncodeToString(sum[:])})
+	if err != nil {
+		t.Fatal("Error creating file: ", err)
+	}
+
+	_, err = dbInst.FileWrite(f.ID, 0, blob)
+	if err != nil {
+		t.Fatal("Error writing file: ", err)
+	}
+
+	// part of the file was downloaded before
+	path := filepath.Join(dir, "blob")
+	err = ioutil.WriteFile(path+".part", blob[:5], 0644)
+	if err != nil {
+		t.Fatal("Error writing partial file: ", err)
+	}
+
+	_, err = c.DownloadFile(f.ID, path)
+	if err != nil {
+		t.Fatal("Error downloading file: ", err)
+	}
+
+	d, err = ioutil.ReadFile(path)
+	if err != nil || !bytes.Equal(d, blob) {
+		t.Errorf("wrong downloaded data: %q, %v", d, err)
+	}
+
+	if len(ranges) != 1 || ranges[0] != "bytes=5-" {
+		t.Error("download not resumed: ", ranges)
+	}
+}
+
+func TestCerts(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "siot-client-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, err := pki.LoadCA(filepath.Join(dir, "ca"), time.Hour)
+	if err != nil {
+		t.Fatal("Error creating CA: ", err)
+	}
+
+	tlsConfig, err := pki.ServerTLSConfig(ca)
+	if err != nil {
+		t.Fatal("Error creating TLS config: ", err)
+	}
+
+	v1 := api.NewV1Handler(api.ServerArgs{DbInst: dbInst, Signer: ca})
+	ts := httptest.NewUnstartedServer(api.NewMTLSHandler(dbInst, ca, v1))
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	config := Config{
+		ID:            "dev1",
+		ClaimCode:     "code1",
+		Server:        ts.URL,
+		CertDir:       filepath.Join(dir, "dev1"),
+		HTTPClient:    ts.Client(),
+		FlushInterval: 10 * time.Millisecond,
+		PollInterval:  10 * time.Millisecond,
+		RetryInterval: 10 * time.Millisecond,
+	}
+
+	c, err := New(config)
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+
+	c.Send(data.Sample{Type: "temp", Value: 21})
+	c.Start()
+
+	wait(t, "registration", func() bool {
+		regs, _ := dbInst.Registrations()
+		return len(regs) == 1
+	})
+
+	err = dbInst.RegistrationClaim("dev1", "code1")
+	if err != nil {
+		t.Fatal("Error claiming device: ", err)
+	}
+
+	wait(t, "samples", func() bool {
+		dev, _ := dbInst.Device("dev1")
+		return len(dev.State.Ios) == 1 && dev.State.Ios[0].Value == 21
+	})
+
+	if c.Key() != "" {
+		t.Error("device got a key")
+	}
+
+	first := pki.Serial(c.Cert())
+
+	err = c.RotateCert()
+	if err != nil {
+		t.Fatal("Error rotating cert: ", err)
+	}
+
+	if pki.Serial(c.Cert()) == first {
+		t.Error("cert was not rotated")
+	}
+
+	c.Stop()
+
+	// the rotated cert is loaded when the device restarts
+	c, err = New(config)
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+
+	cert := c.Cert()
+	if cert == nil || pki.Serial(cert) == first {
+		t.Fatal("rotated cert was not loaded")
+	}
+
+	certs, err := dbInst.DeviceCerts("dev1")
+	if err != nil || len(certs) != 2 {
+		t.Fatal("wrong certs: ", certs, err)
+	}
+
+	_, err = c.request(http.MethodGet, "/v1/devices/dev1", nil, nil)
+	if err != nil {
+		t.Error("Error sending with rotated cert: ", err)
+	}
+
+	err = dbInst.DeviceCertRevoke(pki.Serial(cert))
+	if err != nil {
+		t.Fatal("Error revoking cert: ", err)
+	}
+
+	_, err = c.request(http.MethodGet, "/v1/devices/dev1", nil, nil)
+	if err == nil {
+		t.Error("revoked cert was accepted")
+	}
+}
+
+func TestCertKeyStore(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "siot-client-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, err := pki.LoadCA(filepath.Join(dir, "ca"), time.Hour)
+	if err != nil {
+		t.Fatal("Error creating CA: ", err)
+	}
+
+	tlsConfig, err := pki.ServerTLSConfig(ca)
+	if err != nil {
+		t.Fatal("Error creating TLS config: ", err)
+	}
+
+	v1 := api.NewV1Handler(api.ServerArgs{DbInst: dbInst, Signer: ca})
+	ts := httptest.NewUnstartedServer(api.NewMTLSHandler(dbInst, ca, v1))
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	ks, err := system.OpenKeyStore(system.KeyStoreConfig{
+		Type: system.KeyStoreFile,
+		Dir:  filepath.Join(dir, "keys"),
+	})
+	if err != nil {
+		t.Fatal("Error opening key store: ", err)
+	}
+
+	// the device registers before it has a key store, so its key is
+	// saved in the cert dir
+	config := Config{
+		ID:            "dev1",
+		ClaimCode:     "code1",
+		Server:        ts.URL,
+		CertDir:       filepath.Join(dir, "dev1"),
+		HTTPClient:    ts.Client(),
+		FlushInterval: 10 * time.Millisecond,
+		PollInterval:  10 * time.Millisecond,
+		RetryInterval: 10 * time.Millisecond,
+	}
+
+	c, err := New(config)
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	c.Start()
+
+	wait(t, "registration", func() bool {
+		regs, _ := dbInst.Registrations()
+		return len(regs) == 1
+	})
+
+	err = dbInst.RegistrationClaim("dev1", "code1")
+	if err != nil {
+		t.Fatal("Error claiming device: ", err)
+	}
+
+	wait(t, "certificate", func() bool { return c.Cert() != nil })
+	c.Stop()
+
+	certPath := filepath.Join(config.CertDir, certFile)
+	b, err := ioutil.ReadFile(certPath)
+	if err != nil || !hasPEMKey(b) {
+		t.Fatal("key was not saved in the cert dir: ", err)
+	}
+
+	// with a key store, the key is moved to it
+	config.KeyStore = ks
+	c, err = New(config)
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	c.Start()
+
+	wait(t, "key to move to the key store", func() bool {
+		b, err := ioutil.ReadFile(certPath)
+		return err == nil && !hasPEMKey(b)
+	})
+	c.Stop()
+
+	signer, err := ks.Signer(deviceKey)
+	if err != nil {
+		t.Fatal("Error getting key store key: ", err)
+	}
+
+	c, err = New(config)
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+
+	cert := c.Cert()
+	if cert == nil {
+		t.Fatal("cert was not loaded")
+	}
+
+	certPub, _ := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	keyPub, _ := x509.MarshalPKIXPublicKey(signer.Public())
+	if !bytes.Equal(certPub, keyPub) {
+		t.Error("cert is not for the key store key")
+	}
+
+	_, err = c.request(http.MethodGet, "/v1/devices/dev1", nil, nil)
+	if err != nil {
+		t.Error("Error sending with key store key: ", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	ts := httptest.NewServer(http.StripPrefix("/v1",
+		api.NewV1Handler(api.ServerArgs{DbInst: dbInst})))
+	defer ts.Close()
+
+	err := dbInst.DeviceSample("dev1", data.Sample{Type: "temp", Value: 1})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	key, _, err := dbInst.DeviceKeyCreate("dev1")
+	if err != nil {
+		t.Fatal("Error creating key: ", err)
+	}
+
+	h := newTestHandler()
+	c, err := New(h.config(Config{
+		ID:            "dev1",
+		Key:           key,
+		Server:        ts.URL,
+		FlushInterval: 10 * time.Millisecond,
+		PollInterval:  10 * time.Millisecond,
+		KeyInterval:   10 * time.Millisecond,
+		RetryInterval: 10 * time.Millisecond,
+	}))
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+
+	c.Start()
+	defer c.Stop()
+
+	// the key is not due, so it is kept
+	time.Sleep(50 * time.Millisecond)
+	if c.Key() != key {
+		t.Fatal("key rotated before it was due")
+	}
+
+	err = dbInst.DeviceKeysRotate("dev1", time.Hour)
+	if err != nil {
+		t.Fatal("Error rotating keys: ", err)
+	}
+
+	select {
+	case newKey := <-h.keys:
+		if newKey == key || c.Key() != newKey {
+			t.Error("key was not rotated")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for key rotation")
+	}
+
+	keys, err := dbInst.DeviceKeys("dev1")
+	if err != nil || len(keys) != 2 {
+		t.Fatal("wrong keys: ", keys, err)
+	}
+
+	if keys[0].Rotate || keys[0].Expires.IsZero() || !keys[1].Expires.IsZero() {
+		t.Error("wrong key state after rotation: ", keys)
+	}
+}
+
+func TestAdapters(t *testing.T) {
+	_, err := New(Config{ID: "dev1", Key: "key", Server: "http://localhost",
+		Adapters: []string{"bogus"}})
+	if err == nil {
+		t.Error("Expected error for unknown adapter")
+	}
+
+	// the test adapter reports the length of the description, and logs
+	// each config
+	defer adapter.Unregister("clientTest")
+	err = adapter.Register("clientTest", func(env adapter.Env) (adapter.Adapter, error) {
+		return &testAdapter{env: env}, nil
+	})
+	if err != nil {
+		t.Fatal("Error registering adapter: ", err)
+	}
+
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	ts := httptest.NewServer(http.StripPrefix("/v1",
+		api.NewV1Handler(api.ServerArgs{DbInst: dbInst})))
+	defer ts.Close()
+
+	h := newTestHandler()
+	c, err := New(h.config(Config{
+		ID:            "dev1",
+		ClaimCode:     "code1",
+		Server:        ts.URL,
+		Adapters:      []string{"clientTest"},
+		FlushInterval: 10 * time.Millisecond,
+		PollInterval:  10 * time.Millisecond,
+		RetryInterval: 10 * time.Millisecond,
+	}))
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+
+	c.Start()
+	defer c.Stop()
+
+	wait(t, "registration", func() bool {
+		regs, _ := dbInst.Registrations()
+		return len(regs) == 1
+	})
+
+	err = dbInst.RegistrationClaim("dev1", "code1")
+	if err != nil {
+		t.Fatal("Error claiming device: ", err)
+	}
+
+	err = dbInst.DeviceUpdateConfig("dev1", data.DeviceConfig{Description: "pump"})
+	if err != nil {
+		t.Fatal("Error updating config: ", err)
+	}
+
+	wait(t, "adapter samples", func() bool {
+		dev, _ := dbInst.Device("dev1")
+		for _, io := range dev.State.Ios {
+			if io.Type == "descLen" && io.Value == 4 {
+				return true
+			}
+		}
+		return false
+	})
+
+	wait(t, "adapter logs", func() bool {
+		logs, _ := dbInst.Logs("dev1", time.Time{})
+		return len(logs) > 0 && logs[0].Message == "config pump"
+	})
+
+	status := c.Adapters()
+	if len(status) != 1 || status[0].Name != "clientTest" || !status[0].Running {
+		t.Error("Wrong adapter status: ", status)
+	}
+}
+
+type testAdapter struct {
+	env adapter.Env
+}
+
+func (a *testAdapter) Start() error {
+	return nil
+}
+
+func (a *testAdapter) Update(config data.DeviceConfig) error {
+	err := a.env.Send([]data.Sample{{Type: "descLen",
+		Value: float64(len(config.Description))}})
+	if err != nil {
+		return err
+	}
+
+	return a.env.Upload([]data.LogEntry{{Time: time.Now(),
+		Message: "config " + config.Description}})
+}
+
+func (a *testAdapter) Stop() {}
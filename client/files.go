@@ -0,0 +1,234 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// fileChunk is the size of the chunks files are uploaded in
+const fileChunk = 256 << 10
+
+func (c *Client) filesPath() string {
+	return "/v1/devices/" + c.config.ID + "/files"
+}
+
+// putChunk sends a chunk of a file. If the server has a different offset,
+// the file is returned without an error, so the upload continues at
+// Received.
+func (c *Client) putChunk(f data.DeviceFile, chunk []byte) (data.DeviceFile, error) {
+	url := fmt.Sprintf("%v%v/%v?offset=%v", strings.TrimRight(c.config.Server, "/"),
+		c.filesPath(), f.ID, f.Received)
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(chunk))
+	if err != nil {
+		return f, err
+	}
+
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	c.authorize(req)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return f, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return f, fmt.Errorf("Server error: %v %v %v", resp.Status, url,
+			strings.TrimSpace(string(b)))
+	}
+
+	var ret data.DeviceFile
+	err = json.NewDecoder(resp.Body).Decode(&ret)
+	return ret, err
+}
+
+// UploadFile uploads a file, like a diagnostic bundle or camera snapshot,
+// in chunks. If an upload of the same data was interrupted, it continues
+// where it stopped, so calling UploadFile again after an error only sends
+// the rest of the file. The uploaded file is returned.
+func (c *Client) UploadFile(name, contentType string, r io.ReadSeeker) (data.DeviceFile, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, r)
+	if err != nil {
+		return data.DeviceFile{}, err
+	}
+
+	digest := hex.EncodeToString(hash.Sum(nil))
+
+	var files []data.DeviceFile
+	_, err = c.request(http.MethodGet, c.filesPath()+"?direction="+data.FileUpload,
+		nil, &files)
+	if err != nil {
+		return data.DeviceFile{}, err
+	}
+
+	var f data.DeviceFile
+	for _, e := range files {
+		if e.Name == name && e.SHA256 == digest && e.Size == size {
+			f = e
+		}
+	}
+
+	if f.ID == 0 {
+		_, err = c.request(http.MethodPost, c.filesPath(), data.DeviceFile{
+			Name:        name,
+			ContentType: contentType,
+			Direction:   data.FileUpload,
+			Size:        size,
+			SHA256:      digest,
+		}, &f)
+		if err != nil {
+			return f, err
+		}
+	}
+
+	buf := make([]byte, fileChunk)
+	for !f.Complete {
+		_, err := r.Seek(f.Received, io.SeekStart)
+		if err != nil {
+			return f, err
+		}
+
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return f, err
+		}
+
+		f, err = c.putChunk(f, buf[:n])
+		if err != nil {
+			return f, err
+		}
+	}
+
+	return f, nil
+}
+
+// resumeDownload downloads the rest of a file after the data already in
+// part. The download starts over if the file changed on the server.
+func (c *Client) resumeDownload(f data.DeviceFile, part *os.File) error {
+	offset, err := part.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	if offset >= f.Size {
+		return nil
+	}
+
+	url := fmt.Sprintf("%v%v/%v/data", strings.TrimRight(c.config.Server, "/"),
+		c.filesPath(), f.ID)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		req.Header.Set("If-Range", `"`+f.SHA256+`"`)
+	}
+
+	c.authorize(req)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		err = part.Truncate(0)
+		if err != nil {
+			return err
+		}
+
+		_, err = part.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Server error: %v %v", resp.Status, url)
+	}
+
+	_, err = io.Copy(part, resp.Body)
+	return err
+}
+
+// DownloadFile downloads a file sent to the device, typically after a
+// data.FileCommand, and writes it to path once the digest is checked.
+// Partial data is kept in path.part, so calling DownloadFile again after an
+// error continues where it stopped.
+func (c *Client) DownloadFile(id uint64, path string) (data.DeviceFile, error) {
+	var f data.DeviceFile
+	_, err := c.request(http.MethodGet,
+		c.filesPath()+"/"+strconv.FormatUint(id, 10), nil, &f)
+	if err != nil {
+		return f, err
+	}
+
+	if !f.Complete {
+		return f, errors.New("file is not complete on the server")
+	}
+
+	partName := path + ".part"
+	part, err := os.OpenFile(partName, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return f, err
+	}
+	defer part.Close()
+
+	// keep going while the download makes progress, as the request
+	// timeout can end downloads of large files
+	for {
+		before, err := part.Seek(0, io.SeekEnd)
+		if err != nil {
+			return f, err
+		}
+
+		err = c.resumeDownload(f, part)
+		if err == nil {
+			break
+		}
+
+		after, serr := part.Seek(0, io.SeekEnd)
+		if serr != nil || after <= before {
+			return f, err
+		}
+	}
+
+	_, err = part.Seek(0, io.SeekStart)
+	if err != nil {
+		return f, err
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, part)
+	if err != nil {
+		return f, err
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != f.SHA256 {
+		os.Remove(partName)
+		return f, errors.New("downloaded file does not match the sha256 digest")
+	}
+
+	err = part.Close()
+	if err != nil {
+		return f, err
+	}
+
+	return f, os.Rename(partName, path)
+}
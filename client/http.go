@@ -0,0 +1,261 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// ErrNotClaimed is returned by Register while the device is waiting to be
+// claimed
+var ErrNotClaimed = errors.New("device is not claimed yet")
+
+// authorize adds the device key to a request, for servers that require
+// authentication
+func (c *Client) authorize(req *http.Request) {
+	if key := c.Key(); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+}
+
+// request does an HTTP request to the server and decodes the JSON
+// response into ret, if it is not nil
+func (c *Client) request(method, path string, body interface{}, ret interface{}) (int, error) {
+	var r io.Reader
+	if body != nil {
+		j, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		r = bytes.NewBuffer(j)
+	}
+
+	url := strings.TrimRight(c.config.Server, "/") + path
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		return 0, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	c.authorize(req)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, fmt.Errorf("Server error: %v %v %v",
+			resp.Status, url, strings.TrimSpace(string(b)))
+	}
+
+	if ret != nil {
+		err = json.NewDecoder(resp.Body).Decode(ret)
+		if err != nil {
+			return resp.StatusCode, err
+		}
+	}
+
+	return resp.StatusCode, nil
+}
+
+// UploadLogs uploads log entries of the device over HTTP, like SNMP traps
+// from an adapter
+func (c *Client) UploadLogs(entries []data.LogEntry) error {
+	if c.config.Server == "" {
+		return errors.New("server url is required to upload logs")
+	}
+
+	_, err := c.request(http.MethodPost, "/v1/devices/"+c.config.ID+"/logs",
+		entries, nil)
+	return err
+}
+
+// Register registers the device with its claim code. ErrNotClaimed is
+// returned until the device is claimed, and then the device key is
+// returned. With a CertDir, the device gets a certificate instead, which
+// is stored, and the key is blank. Start registers automatically if the
+// config has no key.
+func (c *Client) Register() (string, error) {
+	req := data.RegisterRequest{ID: c.config.ID, Code: c.config.ClaimCode,
+		Type: c.config.Type}
+	if c.config.CertDir != "" {
+		var err error
+		req.CSR, err = c.csr()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var r data.RegisterResponse
+	status, err := c.request(http.MethodPost, "/v1/register", req, &r)
+	if err != nil {
+		return "", err
+	}
+
+	if c.config.CertDir != "" {
+		if status == http.StatusAccepted || r.Cert == "" {
+			return "", ErrNotClaimed
+		}
+
+		err = c.saveCert(c.pendingKey, r.Cert, r.CACert)
+		if err != nil {
+			return "", err
+		}
+
+		c.pendingKey, c.pendingCSR = nil, nil
+		return "", nil
+	}
+
+	if status == http.StatusAccepted || r.Key == "" {
+		return "", ErrNotClaimed
+	}
+
+	return r.Key, nil
+}
+
+// RotateKey replaces the device key with a new key from the server. The
+// old key keeps working for a while, so connections that use it are not
+// dropped. The client rotates the key automatically when the server says
+// it is due.
+func (c *Client) RotateKey() error {
+	var r data.KeyResponse
+	_, err := c.request(http.MethodPost, "/v1/devices/"+c.config.ID+"/key",
+		nil, &r)
+	if err != nil {
+		return err
+	}
+
+	if r.Key == "" {
+		return errors.New("server did not return a key")
+	}
+
+	c.lock.Lock()
+	c.key = r.Key
+	c.lock.Unlock()
+
+	if c.config.OnRegister != nil {
+		c.config.OnRegister(r.Key)
+	}
+
+	for _, t := range c.transports {
+		t.setKey(r.Key)
+	}
+
+	return nil
+}
+
+// rotateKeys rotates the device key when the server says it is due, until
+// the client is stopped
+func (c *Client) rotateKeys() {
+	for {
+		if c.Key() != "" {
+			var status data.KeyStatus
+			_, err := c.request(http.MethodGet,
+				"/v1/devices/"+c.config.ID+"/key", nil, &status)
+			if err != nil {
+				log.Println("Error checking device key: ", err)
+			} else if status.Due {
+				err := c.RotateKey()
+				if err != nil {
+					log.Println("Error rotating device key: ", err)
+				} else {
+					log.Println("Device key rotated: ", c.config.ID)
+				}
+			}
+		}
+
+		select {
+		case <-time.After(c.config.KeyInterval):
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// ReportFirmware reports the progress of a firmware install to the server.
+// It can be used as system.FirmwareConfig.Report. Reports are sent over
+// HTTP, as firmware is downloaded over HTTP.
+func (c *Client) ReportFirmware(r data.FirmwareReport) error {
+	_, err := c.request(http.MethodPost,
+		"/v1/devices/"+c.config.ID+"/firmware", r, nil)
+	return err
+}
+
+// httpTransport uses the HTTP API. Config and commands are polled.
+type httpTransport struct {
+	c *Client
+}
+
+func newHTTPTransport(c *Client) *httpTransport {
+	return &httpTransport{c}
+}
+
+func (t *httpTransport) name() string    { return TransportHTTP }
+func (t *httpTransport) start()          {}
+func (t *httpTransport) stop()           {}
+func (t *httpTransport) setKey(string)   {}
+func (t *httpTransport) connected() bool { return true }
+func (t *httpTransport) push() bool      { return false }
+
+func (t *httpTransport) send(samples []data.Sample) error {
+	_, err := t.c.request(http.MethodPost,
+		"/v1/devices/"+t.c.config.ID+"/samples", samples, nil)
+	return err
+}
+
+func (t *httpTransport) sendBatch(batch data.SampleBatch) error {
+	_, err := t.c.request(http.MethodPost,
+		"/v1/devices/"+t.c.config.ID+"/batch", batch, nil)
+	return err
+}
+
+func (t *httpTransport) report(r data.ConfigReport) error {
+	_, err := t.c.request(http.MethodPost,
+		"/v1/devices/"+t.c.config.ID+"/config/reported", r, nil)
+	return err
+}
+
+func (t *httpTransport) sync() error {
+	id := t.c.config.ID
+
+	var dev data.Device
+	_, err := t.c.request(http.MethodGet, "/v1/devices/"+id, nil, &dev)
+	if err != nil {
+		return err
+	}
+
+	t.c.handleConfig(dev.Config)
+
+	var cmds []data.DeviceCommand
+	_, err = t.c.request(http.MethodGet, "/v1/devices/"+id+"/cmd", nil, &cmds)
+	if err != nil {
+		return err
+	}
+
+	for _, cmd := range cmds {
+		cmd := cmd
+		path := fmt.Sprintf("/v1/devices/%v/cmd/%v", id, cmd.ID)
+		t.c.handleCommand(cmd, func() {
+			_, err := t.c.request(http.MethodDelete, path, nil, nil)
+			if err != nil {
+				log.Printf("Error removing command %v: %v", cmd.ID, err)
+			}
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/mqtt"
+)
+
+// mqttTransport uses MQTT. The config is retained by the broker, and
+// commands are published with QoS 1, so both arrive when the client
+// subscribes.
+type mqttTransport struct {
+	c      *Client
+	conn   *mqtt.Client
+	prefix string
+}
+
+func newMQTTTransport(c *Client) *mqttTransport {
+	id := c.config.ID
+
+	return &mqttTransport{
+		c: c,
+		conn: mqtt.NewClient(mqtt.ClientConfig{
+			Broker:        c.config.MQTT,
+			ClientID:      id,
+			User:          id,
+			Password:      c.Key(),
+			Timeout:       c.config.Timeout,
+			RetryInterval: c.config.RetryInterval,
+		}),
+		prefix: c.config.Prefix + "/" + id,
+	}
+}
+
+func (t *mqttTransport) name() string    { return TransportMQTT }
+func (t *mqttTransport) connected() bool { return t.conn.Connected() }
+func (t *mqttTransport) push() bool      { return true }
+func (t *mqttTransport) sync() error     { return nil }
+
+func (t *mqttTransport) start() {
+	// subscriptions are made when the client connects
+	err := t.conn.Subscribe(t.prefix+"/config", 1, func(msg mqtt.Message) {
+		var config data.DeviceConfig
+		err := json.Unmarshal(msg.Payload, &config)
+		if err != nil {
+			log.Println("MQTT: invalid config: ", err)
+			return
+		}
+
+		t.c.handleConfig(config)
+	})
+	if err != nil {
+		log.Println("MQTT: error subscribing to config: ", err)
+	}
+
+	err = t.conn.Subscribe(t.prefix+"/command", 1, func(msg mqtt.Message) {
+		var cmd data.DeviceCommand
+		err := json.Unmarshal(msg.Payload, &cmd)
+		if err != nil {
+			log.Println("MQTT: invalid command: ", err)
+			return
+		}
+
+		// the command was removed from the queue when the broker acked it
+		t.c.handleCommand(cmd, nil)
+	})
+	if err != nil {
+		log.Println("MQTT: error subscribing to commands: ", err)
+	}
+
+	t.conn.Start()
+}
+
+func (t *mqttTransport) stop() {
+	t.conn.Stop()
+}
+
+func (t *mqttTransport) setKey(key string) {
+	t.conn.SetPassword(key)
+}
+
+func (t *mqttTransport) send(samples []data.Sample) error {
+	payload, err := json.Marshal(samples)
+	if err != nil {
+		return err
+	}
+
+	return t.conn.Publish(t.prefix+"/samples", payload, 1, false)
+}
+
+func (t *mqttTransport) sendBatch(batch data.SampleBatch) error {
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	return t.conn.Publish(t.prefix+"/batch", payload, 1, false)
+}
+
+func (t *mqttTransport) report(r data.ConfigReport) error {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return t.conn.Publish(t.prefix+"/config/reported", payload, 1, false)
+}
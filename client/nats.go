@@ -0,0 +1,163 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/nats"
+)
+
+// natsTransport uses NATS. Config and commands are pushed by the server.
+type natsTransport struct {
+	c      *Client
+	conn   *nats.Client
+	prefix string
+}
+
+func newNATSTransport(c *Client) *natsTransport {
+	id := c.config.ID
+
+	return &natsTransport{
+		c: c,
+		conn: nats.NewClient(nats.ClientConfig{
+			Server:        c.config.NATS,
+			Name:          id,
+			User:          id,
+			Password:      c.Key(),
+			Timeout:       c.config.Timeout,
+			RetryInterval: c.config.RetryInterval,
+			InboxPrefix:   "_INBOX." + id,
+		}),
+		prefix: c.config.Prefix + "." + id,
+	}
+}
+
+func (t *natsTransport) name() string    { return TransportNATS }
+func (t *natsTransport) connected() bool { return t.conn.Connected() }
+func (t *natsTransport) push() bool      { return true }
+
+func (t *natsTransport) start() {
+	// subscriptions are made when the client connects
+	_, err := t.conn.Subscribe(t.prefix+".config", func(msg nats.Msg) {
+		var config data.DeviceConfig
+		err := json.Unmarshal(msg.Data, &config)
+		if err != nil {
+			log.Println("NATS: invalid config: ", err)
+			return
+		}
+
+		t.c.handleConfig(config)
+	})
+	if err != nil {
+		log.Println("NATS: error subscribing to config: ", err)
+	}
+
+	_, err = t.conn.Subscribe(t.prefix+".command", func(msg nats.Msg) {
+		var cmd data.DeviceCommand
+		err := json.Unmarshal(msg.Data, &cmd)
+		if err != nil {
+			log.Println("NATS: invalid command: ", err)
+			return
+		}
+
+		t.c.handleCommand(cmd, func() {
+			t.respond(msg.Reply, data.StandardResponse{Success: true})
+		})
+	})
+	if err != nil {
+		log.Println("NATS: error subscribing to commands: ", err)
+	}
+
+	t.conn.Start()
+}
+
+func (t *natsTransport) stop() {
+	t.conn.Stop()
+}
+
+func (t *natsTransport) setKey(key string) {
+	t.conn.SetPassword(key)
+}
+
+func (t *natsTransport) respond(reply string, v interface{}) {
+	if reply == "" {
+		return
+	}
+
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	err = t.conn.Publish(reply, "", payload)
+	if err != nil {
+		log.Println("NATS: error sending response: ", err)
+	}
+}
+
+func (t *natsTransport) send(samples []data.Sample) error {
+	return t.request(".samples", samples)
+}
+
+func (t *natsTransport) sendBatch(batch data.SampleBatch) error {
+	return t.request(".batch", batch)
+}
+
+func (t *natsTransport) report(r data.ConfigReport) error {
+	return t.request(".config.reported", r)
+}
+
+// request sends v to the server and waits for it to be written
+func (t *natsTransport) request(subject string, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	msg, err := nats.Request(t.conn, t.prefix+subject, payload,
+		t.c.config.Timeout)
+	if err != nil {
+		return err
+	}
+
+	var resp data.StandardResponse
+	err = json.Unmarshal(msg.Data, &resp)
+	if err != nil {
+		return err
+	}
+
+	if !resp.Success {
+		return errors.New(resp.Error)
+	}
+
+	return nil
+}
+
+// sync requests the config. Queued commands are sent by the server when
+// the device sends samples.
+func (t *natsTransport) sync() error {
+	msg, err := nats.Request(t.conn, t.prefix+".config.get", nil,
+		t.c.config.Timeout)
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		data.DeviceConfig
+		Error string `json:"error"`
+	}
+
+	err = json.Unmarshal(msg.Data, &resp)
+	if err != nil {
+		return err
+	}
+
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+
+	t.c.handleConfig(resp.DeviceConfig)
+	return nil
+}
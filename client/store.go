@@ -0,0 +1,209 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketSamples = []byte("samples")
+	bucketMeta    = []byte("meta")
+	keyStoreID    = []byte("id")
+	keySeq        = []byte("seq")
+	keyPending    = []byte("pending")
+)
+
+// store persists samples that could not be sent, so they survive long
+// outages and reboots. Samples are kept in time order. The oldest samples
+// are moved to a pending batch, which is sent until the server acks it, so
+// a batch that is sent again always has the same samples and sequence
+// number.
+type store struct {
+	db *bolt.DB
+	id string
+}
+
+func openStore(dir string) (*store, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(filepath.Join(dir, "backlog.db"), 0600,
+		&bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &store{db: db}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketSamples)
+		if err != nil {
+			return err
+		}
+
+		meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+		if err != nil {
+			return err
+		}
+
+		// the server uses the store ID to tell a reset store from batches
+		// that were already written
+		id := meta.Get(keyStoreID)
+		if id == nil {
+			b := make([]byte, 8)
+			_, err := rand.Read(b)
+			if err != nil {
+				return err
+			}
+
+			id = []byte(hex.EncodeToString(b))
+			err = meta.Put(keyStoreID, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		s.id = string(id)
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *store) close() error {
+	return s.db.Close()
+}
+
+// add stores samples. Keys are the sample time and a sequence number, so
+// samples are read back in time order.
+func (s *store) add(samples []data.Sample) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketSamples)
+
+		for _, sample := range samples {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+
+			key := make([]byte, 16)
+			binary.BigEndian.PutUint64(key, uint64(sample.Time.UnixNano()))
+			binary.BigEndian.PutUint64(key[8:], seq)
+
+			v, err := json.Marshal(sample)
+			if err != nil {
+				return err
+			}
+
+			err = b.Put(key, v)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// pending returns the batch to send next, moving up to size of the oldest
+// samples into a new batch if there is no pending batch. Returns nil if
+// the store is empty.
+func (s *store) pending(size int) (*data.SampleBatch, error) {
+	var ret *data.SampleBatch
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(bucketMeta)
+
+		if v := meta.Get(keyPending); v != nil {
+			ret = &data.SampleBatch{}
+			return json.Unmarshal(v, ret)
+		}
+
+		b := tx.Bucket(bucketSamples)
+		batch := data.SampleBatch{Store: s.id}
+
+		c := b.Cursor()
+		for k, v := c.First(); k != nil && len(batch.Samples) < size; k, v = c.First() {
+			var sample data.Sample
+			err := json.Unmarshal(v, &sample)
+			if err != nil {
+				return err
+			}
+
+			batch.Samples = append(batch.Samples, sample)
+
+			err = c.Delete()
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(batch.Samples) <= 0 {
+			return nil
+		}
+
+		var seq uint64
+		if v := meta.Get(keySeq); v != nil {
+			seq = binary.BigEndian.Uint64(v)
+		}
+		batch.Seq = seq + 1
+
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, batch.Seq)
+		err := meta.Put(keySeq, v)
+		if err != nil {
+			return err
+		}
+
+		p, err := json.Marshal(batch)
+		if err != nil {
+			return err
+		}
+
+		ret = &batch
+		return meta.Put(keyPending, p)
+	})
+
+	return ret, err
+}
+
+// sent removes the pending batch once the server has it
+func (s *store) sent() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMeta).Delete(keyPending)
+	})
+}
+
+// count returns the number of stored samples, including the pending batch
+func (s *store) count() int {
+	ret := 0
+
+	s.db.View(func(tx *bolt.Tx) error {
+		ret = tx.Bucket(bucketSamples).Stats().KeyN
+
+		if v := tx.Bucket(bucketMeta).Get(keyPending); v != nil {
+			var batch data.SampleBatch
+			if json.Unmarshal(v, &batch) == nil {
+				ret += len(batch.Samples)
+			}
+		}
+
+		return nil
+	})
+
+	return ret
+}
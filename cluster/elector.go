@@ -0,0 +1,208 @@
+// Package cluster coordinates multiple SIOT server instances. One instance
+// is elected leader with a lease in a shared store like Redis. The leader
+// runs as the primary server, which ingests samples and runs singleton
+// jobs like rules and retention. The other instances follow the leader,
+// and one of them takes over if the leader fails to renew its lease.
+package cluster
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// LeaseStore stores leases shared by the instances of a cluster.
+// db.RedisCache is a LeaseStore.
+type LeaseStore interface {
+	// AcquireLease sets key to holder if no one holds it
+	AcquireLease(key, holder string, ttl time.Duration) (bool, error)
+	// RenewLease extends the lease if holder still holds it
+	RenewLease(key, holder string, ttl time.Duration) (bool, error)
+	// ReleaseLease deletes the lease if holder holds it
+	ReleaseLease(key, holder string) error
+	// Get returns the holder of the lease
+	Get(key string) ([]byte, bool, error)
+}
+
+// Config describes an instance of a cluster
+type Config struct {
+	// Key is the lease key (default siot:leader)
+	Key string
+	// URL is the URL of this instance that the other instances follow
+	// when it is leader
+	URL string
+	// TTL is how long the lease is held without being renewed (default
+	// 15s). A new leader is elected within TTL of a leader failing.
+	TTL time.Duration
+	// OnChange is called when the leader changes after Start. leader is
+	// the URL of the new leader, or blank if there is no leader.
+	OnChange func(leader string)
+}
+
+// Elector elects the leader of a cluster. The leader renews its lease
+// every third of the TTL, and the other instances try to acquire the
+// lease at the same interval. If the leader can't reach the store, it
+// steps down before its lease could expire, because another instance can
+// acquire the lease once it expires.
+type Elector struct {
+	store  LeaseStore
+	config Config
+
+	lock    sync.Mutex
+	leader  string
+	renewed time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewElector creates a new elector
+func NewElector(store LeaseStore, config Config) (*Elector, error) {
+	if config.URL == "" {
+		return nil, errors.New("cluster url is required")
+	}
+
+	if config.Key == "" {
+		config.Key = "siot:leader"
+	}
+
+	if config.TTL == 0 {
+		config.TTL = 15 * time.Second
+	}
+
+	return &Elector{
+		store:  store,
+		config: config,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// Campaign runs elections until a leader is known, and returns its URL.
+// It is called before Start to decide which role the instance starts in.
+func (e *Elector) Campaign() string {
+	for {
+		leader := e.elect()
+		if leader != "" {
+			return leader
+		}
+
+		select {
+		case <-time.After(e.config.TTL / 3):
+		case <-e.stop:
+			return ""
+		}
+	}
+}
+
+// Start runs elections in a goroutine until Stop is called
+func (e *Elector) Start() {
+	go func() {
+		defer close(e.done)
+
+		ticker := time.NewTicker(e.config.TTL / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-e.stop:
+				return
+			}
+
+			last := e.Leader()
+			leader := e.elect()
+			if leader != last && e.config.OnChange != nil {
+				e.config.OnChange(leader)
+			}
+		}
+	}()
+}
+
+// Stop stops the elector. If this instance is leader, the lease is
+// released so another instance takes over without waiting for it to
+// expire.
+func (e *Elector) Stop() {
+	close(e.stop)
+	<-e.done
+
+	if e.IsLeader() {
+		err := e.store.ReleaseLease(e.config.Key, e.config.URL)
+		if err != nil {
+			log.Println("Error releasing cluster lease: ", err)
+		}
+	}
+}
+
+// Leader returns the URL of the leader, or blank if it is not known
+func (e *Elector) Leader() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.leader
+}
+
+// IsLeader returns true if this instance is leader
+func (e *Elector) IsLeader() bool {
+	return e.Leader() == e.config.URL
+}
+
+// elect renews or acquires the lease, and returns the leader
+func (e *Elector) elect() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	now := time.Now()
+
+	if e.leader == e.config.URL {
+		ok, err := e.store.RenewLease(e.config.Key, e.config.URL, e.config.TTL)
+		if err != nil {
+			log.Println("Error renewing cluster lease: ", err)
+			// keep leading only if the next renewal is before the lease
+			// expires, with a margin for clock drift and slow stores
+			next := time.Now().Add(e.config.TTL / 3)
+			if next.Before(e.renewed.Add(e.config.TTL - e.config.TTL/5)) {
+				return e.leader
+			}
+			log.Println("Cluster lease about to expire, stepping down")
+			e.leader = ""
+			return e.leader
+		}
+
+		if ok {
+			e.renewed = now
+			return e.leader
+		}
+
+		log.Println("Cluster lease lost, stepping down")
+		e.leader = ""
+	}
+
+	ok, err := e.store.AcquireLease(e.config.Key, e.config.URL, e.config.TTL)
+	if err != nil {
+		log.Println("Error acquiring cluster lease: ", err)
+		return e.leader
+	}
+
+	if ok {
+		log.Println("Elected cluster leader: ", e.config.URL)
+		e.leader = e.config.URL
+		e.renewed = now
+		return e.leader
+	}
+
+	holder, ok, err := e.store.Get(e.config.Key)
+	if err != nil {
+		log.Println("Error reading cluster leader: ", err)
+		return e.leader
+	}
+
+	if !ok {
+		// the lease expired between acquiring and reading it
+		e.leader = ""
+	} else {
+		e.leader = string(holder)
+	}
+
+	return e.leader
+}
@@ -0,0 +1,195 @@
+package cluster
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore is a LeaseStore in memory
+type memStore struct {
+	lock    sync.Mutex
+	holder  map[string]string
+	expires map[string]time.Time
+	down    bool
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		holder:  make(map[string]string),
+		expires: make(map[string]time.Time),
+	}
+}
+
+var errDown = errors.New("store down")
+
+// get returns the holder of an unexpired lease. lock must be held.
+func (s *memStore) get(key string) string {
+	if time.Now().After(s.expires[key]) {
+		delete(s.holder, key)
+	}
+	return s.holder[key]
+}
+
+func (s *memStore) AcquireLease(key, holder string, ttl time.Duration) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.down {
+		return false, errDown
+	}
+
+	if s.get(key) != "" {
+		return false, nil
+	}
+
+	s.holder[key] = holder
+	s.expires[key] = time.Now().Add(ttl)
+	return true, nil
+}
+
+func (s *memStore) RenewLease(key, holder string, ttl time.Duration) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.down {
+		return false, errDown
+	}
+
+	if s.get(key) != holder {
+		return false, nil
+	}
+
+	s.expires[key] = time.Now().Add(ttl)
+	return true, nil
+}
+
+func (s *memStore) ReleaseLease(key, holder string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.down {
+		return errDown
+	}
+
+	if s.get(key) == holder {
+		delete(s.holder, key)
+	}
+	return nil
+}
+
+func (s *memStore) Get(key string) ([]byte, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.down {
+		return nil, false, errDown
+	}
+
+	h := s.get(key)
+	return []byte(h), h != "", nil
+}
+
+func (s *memStore) setDown(down bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.down = down
+}
+
+// waitLeader waits for the leader seen by an elector to be leader
+func waitLeader(t *testing.T, e *Elector, leader string) {
+	start := time.Now()
+	for e.Leader() != leader {
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("expected leader %q, got %q", leader, e.Leader())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestElector(t *testing.T) {
+	store := newMemStore()
+	ttl := 60 * time.Millisecond
+
+	var lock sync.Mutex
+	var changes []string
+
+	newElector := func(url string) *Elector {
+		e, err := NewElector(store, Config{URL: url, TTL: ttl,
+			OnChange: func(leader string) {
+				lock.Lock()
+				changes = append(changes, url+">"+leader)
+				lock.Unlock()
+			}})
+		if err != nil {
+			t.Fatal("Error creating elector: ", err)
+		}
+		return e
+	}
+
+	a := newElector("http://a")
+	b := newElector("http://b")
+
+	if leader := a.Campaign(); leader != "http://a" {
+		t.Fatal("first instance was not elected: ", leader)
+	}
+
+	if leader := b.Campaign(); leader != "http://a" {
+		t.Fatal("second instance does not follow the leader: ", leader)
+	}
+
+	a.Start()
+	b.Start()
+
+	// the leader keeps its lease
+	time.Sleep(3 * ttl)
+	if !a.IsLeader() || b.IsLeader() {
+		t.Fatal("leader changed while renewing")
+	}
+
+	// the other instance takes over when the leader stops
+	a.Stop()
+	waitLeader(t, b, "http://b")
+	b.Stop()
+
+	lock.Lock()
+	if len(changes) != 1 || changes[0] != "http://b>http://b" {
+		t.Error("unexpected changes: ", changes)
+	}
+	lock.Unlock()
+}
+
+func TestElectorStoreDown(t *testing.T) {
+	store := newMemStore()
+	ttl := 60 * time.Millisecond
+
+	// the lease must still be held when the leader steps down, or another
+	// instance could have acquired it while this one still leads
+	expired := make(chan bool, 10)
+	e, err := NewElector(store, Config{URL: "http://a", TTL: ttl,
+		OnChange: func(leader string) {
+			if leader == "" {
+				store.lock.Lock()
+				expired <- !time.Now().Before(store.expires["siot:leader"])
+				store.lock.Unlock()
+			}
+		}})
+	if err != nil {
+		t.Fatal("Error creating elector: ", err)
+	}
+
+	if leader := e.Campaign(); leader != "http://a" {
+		t.Fatal("instance was not elected: ", leader)
+	}
+
+	e.Start()
+	defer e.Stop()
+
+	// the leader steps down when it can't renew
+	store.setDown(true)
+	waitLeader(t, e, "")
+
+	if <-expired {
+		t.Error("leader stepped down after its lease expired")
+	}
+
+	store.setDown(false)
+	waitLeader(t, e, "http://a")
+}
@@ -1,95 +1,1327 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/simpleiot/simpleiot/anomaly"
 	"github.com/simpleiot/simpleiot/api"
 	"github.com/simpleiot/simpleiot/assets/frontend"
+	"github.com/simpleiot/simpleiot/awsiot"
+	"github.com/simpleiot/simpleiot/azureiot"
+	"github.com/simpleiot/simpleiot/bus"
+	"github.com/simpleiot/simpleiot/cluster"
+	"github.com/simpleiot/simpleiot/coap"
+	"github.com/simpleiot/simpleiot/config"
 	"github.com/simpleiot/simpleiot/data"
 	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/grpc"
+	"github.com/simpleiot/simpleiot/logging"
+	"github.com/simpleiot/simpleiot/lorawan"
+	"github.com/simpleiot/simpleiot/modbus"
+	"github.com/simpleiot/simpleiot/mqtt"
+	"github.com/simpleiot/simpleiot/nats"
+	"github.com/simpleiot/simpleiot/network"
+	"github.com/simpleiot/simpleiot/notify"
+	"github.com/simpleiot/simpleiot/oidc"
+	"github.com/simpleiot/simpleiot/ota"
 	"github.com/simpleiot/simpleiot/particle"
+	"github.com/simpleiot/simpleiot/pki"
+	"github.com/simpleiot/simpleiot/report"
+	"github.com/simpleiot/simpleiot/rules"
+	"github.com/simpleiot/simpleiot/script"
 	"github.com/simpleiot/simpleiot/sim"
+	"github.com/simpleiot/simpleiot/sparkplug"
+	"github.com/simpleiot/simpleiot/system"
+	"github.com/simpleiot/simpleiot/trace"
+	"github.com/simpleiot/simpleiot/tunnel"
 )
 
 func main() {
 	flagSim := flag.Bool("sim", false, "Start device simulator")
 	flagSimPortal := flag.String("simPortal", "http://localhost:8080", "Portal URL")
 	flagSimDeviceID := flag.String("simDeviceId", "1234", "Simulation Device ID")
+	flagSimCount := flag.Int("simCount", 1,
+		"Number of simulated devices. If more than 1, -<n> is appended to the IDs.")
 	flagDebugHTTP := flag.Bool("debugHttp", false, "Dump http requests")
+	flagMigrateDryRun := flag.Bool("migrateDryRun", false,
+		"Print pending database migrations and exit")
+	flagConfig := flag.String("config", os.Getenv("SIOT_CONFIG"),
+		"Config file (TOML or JSON)")
+	flagPrintConfig := flag.Bool("printConfig", false,
+		"Print the config and exit")
+
+	var cfg config.Config
+	cfgLoader := config.NewLoader(&cfg)
+	cfgLoader.RegisterFlags(flag.CommandLine)
+
 	flag.Parse()
 
 	if *flagSim {
-		sim.DeviceSim(*flagSimPortal, *flagSimDeviceID)
+		fleet, err := sim.NewFleet(sim.Config{
+			ID:     *flagSimDeviceID,
+			Server: *flagSimPortal,
+		}, *flagSimCount)
+		if err != nil {
+			log.Fatal("Error starting simulator: ", err)
+		}
+		fleet.Start(time.Minute)
+		select {}
 	}
 
 	// default action is to start server
 
+	err := cfgLoader.Load(*flagConfig)
+	if err != nil {
+		log.Fatal("Error loading config: ", err)
+	}
+
+	if *flagPrintConfig {
+		cfgLoader.Write(os.Stdout)
+		os.Exit(0)
+	}
+
+	// optionally keep application logs in rotating files
+	var logOut io.Writer = os.Stderr
+	if cfg.LogDir != "" {
+		logFile, err := system.NewLogFile(system.LogFileConfig{Dir: cfg.LogDir})
+		if err != nil {
+			log.Fatal("Error opening log file: ", err)
+		}
+		defer logFile.Close()
+		logOut = io.MultiWriter(os.Stderr, logFile)
+	}
+
+	// log messages go through the leveled logger. The settings are checked
+	// when the config is loaded.
+	logging.SetOutput(logOut)
+	logging.SetFormat(cfg.LogFormat)
+	logLevel, _ := logging.ParseLevel(cfg.LogLevel)
+	logging.SetLevel(logLevel)
+	logModules, _ := logging.ParseModules(cfg.LogModules)
+	for m, l := range logModules {
+		logging.SetModuleLevel(m, l)
+	}
+	logging.CaptureStdLog()
+
 	// set up local database
-	dataDir := os.Getenv("SIOT_DATA")
-	if dataDir == "" {
-		dataDir = "./"
+	dataDir := cfg.DataDir
+
+	dbOptions := db.Options{
+		CommandTTL:     cfg.Db.CmdTTL,
+		LogTTL:         cfg.Db.LogTTL,
+		KeyRotation:    cfg.Keys.Rotation,
+		KeyOverlap:     cfg.Keys.Overlap,
+		OfflineTimeout: cfg.Db.OfflineTimeout,
+		HistoryCache:   cfg.Db.HistoryCache,
+		UsageLimits: db.UsageLimits{
+			DevicePoints: cfg.Db.DevicePointLimit,
+			DeviceBytes:  cfg.Db.DeviceByteLimit,
+			GroupPoints:  cfg.Db.GroupPointLimit,
+			GroupBytes:   cfg.Db.GroupByteLimit,
+		},
+	}
+
+	dbOptions.EncryptionKey, err = dbKey(cfg, dataDir)
+	if err != nil {
+		log.Fatal("Error loading db key: ", err)
+	}
+
+	if *flagMigrateDryRun {
+		pending, err := db.MigrateDryRun(dataDir, &dbOptions)
+		if err != nil {
+			log.Fatal("Error checking migrations: ", err)
+		}
+
+		if len(pending) <= 0 {
+			fmt.Println("Database is up to date")
+		}
+
+		for _, m := range pending {
+			fmt.Println("Pending migration: ", m)
+		}
+
+		os.Exit(0)
 	}
 
-	dbInst, err := db.NewDb(dataDir)
+	dbInst, err := db.NewDb(dataDir, &dbOptions)
 	if err != nil {
 		log.Println("Error opening db: ", err)
 		os.Exit(-1)
 	}
 
-	// set up influxdb support if configured
-	influxURL := os.Getenv("SIOT_INFLUX_URL")
-	influxUser := os.Getenv("SIOT_INFLUX_USER")
-	influxPass := os.Getenv("SIOT_INFLUX_PASS")
+	slowOp := cfg.Db.SlowOp
+	dbInst.Metrics().SetSlowThreshold(slowOp)
+
+	// changes to the db are published on the event bus
+	dbInst.SetBus(bus.New())
+
+	// optional redis cache for multi-instance deployments
+	var redis *db.RedisCache
+	if cfg.Redis.Addr != "" {
+		redis = db.NewRedisCache(cfg.Redis.Addr, cfg.Redis.Pass, 10*time.Minute)
+		dbInst.SetCache(redis)
+	}
+
+	followURL := cfg.Follow.URL
+	followToken := cfg.Follow.Token
+
+	// in a cluster, the leader runs as the primary and the other instances
+	// follow it. When the leader changes, the instance exits so it is
+	// restarted in its new role.
+	if cfg.Cluster.URL != "" {
+		elector, err := cluster.NewElector(redis, cluster.Config{
+			URL: cfg.Cluster.URL,
+			TTL: cfg.Cluster.TTL,
+			OnChange: func(leader string) {
+				log.Fatalf("Cluster leader changed to %q, restarting\n", leader)
+			},
+		})
+		if err != nil {
+			log.Fatal("Error starting cluster: ", err)
+		}
+
+		leader := elector.Campaign()
+		if leader != cfg.Cluster.URL {
+			log.Println("Following cluster leader: ", leader)
+			followURL = leader
+			followToken = cfg.AdminToken
+		}
+
+		elector.Start()
+	}
+
+	// upstream connections can go through a proxy
+	proxyClient, err := network.ProxyConfig{
+		URL:      cfg.Proxy.URL,
+		User:     cfg.Proxy.User,
+		Password: cfg.Proxy.Password,
+	}.Client()
+	if err != nil {
+		log.Fatal("Error parsing proxy url: ", err)
+	}
+
+	// a follower is a read only replica of a primary server that can be
+	// used to serve dashboards and reports
+	if followURL != "" {
+		dbInst.SetReadOnly(true)
+		follower := api.NewFollower(dbInst, followURL, followToken,
+			cfg.Follow.Resync)
+		follower.SetClient(proxyClient)
+		follower.Start()
+	}
+
+	// an edge server syncs its devices to an upstream server
+	if cfg.Upstream.URL != "" && followURL == "" {
+		id := cfg.Upstream.ID
+		if id == "" {
+			id, err = os.Hostname()
+			if err != nil {
+				log.Fatal("Error getting host name: ", err)
+			}
+		}
+
+		upstream := api.NewUpstream(dbInst, cfg.Upstream.URL, cfg.Upstream.Token,
+			id, cfg.Upstream.Interval)
+		client := *proxyClient
+		client.Timeout = 30 * time.Second
+		upstream.SetClient(&client)
+		upstream.Start()
+	}
+
+	// the primary does the maintenance for followers
+	if followURL == "" {
+		// roll raw sample history into 1m/1h aggregates. Raw samples older
+		// than the retention are compressed, and the compressed samples
+		// kept for the block retention.
+		downsampler := db.NewDownsampler(dbInst, cfg.Db.RawRetention, time.Minute)
+		downsampler.SetBlockRetention(cfg.Db.BlockRetention)
+		downsampler.Start()
 
+		// garbage collect expired commands, etc
+		db.NewExpirer(dbInst, time.Minute).Start()
+
+		// record devices that stop sending samples in their timelines
+		db.NewPresence(dbInst, time.Minute).Start()
+	}
+
+	// compact the db when pruning leaves a lot of free space in the file,
+	// during the maintenance windows if set
+	if cfg.Db.CompactThreshold > 0 && followURL == "" {
+		// the windows are checked when the config is loaded
+		windows, _ := data.ParseMaintenanceWindows(cfg.Maintenance)
+		maintenance := system.NewMaintenance()
+		maintenance.SetWindows(windows, "")
+
+		compactor := db.NewCompactor(dbInst, cfg.Db.CompactThreshold, time.Hour)
+		compactor.SetWindow(maintenance.Open)
+		compactor.Start()
+	}
+
+	// export traces of ingest and storage if configured
+	if cfg.Trace.Endpoint != "" {
+		headers := make(map[string]string)
+		for _, h := range splitList(cfg.Trace.Headers) {
+			// headers are checked when the config is loaded
+			kv := strings.SplitN(h, "=", 2)
+			headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+
+		exporter := trace.NewOTLPExporter(trace.OTLPConfig{
+			Endpoint: cfg.Trace.Endpoint,
+			Service:  cfg.Trace.Service,
+			Headers:  headers,
+		})
+		defer exporter.Stop()
+
+		trace.SetTracer(trace.NewTracer(exporter, cfg.Trace.Sample))
+	}
+
+	// set up influxdb support if configured
 	var influx *db.Influx
 
-	if influxURL != "" {
-		influx, err = db.NewInflux(influxURL, "siot", influxUser, influxPass)
+	if cfg.Influx.URL != "" {
+		var mapping *db.InfluxMapping
+		if cfg.Influx.Mapping != "" {
+			mapping, err = db.LoadInfluxMapping(cfg.Influx.Mapping)
+			if err != nil {
+				log.Fatal("Error loading influx mapping: ", err)
+			}
+		}
+
+		influx, err = db.NewInflux(cfg.Influx.URL, "siot", cfg.Influx.User,
+			cfg.Influx.Pass, mapping)
 		if err != nil {
 			log.Fatal("Error connecting to influxdb: ", err)
 		}
+
+		influx.Metrics().SetSlowThreshold(slowOp)
+
+		err = influx.CreateDownsampleQueries()
+		if err != nil {
+			log.Println("Error creating influx downsample queries: ", err)
+		}
 	}
 
-	// set up particle connection if configured
-	particleAPIKey := os.Getenv("SIOT_PARTICLE_API_KEY")
+	// delete sample history that is older than the retention of its
+	// groups, locally and in influx
+	if cfg.Db.Retention != "" && followURL == "" {
+		// the policies are checked when the config is loaded
+		policies, _ := data.ParseRetentionPolicies(cfg.Db.Retention)
+		db.NewRetainer(dbInst, influx, policies, time.Hour).Start()
+	}
+
+	// finally, start web server
+	port := cfg.Port
+
+	// advertise the server so devices on the LAN can find it
+	if cfgLoader.IsSet("mdns") {
+		// the port is checked when the config is loaded
+		portNum, _ := strconv.Atoi(port)
+
+		mdns := network.NewMdnsAdvertiser(cfg.Mdns, portNum, nil)
+		err = mdns.Start()
+		if err != nil {
+			log.Println("Error starting mDNS advertisement: ", err)
+		} else {
+			defer mdns.Stop()
+		}
+	}
+
+	// optionally queue posted samples on disk so ingest bursts don't
+	// time out requests
+	var ingest *db.IngestQueue
+	if cfg.IngestWorkers > 0 && followURL == "" {
+		ingest, err = db.NewIngestQueue(path.Join(dataDir, "ingest"),
+			cfg.IngestWorkers, func(ctx context.Context, id string, samples []data.Sample) error {
+				return api.WriteSamplesContext(ctx, dbInst, influx, id, samples)
+			})
+		if err != nil {
+			log.Fatal("Error opening ingest queue: ", err)
+		}
+
+		policy, err := db.ParseIngestPolicy(cfg.IngestPolicy)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ingest.SetLimit(int64(cfg.IngestLimitMB)*1024*1024, policy)
+		ingest.Start()
+	}
+
+	// samples from MQTT and NATS devices are written like posted samples
+	writeSamplesContext := func(ctx context.Context, id string, samples []data.Sample) error {
+		return api.WriteSamplesContext(ctx, dbInst, influx, id, samples)
+	}
+
+	if ingest != nil {
+		writeSamplesContext = ingest.EnqueueContext
+	}
+
+	writeSamples := func(id string, samples []data.Sample) error {
+		return writeSamplesContext(context.Background(), id, samples)
+	}
+
+	writeBatch := func(ctx context.Context, id string, batch data.SampleBatch) error {
+		return api.WriteBatchContext(ctx, dbInst, influx, id, batch)
+	}
+
+	// connect devices that speak MQTT, through an external broker or the
+	// embedded broker
+	if (cfg.Mqtt.Broker != "" || cfg.Mqtt.Listen != "") && followURL == "" {
+		var conn mqtt.Conn
+		var client *mqtt.Client
+
+		if cfg.Mqtt.Listen != "" {
+			broker, err := startBroker(cfg, dbInst)
+			if err != nil {
+				log.Fatal("Error starting MQTT broker: ", err)
+			}
+			conn = broker
+		} else {
+			client = mqtt.NewClient(mqtt.ClientConfig{
+				Broker:           cfg.Mqtt.Broker,
+				ClientID:         cfg.Mqtt.ClientID,
+				User:             cfg.Mqtt.User,
+				Password:         cfg.Mqtt.Pass,
+				RetryInterval:    cfg.Mqtt.Retry,
+				MaxRetryInterval: cfg.Mqtt.RetryMax,
+			})
+			conn = client
+		}
+
+		bridge := mqtt.NewBridge(conn, dbInst, mqtt.BridgeConfig{
+			Prefix:     cfg.Mqtt.Prefix,
+			Write:      writeSamplesContext,
+			WriteBatch: writeBatch,
+		})
+
+		err = bridge.Start()
+		if err != nil {
+			log.Fatal("Error starting MQTT bridge: ", err)
+		}
+
+		if client != nil {
+			client.Start()
+		}
+	}
+
+	// connect edge devices that speak NATS
+	if (cfg.Nats.Server != "" || cfg.Nats.Listen != "") && followURL == "" {
+		var conn nats.Conn
+		var client *nats.Client
+
+		if cfg.Nats.Listen != "" {
+			server, err := startNatsServer(cfg, dbInst)
+			if err != nil {
+				log.Fatal("Error starting NATS server: ", err)
+			}
+			conn = server
+		} else {
+			client = nats.NewClient(nats.ClientConfig{
+				Server:   cfg.Nats.Server,
+				Name:     "siot",
+				User:     cfg.Nats.User,
+				Password: cfg.Nats.Pass,
+			})
+			conn = client
+		}
+
+		bridge := nats.NewBridge(conn, dbInst, nats.BridgeConfig{
+			Prefix:     cfg.Nats.Prefix,
+			Write:      writeSamplesContext,
+			WriteBatch: writeBatch,
+		})
+
+		err = bridge.Start()
+		if err != nil {
+			log.Fatal("Error starting NATS bridge: ", err)
+		}
+
+		if client != nil {
+			client.Start()
+		}
+	}
+
+	// constrained devices post samples and get config with CoAP
+	if cfg.Coap.Listen != "" && followURL == "" {
+		conn, err := net.ListenPacket("udp", cfg.Coap.Listen)
+		if err != nil {
+			log.Fatal("Error starting CoAP server: ", err)
+		}
+
+		server := coap.NewServer(dbInst, coap.ServerConfig{Write: writeSamples})
+
+		log.Println("CoAP server listening on ", cfg.Coap.Listen)
+
+		go func() {
+			err := server.Serve(conn)
+			log.Println("CoAP server stopped: ", err)
+		}()
+	}
+
+	if cfg.Modbus.Listen != "" && followURL == "" {
+		m, err := modbus.LoadMap(cfg.Modbus.Map)
+		if err != nil {
+			log.Fatal("Error loading modbus map: ", err)
+		}
+
+		l, err := net.Listen("tcp", cfg.Modbus.Listen)
+		if err != nil {
+			log.Fatal("Error starting Modbus server: ", err)
+		}
+
+		server := modbus.NewServer(modbus.NewGateway(dbInst, m))
+
+		log.Println("Modbus server listening on ", cfg.Modbus.Listen)
+
+		go func() {
+			err := server.Serve(l)
+			log.Println("Modbus server stopped: ", err)
+		}()
+	}
+
+	// LoRaWAN devices send uplinks through a network server
+	var lora *lorawan.Integration
+	if cfg.Lorawan.Network != "" && followURL == "" {
+		var conn mqtt.Conn
+		var client *mqtt.Client
+
+		if cfg.Lorawan.Broker != "" {
+			client = mqtt.NewClient(mqtt.ClientConfig{
+				Broker:   cfg.Lorawan.Broker,
+				ClientID: cfg.Lorawan.ClientID,
+				User:     cfg.Lorawan.User,
+				Password: cfg.Lorawan.Pass,
+			})
+			conn = client
+		}
+
+		lora = lorawan.NewIntegration(conn, dbInst, lorawan.Config{
+			Network: cfg.Lorawan.Network,
+			Decoder: cfg.Lorawan.Decoder,
+			Token:   cfg.Lorawan.Token,
+			Write:   writeSamples,
+		})
+
+		err = lora.Start()
+		if err != nil {
+			log.Fatal("Error starting LoRaWAN integration: ", err)
+		}
+
+		if client != nil {
+			client.Start()
+		}
+	}
+
+	// mirror devices to AWS IoT Core
+	if cfg.AWS.Endpoint != "" && followURL == "" {
+		tlsConfig, err := awsiot.TLSConfig(cfg.AWS.Endpoint, cfg.AWS.Cert,
+			cfg.AWS.Key, cfg.AWS.CA)
+		if err != nil {
+			log.Fatal("Error loading AWS IoT certificate: ", err)
+		}
+
+		client := mqtt.NewClient(mqtt.ClientConfig{
+			Broker:   "tls://" + cfg.AWS.Endpoint,
+			ClientID: cfg.AWS.ClientID,
+			TLS:      tlsConfig,
+		})
+
+		err = awsiot.NewBridge(client, dbInst, awsiot.Config{
+			ThingPrefix: cfg.AWS.ThingPrefix,
+			Topic:       cfg.AWS.Topic,
+			Types:       splitList(cfg.AWS.Types),
+			Shadow:      cfg.AWS.Shadow,
+			Validate:    api.ValidateConfig,
+		}).Start()
+		if err != nil {
+			log.Fatal("Error starting AWS IoT bridge: ", err)
+		}
+
+		client.Start()
+	}
+
+	// republish samples and events to a third party platform
+	if cfg.Forward.Broker != "" && followURL == "" {
+		var events []db.EventType
+		for _, name := range splitList(cfg.Forward.Events) {
+			var t db.EventType
+			err := t.UnmarshalText([]byte(name))
+			if err != nil {
+				log.Fatal("Error parsing forward events: ", err)
+			}
+			events = append(events, t)
+		}
+
+		tlsConfig, err := mqtt.LoadTLS(cfg.Forward.CA, cfg.Forward.Cert,
+			cfg.Forward.Key)
+		if err != nil {
+			log.Fatal("Error loading forward TLS config: ", err)
+		}
+
+		client := mqtt.NewClient(mqtt.ClientConfig{
+			Broker:   cfg.Forward.Broker,
+			ClientID: cfg.Forward.ClientID,
+			User:     cfg.Forward.User,
+			Password: cfg.Forward.Pass,
+			TLS:      tlsConfig,
+		})
+
+		forwarder, err := mqtt.NewForwarder(client, dbInst, mqtt.ForwarderConfig{
+			Topic:      cfg.Forward.Topic,
+			EventTopic: cfg.Forward.EventTopic,
+			Format:     cfg.Forward.Format,
+			Payload:    cfg.Forward.Payload,
+			Types:      splitList(cfg.Forward.Types),
+			Events:     events,
+			QoS:        byte(cfg.Forward.QoS),
+			Retain:     cfg.Forward.Retain,
+		})
+		if err != nil {
+			log.Fatal("Error creating forwarder: ", err)
+		}
+
+		forwarder.Start()
+		client.Start()
+	}
+
+	// publish devices to SCADA systems as a Sparkplug B edge node
+	if cfg.Sparkplug.Broker != "" && followURL == "" {
+		tlsConfig, err := mqtt.LoadTLS(cfg.Sparkplug.CA, cfg.Sparkplug.Cert,
+			cfg.Sparkplug.Key)
+		if err != nil {
+			log.Fatal("Error loading Sparkplug TLS config: ", err)
+		}
+
+		err = sparkplug.NewNode(dbInst, mqtt.ClientConfig{
+			Broker:   cfg.Sparkplug.Broker,
+			ClientID: cfg.Sparkplug.ClientID,
+			User:     cfg.Sparkplug.User,
+			Password: cfg.Sparkplug.Pass,
+			TLS:      tlsConfig,
+		}, sparkplug.Config{
+			GroupID:     cfg.Sparkplug.GroupID,
+			NodeID:      cfg.Sparkplug.NodeID,
+			PrimaryHost: cfg.Sparkplug.PrimaryHost,
+		}).Start()
+		if err != nil {
+			log.Fatal("Error starting Sparkplug node: ", err)
+		}
+	}
+
+	// connect devices to Azure IoT Hub
+	if cfg.Azure.IDScope != "" && followURL == "" {
+		err := azureiot.NewBridge(dbInst, azureiot.Config{
+			IDScope:            cfg.Azure.IDScope,
+			GroupKey:           cfg.Azure.GroupKey,
+			RegistrationPrefix: cfg.Azure.RegistrationPrefix,
+			DPSURL:             cfg.Azure.DPS,
+			Types:              splitList(cfg.Azure.Types),
+		}).Start()
+		if err != nil {
+			log.Fatal("Error starting Azure IoT Hub bridge: ", err)
+		}
+	}
+
+	// Particle devices publish events to the Particle cloud, which are
+	// streamed or posted to webhooks
+	var particleInt *particle.Integration
+	if (cfg.ParticleAPIKey != "" || cfg.ParticleWebhookToken != "") && followURL == "" {
+		particleInt = particle.NewIntegration(dbInst, particle.Config{
+			Token:        cfg.ParticleAPIKey,
+			Prefix:       cfg.ParticleEvent,
+			WebhookToken: cfg.ParticleWebhookToken,
+			Write:        writeSamples,
+		})
+
+		err = particleInt.Start()
+		if err != nil {
+			log.Println("Error starting Particle integration: ", err)
+		}
+	}
+
+	// backend integrators can use gRPC. Followers serve it too, but
+	// commands fail because the db is read only.
+	if cfg.Grpc.Listen != "" {
+		server := &http.Server{
+			Addr:    cfg.Grpc.Listen,
+			Handler: grpc.NewServer(dbInst, cfg.AdminToken),
+		}
+
+		log.Println("gRPC server listening on ", cfg.Grpc.Listen)
 
-	if particleAPIKey != "" {
 		go func() {
-			err := particle.SampleReader("sample", particleAPIKey,
-				func(id string, samples []data.Sample) {
+			err := server.ListenAndServeTLS(cfg.Grpc.Cert, cfg.Grpc.Key)
+			log.Println("gRPC server stopped: ", err)
+		}()
+	}
+
+	// rule notifications and system alerts are logged unless a notifier is
+	// configured
+	var sendNotification func(n data.Notification) error
+	notifiers := notify.Channels{}
+	var sms *notify.SMS
+	// mail sends scheduled reports
+	var mail func(to []string, subject, body string, attachments ...notify.Attachment) error
+
+	if cfg.Email.Server != "" && followURL == "" {
+		email, err := newEmail(cfg, dbInst)
+		if err != nil {
+			log.Fatal("Error setting up email notifications: ", err)
+		}
+
+		email.Start()
+		notifiers[data.ChannelEmail] = email
+		mail = email.Send
+	}
+
+	if cfg.SMS.Provider != "" && followURL == "" {
+		sms, err = newSMS(cfg, dbInst)
+		if err != nil {
+			log.Fatal("Error setting up SMS notifications: ", err)
+		}
+
+		sms.Start()
+		notifiers[data.ChannelSMS] = sms
+	}
+
+	// chat and push notifications are retried for about half an hour
+	const notifyRetries = 5
+
+	if cfg.Slack.URL != "" && followURL == "" {
+		slack, err := notify.NewSlack(dbInst, notify.SlackConfig{
+			URL:     cfg.Slack.URL,
+			Text:    cfg.Slack.Template,
+			Retries: notifyRetries,
+		})
+		if err != nil {
+			log.Fatal("Error setting up Slack notifications: ", err)
+		}
+
+		slack.Start()
+		notifiers[data.ChannelSlack] = slack
+	}
+
+	if cfg.Webhook.URL != "" && followURL == "" {
+		webhook, err := notify.NewWebhook(dbInst, notify.WebhookConfig{
+			URL:     cfg.Webhook.URL,
+			Secret:  cfg.Webhook.Secret,
+			Retries: notifyRetries,
+		})
+		if err != nil {
+			log.Fatal("Error setting up webhook notifications: ", err)
+		}
+
+		webhook.Start()
+		notifiers[data.ChannelWebhook] = webhook
+	}
+
+	if cfg.Pushover.Token != "" && followURL == "" {
+		pushover, err := notify.NewPushover(dbInst, notify.PushoverConfig{
+			Token:    cfg.Pushover.Token,
+			User:     cfg.Pushover.User,
+			Priority: cfg.Pushover.Priority,
+			Retries:  notifyRetries,
+		})
+		if err != nil {
+			log.Fatal("Error setting up Pushover notifications: ", err)
+		}
+
+		pushover.Start()
+		notifiers[data.ChannelPushover] = pushover
+	}
+
+	if len(notifiers) > 0 {
+		sendNotification = notifiers.Notify
+	}
+
+	var tunnels *tunnel.Hub
+	var reporter *report.Reporter
+
+	if followURL == "" {
+		engine := rules.NewEngine(dbInst, rules.Config{
+			Write:  writeSamples,
+			Notify: sendNotification,
+		})
+		err := engine.Start()
+		if err != nil {
+			log.Fatal("Error starting rules engine: ", err)
+		}
+
+		scripts := script.NewEngine(dbInst, script.Config{
+			Write:  writeSamples,
+			Notify: sendNotification,
+		})
+		err = scripts.Start()
+		if err != nil {
+			log.Fatal("Error starting script engine: ", err)
+		}
+
+		if cfg.Anomaly.Enable {
+			c := anomalyConfig(cfg)
+			c.Notify = sendNotification
+			err = anomaly.NewDetector(dbInst, c).Start()
+			if err != nil {
+				log.Fatal("Error starting anomaly detection: ", err)
+			}
+		}
+
+		ota.NewManager(dbInst, ota.Config{}).Start()
+
+		tunnels = tunnel.NewHub(dbInst, tunnel.Config{})
+		tunnels.Start()
+
+		reporter = report.NewReporter(dbInst, report.Config{Mail: mail})
+		reporter.Start()
+	}
+
+	// each tenant has its own db and background jobs. Tenant alerts are
+	// not sent through the server's notification channels.
+	var tenants *db.Tenants
+
+	if cfg.Tenants && followURL == "" {
+		tenants = db.NewTenants(dataDir, &dbOptions, tenantJobs(cfg))
+
+		// start the jobs of existing tenants
+		list, err := dbInst.TenantList()
+		if err != nil {
+			log.Fatal("Error reading tenants: ", err)
+		}
+
+		for _, t := range list {
+			_, err := tenants.Get(t.ID)
+			if err != nil {
+				log.Fatalf("Error opening tenant %v: %v\n", t.ID, err)
+			}
+		}
+	}
+
+	// create the first admin user, so a new install can be logged into
+	if cfg.Auth.Admin != "" && followURL == "" {
+		users, err := dbInst.Users()
+		if err != nil {
+			log.Fatal("Error reading users: ", err)
+		}
+
+		if len(users) == 0 {
+			// validated with the config
+			parts := strings.SplitN(cfg.Auth.Admin, ":", 2)
+			_, err := dbInst.UserInsert(data.User{Username: parts[0],
+				Role: data.UserRoleAdmin}, parts[1])
+			if err != nil {
+				log.Fatal("Error creating admin user: ", err)
+			}
+
+			log.Println("Created admin user: ", parts[0])
+		}
+	}
+
+	if cfg.Auth.Mode == config.AuthModeLocal && cfg.Auth.Admin == "" &&
+		followURL == "" {
+		users, err := dbInst.Users()
+		if err == nil && len(users) == 0 {
+			log.Println("Warning: there are no users to log in with. Set SIOT_AUTH_ADMIN " +
+				"to create the first user, or SIOT_AUTH_MODE=none to disable login.")
+		}
+	}
+
+	// with local auth, users log in to use the API. Users can't log in to
+	// followers since their db is read only, but the admin token works.
+	var sessionTTL, sessionMaxAge time.Duration
+	var oidcProvider *oidc.Provider
+	if cfg.Auth.Mode == config.AuthModeLocal {
+		sessionTTL = cfg.Auth.SessionTTL
+		sessionMaxAge = cfg.Auth.SessionMaxAge
+	}
+
+	if cfg.OIDC.Issuer != "" {
+		// validated with the config
+		roles, _ := oidc.ParseRoles(cfg.OIDC.Roles, cfg.OIDC.DefaultRole)
+		oidcProvider, err = oidc.New(oidc.Config{
+			Issuer:        cfg.OIDC.Issuer,
+			ClientID:      cfg.OIDC.ClientID,
+			ClientSecret:  cfg.OIDC.ClientSecret,
+			RedirectURL:   cfg.OIDC.RedirectURL,
+			Scopes:        strings.Fields(cfg.OIDC.Scopes),
+			UsernameClaim: cfg.OIDC.UsernameClaim,
+			GroupsClaim:   cfg.OIDC.GroupsClaim,
+			Roles:         roles,
+		})
+		if err != nil {
+			log.Fatal("Error configuring OIDC: ", err)
+		}
+	}
+
+	// devices with client certificates connect to the mTLS listener.
+	// Certificates are signed by the built-in CA unless a sign command for
+	// an external CA is configured.
+	var signer pki.Signer
+	if cfg.MTLS.Listen != "" {
+		if cfg.MTLS.SignCommand != "" {
+			caPEM, err := ioutil.ReadFile(cfg.MTLS.CACert)
+			if err != nil {
+				log.Fatal("Error reading CA certificate: ", err)
+			}
+
+			signer, err = pki.NewCommandSigner(cfg.MTLS.SignCommand, caPEM)
+			if err != nil {
+				log.Fatal("Error configuring external CA: ", err)
+			}
+		} else {
+			signer, err = pki.LoadCA(path.Join(dataDir, "pki"), cfg.MTLS.Validity)
+			if err != nil {
+				log.Fatal("Error loading CA: ", err)
+			}
+		}
+	}
+
+	// validated with the config
+	firmwareKeys, _ := data.ParseFirmwareKeys(cfg.Firmware.Keys)
+
+	// record the server's own resource usage so slow leaks are caught
+	// before the process is killed
+	if cfg.Monitor.Interval > 0 && followURL == "" {
+		monitorConfig := system.SelfMonitorConfig{
+			ID:            cfg.Monitor.ID,
+			Interval:      cfg.Monitor.Interval,
+			MaxGoroutines: cfg.Monitor.Goroutines,
+			MaxHeap:       uint64(cfg.Monitor.HeapMB) << 20,
+			MaxFDs:        cfg.Monitor.FDs,
+			MaxQueueDepth: int64(cfg.Monitor.QueueMB) << 20,
+			Send: func(samples []data.Sample) error {
+				if sendNotification != nil {
 					for _, s := range samples {
-						err = dbInst.DeviceSample(id, s)
-						if err != nil {
-							log.Println("Error getting particle sample: ", err)
+						if s.Type != "resourceWarning" {
+							continue
 						}
-					}
-					if influx != nil {
-						err = influx.WriteSamples(samples)
+
+						msg := s.Tags["resource"] + " is back to normal"
+						if s.Value != 0 {
+							msg = s.Tags["resource"] + " is over its limit"
+						}
+
+						err := sendNotification(data.Notification{
+							Description: "resource warning",
+							DeviceID:    cfg.Monitor.ID,
+							Message:     msg,
+							Active:      s.Value != 0,
+							Time:        s.Time,
+						})
 						if err != nil {
-							log.Println("Error writing particle samples to influx: ", err)
+							log.Println("Error sending resource warning: ", err)
 						}
 					}
-				})
+				}
+
+				return api.WriteSamples(dbInst, influx, cfg.Monitor.ID, samples)
+			},
+		}
+
+		if ingest != nil {
+			monitorConfig.QueueDepth = ingest.Pending
+		}
+
+		system.NewSelfMonitor(monitorConfig).Start()
+	}
+
+	// fail over between the server's uplinks, like on a gateway with
+	// ethernet and a cellular modem
+	var netManager *network.Manager
+	if cfg.Network.Interfaces != "" {
+		// validated with the config
+		ifaces, _ := data.ParseNetworkInterfaces(cfg.Network.Interfaces)
+
+		netManager = network.NewManager(cfg.Network.ResetCount)
+		for _, i := range ifaces {
+			switch i.Kind {
+			case "eth":
+				netManager.AddInterface(network.NewEthernet(i.Name))
+			case "wifi":
+				netManager.AddInterface(network.NewWifi(i.Name))
+			case "nm":
+				netManager.AddInterface(network.NewNMInterface(i.Name, ""))
+			}
+		}
+
+		netManager.Start(cfg.Network.Interval)
+
+		if followURL == "" {
+			network.NewStatusPublisher(netManager, cfg.Monitor.ID, cfg.Network.Interval,
+				func(samples []data.Sample) error {
+					return api.WriteSamples(dbInst, influx, cfg.Monitor.ID, samples)
+				}).Start()
+		}
+	}
+
+	err = api.Server(api.ServerArgs{
+		Port:            port,
+		DbInst:          dbInst,
+		Influx:          influx,
+		Ingest:          ingest,
+		GetAsset:        frontend.Asset,
+		Filesystem:      frontend.FileSystem(),
+		Debug:           *flagDebugHTTP,
+		AdminToken:      cfg.AdminToken,
+		SMS:             sms,
+		FirmwareKeys:    firmwareKeys,
+		Tunnels:         tunnels,
+		Lorawan:         lora,
+		Particle:        particleInt,
+		Network:         netManager,
+		Tenants:         tenants,
+		SessionTTL:      sessionTTL,
+		SessionMaxAge:   sessionMaxAge,
+		OIDC:            oidcProvider,
+		Signer:          signer,
+		MTLSListen:      cfg.MTLS.Listen,
+		MTLSCert:        cfg.MTLS.Cert,
+		MTLSKey:         cfg.MTLS.Key,
+		Prometheus:      cfg.Prometheus.Enable,
+		PrometheusToken: cfg.Prometheus.Token,
+		PrometheusTypes: splitList(cfg.Prometheus.Types),
+		Reporter:        reporter,
+	})
+
+	if err != nil {
+		log.Println("Error starting server: ", err)
+	}
+}
+
+// anomalyConfig returns the config of anomaly detection without
+// notifications
+func anomalyConfig(cfg config.Config) anomaly.Config {
+	// the timezone is checked when the config is loaded
+	loc, _ := time.LoadLocation(cfg.Anomaly.Timezone)
+
+	return anomaly.Config{
+		Method:    cfg.Anomaly.Method,
+		Window:    cfg.Anomaly.Window,
+		Threshold: cfg.Anomaly.Threshold,
+		Warmup:    cfg.Anomaly.Warmup,
+		Types:     splitList(cfg.Anomaly.Types),
+		Location:  loc,
+	}
+}
+
+// dbKeyName is the name of the db encryption key in a key store or keyring
+const dbKeyName = "siot-db-key"
 
+// dbKey returns the db encryption key, or nil if the db is not encrypted.
+// A key store key is only created with a new db, so a lost key is an error
+// instead of a key the existing db can't be read with.
+func dbKey(cfg config.Config, dataDir string) ([]byte, error) {
+	switch cfg.Db.KeySource {
+	case "keystore":
+		ks, err := system.OpenKeyStore(system.KeyStoreConfig{
+			Dir: cfg.Db.KeyStoreDir,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := ks.Secret(dbKeyName)
+		if err == system.ErrSecretNotFound && !db.Exists(dataDir) {
+			key = make([]byte, db.KeySize)
+			_, err = rand.Read(key)
 			if err != nil {
-				fmt.Println("Get returned error: ", err)
+				return nil, err
 			}
-		}()
+
+			err = ks.SetSecret(dbKeyName, key)
+			if err == nil {
+				log.Printf("Created db key in %v key store\n", ks.Type())
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return db.DecodeKey(key)
+	case "keyring":
+		key, err := system.KeyringSecret(dbKeyName)
+		if err != nil {
+			return nil, err
+		}
+
+		return db.DecodeKey(key)
 	}
 
-	// finally, start web server
-	port := os.Getenv("SIOT_PORT")
-	if port == "" {
-		port = "8080"
+	if cfg.Db.Key != "" {
+		return db.ParseKey(cfg.Db.Key)
+	}
+
+	if cfg.Db.KeyFile != "" {
+		return db.ReadKeyFile(cfg.Db.KeyFile)
+	}
+
+	return nil, nil
+}
+
+// tenantJobs returns a function that starts the background jobs of a
+// tenant db, and returns a function that stops them
+func tenantJobs(cfg config.Config) func(string, *db.Db) func() {
+	return func(id string, tdb *db.Db) func() {
+		write := func(devID string, samples []data.Sample) error {
+			return api.WriteSamples(tdb, nil, devID, samples)
+		}
+
+		downsampler := db.NewDownsampler(tdb, cfg.Db.RawRetention, time.Minute)
+		downsampler.SetBlockRetention(cfg.Db.BlockRetention)
+		downsampler.Start()
+
+		expirer := db.NewExpirer(tdb, time.Minute)
+		expirer.Start()
+
+		presence := db.NewPresence(tdb, time.Minute)
+		presence.Start()
+
+		stops := []func(){presence.Stop, expirer.Stop, downsampler.Stop}
+
+		if cfg.Db.Retention != "" {
+			policies, _ := data.ParseRetentionPolicies(cfg.Db.Retention)
+			retainer := db.NewRetainer(tdb, nil, policies, time.Hour)
+			retainer.Start()
+			stops = append([]func(){retainer.Stop}, stops...)
+		}
+
+		engine := rules.NewEngine(tdb, rules.Config{Write: write})
+		err := engine.Start()
+		if err != nil {
+			log.Printf("Error starting rules engine of tenant %v: %v\n", id, err)
+		} else {
+			stops = append([]func(){engine.Stop}, stops...)
+		}
+
+		scripts := script.NewEngine(tdb, script.Config{Write: write})
+		err = scripts.Start()
+		if err != nil {
+			log.Printf("Error starting script engine of tenant %v: %v\n", id, err)
+		} else {
+			stops = append([]func(){scripts.Stop}, stops...)
+		}
+
+		if cfg.Anomaly.Enable {
+			detector := anomaly.NewDetector(tdb, anomalyConfig(cfg))
+			err := detector.Start()
+			if err != nil {
+				log.Printf("Error starting anomaly detection of tenant %v: %v\n", id, err)
+			} else {
+				stops = append([]func(){detector.Stop}, stops...)
+			}
+		}
+
+		// tenant reports can only be stored, as email is not shared
+		reporter := report.NewReporter(tdb, report.Config{})
+		reporter.Start()
+		stops = append([]func(){reporter.Stop}, stops...)
+
+		return func() {
+			for _, stop := range stops {
+				stop()
+			}
+		}
+	}
+}
+
+// startBroker starts the embedded MQTT broker. Devices connect with one of
+// their keys as the password, and can only use their own topics. The admin
+// token can use all topics.
+// newEmail creates the email notifier
+func newEmail(cfg config.Config, dbInst *db.Db) (*notify.Email, error) {
+	c := cfg.Email
+
+	// the groups are checked when the config is loaded
+	groups, _ := data.ParseRecipientGroups(c.Groups)
+
+	var body string
+	if c.Template != "" {
+		b, err := ioutil.ReadFile(c.Template)
+		if err != nil {
+			return nil, err
+		}
+		body = string(b)
+	}
+
+	return notify.NewEmail(dbInst, notify.EmailConfig{
+		Server:     c.Server,
+		TLS:        c.TLS,
+		User:       c.User,
+		Pass:       c.Pass,
+		From:       c.From,
+		To:         splitList(c.To),
+		Groups:     groups,
+		Subject:    c.Subject,
+		Body:       body,
+		Retries:    c.Retries,
+		RetryDelay: c.RetryDelay,
+	})
+}
+
+// newSMS creates the SMS notifier
+func newSMS(cfg config.Config, dbInst *db.Db) (*notify.SMS, error) {
+	c := cfg.SMS
+
+	// the groups and quiet hours are checked when the config is loaded
+	groups, _ := data.ParseRecipientGroups(c.Groups)
+	quiet, _ := data.ParseMaintenanceWindows(c.QuietHours)
+
+	return notify.NewSMS(dbInst, notify.SMSConfig{
+		Provider:   c.Provider,
+		URL:        c.URL,
+		User:       c.User,
+		Pass:       c.Pass,
+		From:       c.From,
+		To:         splitList(c.To),
+		Groups:     groups,
+		Body:       c.Template,
+		RateLimit:  c.RateLimit,
+		QuietHours: quiet,
+		Timezone:   c.Timezone,
+		StatusURL:  c.StatusURL,
+		Retries:    c.Retries,
+		RetryDelay: c.RetryDelay,
+	})
+}
+
+// splitList splits a comma separated list
+func splitList(s string) []string {
+	var ret []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			ret = append(ret, v)
+		}
 	}
+	return ret
+}
+
+// isAdminToken compares a password with the admin token in constant time
+func isAdminToken(cfg config.Config, password string) bool {
+	return data.TokenEqual(password, cfg.AdminToken)
+}
+
+func startBroker(cfg config.Config, dbInst *db.Db) (*mqtt.Broker, error) {
+	broker := mqtt.NewBroker(mqtt.BrokerConfig{
+		Auth: func(clientID, user, password string) (mqtt.Permissions, error) {
+			if isAdminToken(cfg, password) {
+				return mqtt.AllPermissions, nil
+			}
+
+			id, err := dbInst.DeviceKeyAuth(password)
+			if err != nil {
+				return mqtt.Permissions{}, err
+			}
+
+			// the user is optional, but must be the device if set
+			if user != "" && user != id {
+				return mqtt.Permissions{}, mqtt.ErrNotAuthorized
+			}
+
+			topics := []string{cfg.Mqtt.Prefix + "/" + id + "/#"}
+			return mqtt.Permissions{Publish: topics, Subscribe: topics}, nil
+		},
+	})
 
-	err = api.Server(port, dbInst, influx, frontend.Asset,
-		frontend.FileSystem(), *flagDebugHTTP)
+	var l net.Listener
+	var err error
+
+	if cfg.Mqtt.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Mqtt.Cert, cfg.Mqtt.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		l, err = tls.Listen("tcp", cfg.Mqtt.Listen,
+			&tls.Config{Certificates: []tls.Certificate{cert}})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		l, err = net.Listen("tcp", cfg.Mqtt.Listen)
+		if err != nil {
+			return nil, err
+		}
+	}
 
+	log.Println("MQTT broker listening on ", cfg.Mqtt.Listen)
+
+	go func() {
+		err := broker.Serve(l)
+		log.Println("MQTT broker stopped: ", err)
+	}()
+
+	return broker, nil
+}
+
+// startNatsServer starts the embedded NATS server. Devices connect with
+// their ID as the user and one of their keys as the password or token, and
+// can only use their own subjects, their own _INBOX.<device id> inbox, and
+// respond to requests. The admin token can use all subjects.
+func startNatsServer(cfg config.Config, dbInst *db.Db) (*nats.Server, error) {
+	serverConfig := nats.ServerConfig{
+		Auth: func(user, password, token string) (nats.Permissions, error) {
+			if password == "" {
+				password = token
+			}
+
+			if isAdminToken(cfg, password) {
+				return nats.AllPermissions, nil
+			}
+
+			id, err := dbInst.DeviceKeyAuth(password)
+			if err != nil {
+				return nats.Permissions{}, err
+			}
+
+			if user != "" && user != id {
+				return nats.Permissions{}, nats.ErrNotAuthorized
+			}
+
+			subjects := []string{cfg.Nats.Prefix + "." + id + ".>"}
+			return nats.Permissions{
+				Publish:   subjects,
+				Subscribe: append(subjects, "_INBOX."+id+".>"),
+			}, nil
+		},
+	}
+
+	// the NATS protocol starts TLS after the server info, so TLS is done by
+	// the server instead of the listener
+	if cfg.Nats.Cert != "" {
+		pair, err := tls.LoadX509KeyPair(cfg.Nats.Cert, cfg.Nats.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		serverConfig.TLS = &tls.Config{Certificates: []tls.Certificate{pair}}
+	}
+
+	l, err := net.Listen("tcp", cfg.Nats.Listen)
 	if err != nil {
-		log.Println("Error starting server: ", err)
+		return nil, err
 	}
+
+	server := nats.NewServer(serverConfig)
+
+	log.Println("NATS server listening on ", cfg.Nats.Listen)
+
+	go func() {
+		err := server.Serve(l)
+		log.Println("NATS server stopped: ", err)
+	}()
+
+	return server, nil
 }
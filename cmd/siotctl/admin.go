@@ -0,0 +1,279 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/logging"
+	"github.com/simpleiot/simpleiot/tunnel"
+)
+
+func export(c *client, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	out := flags.String("o", "", "Output file (default stdout)")
+	flags.Parse(args)
+
+	// exports can take longer than a request
+	c.http.Timeout = 0
+
+	resp, err := c.do(http.MethodGet, "/admin/export", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func keys(c *client, args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+
+	path := "/admin/keys/" + url.PathEscape(args[1])
+
+	switch {
+	case args[0] == "list" && len(args) == 2:
+		var ret []data.KeyStatus
+		err := c.request(http.MethodGet, path, nil, &ret)
+		if err != nil {
+			return err
+		}
+
+		var rows [][]string
+		for _, k := range ret {
+			status := "active"
+			switch {
+			case !k.Revoked.IsZero():
+				status = "revoked"
+			case !k.Active:
+				status = "expired"
+			case k.Due:
+				status = "due"
+			}
+
+			rotateAt := ""
+			if !k.RotateAt.IsZero() {
+				rotateAt = k.RotateAt.Format(time.RFC3339)
+			}
+
+			rows = append(rows, []string{strconv.FormatUint(k.ID, 10),
+				k.Created.Format(time.RFC3339), status, rotateAt})
+		}
+
+		return c.table(ret, "ID\tCREATED\tSTATUS\tROTATE AT", rows)
+	case args[0] == "create" && len(args) == 2:
+		var ret data.KeyResponse
+		err := c.request(http.MethodPost, path, nil, &ret)
+		if err != nil {
+			return err
+		}
+
+		if c.json {
+			return c.print(ret)
+		}
+
+		// the key is only returned once, so print only the key for
+		// scripts
+		fmt.Println(ret.Key)
+		return nil
+	case args[0] == "rotate" && (len(args) == 2 || len(args) == 3):
+		if len(args) == 3 {
+			path += "/rotate?overlap=" + url.QueryEscape(args[2])
+		} else {
+			path += "/rotate"
+		}
+		return c.request(http.MethodPost, path, nil, nil)
+	case (args[0] == "revoke" || args[0] == "delete") && len(args) == 3:
+		return c.request(http.MethodDelete, path+"/"+url.PathEscape(args[2]),
+			nil, nil)
+	default:
+		return errUsage
+	}
+}
+
+// logLevels shows the log level of each module, or changes the default
+// level or the level of a module. A module set to "default" uses the
+// default level again.
+func logLevels(c *client, args []string) error {
+	method := http.MethodPost
+	var body interface{}
+
+	switch len(args) {
+	case 0:
+		method = http.MethodGet
+	case 1:
+		body = logging.Settings{Level: args[0]}
+	case 2:
+		level := args[1]
+		if level == "default" {
+			level = ""
+		}
+		body = logging.Settings{Modules: map[string]string{args[0]: level}}
+	default:
+		return errUsage
+	}
+
+	var ret logging.Settings
+	err := c.request(method, "/admin/log", body, &ret)
+	if err != nil {
+		return err
+	}
+
+	rows := [][]string{{"(default)", ret.Level}}
+	for _, m := range ret.Known {
+		level, ok := ret.Modules[m]
+		if !ok {
+			level = ret.Level + " (default)"
+		}
+		rows = append(rows, []string{m, level})
+	}
+
+	return c.table(ret, "MODULE\tLEVEL", rows)
+}
+
+func registrations(c *client, args []string) error {
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		var ret []data.Registration
+		err := c.request(http.MethodGet, "/admin/registrations", nil, &ret)
+		if err != nil {
+			return err
+		}
+
+		var rows [][]string
+		for _, r := range ret {
+			rows = append(rows, []string{r.DeviceID,
+				strconv.FormatBool(r.Claimed), r.Created.Format(time.RFC3339),
+				r.Expires.Format(time.RFC3339)})
+		}
+
+		return c.table(ret, "DEVICE\tCLAIMED\tCREATED\tEXPIRES", rows)
+	case len(args) == 3 && args[0] == "claim":
+		return c.request(http.MethodPost, "/admin/registrations/"+
+			url.PathEscape(args[1])+"/claim",
+			map[string]string{"code": args[2]}, nil)
+	case len(args) == 2 && args[0] == "delete":
+		return c.request(http.MethodDelete, "/admin/registrations/"+
+			url.PathEscape(args[1]), nil, nil)
+	default:
+		return errUsage
+	}
+}
+
+func tunnels(c *client, args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "list":
+		flags := flag.NewFlagSet("tunnel list", flag.ExitOnError)
+		deviceID := flags.String("device", "", "Only sessions for device")
+		flags.Parse(args[1:])
+
+		var ret []data.TunnelSession
+		err := c.request(http.MethodGet, "/admin/tunnels?device="+
+			url.QueryEscape(*deviceID), nil, &ret)
+		if err != nil {
+			return err
+		}
+
+		var rows [][]string
+		for _, s := range ret {
+			rows = append(rows, []string{strconv.FormatUint(s.ID, 10),
+				s.DeviceID, strconv.Itoa(s.Port), s.User, s.State,
+				s.Ends.Format(time.RFC3339)})
+		}
+
+		return c.table(ret, "ID\tDEVICE\tPORT\tUSER\tSTATE\tENDS", rows)
+	case "open":
+		flags := flag.NewFlagSet("tunnel open", flag.ExitOnError)
+		reason := flags.String("reason", "", "Why the session is opened")
+		duration := flags.Duration("duration", 0, "Time limit (default server default)")
+		flags.Parse(args[1:])
+
+		if flags.NArg() != 2 {
+			return errUsage
+		}
+
+		port, err := strconv.Atoi(flags.Arg(1))
+		if err != nil {
+			return fmt.Errorf("invalid port: %v", flags.Arg(1))
+		}
+
+		r := map[string]interface{}{
+			"deviceId": flags.Arg(0),
+			"port":     port,
+			"reason":   *reason,
+		}
+		if *duration > 0 {
+			r["duration"] = duration.String()
+		}
+
+		var ret data.TunnelSession
+		err = c.request(http.MethodPost, "/admin/tunnels", r, &ret)
+		if err != nil {
+			return err
+		}
+
+		if c.json {
+			return c.print(ret)
+		}
+
+		fmt.Println(ret.ID)
+		return nil
+	case "close":
+		if len(args) != 2 {
+			return errUsage
+		}
+
+		return c.request(http.MethodDelete, "/admin/tunnels/"+
+			url.PathEscape(args[1]), nil, nil)
+	case "connect":
+		if len(args) != 2 {
+			return errUsage
+		}
+
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid session id: %v", args[1])
+		}
+
+		conn, err := tunnel.Connect(c.server, c.token, id, nil)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		// stdin and stdout are the connection, like for an SSH
+		// ProxyCommand
+		go func() {
+			io.Copy(conn, os.Stdin)
+			conn.Close()
+		}()
+
+		_, err = io.Copy(os.Stdout, conn)
+		return err
+	default:
+		return errUsage
+	}
+}
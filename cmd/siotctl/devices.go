@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func devices(c *client, args []string) error {
+	flags := flag.NewFlagSet("devices", flag.ExitOnError)
+	group := flags.String("group", "", "Only devices in group")
+	tag := flags.String("tag", "", "Only devices with tag, like site=north")
+	io := flags.String("io", "", "Only devices with io")
+	query := flags.String("q", "", "Only devices matching text")
+	flags.Parse(args)
+
+	q := url.Values{}
+	for k, v := range map[string]string{"group": *group, "tag": *tag,
+		"io": *io, "q": *query} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+
+	var ret []data.Device
+	err := c.request(http.MethodGet, "/v1/devices?"+q.Encode(), nil, &ret)
+	if err != nil {
+		return err
+	}
+
+	var rows [][]string
+	for _, d := range ret {
+		rows = append(rows, []string{d.ID, d.Config.Description,
+			strings.Join(d.Groups(), ","), strconv.Itoa(len(d.State.Ios))})
+	}
+
+	return c.table(ret, "ID\tDESCRIPTION\tGROUPS\tIOS", rows)
+}
+
+func device(c *client, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	var ret data.Device
+	err := c.request(http.MethodGet, "/v1/devices/"+url.PathEscape(args[0]),
+		nil, &ret)
+	if err != nil {
+		return err
+	}
+
+	return c.print(ret)
+}
+
+func samples(c *client, args []string) error {
+	flags := flag.NewFlagSet("samples", flag.ExitOnError)
+	start := flags.String("start", "", "Start time, RFC3339 (default 24h before end)")
+	end := flags.String("end", "", "End time, RFC3339 (default now)")
+	resolution := flags.String("resolution", "", "raw, 1m, or 1h (default raw)")
+	asCSV := flags.Bool("csv", false, "Print CSV")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errUsage
+	}
+
+	q := url.Values{}
+	for k, v := range map[string]string{"start": *start, "end": *end,
+		"resolution": *resolution} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+
+	var ret []data.Sample
+	err := c.request(http.MethodGet, "/v1/devices/"+
+		url.PathEscape(flags.Arg(0))+"/samples?"+q.Encode(), nil, &ret)
+	if err != nil {
+		return err
+	}
+
+	if !*asCSV {
+		return c.print(ret)
+	}
+
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"time", "type", "id", "value", "min", "max"})
+	for _, s := range ret {
+		w.Write([]string{
+			s.Time.Format(time.RFC3339Nano), s.Type, s.ID,
+			formatFloat(s.Value), formatFloat(s.Min), formatFloat(s.Max),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func events(c *client, args []string) error {
+	flags := flag.NewFlagSet("events", flag.ExitOnError)
+	since := flags.String("since", "", "Start time, RFC3339 (default 24h ago)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errUsage
+	}
+
+	q := url.Values{}
+	if *since != "" {
+		q.Set("since", *since)
+	}
+
+	var ret []data.Event
+	err := c.request(http.MethodGet, "/v1/devices/"+
+		url.PathEscape(flags.Arg(0))+"/events?"+q.Encode(), nil, &ret)
+	if err != nil {
+		return err
+	}
+
+	var rows [][]string
+	for _, e := range ret {
+		rows = append(rows, []string{e.Time.Format(time.RFC3339), e.Type.String(),
+			e.Message})
+	}
+
+	return c.table(ret, "TIME\tTYPE\tMESSAGE", rows)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// event is the part of a stream event that is printed
+type event struct {
+	Type     string       `json:"type"`
+	DeviceID string       `json:"deviceId"`
+	Sample   *data.Sample `json:"sample"`
+}
+
+func tail(c *client, args []string) error {
+	flags := flag.NewFlagSet("tail", flag.ExitOnError)
+	deviceID := flags.String("device", "", "Only samples from device")
+	all := flags.Bool("all", false, "Print all change events, not just samples")
+	flags.Parse(args)
+
+	q := url.Values{}
+	if *deviceID != "" {
+		q.Set("device", *deviceID)
+	}
+
+	// the stream does not end, so the request can't time out
+	c.http.Timeout = 0
+
+	resp, err := c.do(http.MethodGet, "/v1/stream?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+
+		var e event
+		err := json.Unmarshal([]byte(line[6:]), &e)
+		if err != nil {
+			return err
+		}
+
+		if e.Sample == nil && !*all {
+			continue
+		}
+
+		switch {
+		case c.json:
+			fmt.Println(line[6:])
+		case e.Sample != nil:
+			s := e.Sample
+			fmt.Printf("%v  %v  %v  %v  %v\n", s.Time.Format(time.RFC3339),
+				e.DeviceID, s.Type, s.ID, formatFloat(s.Value))
+		default:
+			fmt.Printf("%v  %v  %v\n", time.Now().Format(time.RFC3339),
+				e.DeviceID, e.Type)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func sendCommand(c *client, args []string) error {
+	flags := flag.NewFlagSet("cmd", flag.ExitOnError)
+	expires := flags.Duration("expires", 0,
+		"Discard the command if it is not processed in time (default server TTL)")
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		return errUsage
+	}
+
+	cmd := data.DeviceCommand{Command: flags.Arg(1)}
+	for _, a := range flags.Args()[2:] {
+		parts := strings.SplitN(a, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid arg %q, must be name=value", a)
+		}
+
+		if cmd.Args == nil {
+			cmd.Args = make(map[string]string)
+		}
+		cmd.Args[parts[0]] = parts[1]
+	}
+
+	if *expires > 0 {
+		cmd.Expires = time.Now().Add(*expires)
+	}
+
+	var ret data.DeviceCommand
+	err := c.request(http.MethodPost, "/v1/devices/"+
+		url.PathEscape(flags.Arg(0))+"/cmd", cmd, &ret)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return c.print(ret)
+	}
+
+	fmt.Println(ret.ID)
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/simpleiot/simpleiot/load"
+)
+
+// loadTest generates sample load against the server and prints the
+// throughput, latency, and errors
+func loadTest(c *client, args []string) error {
+	flags := flag.NewFlagSet("load", flag.ExitOnError)
+	transport := flags.String("transport", "http", "Transport: http, nats, or mqtt")
+	url := flags.String("url", "",
+		"NATS server or MQTT broker URL (default the server URL for http)")
+	devices := flags.Int("devices", 10, "Number of devices")
+	rate := flags.Float64("rate", 100, "Total samples per second")
+	batch := flags.Int("batch", 1, "Samples per request")
+	duration := flags.Duration("duration", 10*time.Second, "How long to run")
+	flags.Parse(args)
+
+	if *url == "" {
+		if *transport != "http" {
+			return errUsage
+		}
+		*url = c.server
+	}
+
+	r, err := load.Run(load.Config{
+		Transport: *transport,
+		URL:       *url,
+		Token:     c.token,
+		Devices:   *devices,
+		Rate:      *rate,
+		Batch:     *batch,
+		Duration:  *duration,
+		Timeout:   c.http.Timeout,
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return c.print(struct {
+			Throughput  float64        `json:"throughput"`
+			Requests    int            `json:"requests"`
+			Samples     int            `json:"samples"`
+			Errors      int            `json:"errors"`
+			P50         time.Duration  `json:"p50"`
+			P90         time.Duration  `json:"p90"`
+			P99         time.Duration  `json:"p99"`
+			Max         time.Duration  `json:"max"`
+			ErrorCounts map[string]int `json:"errorCounts,omitempty"`
+		}{r.Throughput(), r.Requests, r.Samples, r.Errors, r.Percentile(50),
+			r.Percentile(90), r.Percentile(99), r.Percentile(100), r.ErrorCounts})
+	}
+
+	fmt.Print(r)
+	return nil
+}
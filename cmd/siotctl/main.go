@@ -0,0 +1,205 @@
+// siotctl is a command line tool for the SIOT API, for common operations
+// and fleet automation scripts. Run siotctl -h for the commands.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: siotctl [flags] <command> [args]
+
+Commands:
+  devices [-group g] [-tag k=v] [-io id] [-q text]
+                                    list devices
+  device <id>                       show a device
+  samples [-start t] [-end t] [-resolution r] [-csv] <id>
+                                    export the sample history of a device
+  events [-since t] <id>            show the event timeline of a device
+  tail [-device id] [-all]          print samples as they arrive
+  cmd [-expires d] <id> <command> [arg=value...]
+                                    send a command to a device
+  export [-o file]                  export all data (admin)
+  keys list|create|rotate|revoke <id> [key id|overlap]
+                                    manage device API keys (admin)
+  log [level | <module> <level|default>]
+                                    show or change log levels (admin)
+  registrations list|claim|delete [id] [code]
+                                    manage device registrations (admin)
+  tunnel list|open|close|connect ...
+                                    manage tunnel sessions (admin)
+  sim [-device id] [-count n] [-interval d] [-nats url] [-mqtt url]
+                                    run simulated devices
+  load [-transport t] [-url u] [-devices n] [-rate r] [-batch n] [-duration d]
+                                    measure ingest throughput and latency
+
+Flags:
+`
+
+// client makes requests to the SIOT API
+type client struct {
+	server string
+	token  string
+	http   *http.Client
+	// json prints raw JSON instead of tables
+	json bool
+}
+
+// request sends body as JSON, and decodes the response into ret if it is
+// not nil
+func (c *client) request(method, path string, body interface{}, ret interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	resp, err := c.do(method, path, r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if ret == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(ret)
+}
+
+// do sends a request and returns the response if the status is 2xx. The
+// caller must close the body.
+func (c *client) do(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(c.server, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("%v: %v", resp.Status,
+			strings.TrimSpace(string(msg)))
+	}
+
+	return resp, nil
+}
+
+// print prints v as indented JSON
+func (c *client) print(v interface{}) error {
+	en := json.NewEncoder(os.Stdout)
+	en.SetIndent("", "  ")
+	return en.Encode(v)
+}
+
+// table prints rows with aligned columns, or v as JSON if -json is set
+func (c *client) table(v interface{}, header string, rows [][]string) error {
+	if c.json {
+		return c.print(v)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	for _, r := range rows {
+		fmt.Fprintln(w, strings.Join(r, "\t"))
+	}
+
+	return w.Flush()
+}
+
+// errUsage is returned when a command has the wrong arguments
+var errUsage = errors.New("invalid arguments, run siotctl -h for usage")
+
+type command func(c *client, args []string) error
+
+var commands = map[string]command{
+	"devices":       devices,
+	"device":        device,
+	"samples":       samples,
+	"events":        events,
+	"tail":          tail,
+	"cmd":           sendCommand,
+	"export":        export,
+	"keys":          keys,
+	"log":           logLevels,
+	"registrations": registrations,
+	"tunnel":        tunnels,
+	"sim":           simulate,
+	"load":          loadTest,
+}
+
+func main() {
+	flagServer := flag.String("server", "",
+		"SIOT server URL (default SIOT_SERVER or http://localhost:8080)")
+	flagToken := flag.String("token", "", "Admin token (default SIOT_ADMIN_TOKEN)")
+	flagJSON := flag.Bool("json", false, "Print JSON instead of tables")
+	flagTimeout := flag.Duration("timeout", 30*time.Second,
+		"Request timeout, except for streams")
+
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// the env is read after parsing so the token isn't shown in the usage
+	server := *flagServer
+	if server == "" {
+		server = os.Getenv("SIOT_SERVER")
+	}
+	if server == "" {
+		server = "http://localhost:8080"
+	}
+
+	token := *flagToken
+	if token == "" {
+		token = os.Getenv("SIOT_ADMIN_TOKEN")
+	}
+
+	c := &client{
+		server: server,
+		token:  token,
+		http:   &http.Client{Timeout: *flagTimeout},
+		json:   *flagJSON,
+	}
+
+	err := cmd(c, flag.Args()[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		if err == errUsage {
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/simpleiot/simpleiot/sim"
+)
+
+// simulate runs simulated devices against the server until it is
+// interrupted
+func simulate(c *client, args []string) error {
+	flags := flag.NewFlagSet("sim", flag.ExitOnError)
+	deviceID := flags.String("device", "1234", "Device ID")
+	count := flags.Int("count", 1,
+		"Number of devices. If more than 1, -<n> is appended to the IDs.")
+	interval := flags.Duration("interval", 10*time.Second,
+		"How often each device sends samples")
+	nats := flags.String("nats", "", "NATS server URL")
+	mqtt := flags.String("mqtt", "", "MQTT broker URL")
+	key := flags.String("key", "", "Device key, for NATS and MQTT")
+	report := flags.Duration("report", time.Minute,
+		"How often the sample rate is logged")
+	flags.Parse(args)
+
+	if *count < 1 || *interval <= 0 {
+		return errUsage
+	}
+
+	fleet, err := sim.NewFleet(sim.Config{
+		ID:       *deviceID,
+		Server:   c.server,
+		NATS:     *nats,
+		MQTT:     *mqtt,
+		Key:      *key,
+		Interval: *interval,
+	}, *count)
+	if err != nil {
+		return err
+	}
+
+	fleet.Start(*report)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	fleet.Stop()
+	return nil
+}
@@ -0,0 +1,379 @@
+package coap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// CBOR (RFC 7049) is used for payloads, as it is smaller than JSON and easy
+// to produce on small devices. Values are converted to and from JSON, so
+// CBOR payloads use the same fields as the HTTP API.
+
+// errCBOR is returned when a CBOR value can't be decoded
+var errCBOR = errors.New("invalid CBOR")
+
+// maxDepth limits nesting of decoded arrays and maps
+const maxDepth = 32
+
+// CBOR major types
+const (
+	cborUint   = 0
+	cborNeg    = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+// cborBreak ends indefinite length items
+const cborBreak = 0xff
+
+func appendHead(b []byte, major byte, v uint64) []byte {
+	m := major << 5
+	switch {
+	case v < 24:
+		return append(b, m|byte(v))
+	case v <= math.MaxUint8:
+		return append(b, m|24, byte(v))
+	case v <= math.MaxUint16:
+		return append(b, m|25, byte(v>>8), byte(v))
+	case v <= math.MaxUint32:
+		return append(b, m|26, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+
+	b = append(b, m|27)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendInt(b []byte, v int64) []byte {
+	if v < 0 {
+		return appendHead(b, cborNeg, uint64(-1-v))
+	}
+	return appendHead(b, cborUint, uint64(v))
+}
+
+func appendFloat(b []byte, v float64) []byte {
+	// whole numbers are encoded as integers, which are smaller
+	if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+		return appendInt(b, int64(v))
+	}
+
+	if float64(float32(v)) == v || math.IsNaN(v) {
+		b = append(b, cborSimple<<5|26)
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], math.Float32bits(float32(v)))
+		return append(b, buf[:]...)
+	}
+
+	b = append(b, cborSimple<<5|27)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], math.Float64bits(v))
+	return append(b, buf[:]...)
+}
+
+// appendValue encodes the types produced by decoding JSON with UseNumber
+func appendValue(b []byte, v interface{}) ([]byte, error) {
+	var err error
+
+	switch v := v.(type) {
+	case nil:
+		return append(b, cborSimple<<5|22), nil
+	case bool:
+		if v {
+			return append(b, cborSimple<<5|21), nil
+		}
+		return append(b, cborSimple<<5|20), nil
+	case string:
+		b = appendHead(b, cborText, uint64(len(v)))
+		return append(b, v...), nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return appendInt(b, i), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return appendFloat(b, f), nil
+	case float64:
+		return appendFloat(b, v), nil
+	case []interface{}:
+		b = appendHead(b, cborArray, uint64(len(v)))
+		for _, item := range v {
+			b, err = appendValue(b, item)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b = appendHead(b, cborMap, uint64(len(v)))
+		for _, k := range keys {
+			b, _ = appendValue(b, k)
+			b, err = appendValue(b, v[k])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+
+	return nil, fmt.Errorf("can't encode %T as CBOR", v)
+}
+
+// MarshalCBOR encodes v as CBOR, using the same fields as JSON
+func MarshalCBOR(v interface{}) ([]byte, error) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(j))
+	d.UseNumber()
+
+	var generic interface{}
+	err = d.Decode(&generic)
+	if err != nil {
+		return nil, err
+	}
+
+	return appendValue(nil, generic)
+}
+
+type cborDecoder struct {
+	b []byte
+}
+
+func (d *cborDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.b) < n {
+		return nil, errCBOR
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v, nil
+}
+
+// head returns the major type, additional info, and argument of the next
+// item. Info 31 is an indefinite length item.
+func (d *cborDecoder) head() (major, info byte, arg uint64, err error) {
+	h, err := d.next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	major = h[0] >> 5
+	info = h[0] & 0x1f
+
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info == 31:
+		return major, info, 0, nil
+	case info > 27:
+		return 0, 0, 0, errCBOR
+	}
+
+	b, err := d.next(1 << (info - 24))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	for _, c := range b {
+		arg = arg<<8 | uint64(c)
+	}
+
+	return major, info, arg, nil
+}
+
+// isBreak consumes a break if it is next
+func (d *cborDecoder) isBreak() bool {
+	if len(d.b) > 0 && d.b[0] == cborBreak {
+		d.b = d.b[1:]
+		return true
+	}
+	return false
+}
+
+func halfFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+
+	var v float64
+	switch exp {
+	case 0:
+		v = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			v = math.Inf(1)
+		} else {
+			v = math.NaN()
+		}
+	default:
+		v = math.Ldexp(mant+1024, exp-25)
+	}
+
+	if h&0x8000 != 0 {
+		v = -v
+	}
+	return v
+}
+
+// str decodes a definite or indefinite length byte or text string
+func (d *cborDecoder) str(major byte, arg uint64, indefinite bool) ([]byte, error) {
+	if !indefinite {
+		if arg > uint64(len(d.b)) {
+			return nil, errCBOR
+		}
+		return d.next(int(arg))
+	}
+
+	var ret []byte
+	for !d.isBreak() {
+		m, info, n, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if m != major || info == 31 {
+			return nil, errCBOR
+		}
+		chunk, err := d.str(m, n, false)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, chunk...)
+	}
+	return ret, nil
+}
+
+// value decodes the next item to the types produced by decoding JSON
+func (d *cborDecoder) value(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errCBOR
+	}
+
+	major, info, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	indefinite := info == 31
+	if indefinite && (major < cborBytes || major == cborTag) {
+		return nil, errCBOR
+	}
+
+	switch major {
+	case cborUint:
+		return float64(arg), nil
+	case cborNeg:
+		return -1 - float64(arg), nil
+	case cborBytes, cborText:
+		s, err := d.str(major, arg, indefinite)
+		return string(s), err
+	case cborArray:
+		ret := []interface{}{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			if indefinite && d.isBreak() {
+				break
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, v)
+		}
+		return ret, nil
+	case cborMap:
+		ret := make(map[string]interface{})
+		for i := uint64(0); indefinite || i < arg; i++ {
+			if indefinite && d.isBreak() {
+				break
+			}
+			k, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, errors.New("CBOR map keys must be strings")
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			ret[key] = v
+		}
+		return ret, nil
+	case cborTag:
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		// tag 1 is an epoch time, which is converted to the JSON time
+		// format
+		if arg == 1 {
+			secs, ok := v.(float64)
+			if !ok {
+				return nil, errCBOR
+			}
+			whole, frac := math.Modf(secs)
+			t := time.Unix(int64(whole), int64(frac*1e9)).UTC()
+			return t.Format(time.RFC3339Nano), nil
+		}
+		return v, nil
+	}
+
+	// simple values and floats
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		return halfFloat(uint16(arg)), nil
+	case 26:
+		return float64(math.Float32frombits(uint32(arg))), nil
+	case 27:
+		return math.Float64frombits(arg), nil
+	}
+
+	return nil, errCBOR
+}
+
+// UnmarshalCBOR decodes CBOR into v, using the same fields as JSON
+func UnmarshalCBOR(b []byte, v interface{}) error {
+	d := cborDecoder{b: b}
+
+	generic, err := d.value(0)
+	if err != nil {
+		return err
+	}
+
+	if len(d.b) > 0 {
+		return errCBOR
+	}
+
+	j, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(j, v)
+}
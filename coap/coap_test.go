@@ -0,0 +1,252 @@
+package coap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+func TestMessage(t *testing.T) {
+	m := message{
+		typ:   typeCON,
+		code:  codePOST,
+		id:    0x1234,
+		token: []byte{1, 2},
+		options: []option{
+			{num: optURIPath, value: []byte("v1")},
+			{num: optURIPath, value: []byte("devices")},
+			{num: optContentFormat, value: encodeUint(formatCBOR)},
+			{num: optObserve, value: nil},
+			// extended delta and length
+			{num: 2000, value: make([]byte, 300)},
+		},
+		payload: []byte("hi"),
+	}
+
+	b := m.encode()
+	if !bytes.Equal(b[:6], []byte{0x42, 0x02, 0x12, 0x34, 1, 2}) {
+		t.Errorf("wrong header: % x", b[:6])
+	}
+
+	ret, err := decodeMessage(b)
+	if err != nil {
+		t.Fatal("Error decoding message: ", err)
+	}
+
+	if ret.path() != "v1/devices" || !bytes.Equal(ret.payload, m.payload) ||
+		len(ret.options) != 5 {
+		t.Errorf("message changed: %+v", ret)
+	}
+
+	cf, _ := ret.option(optContentFormat)
+	if decodeUint(cf) != formatCBOR {
+		t.Error("wrong content format: ", cf)
+	}
+
+	// payload marker without a payload
+	_, err = decodeMessage([]byte{0x40, 0x01, 0, 0, 0xff})
+	if err == nil {
+		t.Error("expected error for empty payload")
+	}
+}
+
+func TestCBOR(t *testing.T) {
+	// examples from RFC 7049 appendix A
+	for _, c := range []struct {
+		cbor string
+		exp  interface{}
+	}{
+		{"1903e8", 1000.0},
+		{"3863", -100.0},
+		{"f93c00", 1.0},
+		{"fb3ff199999999999a", 1.1},
+		{"f5", true},
+		{"c11a514b67b0", "2013-03-21T20:04:00Z"},
+		{"9f018202039f0405ffff", []interface{}{1.0, []interface{}{2.0, 3.0},
+			[]interface{}{4.0, 5.0}}},
+		{"bf6346756ef563416d7421ff", map[string]interface{}{"Fun": true,
+			"Amt": -2.0}},
+		{"7f657374726561646d696e67ff", "streaming"},
+	} {
+		b, _ := hex.DecodeString(c.cbor)
+		var v interface{}
+		err := UnmarshalCBOR(b, &v)
+		if err != nil {
+			t.Errorf("Error decoding %v: %v", c.cbor, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(v, c.exp) {
+			t.Errorf("%v decoded to %#v, expected %#v", c.cbor, v, c.exp)
+		}
+	}
+
+	b, err := MarshalCBOR(map[string]interface{}{"a": 1, "b": []float64{1.5, -2}})
+	if err != nil {
+		t.Fatal("Error encoding: ", err)
+	}
+
+	if hex.EncodeToString(b) != "a2616101616282fa3fc0000021" {
+		t.Errorf("wrong encoding: %x", b)
+	}
+
+	samples := []data.Sample{{Type: "temp", ID: "1", Value: 23.5,
+		Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Tags: map[string]string{"a": "b"}}}
+
+	b, err = MarshalCBOR(samples)
+	if err != nil {
+		t.Fatal("Error encoding samples: ", err)
+	}
+
+	var ret []data.Sample
+	err = UnmarshalCBOR(b, &ret)
+	if err != nil {
+		t.Fatal("Error decoding samples: ", err)
+	}
+
+	if !reflect.DeepEqual(ret, samples) {
+		t.Errorf("samples changed: %+v, %+v", samples, ret)
+	}
+
+	for _, bad := range []string{"", "1a0000", "a1016161", "9f01", "ff"} {
+		b, _ := hex.DecodeString(bad)
+		var v interface{}
+		if UnmarshalCBOR(b, &v) == nil {
+			t.Errorf("expected error for %v", bad)
+		}
+	}
+}
+
+func request(t *testing.T, conn net.Conn, m message) message {
+	_, err := conn.Write(m.encode())
+	if err != nil {
+		t.Fatal("Error sending request: ", err)
+	}
+
+	return receive(t, conn)
+}
+
+func receive(t *testing.T, conn net.Conn) message {
+	buf := make([]byte, maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal("Error reading response: ", err)
+	}
+
+	resp, err := decodeMessage(buf[:n])
+	if err != nil {
+		t.Fatal("Error decoding response: ", err)
+	}
+
+	return resp
+}
+
+func path(p ...string) []option {
+	var ret []option
+	for _, s := range p {
+		ret = append(ret, option{num: optURIPath, value: []byte(s)})
+	}
+	return ret
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-coap-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbInst, err := db.NewDb(dir, nil)
+	if err != nil {
+		t.Fatal("Error opening db: ", err)
+	}
+	defer dbInst.Close()
+
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening: ", err)
+	}
+
+	writes := 0
+	s := NewServer(dbInst, ServerConfig{
+		Write: func(id string, samples []data.Sample) error {
+			writes++
+			return dbInst.DeviceSample(id, samples[0])
+		},
+	})
+	go s.Serve(l)
+	defer s.Stop()
+
+	conn, err := net.Dial("udp", l.LocalAddr().String())
+	if err != nil {
+		t.Fatal("Error connecting: ", err)
+	}
+	defer conn.Close()
+
+	payload, _ := MarshalCBOR([]data.Sample{{Type: "temp", Value: 21}})
+	post := message{typ: typeCON, code: codePOST, id: 1, token: []byte{9},
+		options: append(path("v1", "devices", "1234", "samples"),
+			option{num: optContentFormat, value: encodeUint(formatCBOR)}),
+		payload: payload}
+
+	resp := request(t, conn, post)
+	if resp.typ != typeACK || resp.id != 1 || resp.code != codeChanged ||
+		!bytes.Equal(resp.token, []byte{9}) {
+		t.Fatalf("wrong response: %+v", resp)
+	}
+
+	// a retransmitted request is not processed again
+	request(t, conn, post)
+	if writes != 1 {
+		t.Error("retransmitted request was processed again")
+	}
+
+	resp = request(t, conn, message{typ: typeCON, code: codeGET, id: 2,
+		options: append(path("v1", "devices", "1234", "config"),
+			option{num: optAccept, value: encodeUint(formatJSON)})})
+	if resp.code != codeContent || string(resp.payload) != `{"description":""}` {
+		t.Errorf("wrong config response: %+v", resp)
+	}
+
+	resp = request(t, conn, message{typ: typeCON, code: codeGET, id: 3,
+		token:   []byte{7},
+		options: append(path("v1", "devices", "1234", "cmd"), option{num: optObserve})})
+	if resp.code != codeContent {
+		t.Fatalf("wrong observe response: %+v", resp)
+	}
+
+	_, err = dbInst.CommandEnqueue(data.DeviceCommand{DeviceID: "1234",
+		Command: "reboot"})
+	if err != nil {
+		t.Fatal("Error queueing command: ", err)
+	}
+
+	notification := receive(t, conn)
+	if notification.typ != typeCON || !bytes.Equal(notification.token, []byte{7}) {
+		t.Fatalf("wrong notification: %+v", notification)
+	}
+
+	var cmds []data.DeviceCommand
+	err = UnmarshalCBOR(notification.payload, &cmds)
+	if err != nil || len(cmds) != 1 || cmds[0].Command != "reboot" {
+		t.Fatalf("wrong commands: %+v, %v", cmds, err)
+	}
+
+	resp = request(t, conn, message{typ: typeNON, code: codeDELETE, id: 4,
+		options: path("v1", "devices", "1234", "cmd",
+			strconv.FormatUint(cmds[0].ID, 10))})
+	if resp.typ != typeNON || resp.code != codeDeleted {
+		t.Errorf("wrong delete response: %+v", resp)
+	}
+}
@@ -0,0 +1,237 @@
+// Package coap is a CoAP (RFC 7252) server for constrained devices that
+// can't afford TCP or TLS. It mirrors the sample post and config get HTTP
+// APIs with CBOR or JSON payloads, and supports observing commands (RFC
+// 7641). Block-wise transfers are not supported, so payloads must fit in a
+// datagram.
+package coap
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// message types
+const (
+	typeCON = 0
+	typeNON = 1
+	typeACK = 2
+	typeRST = 3
+)
+
+// codes are a 3 bit class and 5 bit detail, written as c.dd
+const (
+	codeEmpty  = 0
+	codeGET    = 1
+	codePOST   = 2
+	codePUT    = 3
+	codeDELETE = 4
+
+	codeDeleted = 2<<5 | 2
+	codeChanged = 2<<5 | 4
+	codeContent = 2<<5 | 5
+
+	codeBadRequest       = 4<<5 | 0
+	codeForbidden        = 4<<5 | 3
+	codeNotFound         = 4<<5 | 4
+	codeMethodNotAllowed = 4<<5 | 5
+	codeNotAcceptable    = 4<<5 | 6
+	codeUnsupportedType  = 4<<5 | 15
+
+	codeInternalError = 5<<5 | 0
+)
+
+// option numbers
+const (
+	optObserve       = 6
+	optURIPath       = 11
+	optContentFormat = 12
+	optURIQuery      = 15
+	optAccept        = 17
+)
+
+// content formats
+const (
+	formatText = 0
+	formatJSON = 50
+	formatCBOR = 60
+)
+
+// errMessage is returned when a message can't be decoded
+var errMessage = errors.New("invalid CoAP message")
+
+type option struct {
+	num   uint16
+	value []byte
+}
+
+// message is a CoAP request or response
+type message struct {
+	typ     byte
+	code    byte
+	id      uint16
+	token   []byte
+	options []option
+	payload []byte
+}
+
+// encodeUint encodes an option value in as few bytes as possible
+func encodeUint(v uint32) []byte {
+	var b []byte
+	for v > 0 {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+	}
+	return b
+}
+
+func decodeUint(b []byte) uint32 {
+	var v uint32
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
+
+// optionNibble returns the 4 bit nibble and extended bytes of an option
+// delta or length
+func optionNibble(v int) (byte, []byte) {
+	switch {
+	case v < 13:
+		return byte(v), nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	}
+	v -= 269
+	return 14, []byte{byte(v >> 8), byte(v)}
+}
+
+func (m message) encode() []byte {
+	b := []byte{1<<6 | m.typ<<4 | byte(len(m.token)), m.code,
+		byte(m.id >> 8), byte(m.id)}
+	b = append(b, m.token...)
+
+	options := append([]option{}, m.options...)
+	sort.SliceStable(options, func(i, j int) bool {
+		return options[i].num < options[j].num
+	})
+
+	last := 0
+	for _, o := range options {
+		delta, deltaExt := optionNibble(int(o.num) - last)
+		length, lengthExt := optionNibble(len(o.value))
+		b = append(b, delta<<4|length)
+		b = append(b, deltaExt...)
+		b = append(b, lengthExt...)
+		b = append(b, o.value...)
+		last = int(o.num)
+	}
+
+	if len(m.payload) > 0 {
+		b = append(b, 0xff)
+		b = append(b, m.payload...)
+	}
+
+	return b
+}
+
+// readNibble decodes an option delta or length
+func readNibble(n byte, b []byte) (int, []byte, error) {
+	switch n {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, errMessage
+		}
+		return int(b[0]) + 13, b[1:], nil
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, errMessage
+		}
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], nil
+	case 15:
+		return 0, nil, errMessage
+	}
+	return int(n), b, nil
+}
+
+func decodeMessage(b []byte) (message, error) {
+	var m message
+
+	if len(b) < 4 || b[0]>>6 != 1 {
+		return m, errMessage
+	}
+
+	m.typ = (b[0] >> 4) & 0x03
+	tokenLen := int(b[0] & 0x0f)
+	m.code = b[1]
+	m.id = binary.BigEndian.Uint16(b[2:])
+	b = b[4:]
+
+	if tokenLen > 8 || len(b) < tokenLen {
+		return m, errMessage
+	}
+	m.token = b[:tokenLen]
+	b = b[tokenLen:]
+
+	num := 0
+	for len(b) > 0 {
+		if b[0] == 0xff {
+			if len(b) == 1 {
+				return m, errMessage
+			}
+			m.payload = b[1:]
+			break
+		}
+
+		h := b[0]
+		b = b[1:]
+
+		delta, rest, err := readNibble(h>>4, b)
+		if err != nil {
+			return m, err
+		}
+
+		length, rest, err := readNibble(h&0x0f, rest)
+		if err != nil {
+			return m, err
+		}
+
+		if len(rest) < length {
+			return m, errMessage
+		}
+
+		num += delta
+		m.options = append(m.options, option{num: uint16(num),
+			value: rest[:length]})
+		b = rest[length:]
+	}
+
+	return m, nil
+}
+
+// option returns the first value of an option
+func (m message) option(num uint16) ([]byte, bool) {
+	for _, o := range m.options {
+		if o.num == num {
+			return o.value, true
+		}
+	}
+	return nil, false
+}
+
+// path returns the URI path, like v1/devices/1234/samples
+func (m message) path() string {
+	var segments []string
+	for _, o := range m.options {
+		if o.num == optURIPath {
+			segments = append(segments, string(o.value))
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// isRequest returns true for request codes (class 0)
+func (m message) isRequest() bool {
+	return m.code != codeEmpty && m.code>>5 == 0
+}
@@ -0,0 +1,484 @@
+package coap
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+// exchangeLifetime is how long responses to confirmable requests are kept,
+// so retransmitted requests are not processed twice (RFC 7252 4.8.2)
+const exchangeLifetime = 247 * time.Second
+
+// observeLifetime is how long an observer is kept after it registers.
+// Devices re-register to keep observing.
+const observeLifetime = 24 * time.Hour
+
+// maxMessageSize is the largest datagram read
+const maxMessageSize = 1152
+
+// ServerConfig describes how the CoAP server stores samples
+type ServerConfig struct {
+	// Write stores samples from devices, typically api.WriteSamples or
+	// db.IngestQueue.Enqueue
+	Write func(id string, samples []data.Sample) error
+}
+
+type cachedResponse struct {
+	b       []byte
+	expires time.Time
+}
+
+// observer is a device observing its commands
+type observer struct {
+	addr    net.Addr
+	token   []byte
+	format  uint32
+	seq     uint32
+	expires time.Time
+	// lastID is the message ID of the last notification, which the device
+	// resets if it is no longer observing
+	lastID uint16
+}
+
+// Server is a CoAP server for constrained devices. Resources are:
+//
+//	POST /v1/devices/<id>/samples: samples as CBOR or JSON
+//	GET /v1/devices/<id>/config: the device config
+//	GET /v1/devices/<id>/cmd: queued commands, which can be observed
+//	DELETE /v1/devices/<id>/cmd/<command id>: removes a processed command
+//
+// Payloads are CBOR unless the Content-Format or Accept option is JSON.
+// Command notifications are confirmable so devices that stopped observing
+// reset them, but they are not retransmitted.
+type Server struct {
+	db        *db.Db
+	config    ServerConfig
+	conn      net.PacketConn
+	lock      sync.Mutex
+	nextID    uint16
+	responses map[string]cachedResponse
+	// observers are indexed by device ID, then address and token
+	observers map[string]map[string]*observer
+	events    <-chan db.Event
+	stop      chan struct{}
+}
+
+// NewServer creates a CoAP server. Serve handles requests.
+func NewServer(dbInst *db.Db, config ServerConfig) *Server {
+	return &Server{
+		db:        dbInst,
+		config:    config,
+		responses: make(map[string]cachedResponse),
+		observers: make(map[string]map[string]*observer),
+		stop:      make(chan struct{}),
+	}
+}
+
+// Serve handles requests on conn until Stop is called
+func (s *Server) Serve(conn net.PacketConn) error {
+	s.lock.Lock()
+	s.conn = conn
+	s.lock.Unlock()
+
+	s.events = s.db.Subscribe(db.EventFilter{
+		Types: []db.EventType{db.EventCommandQueued},
+	})
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case e, ok := <-s.events:
+				if !ok {
+					return
+				}
+				s.notify(e.DeviceID)
+			case <-ticker.C:
+				s.expire(time.Now())
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.stop:
+				return nil
+			default:
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		s.handle(addr, append([]byte{}, buf[:n]...))
+	}
+}
+
+// Stop stops the server
+func (s *Server) Stop() {
+	close(s.stop)
+	s.db.Unsubscribe(s.events)
+
+	s.lock.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.lock.Unlock()
+}
+
+// expire removes old responses and observers
+func (s *Server) expire(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for k, r := range s.responses {
+		if now.After(r.expires) {
+			delete(s.responses, k)
+		}
+	}
+
+	for id, observers := range s.observers {
+		for k, o := range observers {
+			if now.After(o.expires) {
+				delete(observers, k)
+			}
+		}
+		if len(observers) == 0 {
+			delete(s.observers, id)
+		}
+	}
+}
+
+// messageID returns the next message ID. s.lock must be held.
+func (s *Server) messageID() uint16 {
+	s.nextID++
+	return s.nextID
+}
+
+func (s *Server) send(addr net.Addr, b []byte) {
+	_, err := s.conn.WriteTo(b, addr)
+	if err != nil {
+		log.Printf("CoAP: error sending to %v: %v\n", addr, err)
+	}
+}
+
+func (s *Server) handle(addr net.Addr, b []byte) {
+	m, err := decodeMessage(b)
+	if err != nil {
+		// a confirmable message that can't be processed is reset
+		if len(b) >= 4 && (b[0]>>4)&0x03 == typeCON {
+			id := uint16(b[2])<<8 | uint16(b[3])
+			s.send(addr, message{typ: typeRST, id: id}.encode())
+		}
+		return
+	}
+
+	switch {
+	case m.typ == typeRST:
+		s.removeObserver(addr, m.id)
+		return
+	case m.typ == typeACK:
+		return
+	case m.code == codeEmpty:
+		// an empty confirmable message is a ping
+		if m.typ == typeCON {
+			s.send(addr, message{typ: typeRST, id: m.id}.encode())
+		}
+		return
+	case !m.isRequest():
+		return
+	}
+
+	key := addr.String() + "/" + strconv.Itoa(int(m.id))
+
+	if m.typ == typeCON {
+		s.lock.Lock()
+		cached, ok := s.responses[key]
+		s.lock.Unlock()
+
+		if ok {
+			s.send(addr, cached.b)
+			return
+		}
+	}
+
+	resp := s.serve(addr, m)
+	resp.token = m.token
+
+	s.lock.Lock()
+	if m.typ == typeCON {
+		// the response is piggybacked on the ack
+		resp.typ = typeACK
+		resp.id = m.id
+	} else {
+		resp.typ = typeNON
+		resp.id = s.messageID()
+	}
+
+	b = resp.encode()
+	if m.typ == typeCON {
+		s.responses[key] = cachedResponse{b: b,
+			expires: time.Now().Add(exchangeLifetime)}
+	}
+	s.lock.Unlock()
+
+	s.send(addr, b)
+}
+
+// format returns the content format of a response to m
+func format(m message) (uint32, bool) {
+	if accept, ok := m.option(optAccept); ok {
+		f := decodeUint(accept)
+		return f, f == formatCBOR || f == formatJSON
+	}
+
+	if cf, ok := m.option(optContentFormat); ok && decodeUint(cf) == formatJSON {
+		return formatJSON, true
+	}
+
+	return formatCBOR, true
+}
+
+// content returns a response with v encoded in the format
+func content(code byte, f uint32, v interface{}) message {
+	var payload []byte
+	var err error
+
+	if f == formatJSON {
+		payload, err = json.Marshal(v)
+	} else {
+		payload, err = MarshalCBOR(v)
+	}
+
+	if err != nil {
+		return errorResponse(codeInternalError, err)
+	}
+
+	return message{code: code, payload: payload, options: []option{
+		{num: optContentFormat, value: encodeUint(f)},
+	}}
+}
+
+// errorResponse returns a response with a diagnostic payload
+func errorResponse(code byte, err error) message {
+	return message{code: code, payload: []byte(err.Error()), options: []option{
+		{num: optContentFormat, value: encodeUint(formatText)},
+	}}
+}
+
+// serve handles a request and returns the response
+func (s *Server) serve(addr net.Addr, m message) message {
+	// v1/devices/<id>/<resource>[/<command id>]
+	parts := strings.Split(m.path(), "/")
+	if len(parts) < 4 || parts[0] != "v1" || parts[1] != "devices" ||
+		parts[2] == "" {
+		return message{code: codeNotFound}
+	}
+
+	id := parts[2]
+	resource := strings.Join(parts[3:], "/")
+
+	f, ok := format(m)
+	if !ok {
+		return message{code: codeNotAcceptable}
+	}
+
+	switch {
+	case resource == "samples":
+		if m.code != codePOST {
+			return message{code: codeMethodNotAllowed}
+		}
+		return s.postSamples(id, m)
+	case resource == "config":
+		if m.code != codeGET {
+			return message{code: codeMethodNotAllowed}
+		}
+
+		dev, err := s.db.Device(id)
+		if err != nil {
+			return errorResponse(codeNotFound, err)
+		}
+		return content(codeContent, f, dev.Config)
+	case resource == "cmd":
+		if m.code != codeGET {
+			return message{code: codeMethodNotAllowed}
+		}
+		return s.getCommands(addr, id, m, f)
+	case len(parts) == 5 && parts[3] == "cmd":
+		if m.code != codeDELETE {
+			return message{code: codeMethodNotAllowed}
+		}
+
+		cmdID, err := strconv.ParseUint(parts[4], 10, 64)
+		if err != nil {
+			return errorResponse(codeBadRequest,
+				errors.New("invalid command id"))
+		}
+
+		err = s.db.CommandDelete(cmdID)
+		if err != nil {
+			return errorResponse(codeNotFound, err)
+		}
+		return message{code: codeDeleted}
+	}
+
+	return message{code: codeNotFound}
+}
+
+func (s *Server) postSamples(id string, m message) message {
+	var samples []data.Sample
+	var err error
+
+	// CBOR is assumed if the format is not set
+	f := uint32(formatCBOR)
+	if cf, ok := m.option(optContentFormat); ok {
+		f = decodeUint(cf)
+	}
+
+	switch f {
+	case formatCBOR:
+		err = UnmarshalCBOR(m.payload, &samples)
+	case formatJSON:
+		err = json.Unmarshal(m.payload, &samples)
+	default:
+		return message{code: codeUnsupportedType}
+	}
+
+	if err != nil {
+		return errorResponse(codeBadRequest, err)
+	}
+
+	// samples without a time get the time they were received
+	now := time.Now()
+	for i := range samples {
+		if samples[i].Time.IsZero() {
+			samples[i].Time = now
+		}
+	}
+
+	err = s.config.Write(id, samples)
+	if errors.Is(err, db.ErrUsageLimit) {
+		return errorResponse(codeForbidden, err)
+	} else if err != nil {
+		return errorResponse(codeInternalError, err)
+	}
+
+	return message{code: codeChanged}
+}
+
+// getCommands returns the queued commands, and registers or removes an
+// observer if the request has the observe option
+func (s *Server) getCommands(addr net.Addr, id string, m message, f uint32) message {
+	cmds, err := s.db.DeviceCommands(id)
+	if err != nil {
+		return errorResponse(codeInternalError, err)
+	}
+
+	if cmds == nil {
+		cmds = []data.DeviceCommand{}
+	}
+
+	resp := content(codeContent, f, cmds)
+
+	obs, ok := m.option(optObserve)
+	if !ok {
+		return resp
+	}
+
+	key := addr.String() + "/" + string(m.token)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// 0 registers and 1 deregisters
+	if decodeUint(obs) == 1 {
+		delete(s.observers[id], key)
+		return resp
+	}
+
+	if s.observers[id] == nil {
+		s.observers[id] = make(map[string]*observer)
+	}
+
+	o := &observer{
+		addr:    addr,
+		token:   append([]byte{}, m.token...),
+		format:  f,
+		expires: time.Now().Add(observeLifetime),
+	}
+	s.observers[id][key] = o
+
+	resp.options = append(resp.options, option{num: optObserve,
+		value: encodeUint(o.seq)})
+
+	return resp
+}
+
+// removeObserver removes the observer that reset a notification
+func (s *Server) removeObserver(addr net.Addr, id uint16) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, observers := range s.observers {
+		for k, o := range observers {
+			if o.lastID == id && o.addr.String() == addr.String() {
+				delete(observers, k)
+			}
+		}
+	}
+}
+
+// notify sends the queued commands to the observers of a device
+func (s *Server) notify(id string) {
+	s.lock.Lock()
+	var observers []*observer
+	for _, o := range s.observers[id] {
+		observers = append(observers, o)
+	}
+	s.lock.Unlock()
+
+	if len(observers) == 0 {
+		return
+	}
+
+	cmds, err := s.db.DeviceCommands(id)
+	if err != nil {
+		log.Printf("CoAP: error reading commands for %v: %v\n", id, err)
+		return
+	}
+
+	for _, o := range observers {
+		resp := content(codeContent, o.format, cmds)
+
+		s.lock.Lock()
+		// sequence numbers are 24 bits
+		o.seq = (o.seq + 1) & 0xffffff
+		o.lastID = s.messageID()
+		resp.typ = typeCON
+		resp.id = o.lastID
+		resp.token = o.token
+		resp.options = append(resp.options, option{num: optObserve,
+			value: encodeUint(o.seq)})
+		s.lock.Unlock()
+
+		s.send(o.addr, resp.encode())
+	}
+}
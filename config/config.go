@@ -0,0 +1,823 @@
+// Package config loads the SIOT server settings from a config file,
+// environment variables, and command line flags.
+//
+// Settings are applied in order, so later sources override earlier ones:
+// defaults, the config file, environment variables, then flags. The config
+// file can be TOML (simple key = value pairs and [sections]) or JSON.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/logging"
+	"github.com/simpleiot/simpleiot/oidc"
+)
+
+// Config is the configuration of the SIOT server. Each field has the key
+// used in the config file and as a flag name (prefixed with the section,
+// like db.cmdTTL), the environment variable, and the default.
+type Config struct {
+	// Port is the network port the server listens on
+	Port string `key:"port" env:"SIOT_PORT" default:"8080" help:"network port the server listens on"`
+	// DataDir is where the database and other data are stored
+	DataDir string `key:"dataDir" env:"SIOT_DATA" default:"./" help:"directory where data is stored"`
+	// AdminToken is required to access the admin API, which is disabled if
+	// it is not set
+	AdminToken string `key:"adminToken" env:"SIOT_ADMIN_TOKEN" help:"token required for the admin API"`
+	// LogDir is where application logs are written, if set
+	LogDir string `key:"logDir" env:"SIOT_LOG_DIR" help:"directory for rotating application log files"`
+	// LogLevel, LogFormat, and LogModules set up the logger. Module levels
+	// can be changed later with the admin API.
+	LogLevel   string `key:"logLevel" env:"SIOT_LOG_LEVEL" default:"info" help:"log level: debug, info, warn, or error"`
+	LogFormat  string `key:"logFormat" env:"SIOT_LOG_FORMAT" default:"console" help:"log format: console or json"`
+	LogModules string `key:"logModules" env:"SIOT_LOG_MODULES" help:"comma separated module levels, like 'modem=debug,nats=warn'"`
+	// Mdns is the instance name the server is advertised with on the local
+	// network. The server is only advertised if mdns is set (see
+	// Loader.IsSet), and the host name is used if it is blank.
+	Mdns string `key:"mdns" env:"SIOT_MDNS,empty" help:"advertise the server with mDNS using this instance name"`
+	// Tenants serves multiple organizations from one server, each with its
+	// own db (see api.Tenancy)
+	Tenants bool `key:"tenants" env:"SIOT_TENANTS" help:"serve multiple tenants, each with its own db and API tokens"`
+	// IngestWorkers is the number of workers that write queued samples. 0
+	// disables the ingest queue.
+	IngestWorkers int `key:"ingestWorkers" env:"SIOT_INGEST_WORKERS" help:"number of ingest queue workers (0 disables the queue)"`
+	// IngestLimitMB bounds the ingest queue, and IngestPolicy is what
+	// happens to posted samples when it is full (see db.IngestPolicy)
+	IngestLimitMB  int    `key:"ingestLimitMB" env:"SIOT_INGEST_LIMIT_MB" help:"ingest queue size in MB before the ingest policy applies (0 is unbounded)"`
+	IngestPolicy   string `key:"ingestPolicy" env:"SIOT_INGEST_POLICY" default:"block" help:"what to do when the ingest queue is full: block, shed, or reject"`
+	ParticleAPIKey string `key:"particleApiKey" env:"SIOT_PARTICLE_API_KEY" help:"key used to fetch data from Particle.io"`
+	// ParticleEvent is the prefix of the names of the Particle events
+	// samples are read from, and ParticleWebhookToken enables Particle
+	// webhooks (see particle.Integration)
+	ParticleEvent        string `key:"particleEvent" env:"SIOT_PARTICLE_EVENT" default:"sample" help:"prefix of the Particle events samples are read from"`
+	ParticleWebhookToken string `key:"particleWebhookToken" env:"SIOT_PARTICLE_WEBHOOK_TOKEN" help:"token required to post Particle webhooks to /v1/particle"`
+	// Maintenance are the local time windows when disruptive operations
+	// like db compaction can run (see data.ParseMaintenanceWindows)
+	Maintenance string `key:"maintenance" env:"SIOT_MAINTENANCE" help:"windows for disruptive operations like db compaction, like 'sat,sun 02:00 4h'"`
+
+	Auth       AuthConfig       `key:"auth"`
+	OIDC       OIDCConfig       `key:"oidc"`
+	Db         DbConfig         `key:"db"`
+	Influx     InfluxConfig     `key:"influx"`
+	Redis      RedisConfig      `key:"redis"`
+	Follow     FollowConfig     `key:"follow"`
+	Cluster    ClusterConfig    `key:"cluster"`
+	Upstream   UpstreamConfig   `key:"upstream"`
+	Proxy      ProxyConfig      `key:"proxy"`
+	Monitor    MonitorConfig    `key:"monitor"`
+	Network    NetworkConfig    `key:"network"`
+	Mqtt       MqttConfig       `key:"mqtt"`
+	Nats       NatsConfig       `key:"nats"`
+	Coap       CoapConfig       `key:"coap"`
+	Grpc       GrpcConfig       `key:"grpc"`
+	MTLS       MTLSConfig       `key:"mtls"`
+	Keys       KeysConfig       `key:"keys"`
+	Prometheus PrometheusConfig `key:"prometheus"`
+	Trace      TraceConfig      `key:"trace"`
+	Anomaly    AnomalyConfig    `key:"anomaly"`
+	Lorawan    LorawanConfig    `key:"lorawan"`
+	AWS        AWSConfig        `key:"aws"`
+	Azure      AzureConfig      `key:"azure"`
+	Forward    ForwardConfig    `key:"forward"`
+	Sparkplug  SparkplugConfig  `key:"sparkplug"`
+	Modbus     ModbusConfig     `key:"modbus"`
+	Email      EmailConfig      `key:"email"`
+	SMS        SMSConfig        `key:"sms"`
+	Slack      SlackConfig      `key:"slack"`
+	Webhook    WebhookConfig    `key:"webhook"`
+	Pushover   PushoverConfig   `key:"pushover"`
+	Firmware   FirmwareConfig   `key:"firmware"`
+}
+
+// AuthConfig describes how users authenticate to the API
+type AuthConfig struct {
+	Mode          string        `key:"mode" env:"SIOT_AUTH_MODE" default:"local" help:"API authentication: local (user accounts) or none"`
+	SessionTTL    time.Duration `key:"sessionTTL" env:"SIOT_SESSION_TTL" default:"24h" help:"how long an unused login session lasts"`
+	SessionMaxAge time.Duration `key:"sessionMaxAge" env:"SIOT_SESSION_MAX_AGE" default:"720h" help:"how long a login session lasts even if it is used"`
+	Admin         string        `key:"admin" env:"SIOT_AUTH_ADMIN" help:"admin user created at startup if there are no users, as user:password"`
+}
+
+// OIDCConfig is the configuration of OpenID Connect single sign-on
+type OIDCConfig struct {
+	Issuer        string `key:"issuer" env:"SIOT_OIDC_ISSUER" help:"OpenID Connect issuer url, enables single sign-on"`
+	ClientID      string `key:"clientId" env:"SIOT_OIDC_CLIENT_ID" help:"client ID registered with the identity provider"`
+	ClientSecret  string `key:"clientSecret" env:"SIOT_OIDC_CLIENT_SECRET" help:"client secret registered with the identity provider"`
+	RedirectURL   string `key:"redirectUrl" env:"SIOT_OIDC_REDIRECT_URL" help:"callback url registered with the identity provider, like https://siot.example.com/v1/auth/oidc/callback"`
+	Scopes        string `key:"scopes" env:"SIOT_OIDC_SCOPES" default:"openid email profile" help:"scopes requested from the identity provider"`
+	UsernameClaim string `key:"usernameClaim" env:"SIOT_OIDC_USERNAME_CLAIM" default:"email" help:"ID token claim used as the username"`
+	GroupsClaim   string `key:"groupsClaim" env:"SIOT_OIDC_GROUPS_CLAIM" default:"groups" help:"ID token claim that lists the user's groups"`
+	Roles         string `key:"roles" env:"SIOT_OIDC_ROLES" help:"maps groups to roles, like 'siot-admins=admin,staff=user'"`
+	DefaultRole   string `key:"defaultRole" env:"SIOT_OIDC_DEFAULT_ROLE" help:"role of users in no mapped group (blank denies them)"`
+}
+
+// define auth modes
+const (
+	// AuthModeNone does not authenticate users
+	AuthModeNone = "none"
+	// AuthModeLocal authenticates local user accounts (see api.Auth)
+	AuthModeLocal = "local"
+)
+
+// PrometheusConfig is the configuration of the Prometheus exporter
+type PrometheusConfig struct {
+	Enable bool   `key:"enable" env:"SIOT_PROMETHEUS" help:"serve device data as Prometheus metrics at /metrics"`
+	Types  string `key:"types" env:"SIOT_PROMETHEUS_TYPES" help:"comma separated sample types that are exported (blank exports all)"`
+	Token  string `key:"token" env:"SIOT_PROMETHEUS_TOKEN" help:"bearer token Prometheus must send to scrape (blank allows anyone)"`
+}
+
+// TraceConfig describes how traces are exported
+type TraceConfig struct {
+	Endpoint string  `key:"endpoint" env:"SIOT_OTLP_ENDPOINT" help:"OTLP/HTTP collector URL traces are sent to, like http://localhost:4318 (blank disables tracing)"`
+	Service  string  `key:"service" env:"SIOT_OTLP_SERVICE" default:"siot" help:"service name of exported traces"`
+	Headers  string  `key:"headers" env:"SIOT_OTLP_HEADERS" help:"comma separated name=value headers sent to the collector"`
+	Sample   float64 `key:"sample" env:"SIOT_TRACE_SAMPLE" default:"1" help:"fraction of new traces that are recorded"`
+}
+
+// AnomalyConfig describes how anomalies in sample streams are detected
+type AnomalyConfig struct {
+	Enable    bool    `key:"enable" env:"SIOT_ANOMALY" help:"detect samples that deviate from the baseline of their point"`
+	Method    string  `key:"method" env:"SIOT_ANOMALY_METHOD" default:"rolling" help:"baseline of each point: rolling, or seasonal for one per hour of the day"`
+	Window    int     `key:"window" env:"SIOT_ANOMALY_WINDOW" default:"100" help:"about how many values each baseline is learned from"`
+	Threshold float64 `key:"threshold" env:"SIOT_ANOMALY_THRESHOLD" default:"4" help:"standard deviations from the mean at which a value is anomalous"`
+	Warmup    int     `key:"warmup" env:"SIOT_ANOMALY_WARMUP" default:"30" help:"values each baseline learns before values are checked"`
+	Types     string  `key:"types" env:"SIOT_ANOMALY_TYPES" help:"comma separated sample types that are checked (blank checks all)"`
+	Timezone  string  `key:"timezone" env:"SIOT_ANOMALY_TIMEZONE" help:"time zone of the hours of seasonal baselines (default UTC)"`
+}
+
+// KeysConfig describes how device keys are rotated
+type KeysConfig struct {
+	Rotation time.Duration `key:"rotation" env:"SIOT_KEY_ROTATION" help:"age at which devices rotate their keys (0 only rotates when an admin asks)"`
+	Overlap  time.Duration `key:"overlap" env:"SIOT_KEY_OVERLAP" default:"24h" help:"how long a rotated device key keeps working"`
+}
+
+// DbConfig is the configuration of the local database
+type DbConfig struct {
+	Key              string        `key:"key" env:"SIOT_DB_KEY" help:"hex encoded database encryption key"`
+	KeyFile          string        `key:"keyFile" env:"SIOT_DB_KEY_FILE" help:"file containing the database encryption key"`
+	KeySource        string        `key:"keySource" env:"SIOT_DB_KEY_SOURCE" help:"where the database encryption key is kept instead of db.key: keystore (created on first start, sealed by a TPM when present) or keyring (Linux kernel keyring)"`
+	KeyStoreDir      string        `key:"keyStoreDir" env:"SIOT_KEY_STORE_DIR" help:"key store directory (default /var/lib/siot/keys)"`
+	SlowOp           time.Duration `key:"slowOp" env:"SIOT_DB_SLOW_OP" help:"log db operations slower than this"`
+	CmdTTL           time.Duration `key:"cmdTTL" env:"SIOT_CMD_TTL" default:"24h" help:"how long queued device commands are kept"`
+	OfflineTimeout   time.Duration `key:"offlineTimeout" env:"SIOT_OFFLINE_TIMEOUT" default:"15m" help:"how long a device can go without samples before it is disconnected in its event timeline (0 disables)"`
+	LogTTL           time.Duration `key:"logTTL" env:"SIOT_LOG_TTL" default:"168h" help:"how long device logs, support archives, uploaded files, and cleared alerts are kept"`
+	RawRetention     time.Duration `key:"rawRetention" env:"SIOT_RAW_RETENTION" default:"24h" help:"how long raw samples are kept before compression"`
+	BlockRetention   time.Duration `key:"blockRetention" env:"SIOT_BLOCK_RETENTION" default:"2160h" help:"how long compressed raw samples are kept"`
+	HistoryCache     time.Duration `key:"historyCache" env:"SIOT_HISTORY_CACHE" help:"how much raw sample history is cached in memory for range queries (0 disables)"`
+	Retention        string        `key:"retention" env:"SIOT_RETENTION" help:"how long the sample history of groups is kept, like 'eu=720h; *=8760h'"`
+	CompactThreshold float64       `key:"compactThreshold" env:"SIOT_DB_COMPACT_THRESHOLD" default:"0.5" help:"free space fraction at which the db is compacted"`
+	DevicePointLimit int64         `key:"devicePointLimit" env:"SIOT_DEVICE_POINT_LIMIT" help:"max stored points for each device"`
+	DeviceByteLimit  int64         `key:"deviceByteLimit" env:"SIOT_DEVICE_BYTE_LIMIT" help:"max stored bytes for each device"`
+	GroupPointLimit  int64         `key:"groupPointLimit" env:"SIOT_GROUP_POINT_LIMIT" help:"max stored points for each group"`
+	GroupByteLimit   int64         `key:"groupByteLimit" env:"SIOT_GROUP_BYTE_LIMIT" help:"max stored bytes for each group"`
+}
+
+// InfluxConfig is the configuration of the optional influxdb 1.x support
+type InfluxConfig struct {
+	URL     string `key:"url" env:"SIOT_INFLUX_URL" help:"influxdb url, enables influxdb support"`
+	User    string `key:"user" env:"SIOT_INFLUX_USER" help:"influxdb user"`
+	Pass    string `key:"pass" env:"SIOT_INFLUX_PASS" help:"influxdb password"`
+	Mapping string `key:"mapping" env:"SIOT_INFLUX_MAPPING" help:"JSON file describing how samples are written to influxdb"`
+}
+
+// RedisConfig is the configuration of the optional Redis device cache
+type RedisConfig struct {
+	Addr string `key:"addr" env:"SIOT_REDIS_ADDR" help:"Redis address (host:port) used to cache devices"`
+	Pass string `key:"pass" env:"SIOT_REDIS_PASS" help:"Redis password"`
+}
+
+// FollowConfig is the configuration of a read only follower
+type FollowConfig struct {
+	URL    string        `key:"url" env:"SIOT_FOLLOW_URL" help:"primary server url, runs this server as a follower"`
+	Token  string        `key:"token" env:"SIOT_FOLLOW_TOKEN" help:"admin token of the primary server"`
+	Resync time.Duration `key:"resync" env:"SIOT_FOLLOW_RESYNC" default:"1h" help:"how often a follower does a full sync"`
+}
+
+// ClusterConfig is the configuration of an instance of a cluster. The
+// instances elect a leader with a lease in Redis, and the others follow
+// it.
+type ClusterConfig struct {
+	URL string        `key:"url" env:"SIOT_CLUSTER_URL" help:"url other instances reach this server at, enables clustering"`
+	TTL time.Duration `key:"ttl" env:"SIOT_CLUSTER_TTL" default:"15s" help:"how long the leader lease lasts without being renewed"`
+}
+
+// UpstreamConfig is the configuration of an edge server that syncs its
+// devices to an upstream server
+type UpstreamConfig struct {
+	URL      string        `key:"url" env:"SIOT_UPSTREAM_URL" help:"upstream server url, syncs devices and samples to it"`
+	Token    string        `key:"token" env:"SIOT_UPSTREAM_TOKEN" help:"bearer token sent to the upstream server"`
+	ID       string        `key:"id" env:"SIOT_UPSTREAM_ID" help:"name of this server on the upstream server (default host name)"`
+	Interval time.Duration `key:"interval" env:"SIOT_UPSTREAM_INTERVAL" default:"10s" help:"how often devices and samples are synced upstream"`
+}
+
+// ProxyConfig is the HTTP proxy used to reach the primary server
+type ProxyConfig struct {
+	URL      string `key:"url" env:"SIOT_PROXY_URL" help:"HTTP proxy url"`
+	User     string `key:"user" env:"SIOT_PROXY_USER" help:"HTTP proxy user"`
+	Password string `key:"pass" env:"SIOT_PROXY_PASS" help:"HTTP proxy password"`
+}
+
+// MonitorConfig describes how the server monitors its own resource usage.
+// Limits that are 0 are not checked.
+type MonitorConfig struct {
+	Interval   time.Duration `key:"interval" env:"SIOT_MONITOR_INTERVAL" default:"1m" help:"how often the server's own resource usage is recorded (0 disables)"`
+	ID         string        `key:"id" env:"SIOT_MONITOR_ID" default:"siot" help:"sample ID of the server's resource usage"`
+	Goroutines int           `key:"goroutines" env:"SIOT_MONITOR_GOROUTINES" default:"10000" help:"goroutine count that causes a warning"`
+	HeapMB     int           `key:"heapMB" env:"SIOT_MONITOR_HEAP_MB" default:"512" help:"heap size in MB that causes a warning"`
+	FDs        int           `key:"fds" env:"SIOT_MONITOR_FDS" default:"1000" help:"open file count that causes a warning"`
+	QueueMB    int           `key:"queueMB" env:"SIOT_MONITOR_QUEUE_MB" default:"64" help:"ingest queue size in MB that causes a warning"`
+}
+
+// NetworkConfig is the configuration of the optional network manager that
+// fails over between the server's uplinks (see network.Manager)
+type NetworkConfig struct {
+	Interfaces string        `key:"interfaces" env:"SIOT_NETWORK_INTERFACES" help:"uplinks in priority order, like 'eth:eth0,wifi:wlan0,nm:wwan0', enables the network manager"`
+	Interval   time.Duration `key:"interval" env:"SIOT_NETWORK_INTERVAL" default:"10s" help:"how often the active uplink is checked"`
+	ResetCount int           `key:"resetCount" env:"SIOT_NETWORK_RESET_COUNT" default:"3" help:"failures of every uplink in a row before all uplinks are reset"`
+}
+
+// MqttConfig is the configuration of the optional MQTT broker connection
+// used by devices that can't use the HTTP API. The server connects to an
+// external broker, or runs its own broker if Listen is set.
+type MqttConfig struct {
+	Broker   string        `key:"broker" env:"SIOT_MQTT_BROKER" help:"MQTT broker url, like tcp://localhost:1883, enables MQTT support"`
+	Listen   string        `key:"listen" env:"SIOT_MQTT_LISTEN" help:"address of the embedded MQTT broker, like :1883, enables MQTT support"`
+	Cert     string        `key:"cert" env:"SIOT_MQTT_CERT" help:"TLS certificate file of the embedded MQTT broker"`
+	Key      string        `key:"key" env:"SIOT_MQTT_KEY" help:"TLS key file of the embedded MQTT broker"`
+	ClientID string        `key:"clientId" env:"SIOT_MQTT_CLIENT_ID" default:"siot" help:"MQTT client ID"`
+	User     string        `key:"user" env:"SIOT_MQTT_USER" help:"MQTT user"`
+	Pass     string        `key:"pass" env:"SIOT_MQTT_PASS" help:"MQTT password"`
+	Prefix   string        `key:"prefix" env:"SIOT_MQTT_PREFIX" default:"siot" help:"first level of MQTT device topics"`
+	Retry    time.Duration `key:"retry" env:"SIOT_MQTT_RETRY" default:"5s" help:"delay after the first failed connection to mqtt.broker"`
+	RetryMax time.Duration `key:"retryMax" env:"SIOT_MQTT_RETRY_MAX" default:"2m" help:"longest delay between connection attempts to mqtt.broker, raised to mqtt.retry if lower"`
+}
+
+// NatsConfig is the configuration of the optional NATS connection used by
+// edge devices. The server connects to an external NATS server, or runs its
+// own server if Listen is set.
+type NatsConfig struct {
+	Server string `key:"server" env:"SIOT_NATS_SERVER" help:"NATS server url, like nats://localhost:4222, enables NATS support"`
+	Listen string `key:"listen" env:"SIOT_NATS_LISTEN" help:"address of the embedded NATS server, like :4222, enables NATS support"`
+	Cert   string `key:"cert" env:"SIOT_NATS_CERT" help:"TLS certificate file of the embedded NATS server"`
+	Key    string `key:"key" env:"SIOT_NATS_KEY" help:"TLS key file of the embedded NATS server"`
+	User   string `key:"user" env:"SIOT_NATS_USER" help:"NATS user"`
+	Pass   string `key:"pass" env:"SIOT_NATS_PASS" help:"NATS password"`
+	Prefix string `key:"prefix" env:"SIOT_NATS_PREFIX" default:"siot" help:"first token of NATS device subjects"`
+}
+
+// CoapConfig is the configuration of the optional CoAP endpoint used by
+// constrained devices
+type CoapConfig struct {
+	Listen string `key:"listen" env:"SIOT_COAP_LISTEN" help:"UDP address of the CoAP endpoint, like :5683, enables CoAP support"`
+}
+
+// GrpcConfig is the configuration of the optional gRPC API for backend
+// integrators. gRPC requires TLS, and calls use the admin token.
+type GrpcConfig struct {
+	Listen string `key:"listen" env:"SIOT_GRPC_LISTEN" help:"address of the gRPC API, like :8443, enables gRPC support"`
+	Cert   string `key:"cert" env:"SIOT_GRPC_CERT" help:"TLS certificate file of the gRPC API"`
+	Key    string `key:"key" env:"SIOT_GRPC_KEY" help:"TLS key file of the gRPC API"`
+}
+
+// MTLSConfig is the configuration of the optional mutual TLS listener,
+// where devices authenticate with client certificates instead of keys
+type MTLSConfig struct {
+	Listen      string        `key:"listen" env:"SIOT_MTLS_LISTEN" help:"address of the device mTLS listener, like :9443, enables device certificates"`
+	Cert        string        `key:"cert" env:"SIOT_MTLS_CERT" help:"TLS certificate file of the mTLS listener"`
+	Key         string        `key:"key" env:"SIOT_MTLS_KEY" help:"TLS key file of the mTLS listener"`
+	Validity    time.Duration `key:"validity" env:"SIOT_MTLS_VALIDITY" default:"2160h" help:"how long device certificates from the built-in CA are valid"`
+	SignCommand string        `key:"signCommand" env:"SIOT_MTLS_SIGN_COMMAND" help:"command that signs device CSRs with an external CA instead of the built-in CA"`
+	CACert      string        `key:"caCert" env:"SIOT_MTLS_CA_CERT" help:"certificate file of the external CA"`
+}
+
+// LorawanConfig is the configuration of the optional LoRaWAN network server
+// integration. Uplinks are received from the network server's MQTT broker,
+// or from webhooks if Token is set.
+type LorawanConfig struct {
+	Network  string `key:"network" env:"SIOT_LORAWAN_NETWORK" help:"LoRaWAN network server, chirpstack or ttn, enables LoRaWAN support"`
+	Broker   string `key:"broker" env:"SIOT_LORAWAN_BROKER" help:"MQTT broker url of the network server, like tls://eu1.cloud.thethings.network:8883"`
+	ClientID string `key:"clientId" env:"SIOT_LORAWAN_CLIENT_ID" default:"siot" help:"MQTT client ID"`
+	User     string `key:"user" env:"SIOT_LORAWAN_USER" help:"MQTT user"`
+	Pass     string `key:"pass" env:"SIOT_LORAWAN_PASS" help:"MQTT password"`
+	Token    string `key:"token" env:"SIOT_LORAWAN_TOKEN" help:"token required to post uplinks to /v1/lorawan/uplink"`
+	Decoder  string `key:"decoder" env:"SIOT_LORAWAN_DECODER" default:"object" help:"payload decoder of devices that don't set one, object or cayenne"`
+}
+
+// AWSConfig is the configuration of the optional AWS IoT Core bridge, which
+// connects to AWS IoT Core as a thing with a certificate
+type AWSConfig struct {
+	Endpoint    string `key:"endpoint" env:"SIOT_AWS_ENDPOINT" help:"AWS IoT Core endpoint, like abc123-ats.iot.us-east-1.amazonaws.com, enables the AWS IoT bridge"`
+	ClientID    string `key:"clientId" env:"SIOT_AWS_CLIENT_ID" default:"siot" help:"MQTT client ID, usually the thing name of the bridge"`
+	Cert        string `key:"cert" env:"SIOT_AWS_CERT" help:"certificate file of the bridge thing"`
+	Key         string `key:"key" env:"SIOT_AWS_KEY" help:"private key file of the bridge thing"`
+	CA          string `key:"ca" env:"SIOT_AWS_CA" help:"CA certificate file of the endpoint, like AmazonRootCA1.pem (default system CAs)"`
+	ThingPrefix string `key:"thingPrefix" env:"SIOT_AWS_THING_PREFIX" help:"prefix of the thing names of devices"`
+	Topic       string `key:"topic" env:"SIOT_AWS_TOPIC,empty" default:"siot/{device}/samples" help:"topic samples are forwarded to, {device} and {type} are replaced (blank disables forwarding)"`
+	Types       string `key:"types" env:"SIOT_AWS_TYPES" help:"comma separated sample types that are forwarded (default all)"`
+	Shadow      bool   `key:"shadow" env:"SIOT_AWS_SHADOW" default:"true" help:"sync device config with thing shadows"`
+}
+
+// AzureConfig is the configuration of the optional Azure IoT Hub bridge,
+// which registers devices with the Device Provisioning Service in a
+// symmetric key enrollment group
+type AzureConfig struct {
+	IDScope            string `key:"idScope" env:"SIOT_AZURE_ID_SCOPE" help:"ID scope of the Device Provisioning Service, enables the Azure IoT Hub bridge"`
+	GroupKey           string `key:"groupKey" env:"SIOT_AZURE_GROUP_KEY" help:"primary key of the symmetric key enrollment group"`
+	RegistrationPrefix string `key:"registrationPrefix" env:"SIOT_AZURE_REGISTRATION_PREFIX" help:"prefix of the registration IDs of devices"`
+	DPS                string `key:"dps" env:"SIOT_AZURE_DPS" default:"https://global.azure-devices-provisioning.net" help:"Device Provisioning Service endpoint"`
+	Types              string `key:"types" env:"SIOT_AZURE_TYPES" help:"comma separated sample types that are sent (default all)"`
+}
+
+// ForwardConfig is the configuration of the optional bridge that
+// republishes samples and events to an external MQTT broker, like a third
+// party IoT platform. Topics and payloads are templates.
+type ForwardConfig struct {
+	Broker     string `key:"broker" env:"SIOT_FORWARD_BROKER" help:"MQTT broker url samples are forwarded to, like tls://broker:8883"`
+	ClientID   string `key:"clientId" env:"SIOT_FORWARD_CLIENT_ID" default:"siot-forward" help:"MQTT client ID"`
+	User       string `key:"user" env:"SIOT_FORWARD_USER" help:"MQTT user"`
+	Pass       string `key:"pass" env:"SIOT_FORWARD_PASS" help:"MQTT password"`
+	CA         string `key:"ca" env:"SIOT_FORWARD_CA" help:"CA certificate file of the broker (default system CAs)"`
+	Cert       string `key:"cert" env:"SIOT_FORWARD_CERT" help:"client certificate file"`
+	Key        string `key:"key" env:"SIOT_FORWARD_KEY" help:"client key file"`
+	Topic      string `key:"topic" env:"SIOT_FORWARD_TOPIC" default:"siot/{{.DeviceID}}/{{.Sample.Type}}" help:"topic template of samples"`
+	EventTopic string `key:"eventTopic" env:"SIOT_FORWARD_EVENT_TOPIC" default:"siot/events/{{.Type}}" help:"topic template of events"`
+	Types      string `key:"types" env:"SIOT_FORWARD_TYPES" help:"comma separated sample types that are forwarded (default all)"`
+	Events     string `key:"events" env:"SIOT_FORWARD_EVENTS" help:"comma separated event types that are forwarded, like alertChanged,deviceDeleted"`
+	Format     string `key:"format" env:"SIOT_FORWARD_FORMAT" default:"json" help:"payload format: json, line, or template"`
+	Payload    string `key:"payload" env:"SIOT_FORWARD_PAYLOAD" help:"payload template of the template format"`
+	QoS        int    `key:"qos" env:"SIOT_FORWARD_QOS" help:"QoS of forwarded messages, 0 or 1"`
+	Retain     bool   `key:"retain" env:"SIOT_FORWARD_RETAIN" help:"publish retained messages"`
+}
+
+// SparkplugConfig is the configuration of the optional Sparkplug B edge
+// node that publishes devices to SCADA systems
+type SparkplugConfig struct {
+	Broker      string `key:"broker" env:"SIOT_SPARKPLUG_BROKER" help:"MQTT broker url of the Sparkplug infrastructure, enables Sparkplug B support"`
+	ClientID    string `key:"clientId" env:"SIOT_SPARKPLUG_CLIENT_ID" default:"siot" help:"MQTT client ID"`
+	User        string `key:"user" env:"SIOT_SPARKPLUG_USER" help:"MQTT user"`
+	Pass        string `key:"pass" env:"SIOT_SPARKPLUG_PASS" help:"MQTT password"`
+	CA          string `key:"ca" env:"SIOT_SPARKPLUG_CA" help:"CA certificate file of the broker (default system CAs)"`
+	Cert        string `key:"cert" env:"SIOT_SPARKPLUG_CERT" help:"client certificate file"`
+	Key         string `key:"key" env:"SIOT_SPARKPLUG_KEY" help:"client key file"`
+	GroupID     string `key:"groupId" env:"SIOT_SPARKPLUG_GROUP_ID" default:"siot" help:"Sparkplug group ID"`
+	NodeID      string `key:"nodeId" env:"SIOT_SPARKPLUG_NODE_ID" default:"siot" help:"Sparkplug edge node ID"`
+	PrimaryHost string `key:"primaryHost" env:"SIOT_SPARKPLUG_PRIMARY_HOST" help:"ID of the primary host application, the node only publishes while it is online"`
+}
+
+// ModbusConfig is the configuration of the optional Modbus TCP server that
+// exposes device samples to SCADA systems and PLCs
+type ModbusConfig struct {
+	Listen string `key:"listen" env:"SIOT_MODBUS_LISTEN" help:"address of the Modbus TCP server, like :502, enables Modbus support"`
+	Map    string `key:"map" env:"SIOT_MODBUS_MAP" help:"JSON file mapping device samples to Modbus registers"`
+}
+
+// EmailConfig is the configuration of the optional email notifications
+// sent by rules and system alerts
+type EmailConfig struct {
+	Server     string        `key:"server" env:"SIOT_EMAIL_SERVER" help:"SMTP server host:port, enables email notifications"`
+	TLS        string        `key:"tls" env:"SIOT_EMAIL_TLS" default:"starttls" help:"SMTP TLS mode: starttls, tls, or none"`
+	User       string        `key:"user" env:"SIOT_EMAIL_USER" help:"SMTP user"`
+	Pass       string        `key:"pass" env:"SIOT_EMAIL_PASS" help:"SMTP password"`
+	From       string        `key:"from" env:"SIOT_EMAIL_FROM" help:"address notifications are sent from"`
+	To         string        `key:"to" env:"SIOT_EMAIL_TO" help:"comma separated addresses all notifications are sent to"`
+	Groups     string        `key:"groups" env:"SIOT_EMAIL_GROUPS" help:"addresses notifications about device groups are sent to, like 'ops=a@example.com,b@example.com; field=c@example.com'"`
+	Subject    string        `key:"subject" env:"SIOT_EMAIL_SUBJECT" help:"subject template of notification emails"`
+	Template   string        `key:"template" env:"SIOT_EMAIL_TEMPLATE" help:"file containing the body template of notification emails"`
+	Retries    int           `key:"retries" env:"SIOT_EMAIL_RETRIES" default:"5" help:"how many times a failed email is retried"`
+	RetryDelay time.Duration `key:"retryDelay" env:"SIOT_EMAIL_RETRY_DELAY" default:"1m" help:"delay before the first retry of a failed email, which doubles each retry"`
+}
+
+// SMSConfig is the configuration of the optional text message
+// notifications sent by rules and system alerts
+type SMSConfig struct {
+	Provider   string        `key:"provider" env:"SIOT_SMS_PROVIDER" help:"SMS provider, twilio or http, enables SMS notifications"`
+	URL        string        `key:"url" env:"SIOT_SMS_URL" help:"url of the http SMS gateway, or the Twilio API url"`
+	User       string        `key:"user" env:"SIOT_SMS_USER" help:"Twilio account SID, or http gateway user"`
+	Pass       string        `key:"pass" env:"SIOT_SMS_PASS" help:"Twilio auth token, or http gateway password"`
+	From       string        `key:"from" env:"SIOT_SMS_FROM" help:"number or sender ID messages are sent from"`
+	To         string        `key:"to" env:"SIOT_SMS_TO" help:"comma separated numbers all notifications are sent to"`
+	Groups     string        `key:"groups" env:"SIOT_SMS_GROUPS" help:"numbers notifications about device groups are sent to, like 'ops=+15550001,+15550002'"`
+	Template   string        `key:"template" env:"SIOT_SMS_TEMPLATE" help:"template of notification messages"`
+	RateLimit  int           `key:"rateLimit" env:"SIOT_SMS_RATE_LIMIT" default:"10" help:"max messages sent to a number per hour (0 is unlimited)"`
+	QuietHours string        `key:"quietHours" env:"SIOT_SMS_QUIET_HOURS" help:"windows when messages are held, like '22:00 8h'"`
+	Timezone   string        `key:"timezone" env:"SIOT_SMS_TIMEZONE" help:"time zone of the quiet hours (default UTC)"`
+	StatusURL  string        `key:"statusUrl" env:"SIOT_SMS_STATUS_URL" help:"public url of /v1/notifications/sms/status for delivery status callbacks"`
+	Retries    int           `key:"retries" env:"SIOT_SMS_RETRIES" default:"5" help:"how many times a failed message is retried"`
+	RetryDelay time.Duration `key:"retryDelay" env:"SIOT_SMS_RETRY_DELAY" default:"1m" help:"delay before the first retry of a failed message, which doubles each retry"`
+}
+
+// SlackConfig is the configuration of the optional Slack notifications
+type SlackConfig struct {
+	URL      string `key:"url" env:"SIOT_SLACK_URL" help:"Slack incoming webhook url, enables Slack notifications"`
+	Template string `key:"template" env:"SIOT_SLACK_TEMPLATE" help:"template of Slack messages"`
+}
+
+// WebhookConfig is the configuration of the optional webhook notifications
+type WebhookConfig struct {
+	URL    string `key:"url" env:"SIOT_WEBHOOK_URL" help:"url notifications are posted to as JSON, enables webhook notifications"`
+	Secret string `key:"secret" env:"SIOT_WEBHOOK_SECRET" help:"secret webhook requests are signed with"`
+}
+
+// PushoverConfig is the configuration of the optional Pushover
+// notifications
+type PushoverConfig struct {
+	Token    string `key:"token" env:"SIOT_PUSHOVER_TOKEN" help:"Pushover application token, enables Pushover notifications"`
+	User     string `key:"user" env:"SIOT_PUSHOVER_USER" help:"Pushover user or group key"`
+	Priority int    `key:"priority" env:"SIOT_PUSHOVER_PRIORITY" help:"Pushover priority of active notifications, -2 to 1"`
+}
+
+// FirmwareConfig is the configuration of application firmware updates
+type FirmwareConfig struct {
+	Keys string `key:"keys" env:"SIOT_FIRMWARE_KEYS" help:"comma separated base64 Ed25519 public keys firmware must be signed with, enables firmware uploads"`
+}
+
+// Validate checks settings that can't be checked by type alone
+func (c Config) Validate() error {
+	port, err := strconv.Atoi(c.Port)
+	if err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid port: %v", c.Port)
+	}
+
+	if c.DataDir == "" {
+		return errors.New("dataDir is required")
+	}
+
+	_, err = logging.ParseLevel(c.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	if c.LogFormat != logging.FormatConsole && c.LogFormat != logging.FormatJSON {
+		return fmt.Errorf("invalid log format: %v", c.LogFormat)
+	}
+
+	_, err = logging.ParseModules(c.LogModules)
+	if err != nil {
+		return err
+	}
+
+	if c.IngestWorkers < 0 {
+		return errors.New("ingestWorkers can't be negative")
+	}
+
+	if c.IngestLimitMB < 0 {
+		return errors.New("ingestLimitMB can't be negative")
+	}
+
+	switch c.IngestPolicy {
+	case "block", "shed", "reject":
+	default:
+		return fmt.Errorf("invalid ingestPolicy: %v", c.IngestPolicy)
+	}
+
+	switch c.Db.KeySource {
+	case "", "keystore", "keyring":
+	default:
+		return fmt.Errorf("invalid db.keySource: %v", c.Db.KeySource)
+	}
+
+	if c.Db.KeySource != "" && (c.Db.Key != "" || c.Db.KeyFile != "") {
+		return errors.New("db.keySource can't be used with db.key or db.keyFile")
+	}
+
+	if c.Db.CompactThreshold < 0 || c.Db.CompactThreshold >= 1 {
+		return fmt.Errorf("db.compactThreshold must be between 0 and 1: %v",
+			c.Db.CompactThreshold)
+	}
+
+	err = data.ValidateAnomalyMethod(c.Anomaly.Method)
+	if err != nil {
+		return err
+	}
+
+	if c.Anomaly.Window < 2 || c.Anomaly.Warmup < 1 {
+		return errors.New("anomaly.window must be at least 2 and anomaly.warmup at least 1")
+	}
+
+	if c.Anomaly.Threshold <= 0 {
+		return errors.New("anomaly.threshold must be positive")
+	}
+
+	if c.Anomaly.Timezone != "" {
+		err = data.ValidateTimezone(c.Anomaly.Timezone)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Trace.Sample < 0 || c.Trace.Sample > 1 {
+		return fmt.Errorf("trace.sample must be between 0 and 1: %v",
+			c.Trace.Sample)
+	}
+
+	for _, h := range strings.Split(c.Trace.Headers, ",") {
+		if strings.TrimSpace(h) != "" && !strings.Contains(h, "=") {
+			return fmt.Errorf("invalid trace header, expected name=value: %v", h)
+		}
+	}
+
+	for name, d := range map[string]time.Duration{
+		"db.slowOp":         c.Db.SlowOp,
+		"db.cmdTTL":         c.Db.CmdTTL,
+		"db.logTTL":         c.Db.LogTTL,
+		"db.offlineTimeout": c.Db.OfflineTimeout,
+		"db.rawRetention":   c.Db.RawRetention,
+		"db.blockRetention": c.Db.BlockRetention,
+		"db.historyCache":   c.Db.HistoryCache,
+		"follow.resync":     c.Follow.Resync,
+		"cluster.ttl":       c.Cluster.TTL,
+		"upstream.interval": c.Upstream.Interval,
+		"monitor.interval":  c.Monitor.Interval,
+		"network.interval":  c.Network.Interval,
+		"email.retryDelay":  c.Email.RetryDelay,
+		"sms.retryDelay":    c.SMS.RetryDelay,
+		"keys.rotation":     c.Keys.Rotation,
+		"keys.overlap":      c.Keys.Overlap,
+	} {
+		if d < 0 {
+			return fmt.Errorf("%v can't be negative", name)
+		}
+	}
+
+	for name, v := range map[string]int{
+		"monitor.goroutines": c.Monitor.Goroutines,
+		"monitor.heapMB":     c.Monitor.HeapMB,
+		"monitor.fds":        c.Monitor.FDs,
+		"monitor.queueMB":    c.Monitor.QueueMB,
+		"email.retries":      c.Email.Retries,
+		"sms.rateLimit":      c.SMS.RateLimit,
+		"sms.retries":        c.SMS.Retries,
+	} {
+		if v < 0 {
+			return fmt.Errorf("%v can't be negative", name)
+		}
+	}
+
+	_, err = data.ParseMaintenanceWindows(c.Maintenance)
+	if err != nil {
+		return err
+	}
+
+	_, err = data.ParseNetworkInterfaces(c.Network.Interfaces)
+	if err != nil {
+		return err
+	}
+
+	if c.Network.Interfaces != "" && (c.Network.Interval <= 0 || c.Network.ResetCount < 1) {
+		return errors.New("network.interfaces requires a positive network.interval and network.resetCount")
+	}
+
+	if c.Influx.Mapping != "" && c.Influx.URL == "" {
+		return errors.New("influx.mapping requires influx.url")
+	}
+
+	if c.Mqtt.Broker != "" && c.Mqtt.Listen != "" {
+		return errors.New("mqtt.broker and mqtt.listen can't both be set")
+	}
+
+	if (c.Mqtt.Cert == "") != (c.Mqtt.Key == "") {
+		return errors.New("mqtt.cert and mqtt.key must be set together")
+	}
+
+	if c.Mqtt.Retry < 0 || c.Mqtt.RetryMax < 0 {
+		return errors.New("mqtt.retry and mqtt.retryMax can't be negative")
+	}
+
+	if c.Nats.Server != "" && c.Nats.Listen != "" {
+		return errors.New("nats.server and nats.listen can't both be set")
+	}
+
+	if (c.Nats.Cert == "") != (c.Nats.Key == "") {
+		return errors.New("nats.cert and nats.key must be set together")
+	}
+
+	if c.Grpc.Listen != "" {
+		if c.Grpc.Cert == "" || c.Grpc.Key == "" {
+			return errors.New("grpc.listen requires grpc.cert and grpc.key")
+		}
+
+		if c.AdminToken == "" {
+			return errors.New("grpc.listen requires adminToken")
+		}
+	}
+
+	if c.Lorawan.Network != "" {
+		switch c.Lorawan.Network {
+		case "chirpstack", "ttn":
+		default:
+			return fmt.Errorf("invalid lorawan.network: %v", c.Lorawan.Network)
+		}
+
+		if c.Lorawan.Broker == "" && c.Lorawan.Token == "" {
+			return errors.New("lorawan.network requires lorawan.broker or lorawan.token")
+		}
+	}
+
+	switch c.Lorawan.Decoder {
+	case data.LorawanObject, data.LorawanCayenne:
+	default:
+		return fmt.Errorf("invalid lorawan.decoder: %v", c.Lorawan.Decoder)
+	}
+
+	if c.AWS.Endpoint != "" && (c.AWS.Cert == "" || c.AWS.Key == "") {
+		return errors.New("aws.endpoint requires aws.cert and aws.key")
+	}
+
+	if c.Azure.IDScope != "" && c.Azure.GroupKey == "" {
+		return errors.New("azure.idScope requires azure.groupKey")
+	}
+
+	switch c.Forward.Format {
+	case "json", "line":
+	case "template":
+		if c.Forward.Payload == "" {
+			return errors.New("forward.format template requires forward.payload")
+		}
+	default:
+		return fmt.Errorf("invalid forward.format: %v", c.Forward.Format)
+	}
+
+	if c.Forward.QoS < 0 || c.Forward.QoS > 1 {
+		return fmt.Errorf("forward.qos must be 0 or 1: %v", c.Forward.QoS)
+	}
+
+	for _, id := range []string{c.Sparkplug.GroupID, c.Sparkplug.NodeID,
+		c.Sparkplug.PrimaryHost} {
+		if strings.ContainsAny(id, "/+#") {
+			return fmt.Errorf("invalid Sparkplug ID: %v", id)
+		}
+	}
+
+	if c.Sparkplug.Broker != "" && (c.Sparkplug.GroupID == "" || c.Sparkplug.NodeID == "") {
+		return errors.New("sparkplug.broker requires sparkplug.groupId and sparkplug.nodeId")
+	}
+
+	if (c.Modbus.Listen == "") != (c.Modbus.Map == "") {
+		return errors.New("modbus.listen and modbus.map must be set together")
+	}
+
+	if c.Email.Server != "" {
+		switch c.Email.TLS {
+		case "starttls", "tls", "none":
+		default:
+			return fmt.Errorf("invalid email.tls: %v", c.Email.TLS)
+		}
+
+		if c.Email.From == "" {
+			return errors.New("email.from is required for email notifications")
+		}
+
+		if c.Email.To == "" && c.Email.Groups == "" {
+			return errors.New("email.to or email.groups is required for email notifications")
+		}
+	}
+
+	_, err = data.ParseRecipientGroups(c.Email.Groups)
+	if err != nil {
+		return err
+	}
+
+	switch c.SMS.Provider {
+	case "":
+	case "twilio":
+		if c.SMS.User == "" || c.SMS.Pass == "" {
+			return errors.New("sms.user and sms.pass are required for twilio")
+		}
+	case "http":
+		if c.SMS.URL == "" {
+			return errors.New("sms.url is required for the http provider")
+		}
+	default:
+		return fmt.Errorf("invalid sms.provider: %v", c.SMS.Provider)
+	}
+
+	if c.SMS.Provider != "" {
+		if c.SMS.From == "" {
+			return errors.New("sms.from is required for SMS notifications")
+		}
+
+		if c.SMS.To == "" && c.SMS.Groups == "" {
+			return errors.New("sms.to or sms.groups is required for SMS notifications")
+		}
+	}
+
+	_, err = data.ParseRecipientGroups(c.SMS.Groups)
+	if err != nil {
+		return err
+	}
+
+	_, err = data.ParseMaintenanceWindows(c.SMS.QuietHours)
+	if err != nil {
+		return err
+	}
+
+	if c.SMS.Timezone != "" {
+		err = data.ValidateTimezone(c.SMS.Timezone)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Pushover.Token != "" && c.Pushover.User == "" {
+		return errors.New("pushover.user is required for Pushover notifications")
+	}
+
+	if c.Pushover.Priority < -2 || c.Pushover.Priority > 1 {
+		return errors.New("pushover.priority must be -2 to 1")
+	}
+
+	_, err = data.ParseRetentionPolicies(c.Db.Retention)
+	if err != nil {
+		return err
+	}
+
+	_, err = data.ParseFirmwareKeys(c.Firmware.Keys)
+	if err != nil {
+		return err
+	}
+
+	if c.Follow.URL != "" && c.Follow.Resync == 0 {
+		return errors.New("follow.resync is required for a follower")
+	}
+
+	if c.Upstream.URL != "" {
+		if c.Upstream.Interval == 0 {
+			return errors.New("upstream.interval is required to sync upstream")
+		}
+
+		if c.Follow.URL != "" {
+			return errors.New("upstream.url and follow.url can't both be set")
+		}
+	}
+
+	switch c.Auth.Mode {
+	case AuthModeNone:
+	case AuthModeLocal:
+		if c.Auth.SessionTTL <= 0 || c.Auth.SessionMaxAge <= 0 {
+			return errors.New("auth.sessionTTL and auth.sessionMaxAge are required for local auth")
+		}
+
+		if c.Tenants {
+			return errors.New("local auth and tenants can't both be enabled")
+		}
+	default:
+		return fmt.Errorf("unknown auth.mode: %v", c.Auth.Mode)
+	}
+
+	if c.MTLS.Listen != "" {
+		if c.MTLS.Cert == "" || c.MTLS.Key == "" {
+			return errors.New("mtls.cert and mtls.key are required for the mTLS listener")
+		}
+
+		if c.MTLS.SignCommand != "" && c.MTLS.CACert == "" {
+			return errors.New("mtls.caCert is required with mtls.signCommand")
+		}
+
+		if c.MTLS.SignCommand == "" && c.MTLS.Validity <= 0 {
+			return errors.New("mtls.validity is required for the built-in CA")
+		}
+	}
+
+	if c.OIDC.Issuer != "" {
+		if c.Auth.Mode != AuthModeLocal {
+			return errors.New("oidc.issuer requires local auth")
+		}
+
+		if c.OIDC.ClientID == "" || c.OIDC.RedirectURL == "" {
+			return errors.New("oidc.clientId and oidc.redirectUrl are required for single sign-on")
+		}
+
+		_, err := oidc.ParseRoles(c.OIDC.Roles, c.OIDC.DefaultRole)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Auth.Admin != "" && !strings.Contains(c.Auth.Admin, ":") {
+		return errors.New("auth.admin must be user:password")
+	}
+
+	if c.Tenants && c.AdminToken == "" {
+		return errors.New("tenants requires an admin token")
+	}
+
+	if c.Cluster.URL != "" {
+		if c.Redis.Addr == "" {
+			return errors.New("cluster.url requires redis.addr")
+		}
+
+		if c.Follow.URL != "" {
+			return errors.New("cluster.url and follow.url can't both be set")
+		}
+
+		if c.AdminToken == "" {
+			return errors.New("cluster.url requires an admin token")
+		}
+	}
+
+	return nil
+}
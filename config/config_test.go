@@ -0,0 +1,197 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "siot-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := path.Join(dir, name)
+	err = ioutil.WriteFile(file, []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return file, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadOrder(t *testing.T) {
+	file, cleanup := writeFile(t, "siot.toml", `
+# server settings
+port = "9000"
+adminToken = "abc # not a comment"
+
+[db]
+cmdTTL = "2h"     # comment
+logTTL = "3h"
+compactThreshold = 0.25
+devicePointLimit = 1_000
+`)
+	defer cleanup()
+
+	os.Setenv("SIOT_LOG_TTL", "4h")
+	defer os.Unsetenv("SIOT_LOG_TTL")
+
+	var c Config
+	l := NewLoader(&c)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	l.RegisterFlags(fs)
+
+	err := fs.Parse([]string{"-db.rawRetention", "5h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = l.Load(file)
+	if err != nil {
+		t.Fatal("Error loading: ", err)
+	}
+
+	if c.Port != "9000" || c.AdminToken != "abc # not a comment" {
+		t.Error("wrong file values: ", c.Port, c.AdminToken)
+	}
+
+	if c.Db.CmdTTL != 2*time.Hour || c.Db.CompactThreshold != 0.25 ||
+		c.Db.DevicePointLimit != 1000 {
+		t.Error("wrong db file values: ", c.Db)
+	}
+
+	if c.Db.LogTTL != 4*time.Hour {
+		t.Error("env did not override file: ", c.Db.LogTTL)
+	}
+
+	if c.Db.RawRetention != 5*time.Hour {
+		t.Error("flag was not applied: ", c.Db.RawRetention)
+	}
+
+	if c.Db.BlockRetention != 2160*time.Hour || c.DataDir != "./" {
+		t.Error("defaults were not applied: ", c.Db.BlockRetention, c.DataDir)
+	}
+
+	if l.IsSet("mdns") || !l.IsSet("db.cmdTTL") {
+		t.Error("wrong set settings")
+	}
+
+	// the written config loads to the same values
+	var buf bytes.Buffer
+	err = l.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, cleanupOut := writeFile(t, "out.toml", buf.String())
+	defer cleanupOut()
+
+	var c2 Config
+	err = NewLoader(&c2).Load(out)
+	if err != nil || c2 != c {
+		t.Errorf("written config is different: %v\n%+v\n%+v", err, c, c2)
+	}
+}
+
+func TestLoadJSON(t *testing.T) {
+	file, cleanup := writeFile(t, "siot.json", `{"port": "9001", "db": {"cmdTTL": "1h"}}`)
+	defer cleanup()
+
+	var c Config
+	err := NewLoader(&c).Load(file)
+	if err != nil || c.Port != "9001" || c.Db.CmdTTL != time.Hour {
+		t.Error("wrong JSON config: ", c, err)
+	}
+}
+
+func TestLoadMqttRetry(t *testing.T) {
+	file, cleanup := writeFile(t, "siot.toml", "[mqtt]\nretry = \"5m\"")
+	defer cleanup()
+
+	// retryMax defaults below retry, which the mqtt client raises to retry
+	var c Config
+	err := NewLoader(&c).Load(file)
+	if err != nil || c.Mqtt.Retry != 5*time.Minute {
+		t.Error("wrong mqtt retry config: ", c.Mqtt, err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, contents := range []string{
+		"bogus = 1",
+		"[db]\ncmdTTL = 1",
+		"port = \"9000",
+		"port = 9000 extra",
+		"port = \"0\"",
+		"[db]\ncompactThreshold = 2",
+		"groups = [\"a\"]",
+		"port = \"1\"\nport = \"2\"",
+		"[mqtt]\nbroker = \"tcp://a\"\nlisten = \":1883\"",
+		"[modbus]\nlisten = \":502\"",
+		"[grpc]\nlisten = \":8443\"",
+		"adminToken = \"a\"\n[grpc]\nlisten = \":8443\"\ncert = \"c.pem\"",
+		"[grpc]\nlisten = \":8443\"\ncert = \"c.pem\"\nkey = \"k.pem\"",
+		"[lorawan]\nnetwork = \"loriot\"\ntoken = \"a\"",
+		"[lorawan]\nnetwork = \"ttn\"",
+		"[lorawan]\ndecoder = \"fields\"",
+		"[email]\nserver = \"smtp:587\"\nto = \"a@example.com\"",
+		"[email]\ngroups = \"ops\"",
+		"[sms]\nprovider = \"twilio\"\nfrom = \"+1555\"\nto = \"+1556\"",
+		"[sms]\nquietHours = \"22:00\"",
+		"[pushover]\ntoken = \"abc\"",
+		"adminToken = \"a\"\n[cluster]\nurl = \"http://a:8080\"",
+		"[redis]\naddr = \"r:6379\"\n[cluster]\nurl = \"http://a:8080\"",
+		"tenants = true",
+		"[auth]\nmode = \"ldap\"",
+		"[mtls]\nlisten = \":9443\"",
+		"[mtls]\nlisten = \":9443\"\ncert = \"c.pem\"\nkey = \"k.pem\"\nsignCommand = \"sign\"",
+		"tenants = true\nadminToken = \"a\"\n[auth]\nmode = \"local\"",
+		"[auth]\nmode = \"local\"\nadmin = \"bob\"",
+		"[auth]\nmode = \"none\"\n[oidc]\nissuer = \"https://idp\"\nclientId = \"siot\"\nredirectUrl = \"https://siot/cb\"",
+		"[auth]\nmode = \"local\"\n[oidc]\nissuer = \"https://idp\"",
+		"[auth]\nmode = \"local\"\n[oidc]\nissuer = \"https://idp\"\nclientId = \"siot\"\nredirectUrl = \"https://siot/cb\"\nroles = \"admins=root\"",
+		"[upstream]\nurl = \"http://cloud\"\n[follow]\nurl = \"http://primary\"",
+		"[keys]\noverlap = \"-1h\"",
+		"[trace]\nsample = 1.5",
+		"[db]\nretention = \"eu=forever\"",
+		"[db]\nofflineTimeout = \"-1m\"",
+		"[db]\nkeySource = \"vault\"",
+		"[db]\nkeySource = \"keyring\"\nkeyFile = \"db.key\"",
+		"[aws]\nendpoint = \"abc-ats.iot.us-east-1.amazonaws.com\"",
+		"[azure]\nidScope = \"0ne000\"",
+		"[forward]\nformat = \"xml\"",
+		"[forward]\nformat = \"template\"",
+		"[forward]\nqos = 2",
+		"[sparkplug]\ngroupId = \"plant/1\"",
+		"[db]\nhistoryCache = \"-1h\"",
+		"ingestLimitMB = -1",
+		"ingestPolicy = \"drop\"",
+		"[mqtt]\nretry = \"-1s\"",
+		"[mqtt]\nretryMax = \"-1s\"",
+		"[anomaly]\nmethod = \"weekly\"",
+		"[anomaly]\nthreshold = -1",
+		"[anomaly]\ntimezone = \"Mars/Base\"",
+		"[trace]\nheaders = \"token\"",
+		"[network]\ninterfaces = \"ppp:ppp0\"",
+		"[network]\ninterfaces = \"eth:\"",
+		"[network]\ninterfaces = \"eth:eth0\"\nresetCount = 0",
+		"logLevel = \"loud\"",
+		"logFormat = \"xml\"",
+		"logModules = \"modem\"",
+	} {
+		file, cleanup := writeFile(t, "siot.toml", contents)
+
+		var c Config
+		err := NewLoader(&c).Load(file)
+		cleanup()
+		if err == nil {
+			t.Errorf("expected error for %q", contents)
+		}
+	}
+}
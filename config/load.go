@@ -0,0 +1,382 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// field is one setting in a config struct
+type field struct {
+	// key is the full key, like db.cmdTTL
+	key string
+	env string
+	// envEmpty is true if an empty environment variable sets the value
+	envEmpty bool
+	def      string
+	help     string
+	value    reflect.Value
+}
+
+// Loader loads settings into a config struct like Config. Settings are
+// described by struct tags:
+//
+//	key:     name in the config file and flag name. Nested structs are
+//	         sections, and their keys are prefixed with the section.
+//	env:     environment variable. Empty variables are ignored unless the
+//	         tag ends with ",empty".
+//	default: value used if the setting is not set anywhere
+//	help:    flag usage
+type Loader struct {
+	config interface{}
+	fields []field
+	set    map[string]bool
+	fs     *flag.FlagSet
+}
+
+// NewLoader creates a loader for config, which must be a pointer to a
+// struct
+func NewLoader(config interface{}) *Loader {
+	v := reflect.ValueOf(config)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		panic("config must be a pointer to a struct")
+	}
+
+	l := &Loader{config: config, set: make(map[string]bool)}
+	l.addFields("", v.Elem())
+	return l
+}
+
+func (l *Loader) addFields(prefix string, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		key := sf.Tag.Get("key")
+		if key == "" {
+			continue
+		}
+
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		if sf.Type.Kind() == reflect.Struct {
+			l.addFields(key, v.Field(i))
+			continue
+		}
+
+		env := strings.Split(sf.Tag.Get("env"), ",")
+
+		l.fields = append(l.fields, field{
+			key:      key,
+			env:      env[0],
+			envEmpty: len(env) > 1 && env[1] == "empty",
+			def:      sf.Tag.Get("default"),
+			help:     sf.Tag.Get("help"),
+			value:    v.Field(i),
+		})
+	}
+}
+
+func (l *Loader) field(key string) *field {
+	for i := range l.fields {
+		if l.fields[i].key == key {
+			return &l.fields[i]
+		}
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setValue(v reflect.Value, s string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int || v.Kind() == reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case v.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type: %v", v.Type())
+	}
+
+	return nil
+}
+
+func (l *Loader) setField(f *field, s string) error {
+	err := setValue(f.value, s)
+	if err != nil {
+		return err
+	}
+
+	l.set[f.key] = true
+	return nil
+}
+
+// flagValue is a flag.Value for a setting. Flags are only applied after
+// the config file and environment, so the value is just recorded.
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (v *flagValue) String() string   { return v.value }
+func (v *flagValue) IsBoolFlag() bool { return v.isBool }
+
+func (v *flagValue) Set(s string) error {
+	v.value = s
+	return nil
+}
+
+// RegisterFlags adds a flag for each setting to fs. The flags are applied
+// by Load, after fs is parsed.
+func (l *Loader) RegisterFlags(fs *flag.FlagSet) {
+	l.fs = fs
+	for _, f := range l.fields {
+		help := f.help
+		if f.env != "" {
+			help += " (" + f.env + ")"
+		}
+
+		fs.Var(&flagValue{value: f.def, isBool: f.value.Kind() == reflect.Bool},
+			f.key, help)
+	}
+}
+
+// Load applies the defaults, the config file (if file is not blank),
+// environment variables, and flags, then validates the config if it has a
+// Validate method
+func (l *Loader) Load(file string) error {
+	for i := range l.fields {
+		f := &l.fields[i]
+		if f.def == "" {
+			continue
+		}
+
+		err := setValue(f.value, f.def)
+		if err != nil {
+			return fmt.Errorf("invalid default for %v: %v", f.key, err)
+		}
+	}
+
+	if file != "" {
+		err := l.loadFile(file)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range l.fields {
+		f := &l.fields[i]
+		if f.env == "" {
+			continue
+		}
+
+		v, ok := os.LookupEnv(f.env)
+		if !ok || (v == "" && !f.envEmpty) {
+			continue
+		}
+
+		err := l.setField(f, v)
+		if err != nil {
+			return fmt.Errorf("Error parsing %v: %v", f.env, err)
+		}
+	}
+
+	if l.fs != nil {
+		var err error
+		l.fs.Visit(func(fl *flag.Flag) {
+			f := l.field(fl.Name)
+			if f == nil || err != nil {
+				return
+			}
+
+			e := l.setField(f, fl.Value.String())
+			if e != nil {
+				err = fmt.Errorf("Error parsing -%v: %v", fl.Name, e)
+			}
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if v, ok := l.config.(interface{ Validate() error }); ok {
+		return v.Validate()
+	}
+
+	return nil
+}
+
+func (l *Loader) loadFile(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var values []keyValue
+	if path.Ext(file) == ".json" {
+		values, err = parseJSON(b)
+	} else {
+		values, err = parseToml(b)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%v: %v", file, err)
+	}
+
+	for _, kv := range values {
+		where := file
+		if kv.line > 0 {
+			where = fmt.Sprintf("%v: line %v", file, kv.line)
+		}
+
+		f := l.field(kv.key)
+		if f == nil {
+			return fmt.Errorf("%v: unknown setting %v", where, kv.key)
+		}
+
+		err := l.setField(f, kv.value)
+		if err != nil {
+			return fmt.Errorf("%v: %v: %v", where, kv.key, err)
+		}
+	}
+
+	return nil
+}
+
+// IsSet returns true if a setting was set in the config file, environment,
+// or flags
+func (l *Loader) IsSet(key string) bool {
+	return l.set[key]
+}
+
+// Write writes the current settings as a TOML config file, which is
+// useful for provisioning devices with the same settings. Settings that are
+// blank or zero and were not set are skipped.
+func (l *Loader) Write(w io.Writer) error {
+	section := ""
+	for _, f := range l.fields {
+		if !l.set[f.key] && isZero(f.value) {
+			continue
+		}
+
+		key := f.key
+		if i := strings.LastIndex(key, "."); i >= 0 {
+			if s := key[:i]; s != section {
+				section = s
+				_, err := fmt.Fprintf(w, "\n[%v]\n", section)
+				if err != nil {
+					return err
+				}
+			}
+			key = key[i+1:]
+		}
+
+		var value string
+		switch v := f.value.Interface().(type) {
+		case string:
+			value = strconv.Quote(v)
+		case time.Duration:
+			value = strconv.Quote(v.String())
+		default:
+			value = fmt.Sprint(v)
+		}
+
+		_, err := fmt.Fprintf(w, "%v = %v\n", key, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// keyValue is a setting read from a config file
+type keyValue struct {
+	key   string
+	value string
+	line  int
+}
+
+// parseJSON flattens a JSON object, so {"db": {"cmdTTL": "1h"}} is
+// db.cmdTTL = 1h. JSON does not have line numbers, so line is 0.
+func parseJSON(b []byte) ([]keyValue, error) {
+	var m map[string]interface{}
+	err := json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []keyValue
+	var flatten func(prefix string, m map[string]interface{}) error
+	flatten = func(prefix string, m map[string]interface{}) error {
+		for k, v := range m {
+			key := prefix + k
+			var value string
+			switch v := v.(type) {
+			case map[string]interface{}:
+				err := flatten(key+".", v)
+				if err != nil {
+					return err
+				}
+				continue
+			case string:
+				value = v
+			case float64:
+				value = strconv.FormatFloat(v, 'f', -1, 64)
+			case bool:
+				value = strconv.FormatBool(v)
+			default:
+				return errors.New("unsupported value for " + key)
+			}
+			ret = append(ret, keyValue{key: key, value: value})
+		}
+		return nil
+	}
+
+	err = flatten("", m)
+
+	// map order is random, so sort for consistent errors
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].key < ret[j].key
+	})
+
+	return ret, err
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// lineError is an error at a line in a config file
+type lineError struct {
+	line int
+	msg  string
+}
+
+func (e lineError) Error() string {
+	return fmt.Sprintf("line %v: %v", e.line, e.msg)
+}
+
+var reTomlKey = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+// parseToml parses the subset of TOML used for config files: [sections],
+// key = value pairs, strings, numbers, booleans, and comments. Arrays,
+// inline tables, and multi-line strings are not supported.
+func parseToml(b []byte) ([]keyValue, error) {
+	var ret []keyValue
+	seen := make(map[string]bool)
+	section := ""
+	line := 0
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+
+		if text == "" || text[0] == '#' {
+			continue
+		}
+
+		if text[0] == '[' {
+			end := strings.IndexByte(text, ']')
+			if end < 0 || strings.HasPrefix(text, "[[") {
+				return nil, lineError{line, "invalid section"}
+			}
+
+			if rest := strings.TrimSpace(text[end+1:]); rest != "" && rest[0] != '#' {
+				return nil, lineError{line, "unexpected text after section"}
+			}
+
+			section = strings.TrimSpace(text[1:end])
+			if !reTomlKey.MatchString(section) {
+				return nil, lineError{line, "invalid section name: " + section}
+			}
+			continue
+		}
+
+		eq := strings.IndexByte(text, '=')
+		if eq < 0 {
+			return nil, lineError{line, "expected key = value"}
+		}
+
+		key := strings.TrimSpace(text[:eq])
+		if !reTomlKey.MatchString(key) {
+			return nil, lineError{line, "invalid key: " + key}
+		}
+
+		if section != "" {
+			key = section + "." + key
+		}
+
+		if seen[key] {
+			return nil, lineError{line, "duplicate key: " + key}
+		}
+		seen[key] = true
+
+		value, err := parseTomlValue(strings.TrimSpace(text[eq+1:]))
+		if err != nil {
+			return nil, lineError{line, err.Error()}
+		}
+
+		ret = append(ret, keyValue{key: key, value: value, line: line})
+	}
+
+	return ret, scanner.Err()
+}
+
+// parseTomlValue returns a value with quotes and comments removed
+func parseTomlValue(s string) (string, error) {
+	var value, rest string
+
+	switch {
+	case s == "":
+		return "", fmt.Errorf("missing value")
+	case strings.HasPrefix(s, `"""`) || strings.HasPrefix(s, "'''"):
+		return "", fmt.Errorf("multi-line strings are not supported")
+	case s[0] == '[' || s[0] == '{':
+		return "", fmt.Errorf("arrays and tables are not supported")
+	case s[0] == '"':
+		var err error
+		value, rest, err = parseTomlString(s[1:])
+		if err != nil {
+			return "", err
+		}
+	case s[0] == '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		value = s[1 : end+1]
+		rest = s[end+2:]
+	default:
+		// numbers and booleans
+		if i := strings.IndexByte(s, '#'); i >= 0 {
+			s = s[:i]
+		}
+		return strings.Replace(strings.TrimSpace(s), "_", "", -1), nil
+	}
+
+	rest = strings.TrimSpace(rest)
+	if rest != "" && rest[0] != '#' {
+		return "", fmt.Errorf("unexpected text after value")
+	}
+
+	return value, nil
+}
+
+// parseTomlString parses a basic string after the opening quote
+func parseTomlString(s string) (value, rest string, err error) {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"':
+			return b.String(), s[i+1:], nil
+		case '\\':
+			if i+1 >= len(s) {
+				return "", "", fmt.Errorf("unterminated string")
+			}
+			i++
+			switch s[i] {
+			case '"', '\\':
+				b.WriteByte(s[i])
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case 'u':
+				if i+4 >= len(s) {
+					return "", "", fmt.Errorf("invalid escape")
+				}
+				r, err := strconv.ParseUint(s[i+1:i+5], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(r)) {
+					return "", "", fmt.Errorf("invalid escape")
+				}
+				b.WriteRune(rune(r))
+				i += 4
+			default:
+				return "", "", fmt.Errorf("invalid escape: \\%c", s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", "", fmt.Errorf("unterminated string")
+}
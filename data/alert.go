@@ -0,0 +1,92 @@
+package data
+
+import (
+	"fmt"
+	"time"
+)
+
+// alert states
+const (
+	// AlertActive alerts are notified again and escalated until they are
+	// acknowledged
+	AlertActive = "active"
+	// AlertAcknowledged alerts are being handled by someone
+	AlertAcknowledged = "acknowledged"
+	// AlertCleared alerts are no longer active
+	AlertCleared = "cleared"
+)
+
+// Escalation notifies more people when an alert is not acknowledged
+type Escalation struct {
+	// After is a Go duration after the alert was raised
+	After string `json:"after"`
+	// Channels are the channels the escalation is sent on. All configured
+	// channels are used if empty.
+	Channels []string `json:"channels,omitempty"`
+	// Message is sent with the escalation. A message saying the alert is
+	// not acknowledged is used if blank.
+	Message string `json:"message,omitempty"`
+}
+
+// AfterValue returns the parsed After
+func (e Escalation) AfterValue() time.Duration {
+	d, _ := time.ParseDuration(e.After)
+	return d
+}
+
+// Validate checks the escalation is valid
+func (e Escalation) Validate() error {
+	d, err := time.ParseDuration(e.After)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid escalation after: %v", e.After)
+	}
+
+	for _, c := range e.Channels {
+		err := ValidateChannel(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Alert is raised when a rule with notify actions becomes active, and is
+// cleared when the rule is no longer active
+type Alert struct {
+	ID          uint64 `json:"id" boltholdKey:"ID"`
+	RuleID      uint64 `json:"ruleId" boltholdIndex:"RuleID"`
+	Description string `json:"description"`
+	DeviceID    string `json:"deviceId,omitempty"`
+	Message     string `json:"message"`
+	// State is active, acknowledged, or cleared
+	State string `json:"state"`
+	// Level is the number of escalations that were sent
+	Level int `json:"level"`
+	// Raised is when the alert was raised, and Notified is when
+	// notifications were last sent
+	Raised   time.Time `json:"raised"`
+	Notified time.Time `json:"notified"`
+	// Acked and AckedBy are when and by whom the alert was acknowledged
+	Acked   time.Time `json:"acked,omitempty"`
+	AckedBy string    `json:"ackedBy,omitempty"`
+	Cleared time.Time `json:"cleared,omitempty"`
+	// Expires is when a cleared alert is discarded. A zero value means the
+	// alert never expires.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// Open returns true if the alert is not cleared
+func (a Alert) Open() bool {
+	return a.State != AlertCleared
+}
+
+// ValidateAlertState checks an alert state is valid
+func ValidateAlertState(s string) error {
+	switch s {
+	case AlertActive, AlertAcknowledged, AlertCleared:
+		return nil
+	}
+
+	return fmt.Errorf("invalid alert state: %v", s)
+}
@@ -0,0 +1,63 @@
+package data
+
+import (
+	"fmt"
+	"time"
+)
+
+// anomaly detection methods
+const (
+	// AnomalyRolling compares values to the mean and standard deviation
+	// of the recent values of a point
+	AnomalyRolling = "rolling"
+	// AnomalySeasonal compares values to the mean and standard deviation
+	// of the values of a point at the same hour of the day
+	AnomalySeasonal = "seasonal"
+)
+
+// ValidateAnomalyMethod checks an anomaly detection method is valid
+func ValidateAnomalyMethod(m string) error {
+	switch m {
+	case AnomalyRolling, AnomalySeasonal:
+		return nil
+	}
+
+	return fmt.Errorf("invalid anomaly method: %v", m)
+}
+
+// Anomaly is recorded when the values of a point deviate from the baseline
+// learned from its history
+type Anomaly struct {
+	ID       uint64 `json:"id" boltholdKey:"ID"`
+	DeviceID string `json:"deviceId" boltholdIndex:"DeviceID"`
+	// Type and SampleID are the type and ID of the samples of the point
+	Type     string `json:"type"`
+	SampleID string `json:"sampleId,omitempty"`
+	// Value is the first value that deviated, and Mean and StdDev are the
+	// baseline it was compared to
+	Value  float64 `json:"value"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stdDev"`
+	// Score is how many standard deviations Value is from Mean
+	Score float64 `json:"score"`
+	// Start is when the values started deviating, and End is when they
+	// returned to the baseline. End is zero while the anomaly is active.
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end,omitempty"`
+	// Expires is when an ended anomaly is discarded
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// Active returns true if the values of the point still deviate
+func (a Anomaly) Active() bool {
+	return a.End.IsZero()
+}
+
+// Point returns the name of the point, which is the type, and the ID if
+// it is set, like "temp" or "temp.inlet"
+func (a Anomaly) Point() string {
+	if a.SampleID == "" {
+		return a.Type
+	}
+	return a.Type + "." + a.SampleID
+}
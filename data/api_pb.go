@@ -0,0 +1,265 @@
+package data
+
+import (
+	"time"
+)
+
+// The messages of the gRPC service in api.proto are encoded by hand like
+// samples.
+
+// DeviceListRequest is the filter of a ListDevices call
+type DeviceListRequest struct {
+	Group string
+	// Tag is in the form key=value
+	Tag   string
+	Io    string
+	Query string
+	// Limit of 0 returns all devices after Offset
+	Offset int
+	Limit  int
+}
+
+// DeviceListRequestToPb encodes a protobuf ListDevicesRequest message
+func DeviceListRequestToPb(r DeviceListRequest) []byte {
+	var e pbEncoder
+	e.string(1, r.Group)
+	e.string(2, r.Tag)
+	e.string(3, r.Io)
+	e.string(4, r.Query)
+	e.int64(5, int64(r.Offset))
+	e.int64(6, int64(r.Limit))
+	return e.b
+}
+
+// PbToDeviceListRequest decodes a protobuf ListDevicesRequest message
+func PbToDeviceListRequest(b []byte) (DeviceListRequest, error) {
+	var r DeviceListRequest
+	d := pbDecoder{b: b}
+
+	for d.err == nil && len(d.b) > 0 {
+		field, wire := d.next()
+		switch {
+		case field == 1 && wire == pbBytes:
+			r.Group = string(d.bytes())
+		case field == 2 && wire == pbBytes:
+			r.Tag = string(d.bytes())
+		case field == 3 && wire == pbBytes:
+			r.Io = string(d.bytes())
+		case field == 4 && wire == pbBytes:
+			r.Query = string(d.bytes())
+		case field == 5 && wire == pbVarint:
+			r.Offset = int(d.varint())
+		case field == 6 && wire == pbVarint:
+			r.Limit = int(d.varint())
+		default:
+			d.skip(wire)
+		}
+	}
+
+	if r.Offset < 0 || r.Limit < 0 {
+		return r, errPb
+	}
+
+	return r, d.err
+}
+
+// deviceToPb encodes the ID, description, groups, tags, and ios of a
+// device
+func deviceToPb(dev Device) []byte {
+	var e pbEncoder
+	e.string(1, dev.ID)
+	e.string(2, dev.Config.Description)
+	for _, g := range dev.Config.Groups {
+		e.bytes(3, []byte(g))
+	}
+	e.stringMap(4, dev.Config.Tags)
+	for _, s := range dev.State.Ios {
+		e.bytes(5, sampleToPb(s))
+	}
+	return e.b
+}
+
+func pbToDevice(b []byte) (Device, error) {
+	var dev Device
+	d := pbDecoder{b: b}
+
+	for d.err == nil && len(d.b) > 0 {
+		field, wire := d.next()
+		switch {
+		case field == 1 && wire == pbBytes:
+			dev.ID = string(d.bytes())
+		case field == 2 && wire == pbBytes:
+			dev.Config.Description = string(d.bytes())
+		case field == 3 && wire == pbBytes:
+			dev.Config.Groups = append(dev.Config.Groups, string(d.bytes()))
+		case field == 4 && wire == pbBytes:
+			k, v, _, err := mapEntry(d.bytes())
+			if err != nil {
+				return dev, err
+			}
+			if dev.Config.Tags == nil {
+				dev.Config.Tags = make(map[string]string)
+			}
+			dev.Config.Tags[k] = v
+		case field == 5 && wire == pbBytes:
+			s, err := pbToSample(d.bytes())
+			if err != nil {
+				return dev, err
+			}
+			dev.State.Ios = append(dev.State.Ios, s)
+		default:
+			d.skip(wire)
+		}
+	}
+
+	return dev, d.err
+}
+
+// DeviceListToPb encodes a protobuf ListDevicesResponse message. Only the
+// fields in api.proto are encoded.
+func DeviceListToPb(devices []Device, total int) []byte {
+	var e pbEncoder
+	for _, dev := range devices {
+		e.bytes(1, deviceToPb(dev))
+	}
+	e.int64(2, int64(total))
+	return e.b
+}
+
+// PbToDeviceList decodes a protobuf ListDevicesResponse message
+func PbToDeviceList(b []byte) ([]Device, int, error) {
+	var ret []Device
+	var total int
+	d := pbDecoder{b: b}
+
+	for d.err == nil && len(d.b) > 0 {
+		field, wire := d.next()
+		switch {
+		case field == 1 && wire == pbBytes:
+			dev, err := pbToDevice(d.bytes())
+			if err != nil {
+				return nil, 0, err
+			}
+			ret = append(ret, dev)
+		case field == 2 && wire == pbVarint:
+			total = int(d.varint())
+		default:
+			d.skip(wire)
+		}
+	}
+
+	return ret, total, d.err
+}
+
+// SampleStreamRequestToPb encodes a protobuf StreamSamplesRequest message
+func SampleStreamRequestToPb(deviceID string) []byte {
+	var e pbEncoder
+	e.string(1, deviceID)
+	return e.b
+}
+
+// PbToSampleStreamRequest decodes a protobuf StreamSamplesRequest message
+// and returns the device ID
+func PbToSampleStreamRequest(b []byte) (string, error) {
+	var id string
+	d := pbDecoder{b: b}
+
+	for d.err == nil && len(d.b) > 0 {
+		field, wire := d.next()
+		if field == 1 && wire == pbBytes {
+			id = string(d.bytes())
+		} else {
+			d.skip(wire)
+		}
+	}
+
+	return id, d.err
+}
+
+// DeviceSampleToPb encodes a protobuf DeviceSample message
+func DeviceSampleToPb(deviceID string, s Sample) []byte {
+	var e pbEncoder
+	e.string(1, deviceID)
+	e.bytes(2, sampleToPb(s))
+	return e.b
+}
+
+// PbToDeviceSample decodes a protobuf DeviceSample message and returns the
+// device ID and sample
+func PbToDeviceSample(b []byte) (string, Sample, error) {
+	var id string
+	var s Sample
+	d := pbDecoder{b: b}
+
+	for d.err == nil && len(d.b) > 0 {
+		field, wire := d.next()
+		switch {
+		case field == 1 && wire == pbBytes:
+			id = string(d.bytes())
+		case field == 2 && wire == pbBytes:
+			var err error
+			s, err = pbToSample(d.bytes())
+			if err != nil {
+				return id, s, err
+			}
+		default:
+			d.skip(wire)
+		}
+	}
+
+	return id, s, d.err
+}
+
+// CommandToPb encodes a protobuf Command message
+func CommandToPb(c DeviceCommand) []byte {
+	var e pbEncoder
+	if c.ID != 0 {
+		e.key(1, pbVarint)
+		e.varint(c.ID)
+	}
+	e.string(2, c.DeviceID)
+	e.string(3, c.Command)
+	e.stringMap(4, c.Args)
+	if !c.Created.IsZero() {
+		e.int64(5, c.Created.UnixNano())
+	}
+	if !c.Expires.IsZero() {
+		e.int64(6, c.Expires.UnixNano())
+	}
+	return e.b
+}
+
+// PbToCommand decodes a protobuf Command message
+func PbToCommand(b []byte) (DeviceCommand, error) {
+	var c DeviceCommand
+	d := pbDecoder{b: b}
+
+	for d.err == nil && len(d.b) > 0 {
+		field, wire := d.next()
+		switch {
+		case field == 1 && wire == pbVarint:
+			c.ID = d.varint()
+		case field == 2 && wire == pbBytes:
+			c.DeviceID = string(d.bytes())
+		case field == 3 && wire == pbBytes:
+			c.Command = string(d.bytes())
+		case field == 4 && wire == pbBytes:
+			k, v, _, err := mapEntry(d.bytes())
+			if err != nil {
+				return c, err
+			}
+			if c.Args == nil {
+				c.Args = make(map[string]string)
+			}
+			c.Args[k] = v
+		case field == 5 && wire == pbVarint:
+			c.Created = time.Unix(0, int64(d.varint()))
+		case field == 6 && wire == pbVarint:
+			c.Expires = time.Unix(0, int64(d.varint()))
+		default:
+			d.skip(wire)
+		}
+	}
+
+	return c, d.err
+}
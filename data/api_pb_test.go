@@ -0,0 +1,70 @@
+package data
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCommandPb(t *testing.T) {
+	// Command{id: 5, device_id: "d", command: "r"}
+	exp := []byte{0x08, 0x05, 0x12, 0x01, 'd', 0x1a, 0x01, 'r'}
+	b := CommandToPb(DeviceCommand{ID: 5, DeviceID: "d", Command: "r"})
+	if !bytes.Equal(b, exp) {
+		t.Errorf("wrong encoding: % x", b)
+	}
+
+	cmd := DeviceCommand{ID: 1 << 40, DeviceID: "pump", Command: "reboot",
+		Args:    map[string]string{"delay": "5", "force": ""},
+		Created: time.Unix(1580000000, 1), Expires: time.Unix(1580000060, 0)}
+
+	ret, err := PbToCommand(CommandToPb(cmd))
+	if err != nil {
+		t.Fatal("Error decoding command: ", err)
+	}
+
+	if !reflect.DeepEqual(ret, cmd) {
+		t.Errorf("command changed: %+v, %+v", cmd, ret)
+	}
+}
+
+func TestDeviceListPb(t *testing.T) {
+	r := DeviceListRequest{Group: "pumps", Tag: "site=north", Io: "temp",
+		Query: "north", Offset: 10, Limit: 5}
+
+	retR, err := PbToDeviceListRequest(DeviceListRequestToPb(r))
+	if err != nil || retR != r {
+		t.Errorf("request changed: %+v, %+v, %v", r, retR, err)
+	}
+
+	devices := []Device{
+		{ID: "1", Config: DeviceConfig{Description: "pump",
+			Groups: []string{"pumps", "north"},
+			Tags:   map[string]string{"site": "north"}},
+			State: DeviceState{Ios: []Sample{{Type: "temp", Value: 20}}}},
+		{ID: "2"},
+	}
+
+	ret, total, err := PbToDeviceList(DeviceListToPb(devices, 12))
+	if err != nil {
+		t.Fatal("Error decoding devices: ", err)
+	}
+
+	if total != 12 || !reflect.DeepEqual(ret, devices) {
+		t.Errorf("devices changed: %+v, %v", ret, total)
+	}
+}
+
+func TestDeviceSamplePb(t *testing.T) {
+	id, err := PbToSampleStreamRequest(SampleStreamRequestToPb("pump"))
+	if err != nil || id != "pump" {
+		t.Errorf("wrong device: %v, %v", id, err)
+	}
+
+	s := Sample{Type: "temp", Value: 20, Time: time.Unix(1580000000, 0)}
+	id, ret, err := PbToDeviceSample(DeviceSampleToPb("pump", s))
+	if err != nil || id != "pump" || !reflect.DeepEqual(ret, s) {
+		t.Errorf("sample changed: %v, %+v, %v", id, ret, err)
+	}
+}
@@ -0,0 +1,131 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// BLE sensor formats
+const (
+	// BlePresence sensors only report presence and rssi
+	BlePresence = "presence"
+	// BleIBeacon sensors are Apple iBeacons, which are matched by UUID,
+	// major, and minor, as their address can change
+	BleIBeacon = "ibeacon"
+	// BleRuuvi sensors are RuuviTags that advertise data format 5
+	BleRuuvi = "ruuvi"
+	// BleGatt sensors are connected to read GATT characteristics
+	BleGatt = "gatt"
+)
+
+// BleSensor is a Bluetooth LE beacon or sensor that a gateway device scans
+// for. All sensors report presence (1 if an advertisement was received in
+// the last Timeout seconds, else 0) and rssi samples, and ruuvi and gatt
+// sensors also report their readings.
+type BleSensor struct {
+	// ID is used as the sample ID
+	ID string `json:"id"`
+	// Format is presence (default), ibeacon, ruuvi, or gatt
+	Format string `json:"format,omitempty"`
+	// Address is the MAC address, like C4:7C:8D:6A:3B:01. It is required
+	// for all formats except ibeacon.
+	Address string `json:"address,omitempty"`
+	// UUID is the iBeacon proximity UUID. Major and Minor match any value
+	// if 0.
+	UUID  string `json:"uuid,omitempty"`
+	Major int    `json:"major,omitempty"`
+	Minor int    `json:"minor,omitempty"`
+	// Characteristics are read from gatt sensors every Interval seconds
+	// (default 60)
+	Characteristics []BleCharacteristic `json:"characteristics,omitempty"`
+	Interval        int                 `json:"interval,omitempty"`
+	// Timeout is how long in seconds after the last advertisement the
+	// sensor is reported absent (default 60)
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// BleCharacteristic is a GATT characteristic value. Values use the formats
+// of LoRaWAN fields, are little endian as in the BLE spec, and are
+// raw*Scale + Offset.
+type BleCharacteristic struct {
+	// UUID is the characteristic UUID, like
+	// 00002a6e-0000-1000-8000-00805f9b34fb
+	UUID string `json:"uuid"`
+	// Type is the sample type, like temp
+	Type   string  `json:"type"`
+	Format string  `json:"format,omitempty"`
+	Scale  float64 `json:"scale,omitempty"`
+	Offset float64 `json:"offset,omitempty"`
+}
+
+// Value decodes a characteristic value. ok is false if the value is too
+// short.
+func (c BleCharacteristic) Value(b []byte) (v float64, ok bool) {
+	return LorawanField{Format: c.Format, LittleEndian: true, Scale: c.Scale,
+		Offset: c.Offset}.Value(b)
+}
+
+var reBleAddress = regexp.MustCompile(`^([0-9A-Fa-f]{2}:){5}[0-9A-Fa-f]{2}$`)
+var reBleUUID = regexp.MustCompile(`^[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}$`)
+
+// Validate checks the characteristic is valid
+func (c BleCharacteristic) Validate() error {
+	if !reBleUUID.MatchString(c.UUID) {
+		return errors.New("invalid ble characteristic uuid")
+	}
+
+	if c.Type == "" {
+		return errors.New("ble characteristic type is required")
+	}
+
+	switch c.Format {
+	case "", LorawanUint8, LorawanInt8, LorawanUint16, LorawanInt16,
+		LorawanUint32, LorawanInt32, LorawanFloat32:
+	default:
+		return fmt.Errorf("unsupported ble format: %v", c.Format)
+	}
+
+	return nil
+}
+
+// Validate checks the BLE sensor config is valid
+func (s BleSensor) Validate() error {
+	if s.ID == "" {
+		return errors.New("ble sensor id is required")
+	}
+
+	switch s.Format {
+	case "", BlePresence, BleRuuvi, BleGatt:
+		if !reBleAddress.MatchString(s.Address) {
+			return errors.New("invalid ble sensor address")
+		}
+	case BleIBeacon:
+		if !reBleUUID.MatchString(s.UUID) {
+			return errors.New("invalid ibeacon uuid")
+		}
+	default:
+		return fmt.Errorf("unsupported ble sensor format: %v", s.Format)
+	}
+
+	if s.Major < 0 || s.Major > 0xffff || s.Minor < 0 || s.Minor > 0xffff {
+		return errors.New("ibeacon major and minor must be 0 to 65535")
+	}
+
+	if (s.Format == BleGatt) != (len(s.Characteristics) > 0) {
+		return errors.New("ble characteristics are required for gatt sensors only")
+	}
+
+	for _, c := range s.Characteristics {
+		err := c.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.Interval < 0 || s.Timeout < 0 {
+		return errors.New("ble sensor interval and timeout can't be negative")
+	}
+
+	return nil
+}
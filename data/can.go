@@ -0,0 +1,80 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CanConfig is a CAN bus the device reads frames from, like the J1939 bus
+// of a vehicle or generator set. Frames are decoded with a DBC file, and
+// the selected signals are reported as samples.
+type CanConfig struct {
+	// Interface is the SocketCAN interface, like can0. It must be up with
+	// the bus bitrate set.
+	Interface string `json:"interface"`
+	// Dbc is the path of the DBC file on the device
+	Dbc string `json:"dbc"`
+	// J1939 matches extended frames to DBC messages by PGN, so any source
+	// address and priority match, reassembles broadcast multi-packet
+	// messages, and skips not available values
+	J1939 bool `json:"j1939,omitempty"`
+	// Interval is how often the latest signal values are sent in seconds
+	// (default 1)
+	Interval int `json:"interval,omitempty"`
+	// Signals are the DBC signals reported as samples
+	Signals []CanSignal `json:"signals"`
+}
+
+// CanSignal is a DBC signal reported as samples
+type CanSignal struct {
+	// Message is the DBC message name. It is only needed if signals in
+	// different messages have the same name.
+	Message string `json:"message,omitempty"`
+	// Signal is the DBC signal name, like EngineSpeed
+	Signal string `json:"signal"`
+	// ID is used as the sample ID
+	ID string `json:"id,omitempty"`
+	// Type is the sample type, like rpm
+	Type string `json:"type"`
+}
+
+// Validate checks the signal config is valid
+func (s CanSignal) Validate() error {
+	if s.Signal == "" {
+		return errors.New("can signal name is required")
+	}
+
+	if s.Type == "" {
+		return fmt.Errorf("can signal %v type is required", s.Signal)
+	}
+
+	return nil
+}
+
+// Validate checks the CAN config is valid
+func (c CanConfig) Validate() error {
+	if c.Interface == "" {
+		return errors.New("can interface is required")
+	}
+
+	if c.Dbc == "" {
+		return errors.New("can dbc file is required")
+	}
+
+	if c.Interval < 0 {
+		return errors.New("can interval can't be negative")
+	}
+
+	if len(c.Signals) == 0 {
+		return errors.New("can signals are required")
+	}
+
+	for _, s := range c.Signals {
+		err := s.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
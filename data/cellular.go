@@ -0,0 +1,54 @@
+package data
+
+import (
+	"errors"
+	"regexp"
+)
+
+// CellularConfig is the APN and SIM profile used by a cellular modem. It
+// can be changed remotely to re-provision a device for a new carrier.
+type CellularConfig struct {
+	APN      string `json:"apn"`
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+	// PIN is entered if the SIM is locked
+	PIN string `json:"pin,omitempty"`
+	// Operator is the numeric ID (MCC and MNC) of the preferred operator.
+	// If blank, the operator is selected automatically.
+	Operator string `json:"operator,omitempty"`
+	// DenyRoaming keeps the modem from using data while roaming
+	DenyRoaming bool `json:"denyRoaming,omitempty"`
+}
+
+var reAPN = regexp.MustCompile(`^[A-Za-z0-9.\-]{1,100}$`)
+var rePIN = regexp.MustCompile(`^\d{4,8}$`)
+var reOperator = regexp.MustCompile(`^\d{5,6}$`)
+var reCredential = regexp.MustCompile(`["\r\n]`)
+
+// Validate checks the profile can be sent to a modem
+func (c CellularConfig) Validate() error {
+	if !reAPN.MatchString(c.APN) {
+		return errors.New("invalid APN")
+	}
+
+	if c.Password != "" && c.User == "" {
+		return errors.New("password set without user")
+	}
+
+	// these end up in AT commands and the pppd config
+	for _, s := range []string{c.User, c.Password} {
+		if reCredential.MatchString(s) {
+			return errors.New("user and password can't contain quotes or newlines")
+		}
+	}
+
+	if c.PIN != "" && !rePIN.MatchString(c.PIN) {
+		return errors.New("PIN must be 4 to 8 digits")
+	}
+
+	if c.Operator != "" && !reOperator.MatchString(c.Operator) {
+		return errors.New("operator must be a 5 or 6 digit MCC/MNC")
+	}
+
+	return nil
+}
@@ -0,0 +1,27 @@
+package data
+
+import "testing"
+
+func TestCellularConfigValidate(t *testing.T) {
+	cases := []struct {
+		config CellularConfig
+		valid  bool
+	}{
+		{CellularConfig{APN: "hologram"}, true},
+		{CellularConfig{APN: "iot.1nce.net", User: "u", Password: "p",
+			PIN: "1234", Operator: "310410"}, true},
+		{CellularConfig{}, false},
+		{CellularConfig{APN: "bad apn"}, false},
+		{CellularConfig{APN: "a", Password: "p"}, false},
+		{CellularConfig{APN: "a", User: `u"`}, false},
+		{CellularConfig{APN: "a", User: "u", Password: "p\r\nATD"}, false},
+		{CellularConfig{APN: "a", PIN: "12"}, false},
+		{CellularConfig{APN: "a", Operator: "AT&T"}, false},
+	}
+
+	for _, c := range cases {
+		if err := c.config.Validate(); (err == nil) != c.valid {
+			t.Errorf("%+v: expected valid %v, got %v", c.config, c.valid, err)
+		}
+	}
+}
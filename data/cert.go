@@ -0,0 +1,30 @@
+package data
+
+import "time"
+
+// DeviceCert is a client certificate issued to a device for mutual TLS.
+// Every certificate issued is recorded, so certificates can be revoked.
+// Records are deleted when the certificate expires.
+type DeviceCert struct {
+	// Serial is the hex encoded serial number of the certificate
+	Serial   string    `json:"serial" boltholdKey:"Serial"`
+	DeviceID string    `json:"deviceId" boltholdIndex:"DeviceID"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	// Revoked is when the certificate was revoked, or zero
+	Revoked time.Time `json:"revoked,omitempty"`
+}
+
+// CertRequest is sent by a device to get a new certificate
+type CertRequest struct {
+	// CSR is the PEM encoded certificate signing request
+	CSR string `json:"csr"`
+}
+
+// CertResponse is returned when a certificate is issued
+type CertResponse struct {
+	// Cert is the PEM encoded device certificate
+	Cert string `json:"cert"`
+	// CACert is the PEM encoded certificate of the CA that signed it
+	CACert string `json:"caCert"`
+}
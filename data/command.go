@@ -0,0 +1,35 @@
+package data
+
+import "time"
+
+// DeviceCommand is a command that is queued for a device. Devices fetch
+// queued commands the next time they check in.
+type DeviceCommand struct {
+	ID       uint64            `json:"id" boltholdKey:"ID"`
+	DeviceID string            `json:"deviceId" boltholdIndex:"DeviceID"`
+	Command  string            `json:"command"`
+	Args     map[string]string `json:"args,omitempty"`
+	Created  time.Time         `json:"created"`
+	// Expires is when the command is discarded if it has not been
+	// processed. A zero value means the command never expires.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// Expired returns true if the command has expired
+func (c *DeviceCommand) Expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !now.Before(c.Expires)
+}
+
+// PollCommand asks a device to read the equipment that reports a sample
+// type now, instead of waiting for its poll interval. The type arg is the
+// sample type, and the optional id arg is the sample ID.
+const PollCommand = "poll"
+
+// AuditRecord records a change that was made to the system
+type AuditRecord struct {
+	ID       uint64    `json:"id" boltholdKey:"ID"`
+	Time     time.Time `json:"time"`
+	DeviceID string    `json:"deviceId,omitempty" boltholdIndex:"DeviceID"`
+	Action   string    `json:"action"`
+	Message  string    `json:"message,omitempty"`
+}
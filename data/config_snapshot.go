@@ -0,0 +1,58 @@
+package data
+
+import (
+	"reflect"
+	"time"
+)
+
+// ConfigSnapshot is a version of the config of a device. A snapshot is
+// recorded every time the config changes, so the device can be rolled back
+// to an earlier version.
+type ConfigSnapshot struct {
+	ID       uint64 `json:"-" boltholdKey:"ID"`
+	DeviceID string `json:"deviceId" boltholdIndex:"DeviceID"`
+	// Version counts the config versions of the device, starting at 1
+	Version int          `json:"version"`
+	Time    time.Time    `json:"time"`
+	Config  DeviceConfig `json:"config"`
+	// Reason describes changes that were not made directly, like
+	// "rollback to version 3"
+	Reason string `json:"reason,omitempty"`
+}
+
+// ConfigFieldDiff is a config field that is different in two versions
+type ConfigFieldDiff struct {
+	// Field is the JSON name of the field, like "wifi"
+	Field string `json:"field"`
+	// From and To are the values of the field, or nil if it is not set
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// ConfigDiff returns the fields that are different in two configs
+func ConfigDiff(from, to DeviceConfig) []ConfigFieldDiff {
+	ret := []ConfigFieldDiff{}
+
+	fromV := reflect.ValueOf(from)
+	toV := reflect.ValueOf(to)
+	typ := fromV.Type()
+
+	value := func(v reflect.Value) interface{} {
+		if configFieldEmpty(v) {
+			return nil
+		}
+		return v.Interface()
+	}
+
+	for i := 0; i < typ.NumField(); i++ {
+		if !configFieldEqual(fromV.Field(i), toV.Field(i)) {
+			ret = append(ret, ConfigFieldDiff{
+				Field: configFieldName(typ.Field(i)),
+				From:  value(fromV.Field(i)),
+				To:    value(toV.Field(i)),
+			})
+		}
+	}
+
+	return ret
+}
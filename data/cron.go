@@ -0,0 +1,193 @@
+package data
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a parsed cron expression. Each field is a bit set of the values
+// that match.
+type Cron struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are set if the day fields are *. If both day
+	// fields are restricted, a day matches if either matches, like cron.
+	domAny, dowAny bool
+}
+
+var cronMonths = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul",
+	"aug", "sep", "oct", "nov", "dec"}
+
+var cronDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseCronValue parses a number or a name. Names start at first.
+func parseCronValue(s string, names []string, first int) (int, error) {
+	for i, n := range names {
+		if strings.ToLower(s) == n {
+			return i + first, nil
+		}
+	}
+
+	return strconv.Atoi(s)
+}
+
+// parseCronField parses a comma separated list of *, values, and ranges
+// with optional steps, like "*/15" or "1-5,10"
+func parseCronField(s string, min, max int, names []string) (uint64, error) {
+	var ret uint64
+
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		hasStep := false
+		if i := strings.Index(part, "/"); i >= 0 {
+			hasStep = true
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid cron step: %v", part)
+			}
+			part = part[:i]
+		}
+
+		start, end := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			r := strings.SplitN(part, "-", 2)
+			var err1, err2 error
+			start, err1 = parseCronValue(r[0], names, min)
+			end, err2 = parseCronValue(r[1], names, min)
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid cron range: %v", part)
+			}
+		default:
+			v, err := parseCronValue(part, names, min)
+			if err != nil {
+				return 0, fmt.Errorf("invalid cron value: %v", part)
+			}
+			start = v
+			// a value with a step is a range to the max, like cron
+			if hasStep {
+				end = max
+			} else {
+				end = v
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("cron value out of range %v-%v: %v", min, max,
+				part)
+		}
+
+		for v := start; v <= end; v += step {
+			ret |= 1 << uint(v)
+		}
+	}
+
+	return ret, nil
+}
+
+// ParseCron parses a cron expression with minute, hour, day of month,
+// month, and day of week fields, like "30 6 * * mon-fri". Months and days
+// can be names, and Sunday is 0 or 7.
+func ParseCron(s string) (Cron, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return Cron{}, fmt.Errorf("cron expression must have 5 fields: %v", s)
+	}
+
+	var c Cron
+	var err error
+
+	c.minute, err = parseCronField(fields[0], 0, 59, nil)
+	if err != nil {
+		return Cron{}, err
+	}
+
+	c.hour, err = parseCronField(fields[1], 0, 23, nil)
+	if err != nil {
+		return Cron{}, err
+	}
+
+	c.dom, err = parseCronField(fields[2], 1, 31, nil)
+	if err != nil {
+		return Cron{}, err
+	}
+
+	c.month, err = parseCronField(fields[3], 1, 12, cronMonths)
+	if err != nil {
+		return Cron{}, err
+	}
+
+	c.dow, err = parseCronField(fields[4], 0, 7, cronDays)
+	if err != nil {
+		return Cron{}, err
+	}
+
+	// 7 is also Sunday
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+
+	c.domAny = strings.HasPrefix(fields[2], "*")
+	c.dowAny = strings.HasPrefix(fields[4], "*")
+
+	return c, nil
+}
+
+func (c Cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+
+	return dom || dow
+}
+
+// Next returns the first time after t that matches, in the time zone loc.
+// The zero time is returned if nothing matches in the next 5 years, like
+// Feb 30.
+func (c Cron) Next(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0,
+				loc)
+			// an hour can repeat when DST ends
+			if !next.After(t) {
+				next = t.Add(time.Hour).Truncate(time.Hour)
+			}
+			t = next
+			continue
+		}
+
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,55 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCron(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("tzdata not available: ", err)
+	}
+
+	// Friday
+	start := time.Date(2020, 3, 6, 12, 0, 0, 0, loc)
+
+	tests := []struct {
+		expr string
+		next time.Time
+	}{
+		{"*/15 * * * *", time.Date(2020, 3, 6, 12, 15, 0, 0, loc)},
+		{"30 6 * * mon-fri", time.Date(2020, 3, 9, 6, 30, 0, 0, loc)},
+		{"0 18,20 * * *", time.Date(2020, 3, 6, 18, 0, 0, 0, loc)},
+		{"0 0 1 apr *", time.Date(2020, 4, 1, 0, 0, 0, 0, loc)},
+		{"0 12 * * 7", time.Date(2020, 3, 8, 12, 0, 0, 0, loc)},
+		// day of month or day of week
+		{"0 0 10 * sat", time.Date(2020, 3, 7, 0, 0, 0, 0, loc)},
+		{"5/20 12 * * *", time.Date(2020, 3, 6, 12, 5, 0, 0, loc)},
+		// 2:30 does not exist when DST starts on Mar 8
+		{"30 2 * * *", time.Date(2020, 3, 7, 2, 30, 0, 0, loc)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+
+	for _, test := range tests {
+		c, err := ParseCron(test.expr)
+		if err != nil {
+			t.Errorf("%v: error parsing: %v", test.expr, err)
+			continue
+		}
+
+		next := c.Next(start, loc)
+		if !next.Equal(test.next) {
+			t.Errorf("%v: expected %v, got %v", test.expr, test.next, next)
+		}
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *",
+		"* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *",
+		"* * * foo *"} {
+		_, err := ParseCron(expr)
+		if err == nil {
+			t.Errorf("%v: expected error", expr)
+		}
+	}
+}
@@ -1,15 +1,81 @@
 package data
 
+import (
+	"sort"
+	"time"
+)
+
 // DeviceConfig represents a device configuration (stuff that
 // is set by user in UI)
 type DeviceConfig struct {
 	Description string `json:"description"`
+	// Type is the device template the device is an instance of (see
+	// DeviceTemplate)
+	Type string `json:"type,omitempty"`
+	// Groups the device is a member of
+	Groups []string `json:"groups,omitempty"`
+	// Parent is the ID of the device this device is attached to, like the
+	// Modbus gateway a meter is read through. Devices are members of the
+	// groups of their parents.
+	Parent string `json:"parent,omitempty"`
+	// Tags are arbitrary key/value pairs used to organize devices
+	Tags map[string]string `json:"tags,omitempty"`
+	// Cellular is the modem profile for devices with a cellular modem
+	Cellular *CellularConfig `json:"cellular,omitempty"`
+	// Wifi is the network for devices with a WiFi client interface
+	Wifi *WifiConfig `json:"wifi,omitempty"`
+	// Ethernet is the address config for devices with an Ethernet interface
+	Ethernet *EthernetConfig `json:"ethernet,omitempty"`
+	// Timezone is the tzdata name of the local time zone at the site, like
+	// America/New_York
+	Timezone string `json:"timezone,omitempty"`
+	// Hostname is the host name of the device
+	Hostname string `json:"hostname,omitempty"`
+	// Sensors are read by the device and reported as samples
+	Sensors []SensorConfig `json:"sensors,omitempty"`
+	// OneWire reads 1-Wire temperature probes if set
+	OneWire *OneWireConfig `json:"oneWire,omitempty"`
+	// Modbus are Modbus devices polled by the device
+	Modbus []ModbusConfig `json:"modbus,omitempty"`
+	// Ble are Bluetooth LE beacons and sensors the device scans for
+	Ble []BleSensor `json:"ble,omitempty"`
+	// Opcua are OPC UA servers the device subscribes to
+	Opcua []OpcuaConfig `json:"opcua,omitempty"`
+	// Snmp are SNMP agents polled by the device
+	Snmp []SnmpConfig `json:"snmp,omitempty"`
+	// SnmpTraps receives traps from SNMP agents if set
+	SnmpTraps *SnmpTrapConfig `json:"snmpTraps,omitempty"`
+	// Dnp3 are DNP3 outstations polled by the device
+	Dnp3 []Dnp3Config `json:"dnp3,omitempty"`
+	// Can are CAN buses the device reads signals from
+	Can []CanConfig `json:"can,omitempty"`
+	// Transforms convert the values of samples from the device as they
+	// are written
+	Transforms []Transform `json:"transforms,omitempty"`
+	// Virtual are sample types computed from other samples of the device
+	Virtual []VirtualPoint `json:"virtual,omitempty"`
+	// Maintenance are the windows when disruptive operations like OS
+	// updates and reboots can run. If blank, they run right away.
+	Maintenance []MaintenanceWindow `json:"maintenance,omitempty"`
+	// Location is the position of the site, which sunrise and sunset
+	// schedules need
+	Location *Location `json:"location,omitempty"`
+	// Schedules run device commands at set times
+	Schedules []Schedule `json:"schedules,omitempty"`
+	// Lorawan is how uplinks and downlinks of LoRaWAN devices are mapped
+	Lorawan *LorawanConfig `json:"lorawan,omitempty"`
 }
 
 // DeviceState represents information about a device that is
 // collected, vs set by user.
 type DeviceState struct {
 	Ios []Sample `json:"ios"`
+	// ConfigUpdated is when the config last changed
+	ConfigUpdated time.Time `json:"configUpdated,omitempty"`
+	// Reported is the config the device last reported it applied
+	Reported *ConfigReport `json:"reported,omitempty"`
+	// InheritedGroups are the groups of the parents of the device
+	InheritedGroups []string `json:"inheritedGroups,omitempty"`
 }
 
 // Device represents the state of a device
@@ -19,6 +85,41 @@ type Device struct {
 	State  DeviceState  `json:"state"`
 }
 
+// Groups returns the groups the device is a member of, including the
+// groups inherited from its parents, sorted
+func (d *Device) Groups() []string {
+	seen := make(map[string]bool)
+	ret := []string{}
+	for _, g := range append(append([]string{}, d.Config.Groups...),
+		d.State.InheritedGroups...) {
+		if !seen[g] {
+			seen[g] = true
+			ret = append(ret, g)
+		}
+	}
+
+	sort.Strings(ret)
+	return ret
+}
+
+// DeviceNode is a device and the devices attached to it
+type DeviceNode struct {
+	Device   Device       `json:"device"`
+	Children []DeviceNode `json:"children"`
+}
+
+// LastSeen returns the time of the newest sample of the device, or zero if
+// it has no samples
+func (d *Device) LastSeen() time.Time {
+	var ret time.Time
+	for _, s := range d.State.Ios {
+		if s.Time.After(ret) {
+			ret = s.Time
+		}
+	}
+	return ret
+}
+
 // ProcessSample takes a sample for a device and adds/updates in Ios
 func (d *Device) ProcessSample(sample Sample) {
 	ioFound := false
@@ -0,0 +1,134 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DNP3 point objects
+const (
+	Dnp3BinaryInput   = "binaryInput"
+	Dnp3BinaryOutput  = "binaryOutput"
+	Dnp3Counter       = "counter"
+	Dnp3FrozenCounter = "frozenCounter"
+	Dnp3AnalogInput   = "analogInput"
+	Dnp3AnalogOutput  = "analogOutput"
+)
+
+// Dnp3Config is a DNP3 outstation, like an RTU at a lift station or
+// substation, that the device polls as a master. Outstations on a serial
+// port are on Port, and TCP outstations have an Address.
+type Dnp3Config struct {
+	// Port is the serial port, like /dev/ttyUSB0 or usb:<vendor>:<product>
+	Port string `json:"port,omitempty"`
+	// Baud is the serial port baud rate (default 9600)
+	Baud int `json:"baud,omitempty"`
+	// Address is the host of TCP outstations, or host:port if it isn't on
+	// port 20000
+	Address string `json:"address,omitempty"`
+	// Master is the link address of the device (default 1)
+	Master int `json:"master,omitempty"`
+	// Outstation is the link address of the outstation
+	Outstation int `json:"outstation"`
+	// Interval is how often events are read in seconds (default 10)
+	Interval int `json:"interval,omitempty"`
+	// IntegrityInterval is how often all static values are read in
+	// seconds (default 3600). An integrity poll is also done when the
+	// device connects and after the outstation restarts.
+	IntegrityInterval int `json:"integrityInterval,omitempty"`
+	// Points are the values reported as samples. Other points are
+	// ignored.
+	Points []Dnp3Point `json:"points"`
+}
+
+// Dnp3Point is a point in an outstation. Values are raw*Scale + Offset.
+type Dnp3Point struct {
+	// ID is used as the sample ID
+	ID string `json:"id"`
+	// Type is the sample type, like flow
+	Type string `json:"type"`
+	// Object is binaryInput, binaryOutput, counter, frozenCounter,
+	// analogInput, or analogOutput
+	Object string `json:"object"`
+	// Index is the point index in the outstation
+	Index int `json:"index"`
+	// Scale multiplies the raw value (default 1)
+	Scale  float64 `json:"scale,omitempty"`
+	Offset float64 `json:"offset,omitempty"`
+}
+
+// Value returns the scaled value
+func (p Dnp3Point) Value(raw float64) float64 {
+	scale := p.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	return raw*scale + p.Offset
+}
+
+// Validate checks the point is valid
+func (p Dnp3Point) Validate() error {
+	if p.ID == "" {
+		return errors.New("dnp3 point id is required")
+	}
+
+	if p.Type == "" {
+		return errors.New("dnp3 point type is required")
+	}
+
+	switch p.Object {
+	case Dnp3BinaryInput, Dnp3BinaryOutput, Dnp3Counter, Dnp3FrozenCounter,
+		Dnp3AnalogInput, Dnp3AnalogOutput:
+	default:
+		return fmt.Errorf("unsupported dnp3 object: %v", p.Object)
+	}
+
+	if p.Index < 0 || p.Index > 0xffff {
+		return errors.New("dnp3 point index must be 0 to 65535")
+	}
+
+	return nil
+}
+
+// Validate checks the DNP3 config is valid
+func (c Dnp3Config) Validate() error {
+	if (c.Port == "") == (c.Address == "") {
+		return errors.New("dnp3 port or address is required")
+	}
+
+	if c.Baud < 0 {
+		return errors.New("dnp3 baud must not be negative")
+	}
+
+	// addresses above 0xfff0 are reserved for broadcast and self address
+	if c.Master < 0 || c.Master > 0xffef || c.Outstation < 0 ||
+		c.Outstation > 0xffef {
+		return errors.New("dnp3 link addresses must be 0 to 65519")
+	}
+
+	master := c.Master
+	if master == 0 {
+		master = 1
+	}
+
+	if master == c.Outstation {
+		return errors.New("dnp3 master and outstation addresses must differ")
+	}
+
+	if c.Interval < 0 || c.IntegrityInterval < 0 {
+		return errors.New("dnp3 intervals can't be negative")
+	}
+
+	if len(c.Points) == 0 {
+		return errors.New("dnp3 points are required")
+	}
+
+	for _, p := range c.Points {
+		err := p.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package data
+
+import (
+	"errors"
+	"net"
+)
+
+// EthernetConfig is the address configuration for an Ethernet interface
+type EthernetConfig struct {
+	// DHCP is true to get an address with DHCP, otherwise the static
+	// address is used
+	DHCP bool `json:"dhcp"`
+	// Address is the static address in CIDR notation (192.168.1.10/24)
+	Address string   `json:"address,omitempty"`
+	Gateway string   `json:"gateway,omitempty"`
+	DNS     []string `json:"dns,omitempty"`
+}
+
+// Validate checks the Ethernet config is valid
+func (c EthernetConfig) Validate() error {
+	if c.DHCP {
+		return nil
+	}
+
+	ip, ipNet, err := net.ParseCIDR(c.Address)
+	if err != nil {
+		return errors.New("static address must be in CIDR notation")
+	}
+
+	if c.Gateway != "" {
+		gw := net.ParseIP(c.Gateway)
+		if gw == nil {
+			return errors.New("invalid gateway")
+		}
+
+		if !ipNet.Contains(gw) || gw.Equal(ip) {
+			return errors.New("gateway must be another address on the same network")
+		}
+	}
+
+	for _, dns := range c.DNS {
+		if net.ParseIP(dns) == nil {
+			return errors.New("invalid DNS server: " + dns)
+		}
+	}
+
+	return nil
+}
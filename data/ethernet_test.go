@@ -0,0 +1,27 @@
+package data
+
+import "testing"
+
+func TestEthernetConfigValidate(t *testing.T) {
+	cases := []struct {
+		config EthernetConfig
+		valid  bool
+	}{
+		{EthernetConfig{DHCP: true}, true},
+		{EthernetConfig{Address: "192.168.1.10/24"}, true},
+		{EthernetConfig{Address: "192.168.1.10/24", Gateway: "192.168.1.1",
+			DNS: []string{"1.1.1.1", "2606:4700:4700::1111"}}, true},
+		{EthernetConfig{}, false},
+		{EthernetConfig{Address: "192.168.1.10"}, false},
+		{EthernetConfig{Address: "192.168.1.10/24", Gateway: "router"}, false},
+		{EthernetConfig{Address: "192.168.1.10/24", Gateway: "192.168.2.1"}, false},
+		{EthernetConfig{Address: "192.168.1.10/24", Gateway: "192.168.1.10"}, false},
+		{EthernetConfig{Address: "192.168.1.10/24", DNS: []string{"dns.google"}}, false},
+	}
+
+	for _, c := range cases {
+		if err := c.config.Validate(); (err == nil) != c.valid {
+			t.Errorf("%+v: expected valid %v, got %v", c.config, c.valid, err)
+		}
+	}
+}
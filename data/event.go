@@ -1,6 +1,10 @@
 package data
 
-import "time"
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
 
 // EventType describes an event. Custom applications that build on top of Simple IoT
 // should custom event types at high number above 10,000 to ensure there is not a collision
@@ -9,19 +13,90 @@ type EventType int
 
 // define valid events
 const (
-	EventTypeStartSystem EventType = 10
+	EventTypeStartSystem EventType = iota + 10
 	EventTypeStartApp
 	EventTypeSystemUpdate
 	EventTypeAppUpdate
+	// EventTypeFirstSeen is recorded when a device sends its first sample
+	EventTypeFirstSeen
+	// EventTypeConfigChanged is recorded when the config of a device is
+	// changed, and EventTypeConfigApplied and EventTypeConfigFailed when
+	// the device reports it applied it
+	EventTypeConfigChanged
+	EventTypeConfigApplied
+	EventTypeConfigFailed
+	// EventTypeConnected is recorded when a device sends a sample after
+	// being disconnected, and EventTypeDisconnected when it has not sent
+	// samples for the offline timeout
+	EventTypeConnected
+	EventTypeDisconnected
+	// EventTypeCommand is recorded when a command is queued for a device
+	EventTypeCommand
+	EventTypeAlertRaised
+	EventTypeAlertAcknowledged
+	EventTypeAlertCleared
+	// EventTypeFirmwareUpdate is recorded when a device reports firmware
+	// install progress
+	EventTypeFirmwareUpdate
 )
 
+var eventTypeNames = map[EventType]string{
+	EventTypeStartSystem:       "startSystem",
+	EventTypeStartApp:          "startApp",
+	EventTypeSystemUpdate:      "systemUpdate",
+	EventTypeAppUpdate:         "appUpdate",
+	EventTypeFirstSeen:         "firstSeen",
+	EventTypeConfigChanged:     "configChanged",
+	EventTypeConfigApplied:     "configApplied",
+	EventTypeConfigFailed:      "configFailed",
+	EventTypeConnected:         "connected",
+	EventTypeDisconnected:      "disconnected",
+	EventTypeCommand:           "command",
+	EventTypeAlertRaised:       "alertRaised",
+	EventTypeAlertAcknowledged: "alertAcknowledged",
+	EventTypeAlertCleared:      "alertCleared",
+	EventTypeFirmwareUpdate:    "firmwareUpdate",
+}
+
+// String returns the name of the event type, or the number of custom types
+func (et EventType) String() string {
+	if name, ok := eventTypeNames[et]; ok {
+		return name
+	}
+	return strconv.Itoa(int(et))
+}
+
+// MarshalText is used to encode the event type as a string in JSON
+func (et EventType) MarshalText() ([]byte, error) {
+	return []byte(et.String()), nil
+}
+
+// UnmarshalText is used to decode the event type from a name or number in
+// JSON
+func (et *EventType) UnmarshalText(text []byte) error {
+	for t, name := range eventTypeNames {
+		if name == string(text) {
+			*et = t
+			return nil
+		}
+	}
+
+	n, err := strconv.Atoi(string(text))
+	if err != nil {
+		return fmt.Errorf("unknown event type: %v", string(text))
+	}
+
+	*et = EventType(n)
+	return nil
+}
+
 // EventLevel is used to describe the "severity" of the event and can be used to
 // quickly filter the type of events
 type EventLevel int
 
 // define valid events
 const (
-	EventLevelFault EventLevel = 3
+	EventLevelFault EventLevel = iota + 3
 	EventLevelInfo
 	EventLevelDebug
 )
@@ -29,8 +104,13 @@ const (
 // Event describes something that happened and might be displayed to user in a
 // a sequential log format.
 type Event struct {
-	Time    time.Time
-	Type    EventType
-	Level   EventLevel
-	Message string
+	ID       uint64     `json:"id" boltholdKey:"ID"`
+	DeviceID string     `json:"deviceId" boltholdIndex:"DeviceID"`
+	Time     time.Time  `json:"time"`
+	Type     EventType  `json:"type"`
+	Level    EventLevel `json:"level"`
+	Message  string     `json:"message"`
+	// Expires is when the event is discarded. A zero value means the event
+	// never expires.
+	Expires time.Time `json:"expires,omitempty"`
 }
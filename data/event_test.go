@@ -0,0 +1,32 @@
+package data
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEventType(t *testing.T) {
+	if EventTypeStartSystem != 10 || EventTypeAppUpdate != 13 ||
+		EventLevelFault != 3 || EventLevelDebug != 5 {
+		t.Fatal("Event enums changed")
+	}
+
+	for _, et := range []EventType{EventTypeConfigFailed, 10001} {
+		b, err := json.Marshal(Event{Type: et})
+		if err != nil {
+			t.Fatal("Error encoding event: ", err)
+		}
+
+		var e Event
+		err = json.Unmarshal(b, &e)
+		if err != nil || e.Type != et {
+			t.Errorf("Wrong type decoded from %v: %v %v", string(b), e.Type, err)
+		}
+	}
+
+	var e Event
+	err := json.Unmarshal([]byte(`{"type": "reboot"}`), &e)
+	if err == nil {
+		t.Error("Unknown type decoded")
+	}
+}
@@ -0,0 +1,77 @@
+package data
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// FileCommand is the device command sent when a file is ready for the
+// device to download. The args are fileId, name, size, sha256, and url,
+// which is the path of the file data on the server.
+const FileCommand = "fileDownload"
+
+// file transfer directions
+const (
+	// FileUpload files are uploaded by a device, like diagnostic bundles,
+	// camera snapshots, or data logs
+	FileUpload = "upload"
+	// FileDownload files are uploaded for a device to download, like
+	// config blobs too large for the device config
+	FileDownload = "download"
+)
+
+// DeviceFile is a file transferred between a device and the server. The
+// data is sent in chunks, so a transfer can be resumed where it stopped,
+// and the digest is checked when the last chunk is received.
+type DeviceFile struct {
+	ID          uint64 `json:"id" boltholdKey:"ID"`
+	DeviceID    string `json:"deviceId" boltholdIndex:"DeviceID"`
+	Name        string `json:"name"`
+	ContentType string `json:"contentType,omitempty"`
+	Direction   string `json:"direction"`
+	Size        int64  `json:"size"`
+	// SHA256 is the hex digest of the file
+	SHA256 string `json:"sha256"`
+	// Received is the number of bytes received, which is the offset of
+	// the next chunk
+	Received int64     `json:"received"`
+	Complete bool      `json:"complete"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+	Expires  time.Time `json:"expires,omitempty"`
+}
+
+// Validate checks the file is valid
+func (f DeviceFile) Validate() error {
+	if f.Name == "" {
+		return errors.New("file name is required")
+	}
+
+	if f.Size < 0 {
+		return errors.New("file size can't be negative")
+	}
+
+	d, err := hex.DecodeString(f.SHA256)
+	if err != nil || len(d) != 32 {
+		return errors.New("file sha256 must be a hex SHA-256 digest")
+	}
+
+	switch f.Direction {
+	case FileUpload, FileDownload:
+	default:
+		return fmt.Errorf("invalid file direction: %v", f.Direction)
+	}
+
+	return nil
+}
+
+// FileChunk is part of the data of a DeviceFile
+type FileChunk struct {
+	ID      uint64 `boltholdKey:"ID"`
+	FileID  uint64 `boltholdIndex:"FileID"`
+	Offset  int64
+	Data    []byte
+	Expires time.Time
+}
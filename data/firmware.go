@@ -0,0 +1,225 @@
+package data
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FirmwareCommand is the device command that installs application
+// firmware. The args are rolloutId, firmwareId, version, size, sha256,
+// signature, and url, which is the path of the firmware file on the server.
+const FirmwareCommand = "firmwareUpdate"
+
+// Firmware is a signed application firmware artifact. The signature is an
+// Ed25519 signature of the SHA-256 digest of the file, so devices can check
+// the file came from the vendor even if the server is compromised.
+type Firmware struct {
+	ID      uint64 `json:"id" boltholdKey:"ID"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Size    int64  `json:"size"`
+	// SHA256 is the hex digest of the file
+	SHA256 string `json:"sha256"`
+	// Signature is the base64 Ed25519 signature of the digest
+	Signature string    `json:"signature"`
+	Created   time.Time `json:"created"`
+}
+
+// FirmwareData is the file of a Firmware. It is stored separately so lists
+// of firmware don't load the files.
+type FirmwareData struct {
+	ID   uint64 `boltholdKey:"ID"`
+	Data []byte
+}
+
+// ParseFirmwareKeys parses comma separated base64 Ed25519 public keys
+func ParseFirmwareKeys(s string) ([]ed25519.PublicKey, error) {
+	var ret []ed25519.PublicKey
+	for _, k := range strings.Split(s, ",") {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+
+		b, err := base64.StdEncoding.DecodeString(k)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid firmware key: %v", k)
+		}
+
+		ret = append(ret, ed25519.PublicKey(b))
+	}
+
+	return ret, nil
+}
+
+// VerifyFirmware checks the signature of a firmware digest with keys. The
+// firmware is valid if it is signed by any of the keys.
+func VerifyFirmware(keys []ed25519.PublicKey, digest []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.New("invalid firmware signature encoding")
+	}
+
+	for _, k := range keys {
+		if ed25519.Verify(k, digest, sig) {
+			return nil
+		}
+	}
+
+	return errors.New("firmware signature is not valid")
+}
+
+// rollout states
+const (
+	// RolloutActive rollouts send the firmware to devices
+	RolloutActive = "active"
+	// RolloutPaused rollouts don't send the firmware to more devices, but
+	// devices already updating finish
+	RolloutPaused = "paused"
+	// RolloutHalted rollouts were stopped because too many installs
+	// failed, or by a user. They can be resumed by making them active.
+	RolloutHalted = "halted"
+	// RolloutDone rollouts sent the firmware to all devices in their
+	// groups, and all installs finished
+	RolloutDone = "done"
+)
+
+// Rollout sends firmware to the devices in a set of groups in stages. The
+// Canary devices are updated first, and the rest of the devices are only
+// updated once they all finished. Then Percent of the devices are updated,
+// and Percent can be raised as the rollout goes well. Devices are picked in
+// a random but stable order, so raising Percent adds devices.
+type Rollout struct {
+	ID          uint64 `json:"id" boltholdKey:"ID"`
+	FirmwareID  uint64 `json:"firmwareId"`
+	Description string `json:"description,omitempty"`
+	// Groups are the device groups the firmware is sent to. All devices
+	// are updated if it is empty.
+	Groups []string `json:"groups,omitempty"`
+	// Canary is the number of devices that are updated first
+	Canary int `json:"canary,omitempty"`
+	// Percent is the percent of devices that are updated after the
+	// canaries
+	Percent int `json:"percent"`
+	// MaxFailures is the fraction (0-1) of finished installs that can fail
+	// before the rollout is halted. Any failure halts the rollout if it is
+	// 0.
+	MaxFailures float64 `json:"maxFailures"`
+	// MinInstalls is how many installs must finish before the failure rate
+	// is checked (default 1)
+	MinInstalls int    `json:"minInstalls,omitempty"`
+	State       string `json:"state"`
+	// Reason is why the rollout was halted
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Validate checks the rollout is valid
+func (r Rollout) Validate() error {
+	if r.FirmwareID == 0 {
+		return errors.New("rollout firmware is required")
+	}
+
+	if r.Canary < 0 {
+		return errors.New("rollout canary can't be negative")
+	}
+
+	if r.Percent < 0 || r.Percent > 100 {
+		return fmt.Errorf("invalid rollout percent: %v", r.Percent)
+	}
+
+	if r.MaxFailures < 0 || r.MaxFailures > 1 {
+		return fmt.Errorf("invalid rollout max failures: %v", r.MaxFailures)
+	}
+
+	if r.MinInstalls < 0 {
+		return errors.New("rollout min installs can't be negative")
+	}
+
+	switch r.State {
+	case RolloutActive, RolloutPaused, RolloutHalted, RolloutDone:
+	default:
+		return fmt.Errorf("invalid rollout state: %v", r.State)
+	}
+
+	return nil
+}
+
+// firmware install states
+const (
+	// InstallPending installs were sent to the device, which has not
+	// reported progress yet
+	InstallPending = "pending"
+	// InstallDownloading and InstallInstalling installs are in progress
+	InstallDownloading = "downloading"
+	InstallInstalling  = "installing"
+	// InstallDone installs are running the new firmware
+	InstallDone = "done"
+	// InstallFailed installs could not be downloaded, verified, or
+	// installed
+	InstallFailed = "failed"
+)
+
+// FirmwareInstall is the progress of a rollout on a device
+type FirmwareInstall struct {
+	// ID is the rollout and device ID, like 12/pump-1
+	ID        string `json:"-" boltholdKey:"ID"`
+	RolloutID uint64 `json:"rolloutId" boltholdIndex:"RolloutID"`
+	DeviceID  string `json:"deviceId" boltholdIndex:"DeviceID"`
+	State     string `json:"state"`
+	// Progress is 0-100 while downloading or installing
+	Progress int    `json:"progress"`
+	Error    string `json:"error,omitempty"`
+	// Version is the firmware version running on the device, which is
+	// reported when the install is done
+	Version string    `json:"version,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// Finished returns true if the install is done or failed
+func (i FirmwareInstall) Finished() bool {
+	return i.State == InstallDone || i.State == InstallFailed
+}
+
+// FirmwareInstallID returns the ID of the install of a rollout on a device
+func FirmwareInstallID(rolloutID uint64, deviceID string) string {
+	return fmt.Sprintf("%v/%v", rolloutID, deviceID)
+}
+
+// FirmwareReport is sent by a device with the progress of an install
+type FirmwareReport struct {
+	RolloutID uint64 `json:"rolloutId"`
+	State     string `json:"state"`
+	Progress  int    `json:"progress"`
+	Error     string `json:"error,omitempty"`
+	Version   string `json:"version,omitempty"`
+}
+
+// Validate checks the report is valid
+func (r FirmwareReport) Validate() error {
+	switch r.State {
+	case InstallDownloading, InstallInstalling, InstallDone, InstallFailed:
+	default:
+		return fmt.Errorf("invalid install state: %v", r.State)
+	}
+
+	if r.Progress < 0 || r.Progress > 100 {
+		return fmt.Errorf("invalid install progress: %v", r.Progress)
+	}
+
+	return nil
+}
+
+// RolloutStatus is a rollout and the number of devices in each install
+// state
+type RolloutStatus struct {
+	Rollout
+	// Devices is the number of devices in the rollout groups
+	Devices  int            `json:"devices"`
+	Installs map[string]int `json:"installs"`
+}
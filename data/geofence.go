@@ -0,0 +1,85 @@
+package data
+
+import (
+	"errors"
+	"math"
+)
+
+// geofence positions
+const (
+	GeofenceInside  = "inside"
+	GeofenceOutside = "outside"
+)
+
+// earthRadius is the mean radius of the earth in meters
+const earthRadius = 6371000
+
+// Area is a geofence, which is either a circle with a Center and Radius, or
+// a Polygon
+type Area struct {
+	Center *Location `json:"center,omitempty"`
+	// Radius is in meters
+	Radius float64 `json:"radius,omitempty"`
+	// Polygon is the corners of the area in order. Polygons can't cross the
+	// 180° meridian.
+	Polygon []Location `json:"polygon,omitempty"`
+}
+
+// Validate checks the area is valid
+func (a Area) Validate() error {
+	if a.Center != nil && len(a.Polygon) > 0 {
+		return errors.New("area can't have both a center and a polygon")
+	}
+
+	if a.Center != nil {
+		if a.Radius <= 0 {
+			return errors.New("area radius must be positive")
+		}
+		return a.Center.Validate()
+	}
+
+	if len(a.Polygon) < 3 {
+		return errors.New("area needs a center and radius, or a polygon with at least 3 points")
+	}
+
+	for _, l := range a.Polygon {
+		err := l.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Contains returns true if a location is inside the area
+func (a Area) Contains(l Location) bool {
+	if a.Center != nil {
+		return Distance(*a.Center, l) <= a.Radius
+	}
+
+	// count the polygon edges a ray east of the location crosses
+	inside := false
+	for i, j := 0, len(a.Polygon)-1; i < len(a.Polygon); j, i = i, i+1 {
+		p, q := a.Polygon[i], a.Polygon[j]
+		if (p.Lat > l.Lat) != (q.Lat > l.Lat) &&
+			l.Long < (q.Long-p.Long)*(l.Lat-p.Lat)/(q.Lat-p.Lat)+p.Long {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+// Distance returns the great circle distance between two locations in
+// meters
+func Distance(a, b Location) float64 {
+	rad := math.Pi / 180
+	dLat := (b.Lat - a.Lat) * rad
+	dLong := (b.Long - a.Long) * rad
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(a.Lat*rad)*math.Cos(b.Lat*rad)*math.Sin(dLong/2)*math.Sin(dLong/2)
+
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
@@ -0,0 +1,57 @@
+package data
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	// New York to London is about 5570km
+	d := Distance(Location{Lat: 40.71, Long: -74.01}, Location{Lat: 51.51, Long: -0.13})
+	if math.Abs(d-5570e3) > 10e3 {
+		t.Error("wrong distance: ", d)
+	}
+
+	if d := Distance(Location{Lat: 10, Long: 10}, Location{Lat: 10, Long: 10}); d != 0 {
+		t.Error("wrong distance to the same location: ", d)
+	}
+}
+
+func TestArea(t *testing.T) {
+	circle := Area{Center: &Location{Lat: 45, Long: -93}, Radius: 1000}
+	square := Area{Polygon: []Location{{Lat: 45, Long: -93}, {Lat: 45, Long: -92},
+		{Lat: 46, Long: -92}, {Lat: 46, Long: -93}}}
+
+	for _, tc := range []struct {
+		area Area
+		loc  Location
+		exp  bool
+	}{
+		// 0.005° of latitude is about 556m
+		{circle, Location{Lat: 45.005, Long: -93}, true},
+		{circle, Location{Lat: 45.01, Long: -93}, false},
+		{square, Location{Lat: 45.5, Long: -92.5}, true},
+		{square, Location{Lat: 45.5, Long: -91.5}, false},
+		{square, Location{Lat: 46.5, Long: -92.5}, false},
+	} {
+		if tc.area.Contains(tc.loc) != tc.exp {
+			t.Errorf("%+v in %+v should be %v", tc.loc, tc.area, tc.exp)
+		}
+	}
+
+	for _, a := range []Area{
+		{},
+		{Center: &Location{Lat: 45, Long: -93}},
+		{Center: &Location{Lat: 95, Long: -93}, Radius: 10},
+		{Polygon: []Location{{Lat: 45, Long: -93}, {Lat: 45, Long: -92}}},
+		{Center: &Location{Lat: 45, Long: -93}, Radius: 10, Polygon: square.Polygon},
+	} {
+		if a.Validate() == nil {
+			t.Errorf("area should be invalid: %+v", a)
+		}
+	}
+
+	if circle.Validate() != nil || square.Validate() != nil {
+		t.Error("areas should be valid")
+	}
+}
@@ -1,6 +1,8 @@
 package data
 
 import (
+	"time"
+
 	nmea "github.com/adrianmo/go-nmea"
 )
 
@@ -19,3 +21,14 @@ func (p *GpsPos) FromGPGGA(gpgga nmea.GPGGA) {
 	p.Fix = gpgga.FixQuality
 	p.NumSat = gpgga.NumSatellites
 }
+
+// Samples returns the position as latitude, longitude, and numSat samples
+// so it can be stored with the other device samples
+func (p GpsPos) Samples(id string) []Sample {
+	now := time.Now()
+	return []Sample{
+		{Type: SampleTypeLatitude, ID: id, Value: p.Lat, Time: now},
+		{Type: SampleTypeLongitude, ID: id, Value: p.Long, Time: now},
+		{Type: "numSat", ID: id, Value: float64(p.NumSat), Time: now},
+	}
+}
@@ -0,0 +1,19 @@
+package data
+
+import (
+	"errors"
+	"regexp"
+)
+
+// host names are letters, digits, and hyphens that don't start or end
+// with a hyphen (RFC 1123)
+var reHostname = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// ValidateHostname checks name is a valid host name
+func ValidateHostname(name string) error {
+	if !reHostname.MatchString(name) {
+		return errors.New("host name must be 1 to 63 letters, digits, or hyphens, and can't start or end with a hyphen")
+	}
+
+	return nil
+}
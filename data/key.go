@@ -0,0 +1,56 @@
+package data
+
+import (
+	"crypto/subtle"
+	"time"
+)
+
+// TokenEqual compares a token with the expected token in constant time.
+// It is false if the expected token is not set.
+func TokenEqual(token, expected string) bool {
+	return expected != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// DeviceKey is an API key a device uses to authenticate, like with the
+// MQTT broker. Only a hash of the key is stored, so the key is only known
+// when it is created.
+type DeviceKey struct {
+	ID       uint64    `json:"id" boltholdKey:"ID"`
+	DeviceID string    `json:"deviceId" boltholdIndex:"DeviceID"`
+	Hash     string    `json:"-" boltholdIndex:"Hash"`
+	Created  time.Time `json:"created"`
+	// Expires is when the key stops working, or zero. A rotated key keeps
+	// working for an overlap window, so the device can switch to its new
+	// key without losing its connections.
+	Expires time.Time `json:"expires,omitempty"`
+	// Revoked is when the key was revoked, or zero. Revoked keys are kept
+	// so they show in the device's key list.
+	Revoked time.Time `json:"revoked,omitempty"`
+	// Rotate is set when an admin asks the device to rotate the key, like
+	// when it may be compromised
+	Rotate bool `json:"rotate,omitempty"`
+}
+
+// Active returns true if the key can be used at time now
+func (k DeviceKey) Active(now time.Time) bool {
+	return k.Revoked.IsZero() && (k.Expires.IsZero() || now.Before(k.Expires))
+}
+
+// KeyStatus is the rotation status of a device key
+type KeyStatus struct {
+	DeviceKey
+	// Active is false if the key expired or was revoked
+	Active bool `json:"active"`
+	// RotateAt is when the key is due to be rotated, or zero if it isn't
+	RotateAt time.Time `json:"rotateAt,omitempty"`
+	// Due is true if the device should rotate the key now
+	Due bool `json:"due"`
+}
+
+// KeyResponse is returned when a device key is created. This is the only
+// time the key is available.
+type KeyResponse struct {
+	DeviceKey
+	Key string `json:"key"`
+}
@@ -0,0 +1,22 @@
+package data
+
+import "testing"
+
+func TestTokenEqual(t *testing.T) {
+	cases := []struct {
+		token, expected string
+		exp             bool
+	}{
+		{"abc", "abc", true},
+		{"abd", "abc", false},
+		{"ab", "abc", false},
+		{"", "", false},
+		{"abc", "", false},
+	}
+
+	for _, c := range cases {
+		if TokenEqual(c.token, c.expected) != c.exp {
+			t.Errorf("%q, %q: expected %v", c.token, c.expected, c.exp)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package data
+
+import "time"
+
+// LogEntry is a system log entry uploaded by a device
+type LogEntry struct {
+	ID       uint64    `json:"id" boltholdKey:"ID"`
+	DeviceID string    `json:"deviceId" boltholdIndex:"DeviceID"`
+	Time     time.Time `json:"time"`
+	// Unit is the systemd unit or syslog tag
+	Unit string `json:"unit,omitempty"`
+	// Priority is the syslog priority, 0 (emergency) to 7 (debug)
+	Priority int    `json:"priority"`
+	Message  string `json:"message"`
+	// Expires is when the entry is discarded. A zero value means the entry
+	// never expires.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// SupportArchive is an archive of application logs uploaded by a device
+// for support
+type SupportArchive struct {
+	ID       uint64    `json:"id" boltholdKey:"ID"`
+	DeviceID string    `json:"deviceId" boltholdIndex:"DeviceID"`
+	Time     time.Time `json:"time"`
+	Size     int       `json:"size"`
+	// Data is the gzipped tar archive. It is not included in lists.
+	Data    []byte    `json:"-"`
+	Expires time.Time `json:"expires,omitempty"`
+}
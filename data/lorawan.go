@@ -0,0 +1,175 @@
+package data
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// LoRaWAN payload decoders
+const (
+	// LorawanObject uses the fields decoded by the network server's
+	// payload formatter
+	LorawanObject = "object"
+	// LorawanCayenne decodes Cayenne LPP payloads
+	LorawanCayenne = "cayenne"
+	// LorawanFields decodes the values in LorawanConfig.Fields
+	LorawanFields = "fields"
+)
+
+// LoRaWAN field value formats
+const (
+	LorawanUint8   = "uint8"
+	LorawanInt8    = "int8"
+	LorawanUint16  = "uint16"
+	LorawanInt16   = "int16"
+	LorawanUint32  = "uint32"
+	LorawanInt32   = "int32"
+	LorawanFloat32 = "float32"
+)
+
+// LorawanConfig describes how a LoRaWAN device's uplinks are decoded into
+// samples, and how commands are sent to it as downlinks
+type LorawanConfig struct {
+	// Decoder is object, cayenne, or fields. If blank, the server default
+	// is used.
+	Decoder string `json:"decoder,omitempty"`
+	// Fields are the values in the payload for the fields decoder
+	Fields []LorawanField `json:"fields,omitempty"`
+	// FPort is the port downlinks are sent on (default 1)
+	FPort int `json:"fPort,omitempty"`
+	// Confirmed downlinks are acknowledged by the device
+	Confirmed bool `json:"confirmed,omitempty"`
+	// Downlinks are the hex payloads sent for commands, like
+	// {"valveOpen": "0101"}. Other commands are sent with the hex payload
+	// in their payload arg.
+	Downlinks map[string]string `json:"downlinks,omitempty"`
+}
+
+// LorawanField is a value in an uplink payload. Values are raw*Scale +
+// Offset.
+type LorawanField struct {
+	// Type is the sample type, like temp
+	Type string `json:"type"`
+	// ID is used as the sample ID
+	ID string `json:"id,omitempty"`
+	// Start is the index of the first byte of the value in the payload
+	Start int `json:"start"`
+	// Format is uint8 (default), int8, uint16, int16, uint32, int32, or
+	// float32. Values are big endian unless LittleEndian is set.
+	Format       string `json:"format,omitempty"`
+	LittleEndian bool   `json:"littleEndian,omitempty"`
+	// Scale multiplies the raw value (default 1)
+	Scale  float64 `json:"scale,omitempty"`
+	Offset float64 `json:"offset,omitempty"`
+}
+
+// Size returns the number of bytes used by the value
+func (f LorawanField) Size() int {
+	switch f.Format {
+	case LorawanUint16, LorawanInt16:
+		return 2
+	case LorawanUint32, LorawanInt32, LorawanFloat32:
+		return 4
+	}
+	return 1
+}
+
+// Value decodes the field from a payload and applies the scale and offset.
+// ok is false if the payload is too short.
+func (f LorawanField) Value(payload []byte) (v float64, ok bool) {
+	if f.Start+f.Size() > len(payload) {
+		return 0, false
+	}
+
+	b := payload[f.Start : f.Start+f.Size()]
+
+	var order binary.ByteOrder = binary.BigEndian
+	if f.LittleEndian {
+		order = binary.LittleEndian
+	}
+
+	switch f.Format {
+	case LorawanInt8:
+		v = float64(int8(b[0]))
+	case LorawanUint16:
+		v = float64(order.Uint16(b))
+	case LorawanInt16:
+		v = float64(int16(order.Uint16(b)))
+	case LorawanUint32:
+		v = float64(order.Uint32(b))
+	case LorawanInt32:
+		v = float64(int32(order.Uint32(b)))
+	case LorawanFloat32:
+		v = float64(math.Float32frombits(order.Uint32(b)))
+	default:
+		v = float64(b[0])
+	}
+
+	scale := f.Scale
+	if scale == 0 {
+		scale = 1
+	}
+
+	return v*scale + f.Offset, true
+}
+
+// Validate checks the field is valid
+func (f LorawanField) Validate() error {
+	if f.Type == "" {
+		return errors.New("lorawan field type is required")
+	}
+
+	switch f.Format {
+	case "", LorawanUint8, LorawanInt8, LorawanUint16, LorawanInt16,
+		LorawanUint32, LorawanInt32, LorawanFloat32:
+	default:
+		return fmt.Errorf("unsupported lorawan format: %v", f.Format)
+	}
+
+	// LoRaWAN payloads are at most 242 bytes
+	if f.Start < 0 || f.Start+f.Size() > 242 {
+		return errors.New("lorawan field start must be 0 to 241")
+	}
+
+	return nil
+}
+
+// Validate checks the LoRaWAN config is valid
+func (c LorawanConfig) Validate() error {
+	switch c.Decoder {
+	case "", LorawanObject, LorawanCayenne:
+		if len(c.Fields) > 0 {
+			return errors.New("lorawan fields require the fields decoder")
+		}
+	case LorawanFields:
+		if len(c.Fields) == 0 {
+			return errors.New("lorawan fields are required")
+		}
+	default:
+		return fmt.Errorf("unsupported lorawan decoder: %v", c.Decoder)
+	}
+
+	for _, f := range c.Fields {
+		err := f.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	// port 0 is for MAC commands, and 224 and up are reserved
+	if c.FPort < 0 || c.FPort > 223 {
+		return errors.New("lorawan fPort must be 1 to 223")
+	}
+
+	for cmd, payload := range c.Downlinks {
+		_, err := hex.DecodeString(payload)
+		if err != nil {
+			return fmt.Errorf("invalid lorawan downlink for %v: %v", cmd, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// MaintenanceWindow is a time when disruptive operations like OS updates,
+// reboots, and modem firmware updates can run. Times are in the local time
+// zone of the device.
+type MaintenanceWindow struct {
+	// Days the window starts on, like sat or sun. Blank is every day.
+	Days []string `json:"days,omitempty"`
+	// Start is the local time the window starts, like 02:00
+	Start string `json:"start"`
+	// Duration is a Go duration like 2h, up to 24h
+	Duration string `json:"duration"`
+}
+
+func (w MaintenanceWindow) parse() (start, duration time.Duration, err error) {
+	t, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid maintenance window start: %v", w.Start)
+	}
+	start = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+
+	duration, err = time.ParseDuration(w.Duration)
+	if err != nil || duration <= 0 || duration > 24*time.Hour {
+		return 0, 0, fmt.Errorf("invalid maintenance window duration: %v",
+			w.Duration)
+	}
+
+	return start, duration, nil
+}
+
+// Validate checks the window is valid
+func (w MaintenanceWindow) Validate() error {
+	for _, d := range w.Days {
+		if _, ok := weekdays[d]; !ok {
+			return fmt.Errorf("invalid maintenance window day: %v", d)
+		}
+	}
+
+	_, _, err := w.parse()
+	return err
+}
+
+// Next returns the window that contains t, or the next window after t if
+// t is not in a window
+func (w MaintenanceWindow) Next(t time.Time, loc *time.Location) (start, end time.Time, err error) {
+	offset, duration, err := w.parse()
+	if err != nil {
+		return
+	}
+
+	days := make(map[time.Weekday]bool)
+	for _, d := range w.Days {
+		days[weekdays[d]] = true
+	}
+
+	local := t.In(loc)
+	hour, min := int(offset/time.Hour), int(offset%time.Hour/time.Minute)
+
+	// start the day before, as that window may not have ended
+	for i := -1; i <= 7; i++ {
+		start = time.Date(local.Year(), local.Month(), local.Day()+i, hour, min,
+			0, 0, loc)
+		if len(days) > 0 && !days[start.Weekday()] {
+			continue
+		}
+
+		end = start.Add(duration)
+		if end.After(t) {
+			return start, end, nil
+		}
+	}
+
+	return time.Time{}, time.Time{}, errors.New("no maintenance window found")
+}
+
+// NextMaintenance returns the earliest window that contains t or starts
+// after t. ok is false if there are no windows.
+func NextMaintenance(windows []MaintenanceWindow, t time.Time, loc *time.Location) (start, end time.Time, ok bool) {
+	for _, w := range windows {
+		s, e, err := w.Next(t, loc)
+		if err != nil {
+			continue
+		}
+
+		if !ok || s.Before(start) {
+			start, end, ok = s, e, true
+		}
+	}
+
+	return
+}
+
+// InMaintenance returns true if t is in a window, or if there are no
+// windows
+func InMaintenance(windows []MaintenanceWindow, t time.Time, loc *time.Location) bool {
+	if len(windows) <= 0 {
+		return true
+	}
+
+	start, _, ok := NextMaintenance(windows, t, loc)
+	return ok && !start.After(t)
+}
+
+// ParseMaintenanceWindows parses windows from a string, which is used in
+// config files and environment variables. Windows are separated by ';',
+// and are optional comma separated days, the start time, and the duration,
+// like "sat,sun 02:00 4h; 03:00 1h".
+func ParseMaintenanceWindows(s string) ([]MaintenanceWindow, error) {
+	var ret []MaintenanceWindow
+
+	for _, ws := range strings.Split(s, ";") {
+		fields := strings.Fields(ws)
+		var w MaintenanceWindow
+
+		switch len(fields) {
+		case 0:
+			continue
+		case 2:
+			w.Start, w.Duration = fields[0], fields[1]
+		case 3:
+			w.Days = strings.Split(strings.ToLower(fields[0]), ",")
+			w.Start, w.Duration = fields[1], fields[2]
+		default:
+			return nil, fmt.Errorf("invalid maintenance window: %v",
+				strings.TrimSpace(ws))
+		}
+
+		err := w.Validate()
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, w)
+	}
+
+	return ret, nil
+}
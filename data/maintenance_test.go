@@ -0,0 +1,71 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("tzdata not available: ", err)
+	}
+
+	windows, err := ParseMaintenanceWindows("sat,sun 23:00 4h")
+	if err != nil {
+		t.Fatal("Error parsing windows: ", err)
+	}
+
+	tests := []struct {
+		time  time.Time
+		in    bool
+		start time.Time
+	}{
+		// Friday
+		{time.Date(2020, 3, 6, 12, 0, 0, 0, loc), false,
+			time.Date(2020, 3, 7, 23, 0, 0, 0, loc)},
+		// Saturday in the window
+		{time.Date(2020, 3, 7, 23, 30, 0, 0, loc), true,
+			time.Date(2020, 3, 7, 23, 0, 0, 0, loc)},
+		// the window that started Sunday ends Monday morning
+		{time.Date(2020, 3, 9, 2, 0, 0, 0, loc), true,
+			time.Date(2020, 3, 8, 23, 0, 0, 0, loc)},
+		{time.Date(2020, 3, 9, 3, 0, 0, 0, loc), false,
+			time.Date(2020, 3, 14, 23, 0, 0, 0, loc)},
+	}
+
+	for _, test := range tests {
+		in := InMaintenance(windows, test.time, loc)
+		if in != test.in {
+			t.Errorf("%v: expected in window %v, got %v", test.time, test.in, in)
+		}
+
+		start, _, ok := NextMaintenance(windows, test.time, loc)
+		if !ok || !start.Equal(test.start) {
+			t.Errorf("%v: expected start %v, got %v", test.time, test.start, start)
+		}
+	}
+
+	if !InMaintenance(nil, time.Now(), loc) {
+		t.Error("no windows should always be maintenance")
+	}
+}
+
+func TestParseMaintenanceWindows(t *testing.T) {
+	windows, err := ParseMaintenanceWindows("02:00 1h; mon,tue 22:30 90m")
+	if err != nil {
+		t.Fatal("Error parsing windows: ", err)
+	}
+
+	if len(windows) != 2 || windows[0].Start != "02:00" ||
+		len(windows[1].Days) != 2 || windows[1].Duration != "90m" {
+		t.Errorf("unexpected windows: %+v", windows)
+	}
+
+	for _, s := range []string{"02:00", "25:00 1h", "02:00 25h", "fun 02:00 1h"} {
+		_, err := ParseMaintenanceWindows(s)
+		if err == nil {
+			t.Errorf("expected error for %v", s)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Modbus register tables
+const (
+	ModbusCoil          = "coil"
+	ModbusDiscreteInput = "discrete"
+	ModbusHolding       = "holding"
+	ModbusInput         = "input"
+)
+
+// Modbus register value formats
+const (
+	ModbusUint16  = "uint16"
+	ModbusInt16   = "int16"
+	ModbusUint32  = "uint32"
+	ModbusInt32   = "int32"
+	ModbusFloat32 = "float32"
+)
+
+// ModbusConfig is a Modbus server (slave) that the device polls for
+// register values, which are reported as samples. RTU devices are on a
+// serial port, and TCP devices have a network address.
+type ModbusConfig struct {
+	// Port is the serial port of RTU devices, like /dev/ttyUSB0 or
+	// usb:<vendor>:<product>
+	Port string `json:"port,omitempty"`
+	// Baud is the serial port baud rate (default 9600)
+	Baud int `json:"baud,omitempty"`
+	// Address is the host:port of TCP devices
+	Address string `json:"address,omitempty"`
+	// UnitID is the Modbus address of the device
+	UnitID int `json:"unitId"`
+	// Interval is how often the registers are read in seconds
+	Interval int `json:"interval"`
+	// Registers are the values read from the device
+	Registers []ModbusRegister `json:"registers"`
+}
+
+// ModbusRegister is a value read from a Modbus device. Values are
+// raw*Scale + Offset.
+type ModbusRegister struct {
+	// ID is used as the sample ID
+	ID string `json:"id"`
+	// Type is the sample type, like temp
+	Type string `json:"type"`
+	// Table is coil, discrete, holding, or input
+	Table string `json:"table"`
+	// Address is the zero based register or coil address
+	Address int `json:"address"`
+	// Format is how holding and input registers are decoded: uint16
+	// (default), int16, uint32, int32, or float32. 32 bit values use two
+	// registers with the high word first unless WordSwap is set.
+	Format   string `json:"format,omitempty"`
+	WordSwap bool   `json:"wordSwap,omitempty"`
+	// Scale multiplies the raw value (default 1)
+	Scale  float64 `json:"scale,omitempty"`
+	Offset float64 `json:"offset,omitempty"`
+}
+
+// Count returns the number of registers or coils used by the value
+func (r ModbusRegister) Count() int {
+	switch r.Format {
+	case ModbusUint32, ModbusInt32, ModbusFloat32:
+		return 2
+	}
+	return 1
+}
+
+func (r ModbusRegister) scale() float64 {
+	if r.Scale == 0 {
+		return 1
+	}
+	return r.Scale
+}
+
+// Value decodes the raw register values and applies the scale and offset.
+// regs must have Count values. Coils and discrete inputs are 0 or 1, and
+// are not scaled.
+func (r ModbusRegister) Value(regs []uint16) float64 {
+	if r.Table == ModbusCoil || r.Table == ModbusDiscreteInput {
+		return float64(regs[0])
+	}
+
+	if r.Count() == 2 && !r.WordSwap {
+		regs = []uint16{regs[1], regs[0]}
+	}
+
+	var v float64
+	switch r.Format {
+	case ModbusInt16:
+		v = float64(int16(regs[0]))
+	case ModbusUint32:
+		v = float64(uint32(regs[1])<<16 | uint32(regs[0]))
+	case ModbusInt32:
+		v = float64(int32(uint32(regs[1])<<16 | uint32(regs[0])))
+	case ModbusFloat32:
+		v = float64(math.Float32frombits(uint32(regs[1])<<16 | uint32(regs[0])))
+	default:
+		v = float64(regs[0])
+	}
+
+	return v*r.scale() + r.Offset
+}
+
+// Registers is the inverse of Value. Integer values are rounded and limited
+// to the range of the format, and coils are 1 if v is not 0.
+func (r ModbusRegister) Registers(v float64) []uint16 {
+	if r.Table == ModbusCoil || r.Table == ModbusDiscreteInput {
+		if v != 0 {
+			return []uint16{1}
+		}
+		return []uint16{0}
+	}
+
+	v = (v - r.Offset) / r.scale()
+
+	limit := func(min, max float64) float64 {
+		return math.Max(min, math.Min(max, math.Round(v)))
+	}
+
+	var u uint32
+	switch r.Format {
+	case ModbusInt16:
+		return []uint16{uint16(int16(limit(math.MinInt16, math.MaxInt16)))}
+	case ModbusUint32:
+		u = uint32(limit(0, math.MaxUint32))
+	case ModbusInt32:
+		u = uint32(int32(limit(math.MinInt32, math.MaxInt32)))
+	case ModbusFloat32:
+		u = math.Float32bits(float32(v))
+	default:
+		return []uint16{uint16(limit(0, math.MaxUint16))}
+	}
+
+	if r.WordSwap {
+		return []uint16{uint16(u), uint16(u >> 16)}
+	}
+	return []uint16{uint16(u >> 16), uint16(u)}
+}
+
+// Validate checks the register is valid
+func (r ModbusRegister) Validate() error {
+	if r.ID == "" {
+		return errors.New("modbus register id is required")
+	}
+
+	if r.Type == "" {
+		return errors.New("modbus register type is required")
+	}
+
+	switch r.Table {
+	case ModbusCoil, ModbusDiscreteInput:
+		if r.Format != "" {
+			return errors.New("modbus coils and discrete inputs can't have a format")
+		}
+	case ModbusHolding, ModbusInput:
+		switch r.Format {
+		case "", ModbusUint16, ModbusInt16, ModbusUint32, ModbusInt32,
+			ModbusFloat32:
+		default:
+			return fmt.Errorf("unsupported modbus format: %v", r.Format)
+		}
+	default:
+		return fmt.Errorf("unsupported modbus table: %v", r.Table)
+	}
+
+	if r.Address < 0 || r.Address+r.Count() > 0x10000 {
+		return errors.New("modbus register address must be 0 to 65535")
+	}
+
+	return nil
+}
+
+// Validate checks the Modbus config is valid
+func (c ModbusConfig) Validate() error {
+	if (c.Port == "") == (c.Address == "") {
+		return errors.New("modbus port or address is required")
+	}
+
+	if c.Baud < 0 {
+		return errors.New("modbus baud must not be negative")
+	}
+
+	if c.UnitID < 0 || c.UnitID > 247 {
+		return errors.New("modbus unit id must be 0 to 247")
+	}
+
+	if c.Interval <= 0 {
+		return errors.New("modbus interval must be greater than 0")
+	}
+
+	if len(c.Registers) == 0 {
+		return errors.New("modbus registers are required")
+	}
+
+	for _, r := range c.Registers {
+		err := r.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestModbusRegisterValue(t *testing.T) {
+	for _, c := range []struct {
+		reg   ModbusRegister
+		regs  []uint16
+		value float64
+	}{
+		{ModbusRegister{Table: ModbusHolding}, []uint16{500}, 500},
+		{ModbusRegister{Table: ModbusHolding, Format: ModbusInt16, Scale: 0.1,
+			Offset: 2}, []uint16{0xfff6}, 1},
+		{ModbusRegister{Table: ModbusInput, Format: ModbusUint32},
+			[]uint16{1, 2}, 65538},
+		{ModbusRegister{Table: ModbusInput, Format: ModbusInt32,
+			WordSwap: true}, []uint16{0xfffe, 0xffff}, -2},
+		{ModbusRegister{Table: ModbusInput, Format: ModbusFloat32},
+			[]uint16{0x41c8, 0}, 25},
+		{ModbusRegister{Table: ModbusCoil, Scale: 10}, []uint16{1}, 1},
+	} {
+		v := c.reg.Value(c.regs)
+		if v != c.value {
+			t.Errorf("%+v decoded to %v, expected %v", c.reg, v, c.value)
+		}
+
+		regs := c.reg.Registers(v)
+		if !reflect.DeepEqual(regs, c.regs) {
+			t.Errorf("%+v encoded to %x, expected %x", c.reg, regs, c.regs)
+		}
+	}
+
+	// integers are rounded and limited to the format range
+	r := ModbusRegister{Table: ModbusHolding, Format: ModbusInt16}
+	if regs := r.Registers(1e6); regs[0] != 0x7fff {
+		t.Errorf("value was not limited: %x", regs)
+	}
+
+	if regs := r.Registers(-2.6); regs[0] != 0xfffd {
+		t.Errorf("value was not rounded: %x", regs)
+	}
+}
@@ -0,0 +1,42 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NetworkInterface is an uplink of the server's network manager
+type NetworkInterface struct {
+	// Kind is eth, wifi, or nm (NetworkManager)
+	Kind string
+	// Name is the OS interface name, like eth0
+	Name string
+}
+
+// ParseNetworkInterfaces parses comma separated kind:name uplinks in
+// priority order, like eth:eth0,wifi:wlan0,nm:wwan0
+func ParseNetworkInterfaces(s string) ([]NetworkInterface, error) {
+	var ret []NetworkInterface
+	for _, i := range strings.Split(s, ",") {
+		i = strings.TrimSpace(i)
+		if i == "" {
+			continue
+		}
+
+		parts := strings.SplitN(i, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid network interface, expected kind:name: %v", i)
+		}
+
+		kind := strings.TrimSpace(parts[0])
+		switch kind {
+		case "eth", "wifi", "nm":
+		default:
+			return nil, fmt.Errorf("invalid network interface kind: %v", kind)
+		}
+
+		ret = append(ret, NetworkInterface{Kind: kind, Name: strings.TrimSpace(parts[1])})
+	}
+
+	return ret, nil
+}
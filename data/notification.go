@@ -0,0 +1,78 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// notification channels
+const (
+	ChannelEmail    = "email"
+	ChannelSMS      = "sms"
+	ChannelSlack    = "slack"
+	ChannelWebhook  = "webhook"
+	ChannelPushover = "pushover"
+)
+
+// ValidateChannel checks a notification channel name is valid
+func ValidateChannel(c string) error {
+	switch c {
+	case ChannelEmail, ChannelSMS, ChannelSlack, ChannelWebhook, ChannelPushover:
+		return nil
+	}
+
+	return fmt.Errorf("invalid notification channel: %v", c)
+}
+
+// Notification is sent by rule notify actions and system alerts
+type Notification struct {
+	// RuleID is the rule that sent the notification, or 0 for system
+	// alerts
+	RuleID uint64 `json:"ruleId,omitempty"`
+	// AlertID is the alert raised by the rule, which can be acknowledged
+	AlertID     uint64 `json:"alertId,omitempty"`
+	Description string `json:"description"`
+	// DeviceID is the device the notification is about, if any
+	DeviceID string    `json:"deviceId,omitempty"`
+	Message  string    `json:"message"`
+	Active   bool      `json:"active"`
+	Time     time.Time `json:"time"`
+	// Channels are the channels the notification is sent on. It is sent
+	// on all configured channels if empty.
+	Channels []string `json:"channels,omitempty"`
+}
+
+// ParseRecipientGroups parses the recipients of device groups from a string,
+// which is used in config files and environment variables. Groups are
+// separated by ';', and are the group name, '=', and comma separated
+// recipients, like "ops=a@example.com,b@example.com; field=c@example.com".
+func ParseRecipientGroups(s string) (map[string][]string, error) {
+	ret := make(map[string][]string)
+
+	for _, gs := range strings.Split(s, ";") {
+		if strings.TrimSpace(gs) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(gs, "=", 2)
+		group := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || group == "" {
+			return nil, fmt.Errorf("invalid recipient group: %v",
+				strings.TrimSpace(gs))
+		}
+
+		for _, r := range strings.Split(parts[1], ",") {
+			r = strings.TrimSpace(r)
+			if r != "" {
+				ret[group] = append(ret[group], r)
+			}
+		}
+
+		if len(ret[group]) <= 0 {
+			return nil, fmt.Errorf("recipient group %v has no recipients", group)
+		}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,30 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRecipientGroups(t *testing.T) {
+	groups, err := ParseRecipientGroups(
+		"ops=a@example.com, b@example.com; field = c@example.com;")
+	if err != nil {
+		t.Fatal("Error parsing groups: ", err)
+	}
+
+	exp := map[string][]string{
+		"ops":   {"a@example.com", "b@example.com"},
+		"field": {"c@example.com"},
+	}
+
+	if !reflect.DeepEqual(groups, exp) {
+		t.Errorf("wrong groups: %v", groups)
+	}
+
+	for _, s := range []string{"ops", "=a@example.com", "ops=,"} {
+		_, err := ParseRecipientGroups(s)
+		if err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// OneWireConfig is how 1-Wire temperature probes, like the DS18B20, are
+// read with the kernel w1 driver. Probes are discovered automatically, and
+// each reports a temp sample in C.
+type OneWireConfig struct {
+	// Interval is how often the probes are read in seconds (default 60)
+	Interval int `json:"interval,omitempty"`
+	// Probes name discovered probes. Probes that aren't listed use their
+	// address as the sample ID.
+	Probes []OneWireProbe `json:"probes,omitempty"`
+	// Listed only reads the probes that are listed
+	Listed bool `json:"listed,omitempty"`
+}
+
+// OneWireProbe names a 1-Wire probe
+type OneWireProbe struct {
+	// Address is the w1 device name, like 28-0316a2795aff
+	Address string `json:"address"`
+	// ID is used as the sample ID
+	ID string `json:"id"`
+	// Offset is added to readings to calibrate the probe
+	Offset float64 `json:"offset,omitempty"`
+}
+
+var reOneWireAddress = regexp.MustCompile(`^[0-9a-f]{2}-[0-9a-f]{12}$`)
+
+// Validate checks the probe config is valid
+func (p OneWireProbe) Validate() error {
+	if !reOneWireAddress.MatchString(p.Address) {
+		return fmt.Errorf("invalid 1-wire address: %v", p.Address)
+	}
+
+	if p.ID == "" {
+		return fmt.Errorf("1-wire probe %v id is required", p.Address)
+	}
+
+	return nil
+}
+
+// Validate checks the 1-Wire config is valid
+func (c OneWireConfig) Validate() error {
+	if c.Interval < 0 {
+		return errors.New("1-wire interval can't be negative")
+	}
+
+	if c.Listed && len(c.Probes) == 0 {
+		return errors.New("1-wire probes are required if only listed probes are read")
+	}
+
+	ids := make(map[string]bool)
+	for _, p := range c.Probes {
+		err := p.Validate()
+		if err != nil {
+			return err
+		}
+
+		if ids[p.ID] {
+			return fmt.Errorf("duplicate 1-wire probe id: %v", p.ID)
+		}
+		ids[p.ID] = true
+	}
+
+	return nil
+}
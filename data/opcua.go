@@ -0,0 +1,75 @@
+package data
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// OpcuaConfig is an OPC UA server, like a PLC, whose node values the device
+// subscribes to and reports as samples. Writable nodes can be set with
+// the opcuaWrite command.
+type OpcuaConfig struct {
+	// Endpoint is the server URL, like opc.tcp://plc:4840
+	Endpoint string `json:"endpoint"`
+	// User and Password are used to log in, or anonymous login is used if
+	// User is blank
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Interval is how often the server samples the nodes in milliseconds
+	// (default 1000)
+	Interval int `json:"interval,omitempty"`
+	// Nodes are the values reported by the server
+	Nodes []OpcuaNode `json:"nodes"`
+}
+
+// OpcuaNode is a variable node on an OPC UA server
+type OpcuaNode struct {
+	// NodeID is the node ID, like ns=2;s=Tank.Level
+	NodeID string `json:"nodeId"`
+	// ID is used as the sample ID
+	ID string `json:"id"`
+	// Type is the sample type, like level
+	Type string `json:"type"`
+	// Writable nodes can be set by commands
+	Writable bool `json:"writable,omitempty"`
+}
+
+var reOpcuaNodeID = regexp.MustCompile(`^(ns=\d+;)?[isgb]=.+$`)
+
+// Validate checks the node config is valid
+func (n OpcuaNode) Validate() error {
+	if !reOpcuaNodeID.MatchString(n.NodeID) {
+		return errors.New("invalid opcua node id")
+	}
+
+	if n.Type == "" {
+		return errors.New("opcua node type is required")
+	}
+
+	return nil
+}
+
+// Validate checks the OPC UA config is valid
+func (c OpcuaConfig) Validate() error {
+	if !strings.HasPrefix(c.Endpoint, "opc.tcp://") {
+		return errors.New("opcua endpoint must be an opc.tcp:// URL")
+	}
+
+	if c.Interval < 0 {
+		return errors.New("opcua interval can't be negative")
+	}
+
+	if len(c.Nodes) == 0 {
+		return errors.New("opcua nodes are required")
+	}
+
+	for _, n := range c.Nodes {
+		err := n.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
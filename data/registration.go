@@ -0,0 +1,41 @@
+package data
+
+import "time"
+
+// Registration is a request from a new device to join the server. The
+// device proves it is the device that was claimed with a claim code, which
+// is typically printed on a label. Only a hash of the code is stored.
+// Devices that register with a type are created with the template config
+// of the type.
+type Registration struct {
+	DeviceID string `json:"deviceId" boltholdKey:"DeviceID"`
+	Hash     string `json:"-"`
+	// Type is the device template applied when the device is claimed
+	Type    string    `json:"type,omitempty"`
+	Claimed bool      `json:"claimed"`
+	Created time.Time `json:"created"`
+	// Expires is when the registration is discarded if the device has not
+	// completed it
+	Expires time.Time `json:"expires"`
+}
+
+// RegisterRequest is sent by a device to register with a claim code. A
+// device that authenticates with mutual TLS sends a CSR, and gets a
+// certificate instead of a key.
+type RegisterRequest struct {
+	ID   string `json:"id"`
+	Code string `json:"code"`
+	// Type is the device template the device is created with, if set
+	Type string `json:"type,omitempty"`
+	CSR  string `json:"csr,omitempty"`
+}
+
+// RegisterResponse is returned when a device registers. Key, or Cert and
+// CACert if the device sent a CSR, are only set once the device is
+// claimed.
+type RegisterResponse struct {
+	ID     string `json:"id"`
+	Key    string `json:"key,omitempty"`
+	Cert   string `json:"cert,omitempty"`
+	CACert string `json:"caCert,omitempty"`
+}
@@ -0,0 +1,177 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// report formats
+const (
+	ReportCSV = "csv"
+	ReportPDF = "pdf"
+)
+
+// Report is a summary of device data that is generated on a schedule, like
+// a daily report for a facilities customer. For each device and day, it
+// has the min, max, and average of each point, the uptime, and the number
+// of alerts raised. Reports are emailed, stored for download, or both.
+type Report struct {
+	ID          uint64 `json:"id" boltholdKey:"ID"`
+	Description string `json:"description"`
+	Disabled    bool   `json:"disabled,omitempty"`
+	// Group is the device group the report covers. All devices are
+	// included if blank.
+	Group string `json:"group,omitempty"`
+	// Format is csv (default) or pdf
+	Format string `json:"format,omitempty"`
+	// Cron is when the report runs, in Timezone (default "0 0 * * *",
+	// daily at midnight)
+	Cron string `json:"cron,omitempty"`
+	// Timezone is the tzdata name of the time zone of the schedule and of
+	// the days in the report (default UTC)
+	Timezone string `json:"timezone,omitempty"`
+	// Days is the number of days the report covers, ending at the start of
+	// the day it runs (default 1, the day before)
+	Days int `json:"days,omitempty"`
+	// Email are the addresses the report is emailed to
+	Email []string `json:"email,omitempty"`
+	// Store keeps the report for download. Keep is how many reports are
+	// kept (default 30).
+	Store bool `json:"store,omitempty"`
+	Keep  int  `json:"keep,omitempty"`
+	// OfflineTimeout is a Go duration. A device is down when it has not
+	// sent samples for this long (default 15m).
+	OfflineTimeout string `json:"offlineTimeout,omitempty"`
+	// LastRun is when the report last ran, and Error is the error of the
+	// last run, which are set by the reporter
+	LastRun time.Time `json:"lastRun,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// FormatValue returns the format, or the default
+func (r Report) FormatValue() string {
+	if r.Format == "" {
+		return ReportCSV
+	}
+	return r.Format
+}
+
+// CronValue returns the parsed cron expression, or the default
+func (r Report) CronValue() Cron {
+	s := r.Cron
+	if s == "" {
+		s = "0 0 * * *"
+	}
+	c, _ := ParseCron(s)
+	return c
+}
+
+// Location returns the time zone of the report
+func (r Report) Location() *time.Location {
+	if r.Timezone == "" {
+		return time.UTC
+	}
+
+	loc, err := time.LoadLocation(r.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// DaysValue returns the number of days, or the default
+func (r Report) DaysValue() int {
+	if r.Days <= 0 {
+		return 1
+	}
+	return r.Days
+}
+
+// KeepValue returns the number of stored reports kept, or the default
+func (r Report) KeepValue() int {
+	if r.Keep <= 0 {
+		return 30
+	}
+	return r.Keep
+}
+
+// OfflineTimeoutValue returns the parsed offline timeout, or the default
+func (r Report) OfflineTimeoutValue() time.Duration {
+	d, err := time.ParseDuration(r.OfflineTimeout)
+	if err != nil || d <= 0 {
+		return 15 * time.Minute
+	}
+	return d
+}
+
+// Validate checks the report is valid
+func (r Report) Validate() error {
+	switch r.Format {
+	case "", ReportCSV, ReportPDF:
+	default:
+		return fmt.Errorf("invalid report format: %v", r.Format)
+	}
+
+	if r.Cron != "" {
+		_, err := ParseCron(r.Cron)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.Timezone != "" {
+		_, err := time.LoadLocation(r.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid report timezone: %v", r.Timezone)
+		}
+	}
+
+	if r.Days < 0 || r.Days > 366 {
+		return fmt.Errorf("invalid report days: %v", r.Days)
+	}
+
+	if r.Keep < 0 {
+		return errors.New("report keep can't be negative")
+	}
+
+	if r.OfflineTimeout != "" {
+		d, err := time.ParseDuration(r.OfflineTimeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid report offline timeout: %v", r.OfflineTimeout)
+		}
+	}
+
+	if len(r.Email) <= 0 && !r.Store {
+		return errors.New("report must be emailed or stored")
+	}
+
+	for _, e := range r.Email {
+		if e == "" {
+			return errors.New("report email addresses can't be blank")
+		}
+	}
+
+	return nil
+}
+
+// ReportFile is a generated report that is stored for download
+type ReportFile struct {
+	ID       uint64 `json:"id" boltholdKey:"ID"`
+	ReportID uint64 `json:"reportId" boltholdIndex:"ReportID"`
+	// Name is the file name, like daily-2020-01-02.csv
+	Name   string `json:"name"`
+	Format string `json:"format"`
+	// Start and End are the times the report covers
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Created time.Time `json:"created"`
+	Size    int       `json:"size"`
+}
+
+// ReportData is the file of a ReportFile. It is stored separately so lists
+// of reports don't load the files.
+type ReportData struct {
+	ID   uint64 `boltholdKey:"ID"`
+	Data []byte
+}
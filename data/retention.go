@@ -0,0 +1,56 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RetentionPolicies are how long the sample history of the devices in each
+// group is kept. The "*" group applies to all devices.
+type RetentionPolicies map[string]time.Duration
+
+// ParseRetentionPolicies parses retention policies from a string, which is
+// used in config files and environment variables. Policies are separated by
+// ';', and are the group name, '=', and a Go duration, like
+// "eu=720h; trial=168h; *=8760h".
+func ParseRetentionPolicies(s string) (RetentionPolicies, error) {
+	ret := make(RetentionPolicies)
+
+	for _, ps := range strings.Split(s, ";") {
+		if strings.TrimSpace(ps) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(ps, "=", 2)
+		group := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || group == "" {
+			return nil, fmt.Errorf("invalid retention policy: %v",
+				strings.TrimSpace(ps))
+		}
+
+		d, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid retention of group %v: %v", group,
+				strings.TrimSpace(parts[1]))
+		}
+
+		ret[group] = d
+	}
+
+	return ret, nil
+}
+
+// Device returns how long the sample history of a device is kept, which is
+// the shortest retention of its groups, or 0 if it is kept forever
+func (p RetentionPolicies) Device(dev Device) time.Duration {
+	ret := p["*"]
+
+	for _, g := range dev.Groups() {
+		if d, ok := p[g]; ok && (ret == 0 || d < ret) {
+			ret = d
+		}
+	}
+
+	return ret
+}
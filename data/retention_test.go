@@ -0,0 +1,38 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicies(t *testing.T) {
+	p, err := ParseRetentionPolicies("eu=720h; trial = 168h;")
+	if err != nil {
+		t.Fatal("Error parsing policies: ", err)
+	}
+
+	if len(p) != 2 || p["eu"] != 720*time.Hour || p["trial"] != 168*time.Hour {
+		t.Errorf("Wrong policies: %v", p)
+	}
+
+	dev := Device{Config: DeviceConfig{Groups: []string{"eu", "trial"}}}
+	if p.Device(dev) != 168*time.Hour {
+		t.Error("Shortest retention is not used: ", p.Device(dev))
+	}
+
+	if p.Device(Device{}) != 0 {
+		t.Error("Device without groups has retention: ", p.Device(Device{}))
+	}
+
+	p["*"] = time.Hour
+	if p.Device(Device{}) != time.Hour || p.Device(dev) != time.Hour {
+		t.Error("Default retention is not used")
+	}
+
+	for _, s := range []string{"eu", "=720h", "eu=forever", "eu=-1h"} {
+		_, err := ParseRetentionPolicies(s)
+		if err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
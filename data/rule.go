@@ -0,0 +1,348 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// rule condition types
+const (
+	// RuleConditionValue compares the latest value of a device sample to a
+	// threshold
+	RuleConditionValue = "value"
+	// RuleConditionSchedule is true during a set of time windows
+	RuleConditionSchedule = "schedule"
+	// RuleConditionOffline is true if a device has not sent samples for a
+	// while
+	RuleConditionOffline = "offline"
+	// RuleConditionGeofence is true if the location of a device is inside
+	// or outside an area
+	RuleConditionGeofence = "geofence"
+	// RuleConditionSpeed compares the speed of a device in km/h, which is
+	// calculated from its last two locations, to a threshold
+	RuleConditionSpeed = "speed"
+)
+
+// location sample types, which are written by GpsPos.Samples
+const (
+	SampleTypeLatitude  = "latitude"
+	SampleTypeLongitude = "longitude"
+)
+
+// rule action types
+const (
+	// RuleActionNotify sends a notification
+	RuleActionNotify = "notify"
+	// RuleActionOutput queues a setOutput command for a device with id,
+	// type, and value args
+	RuleActionOutput = "setOutput"
+	// RuleActionCommand queues a command for a device
+	RuleActionCommand = "command"
+	// RuleActionState writes a sample to a device
+	RuleActionState = "setState"
+)
+
+// RuleCondition is a condition of a rule
+type RuleCondition struct {
+	// Type is value, schedule, offline, geofence, or speed
+	Type string `json:"type"`
+	// DeviceID is the device of value, offline, geofence, and speed
+	// conditions
+	DeviceID string `json:"deviceId,omitempty"`
+	// SampleType and SampleID select the value compared. SampleID also
+	// selects the latitude and longitude samples of geofence and speed
+	// conditions.
+	SampleType string `json:"sampleType,omitempty"`
+	SampleID   string `json:"sampleId,omitempty"`
+	// Operator is >, >=, <, <=, =, or !=
+	Operator string  `json:"operator,omitempty"`
+	Value    float64 `json:"value,omitempty"`
+	// Hysteresis is how far the value must go back past Value before a
+	// true condition is false again. It only applies to >, >=, <, and <=.
+	Hysteresis float64 `json:"hysteresis,omitempty"`
+	// MinDuration is a Go duration the condition must be true for before
+	// it counts as true
+	MinDuration string `json:"minDuration,omitempty"`
+	// Windows are when schedule conditions are true, in the local time of
+	// Timezone (UTC if blank)
+	Windows  []MaintenanceWindow `json:"windows,omitempty"`
+	Timezone string              `json:"timezone,omitempty"`
+	// Timeout is a Go duration after the last sample when a device is
+	// offline
+	Timeout string `json:"timeout,omitempty"`
+	// Area is the geofence of geofence conditions, and Geofence is inside
+	// or outside, which is where the device must be for the condition to
+	// be true
+	Area     *Area  `json:"area,omitempty"`
+	Geofence string `json:"geofence,omitempty"`
+}
+
+// MinDurationValue returns the parsed MinDuration
+func (c RuleCondition) MinDurationValue() time.Duration {
+	d, _ := time.ParseDuration(c.MinDuration)
+	return d
+}
+
+// TimeoutValue returns the parsed Timeout
+func (c RuleCondition) TimeoutValue() time.Duration {
+	d, _ := time.ParseDuration(c.Timeout)
+	return d
+}
+
+// Compare returns true if v meets the condition. If the condition was
+// true, hysteresis is applied so noisy values don't toggle it.
+func (c RuleCondition) Compare(v float64, wasTrue bool) bool {
+	h := 0.0
+	if wasTrue {
+		h = c.Hysteresis
+	}
+
+	switch c.Operator {
+	case ">":
+		return v > c.Value-h
+	case ">=":
+		return v >= c.Value-h
+	case "<":
+		return v < c.Value+h
+	case "<=":
+		return v <= c.Value+h
+	case "=":
+		return v == c.Value
+	case "!=":
+		return v != c.Value
+	}
+
+	return false
+}
+
+// Validate checks the condition is valid
+func (c RuleCondition) Validate() error {
+	if c.MinDuration != "" {
+		d, err := time.ParseDuration(c.MinDuration)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid rule condition minDuration: %v",
+				c.MinDuration)
+		}
+	}
+
+	switch c.Type {
+	case RuleConditionValue:
+		if c.DeviceID == "" {
+			return errors.New("rule condition deviceId is required")
+		}
+
+		if c.SampleType == "" {
+			return errors.New("rule condition sampleType is required")
+		}
+
+		return c.validateOperator()
+	case RuleConditionSpeed:
+		if c.DeviceID == "" {
+			return errors.New("rule condition deviceId is required")
+		}
+
+		return c.validateOperator()
+	case RuleConditionGeofence:
+		if c.DeviceID == "" {
+			return errors.New("rule condition deviceId is required")
+		}
+
+		if c.Geofence != GeofenceInside && c.Geofence != GeofenceOutside {
+			return fmt.Errorf("invalid rule condition geofence: %v", c.Geofence)
+		}
+
+		if c.Area == nil {
+			return errors.New("rule condition area is required")
+		}
+
+		return c.Area.Validate()
+	case RuleConditionSchedule:
+		if len(c.Windows) <= 0 {
+			return errors.New("rule condition windows are required")
+		}
+
+		for _, w := range c.Windows {
+			err := w.Validate()
+			if err != nil {
+				return err
+			}
+		}
+
+		if c.Timezone != "" {
+			err := ValidateTimezone(c.Timezone)
+			if err != nil {
+				return err
+			}
+		}
+	case RuleConditionOffline:
+		if c.DeviceID == "" {
+			return errors.New("rule condition deviceId is required")
+		}
+
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid rule condition timeout: %v", c.Timeout)
+		}
+	default:
+		return fmt.Errorf("unsupported rule condition type: %v", c.Type)
+	}
+
+	return nil
+}
+
+func (c RuleCondition) validateOperator() error {
+	switch c.Operator {
+	case ">", ">=", "<", "<=", "=", "!=":
+	default:
+		return fmt.Errorf("invalid rule condition operator: %v", c.Operator)
+	}
+
+	if c.Hysteresis < 0 {
+		return errors.New("rule condition hysteresis can't be negative")
+	}
+
+	return nil
+}
+
+// RuleAction is run when a rule becomes active or inactive
+type RuleAction struct {
+	// Type is notify, setOutput, command, or setState
+	Type string `json:"type"`
+	// DeviceID is the device commands are queued for or samples are
+	// written to
+	DeviceID string `json:"deviceId,omitempty"`
+	// Command and Args are queued by command actions
+	Command string            `json:"command,omitempty"`
+	Args    map[string]string `json:"args,omitempty"`
+	// SampleType, SampleID, and Value are the output or state that is set
+	SampleType string  `json:"sampleType,omitempty"`
+	SampleID   string  `json:"sampleId,omitempty"`
+	Value      float64 `json:"value,omitempty"`
+	// Message is sent by notify actions. The rule description is used if
+	// blank.
+	Message string `json:"message,omitempty"`
+	// Channels are the channels notify actions send on, like email or
+	// slack. All configured channels are used if empty.
+	Channels []string `json:"channels,omitempty"`
+}
+
+// Validate checks the action is valid
+func (a RuleAction) Validate() error {
+	switch a.Type {
+	case RuleActionNotify:
+		for _, c := range a.Channels {
+			err := ValidateChannel(c)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case RuleActionCommand:
+		if a.Command == "" {
+			return errors.New("rule action command is required")
+		}
+	case RuleActionOutput, RuleActionState:
+		if a.SampleType == "" {
+			return errors.New("rule action sampleType is required")
+		}
+	default:
+		return fmt.Errorf("unsupported rule action type: %v", a.Type)
+	}
+
+	if a.DeviceID == "" {
+		return errors.New("rule action deviceId is required")
+	}
+
+	return nil
+}
+
+// Rule runs actions when all of its conditions are true. The rule is
+// active while the conditions are true, and actions only run when it
+// changes state.
+type Rule struct {
+	ID          uint64 `json:"id" boltholdKey:"ID"`
+	Description string `json:"description"`
+	Disabled    bool   `json:"disabled,omitempty"`
+	// Conditions must all be true for the rule to be active
+	Conditions []RuleCondition `json:"conditions"`
+	// Actions run when the rule becomes active
+	Actions []RuleAction `json:"actions"`
+	// InactiveActions run when the rule is no longer active
+	InactiveActions []RuleAction `json:"inactiveActions,omitempty"`
+	// Repeat is a Go duration. The notify actions of rules with
+	// unacknowledged alerts run again this often.
+	Repeat string `json:"repeat,omitempty"`
+	// Escalations are sent in order when an alert of the rule is not
+	// acknowledged
+	Escalations []Escalation `json:"escalations,omitempty"`
+	// Active and Changed are the state of the rule, which is set by the
+	// rules engine
+	Active  bool      `json:"active"`
+	Changed time.Time `json:"changed,omitempty"`
+}
+
+// RepeatValue returns the parsed Repeat
+func (r Rule) RepeatValue() time.Duration {
+	d, _ := time.ParseDuration(r.Repeat)
+	return d
+}
+
+// Notifies returns true if the rule has notify actions, so it raises
+// alerts
+func (r Rule) Notifies() bool {
+	for _, a := range r.Actions {
+		if a.Type == RuleActionNotify {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the rule is valid
+func (r Rule) Validate() error {
+	if len(r.Conditions) <= 0 {
+		return errors.New("rule conditions are required")
+	}
+
+	for _, c := range r.Conditions {
+		err := c.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, a := range append(append([]RuleAction{}, r.Actions...),
+		r.InactiveActions...) {
+		err := a.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.Repeat != "" {
+		d, err := time.ParseDuration(r.Repeat)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid rule repeat: %v", r.Repeat)
+		}
+	}
+
+	var last time.Duration
+	for _, e := range r.Escalations {
+		err := e.Validate()
+		if err != nil {
+			return err
+		}
+
+		if e.AfterValue() < last {
+			return errors.New("rule escalations must be in order")
+		}
+		last = e.AfterValue()
+	}
+
+	if (r.Repeat != "" || len(r.Escalations) > 0) && !r.Notifies() {
+		return errors.New("rule repeat and escalations require a notify action")
+	}
+
+	return nil
+}
@@ -49,3 +49,18 @@ func (s *Sample) Bool() bool {
 	}
 	return true
 }
+
+// SyncTag is the sample tag set to the name of the edge server that synced
+// the sample to an upstream server. Synced samples were already transformed
+// on the edge, so transforms and virtual points are not applied again.
+const SyncTag = "edge"
+
+// SampleBatch is a batch of samples uploaded from a device backlog. Store
+// identifies the device's local store, and Seq increases with each batch
+// from the store, so a batch that is sent again after a lost response is
+// only written once.
+type SampleBatch struct {
+	Store   string   `json:"store"`
+	Seq     uint64   `json:"seq"`
+	Samples []Sample `json:"samples"`
+}
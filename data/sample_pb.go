@@ -0,0 +1,294 @@
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// Samples are encoded as protobuf messages by hand, so devices can use the
+// compact encoding without the server depending on a protobuf library. The
+// schema is in sample.proto.
+
+// protobuf wire types
+const (
+	pbVarint  = 0
+	pb64      = 1
+	pbBytes   = 2
+	pb32      = 5
+	pbMaxSize = 1 << 20
+)
+
+// errPb is returned when a protobuf message can't be decoded
+var errPb = errors.New("invalid protobuf message")
+
+type pbEncoder struct {
+	b []byte
+}
+
+func (e *pbEncoder) varint(v uint64) {
+	for v >= 0x80 {
+		e.b = append(e.b, byte(v)|0x80)
+		v >>= 7
+	}
+	e.b = append(e.b, byte(v))
+}
+
+func (e *pbEncoder) key(field int, wire int) {
+	e.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (e *pbEncoder) bytes(field int, b []byte) {
+	e.key(field, pbBytes)
+	e.varint(uint64(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// string, double, and int64 skip zero values like proto3 does
+func (e *pbEncoder) string(field int, s string) {
+	if s != "" {
+		e.bytes(field, []byte(s))
+	}
+}
+
+func (e *pbEncoder) double(field int, v float64) {
+	if v != 0 {
+		e.key(field, pb64)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+		e.b = append(e.b, b[:]...)
+	}
+}
+
+func (e *pbEncoder) int64(field int, v int64) {
+	if v != 0 {
+		e.key(field, pbVarint)
+		e.varint(uint64(v))
+	}
+}
+
+type pbDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *pbDecoder) varint() uint64 {
+	var v uint64
+	for i := 0; i < 10; i++ {
+		if len(d.b) < 1 {
+			break
+		}
+		c := d.b[0]
+		d.b = d.b[1:]
+		v |= uint64(c&0x7f) << (7 * uint(i))
+		if c < 0x80 {
+			return v
+		}
+	}
+	d.err = errPb
+	return 0
+}
+
+// next returns the next field number and wire type
+func (d *pbDecoder) next() (int, int) {
+	k := d.varint()
+	return int(k >> 3), int(k & 7)
+}
+
+func (d *pbDecoder) bytes() []byte {
+	n := d.varint()
+	if n > uint64(len(d.b)) {
+		d.err = errPb
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *pbDecoder) fixed64() uint64 {
+	if len(d.b) < 8 {
+		d.err = errPb
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return v
+}
+
+// skip skips a field that is not known
+func (d *pbDecoder) skip(wire int) {
+	switch wire {
+	case pbVarint:
+		d.varint()
+	case pb64:
+		d.fixed64()
+	case pbBytes:
+		d.bytes()
+	case pb32:
+		if len(d.b) < 4 {
+			d.err = errPb
+			return
+		}
+		d.b = d.b[4:]
+	default:
+		d.err = errPb
+	}
+}
+
+// stringMap encodes a map<string, string> field
+func (e *pbEncoder) stringMap(field int, m map[string]string) {
+	for _, k := range sortedKeys(m) {
+		var entry pbEncoder
+		entry.bytes(1, []byte(k))
+		entry.bytes(2, []byte(m[k]))
+		e.bytes(field, entry.b)
+	}
+}
+
+// sortedKeys keeps the encoding of maps stable
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sampleToPb(s Sample) []byte {
+	var e pbEncoder
+	e.string(1, s.Type)
+	e.string(2, s.ID)
+	e.double(3, s.Value)
+	e.double(4, s.Min)
+	e.double(5, s.Max)
+	if !s.Time.IsZero() {
+		e.int64(6, s.Time.UnixNano())
+	}
+	e.int64(7, int64(s.Duration))
+
+	e.stringMap(8, s.Tags)
+
+	keys := make([]string, 0, len(s.Attributes))
+	for k := range s.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var entry pbEncoder
+		entry.bytes(1, []byte(k))
+		entry.key(2, pb64)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(s.Attributes[k]))
+		entry.b = append(entry.b, b[:]...)
+		e.bytes(9, entry.b)
+	}
+
+	return e.b
+}
+
+// mapEntry decodes a map entry with a string key and a string (wire type
+// bytes) or double value
+func mapEntry(b []byte) (key string, str string, num float64, err error) {
+	d := pbDecoder{b: b}
+	for d.err == nil && len(d.b) > 0 {
+		field, wire := d.next()
+		switch {
+		case field == 1 && wire == pbBytes:
+			key = string(d.bytes())
+		case field == 2 && wire == pbBytes:
+			str = string(d.bytes())
+		case field == 2 && wire == pb64:
+			num = math.Float64frombits(d.fixed64())
+		default:
+			d.skip(wire)
+		}
+	}
+	return key, str, num, d.err
+}
+
+func pbToSample(b []byte) (Sample, error) {
+	var s Sample
+	d := pbDecoder{b: b}
+
+	for d.err == nil && len(d.b) > 0 {
+		field, wire := d.next()
+		switch {
+		case field == 1 && wire == pbBytes:
+			s.Type = string(d.bytes())
+		case field == 2 && wire == pbBytes:
+			s.ID = string(d.bytes())
+		case field == 3 && wire == pb64:
+			s.Value = math.Float64frombits(d.fixed64())
+		case field == 4 && wire == pb64:
+			s.Min = math.Float64frombits(d.fixed64())
+		case field == 5 && wire == pb64:
+			s.Max = math.Float64frombits(d.fixed64())
+		case field == 6 && wire == pbVarint:
+			s.Time = time.Unix(0, int64(d.varint()))
+		case field == 7 && wire == pbVarint:
+			s.Duration = time.Duration(d.varint())
+		case field == 8 && wire == pbBytes:
+			k, v, _, err := mapEntry(d.bytes())
+			if err != nil {
+				return s, err
+			}
+			if s.Tags == nil {
+				s.Tags = make(map[string]string)
+			}
+			s.Tags[k] = v
+		case field == 9 && wire == pbBytes:
+			k, _, v, err := mapEntry(d.bytes())
+			if err != nil {
+				return s, err
+			}
+			if s.Attributes == nil {
+				s.Attributes = make(map[string]float64)
+			}
+			s.Attributes[k] = v
+		default:
+			d.skip(wire)
+		}
+	}
+
+	return s, d.err
+}
+
+// SamplesToPb encodes samples as a protobuf Samples message
+func SamplesToPb(samples []Sample) []byte {
+	var e pbEncoder
+	for _, s := range samples {
+		e.bytes(1, sampleToPb(s))
+	}
+	return e.b
+}
+
+// PbToSamples decodes a protobuf Samples message
+func PbToSamples(b []byte) ([]Sample, error) {
+	if len(b) > pbMaxSize {
+		return nil, errPb
+	}
+
+	var ret []Sample
+	d := pbDecoder{b: b}
+
+	for d.err == nil && len(d.b) > 0 {
+		field, wire := d.next()
+		if field != 1 || wire != pbBytes {
+			d.skip(wire)
+			continue
+		}
+
+		s, err := pbToSample(d.bytes())
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, s)
+	}
+
+	return ret, d.err
+}
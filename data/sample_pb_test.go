@@ -0,0 +1,39 @@
+package data
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSamplesPb(t *testing.T) {
+	// Samples{samples: [{type: "t", value: 1}]} from protoc
+	exp := []byte{0x0a, 0x0c, 0x0a, 0x01, 't', 0x19, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f}
+	b := SamplesToPb([]Sample{{Type: "t", Value: 1}})
+	if !bytes.Equal(b, exp) {
+		t.Errorf("wrong encoding: % x", b)
+	}
+
+	samples := []Sample{
+		{Type: "temp", ID: "1", Value: 23.5, Min: -1, Max: 100,
+			Time: time.Unix(1580000000, 123), Duration: time.Minute,
+			Tags:       map[string]string{"a": "b", "c": ""},
+			Attributes: map[string]float64{"x": 1.5}},
+		{Type: "count"},
+	}
+
+	ret, err := PbToSamples(SamplesToPb(samples))
+	if err != nil {
+		t.Fatal("Error decoding samples: ", err)
+	}
+
+	if !reflect.DeepEqual(ret, samples) {
+		t.Errorf("samples changed: %+v, %+v", samples, ret)
+	}
+
+	_, err = PbToSamples([]byte{0x0a, 0x10, 0x0a})
+	if err == nil {
+		t.Error("expected error for truncated message")
+	}
+}
@@ -0,0 +1,196 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// schedule types
+const (
+	ScheduleCron    = "cron"
+	ScheduleSunrise = "sunrise"
+	ScheduleSunset  = "sunset"
+)
+
+// Location is the position of a site, which is used to calculate sunrise
+// and sunset
+type Location struct {
+	Lat  float64 `json:"lat"`
+	Long float64 `json:"long"`
+}
+
+// Validate checks the location is valid
+func (l Location) Validate() error {
+	if l.Lat < -90 || l.Lat > 90 {
+		return errors.New("latitude must be -90 to 90")
+	}
+
+	if l.Long < -180 || l.Long > 180 {
+		return errors.New("longitude must be -180 to 180")
+	}
+
+	return nil
+}
+
+// Schedule runs a device command at set times, like turning an output on
+// at sunset. Schedules are evaluated on the device in its local time zone,
+// so they keep running when it is offline.
+type Schedule struct {
+	ID          string `json:"id"`
+	Description string `json:"description,omitempty"`
+	Disabled    bool   `json:"disabled,omitempty"`
+	// Type is cron, sunrise, or sunset
+	Type string `json:"type"`
+	// Cron is the cron expression for cron schedules, like "0 6 * * mon-fri"
+	Cron string `json:"cron,omitempty"`
+	// Days limits sunrise and sunset schedules to days like sat or sun.
+	// Blank is every day.
+	Days []string `json:"days,omitempty"`
+	// Offset is a Go duration added to sunrise or sunset, like -30m
+	Offset string `json:"offset,omitempty"`
+	// Command and Args are the device command that is run, like gpio with
+	// name and value args
+	Command string            `json:"command"`
+	Args    map[string]string `json:"args,omitempty"`
+}
+
+// Validate checks the schedule is valid. Sunrise and sunset schedules also
+// need the device location, which is checked by the caller.
+func (s Schedule) Validate() error {
+	if s.ID == "" {
+		return errors.New("schedule id is required")
+	}
+
+	switch s.Type {
+	case ScheduleCron:
+		_, err := ParseCron(s.Cron)
+		if err != nil {
+			return err
+		}
+	case ScheduleSunrise, ScheduleSunset:
+		for _, d := range s.Days {
+			if _, ok := weekdays[d]; !ok {
+				return fmt.Errorf("invalid schedule day: %v", d)
+			}
+		}
+
+		if s.Offset != "" {
+			o, err := time.ParseDuration(s.Offset)
+			if err != nil || o <= -12*time.Hour || o >= 12*time.Hour {
+				return fmt.Errorf("invalid schedule offset: %v", s.Offset)
+			}
+		}
+	default:
+		return fmt.Errorf("invalid schedule type: %v", s.Type)
+	}
+
+	if s.Command == "" {
+		return errors.New("schedule command is required")
+	}
+
+	return nil
+}
+
+// Next returns the first time after t the schedule runs. The zero time is
+// returned if it never runs, like when the sun does not rise or the
+// location is missing.
+func (s Schedule) Next(t time.Time, loc *time.Location, pos *Location) time.Time {
+	if s.Type == ScheduleCron {
+		c, err := ParseCron(s.Cron)
+		if err != nil {
+			return time.Time{}
+		}
+
+		return c.Next(t, loc)
+	}
+
+	if pos == nil {
+		return time.Time{}
+	}
+
+	offset, _ := time.ParseDuration(s.Offset)
+
+	days := make(map[time.Weekday]bool)
+	for _, d := range s.Days {
+		days[weekdays[d]] = true
+	}
+
+	local := t.In(loc)
+
+	// start the day before, as a negative offset can move an event back a
+	// day. The sun may not rise or set for months near the poles.
+	for i := -1; i <= 366; i++ {
+		date := time.Date(local.Year(), local.Month(), local.Day()+i, 12, 0, 0,
+			0, loc)
+
+		rise, set, ok := SunTimes(date, pos.Lat, pos.Long)
+		if !ok {
+			continue
+		}
+
+		event := rise
+		if s.Type == ScheduleSunset {
+			event = set
+		}
+		event = event.Add(offset).Truncate(time.Minute)
+
+		if len(days) > 0 && !days[event.In(loc).Weekday()] {
+			continue
+		}
+
+		if event.After(t) {
+			return event
+		}
+	}
+
+	return time.Time{}
+}
+
+func sinDeg(d float64) float64 { return math.Sin(d * math.Pi / 180) }
+func cosDeg(d float64) float64 { return math.Cos(d * math.Pi / 180) }
+
+// julian dates of the Unix and J2000 epochs
+const (
+	julianUnix  = 2440587.5
+	julian2000  = 2451545.0
+	secondsADay = 24 * 60 * 60
+)
+
+func fromJulian(j float64) time.Time {
+	s := (j - julianUnix) * secondsADay
+	return time.Unix(int64(s), 0).UTC()
+}
+
+// SunTimes returns sunrise and sunset on the local date of date at a
+// latitude and longitude (east is positive), using the sunrise equation.
+// Times are within a couple minutes. ok is false if the sun does not rise
+// or set that day.
+func SunTimes(date time.Time, lat, long float64) (rise, set time.Time, ok bool) {
+	y, m, d := date.Date()
+	noon := time.Date(y, m, d, 12, 0, 0, 0, time.UTC)
+
+	// days since J2000 and the mean solar noon at the longitude
+	n := math.Floor(float64(noon.Unix())/secondsADay+julianUnix-julian2000) + 0.0008
+	j := n - long/360
+
+	// solar mean anomaly, equation of the center, and ecliptic longitude
+	ma := math.Mod(357.5291+0.98560028*j, 360)
+	c := 1.9148*sinDeg(ma) + 0.02*sinDeg(2*ma) + 0.0003*sinDeg(3*ma)
+	l := math.Mod(ma+c+180+102.9372, 360)
+
+	transit := julian2000 + j + 0.0053*sinDeg(ma) - 0.0069*sinDeg(2*l)
+
+	// declination of the sun and the hour angle
+	decl := math.Asin(sinDeg(l) * sinDeg(23.4397))
+	cosH := (sinDeg(-0.833) - sinDeg(lat)*math.Sin(decl)) /
+		(cosDeg(lat) * math.Cos(decl))
+	if cosH < -1 || cosH > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+
+	h := math.Acos(cosH) * 180 / math.Pi
+
+	return fromJulian(transit - h/360), fromJulian(transit + h/360), true
+}
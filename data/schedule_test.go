@@ -0,0 +1,201 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSunTimes(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("tzdata not available: ", err)
+	}
+
+	near := func(a, b time.Time) bool {
+		d := a.Sub(b)
+		return d > -3*time.Minute && d < 3*time.Minute
+	}
+
+	// New York
+	rise, set, ok := SunTimes(time.Date(2021, 3, 20, 0, 0, 0, 0, loc), 40.71, -74.01)
+	if !ok || !near(rise, time.Date(2021, 3, 20, 6, 59, 0, 0, loc)) ||
+		!near(set, time.Date(2021, 3, 20, 19, 9, 0, 0, loc)) {
+		t.Errorf("wrong sun times: %v %v", rise.In(loc), set.In(loc))
+	}
+
+	// no sunrise in Tromsø in December
+	_, _, ok = SunTimes(time.Date(2021, 12, 21, 0, 0, 0, 0, time.UTC), 69.65, 18.96)
+	if ok {
+		t.Error("expected no sunrise")
+	}
+
+	pos := &Location{Lat: 40.71, Long: -74.01}
+	s := Schedule{ID: "lights", Type: ScheduleSunset, Offset: "-30m",
+		Days: []string{"sun"}, Command: "gpio"}
+
+	err = s.Validate()
+	if err != nil {
+		t.Fatal("Error validating schedule: ", err)
+	}
+
+	// Saturday after sunset
+	next := s.Next(time.Date(2021, 3, 20, 20, 0, 0, 0, loc), loc, pos)
+	if !near(next, time.Date(2021, 3, 21, 18, 40, 0, 0, loc)) {
+		t.Error("wrong next time: ", next.In(loc))
+	}
+
+	if !s.Next(time.Now(), loc, nil).IsZero() {
+		t.Error("expected no time without a location")
+	}
+}
+
+func TestSunTimesTable(t *testing.T) {
+	tests := []struct {
+		name      string
+		tz        string
+		lat, long float64
+		date      time.Time
+		rise, set string
+	}{
+		{"New York equinox", "America/New_York", 40.71, -74.01,
+			time.Date(2021, 3, 20, 0, 0, 0, 0, time.UTC), "06:59", "19:09"},
+		{"London solstice", "Europe/London", 51.51, -0.13,
+			time.Date(2021, 6, 21, 0, 0, 0, 0, time.UTC), "04:43", "21:21"},
+		{"Sydney summer", "Australia/Sydney", -33.87, 151.21,
+			time.Date(2021, 12, 21, 0, 0, 0, 0, time.UTC), "05:41", "20:05"},
+		{"Quito", "America/Guayaquil", -0.18, -78.47,
+			time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC), "06:13", "18:19"},
+	}
+
+	for _, test := range tests {
+		loc, err := time.LoadLocation(test.tz)
+		if err != nil {
+			t.Skip("tzdata not available: ", err)
+		}
+
+		y, m, d := test.date.Date()
+		rise, set, ok := SunTimes(time.Date(y, m, d, 12, 0, 0, 0, loc), test.lat, test.long)
+		if !ok {
+			t.Errorf("%v: expected sunrise and sunset", test.name)
+			continue
+		}
+
+		for _, c := range []struct {
+			got time.Time
+			exp string
+		}{{rise, test.rise}, {set, test.set}} {
+			exp, _ := time.ParseInLocation("2006-01-02 15:04",
+				test.date.Format("2006-01-02 ")+c.exp, loc)
+			if d := c.got.Sub(exp); d < -3*time.Minute || d > 3*time.Minute {
+				t.Errorf("%v: expected %v, got %v", test.name, c.exp,
+					c.got.In(loc).Format("15:04"))
+			}
+		}
+	}
+
+	// midnight sun in Tromsø in June
+	if _, _, ok := SunTimes(time.Date(2021, 6, 21, 0, 0, 0, 0, time.UTC), 69.65, 18.96); ok {
+		t.Error("expected no sunset")
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("tzdata not available: ", err)
+	}
+
+	ny := &Location{Lat: 40.71, Long: -74.01}
+	tromso := &Location{Lat: 69.65, Long: 18.96}
+
+	tests := []struct {
+		name  string
+		sched Schedule
+		pos   *Location
+		t     time.Time
+		next  time.Time
+	}{
+		{"sunrise today", Schedule{Type: ScheduleSunrise}, ny,
+			time.Date(2021, 3, 20, 5, 0, 0, 0, loc),
+			time.Date(2021, 3, 20, 6, 59, 0, 0, loc)},
+		{"sunrise tomorrow", Schedule{Type: ScheduleSunrise}, ny,
+			time.Date(2021, 3, 20, 8, 0, 0, 0, loc),
+			time.Date(2021, 3, 21, 6, 57, 0, 0, loc)},
+		{"after sunset", Schedule{Type: ScheduleSunset, Offset: "1h"}, ny,
+			time.Date(2021, 3, 20, 19, 30, 0, 0, loc),
+			time.Date(2021, 3, 20, 20, 9, 0, 0, loc)},
+		// the event is on the day before the sunrise
+		{"before sunrise", Schedule{Type: ScheduleSunrise, Offset: "-8h"}, ny,
+			time.Date(2021, 3, 19, 22, 0, 0, 0, loc),
+			time.Date(2021, 3, 19, 22, 59, 0, 0, loc)},
+		{"weekends", Schedule{Type: ScheduleSunrise, Days: []string{"sat", "sun"}}, ny,
+			time.Date(2021, 3, 22, 0, 0, 0, 0, loc),
+			time.Date(2021, 3, 27, 6, 48, 0, 0, loc)},
+		// the sun first rises again in the middle of January
+		{"polar night", Schedule{Type: ScheduleSunrise}, tromso,
+			time.Date(2021, 12, 21, 0, 0, 0, 0, loc),
+			time.Date(2022, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"cron", Schedule{Type: ScheduleCron, Cron: "0 6 * * *"}, nil,
+			time.Date(2021, 3, 20, 8, 0, 0, 0, loc),
+			time.Date(2021, 3, 21, 6, 0, 0, 0, loc)},
+		{"invalid cron", Schedule{Type: ScheduleCron, Cron: "0 6 * *"}, nil,
+			time.Date(2021, 3, 20, 8, 0, 0, 0, loc), time.Time{}},
+	}
+
+	for _, test := range tests {
+		next := test.sched.Next(test.t, loc, test.pos)
+		if test.next.IsZero() {
+			if !next.IsZero() {
+				t.Errorf("%v: expected no time, got %v", test.name, next)
+			}
+			continue
+		}
+
+		// polar sunrise dates are only approximate
+		tolerance := 3 * time.Minute
+		if test.pos == tromso {
+			tolerance = 2 * 24 * time.Hour
+		}
+
+		if d := next.Sub(test.next); d < -tolerance || d > tolerance {
+			t.Errorf("%v: expected %v, got %v", test.name, test.next, next.In(loc))
+		}
+
+		if next.Second() != 0 {
+			t.Errorf("%v: not truncated to the minute: %v", test.name, next)
+		}
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	tests := []struct {
+		sched Schedule
+		valid bool
+	}{
+		{Schedule{ID: "a", Type: ScheduleCron, Cron: "0 6 * * *", Command: "gpio"}, true},
+		{Schedule{ID: "a", Type: ScheduleSunset, Days: []string{"mon"}, Offset: "-30m",
+			Command: "gpio"}, true},
+		{Schedule{Type: ScheduleCron, Cron: "0 6 * * *", Command: "gpio"}, false},
+		{Schedule{ID: "a", Type: ScheduleCron, Cron: "0 6 * *", Command: "gpio"}, false},
+		{Schedule{ID: "a", Type: ScheduleCron, Cron: "0 6 * * *"}, false},
+		{Schedule{ID: "a", Type: "weekly", Command: "gpio"}, false},
+		{Schedule{ID: "a", Type: ScheduleSunrise, Days: []string{"monday"},
+			Command: "gpio"}, false},
+		{Schedule{ID: "a", Type: ScheduleSunrise, Offset: "30", Command: "gpio"}, false},
+		{Schedule{ID: "a", Type: ScheduleSunrise, Offset: "12h", Command: "gpio"}, false},
+		{Schedule{ID: "a", Type: ScheduleSunrise, Offset: "-11h59m", Command: "gpio"}, true},
+	}
+
+	for _, test := range tests {
+		err := test.sched.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("%+v: expected valid %v, got %v", test.sched, test.valid, err)
+		}
+	}
+
+	for _, l := range []Location{{Lat: 91}, {Lat: -91}, {Long: 181}, {Long: -180.5}} {
+		if l.Validate() == nil {
+			t.Errorf("%+v: expected error", l)
+		}
+	}
+}
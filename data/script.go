@@ -0,0 +1,64 @@
+package data
+
+import (
+	"errors"
+	"time"
+)
+
+// ScriptTag is the sample tag set to the script ID on samples written by
+// scripts. Scripts don't run on these samples, so they can't trigger
+// themselves.
+const ScriptTag = "script"
+
+// Script is a user script that runs on the server when devices send
+// samples. Scripts are written in a subset of Lua, and handle samples by
+// defining an on_sample function.
+type Script struct {
+	ID          uint64 `json:"id" boltholdKey:"ID"`
+	Description string `json:"description"`
+	Disabled    bool   `json:"disabled,omitempty"`
+	// DeviceIDs are the devices whose samples run the script. It runs on
+	// samples from all devices if empty.
+	DeviceIDs []string `json:"deviceIds,omitempty"`
+	// Source is the script source code
+	Source string `json:"source"`
+	// Error is the last error running the script, which is set by the
+	// script engine and cleared when the script runs without errors
+	Error     string    `json:"error,omitempty"`
+	ErrorTime time.Time `json:"errorTime,omitempty"`
+}
+
+// Runs returns true if samples from a device run the script
+func (s Script) Runs(deviceID string) bool {
+	if s.Disabled {
+		return false
+	}
+
+	if len(s.DeviceIDs) == 0 {
+		return true
+	}
+
+	for _, id := range s.DeviceIDs {
+		if id == deviceID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Validate checks the script is valid. The source is checked by the
+// script engine.
+func (s Script) Validate() error {
+	if s.Source == "" {
+		return errors.New("script source is required")
+	}
+
+	for _, id := range s.DeviceIDs {
+		if id == "" {
+			return errors.New("script device ids can't be blank")
+		}
+	}
+
+	return nil
+}
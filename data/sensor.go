@@ -0,0 +1,71 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+)
+
+// supported sensor types
+const (
+	SensorBME280  = "bme280"
+	SensorADS1115 = "ads1115"
+)
+
+// SensorConfig is a sensor connected to a device bus that is read on a
+// schedule
+type SensorConfig struct {
+	// ID is used as the sample ID
+	ID string `json:"id"`
+	// Type is bme280 or ads1115
+	Type string `json:"type"`
+	// Bus is the I2C bus device, like /dev/i2c-1
+	Bus string `json:"bus"`
+	// Address is the I2C address of the sensor (default 0x76 for bme280,
+	// 0x48 for ads1115)
+	Address int `json:"address,omitempty"`
+	// Channel is the ads1115 input (0-3)
+	Channel int `json:"channel,omitempty"`
+	// Range is the ads1115 full scale voltage (default 2.048)
+	Range float64 `json:"range,omitempty"`
+	// Interval is how often the sensor is read in seconds
+	Interval int `json:"interval"`
+}
+
+// Validate checks the sensor config is valid
+func (c SensorConfig) Validate() error {
+	if c.ID == "" {
+		return errors.New("sensor id is required")
+	}
+
+	switch c.Type {
+	case SensorBME280, SensorADS1115:
+	default:
+		return fmt.Errorf("unsupported sensor type: %v", c.Type)
+	}
+
+	if c.Bus == "" {
+		return errors.New("sensor bus is required")
+	}
+
+	if c.Address < 0 || c.Address > 0x7f {
+		return errors.New("sensor address must be 0 to 0x7f")
+	}
+
+	if c.Type == SensorADS1115 {
+		if c.Channel < 0 || c.Channel > 3 {
+			return errors.New("ads1115 channel must be 0 to 3")
+		}
+
+		switch c.Range {
+		case 0, 6.144, 4.096, 2.048, 1.024, 0.512, 0.256:
+		default:
+			return errors.New("ads1115 range must be 6.144, 4.096, 2.048, 1.024, 0.512, or 0.256")
+		}
+	}
+
+	if c.Interval <= 0 {
+		return errors.New("sensor interval must be greater than 0")
+	}
+
+	return nil
+}
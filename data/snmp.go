@@ -0,0 +1,140 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// SnmpConfig is an SNMP agent, like a UPS, switch, or radio, that the
+// device polls for OID values, which are reported as samples
+type SnmpConfig struct {
+	// Address is the agent host, or host:port if it isn't on port 161
+	Address string `json:"address"`
+	// Version is 1, 2c (default), or 3
+	Version string `json:"version,omitempty"`
+	// Community is used for v1 and v2c (default public)
+	Community string `json:"community,omitempty"`
+	// User is the v3 user. AuthProtocol is md5 or sha, and PrivProtocol
+	// is des or aes. They are blank if not used.
+	User         string `json:"user,omitempty"`
+	AuthProtocol string `json:"authProtocol,omitempty"`
+	AuthPassword string `json:"authPassword,omitempty"`
+	PrivProtocol string `json:"privProtocol,omitempty"`
+	PrivPassword string `json:"privPassword,omitempty"`
+	// Interval is how often the OIDs are read in seconds (default 60)
+	Interval int `json:"interval,omitempty"`
+	// Oids are the values read from the agent
+	Oids []SnmpOid `json:"oids"`
+}
+
+// SnmpOid is a value read from an SNMP agent. Values are raw*Scale +
+// Offset.
+type SnmpOid struct {
+	// OID is the object identifier, like 1.3.6.1.2.1.33.1.2.4.0
+	OID string `json:"oid"`
+	// ID is used as the sample ID
+	ID string `json:"id,omitempty"`
+	// Type is the sample type, like batteryCharge
+	Type string `json:"type"`
+	// Scale multiplies the raw value (default 1)
+	Scale  float64 `json:"scale,omitempty"`
+	Offset float64 `json:"offset,omitempty"`
+}
+
+// SnmpTrapConfig is how the device receives traps from agents. Traps
+// are reported as log entries.
+type SnmpTrapConfig struct {
+	// Port is the UDP port traps are received on (default 162)
+	Port int `json:"port,omitempty"`
+	// Community must match the community of v1 and v2c traps, unless it
+	// is blank
+	Community string `json:"community,omitempty"`
+}
+
+var reSnmpOID = regexp.MustCompile(`^\.?\d+(\.\d+)+$`)
+
+// Value returns the scaled value
+func (o SnmpOid) Value(raw float64) float64 {
+	scale := o.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	return raw*scale + o.Offset
+}
+
+// Validate checks the OID config is valid
+func (o SnmpOid) Validate() error {
+	if !reSnmpOID.MatchString(o.OID) {
+		return fmt.Errorf("invalid snmp oid: %v", o.OID)
+	}
+
+	if o.Type == "" {
+		return errors.New("snmp oid type is required")
+	}
+
+	return nil
+}
+
+// Validate checks the SNMP config is valid
+func (c SnmpConfig) Validate() error {
+	if c.Address == "" {
+		return errors.New("snmp address is required")
+	}
+
+	switch c.Version {
+	case "", "1", "2c":
+	case "3":
+		if c.User == "" {
+			return errors.New("snmp v3 user is required")
+		}
+
+		switch c.AuthProtocol {
+		case "", "md5", "sha":
+		default:
+			return fmt.Errorf("unsupported snmp auth protocol: %v", c.AuthProtocol)
+		}
+
+		switch c.PrivProtocol {
+		case "", "des", "aes":
+		default:
+			return fmt.Errorf("unsupported snmp privacy protocol: %v", c.PrivProtocol)
+		}
+
+		if c.PrivProtocol != "" && c.AuthProtocol == "" {
+			return errors.New("snmp privacy requires authentication")
+		}
+
+		if (c.AuthProtocol != "" && len(c.AuthPassword) < 8) ||
+			(c.PrivProtocol != "" && len(c.PrivPassword) < 8) {
+			return errors.New("snmp v3 passwords must be at least 8 characters")
+		}
+	default:
+		return fmt.Errorf("unsupported snmp version: %v", c.Version)
+	}
+
+	if c.Interval < 0 {
+		return errors.New("snmp interval can't be negative")
+	}
+
+	if len(c.Oids) == 0 {
+		return errors.New("snmp oids are required")
+	}
+
+	for _, o := range c.Oids {
+		err := o.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the trap config is valid
+func (c SnmpTrapConfig) Validate() error {
+	if c.Port < 0 || c.Port > 65535 {
+		return errors.New("snmp trap port must be 0 to 65535")
+	}
+	return nil
+}
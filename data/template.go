@@ -0,0 +1,83 @@
+package data
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// DeviceTemplate is the default config of a type of device, like a model
+// of meter, so every device of the type does not have to be configured by
+// hand. Devices that register with a type get the template config when
+// they are claimed, and template changes can be rolled out to the devices
+// of the type.
+type DeviceTemplate struct {
+	Type        string `json:"type" boltholdKey:"Type"`
+	Description string `json:"description,omitempty"`
+	// Config is the default config, like the Modbus registers to poll,
+	// sensor poll schedules, and transforms. Fields that are not set are
+	// left as they are on the devices.
+	Config DeviceConfig `json:"config"`
+	// SampleTypes are the sample types devices of the type should report
+	SampleTypes []string `json:"sampleTypes,omitempty"`
+	// Version is incremented every time the template changes
+	Version int       `json:"version"`
+	Updated time.Time `json:"updated"`
+}
+
+// Validate checks a template is valid. The config must be checked
+// separately.
+func (t DeviceTemplate) Validate() error {
+	if t.Type == "" {
+		return errors.New("template type is required")
+	}
+
+	if t.Config.Type != "" && t.Config.Type != t.Type {
+		return errors.New("template config type must match the template type")
+	}
+
+	return nil
+}
+
+// Apply returns a device config with the fields that are set in the
+// template config replaced, and the type set to the template type
+func (t DeviceTemplate) Apply(c DeviceConfig) DeviceConfig {
+	ret := reflect.ValueOf(&c).Elem()
+	tmpl := reflect.ValueOf(t.Config)
+
+	for i := 0; i < tmpl.NumField(); i++ {
+		if !configFieldEmpty(tmpl.Field(i)) {
+			ret.Field(i).Set(tmpl.Field(i))
+		}
+	}
+
+	c.Type = t.Type
+	return c
+}
+
+// Missing returns the sample types of the template a device has not
+// reported, sorted
+func (t DeviceTemplate) Missing(dev Device) []string {
+	reported := make(map[string]bool)
+	for _, io := range dev.State.Ios {
+		reported[io.Type] = true
+	}
+
+	ret := []string{}
+	for _, typ := range t.SampleTypes {
+		if !reported[typ] {
+			ret = append(ret, typ)
+		}
+	}
+
+	sort.Strings(ret)
+	return ret
+}
+
+// TemplateInstance is a device of a template type
+type TemplateInstance struct {
+	DeviceID string `json:"deviceId"`
+	// Missing are the template sample types the device has not reported
+	Missing []string `json:"missing"`
+}
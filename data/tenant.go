@@ -0,0 +1,56 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Tenant is an organization on a hosted server. Each tenant's devices,
+// groups, rules, scripts, and sample history are stored in a separate db,
+// so tenants can't see each other's data.
+type Tenant struct {
+	ID      string    `json:"id" boltholdKey:"ID"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+// define tenant user roles
+const (
+	// TenantRoleUser can read and write the tenant's data
+	TenantRoleUser = "user"
+	// TenantRoleViewer can only read the tenant's data
+	TenantRoleViewer = "viewer"
+)
+
+// TenantUser is a user of a tenant. Users authenticate to the API with a
+// token, and only a hash of the token is stored, so the token is only
+// known when the user is created.
+type TenantUser struct {
+	ID       uint64    `json:"id" boltholdKey:"ID"`
+	TenantID string    `json:"tenantId" boltholdIndex:"TenantID"`
+	Name     string    `json:"name"`
+	Role     string    `json:"role"`
+	Hash     string    `json:"-" boltholdIndex:"Hash"`
+	Created  time.Time `json:"created"`
+}
+
+// Validate checks the user is valid
+func (u TenantUser) Validate() error {
+	if u.Name == "" {
+		return errors.New("user name is required")
+	}
+
+	switch u.Role {
+	case TenantRoleUser, TenantRoleViewer:
+	default:
+		return fmt.Errorf("unknown role: %v", u.Role)
+	}
+
+	return nil
+}
+
+// CanWrite returns true if the user can change the tenant's data
+func (u TenantUser) CanWrite() bool {
+	return u.Role == TenantRoleUser
+}
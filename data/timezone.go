@@ -0,0 +1,21 @@
+package data
+
+import (
+	"fmt"
+	"time"
+)
+
+// ValidateTimezone checks tz is a tzdata time zone name like
+// America/New_York
+func ValidateTimezone(tz string) error {
+	if tz == "Local" {
+		return fmt.Errorf("invalid time zone: %v", tz)
+	}
+
+	_, err := time.LoadLocation(tz)
+	if err != nil {
+		return fmt.Errorf("unknown time zone: %v", tz)
+	}
+
+	return nil
+}
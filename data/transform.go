@@ -0,0 +1,189 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Transform converts the values of samples as they are written, so raw
+// readings from devices, like ADC counts, are stored in engineering units.
+// The steps run in order: the value is scaled, the offset is added, the
+// unit is converted, the expression is evaluated, and the result is
+// clamped.
+type Transform struct {
+	// Type is the sample type transformed
+	Type string `json:"type"`
+	// ID is the sample ID transformed. If blank, samples with any ID are
+	// transformed.
+	ID string `json:"id,omitempty"`
+	// Scale multiplies the value (default 1)
+	Scale float64 `json:"scale,omitempty"`
+	// Offset is added to the value after scaling, like a calibration
+	// offset
+	Offset float64 `json:"offset,omitempty"`
+	// From and To convert the value between units, like c and f
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	// Expression is a script expression that computes the value, like
+	// "value * value / 2". sample(type, [id]) returns the latest value of
+	// another sample of the device.
+	Expression string `json:"expression,omitempty"`
+	// Min and Max clamp the value if set
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+	// OutputType and OutputID derive a new sample with the result and keep
+	// the original sample. If OutputType is blank, the sample value is
+	// replaced.
+	OutputType string `json:"outputType,omitempty"`
+	OutputID   string `json:"outputID,omitempty"`
+}
+
+// Matches returns true if the transform applies to a sample
+func (t Transform) Matches(s Sample) bool {
+	return s.Type == t.Type && (t.ID == "" || s.ID == t.ID)
+}
+
+// Linear applies the scale, offset, and unit conversion steps to a value
+func (t Transform) Linear(v float64) float64 {
+	if t.Scale != 0 {
+		v *= t.Scale
+	}
+
+	v += t.Offset
+
+	if t.From != "" {
+		// units are checked by Validate
+		v, _ = ConvertUnit(v, t.From, t.To)
+	}
+
+	return v
+}
+
+// Clamp limits a value to Min and Max
+func (t Transform) Clamp(v float64) float64 {
+	if t.Min != nil && v < *t.Min {
+		v = *t.Min
+	}
+
+	if t.Max != nil && v > *t.Max {
+		v = *t.Max
+	}
+
+	return v
+}
+
+// Validate checks the transform is valid. Expressions are checked by the
+// script package.
+func (t Transform) Validate() error {
+	if t.Type == "" {
+		return errors.New("transform sample type is required")
+	}
+
+	if (t.From == "") != (t.To == "") {
+		return fmt.Errorf("transform %v needs both from and to units", t.Type)
+	}
+
+	if t.From != "" {
+		_, err := ConvertUnit(0, t.From, t.To)
+		if err != nil {
+			return err
+		}
+	}
+
+	if t.Min != nil && t.Max != nil && *t.Min > *t.Max {
+		return fmt.Errorf("transform %v min is more than max", t.Type)
+	}
+
+	if t.OutputType == "" && t.OutputID != "" {
+		return fmt.Errorf("transform %v output id requires an output type", t.Type)
+	}
+
+	if t.OutputType == t.Type && t.OutputID == t.ID {
+		return fmt.Errorf("transform %v output can't match its input", t.Type)
+	}
+
+	return nil
+}
+
+// unit is a unit of measure. Values are converted to the base unit of the
+// quantity with value*scale + offset.
+type unit struct {
+	quantity string
+	scale    float64
+	offset   float64
+}
+
+var units = map[string]unit{
+	// temperature, base K
+	"k": {"temperature", 1, 0},
+	"c": {"temperature", 1, 273.15},
+	"f": {"temperature", 5.0 / 9, 273.15 - 32*5.0/9},
+
+	// length, base m
+	"m":  {"length", 1, 0},
+	"cm": {"length", 0.01, 0},
+	"mm": {"length", 0.001, 0},
+	"km": {"length", 1000, 0},
+	"in": {"length", 0.0254, 0},
+	"ft": {"length", 0.3048, 0},
+	"mi": {"length", 1609.344, 0},
+
+	// pressure, base Pa
+	"pa":   {"pressure", 1, 0},
+	"kpa":  {"pressure", 1000, 0},
+	"bar":  {"pressure", 100000, 0},
+	"mbar": {"pressure", 100, 0},
+	"psi":  {"pressure", 6894.757293168, 0},
+	"inhg": {"pressure", 3386.389, 0},
+
+	// volume, base l
+	"l":   {"volume", 1, 0},
+	"ml":  {"volume", 0.001, 0},
+	"m3":  {"volume", 1000, 0},
+	"gal": {"volume", 3.785411784, 0},
+
+	// speed, base m/s
+	"m/s":  {"speed", 1, 0},
+	"km/h": {"speed", 1 / 3.6, 0},
+	"mph":  {"speed", 0.44704, 0},
+	"kn":   {"speed", 1852.0 / 3600, 0},
+
+	// mass, base kg
+	"kg": {"mass", 1, 0},
+	"g":  {"mass", 0.001, 0},
+	"lb": {"mass", 0.45359237, 0},
+	"oz": {"mass", 0.028349523125, 0},
+
+	// flow, base l/min
+	"l/min": {"flow", 1, 0},
+	"l/s":   {"flow", 60, 0},
+	"m3/h":  {"flow", 1000.0 / 60, 0},
+	"gpm":   {"flow", 3.785411784, 0},
+
+	// energy, base Wh
+	"wh":  {"energy", 1, 0},
+	"kwh": {"energy", 1000, 0},
+	"j":   {"energy", 1 / 3600.0, 0},
+	"btu": {"energy", 0.29307107, 0},
+}
+
+// ConvertUnit converts a value between units, like c to f. Unit names are
+// not case sensitive.
+func ConvertUnit(v float64, from, to string) (float64, error) {
+	f, ok := units[strings.ToLower(from)]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit: %v", from)
+	}
+
+	t, ok := units[strings.ToLower(to)]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit: %v", to)
+	}
+
+	if f.quantity != t.quantity {
+		return 0, fmt.Errorf("can't convert %v to %v", from, to)
+	}
+
+	return (v*f.scale + f.offset - t.offset) / t.scale, nil
+}
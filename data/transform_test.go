@@ -0,0 +1,80 @@
+package data
+
+import (
+	"math"
+	"testing"
+)
+
+func TestConvertUnit(t *testing.T) {
+	tests := []struct {
+		v        float64
+		from, to string
+		exp      float64
+	}{
+		{100, "c", "f", 212},
+		{32, "F", "C", 0},
+		{0, "c", "k", 273.15},
+		{1, "ft", "in", 12},
+		{1, "bar", "psi", 14.5038},
+		{60, "mph", "km/h", 96.5606},
+		{1, "gpm", "l/min", 3.7854},
+	}
+
+	for _, test := range tests {
+		v, err := ConvertUnit(test.v, test.from, test.to)
+		if err != nil {
+			t.Errorf("Error converting %v %v to %v: %v", test.v, test.from, test.to, err)
+			continue
+		}
+
+		if math.Abs(v-test.exp) > 0.0001 {
+			t.Errorf("%v %v is %v %v, expected %v", test.v, test.from, v, test.to, test.exp)
+		}
+	}
+
+	_, err := ConvertUnit(1, "c", "psi")
+	if err == nil {
+		t.Error("expected error converting temperature to pressure")
+	}
+
+	_, err = ConvertUnit(1, "furlong", "m")
+	if err == nil {
+		t.Error("expected error converting unknown unit")
+	}
+}
+
+func TestTransform(t *testing.T) {
+	min, max := 0.0, 100.0
+
+	// 4-20mA input read as 0-4095 counts
+	tr := Transform{Type: "level", Scale: 100.0 / 4095, Offset: -2, Min: &min, Max: &max}
+
+	for _, test := range []struct{ v, exp float64 }{
+		{0, 0},
+		{2047.5, 48},
+		{4095, 98},
+		{5000, 100},
+	} {
+		v := tr.Clamp(tr.Linear(test.v))
+		if math.Abs(v-test.exp) > 0.0001 {
+			t.Errorf("%v transformed to %v, expected %v", test.v, v, test.exp)
+		}
+	}
+
+	if !tr.Matches(Sample{Type: "level", ID: "tank1"}) || tr.Matches(Sample{Type: "temp"}) {
+		t.Error("transform matched wrong samples")
+	}
+
+	for _, bad := range []Transform{
+		{},
+		{Type: "temp", From: "c"},
+		{Type: "temp", From: "c", To: "psi"},
+		{Type: "temp", Min: &max, Max: &min},
+		{Type: "temp", OutputID: "x"},
+		{Type: "temp", OutputType: "temp"},
+	} {
+		if bad.Validate() == nil {
+			t.Errorf("expected error validating %+v", bad)
+		}
+	}
+}
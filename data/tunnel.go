@@ -0,0 +1,70 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TunnelCommand is the device command that asks a device to open a tunnel
+// to the server. The args are sessionId, port, token, and ends, the RFC3339
+// time the session ends. The device connects to the websocket at
+// /v1/tunnels/<sessionId> on the server it is configured with.
+const TunnelCommand = "tunnelOpen"
+
+// tunnel session states
+const (
+	// TunnelPending sessions are waiting for the device to connect
+	TunnelPending = "pending"
+	// TunnelConnected sessions have a device connection, and support
+	// engineers can connect to the device port
+	TunnelConnected = "connected"
+	// TunnelClosed sessions were closed or reached their time limit
+	TunnelClosed = "closed"
+)
+
+// TunnelSession allows support engineers to connect to a TCP port on a
+// device, like SSH, for a limited time. The device opens an outbound
+// connection to the server, so it does not need to be reachable, and each
+// engineer connection is a stream over the device connection.
+type TunnelSession struct {
+	ID       uint64 `json:"id" boltholdKey:"ID"`
+	DeviceID string `json:"deviceId" boltholdIndex:"DeviceID"`
+	// Port is the TCP port on the device that connections are forwarded
+	// to
+	Port int `json:"port"`
+	// User is who opened the session, and Reason why
+	User   string `json:"user"`
+	Reason string `json:"reason,omitempty"`
+	State  string `json:"state"`
+	// TokenHash is the hash of the token the device connects with
+	TokenHash string    `json:"-"`
+	Created   time.Time `json:"created"`
+	// Ends is when the session is closed, even if it is in use
+	Ends        time.Time `json:"ends"`
+	Closed      time.Time `json:"closed,omitempty"`
+	CloseReason string    `json:"closeReason,omitempty"`
+	// Connections is the number of engineer connections made
+	Connections int `json:"connections"`
+	// BytesIn are the bytes sent to the device, and BytesOut the bytes
+	// sent by the device
+	BytesIn  int64 `json:"bytesIn"`
+	BytesOut int64 `json:"bytesOut"`
+}
+
+// Validate checks the session is valid
+func (s TunnelSession) Validate() error {
+	if s.DeviceID == "" {
+		return errors.New("tunnel device is required")
+	}
+
+	if s.Port <= 0 || s.Port > 65535 {
+		return fmt.Errorf("invalid tunnel port: %v", s.Port)
+	}
+
+	if s.User == "" {
+		return errors.New("tunnel user is required")
+	}
+
+	return nil
+}
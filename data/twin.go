@@ -0,0 +1,175 @@
+package data
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// config sync states, from best to worst
+const (
+	// SyncOK fields are applied by the device as desired
+	SyncOK = "ok"
+	// SyncPending fields changed since the device last reported its config
+	SyncPending = "pending"
+	// SyncDrift fields are different on the device, although it reported
+	// its config after they changed and did not report an error, like when
+	// the device was changed locally
+	SyncDrift = "drift"
+	// SyncFailed fields could not be applied by the device
+	SyncFailed = "failed"
+)
+
+var syncRank = map[string]int{
+	SyncOK:      0,
+	SyncPending: 1,
+	SyncDrift:   2,
+	SyncFailed:  3,
+}
+
+// ConfigReport is sent by a device with the config it has applied
+type ConfigReport struct {
+	Config DeviceConfig `json:"config"`
+	// Errors are the config fields the device failed to apply, by JSON
+	// field name, like "wifi"
+	Errors map[string]string `json:"errors,omitempty"`
+	// Time is when the server received the report
+	Time time.Time `json:"time"`
+}
+
+// FieldSync is the sync status of a config field
+type FieldSync struct {
+	Field  string `json:"field"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Twin compares the config desired for a device with the config the device
+// reported it applied
+type Twin struct {
+	ID       string        `json:"id"`
+	Desired  DeviceConfig  `json:"desired"`
+	Reported *DeviceConfig `json:"reported,omitempty"`
+	// Updated is when the desired config last changed
+	Updated time.Time `json:"updated"`
+	// ReportTime is when the device last reported its config
+	ReportTime time.Time `json:"reportTime"`
+	// Status is the worst status of all fields
+	Status string `json:"status"`
+	// Fields are the fields set in the desired or reported config
+	Fields []FieldSync `json:"fields"`
+}
+
+// Failed returns the fields the device failed to apply, with the errors
+func (t Twin) Failed() map[string]string {
+	ret := make(map[string]string)
+	for _, f := range t.Fields {
+		if f.Status == SyncFailed {
+			ret[f.Field] = f.Error
+		}
+	}
+	return ret
+}
+
+// configFieldName returns the JSON name of a DeviceConfig field
+func configFieldName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+// configFieldEmpty returns true if a config field is not set. Empty slices
+// and maps are the same as nil.
+func configFieldEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+// configFieldEqual compares config field values
+func configFieldEqual(a, b reflect.Value) bool {
+	if configFieldEmpty(a) || configFieldEmpty(b) {
+		return configFieldEmpty(a) && configFieldEmpty(b)
+	}
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
+
+// ConfigChanges returns the JSON names of the fields that are different
+// in two configs
+func ConfigChanges(a, b DeviceConfig) []string {
+	var ret []string
+
+	av := reflect.ValueOf(a)
+	bv := reflect.ValueOf(b)
+	typ := av.Type()
+
+	for i := 0; i < typ.NumField(); i++ {
+		if !configFieldEqual(av.Field(i), bv.Field(i)) {
+			ret = append(ret, configFieldName(typ.Field(i)))
+		}
+	}
+
+	return ret
+}
+
+// Twin returns the sync status of the device config
+func (d Device) Twin() Twin {
+	ret := Twin{
+		ID:      d.ID,
+		Desired: d.Config,
+		Updated: d.State.ConfigUpdated,
+		Status:  SyncOK,
+		Fields:  []FieldSync{},
+	}
+
+	var reported DeviceConfig
+	report := d.State.Reported
+	current := false
+	if report != nil {
+		reported = report.Config
+		ret.Reported = &reported
+		ret.ReportTime = report.Time
+		current = !report.Time.Before(d.State.ConfigUpdated)
+	}
+
+	desiredV := reflect.ValueOf(d.Config)
+	reportedV := reflect.ValueOf(reported)
+	typ := desiredV.Type()
+
+	for i := 0; i < typ.NumField(); i++ {
+		name := configFieldName(typ.Field(i))
+		desired := desiredV.Field(i)
+
+		fs := FieldSync{Field: name, Status: SyncOK}
+
+		switch {
+		case configFieldEqual(desired, reportedV.Field(i)):
+			if configFieldEmpty(desired) {
+				// not set on either side
+				continue
+			}
+			if report == nil {
+				fs.Status = SyncPending
+			}
+		case !current:
+			fs.Status = SyncPending
+		case report.Errors[name] != "":
+			fs.Status = SyncFailed
+			fs.Error = report.Errors[name]
+		default:
+			fs.Status = SyncDrift
+		}
+
+		if syncRank[fs.Status] > syncRank[ret.Status] {
+			ret.Status = fs.Status
+		}
+
+		ret.Fields = append(ret.Fields, fs)
+	}
+
+	return ret
+}
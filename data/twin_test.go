@@ -0,0 +1,89 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTwin(t *testing.T) {
+	start := time.Now()
+
+	status := func(twin Twin) map[string]string {
+		ret := make(map[string]string)
+		for _, f := range twin.Fields {
+			ret[f.Field] = f.Status
+		}
+		return ret
+	}
+
+	dev := Device{
+		ID: "1234",
+		Config: DeviceConfig{
+			Description: "pump",
+			Hostname:    "pump-1",
+			Timezone:    "America/New_York",
+		},
+		State: DeviceState{ConfigUpdated: start},
+	}
+
+	// the device has not reported its config
+	twin := dev.Twin()
+	if twin.Status != SyncPending || len(twin.Fields) != 3 ||
+		status(twin)["hostname"] != SyncPending {
+		t.Errorf("wrong twin: %+v", twin)
+	}
+
+	dev.State.Reported = &ConfigReport{
+		Config: DeviceConfig{
+			Description: "pump",
+			Hostname:    "pump-old",
+			Timezone:    "UTC",
+			Groups:      []string{},
+		},
+		Errors: map[string]string{"hostname": "read-only filesystem"},
+		Time:   start.Add(time.Second),
+	}
+
+	twin = dev.Twin()
+	s := status(twin)
+	if twin.Status != SyncFailed || len(twin.Fields) != 3 ||
+		s["description"] != SyncOK || s["hostname"] != SyncFailed ||
+		s["timezone"] != SyncDrift {
+		t.Errorf("wrong twin: %+v", twin)
+	}
+
+	if f := twin.Failed(); len(f) != 1 || f["hostname"] != "read-only filesystem" {
+		t.Error("wrong failed fields: ", f)
+	}
+
+	// the config changed after the report
+	dev.State.ConfigUpdated = start.Add(2 * time.Second)
+	twin = dev.Twin()
+	s = status(twin)
+	if twin.Status != SyncPending || s["description"] != SyncOK ||
+		s["hostname"] != SyncPending || s["timezone"] != SyncPending {
+		t.Errorf("wrong twin: %+v", twin)
+	}
+
+	dev.State.Reported = &ConfigReport{Config: dev.Config,
+		Time: start.Add(3 * time.Second)}
+	twin = dev.Twin()
+	if twin.Status != SyncOK || twin.ReportTime != dev.State.Reported.Time {
+		t.Errorf("wrong twin: %+v", twin)
+	}
+}
+
+func TestConfigChanges(t *testing.T) {
+	a := DeviceConfig{Description: "pump", Tags: map[string]string{}}
+	b := DeviceConfig{Description: "pump 2", Groups: []string{"plant"}}
+
+	changes := ConfigChanges(a, b)
+	if !reflect.DeepEqual(changes, []string{"description", "groups"}) {
+		t.Error("Wrong changes: ", changes)
+	}
+
+	if len(ConfigChanges(a, a)) != 0 {
+		t.Error("Same config has changes")
+	}
+}
@@ -0,0 +1,97 @@
+package data
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// define user roles
+const (
+	// UserRoleAdmin can do everything, including using the admin API
+	UserRoleAdmin = "admin"
+	// UserRoleUser can read and write devices, rules, and scripts
+	UserRoleUser = "user"
+	// UserRoleViewer can only read
+	UserRoleViewer = "viewer"
+)
+
+// MinPasswordLength is the shortest password allowed
+const MinPasswordLength = 8
+
+// MaxPasswordLength is the longest password allowed in bytes, as bcrypt
+// ignores the rest
+const MaxPasswordLength = 72
+
+var reUsername = regexp.MustCompile(`^[a-zA-Z0-9_.@-]{1,64}$`)
+
+// User is a user account of the portal. Only a hash of the password is
+// stored.
+type User struct {
+	Username string `json:"username" boltholdKey:"Username"`
+	Role     string `json:"role"`
+	Hash     string `json:"-"`
+	// Provider is the identity provider that manages the user, or blank
+	// for local users that log in with a password
+	Provider string    `json:"provider,omitempty"`
+	Created  time.Time `json:"created"`
+	// FailedLogins is the number of failed logins in a row. The account is
+	// locked until LockedUntil after too many.
+	FailedLogins int       `json:"failedLogins,omitempty"`
+	LockedUntil  time.Time `json:"lockedUntil,omitempty"`
+}
+
+// Validate checks the user is valid
+func (u User) Validate() error {
+	if !reUsername.MatchString(u.Username) {
+		return fmt.Errorf("invalid username: %q", u.Username)
+	}
+
+	switch u.Role {
+	case UserRoleAdmin, UserRoleUser, UserRoleViewer:
+	default:
+		return fmt.Errorf("unknown role: %v", u.Role)
+	}
+
+	return nil
+}
+
+// CanWrite returns true if the user can change data
+func (u User) CanWrite() bool {
+	return u.Role == UserRoleAdmin || u.Role == UserRoleUser
+}
+
+// ValidatePassword checks a new password is acceptable
+func ValidatePassword(password string) error {
+	if len(password) < MinPasswordLength {
+		return fmt.Errorf("password must be at least %v characters",
+			MinPasswordLength)
+	}
+
+	if len(password) > MaxPasswordLength {
+		return fmt.Errorf("password can't be longer than %v bytes",
+			MaxPasswordLength)
+	}
+
+	return nil
+}
+
+// Session is a login session of a user. The session token is only known
+// by the client, and ID is its hash. Sessions expire if they are not used,
+// and can be refreshed until MaxExpires.
+type Session struct {
+	ID       string    `json:"-" boltholdKey:"ID"`
+	Username string    `json:"username" boltholdIndex:"Username"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	// MaxExpires is when the session expires even if it is used
+	MaxExpires time.Time `json:"maxExpires"`
+}
+
+// PasswordReset is a one time token that sets the password of a user. ID
+// is the hash of the token.
+type PasswordReset struct {
+	ID       string    `json:"-" boltholdKey:"ID"`
+	Username string    `json:"username" boltholdIndex:"Username"`
+	Expires  time.Time `json:"expires"`
+}
@@ -0,0 +1,108 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+)
+
+// VirtualPoint is a sample type computed from other samples of a device,
+// like power from voltage and current. It is recalculated when one of its
+// inputs is written, and stored like samples from the device.
+type VirtualPoint struct {
+	// Type and ID of the computed sample
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+	// Inputs are the samples the point is computed from. The point is
+	// only computed once all of the inputs have values.
+	Inputs []VirtualInput `json:"inputs"`
+	// Table maps the value of the first input to the point value, with
+	// linear interpolation between entries, like a tank strapping table
+	// that maps level to volume
+	Table []TableEntry `json:"table,omitempty"`
+	// Expression is a script expression that computes the value, like
+	// "sample('voltage') * sample('current')". If there is a table, value
+	// is the table result, otherwise it is the value of the first input.
+	Expression string `json:"expression,omitempty"`
+}
+
+// VirtualInput is a sample a virtual point is computed from
+type VirtualInput struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+}
+
+// TableEntry maps an input value to an output value
+type TableEntry struct {
+	In  float64 `json:"in"`
+	Out float64 `json:"out"`
+}
+
+// Matches returns true if a sample is an input of the point
+func (p VirtualPoint) Matches(s Sample) bool {
+	for _, in := range p.Inputs {
+		if s.Type == in.Type && s.ID == in.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// Interpolate looks up a value in the table. Values outside of the table
+// are limited to the first and last entries.
+func (p VirtualPoint) Interpolate(v float64) float64 {
+	t := p.Table
+	if len(t) == 0 {
+		return v
+	}
+
+	if v <= t[0].In {
+		return t[0].Out
+	}
+
+	for i := 1; i < len(t); i++ {
+		if v <= t[i].In {
+			f := (v - t[i-1].In) / (t[i].In - t[i-1].In)
+			return t[i-1].Out + f*(t[i].Out-t[i-1].Out)
+		}
+	}
+
+	return t[len(t)-1].Out
+}
+
+// Validate checks the virtual point is valid. Expressions are checked by
+// the script package.
+func (p VirtualPoint) Validate() error {
+	if p.Type == "" {
+		return errors.New("virtual point type is required")
+	}
+
+	if len(p.Inputs) == 0 {
+		return fmt.Errorf("virtual point %v inputs are required", p.Type)
+	}
+
+	for _, in := range p.Inputs {
+		if in.Type == "" {
+			return fmt.Errorf("virtual point %v input type is required", p.Type)
+		}
+
+		if in.Type == p.Type && in.ID == p.ID {
+			return fmt.Errorf("virtual point %v can't be its own input", p.Type)
+		}
+	}
+
+	if len(p.Table) == 0 && p.Expression == "" {
+		return fmt.Errorf("virtual point %v needs a table or expression", p.Type)
+	}
+
+	if len(p.Table) == 1 {
+		return fmt.Errorf("virtual point %v table needs at least 2 entries", p.Type)
+	}
+
+	for i := 1; i < len(p.Table); i++ {
+		if p.Table[i].In <= p.Table[i-1].In {
+			return fmt.Errorf("virtual point %v table inputs must increase", p.Type)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package data
+
+import (
+	"math"
+	"testing"
+)
+
+func TestVirtualPointInterpolate(t *testing.T) {
+	// horizontal cylinder tank, level in inches to gallons
+	p := VirtualPoint{
+		Type:   "volume",
+		Inputs: []VirtualInput{{Type: "level"}},
+		Table: []TableEntry{
+			{0, 0},
+			{12, 150},
+			{24, 500},
+			{48, 1000},
+		},
+	}
+
+	err := p.Validate()
+	if err != nil {
+		t.Fatal("Error validating: ", err)
+	}
+
+	for _, test := range []struct{ v, exp float64 }{
+		{-1, 0},
+		{6, 75},
+		{12, 150},
+		{36, 750},
+		{60, 1000},
+	} {
+		v := p.Interpolate(test.v)
+		if math.Abs(v-test.exp) > 0.0001 {
+			t.Errorf("%v interpolated to %v, expected %v", test.v, v, test.exp)
+		}
+	}
+
+	for _, bad := range []VirtualPoint{
+		{Inputs: []VirtualInput{{Type: "level"}}, Expression: "value"},
+		{Type: "volume", Expression: "value"},
+		{Type: "volume", Inputs: []VirtualInput{{Type: "level"}}},
+		{Type: "volume", Inputs: []VirtualInput{{Type: "volume"}}, Expression: "value"},
+		{Type: "volume", Inputs: []VirtualInput{{Type: "level"}},
+			Table: []TableEntry{{0, 0}, {0, 1}}},
+	} {
+		if bad.Validate() == nil {
+			t.Errorf("expected error validating %+v", bad)
+		}
+	}
+}
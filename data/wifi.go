@@ -0,0 +1,29 @@
+package data
+
+import "errors"
+
+// WifiConfig is the network a WiFi client connects to
+type WifiConfig struct {
+	SSID string `json:"ssid"`
+	// Psk is the WPA passphrase. If blank, the network is open.
+	Psk string `json:"psk,omitempty"`
+}
+
+// Validate checks the WiFi config is valid
+func (c WifiConfig) Validate() error {
+	if len(c.SSID) < 1 || len(c.SSID) > 32 {
+		return errors.New("SSID must be 1 to 32 characters")
+	}
+
+	if c.Psk != "" && (len(c.Psk) < 8 || len(c.Psk) > 63) {
+		return errors.New("passphrase must be 8 to 63 characters")
+	}
+
+	for _, s := range []string{c.SSID, c.Psk} {
+		if reCredential.MatchString(s) {
+			return errors.New("SSID and passphrase can't contain quotes or newlines")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,24 @@
+package data
+
+import "testing"
+
+func TestWifiConfigValidate(t *testing.T) {
+	cases := []struct {
+		config WifiConfig
+		valid  bool
+	}{
+		{WifiConfig{SSID: "shop floor"}, true},
+		{WifiConfig{SSID: "shop floor", Psk: "12345678"}, true},
+		{WifiConfig{}, false},
+		{WifiConfig{SSID: "012345678901234567890123456789012"}, false},
+		{WifiConfig{SSID: "a", Psk: "short"}, false},
+		{WifiConfig{SSID: `a"`, Psk: "12345678"}, false},
+		{WifiConfig{SSID: "a", Psk: "12345678\nnetwork"}, false},
+	}
+
+	for _, c := range cases {
+		if err := c.config.Validate(); (err == nil) != c.valid {
+			t.Errorf("%+v: expected valid %v, got %v", c.config, c.valid, err)
+		}
+	}
+}
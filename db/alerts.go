@@ -0,0 +1,214 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+)
+
+// ErrAlertCleared is returned when acknowledging a cleared alert
+var ErrAlertCleared = errors.New("alert is cleared")
+
+// Alerts returns the alerts in a state, or all alerts if state is blank,
+// newest first
+func (db *Db) Alerts(state string) (ret []data.Alert, err error) {
+	defer db.metrics.observe("Alerts", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var query *bolthold.Query
+	if state != "" {
+		query = bolthold.Where("State").Eq(state)
+	}
+
+	err = db.store.Find(&ret, query)
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID > ret[j].ID })
+	return
+}
+
+// Alert returns an alert. Returns bolthold.ErrNotFound if it does not
+// exist.
+func (db *Db) Alert(id uint64) (ret data.Alert, err error) {
+	defer db.metrics.observe("Alert", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Get(id, &ret)
+	ret.ID = id
+	return
+}
+
+// alertSave stores an alert and sends a change event
+func (txn *Txn) alertSave(alert *data.Alert, insert bool) error {
+	var err error
+	if insert {
+		err = txn.db.store.TxInsert(txn.tx, bolthold.NextSequence(), alert)
+	} else {
+		err = txn.db.store.TxUpdate(txn.tx, alert.ID, alert)
+	}
+	if err != nil {
+		return err
+	}
+
+	txn.db.feed.publishOnCommit(txn.tx, Event{
+		Type:     EventAlertChanged,
+		DeviceID: alert.DeviceID,
+		Alert:    alert,
+	})
+
+	return nil
+}
+
+// alertEvent records a change of the state of an alert in the timeline of
+// its device, if it has one
+func (txn *Txn) alertEvent(alert *data.Alert, typ data.EventType, t time.Time) error {
+	if alert.DeviceID == "" {
+		return nil
+	}
+
+	msg := alert.Message
+	if msg == "" {
+		msg = alert.Description
+	}
+
+	level := data.EventLevelInfo
+	if typ == data.EventTypeAlertRaised {
+		level = data.EventLevelFault
+	} else if typ == data.EventTypeAlertAcknowledged && alert.AckedBy != "" {
+		msg += " (by " + alert.AckedBy + ")"
+	}
+
+	return txn.DeviceEventAppend(data.Event{
+		DeviceID: alert.DeviceID,
+		Time:     t,
+		Type:     typ,
+		Level:    level,
+		Message:  msg,
+	})
+}
+
+// AlertRaise creates an active alert. The ID is set and the alert is
+// returned.
+func (db *Db) AlertRaise(alert data.Alert) (ret data.Alert, err error) {
+	defer db.metrics.observe("AlertRaise", time.Now(), &err)
+
+	alert.ID = 0
+	alert.State = data.AlertActive
+	alert.Level = 0
+	if alert.Raised.IsZero() {
+		alert.Raised = time.Now()
+	}
+	alert.Notified = alert.Raised
+
+	err = db.update(func(txn *Txn) error {
+		err := txn.alertSave(&alert, true)
+		if err != nil {
+			return err
+		}
+
+		return txn.alertEvent(&alert, data.EventTypeAlertRaised, alert.Raised)
+	})
+
+	return alert, err
+}
+
+// AlertNotified records that notifications were sent for an alert, and the
+// escalation level it reached. It is used by the rules engine.
+func (db *Db) AlertNotified(id uint64, level int, notified time.Time) (err error) {
+	defer db.metrics.observe("AlertNotified", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		var alert data.Alert
+		err := txn.db.store.TxGet(txn.tx, id, &alert)
+		if err != nil {
+			return err
+		}
+		alert.ID = id
+
+		alert.Level = level
+		alert.Notified = notified
+
+		return txn.alertSave(&alert, false)
+	})
+}
+
+// AlertAck acknowledges an active alert, so it is no longer notified
+// again or escalated. Acknowledging an acknowledged alert does nothing.
+// Returns bolthold.ErrNotFound if it does not exist, and ErrAlertCleared if
+// it is cleared.
+func (db *Db) AlertAck(id uint64, by string) (ret data.Alert, err error) {
+	defer db.metrics.observe("AlertAck", time.Now(), &err)
+
+	err = db.update(func(txn *Txn) error {
+		err := txn.db.store.TxGet(txn.tx, id, &ret)
+		if err != nil {
+			return err
+		}
+		ret.ID = id
+
+		switch ret.State {
+		case data.AlertAcknowledged:
+			return nil
+		case data.AlertCleared:
+			return ErrAlertCleared
+		}
+
+		ret.State = data.AlertAcknowledged
+		ret.Acked = time.Now()
+		ret.AckedBy = by
+
+		err = txn.alertSave(&ret, false)
+		if err != nil {
+			return err
+		}
+
+		return txn.alertEvent(&ret, data.EventTypeAlertAcknowledged, ret.Acked)
+	})
+
+	return
+}
+
+// AlertClear clears the open alerts of a rule. Cleared alerts expire
+// after the log TTL.
+func (db *Db) AlertClear(ruleID uint64, cleared time.Time) (err error) {
+	defer db.metrics.observe("AlertClear", time.Now(), &err)
+
+	ttl := db.options.logTTL()
+
+	return db.update(func(txn *Txn) error {
+		var alerts []data.Alert
+		err := txn.db.store.TxFind(txn.tx, &alerts,
+			bolthold.Where("RuleID").Eq(ruleID).Index("RuleID").
+				And("State").Ne(data.AlertCleared))
+		if err != nil {
+			return err
+		}
+
+		for _, a := range alerts {
+			// the event has a pointer to the alert
+			a := a
+			a.State = data.AlertCleared
+			a.Cleared = cleared
+			if ttl > 0 {
+				a.Expires = cleared.Add(ttl)
+			}
+
+			err := txn.alertSave(&a, false)
+			if err != nil {
+				return err
+			}
+
+			err = txn.alertEvent(&a, data.EventTypeAlertCleared, cleared)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"sort"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+)
+
+// Anomalies returns the anomalies of a device, or of all devices if id is
+// blank, newest first. If active is true, only active anomalies are
+// returned.
+func (db *Db) Anomalies(id string, active bool) (ret []data.Anomaly, err error) {
+	defer db.metrics.observe("Anomalies", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var query *bolthold.Query
+	if id != "" {
+		query = bolthold.Where("DeviceID").Eq(id).Index("DeviceID")
+	}
+
+	var all []data.Anomaly
+	err = db.store.Find(&all, query)
+	for _, a := range all {
+		if !active || a.Active() {
+			ret = append(ret, a)
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID > ret[j].ID })
+	return
+}
+
+func (txn *Txn) anomalySave(a *data.Anomaly, insert bool) error {
+	var err error
+	if insert {
+		err = txn.db.store.TxInsert(txn.tx, bolthold.NextSequence(), a)
+	} else {
+		err = txn.db.store.TxUpdate(txn.tx, a.ID, a)
+	}
+	if err != nil {
+		return err
+	}
+
+	txn.db.feed.publishOnCommit(txn.tx, Event{
+		Type:     EventAnomalyChanged,
+		DeviceID: a.DeviceID,
+		Anomaly:  a,
+	})
+
+	return nil
+}
+
+// AnomalyStart records an active anomaly. The ID is set and the anomaly is
+// returned.
+func (db *Db) AnomalyStart(a data.Anomaly) (ret data.Anomaly, err error) {
+	defer db.metrics.observe("AnomalyStart", time.Now(), &err)
+
+	a.ID = 0
+	a.End = time.Time{}
+	a.Expires = time.Time{}
+	if a.Start.IsZero() {
+		a.Start = time.Now()
+	}
+
+	err = db.update(func(txn *Txn) error {
+		return txn.anomalySave(&a, true)
+	})
+
+	return a, err
+}
+
+// AnomalyEnd records that the values of an anomaly returned to the
+// baseline. Ended anomalies expire after the log TTL.
+func (db *Db) AnomalyEnd(id uint64, end time.Time) (err error) {
+	defer db.metrics.observe("AnomalyEnd", time.Now(), &err)
+
+	ttl := db.options.logTTL()
+
+	return db.update(func(txn *Txn) error {
+		var a data.Anomaly
+		err := txn.db.store.TxGet(txn.tx, id, &a)
+		if err != nil {
+			return err
+		}
+
+		if !a.Active() {
+			return nil
+		}
+
+		a.ID = id
+		a.End = end
+		if ttl > 0 {
+			a.Expires = end.Add(ttl)
+		}
+
+		return txn.anomalySave(&a, false)
+	})
+}
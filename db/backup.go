@@ -0,0 +1,144 @@
+package db
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Backup writes a consistent snapshot of the database to w. The database
+// remains available for reads and writes while the backup is running.
+func (db *Db) Backup(w io.Writer) error {
+	return db.BackupTo(w, nil)
+}
+
+// BackupTo is like Backup, but if size is not nil, it is called with the
+// size of the snapshot before anything is written, so it can be used to set
+// a Content-Length. The size and snapshot come from the same transaction.
+func (db *Db) BackupTo(w io.Writer, size func(int64)) (err error) {
+	defer db.metrics.observe("Backup", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.store.Bolt().View(func(tx *bolt.Tx) error {
+		if size != nil {
+			size(tx.Size())
+		}
+
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// Restore replaces the database with the backup read from r. The backup
+// is validated before the current database is replaced. If the database is
+// encrypted, the backup must have been made with the same key.
+func (db *Db) Restore(r io.Reader) (err error) {
+	defer db.metrics.observe("Restore", time.Now(), &err)
+
+	tmp, err := ioutil.TempFile(path.Dir(db.dbFile), "restore-")
+	if err != nil {
+		return err
+	}
+
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	err = validateDbFile(tmpName, db.options)
+	if err != nil {
+		return err
+	}
+
+	return db.replace(tmpName)
+}
+
+// validateDbFile makes sure a file is a valid bolt database that can be
+// read with options
+func validateDbFile(file string, options *Options) error {
+	store, err := openStore(file, options)
+	if err != nil {
+		return err
+	}
+
+	defer store.Close()
+
+	return store.Bolt().View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			return errors.New("backup is corrupt: " + err.Error())
+		}
+		return nil
+	})
+}
+
+// replace closes the current store, moves file into its place, and reopens
+// the store.
+func (db *Db) replace(file string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.replaceLocked(file)
+}
+
+// replaceLocked is the same as replace, but the caller must hold the write
+// lock.
+func (db *Db) replaceLocked(file string) error {
+	invalidate := db.cacheDeviceIDs()
+	defer func() {
+		for _, id := range append(invalidate, db.cacheDeviceIDs()...) {
+			db.cacheDeleteDevice(id)
+		}
+	}()
+
+	err := db.store.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(file, db.dbFile)
+	if err != nil {
+		// try to get the old database back up
+		store, errOpen := openStore(db.dbFile, db.options)
+		if errOpen == nil {
+			db.store = store
+		}
+		return err
+	}
+
+	store, err := openStore(db.dbFile, db.options)
+	if err != nil {
+		return err
+	}
+
+	db.store = store
+
+	// backup may be from an older version of the application
+	err = migrate(store, db.index)
+	if err != nil {
+		return err
+	}
+
+	err = db.latest.load(store)
+	if err != nil {
+		return err
+	}
+
+	db.series.reset()
+
+	return db.usage.load(store, db.options)
+}
@@ -0,0 +1,59 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+)
+
+// batchMark records the last sample batch written for a device
+type batchMark struct {
+	DeviceID string `boltholdKey:"DeviceID"`
+	Store    string
+	Seq      uint64
+}
+
+// DeviceBatch writes a batch of samples from a device backlog. Batches
+// are written in order, so a batch is skipped if its sequence number is
+// not greater than the last batch from the same store. The samples that
+// were written are returned.
+func (db *Db) DeviceBatch(id string, batch data.SampleBatch) (ret []data.Sample, err error) {
+	defer db.metrics.observe("DeviceBatch", time.Now(), &err)
+
+	if batch.Store == "" {
+		return nil, errors.New("batch store is required")
+	}
+
+	err = db.update(func(txn *Txn) error {
+		ret = nil
+
+		var mark batchMark
+		err := txn.db.store.TxGet(txn.tx, id, &mark)
+		if err != nil && err != bolthold.ErrNotFound {
+			return err
+		}
+
+		// a new store, like after the device was reset, starts over
+		if err == nil && mark.Store == batch.Store && batch.Seq <= mark.Seq {
+			return nil
+		}
+
+		for _, s := range batch.Samples {
+			written, err := txn.deviceSample(id, s)
+			if err != nil {
+				return err
+			}
+
+			if written {
+				ret = append(ret, s)
+			}
+		}
+
+		mark = batchMark{DeviceID: id, Store: batch.Store, Seq: batch.Seq}
+		return txn.db.store.TxUpsert(txn.tx, id, &mark)
+	})
+
+	return
+}
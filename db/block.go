@@ -0,0 +1,138 @@
+package db
+
+import (
+	"sort"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/series"
+	"github.com/timshannon/bolthold"
+	bolt "go.etcd.io/bbolt"
+)
+
+// sampleBlock stores compressed raw samples for one device IO over a block
+// window. Only the time (ms resolution) and value of each sample are kept.
+type sampleBlock struct {
+	DeviceID string `boltholdIndex:"DeviceID"`
+	Type     string
+	ID       string
+	// Start is the start of the block window, and End is the time of the
+	// last sample in the block
+	Start time.Time
+	End   time.Time
+	Count int
+	Data  []byte
+}
+
+// blockWindow is the time span of each compressed block
+const blockWindow = time.Hour
+
+func blockKey(deviceID string, s data.Sample, start time.Time) string {
+	return deviceID + "/" + s.Type + "/" + s.ID + "/" +
+		start.UTC().Format(time.RFC3339)
+}
+
+// samples returns the decoded samples in the block
+func (b *sampleBlock) samples() ([]data.Sample, error) {
+	points, err := series.Decode(b.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]data.Sample, len(points))
+	for i, p := range points {
+		ret[i] = data.Sample{
+			Type:  b.Type,
+			ID:    b.ID,
+			Time:  p.Time,
+			Value: p.Value,
+		}
+	}
+
+	return ret, nil
+}
+
+// txBlockAppend compresses raw records into blocks. Records are merged
+// with any samples already in the blocks.
+func (db *Db) txBlockAppend(tx *bolt.Tx, records []sampleRecord) error {
+	pending := make(map[string][]data.Sample)
+	blocks := make(map[string]*sampleBlock)
+
+	for _, r := range records {
+		start := r.Time.Truncate(blockWindow)
+		key := blockKey(r.DeviceID, r.Sample, start)
+
+		if _, ok := blocks[key]; !ok {
+			b := &sampleBlock{}
+			err := db.store.TxGet(tx, key, b)
+			if err == bolthold.ErrNotFound {
+				b.DeviceID = r.DeviceID
+				b.Type = r.Sample.Type
+				b.ID = r.Sample.ID
+				b.Start = start
+			} else if err != nil {
+				return err
+			} else {
+				existing, err := b.samples()
+				if err != nil {
+					return err
+				}
+				pending[key] = existing
+			}
+			blocks[key] = b
+		}
+
+		pending[key] = append(pending[key], r.Sample)
+	}
+
+	for key, b := range blocks {
+		samples := pending[key]
+		sort.SliceStable(samples, func(i, j int) bool {
+			return samples[i].Time.Before(samples[j].Time)
+		})
+
+		enc := series.NewEncoder()
+		for _, s := range samples {
+			enc.Append(s.Time, s.Value)
+		}
+
+		b.Data = enc.Bytes()
+		b.Count = enc.Count()
+		b.End = samples[len(samples)-1].Time
+
+		err := db.store.TxUpsert(tx, key, b)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// blockHistory returns the compressed samples for a device between start
+// and end
+func (db *Db) blockHistory(id string, start, end time.Time) ([]data.Sample, error) {
+	var blocks []sampleBlock
+	err := db.store.Find(&blocks, bolthold.Where("DeviceID").Eq(id).
+		And("Start").Lt(end).And("End").Ge(start))
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []data.Sample
+
+	for _, b := range blocks {
+		samples, err := b.samples()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, s := range samples {
+			if !s.Time.Before(start) && s.Time.Before(end) {
+				ret = append(ret, s)
+			}
+		}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+)
+
+// ErrInvalidCert is returned when a device certificate was not issued by
+// this server, was revoked, or belongs to another device
+var ErrInvalidCert = errors.New("invalid device certificate")
+
+func (txn *Txn) deviceCertInsert(cert *data.DeviceCert) error {
+	if cert.Serial == "" || cert.DeviceID == "" {
+		return errors.New("certificate serial and device ID are required")
+	}
+
+	cert.Created = time.Now()
+	cert.Revoked = time.Time{}
+	return txn.db.store.TxInsert(txn.tx, cert.Serial, cert)
+}
+
+// DeviceCertInsert records a certificate issued to a device
+func (db *Db) DeviceCertInsert(cert data.DeviceCert) (err error) {
+	defer db.metrics.observe("DeviceCertInsert", time.Now(), &err)
+	return db.update(func(txn *Txn) error {
+		return txn.deviceCertInsert(&cert)
+	})
+}
+
+// DeviceCerts returns the certificates issued to a device that have not
+// expired
+func (db *Db) DeviceCerts(id string) (ret []data.DeviceCert, err error) {
+	defer db.metrics.observe("DeviceCerts", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Find(&ret, bolthold.Where("DeviceID").Eq(id).
+		Index("DeviceID").SortBy("Created"))
+	return
+}
+
+// DeviceCertRevoke revokes a certificate. Returns bolthold.ErrNotFound if
+// it does not exist.
+func (db *Db) DeviceCertRevoke(serial string) (err error) {
+	defer db.metrics.observe("DeviceCertRevoke", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		var cert data.DeviceCert
+		err := txn.db.store.TxGet(txn.tx, serial, &cert)
+		if err != nil {
+			return err
+		}
+
+		if !cert.Revoked.IsZero() {
+			return nil
+		}
+
+		cert.Revoked = time.Now()
+		err = txn.db.store.TxUpdate(txn.tx, serial, &cert)
+		if err != nil {
+			return err
+		}
+
+		return txn.AuditAppend(data.AuditRecord{
+			DeviceID: cert.DeviceID,
+			Action:   "certRevoke",
+			Message:  serial,
+		})
+	})
+}
+
+// DeviceCertAuth checks that a certificate was issued to a device by this
+// server and has not been revoked. Returns ErrInvalidCert if not.
+func (db *Db) DeviceCertAuth(serial, deviceID string) (err error) {
+	defer db.metrics.observe("DeviceCertAuth", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var cert data.DeviceCert
+	err = db.store.Get(serial, &cert)
+	if err == bolthold.ErrNotFound {
+		return ErrInvalidCert
+	} else if err != nil {
+		return err
+	}
+
+	if cert.DeviceID != deviceID || !cert.Revoked.IsZero() ||
+		!time.Now().Before(cert.Expires) {
+		return ErrInvalidCert
+	}
+
+	return nil
+}
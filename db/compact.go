@@ -0,0 +1,319 @@
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrCompactRunning is returned if a compaction is requested while one is
+// already running
+var ErrCompactRunning = errors.New("compaction already running")
+
+var errCompactRollback = errors.New("compaction source rollback")
+
+// CompactStatus describes the current or last compaction
+type CompactStatus struct {
+	Running bool `json:"running"`
+	// KeysCopied and BytesCopied report the progress of the current (or
+	// last) compaction. BytesCopied can be compared to SizeBefore.
+	KeysCopied   int64         `json:"keysCopied"`
+	BytesCopied  int64         `json:"bytesCopied"`
+	LastRun      time.Time     `json:"lastRun,omitempty"`
+	LastDuration time.Duration `json:"lastDuration"`
+	SizeBefore   int64         `json:"sizeBefore"`
+	SizeAfter    int64         `json:"sizeAfter"`
+	LastError    string        `json:"lastError,omitempty"`
+}
+
+// compactState tracks compaction status. It is separate from the db lock
+// so status can be read while a compaction is running.
+type compactState struct {
+	lock   sync.Mutex
+	status CompactStatus
+}
+
+func (c *compactState) update(fn func(s *CompactStatus)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	fn(&c.status)
+}
+
+// CompactStatus returns the status of the current or last compaction
+func (db *Db) CompactStatus() CompactStatus {
+	db.compact.lock.Lock()
+	defer db.compact.lock.Unlock()
+	return db.compact.status
+}
+
+// Fragmentation returns the fraction of the database file that is free
+// pages. Bolt never shrinks the file, so after large deletes (sample
+// pruning, etc) this can get large.
+func (db *Db) Fragmentation() (float64, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	stats := db.store.Bolt().Stats()
+
+	var size int64
+	err := db.store.Bolt().View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+
+	if err != nil || size <= 0 {
+		return 0, err
+	}
+
+	return float64(stats.FreeAlloc) / float64(size), nil
+}
+
+// Compact copies the database to a new file, which drops all free pages,
+// and then swaps the new file in place of the current one. All db
+// operations are blocked while the compaction is running.
+func (db *Db) Compact() (err error) {
+	defer db.metrics.observe("Compact", time.Now(), &err)
+
+	db.compact.lock.Lock()
+	if db.compact.status.Running {
+		db.compact.lock.Unlock()
+		return ErrCompactRunning
+	}
+
+	start := time.Now()
+	db.compact.status = CompactStatus{
+		Running: true,
+		LastRun: start,
+	}
+	db.compact.lock.Unlock()
+
+	defer func() {
+		db.compact.update(func(s *CompactStatus) {
+			s.Running = false
+			s.LastDuration = time.Since(start)
+			if err != nil {
+				s.LastError = err.Error()
+			}
+		})
+	}()
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	tmp, err := ioutil.TempFile(path.Dir(db.dbFile), "compact-")
+	if err != nil {
+		return err
+	}
+
+	tmpName := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpName)
+
+	dst, err := bolt.Open(tmpName, 0666, nil)
+	if err != nil {
+		return err
+	}
+
+	// the source is copied in a write tx that is always rolled back -- see
+	// copySequence
+	err = db.store.Bolt().Update(func(tx *bolt.Tx) error {
+		size := tx.Size()
+		db.compact.update(func(s *CompactStatus) {
+			s.SizeBefore = size
+		})
+
+		err := dst.Update(func(dtx *bolt.Tx) error {
+			return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				nb, err := dtx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return db.compactBucket(nb, b)
+			})
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return errCompactRollback
+	})
+
+	if err != errCompactRollback {
+		dst.Close()
+		return err
+	}
+
+	err = dst.Close()
+	if err != nil {
+		return err
+	}
+
+	err = db.replaceLocked(tmpName)
+	if err != nil {
+		return err
+	}
+
+	return db.store.Bolt().View(func(tx *bolt.Tx) error {
+		size := tx.Size()
+		db.compact.update(func(s *CompactStatus) {
+			s.SizeAfter = size
+		})
+		return nil
+	})
+}
+
+// compactBucketProgressKeys is how often (in keys) progress is updated
+const compactBucketProgressKeys = 1000
+
+// copySequence sets the dst bucket sequence to the src bucket sequence so
+// sequence keys are not reused. This version of bolt does not have
+// Bucket.Sequence or SetSequence, so the sequence is read by incrementing
+// it in src (the source tx must be rolled back) and then replayed in dst.
+// NextSequence only increments a counter in memory, so this is cheap.
+func copySequence(dst, src *bolt.Bucket) error {
+	seq, err := src.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(1); i < seq; i++ {
+		_, err := dst.NextSequence()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compactBucket recursively copies all keys and nested buckets from src to
+// dst.
+func (db *Db) compactBucket(dst, src *bolt.Bucket) error {
+	err := copySequence(dst, src)
+	if err != nil {
+		return err
+	}
+
+	var keys, bytes int64
+
+	err = src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			// nested bucket
+			nb, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return db.compactBucket(nb, src.Bucket(k))
+		}
+
+		keys++
+		bytes += int64(len(k) + len(v))
+
+		if keys >= compactBucketProgressKeys {
+			db.compactProgress(keys, bytes)
+			keys, bytes = 0, 0
+		}
+
+		return dst.Put(k, v)
+	})
+
+	db.compactProgress(keys, bytes)
+
+	return err
+}
+
+func (db *Db) compactProgress(keys, bytes int64) {
+	db.compact.update(func(s *CompactStatus) {
+		s.KeysCopied += keys
+		s.BytesCopied += bytes
+	})
+}
+
+// Compactor runs in the background and compacts the db when the
+// fragmentation exceeds a threshold.
+type Compactor struct {
+	db        *Db
+	threshold float64
+	interval  time.Duration
+	window    func() bool
+	stop      chan struct{}
+}
+
+// NewCompactor creates a new compactor. The db is checked every interval
+// and compacted if more than threshold (0-1) of the file is free pages.
+func NewCompactor(db *Db, threshold float64, interval time.Duration) *Compactor {
+	return &Compactor{
+		db:        db,
+		threshold: threshold,
+		interval:  interval,
+		stop:      make(chan struct{}),
+	}
+}
+
+// Start runs the compactor in a goroutine until Stop is called
+func (c *Compactor) Start() {
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := c.Run()
+				if err != nil {
+					log.Println("Error compacting db: ", err)
+				}
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the compactor
+func (c *Compactor) Stop() {
+	close(c.stop)
+}
+
+// SetWindow limits compaction to times when open returns true, like
+// system.Maintenance.Open. It must be called before Start.
+func (c *Compactor) SetWindow(open func() bool) {
+	c.window = open
+}
+
+// Run compacts the db if the fragmentation is over the threshold and the
+// window is open
+func (c *Compactor) Run() error {
+	if c.window != nil && !c.window() {
+		return nil
+	}
+
+	frag, err := c.db.Fragmentation()
+	if err != nil {
+		return err
+	}
+
+	if frag < c.threshold {
+		return nil
+	}
+
+	log.Printf("db is %.0f%% free pages, compacting\n", frag*100)
+
+	err = c.db.Compact()
+	if err != nil {
+		return err
+	}
+
+	status := c.db.CompactStatus()
+	log.Printf("db compacted from %v to %v bytes in %v\n",
+		status.SizeBefore, status.SizeAfter, status.LastDuration)
+
+	return nil
+}
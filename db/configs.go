@@ -0,0 +1,160 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+)
+
+// configSnapshotLimit is the number of config versions kept for each
+// device. Older versions are deleted.
+const configSnapshotLimit = 50
+
+// ErrConfigVersion is returned if a config version of a device does not
+// exist
+var ErrConfigVersion = errors.New("config version not found")
+
+// txConfigSnapshots returns the config versions of a device, oldest first
+func (txn *Txn) txConfigSnapshots(id string) ([]data.ConfigSnapshot, error) {
+	var ret []data.ConfigSnapshot
+	err := txn.db.store.TxFind(txn.tx, &ret, bolthold.Where("DeviceID").Eq(id).
+		Index("DeviceID").SortBy("Version"))
+	return ret, err
+}
+
+// configSnapshot records a new version of the config of a device. The
+// first time the config of a device changes, the old config is recorded as
+// well, so the device can be rolled back to it.
+func (txn *Txn) configSnapshot(old *data.Device, snap data.ConfigSnapshot) error {
+	id := old.ID
+
+	snaps, err := txn.txConfigSnapshots(id)
+	if err != nil {
+		return err
+	}
+
+	if len(snaps) == 0 {
+		first := data.ConfigSnapshot{
+			DeviceID: id,
+			Version:  1,
+			Time:     old.State.ConfigUpdated,
+			Config:   old.Config,
+		}
+		err := txn.db.store.TxInsert(txn.tx, bolthold.NextSequence(), &first)
+		if err != nil {
+			return err
+		}
+		snaps = append(snaps, first)
+	}
+
+	snap.DeviceID = id
+	snap.Version = snaps[len(snaps)-1].Version + 1
+	err = txn.db.store.TxInsert(txn.tx, bolthold.NextSequence(), &snap)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(snaps)+1-configSnapshotLimit; i++ {
+		err := txn.db.store.TxDelete(txn.tx, snaps[i].ID, data.ConfigSnapshot{})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ConfigRollback sets the config of a device to an earlier version. This is
+// recorded as a new version. Returns ErrConfigVersion if the version does
+// not exist.
+func (txn *Txn) ConfigRollback(id string, version int) error {
+	var snaps []data.ConfigSnapshot
+	err := txn.db.store.TxFind(txn.tx, &snaps, bolthold.Where("DeviceID").Eq(id).
+		Index("DeviceID").And("Version").Eq(version))
+	if err != nil {
+		return err
+	}
+
+	if len(snaps) == 0 {
+		return ErrConfigVersion
+	}
+
+	return txn.deviceUpdateConfig(id, snaps[0].Config,
+		fmt.Sprintf("rollback to version %v", version))
+}
+
+// GroupConfigRollback sets the config of each device in a group to the
+// version it had at a time, like right before a bad config was pushed to
+// the group. Devices whose config did not change since, or that have no
+// version from before the time, are skipped. Returns the IDs of the
+// devices that were rolled back.
+func (txn *Txn) GroupConfigRollback(group string, t time.Time) ([]string, error) {
+	var ids []string
+	for id := range txn.db.index.lookup(txn.tx, indexGroup, group) {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	ret := []string{}
+
+	for _, id := range ids {
+		snaps, err := txn.txConfigSnapshots(id)
+		if err != nil {
+			return nil, err
+		}
+
+		i := sort.Search(len(snaps), func(i int) bool {
+			return snaps[i].Time.After(t)
+		})
+		if i == 0 || i == len(snaps) {
+			continue
+		}
+
+		err = txn.ConfigRollback(id, snaps[i-1].Version)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, id)
+	}
+
+	return ret, nil
+}
+
+// ConfigSnapshots returns the config versions of a device, oldest first
+func (db *Db) ConfigSnapshots(id string) (ret []data.ConfigSnapshot, err error) {
+	defer db.metrics.observe("ConfigSnapshots", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Find(&ret, bolthold.Where("DeviceID").Eq(id).Index("DeviceID").
+		SortBy("Version"))
+	return
+}
+
+// ConfigSnapshot returns a config version of a device. Returns
+// ErrConfigVersion if it does not exist.
+func (db *Db) ConfigSnapshot(id string, version int) (ret data.ConfigSnapshot, err error) {
+	defer db.metrics.observe("ConfigSnapshot", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var snaps []data.ConfigSnapshot
+	err = db.store.Find(&snaps, bolthold.Where("DeviceID").Eq(id).Index("DeviceID").
+		And("Version").Eq(version))
+	if err != nil {
+		return
+	}
+
+	if len(snaps) == 0 {
+		return ret, ErrConfigVersion
+	}
+
+	return snaps[0], nil
+}
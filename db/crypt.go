@@ -0,0 +1,220 @@
+package db
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"strings"
+
+	"github.com/timshannon/bolthold"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrDecrypt is returned if data in the store can't be decrypted. This
+// typically means the wrong key is being used, or encryption is being
+// enabled on a database that was created without encryption.
+var ErrDecrypt = errors.New("error decrypting data, is the encryption key correct?")
+
+// KeySize is the size of the db encryption key
+const KeySize = 32
+
+const encryptedVersion = 1
+
+// cryptCodec encrypts all values and keys written to the store with
+// AES-GCM. The nonce is derived from an HMAC of the plaintext (SIV style)
+// so the same plaintext always encrypts to the same ciphertext. This is
+// required so that bolthold key lookups and indexes continue to work,
+// at the cost of revealing when two records have identical contents.
+type cryptCodec struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+func deriveKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func newCryptCodec(key []byte) (*cryptCodec, error) {
+	if len(key) != KeySize {
+		return nil, errors.New("encryption key must be 32 bytes")
+	}
+
+	block, err := aes.NewCipher(deriveKey(key, "siot-db-encrypt"))
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cryptCodec{
+		aead:     aead,
+		nonceKey: deriveKey(key, "siot-db-nonce"),
+	}, nil
+}
+
+func (c *cryptCodec) encode(value interface{}) ([]byte, error) {
+	plain, err := bolthold.DefaultEncode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, c.nonceKey)
+	mac.Write(plain)
+	nonce := mac.Sum(nil)[:c.aead.NonceSize()]
+
+	ret := append([]byte{encryptedVersion}, nonce...)
+	return c.aead.Seal(ret, nonce, plain, nil), nil
+}
+
+func (c *cryptCodec) decode(data []byte, value interface{}) error {
+	ns := c.aead.NonceSize()
+	if len(data) < 1+ns || data[0] != encryptedVersion {
+		return ErrDecrypt
+	}
+
+	nonce := data[1 : 1+ns]
+	plain, err := c.aead.Open(nil, nonce, data[1+ns:], nil)
+	if err != nil {
+		return ErrDecrypt
+	}
+
+	return bolthold.DefaultDecode(plain, value)
+}
+
+var metaBucket = []byte("meta")
+var encodingCheckKey = []byte("encodingCheck")
+
+const encodingCheckValue = "simpleiot"
+
+// checkEncoding verifies that the store was created with the same
+// encoding (encryption key) as we are opening it with. A check value is
+// written the first time a store is opened.
+func checkEncoding(tx *bolt.Tx, encrypted bool, encode bolthold.EncodeFunc, decode bolthold.DecodeFunc) error {
+	err := verifyEncoding(tx, encrypted, decode)
+	if err != nil {
+		return err
+	}
+
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+
+	if meta.Get(encodingCheckKey) != nil {
+		return nil
+	}
+
+	data, err := encode(encodingCheckValue)
+	if err != nil {
+		return err
+	}
+
+	return meta.Put(encodingCheckKey, data)
+}
+
+// verifyEncoding is like checkEncoding, but does not write the check value,
+// so it can be used in a read only transaction
+func verifyEncoding(tx *bolt.Tx, encrypted bool, decode bolthold.DecodeFunc) error {
+	var check []byte
+	if meta := tx.Bucket(metaBucket); meta != nil {
+		check = meta.Get(encodingCheckKey)
+	}
+
+	if check == nil {
+		// databases created before the check value was added are not
+		// encrypted, so encryption can't be enabled for them
+		empty := true
+		tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if !bytes.Equal(name, metaBucket) {
+				empty = false
+			}
+			return nil
+		})
+
+		if !empty && encrypted {
+			return ErrDecrypt
+		}
+
+		return nil
+	}
+
+	var v string
+	err := decode(check, &v)
+	if err != nil || v != encodingCheckValue {
+		return ErrDecrypt
+	}
+
+	return nil
+}
+
+// codec returns the encode/decode functions for the db options
+func (o *Options) codec() (bolthold.EncodeFunc, bolthold.DecodeFunc, error) {
+	if o == nil || o.EncryptionKey == nil {
+		return bolthold.DefaultEncode, bolthold.DefaultDecode, nil
+	}
+
+	c, err := newCryptCodec(o.EncryptionKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c.encode, c.decode, nil
+}
+
+// boltholdOptions returns the bolthold options for the db options
+func (o *Options) boltholdOptions() (*bolthold.Options, error) {
+	encode, decode, err := o.codec()
+	if err != nil {
+		return nil, err
+	}
+
+	return &bolthold.Options{
+		Encoder: encode,
+		Decoder: decode,
+	}, nil
+}
+
+// ParseKey parses a hex encoded encryption key
+func ParseKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.New("encryption key must be hex encoded")
+	}
+
+	if len(key) != KeySize {
+		return nil, errors.New("encryption key must be 32 bytes (64 hex characters)")
+	}
+
+	return key, nil
+}
+
+// DecodeKey decodes an encryption key that is either the raw 32 byte key,
+// or the key hex encoded.
+func DecodeKey(key []byte) ([]byte, error) {
+	if len(key) == KeySize {
+		return key, nil
+	}
+
+	return ParseKey(string(bytes.TrimSpace(key)))
+}
+
+// ReadKeyFile reads an encryption key from a file. The file can contain
+// either the raw 32 byte key, or the key hex encoded.
+func ReadKeyFile(file string) ([]byte, error) {
+	key, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeKey(key)
+}
@@ -1,87 +1,343 @@
 package db
 
 import (
+	"os"
 	"path"
+	"reflect"
+	"sync"
+	"time"
 
 	"github.com/simpleiot/simpleiot/data"
 	"github.com/timshannon/bolthold"
+	bolt "go.etcd.io/bbolt"
 )
 
 // Db is used for all db access in the application.
 // We will eventually turn this into an interface to
 // handle multiple Db backends.
 type Db struct {
+	dbFile  string
+	options *Options
+	metrics *Metrics
+	feed    feed
+	latest  latestCache
+	compact compactState
+	cache   Cache
+	dedup   dedup
+	usage   usageState
+	series  seriesCache
+	// readOnly is protected by lock
+	readOnly bool
+	// lock is held for reading by all db operations, and for writing
+	// when the underlying store is being swapped out (restore, etc)
+	lock  sync.RWMutex
 	store *bolthold.Store
+	index *deviceIndex
 }
 
-// NewDb creates a new Db instance for the app
-func NewDb(dataDir string) (*Db, error) {
-	dbFile := path.Join(dataDir, "data.db")
-	store, err := bolthold.Open(dbFile, 0666, nil)
+func dbPath(dataDir string) string {
+	return path.Join(dataDir, "data.db")
+}
+
+// Exists returns true if a database has been created in dataDir
+func Exists(dataDir string) bool {
+	_, err := os.Stat(dbPath(dataDir))
+	return err == nil
+}
+
+// Options is used to specify Db options. A nil *Options can be used for
+// the defaults.
+type Options struct {
+	// EncryptionKey is used to encrypt the database. Must be KeySize bytes
+	// long. If nil, the database is not encrypted.
+	EncryptionKey []byte
+	// CommandTTL is how long queued commands are kept if they don't have
+	// an expiration time set. Zero means commands don't expire.
+	CommandTTL time.Duration
+	// LogTTL is how long device log entries, support archives, uploaded
+	// files, and cleared alerts are kept. Zero means they don't expire.
+	LogTTL time.Duration
+	// UsageLimits limits the sample history stored for each device and
+	// group. Samples that would exceed a limit are rejected with
+	// ErrUsageLimit.
+	UsageLimits UsageLimits
+	// KeyRotation is the age at which device keys are due to be rotated.
+	// Zero means keys are only rotated when an admin asks.
+	KeyRotation time.Duration
+	// KeyOverlap is how long a rotated device key keeps working
+	KeyOverlap time.Duration
+	// OfflineTimeout is how long a device can go without sending samples
+	// before it is disconnected in its event timeline. Zero means
+	// connections are not recorded.
+	OfflineTimeout time.Duration
+	// HistoryCache is how much raw sample history is kept in memory to
+	// serve range queries. Zero disables the cache.
+	HistoryCache time.Duration
+}
+
+func (o *Options) commandTTL() time.Duration {
+	if o == nil {
+		return 0
+	}
+	return o.CommandTTL
+}
+
+func (o *Options) logTTL() time.Duration {
+	if o == nil {
+		return 0
+	}
+	return o.LogTTL
+}
+
+func (o *Options) offlineTimeout() time.Duration {
+	if o == nil {
+		return 0
+	}
+	return o.OfflineTimeout
+}
+
+func (o *Options) historyCache() time.Duration {
+	if o == nil {
+		return 0
+	}
+	return o.HistoryCache
+}
+
+func (o *Options) usageLimits() UsageLimits {
+	if o == nil {
+		return UsageLimits{}
+	}
+	return o.UsageLimits
+}
+
+func (o *Options) keyRotation() time.Duration {
+	if o == nil {
+		return 0
+	}
+	return o.KeyRotation
+}
+
+func (o *Options) keyOverlap() time.Duration {
+	if o == nil {
+		return 0
+	}
+	return o.KeyOverlap
+}
+
+// openStore opens the bolthold store with the options
+func openStore(dbFile string, options *Options) (*bolthold.Store, error) {
+	bhOptions, err := options.boltholdOptions()
 	if err != nil {
 		return nil, err
 	}
 
-	return &Db{
-		store: store,
-	}, nil
-}
+	store, err := bolthold.Open(dbFile, 0666, bhOptions)
+	if err != nil {
+		return nil, err
+	}
 
-// DeviceUpdate updates a devices state in the database
-func (db *Db) DeviceUpdate(device data.Device) error {
-	return db.store.Upsert(device.ID, &device)
+	// make sure we can read the db with the encoding we've been given
+	err = store.Bolt().Update(func(tx *bolt.Tx) error {
+		return checkEncoding(tx, options != nil && options.EncryptionKey != nil,
+			bhOptions.Encoder, bhOptions.Decoder)
+	})
+
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	return store, nil
 }
 
-// DeviceUpdateConfig updates the config for a particular device
-func (db *Db) DeviceUpdateConfig(id string, config data.DeviceConfig) error {
-	var dev data.Device
-	err := db.store.Get(id, &dev)
+// NewDb creates a new Db instance for the app. Any pending schema
+// migrations are run before the Db is returned.
+func NewDb(dataDir string, options *Options) (*Db, error) {
+	dbFile := dbPath(dataDir)
+	index, err := newDeviceIndex(options)
+	if err != nil {
+		return nil, err
+	}
 
-	if err == bolthold.ErrNotFound {
-		return err
+	store, err := openStore(dbFile, options)
+	if err != nil {
+		return nil, err
 	}
 
-	dev.Config = config
+	err = migrate(store, index)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
 
-	return db.store.Update(id, dev)
+	db := &Db{
+		dbFile:  dbFile,
+		options: options,
+		metrics: NewMetrics("db"),
+		store:   store,
+		index:   index,
+	}
+
+	err = db.latest.load(store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	err = db.usage.load(store, options)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	db.series.window = options.historyCache()
+	db.series.reset()
+
+	return db, nil
 }
 
-// DeviceSample processes a sample for a particular device
-func (db *Db) DeviceSample(id string, sample data.Sample) error {
-	var dev data.Device
-	err := db.store.Get(id, &dev)
+// Metrics returns the operation metrics for the db
+func (db *Db) Metrics() *Metrics {
+	return db.metrics
+}
 
+// Close closes the db
+func (db *Db) Close() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.store.Close()
+}
+
+// txDeviceGet returns a device, or nil if not found
+func (db *Db) txDeviceGet(tx *bolt.Tx, id string) (*data.Device, error) {
+	var dev data.Device
+	err := db.store.TxGet(tx, id, &dev)
 	if err == bolthold.ErrNotFound {
-		dev := data.Device{
-			ID: id,
-			State: data.DeviceState{
-				Ios: []data.Sample{sample},
-			},
-		}
-
-		return db.store.Insert(id, dev)
+		return nil, nil
 	} else if err != nil {
+		return nil, err
+	}
+
+	return &dev, nil
+}
+
+// txDevicePut writes a device and updates the device indexes. old is the
+// existing device record, or nil for a new device.
+func (db *Db) txDevicePut(tx *bolt.Tx, old *data.Device, dev data.Device) error {
+	err := db.txDeviceInherit(tx, &dev)
+	if err != nil {
 		return err
 	}
 
-	dev.ProcessSample(sample)
+	err = db.store.TxUpsert(tx, dev.ID, &dev)
+	if err != nil {
+		return err
+	}
+
+	eventType := EventDeviceUpdated
+	if old == nil {
+		eventType = EventDeviceCreated
+	}
+
+	db.latest.setOnCommit(tx, &dev)
+	db.usage.setGroupsOnCommit(tx, &dev)
+	tx.OnCommit(func() {
+		db.cacheSetDevice(&dev)
+	})
+	db.feed.publishOnCommit(tx, Event{
+		Type:     eventType,
+		DeviceID: dev.ID,
+		Device:   &dev,
+	})
 
-	return db.store.Update(id, dev)
+	err = db.index.update(tx, old, &dev)
+	if err != nil {
+		return err
+	}
+
+	if old == nil || !reflect.DeepEqual(old.Groups(), dev.Groups()) {
+		return db.txDeviceUpdateChildren(tx, dev.ID)
+	}
+
+	return nil
+}
+
+// DeviceUpdate updates a devices state in the database
+func (db *Db) DeviceUpdate(device data.Device) (err error) {
+	defer db.metrics.observe("DeviceUpdate", time.Now(), &err)
+	return db.update(func(txn *Txn) error {
+		return txn.DeviceUpdate(device)
+	})
+}
+
+// DeviceUpdateConfig updates the config for a particular device
+func (db *Db) DeviceUpdateConfig(id string, config data.DeviceConfig) (err error) {
+	defer db.metrics.observe("DeviceUpdateConfig", time.Now(), &err)
+	return db.update(func(txn *Txn) error {
+		return txn.DeviceUpdateConfig(id, config)
+	})
+}
+
+// DeviceReportConfig records the config a device applied
+func (db *Db) DeviceReportConfig(id string, report data.ConfigReport) (err error) {
+	defer db.metrics.observe("DeviceReportConfig", time.Now(), &err)
+	return db.update(func(txn *Txn) error {
+		return txn.DeviceReportConfig(id, report)
+	})
+}
+
+// DeviceSample processes a sample for a particular device. The sample is
+// also added to the local sample history.
+func (db *Db) DeviceSample(id string, sample data.Sample) (err error) {
+	defer db.metrics.observe("DeviceSample", time.Now(), &err)
+	return db.update(func(txn *Txn) error {
+		return txn.DeviceSample(id, sample)
+	})
 }
 
 // Device returns data for a particular device
 func (db *Db) Device(id string) (ret data.Device, err error) {
+	defer db.metrics.observe("Device", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if dev := db.cacheGetDevice(id); dev != nil {
+		return *dev, nil
+	}
+
 	err = db.store.Get(id, &ret)
+	if err == nil {
+		db.cacheSetDevice(&ret)
+	}
 	return
 }
 
 // DeviceDelete deletes a device from the database
-func (db *Db) DeviceDelete(id string) error {
-	return db.store.Delete(id, data.Device{})
+func (db *Db) DeviceDelete(id string) (err error) {
+	defer db.metrics.observe("DeviceDelete", time.Now(), &err)
+	return db.update(func(txn *Txn) error {
+		return txn.DeviceDelete(id)
+	})
+}
+
+// CommandEnqueue queues a command for a device
+func (db *Db) CommandEnqueue(cmd data.DeviceCommand) (ret data.DeviceCommand, err error) {
+	defer db.metrics.observe("CommandEnqueue", time.Now(), &err)
+	err = db.update(func(txn *Txn) error {
+		var err error
+		ret, err = txn.CommandEnqueue(cmd)
+		return err
+	})
+	return
 }
 
 // Devices returns all devices
 func (db *Db) Devices() (ret []data.Device, err error) {
+	defer db.metrics.observe("Devices", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
 	err = db.store.Find(&ret, nil)
 	return
 }
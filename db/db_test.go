@@ -0,0 +1,3179 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/bus"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/trace"
+	"github.com/timshannon/bolthold"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// newTestDb is like dbtest.New, which these tests can't import as it imports
+// db
+func newTestDb(t *testing.T) (*Db, func()) {
+	dir, err := ioutil.TempDir("", "siot-db-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal("Error opening db: ", err)
+	}
+
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	start := time.Date(2019, 10, 1, 10, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 120; i++ {
+		err := db.DeviceSample("1234", data.Sample{
+			Type:  "temp",
+			Value: float64(i % 60),
+			Time:  start.Add(time.Duration(i) * time.Second),
+		})
+		if err != nil {
+			t.Fatal("Error writing sample: ", err)
+		}
+	}
+
+	ds := NewDownsampler(db, time.Hour, time.Minute)
+	err := ds.Run(start.Add(time.Hour * 24))
+	if err != nil {
+		t.Fatal("Error downsampling: ", err)
+	}
+
+	// running again should not change aggregates
+	err = ds.Run(start.Add(time.Hour * 24))
+	if err != nil {
+		t.Fatal("Error downsampling: ", err)
+	}
+
+	raw, err := db.SampleHistory("1234", start, start.Add(time.Hour),
+		ResolutionRaw)
+	if err != nil {
+		t.Fatal("Error getting raw history: ", err)
+	}
+
+	var records []sampleRecord
+	err = db.store.Find(&records, nil)
+	if err != nil || len(records) != 0 {
+		t.Error("raw samples were not pruned, count: ", len(records), err)
+	}
+
+	// pruned raw samples are kept in compressed blocks
+	if len(raw) != 120 {
+		t.Fatal("expected 120 compressed raw samples, got: ", len(raw))
+	}
+
+	for i, s := range raw {
+		if s.Value != float64(i%60) || !s.Time.Equal(start.Add(time.Duration(i)*time.Second)) {
+			t.Fatalf("compressed raw sample %v is not correct: %+v", i, s)
+		}
+	}
+
+	mins, err := db.SampleHistory("1234", start, start.Add(time.Hour),
+		ResolutionMinute)
+	if err != nil {
+		t.Fatal("Error getting minute history: ", err)
+	}
+
+	if len(mins) != 2 {
+		t.Fatal("expected 2 minute aggregates, got: ", len(mins))
+	}
+
+	for _, m := range mins {
+		if m.Value != 29.5 || m.Min != 0 || m.Max != 59 {
+			t.Errorf("minute aggregate is not correct: %+v", m)
+		}
+	}
+
+	hours, err := db.SampleHistory("1234", start, start.Add(time.Hour),
+		ResolutionHour)
+	if err != nil {
+		t.Fatal("Error getting hour history: ", err)
+	}
+
+	if len(hours) != 1 || hours[0].Value != 29.5 {
+		t.Errorf("hour aggregate is not correct: %+v", hours)
+	}
+
+	ds.SetBlockRetention(time.Hour)
+	err = ds.Run(start.Add(time.Hour * 24))
+	if err != nil {
+		t.Fatal("Error downsampling: ", err)
+	}
+
+	raw, err = db.SampleHistory("1234", start, start.Add(time.Hour),
+		ResolutionRaw)
+	if err != nil || len(raw) != 0 {
+		t.Error("compressed samples were not removed: ", len(raw), err)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	err := db.DeviceSample("1234", data.Sample{Type: "temp", Value: 10})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	var backup bytes.Buffer
+	err = db.Backup(&backup)
+	if err != nil {
+		t.Fatal("Error backing up: ", err)
+	}
+
+	var sized bytes.Buffer
+	var size int64
+	err = db.BackupTo(&sized, func(s int64) { size = s })
+	if err != nil {
+		t.Fatal("Error backing up: ", err)
+	}
+
+	if size != int64(sized.Len()) {
+		t.Errorf("backup size %v does not match backup length %v", size,
+			sized.Len())
+	}
+
+	err = db.DeviceDelete("1234")
+	if err != nil {
+		t.Fatal("Error deleting device: ", err)
+	}
+
+	err = db.Restore(&backup)
+	if err != nil {
+		t.Fatal("Error restoring: ", err)
+	}
+
+	dev, err := db.Device("1234")
+	if err != nil {
+		t.Fatal("Error getting restored device: ", err)
+	}
+
+	if len(dev.State.Ios) != 1 || dev.State.Ios[0].Value != 10 {
+		t.Errorf("restored device is not correct: %+v", dev)
+	}
+
+	err = db.Restore(bytes.NewBufferString("not a db"))
+	if err == nil {
+		t.Error("restoring invalid backup should fail")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	version, err := db.SchemaVersion()
+	if err != nil {
+		t.Fatal("Error getting schema version: ", err)
+	}
+
+	latest := migrations[len(migrations)-1].version
+
+	if version != latest {
+		t.Errorf("schema version is %v, expected %v", version, latest)
+	}
+
+	pending, err := pendingMigrations(db.store)
+	if err != nil {
+		t.Fatal("Error getting pending migrations: ", err)
+	}
+
+	if len(pending) != 0 {
+		t.Error("there should be no pending migrations: ", pending)
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-db-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pending, err := MigrateDryRun(dir, nil)
+	if err != nil {
+		t.Fatal("dry run on missing db failed: ", err)
+	}
+
+	if len(pending) != len(migrations) {
+		t.Error("all migrations should be pending: ", pending)
+	}
+
+	_, err = os.Stat(dbPath(dir))
+	if !os.IsNotExist(err) {
+		t.Error("dry run created the db: ", err)
+	}
+
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal("Error opening db: ", err)
+	}
+
+	// the open db holds the file lock
+	_, err = MigrateDryRun(dir, nil)
+	if err == nil {
+		t.Error("dry run should time out while the db is open")
+	}
+
+	db.Close()
+
+	before, err := ioutil.ReadFile(dbPath(dir))
+	if err != nil {
+		t.Fatal("Error reading db: ", err)
+	}
+
+	pending, err = MigrateDryRun(dir, nil)
+	if err != nil || len(pending) != 0 {
+		t.Error("there should be no pending migrations: ", pending, err)
+	}
+
+	after, err := ioutil.ReadFile(dbPath(dir))
+	if err != nil {
+		t.Fatal("Error reading db: ", err)
+	}
+
+	if !bytes.Equal(before, after) {
+		t.Error("dry run modified the db")
+	}
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-db-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal("Error opening db: ", err)
+	}
+
+	latest := migrations[len(migrations)-1].version
+	err = db.store.Upsert(schemaVersionKey, &schemaVersion{Version: latest + 1})
+	db.Close()
+	if err != nil {
+		t.Fatal("Error setting schema version: ", err)
+	}
+
+	_, err = NewDb(dir, nil)
+	if !errors.Is(err, ErrSchemaVersion) {
+		t.Error("expected schema version error opening db, got: ", err)
+	}
+
+	_, err = MigrateDryRun(dir, nil)
+	if !errors.Is(err, ErrSchemaVersion) {
+		t.Error("expected schema version error from dry run, got: ", err)
+	}
+}
+
+func TestDevicesFiltered(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	for _, id := range []string{"1", "2", "3"} {
+		err := db.DeviceSample(id, data.Sample{Type: "temp", Value: 10})
+		if err != nil {
+			t.Fatal("Error writing sample: ", err)
+		}
+	}
+
+	err := db.DeviceUpdateConfig("2", data.DeviceConfig{
+		Groups: []string{"pumps"},
+		Tags:   map[string]string{"site": "north"},
+	})
+	if err != nil {
+		t.Fatal("Error updating config: ", err)
+	}
+
+	err = db.DeviceUpdateConfig("3", data.DeviceConfig{
+		Groups: []string{"pumps"},
+	})
+	if err != nil {
+		t.Fatal("Error updating config: ", err)
+	}
+
+	check := func(filter DeviceFilter, expTotal int, expIDs ...string) {
+		devs, total, err := db.DevicesFiltered(filter)
+		if err != nil {
+			t.Fatal("Error getting devices: ", err)
+		}
+
+		var ids []string
+		for _, d := range devs {
+			ids = append(ids, d.ID)
+		}
+
+		if total != expTotal || !reflect.DeepEqual(ids, expIDs) {
+			t.Errorf("filter %+v returned %v/%v, expected %v/%v",
+				filter, ids, total, expIDs, expTotal)
+		}
+	}
+
+	check(DeviceFilter{}, 3, "1", "2", "3")
+	check(DeviceFilter{Group: "pumps"}, 2, "2", "3")
+	check(DeviceFilter{Group: "pumps", Tag: "site=north"}, 1, "2")
+	check(DeviceFilter{Io: "temp", Offset: 1, Limit: 1}, 3, "2")
+	check(DeviceFilter{State: data.SyncOK}, 1, "1")
+	check(DeviceFilter{State: data.SyncPending}, 2, "2", "3")
+
+	err = db.DeviceUpdateConfig("3", data.DeviceConfig{})
+	if err != nil {
+		t.Fatal("Error updating config: ", err)
+	}
+
+	err = db.DeviceDelete("2")
+	if err != nil {
+		t.Fatal("Error deleting device: ", err)
+	}
+
+	check(DeviceFilter{Group: "pumps"}, 0)
+}
+
+func TestDevicesFilteredEmptyValues(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	// empty index values used to be bolt bucket names, which fails with
+	// "bucket name required"
+	err := db.DeviceSample("1234", data.Sample{Value: 10})
+	if err != nil {
+		t.Fatal("Error writing sample with no type: ", err)
+	}
+
+	err = db.DeviceUpdateConfig("1234", data.DeviceConfig{
+		Groups: []string{""},
+		Tags:   map[string]string{"": "north", "site": ""},
+	})
+	if err != nil {
+		t.Fatal("Error updating config with empty values: ", err)
+	}
+
+	devs, total, err := db.DevicesFiltered(DeviceFilter{})
+	if err != nil {
+		t.Fatal("Error getting devices: ", err)
+	}
+
+	if total != 1 || len(devs) != 1 || devs[0].ID != "1234" {
+		t.Errorf("expected device 1234, got %v/%v", devs, total)
+	}
+
+	devs, _, err = db.DevicesFiltered(DeviceFilter{Tag: "site="})
+	if err != nil {
+		t.Fatal("Error getting devices: ", err)
+	}
+
+	if len(devs) != 0 {
+		t.Error("empty tag value should not be indexed: ", devs)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-db-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := make([]byte, KeySize)
+	key[0] = 1
+
+	db, err := NewDb(dir, &Options{EncryptionKey: key})
+	if err != nil {
+		t.Fatal("Error opening db: ", err)
+	}
+
+	err = db.DeviceSample("1234", data.Sample{Type: "temp", Value: 10})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	err = db.DeviceUpdateConfig("1234", data.DeviceConfig{
+		Description: "secret pump", Groups: []string{"pumpgroup"},
+		Tags: map[string]string{"site": "hidden"}})
+	if err != nil {
+		t.Fatal("Error updating config: ", err)
+	}
+
+	dev, err := db.Device("1234")
+	if err != nil || dev.Config.Description != "secret pump" {
+		t.Fatal("Error reading device: ", err)
+	}
+
+	// the indexes work with hashed values and encrypted IDs
+	for _, f := range []DeviceFilter{
+		{Group: "pumpgroup"},
+		{Tag: "site=hidden"},
+		{Query: "secr pum"},
+	} {
+		devs, _, err := db.DevicesFiltered(f)
+		if err != nil || len(devs) != 1 || devs[0].ID != "1234" {
+			t.Errorf("filter %+v returned %v, %v", f, devs, err)
+		}
+	}
+
+	db.Close()
+
+	raw, err := ioutil.ReadFile(dbPath(dir))
+	if err != nil {
+		t.Fatal("Error reading db file: ", err)
+	}
+
+	for _, s := range []string{"secret", "pumpgroup", "hidden", "1234"} {
+		if bytes.Contains(raw, []byte(s)) {
+			t.Errorf("db file contains plain text %q", s)
+		}
+	}
+
+	key[0] = 2
+	_, err = NewDb(dir, &Options{EncryptionKey: key})
+	if err != ErrDecrypt {
+		t.Error("opening db with wrong key should fail, got: ", err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	events := db.Subscribe(EventFilter{DeviceID: "1234"})
+	defer db.Unsubscribe(events)
+
+	err := db.DeviceSample("1234", data.Sample{Type: "temp", Value: 10})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	err = db.DeviceSample("5678", data.Sample{Type: "temp", Value: 10})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	err = db.DeviceDelete("1234")
+	if err != nil {
+		t.Fatal("Error deleting device: ", err)
+	}
+
+	exp := []EventType{EventSampleWritten, EventDeviceCreated, EventDeviceDeleted}
+
+	for _, et := range exp {
+		select {
+		case e := <-events:
+			if e.Type != et || e.DeviceID != "1234" {
+				t.Errorf("expected %v event, got %v for %v", et, e.Type, e.DeviceID)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for ", et)
+		}
+	}
+
+	select {
+	case e := <-events:
+		t.Error("unexpected event: ", e.Type, e.DeviceID)
+	default:
+	}
+}
+
+func TestBus(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	b := bus.New()
+	db.SetBus(b)
+
+	messages := b.Subscribe(bus.TopicSample, bus.TopicDevice)
+	defer b.Unsubscribe(messages)
+
+	err := db.DeviceSample("1234", data.Sample{Type: "temp", Value: 10})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	for _, exp := range []string{"sampleWritten", "deviceCreated"} {
+		select {
+		case msg := <-messages:
+			e, ok := msg.Payload.(Event)
+			if msg.Type != exp || msg.DeviceID != "1234" || !ok ||
+				e.Type.String() != exp {
+				t.Errorf("wrong message: %+v", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for ", exp)
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src, cleanup := newTestDb(t)
+	defer cleanup()
+
+	err := src.DeviceSample("1234", data.Sample{Type: "temp", Value: 10})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	err = src.DeviceUpdateConfig("1234", data.DeviceConfig{
+		Description: "pump", Tags: map[string]string{"site": "a"}})
+	if err != nil {
+		t.Fatal("Error updating config: ", err)
+	}
+
+	var buf bytes.Buffer
+	err = src.Export(&buf)
+	if err != nil {
+		t.Fatal("Error exporting: ", err)
+	}
+
+	dst, cleanup2 := newTestDb(t)
+	defer cleanup2()
+
+	err = dst.DeviceUpdate(data.Device{ID: "1234"})
+	if err != nil {
+		t.Fatal("Error updating device: ", err)
+	}
+
+	_, err = dst.Import(bytes.NewReader(buf.Bytes()), ImportFail)
+	if !errors.Is(err, ErrImportConflict) {
+		t.Fatal("expected conflict error, got: ", err)
+	}
+
+	res, err := dst.Import(bytes.NewReader(buf.Bytes()), ImportSkip)
+	if err != nil || res.Skipped != 1 {
+		t.Fatal("skip import failed: ", res, err)
+	}
+
+	res, err = dst.Import(bytes.NewReader(buf.Bytes()), ImportOverwrite)
+	if err != nil || res.Overwritten != 1 {
+		t.Fatal("overwrite import failed: ", res, err)
+	}
+
+	devs, _, err := dst.DevicesFiltered(DeviceFilter{Tag: "site=a"})
+	if err != nil || len(devs) != 1 || devs[0].Config.Description != "pump" {
+		t.Error("imported device not found: ", devs, err)
+	}
+}
+
+func TestExportImportAll(t *testing.T) {
+	src, cleanup := newTestDb(t)
+	defer cleanup()
+
+	_, err := src.UserInsert(data.User{Username: "bob", Role: data.UserRoleUser},
+		"password1")
+	if err != nil {
+		t.Fatal("Error inserting user: ", err)
+	}
+
+	rule, err := src.RuleInsert(data.Rule{Description: "high temp",
+		Conditions: []data.RuleCondition{
+			{Type: data.RuleConditionValue, DeviceID: "1234", SampleType: "temp",
+				Operator: ">", Value: 30},
+		}})
+	if err != nil {
+		t.Fatal("Error inserting rule: ", err)
+	}
+
+	script, err := src.ScriptInsert(data.Script{Description: "double",
+		Source: "function on_sample(s) end"})
+	if err != nil {
+		t.Fatal("Error inserting script: ", err)
+	}
+
+	_, err = src.TemplateSet(data.DeviceTemplate{Type: "pump",
+		Description: "pump controller"})
+	if err != nil {
+		t.Fatal("Error setting template: ", err)
+	}
+
+	var buf bytes.Buffer
+	err = src.Export(&buf)
+	if err != nil {
+		t.Fatal("Error exporting: ", err)
+	}
+
+	dst, cleanup2 := newTestDb(t)
+	defer cleanup2()
+
+	res, err := dst.Import(bytes.NewReader(buf.Bytes()), ImportFail)
+	if err != nil || res.Created != 4 {
+		t.Fatal("import failed: ", res, err)
+	}
+
+	err = dst.UserCheckPassword("bob", "password1")
+	if err != nil {
+		t.Error("imported user can't log in: ", err)
+	}
+
+	r, err := dst.Rule(rule.ID)
+	if err != nil || r.Description != "high temp" {
+		t.Error("imported rule not found: ", r, err)
+	}
+
+	s, err := dst.Script(script.ID)
+	if err != nil || s.Source != script.Source {
+		t.Error("imported script not found: ", s, err)
+	}
+
+	tmpl, err := dst.Template("pump")
+	if err != nil || tmpl.Description != "pump controller" {
+		t.Error("imported template not found: ", tmpl, err)
+	}
+
+	// new records must not reuse the imported IDs
+	r2, err := dst.RuleInsert(r)
+	if err != nil || r2.ID == rule.ID {
+		t.Error("rule ID reused: ", r2.ID, err)
+	}
+
+	s2, err := dst.ScriptInsert(s)
+	if err != nil || s2.ID == script.ID {
+		t.Error("script ID reused: ", s2.ID, err)
+	}
+
+	_, err = dst.Import(bytes.NewReader(buf.Bytes()), ImportFail)
+	if !errors.Is(err, ErrImportConflict) {
+		t.Fatal("expected conflict error, got: ", err)
+	}
+
+	res, err = dst.Import(bytes.NewReader(buf.Bytes()), ImportSkip)
+	if err != nil || res.Skipped != 4 || res.Created != 0 {
+		t.Fatal("skip import failed: ", res, err)
+	}
+
+	err = dst.UserSetPassword("bob", "password2")
+	if err != nil {
+		t.Fatal("Error setting password: ", err)
+	}
+
+	res, err = dst.Import(bytes.NewReader(buf.Bytes()), ImportOverwrite)
+	if err != nil || res.Overwritten != 4 {
+		t.Fatal("overwrite import failed: ", res, err)
+	}
+
+	err = dst.UserCheckPassword("bob", "password1")
+	if err != nil {
+		t.Error("overwritten user should have the archive password: ", err)
+	}
+}
+
+func TestLatest(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		err := db.DeviceSample("1234", data.Sample{Type: "temp", Value: float64(i)})
+		if err != nil {
+			t.Fatal("Error writing sample: ", err)
+		}
+	}
+
+	s, ok := db.LatestValue("1234", "temp", "")
+	if !ok || s.Value != 2 {
+		t.Error("wrong latest value: ", s, ok)
+	}
+
+	err := db.DeviceDelete("1234")
+	if err != nil {
+		t.Fatal("Error deleting device: ", err)
+	}
+
+	_, err = db.Latest("1234")
+	if err == nil {
+		t.Error("deleted device should not be in cache")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	errAbort := errors.New("abort")
+
+	err := db.Update(func(txn *Txn) error {
+		err := txn.DeviceSample("1234", data.Sample{Type: "temp", Value: 10})
+		if err != nil {
+			return err
+		}
+
+		_, err = txn.CommandEnqueue(data.DeviceCommand{DeviceID: "1234", Command: "reboot"})
+		if err != nil {
+			return err
+		}
+
+		return errAbort
+	})
+
+	if err != errAbort {
+		t.Fatal("expected abort error, got: ", err)
+	}
+
+	_, err = db.Device("1234")
+	if err == nil {
+		t.Error("device should not exist after aborted txn")
+	}
+
+	err = db.Update(func(txn *Txn) error {
+		err := txn.DeviceSample("1234", data.Sample{Type: "temp", Value: 10})
+		if err != nil {
+			return err
+		}
+
+		_, err = txn.CommandEnqueue(data.DeviceCommand{DeviceID: "1234", Command: "reboot"})
+		if err != nil {
+			return err
+		}
+
+		return txn.AuditAppend(data.AuditRecord{DeviceID: "1234", Action: "reboot"})
+	})
+
+	if err != nil {
+		t.Fatal("Error running txn: ", err)
+	}
+
+	cmds, err := db.DeviceCommands("1234")
+	if err != nil || len(cmds) != 1 || cmds[0].ID == 0 {
+		t.Fatal("expected 1 queued command: ", cmds, err)
+	}
+
+	audit, err := db.Audit("1234")
+	if err != nil || len(audit) != 1 {
+		t.Error("expected 1 audit record: ", audit, err)
+	}
+
+	cmd := cmds[0]
+	queued, err := db.CommandQueued(cmd)
+	if err != nil || !queued {
+		t.Error("command should be queued: ", err)
+	}
+
+	err = db.CommandDelete(cmd.ID)
+	if err != nil {
+		t.Fatal("Error deleting command: ", err)
+	}
+
+	cmds, err = db.DeviceCommands("1234")
+	if err != nil || len(cmds) != 0 {
+		t.Error("command was not deleted: ", cmds, err)
+	}
+
+	queued, err = db.CommandQueued(cmd)
+	if err != nil || queued {
+		t.Error("deleted command should not be queued: ", err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	now := time.Now()
+
+	_, err := db.CommandEnqueue(data.DeviceCommand{DeviceID: "1234",
+		Command: "old", Expires: now.Add(-time.Minute)})
+	if err != nil {
+		t.Fatal("Error enqueuing command: ", err)
+	}
+
+	_, err = db.CommandEnqueue(data.DeviceCommand{DeviceID: "1234",
+		Command: "new"})
+	if err != nil {
+		t.Fatal("Error enqueuing command: ", err)
+	}
+
+	cmds, err := db.DeviceCommands("1234")
+	if err != nil || len(cmds) != 1 || cmds[0].Command != "new" {
+		t.Fatal("expired command should not be returned: ", cmds, err)
+	}
+
+	err = NewExpirer(db, time.Minute).Run(now)
+	if err != nil {
+		t.Fatal("Error expiring: ", err)
+	}
+
+	var all []data.DeviceCommand
+	err = db.store.Find(&all, nil)
+	if err != nil || len(all) != 1 {
+		t.Error("expired command was not deleted: ", all, err)
+	}
+}
+
+func TestLogs(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	now := time.Now()
+
+	err := db.LogAppend("1234", []data.LogEntry{
+		{Time: now.Add(-time.Hour), Message: "old"},
+		{Time: now, Message: "new", Expires: now.Add(-time.Minute)},
+	})
+	if err != nil {
+		t.Fatal("Error appending logs: ", err)
+	}
+
+	entries, err := db.Logs("1234", now.Add(-time.Minute))
+	if err != nil || len(entries) != 1 || entries[0].Message != "new" ||
+		entries[0].DeviceID != "1234" {
+		t.Fatal("wrong log entries: ", entries, err)
+	}
+
+	err = NewExpirer(db, time.Minute).Run(now)
+	if err != nil {
+		t.Fatal("Error expiring: ", err)
+	}
+
+	entries, err = db.Logs("1234", time.Time{})
+	if err != nil || len(entries) != 1 || entries[0].Message != "old" {
+		t.Error("expired log entry was not deleted: ", entries, err)
+	}
+}
+
+func TestSupportArchives(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	a, err := db.SupportArchiveAdd("1234", []byte("archive"))
+	if err != nil {
+		t.Fatal("Error adding archive: ", err)
+	}
+
+	archives, err := db.SupportArchives("1234")
+	if err != nil || len(archives) != 1 || archives[0].Size != 7 ||
+		archives[0].Data != nil {
+		t.Fatal("wrong archive list: ", archives, err)
+	}
+
+	got, err := db.SupportArchive(a.ID)
+	if err != nil || string(got.Data) != "archive" {
+		t.Error("wrong archive: ", got, err)
+	}
+}
+
+func TestDeviceKeys(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	_, _, err := db.DeviceKeyCreate("1234")
+	if err != bolthold.ErrNotFound {
+		t.Fatal("expected not found for missing device: ", err)
+	}
+
+	err = db.DeviceSample("1234", data.Sample{Type: "temp", Value: 1})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	key, k, err := db.DeviceKeyCreate("1234")
+	if err != nil {
+		t.Fatal("Error creating key: ", err)
+	}
+
+	id, err := db.DeviceKeyAuth(key)
+	if err != nil || id != "1234" {
+		t.Fatal("key did not authenticate: ", id, err)
+	}
+
+	_, err = db.DeviceKeyAuth("bad")
+	if err != ErrInvalidKey {
+		t.Error("expected invalid key: ", err)
+	}
+
+	keys, err := db.DeviceKeys("1234")
+	if err != nil || len(keys) != 1 || keys[0].ID != k.ID {
+		t.Fatal("wrong keys: ", keys, err)
+	}
+
+	err = db.DeviceKeyDelete(k.ID)
+	if err != nil {
+		t.Fatal("Error deleting key: ", err)
+	}
+
+	_, err = db.DeviceKeyAuth(key)
+	if err != ErrInvalidKey {
+		t.Error("deleted key is still valid: ", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	db.options = &Options{KeyRotation: time.Hour, KeyOverlap: time.Minute}
+
+	err := db.DeviceSample("1234", data.Sample{Type: "temp", Value: 1})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	key, k, err := db.DeviceKeyCreate("1234")
+	if err != nil {
+		t.Fatal("Error creating key: ", err)
+	}
+
+	now := time.Now()
+	status := db.KeyStatus(k, now)
+	if !status.Active || status.Due || !status.RotateAt.Equal(k.Created.Add(time.Hour)) {
+		t.Error("wrong status of new key: ", status)
+	}
+
+	if !db.KeyStatus(k, now.Add(2*time.Hour)).Due {
+		t.Error("old key is not due")
+	}
+
+	// the old key works until the overlap ends
+	key2, k2, err := db.DeviceKeyRotate(key)
+	if err != nil {
+		t.Fatal("Error rotating key: ", err)
+	}
+
+	for _, key := range []string{key, key2} {
+		if id, err := db.DeviceKeyAuth(key); err != nil || id != "1234" {
+			t.Error("key does not work after rotation: ", err)
+		}
+	}
+
+	keys, _ := db.DeviceKeys("1234")
+	if len(keys) != 2 || keys[0].Expires.IsZero() || !keys[1].Expires.IsZero() {
+		t.Fatal("wrong keys: ", keys)
+	}
+
+	if db.KeyStatus(keys[0], now.Add(2*time.Hour)).Due {
+		t.Error("replaced key is due")
+	}
+
+	if db.KeyStatus(keys[0], now.Add(2*time.Minute)).Active {
+		t.Error("replaced key is active after the overlap")
+	}
+
+	// an admin asks for the keys to be rotated with no overlap
+	err = db.DeviceKeysRotate("1234", 0)
+	if err != nil {
+		t.Fatal("Error rotating keys: ", err)
+	}
+
+	if _, err := db.DeviceKeyAuth(key2); err != ErrInvalidKey {
+		t.Error("key works after forced rotation: ", err)
+	}
+
+	_, _, err = db.DeviceKeyRotate(key2)
+	if err != ErrInvalidKey {
+		t.Error("rotated expired key: ", err)
+	}
+
+	key3, k3, err := db.DeviceKeyCreate("1234")
+	if err != nil {
+		t.Fatal("Error creating key: ", err)
+	}
+
+	err = db.DeviceKeyRevoke(k3.ID)
+	if err != nil {
+		t.Fatal("Error revoking key: ", err)
+	}
+
+	if _, err := db.DeviceKeyAuth(key3); err != ErrInvalidKey {
+		t.Error("revoked key works: ", err)
+	}
+
+	if _, err := db.DeviceKeyStatus(key3); err != ErrInvalidKey {
+		t.Error("got status of revoked key: ", err)
+	}
+
+	// revoked keys stay on the list, and replaced keys expire
+	err = NewExpirer(db, time.Hour).Run(now.Add(time.Hour))
+	if err != nil {
+		t.Fatal("Error expiring: ", err)
+	}
+
+	keys, _ = db.DeviceKeys("1234")
+	if len(keys) != 1 || keys[0].ID != k3.ID || keys[0].Revoked.IsZero() {
+		t.Error("wrong keys after expiring: ", keys, k2)
+	}
+}
+
+func TestRules(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	events := db.Subscribe(EventFilter{Types: []EventType{EventRuleChanged}})
+	defer db.Unsubscribe(events)
+
+	rule := data.Rule{Description: "high temp", Conditions: []data.RuleCondition{
+		{Type: data.RuleConditionValue, DeviceID: "1234", SampleType: "temp",
+			Operator: ">", Value: 30},
+	}}
+
+	r1, err := db.RuleInsert(rule)
+	if err != nil {
+		t.Fatal("Error inserting rule: ", err)
+	}
+
+	r2, err := db.RuleInsert(rule)
+	if err != nil {
+		t.Fatal("Error inserting rule: ", err)
+	}
+
+	if r1.ID == 0 || r2.ID == r1.ID {
+		t.Fatal("rules did not get IDs: ", r1.ID, r2.ID)
+	}
+
+	e := <-events
+	if e.Type != EventRuleChanged || e.Rule.ID != r1.ID {
+		t.Error("wrong event: ", e)
+	}
+
+	now := time.Now().UTC()
+	err = db.RuleSetState(r1.ID, true, now)
+	if err != nil {
+		t.Fatal("Error setting rule state: ", err)
+	}
+
+	// updates keep the state
+	r1.Description = "very high temp"
+	err = db.RuleUpdate(r1)
+	if err != nil {
+		t.Fatal("Error updating rule: ", err)
+	}
+
+	ret, err := db.Rule(r1.ID)
+	if err != nil || ret.Description != "very high temp" || !ret.Active ||
+		!ret.Changed.Equal(now) {
+		t.Errorf("wrong rule: %+v, %v", ret, err)
+	}
+
+	err = db.RuleDelete(r2.ID)
+	if err != nil {
+		t.Fatal("Error deleting rule: ", err)
+	}
+
+	rules, err := db.Rules()
+	if err != nil || len(rules) != 1 || rules[0].ID != r1.ID {
+		t.Errorf("wrong rules: %+v, %v", rules, err)
+	}
+
+	err = db.RuleUpdate(r2)
+	if err != bolthold.ErrNotFound {
+		t.Error("expected not found updating deleted rule: ", err)
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	events := db.Subscribe(EventFilter{Types: []EventType{EventAlertChanged}})
+	defer db.Unsubscribe(events)
+
+	a1, err := db.AlertRaise(data.Alert{RuleID: 1, DeviceID: "1234",
+		Message: "tank high"})
+	if err != nil {
+		t.Fatal("Error raising alert: ", err)
+	}
+
+	a2, err := db.AlertRaise(data.Alert{RuleID: 2, Message: "pump failed"})
+	if err != nil {
+		t.Fatal("Error raising alert: ", err)
+	}
+
+	e := <-events
+	if e.Type != EventAlertChanged || e.Alert.ID != a1.ID || e.DeviceID != "1234" {
+		t.Error("wrong event: ", e)
+	}
+
+	if a1.State != data.AlertActive || a1.Raised.IsZero() {
+		t.Errorf("wrong alert: %+v", a1)
+	}
+
+	ack, err := db.AlertAck(a1.ID, "sam")
+	if err != nil || ack.State != data.AlertAcknowledged || ack.AckedBy != "sam" {
+		t.Fatalf("wrong ack: %+v, %v", ack, err)
+	}
+
+	active, err := db.Alerts(data.AlertActive)
+	if err != nil || len(active) != 1 || active[0].ID != a2.ID {
+		t.Errorf("wrong active alerts: %+v, %v", active, err)
+	}
+
+	now := time.Now()
+	err = db.AlertClear(1, now)
+	if err != nil {
+		t.Fatal("Error clearing alert: ", err)
+	}
+
+	ret, err := db.Alert(a1.ID)
+	if err != nil || ret.State != data.AlertCleared || !ret.Cleared.Equal(now) {
+		t.Errorf("wrong cleared alert: %+v, %v", ret, err)
+	}
+
+	_, err = db.AlertAck(a1.ID, "sam")
+	if err != ErrAlertCleared {
+		t.Error("expected cleared error: ", err)
+	}
+
+	all, err := db.Alerts("")
+	if err != nil || len(all) != 2 || all[0].ID != a2.ID {
+		t.Errorf("wrong alerts: %+v, %v", all, err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	start := time.Date(2019, 10, 1, 10, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2000; i++ {
+		err := db.DeviceSample("1234", data.Sample{
+			Type:  "temp",
+			Value: float64(i),
+			Time:  start.Add(time.Duration(i) * time.Second),
+		})
+		if err != nil {
+			t.Fatal("Error writing sample: ", err)
+		}
+	}
+
+	// prune all raw samples
+	err := NewDownsampler(db, 0, time.Minute).Run(start.Add(time.Hour * 24))
+	if err != nil {
+		t.Fatal("Error downsampling: ", err)
+	}
+
+	err = db.Compact()
+	if err != nil {
+		t.Fatal("Error compacting: ", err)
+	}
+
+	status := db.CompactStatus()
+	if status.Running || status.SizeAfter >= status.SizeBefore {
+		t.Errorf("compaction did not shrink db: %+v", status)
+	}
+
+	// sequence keys must not be reused after compaction
+	err = db.DeviceSample("1234", data.Sample{Type: "temp", Value: 1})
+	if err != nil {
+		t.Fatal("Error writing sample after compaction: ", err)
+	}
+
+	var records []sampleRecord
+	err = db.store.Find(&records, nil)
+	if err != nil || len(records) != 1 || records[0].Seq <= 2000 {
+		t.Error("sample sequence was not preserved: ", records, err)
+	}
+
+	dev, err := db.Device("1234")
+	if err != nil || len(dev.State.Ios) != 1 {
+		t.Error("device lost after compaction: ", dev, err)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-db-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var stopped []string
+	tenants := NewTenants(dir, nil, func(id string, db *Db) func() {
+		return func() { stopped = append(stopped, id) }
+	})
+	defer tenants.Close()
+
+	_, err = tenants.Get("../escape")
+	if err != ErrInvalidTenant {
+		t.Error("expected invalid tenant error, got: ", err)
+	}
+
+	a, err := tenants.Get("a")
+	if err != nil {
+		t.Fatal("Error opening tenant: ", err)
+	}
+
+	b, err := tenants.Get("b")
+	if err != nil {
+		t.Fatal("Error opening tenant: ", err)
+	}
+
+	err = a.DeviceSample("1234", data.Sample{Type: "temp", Value: 10})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	_, err = b.Device("1234")
+	if err == nil {
+		t.Error("tenant b can see tenant a's device")
+	}
+
+	ids, err := tenants.List()
+	if err != nil || !reflect.DeepEqual(ids, []string{"a", "b"}) {
+		t.Error("wrong tenant list: ", ids, err)
+	}
+
+	err = tenants.Delete("a")
+	if err != nil {
+		t.Fatal("Error deleting tenant: ", err)
+	}
+
+	if !reflect.DeepEqual(stopped, []string{"a"}) {
+		t.Error("tenant workers were not stopped: ", stopped)
+	}
+
+	a, err = tenants.Get("a")
+	if err != nil {
+		t.Fatal("Error opening tenant: ", err)
+	}
+
+	_, err = a.Device("1234")
+	if err == nil {
+		t.Error("deleted tenant data still exists")
+	}
+}
+
+func TestTenantRecords(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	_, err := db.TenantInsert(data.Tenant{ID: "../escape"})
+	if err != ErrInvalidTenant {
+		t.Error("expected invalid tenant error, got: ", err)
+	}
+
+	_, err = db.TenantInsert(data.Tenant{ID: "acme", Name: "Acme"})
+	if err != nil {
+		t.Fatal("Error creating tenant: ", err)
+	}
+
+	_, err = db.TenantInsert(data.Tenant{ID: "acme"})
+	if err != ErrTenantExists {
+		t.Error("expected tenant exists error, got: ", err)
+	}
+
+	_, _, err = db.TenantUserCreate(data.TenantUser{TenantID: "other",
+		Name: "bob", Role: data.TenantRoleUser})
+	if err != bolthold.ErrNotFound {
+		t.Error("created user of missing tenant: ", err)
+	}
+
+	token, user, err := db.TenantUserCreate(data.TenantUser{TenantID: "acme",
+		Name: "bob", Role: data.TenantRoleViewer})
+	if err != nil {
+		t.Fatal("Error creating user: ", err)
+	}
+
+	auth, err := db.TenantAuth(token)
+	if err != nil || auth.ID != user.ID || auth.TenantID != "acme" {
+		t.Error("token did not authenticate user: ", auth, err)
+	}
+
+	_, err = db.TenantAuth("bogus")
+	if err != ErrInvalidToken {
+		t.Error("expected invalid token error, got: ", err)
+	}
+
+	err = db.TenantUserDelete("other", user.ID)
+	if err != bolthold.ErrNotFound {
+		t.Error("deleted user of another tenant: ", err)
+	}
+
+	err = db.TenantDelete("acme")
+	if err != nil {
+		t.Fatal("Error deleting tenant: ", err)
+	}
+
+	_, err = db.TenantAuth(token)
+	if err != ErrInvalidToken {
+		t.Error("user of deleted tenant is still valid: ", err)
+	}
+
+	tenants, err := db.TenantList()
+	if err != nil || len(tenants) != 0 {
+		t.Error("deleted tenant still listed: ", tenants, err)
+	}
+}
+
+func TestPasswordHash(t *testing.T) {
+	hash, err := hashPassword("secret password")
+	if err != nil {
+		t.Fatal("Error hashing password: ", err)
+	}
+
+	ok, rehash, err := checkPassword(hash, "secret password")
+	if err != nil || !ok || rehash {
+		t.Error("password did not match its hash: ", ok, rehash, err)
+	}
+
+	ok, _, err = checkPassword(hash, "wrong password")
+	if err != nil || ok {
+		t.Error("wrong password matched: ", err)
+	}
+
+	_, _, err = checkPassword("bogus", "secret password")
+	if err != errInvalidHash {
+		t.Error("expected invalid hash error, got: ", err)
+	}
+
+	// PBKDF2 hashes from before bcrypt was used still work, and are
+	// replaced on login
+	salt := []byte("0123456789abcdef")
+	legacy := "pbkdf2-sha256$1000$" +
+		base64.RawStdEncoding.EncodeToString(salt) + "$" +
+		base64.RawStdEncoding.EncodeToString(pbkdf2.Key(
+			[]byte("secret password"), salt, 1000, sha256.Size, sha256.New))
+
+	ok, rehash, err = checkPassword(legacy, "secret password")
+	if err != nil || !ok || !rehash {
+		t.Error("legacy hash did not match: ", ok, rehash, err)
+	}
+
+	ok, _, err = checkPassword(legacy, "wrong password")
+	if err != nil || ok {
+		t.Error("wrong password matched legacy hash: ", err)
+	}
+
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	_, err = db.UserInsert(data.User{Username: "bob", Role: data.UserRoleUser},
+		"secret password")
+	if err != nil {
+		t.Fatal("Error creating user: ", err)
+	}
+
+	err = db.update(func(txn *Txn) error {
+		var user data.User
+		err := txn.db.store.TxGet(txn.tx, "bob", &user)
+		if err != nil {
+			return err
+		}
+
+		user.Hash = legacy
+		return txn.db.store.TxUpdate(txn.tx, "bob", &user)
+	})
+	if err != nil {
+		t.Fatal("Error setting legacy hash: ", err)
+	}
+
+	err = db.UserCheckPassword("bob", "secret password")
+	if err != nil {
+		t.Fatal("Error checking legacy password: ", err)
+	}
+
+	user, err := db.User("bob")
+	if err != nil || !strings.HasPrefix(user.Hash, "$2a$") {
+		t.Error("legacy hash was not replaced: ", user.Hash, err)
+	}
+
+	err = db.UserCheckPassword("bob", "secret password")
+	if err != nil {
+		t.Error("Error checking rehashed password: ", err)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	_, err := db.UserInsert(data.User{Username: "bob", Role: data.UserRoleUser},
+		"short")
+	if err == nil {
+		t.Error("created user with short password")
+	}
+
+	_, err = db.UserInsert(data.User{Username: "bob", Role: data.UserRoleUser},
+		"password1")
+	if err != nil {
+		t.Fatal("Error creating user: ", err)
+	}
+
+	_, err = db.UserInsert(data.User{Username: "bob", Role: data.UserRoleAdmin},
+		"password2")
+	if err != ErrUserExists {
+		t.Error("expected user exists error, got: ", err)
+	}
+
+	_, _, err = db.UserLogin("alice", "password1", time.Hour, 24*time.Hour)
+	if err != ErrInvalidLogin {
+		t.Error("expected invalid login for unknown user, got: ", err)
+	}
+
+	token, _, err := db.UserLogin("bob", "password1", time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal("Error logging in: ", err)
+	}
+
+	user, _, err := db.SessionAuth(token, time.Hour)
+	if err != nil || user.Username != "bob" {
+		t.Error("session did not authenticate user: ", user, err)
+	}
+
+	refreshed, _, err := db.SessionRefresh(token, time.Hour)
+	if err != nil {
+		t.Fatal("Error refreshing session: ", err)
+	}
+
+	_, _, err = db.SessionAuth(token, time.Hour)
+	if err != ErrInvalidToken {
+		t.Error("old token valid after refresh: ", err)
+	}
+
+	err = db.SessionDelete(refreshed)
+	if err != nil {
+		t.Fatal("Error logging out: ", err)
+	}
+
+	_, _, err = db.SessionAuth(refreshed, time.Hour)
+	if err != ErrInvalidToken {
+		t.Error("token valid after logout: ", err)
+	}
+
+	// lock the account
+	for i := 0; i < maxFailedLogins; i++ {
+		_, _, err = db.UserLogin("bob", "wrong", time.Hour, 24*time.Hour)
+		if err != ErrInvalidLogin {
+			t.Error("expected invalid login, got: ", err)
+		}
+	}
+
+	_, _, err = db.UserLogin("bob", "password1", time.Hour, 24*time.Hour)
+	if err != ErrUserLocked {
+		t.Error("expected locked account, got: ", err)
+	}
+
+	// a password reset unlocks the account
+	reset, err := db.PasswordResetCreate("bob", time.Hour)
+	if err != nil {
+		t.Fatal("Error creating reset: ", err)
+	}
+
+	err = db.PasswordReset(reset, "password3")
+	if err != nil {
+		t.Fatal("Error resetting password: ", err)
+	}
+
+	err = db.PasswordReset(reset, "password4")
+	if err != ErrInvalidToken {
+		t.Error("reset token used twice: ", err)
+	}
+
+	_, _, err = db.UserLogin("bob", "password3", time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Error("Error logging in with new password: ", err)
+	}
+
+	// sessions don't outlive the user
+	token, _, err = db.UserLogin("bob", "password3", time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal("Error logging in: ", err)
+	}
+
+	err = db.UserDelete("bob")
+	if err != nil {
+		t.Fatal("Error deleting user: ", err)
+	}
+
+	_, _, err = db.SessionAuth(token, time.Hour)
+	if err != ErrInvalidToken {
+		t.Error("session of deleted user is still valid: ", err)
+	}
+}
+
+func TestExternalUsers(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	_, err := db.UserInsert(data.User{Username: "bob", Role: data.UserRoleUser},
+		"password1")
+	if err != nil {
+		t.Fatal("Error creating user: ", err)
+	}
+
+	_, err = db.UserUpsertExternal(data.User{Username: "bob",
+		Role: data.UserRoleAdmin, Provider: "oidc"})
+	if err != ErrUserExists {
+		t.Error("external login took over local user: ", err)
+	}
+
+	sam := data.User{Username: "sam@example.com", Role: data.UserRoleViewer,
+		Provider: "oidc"}
+	_, err = db.UserUpsertExternal(sam)
+	if err != nil {
+		t.Fatal("Error creating external user: ", err)
+	}
+
+	sam.Role = data.UserRoleUser
+	user, err := db.UserUpsertExternal(sam)
+	if err != nil || user.Role != data.UserRoleUser {
+		t.Error("role was not updated: ", user, err)
+	}
+
+	err = db.UserCheckPassword(sam.Username, "")
+	if err != ErrInvalidLogin {
+		t.Error("external user logged in with password: ", err)
+	}
+
+	err = db.UserSetPassword(sam.Username, "password1")
+	if err != ErrExternalUser {
+		t.Error("set password of external user: ", err)
+	}
+
+	_, err = db.PasswordResetCreate(sam.Username, time.Hour)
+	if err != ErrExternalUser {
+		t.Error("created password reset for external user: ", err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	configs := map[string]data.DeviceConfig{
+		"1": {Description: "Pump house 3"},
+		"2": {Description: "Pump house 4", Tags: map[string]string{"site": "North"}},
+		"3": {Description: "Well monitor", Groups: []string{"north-field"}},
+	}
+
+	for id, c := range configs {
+		err := db.DeviceUpdate(data.Device{ID: id, Config: c})
+		if err != nil {
+			t.Fatal("Error updating device: ", err)
+		}
+	}
+
+	check := func(query string, exp ...string) {
+		devs, err := db.Search(query)
+		if err != nil {
+			t.Fatal("Error searching: ", err)
+		}
+
+		var ids []string
+		for _, d := range devs {
+			ids = append(ids, d.ID)
+		}
+
+		if !reflect.DeepEqual(ids, exp) {
+			t.Errorf("search %q returned %v, expected %v", query, ids, exp)
+		}
+	}
+
+	check("pump house 3", "1")
+	check("PUMP", "1", "2")
+	check("nor", "2", "3")
+	check("pump nor", "2")
+	check("missing")
+
+	err := db.DeviceUpdateConfig("1", data.DeviceConfig{Description: "Tank"})
+	if err != nil {
+		t.Fatal("Error updating config: ", err)
+	}
+
+	check("pump", "2")
+}
+
+type testCache map[string][]byte
+
+func (c testCache) Get(key string) ([]byte, bool, error) {
+	v, ok := c[key]
+	return v, ok, nil
+}
+
+func (c testCache) Set(key string, value []byte) error {
+	c[key] = value
+	return nil
+}
+
+func (c testCache) Delete(key string) error {
+	delete(c, key)
+	return nil
+}
+
+func TestCache(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	cache := testCache{}
+	db.SetCache(cache)
+
+	err := db.DeviceSample("1234", data.Sample{Type: "temp", Value: 10})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	if _, ok := cache[cacheDevicePrefix+"1234"]; !ok {
+		t.Fatal("device was not written to cache")
+	}
+
+	// make sure reads are served from the cache
+	cache[cacheDevicePrefix+"1234"] = []byte(`{"id":"1234","config":{"description":"cached"}}`)
+
+	dev, err := db.Device("1234")
+	if err != nil || dev.Config.Description != "cached" {
+		t.Error("device was not read from cache: ", dev, err)
+	}
+
+	err = db.DeviceDelete("1234")
+	if err != nil {
+		t.Fatal("Error deleting device: ", err)
+	}
+
+	if _, ok := cache[cacheDevicePrefix+"1234"]; ok {
+		t.Error("deleted device is still cached")
+	}
+}
+
+func TestRedisReply(t *testing.T) {
+	replies := "+OK\r\n$5\r\nhello\r\n$-1\r\n:3\r\n*2\r\n$1\r\na\r\n:1\r\n-ERR bad\r\n"
+	rd := bufio.NewReader(strings.NewReader(replies))
+
+	exp := []interface{}{
+		[]byte("OK"),
+		[]byte("hello"),
+		errRedisNil,
+		int64(3),
+		[]interface{}{[]byte("a"), int64(1)},
+		redisError("ERR bad"),
+	}
+
+	for _, e := range exp {
+		reply, err := redisReadReply(rd)
+		if err != nil {
+			reply = err
+		}
+
+		if !reflect.DeepEqual(reply, e) {
+			t.Errorf("expected reply %v, got %v", e, reply)
+		}
+	}
+
+	cmd := string(redisCommand("GET", "key"))
+	if cmd != "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n" {
+		t.Errorf("wrong command encoding: %q", cmd)
+	}
+}
+
+func TestIngestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-ingest-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var lock sync.Mutex
+	received := make(map[string][]float64)
+
+	handler := func(ctx context.Context, id string, samples []data.Sample) error {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, s := range samples {
+			received[id] = append(received[id], s.Value)
+		}
+		return nil
+	}
+
+	q, err := NewIngestQueue(dir, 4, handler)
+	if err != nil {
+		t.Fatal("Error opening queue: ", err)
+	}
+
+	// enqueue before starting to simulate a backlog left from a restart
+	for i := 0; i < 50; i++ {
+		for _, id := range []string{"a", "b", "c"} {
+			err := q.Enqueue(id, []data.Sample{{Type: "temp", Value: float64(i)}})
+			if err != nil {
+				t.Fatal("Error enqueuing: ", err)
+			}
+		}
+	}
+
+	err = q.Close()
+	if err != nil {
+		t.Fatal("Error closing queue: ", err)
+	}
+
+	// simulate a partial write from a crash
+	f, err := os.OpenFile(path.Join(dir, ingestSegmentName(1)), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal("Error opening segment: ", err)
+	}
+	f.Write([]byte{0, 0, 0, 100, 1, 2})
+	f.Close()
+
+	q, err = NewIngestQueue(dir, 4, handler)
+	if err != nil {
+		t.Fatal("Error reopening queue: ", err)
+	}
+	q.Start()
+
+	err = q.Enqueue("a", []data.Sample{{Type: "temp", Value: 50}})
+	if err != nil {
+		t.Fatal("Error enqueuing: ", err)
+	}
+
+	for start := time.Now(); q.Pending() > 0; {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timeout waiting for queue to drain")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = q.Close()
+	if err != nil {
+		t.Fatal("Error closing queue: ", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	for _, id := range []string{"a", "b", "c"} {
+		exp := 50
+		if id == "a" {
+			exp = 51
+		}
+
+		if len(received[id]) != exp {
+			t.Fatalf("device %v: expected %v samples, got %v", id, exp, len(received[id]))
+		}
+
+		for i, v := range received[id] {
+			if v != float64(i) {
+				t.Fatalf("device %v: samples out of order: %v", id, received[id])
+			}
+		}
+	}
+
+	// nothing should be processed again after reopening
+	received = make(map[string][]float64)
+	q, err = NewIngestQueue(dir, 4, handler)
+	if err != nil {
+		t.Fatal("Error reopening queue: ", err)
+	}
+
+	if q.Pending() != 0 {
+		t.Error("queue should be empty after reopen, pending: ", q.Pending())
+	}
+
+	q.Close()
+}
+
+type testExporter struct {
+	lock  sync.Mutex
+	spans []trace.SpanData
+}
+
+func (e *testExporter) Export(s trace.SpanData) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+func TestIngestQueueTrace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-ingest-trace-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	exp := &testExporter{}
+	trace.SetTracer(trace.NewTracer(exp, 1))
+	defer trace.SetTracer(nil)
+
+	handled := make(chan trace.SpanContext, 1)
+	q, err := NewIngestQueue(dir, 1, func(ctx context.Context, id string, samples []data.Sample) error {
+		handled <- trace.SpanContextFrom(ctx)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error opening queue: ", err)
+	}
+	defer q.Close()
+	q.Start()
+
+	ctx, span := trace.Start(context.Background(), "request", trace.KindServer)
+	err = q.EnqueueContext(ctx, "1234", []data.Sample{{Type: "temp", Value: 1}})
+	if err != nil {
+		t.Fatal("Error enqueuing: ", err)
+	}
+	span.End(nil)
+
+	var sc trace.SpanContext
+	select {
+	case sc = <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Samples were not processed")
+	}
+
+	// the worker continues the trace of the request
+	if sc.TraceID != span.Context().TraceID {
+		t.Error("Worker did not continue the trace")
+	}
+}
+
+func TestIngestQueueLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-ingest-limit-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sample := []data.Sample{{Type: "temp", Value: 1}}
+
+	// reject
+	q, err := NewIngestQueue(path.Join(dir, "reject"), 1,
+		func(ctx context.Context, id string, samples []data.Sample) error {
+			return nil
+		})
+	if err != nil {
+		t.Fatal("Error opening queue: ", err)
+	}
+
+	q.SetLimit(300, IngestReject)
+
+	for i := 0; err == nil && i < 100; i++ {
+		err = q.Enqueue("1234", sample)
+	}
+
+	if err != ErrIngestFull {
+		t.Fatal("Expected queue full error, got: ", err)
+	}
+
+	if s := q.Stats(); s.Rejected != 1 || s.Pending > s.Limit {
+		t.Errorf("wrong stats after reject: %+v", s)
+	}
+	q.Close()
+
+	// shed
+	var lock sync.Mutex
+	var received []float64
+	q, err = NewIngestQueue(path.Join(dir, "shed"), 1,
+		func(ctx context.Context, id string, samples []data.Sample) error {
+			lock.Lock()
+			defer lock.Unlock()
+			received = append(received, samples[0].Value)
+			return nil
+		})
+	if err != nil {
+		t.Fatal("Error opening queue: ", err)
+	}
+
+	q.SetLimit(300, IngestShed)
+
+	for i := 0; i < 20; i++ {
+		err := q.Enqueue("1234", []data.Sample{{Type: "temp", Value: float64(i)}})
+		if err != nil {
+			t.Fatal("Error enqueuing: ", err)
+		}
+	}
+
+	q.Start()
+
+	start := time.Now()
+	for q.Pending() > 0 {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Queue was not processed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	q.Close()
+
+	lock.Lock()
+	if len(received) == 0 || len(received) >= 20 || received[len(received)-1] != 19 {
+		t.Errorf("shed queue should process the newest samples: %v", received)
+	}
+	lock.Unlock()
+
+	if s := q.Stats(); s.Shed == 0 || int(s.Shed)+len(received) != 20 {
+		t.Errorf("wrong stats after shed: %+v", s)
+	}
+
+	// block
+	release := make(chan struct{})
+	q, err = NewIngestQueue(path.Join(dir, "block"), 1,
+		func(ctx context.Context, id string, samples []data.Sample) error {
+			<-release
+			return nil
+		})
+	if err != nil {
+		t.Fatal("Error opening queue: ", err)
+	}
+	defer q.Close()
+
+	q.SetLimit(300, IngestBlock)
+	q.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	for i := 0; err == nil && i < 100; i++ {
+		err = q.EnqueueContext(ctx, "1234", sample)
+	}
+
+	if err != context.DeadlineExceeded {
+		t.Fatal("Expected enqueue to block until the deadline, got: ", err)
+	}
+
+	if q.Stats().Blocked != 1 {
+		t.Errorf("wrong stats after block: %+v", q.Stats())
+	}
+
+	// enqueues continue once the workers make room
+	close(release)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = q.EnqueueContext(ctx, "1234", sample)
+	if err != nil {
+		t.Error("Error enqueuing after the queue drained: ", err)
+	}
+}
+
+func TestInfluxMapping(t *testing.T) {
+	m := InfluxMapping{
+		DeviceIDTag: "device",
+		GroupsTag:   "groups",
+		DeviceTags:  map[string]string{"site": "site_name"},
+		Types: map[string]InfluxTypeMapping{
+			"temp": {Measurement: "temperature"},
+		},
+	}
+
+	dev := data.Device{
+		ID: "1234",
+		Config: data.DeviceConfig{
+			Groups: []string{"b", "a"},
+			Tags:   map[string]string{"site": "north", "other": "x"},
+		},
+	}
+
+	exp := map[string]string{"device": "1234", "groups": "a,b", "site_name": "north"}
+	if tags := m.deviceTags(&dev); !reflect.DeepEqual(tags, exp) {
+		t.Errorf("wrong device tags: %v", tags)
+	}
+
+	if m.measurement("temp") != "temperature" || m.measurement("volts") != "samples" {
+		t.Error("wrong measurement mapping")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	now := time.Now()
+	samples := []data.Sample{
+		{Type: "temp", Value: 10, Time: now},
+		{Type: "temp", Value: 10, Time: now},
+		{Type: "temp", Value: 11, Time: now.Add(time.Second)},
+	}
+
+	written, err := db.DeviceSamples("1234", samples)
+	if err != nil || len(written) != 2 {
+		t.Fatal("expected 2 samples written: ", written, err)
+	}
+
+	// device retries the post
+	written, err = db.DeviceSamples("1234", samples)
+	if err != nil || len(written) != 0 {
+		t.Fatal("expected retry to be dropped: ", written, err)
+	}
+
+	if db.Duplicates() != 4 {
+		t.Error("wrong duplicate count: ", db.Duplicates())
+	}
+
+	history, err := db.SampleHistory("1234", now.Add(-time.Minute),
+		now.Add(time.Minute), ResolutionRaw)
+	if err != nil || len(history) != 2 {
+		t.Error("wrong sample history: ", history, err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	primary, cleanup := newTestDb(t)
+	defer cleanup()
+
+	follower, cleanup2 := newTestDb(t)
+	defer cleanup2()
+
+	events := primary.Subscribe(EventFilter{})
+	defer primary.Unsubscribe(events)
+
+	follower.SetReadOnly(true)
+
+	err := follower.DeviceUpdate(data.Device{ID: "1234"})
+	if err != ErrReadOnly {
+		t.Fatal("expected read only error, got: ", err)
+	}
+
+	err = primary.DeviceUpdate(data.Device{ID: "1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = primary.DeviceSample("1234", data.Sample{Type: "temp", Value: 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for done := false; !done; {
+		var e Event
+		select {
+		case e = <-events:
+		case <-time.After(100 * time.Millisecond):
+			done = true
+			continue
+		}
+
+		// events are sent to followers as JSON
+		d, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var e2 Event
+		err = json.Unmarshal(d, &e2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = follower.ApplyEvent(e2)
+		if err != nil {
+			t.Fatal("Error applying event: ", err)
+		}
+	}
+
+	dev, err := follower.Device("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dev.State.Ios) != 1 || dev.State.Ios[0].Value != 12 {
+		t.Fatal("sample not replicated: ", dev.State.Ios)
+	}
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	err := db.DeviceSample("1234", data.Sample{Type: "temp", Value: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.DeviceSample("5678", data.Sample{Type: "temp", Value: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// orphan the samples for 5678 and corrupt a command record
+	err = db.store.Delete("5678", data.Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.store.Bolt().Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("DeviceCommand"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("bad"), []byte("not a record"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := db.CheckIntegrity(IntegrityCheck)
+	if err != nil {
+		t.Fatal("Error checking integrity: ", err)
+	}
+
+	if len(result.Issues) != 2 || result.Repaired {
+		t.Fatal("expected 2 issues: ", result)
+	}
+
+	result, err = db.CheckIntegrity(IntegrityQuarantine)
+	if err != nil || !result.Repaired {
+		t.Fatal("Error repairing: ", result, err)
+	}
+
+	result, err = db.CheckIntegrity(IntegrityCheck)
+	if err != nil || len(result.Issues) != 0 {
+		t.Fatal("issues after repair: ", result, err)
+	}
+
+	samples, err := db.SampleHistory("1234", time.Now().Add(-time.Hour),
+		time.Now().Add(time.Hour), ResolutionRaw)
+	if err != nil || len(samples) != 1 {
+		t.Fatal("valid samples should not be removed: ", samples, err)
+	}
+
+	err = db.store.Bolt().View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(quarantineBucket)
+		if b == nil || b.Bucket([]byte("DeviceCommand")) == nil ||
+			b.Bucket([]byte("sampleRecord")) == nil {
+			return errors.New("records were not quarantined")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	err := db.DeviceUpdate(data.Device{ID: "1234",
+		Config: data.DeviceConfig{Groups: []string{"plant"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.options = &Options{UsageLimits: UsageLimits{DevicePoints: 3}}
+
+	for i := 0; i < 3; i++ {
+		err := db.DeviceSample("1234", data.Sample{Type: "temp", Value: float64(i)})
+		if err != nil {
+			t.Fatal("Error writing sample: ", err)
+		}
+	}
+
+	err = db.DeviceSample("1234", data.Sample{Type: "temp", Value: 4})
+	if err != ErrUsageLimit {
+		t.Fatal("expected usage limit error, got: ", err)
+	}
+
+	usage := db.Usage()
+	if usage.Devices["1234"].Points != 3 || usage.Groups["plant"].Points != 3 {
+		t.Fatal("wrong usage: ", usage)
+	}
+
+	// bytes are only updated when usage is counted
+	err = db.usage.load(db.store, db.options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage = db.Usage()
+	if usage.Total.Points != 3 || usage.Total.Bytes <= 0 ||
+		usage.Groups["plant"] != usage.Devices["1234"] {
+		t.Fatal("wrong usage after count: ", usage)
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	_, err := db.Register("dev1", "code1", "")
+	if err != ErrNotClaimed {
+		t.Fatal("expected not claimed, got: ", err)
+	}
+
+	regs, err := db.Registrations()
+	if err != nil || len(regs) != 1 || regs[0].DeviceID != "dev1" ||
+		regs[0].Claimed {
+		t.Fatalf("wrong registrations: %+v, %v", regs, err)
+	}
+
+	err = db.RegistrationClaim("dev1", "wrong")
+	if err != ErrInvalidCode {
+		t.Error("expected invalid code, got: ", err)
+	}
+
+	_, err = db.Register("dev1", "wrong", "")
+	if err != ErrInvalidCode {
+		t.Error("expected invalid code, got: ", err)
+	}
+
+	err = db.RegistrationClaim("dev2", "code1")
+	if err != bolthold.ErrNotFound {
+		t.Error("expected not found, got: ", err)
+	}
+
+	err = db.RegistrationClaim("dev1", "code1")
+	if err != nil {
+		t.Fatal("Error claiming device: ", err)
+	}
+
+	key, err := db.Register("dev1", "code1", "")
+	if err != nil || key == "" {
+		t.Fatal("Error registering claimed device: ", err)
+	}
+
+	id, err := db.DeviceKeyAuth(key)
+	if err != nil || id != "dev1" {
+		t.Error("key does not work: ", id, err)
+	}
+
+	regs, _ = db.Registrations()
+	if len(regs) != 0 {
+		t.Error("registration was not removed")
+	}
+
+	// the key is only returned once
+	_, err = db.Register("dev1", "code1", "")
+	if err != ErrRegistered {
+		t.Error("expected registered, got: ", err)
+	}
+}
+
+func TestRegisterCert(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	issued := 0
+	issue := func() (data.DeviceCert, error) {
+		issued++
+		return data.DeviceCert{Serial: "01" + strconv.Itoa(issued),
+			Expires: time.Now().Add(time.Hour)}, nil
+	}
+
+	_, err := db.RegisterCert("dev1", "code1", "", issue)
+	if err != ErrNotClaimed || issued != 0 {
+		t.Fatal("expected not claimed, got: ", err)
+	}
+
+	err = db.RegistrationClaim("dev1", "code1")
+	if err != nil {
+		t.Fatal("Error claiming device: ", err)
+	}
+
+	cert, err := db.RegisterCert("dev1", "code1", "", issue)
+	if err != nil || cert.DeviceID != "dev1" {
+		t.Fatal("Error registering claimed device: ", cert, err)
+	}
+
+	keys, _ := db.DeviceKeys("dev1")
+	if len(keys) != 0 {
+		t.Error("device key created for cert registration")
+	}
+
+	err = db.DeviceCertAuth(cert.Serial, "dev1")
+	if err != nil {
+		t.Error("cert does not work: ", err)
+	}
+
+	err = db.DeviceCertAuth(cert.Serial, "dev2")
+	if err != ErrInvalidCert {
+		t.Error("cert works for another device: ", err)
+	}
+
+	err = db.DeviceCertAuth("bogus", "dev1")
+	if err != ErrInvalidCert {
+		t.Error("unknown cert works: ", err)
+	}
+
+	// rotate
+	err = db.DeviceCertInsert(data.DeviceCert{Serial: "02", DeviceID: "dev1",
+		Expires: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal("Error inserting cert: ", err)
+	}
+
+	err = db.DeviceCertRevoke(cert.Serial)
+	if err != nil {
+		t.Fatal("Error revoking cert: ", err)
+	}
+
+	err = db.DeviceCertAuth(cert.Serial, "dev1")
+	if err != ErrInvalidCert {
+		t.Error("revoked cert works: ", err)
+	}
+
+	err = db.DeviceCertAuth("02", "dev1")
+	if err != nil {
+		t.Error("rotated cert does not work: ", err)
+	}
+
+	certs, err := db.DeviceCerts("dev1")
+	if err != nil || len(certs) != 2 || certs[0].Revoked.IsZero() {
+		t.Error("wrong certs: ", certs, err)
+	}
+
+	err = db.DeviceCertRevoke("03")
+	if err != bolthold.ErrNotFound {
+		t.Error("expected not found, got: ", err)
+	}
+}
+
+func TestDeviceBatch(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	start := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	batch := func(store string, seq uint64, value float64) data.SampleBatch {
+		return data.SampleBatch{Store: store, Seq: seq, Samples: []data.Sample{
+			{Type: "temp", Value: value, Time: start.Add(time.Duration(seq) * time.Minute)},
+		}}
+	}
+
+	tests := []struct {
+		batch   data.SampleBatch
+		written int
+	}{
+		{batch("a", 1, 1), 1},
+		{batch("a", 2, 2), 1},
+		// sent again after a lost response
+		{batch("a", 2, 2), 0},
+		{batch("a", 1, 1), 0},
+		// the device store was reset
+		{batch("b", 1, 3), 1},
+	}
+
+	for i, test := range tests {
+		written, err := db.DeviceBatch("1234", test.batch)
+		if err != nil {
+			t.Fatal("Error writing batch: ", err)
+		}
+
+		if len(written) != test.written {
+			t.Errorf("%v: expected %v written, got %v", i, test.written,
+				len(written))
+		}
+	}
+
+	_, err := db.DeviceBatch("1234", data.SampleBatch{Seq: 3})
+	if err == nil {
+		t.Error("expected error for batch without a store")
+	}
+
+	err = db.DeviceDelete("1234")
+	if err != nil {
+		t.Fatal("Error deleting device: ", err)
+	}
+
+	written, err := db.DeviceBatch("1234", batch("b", 1, 3))
+	if err != nil || len(written) != 1 {
+		t.Error("batch mark was not deleted with the device: ", err)
+	}
+}
+
+func TestUpstreamMark(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	mark, err := db.UpstreamMark()
+	if err != nil || mark.Seq != 0 || mark.Devices == nil {
+		t.Fatal("wrong initial mark: ", mark, err)
+	}
+
+	start := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i, id := range []string{"a", "b", "a"} {
+		err := db.DeviceSample(id, data.Sample{Type: "temp", Value: float64(i),
+			Time: start.Add(time.Duration(i) * time.Minute)})
+		if err != nil {
+			t.Fatal("Error writing sample: ", err)
+		}
+	}
+
+	samples, err := db.SamplesAfter(0, 2)
+	if err != nil || len(samples) != 2 {
+		t.Fatal("wrong samples: ", samples, err)
+	}
+
+	if samples[0].DeviceID != "a" || samples[1].DeviceID != "b" ||
+		samples[1].Seq <= samples[0].Seq {
+		t.Error("samples are not in write order: ", samples)
+	}
+
+	mark.Seq = samples[1].Seq
+	mark.Devices["a"] = DeviceSyncState{Reported: start}
+	err = db.SetUpstreamMark(mark)
+	if err != nil {
+		t.Fatal("Error setting mark: ", err)
+	}
+
+	mark, err = db.UpstreamMark()
+	if err != nil || !mark.Devices["a"].Reported.Equal(start) {
+		t.Fatal("mark was not stored: ", mark, err)
+	}
+
+	samples, err = db.SamplesAfter(mark.Seq, 10)
+	if err != nil || len(samples) != 1 || samples[0].Sample.Value != 2 {
+		t.Error("wrong samples after mark: ", samples, err)
+	}
+}
+
+func TestDeviceReportConfig(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	events := db.Subscribe(EventFilter{Types: []EventType{EventConfigFailed}})
+	defer db.Unsubscribe(events)
+
+	err := db.DeviceSample("1234", data.Sample{Type: "temp", Value: 21})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	config := data.DeviceConfig{Description: "pump", Hostname: "pump-1"}
+	err = db.DeviceUpdateConfig("1234", config)
+	if err != nil {
+		t.Fatal("Error updating config: ", err)
+	}
+
+	dev, err := db.Device("1234")
+	if err != nil || dev.State.ConfigUpdated.IsZero() {
+		t.Fatalf("config update time not set: %+v, %v", dev.State, err)
+	}
+
+	report := data.ConfigReport{
+		Config: data.DeviceConfig{Description: "pump"},
+		Errors: map[string]string{"hostname": "read-only filesystem"},
+	}
+
+	// the same failure is only published once
+	for i := 0; i < 2; i++ {
+		err = db.DeviceReportConfig("1234", report)
+		if err != nil {
+			t.Fatal("Error reporting config: ", err)
+		}
+	}
+
+	e := <-events
+	if e.Type != EventConfigFailed || e.DeviceID != "1234" ||
+		e.Twin.Status != data.SyncFailed ||
+		e.Twin.Failed()["hostname"] != "read-only filesystem" {
+		t.Errorf("wrong event: %+v", e)
+	}
+
+	err = db.DeviceReportConfig("1234", data.ConfigReport{Config: config})
+	if err != nil {
+		t.Fatal("Error reporting config: ", err)
+	}
+
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event: %+v", e)
+	default:
+	}
+
+	dev, err = db.Device("1234")
+	if err != nil {
+		t.Fatal("Error getting device: ", err)
+	}
+
+	twin := dev.Twin()
+	if twin.Status != data.SyncOK || twin.ReportTime.IsZero() ||
+		len(dev.State.Ios) != 1 {
+		t.Errorf("wrong twin: %+v", twin)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	events := db.Subscribe(EventFilter{Types: []EventType{EventFileReceived}})
+	defer db.Unsubscribe(events)
+
+	content := []byte("camera snapshot")
+	sum := sha256.Sum256(content)
+	f, err := db.FileCreate(data.DeviceFile{DeviceID: "1234", Name: "snap.jpg",
+		Direction: data.FileUpload, Size: int64(len(content)),
+		SHA256: hex.EncodeToString(sum[:])})
+	if err != nil {
+		t.Fatal("Error creating file: ", err)
+	}
+
+	f, err = db.FileWrite(f.ID, 0, content[:6])
+	if err != nil || f.Received != 6 || f.Complete {
+		t.Fatalf("wrong file: %+v, %v", f, err)
+	}
+
+	// a chunk that was already received is rejected with the offset to
+	// continue at
+	f, err = db.FileWrite(f.ID, 0, content[:6])
+	if err != ErrFileOffset || f.Received != 6 {
+		t.Fatalf("expected offset error: %+v, %v", f, err)
+	}
+
+	f, err = db.FileWrite(f.ID, 6, content[6:])
+	if err != nil || !f.Complete {
+		t.Fatalf("file not complete: %+v, %v", f, err)
+	}
+
+	e := <-events
+	if e.File == nil || e.File.ID != f.ID || e.DeviceID != "1234" {
+		t.Errorf("wrong event: %+v", e)
+	}
+
+	d, err := db.FileData(f.ID)
+	if err != nil || string(d) != string(content) {
+		t.Errorf("wrong data: %q, %v", d, err)
+	}
+
+	// data that does not match the digest is discarded
+	blob, err := db.FileCreate(data.DeviceFile{DeviceID: "1234", Name: "blob",
+		Direction: data.FileDownload, Size: 4, SHA256: hex.EncodeToString(sum[:])})
+	if err != nil {
+		t.Fatal("Error creating file: ", err)
+	}
+
+	blob, err = db.FileWrite(blob.ID, 0, []byte("abcd"))
+	if err != ErrFileDigest || blob.Received != 0 {
+		t.Fatalf("expected digest error: %+v, %v", blob, err)
+	}
+
+	d, err = db.FileData(blob.ID)
+	if err != nil || len(d) != 0 {
+		t.Errorf("data not discarded: %q, %v", d, err)
+	}
+
+	// devices are told about files to download
+	sum = sha256.Sum256([]byte("abcd"))
+	blob, err = db.FileCreate(data.DeviceFile{DeviceID: "1234", Name: "blob",
+		Direction: data.FileDownload, Size: 4, SHA256: hex.EncodeToString(sum[:])})
+	if err != nil {
+		t.Fatal("Error creating file: ", err)
+	}
+
+	_, err = db.FileWrite(blob.ID, 0, []byte("abcd"))
+	if err != nil {
+		t.Fatal("Error writing file: ", err)
+	}
+
+	cmds, err := db.DeviceCommands("1234")
+	if err != nil || len(cmds) != 1 || cmds[0].Command != data.FileCommand ||
+		cmds[0].Args["fileId"] != strconv.FormatUint(blob.ID, 10) {
+		t.Errorf("wrong commands: %+v, %v", cmds, err)
+	}
+
+	files, err := db.Files("1234")
+	if err != nil || len(files) != 3 {
+		t.Errorf("wrong files: %+v, %v", files, err)
+	}
+
+	err = db.DeviceSample("1234", data.Sample{Type: "temp", Value: 21})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	err = db.DeviceDelete("1234")
+	if err != nil {
+		t.Fatal("Error deleting device: ", err)
+	}
+
+	files, err = db.Files("1234")
+	if err != nil || len(files) != 0 {
+		t.Errorf("files not deleted with device: %+v, %v", files, err)
+	}
+
+	d, err = db.FileData(f.ID)
+	if err != nil || len(d) != 0 {
+		t.Errorf("file data not deleted: %q, %v", d, err)
+	}
+}
+
+func TestHistoryDelete(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	start := time.Date(2019, 10, 1, 10, 0, 0, 0, time.UTC)
+
+	// 2 hours of samples, and the first hour is compressed
+	for _, id := range []string{"1234", "5678"} {
+		for i := 0; i < 120; i++ {
+			err := db.DeviceSample(id, data.Sample{Type: "temp", Value: float64(i),
+				Time: start.Add(time.Duration(i) * time.Minute)})
+			if err != nil {
+				t.Fatal("Error writing sample: ", err)
+			}
+		}
+	}
+
+	err := db.DeviceUpdateConfig("1234", data.DeviceConfig{Groups: []string{"eu"}})
+	if err != nil {
+		t.Fatal("Error updating config: ", err)
+	}
+
+	err = NewDownsampler(db, time.Hour, time.Minute).Run(start.Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal("Error downsampling: ", err)
+	}
+
+	end := start.Add(3 * time.Hour)
+	history := func(id string, res time.Duration) []data.Sample {
+		ret, err := db.SampleHistory(id, start, end, res)
+		if err != nil {
+			t.Fatal("Error getting history: ", err)
+		}
+		return ret
+	}
+
+	// keep the last 30 minutes
+	r := NewRetainer(db, nil, data.RetentionPolicies{"eu": time.Hour}, time.Hour)
+	err = r.Run(start.Add(150 * time.Minute))
+	if err != nil {
+		t.Fatal("Error applying retention: ", err)
+	}
+
+	raw := history("1234", ResolutionRaw)
+	if len(raw) != 30 || !raw[0].Time.Equal(start.Add(90*time.Minute)) {
+		t.Fatal("Wrong raw history after retention: ", len(raw))
+	}
+
+	mins := history("1234", ResolutionMinute)
+	hours := history("1234", ResolutionHour)
+	if len(mins) != 30 || len(hours) != 1 {
+		t.Error("Wrong aggregates after retention: ", len(mins), len(hours))
+	}
+
+	if len(history("5678", ResolutionRaw)) != 120 {
+		t.Error("Device without policy lost history")
+	}
+
+	audit, err := db.Audit("1234")
+	if err != nil {
+		t.Fatal("Error reading audit: ", err)
+	}
+
+	if len(audit) != 1 || audit[0].Action != "historyDelete" ||
+		audit[0].Message != "retention 1h0m0s: deleted 90 samples before 2019-10-01T11:30:00Z" {
+		t.Errorf("Wrong audit: %+v", audit)
+	}
+
+	// nothing is audited if nothing was deleted
+	err = r.Run(start.Add(150 * time.Minute))
+	if err != nil {
+		t.Fatal("Error applying retention: ", err)
+	}
+
+	var count int
+	err = db.Update(func(txn *Txn) error {
+		var err error
+		count, err = txn.HistoryDelete("5678", time.Time{})
+		return err
+	})
+	if err != nil || count != 120 {
+		t.Fatal("Error deleting history: ", count, err)
+	}
+
+	if len(history("5678", ResolutionRaw)) != 0 || len(history("5678", ResolutionMinute)) != 0 ||
+		len(history("5678", ResolutionHour)) != 0 {
+		t.Error("History was not deleted")
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	db.options = &Options{OfflineTimeout: 15 * time.Minute}
+
+	start := time.Date(2020, 3, 10, 0, 0, 0, 0, time.UTC)
+	sample := func(m int) {
+		err := db.DeviceSample("1234", data.Sample{Type: "temp", Value: 20,
+			Time: start.Add(time.Duration(m) * time.Minute)})
+		if err != nil {
+			t.Fatal("Error writing sample: ", err)
+		}
+	}
+
+	sample(0)
+	sample(10)
+
+	p := NewPresence(db, time.Minute)
+	for _, m := range []int{20, 30, 40} {
+		err := p.Run(start.Add(time.Duration(m) * time.Minute))
+		if err != nil {
+			t.Fatal("Error checking presence: ", err)
+		}
+	}
+
+	sample(60)
+
+	err := db.DeviceUpdateConfig("1234", data.DeviceConfig{Description: "pump",
+		Groups: []string{"plant"}})
+	if err != nil {
+		t.Fatal("Error updating config: ", err)
+	}
+
+	err = db.Update(func(txn *Txn) error {
+		_, err := txn.CommandEnqueue(data.DeviceCommand{DeviceID: "1234",
+			Command: "reboot"})
+		return err
+	})
+	if err != nil {
+		t.Fatal("Error queuing command: ", err)
+	}
+
+	err = db.DeviceReportConfig("1234", data.ConfigReport{
+		Config: data.DeviceConfig{Description: "pump"},
+		Errors: map[string]string{"groups": "not supported"},
+	})
+	if err != nil {
+		t.Fatal("Error reporting config: ", err)
+	}
+
+	alert, err := db.AlertRaise(data.Alert{RuleID: 1, DeviceID: "1234",
+		Message: "pump hot"})
+	if err != nil {
+		t.Fatal("Error raising alert: ", err)
+	}
+
+	_, err = db.AlertAck(alert.ID, "bob")
+	if err != nil {
+		t.Fatal("Error acknowledging alert: ", err)
+	}
+
+	err = db.AlertClear(1, time.Now())
+	if err != nil {
+		t.Fatal("Error clearing alert: ", err)
+	}
+
+	events, err := db.DeviceEvents("1234", time.Time{})
+	if err != nil {
+		t.Fatal("Error getting events: ", err)
+	}
+
+	exp := []struct {
+		typ data.EventType
+		msg string
+	}{
+		{data.EventTypeFirstSeen, "first sample: temp"},
+		{data.EventTypeDisconnected, "no samples for 15m0s since 2020-03-10T00:10:00Z"},
+		{data.EventTypeConnected, "connected after 50m0s without samples"},
+		{data.EventTypeConfigChanged, "changed description, groups"},
+		{data.EventTypeCommand, "queued reboot"},
+		{data.EventTypeConfigFailed, "failed to apply groups: not supported"},
+		{data.EventTypeAlertRaised, "pump hot"},
+		{data.EventTypeAlertAcknowledged, "pump hot (by bob)"},
+		{data.EventTypeAlertCleared, "pump hot"},
+	}
+
+	if len(events) != len(exp) {
+		t.Fatalf("Wrong events: %+v", events)
+	}
+
+	for i, e := range exp {
+		if events[i].Type != e.typ || events[i].Message != e.msg {
+			t.Errorf("Wrong event %v: %+v", i, events[i])
+		}
+	}
+
+	if !events[1].Time.Equal(start.Add(25*time.Minute)) ||
+		events[1].Level != data.EventLevelFault || events[0].Level != data.EventLevelInfo {
+		t.Errorf("Wrong disconnected event: %+v", events[1])
+	}
+
+	// only the events since a time are returned
+	events, _ = db.DeviceEvents("1234", start.Add(time.Hour))
+	if len(events) != len(exp)-2 {
+		t.Errorf("Wrong events since: %+v", events)
+	}
+
+	// events are deleted with the device
+	err = db.DeviceDelete("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, _ = db.DeviceEvents("1234", time.Time{})
+	if len(events) != 0 {
+		t.Errorf("Events not deleted: %+v", events)
+	}
+}
+
+func TestHistoryCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-db-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, &Options{HistoryCache: time.Hour})
+	if err != nil {
+		t.Fatal("Error opening db: ", err)
+	}
+	defer db.Close()
+
+	// the cache has samples written after it was started
+	start := db.series.since.Add(time.Millisecond).Truncate(time.Millisecond)
+	end := start.Add(time.Minute)
+
+	for i := 0; i < 60; i++ {
+		err := db.DeviceSample("1234", data.Sample{Type: "temp", Value: float64(i),
+			Time: start.Add(time.Duration(i) * time.Second)})
+		if err != nil {
+			t.Fatal("Error writing sample: ", err)
+		}
+	}
+
+	err = db.DeviceSample("1234", data.Sample{Type: "pump", ID: "2", Value: 1,
+		Time: start.Add(1500 * time.Millisecond)})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	// the raw history is deleted from the store, so the history can only
+	// come from the cache
+	err = db.store.DeleteMatching(&sampleRecord{}, nil)
+	if err != nil {
+		t.Fatal("Error deleting raw history: ", err)
+	}
+
+	history, err := db.SampleHistory("1234", start, end, ResolutionRaw)
+	if err != nil {
+		t.Fatal("Error getting history: ", err)
+	}
+
+	if len(history) != 61 || history[2].Type != "pump" || history[2].ID != "2" ||
+		!history[59].Time.Equal(start.Add(58*time.Second)) || history[60].Value != 59 {
+		t.Fatalf("Wrong cached history: %v", len(history))
+	}
+
+	// queries from before the cache was started use the store
+	history, _ = db.SampleHistory("1234", start.Add(-time.Second), end,
+		ResolutionRaw)
+	if len(history) != 0 {
+		t.Error("history before the cache came from the cache")
+	}
+
+	err = db.Update(func(txn *Txn) error {
+		_, err := txn.HistoryDelete("1234", start.Add(30*time.Second))
+		return err
+	})
+	if err != nil {
+		t.Fatal("Error deleting history: ", err)
+	}
+
+	history, _ = db.SampleHistory("1234", start, end, ResolutionRaw)
+	if len(history) != 30 || history[0].Value != 30 {
+		t.Errorf("Wrong history after delete: %v", len(history))
+	}
+}
+
+func TestConfigSnapshots(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	for _, id := range []string{"1234", "5678"} {
+		err := db.DeviceSample(id, data.Sample{Type: "temp", Value: 10})
+		if err != nil {
+			t.Fatal("Error writing sample: ", err)
+		}
+
+		err = db.DeviceUpdateConfig(id, data.DeviceConfig{Description: "good",
+			Groups: []string{"eu"}})
+		if err != nil {
+			t.Fatal("Error updating config: ", err)
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	pushed := time.Now()
+
+	for _, id := range []string{"1234", "5678"} {
+		err := db.DeviceUpdateConfig(id, data.DeviceConfig{Description: "bad",
+			Groups: []string{"eu"}, Hostname: "bad"})
+		if err != nil {
+			t.Fatal("Error updating config: ", err)
+		}
+	}
+
+	// unchanged configs are not recorded
+	err := db.DeviceUpdateConfig("1234", data.DeviceConfig{Description: "bad",
+		Groups: []string{"eu"}, Hostname: "bad"})
+	if err != nil {
+		t.Fatal("Error updating config: ", err)
+	}
+
+	snaps, err := db.ConfigSnapshots("1234")
+	if err != nil {
+		t.Fatal("Error getting snapshots: ", err)
+	}
+
+	if len(snaps) != 3 || snaps[0].Version != 1 || snaps[0].Config.Description != "" ||
+		snaps[2].Version != 3 || snaps[2].Config.Hostname != "bad" {
+		t.Fatalf("Wrong snapshots: %+v", snaps)
+	}
+
+	diff := data.ConfigDiff(snaps[1].Config, snaps[2].Config)
+	if len(diff) != 2 || diff[0].Field != "description" || diff[0].To != "bad" ||
+		diff[1].Field != "hostname" || diff[1].From != nil {
+		t.Errorf("Wrong diff: %+v", diff)
+	}
+
+	err = db.Update(func(txn *Txn) error {
+		return txn.ConfigRollback("1234", 7)
+	})
+	if err != ErrConfigVersion {
+		t.Error("Expected ErrConfigVersion, got ", err)
+	}
+
+	var ids []string
+	err = db.Update(func(txn *Txn) error {
+		var err error
+		ids, err = txn.GroupConfigRollback("eu", pushed)
+		return err
+	})
+	if err != nil || len(ids) != 2 {
+		t.Fatal("Error rolling back group: ", ids, err)
+	}
+
+	dev, _ := db.Device("5678")
+	if dev.Config.Description != "good" || dev.Config.Hostname != "" {
+		t.Errorf("Config not rolled back: %+v", dev.Config)
+	}
+
+	snap, err := db.ConfigSnapshot("5678", 4)
+	if err != nil || snap.Reason != "rollback to version 2" {
+		t.Errorf("Wrong rollback snapshot: %+v, %v", snap, err)
+	}
+
+	err = db.DeviceDelete("5678")
+	if err != nil {
+		t.Fatal("Error deleting device: ", err)
+	}
+
+	snaps, _ = db.ConfigSnapshots("5678")
+	if len(snaps) != 0 {
+		t.Error("Snapshots not deleted")
+	}
+}
+
+func TestDeviceTree(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	for _, id := range []string{"gw", "bus", "meter1", "meter2"} {
+		err := db.DeviceSample(id, data.Sample{Type: "temp", Value: 10})
+		if err != nil {
+			t.Fatal("Error writing sample: ", err)
+		}
+	}
+
+	configs := []struct {
+		id     string
+		config data.DeviceConfig
+	}{
+		{"meter1", data.DeviceConfig{Parent: "bus", Groups: []string{"meters"}}},
+		{"meter2", data.DeviceConfig{Parent: "bus"}},
+		{"bus", data.DeviceConfig{Parent: "gw"}},
+		{"gw", data.DeviceConfig{Groups: []string{"plant"}}},
+	}
+
+	for _, c := range configs {
+		err := db.DeviceUpdateConfig(c.id, c.config)
+		if err != nil {
+			t.Fatal("Error updating config: ", err)
+		}
+	}
+
+	// groups are inherited down the tree
+	dev, err := db.Device("meter1")
+	if err != nil {
+		t.Fatal("Error getting device: ", err)
+	}
+
+	if !reflect.DeepEqual(dev.Groups(), []string{"meters", "plant"}) {
+		t.Errorf("wrong groups for meter1: %v", dev.Groups())
+	}
+
+	devices, _, err := db.DevicesFiltered(DeviceFilter{Group: "plant"})
+	if err != nil {
+		t.Fatal("Error filtering devices: ", err)
+	}
+
+	if len(devices) != 4 {
+		t.Errorf("expected 4 devices in plant, got %v", len(devices))
+	}
+
+	children, err := db.DeviceChildren("bus")
+	if err != nil {
+		t.Fatal("Error getting children: ", err)
+	}
+
+	if len(children) != 2 || children[0].ID != "meter1" || children[1].ID != "meter2" {
+		t.Errorf("wrong children: %+v", children)
+	}
+
+	tree, err := db.DeviceTree("gw")
+	if err != nil {
+		t.Fatal("Error getting tree: ", err)
+	}
+
+	if len(tree.Children) != 1 || tree.Children[0].Device.ID != "bus" ||
+		len(tree.Children[0].Children) != 2 {
+		t.Errorf("wrong tree: %+v", tree)
+	}
+
+	// cycles are rejected
+	err = db.DeviceUpdateConfig("gw", data.DeviceConfig{Parent: "meter2",
+		Groups: []string{"plant"}})
+	if err != ErrDeviceCycle {
+		t.Error("Expected cycle error, got: ", err)
+	}
+
+	// group changes and deletes are passed down the tree
+	err = db.DeviceUpdateConfig("gw", data.DeviceConfig{Groups: []string{"north"}})
+	if err != nil {
+		t.Fatal("Error updating config: ", err)
+	}
+
+	dev, _ = db.Device("meter2")
+	if !reflect.DeepEqual(dev.Groups(), []string{"north"}) {
+		t.Errorf("wrong groups after parent changed: %v", dev.Groups())
+	}
+
+	err = db.DeviceDelete("gw")
+	if err != nil {
+		t.Fatal("Error deleting device: ", err)
+	}
+
+	dev, _ = db.Device("meter2")
+	if len(dev.Groups()) != 0 || dev.Config.Parent != "bus" {
+		t.Errorf("wrong device after parent was deleted: %+v", dev)
+	}
+
+	devices, _, err = db.DevicesFiltered(DeviceFilter{Group: "north"})
+	if err != nil {
+		t.Fatal("Error filtering devices: ", err)
+	}
+
+	if len(devices) != 0 {
+		t.Errorf("deleted parent groups still indexed: %+v", devices)
+	}
+}
+
+func TestDeviceTemplates(t *testing.T) {
+	db, cleanup := newTestDb(t)
+	defer cleanup()
+
+	tmpl, err := db.TemplateSet(data.DeviceTemplate{
+		Type:        "meter",
+		Config:      data.DeviceConfig{Timezone: "UTC", Hostname: "meter"},
+		SampleTypes: []string{"kwh", "volts"},
+	})
+	if err != nil {
+		t.Fatal("Error setting template: ", err)
+	}
+
+	if tmpl.Version != 1 {
+		t.Error("wrong template version: ", tmpl.Version)
+	}
+
+	// devices that register with a type get the template when claimed
+	_, err = db.Register("dev1", "code1", "meter")
+	if err != ErrNotClaimed {
+		t.Fatal("Expected not claimed error, got: ", err)
+	}
+
+	err = db.RegistrationClaim("dev1", "code1")
+	if err != nil {
+		t.Fatal("Error claiming device: ", err)
+	}
+
+	dev, err := db.Device("dev1")
+	if err != nil {
+		t.Fatal("Error getting device: ", err)
+	}
+
+	if dev.Config.Type != "meter" || dev.Config.Timezone != "UTC" ||
+		dev.Config.Hostname != "meter" {
+		t.Errorf("template not applied: %+v", dev.Config)
+	}
+
+	// fields that are not in the template are kept by a rollout
+	config := dev.Config
+	config.Description = "north meter"
+	config.Hostname = "custom"
+	err = db.DeviceUpdateConfig("dev1", config)
+	if err != nil {
+		t.Fatal("Error updating config: ", err)
+	}
+
+	tmpl.Config.Timezone = "America/New_York"
+	tmpl, err = db.TemplateSet(tmpl)
+	if err != nil {
+		t.Fatal("Error setting template: ", err)
+	}
+
+	if tmpl.Version != 2 {
+		t.Error("wrong template version: ", tmpl.Version)
+	}
+
+	var updated []string
+	err = db.Update(func(txn *Txn) error {
+		var err error
+		updated, err = txn.TemplateRollout("meter")
+		return err
+	})
+	if err != nil {
+		t.Fatal("Error rolling out template: ", err)
+	}
+
+	if !reflect.DeepEqual(updated, []string{"dev1"}) {
+		t.Errorf("wrong devices updated: %v", updated)
+	}
+
+	dev, _ = db.Device("dev1")
+	if dev.Config.Timezone != "America/New_York" || dev.Config.Hostname != "meter" ||
+		dev.Config.Description != "north meter" {
+		t.Errorf("wrong config after rollout: %+v", dev.Config)
+	}
+
+	snaps, err := db.ConfigSnapshots("dev1")
+	if err != nil {
+		t.Fatal("Error getting snapshots: ", err)
+	}
+
+	if len(snaps) == 0 || snaps[len(snaps)-1].Reason != "template meter version 2" {
+		t.Errorf("rollout not recorded as a config version: %+v", snaps)
+	}
+
+	err = db.DeviceSample("dev1", data.Sample{Type: "kwh", Value: 1})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	instances, err := db.TemplateInstances("meter")
+	if err != nil {
+		t.Fatal("Error getting instances: ", err)
+	}
+
+	if len(instances) != 1 || instances[0].DeviceID != "dev1" ||
+		!reflect.DeepEqual(instances[0].Missing, []string{"volts"}) {
+		t.Errorf("wrong instances: %+v", instances)
+	}
+
+	err = db.Update(func(txn *Txn) error {
+		_, err := txn.TemplateRollout("unknown")
+		return err
+	})
+	if err != bolthold.ErrNotFound {
+		t.Error("Expected not found error, got: ", err)
+	}
+}
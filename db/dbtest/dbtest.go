@@ -0,0 +1,30 @@
+// Package dbtest has helpers for tests of packages that use the db
+package dbtest
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/simpleiot/simpleiot/db"
+)
+
+// New opens a db in a temp dir. The returned function closes the db and
+// removes the dir.
+func New(t testing.TB) (*db.Db, func()) {
+	dir, err := ioutil.TempDir("", "siot-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+
+	dbInst, err := db.NewDb(dir, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal("Error opening db: ", err)
+	}
+
+	return dbInst, func() {
+		dbInst.Close()
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	bolt "go.etcd.io/bbolt"
+)
+
+// dedupWindowSize is the number of recent samples remembered per device.
+// Duplicates are typically caused by a device retrying a post after a
+// network timeout, so the duplicates arrive shortly after the originals.
+const dedupWindowSize = 512
+
+// dedupWindow remembers the most recent sample keys for a device
+type dedupWindow struct {
+	keys map[string]bool
+	ring []string
+	next int
+}
+
+// dedup detects duplicate samples (same device, type, id, time, and
+// value). Samples without a timestamp are never duplicates as they are
+// given the current time.
+type dedup struct {
+	lock       sync.Mutex
+	devices    map[string]*dedupWindow
+	suppressed uint64
+}
+
+func dedupKey(s data.Sample) string {
+	return s.Type + "/" + s.ID + "/" + strconv.FormatInt(s.Time.UnixNano(), 10) +
+		"/" + strconv.FormatUint(math.Float64bits(s.Value), 16)
+}
+
+func (d *dedup) seen(id string, s data.Sample) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	w, ok := d.devices[id]
+	return ok && w.keys[dedupKey(s)]
+}
+
+func (d *dedup) add(id string, s data.Sample) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.devices == nil {
+		d.devices = make(map[string]*dedupWindow)
+	}
+
+	w, ok := d.devices[id]
+	if !ok {
+		w = &dedupWindow{
+			keys: make(map[string]bool),
+			ring: make([]string, dedupWindowSize),
+		}
+		d.devices[id] = w
+	}
+
+	key := dedupKey(s)
+	if w.keys[key] {
+		return
+	}
+
+	delete(w.keys, w.ring[w.next])
+	w.ring[w.next] = key
+	w.keys[key] = true
+	w.next = (w.next + 1) % dedupWindowSize
+}
+
+func (d *dedup) suppress() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.suppressed++
+}
+
+func (d *dedup) remove(id string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.devices, id)
+}
+
+// addOnCommit remembers a sample if tx commits
+func (d *dedup) addOnCommit(tx *bolt.Tx, id string, s data.Sample) {
+	tx.OnCommit(func() {
+		d.add(id, s)
+	})
+}
+
+// Duplicates returns the number of duplicate samples that have been
+// dropped
+func (db *Db) Duplicates() uint64 {
+	db.dedup.lock.Lock()
+	defer db.dedup.lock.Unlock()
+	return db.dedup.suppressed
+}
+
+// DeviceSamples processes a batch of samples for a device in a single
+// transaction. Duplicate samples are dropped, and the samples that were
+// written are returned so they can be forwarded (to influx, etc).
+func (db *Db) DeviceSamples(id string, samples []data.Sample) (ret []data.Sample, err error) {
+	defer db.metrics.observe("DeviceSamples", time.Now(), &err)
+
+	err = db.update(func(txn *Txn) error {
+		ret = nil
+		for _, s := range samples {
+			written, err := txn.deviceSample(id, s)
+			if err != nil {
+				return err
+			}
+
+			if written {
+				ret = append(ret, s)
+			}
+		}
+
+		return nil
+	})
+
+	return
+}
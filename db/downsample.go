@@ -0,0 +1,173 @@
+package db
+
+import (
+	"log"
+	"time"
+
+	"github.com/timshannon/bolthold"
+	bolt "go.etcd.io/bbolt"
+)
+
+// downsampleMark records the last raw sample sequence number that has been
+// rolled into the aggregates.
+type downsampleMark struct {
+	Seq uint64
+}
+
+const downsampleMarkKey = "downsample"
+
+// Downsampler runs in the background and rolls raw samples into 1 minute
+// and 1 hour aggregates. Raw samples are only kept for rawRetention so that
+// long term trend queries stay fast on edge hardware. After rawRetention,
+// the time and value of raw samples are compressed into blocks, which are
+// kept for blockRetention.
+type Downsampler struct {
+	db             *Db
+	rawRetention   time.Duration
+	blockRetention time.Duration
+	interval       time.Duration
+	stop           chan struct{}
+}
+
+// NewDownsampler creates a new downsampler. rawRetention is how long raw
+// samples are kept, and interval is how often the downsampler runs.
+func NewDownsampler(db *Db, rawRetention, interval time.Duration) *Downsampler {
+	return &Downsampler{
+		db:           db,
+		rawRetention: rawRetention,
+		interval:     interval,
+		stop:         make(chan struct{}),
+	}
+}
+
+// SetBlockRetention sets how long compressed raw samples are kept. If 0 (the
+// default), compressed samples are kept forever.
+func (d *Downsampler) SetBlockRetention(retention time.Duration) {
+	d.blockRetention = retention
+}
+
+// Start runs the downsampler in a goroutine until Stop is called
+func (d *Downsampler) Start() {
+	go func() {
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := d.Run(time.Now())
+				if err != nil {
+					log.Println("Error downsampling samples: ", err)
+				}
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the downsampler
+func (d *Downsampler) Stop() {
+	close(d.stop)
+}
+
+// Run does a single downsample pass. All raw samples that have not been
+// processed yet are merged into the aggregates, and then raw samples older
+// than the retention window are compressed. The storage usage is recounted
+// after each pass.
+func (d *Downsampler) Run(now time.Time) error {
+	d.db.lock.RLock()
+	defer d.db.lock.RUnlock()
+
+	var mark downsampleMark
+	err := d.db.store.Get(downsampleMarkKey, &mark)
+	if err != nil && err != bolthold.ErrNotFound {
+		return err
+	}
+
+	var records []sampleRecord
+	err = d.db.store.Find(&records, bolthold.Where(bolthold.Key).Gt(mark.Seq))
+	if err != nil {
+		return err
+	}
+
+	aggs := make(map[string]*sampleAggregate)
+
+	for _, r := range records {
+		for _, res := range []time.Duration{ResolutionMinute, ResolutionHour} {
+			start := r.Time.Truncate(res)
+			key := aggregateKey(r.DeviceID, r.Sample, res, start)
+
+			agg, ok := aggs[key]
+			if !ok {
+				agg = &sampleAggregate{}
+				err := d.db.store.Get(key, agg)
+				if err == bolthold.ErrNotFound {
+					agg.DeviceID = r.DeviceID
+					agg.Resolution = res
+					agg.Sample.ID = r.Sample.ID
+					agg.Sample.Type = r.Sample.Type
+					agg.Sample.Time = start
+					agg.Sample.Duration = res
+				} else if err != nil {
+					return err
+				}
+				aggs[key] = agg
+			}
+
+			agg.merge(r.Sample)
+		}
+
+		if r.Seq > mark.Seq {
+			mark.Seq = r.Seq
+		}
+	}
+
+	for key, agg := range aggs {
+		err := d.db.store.Upsert(key, agg)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = d.db.store.Upsert(downsampleMarkKey, &mark)
+	if err != nil {
+		return err
+	}
+
+	// compress raw samples that are past the retention window
+	err = d.db.store.Bolt().Update(func(tx *bolt.Tx) error {
+		query := bolthold.Where(bolthold.Key).Le(mark.Seq).
+			And("Time").Lt(now.Add(-d.rawRetention))
+
+		var old []sampleRecord
+		err := d.db.store.TxFind(tx, &old, query)
+		if err != nil {
+			return err
+		}
+
+		err = d.db.txBlockAppend(tx, old)
+		if err != nil {
+			return err
+		}
+
+		err = d.db.store.TxDeleteMatching(tx, &sampleRecord{}, query)
+		if err != nil {
+			return err
+		}
+
+		if d.blockRetention <= 0 {
+			return nil
+		}
+
+		return d.db.store.TxDeleteMatching(tx, &sampleBlock{},
+			bolthold.Where("End").Lt(now.Add(-d.blockRetention)))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// compression and pruning change the storage used
+	return d.db.usage.load(d.db.store, d.db.options)
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"log"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+)
+
+// expiringTypes are the record types that have an Expires field and are
+// garbage collected by the Expirer. Records with a zero Expires time
+// never expire.
+var expiringTypes = []interface{}{
+	&data.DeviceCommand{},
+	&data.LogEntry{},
+	&data.SupportArchive{},
+	&data.Alert{},
+	&data.Anomaly{},
+	&data.Event{},
+	&data.Registration{},
+	&data.DeviceFile{},
+	&data.FileChunk{},
+	&data.Session{},
+	&data.PasswordReset{},
+	&data.DeviceCert{},
+	&data.DeviceKey{},
+}
+
+// Expirer runs in the background and deletes expired records so they
+// don't accumulate forever.
+type Expirer struct {
+	db       *Db
+	interval time.Duration
+	stop     chan struct{}
+}
+
+// NewExpirer creates a new expirer that runs every interval
+func NewExpirer(db *Db, interval time.Duration) *Expirer {
+	return &Expirer{
+		db:       db,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start runs the expirer in a goroutine until Stop is called
+func (e *Expirer) Start() {
+	go func() {
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := e.Run(time.Now())
+				if err != nil {
+					log.Println("Error expiring records: ", err)
+				}
+			case <-e.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the expirer
+func (e *Expirer) Stop() {
+	close(e.stop)
+}
+
+// Run deletes all records that expired before now
+func (e *Expirer) Run(now time.Time) (err error) {
+	defer e.db.metrics.observe("Expire", time.Now(), &err)
+
+	e.db.lock.RLock()
+	defer e.db.lock.RUnlock()
+
+	for _, t := range expiringTypes {
+		err := e.db.store.DeleteMatching(t,
+			bolthold.Where("Expires").Ne(time.Time{}).
+				And("Expires").Le(now))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,398 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ArchiveVersion is the version of the JSON archive format written by
+// Export. Bump this if the archive format changes in an incompatible way.
+const ArchiveVersion = 1
+
+// Archive is a portable JSON representation of the dataset. Device groups
+// and tags are part of the device config, so they are included with the
+// devices. Sample history, sessions, and alerts are not included -- use
+// Backup for that.
+type Archive struct {
+	Version       int                   `json:"version"`
+	SchemaVersion int                   `json:"schemaVersion"`
+	Created       time.Time             `json:"created"`
+	Devices       []data.Device         `json:"devices"`
+	Users         []ArchiveUser         `json:"users,omitempty"`
+	Rules         []data.Rule           `json:"rules,omitempty"`
+	Scripts       []data.Script         `json:"scripts,omitempty"`
+	Templates     []data.DeviceTemplate `json:"templates,omitempty"`
+}
+
+// ArchiveUser is a user in an Archive. The password hash is included so
+// local users can log in after an import.
+type ArchiveUser struct {
+	data.User
+	Hash string `json:"hash,omitempty"`
+}
+
+// ImportConflict describes what Import does when a record in the archive
+// already exists in the database.
+type ImportConflict int
+
+// define valid import conflict modes
+const (
+	// ImportSkip keeps the existing record
+	ImportSkip ImportConflict = iota
+	// ImportOverwrite replaces the existing record with the archive record
+	ImportOverwrite
+	// ImportFail aborts the import without changing anything
+	ImportFail
+)
+
+// ParseImportConflict parses an import conflict mode from a string
+func ParseImportConflict(s string) (ImportConflict, error) {
+	switch s {
+	case "", "skip":
+		return ImportSkip, nil
+	case "overwrite":
+		return ImportOverwrite, nil
+	case "fail":
+		return ImportFail, nil
+	default:
+		return ImportSkip, fmt.Errorf("invalid import conflict mode: %v", s)
+	}
+}
+
+// ImportResult describes what was done during an import
+type ImportResult struct {
+	Created     int `json:"created"`
+	Overwritten int `json:"overwritten"`
+	Skipped     int `json:"skipped"`
+}
+
+// ErrImportConflict is returned by Import in ImportFail mode if a record
+// already exists.
+var ErrImportConflict = errors.New("import record already exists")
+
+// ErrArchiveVersion is returned if the archive version is not supported
+var ErrArchiveVersion = errors.New("unsupported archive version")
+
+// Export writes all devices, users, rules, scripts, and templates to w as
+// a JSON Archive
+func (db *Db) Export(w io.Writer) (err error) {
+	defer db.metrics.observe("Export", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	archive := Archive{
+		Version: ArchiveVersion,
+		Created: time.Now().UTC(),
+		Devices: []data.Device{},
+	}
+
+	err = db.store.Bolt().View(func(tx *bolt.Tx) error {
+		var err error
+		archive.SchemaVersion, err = getSchemaVersion(db.store, tx)
+		if err != nil {
+			return err
+		}
+
+		err = db.store.TxFind(tx, &archive.Devices, nil)
+		if err != nil {
+			return err
+		}
+
+		var users []data.User
+		err = db.store.TxFind(tx, &users, nil)
+		if err != nil {
+			return err
+		}
+
+		for _, u := range users {
+			archive.Users = append(archive.Users, ArchiveUser{User: u, Hash: u.Hash})
+		}
+
+		err = db.store.TxFind(tx, &archive.Rules, nil)
+		if err != nil {
+			return err
+		}
+
+		err = db.store.TxFind(tx, &archive.Scripts, nil)
+		if err != nil {
+			return err
+		}
+
+		return db.store.TxFind(tx, &archive.Templates, nil)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(archive.Users, func(i, j int) bool {
+		return archive.Users[i].Username < archive.Users[j].Username
+	})
+	sort.Slice(archive.Rules, func(i, j int) bool {
+		return archive.Rules[i].ID < archive.Rules[j].ID
+	})
+	sort.Slice(archive.Scripts, func(i, j int) bool {
+		return archive.Scripts[i].ID < archive.Scripts[j].ID
+	})
+	sort.Slice(archive.Templates, func(i, j int) bool {
+		return archive.Templates[i].Type < archive.Templates[j].Type
+	})
+
+	en := json.NewEncoder(w)
+	en.SetIndent("", "  ")
+	return en.Encode(archive)
+}
+
+// Import reads a JSON Archive from r and writes it to the database. The
+// entire import is done in one transaction, so nothing is changed if an
+// error occurs. Rules and scripts keep their IDs, so the conflict mode
+// applies to records with the same ID. The state of imported rules and the
+// errors of imported scripts are cleared.
+func (db *Db) Import(r io.Reader, conflict ImportConflict) (ret ImportResult, err error) {
+	defer db.metrics.observe("Import", time.Now(), &err)
+
+	var archive Archive
+	err = json.NewDecoder(r).Decode(&archive)
+	if err != nil {
+		return ret, err
+	}
+
+	if archive.Version < 1 || archive.Version > ArchiveVersion {
+		return ret, ErrArchiveVersion
+	}
+
+	// resolve returns true if a record should be written, and counts it
+	resolve := func(exists bool, kind string, key interface{}) (bool, error) {
+		if !exists {
+			ret.Created++
+			return true, nil
+		}
+
+		switch conflict {
+		case ImportSkip:
+			ret.Skipped++
+			return false, nil
+		case ImportFail:
+			return false, fmt.Errorf("%w: %v %v", ErrImportConflict, kind, key)
+		}
+
+		ret.Overwritten++
+		return true, nil
+	}
+
+	err = db.update(func(txn *Txn) error {
+		tx := txn.tx
+
+		for _, dev := range archive.Devices {
+			if dev.ID == "" {
+				return errors.New("archive contains device without ID")
+			}
+
+			old, err := db.txDeviceGet(tx, dev.ID)
+			if err != nil {
+				return err
+			}
+
+			write, err := resolve(old != nil, "device", dev.ID)
+			if err != nil {
+				return err
+			}
+
+			if !write {
+				continue
+			}
+
+			err = db.txDevicePut(tx, old, dev)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, au := range archive.Users {
+			user := au.User
+			user.Hash = au.Hash
+			user.FailedLogins = 0
+			user.LockedUntil = time.Time{}
+
+			err := user.Validate()
+			if err != nil {
+				return err
+			}
+
+			var old data.User
+			err = db.store.TxGet(tx, user.Username, &old)
+			if err != nil && err != bolthold.ErrNotFound {
+				return err
+			}
+
+			exists := err == nil
+			write, err := resolve(exists, "user", user.Username)
+			if err != nil {
+				return err
+			}
+
+			if !write {
+				continue
+			}
+
+			if exists {
+				// the password may have changed
+				err = txn.deleteUserTokens(user.Username)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = db.store.TxUpsert(tx, user.Username, &user)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, rule := range archive.Rules {
+			rule := rule
+			if rule.ID == 0 {
+				return errors.New("archive contains rule without ID")
+			}
+
+			rule.Active = false
+			rule.Changed = time.Time{}
+
+			err := rule.Validate()
+			if err != nil {
+				return err
+			}
+
+			var old data.Rule
+			err = db.store.TxGet(tx, rule.ID, &old)
+			if err != nil && err != bolthold.ErrNotFound {
+				return err
+			}
+
+			write, err := resolve(err == nil, "rule", rule.ID)
+			if err != nil {
+				return err
+			}
+
+			if !write {
+				continue
+			}
+
+			err = db.txImportSequence(tx, data.Rule{}, rule.ID, &rule)
+			if err != nil {
+				return err
+			}
+
+			db.feed.publishOnCommit(tx, Event{
+				Type: EventRuleChanged,
+				Rule: &rule,
+			})
+		}
+
+		for _, script := range archive.Scripts {
+			script := script
+			if script.ID == 0 {
+				return errors.New("archive contains script without ID")
+			}
+
+			script.Error = ""
+			script.ErrorTime = time.Time{}
+
+			var old data.Script
+			err := db.store.TxGet(tx, script.ID, &old)
+			if err != nil && err != bolthold.ErrNotFound {
+				return err
+			}
+
+			write, err := resolve(err == nil, "script", script.ID)
+			if err != nil {
+				return err
+			}
+
+			if !write {
+				continue
+			}
+
+			err = db.txImportSequence(tx, data.Script{}, script.ID, &script)
+			if err != nil {
+				return err
+			}
+
+			db.feed.publishOnCommit(tx, Event{
+				Type:   EventScriptChanged,
+				Script: &script,
+			})
+		}
+
+		for _, tmpl := range archive.Templates {
+			tmpl := tmpl
+			if tmpl.Type == "" {
+				return errors.New("archive contains template without type")
+			}
+
+			old, err := txn.template(tmpl.Type)
+			if err != nil {
+				return err
+			}
+
+			write, err := resolve(old != nil, "template", tmpl.Type)
+			if err != nil {
+				return err
+			}
+
+			if !write {
+				continue
+			}
+
+			err = db.store.TxUpsert(tx, tmpl.Type, &tmpl)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return ImportResult{}, err
+	}
+
+	return ret, nil
+}
+
+// txImportSequence writes a record with a sequence key, and advances the
+// bucket sequence past the key so later inserts don't reuse it. This
+// version of bolt does not have SetSequence, so NextSequence is called
+// until it reaches the key.
+func (db *Db) txImportSequence(tx *bolt.Tx, dataType interface{}, id uint64, record interface{}) error {
+	err := db.store.TxUpsert(tx, id, record)
+	if err != nil {
+		return err
+	}
+
+	b := tx.Bucket([]byte(reflect.TypeOf(dataType).Name()))
+	if b == nil {
+		return nil
+	}
+
+	for {
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		if seq >= id {
+			return nil
+		}
+	}
+}
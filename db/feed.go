@@ -0,0 +1,282 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/simpleiot/simpleiot/bus"
+	"github.com/simpleiot/simpleiot/data"
+	bolt "go.etcd.io/bbolt"
+)
+
+// EventType describes the type of change in a change feed event
+type EventType int
+
+// define valid change feed event types
+const (
+	EventDeviceCreated EventType = iota
+	EventDeviceUpdated
+	EventDeviceDeleted
+	EventSampleWritten
+	EventCommandQueued
+	EventRuleChanged
+	EventAlertChanged
+	EventConfigFailed
+	EventRolloutChanged
+	EventFileReceived
+	EventScriptChanged
+	EventAnomalyChanged
+)
+
+func (et EventType) String() string {
+	switch et {
+	case EventDeviceCreated:
+		return "deviceCreated"
+	case EventDeviceUpdated:
+		return "deviceUpdated"
+	case EventDeviceDeleted:
+		return "deviceDeleted"
+	case EventSampleWritten:
+		return "sampleWritten"
+	case EventCommandQueued:
+		return "commandQueued"
+	case EventRuleChanged:
+		return "ruleChanged"
+	case EventAlertChanged:
+		return "alertChanged"
+	case EventConfigFailed:
+		return "configFailed"
+	case EventRolloutChanged:
+		return "rolloutChanged"
+	case EventFileReceived:
+		return "fileReceived"
+	case EventScriptChanged:
+		return "scriptChanged"
+	case EventAnomalyChanged:
+		return "anomalyChanged"
+	default:
+		return "unknown"
+	}
+}
+
+// topic returns the bus topic events of the type are published to
+func (et EventType) topic() bus.Topic {
+	switch et {
+	case EventSampleWritten:
+		return bus.TopicSample
+	case EventDeviceCreated, EventDeviceUpdated, EventDeviceDeleted:
+		return bus.TopicDevice
+	case EventCommandQueued:
+		return bus.TopicCommand
+	case EventAlertChanged:
+		return bus.TopicAlert
+	case EventConfigFailed:
+		return bus.TopicConfig
+	default:
+		return bus.TopicChange
+	}
+}
+
+// MarshalText is used to encode the event type as a string in JSON
+func (et EventType) MarshalText() ([]byte, error) {
+	return []byte(et.String()), nil
+}
+
+// UnmarshalText is used to decode the event type from a string in JSON
+func (et *EventType) UnmarshalText(text []byte) error {
+	for t := EventDeviceCreated; t <= EventAnomalyChanged; t++ {
+		if t.String() == string(text) {
+			*et = t
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown event type: %v", string(text))
+}
+
+// Event is sent to change feed subscribers any time data in the store
+// changes. Events are only sent after the change has been committed.
+type Event struct {
+	Type     EventType           `json:"type"`
+	DeviceID string              `json:"deviceId"`
+	Device   *data.Device        `json:"device,omitempty"`
+	Sample   *data.Sample        `json:"sample,omitempty"`
+	Command  *data.DeviceCommand `json:"command,omitempty"`
+	// Rule is the rule that was created, updated, or deleted
+	Rule *data.Rule `json:"rule,omitempty"`
+	// Alert is the alert that was raised, escalated, acknowledged, or
+	// cleared
+	Alert *data.Alert `json:"alert,omitempty"`
+	// Twin is the config sync status of a device that failed to apply its
+	// config
+	Twin *data.Twin `json:"twin,omitempty"`
+	// Rollout is the firmware rollout that was created, updated, or
+	// deleted
+	Rollout *data.Rollout `json:"rollout,omitempty"`
+	// Install is the firmware install a device reported progress for
+	Install *data.FirmwareInstall `json:"install,omitempty"`
+	// File is the file transfer that completed
+	File *data.DeviceFile `json:"file,omitempty"`
+	// Script is the script that was created, updated, or deleted
+	Script *data.Script `json:"script,omitempty"`
+	// Anomaly is the anomaly that was detected or ended
+	Anomaly *data.Anomaly `json:"anomaly,omitempty"`
+}
+
+// EventFilter is used to select which events a subscriber receives. Empty
+// fields match all events.
+type EventFilter struct {
+	DeviceID string
+	Types    []EventType
+}
+
+func (f *EventFilter) match(e Event) bool {
+	if f.DeviceID != "" && f.DeviceID != e.DeviceID {
+		return false
+	}
+
+	if len(f.Types) <= 0 {
+		return true
+	}
+
+	for _, t := range f.Types {
+		if t == e.Type {
+			return true
+		}
+	}
+
+	return false
+}
+
+// subscriberBufferSize is the number of events buffered for each subscriber.
+// If a subscriber falls further behind than this, events are dropped.
+const subscriberBufferSize = 100
+
+type subscriber struct {
+	filter EventFilter
+	ch     chan Event
+	// dropped is the number of events dropped because ch was full
+	dropped uint64
+}
+
+// feed distributes change events to subscribers
+type feed struct {
+	lock        sync.Mutex
+	subscribers []*subscriber
+	// bus, if set, also receives all events
+	bus *bus.Bus
+}
+
+func (f *feed) subscribe(filter EventFilter, size int) <-chan Event {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	s := &subscriber{
+		filter: filter,
+		ch:     make(chan Event, size),
+	}
+
+	f.subscribers = append(f.subscribers, s)
+
+	return s.ch
+}
+
+func (f *feed) unsubscribe(ch <-chan Event) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for i, s := range f.subscribers {
+		if s.ch == ch {
+			close(s.ch)
+			f.subscribers = append(f.subscribers[:i], f.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (f *feed) publish(e Event) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, s := range f.subscribers {
+		if !s.filter.match(e) {
+			continue
+		}
+
+		select {
+		case s.ch <- e:
+		default:
+			s.dropped++
+			log.Printf("db: change feed subscriber is full, dropping %v event (%v dropped)\n",
+				e.Type, s.dropped)
+		}
+	}
+
+	if f.bus != nil {
+		f.bus.Publish(bus.Message{
+			Topic:    e.Type.topic(),
+			Type:     e.Type.String(),
+			DeviceID: e.DeviceID,
+			Payload:  e,
+		})
+	}
+}
+
+// publishOnCommit queues an event to be published if tx commits
+func (f *feed) publishOnCommit(tx *bolt.Tx, e Event) {
+	tx.OnCommit(func() {
+		f.publish(e)
+	})
+}
+
+// Subscribe returns a channel that receives events any time devices or
+// samples matching filter are written. Subscribers must read events
+// promptly -- if a subscriber falls behind, events are dropped. Call
+// Unsubscribe when done.
+func (db *Db) Subscribe(filter EventFilter) <-chan Event {
+	return db.feed.subscribe(filter, subscriberBufferSize)
+}
+
+// SubscribeBuffered is like Subscribe, but buffers size events. It is used
+// by subscribers like forwarders that can fall behind during bursts of
+// samples.
+func (db *Db) SubscribeBuffered(filter EventFilter, size int) <-chan Event {
+	return db.feed.subscribe(filter, size)
+}
+
+// Dropped returns the number of events dropped because a subscriber fell
+// behind
+func (db *Db) Dropped(ch <-chan Event) uint64 {
+	db.feed.lock.Lock()
+	defer db.feed.lock.Unlock()
+
+	for _, s := range db.feed.subscribers {
+		if s.ch == ch {
+			return s.dropped
+		}
+	}
+
+	return 0
+}
+
+// SetBus publishes all change events to an event bus, in addition to the
+// change feed subscribers
+func (db *Db) SetBus(b *bus.Bus) {
+	db.feed.lock.Lock()
+	defer db.feed.lock.Unlock()
+	db.feed.bus = b
+}
+
+// Bus returns the event bus set with SetBus, or nil
+func (db *Db) Bus() *bus.Bus {
+	db.feed.lock.Lock()
+	defer db.feed.lock.Unlock()
+	return db.feed.bus
+}
+
+// Unsubscribe stops events from being sent to a channel returned by
+// Subscribe and closes it.
+func (db *Db) Unsubscribe(ch <-chan Event) {
+	db.feed.unsubscribe(ch)
+}
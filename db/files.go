@@ -0,0 +1,253 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrFileOffset is returned when a file chunk does not start where the
+// data received so far ends
+var ErrFileOffset = errors.New("chunk does not start at the received offset")
+
+// ErrFileDigest is returned when the data of a complete file does not
+// match its digest. The data is discarded, so the transfer can start over.
+var ErrFileDigest = errors.New("file data does not match the sha256 digest")
+
+// FileCreate starts a file transfer. The ID is assigned and the file is
+// returned. Uploaded files expire using the LogTTL option.
+func (db *Db) FileCreate(f data.DeviceFile) (ret data.DeviceFile, err error) {
+	defer db.metrics.observe("FileCreate", time.Now(), &err)
+
+	now := time.Now()
+	f.ID = 0
+	f.Received = 0
+	f.Complete = false
+	f.Created = now
+	f.Updated = now
+	f.Expires = time.Time{}
+
+	if ttl := db.options.logTTL(); f.Direction == data.FileUpload && ttl > 0 {
+		f.Expires = now.Add(ttl)
+	}
+
+	err = db.update(func(txn *Txn) error {
+		err := txn.db.store.TxInsert(txn.tx, bolthold.NextSequence(), &f)
+		if err != nil {
+			return err
+		}
+
+		if f.Size == 0 {
+			// there is no data to wait for
+			return txn.fileComplete(&f)
+		}
+
+		return nil
+	})
+
+	return f, err
+}
+
+// Files returns the files of a device, oldest first
+func (db *Db) Files(deviceID string) (ret []data.DeviceFile, err error) {
+	defer db.metrics.observe("Files", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Find(&ret, bolthold.Where("DeviceID").Eq(deviceID).
+		SortBy("ID"))
+	return
+}
+
+// File returns a file. Returns bolthold.ErrNotFound if it does not exist.
+func (db *Db) File(id uint64) (ret data.DeviceFile, err error) {
+	defer db.metrics.observe("File", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Get(id, &ret)
+	ret.ID = id
+	return
+}
+
+// txFileChunks returns the chunks of a file in order
+func (db *Db) txFileChunks(tx *bolt.Tx, id uint64) ([]data.FileChunk, error) {
+	var chunks []data.FileChunk
+	err := db.store.TxFind(tx, &chunks, bolthold.Where("FileID").Eq(id))
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Offset < chunks[j].Offset
+	})
+	return chunks, err
+}
+
+// FileData returns the data of a file
+func (db *Db) FileData(id uint64) (ret []byte, err error) {
+	defer db.metrics.observe("FileData", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Bolt().View(func(tx *bolt.Tx) error {
+		chunks, err := db.txFileChunks(tx, id)
+		for _, c := range chunks {
+			ret = append(ret, c.Data...)
+		}
+		return err
+	})
+
+	return
+}
+
+// FileWrite adds a chunk of data to a file and returns the updated file.
+// The chunk must start at offset Received, or ErrFileOffset is returned
+// with the file, so the sender can continue from where the server is. When
+// the last chunk is received the digest is checked, and ErrFileDigest is
+// returned if it does not match.
+func (db *Db) FileWrite(id uint64, offset int64, chunk []byte) (ret data.DeviceFile, err error) {
+	defer db.metrics.observe("FileWrite", time.Now(), &err)
+
+	digestErr := false
+
+	err = db.update(func(txn *Txn) error {
+		err := txn.db.store.TxGet(txn.tx, id, &ret)
+		if err != nil {
+			return err
+		}
+		ret.ID = id
+
+		if ret.Complete || offset != ret.Received {
+			return ErrFileOffset
+		}
+
+		if ret.Received+int64(len(chunk)) > ret.Size {
+			return fmt.Errorf("chunk ends after the file size %v", ret.Size)
+		}
+
+		if len(chunk) <= 0 {
+			return nil
+		}
+
+		err = txn.db.store.TxInsert(txn.tx, bolthold.NextSequence(),
+			&data.FileChunk{
+				FileID:  id,
+				Offset:  offset,
+				Data:    chunk,
+				Expires: ret.Expires,
+			})
+		if err != nil {
+			return err
+		}
+
+		ret.Received += int64(len(chunk))
+		ret.Updated = time.Now()
+
+		if ret.Received < ret.Size {
+			return txn.db.store.TxUpdate(txn.tx, id, &ret)
+		}
+
+		chunks, err := txn.db.txFileChunks(txn.tx, id)
+		if err != nil {
+			return err
+		}
+
+		hash := sha256.New()
+		for _, c := range chunks {
+			hash.Write(c.Data)
+		}
+
+		if hex.EncodeToString(hash.Sum(nil)) != ret.SHA256 {
+			// keep the reset, so the sender can start over
+			digestErr = true
+			ret.Received = 0
+			err := txn.db.store.TxDeleteMatching(txn.tx, &data.FileChunk{},
+				bolthold.Where("FileID").Eq(id))
+			if err != nil {
+				return err
+			}
+
+			return txn.db.store.TxUpdate(txn.tx, id, &ret)
+		}
+
+		return txn.fileComplete(&ret)
+	})
+
+	if err == nil && digestErr {
+		err = ErrFileDigest
+	}
+
+	if err == ErrFileOffset {
+		// the caller needs the file to continue from Received
+		f, ferr := db.File(id)
+		if ferr == nil {
+			ret = f
+		}
+	}
+
+	return
+}
+
+// fileComplete marks a file as complete. Devices are sent a FileCommand
+// for files they download.
+func (txn *Txn) fileComplete(f *data.DeviceFile) error {
+	f.Complete = true
+	err := txn.db.store.TxUpdate(txn.tx, f.ID, f)
+	if err != nil {
+		return err
+	}
+
+	if f.Direction == data.FileDownload {
+		_, err := txn.CommandEnqueue(data.DeviceCommand{
+			DeviceID: f.DeviceID,
+			Command:  data.FileCommand,
+			Args: map[string]string{
+				"fileId": strconv.FormatUint(f.ID, 10),
+				"name":   f.Name,
+				"size":   strconv.FormatInt(f.Size, 10),
+				"sha256": f.SHA256,
+				"url": fmt.Sprintf("/v1/devices/%v/files/%v/data",
+					f.DeviceID, f.ID),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	file := *f
+	txn.db.feed.publishOnCommit(txn.tx, Event{
+		Type:     EventFileReceived,
+		DeviceID: f.DeviceID,
+		File:     &file,
+	})
+
+	return nil
+}
+
+// FileDelete deletes a file and its data
+func (db *Db) FileDelete(id uint64) (err error) {
+	defer db.metrics.observe("FileDelete", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		return txn.fileDelete(id)
+	})
+}
+
+func (txn *Txn) fileDelete(id uint64) error {
+	err := txn.db.store.TxDelete(txn.tx, id, data.DeviceFile{})
+	if err != nil {
+		return err
+	}
+
+	return txn.db.store.TxDeleteMatching(txn.tx, &data.FileChunk{},
+		bolthold.Where("FileID").Eq(id))
+}
@@ -0,0 +1,500 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+)
+
+// ErrFirmwareInUse is returned when deleting firmware that a rollout uses
+var ErrFirmwareInUse = errors.New("firmware is used by a rollout")
+
+// FirmwareAdd stores a firmware file. The size and digest are set from
+// the file, and the firmware is returned. The signature must be checked
+// by the caller.
+func (db *Db) FirmwareAdd(fw data.Firmware, file []byte) (ret data.Firmware, err error) {
+	defer db.metrics.observe("FirmwareAdd", time.Now(), &err)
+
+	sum := sha256.Sum256(file)
+	fw.ID = 0
+	fw.Size = int64(len(file))
+	fw.SHA256 = hex.EncodeToString(sum[:])
+	fw.Created = time.Now()
+
+	err = db.update(func(txn *Txn) error {
+		err := txn.db.store.TxInsert(txn.tx, bolthold.NextSequence(), &fw)
+		if err != nil {
+			return err
+		}
+
+		err = txn.db.store.TxInsert(txn.tx, fw.ID,
+			&data.FirmwareData{ID: fw.ID, Data: file})
+		if err != nil {
+			return err
+		}
+
+		return txn.AuditAppend(data.AuditRecord{
+			Action:  "firmwareAdd",
+			Message: fmt.Sprintf("%v %v (%v)", fw.Name, fw.Version, fw.ID),
+		})
+	})
+
+	return fw, err
+}
+
+// Firmwares returns all firmware, oldest first
+func (db *Db) Firmwares() (ret []data.Firmware, err error) {
+	defer db.metrics.observe("Firmwares", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Find(&ret, nil)
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return
+}
+
+// Firmware returns a firmware. Returns bolthold.ErrNotFound if it does not
+// exist.
+func (db *Db) Firmware(id uint64) (ret data.Firmware, err error) {
+	defer db.metrics.observe("Firmware", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Get(id, &ret)
+	ret.ID = id
+	return
+}
+
+// FirmwareFile returns the file of a firmware
+func (db *Db) FirmwareFile(id uint64) (ret []byte, err error) {
+	defer db.metrics.observe("FirmwareFile", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var d data.FirmwareData
+	err = db.store.Get(id, &d)
+	return d.Data, err
+}
+
+// FirmwareDelete deletes a firmware. Returns ErrFirmwareInUse if a rollout
+// uses it.
+func (db *Db) FirmwareDelete(id uint64) (err error) {
+	defer db.metrics.observe("FirmwareDelete", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		var rollouts []data.Rollout
+		err := txn.db.store.TxFind(txn.tx, &rollouts,
+			bolthold.Where("FirmwareID").Eq(id))
+		if err != nil {
+			return err
+		}
+
+		if len(rollouts) > 0 {
+			return ErrFirmwareInUse
+		}
+
+		err = txn.db.store.TxDelete(txn.tx, id, data.Firmware{})
+		if err != nil {
+			return err
+		}
+
+		err = txn.db.store.TxDelete(txn.tx, id, data.FirmwareData{})
+		if err != nil && err != bolthold.ErrNotFound {
+			return err
+		}
+
+		return txn.AuditAppend(data.AuditRecord{
+			Action:  "firmwareDelete",
+			Message: strconv.FormatUint(id, 10),
+		})
+	})
+}
+
+// Rollouts returns all rollouts
+func (db *Db) Rollouts() (ret []data.Rollout, err error) {
+	defer db.metrics.observe("Rollouts", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Find(&ret, nil)
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return
+}
+
+// Rollout returns a rollout. Returns bolthold.ErrNotFound if it does not
+// exist.
+func (db *Db) Rollout(id uint64) (ret data.Rollout, err error) {
+	defer db.metrics.observe("Rollout", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Get(id, &ret)
+	ret.ID = id
+	return
+}
+
+// RolloutInsert creates a rollout. The ID is set and the rollout is
+// returned. Returns bolthold.ErrNotFound if the firmware does not exist.
+func (db *Db) RolloutInsert(r data.Rollout) (ret data.Rollout, err error) {
+	defer db.metrics.observe("RolloutInsert", time.Now(), &err)
+
+	r.ID = 0
+	r.Reason = ""
+	r.Created = time.Now()
+
+	err = db.update(func(txn *Txn) error {
+		var fw data.Firmware
+		err := txn.db.store.TxGet(txn.tx, r.FirmwareID, &fw)
+		if err != nil {
+			return err
+		}
+
+		err = txn.db.store.TxInsert(txn.tx, bolthold.NextSequence(), &r)
+		if err != nil {
+			return err
+		}
+
+		txn.db.feed.publishOnCommit(txn.tx, Event{
+			Type:    EventRolloutChanged,
+			Rollout: &r,
+		})
+
+		return txn.AuditAppend(data.AuditRecord{
+			Action: "rolloutCreate",
+			Message: fmt.Sprintf("%v: %v %v", r.ID, fw.Name,
+				fw.Version),
+		})
+	})
+
+	return r, err
+}
+
+// RolloutUpdate replaces a rollout, like to raise the percent or pause it.
+// The firmware and creation time can't be changed. Returns
+// bolthold.ErrNotFound if it does not exist.
+func (db *Db) RolloutUpdate(r data.Rollout) (err error) {
+	defer db.metrics.observe("RolloutUpdate", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		var old data.Rollout
+		err := txn.db.store.TxGet(txn.tx, r.ID, &old)
+		if err != nil {
+			return err
+		}
+
+		r.FirmwareID = old.FirmwareID
+		r.Created = old.Created
+		if r.State == old.State {
+			r.Reason = old.Reason
+		}
+
+		err = txn.db.store.TxUpdate(txn.tx, r.ID, &r)
+		if err != nil {
+			return err
+		}
+
+		txn.db.feed.publishOnCommit(txn.tx, Event{
+			Type:    EventRolloutChanged,
+			Rollout: &r,
+		})
+
+		return txn.AuditAppend(data.AuditRecord{
+			Action: "rolloutUpdate",
+			Message: fmt.Sprintf("%v: %v %v%%", r.ID, r.State,
+				r.Percent),
+		})
+	})
+}
+
+// RolloutSetState changes the state of a rollout, like when it is halted
+// because too many installs failed
+func (db *Db) RolloutSetState(id uint64, state, reason string) (err error) {
+	defer db.metrics.observe("RolloutSetState", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		var r data.Rollout
+		err := txn.db.store.TxGet(txn.tx, id, &r)
+		if err != nil {
+			return err
+		}
+
+		r.ID = id
+		r.State = state
+		r.Reason = reason
+
+		err = txn.db.store.TxUpdate(txn.tx, id, &r)
+		if err != nil {
+			return err
+		}
+
+		txn.db.feed.publishOnCommit(txn.tx, Event{
+			Type:    EventRolloutChanged,
+			Rollout: &r,
+		})
+
+		msg := fmt.Sprintf("%v: %v", id, state)
+		if reason != "" {
+			msg += ": " + reason
+		}
+
+		return txn.AuditAppend(data.AuditRecord{
+			Action:  "rolloutState",
+			Message: msg,
+		})
+	})
+}
+
+// RolloutDelete deletes a rollout and its installs. Devices that are
+// already updating are not stopped.
+func (db *Db) RolloutDelete(id uint64) (err error) {
+	defer db.metrics.observe("RolloutDelete", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		err := txn.db.store.TxDelete(txn.tx, id, data.Rollout{})
+		if err != nil {
+			return err
+		}
+
+		err = txn.db.store.TxDeleteMatching(txn.tx, &data.FirmwareInstall{},
+			bolthold.Where("RolloutID").Eq(id).Index("RolloutID"))
+		if err != nil {
+			return err
+		}
+
+		txn.db.feed.publishOnCommit(txn.tx, Event{
+			Type:    EventRolloutChanged,
+			Rollout: &data.Rollout{ID: id},
+		})
+
+		return txn.AuditAppend(data.AuditRecord{
+			Action:  "rolloutDelete",
+			Message: strconv.FormatUint(id, 10),
+		})
+	})
+}
+
+// RolloutDevices returns the IDs of the devices in the groups of a
+// rollout, in the order they are updated. The order is random, but the same
+// each time for a rollout, so raising the percent adds devices.
+func (db *Db) RolloutDevices(r data.Rollout) (ret []string, err error) {
+	defer db.metrics.observe("RolloutDevices", time.Now(), &err)
+
+	devices, err := db.Devices()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]bool)
+	for _, g := range r.Groups {
+		groups[g] = true
+	}
+
+	order := make(map[string]uint64)
+	for _, dev := range devices {
+		member := len(groups) <= 0
+		for _, g := range dev.Groups() {
+			member = member || groups[g]
+		}
+
+		if !member {
+			continue
+		}
+
+		ret = append(ret, dev.ID)
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%v/%v", r.ID, dev.ID)))
+		order[dev.ID] = binary.BigEndian.Uint64(sum[:])
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return order[ret[i]] < order[ret[j]] })
+	return
+}
+
+// RolloutStatus returns a rollout and the number of installs in each state
+func (db *Db) RolloutStatus(r data.Rollout) (ret data.RolloutStatus, err error) {
+	devices, err := db.RolloutDevices(r)
+	if err != nil {
+		return
+	}
+
+	installs, err := db.FirmwareInstalls(r.ID)
+	if err != nil {
+		return
+	}
+
+	ret = data.RolloutStatus{
+		Rollout:  r,
+		Devices:  len(devices),
+		Installs: make(map[string]int),
+	}
+
+	for _, i := range installs {
+		ret.Installs[i.State]++
+	}
+
+	return
+}
+
+// FirmwareInstalls returns the installs of a rollout
+func (db *Db) FirmwareInstalls(rolloutID uint64) (ret []data.FirmwareInstall, err error) {
+	defer db.metrics.observe("FirmwareInstalls", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Find(&ret,
+		bolthold.Where("RolloutID").Eq(rolloutID).Index("RolloutID"))
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Created.Before(ret[j].Created)
+	})
+	return
+}
+
+// DeviceFirmwareInstalls returns the installs of a device, oldest first
+func (db *Db) DeviceFirmwareInstalls(id string) (ret []data.FirmwareInstall, err error) {
+	defer db.metrics.observe("DeviceFirmwareInstalls", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Find(&ret, bolthold.Where("DeviceID").Eq(id).Index("DeviceID"))
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Created.Before(ret[j].Created)
+	})
+	return
+}
+
+// FirmwareDispatch sends the firmware of a rollout to a device. The
+// install record and the firmware command are written atomically.
+func (db *Db) FirmwareDispatch(r data.Rollout, fw data.Firmware, deviceID string) (err error) {
+	defer db.metrics.observe("FirmwareDispatch", time.Now(), &err)
+
+	now := time.Now()
+	install := data.FirmwareInstall{
+		ID:        data.FirmwareInstallID(r.ID, deviceID),
+		RolloutID: r.ID,
+		DeviceID:  deviceID,
+		State:     data.InstallPending,
+		Created:   now,
+		Updated:   now,
+	}
+
+	return db.update(func(txn *Txn) error {
+		err := txn.db.store.TxInsert(txn.tx, install.ID, &install)
+		if err != nil {
+			return err
+		}
+
+		_, err = txn.CommandEnqueue(data.DeviceCommand{
+			DeviceID: deviceID,
+			Command:  data.FirmwareCommand,
+			Args: map[string]string{
+				"rolloutId":  strconv.FormatUint(r.ID, 10),
+				"firmwareId": strconv.FormatUint(fw.ID, 10),
+				"version":    fw.Version,
+				"size":       strconv.FormatInt(fw.Size, 10),
+				"sha256":     fw.SHA256,
+				"signature":  fw.Signature,
+				"url":        fmt.Sprintf("/v1/firmware/%v/file", fw.ID),
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		return txn.AuditAppend(data.AuditRecord{
+			DeviceID: deviceID,
+			Action:   "firmwareDispatch",
+			Message: fmt.Sprintf("rollout %v: %v %v", r.ID, fw.Name,
+				fw.Version),
+		})
+	})
+}
+
+// FirmwareReport updates the install of a rollout on a device with the
+// progress the device reported. Returns bolthold.ErrNotFound if the
+// firmware was not sent to the device by the rollout.
+func (db *Db) FirmwareReport(deviceID string, report data.FirmwareReport) (ret data.FirmwareInstall, err error) {
+	defer db.metrics.observe("FirmwareReport", time.Now(), &err)
+
+	err = db.update(func(txn *Txn) error {
+		id := data.FirmwareInstallID(report.RolloutID, deviceID)
+		err := txn.db.store.TxGet(txn.tx, id, &ret)
+		if err != nil {
+			return err
+		}
+
+		ret.ID = id
+		prev := ret.State
+		ret.State = report.State
+		ret.Progress = report.Progress
+		ret.Error = report.Error
+		if report.Version != "" {
+			ret.Version = report.Version
+		}
+		ret.Updated = time.Now()
+
+		err = txn.db.store.TxUpdate(txn.tx, id, &ret)
+		if err != nil {
+			return err
+		}
+
+		install := ret
+		txn.db.feed.publishOnCommit(txn.tx, Event{
+			Type:     EventRolloutChanged,
+			DeviceID: deviceID,
+			Install:  &install,
+		})
+
+		// progress within a state is not recorded in the timeline
+		if ret.State != prev {
+			e := data.Event{
+				DeviceID: deviceID,
+				Time:     ret.Updated,
+				Type:     data.EventTypeFirmwareUpdate,
+				Message:  fmt.Sprintf("rollout %v: %v", report.RolloutID, ret.State),
+			}
+			if ret.Version != "" && ret.State == data.InstallDone {
+				e.Message += " " + ret.Version
+			}
+			if ret.Error != "" {
+				e.Level = data.EventLevelFault
+				e.Message += ": " + ret.Error
+			}
+
+			err := txn.DeviceEventAppend(e)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !ret.Finished() {
+			return nil
+		}
+
+		msg := fmt.Sprintf("rollout %v: %v", report.RolloutID, ret.State)
+		if ret.Error != "" {
+			msg += ": " + ret.Error
+		}
+
+		return txn.AuditAppend(data.AuditRecord{
+			DeviceID: deviceID,
+			Action:   "firmwareInstall",
+			Message:  msg,
+		})
+	})
+
+	return
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"sort"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+	bolt "go.etcd.io/bbolt"
+)
+
+// sampleRecord is used to store a raw sample in the local sample history.
+// Records are keyed by a sequence number so the downsampler can track
+// which samples it has already processed.
+type sampleRecord struct {
+	Seq      uint64 `boltholdKey:"Seq"`
+	DeviceID string `boltholdIndex:"DeviceID"`
+	Time     time.Time
+	Sample   data.Sample
+}
+
+// sampleAggregate stores the average/min/max of samples for a device IO
+// over a fixed time window (resolution).
+type sampleAggregate struct {
+	DeviceID   string `boltholdIndex:"DeviceID"`
+	Resolution time.Duration
+	Count      int
+	Sum        float64
+	Sample     data.Sample
+}
+
+// define supported history resolutions
+const (
+	ResolutionRaw    time.Duration = 0
+	ResolutionMinute               = time.Minute
+	ResolutionHour                 = time.Hour
+)
+
+func aggregateKey(deviceID string, s data.Sample, res time.Duration, start time.Time) string {
+	return deviceID + "/" + s.Type + "/" + s.ID + "/" + res.String() + "/" +
+		start.UTC().Format(time.RFC3339)
+}
+
+// merge adds a sample to the aggregate
+func (a *sampleAggregate) merge(s data.Sample) {
+	if a.Count == 0 || s.Value < a.Sample.Min {
+		a.Sample.Min = s.Value
+	}
+
+	if a.Count == 0 || s.Value > a.Sample.Max {
+		a.Sample.Max = s.Value
+	}
+
+	a.Count++
+	a.Sum += s.Value
+	a.Sample.Value = a.Sum / float64(a.Count)
+}
+
+// txHistoryInsert adds a sample to the raw sample history
+func (db *Db) txHistoryInsert(tx *bolt.Tx, id string, sample data.Sample) error {
+	err := db.store.TxInsert(tx, bolthold.NextSequence(), &sampleRecord{
+		DeviceID: id,
+		Time:     sample.Time,
+		Sample:   sample,
+	})
+	if err != nil {
+		return err
+	}
+
+	db.series.addOnCommit(tx, id, sample)
+	return nil
+}
+
+// SampleHistory returns the samples for a device between start and end. If
+// resolution is ResolutionRaw, the raw samples are returned (samples older
+// than the raw retention only include the time and value), otherwise
+// the aggregates for the requested resolution are returned where Value is
+// the average over the window and Duration is the window length. Raw
+// samples in the history cache window are served from the cache if it is
+// enabled, and only include the type, id, time (ms resolution), and value.
+func (db *Db) SampleHistory(id string, start, end time.Time, resolution time.Duration) (ret []data.Sample, err error) {
+	defer db.metrics.observe("SampleHistory", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if resolution == ResolutionRaw {
+		cached, ok, err := db.series.history(id, start, end)
+		if ok || err != nil {
+			return cached, err
+		}
+
+		// older raw samples are stored in compressed blocks
+		ret, err = db.blockHistory(id, start, end)
+		if err != nil {
+			return nil, err
+		}
+
+		var records []sampleRecord
+		err = db.store.Find(&records, bolthold.Where("DeviceID").Eq(id).
+			And("Time").Ge(start).And("Time").Lt(end))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range records {
+			ret = append(ret, r.Sample)
+		}
+
+		sort.SliceStable(ret, func(i, j int) bool {
+			return ret[i].Time.Before(ret[j].Time)
+		})
+
+		return ret, nil
+	}
+
+	var aggs []sampleAggregate
+	err = db.store.Find(&aggs, bolthold.Where("DeviceID").Eq(id).
+		And("Resolution").Eq(resolution).
+		And("Sample.Time").Ge(start).And("Sample.Time").Lt(end).
+		SortBy("Sample.Time"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range aggs {
+		ret = append(ret, a.Sample)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,409 @@
+package db
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+	bolt "go.etcd.io/bbolt"
+)
+
+// device indexes are stored in the deviceIndex bucket with a sub bucket
+// for each index. Each index bucket has a sub bucket for each value which
+// contains the IDs of the devices that match that value.
+var deviceIndexBucket = []byte("deviceIndex")
+
+// maxWordPrefix is the longest search word prefix that is indexed. Longer
+// query words match on their first maxWordPrefix letters.
+const maxWordPrefix = 32
+
+// define device indexes
+const (
+	indexGroup = "group"
+	indexTag   = "tag"
+	indexIo    = "io"
+	indexWord  = "word"
+	// indexParent is the devices attached to each device
+	indexParent = "parent"
+	// indexType is the devices of each template type
+	indexType = "type"
+	// indexState is the devices with each config sync status
+	indexState = "state"
+)
+
+// searchWords splits text into lower case words for the search index
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// deviceIndexValues returns the values a device should be indexed under.
+// Empty values are not indexed, since bolt bucket names can't be empty.
+func deviceIndexValues(dev *data.Device) map[string][]string {
+	ret := make(map[string][]string)
+
+	groups := dev.Groups()
+	for _, g := range groups {
+		if g != "" {
+			ret[indexGroup] = append(ret[indexGroup], g)
+		}
+	}
+
+	if dev.Config.Parent != "" {
+		ret[indexParent] = append(ret[indexParent], dev.Config.Parent)
+	}
+
+	if dev.Config.Type != "" {
+		ret[indexType] = append(ret[indexType], dev.Config.Type)
+	}
+
+	for k, v := range dev.Config.Tags {
+		if k != "" && v != "" {
+			ret[indexTag] = append(ret[indexTag], k+"="+v)
+		}
+	}
+
+	for _, io := range dev.State.Ios {
+		if io.Type != "" {
+			ret[indexIo] = append(ret[indexIo], io.Type)
+		}
+	}
+
+	ret[indexState] = append(ret[indexState], dev.Twin().Status)
+
+	words := make(map[string]bool)
+	text := []string{dev.ID, dev.Config.Description}
+	text = append(text, groups...)
+	for k, v := range dev.Config.Tags {
+		text = append(text, k, v)
+	}
+
+	for _, t := range text {
+		for _, w := range searchWords(t) {
+			words[w] = true
+		}
+	}
+
+	// each prefix is indexed, so words are found with exact lookups,
+	// which also work when values are hashed
+	prefixes := make(map[string]bool)
+	for w := range words {
+		r := []rune(w)
+		for i := 1; i <= len(r) && i <= maxWordPrefix; i++ {
+			prefixes[string(r[:i])] = true
+		}
+	}
+
+	for p := range prefixes {
+		ret[indexWord] = append(ret[indexWord], p)
+	}
+
+	return ret
+}
+
+// deviceIndex reads and writes the device indexes. If the db is encrypted,
+// index values are stored as keyed HMACs and device IDs are encrypted, so
+// the device metadata in the indexes is not written to disk in plain text.
+type deviceIndex struct {
+	// mac and crypt are nil if the db is not encrypted
+	mac   []byte
+	crypt *cryptCodec
+}
+
+func newDeviceIndex(options *Options) (*deviceIndex, error) {
+	if options == nil || options.EncryptionKey == nil {
+		return &deviceIndex{}, nil
+	}
+
+	crypt, err := newCryptCodec(deriveKey(options.EncryptionKey, "siot-db-index"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &deviceIndex{
+		mac:   deriveKey(options.EncryptionKey, "siot-db-index-mac"),
+		crypt: crypt,
+	}, nil
+}
+
+// valueKey returns the bucket name of an index value
+func (di *deviceIndex) valueKey(value string) []byte {
+	if di.mac == nil {
+		return []byte(value)
+	}
+
+	mac := hmac.New(sha256.New, di.mac)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// idKey returns the key a device ID is stored under in an index value
+// bucket
+func (di *deviceIndex) idKey(id string) ([]byte, error) {
+	if di.crypt == nil {
+		return []byte(id), nil
+	}
+
+	return di.crypt.encode(id)
+}
+
+// id returns the device ID of an index value key
+func (di *deviceIndex) id(k []byte) (string, error) {
+	if di.crypt == nil {
+		return string(k), nil
+	}
+
+	var ret string
+	err := di.crypt.decode(k, &ret)
+	return ret, err
+}
+
+// update updates the device indexes. old should be nil for new devices,
+// and dev should be nil for deleted devices.
+func (di *deviceIndex) update(tx *bolt.Tx, old, dev *data.Device) error {
+	root, err := tx.CreateBucketIfNotExists(deviceIndexBucket)
+	if err != nil {
+		return err
+	}
+
+	if old != nil {
+		id, err := di.idKey(old.ID)
+		if err != nil {
+			return err
+		}
+
+		for index, values := range deviceIndexValues(old) {
+			ib := root.Bucket([]byte(index))
+			if ib == nil {
+				continue
+			}
+
+			for _, v := range values {
+				vb := ib.Bucket(di.valueKey(v))
+				if vb == nil {
+					continue
+				}
+
+				err := vb.Delete(id)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if dev != nil {
+		id, err := di.idKey(dev.ID)
+		if err != nil {
+			return err
+		}
+
+		for index, values := range deviceIndexValues(dev) {
+			ib, err := root.CreateBucketIfNotExists([]byte(index))
+			if err != nil {
+				return err
+			}
+
+			for _, v := range values {
+				vb, err := ib.CreateBucketIfNotExists(di.valueKey(v))
+				if err != nil {
+					return err
+				}
+
+				err = vb.Put(id, []byte{})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// lookup returns the IDs of devices that match an index value
+func (di *deviceIndex) lookup(tx *bolt.Tx, index, value string) map[string]bool {
+	ret := make(map[string]bool)
+
+	root := tx.Bucket(deviceIndexBucket)
+	if root == nil {
+		return ret
+	}
+
+	ib := root.Bucket([]byte(index))
+	if ib == nil {
+		return ret
+	}
+
+	vb := ib.Bucket(di.valueKey(value))
+	if vb == nil {
+		return ret
+	}
+
+	vb.ForEach(func(k, v []byte) error {
+		id, err := di.id(k)
+		if err != nil {
+			// the index is rebuilt by CheckIntegrity
+			log.Println("Error reading device index: ", err)
+			return nil
+		}
+
+		ret[id] = true
+		return nil
+	})
+
+	return ret
+}
+
+// reindex rebuilds the device indexes from scratch
+func (di *deviceIndex) reindex(store *bolthold.Store, tx *bolt.Tx) error {
+	if tx.Bucket(deviceIndexBucket) != nil {
+		err := tx.DeleteBucket(deviceIndexBucket)
+		if err != nil {
+			return err
+		}
+	}
+
+	var devices []data.Device
+	err := store.TxFind(tx, &devices, nil)
+	if err != nil {
+		return err
+	}
+
+	for i := range devices {
+		err := di.update(tx, nil, &devices[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeviceFilter is used to select devices. Empty fields match all devices.
+type DeviceFilter struct {
+	// Group matches devices that are a member of group, directly or
+	// through a parent
+	Group string
+	// Parent matches the devices attached to a device
+	Parent string
+	// Type matches the devices of a template type
+	Type string
+	// Tag is in the form key=value
+	Tag string
+	// Io matches devices that have reported a sample of this type
+	Io string
+	// State matches devices with a config sync status (data.SyncOK, etc)
+	State string
+	// Query is a full text search of device IDs, descriptions, groups, and
+	// tags. Devices match if every word in the query is a prefix of a word
+	// in the device metadata (case insensitive).
+	Query string
+	// Offset and Limit are used for pagination. Limit of 0 returns all
+	// devices after Offset.
+	Offset int
+	Limit  int
+}
+
+// DevicesFiltered returns the devices that match filter sorted by ID, and the
+// total number of devices that match before pagination is applied.
+func (db *Db) DevicesFiltered(filter DeviceFilter) (ret []data.Device, total int, err error) {
+	defer db.metrics.observe("DevicesFiltered", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Bolt().View(func(tx *bolt.Tx) error {
+		var ids []string
+
+		var matches []map[string]bool
+		if filter.Group != "" {
+			matches = append(matches, db.index.lookup(tx, indexGroup, filter.Group))
+		}
+		if filter.Parent != "" {
+			matches = append(matches, db.index.lookup(tx, indexParent, filter.Parent))
+		}
+		if filter.Type != "" {
+			matches = append(matches, db.index.lookup(tx, indexType, filter.Type))
+		}
+		if filter.Tag != "" {
+			matches = append(matches, db.index.lookup(tx, indexTag, filter.Tag))
+		}
+		if filter.Io != "" {
+			matches = append(matches, db.index.lookup(tx, indexIo, filter.Io))
+		}
+		if filter.State != "" {
+			matches = append(matches, db.index.lookup(tx, indexState, filter.State))
+		}
+		for _, w := range searchWords(filter.Query) {
+			if r := []rune(w); len(r) > maxWordPrefix {
+				w = string(r[:maxWordPrefix])
+			}
+			matches = append(matches, db.index.lookup(tx, indexWord, w))
+		}
+
+		if len(matches) <= 0 {
+			var devices []data.Device
+			err := db.store.TxFind(tx, &devices, nil)
+			if err != nil {
+				return err
+			}
+			for _, d := range devices {
+				ids = append(ids, d.ID)
+			}
+		} else {
+			for id := range matches[0] {
+				found := true
+				for _, m := range matches[1:] {
+					if !m[id] {
+						found = false
+						break
+					}
+				}
+				if found {
+					ids = append(ids, id)
+				}
+			}
+		}
+
+		sort.Strings(ids)
+		total = len(ids)
+
+		if filter.Offset > len(ids) {
+			ids = nil
+		} else {
+			ids = ids[filter.Offset:]
+		}
+
+		if filter.Limit > 0 && filter.Limit < len(ids) {
+			ids = ids[:filter.Limit]
+		}
+
+		for _, id := range ids {
+			var dev data.Device
+			err := db.store.TxGet(tx, id, &dev)
+			if err != nil {
+				return err
+			}
+			ret = append(ret, dev)
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// Search returns the devices that match a full text query sorted by ID. See
+// DeviceFilter.Query.
+func (db *Db) Search(query string) ([]data.Device, error) {
+	ret, _, err := db.DevicesFiltered(DeviceFilter{Query: query})
+	return ret, err
+}
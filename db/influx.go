@@ -1,19 +1,142 @@
 package db
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
 	"github.com/cbrake/influxdbhelper/v2"
 	client "github.com/influxdata/influxdb1-client/v2"
 	"github.com/simpleiot/simpleiot/data"
 )
 
+// ErrInfluxNoDeviceTag is returned when the history of a device is deleted
+// from influx and the device ID is not written to a tag
+var ErrInfluxNoDeviceTag = errors.New("influx mapping has no device ID tag")
+
+// InfluxTypeMapping overrides where samples of a particular type are
+// written
+type InfluxTypeMapping struct {
+	Measurement     string `json:"measurement"`
+	RetentionPolicy string `json:"retentionPolicy"`
+}
+
+// InfluxMapping describes how samples are written to influxdb so that
+// samples can be written into an existing influx schema. The zero value
+// writes all samples to the "samples" measurement with type and id tags,
+// which is the default schema.
+type InfluxMapping struct {
+	// Measurement is the measurement samples are written to. Defaults to
+	// "samples".
+	Measurement string `json:"measurement"`
+	// Precision is the timestamp precision: ns, u, ms, s, m, or h.
+	// Defaults to ns.
+	Precision string `json:"precision"`
+	// RetentionPolicy is the retention policy samples are written to. If
+	// blank, the database default is used.
+	RetentionPolicy string `json:"retentionPolicy"`
+	// DeviceIDTag is the name of the tag the device ID is written to. If
+	// blank, the device ID is not written.
+	DeviceIDTag string `json:"deviceIdTag"`
+	// GroupsTag is the name of the tag the device groups are written to
+	// (comma separated). If blank, groups are not written.
+	GroupsTag string `json:"groupsTag"`
+	// DeviceTags maps device tag names to influx tag names. Device tags
+	// not in this map are not written.
+	DeviceTags map[string]string `json:"deviceTags"`
+	// Types overrides the measurement and retention policy for samples
+	// with a particular type.
+	Types map[string]InfluxTypeMapping `json:"types"`
+}
+
+// LoadInfluxMapping reads an influx mapping from a JSON file
+func LoadInfluxMapping(file string) (*InfluxMapping, error) {
+	d, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var m InfluxMapping
+	err = json.Unmarshal(d, &m)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing influx mapping %v: %v", file, err)
+	}
+
+	return &m, nil
+}
+
+func (m *InfluxMapping) measurement(sampleType string) string {
+	if t, ok := m.Types[sampleType]; ok && t.Measurement != "" {
+		return t.Measurement
+	}
+
+	if m.Measurement != "" {
+		return m.Measurement
+	}
+
+	return "samples"
+}
+
+func (m *InfluxMapping) retentionPolicy(sampleType string) string {
+	if t, ok := m.Types[sampleType]; ok && t.RetentionPolicy != "" {
+		return t.RetentionPolicy
+	}
+
+	return m.RetentionPolicy
+}
+
+func (m *InfluxMapping) precision() string {
+	if m.Precision != "" {
+		return m.Precision
+	}
+
+	return "ns"
+}
+
+// deviceTags returns the influx tags for a device
+func (m *InfluxMapping) deviceTags(dev *data.Device) map[string]string {
+	ret := make(map[string]string)
+
+	if dev == nil {
+		return ret
+	}
+
+	if m.DeviceIDTag != "" {
+		ret[m.DeviceIDTag] = dev.ID
+	}
+
+	if groups := dev.Groups(); m.GroupsTag != "" && len(groups) > 0 {
+		ret[m.GroupsTag] = strings.Join(groups, ",")
+	}
+
+	for k, v := range dev.Config.Tags {
+		if name, ok := m.DeviceTags[k]; ok {
+			ret[name] = v
+		}
+	}
+
+	return ret
+}
+
 // Influx represents and influxdb that we can write samples to
 type Influx struct {
-	client influxdbhelper.Client
+	client  influxdbhelper.Client
+	dbName  string
+	mapping InfluxMapping
+	metrics *Metrics
 }
 
-// NewInflux creates an influx helper client
-func NewInflux(url, dbName, user, password string) (*Influx, error) {
-	c, err := influxdbhelper.NewClient(url, user, password, "ns")
+// NewInflux creates an influx helper client. mapping can be nil to use the
+// default schema.
+func NewInflux(url, dbName, user, password string, mapping *InfluxMapping) (*Influx, error) {
+	if mapping == nil {
+		mapping = &InfluxMapping{}
+	}
+
+	c, err := influxdbhelper.NewClient(url, user, password, mapping.precision())
 	if err != nil {
 		return nil, err
 	}
@@ -31,18 +154,133 @@ func NewInflux(url, dbName, user, password string) (*Influx, error) {
 	}
 
 	return &Influx{
-		client: c,
+		client:  c,
+		dbName:  dbName,
+		mapping: *mapping,
+		metrics: NewMetrics("influx"),
 	}, nil
 }
 
-// WriteSamples to influxdb
-func (i *Influx) WriteSamples(samples []data.Sample) error {
+// Metrics returns the operation metrics for influx
+func (i *Influx) Metrics() *Metrics {
+	return i.metrics
+}
+
+// WriteSamples to influxdb. dev is the device the samples are from and is
+// used to populate device tags. It can be nil if the device is not known.
+func (i *Influx) WriteSamples(dev *data.Device, samples []data.Sample) (err error) {
+	defer i.metrics.observe("WriteSamples", time.Now(), &err)
+
+	deviceTags := i.mapping.deviceTags(dev)
+
+	// samples are batched by retention policy as that is set per batch
+	batches := make(map[string]client.BatchPoints)
+
 	for _, s := range samples {
-		err := i.client.UseMeasurement("samples").WritePoint(s)
+		rp := i.mapping.retentionPolicy(s.Type)
+
+		bp, ok := batches[rp]
+		if !ok {
+			bp, err = client.NewBatchPoints(client.BatchPointsConfig{
+				Database:        i.dbName,
+				Precision:       i.mapping.precision(),
+				RetentionPolicy: rp,
+			})
+			if err != nil {
+				return err
+			}
+			batches[rp] = bp
+		}
+
+		tags := map[string]string{}
+		for k, v := range deviceTags {
+			tags[k] = v
+		}
+
+		if s.Type != "" {
+			tags["type"] = s.Type
+		}
+
+		if s.ID != "" {
+			tags["id"] = s.ID
+		}
+
+		fields := map[string]interface{}{
+			"value":    s.Value,
+			"min":      s.Min,
+			"max":      s.Max,
+			"duration": int64(s.Duration),
+		}
+
+		t := s.Time
+		if t.IsZero() {
+			t = time.Now()
+		}
+
+		pt, err := client.NewPoint(i.mapping.measurement(s.Type), tags, fields, t)
+		if err != nil {
+			return err
+		}
+
+		bp.AddPoint(pt)
+	}
+
+	for _, bp := range batches {
+		err := i.client.Write(bp)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CreateDownsampleQueries sets up continuous queries in influxdb that roll
+// the raw samples into the <measurement>_1m and <measurement>_1h
+// measurements. This is the influx equivalent of the local Downsampler.
+// Only the default measurement is downsampled.
+func (i *Influx) CreateDownsampleQueries() error {
+	m := i.mapping.measurement("")
+
+	for _, res := range []string{"1m", "1h"} {
+		q := fmt.Sprintf(`CREATE CONTINUOUS QUERY "cq_%[3]v_%[1]v" ON "%[2]v" `+
+			`BEGIN SELECT mean("value") AS "value", min("value") AS "min", `+
+			`max("value") AS "max" INTO "%[3]v_%[1]v" FROM "%[3]v" `+
+			`GROUP BY time(%[1]v), * END`, res, i.dbName, m)
+
+		res, err := i.client.Query(client.NewQuery(q, i.dbName, ""))
 		if err != nil {
 			return err
 		}
+		if res.Error() != nil {
+			return res.Error()
+		}
 	}
 
 	return nil
 }
+
+// DeleteHistory deletes the samples of a device from before a time, or all
+// of them if before is zero, from all measurements and retention policies.
+// Samples can only be found by device if the mapping has a DeviceIDTag.
+func (i *Influx) DeleteHistory(id string, before time.Time) (err error) {
+	defer i.metrics.observe("DeleteHistory", time.Now(), &err)
+
+	tag := i.mapping.DeviceIDTag
+	if tag == "" {
+		return ErrInfluxNoDeviceTag
+	}
+
+	q := fmt.Sprintf(`DELETE WHERE "%v" = '%v'`, strings.Replace(tag, `"`, `\"`, -1),
+		strings.Replace(id, `'`, `\'`, -1))
+	if !before.IsZero() {
+		q += fmt.Sprintf(" AND time < %v", before.UnixNano())
+	}
+
+	res, err := i.client.Query(client.NewQuery(q, i.dbName, ""))
+	if err != nil {
+		return err
+	}
+
+	return res.Error()
+}
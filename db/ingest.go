@@ -0,0 +1,712 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/trace"
+)
+
+// IngestFunc is called by the ingest queue workers to store samples. ctx
+// continues the trace the samples were enqueued in, if any.
+type IngestFunc func(ctx context.Context, id string, samples []data.Sample) error
+
+// ErrIngestClosed is returned if samples are enqueued after the ingest
+// queue is closed
+var ErrIngestClosed = errors.New("ingest queue closed")
+
+// ErrIngestFull is returned if samples are enqueued while the ingest queue
+// is full and its policy is IngestReject
+var ErrIngestFull = errors.New("ingest queue full")
+
+// IngestPolicy is what the ingest queue does with new samples when it is
+// full
+type IngestPolicy string
+
+// define ingest policies
+const (
+	// IngestBlock makes Enqueue wait until the workers make room
+	IngestBlock IngestPolicy = "block"
+	// IngestShed drops the oldest queued samples to make room
+	IngestShed IngestPolicy = "shed"
+	// IngestReject makes Enqueue return ErrIngestFull, so clients can retry
+	// later
+	IngestReject IngestPolicy = "reject"
+)
+
+// ParseIngestPolicy parses an ingest policy name
+func ParseIngestPolicy(s string) (IngestPolicy, error) {
+	switch p := IngestPolicy(s); p {
+	case IngestBlock, IngestShed, IngestReject:
+		return p, nil
+	}
+
+	return "", fmt.Errorf("invalid ingest policy: %v", s)
+}
+
+// IngestStats describes the depth of the ingest queue and how often it
+// was full
+type IngestStats struct {
+	// Pending is the number of bytes that have not been processed
+	Pending int64 `json:"pending"`
+	// Limit is the size the queue is bounded to, or 0 if it is unbounded
+	Limit  int64        `json:"limit"`
+	Policy IngestPolicy `json:"policy"`
+	// Blocked is the number of enqueues that waited for room
+	Blocked uint64 `json:"blocked"`
+	// Shed is the number of samples that were dropped to make room
+	Shed uint64 `json:"shed"`
+	// Rejected is the number of enqueues that failed with ErrIngestFull
+	Rejected uint64 `json:"rejected"`
+}
+
+// ingestRecord is the payload of a record in the ingest log
+type ingestRecord struct {
+	DeviceID string        `json:"id"`
+	Samples  []data.Sample `json:"samples"`
+	// Trace is the traceparent of the span that enqueued the samples
+	Trace string `json:"trace,omitempty"`
+
+	// size is the size of the record in the log
+	size int64
+}
+
+// ingest log records are framed with a 4 byte length and a 4 byte CRC32 of
+// the payload, so a partially written record at the end of the log (from a
+// crash or power loss) can be detected and discarded.
+const ingestHeaderLen = 8
+
+// define ingest queue defaults
+const (
+	ingestSegmentSize = 16 * 1024 * 1024
+	ingestBatchSize   = 500
+	ingestRetries     = 3
+)
+
+var errIngestCorrupt = errors.New("corrupt ingest record")
+
+// IngestQueue decouples sample ingest from storage. Sample batches are
+// appended to a write-ahead log on disk and Enqueue returns as soon as the
+// data is synced. Worker goroutines consume the log and call the ingest
+// function. Samples for a device are always processed in order. If the
+// application stops, any samples that have not been processed are
+// processed the next time the queue is opened.
+//
+// The log is stored in segment files in dir, and segments are deleted once
+// they have been consumed.
+type IngestQueue struct {
+	dir     string
+	workers int
+	handler IngestFunc
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	file     *os.File
+	writeSeg uint64
+	writeOff int64
+	readSeg  uint64
+	readOff  int64
+	started  bool
+	closed   bool
+	done     chan struct{}
+
+	limit    int64
+	policy   IngestPolicy
+	blocked  uint64
+	shed     uint64
+	rejected uint64
+}
+
+func ingestSegmentName(seg uint64) string {
+	return fmt.Sprintf("%020d.log", seg)
+}
+
+// NewIngestQueue opens (or creates) an ingest queue in dir. Call Start to
+// start the workers.
+func NewIngestQueue(dir string, workers int, handler IngestFunc) (*IngestQueue, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &IngestQueue{
+		dir:     dir,
+		workers: workers,
+		handler: handler,
+		done:    make(chan struct{}),
+		policy:  IngestBlock,
+	}
+	q.cond = sync.NewCond(&q.lock)
+
+	segs, err := q.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	q.readSeg, q.readOff, err = q.loadOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	if q.readSeg == 0 {
+		q.readSeg = 1
+		if len(segs) > 0 {
+			q.readSeg = segs[0]
+		}
+	}
+
+	q.writeSeg = q.readSeg
+	if len(segs) > 0 && segs[len(segs)-1] > q.writeSeg {
+		q.writeSeg = segs[len(segs)-1]
+	}
+
+	q.file, err = os.OpenFile(path.Join(dir, ingestSegmentName(q.writeSeg)),
+		os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// discard any partially written record at the end of the log
+	q.writeOff, err = ingestValidLength(q.file)
+	if err != nil {
+		q.file.Close()
+		return nil, err
+	}
+
+	err = q.file.Truncate(q.writeOff)
+	if err == nil {
+		_, err = q.file.Seek(q.writeOff, io.SeekStart)
+	}
+
+	if err != nil {
+		q.file.Close()
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// segments returns the segment numbers in the queue dir, sorted
+func (q *IngestQueue) segments() ([]uint64, error) {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []uint64
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".log") {
+			continue
+		}
+
+		seg, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		ret = append(ret, seg)
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+
+	return ret, nil
+}
+
+func (q *IngestQueue) offsetFile() string {
+	return path.Join(q.dir, "offset")
+}
+
+// loadOffset returns the position of the next record to be processed
+func (q *IngestQueue) loadOffset() (uint64, int64, error) {
+	d, err := ioutil.ReadFile(q.offsetFile())
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+
+	var seg uint64
+	var off int64
+	_, err = fmt.Sscanf(string(d), "%d %d", &seg, &off)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid ingest offset file: %v", err)
+	}
+
+	return seg, off, nil
+}
+
+func (q *IngestQueue) saveOffset(seg uint64, off int64) error {
+	tmp := q.offsetFile() + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", seg, off)), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, q.offsetFile())
+}
+
+// ingestReadRecord reads one record. io.EOF is returned at the end of the
+// log, and io.ErrUnexpectedEOF if the record is incomplete.
+func ingestReadRecord(rd io.Reader) (*ingestRecord, int64, error) {
+	var header [ingestHeaderLen]byte
+	_, err := io.ReadFull(rd, header[:])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	n := binary.BigEndian.Uint32(header[0:4])
+	crc := binary.BigEndian.Uint32(header[4:8])
+
+	if n > ingestSegmentSize {
+		return nil, 0, errIngestCorrupt
+	}
+
+	payload := make([]byte, n)
+	_, err = io.ReadFull(rd, payload)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if crc32.ChecksumIEEE(payload) != crc {
+		return nil, 0, errIngestCorrupt
+	}
+
+	var rec ingestRecord
+	err = json.Unmarshal(payload, &rec)
+	if err != nil {
+		return nil, 0, errIngestCorrupt
+	}
+
+	rec.size = int64(ingestHeaderLen + n)
+
+	return &rec, rec.size, nil
+}
+
+// ingestValidLength returns the length of the complete records in a
+// segment file
+func ingestValidLength(f *os.File) (int64, error) {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	rd := bufio.NewReader(f)
+	var off int64
+
+	for {
+		_, n, err := ingestReadRecord(rd)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("ingest: discarding incomplete record at %v:%v: %v\n",
+					f.Name(), off, err)
+			}
+			return off, nil
+		}
+		off += n
+	}
+}
+
+// Enqueue appends samples for a device to the log. When Enqueue returns
+// without error, the samples are on disk and will be processed even if the
+// application restarts.
+func (q *IngestQueue) Enqueue(id string, samples []data.Sample) error {
+	return q.EnqueueContext(context.Background(), id, samples)
+}
+
+// EnqueueContext is Enqueue with a context. The trace in ctx is stored
+// with the samples, so it is continued when they are processed.
+func (q *IngestQueue) EnqueueContext(ctx context.Context, id string, samples []data.Sample) (err error) {
+	ctx, span := trace.Start(ctx, "ingest.Enqueue", trace.KindProducer,
+		trace.Attr{Key: "device", Value: id},
+		trace.Attr{Key: "samples", Value: len(samples)})
+	defer span.End(&err)
+
+	payload, err := json.Marshal(ingestRecord{DeviceID: id, Samples: samples,
+		Trace: trace.Traceparent(ctx)})
+	if err != nil {
+		return err
+	}
+
+	rec := make([]byte, ingestHeaderLen+len(payload))
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(payload))
+	copy(rec[ingestHeaderLen:], payload)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return ErrIngestClosed
+	}
+
+	err = q.waitRoomLocked(ctx, int64(len(rec)))
+	if err != nil {
+		return err
+	}
+
+	if q.writeOff > 0 && q.writeOff+int64(len(rec)) > ingestSegmentSize {
+		err := q.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = q.file.Write(rec)
+	if err != nil {
+		// get rid of anything that was partially written
+		q.file.Truncate(q.writeOff)
+		q.file.Seek(q.writeOff, io.SeekStart)
+		return err
+	}
+
+	err = q.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	q.writeOff += int64(len(rec))
+	q.cond.Broadcast()
+
+	return nil
+}
+
+// waitRoomLocked applies the queue policy if n more bytes don't fit in the
+// queue. Must be called with lock held.
+func (q *IngestQueue) waitRoomLocked(ctx context.Context, n int64) error {
+	if q.limit <= 0 || q.pendingLocked()+n <= q.limit {
+		return nil
+	}
+
+	switch q.policy {
+	case IngestReject:
+		q.rejected++
+		return ErrIngestFull
+	case IngestShed:
+		// the workers drop the oldest records when they read them
+		return nil
+	}
+
+	q.blocked++
+
+	// wake up if the caller gives up
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			q.lock.Lock()
+			q.cond.Broadcast()
+			q.lock.Unlock()
+		case <-stop:
+		}
+	}()
+
+	// always accept a record if the queue is empty, so records bigger than
+	// the limit don't block forever
+	for q.pendingLocked() > 0 && q.pendingLocked()+n > q.limit {
+		if q.closed {
+			return ErrIngestClosed
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		q.cond.Wait()
+	}
+
+	if q.closed {
+		return ErrIngestClosed
+	}
+
+	return nil
+}
+
+// rotate starts a new segment. Must be called with lock held.
+func (q *IngestQueue) rotate() error {
+	f, err := os.OpenFile(path.Join(q.dir, ingestSegmentName(q.writeSeg+1)),
+		os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	q.file.Close()
+	q.file = f
+	q.writeSeg++
+	q.writeOff = 0
+
+	return nil
+}
+
+// Pending returns the number of bytes in the log that have not been
+// processed
+func (q *IngestQueue) Pending() int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.pendingLocked()
+}
+
+func (q *IngestQueue) pendingLocked() int64 {
+	if q.readSeg == q.writeSeg {
+		return q.writeOff - q.readOff
+	}
+
+	// approximate, as we don't track the size of old segments
+	return int64(q.writeSeg-q.readSeg)*ingestSegmentSize + q.writeOff - q.readOff
+}
+
+// SetLimit bounds the queue to limit bytes, so an overloaded server
+// degrades instead of filling the disk. policy is what happens to new
+// samples when the queue is full. A limit of 0 disables the bound. Shed
+// queues can exceed the limit by the records that arrive while a batch is
+// being processed.
+func (q *IngestQueue) SetLimit(limit int64, policy IngestPolicy) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.limit = limit
+	q.policy = policy
+	q.cond.Broadcast()
+}
+
+// Stats returns the depth of the queue and how often it was full
+func (q *IngestQueue) Stats() IngestStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return IngestStats{
+		Pending:  q.pendingLocked(),
+		Limit:    q.limit,
+		Policy:   q.policy,
+		Blocked:  q.blocked,
+		Shed:     q.shed,
+		Rejected: q.rejected,
+	}
+}
+
+// Start starts the workers that process the log
+func (q *IngestQueue) Start() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.started || q.closed {
+		return
+	}
+
+	q.started = true
+	go q.run()
+}
+
+// Close stops processing and closes the log. Any samples that have not
+// been processed remain in the log.
+func (q *IngestQueue) Close() error {
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return nil
+	}
+	q.closed = true
+	started := q.started
+	q.cond.Broadcast()
+	q.lock.Unlock()
+
+	if started {
+		<-q.done
+	}
+
+	return q.file.Close()
+}
+
+func (q *IngestQueue) run() {
+	defer close(q.done)
+
+	for {
+		q.lock.Lock()
+		for !q.closed && q.readSeg == q.writeSeg && q.readOff >= q.writeOff {
+			q.cond.Wait()
+		}
+
+		if q.closed {
+			q.lock.Unlock()
+			return
+		}
+
+		seg, off := q.readSeg, q.readOff
+		end := int64(-1)
+		if seg == q.writeSeg {
+			end = q.writeOff
+		}
+		q.lock.Unlock()
+
+		records, newOff, err := q.readBatch(seg, off, end)
+		if err != nil {
+			log.Printf("ingest: error reading segment %v, skipping rest of segment: %v\n",
+				seg, err)
+			if end >= 0 {
+				newOff = end
+			}
+		}
+
+		records = q.shedOldest(records)
+
+		if len(records) > 0 {
+			q.process(records)
+		}
+
+		q.lock.Lock()
+		// wake up enqueues waiting for room
+		q.cond.Broadcast()
+		if newOff > off {
+			q.readOff = newOff
+		} else if seg != q.writeSeg {
+			// done with this segment
+			os.Remove(path.Join(q.dir, ingestSegmentName(seg)))
+			q.readSeg++
+			q.readOff = 0
+		}
+		seg, off = q.readSeg, q.readOff
+		q.lock.Unlock()
+
+		err = q.saveOffset(seg, off)
+		if err != nil {
+			log.Println("ingest: error saving offset: ", err)
+		}
+	}
+}
+
+// shedOldest drops records from the front of a batch while the queue is
+// over its limit, if the policy is IngestShed. Returns the records to
+// process.
+func (q *IngestQueue) shedOldest(records []*ingestRecord) []*ingestRecord {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.policy != IngestShed || q.limit <= 0 {
+		return records
+	}
+
+	pending := q.pendingLocked()
+	var samples int
+	i := 0
+	for ; i < len(records) && pending > q.limit; i++ {
+		pending -= records[i].size
+		samples += len(records[i].Samples)
+	}
+
+	if i > 0 {
+		q.shed += uint64(samples)
+		log.Printf("ingest: queue full, dropped %v oldest samples\n", samples)
+	}
+
+	return records[i:]
+}
+
+// readBatch reads up to ingestBatchSize records starting at off. If end is
+// not -1, records are only read up to end.
+func (q *IngestQueue) readBatch(seg uint64, off, end int64) ([]*ingestRecord, int64, error) {
+	f, err := os.Open(path.Join(q.dir, ingestSegmentName(seg)))
+	if os.IsNotExist(err) {
+		return nil, off, nil
+	} else if err != nil {
+		return nil, off, err
+	}
+
+	defer f.Close()
+
+	_, err = f.Seek(off, io.SeekStart)
+	if err != nil {
+		return nil, off, err
+	}
+
+	rd := bufio.NewReader(f)
+	var ret []*ingestRecord
+
+	for len(ret) < ingestBatchSize && (end < 0 || off < end) {
+		rec, n, err := ingestReadRecord(rd)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return ret, off, err
+		}
+
+		ret = append(ret, rec)
+		off += n
+	}
+
+	return ret, off, nil
+}
+
+// process runs the ingest function on a batch of records. Records are
+// distributed to workers by device ID so that samples for a device are
+// processed in order.
+func (q *IngestQueue) process(records []*ingestRecord) {
+	work := make([][]*ingestRecord, q.workers)
+	for _, r := range records {
+		h := fnv.New32a()
+		h.Write([]byte(r.DeviceID))
+		i := int(h.Sum32() % uint32(q.workers))
+		work[i] = append(work[i], r)
+	}
+
+	var wg sync.WaitGroup
+
+	for _, w := range work {
+		if len(w) <= 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(records []*ingestRecord) {
+			defer wg.Done()
+			for _, r := range records {
+				q.handle(r)
+			}
+		}(w)
+	}
+
+	wg.Wait()
+}
+
+func (q *IngestQueue) handle(r *ingestRecord) {
+	ctx := trace.ContextWithTraceparent(context.Background(), r.Trace)
+	ctx, span := trace.Start(ctx, "ingest.Process", trace.KindConsumer,
+		trace.Attr{Key: "device", Value: r.DeviceID},
+		trace.Attr{Key: "samples", Value: len(r.Samples)})
+
+	var err error
+	defer span.End(&err)
+
+	for try := 0; try < ingestRetries; try++ {
+		err = q.handler(ctx, r.DeviceID, r.Samples)
+		if err == nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	log.Printf("ingest: dropping %v samples for device %v: %v\n",
+		len(r.Samples), r.DeviceID, err)
+}
@@ -0,0 +1,292 @@
+package db
+
+import (
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	bolt "go.etcd.io/bbolt"
+)
+
+// quarantineBucket holds records removed by CheckIntegrity in quarantine
+// mode. There is a sub bucket for each record type.
+var quarantineBucket = []byte("quarantine")
+
+// integrityTypes are the record types checked by CheckIntegrity
+var integrityTypes = []interface{}{
+	data.Device{},
+	data.DeviceCommand{},
+	data.AuditRecord{},
+	data.LogEntry{},
+	data.SupportArchive{},
+	data.DeviceKey{},
+	data.DeviceCert{},
+	data.Rule{},
+	data.Script{},
+	data.Alert{},
+	data.Registration{},
+	data.Firmware{},
+	data.FirmwareData{},
+	data.Rollout{},
+	data.FirmwareInstall{},
+	data.DeviceFile{},
+	data.FileChunk{},
+	data.TunnelSession{},
+	data.Tenant{},
+	data.TenantUser{},
+	data.User{},
+	data.Session{},
+	data.PasswordReset{},
+	data.Report{},
+	data.ReportFile{},
+	data.ReportData{},
+	data.Anomaly{},
+	data.Event{},
+	data.ConfigSnapshot{},
+	data.DeviceTemplate{},
+	sampleRecord{},
+	sampleAggregate{},
+	sampleBlock{},
+	downsampleMark{},
+	batchMark{},
+	UpstreamMark{},
+	schemaVersion{},
+}
+
+// IntegrityAction specifies what CheckIntegrity does with bad records
+type IntegrityAction int
+
+// define integrity actions
+const (
+	// IntegrityCheck only reports problems
+	IntegrityCheck IntegrityAction = iota
+	// IntegrityRepair deletes corrupt and orphaned records
+	IntegrityRepair
+	// IntegrityQuarantine moves corrupt and orphaned records to a
+	// quarantine bucket so they can be inspected later
+	IntegrityQuarantine
+)
+
+// ParseIntegrityAction converts a string (check, repair, quarantine) to an
+// IntegrityAction
+func ParseIntegrityAction(s string) (IntegrityAction, error) {
+	switch s {
+	case "", "check":
+		return IntegrityCheck, nil
+	case "repair":
+		return IntegrityRepair, nil
+	case "quarantine":
+		return IntegrityQuarantine, nil
+	default:
+		return 0, errors.New("invalid action, must be check, repair, or quarantine")
+	}
+}
+
+// IntegrityIssue describes a bad record found by CheckIntegrity
+type IntegrityIssue struct {
+	Type string `json:"type"`
+	// Key is the hex encoded bolt key of the record
+	Key      string `json:"key"`
+	DeviceID string `json:"deviceId,omitempty"`
+	Problem  string `json:"problem"`
+}
+
+// IntegrityResult is returned by CheckIntegrity
+type IntegrityResult struct {
+	Checked  int              `json:"checked"`
+	Issues   []IntegrityIssue `json:"issues"`
+	Repaired bool             `json:"repaired"`
+}
+
+// recordDeviceID returns the device a record belongs to. ok is false for
+// records that can outlive their device, such as audit records.
+func recordDeviceID(v interface{}) (id string, ok bool) {
+	switch r := v.(type) {
+	case *data.DeviceCommand:
+		return r.DeviceID, true
+	case *data.LogEntry:
+		return r.DeviceID, true
+	case *data.SupportArchive:
+		return r.DeviceID, true
+	case *data.DeviceKey:
+		return r.DeviceID, true
+	case *sampleRecord:
+		return r.DeviceID, true
+	case *sampleAggregate:
+		return r.DeviceID, true
+	case *sampleBlock:
+		return r.DeviceID, true
+	}
+
+	return "", false
+}
+
+// CheckIntegrity makes sure all records in the db can be decoded, and
+// looks for orphaned records (samples, commands, etc) that belong to
+// devices that no longer exist. This is useful after a power loss on edge
+// hardware. With IntegrityRepair or IntegrityQuarantine, bad records are
+// removed and the indexes rebuilt.
+func (db *Db) CheckIntegrity(action IntegrityAction) (ret IntegrityResult, err error) {
+	defer db.metrics.observe("CheckIntegrity", time.Now(), &err)
+
+	if action == IntegrityCheck {
+		db.lock.RLock()
+		defer db.lock.RUnlock()
+	} else {
+		// the caches are reloaded after a repair, so nothing else can be
+		// running
+		db.lock.Lock()
+		defer db.lock.Unlock()
+
+		if db.readOnly {
+			return ret, ErrReadOnly
+		}
+	}
+
+	bhOptions, err := db.options.boltholdOptions()
+	if err != nil {
+		return ret, err
+	}
+
+	decode := bhOptions.Decoder
+
+	// bad record keys for each bucket
+	bad := make(map[string][][]byte)
+
+	check := func(tx *bolt.Tx) error {
+		devices := make(map[string]bool)
+
+		for _, t := range integrityTypes {
+			rType := reflect.TypeOf(t)
+			name := rType.Name()
+
+			b := tx.Bucket([]byte(name))
+			if b == nil {
+				continue
+			}
+
+			err := b.ForEach(func(k, v []byte) error {
+				ret.Checked++
+
+				issue := IntegrityIssue{
+					Type: name,
+					Key:  hex.EncodeToString(k),
+				}
+
+				rec := reflect.New(rType).Interface()
+				err := decode(v, rec)
+				if err == nil {
+					if blk, ok := rec.(*sampleBlock); ok {
+						_, err = blk.samples()
+					}
+				}
+
+				if err != nil {
+					issue.Problem = "decode: " + err.Error()
+				} else if dev, ok := rec.(*data.Device); ok {
+					devices[dev.ID] = true
+					return nil
+				} else if id, ok := recordDeviceID(rec); ok && !devices[id] {
+					issue.DeviceID = id
+					issue.Problem = "orphaned: device does not exist"
+				} else {
+					return nil
+				}
+
+				ret.Issues = append(ret.Issues, issue)
+				// keys are only valid for the life of the transaction
+				bad[name] = append(bad[name], append([]byte{}, k...))
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if action == IntegrityCheck || len(bad) <= 0 {
+			return nil
+		}
+
+		var quarantine *bolt.Bucket
+		if action == IntegrityQuarantine {
+			var err error
+			quarantine, err = tx.CreateBucketIfNotExists(quarantineBucket)
+			if err != nil {
+				return err
+			}
+		}
+
+		for name, keys := range bad {
+			b := tx.Bucket([]byte(name))
+
+			var qb *bolt.Bucket
+			if quarantine != nil {
+				var err error
+				qb, err = quarantine.CreateBucketIfNotExists([]byte(name))
+				if err != nil {
+					return err
+				}
+			}
+
+			for _, k := range keys {
+				if qb != nil {
+					err := qb.Put(k, append([]byte{}, b.Get(k)...))
+					if err != nil {
+						return err
+					}
+				}
+
+				err := b.Delete(k)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if _, ok := bad[reflect.TypeOf(data.Device{}).Name()]; ok {
+			return db.index.reindex(db.store, tx)
+		}
+
+		return nil
+	}
+
+	if action == IntegrityCheck {
+		err = db.store.Bolt().View(check)
+	} else {
+		err = db.store.Bolt().Update(check)
+	}
+
+	if err != nil || action == IntegrityCheck || len(bad) <= 0 {
+		return ret, err
+	}
+
+	ret.Repaired = true
+
+	// rebuild the bolthold indexes so they don't point at removed records
+	for _, t := range integrityTypes {
+		if _, ok := bad[reflect.TypeOf(t).Name()]; !ok {
+			continue
+		}
+
+		err := db.store.ReIndex(reflect.New(reflect.TypeOf(t)).Interface(), nil)
+		if err != nil {
+			return ret, err
+		}
+	}
+
+	for _, id := range db.cacheDeviceIDs() {
+		db.cacheDeleteDevice(id)
+	}
+
+	err = db.latest.load(db.store)
+	if err != nil {
+		return ret, err
+	}
+
+	db.series.reset()
+
+	return ret, db.usage.load(db.store, db.options)
+}
@@ -0,0 +1,291 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+)
+
+// ErrInvalidKey is returned when a device key is not valid
+var ErrInvalidKey = errors.New("invalid device key")
+
+func hashKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// DeviceKeyCreate creates an API key for a device. The key is returned,
+// and can't be read again later.
+func (db *Db) DeviceKeyCreate(id string) (key string, ret data.DeviceKey, err error) {
+	defer db.metrics.observe("DeviceKeyCreate", time.Now(), &err)
+
+	err = db.update(func(txn *Txn) error {
+		dev, err := txn.Device(id)
+		if err != nil {
+			return err
+		}
+
+		if dev == nil {
+			return bolthold.ErrNotFound
+		}
+
+		key, ret, err = txn.deviceKeyCreate(id)
+		return err
+	})
+
+	return
+}
+
+// deviceKeyCreate creates a key for a device, which must exist
+func (txn *Txn) deviceKeyCreate(id string) (string, data.DeviceKey, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", data.DeviceKey{}, err
+	}
+
+	key := hex.EncodeToString(b)
+	ret := data.DeviceKey{
+		DeviceID: id,
+		Hash:     hashKey(key),
+		Created:  time.Now(),
+	}
+
+	err = txn.db.store.TxInsert(txn.tx, bolthold.NextSequence(), &ret)
+	return key, ret, err
+}
+
+// DeviceKeys returns the keys of a device. Only the key hashes are stored,
+// so the keys themselves are not returned.
+func (db *Db) DeviceKeys(id string) (ret []data.DeviceKey, err error) {
+	defer db.metrics.observe("DeviceKeys", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	// the key field isn't set until records are decoded, so it can't be
+	// sorted by the store
+	err = db.store.Find(&ret, bolthold.Where("DeviceID").Eq(id).Index("DeviceID"))
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return
+}
+
+// DeviceKeyDelete deletes a device key, which can then no longer be used
+func (db *Db) DeviceKeyDelete(keyID uint64) (err error) {
+	defer db.metrics.observe("DeviceKeyDelete", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		return txn.db.store.TxDelete(txn.tx, keyID, data.DeviceKey{})
+	})
+}
+
+// DeviceKeyRevoke revokes a device key. The key is kept, so it shows on
+// the device's revocation list. Returns bolthold.ErrNotFound if it does not
+// exist.
+func (db *Db) DeviceKeyRevoke(keyID uint64) (err error) {
+	defer db.metrics.observe("DeviceKeyRevoke", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		var k data.DeviceKey
+		err := txn.db.store.TxGet(txn.tx, keyID, &k)
+		if err != nil {
+			return err
+		}
+
+		if !k.Revoked.IsZero() {
+			return nil
+		}
+
+		k.Revoked = time.Now()
+		err = txn.db.store.TxUpdate(txn.tx, keyID, &k)
+		if err != nil {
+			return err
+		}
+
+		return txn.AuditAppend(data.AuditRecord{
+			DeviceID: k.DeviceID,
+			Action:   "keyRevoke",
+			Message:  strconv.FormatUint(keyID, 10),
+		})
+	})
+}
+
+// expireKey makes a key stop working after overlap, unless it expires
+// sooner
+func expireKey(k *data.DeviceKey, now time.Time, overlap time.Duration) {
+	expires := now.Add(overlap)
+	if k.Expires.IsZero() || expires.Before(k.Expires) {
+		k.Expires = expires
+	}
+}
+
+// DeviceKeyRotate replaces a device key with a new key, which is returned.
+// The old key keeps working for the KeyOverlap option, so the device can
+// switch without losing its connections. Returns ErrInvalidKey if the old
+// key can't be used.
+func (db *Db) DeviceKeyRotate(key string) (newKey string, ret data.DeviceKey, err error) {
+	defer db.metrics.observe("DeviceKeyRotate", time.Now(), &err)
+
+	err = db.update(func(txn *Txn) error {
+		var keys []data.DeviceKey
+		err := txn.db.store.TxFind(txn.tx, &keys,
+			bolthold.Where("Hash").Eq(hashKey(key)).Index("Hash"))
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if len(keys) <= 0 || !keys[0].Active(now) {
+			return ErrInvalidKey
+		}
+
+		old := keys[0]
+		dev, err := txn.Device(old.DeviceID)
+		if err != nil {
+			return err
+		}
+
+		if dev == nil {
+			return ErrInvalidKey
+		}
+
+		newKey, ret, err = txn.deviceKeyCreate(old.DeviceID)
+		if err != nil {
+			return err
+		}
+
+		old.Rotate = false
+		expireKey(&old, now, db.options.keyOverlap())
+		err = txn.db.store.TxUpdate(txn.tx, old.ID, &old)
+		if err != nil {
+			return err
+		}
+
+		return txn.AuditAppend(data.AuditRecord{
+			DeviceID: old.DeviceID,
+			Action:   "keyRotate",
+			Message:  fmt.Sprintf("%v replaced by %v", old.ID, ret.ID),
+		})
+	})
+
+	return
+}
+
+// DeviceKeysRotate asks a device to rotate all its keys, like when they may
+// be compromised. The keys stop working after overlap, whether the device
+// rotated them or not.
+func (db *Db) DeviceKeysRotate(id string, overlap time.Duration) (err error) {
+	defer db.metrics.observe("DeviceKeysRotate", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		var keys []data.DeviceKey
+		err := txn.db.store.TxFind(txn.tx, &keys,
+			bolthold.Where("DeviceID").Eq(id).Index("DeviceID"))
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, k := range keys {
+			if !k.Active(now) {
+				continue
+			}
+
+			k.Rotate = true
+			expireKey(&k, now, overlap)
+			err := txn.db.store.TxUpdate(txn.tx, k.ID, &k)
+			if err != nil {
+				return err
+			}
+		}
+
+		return txn.AuditAppend(data.AuditRecord{
+			DeviceID: id,
+			Action:   "keysRotate",
+			Message:  "overlap " + overlap.String(),
+		})
+	})
+}
+
+// KeyOverlap returns how long a rotated key keeps working
+func (db *Db) KeyOverlap() time.Duration {
+	return db.options.keyOverlap()
+}
+
+// KeyStatus returns the rotation status of a key at time now. Keys are due
+// when an admin asked for them to be rotated, or when they are older than
+// the KeyRotation option. Keys that have already been replaced are not.
+func (db *Db) KeyStatus(k data.DeviceKey, now time.Time) data.KeyStatus {
+	ret := data.KeyStatus{DeviceKey: k, Active: k.Active(now)}
+
+	if rotation := db.options.keyRotation(); rotation > 0 && k.Expires.IsZero() {
+		ret.RotateAt = k.Created.Add(rotation)
+	}
+
+	if k.Rotate {
+		ret.RotateAt = k.Expires
+	}
+
+	ret.Due = ret.Active && (k.Rotate ||
+		(!ret.RotateAt.IsZero() && !now.Before(ret.RotateAt)))
+	return ret
+}
+
+// DeviceKeyStatus returns the rotation status of a device key. Returns
+// ErrInvalidKey if the key can't be used.
+func (db *Db) DeviceKeyStatus(key string) (ret data.KeyStatus, err error) {
+	defer db.metrics.observe("DeviceKeyStatus", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var keys []data.DeviceKey
+	err = db.store.Find(&keys, bolthold.Where("Hash").Eq(hashKey(key)).
+		Index("Hash"))
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	if len(keys) <= 0 || !keys[0].Active(now) {
+		return ret, ErrInvalidKey
+	}
+
+	return db.KeyStatus(keys[0], now), nil
+}
+
+// DeviceKeyAuth returns the device a key belongs to, or ErrInvalidKey if
+// the key does not exist, expired, or was revoked
+func (db *Db) DeviceKeyAuth(key string) (id string, err error) {
+	defer db.metrics.observe("DeviceKeyAuth", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var keys []data.DeviceKey
+	err = db.store.Find(&keys, bolthold.Where("Hash").Eq(hashKey(key)).
+		Index("Hash"))
+	if err != nil {
+		return "", err
+	}
+
+	if len(keys) <= 0 || !keys[0].Active(time.Now()) {
+		return "", ErrInvalidKey
+	}
+	// keys of deleted devices are not valid
+	var dev data.Device
+	err = db.store.Get(keys[0].DeviceID, &dev)
+	if err == bolthold.ErrNotFound {
+		return "", ErrInvalidKey
+	}
+
+	return keys[0].DeviceID, err
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"sync"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+	bolt "go.etcd.io/bbolt"
+)
+
+// latestCache keeps the most recent sample of each IO on every device in
+// memory so that current value queries don't need to hit the store. The
+// device state is written to the store with every sample, so the cache is
+// rebuilt from the device records when the store is opened rather than
+// being persisted separately.
+type latestCache struct {
+	lock    sync.RWMutex
+	devices map[string]map[string]data.Sample
+}
+
+func latestKey(sampleType, sampleID string) string {
+	return sampleType + "/" + sampleID
+}
+
+// load replaces the contents of the cache with the device state in store
+func (c *latestCache) load(store *bolthold.Store) error {
+	var devices []data.Device
+	err := store.Find(&devices, nil)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.devices = make(map[string]map[string]data.Sample)
+	for _, dev := range devices {
+		c.setLocked(dev.ID, dev.State.Ios)
+	}
+
+	return nil
+}
+
+func (c *latestCache) setLocked(id string, ios []data.Sample) {
+	samples := make(map[string]data.Sample)
+	for _, io := range ios {
+		samples[latestKey(io.Type, io.ID)] = io
+	}
+	c.devices[id] = samples
+}
+
+// setOnCommit updates the cache for a device if tx commits
+func (c *latestCache) setOnCommit(tx *bolt.Tx, dev *data.Device) {
+	tx.OnCommit(func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.setLocked(dev.ID, dev.State.Ios)
+	})
+}
+
+// deleteOnCommit removes a device from the cache if tx commits
+func (c *latestCache) deleteOnCommit(tx *bolt.Tx, id string) {
+	tx.OnCommit(func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		delete(c.devices, id)
+	})
+}
+
+// Latest returns the most recent sample for each IO on a device. Returns
+// bolthold.ErrNotFound if the device does not exist.
+func (db *Db) Latest(id string) ([]data.Sample, error) {
+	db.latest.lock.RLock()
+	defer db.latest.lock.RUnlock()
+
+	samples, ok := db.latest.devices[id]
+	if !ok {
+		return nil, bolthold.ErrNotFound
+	}
+
+	ret := make([]data.Sample, 0, len(samples))
+	for _, s := range samples {
+		ret = append(ret, s)
+	}
+
+	return ret, nil
+}
+
+// LatestValue returns the most recent sample for a particular IO on a
+// device. ok is false if the device or IO does not exist.
+func (db *Db) LatestValue(id, sampleType, sampleID string) (s data.Sample, ok bool) {
+	db.latest.lock.RLock()
+	defer db.latest.lock.RUnlock()
+
+	s, ok = db.latest.devices[id][latestKey(sampleType, sampleID)]
+	return
+}
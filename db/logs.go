@@ -0,0 +1,100 @@
+package db
+
+import (
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+)
+
+// LogAppend stores log entries uploaded by a device. If Expires is not
+// set, it is set using the LogTTL option.
+func (db *Db) LogAppend(id string, entries []data.LogEntry) (err error) {
+	defer db.metrics.observe("LogAppend", time.Now(), &err)
+
+	ttl := db.options.logTTL()
+	now := time.Now()
+
+	return db.update(func(txn *Txn) error {
+		for _, e := range entries {
+			e.ID = 0
+			e.DeviceID = id
+			if e.Time.IsZero() {
+				e.Time = now
+			}
+
+			if e.Expires.IsZero() && ttl > 0 {
+				e.Expires = now.Add(ttl)
+			}
+
+			err := txn.db.store.TxInsert(txn.tx, bolthold.NextSequence(), &e)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Logs returns the log entries for a device since a time, oldest first
+func (db *Db) Logs(id string, since time.Time) (ret []data.LogEntry, err error) {
+	defer db.metrics.observe("Logs", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Find(&ret, bolthold.Where("DeviceID").Eq(id).
+		And("Time").Ge(since).SortBy("Time", "ID"))
+	return
+}
+
+// SupportArchiveAdd stores a support archive uploaded by a device. It
+// expires using the LogTTL option.
+func (db *Db) SupportArchiveAdd(id string, archive []byte) (ret data.SupportArchive, err error) {
+	defer db.metrics.observe("SupportArchiveAdd", time.Now(), &err)
+
+	ret = data.SupportArchive{
+		DeviceID: id,
+		Time:     time.Now(),
+		Size:     len(archive),
+		Data:     archive,
+	}
+
+	if ttl := db.options.logTTL(); ttl > 0 {
+		ret.Expires = ret.Time.Add(ttl)
+	}
+
+	err = db.update(func(txn *Txn) error {
+		return txn.db.store.TxInsert(txn.tx, bolthold.NextSequence(), &ret)
+	})
+
+	return
+}
+
+// SupportArchives returns the support archives for a device, oldest first.
+// Data is not returned.
+func (db *Db) SupportArchives(id string) (ret []data.SupportArchive, err error) {
+	defer db.metrics.observe("SupportArchives", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Find(&ret, bolthold.Where("DeviceID").Eq(id).SortBy("ID"))
+	for i := range ret {
+		ret[i].Data = nil
+	}
+
+	return
+}
+
+// SupportArchive returns a support archive
+func (db *Db) SupportArchive(archiveID uint64) (ret data.SupportArchive, err error) {
+	defer db.metrics.observe("SupportArchive", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Get(archiveID, &ret)
+	return
+}
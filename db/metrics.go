@@ -0,0 +1,112 @@
+package db
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the latency histogram buckets.
+// Operations slower than the last bucket are counted in an extra overflow
+// bucket.
+var LatencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// OpStats are statistics for a single store operation
+type OpStats struct {
+	Count  uint64        `json:"count"`
+	Errors uint64        `json:"errors"`
+	Total  time.Duration `json:"total"`
+	Max    time.Duration `json:"max"`
+	// Buckets contains a count for each of LatencyBuckets, plus one
+	// overflow bucket. Counts are not cumulative.
+	Buckets []uint64 `json:"buckets"`
+}
+
+// Metrics tracks counts and latencies of store operations, and logs
+// operations that take longer than the slow threshold.
+type Metrics struct {
+	name          string
+	lock          sync.Mutex
+	ops           map[string]*OpStats
+	slowThreshold time.Duration
+}
+
+// NewMetrics creates a new metrics instance. name is used in slow op
+// log messages.
+func NewMetrics(name string) *Metrics {
+	return &Metrics{
+		name: name,
+		ops:  make(map[string]*OpStats),
+	}
+}
+
+// SetSlowThreshold sets the duration above which operations are logged.
+// A value of 0 disables slow op logging.
+func (m *Metrics) SetSlowThreshold(threshold time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.slowThreshold = threshold
+}
+
+// observe records an operation. It is designed to be deferred at the start
+// of an operation with a named error return:
+//
+//	defer db.metrics.observe("Op", time.Now(), &err)
+func (m *Metrics) observe(op string, start time.Time, err *error) {
+	d := time.Since(start)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	stats, ok := m.ops[op]
+	if !ok {
+		stats = &OpStats{Buckets: make([]uint64, len(LatencyBuckets)+1)}
+		m.ops[op] = stats
+	}
+
+	stats.Count++
+	stats.Total += d
+	if d > stats.Max {
+		stats.Max = d
+	}
+
+	if err != nil && *err != nil {
+		stats.Errors++
+	}
+
+	i := 0
+	for ; i < len(LatencyBuckets); i++ {
+		if d <= LatencyBuckets[i] {
+			break
+		}
+	}
+	stats.Buckets[i]++
+
+	if m.slowThreshold > 0 && d > m.slowThreshold {
+		log.Printf("%v: slow operation %v took %v\n", m.name, op, d)
+	}
+}
+
+// Snapshot returns a copy of the current operation stats
+func (m *Metrics) Snapshot() map[string]OpStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ret := make(map[string]OpStats, len(m.ops))
+	for op, stats := range m.ops {
+		s := *stats
+		s.Buckets = append([]uint64{}, stats.Buckets...)
+		ret[op] = s
+	}
+
+	return ret
+}
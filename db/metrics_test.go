@@ -0,0 +1,135 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsBuckets(t *testing.T) {
+	tests := []struct {
+		d      time.Duration
+		bucket int
+	}{
+		{0, 0},
+		{500 * time.Microsecond, 0},
+		{3 * time.Millisecond, 1},
+		{7 * time.Millisecond, 2},
+		{30 * time.Millisecond, 3},
+		{70 * time.Millisecond, 4},
+		{300 * time.Millisecond, 5},
+		{700 * time.Millisecond, 6},
+		{3 * time.Second, 7},
+		{7 * time.Second, 8},
+	}
+
+	for _, test := range tests {
+		m := NewMetrics("test")
+		m.observe("op", time.Now().Add(-test.d), nil)
+
+		stats := m.Snapshot()["op"]
+		if len(stats.Buckets) != len(LatencyBuckets)+1 {
+			t.Fatalf("expected %v buckets, got %v", len(LatencyBuckets)+1,
+				len(stats.Buckets))
+		}
+
+		for i, c := range stats.Buckets {
+			exp := uint64(0)
+			if i == test.bucket {
+				exp = 1
+			}
+
+			if c != exp {
+				t.Errorf("%v: bucket %v count is %v, expected %v", test.d, i,
+					c, exp)
+			}
+		}
+	}
+}
+
+func TestMetricsObserve(t *testing.T) {
+	m := NewMetrics("test")
+
+	errTest := errors.New("test")
+
+	tests := []struct {
+		op  string
+		d   time.Duration
+		err error
+	}{
+		{"get", 2 * time.Millisecond, nil},
+		{"get", 20 * time.Millisecond, errTest},
+		{"get", 8 * time.Millisecond, nil},
+		{"put", time.Millisecond / 2, errTest},
+	}
+
+	for _, test := range tests {
+		err := test.err
+		m.observe(test.op, time.Now().Add(-test.d), &err)
+	}
+
+	// a nil error pointer is not an error
+	m.observe("put", time.Now(), nil)
+
+	snap := m.Snapshot()
+
+	get := snap["get"]
+	if get.Count != 3 || get.Errors != 1 {
+		t.Errorf("get count/errors is %v/%v, expected 3/1", get.Count,
+			get.Errors)
+	}
+
+	if get.Max < 20*time.Millisecond || get.Max > 30*time.Millisecond {
+		t.Errorf("get max is %v, expected about 20ms", get.Max)
+	}
+
+	if get.Total < 30*time.Millisecond {
+		t.Errorf("get total is %v, expected at least 30ms", get.Total)
+	}
+
+	put := snap["put"]
+	if put.Count != 2 || put.Errors != 1 {
+		t.Errorf("put count/errors is %v/%v, expected 2/1", put.Count,
+			put.Errors)
+	}
+
+	// the snapshot is a copy
+	get.Buckets[0] = 100
+	if m.Snapshot()["get"].Buckets[0] == 100 {
+		t.Error("snapshot buckets are shared with the metrics")
+	}
+}
+
+func TestMetricsSlowThreshold(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		threshold time.Duration
+		d         time.Duration
+		logged    bool
+	}{
+		{0, time.Second, false},
+		{100 * time.Millisecond, 10 * time.Millisecond, false},
+		{100 * time.Millisecond, 200 * time.Millisecond, true},
+	}
+
+	for _, test := range tests {
+		buf.Reset()
+
+		m := NewMetrics("test")
+		m.SetSlowThreshold(test.threshold)
+		m.observe("op", time.Now().Add(-test.d), nil)
+
+		logged := strings.Contains(buf.String(), "test: slow operation op")
+		if logged != test.logged {
+			t.Errorf("threshold %v, op %v: logged is %v, expected %v",
+				test.threshold, test.d, logged, test.logged)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/timshannon/bolthold"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrSchemaVersion is returned when opening a db that was migrated by a
+// newer version of siot
+var ErrSchemaVersion = errors.New("db schema version is newer than this version of siot")
+
+// migration describes a change to the shape of records in the store. Each
+// migration is run in a single transaction along with the schema version
+// update, so a migration is either fully applied or not at all.
+type migration struct {
+	version int
+	desc    string
+	up      func(store *bolthold.Store, tx *bolt.Tx, index *deviceIndex) error
+}
+
+func reindexDevices(store *bolthold.Store, tx *bolt.Tx, index *deviceIndex) error {
+	return index.reindex(store, tx)
+}
+
+// migrations must be listed in version order. Never change or remove a
+// migration once it has been released -- add a new one instead.
+var migrations = []migration{
+	{
+		version: 1,
+		desc:    "initial schema",
+		up: func(store *bolthold.Store, tx *bolt.Tx, index *deviceIndex) error {
+			return nil
+		},
+	},
+	{
+		version: 2,
+		desc:    "build device group/tag/io indexes",
+		up:      reindexDevices,
+	},
+	{
+		version: 3,
+		desc:    "build device search index",
+		up:      reindexDevices,
+	},
+	{
+		version: 4,
+		desc:    "index search word prefixes, and hide index values in encrypted dbs",
+		up:      reindexDevices,
+	},
+	{
+		version: 5,
+		desc:    "index device config sync state, and skip empty index values",
+		up:      reindexDevices,
+	},
+}
+
+type schemaVersion struct {
+	Version int
+}
+
+const schemaVersionKey = "schema"
+
+func getSchemaVersion(store *bolthold.Store, tx *bolt.Tx) (int, error) {
+	var v schemaVersion
+	err := store.TxGet(tx, schemaVersionKey, &v)
+	if err == bolthold.ErrNotFound {
+		return 0, nil
+	}
+
+	return v.Version, err
+}
+
+// pendingMigrations returns the migrations that have not been run on a
+// store. ErrSchemaVersion is returned if the store was migrated by a newer
+// version of siot.
+func pendingMigrations(store *bolthold.Store) ([]migration, error) {
+	var version int
+
+	err := store.Bolt().View(func(tx *bolt.Tx) error {
+		var err error
+		version, err = getSchemaVersion(store, tx)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	latest := migrations[len(migrations)-1].version
+	if version > latest {
+		return nil, fmt.Errorf("%w: db is version %v, latest migration is %v",
+			ErrSchemaVersion, version, latest)
+	}
+
+	var ret []migration
+
+	for _, m := range migrations {
+		if m.version > version {
+			ret = append(ret, m)
+		}
+	}
+
+	return ret, nil
+}
+
+func (m migration) String() string {
+	return fmt.Sprintf("%v: %v", m.version, m.desc)
+}
+
+// migrate runs all pending migrations on a store
+func migrate(store *bolthold.Store, index *deviceIndex) error {
+	pending, err := pendingMigrations(store)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range pending {
+		log.Println("Running db migration: ", m)
+		err := store.Bolt().Update(func(tx *bolt.Tx) error {
+			err := m.up(store, tx, index)
+			if err != nil {
+				return err
+			}
+
+			return store.TxUpsert(tx, schemaVersionKey,
+				&schemaVersion{Version: m.version})
+		})
+
+		if err != nil {
+			return fmt.Errorf("migration %v failed: %v", m, err)
+		}
+	}
+
+	return nil
+}
+
+// SchemaVersion returns the schema version of the store
+func (db *Db) SchemaVersion() (version int, err error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Bolt().View(func(tx *bolt.Tx) error {
+		version, err = getSchemaVersion(db.store, tx)
+		return err
+	})
+
+	return
+}
+
+// dryRunTimeout is how long MigrateDryRun waits for the db file lock, which
+// is held while the server is running
+var dryRunTimeout = time.Second
+
+// MigrateDryRun opens the database in dataDir read only and returns a
+// description of the migrations that would be run the next time the
+// database is opened with NewDb. The database is not modified, or created
+// if it does not exist.
+func MigrateDryRun(dataDir string, options *Options) ([]string, error) {
+	dbFile := dbPath(dataDir)
+
+	var pending []migration
+
+	_, err := os.Stat(dbFile)
+	if os.IsNotExist(err) {
+		pending = migrations
+	} else if err != nil {
+		return nil, err
+	} else {
+		bhOptions, err := options.boltholdOptions()
+		if err != nil {
+			return nil, err
+		}
+
+		bhOptions.Options = &bolt.Options{ReadOnly: true, Timeout: dryRunTimeout}
+
+		store, err := bolthold.Open(dbFile, 0666, bhOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		defer store.Close()
+
+		err = store.Bolt().View(func(tx *bolt.Tx) error {
+			return verifyEncoding(tx, options != nil && options.EncryptionKey != nil,
+				bhOptions.Decoder)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		pending, err = pendingMigrations(store)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var ret []string
+	for _, m := range pending {
+		ret = append(ret, m.String())
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// passwordCost is the bcrypt work factor of new password hashes. Hashes
+// store their cost, so it can be raised later.
+const passwordCost = bcrypt.DefaultCost
+
+var errInvalidHash = errors.New("invalid password hash")
+
+// hashPassword returns a bcrypt hash of a password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	return string(hash), err
+}
+
+// checkPassword returns true if password matches a hash from hashPassword.
+// rehash is true if the hash should be replaced with one from hashPassword,
+// like for a PBKDF2 hash from before bcrypt was used.
+func checkPassword(hash, password string) (ok, rehash bool, err error) {
+	if strings.HasPrefix(hash, "pbkdf2-sha256$") {
+		ok, err = checkLegacyPassword(hash, password)
+		return ok, ok, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	switch err {
+	case nil:
+	case bcrypt.ErrMismatchedHashAndPassword:
+		return false, false, nil
+	default:
+		return false, false, errInvalidHash
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	return true, err == nil && cost < passwordCost, nil
+}
+
+// checkLegacyPassword checks a password against a hash in the format
+// pbkdf2-sha256$<iterations>$<salt>$<hash>, which was used before bcrypt.
+// These hashes are only checked, so they can be replaced on login.
+func checkLegacyPassword(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 {
+		return false, errInvalidHash
+	}
+
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter < 1 {
+		return false, errInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false, errInvalidHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return false, errInvalidHash
+	}
+
+	check := pbkdf2.Key([]byte(password), salt, iter, len(key), sha256.New)
+	return subtle.ConstantTimeCompare(key, check) == 1, nil
+}
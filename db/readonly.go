@@ -0,0 +1,69 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrReadOnly is returned by write operations when the db is read only
+var ErrReadOnly = errors.New("db is read only")
+
+// SetReadOnly puts the db in read only mode. In read only mode, all
+// write operations return ErrReadOnly except for Restore and ApplyEvent,
+// which are used to keep a follower db in sync with a primary.
+func (db *Db) SetReadOnly(readOnly bool) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.readOnly = readOnly
+}
+
+// ReadOnly returns true if the db is in read only mode
+func (db *Db) ReadOnly() bool {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.readOnly
+}
+
+// ApplyEvent applies a change feed event from another db. This is used to
+// replicate changes from a primary db to a read only follower, and is
+// allowed in read only mode.
+func (db *Db) ApplyEvent(e Event) (err error) {
+	defer db.metrics.observe("ApplyEvent", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.store.Bolt().Update(func(tx *bolt.Tx) error {
+		txn := &Txn{db: db, tx: tx}
+
+		switch e.Type {
+		case EventDeviceCreated, EventDeviceUpdated:
+			if e.Device == nil {
+				return errors.New("device event without device")
+			}
+			return txn.DeviceUpdate(*e.Device)
+		case EventDeviceDeleted:
+			return txn.DeviceDelete(e.DeviceID)
+		case EventSampleWritten:
+			if e.Sample == nil {
+				return errors.New("sample event without sample")
+			}
+			// the device state is replicated by the device updated event
+			// that follows, so only the history is written here
+			db.feed.publishOnCommit(tx, e)
+			db.usage.addPointOnCommit(tx, e.DeviceID)
+			return db.txHistoryInsert(tx, e.DeviceID, *e.Sample)
+		case EventCommandQueued:
+			if e.Command == nil {
+				return errors.New("command event without command")
+			}
+			// keep the ID from the primary so acks can be matched up
+			db.feed.publishOnCommit(tx, e)
+			return db.store.TxUpsert(tx, e.Command.ID, e.Command)
+		default:
+			return errors.New("unknown event type")
+		}
+	})
+}
@@ -0,0 +1,374 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// Cache is an external cache that is shared between server instances.
+// Cache errors are logged, but never cause db operations to fail.
+type Cache interface {
+	// Get returns the value for key. ok is false if key is not cached.
+	Get(key string) (value []byte, ok bool, err error)
+	Set(key string, value []byte) error
+	Delete(key string) error
+}
+
+// RedisCache is a Cache backed by a Redis server. Only the handful of
+// commands needed for caching are implemented.
+type RedisCache struct {
+	addr     string
+	password string
+	ttl      time.Duration
+	timeout  time.Duration
+
+	lock sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// NewRedisCache creates a new Redis cache. addr is host:port. Cached
+// values expire after ttl so stale entries don't live forever if an
+// invalidation is missed. A connection is not made until the cache is
+// first used.
+func NewRedisCache(addr, password string, ttl time.Duration) *RedisCache {
+	return &RedisCache{
+		addr:     addr,
+		password: password,
+		ttl:      ttl,
+		timeout:  time.Second,
+	}
+}
+
+// errRedisNil is returned by redis for missing keys
+var errRedisNil = errors.New("redis: nil")
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (r *RedisCache) connect() error {
+	conn, err := net.DialTimeout("tcp", r.addr, r.timeout)
+	if err != nil {
+		return err
+	}
+
+	r.conn = conn
+	r.rd = bufio.NewReader(conn)
+
+	if r.password != "" {
+		_, err := r.doConn("AUTH", r.password)
+		if err != nil {
+			r.close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *RedisCache) close() {
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+}
+
+// do sends a command and returns the reply. The connection is dropped on
+// any network error so the next command reconnects.
+func (r *RedisCache) do(args ...string) (interface{}, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.conn == nil {
+		err := r.connect()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ret, err := r.doConn(args...)
+	if err != nil && err != errRedisNil {
+		if _, ok := err.(redisError); !ok {
+			r.close()
+		}
+	}
+
+	return ret, err
+}
+
+func (r *RedisCache) doConn(args ...string) (interface{}, error) {
+	err := r.conn.SetDeadline(time.Now().Add(r.timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = r.conn.Write(redisCommand(args...))
+	if err != nil {
+		return nil, err
+	}
+
+	return redisReadReply(r.rd)
+}
+
+// redisCommand encodes a command as a RESP array of bulk strings
+func redisCommand(args ...string) []byte {
+	ret := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		ret = append(ret, "$"+strconv.Itoa(len(a))+"\r\n"...)
+		ret = append(ret, a...)
+		ret = append(ret, "\r\n"...)
+	}
+	return ret
+}
+
+// redisReadReply reads a RESP reply. Simple strings and bulk strings are
+// returned as []byte, integers as int64, and arrays as []interface{}.
+func redisReadReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: invalid reply: %q", line)
+	}
+
+	payload := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return []byte(payload), nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 0 {
+			return nil, errRedisNil
+		}
+
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(rd, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 0 {
+			return nil, errRedisNil
+		}
+
+		ret := make([]interface{}, n)
+		for i := range ret {
+			ret[i], err = redisReadReply(rd)
+			if err != nil && err != errRedisNil {
+				return nil, err
+			}
+		}
+
+		return ret, nil
+	default:
+		return nil, fmt.Errorf("redis: invalid reply: %q", line)
+	}
+}
+
+// Get returns a cached value
+func (r *RedisCache) Get(key string) ([]byte, bool, error) {
+	reply, err := r.do("GET", key)
+	if err == errRedisNil {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected GET reply: %v", reply)
+	}
+
+	return value, true, nil
+}
+
+// Set sets a cached value
+func (r *RedisCache) Set(key string, value []byte) error {
+	args := []string{"SET", key, string(value)}
+	if r.ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(int64(r.ttl/time.Millisecond), 10))
+	}
+
+	_, err := r.do(args...)
+	return err
+}
+
+// Delete removes a cached value
+func (r *RedisCache) Delete(key string) error {
+	_, err := r.do("DEL", key)
+	return err
+}
+
+// leaseRenewScript extends a lease only if it is still held by the caller
+const leaseRenewScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`
+
+// leaseReleaseScript deletes a lease only if it is still held by the caller
+const leaseReleaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+return redis.call("DEL", KEYS[1])
+end
+return 0`
+
+// AcquireLease sets key to holder if it is not set. The lease expires
+// after ttl unless it is renewed. ok is false if another holder has the
+// lease.
+func (r *RedisCache) AcquireLease(key, holder string, ttl time.Duration) (bool, error) {
+	_, err := r.do("SET", key, holder, "NX", "PX",
+		strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	if err == errRedisNil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// RenewLease extends a lease held by holder to ttl from now. ok is false
+// if the lease expired or is held by another holder.
+func (r *RedisCache) RenewLease(key, holder string, ttl time.Duration) (bool, error) {
+	reply, err := r.do("EVAL", leaseRenewScript, "1", key, holder,
+		strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	if err != nil {
+		return false, err
+	}
+
+	return reply == int64(1), nil
+}
+
+// ReleaseLease deletes a lease if it is held by holder, so another holder
+// can acquire it without waiting for it to expire
+func (r *RedisCache) ReleaseLease(key, holder string) error {
+	_, err := r.do("EVAL", leaseReleaseScript, "1", key, holder)
+	return err
+}
+
+// Close closes the connection to the server
+func (r *RedisCache) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.close()
+	return nil
+}
+
+const cacheDevicePrefix = "siot:device:"
+
+// SetCache sets an external cache used for device records. Device
+// records include the latest value of each IO, so dashboards that read
+// devices from multiple server instances are served from the cache.
+// Writes update the cache after they are committed.
+func (db *Db) SetCache(c Cache) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.cache = c
+}
+
+// cacheGetDevice returns a device from the cache, or nil if not cached
+func (db *Db) cacheGetDevice(id string) *data.Device {
+	if db.cache == nil {
+		return nil
+	}
+
+	value, ok, err := db.cache.Get(cacheDevicePrefix + id)
+	if err != nil {
+		log.Println("Error reading device from cache: ", err)
+		return nil
+	}
+
+	if !ok {
+		return nil
+	}
+
+	var dev data.Device
+	err = json.Unmarshal(value, &dev)
+	if err != nil {
+		log.Println("Error decoding cached device: ", err)
+		return nil
+	}
+
+	return &dev
+}
+
+func (db *Db) cacheSetDevice(dev *data.Device) {
+	if db.cache == nil {
+		return
+	}
+
+	value, err := json.Marshal(dev)
+	if err != nil {
+		log.Println("Error encoding device for cache: ", err)
+		return
+	}
+
+	err = db.cache.Set(cacheDevicePrefix+dev.ID, value)
+	if err != nil {
+		log.Println("Error writing device to cache: ", err)
+	}
+}
+
+func (db *Db) cacheDeleteDevice(id string) {
+	if db.cache == nil {
+		return
+	}
+
+	err := db.cache.Delete(cacheDevicePrefix + id)
+	if err != nil {
+		log.Println("Error deleting device from cache: ", err)
+	}
+}
+
+// cacheDeviceIDs returns the IDs of all devices in the store. Used to
+// invalidate the cache when the store is replaced.
+func (db *Db) cacheDeviceIDs() []string {
+	if db.cache == nil {
+		return nil
+	}
+
+	var devices []data.Device
+	err := db.store.Find(&devices, nil)
+	if err != nil {
+		log.Println("Error reading devices to invalidate cache: ", err)
+		return nil
+	}
+
+	ret := make([]string, len(devices))
+	for i, d := range devices {
+		ret[i] = d.ID
+	}
+
+	return ret
+}
@@ -0,0 +1,231 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+)
+
+// registrationTTL is how long a device has to be claimed and complete its
+// registration
+const registrationTTL = 24 * time.Hour
+
+// registration errors
+var (
+	// ErrNotClaimed is returned while a registration is waiting to be
+	// claimed
+	ErrNotClaimed = errors.New("device is not claimed yet")
+	// ErrInvalidCode is returned when a claim code does not match the
+	// registration
+	ErrInvalidCode = errors.New("invalid claim code")
+	// ErrRegistered is returned when registering a device that already
+	// exists
+	ErrRegistered = errors.New("device is already registered")
+)
+
+func (txn *Txn) registration(id string) (*data.Registration, error) {
+	var ret data.Registration
+	err := txn.db.store.TxGet(txn.tx, id, &ret)
+	if err == bolthold.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ret.DeviceID = id
+	return &ret, nil
+}
+
+// Register is called by a device to register with a claim code. The first
+// call creates a registration and returns ErrNotClaimed until the device is
+// claimed with RegistrationClaim. The device is then created, and a device
+// key is returned, which is the only time it is available. If typ is set,
+// the device is created with the template of the type.
+func (db *Db) Register(id, code, typ string) (key string, err error) {
+	defer db.metrics.observe("Register", time.Now(), &err)
+
+	err = db.register(id, code, typ, func(txn *Txn) error {
+		var err error
+		key, _, err = txn.deviceKeyCreate(id)
+		return err
+	})
+
+	return
+}
+
+// RegisterCert is like Register for devices that authenticate with mutual
+// TLS. Once the device is claimed, issue is called to issue its
+// certificate, which is recorded instead of creating a device key.
+func (db *Db) RegisterCert(id, code, typ string, issue func() (data.DeviceCert, error)) (ret data.DeviceCert, err error) {
+	defer db.metrics.observe("RegisterCert", time.Now(), &err)
+
+	err = db.register(id, code, typ, func(txn *Txn) error {
+		var err error
+		ret, err = issue()
+		if err != nil {
+			return err
+		}
+
+		ret.DeviceID = id
+		return txn.deviceCertInsert(&ret)
+	})
+
+	return
+}
+
+// register completes the registration of a claimed device with complete,
+// or returns ErrNotClaimed
+func (db *Db) register(id, code, typ string, complete func(txn *Txn) error) error {
+	if id == "" || code == "" {
+		return errors.New("device id and claim code are required")
+	}
+
+	done := false
+
+	err := db.update(func(txn *Txn) error {
+		reg, err := txn.registration(id)
+		if err != nil {
+			return err
+		}
+
+		if reg == nil {
+			dev, err := txn.Device(id)
+			if err != nil {
+				return err
+			}
+
+			if dev != nil {
+				return ErrRegistered
+			}
+
+			now := time.Now()
+			reg = &data.Registration{
+				DeviceID: id,
+				Hash:     hashKey(code),
+				Type:     typ,
+				Created:  now,
+				Expires:  now.Add(registrationTTL),
+			}
+
+			// the registration must be committed, so ErrNotClaimed is
+			// returned after the txn
+			return txn.db.store.TxInsert(txn.tx, id, reg)
+		}
+
+		if reg.Hash != hashKey(code) {
+			return ErrInvalidCode
+		}
+
+		if !reg.Claimed {
+			return nil
+		}
+
+		err = complete(txn)
+		if err != nil {
+			return err
+		}
+
+		err = txn.AuditAppend(data.AuditRecord{
+			DeviceID: id,
+			Action:   "register",
+		})
+		if err != nil {
+			return err
+		}
+
+		done = true
+		return txn.db.store.TxDelete(txn.tx, id, data.Registration{})
+	})
+
+	if err == nil && !done {
+		err = ErrNotClaimed
+	}
+
+	return err
+}
+
+// Registrations returns the registrations that have not been completed
+func (db *Db) Registrations() (ret []data.Registration, err error) {
+	defer db.metrics.observe("Registrations", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Find(&ret, nil)
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Created.Before(ret[j].Created)
+	})
+	return
+}
+
+// RegistrationClaim claims a registered device. The code must match the one
+// the device registered with. The device is created, with the template
+// config if it registered with a type, and gets its key the next time it
+// calls Register. Returns bolthold.ErrNotFound if the device
+// has not registered.
+func (db *Db) RegistrationClaim(id, code string) (err error) {
+	defer db.metrics.observe("RegistrationClaim", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		reg, err := txn.registration(id)
+		if err != nil {
+			return err
+		}
+
+		if reg == nil {
+			return bolthold.ErrNotFound
+		}
+
+		if reg.Hash != hashKey(code) {
+			return ErrInvalidCode
+		}
+
+		reg.Claimed = true
+		reg.Expires = time.Now().Add(registrationTTL)
+		err = txn.db.store.TxUpdate(txn.tx, id, reg)
+		if err != nil {
+			return err
+		}
+
+		dev, err := txn.Device(id)
+		if err != nil {
+			return err
+		}
+
+		if dev == nil {
+			config := data.DeviceConfig{Type: reg.Type}
+			if reg.Type != "" {
+				tmpl, err := txn.template(reg.Type)
+				if err != nil {
+					return err
+				}
+
+				if tmpl != nil {
+					config = tmpl.Apply(config)
+				}
+			}
+
+			err = txn.DeviceUpdate(data.Device{ID: id, Config: config})
+			if err != nil {
+				return err
+			}
+		}
+
+		return txn.AuditAppend(data.AuditRecord{
+			DeviceID: id,
+			Action:   "claim",
+		})
+	})
+}
+
+// RegistrationDelete deletes a registration
+func (db *Db) RegistrationDelete(id string) (err error) {
+	defer db.metrics.observe("RegistrationDelete", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		return txn.db.store.TxDelete(txn.tx, id, data.Registration{})
+	})
+}
@@ -0,0 +1,208 @@
+package db
+
+import (
+	"sort"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+)
+
+// Reports returns all reports
+func (db *Db) Reports() (ret []data.Report, err error) {
+	defer db.metrics.observe("Reports", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Find(&ret, nil)
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return
+}
+
+// Report returns a report. Returns bolthold.ErrNotFound if it does not
+// exist.
+func (db *Db) Report(id uint64) (ret data.Report, err error) {
+	defer db.metrics.observe("Report", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Get(id, &ret)
+	ret.ID = id
+	return
+}
+
+// ReportInsert creates a report. The ID is set and the report is returned.
+func (db *Db) ReportInsert(report data.Report) (ret data.Report, err error) {
+	defer db.metrics.observe("ReportInsert", time.Now(), &err)
+
+	report.ID = 0
+	report.LastRun = time.Time{}
+	report.Error = ""
+
+	err = db.update(func(txn *Txn) error {
+		return txn.db.store.TxInsert(txn.tx, bolthold.NextSequence(), &report)
+	})
+
+	return report, err
+}
+
+// ReportUpdate replaces a report. The last run and error are kept. Returns
+// bolthold.ErrNotFound if it does not exist.
+func (db *Db) ReportUpdate(report data.Report) (err error) {
+	defer db.metrics.observe("ReportUpdate", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		var existing data.Report
+		err := txn.db.store.TxGet(txn.tx, report.ID, &existing)
+		if err != nil {
+			return err
+		}
+
+		report.LastRun = existing.LastRun
+		report.Error = existing.Error
+
+		return txn.db.store.TxUpdate(txn.tx, report.ID, &report)
+	})
+}
+
+// ReportDelete deletes a report and its stored files
+func (db *Db) ReportDelete(id uint64) (err error) {
+	defer db.metrics.observe("ReportDelete", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		err := txn.db.store.TxDelete(txn.tx, id, data.Report{})
+		if err != nil {
+			return err
+		}
+
+		var files []data.ReportFile
+		err = txn.db.store.TxFind(txn.tx, &files, bolthold.Where("ReportID").Eq(id))
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			err := txn.reportFileDelete(f.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// ReportSetRun records when a report ran, and the error of the run, or
+// clears it if msg is blank. It is used by the reporter.
+func (db *Db) ReportSetRun(id uint64, t time.Time, msg string) (err error) {
+	defer db.metrics.observe("ReportSetRun", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		var report data.Report
+		err := txn.db.store.TxGet(txn.tx, id, &report)
+		if err != nil {
+			return err
+		}
+
+		report.LastRun = t
+		report.Error = msg
+
+		return txn.db.store.TxUpdate(txn.tx, id, &report)
+	})
+}
+
+// ReportFileAdd stores a generated report for download. The oldest files
+// of the report are deleted so only keep are kept. The file is returned
+// with its ID and size set.
+func (db *Db) ReportFileAdd(f data.ReportFile, file []byte, keep int) (ret data.ReportFile, err error) {
+	defer db.metrics.observe("ReportFileAdd", time.Now(), &err)
+
+	f.ID = 0
+	f.Size = len(file)
+
+	err = db.update(func(txn *Txn) error {
+		err := txn.db.store.TxInsert(txn.tx, bolthold.NextSequence(), &f)
+		if err != nil {
+			return err
+		}
+
+		err = txn.db.store.TxInsert(txn.tx, f.ID, &data.ReportData{ID: f.ID, Data: file})
+		if err != nil {
+			return err
+		}
+
+		var files []data.ReportFile
+		err = txn.db.store.TxFind(txn.tx, &files,
+			bolthold.Where("ReportID").Eq(f.ReportID))
+		if err != nil {
+			return err
+		}
+
+		sort.Slice(files, func(i, j int) bool { return files[i].ID > files[j].ID })
+
+		for i := keep; i < len(files); i++ {
+			err := txn.reportFileDelete(files[i].ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return f, err
+}
+
+// reportFileDelete deletes a report file and its data
+func (txn *Txn) reportFileDelete(id uint64) error {
+	err := txn.db.store.TxDelete(txn.tx, id, data.ReportFile{})
+	if err != nil {
+		return err
+	}
+
+	err = txn.db.store.TxDelete(txn.tx, id, data.ReportData{})
+	if err != nil && err != bolthold.ErrNotFound {
+		return err
+	}
+
+	return nil
+}
+
+// ReportFiles returns the stored files of a report, newest first
+func (db *Db) ReportFiles(reportID uint64) (ret []data.ReportFile, err error) {
+	defer db.metrics.observe("ReportFiles", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Find(&ret, bolthold.Where("ReportID").Eq(reportID))
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID > ret[j].ID })
+	return
+}
+
+// ReportFile returns a stored report file. Returns bolthold.ErrNotFound if
+// it does not exist.
+func (db *Db) ReportFile(id uint64) (ret data.ReportFile, err error) {
+	defer db.metrics.observe("ReportFile", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Get(id, &ret)
+	ret.ID = id
+	return
+}
+
+// ReportFileData returns the contents of a stored report file
+func (db *Db) ReportFileData(id uint64) (ret []byte, err error) {
+	defer db.metrics.observe("ReportFileData", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var d data.ReportData
+	err = db.store.Get(id, &d)
+	return d.Data, err
+}
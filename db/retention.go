@@ -0,0 +1,181 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+)
+
+// HistoryDelete deletes the sample history of a device from before a time,
+// or all of it if before is zero. The raw samples, compressed samples, and
+// aggregates are deleted, and the latest samples of the device are kept.
+// Returns the number of samples deleted. The storage usage is recounted by
+// the next downsample pass.
+func (txn *Txn) HistoryDelete(id string, before time.Time) (int, error) {
+	count := 0
+
+	raw := bolthold.Where("DeviceID").Eq(id).Index("DeviceID")
+	blocks := bolthold.Where("DeviceID").Eq(id).Index("DeviceID")
+	if !before.IsZero() {
+		raw = raw.And("Time").Lt(before)
+		blocks = blocks.And("End").Lt(before)
+	}
+
+	var records []sampleRecord
+	err := txn.db.store.TxFind(txn.tx, &records, raw)
+	if err != nil {
+		return 0, err
+	}
+	count += len(records)
+
+	err = txn.db.store.TxDeleteMatching(txn.tx, &sampleRecord{}, raw)
+	if err != nil {
+		return 0, err
+	}
+
+	txn.db.series.deleteOnCommit(txn.tx, id, before)
+
+	var old []sampleBlock
+	err = txn.db.store.TxFind(txn.tx, &old, blocks)
+	if err != nil {
+		return 0, err
+	}
+	for _, b := range old {
+		count += b.Count
+	}
+
+	err = txn.db.store.TxDeleteMatching(txn.tx, &sampleBlock{}, blocks)
+	if err != nil {
+		return 0, err
+	}
+
+	// aggregates are deleted when their whole window is before the time
+	for _, res := range []time.Duration{ResolutionMinute, ResolutionHour} {
+		aggs := bolthold.Where("DeviceID").Eq(id).Index("DeviceID").
+			And("Resolution").Eq(res)
+		if !before.IsZero() {
+			aggs = aggs.And("Sample.Time").Le(before.Add(-res))
+		}
+
+		err := txn.db.store.TxDeleteMatching(txn.tx, &sampleAggregate{}, aggs)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return count, nil
+}
+
+// HistoryDeleteMessage returns the message of the audit record of deleting
+// the history of a device
+func HistoryDeleteMessage(reason string, count int, before time.Time) string {
+	msg := fmt.Sprintf("%v: deleted %v samples", reason, count)
+	if !before.IsZero() {
+		msg += " before " + before.UTC().Format(time.RFC3339)
+	}
+	return msg
+}
+
+// Retainer runs in the background and deletes the sample history of devices
+// that is older than the retention policy of their groups, from the local
+// store and influx.
+type Retainer struct {
+	db       *Db
+	influx   *Influx
+	policies data.RetentionPolicies
+	interval time.Duration
+	stop     chan struct{}
+}
+
+// NewRetainer creates a new retainer that runs every interval. influx can
+// be nil if samples are not written to influx. History is only deleted from
+// influx if its mapping has a DeviceIDTag.
+func NewRetainer(db *Db, influx *Influx, policies data.RetentionPolicies,
+	interval time.Duration) *Retainer {
+	return &Retainer{
+		db:       db,
+		influx:   influx,
+		policies: policies,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start runs the retainer in a goroutine until Stop is called
+func (r *Retainer) Start() {
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			err := r.Run(time.Now())
+			if err != nil {
+				log.Println("Error applying retention policies: ", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the retainer
+func (r *Retainer) Stop() {
+	close(r.stop)
+}
+
+// Run deletes the history of each device that is older than its retention
+// at now. Errors deleting the history of a device are logged, and the last
+// one is returned after all devices are checked.
+func (r *Retainer) Run(now time.Time) error {
+	devices, err := r.db.Devices()
+	if err != nil {
+		return err
+	}
+
+	var ret error
+
+	for _, dev := range devices {
+		retention := r.policies.Device(dev)
+		if retention <= 0 {
+			continue
+		}
+
+		before := now.Add(-retention)
+		reason := "retention " + retention.String()
+
+		if r.influx != nil && r.influx.mapping.DeviceIDTag != "" {
+			err := r.influx.DeleteHistory(dev.ID, before)
+			if err != nil {
+				log.Printf("Error deleting influx history of %v: %v\n", dev.ID, err)
+				ret = err
+			}
+		}
+
+		// retention is only audited when it deletes samples
+		err := r.db.update(func(txn *Txn) error {
+			count, err := txn.HistoryDelete(dev.ID, before)
+			if err != nil || count <= 0 {
+				return err
+			}
+
+			return txn.AuditAppend(data.AuditRecord{
+				DeviceID: dev.ID,
+				Action:   "historyDelete",
+				Message:  HistoryDeleteMessage(reason, count, before),
+			})
+		})
+		if err != nil {
+			log.Printf("Error deleting history of %v: %v\n", dev.ID, err)
+			ret = err
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"sort"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+)
+
+// Rules returns all rules
+func (db *Db) Rules() (ret []data.Rule, err error) {
+	defer db.metrics.observe("Rules", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Find(&ret, nil)
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return
+}
+
+// Rule returns a rule. Returns bolthold.ErrNotFound if it does not exist.
+func (db *Db) Rule(id uint64) (ret data.Rule, err error) {
+	defer db.metrics.observe("Rule", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Get(id, &ret)
+	ret.ID = id
+	return
+}
+
+// RuleInsert creates a rule. The ID is set and the rule is returned.
+func (db *Db) RuleInsert(rule data.Rule) (ret data.Rule, err error) {
+	defer db.metrics.observe("RuleInsert", time.Now(), &err)
+
+	rule.ID = 0
+	rule.Active = false
+	rule.Changed = time.Time{}
+
+	err = db.update(func(txn *Txn) error {
+		err := txn.db.store.TxInsert(txn.tx, bolthold.NextSequence(), &rule)
+		if err != nil {
+			return err
+		}
+
+		txn.db.feed.publishOnCommit(txn.tx, Event{
+			Type: EventRuleChanged,
+			Rule: &rule,
+		})
+
+		return nil
+	})
+
+	return rule, err
+}
+
+// RuleUpdate replaces a rule. The state of the rule is kept. Returns
+// bolthold.ErrNotFound if it does not exist.
+func (db *Db) RuleUpdate(rule data.Rule) (err error) {
+	defer db.metrics.observe("RuleUpdate", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		var old data.Rule
+		err := txn.db.store.TxGet(txn.tx, rule.ID, &old)
+		if err != nil {
+			return err
+		}
+
+		rule.Active = old.Active
+		rule.Changed = old.Changed
+
+		err = txn.db.store.TxUpdate(txn.tx, rule.ID, &rule)
+		if err != nil {
+			return err
+		}
+
+		txn.db.feed.publishOnCommit(txn.tx, Event{
+			Type: EventRuleChanged,
+			Rule: &rule,
+		})
+
+		return nil
+	})
+}
+
+// RuleDelete deletes a rule
+func (db *Db) RuleDelete(id uint64) (err error) {
+	defer db.metrics.observe("RuleDelete", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		err := txn.db.store.TxDelete(txn.tx, id, data.Rule{})
+		if err != nil {
+			return err
+		}
+
+		txn.db.feed.publishOnCommit(txn.tx, Event{
+			Type: EventRuleChanged,
+			Rule: &data.Rule{ID: id},
+		})
+
+		return nil
+	})
+}
+
+// RuleSetState records whether a rule is active. It is used by the rules
+// engine, and does not send a change event.
+func (db *Db) RuleSetState(id uint64, active bool, changed time.Time) (err error) {
+	defer db.metrics.observe("RuleSetState", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		var rule data.Rule
+		err := txn.db.store.TxGet(txn.tx, id, &rule)
+		if err != nil {
+			return err
+		}
+
+		rule.Active = active
+		rule.Changed = changed
+
+		return txn.db.store.TxUpdate(txn.tx, id, &rule)
+	})
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"sort"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+)
+
+// Scripts returns all scripts
+func (db *Db) Scripts() (ret []data.Script, err error) {
+	defer db.metrics.observe("Scripts", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Find(&ret, nil)
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return
+}
+
+// Script returns a script. Returns bolthold.ErrNotFound if it does not
+// exist.
+func (db *Db) Script(id uint64) (ret data.Script, err error) {
+	defer db.metrics.observe("Script", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Get(id, &ret)
+	ret.ID = id
+	return
+}
+
+// ScriptInsert creates a script. The ID is set and the script is returned.
+func (db *Db) ScriptInsert(script data.Script) (ret data.Script, err error) {
+	defer db.metrics.observe("ScriptInsert", time.Now(), &err)
+
+	script.ID = 0
+	script.Error = ""
+	script.ErrorTime = time.Time{}
+
+	err = db.update(func(txn *Txn) error {
+		err := txn.db.store.TxInsert(txn.tx, bolthold.NextSequence(), &script)
+		if err != nil {
+			return err
+		}
+
+		txn.db.feed.publishOnCommit(txn.tx, Event{
+			Type:   EventScriptChanged,
+			Script: &script,
+		})
+
+		return nil
+	})
+
+	return script, err
+}
+
+// ScriptUpdate replaces a script, and clears its error. Returns
+// bolthold.ErrNotFound if it does not exist.
+func (db *Db) ScriptUpdate(script data.Script) (err error) {
+	defer db.metrics.observe("ScriptUpdate", time.Now(), &err)
+
+	script.Error = ""
+	script.ErrorTime = time.Time{}
+
+	return db.update(func(txn *Txn) error {
+		err := txn.db.store.TxUpdate(txn.tx, script.ID, &script)
+		if err != nil {
+			return err
+		}
+
+		txn.db.feed.publishOnCommit(txn.tx, Event{
+			Type:   EventScriptChanged,
+			Script: &script,
+		})
+
+		return nil
+	})
+}
+
+// ScriptDelete deletes a script
+func (db *Db) ScriptDelete(id uint64) (err error) {
+	defer db.metrics.observe("ScriptDelete", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		err := txn.db.store.TxDelete(txn.tx, id, data.Script{})
+		if err != nil {
+			return err
+		}
+
+		txn.db.feed.publishOnCommit(txn.tx, Event{
+			Type:   EventScriptChanged,
+			Script: &data.Script{ID: id},
+		})
+
+		return nil
+	})
+}
+
+// ScriptSetError records the last error of a script, or clears it if msg
+// is blank. It is used by the script engine, and does not send a change
+// event.
+func (db *Db) ScriptSetError(id uint64, msg string, t time.Time) (err error) {
+	defer db.metrics.observe("ScriptSetError", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		var script data.Script
+		err := txn.db.store.TxGet(txn.tx, id, &script)
+		if err != nil {
+			return err
+		}
+
+		script.Error = msg
+		script.ErrorTime = t
+		if msg == "" {
+			script.ErrorTime = time.Time{}
+		}
+
+		return txn.db.store.TxUpdate(txn.tx, id, &script)
+	})
+}
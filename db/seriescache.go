@@ -0,0 +1,202 @@
+package db
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/series"
+	bolt "go.etcd.io/bbolt"
+)
+
+// seriesChunks is the number of chunks the cache window is split into.
+// Samples are dropped a chunk at a time when they age out of the window.
+const seriesChunks = 8
+
+// seriesChunk is part of a cached series
+type seriesChunk struct {
+	// first is the time of the first sample added to the chunk, and min
+	// and max are the range of the sample times
+	first time.Time
+	min   time.Time
+	max   time.Time
+	enc   *series.Encoder
+}
+
+// cachedSeries is the compressed history of one device IO
+type cachedSeries struct {
+	sampleType string
+	sampleID   string
+	chunks     []seriesChunk
+}
+
+// seriesCache keeps the last window of raw samples of every device IO in
+// memory, compressed like the sample blocks, so dashboard range queries
+// don't need to hit the store. It is filled with the samples written after
+// the store is opened, so it only serves queries that start after that.
+type seriesCache struct {
+	lock   sync.RWMutex
+	window time.Duration
+	// since is when the cache started collecting samples
+	since   time.Time
+	devices map[string]map[string]*cachedSeries
+}
+
+// reset empties the cache. Samples are collected from now on.
+func (c *seriesCache) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.since = time.Now()
+	c.devices = make(map[string]map[string]*cachedSeries)
+}
+
+// evictLocked drops the chunks of a series that are older than the window
+func (c *seriesCache) evictLocked(s *cachedSeries, now time.Time) {
+	cutoff := now.Add(-c.window)
+	i := 0
+	for i < len(s.chunks) && s.chunks[i].max.Before(cutoff) {
+		i++
+	}
+	s.chunks = s.chunks[i:]
+}
+
+// addOnCommit adds a sample to the cache if tx commits
+func (c *seriesCache) addOnCommit(tx *bolt.Tx, id string, sample data.Sample) {
+	if c.window <= 0 {
+		return
+	}
+
+	tx.OnCommit(func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		now := time.Now()
+		if sample.Time.Before(now.Add(-c.window)) {
+			return
+		}
+
+		dev, ok := c.devices[id]
+		if !ok {
+			dev = make(map[string]*cachedSeries)
+			c.devices[id] = dev
+		}
+
+		key := latestKey(sample.Type, sample.ID)
+		s, ok := dev[key]
+		if !ok {
+			s = &cachedSeries{sampleType: sample.Type, sampleID: sample.ID}
+			dev[key] = s
+		}
+
+		c.evictLocked(s, now)
+
+		// out of order samples are added to the latest chunk, which the
+		// encoder supports
+		n := len(s.chunks)
+		if n == 0 || sample.Time.Sub(s.chunks[n-1].first) >= c.window/seriesChunks {
+			s.chunks = append(s.chunks, seriesChunk{
+				first: sample.Time,
+				min:   sample.Time,
+				max:   sample.Time,
+				enc:   series.NewEncoder(),
+			})
+			n++
+		}
+
+		chunk := &s.chunks[n-1]
+		chunk.enc.Append(sample.Time, sample.Value)
+		if sample.Time.Before(chunk.min) {
+			chunk.min = sample.Time
+		}
+		if sample.Time.After(chunk.max) {
+			chunk.max = sample.Time
+		}
+	})
+}
+
+// deleteOnCommit removes the samples of a device from before a time, or
+// all of them if before is zero, if tx commits
+func (c *seriesCache) deleteOnCommit(tx *bolt.Tx, id string, before time.Time) {
+	if c.window <= 0 {
+		return
+	}
+
+	tx.OnCommit(func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		if before.IsZero() {
+			delete(c.devices, id)
+			return
+		}
+
+		for _, s := range c.devices[id] {
+			for i, chunk := range s.chunks {
+				if !chunk.min.Before(before) {
+					continue
+				}
+
+				points, err := series.Decode(chunk.enc.Bytes())
+				if err != nil {
+					continue
+				}
+
+				enc := series.NewEncoder()
+				for _, p := range points {
+					if !p.Time.Before(before) {
+						enc.Append(p.Time, p.Value)
+					}
+				}
+
+				// empty chunks are dropped when they age out
+				s.chunks[i].min = before
+				s.chunks[i].enc = enc
+			}
+		}
+	})
+}
+
+// history returns the cached samples of a device between start and end.
+// ok is false if the cache does not cover start.
+func (c *seriesCache) history(id string, start, end time.Time) (ret []data.Sample, ok bool, err error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.window <= 0 || start.Before(c.since) ||
+		start.Before(time.Now().Add(-c.window)) {
+		return nil, false, nil
+	}
+
+	for _, s := range c.devices[id] {
+		for _, chunk := range s.chunks {
+			if chunk.max.Before(start) || !chunk.min.Before(end) {
+				continue
+			}
+
+			points, err := series.Decode(chunk.enc.Bytes())
+			if err != nil {
+				return nil, false, err
+			}
+
+			for _, p := range points {
+				if p.Time.Before(start) || !p.Time.Before(end) {
+					continue
+				}
+
+				ret = append(ret, data.Sample{
+					Type:  s.sampleType,
+					ID:    s.sampleID,
+					Time:  p.Time,
+					Value: p.Value,
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Time.Before(ret[j].Time)
+	})
+
+	return ret, true, nil
+}
@@ -0,0 +1,180 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Templates returns all device templates, sorted by type
+func (db *Db) Templates() (ret []data.DeviceTemplate, err error) {
+	defer db.metrics.observe("Templates", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Find(&ret, nil)
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Type < ret[j].Type })
+	return
+}
+
+// Template returns the template of a device type. Returns
+// bolthold.ErrNotFound if it does not exist.
+func (db *Db) Template(typ string) (ret data.DeviceTemplate, err error) {
+	defer db.metrics.observe("Template", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Get(typ, &ret)
+	ret.Type = typ
+	return
+}
+
+func (txn *Txn) template(typ string) (*data.DeviceTemplate, error) {
+	var ret data.DeviceTemplate
+	err := txn.db.store.TxGet(txn.tx, typ, &ret)
+	if err == bolthold.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ret.Type = typ
+	return &ret, nil
+}
+
+// TemplateSet creates or replaces the template of a device type. The
+// version is incremented, and the template is returned. Devices of the
+// type are not changed until the template is rolled out.
+func (db *Db) TemplateSet(tmpl data.DeviceTemplate) (ret data.DeviceTemplate, err error) {
+	defer db.metrics.observe("TemplateSet", time.Now(), &err)
+
+	err = db.update(func(txn *Txn) error {
+		old, err := txn.template(tmpl.Type)
+		if err != nil {
+			return err
+		}
+
+		tmpl.Version = 1
+		if old != nil {
+			tmpl.Version = old.Version + 1
+		}
+
+		tmpl.Config.Type = ""
+		tmpl.Updated = time.Now()
+		return txn.db.store.TxUpsert(txn.tx, tmpl.Type, &tmpl)
+	})
+
+	return tmpl, err
+}
+
+// TemplateDelete deletes the template of a device type. The devices of
+// the type keep their config.
+func (db *Db) TemplateDelete(typ string) (err error) {
+	defer db.metrics.observe("TemplateDelete", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		return txn.db.store.TxDelete(txn.tx, typ, data.DeviceTemplate{})
+	})
+}
+
+// templateDeviceIDs returns the IDs of the devices of a type, sorted
+func (txn *Txn) templateDeviceIDs(typ string) []string {
+	var ret []string
+	for id := range txn.db.index.lookup(txn.tx, indexType, typ) {
+		ret = append(ret, id)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// TemplateRollout applies the template of a device type to all the
+// devices of the type. Each change is recorded as a config version, so it
+// can be rolled back. Returns the IDs of the devices whose config changed,
+// or bolthold.ErrNotFound if the template does not exist.
+func (txn *Txn) TemplateRollout(typ string) ([]string, error) {
+	tmpl, err := txn.template(typ)
+	if err != nil {
+		return nil, err
+	}
+
+	if tmpl == nil {
+		return nil, bolthold.ErrNotFound
+	}
+
+	reason := fmt.Sprintf("template %v version %v", typ, tmpl.Version)
+	ret := []string{}
+
+	for _, id := range txn.templateDeviceIDs(typ) {
+		dev, err := txn.Device(id)
+		if err != nil {
+			return nil, err
+		}
+
+		if dev == nil {
+			continue
+		}
+
+		config := tmpl.Apply(dev.Config)
+		if len(data.ConfigChanges(dev.Config, config)) == 0 {
+			continue
+		}
+
+		err = txn.deviceUpdateConfig(id, config, reason)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, id)
+	}
+
+	return ret, nil
+}
+
+// TemplateInstances returns the devices of a type, with the template
+// sample types each has not reported. Returns bolthold.ErrNotFound if the
+// template does not exist.
+func (db *Db) TemplateInstances(typ string) (ret []data.TemplateInstance, err error) {
+	defer db.metrics.observe("TemplateInstances", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	ret = []data.TemplateInstance{}
+
+	err = db.store.Bolt().View(func(tx *bolt.Tx) error {
+		txn := &Txn{db: db, tx: tx}
+
+		tmpl, err := txn.template(typ)
+		if err != nil {
+			return err
+		}
+
+		if tmpl == nil {
+			return bolthold.ErrNotFound
+		}
+
+		for _, id := range txn.templateDeviceIDs(typ) {
+			dev, err := txn.Device(id)
+			if err != nil {
+				return err
+			}
+
+			if dev != nil {
+				ret = append(ret, data.TemplateInstance{
+					DeviceID: id,
+					Missing:  tmpl.Missing(*dev),
+				})
+			}
+		}
+
+		return nil
+	})
+
+	return
+}
@@ -0,0 +1,319 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+)
+
+// ErrInvalidTenant is returned if a tenant ID is not valid
+var ErrInvalidTenant = errors.New("invalid tenant ID")
+
+// tenant IDs are used as directory names, so they are restricted
+var reTenantID = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// Tenants manages a separate Db for each tenant (organization). Each
+// tenant's data is stored in its own database file under
+// dataDir/tenants/<id>, so operations on one tenant can never see or
+// modify another tenant's data. Tenant Dbs are opened on first use and
+// stay open until Close is called.
+type Tenants struct {
+	dataDir string
+	options *Options
+	onOpen  func(id string, db *Db) func()
+
+	lock  sync.Mutex
+	dbs   map[string]*Db
+	stops map[string]func()
+}
+
+// NewTenants creates a new tenant manager. onOpen is called (if not nil)
+// each time a tenant Db is opened, and can be used to start background
+// workers (downsampling, etc) for the tenant. If it returns a function, it
+// is called to stop the workers before the Db is closed.
+func NewTenants(dataDir string, options *Options, onOpen func(id string, db *Db) func()) *Tenants {
+	return &Tenants{
+		dataDir: dataDir,
+		options: options,
+		onOpen:  onOpen,
+		dbs:     make(map[string]*Db),
+		stops:   make(map[string]func()),
+	}
+}
+
+func (t *Tenants) tenantDir(id string) string {
+	return path.Join(t.dataDir, "tenants", id)
+}
+
+// Get returns the Db for a tenant, opening it if needed. The tenant is
+// created if it does not exist.
+func (t *Tenants) Get(id string) (*Db, error) {
+	if !reTenantID.MatchString(id) {
+		return nil, ErrInvalidTenant
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if db, ok := t.dbs[id]; ok {
+		return db, nil
+	}
+
+	dir := t.tenantDir(id)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := NewDb(dir, t.options)
+	if err != nil {
+		return nil, err
+	}
+
+	t.dbs[id] = db
+
+	if t.onOpen != nil {
+		t.stops[id] = t.onOpen(id, db)
+	}
+
+	return db, nil
+}
+
+// List returns the IDs of all tenants that have been created, sorted
+func (t *Tenants) List() ([]string, error) {
+	files, err := ioutil.ReadDir(path.Join(t.dataDir, "tenants"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	for _, f := range files {
+		if f.IsDir() && reTenantID.MatchString(f.Name()) {
+			ret = append(ret, f.Name())
+		}
+	}
+
+	sort.Strings(ret)
+
+	return ret, nil
+}
+
+// Delete closes a tenant's Db and removes all of its data
+func (t *Tenants) Delete(id string) error {
+	if !reTenantID.MatchString(id) {
+		return ErrInvalidTenant
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if db, ok := t.dbs[id]; ok {
+		t.stop(id)
+		err := db.Close()
+		if err != nil {
+			return err
+		}
+		delete(t.dbs, id)
+	}
+
+	return os.RemoveAll(t.tenantDir(id))
+}
+
+// stop stops the workers of a tenant. t.lock must be held.
+func (t *Tenants) stop(id string) {
+	if stop := t.stops[id]; stop != nil {
+		stop()
+	}
+	delete(t.stops, id)
+}
+
+// Close closes all open tenant Dbs
+func (t *Tenants) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var retErr error
+	for id, db := range t.dbs {
+		t.stop(id)
+		err := db.Close()
+		if err != nil && retErr == nil {
+			retErr = err
+		}
+		delete(t.dbs, id)
+	}
+
+	return retErr
+}
+
+// tenant record errors
+var (
+	// ErrTenantExists is returned when creating a tenant that already
+	// exists
+	ErrTenantExists = errors.New("tenant already exists")
+	// ErrInvalidToken is returned when a tenant user, session, or
+	// password reset token is not valid
+	ErrInvalidToken = errors.New("invalid token")
+)
+
+// TenantInsert creates a tenant record. The tenant's data is stored
+// separately, see Tenants.
+func (db *Db) TenantInsert(tenant data.Tenant) (ret data.Tenant, err error) {
+	defer db.metrics.observe("TenantInsert", time.Now(), &err)
+
+	if !reTenantID.MatchString(tenant.ID) {
+		return ret, ErrInvalidTenant
+	}
+
+	tenant.Created = time.Now()
+
+	err = db.update(func(txn *Txn) error {
+		err := txn.db.store.TxInsert(txn.tx, tenant.ID, &tenant)
+		if err == bolthold.ErrKeyExists {
+			return ErrTenantExists
+		}
+		return err
+	})
+
+	return tenant, err
+}
+
+// Tenant returns a tenant record, or bolthold.ErrNotFound
+func (db *Db) Tenant(id string) (ret data.Tenant, err error) {
+	defer db.metrics.observe("Tenant", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Get(id, &ret)
+	return
+}
+
+// TenantList returns all tenant records, sorted by ID
+func (db *Db) TenantList() (ret []data.Tenant, err error) {
+	defer db.metrics.observe("TenantList", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Find(&ret, nil)
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].ID < ret[j].ID
+	})
+
+	return
+}
+
+// TenantDelete deletes a tenant record and its users. Returns
+// bolthold.ErrNotFound if it does not exist.
+func (db *Db) TenantDelete(id string) (err error) {
+	defer db.metrics.observe("TenantDelete", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		err := txn.db.store.TxDelete(txn.tx, id, data.Tenant{})
+		if err != nil {
+			return err
+		}
+
+		return txn.db.store.TxDeleteMatching(txn.tx, data.TenantUser{},
+			bolthold.Where("TenantID").Eq(id).Index("TenantID"))
+	})
+}
+
+// TenantUserCreate creates a user of a tenant. The user's API token is
+// returned, and can't be read again later.
+func (db *Db) TenantUserCreate(user data.TenantUser) (token string, ret data.TenantUser, err error) {
+	defer db.metrics.observe("TenantUserCreate", time.Now(), &err)
+
+	err = user.Validate()
+	if err != nil {
+		return "", ret, err
+	}
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", ret, err
+	}
+
+	token = hex.EncodeToString(b)
+	user.ID = 0
+	user.Hash = hashKey(token)
+	user.Created = time.Now()
+
+	err = db.update(func(txn *Txn) error {
+		var tenant data.Tenant
+		err := txn.db.store.TxGet(txn.tx, user.TenantID, &tenant)
+		if err != nil {
+			return err
+		}
+
+		return txn.db.store.TxInsert(txn.tx, bolthold.NextSequence(), &user)
+	})
+
+	return token, user, err
+}
+
+// TenantUsers returns the users of a tenant
+func (db *Db) TenantUsers(tenantID string) (ret []data.TenantUser, err error) {
+	defer db.metrics.observe("TenantUsers", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Find(&ret, bolthold.Where("TenantID").Eq(tenantID).
+		Index("TenantID").SortBy("ID"))
+	return
+}
+
+// TenantUserDelete deletes a user of a tenant, which revokes its token
+func (db *Db) TenantUserDelete(tenantID string, id uint64) (err error) {
+	defer db.metrics.observe("TenantUserDelete", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		var user data.TenantUser
+		err := txn.db.store.TxGet(txn.tx, id, &user)
+		if err != nil {
+			return err
+		}
+
+		if user.TenantID != tenantID {
+			return bolthold.ErrNotFound
+		}
+
+		return txn.db.store.TxDelete(txn.tx, id, data.TenantUser{})
+	})
+}
+
+// TenantAuth returns the tenant user a token belongs to, or
+// ErrInvalidToken
+func (db *Db) TenantAuth(token string) (ret data.TenantUser, err error) {
+	defer db.metrics.observe("TenantAuth", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var users []data.TenantUser
+	err = db.store.Find(&users, bolthold.Where("Hash").Eq(hashKey(token)).
+		Index("Hash"))
+	if err != nil {
+		return ret, err
+	}
+
+	if len(users) <= 0 {
+		return ret, ErrInvalidToken
+	}
+
+	return users[0], nil
+}
@@ -0,0 +1,176 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DeviceEventAppend records an event in the timeline of a device. The
+// time is set to now if it is zero, the level is info if it is not set,
+// and if Expires is not set, it is set using the LogTTL option.
+func (txn *Txn) DeviceEventAppend(e data.Event) error {
+	e.ID = 0
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	if e.Level == 0 {
+		e.Level = data.EventLevelInfo
+	}
+
+	if ttl := txn.db.options.logTTL(); e.Expires.IsZero() && ttl > 0 {
+		e.Expires = time.Now().Add(ttl)
+	}
+
+	return txn.db.store.TxInsert(txn.tx, bolthold.NextSequence(), &e)
+}
+
+// DeviceEvents returns the timeline of a device since a time, oldest first
+func (db *Db) DeviceEvents(id string, since time.Time) (ret []data.Event, err error) {
+	defer db.metrics.observe("DeviceEvents", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Find(&ret, bolthold.Where("DeviceID").Eq(id).Index("DeviceID").
+		And("Time").Ge(since).SortBy("Time", "ID"))
+	return
+}
+
+// txConnectionEvent returns the last connected or disconnected event of a
+// device, or nil if there is none
+func (db *Db) txConnectionEvent(tx *bolt.Tx, id string) (*data.Event, error) {
+	var events []data.Event
+	err := db.store.TxFind(tx, &events, bolthold.Where("DeviceID").Eq(id).
+		Index("DeviceID").And("Type").In(data.EventTypeConnected,
+		data.EventTypeDisconnected).SortBy("Time", "ID").Reverse().Limit(1))
+	if err != nil || len(events) <= 0 {
+		return nil, err
+	}
+
+	return &events[0], nil
+}
+
+// sampleEvents records the first seen and connected events of a sample.
+// old is the device before the sample, or nil for a new device.
+func (txn *Txn) sampleEvents(id string, old *data.Device, sample data.Sample) error {
+	if old == nil {
+		return txn.DeviceEventAppend(data.Event{
+			DeviceID: id,
+			Time:     sample.Time,
+			Type:     data.EventTypeFirstSeen,
+			Message:  "first sample: " + sample.Type,
+		})
+	}
+
+	timeout := txn.db.options.offlineTimeout()
+	last := old.LastSeen()
+	if timeout <= 0 || last.IsZero() || sample.Time.Sub(last) <= timeout {
+		return nil
+	}
+
+	return txn.DeviceEventAppend(data.Event{
+		DeviceID: id,
+		Time:     sample.Time,
+		Type:     data.EventTypeConnected,
+		Message: fmt.Sprintf("connected after %v without samples",
+			sample.Time.Sub(last).Round(time.Second)),
+	})
+}
+
+// Presence runs in the background and records a disconnected event in the
+// timeline of devices that have not sent samples for the OfflineTimeout
+// option. Devices are connected again when they send a sample.
+type Presence struct {
+	db       *Db
+	interval time.Duration
+	stop     chan struct{}
+}
+
+// NewPresence creates a new presence monitor that runs every interval
+func NewPresence(db *Db, interval time.Duration) *Presence {
+	return &Presence{
+		db:       db,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start runs the presence monitor in a goroutine until Stop is called
+func (p *Presence) Start() {
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := p.Run(time.Now())
+				if err != nil {
+					log.Println("Error checking device presence: ", err)
+				}
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the presence monitor
+func (p *Presence) Stop() {
+	close(p.stop)
+}
+
+// Run records a disconnected event for each device that has not sent
+// samples for the offline timeout at now, and is not already disconnected.
+// The event time is when the timeout passed.
+func (p *Presence) Run(now time.Time) error {
+	timeout := p.db.options.offlineTimeout()
+	if timeout <= 0 {
+		return nil
+	}
+
+	devices, err := p.db.Devices()
+	if err != nil {
+		return err
+	}
+
+	for _, dev := range devices {
+		last := dev.LastSeen()
+		if last.IsZero() || now.Sub(last) <= timeout {
+			continue
+		}
+
+		id := dev.ID
+		err := p.db.update(func(txn *Txn) error {
+			e, err := txn.db.txConnectionEvent(txn.tx, id)
+			if err != nil {
+				return err
+			}
+
+			// disconnected since the last sample
+			if e != nil && e.Type == data.EventTypeDisconnected && e.Time.After(last) {
+				return nil
+			}
+
+			return txn.DeviceEventAppend(data.Event{
+				DeviceID: id,
+				Time:     last.Add(timeout),
+				Type:     data.EventTypeDisconnected,
+				Level:    data.EventLevelFault,
+				Message: fmt.Sprintf("no samples for %v since %v", timeout,
+					last.UTC().Format(time.RFC3339)),
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrDeviceCycle is returned if the parent of a device is the device itself
+// or one of the devices attached to it
+var ErrDeviceCycle = errors.New("device can't be attached to itself or its children")
+
+// txDeviceInherit checks the parent of a device and sets the groups it
+// inherits. The parent does not need to exist yet, the device inherits its
+// groups when it is created.
+func (db *Db) txDeviceInherit(tx *bolt.Tx, dev *data.Device) error {
+	dev.State.InheritedGroups = nil
+
+	var parent *data.Device
+	for id := dev.Config.Parent; id != ""; {
+		if id == dev.ID {
+			return ErrDeviceCycle
+		}
+
+		p, err := db.txDeviceGet(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if p == nil {
+			break
+		}
+
+		if parent == nil {
+			parent = p
+		}
+
+		id = p.Config.Parent
+	}
+
+	if parent != nil {
+		if groups := parent.Groups(); len(groups) > 0 {
+			dev.State.InheritedGroups = groups
+		}
+	}
+
+	return nil
+}
+
+// txChildIDs returns the IDs of the devices attached to a device, sorted
+func (db *Db) txChildIDs(tx *bolt.Tx, id string) []string {
+	var ret []string
+	for child := range db.index.lookup(tx, indexParent, id) {
+		ret = append(ret, child)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// txDeviceUpdateChildren updates the inherited groups of the devices
+// attached to a device after its groups changed or it was deleted. Changes
+// are passed down the tree by txDevicePut.
+func (db *Db) txDeviceUpdateChildren(tx *bolt.Tx, id string) error {
+	for _, childID := range db.txChildIDs(tx, id) {
+		child, err := db.txDeviceGet(tx, childID)
+		if err != nil {
+			return err
+		}
+
+		if child == nil {
+			continue
+		}
+
+		dev := *child
+		err = db.txDeviceInherit(tx, &dev)
+		if err != nil {
+			return err
+		}
+
+		if reflect.DeepEqual(dev.State.InheritedGroups, child.State.InheritedGroups) {
+			continue
+		}
+
+		err = db.txDevicePut(tx, child, dev)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeviceChildren returns the devices attached to a device, sorted by ID
+func (db *Db) DeviceChildren(id string) (ret []data.Device, err error) {
+	defer db.metrics.observe("DeviceChildren", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Bolt().View(func(tx *bolt.Tx) error {
+		for _, childID := range db.txChildIDs(tx, id) {
+			dev, err := db.txDeviceGet(tx, childID)
+			if err != nil {
+				return err
+			}
+
+			if dev != nil {
+				ret = append(ret, *dev)
+			}
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// DeviceTree returns a device and all the devices attached to it, like a
+// gateway, its buses, and the sensors on each bus. Returns
+// bolthold.ErrNotFound if the device does not exist.
+func (db *Db) DeviceTree(id string) (ret data.DeviceNode, err error) {
+	defer db.metrics.observe("DeviceTree", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Bolt().View(func(tx *bolt.Tx) error {
+		dev, err := db.txDeviceGet(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if dev == nil {
+			return bolthold.ErrNotFound
+		}
+
+		ret, err = db.txDeviceTree(tx, *dev)
+		return err
+	})
+
+	return
+}
+
+func (db *Db) txDeviceTree(tx *bolt.Tx, dev data.Device) (data.DeviceNode, error) {
+	ret := data.DeviceNode{Device: dev, Children: []data.DeviceNode{}}
+
+	for _, childID := range db.txChildIDs(tx, dev.ID) {
+		child, err := db.txDeviceGet(tx, childID)
+		if err != nil {
+			return ret, err
+		}
+
+		if child == nil {
+			continue
+		}
+
+		node, err := db.txDeviceTree(tx, *child)
+		if err != nil {
+			return ret, err
+		}
+
+		ret.Children = append(ret.Children, node)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,190 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+)
+
+// ErrTunnelClosed is returned when a device connects to a tunnel session
+// that is closed or past its time limit
+var ErrTunnelClosed = errors.New("tunnel session is closed")
+
+// TunnelCreate opens a tunnel session and sends the device a
+// data.TunnelCommand. The ID is assigned, and the session and the token the
+// device connects with are returned. The token can't be read again later.
+func (db *Db) TunnelCreate(s data.TunnelSession) (ret data.TunnelSession, token string, err error) {
+	defer db.metrics.observe("TunnelCreate", time.Now(), &err)
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+
+	token = hex.EncodeToString(b)
+	s.ID = 0
+	s.State = data.TunnelPending
+	s.TokenHash = hashKey(token)
+	s.Created = time.Now()
+	s.Closed = time.Time{}
+	s.CloseReason = ""
+	s.Connections = 0
+	s.BytesIn = 0
+	s.BytesOut = 0
+
+	err = db.update(func(txn *Txn) error {
+		err := txn.db.store.TxInsert(txn.tx, bolthold.NextSequence(), &s)
+		if err != nil {
+			return err
+		}
+
+		// the command is useless after the session ends
+		_, err = txn.CommandEnqueue(data.DeviceCommand{
+			DeviceID: s.DeviceID,
+			Command:  data.TunnelCommand,
+			Args: map[string]string{
+				"sessionId": strconv.FormatUint(s.ID, 10),
+				"port":      strconv.Itoa(s.Port),
+				"token":     token,
+				"ends":      s.Ends.UTC().Format(time.RFC3339),
+			},
+			Expires: s.Ends,
+		})
+		if err != nil {
+			return err
+		}
+
+		msg := fmt.Sprintf("%v: %v opened port %v until %v", s.ID, s.User,
+			s.Port, s.Ends.UTC().Format(time.RFC3339))
+		if s.Reason != "" {
+			msg += ": " + s.Reason
+		}
+
+		return txn.AuditAppend(data.AuditRecord{
+			DeviceID: s.DeviceID,
+			Action:   "tunnelOpen",
+			Message:  msg,
+		})
+	})
+
+	return s, token, err
+}
+
+// Tunnels returns all tunnel sessions, oldest first
+func (db *Db) Tunnels() (ret []data.TunnelSession, err error) {
+	defer db.metrics.observe("Tunnels", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Find(&ret, nil)
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return
+}
+
+// Tunnel returns a tunnel session. Returns bolthold.ErrNotFound if it does
+// not exist.
+func (db *Db) Tunnel(id uint64) (ret data.TunnelSession, err error) {
+	defer db.metrics.observe("Tunnel", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Get(id, &ret)
+	ret.ID = id
+	return
+}
+
+// TunnelAuth checks the token a device connects to a tunnel session with.
+// Returns ErrInvalidKey if the token is wrong, and ErrTunnelClosed if the
+// session is closed.
+func (db *Db) TunnelAuth(id uint64, token string) (ret data.TunnelSession, err error) {
+	ret, err = db.Tunnel(id)
+	if err != nil {
+		return
+	}
+
+	if ret.TokenHash != hashKey(token) {
+		return ret, ErrInvalidKey
+	}
+
+	if ret.State == data.TunnelClosed || time.Now().After(ret.Ends) {
+		return ret, ErrTunnelClosed
+	}
+
+	return ret, nil
+}
+
+// tunnelUpdate changes a tunnel session with fn and writes an audit record
+func (db *Db) tunnelUpdate(id uint64, action string, fn func(s *data.TunnelSession) string) error {
+	return db.update(func(txn *Txn) error {
+		var s data.TunnelSession
+		err := txn.db.store.TxGet(txn.tx, id, &s)
+		if err != nil {
+			return err
+		}
+
+		s.ID = id
+		if s.State == data.TunnelClosed {
+			return nil
+		}
+
+		msg := fn(&s)
+
+		err = txn.db.store.TxUpdate(txn.tx, id, &s)
+		if err != nil {
+			return err
+		}
+
+		return txn.AuditAppend(data.AuditRecord{
+			DeviceID: s.DeviceID,
+			Action:   action,
+			Message:  fmt.Sprintf("%v: %v", id, msg),
+		})
+	})
+}
+
+// TunnelSetState records a device connecting (data.TunnelConnected) or
+// disconnecting (data.TunnelPending). Closed sessions are not changed.
+func (db *Db) TunnelSetState(id uint64, state string) (err error) {
+	defer db.metrics.observe("TunnelSetState", time.Now(), &err)
+
+	return db.tunnelUpdate(id, "tunnelState", func(s *data.TunnelSession) string {
+		s.State = state
+		return state
+	})
+}
+
+// TunnelConnection records an engineer connection to a tunnel session
+func (db *Db) TunnelConnection(id uint64, remote string) (err error) {
+	defer db.metrics.observe("TunnelConnection", time.Now(), &err)
+
+	return db.tunnelUpdate(id, "tunnelConnection", func(s *data.TunnelSession) string {
+		s.Connections++
+		return "connection from " + remote
+	})
+}
+
+// TunnelClose closes a tunnel session, and adds the bytes sent to
+// (in) and from (out) the device. Closed sessions are not changed.
+func (db *Db) TunnelClose(id uint64, reason string, in, out int64) (err error) {
+	defer db.metrics.observe("TunnelClose", time.Now(), &err)
+
+	return db.tunnelUpdate(id, "tunnelClose", func(s *data.TunnelSession) string {
+		s.State = data.TunnelClosed
+		s.Closed = time.Now()
+		s.CloseReason = reason
+		s.BytesIn += in
+		s.BytesOut += out
+		return fmt.Sprintf("%v (%v bytes in, %v bytes out)", reason,
+			s.BytesIn, s.BytesOut)
+	})
+}
@@ -0,0 +1,430 @@
+package db
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Txn is used to make multiple changes to the db atomically. Either all of
+// the changes made in a Txn are written, or none of them are. Change feed
+// events and cache updates only happen after the Txn commits.
+type Txn struct {
+	db *Db
+	tx *bolt.Tx
+	// pending tracks samples written in this txn for deduplication
+	pending map[string]bool
+}
+
+// update runs fn in a write transaction. Callers are responsible for
+// recording metrics.
+func (db *Db) update(fn func(txn *Txn) error) error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	return db.store.Bolt().Update(func(tx *bolt.Tx) error {
+		return fn(&Txn{db: db, tx: tx})
+	})
+}
+
+// Update runs fn in a single write transaction. If fn returns an error,
+// none of the changes made in fn are written. The Txn must not be used
+// after fn returns.
+func (db *Db) Update(fn func(txn *Txn) error) (err error) {
+	defer db.metrics.observe("Update", time.Now(), &err)
+	return db.update(fn)
+}
+
+// Device returns a device, or nil if it does not exist
+func (txn *Txn) Device(id string) (*data.Device, error) {
+	return txn.db.txDeviceGet(txn.tx, id)
+}
+
+// DeviceUpdate writes a device
+func (txn *Txn) DeviceUpdate(device data.Device) error {
+	old, err := txn.db.txDeviceGet(txn.tx, device.ID)
+	if err != nil {
+		return err
+	}
+
+	return txn.db.txDevicePut(txn.tx, old, device)
+}
+
+// DeviceUpdateConfig updates the config for a device. A new config version
+// is recorded if the config changed. Returns bolthold.ErrNotFound if the
+// device does not exist.
+func (txn *Txn) DeviceUpdateConfig(id string, config data.DeviceConfig) error {
+	return txn.deviceUpdateConfig(id, config, "")
+}
+
+// deviceUpdateConfig updates the config for a device. reason is recorded
+// with the new config version.
+func (txn *Txn) deviceUpdateConfig(id string, config data.DeviceConfig, reason string) error {
+	old, err := txn.db.txDeviceGet(txn.tx, id)
+	if err != nil {
+		return err
+	}
+
+	if old == nil {
+		return bolthold.ErrNotFound
+	}
+
+	dev := *old
+	dev.Config = config
+	if !reflect.DeepEqual(old.Config, config) {
+		dev.State.ConfigUpdated = time.Now()
+
+		err := txn.configSnapshot(old, data.ConfigSnapshot{
+			Time:   dev.State.ConfigUpdated,
+			Config: config,
+			Reason: reason,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if changes := data.ConfigChanges(old.Config, config); len(changes) > 0 {
+		msg := "changed " + strings.Join(changes, ", ")
+		if reason != "" {
+			msg += " (" + reason + ")"
+		}
+
+		err := txn.DeviceEventAppend(data.Event{
+			DeviceID: id,
+			Time:     dev.State.ConfigUpdated,
+			Type:     data.EventTypeConfigChanged,
+			Message:  msg,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return txn.db.txDevicePut(txn.tx, old, dev)
+}
+
+// DeviceReportConfig records the config a device applied. The device is
+// created if it does not exist. An EventConfigFailed event is published if
+// the device failed to apply fields that it did not already report as
+// failed.
+func (txn *Txn) DeviceReportConfig(id string, report data.ConfigReport) error {
+	old, err := txn.db.txDeviceGet(txn.tx, id)
+	if err != nil {
+		return err
+	}
+
+	dev := data.Device{ID: id}
+	if old != nil {
+		dev = *old
+	}
+
+	// the server time is used, so reports can be compared with config
+	// changes even if the device clock is wrong
+	report.Time = time.Now()
+
+	prev := dev.Twin().Failed()
+	dev.State.Reported = &report
+	twin := dev.Twin()
+
+	failed := twin.Failed()
+	if len(failed) > 0 && !reflect.DeepEqual(failed, prev) {
+		txn.db.feed.publishOnCommit(txn.tx, Event{
+			Type:     EventConfigFailed,
+			DeviceID: id,
+			Twin:     &twin,
+		})
+	}
+
+	e := data.Event{
+		DeviceID: id,
+		Time:     report.Time,
+		Type:     data.EventTypeConfigApplied,
+		Message:  "applied config",
+	}
+	if len(failed) > 0 {
+		var msgs []string
+		for f, msg := range failed {
+			msgs = append(msgs, f+": "+msg)
+		}
+		sort.Strings(msgs)
+
+		e.Type = data.EventTypeConfigFailed
+		e.Level = data.EventLevelFault
+		e.Message = "failed to apply " + strings.Join(msgs, "; ")
+	}
+
+	err = txn.DeviceEventAppend(e)
+	if err != nil {
+		return err
+	}
+
+	return txn.db.txDevicePut(txn.tx, old, dev)
+}
+
+// DeviceSample processes a sample for a device and adds it to the sample
+// history. The device is created if it does not exist. Duplicate samples
+// (same type, id, time, and value as a recent sample) are dropped.
+func (txn *Txn) DeviceSample(id string, sample data.Sample) error {
+	_, err := txn.deviceSample(id, sample)
+	return err
+}
+
+// deviceSample is the same as DeviceSample, but returns false if the
+// sample was dropped as a duplicate
+func (txn *Txn) deviceSample(id string, sample data.Sample) (bool, error) {
+	if sample.Time.IsZero() {
+		sample.Time = time.Now()
+	} else {
+		// samples written earlier in this txn are not in the dedup window
+		// until the txn commits
+		key := id + "/" + dedupKey(sample)
+		if txn.db.dedup.seen(id, sample) || txn.pending[key] {
+			txn.db.dedup.suppress()
+			return false, nil
+		}
+
+		if txn.pending == nil {
+			txn.pending = make(map[string]bool)
+		}
+		txn.pending[key] = true
+		txn.db.dedup.addOnCommit(txn.tx, id, sample)
+	}
+
+	err := txn.db.usage.check(id, txn.db.options.usageLimits())
+	if err != nil {
+		return false, err
+	}
+
+	err = txn.db.txHistoryInsert(txn.tx, id, sample)
+	if err != nil {
+		return false, err
+	}
+
+	txn.db.usage.addPointOnCommit(txn.tx, id)
+	txn.db.feed.publishOnCommit(txn.tx, Event{
+		Type:     EventSampleWritten,
+		DeviceID: id,
+		Sample:   &sample,
+	})
+
+	old, err := txn.db.txDeviceGet(txn.tx, id)
+	if err != nil {
+		return false, err
+	}
+
+	err = txn.sampleEvents(id, old, sample)
+	if err != nil {
+		return false, err
+	}
+
+	var dev data.Device
+	if old == nil {
+		dev = data.Device{
+			ID: id,
+			State: data.DeviceState{
+				Ios: []data.Sample{sample},
+			},
+		}
+	} else {
+		dev = *old
+		dev.State.Ios = append([]data.Sample{}, old.State.Ios...)
+		dev.ProcessSample(sample)
+	}
+
+	return true, txn.db.txDevicePut(txn.tx, old, dev)
+}
+
+// DeviceDelete deletes a device and its files
+func (txn *Txn) DeviceDelete(id string) error {
+	old, err := txn.db.txDeviceGet(txn.tx, id)
+	if err != nil {
+		return err
+	}
+
+	err = txn.db.store.TxDelete(txn.tx, id, data.Device{})
+	if err != nil {
+		return err
+	}
+
+	err = txn.db.store.TxDelete(txn.tx, id, batchMark{})
+	if err != nil && err != bolthold.ErrNotFound {
+		return err
+	}
+
+	var files []data.DeviceFile
+	err = txn.db.store.TxFind(txn.tx, &files, bolthold.Where("DeviceID").Eq(id))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		err := txn.fileDelete(f.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = txn.db.store.TxDeleteMatching(txn.tx, &data.Event{},
+		bolthold.Where("DeviceID").Eq(id).Index("DeviceID"))
+	if err != nil {
+		return err
+	}
+
+	err = txn.db.store.TxDeleteMatching(txn.tx, &data.ConfigSnapshot{},
+		bolthold.Where("DeviceID").Eq(id).Index("DeviceID"))
+	if err != nil {
+		return err
+	}
+
+	if old == nil {
+		return nil
+	}
+
+	txn.db.latest.deleteOnCommit(txn.tx, id)
+	txn.tx.OnCommit(func() {
+		txn.db.dedup.remove(id)
+	})
+	txn.tx.OnCommit(func() {
+		txn.db.cacheDeleteDevice(id)
+	})
+	txn.db.feed.publishOnCommit(txn.tx, Event{
+		Type:     EventDeviceDeleted,
+		DeviceID: id,
+	})
+
+	err = txn.db.index.update(txn.tx, old, nil)
+	if err != nil {
+		return err
+	}
+
+	// devices attached to the device keep it as their parent, but no
+	// longer inherit its groups
+	return txn.db.txDeviceUpdateChildren(txn.tx, id)
+}
+
+// CommandEnqueue queues a command for a device. The ID and Created fields
+// of cmd are filled in and the new command is returned. If Expires is not
+// set, it is set using the CommandTTL option.
+func (txn *Txn) CommandEnqueue(cmd data.DeviceCommand) (data.DeviceCommand, error) {
+	cmd.ID = 0
+	if cmd.Created.IsZero() {
+		cmd.Created = time.Now()
+	}
+
+	if ttl := txn.db.options.commandTTL(); cmd.Expires.IsZero() && ttl > 0 {
+		cmd.Expires = cmd.Created.Add(ttl)
+	}
+
+	err := txn.db.store.TxInsert(txn.tx, bolthold.NextSequence(), &cmd)
+	if err != nil {
+		return cmd, err
+	}
+
+	txn.db.feed.publishOnCommit(txn.tx, Event{
+		Type:     EventCommandQueued,
+		DeviceID: cmd.DeviceID,
+		Command:  &cmd,
+	})
+
+	return cmd, txn.DeviceEventAppend(data.Event{
+		DeviceID: cmd.DeviceID,
+		Time:     cmd.Created,
+		Type:     data.EventTypeCommand,
+		Message:  "queued " + cmd.Command,
+	})
+}
+
+// CommandDelete removes a command from the queue, typically after the
+// device has acknowledged it.
+func (txn *Txn) CommandDelete(id uint64) error {
+	return txn.db.store.TxDelete(txn.tx, id, data.DeviceCommand{})
+}
+
+// AuditAppend adds a record to the audit log. The time is set to now if
+// it is not set.
+func (txn *Txn) AuditAppend(rec data.AuditRecord) error {
+	rec.ID = 0
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+
+	return txn.db.store.TxInsert(txn.tx, bolthold.NextSequence(), &rec)
+}
+
+// DeviceCommands returns the queued commands for a device, oldest first.
+// Expired commands that have not been collected yet are not returned.
+func (db *Db) DeviceCommands(id string) (ret []data.DeviceCommand, err error) {
+	defer db.metrics.observe("DeviceCommands", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var cmds []data.DeviceCommand
+	err = db.store.Find(&cmds, bolthold.Where("DeviceID").Eq(id).
+		SortBy("ID"))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, c := range cmds {
+		if !c.Expired(now) {
+			ret = append(ret, c)
+		}
+	}
+
+	return ret, nil
+}
+
+// CommandQueued returns true if cmd is still queued. Integrations that
+// send commands both when they are queued and after an uplink use this so
+// a command that was already sent is not sent again.
+func (db *Db) CommandQueued(cmd data.DeviceCommand) (bool, error) {
+	cmds, err := db.DeviceCommands(cmd.DeviceID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, c := range cmds {
+		if c.ID == cmd.ID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// CommandDelete removes a command from the queue
+func (db *Db) CommandDelete(id uint64) (err error) {
+	defer db.metrics.observe("CommandDelete", time.Now(), &err)
+	return db.update(func(txn *Txn) error {
+		return txn.CommandDelete(id)
+	})
+}
+
+// Audit returns the audit records for a device, oldest first. If id is
+// blank, all records are returned.
+func (db *Db) Audit(id string) (ret []data.AuditRecord, err error) {
+	defer db.metrics.observe("Audit", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	query := bolthold.Where(bolthold.Key).Gt(uint64(0))
+	if id != "" {
+		query = bolthold.Where("DeviceID").Eq(id)
+	}
+
+	err = db.store.Find(&ret, query.SortBy("ID"))
+	return
+}
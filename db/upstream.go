@@ -0,0 +1,91 @@
+package db
+
+import (
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+)
+
+// DeviceSyncState is the upstream sync state of a device on an edge server
+type DeviceSyncState struct {
+	// LocalConfig and UpstreamConfig are when the device config was
+	// updated on each server the last time the configs matched. They are
+	// used to tell which side changed the config.
+	LocalConfig    time.Time
+	UpstreamConfig time.Time
+	// Reported is the time of the last config report synced
+	Reported time.Time
+}
+
+// UpstreamMark records how far an edge server has synced to its upstream
+// server
+type UpstreamMark struct {
+	// Store identifies this db on the upstream server, so the upstream
+	// server starts over if the edge db is replaced
+	Store string
+	// Seq is the sequence number of the last raw sample synced
+	Seq     uint64
+	Devices map[string]DeviceSyncState
+}
+
+const upstreamMarkKey = "upstream"
+
+// UpstreamMark returns the upstream sync mark
+func (db *Db) UpstreamMark() (ret UpstreamMark, err error) {
+	defer db.metrics.observe("UpstreamMark", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Get(upstreamMarkKey, &ret)
+	if err == bolthold.ErrNotFound {
+		err = nil
+	}
+
+	if ret.Devices == nil {
+		ret.Devices = make(map[string]DeviceSyncState)
+	}
+
+	return ret, err
+}
+
+// SetUpstreamMark stores the upstream sync mark
+func (db *Db) SetUpstreamMark(mark UpstreamMark) (err error) {
+	defer db.metrics.observe("SetUpstreamMark", time.Now(), &err)
+	return db.update(func(txn *Txn) error {
+		return txn.db.store.TxUpsert(txn.tx, upstreamMarkKey, &mark)
+	})
+}
+
+// WrittenSample is a raw sample and the sequence number it was written
+// with
+type WrittenSample struct {
+	Seq      uint64
+	DeviceID string
+	Sample   data.Sample
+}
+
+// SamplesAfter returns up to limit raw samples written after seq, in the
+// order they were written. Samples that were compressed after the raw
+// retention are not returned.
+func (db *Db) SamplesAfter(seq uint64, limit int) (ret []WrittenSample, err error) {
+	defer db.metrics.observe("SamplesAfter", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var records []sampleRecord
+	err = db.store.Find(&records, bolthold.Where(bolthold.Key).Gt(seq).
+		SortBy("Seq").Limit(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	ret = make([]WrittenSample, len(records))
+	for i, r := range records {
+		ret[i] = WrittenSample{Seq: r.Seq, DeviceID: r.DeviceID, Sample: r.Sample}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,261 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrUsageLimit is returned when writing a sample would exceed a device or
+// group storage limit
+var ErrUsageLimit = errors.New("storage usage limit exceeded")
+
+// Usage is the storage used by sample history
+type Usage struct {
+	// Points is the number of raw samples stored, including compressed
+	// samples
+	Points int64 `json:"points"`
+	// Bytes is the encoded size of all history records, including the
+	// compressed samples and the 1m/1h aggregates
+	Bytes int64 `json:"bytes"`
+}
+
+func (u *Usage) add(o Usage) {
+	u.Points += o.Points
+	u.Bytes += o.Bytes
+}
+
+// UsageReport is the storage used by each device and group
+type UsageReport struct {
+	Total   Usage            `json:"total"`
+	Devices map[string]Usage `json:"devices"`
+	Groups  map[string]Usage `json:"groups"`
+	// Counted is when the usage was last counted from the store. Points
+	// are updated as samples are written, but Bytes are only updated when
+	// the usage is counted.
+	Counted time.Time `json:"counted"`
+}
+
+// UsageLimits are optional limits on the storage used by each device and
+// group. A limit of 0 means no limit.
+type UsageLimits struct {
+	DevicePoints int64 `json:"devicePoints"`
+	DeviceBytes  int64 `json:"deviceBytes"`
+	GroupPoints  int64 `json:"groupPoints"`
+	GroupBytes   int64 `json:"groupBytes"`
+}
+
+func (l UsageLimits) exceeded(u Usage, points, bytes int64) bool {
+	return (points > 0 && u.Points >= points) ||
+		(bytes > 0 && u.Bytes >= bytes)
+}
+
+// usageState tracks the storage used by each device. It is counted from the
+// store when the store is opened and after each downsample pass.
+type usageState struct {
+	lock    sync.Mutex
+	devices map[string]Usage
+	groups  map[string]Usage
+	// deviceGroups are the current groups of each device
+	deviceGroups map[string][]string
+	counted      time.Time
+}
+
+// historyTypes are the record types that make up the sample history
+var historyTypes = []interface{}{
+	sampleRecord{},
+	sampleAggregate{},
+	sampleBlock{},
+}
+
+// load counts the storage used by each device in store
+func (u *usageState) load(store *bolthold.Store, options *Options) error {
+	bhOptions, err := options.boltholdOptions()
+	if err != nil {
+		return err
+	}
+
+	decode := bhOptions.Decoder
+	devices := make(map[string]Usage)
+	deviceGroups := make(map[string][]string)
+
+	err = store.Bolt().View(func(tx *bolt.Tx) error {
+		var devs []data.Device
+		err := store.TxFind(tx, &devs, nil)
+		if err != nil {
+			return err
+		}
+
+		for _, d := range devs {
+			deviceGroups[d.ID] = d.Groups()
+		}
+
+		for _, t := range historyTypes {
+			rType := reflect.TypeOf(t)
+			b := tx.Bucket([]byte(rType.Name()))
+			if b == nil {
+				continue
+			}
+
+			err := b.ForEach(func(k, v []byte) error {
+				rec := reflect.New(rType).Interface()
+				err := decode(v, rec)
+				if err != nil {
+					// reported by CheckIntegrity
+					return nil
+				}
+
+				id, _ := recordDeviceID(rec)
+				use := Usage{Bytes: int64(len(k) + len(v))}
+
+				switch r := rec.(type) {
+				case *sampleRecord:
+					use.Points = 1
+				case *sampleBlock:
+					use.Points = int64(r.Count)
+				}
+
+				d := devices[id]
+				d.add(use)
+				devices[id] = d
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	groups := make(map[string]Usage)
+	for id, use := range devices {
+		for _, g := range deviceGroups[id] {
+			gu := groups[g]
+			gu.add(use)
+			groups[g] = gu
+		}
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.devices = devices
+	u.groups = groups
+	u.deviceGroups = deviceGroups
+	u.counted = time.Now()
+
+	return nil
+}
+
+// check returns ErrUsageLimit if the device, or any group it is in, is at
+// one of the limits
+func (u *usageState) check(id string, limits UsageLimits) error {
+	if limits == (UsageLimits{}) {
+		return nil
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if limits.exceeded(u.devices[id], limits.DevicePoints, limits.DeviceBytes) {
+		return ErrUsageLimit
+	}
+
+	for _, g := range u.deviceGroups[id] {
+		if limits.exceeded(u.groups[g], limits.GroupPoints, limits.GroupBytes) {
+			return ErrUsageLimit
+		}
+	}
+
+	return nil
+}
+
+// addPointOnCommit counts a raw sample for a device if tx commits
+func (u *usageState) addPointOnCommit(tx *bolt.Tx, id string) {
+	tx.OnCommit(func() {
+		u.lock.Lock()
+		defer u.lock.Unlock()
+
+		if u.devices == nil {
+			return
+		}
+
+		d := u.devices[id]
+		d.Points++
+		u.devices[id] = d
+
+		for _, g := range u.deviceGroups[id] {
+			gu := u.groups[g]
+			gu.Points++
+			u.groups[g] = gu
+		}
+	})
+}
+
+// setGroupsOnCommit moves the usage of a device to its current groups if
+// tx commits
+func (u *usageState) setGroupsOnCommit(tx *bolt.Tx, dev *data.Device) {
+	tx.OnCommit(func() {
+		u.lock.Lock()
+		defer u.lock.Unlock()
+
+		if u.devices == nil {
+			return
+		}
+
+		use := u.devices[dev.ID]
+		for _, g := range u.deviceGroups[dev.ID] {
+			gu := u.groups[g]
+			gu.Points -= use.Points
+			gu.Bytes -= use.Bytes
+			u.groups[g] = gu
+		}
+
+		for _, g := range dev.Groups() {
+			gu := u.groups[g]
+			gu.add(use)
+			u.groups[g] = gu
+		}
+
+		u.deviceGroups[dev.ID] = dev.Groups()
+	})
+}
+
+// Usage returns the storage used by each device and group
+func (db *Db) Usage() UsageReport {
+	db.usage.lock.Lock()
+	defer db.usage.lock.Unlock()
+
+	ret := UsageReport{
+		Devices: make(map[string]Usage),
+		Groups:  make(map[string]Usage),
+		Counted: db.usage.counted,
+	}
+
+	for id, use := range db.usage.devices {
+		ret.Devices[id] = use
+		ret.Total.add(use)
+	}
+
+	for g, use := range db.usage.groups {
+		ret.Groups[g] = use
+	}
+
+	return ret
+}
+
+// UsageLimits returns the storage limits for devices and groups
+func (db *Db) UsageLimits() UsageLimits {
+	return db.options.usageLimits()
+}
@@ -0,0 +1,552 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/timshannon/bolthold"
+)
+
+// maxFailedLogins is how many failed logins in a row lock an account for
+// lockoutTime
+const (
+	maxFailedLogins = 5
+	lockoutTime     = 15 * time.Minute
+)
+
+var (
+	// ErrUserExists is returned when creating a user that already exists
+	ErrUserExists = errors.New("user already exists")
+	// ErrInvalidLogin is returned if the username or password is wrong
+	ErrInvalidLogin = errors.New("invalid username or password")
+	// ErrUserLocked is returned on login if the account is locked after
+	// too many failed logins
+	ErrUserLocked = errors.New("account is locked, try again later")
+	// ErrExternalUser is returned when setting the password of a user
+	// managed by an identity provider
+	ErrExternalUser = errors.New("user is managed by an identity provider")
+)
+
+// dummyHash is checked on logins of unknown users, so the response time
+// does not tell if a user exists
+var (
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+// newToken returns a random token for a session or password reset
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// UserInsert creates a local user with a password
+func (db *Db) UserInsert(user data.User, password string) (ret data.User, err error) {
+	defer db.metrics.observe("UserInsert", time.Now(), &err)
+
+	err = user.Validate()
+	if err != nil {
+		return ret, err
+	}
+
+	err = data.ValidatePassword(password)
+	if err != nil {
+		return ret, err
+	}
+
+	user.Hash, err = hashPassword(password)
+	if err != nil {
+		return ret, err
+	}
+
+	user.Provider = ""
+	user.Created = time.Now()
+	user.FailedLogins = 0
+	user.LockedUntil = time.Time{}
+
+	err = db.update(func(txn *Txn) error {
+		err := txn.db.store.TxInsert(txn.tx, user.Username, &user)
+		if err == bolthold.ErrKeyExists {
+			return ErrUserExists
+		}
+		return err
+	})
+
+	return user, err
+}
+
+// UserUpsertExternal creates or updates a user that logged in with an
+// identity provider. The role of an existing user is updated, so role
+// changes at the provider apply at the next login. Returns ErrUserExists
+// if a user with the name exists that is not managed by the provider.
+func (db *Db) UserUpsertExternal(user data.User) (ret data.User, err error) {
+	defer db.metrics.observe("UserUpsertExternal", time.Now(), &err)
+
+	err = user.Validate()
+	if err != nil {
+		return ret, err
+	}
+
+	if user.Provider == "" {
+		return ret, errors.New("provider is required")
+	}
+
+	err = db.update(func(txn *Txn) error {
+		err := txn.db.store.TxGet(txn.tx, user.Username, &ret)
+		if err == bolthold.ErrNotFound {
+			ret = data.User{
+				Username: user.Username,
+				Role:     user.Role,
+				Provider: user.Provider,
+				Created:  time.Now(),
+			}
+			return txn.db.store.TxInsert(txn.tx, ret.Username, &ret)
+		} else if err != nil {
+			return err
+		}
+
+		if ret.Provider != user.Provider {
+			return ErrUserExists
+		}
+
+		if ret.Role == user.Role {
+			return nil
+		}
+
+		ret.Role = user.Role
+		return txn.db.store.TxUpdate(txn.tx, ret.Username, &ret)
+	})
+
+	return ret, err
+}
+
+// User returns a user, or bolthold.ErrNotFound
+func (db *Db) User(username string) (ret data.User, err error) {
+	defer db.metrics.observe("User", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Get(username, &ret)
+	return
+}
+
+// Users returns all users sorted by name
+func (db *Db) Users() (ret []data.User, err error) {
+	defer db.metrics.observe("Users", time.Now(), &err)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	err = db.store.Find(&ret, nil)
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Username < ret[j].Username
+	})
+	return
+}
+
+// UserDelete deletes a user and ends its sessions. Returns
+// bolthold.ErrNotFound if it does not exist.
+func (db *Db) UserDelete(username string) (err error) {
+	defer db.metrics.observe("UserDelete", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		err := txn.db.store.TxDelete(txn.tx, username, data.User{})
+		if err != nil {
+			return err
+		}
+
+		return txn.deleteUserTokens(username)
+	})
+}
+
+// deleteUserTokens deletes the sessions and password resets of a user
+func (txn *Txn) deleteUserTokens(username string) error {
+	err := txn.db.store.TxDeleteMatching(txn.tx, data.Session{},
+		bolthold.Where("Username").Eq(username).Index("Username"))
+	if err != nil {
+		return err
+	}
+
+	return txn.db.store.TxDeleteMatching(txn.tx, data.PasswordReset{},
+		bolthold.Where("Username").Eq(username).Index("Username"))
+}
+
+// UserSetPassword sets the password of a user and ends its sessions, so
+// a stolen session can't outlive a password change
+func (db *Db) UserSetPassword(username, password string) (err error) {
+	defer db.metrics.observe("UserSetPassword", time.Now(), &err)
+
+	err = data.ValidatePassword(password)
+	if err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return db.update(func(txn *Txn) error {
+		return txn.userSetHash(username, hash)
+	})
+}
+
+func (txn *Txn) userSetHash(username, hash string) error {
+	var user data.User
+	err := txn.db.store.TxGet(txn.tx, username, &user)
+	if err != nil {
+		return err
+	}
+
+	if user.Provider != "" {
+		return ErrExternalUser
+	}
+
+	user.Hash = hash
+	user.FailedLogins = 0
+	user.LockedUntil = time.Time{}
+
+	err = txn.db.store.TxUpdate(txn.tx, username, &user)
+	if err != nil {
+		return err
+	}
+
+	return txn.deleteUserTokens(username)
+}
+
+// UserUnlock clears the failed logins of a user
+func (db *Db) UserUnlock(username string) (err error) {
+	defer db.metrics.observe("UserUnlock", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		var user data.User
+		err := txn.db.store.TxGet(txn.tx, username, &user)
+		if err != nil {
+			return err
+		}
+
+		user.FailedLogins = 0
+		user.LockedUntil = time.Time{}
+		return txn.db.store.TxUpdate(txn.tx, username, &user)
+	})
+}
+
+// UserCheckPassword checks the password of a user. Returns
+// ErrInvalidLogin if the user does not exist or the password is wrong.
+// Accounts are locked for a while after too many failed checks, and
+// ErrUserLocked is returned.
+func (db *Db) UserCheckPassword(username, password string) (err error) {
+	defer db.metrics.observe("UserCheckPassword", time.Now(), &err)
+
+	user, err := db.User(username)
+	if err == bolthold.ErrNotFound || (err == nil && user.Provider != "") {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = hashPassword("not a password")
+		})
+		checkPassword(dummyHash, password)
+		return ErrInvalidLogin
+	} else if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if now.Before(user.LockedUntil) {
+		return ErrUserLocked
+	}
+
+	// the check is slow, so it is done outside the transaction
+	ok, rehash, err := checkPassword(user.Hash, password)
+	if err != nil {
+		return err
+	}
+
+	// old hashes are replaced while the password is known. Longer
+	// passwords from before bcrypt was used keep their hash, as bcrypt
+	// would ignore the end.
+	var newHash string
+	if rehash && len(password) <= data.MaxPasswordLength {
+		newHash, err = hashPassword(password)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ok && user.FailedLogins == 0 && newHash == "" {
+		return nil
+	}
+
+	oldHash := user.Hash
+
+	err = db.update(func(txn *Txn) error {
+		var user data.User
+		err := txn.db.store.TxGet(txn.tx, username, &user)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			user.FailedLogins = 0
+			// unless the password was changed since it was checked
+			if newHash != "" && user.Hash == oldHash {
+				user.Hash = newHash
+			}
+		} else {
+			user.FailedLogins++
+			if user.FailedLogins >= maxFailedLogins {
+				user.FailedLogins = 0
+				user.LockedUntil = now.Add(lockoutTime)
+			}
+		}
+
+		return txn.db.store.TxUpdate(txn.tx, username, &user)
+	})
+
+	switch {
+	case err == bolthold.ErrNotFound || (err == nil && !ok):
+		return ErrInvalidLogin
+	default:
+		return err
+	}
+}
+
+// UserLogin checks the password of a user and starts a session. The
+// session token is returned, and can't be read again later. Sessions
+// expire after ttl if not used, and after maxAge in any case.
+func (db *Db) UserLogin(username, password string, ttl, maxAge time.Duration) (token string, ret data.Session, err error) {
+	defer db.metrics.observe("UserLogin", time.Now(), &err)
+
+	err = db.UserCheckPassword(username, password)
+	if err != nil {
+		return "", ret, err
+	}
+
+	return db.SessionCreate(username, ttl, maxAge)
+}
+
+// SessionCreate starts a session of a user that has been authenticated.
+// The session token is returned, and can't be read again later.
+func (db *Db) SessionCreate(username string, ttl, maxAge time.Duration) (token string, ret data.Session, err error) {
+	defer db.metrics.observe("SessionCreate", time.Now(), &err)
+
+	token, err = newToken()
+	if err != nil {
+		return "", ret, err
+	}
+
+	now := time.Now()
+	ret = data.Session{
+		ID:         hashKey(token),
+		Username:   username,
+		Created:    now,
+		Expires:    now.Add(ttl),
+		MaxExpires: now.Add(maxAge),
+	}
+
+	if ret.Expires.After(ret.MaxExpires) {
+		ret.Expires = ret.MaxExpires
+	}
+
+	err = db.update(func(txn *Txn) error {
+		return txn.db.store.TxInsert(txn.tx, ret.ID, &ret)
+	})
+
+	if err != nil {
+		return "", data.Session{}, err
+	}
+
+	return token, ret, nil
+}
+
+// session returns the session of a token if it has not expired
+func (txn *Txn) session(token string, now time.Time) (data.Session, error) {
+	var ret data.Session
+	err := txn.db.store.TxGet(txn.tx, hashKey(token), &ret)
+	if err == bolthold.ErrNotFound || (err == nil && !now.Before(ret.Expires)) {
+		return ret, ErrInvalidToken
+	}
+
+	return ret, err
+}
+
+// SessionAuth returns the user and session a session token belongs to, or
+// ErrInvalidToken. The session expiry is moved out to ttl from now, up to
+// the session's MaxExpires.
+func (db *Db) SessionAuth(token string, ttl time.Duration) (user data.User, ret data.Session, err error) {
+	defer db.metrics.observe("SessionAuth", time.Now(), &err)
+
+	now := time.Now()
+	expires := now.Add(ttl)
+
+	db.lock.RLock()
+	err = db.store.Get(hashKey(token), &ret)
+	if err == nil {
+		err = db.store.Get(ret.Username, &user)
+	}
+	db.lock.RUnlock()
+
+	if err == bolthold.ErrNotFound || (err == nil && !now.Before(ret.Expires)) {
+		return user, ret, ErrInvalidToken
+	} else if err != nil {
+		return user, ret, err
+	}
+
+	if expires.After(ret.MaxExpires) {
+		expires = ret.MaxExpires
+	}
+
+	// only write when the expiry moves enough to matter, so reads don't
+	// turn into writes
+	if expires.Sub(ret.Expires) < time.Minute {
+		return user, ret, nil
+	}
+
+	err = db.update(func(txn *Txn) error {
+		s, err := txn.session(token, now)
+		if err != nil {
+			return err
+		}
+
+		s.Expires = expires
+		ret = s
+		return txn.db.store.TxUpdate(txn.tx, s.ID, &s)
+	})
+
+	return user, ret, err
+}
+
+// SessionDelete ends a session
+func (db *Db) SessionDelete(token string) (err error) {
+	defer db.metrics.observe("SessionDelete", time.Now(), &err)
+
+	return db.update(func(txn *Txn) error {
+		err := txn.db.store.TxDelete(txn.tx, hashKey(token), data.Session{})
+		if err == bolthold.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// SessionRefresh replaces a session token with a new one. The old token
+// stops working, so a leaked token is only valid until the next refresh.
+// The new session keeps the MaxExpires of the old one.
+func (db *Db) SessionRefresh(token string, ttl time.Duration) (refreshed string, ret data.Session, err error) {
+	defer db.metrics.observe("SessionRefresh", time.Now(), &err)
+
+	refreshed, err = newToken()
+	if err != nil {
+		return "", ret, err
+	}
+
+	now := time.Now()
+
+	err = db.update(func(txn *Txn) error {
+		s, err := txn.session(token, now)
+		if err != nil {
+			return err
+		}
+
+		err = txn.db.store.TxDelete(txn.tx, s.ID, data.Session{})
+		if err != nil {
+			return err
+		}
+
+		s.ID = hashKey(refreshed)
+		s.Expires = now.Add(ttl)
+		if s.Expires.After(s.MaxExpires) {
+			s.Expires = s.MaxExpires
+		}
+
+		ret = s
+		return txn.db.store.TxInsert(txn.tx, s.ID, &s)
+	})
+
+	if err != nil {
+		return "", data.Session{}, err
+	}
+
+	return refreshed, ret, nil
+}
+
+// PasswordResetCreate creates a one time token that sets the password of
+// a user. It expires after ttl. Returns bolthold.ErrNotFound if the user
+// does not exist, and ErrExternalUser if it is managed by an identity
+// provider.
+func (db *Db) PasswordResetCreate(username string, ttl time.Duration) (token string, err error) {
+	defer db.metrics.observe("PasswordResetCreate", time.Now(), &err)
+
+	token, err = newToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = db.update(func(txn *Txn) error {
+		var user data.User
+		err := txn.db.store.TxGet(txn.tx, username, &user)
+		if err != nil {
+			return err
+		}
+
+		if user.Provider != "" {
+			return ErrExternalUser
+		}
+
+		return txn.db.store.TxInsert(txn.tx, hashKey(token), &data.PasswordReset{
+			ID:       hashKey(token),
+			Username: username,
+			Expires:  time.Now().Add(ttl),
+		})
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// PasswordReset sets the password of the user a reset token was created
+// for, and unlocks the account. Returns ErrInvalidToken if the token is
+// not valid.
+func (db *Db) PasswordReset(token, password string) (err error) {
+	defer db.metrics.observe("PasswordReset", time.Now(), &err)
+
+	err = data.ValidatePassword(password)
+	if err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return db.update(func(txn *Txn) error {
+		var reset data.PasswordReset
+		err := txn.db.store.TxGet(txn.tx, hashKey(token), &reset)
+		if err == bolthold.ErrNotFound ||
+			(err == nil && !time.Now().Before(reset.Expires)) {
+			return ErrInvalidToken
+		} else if err != nil {
+			return err
+		}
+
+		// also deletes the reset token
+		err = txn.userSetHash(reset.Username, hash)
+		if err == bolthold.ErrNotFound {
+			return ErrInvalidToken
+		}
+		return err
+	})
+}
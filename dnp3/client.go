@@ -0,0 +1,349 @@
+// Package dnp3 is a DNP3 master for polling outstations like RTUs and
+// protection relays over serial or TCP. It reads static values and events
+// by class with the link, transport, and application layers of IEEE 1815.
+// Controls, unsolicited reporting, and secure authentication are not
+// supported.
+package dnp3
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// application layer control bits and function codes
+const (
+	appFir          = 0x80
+	appFin          = 0x40
+	appCon          = 0x20
+	appUns          = 0x10
+	funcConfirm     = 0x00
+	funcRead        = 0x01
+	funcWrite       = 0x02
+	funcResponse    = 0x81
+	funcUnsolicited = 0x82
+	// iinRestart is set in the first IIN byte after the outstation
+	// restarts, until the master clears it
+	iinRestart = 0x80
+)
+
+// errTimeout is returned when an outstation does not respond
+var errTimeout = errors.New("dnp3 request timeout")
+
+// Config describes how to talk to an outstation
+type Config struct {
+	// Master is the link address of the client (default 1)
+	Master uint16
+	// Outstation is the link address of the outstation
+	Outstation uint16
+	// Timeout is how long the outstation has to respond (default 5s)
+	Timeout time.Duration
+}
+
+// deadliner is implemented by connections that support read deadlines
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// Client is a DNP3 master. It is safe to use from multiple goroutines,
+// and requests are sent one at a time.
+type Client struct {
+	lock     sync.Mutex
+	conn     io.ReadWriteCloser
+	config   Config
+	appSeq   byte
+	tranSeq  byte
+	pending  []byte
+	restarts int
+}
+
+// NewClient creates a client for an outstation on a connection, like a
+// serial port. Reads on the port should time out, so a missing response
+// does not block forever.
+func NewClient(conn io.ReadWriteCloser, config Config) *Client {
+	if config.Master == 0 {
+		config.Master = 1
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+
+	return &Client{conn: conn, config: config}
+}
+
+// DialTCP connects to an outstation. The port defaults to 20000.
+func DialTCP(address string, config Config) (*Client, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "20000")
+	}
+
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClient(conn, config), nil
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Restarts returns how many times the outstation reported a restart
+func (c *Client) Restarts() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.restarts
+}
+
+// Read reads the events in classes 1 to 3, and the static values of all
+// points for class 0. Events are returned before static values.
+func (c *Client) Read(classes ...int) ([]Point, error) {
+	if len(classes) == 0 {
+		return nil, errors.New("dnp3 classes are required")
+	}
+
+	var objs []byte
+	for _, class := range classes {
+		if class < 0 || class > 3 {
+			return nil, fmt.Errorf("invalid dnp3 class: %v", class)
+		}
+		// class 0 is g60v1, and classes 1 to 3 are g60v2 to g60v4, with
+		// the all objects qualifier
+		objs = append(objs, 60, byte(class+1), 0x06)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	points, iin, err := c.request(funcRead, objs)
+	if err != nil {
+		return points, err
+	}
+
+	if iin[0]&iinRestart != 0 {
+		c.restarts++
+		// clear the restart bit by writing 0 to IIN1.7 (g80v1 index 7)
+		_, _, err = c.request(funcWrite, []byte{80, 1, 0x00, 7, 7, 0})
+		if err != nil {
+			return points, fmt.Errorf("Error clearing dnp3 restart: %w", err)
+		}
+	}
+
+	return points, nil
+}
+
+// IntegrityPoll reads all events and static values
+func (c *Client) IntegrityPoll() ([]Point, error) {
+	return c.Read(1, 2, 3, 0)
+}
+
+// request sends an application request and returns the points and IIN of
+// the response, which can span multiple fragments
+func (c *Client) request(fc byte, objs []byte) ([]Point, [2]byte, error) {
+	var iin [2]byte
+
+	seq := c.appSeq & 0xf
+	c.appSeq++
+
+	err := c.send(append([]byte{appFir | appFin | seq, fc}, objs...))
+	if err != nil {
+		return nil, iin, err
+	}
+
+	var ret []Point
+	deadline := time.Now().Add(c.config.Timeout)
+	r := reassembler{}
+	matched := false
+
+	for {
+		f, err := c.readFrame(deadline)
+		if err != nil {
+			return ret, iin, err
+		}
+
+		if f.src != c.config.Outstation || f.dest != c.config.Master {
+			continue
+		}
+
+		switch {
+		case f.control&linkPrm == 0:
+			// secondary frames like acks are not used
+			continue
+		case f.function() == linkRequestStatus:
+			err := c.writeFrame(frame{control: linkDir | linkStatus}, nil)
+			if err != nil {
+				return ret, iin, err
+			}
+			continue
+		case f.function() == linkConfirmedData:
+			err := c.writeFrame(frame{control: linkDir}, nil)
+			if err != nil {
+				return ret, iin, err
+			}
+		case f.function() != linkUnconfirmedData:
+			continue
+		}
+
+		fragment, err := r.add(f.data)
+		if err != nil {
+			return ret, iin, err
+		}
+
+		if fragment == nil {
+			continue
+		}
+
+		if len(fragment) < 4 {
+			return ret, iin, errors.New("dnp3 response too short")
+		}
+
+		ac, rfc := fragment[0], fragment[1]
+
+		if rfc == funcUnsolicited {
+			// unsolicited responses are confirmed so the outstation
+			// does not retry them, but are otherwise ignored
+			if ac&appCon != 0 {
+				err := c.send([]byte{appFir | appFin | appUns | ac&0xf, funcConfirm})
+				if err != nil {
+					return ret, iin, err
+				}
+			}
+			continue
+		}
+
+		if rfc != funcResponse {
+			continue
+		}
+
+		// the first fragment has the sequence number of the request, and
+		// fragments of responses to earlier requests are skipped
+		if ac&appFir != 0 {
+			matched = ac&0xf == seq
+		}
+
+		if !matched {
+			continue
+		}
+
+		// bits set in any fragment are kept
+		iin[0] |= fragment[2]
+		iin[1] |= fragment[3]
+
+		points, err := parseObjects(fragment[4:])
+		ret = append(ret, points...)
+		if err != nil {
+			return ret, iin, err
+		}
+
+		if ac&appCon != 0 {
+			err := c.send([]byte{appFir | appFin | ac&0xf, funcConfirm})
+			if err != nil {
+				return ret, iin, err
+			}
+		}
+
+		if ac&appFin != 0 {
+			return ret, iin, nil
+		}
+
+		deadline = time.Now().Add(c.config.Timeout)
+	}
+}
+
+// send sends an application fragment to the outstation
+func (c *Client) send(fragment []byte) error {
+	for _, s := range segments(fragment, &c.tranSeq) {
+		err := c.writeFrame(frame{control: linkDir | linkPrm | linkUnconfirmedData}, s)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) writeFrame(f frame, data []byte) error {
+	f.dest = c.config.Outstation
+	f.src = c.config.Master
+	f.data = data
+	_, err := c.conn.Write(f.encode())
+	return err
+}
+
+// readFull reads len(b) bytes before the deadline. Bytes left from an
+// earlier read are used first.
+func (c *Client) readFull(b []byte, deadline time.Time) error {
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+
+	if d, ok := c.conn.(deadliner); ok {
+		d.SetReadDeadline(deadline)
+	}
+
+	for n < len(b) {
+		m, err := c.conn.Read(b[n:])
+		n += m
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return errTimeout
+			}
+			return err
+		}
+
+		// serial ports return no data when the read times out
+		if m == 0 && time.Now().After(deadline) {
+			return errTimeout
+		}
+	}
+
+	return nil
+}
+
+// readFrame reads the next valid frame. Bytes before a frame, and frames
+// with CRC errors, are skipped.
+func (c *Client) readFrame(deadline time.Time) (frame, error) {
+	head := make([]byte, linkHeaderSize)
+
+	for {
+		err := c.readFull(head, deadline)
+		if err != nil {
+			return frame{}, err
+		}
+
+		size, err := checkHeader(head)
+		if err != nil {
+			// resync on the next start byte
+			for i := 1; i < len(head); i++ {
+				if head[i] == 0x05 {
+					c.pending = append(append([]byte{}, head[i:]...), c.pending...)
+					break
+				}
+			}
+			continue
+		}
+
+		blocks := make([]byte, size)
+		err = c.readFull(blocks, deadline)
+		if err != nil {
+			return frame{}, err
+		}
+
+		f, err := decodeFrame(head, blocks)
+		if err != nil {
+			continue
+		}
+
+		return f, nil
+	}
+}
@@ -0,0 +1,364 @@
+package dnp3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCRC16(t *testing.T) {
+	// reset link states from master 1 to outstation 4
+	crc := CRC16([]byte{0x05, 0x64, 0x05, 0xc0, 0x01, 0x00, 0x00, 0x04})
+	if crc != 0x21e9 {
+		t.Errorf("wrong crc: 0x%x", crc)
+	}
+}
+
+func TestFrame(t *testing.T) {
+	data := make([]byte, 40)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	f := frame{control: 0xc4, dest: 10, src: 1, data: data}
+	b := f.encode()
+
+	// header, and 16, 16, and 8 byte blocks with CRCs
+	if len(b) != 10+18+18+10 {
+		t.Fatal("wrong frame length: ", len(b))
+	}
+
+	size, err := checkHeader(b[:10])
+	if err != nil || size != len(b)-10 {
+		t.Fatalf("wrong size %v: %v", size, err)
+	}
+
+	d, err := decodeFrame(b[:10], b[10:])
+	if err != nil {
+		t.Fatal("Error decoding frame: ", err)
+	}
+
+	if !reflect.DeepEqual(d, f) {
+		t.Errorf("wrong frame: %+v", d)
+	}
+
+	b[20]++
+	_, err = decodeFrame(b[:10], b[10:])
+	if err == nil {
+		t.Error("expected CRC error")
+	}
+}
+
+func TestSegments(t *testing.T) {
+	fragment := make([]byte, 600)
+	for i := range fragment {
+		fragment[i] = byte(i)
+	}
+
+	seq := byte(62)
+	segs := segments(fragment, &seq)
+	if len(segs) != 3 || segs[0][0] != transportFir|62 || segs[1][0] != 63 ||
+		segs[2][0] != transportFin|0 {
+		t.Fatalf("wrong segments: %v", len(segs))
+	}
+
+	r := reassembler{}
+	var ret []byte
+	for _, s := range segs {
+		var err error
+		ret, err = r.add(s)
+		if err != nil {
+			t.Fatal("Error adding segment: ", err)
+		}
+	}
+
+	if !bytes.Equal(ret, fragment) {
+		t.Error("wrong fragment")
+	}
+
+	// a missing segment drops the fragment
+	r = reassembler{}
+	r.add(segs[0])
+	if ret, _ := r.add(segs[2]); ret != nil {
+		t.Error("fragment should be dropped")
+	}
+}
+
+func le16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return b
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func TestParseObjects(t *testing.T) {
+	ts := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	ms := uint64(ts.UnixNano() / int64(time.Millisecond))
+	dt := append(le32(uint32(ms)), le16(uint16(ms>>32))...)
+
+	var b []byte
+	// g1v2 binary inputs 0-1, start/stop
+	b = append(b, 1, 2, 0x00, 0, 1, 0x81, 0x01)
+	// g1v1 packed binary inputs 8-10
+	b = append(b, 1, 1, 0x00, 8, 10, 0x05)
+	// g30v1 analog inputs 3-4
+	b = append(b, 30, 1, 0x01)
+	b = append(b, le16(3)...)
+	b = append(b, le16(4)...)
+	b = append(b, 0x01)
+	b = append(b, le32(uint32(0xfffffff6))...)
+	b = append(b, 0x01)
+	b = append(b, le32(1234)...)
+	// g30v5 float analog input 5, count with no prefix is not valid in a
+	// response, so a range is used
+	b = append(b, 30, 5, 0x00, 5, 5, 0x01)
+	b = append(b, le32(math.Float32bits(21.5))...)
+	// g20v5 counter 2 without flags
+	b = append(b, 20, 5, 0x00, 2, 2)
+	b = append(b, le32(99)...)
+	// g51v1 common time of occurrence is skipped
+	b = append(b, 51, 1, 0x07, 1)
+	b = append(b, dt...)
+	// g32v3 analog event with time at index 7, with a 2 byte prefix
+	b = append(b, 32, 3, 0x28)
+	b = append(b, le16(1)...)
+	b = append(b, le16(7)...)
+	b = append(b, 0x01)
+	b = append(b, le32(55)...)
+	b = append(b, dt...)
+	// g2v1 binary input event at index 1, 1 byte prefix, off and not online
+	b = append(b, 2, 1, 0x17, 1, 1, 0x00)
+
+	points, err := parseObjects(b)
+	if err != nil {
+		t.Fatal("Error parsing objects: ", err)
+	}
+
+	exp := []Point{
+		{Type: BinaryInput, Index: 0, Value: 1, Flags: 0x81},
+		{Type: BinaryInput, Index: 1, Value: 0, Flags: 0x01},
+		{Type: BinaryInput, Index: 8, Value: 1, Flags: FlagOnline},
+		{Type: BinaryInput, Index: 9, Value: 0, Flags: FlagOnline},
+		{Type: BinaryInput, Index: 10, Value: 1, Flags: FlagOnline},
+		{Type: AnalogInput, Index: 3, Value: -10, Flags: 0x01},
+		{Type: AnalogInput, Index: 4, Value: 1234, Flags: 0x01},
+		{Type: AnalogInput, Index: 5, Value: 21.5, Flags: 0x01},
+		{Type: Counter, Index: 2, Value: 99, Flags: FlagOnline},
+		{Type: AnalogInput, Index: 7, Value: 55, Flags: 0x01, Time: ts,
+			Event: true},
+		{Type: BinaryInput, Index: 1, Value: 0, Flags: 0x00, Event: true},
+	}
+
+	if len(points) != len(exp) {
+		t.Fatalf("wrong points: %+v", points)
+	}
+
+	for i := range exp {
+		if !points[i].Time.Equal(exp[i].Time) {
+			t.Errorf("wrong time %v: %v", i, points[i].Time)
+		}
+		points[i].Time = exp[i].Time
+		if points[i] != exp[i] {
+			t.Errorf("wrong point %v: %+v", i, points[i])
+		}
+	}
+
+	if points[10].Online() {
+		t.Error("point should be offline")
+	}
+
+	_, err = parseObjects([]byte{99, 1, 0x06})
+	if err == nil {
+		t.Error("expected error for unsupported object")
+	}
+
+	_, err = parseObjects([]byte{30, 1, 0x00, 0, 3, 0x01})
+	if err != errShort {
+		t.Error("expected short error: ", err)
+	}
+}
+
+// outstation is a fake outstation that answers reads with fragments, and
+// records the requests it gets
+type outstation struct {
+	conn      net.Conn
+	responses [][]byte
+	requests  chan []byte
+	seq       byte
+}
+
+func (o *outstation) readFragment() ([]byte, error) {
+	r := reassembler{}
+	for {
+		head := make([]byte, linkHeaderSize)
+		_, err := readAll(o.conn, head)
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := checkHeader(head)
+		if err != nil {
+			return nil, err
+		}
+
+		blocks := make([]byte, size)
+		_, err = readAll(o.conn, blocks)
+		if err != nil {
+			return nil, err
+		}
+
+		f, err := decodeFrame(head, blocks)
+		if err != nil {
+			return nil, err
+		}
+
+		fragment, err := r.add(f.data)
+		if err != nil || fragment != nil {
+			return fragment, err
+		}
+	}
+}
+
+func readAll(c net.Conn, b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		m, err := c.Read(b[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (o *outstation) send(fragment []byte) {
+	for _, s := range segments(fragment, &o.seq) {
+		f := frame{control: linkPrm | linkUnconfirmedData, dest: 1, src: 10,
+			data: s}
+		o.conn.Write(f.encode())
+	}
+}
+
+func (o *outstation) run() {
+	for {
+		req, err := o.readFragment()
+		if err != nil {
+			return
+		}
+
+		o.requests <- req
+
+		if req[1] != funcRead && req[1] != funcWrite {
+			continue
+		}
+
+		seq := req[0] & 0xf
+		if req[1] == funcWrite {
+			o.send([]byte{appFir | appFin | seq, funcResponse, 0, 0})
+			continue
+		}
+
+		for i, r := range o.responses {
+			ac := seq
+			if i == 0 {
+				ac |= appFir
+			}
+			if i == len(o.responses)-1 {
+				ac |= appFin
+			} else {
+				ac |= appCon
+			}
+			o.send(append([]byte{ac, funcResponse}, r...))
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening: ", err)
+	}
+	defer l.Close()
+
+	a, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Error connecting: ", err)
+	}
+
+	b, err := l.Accept()
+	if err != nil {
+		t.Fatal("Error accepting: ", err)
+	}
+	defer b.Close()
+
+	o := &outstation{
+		conn: b,
+		responses: [][]byte{
+			// restart IIN, and an event in the first fragment
+			append([]byte{iinRestart, 0, 32, 1, 0x17, 1, 4, 0x01},
+				le32(7)...),
+			append([]byte{0, 0, 30, 2, 0x00, 0, 0, 0x01}, le16(300)...),
+		},
+		requests: make(chan []byte, 10),
+	}
+	go o.run()
+
+	c := NewClient(a, Config{Outstation: 10, Timeout: time.Second})
+	defer c.Close()
+
+	points, err := c.IntegrityPoll()
+	if err != nil {
+		t.Fatal("Error polling: ", err)
+	}
+
+	exp := []Point{
+		{Type: AnalogInput, Index: 4, Value: 7, Flags: 0x01, Event: true},
+		{Type: AnalogInput, Index: 0, Value: 300, Flags: 0x01},
+	}
+
+	if !reflect.DeepEqual(points, exp) {
+		t.Errorf("wrong points: %+v", points)
+	}
+
+	read := <-o.requests
+	if !bytes.Equal(read[1:], []byte{funcRead, 60, 2, 0x06, 60, 3, 0x06,
+		60, 4, 0x06, 60, 1, 0x06}) {
+		t.Errorf("wrong read request: % x", read)
+	}
+
+	// the first fragment asked for a confirm
+	confirm := <-o.requests
+	if confirm[1] != funcConfirm || confirm[0]&0xf != read[0]&0xf {
+		t.Errorf("wrong confirm: % x", confirm)
+	}
+
+	write := <-o.requests
+	if !bytes.Equal(write[1:], []byte{funcWrite, 80, 1, 0x00, 7, 7, 0}) {
+		t.Errorf("restart was not cleared: % x", write)
+	}
+
+	if c.Restarts() != 1 {
+		t.Error("wrong restarts: ", c.Restarts())
+	}
+
+	_, err = c.Read(4)
+	if err == nil {
+		t.Error("expected error for invalid class")
+	}
+
+	// the outstation is gone
+	b.Close()
+	_, err = c.Read(0)
+	if err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,195 @@
+package dnp3
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// link layer function codes
+const (
+	linkUnconfirmedData  = 4
+	linkRequestStatus    = 9
+	linkStatus           = 11
+	linkConfirmedData    = 3
+	linkDir              = 0x80
+	linkPrm              = 0x40
+	linkHeaderSize       = 10
+	linkBlockSize        = 16
+	linkMaxUserData      = 250
+	transportFin         = 0x80
+	transportFir         = 0x40
+	transportMaxSegments = 249
+)
+
+// CRC16 returns the DNP3 CRC of data, which is sent low byte first after
+// the link header and each block of user data
+func CRC16(data []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa6bc
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return ^crc
+}
+
+func appendCRC(b []byte, data []byte) []byte {
+	crc := CRC16(data)
+	return append(b, byte(crc), byte(crc>>8))
+}
+
+// frame is a link layer frame
+type frame struct {
+	control byte
+	dest    uint16
+	src     uint16
+	data    []byte
+}
+
+func (f frame) function() byte {
+	return f.control & 0xf
+}
+
+// encode returns the frame with its CRCs. data must be at most
+// linkMaxUserData bytes.
+func (f frame) encode() []byte {
+	head := []byte{0x05, 0x64, byte(5 + len(f.data)), f.control, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(head[4:], f.dest)
+	binary.LittleEndian.PutUint16(head[6:], f.src)
+
+	ret := appendCRC(head, head)
+	for i := 0; i < len(f.data); i += linkBlockSize {
+		end := i + linkBlockSize
+		if end > len(f.data) {
+			end = len(f.data)
+		}
+		ret = append(ret, f.data[i:end]...)
+		ret = appendCRC(ret, f.data[i:end])
+	}
+
+	return ret
+}
+
+// checkHeader checks the CRC of a link header and returns the size of the
+// rest of the frame
+func checkHeader(head []byte) (int, error) {
+	if head[0] != 0x05 || head[1] != 0x64 {
+		return 0, errors.New("invalid dnp3 start bytes")
+	}
+
+	if CRC16(head[:8]) != binary.LittleEndian.Uint16(head[8:]) {
+		return 0, errors.New("dnp3 header CRC check failed")
+	}
+
+	if head[2] < 5 {
+		return 0, fmt.Errorf("invalid dnp3 frame length: %v", head[2])
+	}
+
+	n := int(head[2]) - 5
+	return n + (n+linkBlockSize-1)/linkBlockSize*2, nil
+}
+
+// decodeFrame decodes a frame from its header and the blocks that follow
+func decodeFrame(head, blocks []byte) (frame, error) {
+	f := frame{
+		control: head[3],
+		dest:    binary.LittleEndian.Uint16(head[4:]),
+		src:     binary.LittleEndian.Uint16(head[6:]),
+	}
+
+	for len(blocks) > 0 {
+		n := len(blocks) - 2
+		if n > linkBlockSize {
+			n = linkBlockSize
+		}
+
+		if n <= 0 {
+			return f, errors.New("dnp3 frame too short")
+		}
+
+		if CRC16(blocks[:n]) != binary.LittleEndian.Uint16(blocks[n:]) {
+			return f, errors.New("dnp3 data CRC check failed")
+		}
+
+		f.data = append(f.data, blocks[:n]...)
+		blocks = blocks[n+2:]
+	}
+
+	return f, nil
+}
+
+// segments splits an application fragment into transport segments
+func segments(fragment []byte, seq *byte) [][]byte {
+	var ret [][]byte
+	max := linkMaxUserData - 1
+
+	for i := 0; i < len(fragment) || i == 0; i += max {
+		end := i + max
+		if end > len(fragment) {
+			end = len(fragment)
+		}
+
+		th := *seq & 0x3f
+		*seq++
+		if i == 0 {
+			th |= transportFir
+		}
+		if end == len(fragment) {
+			th |= transportFin
+		}
+
+		ret = append(ret, append([]byte{th}, fragment[i:end]...))
+		if end == len(fragment) {
+			break
+		}
+	}
+
+	return ret
+}
+
+// reassembler collects transport segments into an application fragment
+type reassembler struct {
+	buf     []byte
+	started bool
+	seq     byte
+}
+
+// add adds a segment, and returns the fragment once it is complete
+func (r *reassembler) add(segment []byte) ([]byte, error) {
+	if len(segment) < 1 {
+		return nil, errors.New("empty dnp3 transport segment")
+	}
+
+	th := segment[0]
+	seq := th & 0x3f
+
+	if th&transportFir != 0 {
+		r.buf = nil
+		r.started = true
+	} else if !r.started || seq != (r.seq+1)&0x3f {
+		// segments out of order are discarded, along with the fragment
+		r.started = false
+		return nil, nil
+	}
+
+	r.seq = seq
+	r.buf = append(r.buf, segment[1:]...)
+
+	if len(r.buf) > linkMaxUserData*transportMaxSegments {
+		r.started = false
+		return nil, errors.New("dnp3 fragment too large")
+	}
+
+	if th&transportFin == 0 {
+		return nil, nil
+	}
+
+	r.started = false
+	return r.buf, nil
+}
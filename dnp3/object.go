@@ -0,0 +1,394 @@
+package dnp3
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// PointType is the type of a point in an outstation
+type PointType string
+
+// define the point types. The names match data.Dnp3Point.Object.
+const (
+	BinaryInput   PointType = "binaryInput"
+	BinaryOutput  PointType = "binaryOutput"
+	Counter       PointType = "counter"
+	FrozenCounter PointType = "frozenCounter"
+	AnalogInput   PointType = "analogInput"
+	AnalogOutput  PointType = "analogOutput"
+)
+
+// FlagOnline is set in the flags of a point when it is being read
+// normally by the outstation
+const FlagOnline = 0x01
+
+// Point is a static value or event read from an outstation
+type Point struct {
+	Type  PointType
+	Index int
+	Value float64
+	// Flags are the quality flags, or FlagOnline for objects without
+	// flags
+	Flags byte
+	// Time is only set for events the outstation timestamped
+	Time time.Time
+	// Event is true if the value is a change event rather than the
+	// current value
+	Event bool
+}
+
+// Online returns true if the point is online
+func (p Point) Online() bool {
+	return p.Flags&FlagOnline != 0
+}
+
+// value kinds
+const (
+	kindBit = iota
+	kindInt16
+	kindUint16
+	kindInt32
+	kindUint32
+	kindFloat32
+	kindFloat64
+)
+
+// objectFormat is the layout of an object: flags, then the value, then a
+// time
+type objectFormat struct {
+	kind  int
+	flags bool
+	// time is 6 for an absolute time, 2 for a time relative to a common
+	// time of occurrence, which is not supported, and 0 for none
+	time int
+}
+
+func (f objectFormat) size() int {
+	size := f.time
+	if f.flags {
+		size++
+	}
+
+	switch f.kind {
+	case kindInt16, kindUint16:
+		size += 2
+	case kindInt32, kindUint32, kindFloat32:
+		size += 4
+	case kindFloat64:
+		size += 8
+	}
+
+	return size
+}
+
+// decode returns the value, flags, and time of an object
+func (f objectFormat) decode(b []byte) (float64, byte, time.Time) {
+	flags := byte(FlagOnline)
+	if f.flags {
+		flags = b[0]
+		b = b[1:]
+	}
+
+	var v float64
+	n := 0
+	switch f.kind {
+	case kindBit:
+		v = float64(flags >> 7)
+	case kindInt16:
+		v, n = float64(int16(binary.LittleEndian.Uint16(b))), 2
+	case kindUint16:
+		v, n = float64(binary.LittleEndian.Uint16(b)), 2
+	case kindInt32:
+		v, n = float64(int32(binary.LittleEndian.Uint32(b))), 4
+	case kindUint32:
+		v, n = float64(binary.LittleEndian.Uint32(b)), 4
+	case kindFloat32:
+		v, n = float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), 4
+	case kindFloat64:
+		v, n = math.Float64frombits(binary.LittleEndian.Uint64(b)), 8
+	}
+
+	var t time.Time
+	if f.time == 6 {
+		t = dnp3Time(b[n:])
+	}
+
+	return v, flags, t
+}
+
+// dnp3Time decodes a 48 bit time in milliseconds since the unix epoch
+func dnp3Time(b []byte) time.Time {
+	ms := uint64(binary.LittleEndian.Uint32(b)) | uint64(binary.LittleEndian.Uint16(b[4:]))<<32
+	return time.Unix(0, int64(ms)*int64(time.Millisecond))
+}
+
+type objectType struct {
+	group, variation byte
+}
+
+// objectInfo describes an object the client can decode
+type objectInfo struct {
+	point  PointType
+	event  bool
+	format objectFormat
+	// packed objects are single bits, without flags
+	packed bool
+}
+
+var (
+	bit       = objectFormat{kind: kindBit, flags: true}
+	bitTime   = objectFormat{kind: kindBit, flags: true, time: 6}
+	bitRel    = objectFormat{kind: kindBit, flags: true, time: 2}
+	u32       = objectFormat{kind: kindUint32, flags: true}
+	u16       = objectFormat{kind: kindUint16, flags: true}
+	u32Time   = objectFormat{kind: kindUint32, flags: true, time: 6}
+	u16Time   = objectFormat{kind: kindUint16, flags: true, time: 6}
+	i32       = objectFormat{kind: kindInt32, flags: true}
+	i16       = objectFormat{kind: kindInt16, flags: true}
+	i32Time   = objectFormat{kind: kindInt32, flags: true, time: 6}
+	i16Time   = objectFormat{kind: kindInt16, flags: true, time: 6}
+	f32       = objectFormat{kind: kindFloat32, flags: true}
+	f64       = objectFormat{kind: kindFloat64, flags: true}
+	f32Time   = objectFormat{kind: kindFloat32, flags: true, time: 6}
+	f64Time   = objectFormat{kind: kindFloat64, flags: true, time: 6}
+	u32NoFlag = objectFormat{kind: kindUint32}
+	u16NoFlag = objectFormat{kind: kindUint16}
+	i32NoFlag = objectFormat{kind: kindInt32}
+	i16NoFlag = objectFormat{kind: kindInt16}
+)
+
+var objects = map[objectType]objectInfo{
+	{1, 1}:   {point: BinaryInput, packed: true},
+	{1, 2}:   {point: BinaryInput, format: bit},
+	{2, 1}:   {point: BinaryInput, event: true, format: bit},
+	{2, 2}:   {point: BinaryInput, event: true, format: bitTime},
+	{2, 3}:   {point: BinaryInput, event: true, format: bitRel},
+	{10, 1}:  {point: BinaryOutput, packed: true},
+	{10, 2}:  {point: BinaryOutput, format: bit},
+	{11, 1}:  {point: BinaryOutput, event: true, format: bit},
+	{11, 2}:  {point: BinaryOutput, event: true, format: bitTime},
+	{20, 1}:  {point: Counter, format: u32},
+	{20, 2}:  {point: Counter, format: u16},
+	{20, 5}:  {point: Counter, format: u32NoFlag},
+	{20, 6}:  {point: Counter, format: u16NoFlag},
+	{21, 1}:  {point: FrozenCounter, format: u32},
+	{21, 2}:  {point: FrozenCounter, format: u16},
+	{21, 5}:  {point: FrozenCounter, format: u32Time},
+	{21, 6}:  {point: FrozenCounter, format: u16Time},
+	{21, 9}:  {point: FrozenCounter, format: u32NoFlag},
+	{21, 10}: {point: FrozenCounter, format: u16NoFlag},
+	{22, 1}:  {point: Counter, event: true, format: u32},
+	{22, 2}:  {point: Counter, event: true, format: u16},
+	{22, 5}:  {point: Counter, event: true, format: u32Time},
+	{22, 6}:  {point: Counter, event: true, format: u16Time},
+	{23, 1}:  {point: FrozenCounter, event: true, format: u32},
+	{23, 2}:  {point: FrozenCounter, event: true, format: u16},
+	{23, 5}:  {point: FrozenCounter, event: true, format: u32Time},
+	{23, 6}:  {point: FrozenCounter, event: true, format: u16Time},
+	{30, 1}:  {point: AnalogInput, format: i32},
+	{30, 2}:  {point: AnalogInput, format: i16},
+	{30, 3}:  {point: AnalogInput, format: i32NoFlag},
+	{30, 4}:  {point: AnalogInput, format: i16NoFlag},
+	{30, 5}:  {point: AnalogInput, format: f32},
+	{30, 6}:  {point: AnalogInput, format: f64},
+	{32, 1}:  {point: AnalogInput, event: true, format: i32},
+	{32, 2}:  {point: AnalogInput, event: true, format: i16},
+	{32, 3}:  {point: AnalogInput, event: true, format: i32Time},
+	{32, 4}:  {point: AnalogInput, event: true, format: i16Time},
+	{32, 5}:  {point: AnalogInput, event: true, format: f32},
+	{32, 6}:  {point: AnalogInput, event: true, format: f64},
+	{32, 7}:  {point: AnalogInput, event: true, format: f32Time},
+	{32, 8}:  {point: AnalogInput, event: true, format: f64Time},
+	{40, 1}:  {point: AnalogOutput, format: i32},
+	{40, 2}:  {point: AnalogOutput, format: i16},
+	{40, 3}:  {point: AnalogOutput, format: f32},
+	{40, 4}:  {point: AnalogOutput, format: f64},
+	{42, 1}:  {point: AnalogOutput, event: true, format: i32},
+	{42, 2}:  {point: AnalogOutput, event: true, format: i16},
+	{42, 3}:  {point: AnalogOutput, event: true, format: i32Time},
+	{42, 4}:  {point: AnalogOutput, event: true, format: i16Time},
+	{42, 5}:  {point: AnalogOutput, event: true, format: f32},
+	{42, 6}:  {point: AnalogOutput, event: true, format: f64},
+	{42, 7}:  {point: AnalogOutput, event: true, format: f32Time},
+	{42, 8}:  {point: AnalogOutput, event: true, format: f64Time},
+}
+
+// objects that carry no points, but can be in a response
+var skipObjects = map[objectType]int{
+	// time and date
+	{50, 1}: 6,
+	// common time of occurrence
+	{51, 1}: 6,
+	{51, 2}: 6,
+}
+
+// errShort is returned when a response ends in the middle of an object
+var errShort = fmt.Errorf("dnp3 response too short")
+
+// readUint reads a little endian number of size bytes
+func readUint(b []byte, size int) (int, []byte, error) {
+	if len(b) < size {
+		return 0, nil, errShort
+	}
+
+	switch size {
+	case 1:
+		return int(b[0]), b[1:], nil
+	case 2:
+		return int(binary.LittleEndian.Uint16(b)), b[2:], nil
+	default:
+		return int(binary.LittleEndian.Uint32(b)), b[4:], nil
+	}
+}
+
+// qualifierSizes returns the size of the index prefix and the range field
+// of a qualifier. start/stop ranges are returned as a negative size.
+func qualifierSizes(q byte) (prefix, rng int, err error) {
+	switch (q >> 4) & 0x7 {
+	case 0:
+	case 1:
+		prefix = 1
+	case 2:
+		prefix = 2
+	case 3:
+		prefix = 4
+	default:
+		return 0, 0, fmt.Errorf("unsupported dnp3 qualifier: 0x%02x", q)
+	}
+
+	switch q & 0xf {
+	case 0:
+		rng = -1
+	case 1:
+		rng = -2
+	case 2:
+		rng = -4
+	case 7:
+		rng = 1
+	case 8:
+		rng = 2
+	case 9:
+		rng = 4
+	default:
+		return 0, 0, fmt.Errorf("unsupported dnp3 qualifier: 0x%02x", q)
+	}
+
+	if prefix != 0 && rng < 0 {
+		return 0, 0, fmt.Errorf("unsupported dnp3 qualifier: 0x%02x", q)
+	}
+
+	return prefix, rng, nil
+}
+
+// parseObjects decodes the objects in a response
+func parseObjects(b []byte) ([]Point, error) {
+	var ret []Point
+
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return ret, errShort
+		}
+
+		typ := objectType{b[0], b[1]}
+		prefix, rng, err := qualifierSizes(b[2])
+		if err != nil {
+			return ret, err
+		}
+		b = b[3:]
+
+		// indexes are start..start+count-1 unless they are prefixed
+		var start, count int
+		if rng < 0 {
+			var stop int
+			start, b, err = readUint(b, -rng)
+			if err != nil {
+				return ret, err
+			}
+			stop, b, err = readUint(b, -rng)
+			if err != nil {
+				return ret, err
+			}
+			if stop < start {
+				return ret, fmt.Errorf("invalid dnp3 range %v-%v", start, stop)
+			}
+			count = stop - start + 1
+		} else {
+			count, b, err = readUint(b, rng)
+			if err != nil {
+				return ret, err
+			}
+		}
+
+		info, ok := objects[typ]
+
+		if !ok {
+			size, ok := skipObjects[typ]
+			if !ok {
+				return ret, fmt.Errorf("unsupported dnp3 object g%vv%v",
+					typ.group, typ.variation)
+			}
+
+			n := count * (prefix + size)
+			if len(b) < n {
+				return ret, errShort
+			}
+			b = b[n:]
+			continue
+		}
+
+		if info.packed {
+			if prefix != 0 {
+				return ret, fmt.Errorf("unsupported dnp3 qualifier for g%vv%v",
+					typ.group, typ.variation)
+			}
+
+			n := (count + 7) / 8
+			if len(b) < n {
+				return ret, errShort
+			}
+
+			for i := 0; i < count; i++ {
+				ret = append(ret, Point{
+					Type:  info.point,
+					Index: start + i,
+					Value: float64((b[i/8] >> uint(i%8)) & 1),
+					Flags: FlagOnline,
+				})
+			}
+
+			b = b[n:]
+			continue
+		}
+
+		size := info.format.size()
+		for i := 0; i < count; i++ {
+			index := start + i
+			if prefix != 0 {
+				index, b, err = readUint(b, prefix)
+				if err != nil {
+					return ret, err
+				}
+			}
+
+			if len(b) < size {
+				return ret, errShort
+			}
+
+			v, flags, t := info.format.decode(b)
+			ret = append(ret, Point{
+				Type:  info.point,
+				Index: index,
+				Value: v,
+				Flags: flags,
+				Time:  t,
+				Event: info.event,
+			})
+
+			b = b[size:]
+		}
+	}
+
+	return ret, nil
+}
@@ -12,8 +12,9 @@ require (
 	github.com/jacobsa/go-serial v0.0.0-20180131005756-15cf729a72d4
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/timshannon/bolthold v0.0.0-20180829183128-83840edea944
-	go.etcd.io/bbolt v1.3.0 // indirect
-	golang.org/x/sys v0.0.0-20181206074257-70b957f3b65e // indirect
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/sys v0.0.0-20200202164722-d101bd2416d5
 )
 
 go 1.13
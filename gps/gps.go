@@ -10,6 +10,7 @@ import (
 	nmea "github.com/adrianmo/go-nmea"
 	"github.com/jacobsa/go-serial/serial"
 	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/system"
 )
 
 // Gps represent a GPS receiver
@@ -22,7 +23,8 @@ type Gps struct {
 	port     io.ReadWriteCloser
 }
 
-// NewGps is used to create a new Gps type
+// NewGps is used to create a new Gps type. portName can be a device or a
+// USB spec (see system.ResolveSerialPort).
 func NewGps(portName string, baud uint, c chan data.GpsPos) *Gps {
 	return &Gps{
 		portName: portName,
@@ -48,7 +50,6 @@ func (gps *Gps) Start() {
 	gps.stop = false
 	go func() {
 		options := serial.OpenOptions{
-			PortName:              gps.portName,
 			BaudRate:              gps.baud,
 			DataBits:              8,
 			StopBits:              1,
@@ -57,11 +58,15 @@ func (gps *Gps) Start() {
 		}
 		for {
 			var err error
-			gps.port, err = serial.Open(options)
+			// the device can change if the receiver is plugged in again
+			options.PortName, err = system.ResolveSerialPort(gps.portName)
+			if err == nil {
+				gps.port, err = serial.Open(options)
+			}
 
 			if err != nil {
 				if gps.debug {
-					fmt.Println("failed to open port: ", options.PortName)
+					fmt.Println("failed to open port: ", gps.portName)
 				}
 				// delay a bit before trying to open port again
 				time.Sleep(10 * time.Second)
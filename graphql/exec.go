@@ -0,0 +1,393 @@
+// Package graphql executes read only GraphQL queries against a schema of
+// resolver functions. It supports the query language features dashboards
+// use: variables, aliases, fragments, and the skip and include directives.
+// Types are not checked before a query runs, so argument values are
+// checked by the resolvers, and introspection is not supported.
+package graphql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Object is a GraphQL object type
+type Object struct {
+	Name   string
+	Fields map[string]*Field
+}
+
+// Field is a field of an object type
+type Field struct {
+	// Type is the object type of the value, or nil if the value is a
+	// scalar that is encoded as JSON. A slice value is a list of Type.
+	Type *Object
+	// Args are the names of the arguments the field accepts
+	Args []string
+	// Resolve returns the value of the field for source, which is the
+	// value of the parent object, or nil for query fields. A nil value is
+	// returned as null.
+	Resolve func(source interface{}, args Args) (interface{}, error)
+}
+
+// Args are the arguments of a field, with the variables replaced. Ints are
+// int64 and floats are float64, and enums are strings.
+type Args map[string]interface{}
+
+// String returns a string argument, or "" if it is not set
+func (a Args) String(name string) (string, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	default:
+		return "", fmt.Errorf("argument %v must be a string", name)
+	}
+}
+
+// Int returns an int argument, or 0 if it is not set
+func (a Args) Int(name string) (int, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return int(v), nil
+	case float64:
+		// JSON variables are decoded as floats
+		if v == float64(int(v)) {
+			return int(v), nil
+		}
+	}
+	return 0, fmt.Errorf("argument %v must be an int", name)
+}
+
+// Schema is a read only GraphQL schema. Mutations and subscriptions are
+// not supported.
+type Schema struct {
+	Query *Object
+}
+
+// Request is a GraphQL request in the standard JSON format
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// Response is a GraphQL response. Data is nil if the request could not be
+// executed, like for a syntax error.
+type Response struct {
+	Data   interface{} `json:"data,omitempty"`
+	Errors []Error     `json:"errors,omitempty"`
+}
+
+// Error is an error in a response. Path is the response path of the field
+// that failed.
+type Error struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// object is a result object, which keeps the order of the fields
+type object []objectField
+
+type objectField struct {
+	key   string
+	value interface{}
+}
+
+func (o object) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(f.key)
+		b.Write(k)
+		b.WriteByte(':')
+		v, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// requestError is an error that stops the request, like a query for a
+// field that does not exist
+type requestError struct {
+	msg string
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+type execution struct {
+	doc    *document
+	vars   map[string]interface{}
+	errors []Error
+}
+
+// Execute runs a query
+func (s *Schema) Execute(r Request) Response {
+	doc, err := parse(r.Query)
+	if err != nil {
+		return Response{Errors: []Error{{Message: err.Error()}}}
+	}
+
+	var op *operation
+	for _, o := range doc.operations {
+		if r.OperationName == "" || o.name == r.OperationName {
+			if op != nil {
+				return Response{Errors: []Error{{
+					Message: "operationName is required for documents with more than one operation",
+				}}}
+			}
+			op = o
+		}
+	}
+
+	if op == nil {
+		return Response{Errors: []Error{{
+			Message: "unknown operation " + r.OperationName,
+		}}}
+	}
+
+	e := &execution{doc: doc, vars: make(map[string]interface{})}
+	for _, v := range op.variables {
+		value, ok := r.Variables[v.name]
+		if !ok && v.hasDefault {
+			value = v.def
+		}
+		e.vars[v.name] = value
+	}
+
+	data, err := e.object(s.Query, nil, op.selection, nil)
+	if err != nil {
+		return Response{Errors: []Error{{Message: err.Error()}}}
+	}
+
+	return Response{Data: data, Errors: e.errors}
+}
+
+// value replaces the variables of an argument value
+func (e *execution) value(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case variable:
+		value, ok := e.vars[string(v)]
+		if !ok {
+			return nil, &requestError{"undefined variable $" + string(v)}
+		}
+		return value, nil
+	case enum:
+		return string(v), nil
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i := range v {
+			var err error
+			ret[i], err = e.value(v[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return ret, nil
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for k := range v {
+			var err error
+			ret[k], err = e.value(v[k])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return ret, nil
+	}
+	return v, nil
+}
+
+// included checks the skip and include directives
+func (e *execution) included(directives []argument) (bool, error) {
+	for _, d := range directives {
+		if d.name != "skip" && d.name != "include" {
+			continue
+		}
+
+		v, err := e.value(d.value)
+		if err != nil {
+			return false, err
+		}
+
+		b, ok := v.(bool)
+		if !ok {
+			return false, &requestError{"@" + d.name + " requires a boolean if argument"}
+		}
+
+		if b == (d.name == "skip") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// collect returns the fields of a selection set by response key, in
+// order. Fields with the same key from fragments are merged.
+func (e *execution) collect(t *Object, sel []*selection, keys *[]string, fields map[string][]*selection, visited map[string]bool) error {
+	for _, s := range sel {
+		ok, err := e.included(s.directives)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		switch {
+		case s.inline:
+			if s.on != "" && s.on != t.Name {
+				continue
+			}
+			err := e.collect(t, s.selection, keys, fields, visited)
+			if err != nil {
+				return err
+			}
+		case s.spread != "":
+			f := e.doc.fragments[s.spread]
+			if f == nil {
+				return &requestError{"unknown fragment " + s.spread}
+			}
+			if visited[s.spread] {
+				continue
+			}
+			visited[s.spread] = true
+			if f.on != t.Name {
+				continue
+			}
+			err := e.collect(t, f.selection, keys, fields, visited)
+			if err != nil {
+				return err
+			}
+		default:
+			key := s.alias
+			if key == "" {
+				key = s.name
+			}
+			if fields[key] == nil {
+				*keys = append(*keys, key)
+			}
+			fields[key] = append(fields[key], s)
+		}
+	}
+	return nil
+}
+
+// object resolves the selected fields of an object
+func (e *execution) object(t *Object, source interface{}, sel []*selection, path []interface{}) (object, error) {
+	var keys []string
+	fields := make(map[string][]*selection)
+	err := e.collect(t, sel, &keys, fields, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(object, 0, len(keys))
+	for _, key := range keys {
+		s := fields[key][0]
+
+		if s.name == "__typename" {
+			ret = append(ret, objectField{key, t.Name})
+			continue
+		}
+
+		f := t.Fields[s.name]
+		if f == nil {
+			return nil, &requestError{fmt.Sprintf("cannot query field %v on type %v",
+				s.name, t.Name)}
+		}
+
+		// merge the sub selections of fields with the same key
+		var sub []*selection
+		for _, fs := range fields[key] {
+			sub = append(sub, fs.selection...)
+		}
+
+		if f.Type == nil && len(sub) > 0 {
+			return nil, &requestError{fmt.Sprintf("field %v of type %v can't have a selection",
+				s.name, t.Name)}
+		}
+		if f.Type != nil && len(sub) == 0 {
+			return nil, &requestError{fmt.Sprintf("field %v of type %v must have a selection",
+				s.name, t.Name)}
+		}
+
+		args := Args{}
+		for _, a := range s.args {
+			known := false
+			for _, n := range f.Args {
+				if n == a.name {
+					known = true
+				}
+			}
+			if !known {
+				return nil, &requestError{fmt.Sprintf("unknown argument %v of field %v",
+					a.name, s.name)}
+			}
+
+			args[a.name], err = e.value(a.value)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		fieldPath := append(append([]interface{}{}, path...), key)
+
+		v, err := f.Resolve(source, args)
+		if err != nil {
+			e.errors = append(e.errors, Error{Message: err.Error(), Path: fieldPath})
+			ret = append(ret, objectField{key, nil})
+			continue
+		}
+
+		v, err = e.complete(f.Type, v, sub, fieldPath)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, objectField{key, v})
+	}
+
+	return ret, nil
+}
+
+// complete returns the result of a field value
+func (e *execution) complete(t *Object, v interface{}, sel []*selection, path []interface{}) (interface{}, error) {
+	if t == nil || v == nil {
+		return v, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return nil, nil
+		}
+	case reflect.Slice:
+		ret := make([]interface{}, rv.Len())
+		for i := range ret {
+			var err error
+			ret[i], err = e.complete(t, rv.Index(i).Interface(), sel,
+				append(append([]interface{}{}, path...), i))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return ret, nil
+	}
+
+	return e.object(t, v, sel, path)
+}
@@ -0,0 +1,142 @@
+package graphql
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type testPerson struct {
+	Name    string
+	Friends []string
+}
+
+var testPeople = map[string]*testPerson{
+	"ann": {Name: "ann", Friends: []string{"bob"}},
+	"bob": {Name: "bob", Friends: []string{"ann", "cat"}},
+	"cat": {Name: "cat"},
+}
+
+func testSchema() *Schema {
+	person := &Object{Name: "Person"}
+	person.Fields = map[string]*Field{
+		"name": {Resolve: func(source interface{}, args Args) (interface{}, error) {
+			return source.(*testPerson).Name, nil
+		}},
+		"greeting": {Args: []string{"prefix"},
+			Resolve: func(source interface{}, args Args) (interface{}, error) {
+				prefix, err := args.String("prefix")
+				if prefix == "" {
+					prefix = "hi"
+				}
+				return prefix + " " + source.(*testPerson).Name, err
+			}},
+		"friends": {Type: person, Args: []string{"first"},
+			Resolve: func(source interface{}, args Args) (interface{}, error) {
+				first, err := args.Int("first")
+				if err != nil {
+					return nil, err
+				}
+
+				var ret []*testPerson
+				for _, f := range source.(*testPerson).Friends {
+					if first > 0 && len(ret) >= first {
+						break
+					}
+					ret = append(ret, testPeople[f])
+				}
+				return ret, nil
+			}},
+		"fail": {Resolve: func(source interface{}, args Args) (interface{}, error) {
+			return nil, errors.New("broken")
+		}},
+	}
+
+	return &Schema{Query: &Object{Name: "Query", Fields: map[string]*Field{
+		"person": {Type: person, Args: []string{"name"},
+			Resolve: func(source interface{}, args Args) (interface{}, error) {
+				name, err := args.String("name")
+				return testPeople[name], err
+			}},
+	}}}
+}
+
+func testQuery(t *testing.T, r Request) string {
+	b, err := json.Marshal(testSchema().Execute(r))
+	if err != nil {
+		t.Fatal("Error encoding response: ", err)
+	}
+	return string(b)
+}
+
+func TestExecute(t *testing.T) {
+	for _, test := range []struct {
+		request Request
+		exp     string
+	}{
+		{Request{Query: `{ person(name: "ann") { name } }`},
+			`{"data":{"person":{"name":"ann"}}}`},
+		// fields are in query order, with aliases and nested lists
+		{Request{Query: `
+			# comment
+			query {
+				a: person(name: "bob") {
+					greeting(prefix: "hello"), name
+					friends(first: 1) { name __typename }
+				}
+				missing: person(name: "dan") { name }
+			}`},
+			`{"data":{"a":{"greeting":"hello bob","name":"bob","friends":[{"name":"ann","__typename":"Person"}]},"missing":null}}`},
+		{Request{Query: `query Q($n: String = "cat", $first: Int) {
+				person(name: $n) { name friends(first: $first) { name } } }`},
+			`{"data":{"person":{"name":"cat","friends":[]}}}`},
+		{Request{Query: `query Q($n: String!, $first: Int) {
+				person(name: $n) { friends(first: $first) { name } } }`,
+			Variables: map[string]interface{}{"n": "bob", "first": float64(1)}},
+			`{"data":{"person":{"friends":[{"name":"ann"}]}}}`},
+		// fragments and directives
+		{Request{Query: `query ($skip: Boolean = true) {
+				person(name: "ann") { ...f ... on Person { greeting } name @skip(if: $skip) }
+			}
+			fragment f on Person { friends { name } friends { greeting } }`},
+			`{"data":{"person":{"friends":[{"name":"bob","greeting":"hi bob"}],"greeting":"hi ann"}}}`},
+		{Request{Query: `query A { person(name: "ann") { name } }
+				query B { person(name: "bob") { name } }`, OperationName: "B"},
+			`{"data":{"person":{"name":"bob"}}}`},
+		// field errors return null with the path
+		{Request{Query: `{ person(name: "ann") { name fail } }`},
+			`{"data":{"person":{"name":"ann","fail":null}},"errors":[{"message":"broken","path":["person","fail"]}]}`},
+		{Request{Query: `{ person(name: 1) { name } }`},
+			`{"data":{"person":null},"errors":[{"message":"argument name must be a string","path":["person"]}]}`},
+	} {
+		ret := testQuery(t, test.request)
+		if ret != test.exp {
+			t.Errorf("wrong response for %v:\n%v\n%v", test.request.Query, ret, test.exp)
+		}
+	}
+}
+
+func TestExecuteErrors(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		err   string
+	}{
+		{`{ person(name: "ann") { name }`, "syntax error at 1:31: unexpected end of query"},
+		{`{ person(name: "ann) { name } }`, "unterminated string"},
+		{`mutation { person }`, "mutation operations are not supported"},
+		{`{ people { name } }`, "cannot query field people on type Query"},
+		{`{ person(name: "ann") }`, "field person of type Query must have a selection"},
+		{`{ person(name: "ann") { name { first } } }`, "field name of type Person can't have a selection"},
+		{`{ person(id: "ann") { name } }`, "unknown argument id of field person"},
+		{`{ person(name: $n) { name } }`, "undefined variable $n"},
+		{`{ person(name: "ann") { ...f } }`, "unknown fragment f"},
+		{`query A { person { name } } query B { person { name } }`, "operationName is required"},
+	} {
+		ret := testQuery(t, Request{Query: test.query})
+		if !strings.HasPrefix(ret, `{"errors":[{"message":`) ||
+			!strings.Contains(ret, test.err) {
+			t.Errorf("wrong error for %v: %v", test.query, ret)
+		}
+	}
+}
@@ -0,0 +1,563 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// document is a parsed query document
+type document struct {
+	operations []*operation
+	fragments  map[string]*fragment
+}
+
+type operation struct {
+	name      string
+	variables []variableDef
+	selection []*selection
+}
+
+type variableDef struct {
+	name       string
+	def        interface{}
+	hasDefault bool
+}
+
+type fragment struct {
+	on        string
+	selection []*selection
+}
+
+// selection is a field, a fragment spread, or an inline fragment
+type selection struct {
+	// field
+	alias      string
+	name       string
+	args       []argument
+	directives []argument
+	selection  []*selection
+
+	// fragment spread, or inline fragment if inline is set
+	spread string
+	inline bool
+	on     string
+}
+
+// argument is an argument of a field, or a directive with its if argument
+type argument struct {
+	name  string
+	value interface{}
+}
+
+// variable and enum values are kept until the query is executed
+type variable string
+type enum string
+
+// SyntaxError is returned when a query can't be parsed
+type SyntaxError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at %v:%v: %v", e.Line, e.Column, e.Message)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenPunct
+	tokenName
+	tokenInt
+	tokenFloat
+	tokenString
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+type parser struct {
+	src string
+	pos int
+	tok token
+}
+
+func parse(src string) (doc *document, err error) {
+	p := &parser{src: src}
+
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*SyntaxError)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+
+	p.next()
+	doc = &document{fragments: make(map[string]*fragment)}
+
+	for p.tok.kind != tokenEOF {
+		switch {
+		case p.is(tokenPunct, "{"):
+			doc.operations = append(doc.operations,
+				&operation{selection: p.selectionSet()})
+		case p.is(tokenName, "query"):
+			doc.operations = append(doc.operations, p.operation())
+		case p.is(tokenName, "fragment"):
+			p.next()
+			name := p.name()
+			if name == "on" {
+				p.fail("invalid fragment name on")
+			}
+			if doc.fragments[name] != nil {
+				p.fail("duplicate fragment " + name)
+			}
+			p.keyword("on")
+			doc.fragments[name] = &fragment{on: p.name(),
+				selection: p.selectionSet()}
+		case p.is(tokenName, "mutation"), p.is(tokenName, "subscription"):
+			p.fail(p.tok.value + " operations are not supported")
+		default:
+			p.unexpected()
+		}
+	}
+
+	if len(doc.operations) == 0 {
+		p.fail("no operations")
+	}
+
+	return doc, nil
+}
+
+// fail stops parsing with an error at the current token
+func (p *parser) fail(msg string) {
+	line, col := 1, 1
+	for _, c := range p.src[:p.tok.pos] {
+		if c == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	panic(&SyntaxError{Line: line, Column: col, Message: msg})
+}
+
+func (p *parser) unexpected() {
+	if p.tok.kind == tokenEOF {
+		p.fail("unexpected end of query")
+	}
+	p.fail(fmt.Sprintf("unexpected %q", p.tok.value))
+}
+
+func (p *parser) is(kind tokenKind, value string) bool {
+	return p.tok.kind == kind && p.tok.value == value
+}
+
+// skip skips a punctuator if it is next, and returns true if it was
+func (p *parser) skip(punct string) bool {
+	if p.is(tokenPunct, punct) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(punct string) {
+	if !p.skip(punct) {
+		p.unexpected()
+	}
+}
+
+func (p *parser) keyword(name string) {
+	if !p.is(tokenName, name) {
+		p.unexpected()
+	}
+	p.next()
+}
+
+func (p *parser) name() string {
+	if p.tok.kind != tokenName {
+		p.unexpected()
+	}
+	n := p.tok.value
+	p.next()
+	return n
+}
+
+func (p *parser) operation() *operation {
+	p.next()
+	op := &operation{}
+
+	if p.tok.kind == tokenName {
+		op.name = p.name()
+	}
+
+	if p.skip("(") {
+		for !p.skip(")") {
+			p.expect("$")
+			v := variableDef{name: p.name()}
+			p.expect(":")
+			p.typeRef()
+			if p.skip("=") {
+				v.def = p.value(true)
+				v.hasDefault = true
+			}
+			op.variables = append(op.variables, v)
+		}
+	}
+
+	p.directives()
+	op.selection = p.selectionSet()
+	return op
+}
+
+// typeRef skips a variable type. Values are checked by the resolvers.
+func (p *parser) typeRef() {
+	if p.skip("[") {
+		p.typeRef()
+		p.expect("]")
+	} else {
+		p.name()
+	}
+	p.skip("!")
+}
+
+func (p *parser) directives() []argument {
+	var ret []argument
+	for p.skip("@") {
+		d := argument{name: p.name()}
+		for _, a := range p.arguments() {
+			if a.name == "if" {
+				d.value = a.value
+			}
+		}
+		ret = append(ret, d)
+	}
+	return ret
+}
+
+func (p *parser) arguments() []argument {
+	var ret []argument
+	if p.skip("(") {
+		for !p.skip(")") {
+			a := argument{name: p.name()}
+			p.expect(":")
+			a.value = p.value(false)
+			ret = append(ret, a)
+		}
+	}
+	return ret
+}
+
+func (p *parser) selectionSet() []*selection {
+	p.expect("{")
+	var ret []*selection
+
+	for !p.skip("}") {
+		if p.skip("...") {
+			s := &selection{}
+			switch {
+			case p.is(tokenName, "on"):
+				p.next()
+				s.inline = true
+				s.on = p.name()
+			case p.tok.kind == tokenName:
+				s.spread = p.name()
+			default:
+				s.inline = true
+			}
+			s.directives = p.directives()
+			if s.inline {
+				s.selection = p.selectionSet()
+			}
+			ret = append(ret, s)
+			continue
+		}
+
+		s := &selection{name: p.name()}
+		if p.skip(":") {
+			s.alias = s.name
+			s.name = p.name()
+		}
+		s.args = p.arguments()
+		s.directives = p.directives()
+		if p.is(tokenPunct, "{") {
+			s.selection = p.selectionSet()
+		}
+		ret = append(ret, s)
+	}
+
+	if len(ret) == 0 {
+		p.fail("empty selection set")
+	}
+
+	return ret
+}
+
+// value parses a value. Variables are not allowed in constant values, like
+// variable defaults.
+func (p *parser) value(constant bool) interface{} {
+	t := p.tok
+	switch t.kind {
+	case tokenInt:
+		p.next()
+		v, err := strconv.ParseInt(t.value, 10, 64)
+		if err != nil {
+			p.fail("invalid int " + t.value)
+		}
+		return v
+	case tokenFloat:
+		p.next()
+		v, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			p.fail("invalid float " + t.value)
+		}
+		return v
+	case tokenString:
+		p.next()
+		return t.value
+	case tokenName:
+		p.next()
+		switch t.value {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		}
+		return enum(t.value)
+	}
+
+	switch {
+	case p.skip("$"):
+		if constant {
+			p.fail("variables are not allowed here")
+		}
+		return variable(p.name())
+	case p.skip("["):
+		ret := []interface{}{}
+		for !p.skip("]") {
+			ret = append(ret, p.value(constant))
+		}
+		return ret
+	case p.skip("{"):
+		ret := map[string]interface{}{}
+		for !p.skip("}") {
+			n := p.name()
+			p.expect(":")
+			ret[n] = p.value(constant)
+		}
+		return ret
+	}
+
+	p.unexpected()
+	return nil
+}
+
+// next reads the next token
+func (p *parser) next() {
+	// skip white space, commas, comments, and byte order marks
+loop:
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			p.pos++
+		case strings.HasPrefix(p.src[p.pos:], "\ufeff"):
+			p.pos += len("\ufeff")
+		default:
+			break loop
+		}
+	}
+
+	start := p.pos
+	p.tok = token{pos: start}
+
+	if p.pos >= len(p.src) {
+		p.tok.kind = tokenEOF
+		return
+	}
+
+	c := p.src[p.pos]
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.tok.kind, p.tok.value = tokenPunct, "..."
+	case strings.IndexByte("!$()=:@[]{}|&", c) >= 0:
+		p.pos++
+		p.tok.kind, p.tok.value = tokenPunct, string(c)
+	case c == '_' || isLetter(c):
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' ||
+			isLetter(p.src[p.pos]) || isDigit(p.src[p.pos])) {
+			p.pos++
+		}
+		p.tok.kind, p.tok.value = tokenName, p.src[start:p.pos]
+	case c == '-' || isDigit(c):
+		p.number()
+	case c == '"':
+		p.string()
+	default:
+		r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+		p.tok.value = string(r)
+		p.fail(fmt.Sprintf("unexpected character %q", r))
+	}
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (p *parser) number() {
+	start := p.pos
+	p.tok.kind = tokenInt
+
+	if p.src[p.pos] == '-' {
+		p.pos++
+	}
+
+	digits := func() {
+		n := p.pos
+		for p.pos < len(p.src) && isDigit(p.src[p.pos]) {
+			p.pos++
+		}
+		if n == p.pos {
+			p.fail("invalid number")
+		}
+	}
+
+	digits()
+	if p.pos < len(p.src) && p.src[p.pos] == '.' {
+		p.pos++
+		p.tok.kind = tokenFloat
+		digits()
+	}
+	if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+		p.pos++
+		p.tok.kind = tokenFloat
+		if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+			p.pos++
+		}
+		digits()
+	}
+
+	p.tok.value = p.src[start:p.pos]
+}
+
+func (p *parser) string() {
+	p.tok.kind = tokenString
+
+	if strings.HasPrefix(p.src[p.pos:], `"""`) {
+		end := strings.Index(p.src[p.pos+3:], `"""`)
+		if end < 0 {
+			p.fail("unterminated string")
+		}
+		p.tok.value = blockString(p.src[p.pos+3 : p.pos+3+end])
+		p.pos += end + 6
+		return
+	}
+
+	var b strings.Builder
+	p.pos++
+	for {
+		if p.pos >= len(p.src) || p.src[p.pos] == '\n' {
+			p.fail("unterminated string")
+		}
+
+		c := p.src[p.pos]
+		p.pos++
+
+		if c == '"' {
+			break
+		}
+
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+
+		if p.pos >= len(p.src) {
+			p.fail("unterminated string")
+		}
+
+		e := p.src[p.pos]
+		p.pos++
+		switch e {
+		case '"', '\\', '/':
+			b.WriteByte(e)
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			if p.pos+4 > len(p.src) {
+				p.fail("invalid unicode escape")
+			}
+			r, err := strconv.ParseUint(p.src[p.pos:p.pos+4], 16, 32)
+			if err != nil {
+				p.fail("invalid unicode escape")
+			}
+			b.WriteRune(rune(r))
+			p.pos += 4
+		default:
+			p.fail(fmt.Sprintf("invalid escape \\%c", e))
+		}
+	}
+
+	p.tok.value = b.String()
+}
+
+// blockString removes the common indentation and blank first and last
+// lines of a block string
+func blockString(s string) string {
+	lines := strings.Split(strings.Replace(s, "\r\n", "\n", -1), "\n")
+
+	indent := -1
+	for _, l := range lines[1:] {
+		t := strings.TrimLeft(l, " \t")
+		if t == "" {
+			continue
+		}
+		if n := len(l) - len(t); indent < 0 || n < indent {
+			indent = n
+		}
+	}
+
+	for i := 1; i < len(lines) && indent > 0; i++ {
+		if len(lines[i]) >= indent {
+			lines[i] = lines[i][indent:]
+		}
+	}
+
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return strings.Join(lines, "\n")
+}
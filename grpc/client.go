@@ -0,0 +1,141 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// Client calls the Siot gRPC service. Other languages can generate a
+// client from data/api.proto instead.
+type Client struct {
+	url   string
+	token string
+	http  *http.Client
+}
+
+// NewClient returns a client for the server at addr, like
+// siot.example.com:8443. tlsConfig is used to connect if it is not nil,
+// like to trust a private CA.
+func NewClient(addr, token string, tlsConfig *tls.Config) *Client {
+	return &Client{
+		url:   "https://" + addr,
+		token: token,
+		http: &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   tlsConfig,
+			ForceAttemptHTTP2: true,
+		}},
+	}
+}
+
+// call makes a call with one request message, and calls fn for each
+// response message
+func (c *Client) call(ctx context.Context, method string, msg []byte, fn func(b []byte) error) error {
+	body := &bytes.Buffer{}
+	writeMessage(body, msg)
+
+	req, err := http.NewRequest(http.MethodPost, c.url+"/siot.Siot/"+method, body)
+	if err != nil {
+		return err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errorf(Unknown, "http status %v", resp.Status)
+	}
+
+	for {
+		b, err := readMessage(resp.Body)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		err = fn(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the status is in the headers if there is no response message
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+	}
+
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return errorf(Unknown, "missing grpc status")
+	}
+
+	if Code(code) != OK {
+		return &Error{Code: Code(code), Message: decodeMessage(message)}
+	}
+
+	return nil
+}
+
+// ListDevices returns the devices that match r, and the number of devices
+// that match for pagination
+func (c *Client) ListDevices(ctx context.Context, r data.DeviceListRequest) ([]data.Device, int, error) {
+	var ret []data.Device
+	var total int
+
+	err := c.call(ctx, "ListDevices", data.DeviceListRequestToPb(r),
+		func(b []byte) error {
+			var err error
+			ret, total, err = data.PbToDeviceList(b)
+			return err
+		})
+
+	return ret, total, err
+}
+
+// StreamSamples calls fn with samples as devices send them, until ctx is
+// canceled or the stream fails. Only samples from deviceID are sent if it
+// is not blank.
+func (c *Client) StreamSamples(ctx context.Context, deviceID string, fn func(deviceID string, s data.Sample)) error {
+	return c.call(ctx, "StreamSamples", data.SampleStreamRequestToPb(deviceID),
+		func(b []byte) error {
+			id, s, err := data.PbToDeviceSample(b)
+			if err != nil {
+				return err
+			}
+
+			fn(id, s)
+			return nil
+		})
+}
+
+// SendCommand queues a command for a device, and returns the queued
+// command
+func (c *Client) SendCommand(ctx context.Context, cmd data.DeviceCommand) (data.DeviceCommand, error) {
+	var ret data.DeviceCommand
+
+	err := c.call(ctx, "SendCommand", data.CommandToPb(cmd),
+		func(b []byte) error {
+			var err error
+			ret, err = data.PbToCommand(b)
+			return err
+		})
+
+	return ret, err
+}
@@ -0,0 +1,105 @@
+// Package grpc serves the SIOT gRPC service in data/api.proto, which gives
+// backend integrators a typed interface to list devices, stream samples,
+// and send commands. Clients can be generated from api.proto with the
+// standard gRPC tools.
+//
+// The gRPC protocol is implemented on the HTTP/2 support of net/http, and
+// the messages are encoded by the data package, so the server does not
+// depend on the gRPC and protobuf libraries. Compression is not supported.
+package grpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+)
+
+// Code is a gRPC status code
+type Code int
+
+// gRPC status codes used by the service
+const (
+	OK                 Code = 0
+	Canceled           Code = 1
+	Unknown            Code = 2
+	InvalidArgument    Code = 3
+	NotFound           Code = 5
+	FailedPrecondition Code = 9
+	Unimplemented      Code = 12
+	Internal           Code = 13
+	Unauthenticated    Code = 16
+)
+
+// Error is the status of a call that failed
+type Error struct {
+	Code    Code
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("grpc error %v: %v", e.Code, e.Message)
+}
+
+func errorf(code Code, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// maxMessage is the largest message that is received, which is the gRPC
+// default
+const maxMessage = 4 << 20
+
+// messages are sent with a compressed flag and the message length
+const messageHeader = 5
+
+var errCompressed = errors.New("compressed messages are not supported")
+
+// readMessage reads a length prefixed message. It returns io.EOF if there
+// are no more messages.
+func readMessage(r io.Reader) ([]byte, error) {
+	var h [messageHeader]byte
+	_, err := io.ReadFull(r, h[:])
+	if err != nil {
+		return nil, err
+	}
+
+	if h[0] != 0 {
+		return nil, errCompressed
+	}
+
+	n := binary.BigEndian.Uint32(h[1:])
+	if n > maxMessage {
+		return nil, fmt.Errorf("message of %v bytes is too large", n)
+	}
+
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return b, err
+}
+
+// writeMessage writes a length prefixed message
+func writeMessage(w io.Writer, b []byte) error {
+	m := make([]byte, messageHeader+len(b))
+	binary.BigEndian.PutUint32(m[1:], uint32(len(b)))
+	copy(m[messageHeader:], b)
+	_, err := w.Write(m)
+	return err
+}
+
+// encodeMessage encodes a grpc-message, which is percent encoded
+func encodeMessage(m string) string {
+	return url.PathEscape(m)
+}
+
+func decodeMessage(m string) string {
+	ret, err := url.PathUnescape(m)
+	if err != nil {
+		return m
+	}
+	return ret
+}
@@ -0,0 +1,131 @@
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-grpc-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbInst, err := db.NewDb(dir, nil)
+	if err != nil {
+		t.Fatal("Error opening db: ", err)
+	}
+	defer dbInst.Close()
+
+	for _, id := range []string{"pump", "tank"} {
+		err := dbInst.DeviceSample(id, data.Sample{Type: "temp", Value: 20})
+		if err != nil {
+			t.Fatal("Error writing sample: ", err)
+		}
+	}
+
+	ts := httptest.NewUnstartedServer(NewServer(dbInst, "secret"))
+	ts.TLS = &tls.Config{NextProtos: []string{"h2"}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	tlsConfig := &tls.Config{RootCAs: pool}
+	addr := ts.Listener.Addr().String()
+
+	c := NewClient(addr, "secret", tlsConfig)
+	ctx := context.Background()
+
+	devices, total, err := c.ListDevices(ctx, data.DeviceListRequest{Limit: 1})
+	if err != nil {
+		t.Fatal("Error listing devices: ", err)
+	}
+
+	if total != 2 || len(devices) != 1 || devices[0].ID != "pump" ||
+		len(devices[0].State.Ios) != 1 || devices[0].State.Ios[0].Value != 20 {
+		t.Errorf("wrong devices: %+v, %v", devices, total)
+	}
+
+	cmd, err := c.SendCommand(ctx, data.DeviceCommand{DeviceID: "pump",
+		Command: "reboot", Args: map[string]string{"delay": "5"}})
+	if err != nil {
+		t.Fatal("Error sending command: ", err)
+	}
+
+	cmds, err := dbInst.DeviceCommands("pump")
+	if err != nil || len(cmds) != 1 || cmds[0].ID != cmd.ID ||
+		cmds[0].Args["delay"] != "5" {
+		t.Errorf("command not queued: %+v, %+v, %v", cmd, cmds, err)
+	}
+
+	_, err = c.SendCommand(ctx, data.DeviceCommand{DeviceID: "none",
+		Command: "reboot"})
+	if e, ok := err.(*Error); !ok || e.Code != NotFound {
+		t.Error("expected not found error: ", err)
+	}
+
+	_, _, err = NewClient(addr, "bad", tlsConfig).ListDevices(ctx,
+		data.DeviceListRequest{})
+	if e, ok := err.(*Error); !ok || e.Code != Unauthenticated {
+		t.Error("expected unauthenticated error: ", err)
+	}
+
+	// stream samples from one device
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	received := make(chan data.Sample)
+	done := make(chan error)
+	go func() {
+		done <- c.StreamSamples(ctx, "tank", func(id string, s data.Sample) {
+			if id == "tank" {
+				received <- s
+			}
+		})
+	}()
+
+	// the stream may not be subscribed yet, so keep sending
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	timeout := time.After(5 * time.Second)
+
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			dbInst.DeviceSample("pump", data.Sample{Type: "temp", Value: 1})
+			dbInst.DeviceSample("tank", data.Sample{Type: "level", Value: 2})
+		case s := <-received:
+			if s.Type != "level" || s.Value != 2 {
+				t.Errorf("wrong sample: %+v", s)
+			}
+			break loop
+		case err := <-done:
+			t.Fatal("stream ended: ", err)
+		case <-timeout:
+			t.Fatal("timeout waiting for sample")
+		}
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-received:
+		<-done
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not end when canceled")
+	}
+}
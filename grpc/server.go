@@ -0,0 +1,214 @@
+package grpc
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+// Server serves the Siot gRPC service. Calls must include an
+// "authorization: Bearer <token>" header that matches the admin token.
+// Server is an http.Handler that must be served with HTTP/2, like with
+// http.Server.ListenAndServeTLS.
+type Server struct {
+	db    *db.Db
+	token string
+}
+
+// NewServer returns a new gRPC server. All calls are refused if token is
+// blank.
+func NewServer(dbInst *db.Db, token string) *Server {
+	return &Server{db: dbInst, token: token}
+}
+
+// authorized compares the bearer token with the admin token in constant
+// time
+func (s *Server) authorized(req *http.Request) bool {
+	return s.token != "" &&
+		data.TokenEqual(req.Header.Get("Authorization"), "Bearer "+s.token)
+}
+
+// ServeHTTP handles a gRPC call
+func (s *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.ProtoMajor != 2 {
+		http.Error(res, "gRPC requires HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	if req.Method != http.MethodPost ||
+		!strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(res, "not a gRPC request", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/grpc")
+	res.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	res.WriteHeader(http.StatusOK)
+
+	// send the headers now, so the status is always sent in trailers
+	if flusher, ok := res.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	var err error
+
+	if !s.authorized(req) {
+		err = errorf(Unauthenticated, "not authorized")
+	} else {
+		switch req.URL.Path {
+		case "/siot.Siot/ListDevices":
+			err = s.listDevices(res, req)
+		case "/siot.Siot/StreamSamples":
+			err = s.streamSamples(res, req)
+		case "/siot.Siot/SendCommand":
+			err = s.sendCommand(res, req)
+		default:
+			err = errorf(Unimplemented, "unknown method %v", req.URL.Path)
+		}
+	}
+
+	status := &Error{Code: OK}
+	if err != nil {
+		if !errors.As(err, &status) {
+			status = errorf(Internal, "%v", err)
+		}
+	}
+
+	res.Header().Set("Grpc-Status", strconv.Itoa(int(status.Code)))
+	if status.Message != "" {
+		res.Header().Set("Grpc-Message", encodeMessage(status.Message))
+	}
+}
+
+// request reads the message of a call with one request message
+func request(req *http.Request) ([]byte, error) {
+	b, err := readMessage(req.Body)
+	switch {
+	case err == errCompressed:
+		return nil, errorf(Unimplemented, "%v", err)
+	case err == io.EOF:
+		return nil, errorf(InvalidArgument, "missing request message")
+	case err != nil:
+		return nil, errorf(InvalidArgument, "%v", err)
+	}
+
+	return b, nil
+}
+
+func (s *Server) listDevices(res http.ResponseWriter, req *http.Request) error {
+	b, err := request(req)
+	if err != nil {
+		return err
+	}
+
+	r, err := data.PbToDeviceListRequest(b)
+	if err != nil {
+		return errorf(InvalidArgument, "%v", err)
+	}
+
+	devices, total, err := s.db.DevicesFiltered(db.DeviceFilter{
+		Group:  r.Group,
+		Tag:    r.Tag,
+		Io:     r.Io,
+		Query:  r.Query,
+		Offset: r.Offset,
+		Limit:  r.Limit,
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeMessage(res, data.DeviceListToPb(devices, total))
+}
+
+func (s *Server) streamSamples(res http.ResponseWriter, req *http.Request) error {
+	b, err := request(req)
+	if err != nil {
+		return err
+	}
+
+	id, err := data.PbToSampleStreamRequest(b)
+	if err != nil {
+		return errorf(InvalidArgument, "%v", err)
+	}
+
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		return errorf(Internal, "streaming not supported")
+	}
+
+	events := s.db.Subscribe(db.EventFilter{
+		DeviceID: id,
+		Types:    []db.EventType{db.EventSampleWritten},
+	})
+	defer s.db.Unsubscribe(events)
+
+	for {
+		select {
+		case e := <-events:
+			if e.Sample == nil {
+				continue
+			}
+
+			err := writeMessage(res, data.DeviceSampleToPb(e.DeviceID, *e.Sample))
+			if err != nil {
+				return err
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return errorf(Canceled, "stream canceled")
+		}
+	}
+}
+
+func (s *Server) sendCommand(res http.ResponseWriter, req *http.Request) error {
+	b, err := request(req)
+	if err != nil {
+		return err
+	}
+
+	cmd, err := data.PbToCommand(b)
+	if err != nil {
+		return errorf(InvalidArgument, "%v", err)
+	}
+
+	if cmd.DeviceID == "" || cmd.Command == "" {
+		return errorf(InvalidArgument, "device id and command are required")
+	}
+
+	err = s.db.Update(func(txn *db.Txn) error {
+		dev, err := txn.Device(cmd.DeviceID)
+		if err != nil {
+			return err
+		}
+
+		if dev == nil {
+			return errorf(NotFound, "device not found")
+		}
+
+		cmd, err = txn.CommandEnqueue(cmd)
+		if err != nil {
+			return err
+		}
+
+		return txn.AuditAppend(data.AuditRecord{
+			DeviceID: cmd.DeviceID,
+			Action:   "enqueueCommand",
+			Message:  cmd.Command,
+		})
+	})
+
+	switch {
+	case err == db.ErrReadOnly:
+		return errorf(FailedPrecondition, "%v", err)
+	case err != nil:
+		return err
+	}
+
+	return writeMessage(res, data.CommandToPb(cmd))
+}
@@ -0,0 +1,294 @@
+// Package load generates sample load against a SIOT server to measure the
+// capacity of the ingest path. Simulated devices send samples at a fixed
+// total rate over HTTP, NATS, or MQTT, and the throughput, latency, and
+// errors of the requests are reported.
+//
+// Latency is the time until the server responds: the HTTP response, the
+// NATS reply, or the MQTT PUBACK. The NATS and MQTT bridges respond after
+// the samples are written, unless the ingest queue is enabled, in which
+// case they respond after the samples are queued.
+package load
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// maxErrors is the most distinct error messages kept in a result
+const maxErrors = 10
+
+// Config describes the load to generate
+type Config struct {
+	// Transport is http, nats, or mqtt
+	Transport string
+	// URL is the server URL for HTTP, or the NATS server or MQTT broker
+	// URL
+	URL string
+	// Token is the admin token. It is sent as the HTTP bearer token, and
+	// as the NATS and MQTT password, so devices don't need keys.
+	Token string
+	// Prefix is the first token of NATS subjects and MQTT topics (default
+	// siot)
+	Prefix string
+	// Devices is the number of simulated devices, each with its own
+	// connection (default 10)
+	Devices int
+	// DevicePrefix is the start of the device IDs, which are
+	// <prefix>-<n> (default load)
+	DevicePrefix string
+	// Rate is the total samples per second sent by all devices (default
+	// 100)
+	Rate float64
+	// Batch is the number of samples in each request (default 1)
+	Batch int
+	// Duration is how long load is generated (default 10s)
+	Duration time.Duration
+	// Timeout is used for connecting and requests (default 10s)
+	Timeout time.Duration
+}
+
+// Validate checks the config is valid
+func (c Config) Validate() error {
+	switch c.Transport {
+	case client.TransportHTTP, client.TransportNATS, client.TransportMQTT:
+	default:
+		return fmt.Errorf("unknown transport: %v", c.Transport)
+	}
+
+	if c.URL == "" {
+		return errors.New("url is required")
+	}
+
+	if c.Devices < 0 || c.Rate < 0 || c.Batch < 0 || c.Duration < 0 {
+		return errors.New("devices, rate, batch, and duration can't be negative")
+	}
+
+	return nil
+}
+
+// Result is the result of a load run
+type Result struct {
+	Config   Config
+	Duration time.Duration
+	Requests int
+	// Samples is the number of samples that were written
+	Samples int
+	Errors  int
+	// ErrorCounts counts the errors by message
+	ErrorCounts map[string]int
+	// Latencies of successful requests, sorted
+	Latencies []time.Duration
+}
+
+// Throughput returns the samples written per second
+func (r Result) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Samples) / r.Duration.Seconds()
+}
+
+// ErrorRate returns the fraction of requests that failed
+func (r Result) ErrorRate() float64 {
+	if r.Requests == 0 {
+		return 0
+	}
+	return float64(r.Errors) / float64(r.Requests)
+}
+
+// Percentile returns a latency percentile, like 99 for the latency 99% of
+// requests were faster than
+func (r Result) Percentile(p float64) time.Duration {
+	return Percentile(r.Latencies, p)
+}
+
+// Percentile returns a percentile of sorted durations, using the nearest
+// rank method
+func Percentile(d []time.Duration, p float64) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+
+	i := int(p/100*float64(len(d))+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(d) {
+		i = len(d) - 1
+	}
+
+	return d[i]
+}
+
+func (r Result) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "transport:   %v, %v devices, batch %v\n",
+		r.Config.Transport, r.Config.Devices, r.Config.Batch)
+	fmt.Fprintf(&b, "duration:    %v\n", r.Duration.Round(time.Millisecond))
+	fmt.Fprintf(&b, "throughput:  %.1f samples/s (target %.1f)\n",
+		r.Throughput(), r.Config.Rate)
+	fmt.Fprintf(&b, "requests:    %v, %v errors (%.2f%%)\n",
+		r.Requests, r.Errors, r.ErrorRate()*100)
+	fmt.Fprintf(&b, "latency:     p50 %v, p90 %v, p99 %v, max %v\n",
+		r.Percentile(50), r.Percentile(90), r.Percentile(99),
+		r.Percentile(100))
+
+	msgs := make([]string, 0, len(r.ErrorCounts))
+	for msg := range r.ErrorCounts {
+		msgs = append(msgs, msg)
+	}
+	sort.Strings(msgs)
+
+	for _, msg := range msgs {
+		fmt.Fprintf(&b, "error:       %v (%v)\n", msg, r.ErrorCounts[msg])
+	}
+
+	return b.String()
+}
+
+// sender sends samples for a device and waits for the server to respond
+type sender interface {
+	send(samples []data.Sample) error
+	close()
+}
+
+// newSender connects a device with the configured transport
+func newSender(config Config, id string) (sender, error) {
+	switch config.Transport {
+	case client.TransportHTTP:
+		return newHTTPSender(config, id), nil
+	case client.TransportNATS:
+		return newNATSSender(config, id)
+	case client.TransportMQTT:
+		return newMQTTSender(config, id)
+	default:
+		return nil, fmt.Errorf("unknown transport: %v", config.Transport)
+	}
+}
+
+// Run generates load and returns the result once Duration has passed and
+// all requests have completed. The devices connect before the load
+// starts. Each device sends requests at an even rate, and the devices are
+// staggered, so the load is spread over time. If requests take longer
+// than the interval between them, they are skipped, and the throughput is
+// less than the rate.
+func Run(config Config) (Result, error) {
+	err := config.Validate()
+	if err != nil {
+		return Result{}, err
+	}
+
+	if config.Prefix == "" {
+		config.Prefix = "siot"
+	}
+
+	if config.Devices == 0 {
+		config.Devices = 10
+	}
+
+	if config.DevicePrefix == "" {
+		config.DevicePrefix = "load"
+	}
+
+	if config.Rate == 0 {
+		config.Rate = 100
+	}
+
+	if config.Batch == 0 {
+		config.Batch = 1
+	}
+
+	if config.Duration == 0 {
+		config.Duration = 10 * time.Second
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	senders := make([]sender, config.Devices)
+	defer func() {
+		for _, s := range senders {
+			if s != nil {
+				s.close()
+			}
+		}
+	}()
+
+	for i := range senders {
+		id := fmt.Sprintf("%v-%v", config.DevicePrefix, i+1)
+		senders[i], err = newSender(config, id)
+		if err != nil {
+			return Result{}, fmt.Errorf("Error connecting %v: %v", id, err)
+		}
+	}
+
+	interval := time.Duration(float64(config.Batch*config.Devices) /
+		config.Rate * float64(time.Second))
+
+	ret := Result{Config: config, ErrorCounts: make(map[string]int)}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	end := start.Add(config.Duration)
+
+	for i, s := range senders {
+		wg.Add(1)
+		go func(i int, s sender) {
+			defer wg.Done()
+
+			time.Sleep(interval * time.Duration(i) / time.Duration(config.Devices))
+
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for seq := 0; time.Now().Before(end); seq++ {
+				now := time.Now()
+				samples := make([]data.Sample, config.Batch)
+				for j := range samples {
+					samples[j] = data.Sample{Type: "load", ID: fmt.Sprint(j),
+						Value: float64(seq), Time: now}
+				}
+
+				err := s.send(samples)
+				latency := time.Since(now)
+
+				lock.Lock()
+				ret.Requests++
+				if err != nil {
+					ret.Errors++
+					if _, ok := ret.ErrorCounts[err.Error()]; ok ||
+						len(ret.ErrorCounts) < maxErrors {
+						ret.ErrorCounts[err.Error()]++
+					}
+				} else {
+					ret.Samples += len(samples)
+					ret.Latencies = append(ret.Latencies, latency)
+				}
+				lock.Unlock()
+
+				select {
+				case <-ticker.C:
+				case <-time.After(time.Until(end)):
+				}
+			}
+		}(i, s)
+	}
+
+	wg.Wait()
+	ret.Duration = time.Since(start)
+
+	sort.Slice(ret.Latencies, func(i, j int) bool {
+		return ret.Latencies[i] < ret.Latencies[j]
+	})
+
+	return ret, nil
+}
@@ -0,0 +1,261 @@
+package load
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/api"
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/mqtt"
+	"github.com/simpleiot/simpleiot/nats"
+)
+
+// testServer is a server with the HTTP API, an embedded NATS server, and
+// an embedded MQTT broker
+type testServer struct {
+	db   *db.Db
+	urls map[string]string
+	stop func()
+}
+
+func startServer(tb testing.TB, influx *db.Influx) *testServer {
+	dir, err := ioutil.TempDir("", "siot-load-test")
+	if err != nil {
+		tb.Fatal("Error creating temp dir: ", err)
+	}
+
+	dbInst, err := db.NewDb(dir, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		tb.Fatal("Error opening db: ", err)
+	}
+
+	write := func(ctx context.Context, id string, samples []data.Sample) error {
+		return api.WriteSamplesContext(ctx, dbInst, influx, id, samples)
+	}
+
+	httpServer := httptest.NewServer(api.NewAppHandler(api.ServerArgs{
+		DbInst:     dbInst,
+		Influx:     influx,
+		Filesystem: http.Dir(dir),
+		GetAsset:   func(string) []byte { return nil },
+	}))
+
+	natsListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal("Error listening: ", err)
+	}
+	natsServer := nats.NewServer(nats.ServerConfig{})
+	go natsServer.Serve(natsListener)
+	natsBridge := nats.NewBridge(natsServer, dbInst, nats.BridgeConfig{Write: write})
+	err = natsBridge.Start()
+	if err != nil {
+		tb.Fatal("Error starting NATS bridge: ", err)
+	}
+
+	mqttListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal("Error listening: ", err)
+	}
+	broker := mqtt.NewBroker(mqtt.BrokerConfig{})
+	go broker.Serve(mqttListener)
+	mqttBridge := mqtt.NewBridge(broker, dbInst, mqtt.BridgeConfig{Write: write})
+	err = mqttBridge.Start()
+	if err != nil {
+		tb.Fatal("Error starting MQTT bridge: ", err)
+	}
+
+	return &testServer{
+		db: dbInst,
+		urls: map[string]string{
+			client.TransportHTTP: httpServer.URL,
+			client.TransportNATS: "nats://" + natsListener.Addr().String(),
+			client.TransportMQTT: "tcp://" + mqttListener.Addr().String(),
+		},
+		stop: func() {
+			mqttBridge.Stop()
+			broker.Close()
+			natsBridge.Stop()
+			natsServer.Close()
+			httpServer.Close()
+			dbInst.Close()
+			os.RemoveAll(dir)
+		},
+	}
+}
+
+func TestRun(t *testing.T) {
+	s := startServer(t, nil)
+	defer s.stop()
+
+	for _, transport := range []string{client.TransportHTTP,
+		client.TransportNATS, client.TransportMQTT} {
+		r, err := Run(Config{
+			Transport:    transport,
+			URL:          s.urls[transport],
+			Devices:      4,
+			DevicePrefix: transport,
+			Rate:         200,
+			Batch:        5,
+			Duration:     500 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("Error running %v load: %v", transport, err)
+		}
+
+		// 4 devices send a request every 100ms
+		if r.Errors != 0 || r.Requests < 16 || r.Requests > 24 ||
+			r.Samples != r.Requests*5 || len(r.Latencies) != r.Requests {
+			t.Errorf("wrong %v result:\n%v", transport, r)
+		}
+
+		if r.Percentile(50) <= 0 || r.Percentile(50) > r.Percentile(100) {
+			t.Errorf("wrong %v latencies:\n%v", transport, r)
+		}
+
+		if _, ok := s.db.LatestValue(transport+"-4", "load", "4"); !ok {
+			t.Errorf("%v samples were not written", transport)
+		}
+	}
+
+	_, err := Run(Config{Transport: "carrier pigeon", URL: "x"})
+	if err == nil {
+		t.Error("expected error for unknown transport")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var d []time.Duration
+	for i := 1; i <= 100; i++ {
+		d = append(d, time.Duration(i))
+	}
+
+	for _, test := range []struct {
+		p   float64
+		exp time.Duration
+	}{{0, 1}, {50, 50}, {99, 99}, {99.9, 100}, {100, 100}} {
+		if v := Percentile(d, test.p); v != test.exp {
+			t.Errorf("p%v is %v, expected %v", test.p, v, test.exp)
+		}
+	}
+
+	if Percentile(nil, 50) != 0 {
+		t.Error("percentile of no values should be 0")
+	}
+}
+
+// benchSamples is the batch size used by the benchmarks
+const benchSamples = 10
+
+func benchSamplesAt(t time.Time) []data.Sample {
+	samples := make([]data.Sample, benchSamples)
+	for i := range samples {
+		samples[i] = data.Sample{Type: "load", ID: string(rune('a' + i)),
+			Value: float64(i), Time: t}
+	}
+	return samples
+}
+
+// benchTransport sends batches of samples over a transport from parallel
+// devices, and reports the samples written per second
+func benchTransport(b *testing.B, transport string) {
+	s := startServer(b, nil)
+	defer s.stop()
+
+	config := Config{Transport: transport, URL: s.urls[transport],
+		Prefix: "siot", Timeout: 10 * time.Second}
+
+	var devices int32
+	b.ResetTimer()
+	start := time.Now()
+
+	b.RunParallel(func(pb *testing.PB) {
+		id := "bench-" + string(rune('a'+atomic.AddInt32(&devices, 1)))
+		snd, err := newSender(config, id)
+		if err != nil {
+			b.Error("Error connecting: ", err)
+			return
+		}
+		defer snd.close()
+
+		for pb.Next() {
+			err := snd.send(benchSamplesAt(time.Now()))
+			if err != nil {
+				b.Error("Error sending: ", err)
+			}
+		}
+	})
+
+	b.ReportMetric(float64(b.N*benchSamples)/time.Since(start).Seconds(), "samples/s")
+}
+
+func BenchmarkIngestHTTP(b *testing.B) { benchTransport(b, client.TransportHTTP) }
+func BenchmarkIngestNATS(b *testing.B) { benchTransport(b, client.TransportNATS) }
+func BenchmarkIngestMQTT(b *testing.B) { benchTransport(b, client.TransportMQTT) }
+
+// BenchmarkWriteSamples measures the store without a transport
+func BenchmarkWriteSamples(b *testing.B) {
+	s := startServer(b, nil)
+	defer s.stop()
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		err := api.WriteSamples(s.db, nil, "bench", benchSamplesAt(time.Now()))
+		if err != nil {
+			b.Fatal("Error writing samples: ", err)
+		}
+	}
+
+	b.ReportMetric(float64(b.N*benchSamples)/time.Since(start).Seconds(), "samples/s")
+}
+
+// BenchmarkWriteSamplesInflux measures the store and the Influx writer,
+// with a server that accepts Influx writes without storing them
+func BenchmarkWriteSamplesInflux(b *testing.B) {
+	var writes int64
+	influxServer := httptest.NewServer(http.HandlerFunc(
+		func(res http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/write" {
+				ioutil.ReadAll(req.Body)
+				atomic.AddInt64(&writes, 1)
+				res.WriteHeader(http.StatusNoContent)
+				return
+			}
+			res.Header().Set("Content-Type", "application/json")
+			res.Write([]byte(`{"results":[{"statement_id":0}]}`))
+		}))
+	defer influxServer.Close()
+
+	influx, err := db.NewInflux(influxServer.URL, "siot", "", "", nil)
+	if err != nil {
+		b.Fatal("Error connecting to influx: ", err)
+	}
+
+	s := startServer(b, influx)
+	defer s.stop()
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		err := api.WriteSamples(s.db, influx, "bench", benchSamplesAt(time.Now()))
+		if err != nil {
+			b.Fatal("Error writing samples: ", err)
+		}
+	}
+
+	b.ReportMetric(float64(b.N*benchSamples)/time.Since(start).Seconds(), "samples/s")
+
+	if atomic.LoadInt64(&writes) == 0 {
+		b.Error("no influx writes")
+	}
+}
@@ -0,0 +1,175 @@
+package load
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/mqtt"
+	"github.com/simpleiot/simpleiot/nats"
+)
+
+// httpSender posts samples to the HTTP API
+type httpSender struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newHTTPSender(config Config, id string) *httpSender {
+	return &httpSender{
+		url:   strings.TrimRight(config.URL, "/") + "/v1/devices/" + id + "/samples",
+		token: config.Token,
+		// each device has its own client, so it has its own connection
+		client: &http.Client{Timeout: config.Timeout},
+	}
+}
+
+func (s *httpSender) send(samples []data.Sample) error {
+	body, err := json.Marshal(samples)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// the body is read so the connection is reused
+	b, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Server error: %v %v", resp.Status,
+			strings.TrimSpace(string(b)))
+	}
+
+	return nil
+}
+
+func (s *httpSender) close() {
+	s.client.CloseIdleConnections()
+}
+
+// waitConnected waits for a NATS or MQTT client to connect
+func waitConnected(connected func() bool, timeout time.Duration) error {
+	start := time.Now()
+	for !connected() {
+		if time.Since(start) > timeout {
+			return errors.New("timeout connecting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// natsSender sends samples with NATS requests
+type natsSender struct {
+	conn    *nats.Client
+	subject string
+	timeout time.Duration
+}
+
+func newNATSSender(config Config, id string) (*natsSender, error) {
+	conn := nats.NewClient(nats.ClientConfig{
+		Server:   config.URL,
+		Name:     id,
+		Password: config.Token,
+		Timeout:  config.Timeout,
+	})
+	conn.Start()
+
+	err := waitConnected(conn.Connected, config.Timeout)
+	if err != nil {
+		conn.Stop()
+		return nil, err
+	}
+
+	return &natsSender{
+		conn:    conn,
+		subject: config.Prefix + "." + id + ".samples",
+		timeout: config.Timeout,
+	}, nil
+}
+
+func (s *natsSender) send(samples []data.Sample) error {
+	payload, err := json.Marshal(samples)
+	if err != nil {
+		return err
+	}
+
+	msg, err := nats.Request(s.conn, s.subject, payload, s.timeout)
+	if err != nil {
+		return err
+	}
+
+	var resp data.StandardResponse
+	err = json.Unmarshal(msg.Data, &resp)
+	if err != nil {
+		return err
+	}
+
+	if !resp.Success {
+		return errors.New(resp.Error)
+	}
+
+	return nil
+}
+
+func (s *natsSender) close() {
+	s.conn.Stop()
+}
+
+// mqttSender publishes samples with QoS 1
+type mqttSender struct {
+	conn  *mqtt.Client
+	topic string
+}
+
+func newMQTTSender(config Config, id string) (*mqttSender, error) {
+	conn := mqtt.NewClient(mqtt.ClientConfig{
+		Broker:   config.URL,
+		ClientID: id,
+		Password: config.Token,
+		Timeout:  config.Timeout,
+	})
+	conn.Start()
+
+	err := waitConnected(conn.Connected, config.Timeout)
+	if err != nil {
+		conn.Stop()
+		return nil, err
+	}
+
+	return &mqttSender{conn: conn, topic: config.Prefix + "/" + id + "/samples"}, nil
+}
+
+func (s *mqttSender) send(samples []data.Sample) error {
+	payload, err := json.Marshal(samples)
+	if err != nil {
+		return err
+	}
+
+	return s.conn.Publish(s.topic, payload, 1, false)
+}
+
+func (s *mqttSender) close() {
+	s.conn.Stop()
+}
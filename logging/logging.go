@@ -0,0 +1,407 @@
+// Package logging is a leveled, structured logger. Each part of the
+// application logs with a module logger, and the level of each module can
+// be changed while the application runs, so one module can log at debug
+// level without flooding the log with every other module's debug output.
+//
+// Log lines are written as text for consoles, or as JSON for log
+// collectors:
+//
+//	2020/01/02 15:04:05 INFO modem: connected apn=iot.example
+//	{"time":"2020-01-02T15:04:05Z","level":"info","module":"modem","msg":"connected","apn":"iot.example"}
+//
+// Fields are passed as key value pairs after the message.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message
+type Level int
+
+// define log levels
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name
+func ParseLevel(s string) (Level, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "warning" {
+		return LevelWarn, nil
+	}
+
+	for i, n := range levelNames {
+		if s == n {
+			return Level(i), nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("invalid log level: %v", s)
+}
+
+// define log formats
+const (
+	FormatConsole = "console"
+	FormatJSON    = "json"
+)
+
+// ParseModules parses module levels like "modem=debug,nats=warn"
+func ParseModules(s string) (map[string]Level, error) {
+	ret := make(map[string]Level)
+	for _, m := range strings.Split(s, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+
+		kv := strings.SplitN(m, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid module level, expected module=level: %v", m)
+		}
+
+		l, err := ParseLevel(kv[1])
+		if err != nil {
+			return nil, err
+		}
+
+		ret[strings.TrimSpace(kv[0])] = l
+	}
+
+	return ret, nil
+}
+
+// state is the configuration shared by all loggers
+type state struct {
+	lock    sync.RWMutex
+	out     io.Writer
+	format  string
+	level   Level
+	modules map[string]Level
+	known   map[string]bool
+}
+
+var std = &state{
+	out:     os.Stderr,
+	format:  FormatConsole,
+	level:   LevelInfo,
+	modules: make(map[string]Level),
+	known:   make(map[string]bool),
+}
+
+// SetOutput sets where log lines are written (default stderr)
+func SetOutput(w io.Writer) {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+	std.out = w
+}
+
+// SetFormat sets the log format, FormatConsole or FormatJSON
+func SetFormat(format string) error {
+	if format != FormatConsole && format != FormatJSON {
+		return fmt.Errorf("invalid log format: %v", format)
+	}
+
+	std.lock.Lock()
+	defer std.lock.Unlock()
+	std.format = format
+	return nil
+}
+
+// SetLevel sets the level of modules that don't have their own level
+func SetLevel(l Level) {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+	std.level = l
+}
+
+// SetModuleLevel sets the level of a module
+func SetModuleLevel(module string, l Level) {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+	std.modules[module] = l
+	std.known[module] = true
+}
+
+// ResetModuleLevel makes a module use the default level again
+func ResetModuleLevel(module string) {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+	delete(std.modules, module)
+}
+
+// Settings are the log settings. They are returned by Current and changed
+// with Apply, like by the admin API.
+type Settings struct {
+	// Level is the level of modules that don't have their own level
+	Level string `json:"level,omitempty"`
+	// Format is console or json
+	Format string `json:"format,omitempty"`
+	// Modules are the modules with their own level. When applied, a blank
+	// level makes a module use the default level again.
+	Modules map[string]string `json:"modules,omitempty"`
+	// Known are the modules that have logged or have a logger
+	Known []string `json:"known,omitempty"`
+}
+
+// Current returns the current settings
+func Current() Settings {
+	std.lock.RLock()
+	defer std.lock.RUnlock()
+
+	ret := Settings{
+		Level:   std.level.String(),
+		Format:  std.format,
+		Modules: make(map[string]string),
+	}
+
+	for m, l := range std.modules {
+		ret.Modules[m] = l.String()
+	}
+
+	for m := range std.known {
+		ret.Known = append(ret.Known, m)
+	}
+	sort.Strings(ret.Known)
+
+	return ret
+}
+
+// Apply changes the settings that are set in s. Nothing is changed if any
+// of them are invalid.
+func Apply(s Settings) error {
+	level := LevelInfo
+	var err error
+	if s.Level != "" {
+		level, err = ParseLevel(s.Level)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.Format != "" && s.Format != FormatConsole && s.Format != FormatJSON {
+		return fmt.Errorf("invalid log format: %v", s.Format)
+	}
+
+	modules := make(map[string]Level)
+	for m, l := range s.Modules {
+		if m == "" {
+			return fmt.Errorf("blank module name")
+		}
+
+		if l == "" {
+			continue
+		}
+
+		modules[m], err = ParseLevel(l)
+		if err != nil {
+			return err
+		}
+	}
+
+	std.lock.Lock()
+	defer std.lock.Unlock()
+
+	if s.Level != "" {
+		std.level = level
+	}
+
+	if s.Format != "" {
+		std.format = s.Format
+	}
+
+	for m, l := range s.Modules {
+		if l == "" {
+			delete(std.modules, m)
+		} else {
+			std.modules[m] = modules[m]
+			std.known[m] = true
+		}
+	}
+
+	return nil
+}
+
+// enabled returns true if a module logs at level l. Must be called with
+// the lock held.
+func (s *state) enabled(module string, l Level) bool {
+	min, ok := s.modules[module]
+	if !ok {
+		min = s.level
+	}
+	return l >= min
+}
+
+// Logger logs messages for a module
+type Logger struct {
+	module string
+}
+
+// Module returns the logger of a module. Loggers are typically package
+// variables:
+//
+//	var log = logging.Module("modem")
+func Module(name string) *Logger {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+	std.known[name] = true
+	return &Logger{module: name}
+}
+
+// Enabled returns true if messages at level l are logged, so expensive
+// fields are only computed when needed
+func (l *Logger) Enabled(level Level) bool {
+	std.lock.RLock()
+	defer std.lock.RUnlock()
+	return std.enabled(l.module, level)
+}
+
+// Debug logs a message for troubleshooting
+func (l *Logger) Debug(msg string, fields ...interface{}) {
+	l.Log(LevelDebug, msg, fields...)
+}
+
+// Info logs a message about normal operation
+func (l *Logger) Info(msg string, fields ...interface{}) {
+	l.Log(LevelInfo, msg, fields...)
+}
+
+// Warn logs a message about a problem that was handled
+func (l *Logger) Warn(msg string, fields ...interface{}) {
+	l.Log(LevelWarn, msg, fields...)
+}
+
+// Error logs a message about a failed operation
+func (l *Logger) Error(msg string, fields ...interface{}) {
+	l.Log(LevelError, msg, fields...)
+}
+
+// Log logs a message at a level. fields are key value pairs.
+func (l *Logger) Log(level Level, msg string, fields ...interface{}) {
+	std.lock.RLock()
+	if !std.enabled(l.module, level) {
+		std.lock.RUnlock()
+		return
+	}
+	out, format := std.out, std.format
+	std.lock.RUnlock()
+
+	var b bytes.Buffer
+	if format == FormatJSON {
+		formatJSON(&b, time.Now(), level, l.module, msg, fields)
+	} else {
+		formatConsole(&b, time.Now(), level, l.module, msg, fields)
+	}
+
+	// lines are written with one Write so they aren't interleaved
+	std.lock.Lock()
+	out.Write(b.Bytes())
+	std.lock.Unlock()
+}
+
+// value returns a field value that formats well, like the message of an
+// error
+func value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+// pairs returns the keys and values of fields. A value without a key gets
+// the key "extra".
+func pairs(fields []interface{}) ([]string, []interface{}) {
+	var keys []string
+	var values []interface{}
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 >= len(fields) {
+			keys = append(keys, "extra")
+			values = append(values, value(fields[i]))
+			break
+		}
+
+		keys = append(keys, fmt.Sprint(fields[i]))
+		values = append(values, value(fields[i+1]))
+	}
+	return keys, values
+}
+
+func formatConsole(b *bytes.Buffer, t time.Time, level Level, module, msg string, fields []interface{}) {
+	b.WriteString(t.Format("2006/01/02 15:04:05 "))
+	b.WriteString(strings.ToUpper(level.String()))
+	b.WriteByte(' ')
+	if module != "" {
+		b.WriteString(module)
+		b.WriteString(": ")
+	}
+	b.WriteString(msg)
+
+	keys, values := pairs(fields)
+	for i, k := range keys {
+		s := fmt.Sprint(values[i])
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			s = strconv.Quote(s)
+		}
+
+		b.WriteByte(' ')
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(s)
+	}
+
+	b.WriteByte('\n')
+}
+
+func formatJSON(b *bytes.Buffer, t time.Time, level Level, module, msg string, fields []interface{}) {
+	keys, values := pairs(fields)
+	keys = append([]string{"time", "level", "module", "msg"}, keys...)
+	values = append([]interface{}{t.UTC().Format(time.RFC3339Nano),
+		level.String(), module, msg}, values...)
+
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i == 2 && module == "" {
+			continue
+		}
+
+		v, err := json.Marshal(values[i])
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(values[i]))
+		}
+
+		kj, _ := json.Marshal(k)
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		b.Write(kj)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteString("}\n")
+}
@@ -0,0 +1,212 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reset restores the default settings
+func reset() {
+	SetOutput(os.Stderr)
+	SetFormat(FormatConsole)
+	SetLevel(LevelInfo)
+	for m := range Current().Modules {
+		ResetModuleLevel(m)
+	}
+}
+
+func TestLevels(t *testing.T) {
+	defer reset()
+
+	var out bytes.Buffer
+	SetOutput(&out)
+
+	modem := Module("modem")
+	nats := Module("nats")
+
+	modem.Debug("hidden")
+	nats.Info("shown")
+	if strings.Contains(out.String(), "hidden") || !strings.Contains(out.String(), "shown") {
+		t.Fatal("Wrong output at info level: ", out.String())
+	}
+
+	// one module can log at debug level without the others
+	SetModuleLevel("modem", LevelDebug)
+	out.Reset()
+	modem.Debug("modem debug")
+	nats.Debug("nats debug")
+	if !strings.Contains(out.String(), "modem debug") || strings.Contains(out.String(), "nats debug") {
+		t.Fatal("Wrong output with modem at debug level: ", out.String())
+	}
+
+	SetModuleLevel("nats", LevelError)
+	out.Reset()
+	nats.Warn("warning")
+	if out.Len() != 0 {
+		t.Error("Warning was logged at error level")
+	}
+
+	if !modem.Enabled(LevelDebug) || nats.Enabled(LevelWarn) {
+		t.Error("Wrong enabled levels")
+	}
+
+	ResetModuleLevel("modem")
+	if modem.Enabled(LevelDebug) {
+		t.Error("Module level was not reset")
+	}
+}
+
+func TestFormats(t *testing.T) {
+	defer reset()
+
+	var out bytes.Buffer
+	SetOutput(&out)
+
+	l := Module("modem")
+	l.Error("connect failed", "apn", "iot example", "error", errors.New("timeout"),
+		"tries", 3, "delay", 5*time.Second, "odd")
+
+	line := out.String()
+	for _, s := range []string{
+		" ERROR modem: connect failed",
+		` apn="iot example"`,
+		" error=timeout",
+		" tries=3",
+		" delay=5s",
+		" extra=odd",
+	} {
+		if !strings.Contains(line, s) {
+			t.Errorf("Console line %q does not contain %q", line, s)
+		}
+	}
+
+	err := SetFormat("xml")
+	if err == nil {
+		t.Error("Expected error for invalid format")
+	}
+
+	SetFormat(FormatJSON)
+	out.Reset()
+	l.Warn("signal low", "rssi", -105, "error", errors.New("no cell"))
+
+	var m map[string]interface{}
+	err = json.Unmarshal(out.Bytes(), &m)
+	if err != nil {
+		t.Fatal("Error parsing JSON line: ", err, out.String())
+	}
+
+	if m["level"] != "warn" || m["module"] != "modem" || m["msg"] != "signal low" ||
+		m["rssi"] != float64(-105) || m["error"] != "no cell" || m["time"] == nil {
+		t.Error("Wrong JSON line: ", out.String())
+	}
+}
+
+func TestSettings(t *testing.T) {
+	defer reset()
+
+	Module("gps")
+
+	err := Apply(Settings{Level: "warn", Format: "json",
+		Modules: map[string]string{"gps": "debug"}})
+	if err != nil {
+		t.Fatal("Error applying settings: ", err)
+	}
+
+	s := Current()
+	if s.Level != "warn" || s.Format != "json" || s.Modules["gps"] != "debug" {
+		t.Error("Wrong settings: ", s)
+	}
+
+	found := false
+	for _, k := range s.Known {
+		if k == "gps" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("gps module not known: ", s.Known)
+	}
+
+	// invalid settings change nothing
+	err = Apply(Settings{Level: "info", Modules: map[string]string{"gps": "loud"}})
+	if err == nil {
+		t.Error("Expected error for invalid module level")
+	}
+
+	if Current().Level != "warn" {
+		t.Error("Settings changed by invalid settings")
+	}
+
+	// a blank level resets a module
+	err = Apply(Settings{Modules: map[string]string{"gps": ""}})
+	if err != nil {
+		t.Fatal("Error applying settings: ", err)
+	}
+
+	if _, ok := Current().Modules["gps"]; ok {
+		t.Error("Module level was not reset")
+	}
+
+	modules, err := ParseModules("modem=debug, nats = warning,")
+	if err != nil {
+		t.Fatal("Error parsing modules: ", err)
+	}
+
+	if len(modules) != 2 || modules["modem"] != LevelDebug || modules["nats"] != LevelWarn {
+		t.Error("Wrong modules: ", modules)
+	}
+
+	for _, s := range []string{"modem", "=debug", "modem=loud"} {
+		_, err := ParseModules(s)
+		if err == nil {
+			t.Errorf("Expected error parsing %q", s)
+		}
+	}
+}
+
+func TestStdLog(t *testing.T) {
+	defer reset()
+	defer log.SetOutput(os.Stderr)
+	defer log.SetFlags(log.LstdFlags)
+
+	var out bytes.Buffer
+	SetOutput(&out)
+	SetFormat(FormatJSON)
+	CaptureStdLog()
+
+	for _, c := range []struct {
+		msg, module, level, text string
+	}{
+		{"NATS: error writing samples", "nats", "error", "error writing samples"},
+		{"PPP: started pppd", "ppp", "info", "started pppd"},
+		{"Error loading rules: bad rule", "main", "error", "Error loading rules: bad rule"},
+		{"Starting http server, debug: false", "main", "info", "Starting http server, debug: false"},
+	} {
+		out.Reset()
+		log.Println(c.msg)
+
+		var m map[string]interface{}
+		err := json.Unmarshal(out.Bytes(), &m)
+		if err != nil {
+			t.Fatal("Error parsing JSON line: ", err, out.String())
+		}
+
+		if m["module"] != c.module || m["level"] != c.level || m["msg"] != c.text {
+			t.Errorf("Wrong line for %q: %v", c.msg, out.String())
+		}
+	}
+
+	// std log messages follow the module levels
+	SetModuleLevel("ppp", LevelWarn)
+	out.Reset()
+	log.Println("PPP: started pppd")
+	if out.Len() != 0 {
+		t.Error("Info message logged at warn level")
+	}
+}
@@ -0,0 +1,62 @@
+package logging
+
+import (
+	"log"
+	"strings"
+	"unicode"
+)
+
+// stdWriter logs the messages of the standard log package
+type stdWriter struct{}
+
+// CaptureStdLog sends messages of the standard log package through the
+// logger, so code that hasn't moved to module loggers still gets the
+// format and module levels. A message that starts with a one word prefix,
+// like "NATS: connected", is logged for that module in lower case. Other
+// messages are logged for the "main" module. Messages that mention an
+// error are logged at error level, and the rest at info level.
+func CaptureStdLog() {
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(stdWriter{})
+}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	module, level, msg := parseStd(strings.TrimRight(string(p), "\n"))
+	(&Logger{module: module}).Log(level, msg)
+	return len(p), nil
+}
+
+// parseStd returns the module, level, and message of a standard log
+// message
+func parseStd(line string) (string, Level, string) {
+	module, msg := "main", line
+
+	if i := strings.Index(line, ":"); i > 0 {
+		prefix := line[:i]
+		isWord := true
+		for _, r := range prefix {
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				isWord = false
+				break
+			}
+		}
+
+		// "Error: ..." is a message, not a module
+		if isWord && !strings.EqualFold(prefix, "error") {
+			module = strings.ToLower(prefix)
+			msg = strings.TrimSpace(line[i+1:])
+		}
+	}
+
+	level := LevelInfo
+	if strings.Contains(strings.ToLower(line), "error") {
+		level = LevelError
+	}
+
+	std.lock.Lock()
+	std.known[module] = true
+	std.lock.Unlock()
+
+	return module, level, msg
+}
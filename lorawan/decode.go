@@ -0,0 +1,190 @@
+package lorawan
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// cayenneType is a Cayenne LPP data type. Values are signed if size is
+// negative, and are divided by div. Types with more than one value, like
+// GPS, have a suffix for each value.
+type cayenneType struct {
+	name     string
+	size     int
+	div      float64
+	suffixes []string
+}
+
+var cayenneTypes = map[byte]cayenneType{
+	0:   {"digital_input", 1, 1, nil},
+	1:   {"digital_output", 1, 1, nil},
+	2:   {"analog_input", -2, 100, nil},
+	3:   {"analog_output", -2, 100, nil},
+	101: {"illuminance", 2, 1, nil},
+	102: {"presence", 1, 1, nil},
+	103: {"temperature", -2, 10, nil},
+	104: {"humidity", 1, 2, nil},
+	113: {"accelerometer", -2, 1000, []string{"_x", "_y", "_z"}},
+	115: {"barometer", 2, 10, nil},
+	134: {"gyrometer", -2, 100, []string{"_x", "_y", "_z"}},
+	// gps is latitude, longitude, and altitude, which have different
+	// divisors
+	136: {"gps", -3, 1, nil},
+}
+
+// readInt reads a big endian integer of size bytes
+func readInt(b []byte, size int) float64 {
+	signed := size < 0
+	if signed {
+		size = -size
+	}
+
+	var v uint32
+	for i := 0; i < size; i++ {
+		v = v<<8 | uint32(b[i])
+	}
+
+	if signed {
+		// sign extend
+		shift := uint(32 - 8*size)
+		return float64(int32(v<<shift) >> shift)
+	}
+	return float64(v)
+}
+
+// decodeCayenne decodes a Cayenne LPP payload. The channel is the sample
+// ID.
+func decodeCayenne(payload []byte) ([]data.Sample, error) {
+	var ret []data.Sample
+
+	for len(payload) > 0 {
+		if len(payload) < 2 {
+			return nil, errors.New("cayenne payload is truncated")
+		}
+
+		id := strconv.Itoa(int(payload[0]))
+		t, ok := cayenneTypes[payload[1]]
+		if !ok {
+			return nil, fmt.Errorf("unsupported cayenne type: %v", payload[1])
+		}
+		payload = payload[2:]
+
+		if t.name == "gps" {
+			if len(payload) < 9 {
+				return nil, errors.New("cayenne payload is truncated")
+			}
+
+			ret = append(ret,
+				data.Sample{Type: "latitude", ID: id, Value: readInt(payload, -3) / 10000},
+				data.Sample{Type: "longitude", ID: id, Value: readInt(payload[3:], -3) / 10000},
+				data.Sample{Type: "altitude", ID: id, Value: readInt(payload[6:], -3) / 100})
+			payload = payload[9:]
+			continue
+		}
+
+		size := t.size
+		if size < 0 {
+			size = -size
+		}
+
+		suffixes := t.suffixes
+		if suffixes == nil {
+			suffixes = []string{""}
+		}
+
+		if len(payload) < size*len(suffixes) {
+			return nil, errors.New("cayenne payload is truncated")
+		}
+
+		for _, s := range suffixes {
+			ret = append(ret, data.Sample{Type: t.name + s, ID: id,
+				Value: readInt(payload, t.size) / t.div})
+			payload = payload[size:]
+		}
+	}
+
+	return ret, nil
+}
+
+// decodeObject returns samples for the number and boolean fields of an
+// object decoded by the network server. Nested fields are joined with a
+// dot, like sensor.temp.
+func decodeObject(prefix string, object map[string]interface{}) []data.Sample {
+	keys := make([]string, 0, len(object))
+	for k := range object {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var ret []data.Sample
+	for _, k := range keys {
+		switch v := object[k].(type) {
+		case float64:
+			ret = append(ret, data.Sample{Type: prefix + k, Value: v})
+		case bool:
+			s := data.Sample{Type: prefix + k}
+			if v {
+				s.Value = 1
+			}
+			ret = append(ret, s)
+		case map[string]interface{}:
+			ret = append(ret, decodeObject(prefix+k+".", v)...)
+		}
+	}
+
+	return ret
+}
+
+// decodeFields decodes the configured fields of a payload
+func decodeFields(fields []data.LorawanField, payload []byte) ([]data.Sample, error) {
+	var ret []data.Sample
+	for _, f := range fields {
+		v, ok := f.Value(payload)
+		if !ok {
+			return nil, fmt.Errorf("payload is too short for field %v", f.Type)
+		}
+		ret = append(ret, data.Sample{Type: f.Type, ID: f.ID, Value: v})
+	}
+	return ret, nil
+}
+
+// Decode returns the samples in an uplink, plus rssi and snr samples if
+// the signal was reported. decoder is used if config does not set one.
+func Decode(u Uplink, config data.LorawanConfig, decoder string) ([]data.Sample, error) {
+	if config.Decoder != "" {
+		decoder = config.Decoder
+	}
+
+	var samples []data.Sample
+	var err error
+
+	switch decoder {
+	case "", data.LorawanObject:
+		samples = decodeObject("", u.Object)
+	case data.LorawanCayenne:
+		samples, err = decodeCayenne(u.Payload)
+	case data.LorawanFields:
+		samples, err = decodeFields(config.Fields, u.Payload)
+	default:
+		err = fmt.Errorf("unsupported decoder: %v", decoder)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.HasSignal {
+		samples = append(samples, data.Sample{Type: "rssi", Value: u.RSSI},
+			data.Sample{Type: "snr", Value: u.SNR})
+	}
+
+	for i := range samples {
+		samples[i].Time = u.Time
+	}
+
+	return samples, nil
+}
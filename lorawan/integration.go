@@ -0,0 +1,337 @@
+package lorawan
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/mqtt"
+)
+
+// Config describes how the integration connects to the network server
+type Config struct {
+	// Network is chirpstack or ttn
+	Network string
+	// Decoder is used for devices that don't set one in their config
+	// (default object)
+	Decoder string
+	// Token is required in the Authorization header of webhooks
+	Token string
+	// Write stores samples from devices, typically api.WriteSamples or
+	// db.IngestQueue.Enqueue
+	Write func(id string, samples []data.Sample) error
+}
+
+// Integration receives uplinks from a network server and sends commands as
+// downlinks. Uplinks are received on these MQTT topics, and downlinks are
+// published to the device topic of the last uplink:
+//
+//	ChirpStack: application/<app id>/device/<DevEUI>/event/up and
+//	application/<app id>/device/<DevEUI>/command/down
+//	TTN: v3/<app id>@<tenant>/devices/<device id>/up and
+//	v3/<app id>@<tenant>/devices/<device id>/down/push
+//
+// Commands are sent when they are queued and when the device sends an
+// uplink, and are removed from the queue once the broker acks them.
+type Integration struct {
+	conn   mqtt.Conn
+	db     *db.Db
+	config Config
+	lock   sync.Mutex
+	// routes are the MQTT topic prefixes of devices, which are only
+	// known after an uplink
+	routes map[string]string
+	// cmdLock keeps a command from being sent twice
+	cmdLock sync.Mutex
+	events  <-chan db.Event
+	stop    chan struct{}
+}
+
+// NewIntegration creates an integration. conn is the network server's MQTT
+// broker, and can be nil if uplinks are only received with webhooks, in
+// which case downlinks are not supported.
+func NewIntegration(conn mqtt.Conn, dbInst *db.Db, config Config) *Integration {
+	if config.Decoder == "" {
+		config.Decoder = data.LorawanObject
+	}
+
+	return &Integration{
+		conn:   conn,
+		db:     dbInst,
+		config: config,
+		routes: make(map[string]string),
+		stop:   make(chan struct{}),
+	}
+}
+
+// topics returns the uplink topic filter, and the suffixes of the uplink
+// and downlink topics
+func (i *Integration) topics() (filter, up, down string) {
+	if i.config.Network == NetworkTTN {
+		return "v3/+/devices/+/up", "/up", "/down/push"
+	}
+	return "application/+/device/+/event/up", "/event/up", "/command/down"
+}
+
+// Start subscribes to uplinks and sends queued commands until Stop is
+// called
+func (i *Integration) Start() error {
+	if i.conn == nil {
+		return nil
+	}
+
+	filter, up, _ := i.topics()
+	err := i.conn.Subscribe(filter, 1, func(msg mqtt.Message) {
+		err := i.HandleUplink(strings.TrimSuffix(msg.Topic, up), msg.Payload)
+		if err != nil {
+			log.Printf("LoRaWAN: error handling uplink on %v: %v\n", msg.Topic, err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	i.events = i.db.Subscribe(db.EventFilter{
+		Types: []db.EventType{db.EventCommandQueued},
+	})
+
+	go func() {
+		for {
+			select {
+			case e, ok := <-i.events:
+				if !ok {
+					return
+				}
+
+				// the command may have been sent by sendPending before
+				// the event was received
+				i.cmdLock.Lock()
+				queued, err := i.db.CommandQueued(*e.Command)
+				if err == nil && queued {
+					err = i.sendCommand(*e.Command)
+				}
+				i.cmdLock.Unlock()
+				if err != nil && err != errNoRoute {
+					log.Printf("LoRaWAN: error sending command to %v: %v\n",
+						e.DeviceID, err)
+				}
+			case <-i.stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the integration
+func (i *Integration) Stop() {
+	close(i.stop)
+	if i.events != nil {
+		i.db.Unsubscribe(i.events)
+	}
+}
+
+// ValidToken checks the token of a webhook request. Webhooks are disabled
+// if the token is not configured.
+func (i *Integration) ValidToken(token string) bool {
+	return data.TokenEqual(token, i.config.Token)
+}
+
+// HandleUplink decodes an uplink and writes the samples. route is the MQTT
+// topic prefix of the device, and is blank for webhooks.
+func (i *Integration) HandleUplink(route string, payload []byte) error {
+	u, err := ParseUplink(i.config.Network, payload)
+	if err != nil {
+		return err
+	}
+
+	id := u.DevEUI
+
+	// create new devices, and name them after the network server device
+	dev, err := i.db.Device(id)
+	if err != nil || (dev.Config.Description == "" && u.Name != "") {
+		err := i.db.Update(func(txn *db.Txn) error {
+			d, err := txn.Device(id)
+			if err != nil {
+				return err
+			}
+
+			if d == nil {
+				d = &data.Device{ID: id}
+			}
+
+			dev = *d
+			if d.Config.Description != "" {
+				return nil
+			}
+
+			dev.Config.Description = u.Name
+			return txn.DeviceUpdate(dev)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var config data.LorawanConfig
+	if dev.Config.Lorawan != nil {
+		config = *dev.Config.Lorawan
+	}
+
+	samples, err := Decode(u, config, i.config.Decoder)
+	if err != nil {
+		return fmt.Errorf("error decoding uplink from %v: %v", id, err)
+	}
+
+	if len(samples) > 0 {
+		err = i.config.Write(id, samples)
+		if err != nil {
+			return err
+		}
+	}
+
+	if route != "" && i.conn != nil {
+		i.lock.Lock()
+		i.routes[id] = route
+		i.lock.Unlock()
+
+		// class A devices can only receive a downlink after an uplink,
+		// so this is a good time to send commands. This can't block the
+		// client read loop, which reads the acks.
+		go i.sendPending(id)
+	}
+
+	return nil
+}
+
+var errNoRoute = errors.New("no uplink received from device")
+
+// Downlink returns the port and payload a command is sent with. The
+// payload is from the device's downlinks config, or the hex payload arg of
+// the command. The port can be set with the fPort arg.
+func Downlink(cmd data.DeviceCommand, config data.LorawanConfig) (fPort int, payload []byte, err error) {
+	p, ok := config.Downlinks[cmd.Command]
+	if !ok {
+		p, ok = cmd.Args["payload"]
+	}
+	if !ok {
+		return 0, nil, fmt.Errorf("no downlink for command %v", cmd.Command)
+	}
+
+	payload, err = hex.DecodeString(p)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid payload for command %v: %v", cmd.Command, err)
+	}
+
+	fPort = config.FPort
+	if v, ok := cmd.Args["fPort"]; ok {
+		fPort, err = strconv.Atoi(v)
+		if err != nil || fPort < 1 || fPort > 223 {
+			return 0, nil, errors.New("fPort must be 1 to 223")
+		}
+	}
+
+	if fPort == 0 {
+		fPort = 1
+	}
+
+	return fPort, payload, nil
+}
+
+// chirpstackDownlink is a ChirpStack downlink command
+type chirpstackDownlink struct {
+	DevEUI    string `json:"devEui"`
+	Confirmed bool   `json:"confirmed"`
+	FPort     int    `json:"fPort"`
+	Data      []byte `json:"data"`
+}
+
+// ttnDownlink is a TTN downlink message
+type ttnDownlink struct {
+	FPort      int    `json:"f_port"`
+	FrmPayload []byte `json:"frm_payload"`
+	Confirmed  bool   `json:"confirmed"`
+	Priority   string `json:"priority"`
+}
+
+// sendCommand publishes a command as a downlink and removes it from the
+// queue when the broker acks it. Commands that can't be mapped to a
+// downlink are removed. i.cmdLock must be held.
+func (i *Integration) sendCommand(cmd data.DeviceCommand) error {
+	i.lock.Lock()
+	route, ok := i.routes[cmd.DeviceID]
+	i.lock.Unlock()
+
+	if !ok {
+		return errNoRoute
+	}
+
+	dev, err := i.db.Device(cmd.DeviceID)
+	if err != nil {
+		return err
+	}
+
+	var config data.LorawanConfig
+	if dev.Config.Lorawan != nil {
+		config = *dev.Config.Lorawan
+	}
+
+	fPort, payload, err := Downlink(cmd, config)
+	if err != nil {
+		log.Printf("LoRaWAN: dropping command %v for %v: %v\n", cmd.ID,
+			cmd.DeviceID, err)
+		return i.db.CommandDelete(cmd.ID)
+	}
+
+	var msg interface{}
+	if i.config.Network == NetworkTTN {
+		msg = struct {
+			Downlinks []ttnDownlink `json:"downlinks"`
+		}{[]ttnDownlink{{fPort, payload, config.Confirmed, "NORMAL"}}}
+	} else {
+		msg = chirpstackDownlink{cmd.DeviceID, config.Confirmed, fPort, payload}
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, _, down := i.topics()
+	err = i.conn.Publish(route+down, b, 1, false)
+	if err != nil {
+		// the command stays queued
+		return err
+	}
+
+	return i.db.CommandDelete(cmd.ID)
+}
+
+func (i *Integration) sendPending(id string) {
+	i.cmdLock.Lock()
+	defer i.cmdLock.Unlock()
+
+	cmds, err := i.db.DeviceCommands(id)
+	if err != nil {
+		log.Printf("LoRaWAN: error reading commands for %v: %v\n", id, err)
+		return
+	}
+
+	for _, cmd := range cmds {
+		err := i.sendCommand(cmd)
+		if errors.Is(err, mqtt.ErrNotConnected) || errors.Is(err, mqtt.ErrNoSubscribers) {
+			return
+		}
+		if err != nil {
+			log.Printf("LoRaWAN: error sending command to %v: %v\n", id, err)
+		}
+	}
+}
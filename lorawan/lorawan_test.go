@@ -0,0 +1,360 @@
+package lorawan
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/mqtt"
+)
+
+const chirpstackV4Uplink = `{
+	"time": "2022-07-18T09:34:15Z",
+	"deviceInfo": {"applicationId": "app", "deviceName": "pump", "devEui": "0101010101010101"},
+	"fPort": 1,
+	"data": "AWcA6w==",
+	"object": {"temp": 23.5, "on": true, "status": "ok", "sensor": {"level": 3}},
+	"rxInfo": [{"rssi": -90, "snr": 2}, {"rssi": -60, "snr": 10.5}]
+}`
+
+const chirpstackV3Uplink = `{
+	"applicationID": "1",
+	"deviceName": "tank",
+	"devEUI": "0202020202020202",
+	"fPort": 5,
+	"data": "AQI=",
+	"objectJSON": "{\"level\": 7}",
+	"rxInfo": [{"rssi": -57, "loRaSNR": 9}]
+}`
+
+const ttnUplinkMsg = `{
+	"end_device_ids": {"device_id": "valve-1", "dev_eui": "0004A30B001C0530"},
+	"received_at": "2022-07-18T09:34:15Z",
+	"uplink_message": {
+		"f_port": 2,
+		"frm_payload": "AGQ=",
+		"decoded_payload": {"battery": 3.6}
+	}
+}`
+
+func TestParseUplink(t *testing.T) {
+	u, err := ParseUplink(NetworkChirpstack, []byte(chirpstackV4Uplink))
+	if err != nil {
+		t.Fatal("Error parsing v4 uplink: ", err)
+	}
+
+	if u.DevEUI != "0101010101010101" || u.Name != "pump" || u.FPort != 1 ||
+		!reflect.DeepEqual(u.Payload, []byte{1, 0x67, 0, 0xeb}) ||
+		u.RSSI != -60 || u.SNR != 10.5 || !u.HasSignal ||
+		!u.Time.Equal(time.Date(2022, 7, 18, 9, 34, 15, 0, time.UTC)) {
+		t.Errorf("wrong v4 uplink: %+v", u)
+	}
+
+	u, err = ParseUplink(NetworkChirpstack, []byte(chirpstackV3Uplink))
+	if err != nil {
+		t.Fatal("Error parsing v3 uplink: ", err)
+	}
+
+	if u.DevEUI != "0202020202020202" || u.Name != "tank" ||
+		u.Object["level"] != float64(7) || u.SNR != 9 || u.Time.IsZero() {
+		t.Errorf("wrong v3 uplink: %+v", u)
+	}
+
+	u, err = ParseUplink(NetworkTTN, []byte(ttnUplinkMsg))
+	if err != nil {
+		t.Fatal("Error parsing TTN uplink: ", err)
+	}
+
+	if u.DevEUI != "0004a30b001c0530" || u.Name != "valve-1" || u.FPort != 2 ||
+		!reflect.DeepEqual(u.Payload, []byte{0, 100}) || u.HasSignal {
+		t.Errorf("wrong TTN uplink: %+v", u)
+	}
+
+	for _, c := range []struct {
+		network, payload string
+	}{
+		{NetworkChirpstack, `{"devEUI": "0102"}`},
+		{NetworkTTN, `{"end_device_ids": {"dev_eui": "0004A30B001C0530"}}`},
+		{"loriot", chirpstackV4Uplink},
+	} {
+		_, err := ParseUplink(c.network, []byte(c.payload))
+		if err == nil {
+			t.Errorf("expected error for %v", c.payload)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	u := Uplink{
+		Object: map[string]interface{}{"temp": 23.5, "on": true, "status": "ok",
+			"sensor": map[string]interface{}{"level": float64(3)}},
+		RSSI: -60, SNR: 10, HasSignal: true,
+	}
+
+	samples, err := Decode(u, data.LorawanConfig{}, data.LorawanObject)
+	if err != nil {
+		t.Fatal("Error decoding object: ", err)
+	}
+
+	exp := []data.Sample{{Type: "on", Value: 1}, {Type: "sensor.level", Value: 3},
+		{Type: "temp", Value: 23.5}, {Type: "rssi", Value: -60},
+		{Type: "snr", Value: 10}}
+	if !reflect.DeepEqual(samples, exp) {
+		t.Errorf("wrong object samples: %+v", samples)
+	}
+
+	// temperature on channel 1, humidity on 2, and GPS on 3
+	u = Uplink{Payload: []byte{1, 103, 0xff, 0xd7, 2, 104, 97,
+		3, 136, 0x06, 0x76, 0x5f, 0xf2, 0x96, 0x0a, 0x00, 0x03, 0xe8}}
+	samples, err = Decode(u, data.LorawanConfig{}, data.LorawanCayenne)
+	if err != nil {
+		t.Fatal("Error decoding cayenne: ", err)
+	}
+
+	exp = []data.Sample{{Type: "temperature", ID: "1", Value: -4.1},
+		{Type: "humidity", ID: "2", Value: 48.5},
+		{Type: "latitude", ID: "3", Value: 42.3519},
+		{Type: "longitude", ID: "3", Value: -87.9094},
+		{Type: "altitude", ID: "3", Value: 10}}
+	if !reflect.DeepEqual(samples, exp) {
+		t.Errorf("wrong cayenne samples: %+v", samples)
+	}
+
+	_, err = Decode(Uplink{Payload: []byte{1, 103, 0}}, data.LorawanConfig{},
+		data.LorawanCayenne)
+	if err == nil {
+		t.Error("expected error for truncated cayenne payload")
+	}
+
+	config := data.LorawanConfig{Decoder: data.LorawanFields,
+		Fields: []data.LorawanField{
+			{Type: "level", Start: 1, Format: data.LorawanInt16, Scale: 0.1},
+			{Type: "battery", Start: 0, Offset: 2},
+		}}
+	samples, err = Decode(Uplink{Payload: []byte{1, 0xff, 0xf6}}, config, "")
+	if err != nil {
+		t.Fatal("Error decoding fields: ", err)
+	}
+
+	exp = []data.Sample{{Type: "level", Value: -1}, {Type: "battery", Value: 3}}
+	if !reflect.DeepEqual(samples, exp) {
+		t.Errorf("wrong field samples: %+v", samples)
+	}
+
+	_, err = Decode(Uplink{Payload: []byte{1}}, config, "")
+	if err == nil {
+		t.Error("expected error for short payload")
+	}
+}
+
+func TestIntegration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-lorawan-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbInst, err := db.NewDb(dir, nil)
+	if err != nil {
+		t.Fatal("Error opening db: ", err)
+	}
+	defer dbInst.Close()
+
+	broker := mqtt.NewBroker(mqtt.BrokerConfig{})
+
+	downlinks := make(chan mqtt.Message, 10)
+	err = broker.Subscribe("application/+/device/+/command/down", 1,
+		func(msg mqtt.Message) {
+			downlinks <- msg
+		})
+	if err != nil {
+		t.Fatal("Error subscribing: ", err)
+	}
+
+	i := NewIntegration(broker, dbInst, Config{
+		Network: NetworkChirpstack,
+		Write: func(id string, samples []data.Sample) error {
+			_, err := dbInst.DeviceSamples(id, samples)
+			return err
+		},
+	})
+
+	err = i.Start()
+	if err != nil {
+		t.Fatal("Error starting integration: ", err)
+	}
+	defer i.Stop()
+
+	const id = "0101010101010101"
+
+	// commands are queued until the device sends an uplink
+	err = dbInst.Update(func(txn *db.Txn) error {
+		err := txn.DeviceUpdate(data.Device{ID: id, Config: data.DeviceConfig{
+			Lorawan: &data.LorawanConfig{FPort: 10,
+				Downlinks: map[string]string{"open": "0101"}},
+		}})
+		if err != nil {
+			return err
+		}
+
+		_, err = txn.CommandEnqueue(data.DeviceCommand{DeviceID: id,
+			Command: "open"})
+		return err
+	})
+	if err != nil {
+		t.Fatal("Error queuing command: ", err)
+	}
+
+	err = broker.Publish("application/app/device/"+id+"/event/up",
+		[]byte(chirpstackV4Uplink), 1, false)
+	if err != nil {
+		t.Fatal("Error publishing uplink: ", err)
+	}
+
+	dev, err := dbInst.Device(id)
+	if err != nil {
+		t.Fatal("Error reading device: ", err)
+	}
+
+	if dev.Config.Description != "pump" || len(dev.State.Ios) != 5 {
+		t.Errorf("wrong device: %+v", dev)
+	}
+
+	var down chirpstackDownlink
+	select {
+	case msg := <-downlinks:
+		if msg.Topic != "application/app/device/"+id+"/command/down" {
+			t.Error("wrong downlink topic: ", msg.Topic)
+		}
+		err := json.Unmarshal(msg.Payload, &down)
+		if err != nil {
+			t.Fatal("Error decoding downlink: ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for downlink")
+	}
+
+	if down.DevEUI != id || down.FPort != 10 ||
+		!reflect.DeepEqual(down.Data, []byte{1, 1}) {
+		t.Errorf("wrong downlink: %+v", down)
+	}
+
+	// commands queued after an uplink are sent right away
+	_, err = dbInst.CommandEnqueue(data.DeviceCommand{DeviceID: id,
+		Command: "raw", Args: map[string]string{"payload": "ff", "fPort": "3"}})
+	if err != nil {
+		t.Fatal("Error queuing command: ", err)
+	}
+
+	select {
+	case msg := <-downlinks:
+		err := json.Unmarshal(msg.Payload, &down)
+		if err != nil || down.FPort != 3 || !reflect.DeepEqual(down.Data, []byte{0xff}) {
+			t.Errorf("wrong downlink: %+v, %v", down, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for downlink")
+	}
+
+	// sent commands are removed from the queue
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		cmds, err := dbInst.DeviceCommands(id)
+		if err == nil && len(cmds) == 0 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("commands were not removed: ", cmds, err)
+		}
+	}
+}
+
+func TestIntegrationSendOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-lorawan-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbInst, err := db.NewDb(dir, nil)
+	if err != nil {
+		t.Fatal("Error opening db: ", err)
+	}
+	defer dbInst.Close()
+
+	broker := mqtt.NewBroker(mqtt.BrokerConfig{})
+
+	downlinks := make(chan mqtt.Message, 10)
+	err = broker.Subscribe("application/+/device/+/command/down", 1,
+		func(msg mqtt.Message) {
+			downlinks <- msg
+		})
+	if err != nil {
+		t.Fatal("Error subscribing: ", err)
+	}
+
+	i := NewIntegration(broker, dbInst, Config{
+		Network: NetworkChirpstack,
+		Write: func(id string, samples []data.Sample) error {
+			_, err := dbInst.DeviceSamples(id, samples)
+			return err
+		},
+	})
+
+	err = i.Start()
+	if err != nil {
+		t.Fatal("Error starting integration: ", err)
+	}
+	defer i.Stop()
+
+	const id = "0101010101010101"
+
+	err = broker.Publish("application/app/device/"+id+"/event/up",
+		[]byte(chirpstackV4Uplink), 1, false)
+	if err != nil {
+		t.Fatal("Error publishing uplink: ", err)
+	}
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		i.lock.Lock()
+		_, ok := i.routes[id]
+		i.lock.Unlock()
+		if ok {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timeout waiting for uplink")
+		}
+	}
+
+	// send the command as sendPending does after an uplink, before the
+	// queued event is handled
+	i.cmdLock.Lock()
+	cmd, err := dbInst.CommandEnqueue(data.DeviceCommand{DeviceID: id,
+		Command: "raw", Args: map[string]string{"payload": "ff"}})
+	if err != nil {
+		i.cmdLock.Unlock()
+		t.Fatal("Error queuing command: ", err)
+	}
+	err = i.sendCommand(cmd)
+	i.cmdLock.Unlock()
+	if err != nil {
+		t.Fatal("Error sending command: ", err)
+	}
+
+	select {
+	case <-downlinks:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for downlink")
+	}
+
+	select {
+	case msg := <-downlinks:
+		t.Errorf("command was sent twice: %s", msg.Payload)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,182 @@
+// Package lorawan connects LoRaWAN devices on a ChirpStack or The Things
+// Network (TTN) network server to SIOT. Uplinks are received from the
+// network server's MQTT integration or a webhook, decoded into samples, and
+// written to the device with the DevEUI as the device ID. Devices are
+// created on their first uplink. Commands are sent as downlinks through
+// MQTT.
+package lorawan
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Network servers
+const (
+	// NetworkChirpstack is ChirpStack v3 or v4
+	NetworkChirpstack = "chirpstack"
+	// NetworkTTN is The Things Stack v3
+	NetworkTTN = "ttn"
+)
+
+// Uplink is a message from a device
+type Uplink struct {
+	// DevEUI is the lower case hex EUI of the device
+	DevEUI string
+	// Name is the name of the device in the network server
+	Name    string
+	FPort   int
+	Payload []byte
+	// Object are the fields decoded by the network server's payload
+	// formatter, if it has one
+	Object map[string]interface{}
+	// RSSI and SNR are from the gateway with the best signal, and
+	// HasSignal is false if no gateway metadata was sent
+	RSSI      float64
+	SNR       float64
+	HasSignal bool
+	Time      time.Time
+}
+
+// chirpstackRxInfo is the metadata of a gateway. v3 calls the SNR loRaSNR.
+type chirpstackRxInfo struct {
+	RSSI    float64  `json:"rssi"`
+	SNR     *float64 `json:"snr"`
+	LoRaSNR float64  `json:"loRaSNR"`
+}
+
+// chirpstackUplink is a ChirpStack uplink event. v3 puts the device fields
+// at the top level, and v4 puts them in deviceInfo.
+type chirpstackUplink struct {
+	DeviceInfo struct {
+		DeviceName string `json:"deviceName"`
+		DevEUI     string `json:"devEui"`
+	} `json:"deviceInfo"`
+	DeviceName string                 `json:"deviceName"`
+	DevEUI     string                 `json:"devEUI"`
+	Time       time.Time              `json:"time"`
+	FPort      int                    `json:"fPort"`
+	Data       []byte                 `json:"data"`
+	Object     map[string]interface{} `json:"object"`
+	// ObjectJSON is the object as a JSON string (v3)
+	ObjectJSON string             `json:"objectJSON"`
+	RxInfo     []chirpstackRxInfo `json:"rxInfo"`
+}
+
+// ttnUplink is a TTN uplink message
+type ttnUplink struct {
+	EndDeviceIDs struct {
+		DeviceID string `json:"device_id"`
+		DevEUI   string `json:"dev_eui"`
+	} `json:"end_device_ids"`
+	ReceivedAt    time.Time `json:"received_at"`
+	UplinkMessage *struct {
+		FPort          int                    `json:"f_port"`
+		FrmPayload     []byte                 `json:"frm_payload"`
+		DecodedPayload map[string]interface{} `json:"decoded_payload"`
+		RxMetadata     []struct {
+			RSSI float64 `json:"rssi"`
+			SNR  float64 `json:"snr"`
+		} `json:"rx_metadata"`
+	} `json:"uplink_message"`
+}
+
+// normalizeEUI returns a lower case hex EUI
+func normalizeEUI(eui string) (string, error) {
+	eui = strings.ToLower(strings.Replace(eui, "-", "", -1))
+	b, err := hex.DecodeString(eui)
+	if err != nil || len(b) != 8 {
+		return "", fmt.Errorf("invalid DevEUI: %v", eui)
+	}
+	return eui, nil
+}
+
+// ParseUplink parses an uplink in the JSON format of network
+func ParseUplink(network string, payload []byte) (Uplink, error) {
+	var u Uplink
+	var eui string
+
+	switch network {
+	case NetworkChirpstack:
+		var c chirpstackUplink
+		err := json.Unmarshal(payload, &c)
+		if err != nil {
+			return u, err
+		}
+
+		eui = c.DeviceInfo.DevEUI
+		u.Name = c.DeviceInfo.DeviceName
+		if eui == "" {
+			eui = c.DevEUI
+			u.Name = c.DeviceName
+		}
+
+		u.FPort = c.FPort
+		u.Payload = c.Data
+		u.Object = c.Object
+		u.Time = c.Time
+
+		if u.Object == nil && c.ObjectJSON != "" {
+			err := json.Unmarshal([]byte(c.ObjectJSON), &u.Object)
+			if err != nil {
+				return u, fmt.Errorf("invalid objectJSON: %v", err)
+			}
+		}
+
+		for i, rx := range c.RxInfo {
+			snr := rx.LoRaSNR
+			if rx.SNR != nil {
+				snr = *rx.SNR
+			}
+
+			if i == 0 || rx.RSSI > u.RSSI {
+				u.RSSI = rx.RSSI
+				u.SNR = snr
+				u.HasSignal = true
+			}
+		}
+	case NetworkTTN:
+		var t ttnUplink
+		err := json.Unmarshal(payload, &t)
+		if err != nil {
+			return u, err
+		}
+
+		if t.UplinkMessage == nil {
+			return u, errors.New("not an uplink message")
+		}
+
+		eui = t.EndDeviceIDs.DevEUI
+		u.Name = t.EndDeviceIDs.DeviceID
+		u.FPort = t.UplinkMessage.FPort
+		u.Payload = t.UplinkMessage.FrmPayload
+		u.Object = t.UplinkMessage.DecodedPayload
+		u.Time = t.ReceivedAt
+
+		for i, rx := range t.UplinkMessage.RxMetadata {
+			if i == 0 || rx.RSSI > u.RSSI {
+				u.RSSI = rx.RSSI
+				u.SNR = rx.SNR
+				u.HasSignal = true
+			}
+		}
+	default:
+		return u, fmt.Errorf("unsupported network: %v", network)
+	}
+
+	var err error
+	u.DevEUI, err = normalizeEUI(eui)
+	if err != nil {
+		return u, err
+	}
+
+	if u.Time.IsZero() {
+		u.Time = time.Now()
+	}
+
+	return u, nil
+}
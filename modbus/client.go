@@ -0,0 +1,329 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxPDUSize is the largest function code and data in a request or response
+const maxPDUSize = 253
+
+// ExceptionError is returned when a device responds with an exception
+type ExceptionError struct {
+	FunctionCode FunctionCode
+	Code         byte
+}
+
+func (e ExceptionError) Error() string {
+	return fmt.Sprintf("modbus exception %v for function %v", e.Code,
+		e.FunctionCode)
+}
+
+// CRC16 returns the Modbus RTU CRC of data
+func CRC16(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// transport sends a request PDU to a unit and returns the response PDU
+type transport interface {
+	request(unit byte, pdu []byte) ([]byte, error)
+	Close() error
+}
+
+// rtu frames requests as address, PDU, and CRC on a serial port
+type rtu struct {
+	port io.ReadWriteCloser
+}
+
+func (t *rtu) request(unit byte, pdu []byte) ([]byte, error) {
+	frame := append([]byte{unit}, pdu...)
+	frame = append(frame, 0, 0)
+	binary.LittleEndian.PutUint16(frame[len(frame)-2:], CRC16(frame[:len(frame)-2]))
+
+	_, err := t.port.Write(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	// broadcasts don't get a response
+	if unit == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, maxPDUSize+3)
+	n, err := t.port.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	buf = buf[:n]
+
+	if len(buf) < 4 {
+		return nil, errors.New("modbus response too short")
+	}
+
+	if CRC16(buf[:n-2]) != binary.LittleEndian.Uint16(buf[n-2:]) {
+		return nil, errors.New("modbus CRC check failed")
+	}
+
+	if buf[0] != unit {
+		return nil, fmt.Errorf("modbus response from wrong unit: %v", buf[0])
+	}
+
+	return buf[1 : n-2], nil
+}
+
+func (t *rtu) Close() error {
+	return t.port.Close()
+}
+
+// tcp frames requests with the MBAP header
+type tcp struct {
+	conn    net.Conn
+	timeout time.Duration
+	tid     uint16
+}
+
+func (t *tcp) request(unit byte, pdu []byte) ([]byte, error) {
+	t.tid++
+
+	frame := make([]byte, 7, 7+len(pdu))
+	binary.BigEndian.PutUint16(frame[0:], t.tid)
+	binary.BigEndian.PutUint16(frame[4:], uint16(len(pdu)+1))
+	frame[6] = unit
+	frame = append(frame, pdu...)
+
+	t.conn.SetDeadline(time.Now().Add(t.timeout))
+
+	_, err := t.conn.Write(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		head := make([]byte, 7)
+		_, err = io.ReadFull(t.conn, head)
+		if err != nil {
+			return nil, err
+		}
+
+		length := int(binary.BigEndian.Uint16(head[4:]))
+		if binary.BigEndian.Uint16(head[2:]) != 0 || length < 2 ||
+			length > maxPDUSize+1 {
+			return nil, errors.New("invalid modbus TCP header")
+		}
+
+		resp := make([]byte, length-1)
+		_, err = io.ReadFull(t.conn, resp)
+		if err != nil {
+			return nil, err
+		}
+
+		// responses to earlier requests that timed out are skipped
+		if binary.BigEndian.Uint16(head[0:]) == t.tid {
+			return resp, nil
+		}
+	}
+}
+
+func (t *tcp) Close() error {
+	return t.conn.Close()
+}
+
+// Client is a Modbus master that reads and writes registers on RTU or TCP
+// devices. It is safe to use from multiple goroutines, and requests are
+// sent one at a time.
+type Client struct {
+	lock      sync.Mutex
+	transport transport
+}
+
+// NewRTUClient creates a client for RTU devices on a serial port. The port
+// is typically a respreader.ResponseReadWriteCloser, so each read returns a
+// complete response.
+func NewRTUClient(port io.ReadWriteCloser) *Client {
+	return &Client{transport: &rtu{port: port}}
+}
+
+// DialTCP connects to a Modbus TCP device. timeout is used for connecting
+// and for each request.
+func DialTCP(address string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{transport: &tcp{conn: conn, timeout: timeout}}, nil
+}
+
+// Close closes the port or connection
+func (c *Client) Close() error {
+	return c.transport.Close()
+}
+
+// request sends a request and checks the response is for the same function
+func (c *Client) request(unit byte, fc FunctionCode, data []byte) ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	resp, err := c.transport.request(unit, append([]byte{byte(fc)}, data...))
+	if err != nil || unit == 0 {
+		return nil, err
+	}
+
+	switch {
+	case len(resp) == 2 && resp[0] == byte(fc)|0x80:
+		return nil, ExceptionError{FunctionCode: fc, Code: resp[1]}
+	case len(resp) < 1 || resp[0] != byte(fc):
+		return nil, errors.New("invalid modbus response")
+	}
+
+	return resp[1:], nil
+}
+
+// read sends a read request and returns the data after the byte count
+func (c *Client) read(unit byte, fc FunctionCode, address, count uint16, size int) ([]byte, error) {
+	req := make([]byte, 4)
+	binary.BigEndian.PutUint16(req[0:], address)
+	binary.BigEndian.PutUint16(req[2:], count)
+
+	resp, err := c.request(unit, fc, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp) < 1 || int(resp[0]) != size || len(resp) != size+1 {
+		return nil, errors.New("wrong modbus response size")
+	}
+
+	return resp[1:], nil
+}
+
+func (c *Client) readBits(unit byte, fc FunctionCode, address, count uint16) ([]bool, error) {
+	if count < 1 || count > 2000 {
+		return nil, errors.New("modbus coil count must be 1 to 2000")
+	}
+
+	b, err := c.read(unit, fc, address, count, (int(count)+7)/8)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]bool, count)
+	for i := range ret {
+		ret[i] = b[i/8]&(1<<uint(i%8)) != 0
+	}
+
+	return ret, nil
+}
+
+func (c *Client) readRegisters(unit byte, fc FunctionCode, address, count uint16) ([]uint16, error) {
+	if count < 1 || count > 125 {
+		return nil, errors.New("modbus register count must be 1 to 125")
+	}
+
+	b, err := c.read(unit, fc, address, count, int(count)*2)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]uint16, count)
+	for i := range ret {
+		ret[i] = binary.BigEndian.Uint16(b[i*2:])
+	}
+
+	return ret, nil
+}
+
+// ReadCoils reads count coils starting at address
+func (c *Client) ReadCoils(unit byte, address, count uint16) ([]bool, error) {
+	return c.readBits(unit, FuncCodeReadCoils, address, count)
+}
+
+// ReadDiscreteInputs reads count discrete inputs starting at address
+func (c *Client) ReadDiscreteInputs(unit byte, address, count uint16) ([]bool, error) {
+	return c.readBits(unit, FuncCodeReadDiscreteInputs, address, count)
+}
+
+// ReadHoldingRegisters reads count holding registers starting at address
+func (c *Client) ReadHoldingRegisters(unit byte, address, count uint16) ([]uint16, error) {
+	return c.readRegisters(unit, FuncCodeReadHoldingRegisters, address, count)
+}
+
+// ReadInputRegisters reads count input registers starting at address
+func (c *Client) ReadInputRegisters(unit byte, address, count uint16) ([]uint16, error) {
+	return c.readRegisters(unit, FuncCodeReadInputRegisters, address, count)
+}
+
+// write sends a single write request, which is echoed in the response
+func (c *Client) write(unit byte, fc FunctionCode, address, value uint16) error {
+	req := make([]byte, 4)
+	binary.BigEndian.PutUint16(req[0:], address)
+	binary.BigEndian.PutUint16(req[2:], value)
+
+	resp, err := c.request(unit, fc, req)
+	if err != nil || unit == 0 {
+		return err
+	}
+
+	if string(resp) != string(req) {
+		return errors.New("modbus write was not echoed")
+	}
+
+	return nil
+}
+
+// WriteSingleCoil sets a coil
+func (c *Client) WriteSingleCoil(unit byte, address uint16, value bool) error {
+	v := uint16(0)
+	if value {
+		v = 0xff00
+	}
+	return c.write(unit, FuncCodeWriteSingleCoil, address, v)
+}
+
+// WriteSingleRegister writes a holding register
+func (c *Client) WriteSingleRegister(unit byte, address, value uint16) error {
+	return c.write(unit, FuncCodeWriteSingleRegister, address, value)
+}
+
+// WriteMultipleRegisters writes holding registers starting at address
+func (c *Client) WriteMultipleRegisters(unit byte, address uint16, values []uint16) error {
+	if len(values) < 1 || len(values) > 123 {
+		return errors.New("modbus register count must be 1 to 123")
+	}
+
+	req := make([]byte, 5+len(values)*2)
+	binary.BigEndian.PutUint16(req[0:], address)
+	binary.BigEndian.PutUint16(req[2:], uint16(len(values)))
+	req[4] = byte(len(values) * 2)
+	for i, v := range values {
+		binary.BigEndian.PutUint16(req[5+i*2:], v)
+	}
+
+	resp, err := c.request(unit, FuncCodeWriteMultipleRegisters, req)
+	if err != nil || unit == 0 {
+		return err
+	}
+
+	if string(resp) != string(req[:4]) {
+		return errors.New("modbus write was not echoed")
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package modbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCRC16(t *testing.T) {
+	crc := CRC16([]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0a})
+	if crc != 0xcdc5 {
+		t.Errorf("wrong crc: 0x%x", crc)
+	}
+}
+
+// fakePort returns a canned response to each write
+type fakePort struct {
+	written []byte
+	resp    []byte
+}
+
+func (p *fakePort) Write(b []byte) (int, error) {
+	p.written = append([]byte{}, b...)
+	return len(b), nil
+}
+
+func (p *fakePort) Read(b []byte) (int, error) {
+	if p.resp == nil {
+		return 0, io.EOF
+	}
+	return copy(b, p.resp), nil
+}
+
+func (p *fakePort) Close() error {
+	return nil
+}
+
+func rtuFrame(b ...byte) []byte {
+	crc := CRC16(b)
+	return append(b, byte(crc), byte(crc>>8))
+}
+
+func TestRTUClient(t *testing.T) {
+	port := &fakePort{resp: rtuFrame(1, 3, 4, 0x12, 0x34, 0xff, 0xfe)}
+	c := NewRTUClient(port)
+
+	regs, err := c.ReadHoldingRegisters(1, 0x10, 2)
+	if err != nil {
+		t.Fatal("Error reading registers: ", err)
+	}
+
+	if !bytes.Equal(port.written, rtuFrame(1, 3, 0, 0x10, 0, 2)) {
+		t.Errorf("wrong request: % x", port.written)
+	}
+
+	if !reflect.DeepEqual(regs, []uint16{0x1234, 0xfffe}) {
+		t.Errorf("wrong registers: %x", regs)
+	}
+
+	port.resp = rtuFrame(1, 1, 1, 0x05)
+	coils, err := c.ReadCoils(1, 0, 3)
+	if err != nil {
+		t.Fatal("Error reading coils: ", err)
+	}
+
+	if !reflect.DeepEqual(coils, []bool{true, false, true}) {
+		t.Errorf("wrong coils: %v", coils)
+	}
+
+	port.resp = rtuFrame(1, 0x83, 2)
+	_, err = c.ReadHoldingRegisters(1, 0x10, 2)
+	if e, ok := err.(ExceptionError); !ok || e.Code != 2 {
+		t.Errorf("expected exception, got: %v", err)
+	}
+
+	port.resp = rtuFrame(2, 3, 2, 0, 1)
+	_, err = c.ReadHoldingRegisters(1, 0x10, 1)
+	if err == nil {
+		t.Error("expected error for response from wrong unit")
+	}
+
+	port.resp = rtuFrame(1, 3, 2, 0, 1)
+	port.resp[3]++
+	_, err = c.ReadHoldingRegisters(1, 0x10, 1)
+	if err == nil {
+		t.Error("expected CRC error")
+	}
+
+	port.resp = rtuFrame(1, 6, 0, 1, 0, 3)
+	err = c.WriteSingleRegister(1, 1, 3)
+	if err != nil {
+		t.Error("Error writing register: ", err)
+	}
+}
+
+func TestTCPClient(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening: ", err)
+	}
+	defer l.Close()
+
+	// the server answers input register reads with the register addresses
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			req := make([]byte, 12)
+			_, err := io.ReadFull(conn, req)
+			if err != nil {
+				return
+			}
+
+			addr := binary.BigEndian.Uint16(req[8:])
+			count := binary.BigEndian.Uint16(req[10:])
+
+			pdu := []byte{req[7], byte(count * 2)}
+			for i := uint16(0); i < count; i++ {
+				pdu = append(pdu, byte((addr+i)>>8), byte(addr+i))
+			}
+
+			resp := append([]byte{}, req[:7]...)
+			binary.BigEndian.PutUint16(resp[4:], uint16(len(pdu)+1))
+			conn.Write(append(resp, pdu...))
+		}
+	}()
+
+	c, err := DialTCP(l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal("Error connecting: ", err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		regs, err := c.ReadInputRegisters(1, 0x100, 3)
+		if err != nil {
+			t.Fatal("Error reading registers: ", err)
+		}
+
+		if !reflect.DeepEqual(regs, []uint16{0x100, 0x101, 0x102}) {
+			t.Errorf("wrong registers: %x", regs)
+		}
+	}
+}
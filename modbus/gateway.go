@@ -0,0 +1,242 @@
+package modbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+// MapRegister exposes a device sample as a Modbus value. The sample ID and
+// type are the register ID and type.
+type MapRegister struct {
+	data.ModbusRegister
+	// UnitID is the Modbus address the register is served on
+	UnitID   int    `json:"unitId"`
+	DeviceID string `json:"deviceId"`
+	// Command is queued for the device when the register is written, with
+	// id, type, and value args. The register is read only if blank.
+	Command string `json:"command,omitempty"`
+}
+
+// Map describes the device samples that are served over Modbus
+type Map struct {
+	Registers []MapRegister `json:"registers"`
+}
+
+// Validate checks the map is valid and registers don't overlap
+func (m *Map) Validate() error {
+	used := make(map[string]string)
+
+	for _, r := range m.Registers {
+		err := r.Validate()
+		if err != nil {
+			return err
+		}
+
+		if r.DeviceID == "" {
+			return fmt.Errorf("modbus register %v device id is required", r.ID)
+		}
+
+		if r.UnitID < 0 || r.UnitID > 255 {
+			return fmt.Errorf("modbus register %v unit id must be 0 to 255", r.ID)
+		}
+
+		if r.Command != "" && (r.Table == data.ModbusDiscreteInput ||
+			r.Table == data.ModbusInput) {
+			return fmt.Errorf("modbus register %v is read only", r.ID)
+		}
+
+		for i := 0; i < r.Count(); i++ {
+			k := fmt.Sprintf("%v/%v/%v", r.UnitID, r.Table, r.Address+i)
+			if other, ok := used[k]; ok {
+				return fmt.Errorf("modbus registers %v and %v overlap", other, r.ID)
+			}
+			used[k] = r.ID
+		}
+	}
+
+	return nil
+}
+
+// LoadMap reads a Modbus map from a JSON file
+func LoadMap(file string) (*Map, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var m Map
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing modbus map: %v", err)
+	}
+
+	err = m.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// Gateway is a Handler that serves the latest device samples in a map, and
+// queues commands for writes. Unmapped addresses in a read range read as 0,
+// but a range with no mapped registers is an illegal address.
+type Gateway struct {
+	db *db.Db
+	// registers are indexed by unit and table
+	registers map[byte]map[string][]MapRegister
+}
+
+// NewGateway creates a gateway. The map must be valid.
+func NewGateway(dbInst *db.Db, m *Map) *Gateway {
+	g := &Gateway{
+		db:        dbInst,
+		registers: make(map[byte]map[string][]MapRegister),
+	}
+
+	for _, r := range m.Registers {
+		unit := byte(r.UnitID)
+		if g.registers[unit] == nil {
+			g.registers[unit] = make(map[string][]MapRegister)
+		}
+		g.registers[unit][r.Table] = append(g.registers[unit][r.Table], r)
+	}
+
+	return g
+}
+
+// read returns the raw values of a range of a table
+func (g *Gateway) read(unit byte, table string, address, count uint16) ([]uint16, error) {
+	ret := make([]uint16, count)
+	start := int(address)
+	end := start + int(count)
+	found := false
+
+	for _, r := range g.registers[unit][table] {
+		if r.Address+r.Count() <= start || r.Address >= end {
+			continue
+		}
+
+		found = true
+
+		s, ok := g.db.LatestValue(r.DeviceID, r.Type, r.ID)
+		if !ok {
+			return nil, exception(ExceptionGatewayTargetFailed)
+		}
+
+		for i, v := range r.Registers(s.Value) {
+			a := r.Address + i
+			if a >= start && a < end {
+				ret[a-start] = v
+			}
+		}
+	}
+
+	if !found {
+		return nil, exception(ExceptionIllegalDataAddress)
+	}
+
+	return ret, nil
+}
+
+// write queues commands for the registers in a range. Every address must
+// be a writable register, and multi-register values must be written
+// together.
+func (g *Gateway) write(unit byte, table string, address uint16, values []uint16) error {
+	start := int(address)
+	end := start + len(values)
+
+	var writes []MapRegister
+	covered := 0
+	for _, r := range g.registers[unit][table] {
+		if r.Address+r.Count() <= start || r.Address >= end {
+			continue
+		}
+
+		if r.Command == "" || r.Address < start || r.Address+r.Count() > end {
+			return exception(ExceptionIllegalDataAddress)
+		}
+
+		writes = append(writes, r)
+		covered += r.Count()
+	}
+
+	if covered != len(values) {
+		return exception(ExceptionIllegalDataAddress)
+	}
+
+	for _, r := range writes {
+		off := r.Address - start
+		v := r.Value(values[off : off+r.Count()])
+
+		_, err := g.db.CommandEnqueue(data.DeviceCommand{
+			DeviceID: r.DeviceID,
+			Command:  r.Command,
+			Args: map[string]string{
+				"id":    r.ID,
+				"type":  r.Type,
+				"value": strconv.FormatFloat(v, 'g', -1, 64),
+			},
+		})
+		if err != nil {
+			log.Printf("Modbus: error queueing %v for %v: %v\n", r.Command,
+				r.DeviceID, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadBits reads coils or discrete inputs
+func (g *Gateway) ReadBits(unit byte, discrete bool, address, count uint16) ([]bool, error) {
+	table := data.ModbusCoil
+	if discrete {
+		table = data.ModbusDiscreteInput
+	}
+
+	regs, err := g.read(unit, table, address, count)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]bool, len(regs))
+	for i, r := range regs {
+		ret[i] = r != 0
+	}
+
+	return ret, nil
+}
+
+// ReadRegisters reads holding or input registers
+func (g *Gateway) ReadRegisters(unit byte, input bool, address, count uint16) ([]uint16, error) {
+	table := data.ModbusHolding
+	if input {
+		table = data.ModbusInput
+	}
+
+	return g.read(unit, table, address, count)
+}
+
+// WriteBits queues commands for coil writes
+func (g *Gateway) WriteBits(unit byte, address uint16, values []bool) error {
+	regs := make([]uint16, len(values))
+	for i, v := range values {
+		if v {
+			regs[i] = 1
+		}
+	}
+
+	return g.write(unit, data.ModbusCoil, address, regs)
+}
+
+// WriteRegisters queues commands for holding register writes
+func (g *Gateway) WriteRegisters(unit byte, address uint16, values []uint16) error {
+	return g.write(unit, data.ModbusHolding, address, values)
+}
@@ -0,0 +1,262 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+// exception codes
+const (
+	ExceptionIllegalFunction     = 1
+	ExceptionIllegalDataAddress  = 2
+	ExceptionIllegalDataValue    = 3
+	ExceptionServerDeviceFailure = 4
+	ExceptionGatewayTargetFailed = 11
+)
+
+// Handler reads and writes the values served by a Server. Returning an
+// ExceptionError sends that exception code, and other errors send a server
+// device failure.
+type Handler interface {
+	// ReadBits reads coils, or discrete inputs if discrete is set
+	ReadBits(unit byte, discrete bool, address, count uint16) ([]bool, error)
+	// ReadRegisters reads holding registers, or input registers if input is
+	// set
+	ReadRegisters(unit byte, input bool, address, count uint16) ([]uint16, error)
+	// WriteBits writes coils
+	WriteBits(unit byte, address uint16, values []bool) error
+	// WriteRegisters writes holding registers
+	WriteRegisters(unit byte, address uint16, values []uint16) error
+}
+
+// Server is a Modbus TCP server (slave)
+type Server struct {
+	handler  Handler
+	lock     sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+// NewServer creates a Modbus TCP server. Serve handles connections.
+func NewServer(handler Handler) *Server {
+	return &Server{
+		handler: handler,
+		conns:   make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on l until Close is called
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	s.listener = l
+	s.lock.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+
+			if closed {
+				return nil
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.lock.Unlock()
+
+		go s.handleConn(conn)
+	}
+}
+
+// Close stops the server and closes all connections
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+
+	return nil
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		head := make([]byte, 7)
+		_, err := io.ReadFull(conn, head)
+		if err != nil {
+			return
+		}
+
+		length := int(binary.BigEndian.Uint16(head[4:]))
+		if binary.BigEndian.Uint16(head[2:]) != 0 || length < 2 ||
+			length > maxPDUSize+1 {
+			log.Println("Modbus: invalid header from ", conn.RemoteAddr())
+			return
+		}
+
+		req := make([]byte, length-1)
+		_, err = io.ReadFull(conn, req)
+		if err != nil {
+			return
+		}
+
+		resp := s.serve(head[6], req)
+
+		binary.BigEndian.PutUint16(head[4:], uint16(len(resp)+1))
+		_, err = conn.Write(append(head, resp...))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// serve handles a request PDU and returns the response PDU
+func (s *Server) serve(unit byte, req []byte) []byte {
+	fc := FunctionCode(req[0])
+
+	resp, err := s.dispatch(unit, fc, req[1:])
+	if err != nil {
+		code := byte(ExceptionServerDeviceFailure)
+		var e ExceptionError
+		if errors.As(err, &e) {
+			code = e.Code
+		}
+		return []byte{byte(fc) | 0x80, code}
+	}
+
+	return append([]byte{byte(fc)}, resp...)
+}
+
+func exception(code byte) error {
+	return ExceptionError{Code: code}
+}
+
+// dispatch decodes a request and returns the response data
+func (s *Server) dispatch(unit byte, fc FunctionCode, data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		switch fc {
+		case FuncCodeReadCoils, FuncCodeReadDiscreteInputs,
+			FuncCodeReadHoldingRegisters, FuncCodeReadInputRegisters,
+			FuncCodeWriteSingleCoil, FuncCodeWriteSingleRegister,
+			FuncCodeWriteMultipleCoils, FuncCodeWriteMultipleRegisters:
+			return nil, exception(ExceptionIllegalDataValue)
+		}
+		return nil, exception(ExceptionIllegalFunction)
+	}
+
+	address := binary.BigEndian.Uint16(data[0:])
+	value := binary.BigEndian.Uint16(data[2:])
+
+	switch fc {
+	case FuncCodeReadCoils, FuncCodeReadDiscreteInputs:
+		if value < 1 || value > 2000 {
+			return nil, exception(ExceptionIllegalDataValue)
+		}
+
+		bits, err := s.handler.ReadBits(unit, fc == FuncCodeReadDiscreteInputs,
+			address, value)
+		if err != nil {
+			return nil, err
+		}
+
+		ret := make([]byte, 1+(len(bits)+7)/8)
+		ret[0] = byte(len(ret) - 1)
+		for i, b := range bits {
+			if b {
+				ret[1+i/8] |= 1 << uint(i%8)
+			}
+		}
+		return ret, nil
+
+	case FuncCodeReadHoldingRegisters, FuncCodeReadInputRegisters:
+		if value < 1 || value > 125 {
+			return nil, exception(ExceptionIllegalDataValue)
+		}
+
+		regs, err := s.handler.ReadRegisters(unit,
+			fc == FuncCodeReadInputRegisters, address, value)
+		if err != nil {
+			return nil, err
+		}
+
+		ret := make([]byte, 1+len(regs)*2)
+		ret[0] = byte(len(regs) * 2)
+		for i, r := range regs {
+			binary.BigEndian.PutUint16(ret[1+i*2:], r)
+		}
+		return ret, nil
+
+	case FuncCodeWriteSingleCoil:
+		if value != 0 && value != 0xff00 {
+			return nil, exception(ExceptionIllegalDataValue)
+		}
+
+		err := s.handler.WriteBits(unit, address, []bool{value == 0xff00})
+		return data[:4], err
+
+	case FuncCodeWriteSingleRegister:
+		err := s.handler.WriteRegisters(unit, address, []uint16{value})
+		return data[:4], err
+
+	case FuncCodeWriteMultipleCoils:
+		if len(data) < 5 || value < 1 || value > 1968 ||
+			int(data[4]) != (int(value)+7)/8 || len(data) != 5+int(data[4]) {
+			return nil, exception(ExceptionIllegalDataValue)
+		}
+
+		bits := make([]bool, value)
+		for i := range bits {
+			bits[i] = data[5+i/8]&(1<<uint(i%8)) != 0
+		}
+
+		err := s.handler.WriteBits(unit, address, bits)
+		return data[:4], err
+
+	case FuncCodeWriteMultipleRegisters:
+		if len(data) < 5 || value < 1 || value > 123 ||
+			int(data[4]) != int(value)*2 || len(data) != 5+int(data[4]) {
+			return nil, exception(ExceptionIllegalDataValue)
+		}
+
+		regs := make([]uint16, value)
+		for i := range regs {
+			regs[i] = binary.BigEndian.Uint16(data[5+i*2:])
+		}
+
+		err := s.handler.WriteRegisters(unit, address, regs)
+		return data[:4], err
+	}
+
+	return nil, exception(ExceptionIllegalFunction)
+}
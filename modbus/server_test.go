@@ -0,0 +1,132 @@
+package modbus
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+func TestGateway(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-modbus-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbInst, err := db.NewDb(dir, nil)
+	if err != nil {
+		t.Fatal("Error opening db: ", err)
+	}
+	defer dbInst.Close()
+
+	for _, s := range []data.Sample{
+		{Type: "level", ID: "tank", Value: 12.3},
+		{Type: "flow", ID: "meter", Value: -1.5},
+		{Type: "running", ID: "pump", Value: 1},
+	} {
+		err = dbInst.DeviceSample("1234", s)
+		if err != nil {
+			t.Fatal("Error writing sample: ", err)
+		}
+	}
+
+	reg := func(id, typ, table string, address int, format string) data.ModbusRegister {
+		return data.ModbusRegister{ID: id, Type: typ, Table: table,
+			Address: address, Format: format}
+	}
+
+	tank := reg("tank", "level", data.ModbusHolding, 0, "")
+	tank.Scale = 0.1
+
+	m := &Map{Registers: []MapRegister{
+		{ModbusRegister: tank, UnitID: 1, DeviceID: "1234", Command: "setLevel"},
+		{ModbusRegister: reg("meter", "flow", data.ModbusHolding, 2,
+			data.ModbusFloat32), UnitID: 1, DeviceID: "1234"},
+		{ModbusRegister: reg("pump", "running", data.ModbusCoil, 5, ""),
+			UnitID: 1, DeviceID: "1234", Command: "setPump"},
+		{ModbusRegister: reg("missing", "temp", data.ModbusInput, 0, ""),
+			UnitID: 1, DeviceID: "1234"},
+	}}
+
+	err = m.Validate()
+	if err != nil {
+		t.Fatal("Error validating map: ", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening: ", err)
+	}
+
+	s := NewServer(NewGateway(dbInst, m))
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := DialTCP(l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal("Error connecting: ", err)
+	}
+	defer c.Close()
+
+	regs, err := c.ReadHoldingRegisters(1, 0, 4)
+	if err != nil {
+		t.Fatal("Error reading registers: ", err)
+	}
+
+	if !reflect.DeepEqual(regs, []uint16{123, 0, 0xbfc0, 0}) {
+		t.Errorf("wrong registers: %x", regs)
+	}
+
+	coils, err := c.ReadCoils(1, 4, 2)
+	if err != nil || !reflect.DeepEqual(coils, []bool{false, true}) {
+		t.Errorf("wrong coils: %v, %v", coils, err)
+	}
+
+	for _, f := range []func() error{
+		// the sample does not exist
+		func() error { _, err := c.ReadInputRegisters(1, 0, 1); return err },
+		// no registers are mapped
+		func() error { _, err := c.ReadHoldingRegisters(1, 100, 1); return err },
+		func() error { _, err := c.ReadHoldingRegisters(2, 0, 1); return err },
+		// read only
+		func() error { return c.WriteSingleRegister(1, 2, 0) },
+		// part of a value
+		func() error { return c.WriteMultipleRegisters(1, 0, []uint16{1, 2}) },
+	} {
+		if _, ok := f().(ExceptionError); !ok {
+			t.Error("expected exception")
+		}
+	}
+
+	err = c.WriteSingleRegister(1, 0, 250)
+	if err != nil {
+		t.Fatal("Error writing register: ", err)
+	}
+
+	err = c.WriteSingleCoil(1, 5, false)
+	if err != nil {
+		t.Fatal("Error writing coil: ", err)
+	}
+
+	cmds, err := dbInst.DeviceCommands("1234")
+	if err != nil {
+		t.Fatal("Error reading commands: ", err)
+	}
+
+	if len(cmds) != 2 || cmds[0].Command != "setLevel" ||
+		cmds[0].Args["value"] != "25" || cmds[1].Command != "setPump" ||
+		cmds[1].Args["value"] != "0" {
+		t.Errorf("wrong commands: %+v", cmds)
+	}
+
+	m.Registers = append(m.Registers, m.Registers[1])
+	if m.Validate() == nil {
+		t.Error("expected error for overlapping registers")
+	}
+}
@@ -0,0 +1,364 @@
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/trace"
+)
+
+// BridgeConfig describes how the bridge maps devices to topics
+type BridgeConfig struct {
+	// Prefix is the first level of all topics (default siot)
+	Prefix string
+	// Write stores samples from devices, typically
+	// api.WriteSamplesContext or db.IngestQueue.EnqueueContext. ctx has the
+	// span of the message.
+	Write func(ctx context.Context, id string, samples []data.Sample) error
+	// WriteBatch stores backlog batches from devices, typically
+	// api.WriteBatchContext. Batches are ignored if it is nil.
+	WriteBatch func(ctx context.Context, id string, batch data.SampleBatch) error
+}
+
+// Conn is a connection to a broker, which can be a Client connected to an
+// external broker or the embedded Broker
+type Conn interface {
+	Subscribe(filter string, qos byte, handler Handler) error
+	Publish(topic string, payload []byte, qos byte, retain bool) error
+}
+
+// Bridge connects devices that speak MQTT to the SIOT database. Topics are
+// (with the default prefix):
+//
+//	siot/<device id>/samples: JSON sample or array of samples from the
+//	device
+//	siot/<device id>/sample/<type>[/<sample id>]: plain value from the
+//	device, like 23.5, true, or on
+//	siot/<device id>/batch: JSON data.SampleBatch of backlog samples from
+//	the device
+//	siot/<device id>/config: the device config as JSON, retained
+//	siot/<device id>/config/reported: JSON data.ConfigReport with the
+//	config the device applied
+//	siot/<device id>/command: queued commands as JSON (QoS 1)
+//
+// Commands are published when they are queued and when the device sends
+// samples, and are removed from the queue once the broker acks them.
+type Bridge struct {
+	conn   Conn
+	db     *db.Db
+	config BridgeConfig
+	lock   sync.Mutex
+	// configs is the last config published for each device, so the config
+	// is only published when it changes
+	configs map[string][]byte
+	// cmdLock keeps a command from being published twice
+	cmdLock sync.Mutex
+	events  <-chan db.Event
+	stop    chan struct{}
+}
+
+// NewBridge creates a bridge that uses conn to connect to the broker
+func NewBridge(conn Conn, dbInst *db.Db, config BridgeConfig) *Bridge {
+	if config.Prefix == "" {
+		config.Prefix = "siot"
+	}
+
+	return &Bridge{
+		conn:    conn,
+		db:      dbInst,
+		config:  config,
+		configs: make(map[string][]byte),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start subscribes to device topics and publishes config and commands
+// until Stop is called
+func (b *Bridge) Start() error {
+	p := b.config.Prefix
+
+	err := b.conn.Subscribe(p+"/+/samples", 1, b.handleSamples)
+	if err != nil {
+		return err
+	}
+
+	err = b.conn.Subscribe(p+"/+/sample/#", 1, b.handleSample)
+	if err != nil {
+		return err
+	}
+
+	err = b.conn.Subscribe(p+"/+/config/reported", 1, b.handleConfigReport)
+	if err != nil {
+		return err
+	}
+
+	if b.config.WriteBatch != nil {
+		err = b.conn.Subscribe(p+"/+/batch", 1, b.handleBatch)
+		if err != nil {
+			return err
+		}
+	}
+
+	b.events = b.db.Subscribe(db.EventFilter{
+		Types: []db.EventType{db.EventDeviceCreated, db.EventDeviceUpdated,
+			db.EventCommandQueued},
+	})
+
+	go func() {
+		for {
+			select {
+			case e, ok := <-b.events:
+				if !ok {
+					return
+				}
+
+				switch e.Type {
+				case db.EventDeviceCreated, db.EventDeviceUpdated:
+					b.publishConfig(e.DeviceID, e.Device.Config)
+				case db.EventCommandQueued:
+					b.cmdLock.Lock()
+					b.publishCommand(*e.Command)
+					b.cmdLock.Unlock()
+				}
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the bridge
+func (b *Bridge) Stop() {
+	close(b.stop)
+	b.db.Unsubscribe(b.events)
+}
+
+// deviceID returns the device ID from a topic like siot/<id>/samples
+func (b *Bridge) deviceID(topic string) (id string, rest []string) {
+	levels := strings.Split(strings.TrimPrefix(topic, b.config.Prefix+"/"), "/")
+	return levels[0], levels[1:]
+}
+
+// ParseValue parses a plain sample value. Booleans and on/off are 1 or 0.
+func ParseValue(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+
+	switch strings.ToLower(s) {
+	case "true", "on":
+		return 1, nil
+	case "false", "off":
+		return 0, nil
+	}
+
+	return strconv.ParseFloat(s, 64)
+}
+
+// ParseSamples parses a JSON sample or array of samples. Samples without
+// a time are set to the current time.
+func ParseSamples(payload []byte) ([]data.Sample, error) {
+	var samples []data.Sample
+
+	payload = bytes.TrimSpace(payload)
+	if len(payload) > 0 && payload[0] == '{' {
+		var s data.Sample
+		err := json.Unmarshal(payload, &s)
+		if err != nil {
+			return nil, err
+		}
+		samples = []data.Sample{s}
+	} else {
+		err := json.Unmarshal(payload, &samples)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	for i := range samples {
+		if samples[i].Time.IsZero() {
+			samples[i].Time = now
+		}
+	}
+
+	return samples, nil
+}
+
+// startSpan starts a span for a message from a device
+func startSpan(name string, msg Message, id string) (context.Context, *trace.Span) {
+	return trace.Start(context.Background(), name, trace.KindConsumer,
+		trace.Attr{Key: "messaging.system", Value: "mqtt"},
+		trace.Attr{Key: "messaging.destination", Value: msg.Topic},
+		trace.Attr{Key: "device", Value: id})
+}
+
+func (b *Bridge) write(msg Message, id string, samples []data.Sample) {
+	if id == "" {
+		return
+	}
+
+	ctx, span := startSpan("MQTT samples", msg, id)
+	var err error
+	defer span.End(&err)
+
+	err = b.config.Write(ctx, id, samples)
+	if err != nil {
+		log.Printf("MQTT: error writing samples for %v: %v\n", id, err)
+		return
+	}
+
+	// the device is online, so send it any commands it missed. This can't
+	// block the client read loop, which reads the acks.
+	go b.publishPending(id)
+}
+
+func (b *Bridge) handleSamples(msg Message) {
+	id, _ := b.deviceID(msg.Topic)
+
+	samples, err := ParseSamples(msg.Payload)
+	if err != nil {
+		log.Printf("MQTT: invalid samples from %v: %v\n", id, err)
+		return
+	}
+
+	b.write(msg, id, samples)
+}
+
+func (b *Bridge) handleBatch(msg Message) {
+	id, _ := b.deviceID(msg.Topic)
+
+	ctx, span := startSpan("MQTT batch", msg, id)
+	var err error
+	defer span.End(&err)
+
+	var batch data.SampleBatch
+	err = json.Unmarshal(msg.Payload, &batch)
+	if err != nil {
+		log.Printf("MQTT: invalid batch from %v: %v\n", id, err)
+		return
+	}
+
+	err = b.config.WriteBatch(ctx, id, batch)
+	if err != nil {
+		log.Printf("MQTT: error writing batch for %v: %v\n", id, err)
+		return
+	}
+
+	go b.publishPending(id)
+}
+
+func (b *Bridge) handleConfigReport(msg Message) {
+	id, _ := b.deviceID(msg.Topic)
+
+	var report data.ConfigReport
+	err := json.Unmarshal(msg.Payload, &report)
+	if err != nil {
+		log.Printf("MQTT: invalid config report from %v: %v\n", id, err)
+		return
+	}
+
+	err = b.db.DeviceReportConfig(id, report)
+	if err != nil {
+		log.Printf("MQTT: error writing config report for %v: %v\n", id, err)
+	}
+}
+
+func (b *Bridge) handleSample(msg Message) {
+	id, levels := b.deviceID(msg.Topic)
+
+	// levels are sample, type, and optionally the sample id
+	if len(levels) < 2 || len(levels) > 3 {
+		log.Println("MQTT: invalid sample topic: ", msg.Topic)
+		return
+	}
+
+	v, err := ParseValue(string(msg.Payload))
+	if err != nil {
+		log.Printf("MQTT: invalid value on %v: %v\n", msg.Topic, err)
+		return
+	}
+
+	s := data.Sample{Type: levels[1], Value: v, Time: time.Now()}
+	if len(levels) == 3 {
+		s.ID = levels[2]
+	}
+
+	b.write(msg, id, []data.Sample{s})
+}
+
+func (b *Bridge) publishConfig(id string, config data.DeviceConfig) {
+	payload, err := json.Marshal(config)
+	if err != nil {
+		log.Println("MQTT: error encoding config: ", err)
+		return
+	}
+
+	b.lock.Lock()
+	same := bytes.Equal(b.configs[id], payload)
+	b.lock.Unlock()
+
+	if same {
+		return
+	}
+
+	err = b.conn.Publish(b.config.Prefix+"/"+id+"/config", payload, 1, true)
+	if err != nil {
+		if err != ErrNotConnected && err != ErrNoSubscribers {
+			log.Printf("MQTT: error publishing config for %v: %v\n", id, err)
+		}
+		return
+	}
+
+	b.lock.Lock()
+	b.configs[id] = payload
+	b.lock.Unlock()
+}
+
+// publishCommand publishes a command and removes it from the queue when
+// the broker acks it. b.cmdLock must be held.
+func (b *Bridge) publishCommand(cmd data.DeviceCommand) error {
+	payload, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	err = b.conn.Publish(b.config.Prefix+"/"+cmd.DeviceID+"/command",
+		payload, 1, false)
+	if err != nil {
+		// the command stays queued
+		return err
+	}
+
+	return b.db.CommandDelete(cmd.ID)
+}
+
+func (b *Bridge) publishPending(id string) {
+	b.cmdLock.Lock()
+	defer b.cmdLock.Unlock()
+
+	cmds, err := b.db.DeviceCommands(id)
+	if err != nil {
+		log.Printf("MQTT: error reading commands for %v: %v\n", id, err)
+		return
+	}
+
+	for _, cmd := range cmds {
+		err := b.publishCommand(cmd)
+		if errors.Is(err, ErrNotConnected) || errors.Is(err, ErrNoSubscribers) {
+			return
+		}
+		if err != nil {
+			log.Printf("MQTT: error publishing command for %v: %v\n", id, err)
+		}
+	}
+}
@@ -0,0 +1,544 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoSubscribers is returned by Broker.Publish when a QoS 1 message was
+// not delivered to any subscriber
+var ErrNoSubscribers = errors.New("no MQTT subscribers")
+
+// ErrNotAuthorized is returned by an auth function to refuse a client
+var ErrNotAuthorized = errors.New("not authorized")
+
+// Permissions are the topic filters a client can publish and subscribe to
+type Permissions struct {
+	Publish   []string
+	Subscribe []string
+}
+
+// AllPermissions allows all topics
+var AllPermissions = Permissions{Publish: []string{"#"}, Subscribe: []string{"#"}}
+
+func (p Permissions) canPublish(topic string) bool {
+	for _, f := range p.Publish {
+		if MatchTopic(f, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterWithin returns true if all topics matched by filter are also
+// matched by allowed
+func filterWithin(filter, allowed string) bool {
+	f := strings.Split(filter, "/")
+	a := strings.Split(allowed, "/")
+
+	for i, level := range a {
+		if level == "#" {
+			return true
+		}
+
+		if i >= len(f) || f[i] == "#" {
+			return false
+		}
+
+		if level != "+" && level != f[i] {
+			return false
+		}
+	}
+
+	return len(f) == len(a)
+}
+
+func (p Permissions) canSubscribe(filter string) bool {
+	for _, a := range p.Subscribe {
+		if filterWithin(filter, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// BrokerConfig describes how the broker authorizes clients
+type BrokerConfig struct {
+	// Auth checks the credentials of a client and returns the topics it
+	// can use. If nil, clients can use all topics.
+	Auth func(clientID, user, password string) (Permissions, error)
+	// Timeout is used for the connect packet and writes (default 10s)
+	Timeout time.Duration
+}
+
+// brokerClient is a client connected to the broker
+type brokerClient struct {
+	id    string
+	conn  net.Conn
+	perms Permissions
+	// lock is held while writing to conn
+	lock   sync.Mutex
+	nextID uint16
+	// subs is protected by the broker lock
+	subs map[string]byte
+	// will is published if the client disconnects without a disconnect
+	// packet
+	will *publishPacket
+}
+
+// Broker is a MQTT 3.1.1 broker that can be embedded in the server, so
+// sensors can connect directly to it. Messages are not stored for
+// disconnected clients, except retained messages. The server uses the
+// broker with Subscribe and Publish, which are not limited by permissions.
+type Broker struct {
+	config    BrokerConfig
+	lock      sync.Mutex
+	clients   map[string]*brokerClient
+	internal  map[string]clientSub
+	retained  map[string]publishPacket
+	listeners []net.Listener
+}
+
+// NewBroker creates a broker. Serve accepts connections.
+func NewBroker(config BrokerConfig) *Broker {
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	return &Broker{
+		config:   config,
+		clients:  make(map[string]*brokerClient),
+		internal: make(map[string]clientSub),
+		retained: make(map[string]publishPacket),
+	}
+}
+
+// Serve accepts connections on l until Close is called
+func (b *Broker) Serve(l net.Listener) error {
+	b.lock.Lock()
+	b.listeners = append(b.listeners, l)
+	b.lock.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		go b.handleConn(conn)
+	}
+}
+
+// Close stops the listeners and disconnects all clients
+func (b *Broker) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, l := range b.listeners {
+		l.Close()
+	}
+	b.listeners = nil
+
+	for _, c := range b.clients {
+		c.conn.Close()
+	}
+
+	return nil
+}
+
+// Clients returns the IDs of the connected clients
+func (b *Broker) Clients() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var ret []string
+	for id := range b.clients {
+		ret = append(ret, id)
+	}
+	return ret
+}
+
+// Subscribe subscribes the server to a topic filter
+func (b *Broker) Subscribe(filter string, qos byte, handler Handler) error {
+	err := ValidateFilter(filter)
+	if err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	b.internal[filter] = clientSub{qos: qos, handler: handler}
+	retained := b.matchRetained(filter)
+	b.lock.Unlock()
+
+	for _, pub := range retained {
+		handler(Message{Topic: pub.topic, Payload: pub.payload, QoS: pub.qos,
+			Retain: true})
+	}
+
+	return nil
+}
+
+// Publish publishes a message from the server. ErrNoSubscribers is
+// returned if a QoS 1 message was not delivered to anyone and was not
+// retained.
+func (b *Broker) Publish(topic string, payload []byte, qos byte, retain bool) error {
+	err := ValidateTopic(topic)
+	if err != nil {
+		return err
+	}
+
+	if qos > 1 {
+		qos = 1
+	}
+
+	n := b.route(publishPacket{topic: topic, payload: payload, qos: qos,
+		retain: retain})
+
+	if n == 0 && qos > 0 && !retain {
+		return ErrNoSubscribers
+	}
+
+	return nil
+}
+
+// matchRetained returns the retained messages matching filter. b.lock must
+// be held.
+func (b *Broker) matchRetained(filter string) []publishPacket {
+	var ret []publishPacket
+	for topic, pub := range b.retained {
+		if MatchTopic(filter, topic) {
+			ret = append(ret, pub)
+		}
+	}
+	return ret
+}
+
+// route delivers a message to subscribers and returns the number of
+// subscribers it was delivered to
+func (b *Broker) route(pub publishPacket) int {
+	type target struct {
+		client *brokerClient
+		qos    byte
+	}
+
+	var targets []target
+	var handlers []Handler
+
+	b.lock.Lock()
+	if pub.retain {
+		if len(pub.payload) == 0 {
+			delete(b.retained, pub.topic)
+		} else {
+			b.retained[pub.topic] = pub
+		}
+	}
+
+	for _, c := range b.clients {
+		// a client gets one copy at the highest QoS of its matching
+		// subscriptions
+		matched := false
+		var qos byte
+		for filter, q := range c.subs {
+			if MatchTopic(filter, pub.topic) {
+				matched = true
+				if q > qos {
+					qos = q
+				}
+			}
+		}
+
+		if matched {
+			if pub.qos < qos {
+				qos = pub.qos
+			}
+			targets = append(targets, target{c, qos})
+		}
+	}
+
+	for filter, s := range b.internal {
+		if MatchTopic(filter, pub.topic) {
+			handlers = append(handlers, s.handler)
+		}
+	}
+	b.lock.Unlock()
+
+	for _, t := range targets {
+		b.send(t.client, publishPacket{topic: pub.topic, qos: t.qos,
+			payload: pub.payload})
+	}
+
+	msg := Message{Topic: pub.topic, Payload: pub.payload, QoS: pub.qos}
+	for _, h := range handlers {
+		h(msg)
+	}
+
+	return len(targets) + len(handlers)
+}
+
+// send sends a message to a client. Slow clients are disconnected.
+func (b *Broker) send(c *brokerClient, pub publishPacket) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if pub.qos > 0 {
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		pub.packetID = c.nextID
+	}
+
+	b.write(c, pub.encode())
+}
+
+// write writes a packet to a client. c.lock must be held.
+func (b *Broker) write(c *brokerClient, p packet) {
+	c.conn.SetWriteDeadline(time.Now().Add(b.config.Timeout))
+	err := writePacket(c.conn, p)
+	if err != nil {
+		log.Printf("MQTT broker: error writing to %v: %v\n", c.id, err)
+		c.conn.Close()
+	}
+}
+
+func (b *Broker) reply(c *brokerClient, p packet) {
+	c.lock.Lock()
+	b.write(c, p)
+	c.lock.Unlock()
+}
+
+// connect reads the connect packet and authorizes the client
+func (b *Broker) connect(conn net.Conn, r *bufio.Reader) (*brokerClient, uint16, error) {
+	conn.SetReadDeadline(time.Now().Add(b.config.Timeout))
+
+	p, err := readPacket(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if p.typ != typeConnect {
+		return nil, 0, errors.New("expected connect")
+	}
+
+	connect, err := decodeConnect(p)
+	if err == errBadProtocol {
+		writePacket(conn, connackPacket(false, connBadProtocol))
+		return nil, 0, err
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if connect.clientID == "" {
+		if !connect.cleanSession {
+			writePacket(conn, connackPacket(false, connBadClientID))
+			return nil, 0, errors.New("client ID is required")
+		}
+
+		id := make([]byte, 8)
+		rand.Read(id)
+		connect.clientID = "auto-" + hex.EncodeToString(id)
+	}
+
+	perms := AllPermissions
+	if b.config.Auth != nil {
+		perms, err = b.config.Auth(connect.clientID, connect.user,
+			connect.password)
+		if err != nil {
+			code := byte(connNotAuthorized)
+			if connect.hasPassword {
+				code = connBadUserOrPassword
+			}
+			writePacket(conn, connackPacket(false, code))
+			return nil, 0, err
+		}
+	}
+
+	c := &brokerClient{
+		id:    connect.clientID,
+		conn:  conn,
+		perms: perms,
+		subs:  make(map[string]byte),
+	}
+
+	if connect.hasWill {
+		if connect.willQoS > 1 || ValidateTopic(connect.willTopic) != nil ||
+			!perms.canPublish(connect.willTopic) {
+			writePacket(conn, connackPacket(false, connNotAuthorized))
+			return nil, 0, errors.New("invalid will topic: " + connect.willTopic)
+		}
+
+		c.will = &publishPacket{topic: connect.willTopic,
+			payload: []byte(connect.willPayload), qos: connect.willQoS,
+			retain: connect.willRetain}
+	}
+
+	// a new connection with the same client ID replaces the old one
+	b.lock.Lock()
+	if old, ok := b.clients[c.id]; ok {
+		old.conn.Close()
+	}
+	b.clients[c.id] = c
+	b.lock.Unlock()
+
+	// sessions are not stored, so there is never a session present
+	err = writePacket(conn, connackPacket(false, connAccepted))
+	return c, connect.keepAlive, err
+}
+
+func (b *Broker) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	c, keepAlive, err := b.connect(conn, r)
+	disconnected := false
+	if c != nil {
+		defer func() {
+			b.lock.Lock()
+			if b.clients[c.id] == c {
+				delete(b.clients, c.id)
+			}
+			b.lock.Unlock()
+
+			if c.will != nil && !disconnected {
+				b.route(*c.will)
+			}
+		}()
+	}
+
+	if err != nil {
+		log.Printf("MQTT broker: connection from %v refused: %v\n",
+			conn.RemoteAddr(), err)
+		return
+	}
+
+	for {
+		// clients must send a packet within 1.5 times the keep alive
+		if keepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(
+				time.Duration(keepAlive) * time.Second * 3 / 2))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+
+		p, err := readPacket(r)
+		if err != nil {
+			return
+		}
+
+		switch p.typ {
+		case typePublish:
+			err = b.handlePublish(c, p)
+		case typeSubscribe:
+			err = b.handleSubscribe(c, p)
+		case typeUnsubscribe:
+			var id uint16
+			var filters []string
+			id, filters, err = decodeUnsubscribe(p)
+			if err == nil {
+				b.lock.Lock()
+				for _, f := range filters {
+					delete(c.subs, f)
+				}
+				b.lock.Unlock()
+				b.reply(c, idPacket(typeUnsuback, 0, id))
+			}
+		case typePingreq:
+			b.reply(c, packet{typ: typePingresp})
+		case typePuback:
+			// messages are not redelivered, so acks are not tracked
+		case typeDisconnect:
+			disconnected = true
+			return
+		default:
+			err = errors.New("unsupported packet type")
+		}
+
+		if err != nil {
+			log.Printf("MQTT broker: disconnecting %v: %v\n", c.id, err)
+			return
+		}
+	}
+}
+
+func (b *Broker) handlePublish(c *brokerClient, p packet) error {
+	pub, err := decodePublish(p)
+	if err != nil {
+		return err
+	}
+
+	if pub.qos > 1 {
+		return errors.New("QoS 2 is not supported")
+	}
+
+	err = ValidateTopic(pub.topic)
+	if err != nil {
+		return err
+	}
+
+	// MQTT 3.1.1 can't refuse a publish, so the client is disconnected
+	if !c.perms.canPublish(pub.topic) {
+		return errors.New("not authorized to publish to " + pub.topic)
+	}
+
+	b.route(pub)
+
+	if pub.qos > 0 {
+		b.reply(c, idPacket(typePuback, 0, pub.packetID))
+	}
+
+	return nil
+}
+
+func (b *Broker) handleSubscribe(c *brokerClient, p packet) error {
+	id, subs, err := decodeSubscribe(p)
+	if err != nil {
+		return err
+	}
+
+	var codes []byte
+	var retained []publishPacket
+
+	b.lock.Lock()
+	for _, s := range subs {
+		if ValidateFilter(s.filter) != nil || !c.perms.canSubscribe(s.filter) {
+			codes = append(codes, subFailure)
+			continue
+		}
+
+		qos := s.qos
+		if qos > 1 {
+			qos = 1
+		}
+
+		c.subs[s.filter] = qos
+		codes = append(codes, qos)
+
+		for _, pub := range b.matchRetained(s.filter) {
+			if pub.qos > qos {
+				pub.qos = qos
+			}
+			retained = append(retained, pub)
+		}
+	}
+	b.lock.Unlock()
+
+	b.reply(c, subackPacket(id, codes))
+
+	for _, pub := range retained {
+		b.send(c, pub)
+	}
+
+	return nil
+}
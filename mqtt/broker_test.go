@@ -0,0 +1,204 @@
+package mqtt
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilterWithin(t *testing.T) {
+	for _, c := range []struct {
+		filter, allowed string
+		ok              bool
+	}{
+		{"siot/1/command", "siot/1/#", true},
+		{"siot/1/#", "siot/1/#", true},
+		{"siot/1", "siot/1/#", true},
+		{"siot/+/command", "siot/1/#", false},
+		{"siot/#", "siot/1/#", false},
+		{"siot/+/command", "siot/+/command", true},
+		{"a/b", "#", true},
+	} {
+		if filterWithin(c.filter, c.allowed) != c.ok {
+			t.Errorf("filterWithin(%v, %v) should be %v", c.filter, c.allowed,
+				c.ok)
+		}
+	}
+}
+
+func startBroker(t *testing.T, config BrokerConfig) (*Broker, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening: ", err)
+	}
+
+	b := NewBroker(config)
+	go b.Serve(l)
+
+	return b, "tcp://" + l.Addr().String()
+}
+
+func connectClient(t *testing.T, broker, id, password string) *Client {
+	c := NewClient(ClientConfig{Broker: broker, ClientID: id,
+		Password: password, RetryInterval: 10 * time.Millisecond})
+	c.Start()
+
+	for i := 0; !c.Connected(); i++ {
+		if i > 100 {
+			t.Fatal("client did not connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return c
+}
+
+func TestBroker(t *testing.T) {
+	b, addr := startBroker(t, BrokerConfig{
+		Auth: func(clientID, user, password string) (Permissions, error) {
+			if password != "key" {
+				return Permissions{}, ErrNotAuthorized
+			}
+			return Permissions{
+				Publish:   []string{"siot/" + clientID + "/#"},
+				Subscribe: []string{"siot/" + clientID + "/#"},
+			}, nil
+		},
+	})
+	defer b.Close()
+
+	received := make(chan Message, 10)
+	err := b.Subscribe("siot/+/samples", 1, func(msg Message) {
+		received <- msg
+	})
+	if err != nil {
+		t.Fatal("Error subscribing: ", err)
+	}
+
+	err = b.Publish("siot/dev1/config", []byte(`{}`), 1, true)
+	if err != nil {
+		t.Fatal("Error publishing retained message: ", err)
+	}
+
+	c := connectClient(t, addr, "dev1", "key")
+	defer c.Stop()
+
+	config := make(chan Message, 10)
+	err = c.Subscribe("siot/dev1/config", 1, func(msg Message) {
+		config <- msg
+	})
+	if err != nil {
+		t.Fatal("Error subscribing: ", err)
+	}
+
+	select {
+	case msg := <-config:
+		if string(msg.Payload) != `{}` {
+			t.Error("wrong retained payload: ", string(msg.Payload))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("retained message not received")
+	}
+
+	err = c.Subscribe("siot/dev2/config", 1, func(Message) {})
+	if err == nil {
+		t.Error("subscription to another device should be rejected")
+	}
+
+	err = c.Publish("siot/dev1/samples", []byte(`[]`), 1, false)
+	if err != nil {
+		t.Fatal("Error publishing: ", err)
+	}
+
+	select {
+	case msg := <-received:
+		if msg.Topic != "siot/dev1/samples" {
+			t.Error("wrong topic: ", msg.Topic)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not received by broker")
+	}
+
+	err = b.Publish("siot/dev1/config", []byte(`{"description":"x"}`), 1, true)
+	if err != nil {
+		t.Error("Error publishing to client: ", err)
+	}
+
+	select {
+	case <-config:
+	case <-time.After(time.Second):
+		t.Fatal("message not received by client")
+	}
+
+	err = b.Publish("siot/dev3/command", []byte(`{}`), 1, false)
+	if err != ErrNoSubscribers {
+		t.Error("expected no subscribers, got: ", err)
+	}
+
+	// wrong key
+	bad := NewClient(ClientConfig{Broker: addr, ClientID: "dev2",
+		Password: "bad"})
+	_, _, err = bad.connect()
+	if err == nil {
+		t.Error("client with a bad key should be refused")
+	}
+}
+
+func TestBrokerWill(t *testing.T) {
+	b, addr := startBroker(t, BrokerConfig{})
+	defer b.Close()
+
+	wills := make(chan Message, 10)
+	err := b.Subscribe("siot/+/status", 1, func(msg Message) {
+		wills <- msg
+	})
+	if err != nil {
+		t.Fatal("Error subscribing: ", err)
+	}
+
+	connect := func() net.Conn {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(addr, "tcp://"))
+		if err != nil {
+			t.Fatal("Error connecting: ", err)
+		}
+
+		err = writePacket(conn, connectPacket{clientID: "dev1", cleanSession: true,
+			hasWill: true, willTopic: "siot/dev1/status", willPayload: "offline",
+			willQoS: 1}.encode())
+		if err != nil {
+			t.Fatal("Error writing connect: ", err)
+		}
+
+		p, err := readPacket(bufio.NewReader(conn))
+		if err != nil || p.typ != typeConnack {
+			t.Fatal("Error reading connack: ", err)
+		}
+
+		return conn
+	}
+
+	// the will is published when the connection is lost
+	connect().Close()
+
+	select {
+	case msg := <-wills:
+		if string(msg.Payload) != "offline" {
+			t.Error("wrong will: ", string(msg.Payload))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("will not published")
+	}
+
+	// but not after a disconnect
+	conn := connect()
+	writePacket(conn, packet{typ: typeDisconnect})
+	conn.Close()
+
+	select {
+	case <-wills:
+		t.Error("will published after disconnect")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,576 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ErrNotConnected is returned when publishing while the client is not
+// connected to the broker
+var ErrNotConnected = errors.New("not connected to MQTT broker")
+
+// Message is a message received from the broker
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+// Handler is called for each received message that matches a
+// subscription. Handlers are called from the client read loop, so they
+// should not block.
+type Handler func(Message)
+
+// ClientConfig describes how to connect to a broker
+type ClientConfig struct {
+	// Broker is the broker URL, like tcp://localhost:1883 or
+	// tls://broker:8883
+	Broker   string
+	ClientID string
+	User     string
+	Password string
+	// KeepAlive is how often the connection is checked (default 30s)
+	KeepAlive time.Duration
+	// Timeout is used for connecting and waiting for acks (default 10s)
+	Timeout time.Duration
+	// RetryInterval is the delay after the first failed connection attempt
+	// (default 5s). The delay doubles after each failed attempt, up to
+	// MaxRetryInterval (default 2m), and is reset once the client connects.
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+	// TLS is used for tls:// brokers. The default config is used if nil.
+	TLS *tls.Config
+	// Will is published by the broker if the client disconnects
+	// unexpectedly
+	Will *Message
+	// OnConnect is called in a new goroutine each time the client connects,
+	// after subscriptions are restored
+	OnConnect func()
+}
+
+// LoadTLS returns the TLS config of a client with an optional CA file and
+// client certificate, or nil to use the default config if all are blank
+func LoadTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %v", caFile)
+		}
+	}
+
+	return config, nil
+}
+
+type clientSub struct {
+	qos     byte
+	handler Handler
+}
+
+// Client is a MQTT client that stays connected to a broker. Subscriptions
+// are restored when the client reconnects.
+type Client struct {
+	config ClientConfig
+	lock   sync.Mutex
+	conn   net.Conn
+	nextID uint16
+	subs   map[string]clientSub
+	acks   map[uint16]chan error
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewClient creates a client. Start connects to the broker.
+func NewClient(config ClientConfig) *Client {
+	if config.KeepAlive == 0 {
+		config.KeepAlive = 30 * time.Second
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	if config.RetryInterval == 0 {
+		config.RetryInterval = 5 * time.Second
+	}
+
+	if config.MaxRetryInterval == 0 {
+		config.MaxRetryInterval = 2 * time.Minute
+	}
+
+	if config.MaxRetryInterval < config.RetryInterval {
+		config.MaxRetryInterval = config.RetryInterval
+	}
+
+	return &Client{
+		config: config,
+		subs:   make(map[string]clientSub),
+		acks:   make(map[uint16]chan error),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start connects to the broker in the background and reconnects until
+// Stop is called
+func (c *Client) Start() {
+	go func() {
+		defer close(c.done)
+
+		failures := 0
+		for {
+			connected, err := c.run()
+			if err != nil {
+				log.Println("MQTT: connection error: ", err)
+			}
+
+			if connected {
+				failures = 0
+			}
+
+			delay := retryDelay(c.config.RetryInterval,
+				c.config.MaxRetryInterval, failures)
+			failures++
+
+			select {
+			case <-c.stop:
+				return
+			case <-time.After(delay):
+			}
+		}
+	}()
+}
+
+// retryDelay returns the delay before the next connection attempt after a
+// number of failed attempts in a row. The delay is randomized by +/- 20%,
+// so devices that lost the network at the same time don't all reconnect
+// at the same time.
+func retryDelay(initial, max time.Duration, failures int) time.Duration {
+	delay := initial
+	for i := 0; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+
+	if delay > max {
+		delay = max
+	}
+
+	return time.Duration(float64(delay) * (0.8 + 0.4*rand.Float64()))
+}
+
+// Stop disconnects from the broker
+func (c *Client) Stop() {
+	close(c.stop)
+
+	c.lock.Lock()
+	if c.conn != nil {
+		writePacket(c.conn, packet{typ: typeDisconnect})
+		c.conn.Close()
+	}
+	c.lock.Unlock()
+
+	<-c.done
+}
+
+// SetPassword changes the password used when the client reconnects, like
+// after a device key is rotated. The current connection is kept.
+func (c *Client) SetPassword(password string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.config.Password = password
+}
+
+// SetWill changes the will used when the client reconnects
+func (c *Client) SetWill(will *Message) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.config.Will = will
+}
+
+// Connected returns true if the client is connected to the broker
+func (c *Client) Connected() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.conn != nil
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	u, err := url.Parse(c.config.Broker)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: c.config.Timeout}
+
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "1883")
+		}
+		return dialer.Dial("tcp", host)
+	case "tls", "ssl", "mqtts":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "8883")
+		}
+		config := c.config.TLS
+		if config == nil {
+			config = &tls.Config{ServerName: u.Hostname()}
+		}
+		return tls.DialWithDialer(dialer, "tcp", host, config)
+	}
+
+	return nil, fmt.Errorf("unsupported MQTT broker scheme: %v", u.Scheme)
+}
+
+// connect opens a connection and starts a session
+func (c *Client) connect() (net.Conn, *bufio.Reader, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.lock.Lock()
+	password := c.config.Password
+	will := c.config.Will
+	c.lock.Unlock()
+
+	connect := connectPacket{
+		clientID:     c.config.ClientID,
+		user:         c.config.User,
+		password:     password,
+		hasUser:      c.config.User != "",
+		hasPassword:  password != "",
+		keepAlive:    uint16(c.config.KeepAlive / time.Second),
+		cleanSession: true,
+	}
+
+	if will != nil {
+		connect.hasWill = true
+		connect.willTopic = will.Topic
+		connect.willPayload = string(will.Payload)
+		connect.willQoS = will.QoS
+		connect.willRetain = will.Retain
+	}
+
+	conn.SetDeadline(time.Now().Add(c.config.Timeout))
+
+	err = writePacket(conn, connect.encode())
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	p, err := readPacket(r)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if p.typ != typeConnack || len(p.body) != 2 {
+		conn.Close()
+		return nil, nil, errors.New("expected MQTT connack")
+	}
+
+	if p.body[1] != connAccepted {
+		conn.Close()
+		return nil, nil, fmt.Errorf("MQTT connection refused: %v", p.body[1])
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, r, nil
+}
+
+// run connects and handles packets until the connection fails. connected
+// is true if the broker accepted the connection.
+func (c *Client) run() (connected bool, err error) {
+	conn, r, err := c.connect()
+	if err != nil {
+		return false, err
+	}
+
+	c.lock.Lock()
+	c.conn = conn
+	var subs []subscription
+	for filter, s := range c.subs {
+		subs = append(subs, subscription{filter: filter, qos: s.qos})
+	}
+	c.lock.Unlock()
+
+	log.Println("MQTT: connected to ", c.config.Broker)
+
+	defer func() {
+		c.lock.Lock()
+		c.conn = nil
+		for id, ack := range c.acks {
+			ack <- ErrNotConnected
+			delete(c.acks, id)
+		}
+		c.lock.Unlock()
+		conn.Close()
+	}()
+
+	// restore subscriptions
+	if len(subs) > 0 {
+		c.lock.Lock()
+		err = writePacket(conn, subscribePacket(c.packetID(), subs))
+		c.lock.Unlock()
+		if err != nil {
+			return true, err
+		}
+	}
+
+	pingDone := make(chan struct{})
+	defer close(pingDone)
+	go c.ping(conn, pingDone)
+
+	if c.config.OnConnect != nil {
+		go c.config.OnConnect()
+	}
+
+	for {
+		// the broker must respond to pings within the keep alive
+		conn.SetReadDeadline(time.Now().Add(c.config.KeepAlive * 3 / 2))
+
+		p, err := readPacket(r)
+		if err != nil {
+			select {
+			case <-c.stop:
+				return true, nil
+			default:
+				return true, err
+			}
+		}
+
+		switch p.typ {
+		case typePublish:
+			err = c.handlePublish(conn, p)
+		case typePuback, typeSuback, typeUnsuback:
+			var id uint16
+			var codes []byte
+			if p.typ == typeSuback {
+				id, codes, err = decodeSuback(p)
+			} else {
+				id, err = decodeID(p)
+			}
+			if err != nil {
+				return true, err
+			}
+
+			var ackErr error
+			for _, code := range codes {
+				if code == subFailure {
+					ackErr = errors.New("MQTT subscription rejected")
+				}
+			}
+
+			c.lock.Lock()
+			if ack, ok := c.acks[id]; ok {
+				ack <- ackErr
+				delete(c.acks, id)
+			}
+			c.lock.Unlock()
+		case typePingresp:
+		default:
+			return true, fmt.Errorf("unexpected MQTT packet type: %v", p.typ)
+		}
+
+		if err != nil {
+			return true, err
+		}
+	}
+}
+
+// ping sends pings so the broker knows the client is alive
+func (c *Client) ping(conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(c.config.KeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.lock.Lock()
+			err := writePacket(conn, packet{typ: typePingreq})
+			c.lock.Unlock()
+			if err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (c *Client) handlePublish(conn net.Conn, p packet) error {
+	pub, err := decodePublish(p)
+	if err != nil {
+		return err
+	}
+
+	if pub.qos > 0 {
+		c.lock.Lock()
+		err = writePacket(conn, idPacket(typePuback, 0, pub.packetID))
+		c.lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	msg := Message{Topic: pub.topic, Payload: pub.payload, QoS: pub.qos,
+		Retain: pub.retain}
+
+	c.lock.Lock()
+	var handlers []Handler
+	for filter, s := range c.subs {
+		if MatchTopic(filter, pub.topic) {
+			handlers = append(handlers, s.handler)
+		}
+	}
+	c.lock.Unlock()
+
+	for _, h := range handlers {
+		h(msg)
+	}
+
+	return nil
+}
+
+// packetID returns the next packet ID. c.lock must be held.
+func (c *Client) packetID() uint16 {
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	return c.nextID
+}
+
+// send writes a packet and waits for the ack if ack is true
+func (c *Client) send(build func(id uint16) packet, ack bool) error {
+	c.lock.Lock()
+	if c.conn == nil {
+		c.lock.Unlock()
+		return ErrNotConnected
+	}
+
+	id := c.packetID()
+	var ch chan error
+	if ack {
+		ch = make(chan error, 1)
+		c.acks[id] = ch
+	}
+
+	err := writePacket(c.conn, build(id))
+	c.lock.Unlock()
+
+	if err != nil || !ack {
+		return err
+	}
+
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(c.config.Timeout):
+		c.lock.Lock()
+		delete(c.acks, id)
+		c.lock.Unlock()
+		return errors.New("timeout waiting for MQTT ack")
+	}
+}
+
+// Subscribe subscribes to a topic filter. The subscription is kept and
+// restored on reconnect, so it can be made before the client connects.
+func (c *Client) Subscribe(filter string, qos byte, handler Handler) error {
+	err := ValidateFilter(filter)
+	if err != nil {
+		return err
+	}
+
+	if qos > 1 {
+		qos = 1
+	}
+
+	c.lock.Lock()
+	c.subs[filter] = clientSub{qos: qos, handler: handler}
+	c.lock.Unlock()
+
+	err = c.send(func(id uint16) packet {
+		return subscribePacket(id, []subscription{{filter: filter, qos: qos}})
+	}, true)
+
+	if err == ErrNotConnected {
+		// subscribed when connected
+		return nil
+	}
+
+	return err
+}
+
+// Unsubscribe removes a subscription
+func (c *Client) Unsubscribe(filter string) error {
+	c.lock.Lock()
+	delete(c.subs, filter)
+	c.lock.Unlock()
+
+	err := c.send(func(id uint16) packet {
+		return unsubscribePacket(id, []string{filter})
+	}, true)
+
+	if err == ErrNotConnected {
+		return nil
+	}
+
+	return err
+}
+
+// Publish publishes a message. QoS 1 messages wait for the broker to ack
+// the message. QoS 2 is sent as QoS 1.
+func (c *Client) Publish(topic string, payload []byte, qos byte, retain bool) error {
+	err := ValidateTopic(topic)
+	if err != nil {
+		return err
+	}
+
+	if qos > 1 {
+		qos = 1
+	}
+
+	return c.send(func(id uint16) packet {
+		pub := publishPacket{topic: topic, qos: qos, retain: retain,
+			payload: payload}
+		if qos > 0 {
+			pub.packetID = id
+		}
+		return pub.encode()
+	}, qos > 0)
+}
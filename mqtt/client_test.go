@@ -0,0 +1,25 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	cases := []struct {
+		failures int
+		exp      time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{10, 30 * time.Second},
+	}
+
+	for _, c := range cases {
+		d := retryDelay(time.Second, 30*time.Second, c.failures)
+		if d < c.exp*8/10 || d > c.exp*12/10 {
+			t.Errorf("wrong delay for %v failures: %v", c.failures, d)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"text/template"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+// forwarded payload formats
+const (
+	// FormatJSON publishes samples and events as JSON
+	FormatJSON = "json"
+	// FormatLine publishes samples in the influx line protocol. Events are
+	// published as JSON.
+	FormatLine = "line"
+	// FormatTemplate publishes the output of the payload template
+	FormatTemplate = "template"
+)
+
+// DefaultForwardTopic is the sample topic template used if none is
+// configured
+const DefaultForwardTopic = `siot/{{.DeviceID}}/{{.Sample.Type}}`
+
+// DefaultForwardEventTopic is the event topic template used if none is
+// configured
+const DefaultForwardEventTopic = `siot/events/{{.Type}}`
+
+// ForwarderConfig describes what the forwarder publishes. Topics and
+// payloads are text/template templates executed with a ForwardContext.
+type ForwarderConfig struct {
+	// Topic is the topic samples are published to (default
+	// DefaultForwardTopic)
+	Topic string
+	// EventTopic is the topic events are published to (default
+	// DefaultForwardEventTopic)
+	EventTopic string
+	// Format is the payload format: json (default), line, or template
+	Format string
+	// Payload is the payload template of the template format
+	Payload string
+	// Measurement is the measurement of the line format (default samples)
+	Measurement string
+	// Types are the sample types that are forwarded, or all if empty
+	Types []string
+	// Events are the types of events that are forwarded, or none if empty.
+	// Samples are not events.
+	Events []db.EventType
+	// QoS is the QoS messages are published with, 0 or 1
+	QoS byte
+	// Retain publishes retained messages
+	Retain bool
+	// Buffer is the number of samples and events buffered while messages
+	// are published (default 10000). If the buffer fills, they are dropped
+	// and counted.
+	Buffer int
+}
+
+// ForwardContext is the data forwarder templates are executed with
+type ForwardContext struct {
+	DeviceID string
+	// Type is the sample type or event type
+	Type string
+	// Sample is the forwarded sample, or nil for events
+	Sample *data.Sample
+	// Event is the forwarded event, or nil for samples
+	Event *db.Event
+}
+
+// Forwarder republishes samples and events to a broker, typically a
+// Client connected to a third party platform. Messages are dropped while
+// the client is not connected.
+type Forwarder struct {
+	conn        Conn
+	db          *db.Db
+	config      ForwarderConfig
+	topic       *template.Template
+	eventTopic  *template.Template
+	payload     *template.Template
+	types       map[string]bool
+	eventFilter []db.EventType
+	events      <-chan db.Event
+	stop        chan struct{}
+}
+
+// NewForwarder creates a forwarder that publishes to conn
+func NewForwarder(conn Conn, dbInst *db.Db, config ForwarderConfig) (*Forwarder, error) {
+	if config.Topic == "" {
+		config.Topic = DefaultForwardTopic
+	}
+
+	if config.EventTopic == "" {
+		config.EventTopic = DefaultForwardEventTopic
+	}
+
+	if config.Format == "" {
+		config.Format = FormatJSON
+	}
+
+	if config.Measurement == "" {
+		config.Measurement = "samples"
+	}
+
+	if config.Buffer == 0 {
+		config.Buffer = 10000
+	}
+
+	f := &Forwarder{
+		conn:   conn,
+		db:     dbInst,
+		config: config,
+		types:  make(map[string]bool),
+		stop:   make(chan struct{}),
+	}
+
+	var err error
+	f.topic, err = template.New("topic").Parse(config.Topic)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing forward topic template: %v", err)
+	}
+
+	f.eventTopic, err = template.New("eventTopic").Parse(config.EventTopic)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing forward event topic template: %v", err)
+	}
+
+	switch config.Format {
+	case FormatJSON, FormatLine:
+	case FormatTemplate:
+		if config.Payload == "" {
+			return nil, errors.New("template format requires a payload template")
+		}
+
+		f.payload, err = template.New("payload").Parse(config.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing forward payload template: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown forward format: %v", config.Format)
+	}
+
+	for _, t := range config.Types {
+		f.types[t] = true
+	}
+
+	f.eventFilter = []db.EventType{db.EventSampleWritten}
+	for _, t := range config.Events {
+		if t != db.EventSampleWritten {
+			f.eventFilter = append(f.eventFilter, t)
+		}
+	}
+
+	return f, nil
+}
+
+// Start forwards samples and events until Stop is called
+func (f *Forwarder) Start() {
+	f.events = f.db.SubscribeBuffered(db.EventFilter{Types: f.eventFilter},
+		f.config.Buffer)
+
+	go func() {
+		for {
+			select {
+			case e, ok := <-f.events:
+				if !ok {
+					return
+				}
+
+				err := f.forward(e)
+				if err != nil && err != ErrNotConnected {
+					log.Printf("MQTT: error forwarding %v: %v\n", e.Type, err)
+				}
+			case <-f.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Dropped returns the number of samples and events dropped because the
+// forwarder fell behind
+func (f *Forwarder) Dropped() uint64 {
+	return f.db.Dropped(f.events)
+}
+
+// Stop stops the forwarder
+func (f *Forwarder) Stop() {
+	close(f.stop)
+	f.db.Unsubscribe(f.events)
+}
+
+func (f *Forwarder) forward(e db.Event) error {
+	ctx := ForwardContext{DeviceID: e.DeviceID, Type: e.Type.String()}
+	topicTemplate := f.eventTopic
+
+	if e.Type == db.EventSampleWritten {
+		if len(f.types) > 0 && !f.types[e.Sample.Type] {
+			return nil
+		}
+
+		ctx.Type = e.Sample.Type
+		ctx.Sample = e.Sample
+		topicTemplate = f.topic
+	} else {
+		ctx.Event = &e
+	}
+
+	var topic bytes.Buffer
+	err := topicTemplate.Execute(&topic, ctx)
+	if err != nil {
+		return err
+	}
+
+	payload, err := f.Payload(ctx)
+	if err != nil {
+		return err
+	}
+
+	return f.conn.Publish(topic.String(), payload, f.config.QoS, f.config.Retain)
+}
+
+// Payload returns the payload of a sample or event in the configured format
+func (f *Forwarder) Payload(ctx ForwardContext) ([]byte, error) {
+	switch {
+	case f.config.Format == FormatTemplate:
+		var buf bytes.Buffer
+		err := f.payload.Execute(&buf, ctx)
+		return buf.Bytes(), err
+	case ctx.Sample != nil && f.config.Format == FormatLine:
+		return f.line(ctx.DeviceID, *ctx.Sample)
+	case ctx.Sample != nil:
+		return json.Marshal(ctx.Sample)
+	default:
+		return json.Marshal(ctx.Event)
+	}
+}
+
+// line returns a sample in the influx line protocol, with the device ID,
+// type, ID, and tags of the sample as tags
+func (f *Forwarder) line(id string, s data.Sample) ([]byte, error) {
+	tags := map[string]string{"device": id, "type": s.Type}
+	if s.ID != "" {
+		tags["id"] = s.ID
+	}
+	for k, v := range s.Tags {
+		tags[k] = v
+	}
+
+	fields := map[string]interface{}{"value": s.Value}
+	if s.Min != 0 || s.Max != 0 {
+		fields["min"] = s.Min
+		fields["max"] = s.Max
+	}
+	for k, v := range s.Attributes {
+		fields[k] = v
+	}
+
+	pt, err := client.NewPoint(f.config.Measurement, tags, fields, s.Time)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(pt.String()), nil
+}
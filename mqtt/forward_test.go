@@ -0,0 +1,197 @@
+package mqtt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+func TestForwarderPayload(t *testing.T) {
+	sample := data.Sample{Type: "temp", ID: "t1", Value: 21.5,
+		Time: time.Unix(1600000000, 0)}
+
+	for _, tc := range []struct {
+		config ForwarderConfig
+		exp    string
+	}{
+		{ForwarderConfig{}, `{"type":"temp","id":"t1","value":21.5,"time":"` +
+			sample.Time.Format(time.RFC3339Nano) + `"}`},
+		{ForwarderConfig{Format: FormatLine},
+			"samples,device=1234,id=t1,type=temp value=21.5 1600000000000000000"},
+		{ForwarderConfig{Format: FormatTemplate, Payload: `{{.DeviceID}} {{.Sample.Value}}`},
+			"1234 21.5"},
+	} {
+		f, err := NewForwarder(nil, nil, tc.config)
+		if err != nil {
+			t.Fatal("Error creating forwarder: ", err)
+		}
+
+		payload, err := f.Payload(ForwardContext{DeviceID: "1234", Type: "temp",
+			Sample: &sample})
+		if err != nil {
+			t.Fatal("Error creating payload: ", err)
+		}
+
+		if string(payload) != tc.exp {
+			t.Errorf("wrong %v payload: %s", tc.config.Format, payload)
+		}
+	}
+
+	for _, c := range []ForwarderConfig{
+		{Format: "xml"},
+		{Format: FormatTemplate},
+		{Topic: "{{.DeviceID"},
+	} {
+		_, err := NewForwarder(nil, nil, c)
+		if err == nil {
+			t.Errorf("%+v should be invalid", c)
+		}
+	}
+}
+
+func TestForwarder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-mqtt-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbInst, err := db.NewDb(dir, nil)
+	if err != nil {
+		t.Fatal("Error opening db: ", err)
+	}
+	defer dbInst.Close()
+
+	broker := NewBroker(BrokerConfig{})
+
+	messages := make(chan Message, 10)
+	err = broker.Subscribe("#", 0, func(msg Message) {
+		messages <- msg
+	})
+	if err != nil {
+		t.Fatal("Error subscribing: ", err)
+	}
+
+	f, err := NewForwarder(broker, dbInst, ForwarderConfig{
+		Topic:  "plant/{{.DeviceID}}/{{.Type}}",
+		Types:  []string{"temp"},
+		Events: []db.EventType{db.EventCommandQueued},
+	})
+	if err != nil {
+		t.Fatal("Error creating forwarder: ", err)
+	}
+
+	f.Start()
+	defer f.Stop()
+
+	dbInst.DeviceSample("1234", data.Sample{Type: "humidity", Value: 40})
+	dbInst.DeviceSample("1234", data.Sample{Type: "temp", Value: 21})
+	dbInst.CommandEnqueue(data.DeviceCommand{DeviceID: "1234", Command: "reboot"})
+
+	for _, exp := range []string{"plant/1234/temp", "siot/events/commandQueued"} {
+		select {
+		case msg := <-messages:
+			if msg.Topic != exp {
+				t.Errorf("wrong topic %v, expected %v", msg.Topic, exp)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for ", exp)
+		}
+	}
+}
+
+func TestForwarderBurst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-mqtt-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbInst, err := db.NewDb(dir, nil)
+	if err != nil {
+		t.Fatal("Error opening db: ", err)
+	}
+	defer dbInst.Close()
+
+	// writes count samples in one transaction, so they are all published
+	// at once when it commits
+	burst := func(count int) {
+		start := time.Now()
+		err := dbInst.Update(func(txn *db.Txn) error {
+			for i := 0; i < count; i++ {
+				err := txn.DeviceSample("1234", data.Sample{Type: "temp",
+					Value: float64(i), Time: start.Add(time.Duration(i) * time.Millisecond)})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal("Error writing samples: ", err)
+		}
+	}
+
+	// receive counts messages until none arrive for a while
+	receive := func(messages chan Message) int {
+		count := 0
+		for {
+			select {
+			case <-messages:
+				count++
+			case <-time.After(200 * time.Millisecond):
+				return count
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		buffer    int
+		allArrive bool
+	}{
+		{0, true},
+		{10, false},
+	} {
+		broker := NewBroker(BrokerConfig{})
+
+		// the forwarder blocks publishing until messages are received
+		messages := make(chan Message)
+		err = broker.Subscribe("#", 0, func(msg Message) {
+			messages <- msg
+		})
+		if err != nil {
+			t.Fatal("Error subscribing: ", err)
+		}
+
+		f, err := NewForwarder(broker, dbInst, ForwarderConfig{Buffer: tc.buffer})
+		if err != nil {
+			t.Fatal("Error creating forwarder: ", err)
+		}
+
+		f.Start()
+
+		burst(500)
+		received := receive(messages)
+		dropped := f.Dropped()
+
+		f.Stop()
+
+		if received+int(dropped) != 500 {
+			t.Errorf("buffer %v: %v received and %v dropped, expected 500 total",
+				tc.buffer, received, dropped)
+		}
+
+		if tc.allArrive && received != 500 {
+			t.Errorf("buffer %v: only %v of 500 samples forwarded", tc.buffer,
+				received)
+		}
+
+		if !tc.allArrive && dropped == 0 {
+			t.Errorf("buffer %v: expected dropped samples", tc.buffer)
+		}
+	}
+}
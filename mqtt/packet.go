@@ -0,0 +1,419 @@
+// Package mqtt is a small MQTT 3.1.1 client and broker used to exchange
+// samples, config, and commands with devices that speak MQTT. QoS 0 and 1
+// are supported.
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MQTT control packet types
+const (
+	typeConnect     = 1
+	typeConnack     = 2
+	typePublish     = 3
+	typePuback      = 4
+	typeSubscribe   = 8
+	typeSuback      = 9
+	typeUnsubscribe = 10
+	typeUnsuback    = 11
+	typePingreq     = 12
+	typePingresp    = 13
+	typeDisconnect  = 14
+)
+
+// connack return codes
+const (
+	connAccepted          = 0
+	connBadProtocol       = 1
+	connBadClientID       = 2
+	connBadUserOrPassword = 4
+	connNotAuthorized     = 5
+)
+
+// subFailure is the suback code for a rejected subscription
+const subFailure = 0x80
+
+// maxPacketSize limits the memory used by a packet
+const maxPacketSize = 1 << 20
+
+// errMalformed is returned when a packet can't be decoded
+var errMalformed = errors.New("malformed MQTT packet")
+
+// packet is a MQTT control packet. The body is the variable header and
+// payload.
+type packet struct {
+	typ   byte
+	flags byte
+	body  []byte
+}
+
+func readPacket(r *bufio.Reader) (packet, error) {
+	var p packet
+
+	b, err := r.ReadByte()
+	if err != nil {
+		return p, err
+	}
+
+	p.typ = b >> 4
+	p.flags = b & 0x0f
+
+	// remaining length is up to 4 bytes, 7 bits each
+	length := 0
+	for i := 0; ; i++ {
+		if i >= 4 {
+			return p, errMalformed
+		}
+
+		b, err := r.ReadByte()
+		if err != nil {
+			return p, err
+		}
+
+		length |= int(b&0x7f) << (7 * uint(i))
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	if length > maxPacketSize {
+		return p, fmt.Errorf("MQTT packet too large: %v", length)
+	}
+
+	p.body = make([]byte, length)
+	_, err = io.ReadFull(r, p.body)
+	return p, err
+}
+
+func writePacket(w io.Writer, p packet) error {
+	buf := []byte{p.typ<<4 | p.flags}
+
+	length := len(p.body)
+	for {
+		b := byte(length & 0x7f)
+		length >>= 7
+		if length > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if length == 0 {
+			break
+		}
+	}
+
+	_, err := w.Write(append(buf, p.body...))
+	return err
+}
+
+// encoder builds a packet body
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) byte(b byte) {
+	e.b = append(e.b, b)
+}
+
+func (e *encoder) uint16(v uint16) {
+	e.b = append(e.b, byte(v>>8), byte(v))
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uint16(uint16(len(b)))
+	e.b = append(e.b, b...)
+}
+
+func (e *encoder) string(s string) {
+	e.bytes([]byte(s))
+}
+
+// decoder reads a packet body. Errors are sticky, so they only need to be
+// checked at the end.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) byte() byte {
+	if len(d.b) < 1 {
+		d.err = errMalformed
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *decoder) uint16() uint16 {
+	if len(d.b) < 2 {
+		d.err = errMalformed
+		return 0
+	}
+	v := binary.BigEndian.Uint16(d.b)
+	d.b = d.b[2:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := int(d.uint16())
+	if len(d.b) < n {
+		d.err = errMalformed
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+// connectPacket is sent by a client to start a session
+type connectPacket struct {
+	clientID     string
+	user         string
+	password     string
+	hasUser      bool
+	hasPassword  bool
+	keepAlive    uint16
+	cleanSession bool
+	// the will is published by the broker if the client disconnects
+	// without a disconnect packet
+	hasWill     bool
+	willTopic   string
+	willPayload string
+	willQoS     byte
+	willRetain  bool
+}
+
+func (c connectPacket) encode() packet {
+	var e encoder
+	e.string("MQTT")
+	// protocol level 4 is 3.1.1
+	e.byte(4)
+
+	var flags byte
+	if c.cleanSession {
+		flags |= 0x02
+	}
+	if c.hasUser {
+		flags |= 0x80
+	}
+	if c.hasPassword {
+		flags |= 0x40
+	}
+	if c.hasWill {
+		flags |= 0x04 | c.willQoS<<3
+		if c.willRetain {
+			flags |= 0x20
+		}
+	}
+	e.byte(flags)
+	e.uint16(c.keepAlive)
+
+	e.string(c.clientID)
+	if c.hasWill {
+		e.string(c.willTopic)
+		e.string(c.willPayload)
+	}
+	if c.hasUser {
+		e.string(c.user)
+	}
+	if c.hasPassword {
+		e.string(c.password)
+	}
+
+	return packet{typ: typeConnect, body: e.b}
+}
+
+// errBadProtocol is returned when a client does not use MQTT 3.1.1
+var errBadProtocol = errors.New("unsupported MQTT protocol")
+
+func decodeConnect(p packet) (connectPacket, error) {
+	var c connectPacket
+	d := decoder{b: p.body}
+
+	name := d.string()
+	level := d.byte()
+	flags := d.byte()
+	c.keepAlive = d.uint16()
+
+	if d.err != nil {
+		return c, d.err
+	}
+
+	if name != "MQTT" || level != 4 {
+		return c, errBadProtocol
+	}
+
+	c.cleanSession = flags&0x02 != 0
+	c.hasUser = flags&0x80 != 0
+	c.hasPassword = flags&0x40 != 0
+
+	c.clientID = d.string()
+
+	if flags&0x04 != 0 {
+		c.hasWill = true
+		c.willQoS = flags >> 3 & 0x03
+		c.willRetain = flags&0x20 != 0
+		c.willTopic = d.string()
+		c.willPayload = d.string()
+	}
+
+	if c.hasUser {
+		c.user = d.string()
+	}
+	if c.hasPassword {
+		c.password = d.string()
+	}
+
+	return c, d.err
+}
+
+func connackPacket(sessionPresent bool, code byte) packet {
+	var flags byte
+	if sessionPresent {
+		flags = 1
+	}
+	return packet{typ: typeConnack, body: []byte{flags, code}}
+}
+
+// publishPacket carries an application message
+type publishPacket struct {
+	topic    string
+	packetID uint16
+	qos      byte
+	retain   bool
+	dup      bool
+	payload  []byte
+}
+
+func (pub publishPacket) encode() packet {
+	var e encoder
+	e.string(pub.topic)
+	if pub.qos > 0 {
+		e.uint16(pub.packetID)
+	}
+	e.b = append(e.b, pub.payload...)
+
+	flags := pub.qos << 1
+	if pub.retain {
+		flags |= 0x01
+	}
+	if pub.dup {
+		flags |= 0x08
+	}
+
+	return packet{typ: typePublish, flags: flags, body: e.b}
+}
+
+func decodePublish(p packet) (publishPacket, error) {
+	pub := publishPacket{
+		qos:    (p.flags >> 1) & 0x03,
+		retain: p.flags&0x01 != 0,
+		dup:    p.flags&0x08 != 0,
+	}
+
+	if pub.qos > 2 {
+		return pub, errMalformed
+	}
+
+	d := decoder{b: p.body}
+	pub.topic = d.string()
+	if pub.qos > 0 {
+		pub.packetID = d.uint16()
+	}
+	pub.payload = d.b
+
+	return pub, d.err
+}
+
+// idPacket returns a packet that only contains a packet ID, like a puback
+func idPacket(typ, flags byte, id uint16) packet {
+	var e encoder
+	e.uint16(id)
+	return packet{typ: typ, flags: flags, body: e.b}
+}
+
+func decodeID(p packet) (uint16, error) {
+	d := decoder{b: p.body}
+	id := d.uint16()
+	return id, d.err
+}
+
+// subscription is a topic filter and max QoS
+type subscription struct {
+	filter string
+	qos    byte
+}
+
+func subscribePacket(id uint16, subs []subscription) packet {
+	var e encoder
+	e.uint16(id)
+	for _, s := range subs {
+		e.string(s.filter)
+		e.byte(s.qos)
+	}
+	// the reserved flags of subscribe must be 0010
+	return packet{typ: typeSubscribe, flags: 0x02, body: e.b}
+}
+
+func decodeSubscribe(p packet) (uint16, []subscription, error) {
+	d := decoder{b: p.body}
+	id := d.uint16()
+
+	var subs []subscription
+	for d.err == nil && len(d.b) > 0 {
+		s := subscription{filter: d.string(), qos: d.byte()}
+		if s.qos > 2 {
+			return 0, nil, errMalformed
+		}
+		subs = append(subs, s)
+	}
+
+	if d.err == nil && len(subs) <= 0 {
+		d.err = errMalformed
+	}
+
+	return id, subs, d.err
+}
+
+func subackPacket(id uint16, codes []byte) packet {
+	var e encoder
+	e.uint16(id)
+	e.b = append(e.b, codes...)
+	return packet{typ: typeSuback, body: e.b}
+}
+
+func decodeSuback(p packet) (uint16, []byte, error) {
+	d := decoder{b: p.body}
+	id := d.uint16()
+	return id, d.b, d.err
+}
+
+func unsubscribePacket(id uint16, filters []string) packet {
+	var e encoder
+	e.uint16(id)
+	for _, f := range filters {
+		e.string(f)
+	}
+	return packet{typ: typeUnsubscribe, flags: 0x02, body: e.b}
+}
+
+func decodeUnsubscribe(p packet) (uint16, []string, error) {
+	d := decoder{b: p.body}
+	id := d.uint16()
+
+	var filters []string
+	for d.err == nil && len(d.b) > 0 {
+		filters = append(filters, d.string())
+	}
+
+	return id, filters, d.err
+}
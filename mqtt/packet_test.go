@@ -0,0 +1,174 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func roundTrip(t *testing.T, p packet) packet {
+	var buf bytes.Buffer
+	err := writePacket(&buf, p)
+	if err != nil {
+		t.Fatal("Error writing packet: ", err)
+	}
+
+	ret, err := readPacket(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatal("Error reading packet: ", err)
+	}
+
+	if ret.typ != p.typ || ret.flags != p.flags || !bytes.Equal(ret.body, p.body) {
+		t.Fatalf("packet changed: %+v, %+v", p, ret)
+	}
+
+	return ret
+}
+
+func TestPacketLength(t *testing.T) {
+	for _, size := range []int{0, 127, 128, 16383, 16384, 300000} {
+		roundTrip(t, packet{typ: typePublish, body: make([]byte, size)})
+	}
+
+	// remaining length 321 is encoded as 0xc1 0x02
+	var buf bytes.Buffer
+	writePacket(&buf, packet{typ: typePuback, body: make([]byte, 321)})
+	if !bytes.Equal(buf.Bytes()[:3], []byte{0x40, 0xc1, 0x02}) {
+		t.Errorf("wrong header: % x", buf.Bytes()[:3])
+	}
+}
+
+func TestConnectPacket(t *testing.T) {
+	c := connectPacket{
+		clientID:     "dev1",
+		user:         "user",
+		password:     "pass",
+		hasUser:      true,
+		hasPassword:  true,
+		keepAlive:    30,
+		cleanSession: true,
+		hasWill:      true,
+		willTopic:    "siot/1/status",
+		willPayload:  "offline",
+		willQoS:      1,
+		willRetain:   true,
+	}
+
+	p := roundTrip(t, c.encode())
+	ret, err := decodeConnect(p)
+	if err != nil {
+		t.Fatal("Error decoding connect: ", err)
+	}
+
+	if ret != c {
+		t.Errorf("connect changed: %+v, %+v", c, ret)
+	}
+
+	// MQTT 3.1 is not supported
+	p.body[6] = 3
+	_, err = decodeConnect(p)
+	if err != errBadProtocol {
+		t.Error("expected bad protocol error, got: ", err)
+	}
+}
+
+func TestPublishPacket(t *testing.T) {
+	for _, pub := range []publishPacket{
+		{topic: "siot/1/samples", payload: []byte("[]")},
+		{topic: "siot/1/command", packetID: 10, qos: 1, retain: true,
+			payload: []byte(`{"command":"reboot"}`)},
+	} {
+		ret, err := decodePublish(roundTrip(t, pub.encode()))
+		if err != nil {
+			t.Fatal("Error decoding publish: ", err)
+		}
+
+		if !reflect.DeepEqual(ret, pub) {
+			t.Errorf("publish changed: %+v, %+v", pub, ret)
+		}
+	}
+
+	_, err := decodePublish(packet{typ: typePublish, flags: 0x02, body: []byte{0, 5, 'a'}})
+	if err == nil {
+		t.Error("expected error for short publish")
+	}
+}
+
+func TestSubscribePacket(t *testing.T) {
+	subs := []subscription{{"siot/+/samples", 1}, {"siot/#", 0}}
+
+	p := roundTrip(t, subscribePacket(7, subs))
+	if p.flags != 0x02 {
+		t.Error("wrong subscribe flags: ", p.flags)
+	}
+
+	id, ret, err := decodeSubscribe(p)
+	if err != nil {
+		t.Fatal("Error decoding subscribe: ", err)
+	}
+
+	if id != 7 || !reflect.DeepEqual(ret, subs) {
+		t.Errorf("subscribe changed: %v %+v", id, ret)
+	}
+
+	id, codes, err := decodeSuback(roundTrip(t, subackPacket(7, []byte{1, subFailure})))
+	if err != nil || id != 7 || !bytes.Equal(codes, []byte{1, subFailure}) {
+		t.Errorf("suback changed: %v %v %v", id, codes, err)
+	}
+
+	id, filters, err := decodeUnsubscribe(roundTrip(t,
+		unsubscribePacket(8, []string{"a/b"})))
+	if err != nil || id != 8 || !reflect.DeepEqual(filters, []string{"a/b"}) {
+		t.Errorf("unsubscribe changed: %v %v %v", id, filters, err)
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"siot/+/samples", "siot/1/samples", true},
+		{"siot/+/samples", "siot/1/2/samples", false},
+		{"siot/+/sample/#", "siot/1/sample/temp", true},
+		{"siot/+/sample/#", "siot/1/sample/temp/t1", true},
+		{"siot/#", "siot", true},
+		{"siot/+", "siot", false},
+		{"#", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+		{"a/b", "a/b/c", false},
+	}
+
+	for _, test := range tests {
+		if MatchTopic(test.filter, test.topic) != test.match {
+			t.Errorf("%v %v: expected %v", test.filter, test.topic, test.match)
+		}
+	}
+
+	for _, f := range []string{"a/#/b", "a/b+", ""} {
+		if ValidateFilter(f) == nil {
+			t.Errorf("expected %v to be invalid", f)
+		}
+	}
+}
+
+func TestParseSamples(t *testing.T) {
+	samples, err := ParseSamples([]byte(` {"type":"temp","value":21.5}`))
+	if err != nil || len(samples) != 1 || samples[0].Value != 21.5 ||
+		samples[0].Time.IsZero() {
+		t.Errorf("unexpected samples: %+v %v", samples, err)
+	}
+
+	samples, err = ParseSamples([]byte(`[{"type":"a"},{"type":"b"}]`))
+	if err != nil || len(samples) != 2 {
+		t.Errorf("unexpected samples: %+v %v", samples, err)
+	}
+
+	for s, v := range map[string]float64{"23.5": 23.5, "on": 1, "FALSE": 0} {
+		ret, err := ParseValue(s)
+		if err != nil || ret != v {
+			t.Errorf("%v: expected %v, got %v %v", s, v, ret, err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package mqtt
+
+import (
+	"errors"
+	"strings"
+)
+
+// MatchTopic returns true if topic matches filter. Filters can contain
+// the + (one level) and # (all remaining levels) wildcards.
+func MatchTopic(filter, topic string) bool {
+	// topics starting with $ are not matched by wildcards at the first
+	// level
+	if strings.HasPrefix(topic, "$") && !strings.HasPrefix(filter, "$") {
+		return false
+	}
+
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+
+		if i >= len(t) {
+			return false
+		}
+
+		if level != "+" && level != t[i] {
+			return false
+		}
+	}
+
+	return len(f) == len(t)
+}
+
+// ValidateFilter checks a topic filter is valid
+func ValidateFilter(filter string) error {
+	if filter == "" {
+		return errors.New("topic filter is empty")
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#" && i != len(levels)-1:
+			return errors.New("# must be the last level of a topic filter")
+		case level == "+" || level == "#":
+		case strings.ContainsAny(level, "+#"):
+			return errors.New("wildcards must be a whole topic level")
+		}
+	}
+
+	return nil
+}
+
+// ValidateTopic checks a topic name used to publish is valid
+func ValidateTopic(topic string) error {
+	if topic == "" {
+		return errors.New("topic is empty")
+	}
+
+	if strings.ContainsAny(topic, "+#") {
+		return errors.New("topic can't contain wildcards")
+	}
+
+	return nil
+}
@@ -0,0 +1,361 @@
+package nats
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/mqtt"
+	"github.com/simpleiot/simpleiot/trace"
+)
+
+// BridgeConfig describes how the bridge maps devices to subjects
+type BridgeConfig struct {
+	// Prefix is the first token of all subjects (default siot)
+	Prefix string
+	// Write stores samples from devices, typically
+	// api.WriteSamplesContext or db.IngestQueue.EnqueueContext. ctx has the
+	// span of the message.
+	Write func(ctx context.Context, id string, samples []data.Sample) error
+	// WriteBatch stores backlog batches from devices, typically
+	// api.WriteBatchContext. Batches are ignored if it is nil.
+	WriteBatch func(ctx context.Context, id string, batch data.SampleBatch) error
+	// Timeout is how long to wait for a device to ack a command
+	// (default 5s)
+	Timeout time.Duration
+}
+
+// Bridge connects devices that speak NATS to the SIOT database. Subjects
+// are (with the default prefix):
+//
+//	siot.<device id>.samples: protobuf Samples message (see
+//	data/sample.proto), or JSON sample or array of samples, from the
+//	device. Requests are answered with a JSON data.StandardResponse.
+//	siot.<device id>.batch: JSON data.SampleBatch of backlog samples from
+//	the device, answered like samples
+//	siot.<device id>.config: the device config as JSON, published when it
+//	changes
+//	siot.<device id>.config.get: request for the current device config
+//	siot.<device id>.config.reported: JSON data.ConfigReport with the
+//	config the device applied, answered like samples
+//	siot.<device id>.command: queued commands as JSON requests. A command
+//	is removed from the queue when the device responds.
+//
+// Commands are published when they are queued and when the device sends
+// samples.
+type Bridge struct {
+	conn   Conn
+	db     *db.Db
+	config BridgeConfig
+	lock   sync.Mutex
+	// configs is the last config published for each device, so the config
+	// is only published when it changes
+	configs map[string][]byte
+	// cmdLock keeps a command from being published twice
+	cmdLock sync.Mutex
+	subs    []*Subscription
+	events  <-chan db.Event
+	stop    chan struct{}
+}
+
+// NewBridge creates a bridge that uses conn to connect to the server
+func NewBridge(conn Conn, dbInst *db.Db, config BridgeConfig) *Bridge {
+	if config.Prefix == "" {
+		config.Prefix = "siot"
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+
+	return &Bridge{
+		conn:    conn,
+		db:      dbInst,
+		config:  config,
+		configs: make(map[string][]byte),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start subscribes to device subjects and publishes config and commands
+// until Stop is called
+func (b *Bridge) Start() error {
+	p := b.config.Prefix
+
+	handlers := map[string]Handler{
+		p + ".*.samples":         b.handleSamples,
+		p + ".*.config.get":      b.handleConfigGet,
+		p + ".*.config.reported": b.handleConfigReport,
+	}
+
+	if b.config.WriteBatch != nil {
+		handlers[p+".*.batch"] = b.handleBatch
+	}
+
+	for subject, handler := range handlers {
+		sub, err := b.conn.Subscribe(subject, handler)
+		if err != nil {
+			return err
+		}
+		b.subs = append(b.subs, sub)
+	}
+
+	b.events = b.db.Subscribe(db.EventFilter{
+		Types: []db.EventType{db.EventDeviceCreated, db.EventDeviceUpdated,
+			db.EventCommandQueued},
+	})
+
+	go func() {
+		for {
+			select {
+			case e, ok := <-b.events:
+				if !ok {
+					return
+				}
+
+				switch e.Type {
+				case db.EventDeviceCreated, db.EventDeviceUpdated:
+					b.publishConfig(e.DeviceID, e.Device.Config)
+				case db.EventCommandQueued:
+					// waiting for the device can't block events
+					go func(cmd data.DeviceCommand) {
+						b.cmdLock.Lock()
+						b.publishCommand(cmd)
+						b.cmdLock.Unlock()
+					}(*e.Command)
+				}
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the bridge
+func (b *Bridge) Stop() {
+	close(b.stop)
+	b.db.Unsubscribe(b.events)
+
+	for _, sub := range b.subs {
+		sub.Unsubscribe()
+	}
+}
+
+// deviceID returns the device ID from a subject like siot.<id>.samples
+func (b *Bridge) deviceID(subject string) string {
+	return strings.Split(strings.TrimPrefix(subject, b.config.Prefix+"."), ".")[0]
+}
+
+// ParseSamples parses a protobuf Samples message or JSON samples. Samples
+// without a time are set to the current time.
+func ParseSamples(payload []byte) ([]data.Sample, error) {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return mqtt.ParseSamples(trimmed)
+	}
+
+	samples, err := data.PbToSamples(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for i := range samples {
+		if samples[i].Time.IsZero() {
+			samples[i].Time = now
+		}
+	}
+
+	return samples, nil
+}
+
+// respond answers a request, if the message is one
+func (b *Bridge) respond(msg Msg, v interface{}) {
+	if msg.Reply == "" {
+		return
+	}
+
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.Println("NATS: error encoding response: ", err)
+		return
+	}
+
+	err = b.conn.Publish(msg.Reply, "", payload)
+	if err != nil {
+		log.Println("NATS: error sending response: ", err)
+	}
+}
+
+// startSpan starts a span for a message from a device
+func startSpan(name string, msg Msg, id string) (context.Context, *trace.Span) {
+	return trace.Start(context.Background(), name, trace.KindConsumer,
+		trace.Attr{Key: "messaging.system", Value: "nats"},
+		trace.Attr{Key: "messaging.destination", Value: msg.Subject},
+		trace.Attr{Key: "device", Value: id})
+}
+
+func (b *Bridge) handleSamples(msg Msg) {
+	id := b.deviceID(msg.Subject)
+
+	ctx, span := startSpan("NATS samples", msg, id)
+	var err error
+	defer span.End(&err)
+
+	samples, err := ParseSamples(msg.Data)
+	if err != nil {
+		log.Printf("NATS: invalid samples from %v: %v\n", id, err)
+		b.respond(msg, data.StandardResponse{Error: err.Error()})
+		return
+	}
+
+	err = b.config.Write(ctx, id, samples)
+	if err != nil {
+		log.Printf("NATS: error writing samples for %v: %v\n", id, err)
+		b.respond(msg, data.StandardResponse{Error: err.Error()})
+		return
+	}
+
+	b.respond(msg, data.StandardResponse{Success: true, ID: id})
+
+	// the device is online, so send it any commands it missed. This can't
+	// block the read loop, which reads the responses.
+	go b.publishPending(id)
+}
+
+func (b *Bridge) handleBatch(msg Msg) {
+	id := b.deviceID(msg.Subject)
+
+	ctx, span := startSpan("NATS batch", msg, id)
+	var err error
+	defer span.End(&err)
+
+	var batch data.SampleBatch
+	err = json.Unmarshal(msg.Data, &batch)
+	if err != nil {
+		log.Printf("NATS: invalid batch from %v: %v\n", id, err)
+		b.respond(msg, data.StandardResponse{Error: err.Error()})
+		return
+	}
+
+	err = b.config.WriteBatch(ctx, id, batch)
+	if err != nil {
+		log.Printf("NATS: error writing batch for %v: %v\n", id, err)
+		b.respond(msg, data.StandardResponse{Error: err.Error()})
+		return
+	}
+
+	b.respond(msg, data.StandardResponse{Success: true, ID: id})
+
+	go b.publishPending(id)
+}
+
+func (b *Bridge) handleConfigGet(msg Msg) {
+	id := b.deviceID(msg.Subject)
+
+	dev, err := b.db.Device(id)
+	if err != nil {
+		b.respond(msg, data.StandardResponse{Error: err.Error()})
+		return
+	}
+
+	b.respond(msg, dev.Config)
+}
+
+func (b *Bridge) handleConfigReport(msg Msg) {
+	id := b.deviceID(msg.Subject)
+
+	var report data.ConfigReport
+	err := json.Unmarshal(msg.Data, &report)
+	if err != nil {
+		log.Printf("NATS: invalid config report from %v: %v\n", id, err)
+		b.respond(msg, data.StandardResponse{Error: err.Error()})
+		return
+	}
+
+	err = b.db.DeviceReportConfig(id, report)
+	if err != nil {
+		log.Printf("NATS: error writing config report for %v: %v\n", id, err)
+		b.respond(msg, data.StandardResponse{Error: err.Error()})
+		return
+	}
+
+	b.respond(msg, data.StandardResponse{Success: true, ID: id})
+}
+
+func (b *Bridge) publishConfig(id string, config data.DeviceConfig) {
+	payload, err := json.Marshal(config)
+	if err != nil {
+		log.Println("NATS: error encoding config: ", err)
+		return
+	}
+
+	b.lock.Lock()
+	same := bytes.Equal(b.configs[id], payload)
+	b.lock.Unlock()
+
+	if same {
+		return
+	}
+
+	err = b.conn.Publish(b.config.Prefix+"."+id+".config", "", payload)
+	if err != nil {
+		if err != ErrNotConnected {
+			log.Printf("NATS: error publishing config for %v: %v\n", id, err)
+		}
+		return
+	}
+
+	b.lock.Lock()
+	b.configs[id] = payload
+	b.lock.Unlock()
+}
+
+// publishCommand sends a command and removes it from the queue when the
+// device responds. b.cmdLock must be held.
+func (b *Bridge) publishCommand(cmd data.DeviceCommand) error {
+	payload, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	_, err = Request(b.conn, b.config.Prefix+"."+cmd.DeviceID+".command",
+		payload, b.config.Timeout)
+	if err != nil {
+		// the command stays queued
+		return err
+	}
+
+	return b.db.CommandDelete(cmd.ID)
+}
+
+func (b *Bridge) publishPending(id string) {
+	b.cmdLock.Lock()
+	defer b.cmdLock.Unlock()
+
+	cmds, err := b.db.DeviceCommands(id)
+	if err != nil {
+		log.Printf("NATS: error reading commands for %v: %v\n", id, err)
+		return
+	}
+
+	for _, cmd := range cmds {
+		err := b.publishCommand(cmd)
+		// the device is not listening, so the other commands would also
+		// fail
+		if err == ErrNotConnected || err == ErrNoResponders || err == ErrTimeout {
+			return
+		}
+		if err != nil {
+			log.Printf("NATS: error publishing command for %v: %v\n", id, err)
+		}
+	}
+}
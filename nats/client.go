@@ -0,0 +1,418 @@
+package nats
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrNotConnected is returned when publishing while the client is not
+// connected to the server
+var ErrNotConnected = errors.New("not connected to NATS server")
+
+// serverInfo is sent by the server when a client connects
+type serverInfo struct {
+	ServerID     string `json:"server_id"`
+	ServerName   string `json:"server_name,omitempty"`
+	Version      string `json:"version"`
+	Proto        int    `json:"proto"`
+	MaxPayload   int64  `json:"max_payload"`
+	AuthRequired bool   `json:"auth_required,omitempty"`
+	TLSRequired  bool   `json:"tls_required,omitempty"`
+	Headers      bool   `json:"headers"`
+}
+
+// connectInfo is sent by the client to start a session
+type connectInfo struct {
+	Verbose     bool   `json:"verbose"`
+	Pedantic    bool   `json:"pedantic"`
+	TLSRequired bool   `json:"tls_required"`
+	User        string `json:"user,omitempty"`
+	Pass        string `json:"pass,omitempty"`
+	Token       string `json:"auth_token,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Lang        string `json:"lang"`
+	Version     string `json:"version"`
+	Protocol    int    `json:"protocol"`
+	Echo        bool   `json:"echo"`
+}
+
+// ClientConfig describes how to connect to a server
+type ClientConfig struct {
+	// Server is the server URL, like nats://localhost:4222 or
+	// tls://server:4222
+	Server   string
+	Name     string
+	User     string
+	Password string
+	Token    string
+	// PingInterval is how often the connection is checked (default 30s)
+	PingInterval time.Duration
+	// Timeout is used for connecting (default 10s)
+	Timeout time.Duration
+	// RetryInterval is the delay between connection attempts (default 5s)
+	RetryInterval time.Duration
+	// TLS is used if the server requires TLS. The default config is used
+	// if nil.
+	TLS *tls.Config
+	// InboxPrefix is the start of the response subjects of requests
+	// (default _INBOX). Devices connected to the embedded server use
+	// _INBOX.<device id>.
+	InboxPrefix string
+}
+
+type clientSub struct {
+	subject string
+	handler Handler
+}
+
+// Client is a NATS client that stays connected to a server. Subscriptions
+// are restored when the client reconnects.
+type Client struct {
+	config  ClientConfig
+	lock    sync.Mutex
+	conn    net.Conn
+	nextSID int
+	subs    map[int]clientSub
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewClient creates a client. Start connects to the server.
+func NewClient(config ClientConfig) *Client {
+	if config.PingInterval == 0 {
+		config.PingInterval = 30 * time.Second
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	if config.RetryInterval == 0 {
+		config.RetryInterval = 5 * time.Second
+	}
+
+	return &Client{
+		config: config,
+		subs:   make(map[int]clientSub),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start connects to the server in the background and reconnects until
+// Stop is called
+func (c *Client) Start() {
+	go func() {
+		defer close(c.done)
+
+		for {
+			err := c.run()
+			if err != nil {
+				log.Println("NATS: connection error: ", err)
+			}
+
+			select {
+			case <-c.stop:
+				return
+			case <-time.After(c.config.RetryInterval):
+			}
+		}
+	}()
+}
+
+// Stop disconnects from the server
+func (c *Client) Stop() {
+	close(c.stop)
+
+	c.lock.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.lock.Unlock()
+
+	<-c.done
+}
+
+// SetPassword changes the password used when the client reconnects, like
+// after a device key is rotated. The current connection is kept.
+func (c *Client) SetPassword(password string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.config.Password = password
+}
+
+// Connected returns true if the client is connected to the server
+func (c *Client) Connected() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.conn != nil
+}
+
+// connect opens a connection and starts a session
+func (c *Client) connect() (net.Conn, *bufio.Reader, error) {
+	u, err := url.Parse(c.config.Server)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return nil, nil, fmt.Errorf("unsupported NATS server scheme: %v",
+			u.Scheme)
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	conn, err := net.DialTimeout("tcp", host, c.config.Timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fail := func(err error) (net.Conn, *bufio.Reader, error) {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(c.config.Timeout))
+
+	r := bufio.NewReaderSize(conn, 32*1024)
+	o, err := readOp(r)
+	if err != nil {
+		return fail(err)
+	}
+
+	if o.name != "INFO" || len(o.args) != 1 {
+		return fail(errors.New("expected NATS info"))
+	}
+
+	var info serverInfo
+	err = json.Unmarshal([]byte(o.args[0]), &info)
+	if err != nil {
+		return fail(err)
+	}
+
+	// the server starts TLS after the info
+	if info.TLSRequired || u.Scheme == "tls" {
+		config := c.config.TLS
+		if config == nil {
+			config = &tls.Config{ServerName: u.Hostname()}
+		}
+
+		tlsConn := tls.Client(conn, config)
+		err = tlsConn.Handshake()
+		if err != nil {
+			return fail(err)
+		}
+
+		conn = tlsConn
+		r = bufio.NewReaderSize(conn, 32*1024)
+	}
+
+	c.lock.Lock()
+	password := c.config.Password
+	c.lock.Unlock()
+
+	connect, err := json.Marshal(connectInfo{
+		TLSRequired: info.TLSRequired,
+		User:        c.config.User,
+		Pass:        password,
+		Token:       c.config.Token,
+		Name:        c.config.Name,
+		Lang:        "go",
+		Version:     "siot",
+		Protocol:    1,
+		Echo:        true,
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	// the pong confirms the connect was accepted
+	_, err = conn.Write([]byte("CONNECT " + string(connect) + "\r\nPING\r\n"))
+	if err != nil {
+		return fail(err)
+	}
+
+	for {
+		o, err := readOp(r)
+		if err != nil {
+			return fail(err)
+		}
+
+		switch o.name {
+		case "PONG":
+			conn.SetDeadline(time.Time{})
+			return conn, r, nil
+		case "-ERR":
+			return fail(fmt.Errorf("NATS connection refused: %v", o.args))
+		}
+	}
+}
+
+// run connects and handles messages until the connection fails
+func (c *Client) run() error {
+	conn, r, err := c.connect()
+	if err != nil {
+		return err
+	}
+
+	// restore subscriptions
+	c.lock.Lock()
+	c.conn = conn
+	for sid, s := range c.subs {
+		_, err = fmt.Fprintf(conn, "SUB %v %v\r\n", s.subject, sid)
+		if err != nil {
+			break
+		}
+	}
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		c.conn = nil
+		c.lock.Unlock()
+		conn.Close()
+	}()
+
+	if err != nil {
+		return err
+	}
+
+	log.Println("NATS: connected to ", c.config.Server)
+
+	pingDone := make(chan struct{})
+	defer close(pingDone)
+	go c.ping(conn, pingDone)
+
+	for {
+		// the server must respond to pings
+		conn.SetReadDeadline(time.Now().Add(c.config.PingInterval * 2))
+
+		o, err := readOp(r)
+		if err != nil {
+			select {
+			case <-c.stop:
+				return nil
+			default:
+				return err
+			}
+		}
+
+		switch o.name {
+		case "MSG":
+			// MSG <subject> <sid> [reply]
+			if len(o.args) < 2 || len(o.args) > 3 {
+				return errProtocol
+			}
+
+			sid, _ := strconv.Atoi(o.args[1])
+			msg := Msg{Subject: o.args[0], Data: o.data}
+			if len(o.args) == 3 {
+				msg.Reply = o.args[2]
+			}
+
+			c.lock.Lock()
+			s, ok := c.subs[sid]
+			c.lock.Unlock()
+
+			if ok {
+				s.handler(msg)
+			}
+		case "PING":
+			c.write(conn, []byte("PONG\r\n"))
+		case "-ERR":
+			// permission errors don't close the connection
+			log.Println("NATS: server error: ", o.args)
+		case "PONG", "+OK", "INFO":
+		default:
+			return fmt.Errorf("unexpected NATS operation: %v", o.name)
+		}
+	}
+}
+
+// ping sends pings so the server knows the client is alive
+func (c *Client) ping(conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(c.config.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if c.write(conn, []byte("PING\r\n")) != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (c *Client) write(conn net.Conn, b []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, err := conn.Write(b)
+	return err
+}
+
+func (c *Client) newInbox() string {
+	return NewInbox(c.config.InboxPrefix)
+}
+
+// Subscribe subscribes to a subject. The subscription is kept and restored
+// on reconnect, so it can be made before the client connects.
+func (c *Client) Subscribe(subject string, handler Handler) (*Subscription, error) {
+	err := ValidatePattern(subject)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.nextSID++
+	sid := c.nextSID
+	c.subs[sid] = clientSub{subject: subject, handler: handler}
+
+	if c.conn != nil {
+		fmt.Fprintf(c.conn, "SUB %v %v\r\n", subject, sid)
+	}
+
+	return &Subscription{unsubscribe: func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		delete(c.subs, sid)
+		if c.conn != nil {
+			fmt.Fprintf(c.conn, "UNSUB %v\r\n", sid)
+		}
+	}}, nil
+}
+
+// Publish publishes a message. Reply is optional.
+func (c *Client) Publish(subject, reply string, data []byte) error {
+	err := ValidateSubject(subject)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.conn == nil {
+		return ErrNotConnected
+	}
+
+	_, err = c.conn.Write(encodeMsg("PUB", []string{subject, reply}, data))
+	return err
+}
@@ -0,0 +1,203 @@
+package nats
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchSubject(t *testing.T) {
+	for _, c := range []struct {
+		pattern, subject string
+		match            bool
+	}{
+		{"siot.1.samples", "siot.1.samples", true},
+		{"siot.*.samples", "siot.1.samples", true},
+		{"siot.*.samples", "siot.1.config", false},
+		{"siot.>", "siot.1.config.get", true},
+		{"siot.>", "siot", false},
+		{"siot.*", "siot.1.samples", false},
+	} {
+		if MatchSubject(c.pattern, c.subject) != c.match {
+			t.Errorf("MatchSubject(%v, %v) should be %v", c.pattern,
+				c.subject, c.match)
+		}
+	}
+
+	for _, s := range []string{"", "a..b", "a.>.b", "a b"} {
+		if ValidatePattern(s) == nil {
+			t.Errorf("pattern %q should be invalid", s)
+		}
+	}
+
+	if ValidateSubject("siot.*.samples") == nil {
+		t.Error("subject with wildcard should be invalid")
+	}
+}
+
+func TestPatternWithin(t *testing.T) {
+	for _, c := range []struct {
+		pattern, allowed string
+		ok               bool
+	}{
+		{"siot.1.command", "siot.1.>", true},
+		{"siot.1.>", "siot.1.>", true},
+		{"siot.1", "siot.1.>", false},
+		{"siot.*.command", "siot.1.>", false},
+		{"siot.>", "siot.1.>", false},
+		{"siot.*.command", "siot.*.command", true},
+		{"a.b", ">", true},
+	} {
+		if patternWithin(c.pattern, c.allowed) != c.ok {
+			t.Errorf("patternWithin(%v, %v) should be %v", c.pattern,
+				c.allowed, c.ok)
+		}
+	}
+}
+
+func TestReadOp(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader(
+		"MSG siot.1.command 9 _INBOX.x 5\r\nhello\r\n" +
+			"INFO {\"server_id\":\"a b\"}\r\n" +
+			"ping\r\n" +
+			"PUB a 10\r\nshort\r\n"))
+
+	o, err := readOp(r)
+	if err != nil {
+		t.Fatal("Error reading msg: ", err)
+	}
+
+	if o.name != "MSG" || len(o.args) != 3 || o.args[2] != "_INBOX.x" ||
+		string(o.data) != "hello" {
+		t.Errorf("wrong msg: %+v", o)
+	}
+
+	o, _ = readOp(r)
+	if o.name != "INFO" || o.args[0] != `{"server_id":"a b"}` {
+		t.Errorf("wrong info: %+v", o)
+	}
+
+	o, _ = readOp(r)
+	if o.name != "PING" {
+		t.Errorf("wrong ping: %+v", o)
+	}
+
+	_, err = readOp(r)
+	if err == nil {
+		t.Error("expected error for truncated payload")
+	}
+}
+
+func startServer(t *testing.T, config ServerConfig) (*Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening: ", err)
+	}
+
+	s := NewServer(config)
+	go s.Serve(l)
+
+	return s, "nats://" + l.Addr().String()
+}
+
+func connectClient(t *testing.T, server, user, password string) *Client {
+	c := NewClient(ClientConfig{Server: server, User: user,
+		Password: password, RetryInterval: 10 * time.Millisecond})
+	c.Start()
+
+	for i := 0; !c.Connected(); i++ {
+		if i > 100 {
+			t.Fatal("client did not connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return c
+}
+
+func TestServer(t *testing.T) {
+	s, addr := startServer(t, ServerConfig{
+		Auth: func(user, password, token string) (Permissions, error) {
+			if password != "key" {
+				return Permissions{}, ErrNotAuthorized
+			}
+			allowed := []string{"siot." + user + ".>"}
+			return Permissions{Publish: allowed, Subscribe: allowed}, nil
+		},
+	})
+	defer s.Close()
+
+	received := make(chan Msg, 10)
+	_, err := s.Subscribe("siot.*.samples", func(msg Msg) {
+		received <- msg
+	})
+	if err != nil {
+		t.Fatal("Error subscribing: ", err)
+	}
+
+	c := connectClient(t, addr, "dev1", "key")
+	defer c.Stop()
+
+	// the device answers commands, which requires responding to a reply
+	// subject it can't otherwise publish to
+	_, err = c.Subscribe("siot.dev1.command", func(msg Msg) {
+		c.Publish(msg.Reply, "", []byte("ok"))
+	})
+	if err != nil {
+		t.Fatal("Error subscribing: ", err)
+	}
+
+	// subscriptions of other devices are refused
+	other := make(chan Msg, 10)
+	c.Subscribe("siot.dev2.command", func(msg Msg) {
+		other <- msg
+	})
+
+	err = c.Publish("siot.dev1.samples", "", []byte("[]"))
+	if err != nil {
+		t.Fatal("Error publishing: ", err)
+	}
+
+	select {
+	case msg := <-received:
+		if msg.Subject != "siot.dev1.samples" {
+			t.Error("wrong subject: ", msg.Subject)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not received by server")
+	}
+
+	resp, err := Request(s, "siot.dev1.command", []byte("{}"), time.Second)
+	if err != nil {
+		t.Fatal("Error sending request: ", err)
+	}
+
+	if string(resp.Data) != "ok" {
+		t.Error("wrong response: ", string(resp.Data))
+	}
+
+	_, err = Request(s, "siot.dev2.command", []byte("{}"), time.Second)
+	if err != ErrNoResponders {
+		t.Error("expected no responders, got: ", err)
+	}
+
+	// publishing to another device is refused
+	c.Publish("siot.dev2.samples", "", []byte("[]"))
+
+	select {
+	case msg := <-received:
+		t.Error("message to another device was delivered: ", msg.Subject)
+	case <-other:
+		t.Error("subscription to another device was allowed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	bad := NewClient(ClientConfig{Server: addr, User: "dev1",
+		Password: "bad"})
+	_, _, err = bad.connect()
+	if err == nil {
+		t.Error("client with a bad key should be refused")
+	}
+}
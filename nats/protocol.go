@@ -0,0 +1,188 @@
+// Package nats is a small NATS client and server used to exchange samples,
+// config, and commands with edge devices. Only the core NATS protocol is
+// supported (no headers or JetStream), which is all devices need.
+package nats
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxPayload limits the memory used by a message
+const maxPayload = 1 << 20
+
+// errProtocol is returned when a protocol line can't be parsed
+var errProtocol = errors.New("NATS protocol error")
+
+// ErrTimeout is returned when a request is not answered in time
+var ErrTimeout = errors.New("NATS request timeout")
+
+// Msg is a message published on a subject
+type Msg struct {
+	Subject string
+	// Reply is the subject a response should be published to
+	Reply string
+	Data  []byte
+}
+
+// Handler is called for each received message that matches a
+// subscription. Handlers are called from the connection read loop, so they
+// should not block.
+type Handler func(Msg)
+
+// Subscription is returned by Subscribe
+type Subscription struct {
+	unsubscribe func()
+}
+
+// Unsubscribe removes the subscription
+func (s *Subscription) Unsubscribe() {
+	s.unsubscribe()
+}
+
+// Conn is a connection to a NATS server, which can be a Client connected to
+// an external server or the embedded Server
+type Conn interface {
+	Subscribe(subject string, handler Handler) (*Subscription, error)
+	Publish(subject, reply string, data []byte) error
+}
+
+// NewInbox returns a unique subject for responses that starts with prefix,
+// or _INBOX if prefix is blank
+func NewInbox(prefix string) string {
+	if prefix == "" {
+		prefix = "_INBOX"
+	}
+
+	b := make([]byte, 12)
+	rand.Read(b)
+	return prefix + "." + hex.EncodeToString(b)
+}
+
+// inboxer is implemented by connections that use their own inbox prefix
+type inboxer interface {
+	newInbox() string
+}
+
+// Request publishes a message and waits for the first response
+func Request(c Conn, subject string, data []byte, timeout time.Duration) (Msg, error) {
+	inbox := NewInbox("")
+	if i, ok := c.(inboxer); ok {
+		inbox = i.newInbox()
+	}
+
+	resp := make(chan Msg, 1)
+
+	sub, err := c.Subscribe(inbox, func(msg Msg) {
+		select {
+		case resp <- msg:
+		default:
+		}
+	})
+	if err != nil {
+		return Msg{}, err
+	}
+	defer sub.Unsubscribe()
+
+	err = c.Publish(subject, inbox, data)
+	if err != nil {
+		return Msg{}, err
+	}
+
+	select {
+	case msg := <-resp:
+		return msg, nil
+	case <-time.After(timeout):
+		return Msg{}, ErrTimeout
+	}
+}
+
+// op is a NATS protocol operation, like PUB or MSG. Data is only used by
+// PUB and MSG.
+type op struct {
+	name string
+	args []string
+	data []byte
+}
+
+// readOp reads an operation. The arguments of INFO, CONNECT, and -ERR are
+// the rest of the line.
+func readOp(r *bufio.Reader) (op, error) {
+	var o op
+
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return o, errProtocol
+	}
+	if err != nil {
+		return o, err
+	}
+
+	s := strings.TrimRight(string(line), "\r\n")
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		o.name = strings.ToUpper(s)
+		return o, nil
+	}
+
+	o.name = strings.ToUpper(s[:i])
+	rest := strings.TrimSpace(s[i+1:])
+
+	switch o.name {
+	case "INFO", "CONNECT", "-ERR":
+		o.args = []string{rest}
+		return o, nil
+	}
+
+	o.args = strings.Fields(rest)
+
+	if o.name == "PUB" || o.name == "MSG" {
+		if len(o.args) == 0 {
+			return o, errProtocol
+		}
+
+		n, err := strconv.Atoi(o.args[len(o.args)-1])
+		if err != nil || n < 0 {
+			return o, errProtocol
+		}
+
+		if n > maxPayload {
+			return o, fmt.Errorf("NATS payload too large: %v", n)
+		}
+
+		// payload is followed by \r\n
+		o.data = make([]byte, n+2)
+		_, err = io.ReadFull(r, o.data)
+		if err != nil {
+			return o, err
+		}
+		o.data = o.data[:n]
+		o.args = o.args[:len(o.args)-1]
+	}
+
+	return o, nil
+}
+
+// encodeMsg encodes a PUB or MSG operation
+func encodeMsg(name string, args []string, data []byte) []byte {
+	var b []byte
+	b = append(b, name...)
+	for _, a := range args {
+		if a != "" {
+			b = append(b, ' ')
+			b = append(b, a...)
+		}
+	}
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(len(data)), 10)
+	b = append(b, "\r\n"...)
+	b = append(b, data...)
+	return append(b, "\r\n"...)
+}
@@ -0,0 +1,561 @@
+package nats
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoResponders is returned by Server.Publish when a request is not
+// delivered to any subscriber
+var ErrNoResponders = errors.New("no NATS responders")
+
+// ErrNotAuthorized is returned by an auth function to refuse a client
+var ErrNotAuthorized = errors.New("not authorized")
+
+// Permissions are the subjects a client can publish and subscribe to
+type Permissions struct {
+	Publish   []string
+	Subscribe []string
+}
+
+// AllPermissions allows all subjects
+var AllPermissions = Permissions{Publish: []string{">"}, Subscribe: []string{">"}}
+
+func (p Permissions) canPublish(subject string) bool {
+	for _, a := range p.Publish {
+		if MatchSubject(a, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// patternWithin returns true if all subjects matched by pattern are also
+// matched by allowed
+func patternWithin(pattern, allowed string) bool {
+	p := strings.Split(pattern, ".")
+	a := strings.Split(allowed, ".")
+
+	for i, token := range a {
+		if i >= len(p) {
+			return false
+		}
+
+		if token == ">" {
+			return true
+		}
+
+		switch {
+		case p[i] == ">":
+			return false
+		case token == "*":
+		case p[i] == "*" || token != p[i]:
+			return false
+		}
+	}
+
+	return len(p) == len(a)
+}
+
+func (p Permissions) canSubscribe(pattern string) bool {
+	for _, a := range p.Subscribe {
+		if patternWithin(pattern, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServerConfig describes how the server authorizes clients
+type ServerConfig struct {
+	// Auth checks the credentials of a client and returns the subjects it
+	// can use. If nil, clients can use all subjects.
+	Auth func(user, password, token string) (Permissions, error)
+	// TLS is required for all clients if set
+	TLS *tls.Config
+	// PingInterval is how often clients are checked (default 1m)
+	PingInterval time.Duration
+	// Timeout is used for the connect and writes (default 10s)
+	Timeout time.Duration
+}
+
+// serverSub is a subscription of a client, or of the server itself if
+// client is nil
+type serverSub struct {
+	client  *serverClient
+	sid     string
+	subject string
+	queue   string
+	// max is the number of messages after which the subscription is
+	// removed, 0 for no limit
+	max     int
+	count   int
+	handler Handler
+}
+
+// serverClient is a client connected to the server
+type serverClient struct {
+	conn    net.Conn
+	perms   Permissions
+	verbose bool
+	// lock is held while writing to conn
+	lock sync.Mutex
+	// subs and responses are protected by the server lock
+	subs map[string]*serverSub
+	// responses are reply subjects of requests delivered to the client,
+	// which it can respond to once without publish permission
+	responses map[string]bool
+}
+
+// maxResponses limits the number of outstanding responses of a client
+const maxResponses = 1000
+
+// Server is a NATS server that can be embedded in the server, so devices
+// can connect directly to it. The server uses it with Subscribe and
+// Publish, which are not limited by permissions.
+type Server struct {
+	config    ServerConfig
+	id        string
+	lock      sync.Mutex
+	clients   map[*serverClient]bool
+	subs      map[*serverSub]bool
+	listeners []net.Listener
+}
+
+// NewServer creates a server. Serve accepts connections.
+func NewServer(config ServerConfig) *Server {
+	if config.PingInterval == 0 {
+		config.PingInterval = time.Minute
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return &Server{
+		config:  config,
+		id:      hex.EncodeToString(id),
+		clients: make(map[*serverClient]bool),
+		subs:    make(map[*serverSub]bool),
+	}
+}
+
+// Serve accepts connections on l until Close is called
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	s.listeners = append(s.listeners, l)
+	s.lock.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+// Close stops the listeners and disconnects all clients
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.listeners = nil
+
+	for c := range s.clients {
+		c.conn.Close()
+	}
+
+	return nil
+}
+
+// Clients returns the number of connected clients
+func (s *Server) Clients() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.clients)
+}
+
+// Subscribe subscribes the server to a subject
+func (s *Server) Subscribe(subject string, handler Handler) (*Subscription, error) {
+	err := ValidatePattern(subject)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &serverSub{subject: subject, handler: handler}
+
+	s.lock.Lock()
+	s.subs[sub] = true
+	s.lock.Unlock()
+
+	return &Subscription{unsubscribe: func() {
+		s.lock.Lock()
+		delete(s.subs, sub)
+		s.lock.Unlock()
+	}}, nil
+}
+
+// Publish publishes a message from the server. ErrNoResponders is returned
+// if a message with a reply subject was not delivered to anyone.
+func (s *Server) Publish(subject, reply string, data []byte) error {
+	err := ValidateSubject(subject)
+	if err != nil {
+		return err
+	}
+
+	n := s.route(Msg{Subject: subject, Reply: reply, Data: data})
+	if n == 0 && reply != "" {
+		return ErrNoResponders
+	}
+
+	return nil
+}
+
+// route delivers a message to subscribers and returns the number of
+// subscribers it was delivered to
+func (s *Server) route(msg Msg) int {
+	var targets []*serverSub
+	queues := make(map[string][]*serverSub)
+
+	s.lock.Lock()
+	for sub := range s.subs {
+		if !MatchSubject(sub.subject, msg.Subject) {
+			continue
+		}
+
+		if sub.queue != "" {
+			queues[sub.queue] = append(queues[sub.queue], sub)
+		} else {
+			targets = append(targets, sub)
+		}
+	}
+
+	// a queue group gets one copy, delivered to a random member
+	for _, members := range queues {
+		i, _ := rand.Int(rand.Reader, big.NewInt(int64(len(members))))
+		targets = append(targets, members[i.Int64()])
+	}
+
+	for _, sub := range targets {
+		sub.count++
+		if sub.max > 0 && sub.count >= sub.max {
+			s.removeSub(sub)
+		}
+
+		if msg.Reply != "" && sub.client != nil {
+			if len(sub.client.responses) >= maxResponses {
+				sub.client.responses = make(map[string]bool)
+			}
+			sub.client.responses[msg.Reply] = true
+		}
+	}
+	s.lock.Unlock()
+
+	for _, sub := range targets {
+		if sub.client == nil {
+			sub.handler(msg)
+			continue
+		}
+
+		s.write(sub.client, encodeMsg("MSG",
+			[]string{msg.Subject, sub.sid, msg.Reply}, msg.Data))
+	}
+
+	return len(targets)
+}
+
+// removeSub removes a subscription. s.lock must be held.
+func (s *Server) removeSub(sub *serverSub) {
+	delete(s.subs, sub)
+	if sub.client != nil {
+		delete(sub.client.subs, sub.sid)
+	}
+}
+
+// write writes to a client. Slow clients are disconnected.
+func (s *Server) write(c *serverClient, b []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(s.config.Timeout))
+	_, err := c.conn.Write(b)
+	if err != nil {
+		c.conn.Close()
+	}
+}
+
+func (s *Server) sendErr(c *serverClient, msg string) {
+	s.write(c, []byte("-ERR '"+msg+"'\r\n"))
+}
+
+// connect sends the server info and reads the connect
+func (s *Server) connect(conn net.Conn) (*serverClient, *bufio.Reader, error) {
+	conn.SetDeadline(time.Now().Add(s.config.Timeout))
+
+	info, err := json.Marshal(serverInfo{
+		ServerID:     s.id,
+		ServerName:   "siot",
+		Version:      "2.0.0",
+		Proto:        1,
+		MaxPayload:   maxPayload,
+		AuthRequired: s.config.Auth != nil,
+		TLSRequired:  s.config.TLS != nil,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = conn.Write([]byte("INFO " + string(info) + "\r\n"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if s.config.TLS != nil {
+		tlsConn := tls.Server(conn, s.config.TLS)
+		err = tlsConn.Handshake()
+		if err != nil {
+			return nil, nil, err
+		}
+		conn = tlsConn
+	}
+
+	r := bufio.NewReaderSize(conn, 32*1024)
+
+	o, err := readOp(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if o.name != "CONNECT" || len(o.args) != 1 {
+		return nil, nil, errors.New("expected connect")
+	}
+
+	var connect connectInfo
+	err = json.Unmarshal([]byte(o.args[0]), &connect)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := &serverClient{
+		conn:      conn,
+		perms:     AllPermissions,
+		verbose:   connect.Verbose,
+		subs:      make(map[string]*serverSub),
+		responses: make(map[string]bool),
+	}
+
+	if s.config.Auth != nil {
+		c.perms, err = s.config.Auth(connect.User, connect.Pass, connect.Token)
+		if err != nil {
+			s.sendErr(c, "Authorization Violation")
+			return nil, nil, err
+		}
+	}
+
+	if c.verbose {
+		s.write(c, []byte("+OK\r\n"))
+	}
+
+	conn.SetDeadline(time.Time{})
+	return c, r, nil
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	c, r, err := s.connect(conn)
+	if err != nil {
+		log.Printf("NATS server: connection from %v refused: %v\n",
+			conn.RemoteAddr(), err)
+		return
+	}
+
+	s.lock.Lock()
+	s.clients[c] = true
+	s.lock.Unlock()
+
+	pingDone := make(chan struct{})
+
+	defer func() {
+		close(pingDone)
+		s.lock.Lock()
+		delete(s.clients, c)
+		for _, sub := range c.subs {
+			s.removeSub(sub)
+		}
+		s.lock.Unlock()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(s.config.PingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.write(c, []byte("PING\r\n"))
+			case <-pingDone:
+				return
+			}
+		}
+	}()
+
+	for {
+		// clients answer pings, so they must send something within two
+		// ping intervals
+		c.conn.SetReadDeadline(time.Now().Add(s.config.PingInterval * 2))
+
+		o, err := readOp(r)
+		if err != nil {
+			return
+		}
+
+		switch o.name {
+		case "PUB":
+			err = s.handlePub(c, o)
+		case "SUB":
+			err = s.handleSub(c, o)
+		case "UNSUB":
+			err = s.handleUnsub(c, o)
+		case "PING":
+			s.write(c, []byte("PONG\r\n"))
+			continue
+		case "PONG", "CONNECT":
+			continue
+		default:
+			s.sendErr(c, "Unknown Protocol Operation")
+			return
+		}
+
+		if err != nil {
+			s.sendErr(c, err.Error())
+			if err == errProtocol {
+				return
+			}
+		} else if c.verbose {
+			s.write(c, []byte("+OK\r\n"))
+		}
+	}
+}
+
+func (s *Server) handlePub(c *serverClient, o op) error {
+	// PUB <subject> [reply]
+	if len(o.args) < 1 || len(o.args) > 2 {
+		return errProtocol
+	}
+
+	msg := Msg{Subject: o.args[0], Data: o.data}
+	if len(o.args) == 2 {
+		msg.Reply = o.args[1]
+	}
+
+	if ValidateSubject(msg.Subject) != nil {
+		return errors.New("Invalid Publish Subject")
+	}
+
+	if !c.perms.canPublish(msg.Subject) {
+		s.lock.Lock()
+		ok := c.responses[msg.Subject]
+		delete(c.responses, msg.Subject)
+		s.lock.Unlock()
+
+		if !ok {
+			return fmt.Errorf("Permissions Violation for Publish to %q",
+				msg.Subject)
+		}
+	}
+
+	s.route(msg)
+	return nil
+}
+
+func (s *Server) handleSub(c *serverClient, o op) error {
+	// SUB <subject> [queue] <sid>
+	if len(o.args) < 2 || len(o.args) > 3 {
+		return errProtocol
+	}
+
+	sub := &serverSub{
+		client:  c,
+		subject: o.args[0],
+		sid:     o.args[len(o.args)-1],
+	}
+	if len(o.args) == 3 {
+		sub.queue = o.args[1]
+	}
+
+	if ValidatePattern(sub.subject) != nil {
+		return errors.New("Invalid Subject")
+	}
+
+	if !c.perms.canSubscribe(sub.subject) {
+		return fmt.Errorf("Permissions Violation for Subscription to %q",
+			sub.subject)
+	}
+
+	s.lock.Lock()
+	if old, ok := c.subs[sub.sid]; ok {
+		s.removeSub(old)
+	}
+	c.subs[sub.sid] = sub
+	s.subs[sub] = true
+	s.lock.Unlock()
+
+	return nil
+}
+
+func (s *Server) handleUnsub(c *serverClient, o op) error {
+	// UNSUB <sid> [max]
+	if len(o.args) < 1 || len(o.args) > 2 {
+		return errProtocol
+	}
+
+	max := 0
+	if len(o.args) == 2 {
+		var err error
+		max, err = strconv.Atoi(o.args[1])
+		if err != nil {
+			return errProtocol
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sub, ok := c.subs[o.args[0]]
+	if !ok {
+		return nil
+	}
+
+	if max > 0 && sub.count < max {
+		sub.max = max
+	} else {
+		s.removeSub(sub)
+	}
+
+	return nil
+}
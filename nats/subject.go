@@ -0,0 +1,64 @@
+package nats
+
+import (
+	"errors"
+	"strings"
+)
+
+// MatchSubject returns true if subject matches pattern. Patterns can
+// contain the * (one token) and > (one or more remaining tokens)
+// wildcards.
+func MatchSubject(pattern, subject string) bool {
+	p := strings.Split(pattern, ".")
+	s := strings.Split(subject, ".")
+
+	for i, token := range p {
+		if i >= len(s) {
+			return false
+		}
+
+		if token == ">" {
+			return true
+		}
+
+		if token != "*" && token != s[i] {
+			return false
+		}
+	}
+
+	return len(p) == len(s)
+}
+
+func validate(subject string, wildcards bool) error {
+	if subject == "" {
+		return errors.New("subject is empty")
+	}
+
+	if strings.ContainsAny(subject, " \t\r\n") {
+		return errors.New("subject can't contain spaces")
+	}
+
+	tokens := strings.Split(subject, ".")
+	for i, token := range tokens {
+		switch {
+		case token == "":
+			return errors.New("subject can't contain empty tokens")
+		case !wildcards && (token == "*" || token == ">"):
+			return errors.New("subject can't contain wildcards")
+		case token == ">" && i != len(tokens)-1:
+			return errors.New("> must be the last token of a subject")
+		}
+	}
+
+	return nil
+}
+
+// ValidatePattern checks a subscription subject is valid
+func ValidatePattern(pattern string) error {
+	return validate(pattern, true)
+}
+
+// ValidateSubject checks a subject used to publish is valid
+func ValidateSubject(subject string) error {
+	return validate(subject, false)
+}
@@ -9,27 +9,20 @@ import (
 	"strings"
 )
 
-// DebugAtCommands can be set to true to
-// debug at commands
-var DebugAtCommands = false
-
 // Cmd send a command to modem and read response
 // retry 3 times. Port should be a RespReadWriter.
 func Cmd(port io.ReadWriter, cmd string) (string, error) {
 	var err error
 
 	for try := 0; try < 3; try++ {
-		if DebugAtCommands {
-			fmt.Println("Modem Tx: ", cmd)
-		}
+		atLog.Debug("tx", "cmd", cmd)
 
-		readString := make([]byte, 100)
+		// responses like AT+CMGL can be long
+		readString := make([]byte, 2048)
 
 		_, err = port.Write([]byte(cmd + "\r"))
 		if err != nil {
-			if DebugAtCommands {
-				fmt.Println("Modem cmd write error: ", err)
-			}
+			atLog.Debug("write error", "cmd", cmd, "error", err)
 			continue
 		}
 
@@ -37,9 +30,7 @@ func Cmd(port io.ReadWriter, cmd string) (string, error) {
 		n, err = port.Read(readString)
 
 		if err != nil {
-			if DebugAtCommands {
-				fmt.Println("Modem cmd read error: ", err)
-			}
+			atLog.Debug("read error", "cmd", cmd, "error", err)
 			continue
 		}
 
@@ -47,9 +38,7 @@ func Cmd(port io.ReadWriter, cmd string) (string, error) {
 
 		readStringS := strings.TrimSpace(string(readString))
 
-		if DebugAtCommands {
-			fmt.Println("Modem Rx: ", readStringS)
-		}
+		atLog.Debug("rx", "cmd", cmd, "response", readStringS)
 
 		return readStringS, nil
 	}
@@ -79,12 +68,14 @@ func checkRespOK(resp string) error {
 	return errorNoOK
 }
 
-// service, rssi, rsrp, sinr, rsrq
+// sysmode, rssi, rsrp, sinr, rsrq
 // +QCSQ: "CAT-M1",-52,-81,195,-10
 var reQcsq = regexp.MustCompile(`\+QCSQ:\s*"(.+)",(-*\d+),(-*\d+),(\d+),(-*\d+)`)
 
-// CmdQcsq is used to send the AT+QCSQ command
-func CmdQcsq(port io.ReadWriter) (service bool, rssi, rsrp, rsrq int, err error) {
+// CmdQcsq is used to send the AT+QCSQ command. sysMode is the access
+// technology the modem is using (GSM, WCDMA, LTE, CAT-M1, CAT-NB1, or
+// NOSERVICE). sinr is converted to dB.
+func CmdQcsq(port io.ReadWriter) (sysMode string, rssi, rsrp, sinr, rsrq int, err error) {
 	var resp string
 	resp, err = Cmd(port, "AT+QCSQ")
 	if err != nil {
@@ -103,12 +94,14 @@ func CmdQcsq(port io.ReadWriter) (service bool, rssi, rsrp, rsrq int, err error)
 
 		found = true
 
-		serviceS := matches[1]
+		sysMode = matches[1]
 		rssi, _ = strconv.Atoi(matches[2])
-		rsrq, _ = strconv.Atoi(matches[3])
-		rsrp, _ = strconv.Atoi(matches[5])
+		rsrp, _ = strconv.Atoi(matches[3])
+		sinr, _ = strconv.Atoi(matches[4])
+		rsrq, _ = strconv.Atoi(matches[5])
 
-		service = serviceS == "CAT-M1"
+		// sinr is reported as 0-250, which maps to -20 to 30dB
+		sinr = sinr/5 - 20
 	}
 
 	if !found {
@@ -257,7 +250,8 @@ func CmdGGA(port io.ReadWriter) (string, error) {
 	for _, line := range strings.Split(resp, "\n") {
 		matches := reQGPSNEMA.FindStringSubmatch(line)
 		if len(matches) >= 2 {
-			return matches[1], nil
+			// lines end with \r, which breaks the NMEA checksum
+			return strings.TrimSpace(matches[1]), nil
 		}
 	}
 
@@ -285,7 +279,7 @@ var reBg96ScanMode = regexp.MustCompile(`\++QCFG: "nwscanmode",(\d+)`)
 
 // CmdBg96GetScanMode returns the current modem scan mode
 func CmdBg96GetScanMode(port io.ReadWriter) (BG96ScanMode, error) {
-	resp, err := Cmd(port, "AT+QGPSGNMEA=\"GGA\"")
+	resp, err := Cmd(port, "AT+QCFG=\"nwscanmode\"")
 	if err != nil {
 		return BG96ScanModeUnknown, err
 	}
@@ -303,5 +297,145 @@ func CmdBg96GetScanMode(port io.ReadWriter) (BG96ScanMode, error) {
 	}
 
 	return BG96ScanModeUnknown,
-		fmt.Errorf("Error parsing AT+QGPSGNMEA response: %v", resp)
+		fmt.Errorf("Error parsing AT+QCFG=\"nwscanmode\" response: %v", resp)
+}
+
+// +CSQ: 21,99
+var reCsq = regexp.MustCompile(`\+CSQ:\s*(\d+),(\d+)`)
+
+// CmdCsq is used to send the generic AT+CSQ command. rssi is returned in
+// dBm. An error is returned if the signal is not known.
+func CmdCsq(port io.ReadWriter) (rssi int, err error) {
+	var resp string
+	resp, err = Cmd(port, "AT+CSQ")
+	if err != nil {
+		return
+	}
+
+	for _, line := range strings.Split(resp, "\n") {
+		matches := reCsq.FindStringSubmatch(line)
+		if len(matches) < 3 {
+			continue
+		}
+
+		csq, _ := strconv.Atoi(matches[1])
+		if csq == 99 {
+			return 0, errors.New("signal not known or not detectable")
+		}
+
+		return -113 + 2*csq, nil
+	}
+
+	return 0, fmt.Errorf("Error parsing CSQ response: %v", resp)
+}
+
+// +COPS: 0,0,"AT&T",7
+var reCops = regexp.MustCompile(`\+COPS:\s*\d+(?:,\d+,"(.*)"(?:,(\d+))?)?`)
+
+// access technologies returned by AT+COPS?
+var copsAccessTech = map[string]string{
+	"0": AccessTech2G,
+	"2": AccessTech3G,
+	"3": AccessTech2G,
+	"4": AccessTech3G,
+	"5": AccessTech3G,
+	"6": AccessTech3G,
+	"7": AccessTechLTE,
+	"8": AccessTechLTEM,
+	"9": AccessTechNBIoT,
+}
+
+// CmdCops is used to send the AT+COPS? command and returns the current
+// operator and access technology. Blank values are returned if the modem
+// is not registered.
+func CmdCops(port io.ReadWriter) (operator, accessTech string, err error) {
+	var resp string
+	resp, err = Cmd(port, "AT+COPS?")
+	if err != nil {
+		return
+	}
+
+	for _, line := range strings.Split(resp, "\n") {
+		matches := reCops.FindStringSubmatch(line)
+		if len(matches) < 3 {
+			continue
+		}
+
+		return matches[1], copsAccessTech[matches[2]], nil
+	}
+
+	return "", "", fmt.Errorf("Error parsing COPS response: %v", resp)
+}
+
+// sysmode,opmode,mcc-mnc,tac,scellid,pcellid,band,earfcn,dlbw,ulbw,rsrq,rsrp,rssi,rssnr
+// +CPSI: LTE,Online,460-00,0x5A1E,187214780,257,EUTRAN-BAND3,1825,5,5,-100,-1055,-770,15
+var reCpsiLte = regexp.MustCompile(`\+CPSI:\s*LTE,[^,]*,(?:[^,]*,){7}[^,]*,(-?\d+),(-?\d+),(-?\d+),(-?\d+)`)
+
+// CmdCpsi is used to send the AT+CPSI? command on SIMCom modems. The signal
+// values are only reported when the modem is on LTE.
+func CmdCpsi(port io.ReadWriter) (rssi, rsrp, sinr, rsrq int, err error) {
+	var resp string
+	resp, err = Cmd(port, "AT+CPSI?")
+	if err != nil {
+		return
+	}
+
+	for _, line := range strings.Split(resp, "\n") {
+		matches := reCpsiLte.FindStringSubmatch(line)
+		if len(matches) < 5 {
+			continue
+		}
+
+		// rsrq, rsrp, and rssi are reported in tenths
+		rsrq, _ = strconv.Atoi(matches[1])
+		rsrp, _ = strconv.Atoi(matches[2])
+		rssi, _ = strconv.Atoi(matches[3])
+		sinr, _ = strconv.Atoi(matches[4])
+		return rssi / 10, rsrp / 10, sinr, rsrq / 10, nil
+	}
+
+	return 0, 0, 0, 0, fmt.Errorf("Error parsing CPSI response: %v", resp)
+}
+
+// +CREG: 0,1
+// +CEREG: 0,5
+var reReg = regexp.MustCompile(`\+C(?:E|G)?REG:\s*\d+,(\d+)`)
+
+// define network registration states returned by CmdRegStatus
+const (
+	RegNotRegistered = 0
+	RegHome          = 1
+	RegSearching     = 2
+	RegDenied        = 3
+	RegUnknown       = 4
+	RegRoaming       = 5
+)
+
+// CmdRegStatus returns the network registration state (one of the Reg*
+// constants). cmd should be AT+CREG? (2G/3G), AT+CGREG? (packet), or
+// AT+CEREG? (LTE).
+func CmdRegStatus(port io.ReadWriter, cmd string) (int, error) {
+	resp, err := Cmd(port, cmd)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(resp, "\n") {
+		matches := reReg.FindStringSubmatch(line)
+		if len(matches) < 2 {
+			continue
+		}
+
+		return strconv.Atoi(matches[1])
+	}
+
+	return 0, fmt.Errorf("Error parsing %v response: %v", cmd, resp)
+}
+
+// CmdRegistered returns true if the modem is registered on a network
+// (home or roaming). cmd should be AT+CREG? (2G/3G), AT+CGREG? (packet), or
+// AT+CEREG? (LTE).
+func CmdRegistered(port io.ReadWriter, cmd string) (bool, error) {
+	stat, err := CmdRegStatus(port, cmd)
+	return stat == RegHome || stat == RegRoaming, err
 }
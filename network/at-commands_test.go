@@ -0,0 +1,116 @@
+package network
+
+import "testing"
+
+func TestCmdQcsq(t *testing.T) {
+	cases := []struct {
+		resp    string
+		sysMode string
+		rssi    int
+		rsrp    int
+		sinr    int
+		rsrq    int
+		err     bool
+	}{
+		{resp: `+QCSQ: "CAT-M1",-52,-81,195,-10`, sysMode: "CAT-M1",
+			rssi: -52, rsrp: -81, sinr: 19, rsrq: -10},
+		{resp: `+QCSQ: "LTE",-62,-95,0,-13`, sysMode: "LTE",
+			rssi: -62, rsrp: -95, sinr: -20, rsrq: -13},
+		{resp: `+QCSQ: "CAT-NB1",-71,-103,250,-3`, sysMode: "CAT-NB1",
+			rssi: -71, rsrp: -103, sinr: 30, rsrq: -3},
+		{resp: `+QCSQ: "NOSERVICE"`, err: true},
+	}
+
+	for _, c := range cases {
+		port := &fakePort{resp: map[string]string{
+			"AT+QCSQ": "\r\n" + c.resp + "\r\n\r\nOK\r\n",
+		}}
+
+		sysMode, rssi, rsrp, sinr, rsrq, err := CmdQcsq(port)
+		if (err != nil) != c.err {
+			t.Errorf("%v: expected error %v, got %v", c.resp, c.err, err)
+			continue
+		}
+
+		if sysMode != c.sysMode || rssi != c.rssi || rsrp != c.rsrp ||
+			sinr != c.sinr || rsrq != c.rsrq {
+			t.Errorf("%v: got %v %v %v %v %v", c.resp, sysMode, rssi, rsrp,
+				sinr, rsrq)
+		}
+	}
+}
+
+func TestCmdCops(t *testing.T) {
+	cases := []struct {
+		resp       string
+		operator   string
+		accessTech string
+	}{
+		{`+COPS: 0,0,"AT&T",7`, "AT&T", AccessTechLTE},
+		{`+COPS: 0,0,"Verizon Wireless",8`, "Verizon Wireless", AccessTechLTEM},
+		{`+COPS: 0,0,"T-Mobile",9`, "T-Mobile", AccessTechNBIoT},
+		{`+COPS: 0,0,"CHINA MOBILE",0`, "CHINA MOBILE", AccessTech2G},
+		{`+COPS: 0,0,"CHN-UNICOM",2`, "CHN-UNICOM", AccessTech3G},
+		{`+COPS: 0,0,"CHN-UNICOM",6`, "CHN-UNICOM", AccessTech3G},
+		{`+COPS: 1,2,"310410"`, "310410", ""},
+		// not registered
+		{`+COPS: 0`, "", ""},
+	}
+
+	for _, c := range cases {
+		port := &fakePort{resp: map[string]string{
+			"AT+COPS?": "\r\n" + c.resp + "\r\n\r\nOK\r\n",
+		}}
+
+		operator, accessTech, err := CmdCops(port)
+		if err != nil {
+			t.Errorf("%v: error: %v", c.resp, err)
+			continue
+		}
+
+		if operator != c.operator || accessTech != c.accessTech {
+			t.Errorf("%v: got %q %q", c.resp, operator, accessTech)
+		}
+	}
+
+	port := &fakePort{resp: map[string]string{"AT+COPS?": "\r\n+CME ERROR: 10\r\n"}}
+	if _, _, err := CmdCops(port); err == nil {
+		t.Error("expected error for CME ERROR")
+	}
+}
+
+func TestCmdCpsi(t *testing.T) {
+	cases := []struct {
+		resp string
+		rssi int
+		rsrp int
+		sinr int
+		rsrq int
+		err  bool
+	}{
+		{resp: `+CPSI: LTE,Online,460-00,0x5A1E,187214780,257,EUTRAN-BAND3,1825,5,5,-100,-1055,-770,15`,
+			rssi: -77, rsrp: -105, sinr: 15, rsrq: -10},
+		{resp: `+CPSI: LTE,Online,310-410,0x2D0B,22157834,419,EUTRAN-BAND2,850,4,4,-126,-1174,-862,-3`,
+			rssi: -86, rsrp: -117, sinr: -3, rsrq: -12},
+		// signal values are only parsed on LTE
+		{resp: `+CPSI: WCDMA,Online,460-01,0xA809,11122855,WCDMA IMT 2000,419,10688,0,1.5,64,33,52,500`,
+			err: true},
+		{resp: `+CPSI: NO SERVICE,Online`, err: true},
+	}
+
+	for _, c := range cases {
+		port := &fakePort{resp: map[string]string{
+			"AT+CPSI?": "\r\n" + c.resp + "\r\n\r\nOK\r\n",
+		}}
+
+		rssi, rsrp, sinr, rsrq, err := CmdCpsi(port)
+		if (err != nil) != c.err {
+			t.Errorf("%v: expected error %v, got %v", c.resp, c.err, err)
+			continue
+		}
+
+		if rssi != c.rssi || rsrp != c.rsrp || sinr != c.sinr || rsrq != c.rsrq {
+			t.Errorf("%v: got %v %v %v %v", c.resp, rssi, rsrp, sinr, rsrq)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// ModemATCommand is the device command that sends an AT command to the
+// modem for remote diagnostics. The cmd arg is the AT command.
+const ModemATCommand = "modemAT"
+
+// DefaultATAllowlist are the AT commands allowed if none are configured.
+// They only read the state of the modem.
+var DefaultATAllowlist = []string{
+	"ATI", "AT+CSQ", "AT+COPS?", "AT+CREG?", "AT+CEREG?", "AT+CGREG?",
+	"AT+CPIN?", "AT+CGDCONT?", "AT+CGATT?", "AT+CFUN?", "AT+CCID",
+	"AT+QCCID", "AT+CIMI", "AT+CGSN", "AT+QCSQ", "AT+QNWINFO", "AT+QSPN",
+	"AT+QENG=", "AT+CPSI?",
+}
+
+// atArgs matches the argument of an extended command, like 1,0 or
+// "servingcell". Basic commands can be chained without a separator, like
+// ATI&F, so nothing else can follow an allowed command.
+var atArgs = regexp.MustCompile(`^([0-9,?]|"[^"]*")*$`)
+
+// errATNotAllowed is returned for commands that are not in the allowlist
+var errATNotAllowed = errors.New("AT command not allowed")
+
+// ATAudit records an AT command that was sent, or refused, by passthrough
+type ATAudit struct {
+	Time time.Time
+	// Source is who sent the command, like the remote address of an HTTP
+	// request or "command" for device commands
+	Source   string
+	Command  string
+	Response string
+	Err      error
+}
+
+// ATPassthroughConfig describes which commands can be sent
+type ATPassthroughConfig struct {
+	// Allow are the allowed commands, like AT+CSQ or AT+QENG= (default
+	// DefaultATAllowlist). An extended command like AT+CSQ also allows
+	// its read (AT+CSQ?) and argument (AT+CSQ=?) forms, and a command
+	// ending in = allows any argument. Commands are not case sensitive.
+	Allow []string
+	// Token is the bearer token ServeHTTP requires. If it is blank, HTTP
+	// requests are refused.
+	Token string
+	// Audit, if set, is called for every command, like to send a record to
+	// the server. Commands are always logged.
+	Audit func(ATAudit)
+}
+
+// RawCmd sends a command to the modem and returns the raw response. The
+// response is not checked for OK.
+func (m *Modem) RawCmd(cmd string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.detected() {
+		return "", errors.New("modem not detected")
+	}
+
+	if err := m.openCmdPort(); err != nil {
+		return "", err
+	}
+
+	return Cmd(m.atCmdPort, cmd)
+}
+
+// ATPassthrough sends AT commands from support staff to the modem, so
+// cellular issues can be debugged remotely without SSH. Only single
+// commands in the allowlist are sent.
+type ATPassthrough struct {
+	modem  *Modem
+	config ATPassthroughConfig
+}
+
+// NewATPassthrough creates a passthrough to the command port of a modem
+func NewATPassthrough(modem *Modem, config ATPassthroughConfig) *ATPassthrough {
+	if len(config.Allow) == 0 {
+		config.Allow = DefaultATAllowlist
+	}
+
+	return &ATPassthrough{modem: modem, config: config}
+}
+
+// allowed checks that cmd is a single AT command in the allowlist
+func (p *ATPassthrough) allowed(cmd string) bool {
+	// commands can be concatenated with ; and control characters could
+	// end the command early
+	if strings.ContainsAny(cmd, ";\r\n\x1a\x1b") {
+		return false
+	}
+
+	cmd = strings.ToUpper(cmd)
+	for _, a := range p.config.Allow {
+		a = strings.ToUpper(a)
+		if !strings.HasPrefix(cmd, a) {
+			continue
+		}
+
+		rest := cmd[len(a):]
+		switch {
+		case rest == "":
+			return true
+		case strings.HasSuffix(a, "="):
+			if atArgs.MatchString(rest) {
+				return true
+			}
+		case strings.HasPrefix(a, "AT+") && !strings.HasSuffix(a, "?"):
+			if rest == "?" || (rest[0] == '=' && atArgs.MatchString(rest[1:])) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Run sends an allowed command to the modem and returns the raw response.
+// source is recorded in the audit log.
+func (p *ATPassthrough) Run(source, cmd string) (string, error) {
+	cmd = strings.TrimSpace(cmd)
+
+	audit := ATAudit{Time: time.Now(), Source: source, Command: cmd}
+
+	if p.allowed(cmd) {
+		audit.Response, audit.Err = p.modem.RawCmd(cmd)
+	} else {
+		audit.Err = errATNotAllowed
+	}
+
+	if audit.Err != nil {
+		atLog.Warn("passthrough", "source", source, "cmd", cmd, "error", audit.Err)
+	} else {
+		atLog.Info("passthrough", "source", source, "cmd", cmd,
+			"response", audit.Response)
+	}
+
+	if p.config.Audit != nil {
+		p.config.Audit(audit)
+	}
+
+	return audit.Response, audit.Err
+}
+
+// Command runs a ModemATCommand received from the server and returns the
+// response
+func (p *ATPassthrough) Command(cmd data.DeviceCommand) (string, error) {
+	if cmd.Command != ModemATCommand {
+		return "", fmt.Errorf("unexpected command: %v", cmd.Command)
+	}
+
+	if cmd.Args["cmd"] == "" {
+		return "", errors.New("cmd arg is required")
+	}
+
+	return p.Run("command", cmd.Args["cmd"])
+}
+
+type atRequest struct {
+	Command string `json:"command"`
+}
+
+type atResponse struct {
+	Command  string `json:"command"`
+	Response string `json:"response,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ServeHTTP runs the command of a POST with a JSON body like
+// {"command": "AT+CSQ"} and returns the response as JSON. The request
+// must have the configured bearer token.
+func (p *ATPassthrough) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(res, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !data.TokenEqual(token, p.config.Token) {
+		atLog.Warn("passthrough request refused", "source", req.RemoteAddr)
+		http.Error(res, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var r atRequest
+	err := json.NewDecoder(req.Body).Decode(&r)
+	if err != nil || r.Command == "" {
+		http.Error(res, "command is required", http.StatusBadRequest)
+		return
+	}
+
+	ret := atResponse{Command: r.Command}
+	ret.Response, err = p.Run(req.RemoteAddr, r.Command)
+
+	res.Header().Set("Content-Type", "application/json")
+	switch {
+	case err == errATNotAllowed:
+		res.WriteHeader(http.StatusForbidden)
+	case err != nil:
+		res.WriteHeader(http.StatusBadGateway)
+	}
+
+	if err != nil {
+		ret.Error = err.Error()
+	}
+
+	json.NewEncoder(res).Encode(ret)
+}
@@ -0,0 +1,80 @@
+package network
+
+import (
+	"math/rand"
+	"time"
+)
+
+// BackoffConfig configures exponential backoff with jitter
+type BackoffConfig struct {
+	// Initial is the delay after the first failure (default 10s)
+	Initial time.Duration
+	// Max is the longest delay (default 10m)
+	Max time.Duration
+	// Multiplier is applied to the delay after each failure (default 2)
+	Multiplier float64
+	// Jitter randomizes each delay by +/- this fraction (default 0.2) so
+	// devices that lost the network at the same time don't all retry at
+	// the same time
+	Jitter float64
+}
+
+// Backoff tracks when an operation can be retried
+type Backoff struct {
+	config BackoffConfig
+	delay  time.Duration
+	next   time.Time
+	now    func() time.Time
+}
+
+// NewBackoff creates a backoff. An attempt is allowed right away.
+func NewBackoff(config BackoffConfig) *Backoff {
+	return newBackoff(config, time.Now)
+}
+
+func newBackoff(config BackoffConfig, now func() time.Time) *Backoff {
+	if config.Initial == 0 {
+		config.Initial = 10 * time.Second
+	}
+
+	if config.Max == 0 {
+		config.Max = 10 * time.Minute
+	}
+
+	if config.Multiplier < 1 {
+		config.Multiplier = 2
+	}
+
+	if config.Jitter == 0 {
+		config.Jitter = 0.2
+	}
+
+	return &Backoff{config: config, now: now}
+}
+
+// Ready returns true if the operation can be tried
+func (b *Backoff) Ready() bool {
+	return !b.now().Before(b.next)
+}
+
+// Failed increases the delay before the next attempt
+func (b *Backoff) Failed() {
+	if b.delay == 0 {
+		b.delay = b.config.Initial
+	} else {
+		b.delay = time.Duration(float64(b.delay) * b.config.Multiplier)
+	}
+
+	if b.delay > b.config.Max {
+		b.delay = b.config.Max
+	}
+
+	jitter := (rand.Float64()*2 - 1) * b.config.Jitter * float64(b.delay)
+	b.next = b.now().Add(b.delay + time.Duration(jitter))
+}
+
+// Reset allows the next attempt right away, and starts the delay over
+func (b *Backoff) Reset() {
+	b.delay = 0
+	b.next = time.Time{}
+}
@@ -0,0 +1,43 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	clock := &testClock{t: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	b := newBackoff(BackoffConfig{Initial: 10 * time.Second, Max: time.Minute}, clock.now)
+
+	if !b.Ready() {
+		t.Fatal("first attempt is not allowed")
+	}
+
+	for i, delay := range []time.Duration{10 * time.Second, 20 * time.Second,
+		40 * time.Second, time.Minute, time.Minute} {
+		b.Failed()
+
+		// default jitter is +/- 20%
+		min := clock.t.Add(delay * 8 / 10)
+		max := clock.t.Add(delay * 12 / 10)
+		if b.next.Before(min) || b.next.After(max) {
+			t.Fatalf("failure %v: next attempt %v not within %v of %v",
+				i, b.next.Sub(clock.t), delay, clock.t)
+		}
+
+		if b.Ready() {
+			t.Fatalf("failure %v: ready before the delay", i)
+		}
+
+		clock.t = b.next
+		if !b.Ready() {
+			t.Fatalf("failure %v: not ready after the delay", i)
+		}
+	}
+
+	b.Failed()
+	b.Reset()
+	if !b.Ready() || b.delay != 0 {
+		t.Error("reset did not start the delay over")
+	}
+}
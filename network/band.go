@@ -0,0 +1,236 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// RatMode selects the radio access technologies a modem can use
+type RatMode string
+
+// define supported RAT modes
+const (
+	RatAuto    RatMode = ""
+	RatLTEOnly RatMode = "lteOnly"
+	// RatNo2G allows LTE and 3G, for areas where 2G is being sunset
+	RatNo2G RatMode = "no2G"
+)
+
+// allLTEBands is sent to unlock all bands. The modem ignores bands it
+// does not support.
+const allLTEBands = 0x7fffffffffffffff
+
+// lteBandMask converts a list of LTE bands to a bit mask (band 1 is bit 0)
+func lteBandMask(bands []int) (uint64, error) {
+	if len(bands) <= 0 {
+		return allLTEBands, nil
+	}
+
+	var ret uint64
+	for _, b := range bands {
+		if b < 1 || b > 64 {
+			return 0, fmt.Errorf("unsupported LTE band %v", b)
+		}
+		ret |= 1 << uint(b-1)
+	}
+
+	return ret, nil
+}
+
+// CmdQcfgRat sets the RAT mode on Quectel modems
+func CmdQcfgRat(port io.ReadWriter, rat RatMode) error {
+	switch rat {
+	case RatAuto:
+		return CmdOK(port, "AT+QCFG=\"nwscanmode\",0,1")
+	case RatLTEOnly:
+		return CmdBg96ForceLTE(port)
+	default:
+		return fmt.Errorf("RAT mode %v not supported", rat)
+	}
+}
+
+// CmdQcfgBands locks Quectel modems to LTE bands (CAT-M1 bands on the
+// BG96). All bands are allowed if bands is empty.
+func CmdQcfgBands(port io.ReadWriter, bands []int) error {
+	mask, err := lteBandMask(bands)
+	if err != nil {
+		return err
+	}
+
+	// 0 leaves the GSM and NB-IoT/TDS bands unchanged
+	return CmdOK(port, fmt.Sprintf("AT+QCFG=\"band\",0,%x,0,1", mask))
+}
+
+// CmdCnmp sets the RAT mode on SIMCom modems
+func CmdCnmp(port io.ReadWriter, rat RatMode) error {
+	switch rat {
+	case RatAuto:
+		return CmdOK(port, "AT+CNMP=2")
+	case RatLTEOnly:
+		return CmdOK(port, "AT+CNMP=38")
+	case RatNo2G:
+		return CmdOK(port, "AT+CNMP=54")
+	default:
+		return fmt.Errorf("RAT mode %v not supported", rat)
+	}
+}
+
+// +CNBP: 0x0002000000400183,0x000001E000081A3F
+var reCnbp = regexp.MustCompile(`\+CNBP:\s*(0x[0-9A-Fa-f]+),`)
+
+// CmdCnbp locks SIMCom modems to LTE bands. All bands are allowed if bands
+// is empty.
+func CmdCnbp(port io.ReadWriter, bands []int) error {
+	mask, err := lteBandMask(bands)
+	if err != nil {
+		return err
+	}
+
+	// the GSM/WCDMA bands have to be sent too, so keep the current ones
+	resp, err := Cmd(port, "AT+CNBP?")
+	if err != nil {
+		return err
+	}
+
+	matches := reCnbp.FindStringSubmatch(resp)
+	if len(matches) < 2 {
+		return fmt.Errorf("Error parsing AT+CNBP response: %v", resp)
+	}
+
+	return CmdOK(port, fmt.Sprintf("AT+CNBP=%v,0x%016X", matches[1], mask))
+}
+
+// +QNWINFO: "FDD LTE","310260","LTE BAND 4",2300
+var reQnwinfo = regexp.MustCompile(`\+QNWINFO:\s*"[^"]*","[^"]*","([^"]*)"`)
+
+// CmdQnwinfo returns the active band on Quectel modems (LTE BAND 4)
+func CmdQnwinfo(port io.ReadWriter) (string, error) {
+	resp, err := Cmd(port, "AT+QNWINFO")
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(resp, "\n") {
+		matches := reQnwinfo.FindStringSubmatch(line)
+		if len(matches) >= 2 {
+			return matches[1], nil
+		}
+	}
+
+	return "", fmt.Errorf("Error parsing AT+QNWINFO response: %v", resp)
+}
+
+// +CPSI: LTE,Online,310-260,0x1A2B,27447553,256,EUTRAN-BAND4,2300,...
+var reCpsiBand = regexp.MustCompile(`\+CPSI:.*,EUTRAN-BAND(\d+),`)
+
+// CmdCpsiBand returns the active LTE band on SIMCom modems (LTE BAND 4)
+func CmdCpsiBand(port io.ReadWriter) (string, error) {
+	resp, err := Cmd(port, "AT+CPSI?")
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(resp, "\n") {
+		matches := reCpsiBand.FindStringSubmatch(line)
+		if len(matches) >= 2 {
+			return "LTE BAND " + matches[1], nil
+		}
+	}
+
+	return "", fmt.Errorf("Error parsing AT+CPSI band: %v", resp)
+}
+
+// +CEREG: 2,1,"1A2B","01A2B3C4",7
+var reCeregCell = regexp.MustCompile(`\+CEREG:\s*\d+,\d+,"([0-9A-Fa-f]+)","([0-9A-Fa-f]+)"`)
+
+// CmdCellID returns the LTE tracking area code and cell ID in hex. The
+// location is only reported with AT+CEREG=2, which also enables unsolicited
+// messages, so this is turned off again after reading.
+func CmdCellID(port io.ReadWriter) (tac, cellID string, err error) {
+	err = CmdOK(port, "AT+CEREG=2")
+	if err != nil {
+		return
+	}
+
+	var resp string
+	resp, err = Cmd(port, "AT+CEREG?")
+	CmdOK(port, "AT+CEREG=0")
+	if err != nil {
+		return
+	}
+
+	for _, line := range strings.Split(resp, "\n") {
+		matches := reCeregCell.FindStringSubmatch(line)
+		if len(matches) >= 3 {
+			return matches[1], matches[2], nil
+		}
+	}
+
+	return "", "", fmt.Errorf("Error parsing AT+CEREG location: %v", resp)
+}
+
+// SetBandSelection locks the modem to RAT mode and LTE bands. If bands is
+// empty, all bands are allowed. The settings are stored in the modem, so
+// they persist across resets.
+func (m *Modem) SetBandSelection(rat RatMode, bands []int) error {
+	if _, err := lteBandMask(bands); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.detected() {
+		return errors.New("modem not detected")
+	}
+
+	if err := m.openCmdPort(); err != nil {
+		return err
+	}
+
+	switch m.config.Type {
+	case ModemSIM7600:
+		err := CmdCnmp(m.atCmdPort, rat)
+		if err != nil {
+			return err
+		}
+
+		return CmdCnbp(m.atCmdPort, bands)
+	default:
+		err := CmdQcfgRat(m.atCmdPort, rat)
+		if err != nil {
+			return err
+		}
+
+		return CmdQcfgBands(m.atCmdPort, bands)
+	}
+}
+
+// cellStatus fills in the active band and cell. Must be called with
+// m.lock held and the AT command port open.
+func (m *Modem) cellStatus(status *InterfaceStatus) error {
+	var err error
+	if m.config.Type == ModemSIM7600 {
+		if status.AccessTech == AccessTechLTE {
+			status.Band, err = CmdCpsiBand(m.atCmdPort)
+		}
+	} else {
+		status.Band, err = CmdQnwinfo(m.atCmdPort)
+	}
+	if err != nil {
+		return err
+	}
+
+	var tac, cellID string
+	tac, cellID, err = CmdCellID(m.atCmdPort)
+	if err != nil {
+		// not registered on LTE
+		return nil
+	}
+
+	status.CellID = tac + "-" + cellID
+	return nil
+}
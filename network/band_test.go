@@ -0,0 +1,106 @@
+package network
+
+import (
+	"testing"
+)
+
+func TestLteBandMask(t *testing.T) {
+	cases := []struct {
+		bands []int
+		mask  uint64
+		err   bool
+	}{
+		{nil, allLTEBands, false},
+		{[]int{1}, 0x1, false},
+		{[]int{2, 4, 12}, 0x80a, false},
+		{[]int{13, 13}, 0x1000, false},
+		{[]int{66}, 0, true},
+		{[]int{0}, 0, true},
+	}
+
+	for _, c := range cases {
+		mask, err := lteBandMask(c.bands)
+		if (err != nil) != c.err {
+			t.Errorf("%v: unexpected error: %v", c.bands, err)
+			continue
+		}
+
+		if mask != c.mask {
+			t.Errorf("%v: expected %x, got %x", c.bands, c.mask, mask)
+		}
+	}
+}
+
+func TestCmdBandSelect(t *testing.T) {
+	port := &fakePort{resp: map[string]string{
+		`AT+QCFG="band",0,80a,0,1`: "OK\r\n",
+		"AT+CNBP?":                 "+CNBP: 0x0002000000400183,0x000001E000081A3F\r\n\r\nOK\r\n",
+		"AT+CNBP=0x0002000000400183,0x000000000000080A": "OK\r\n",
+	}}
+
+	if err := CmdQcfgBands(port, []int{2, 4, 12}); err != nil {
+		t.Error("Error setting Quectel bands: ", err)
+	}
+
+	if err := CmdCnbp(port, []int{2, 4, 12}); err != nil {
+		t.Error("Error setting SIMCom bands: ", err)
+	}
+
+	if err := CmdCnmp(port, "3G"); err == nil {
+		t.Error("unsupported RAT mode accepted")
+	}
+
+	if err := CmdQcfgRat(port, RatNo2G); err == nil {
+		t.Error("unsupported RAT mode accepted")
+	}
+}
+
+func TestCmdBand(t *testing.T) {
+	port := &fakePort{resp: map[string]string{
+		"AT+QNWINFO": "+QNWINFO: \"FDD LTE\",\"310260\",\"LTE BAND 4\",2300\r\n\r\nOK\r\n",
+		"AT+CPSI?":   "+CPSI: LTE,Online,310-260,0x1A2B,27447553,256,EUTRAN-BAND12,5110,3,3,-94,-1047,-766,15\r\n\r\nOK\r\n",
+	}}
+
+	band, err := CmdQnwinfo(port)
+	if err != nil || band != "LTE BAND 4" {
+		t.Errorf("AT+QNWINFO: expected LTE BAND 4, got %q (%v)", band, err)
+	}
+
+	band, err = CmdCpsiBand(port)
+	if err != nil || band != "LTE BAND 12" {
+		t.Errorf("AT+CPSI?: expected LTE BAND 12, got %q (%v)", band, err)
+	}
+
+	port.resp["AT+CPSI?"] = "+CPSI: GSM,Online,310-410,0x1234,5678,20,EGSM,-75,0,26-26\r\n\r\nOK\r\n"
+	if _, err := CmdCpsiBand(port); err == nil {
+		t.Error("expected error for GSM response")
+	}
+}
+
+func TestCmdCellID(t *testing.T) {
+	port := &fakePort{resp: map[string]string{
+		"AT+CEREG=2": "OK\r\n",
+		"AT+CEREG=0": "OK\r\n",
+		"AT+CEREG?":  "+CEREG: 2,1,\"1A2B\",\"01A2B3C4\",7\r\n\r\nOK\r\n",
+	}}
+
+	tac, cellID, err := CmdCellID(port)
+	if err != nil {
+		t.Fatal("Error reading cell ID: ", err)
+	}
+
+	if tac != "1A2B" || cellID != "01A2B3C4" {
+		t.Errorf("expected 1A2B 01A2B3C4, got %v %v", tac, cellID)
+	}
+
+	// unsolicited messages must be turned off again
+	if last := port.cmds[len(port.cmds)-1]; last != "AT+CEREG=0" {
+		t.Errorf("expected AT+CEREG=0 last, got %v", last)
+	}
+
+	// not registered on LTE
+	port.resp["AT+CEREG?"] = "+CEREG: 2,0\r\n\r\nOK\r\n"
+	if _, _, err := CmdCellID(port); err == nil {
+		t.Error("expected error when not registered")
+	}
+}
@@ -0,0 +1,236 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// BandwidthTestCommand is the device command used to run a bandwidth test.
+// The optional url, uploadUrl, and maxBytes args override the configured
+// endpoints and size cap. maxBytes can only lower the cap.
+const BandwidthTestCommand = "bandwidthTest"
+
+// BandwidthConfig describes a bandwidth test
+type BandwidthConfig struct {
+	// DownloadURL is fetched for the download test and UploadURL is
+	// posted to for the upload test. A blank URL skips that test.
+	DownloadURL string
+	UploadURL   string
+	// MaxBytes caps the data transferred in each direction (default 10MB)
+	MaxBytes int64
+	// MaxRate limits each transfer in bytes/sec so the test does not
+	// starve other traffic. 0 is unlimited.
+	MaxRate int64
+	// Timeout limits each transfer (default 30s). A transfer that times
+	// out after moving some data still produces a result.
+	Timeout time.Duration
+	// Client is used for the requests (default http.DefaultClient)
+	Client *http.Client
+}
+
+// BandwidthResult is the result of a bandwidth test. Rates are in bits/sec.
+type BandwidthResult struct {
+	Download      float64
+	DownloadBytes int64
+	Upload        float64
+	UploadBytes   int64
+	Time          time.Time
+}
+
+// Samples returns the bandwidth result as samples
+func (r BandwidthResult) Samples(id string) []data.Sample {
+	var ret []data.Sample
+
+	if r.DownloadBytes > 0 {
+		ret = append(ret, data.Sample{Type: "bwDownload", ID: id,
+			Value: r.Download, Time: r.Time})
+	}
+
+	if r.UploadBytes > 0 {
+		ret = append(ret, data.Sample{Type: "bwUpload", ID: id,
+			Value: r.Upload, Time: r.Time})
+	}
+
+	return ret
+}
+
+// throttledReader limits reads to a rate in bytes/sec
+type throttledReader struct {
+	r     io.Reader
+	rate  int64
+	start time.Time
+	count int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+
+	if t.rate > 0 && int64(len(p)) > t.rate/10 {
+		// keep reads small so the rate is smooth
+		p = p[:t.rate/10+1]
+	}
+
+	n, err := t.r.Read(p)
+	t.count += int64(n)
+
+	if t.rate > 0 {
+		due := time.Duration(float64(t.count) / float64(t.rate) * float64(time.Second))
+		if wait := due - time.Since(t.start); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+
+	return n, err
+}
+
+// zeroReader returns an endless stream of zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func bitsPerSec(count int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(count) * 8 / d.Seconds()
+}
+
+// isTimeout returns true if err is a client timeout
+func isTimeout(err error) bool {
+	var t interface{ Timeout() bool }
+	return errors.As(err, &t) && t.Timeout()
+}
+
+func (c BandwidthConfig) download() (float64, int64, error) {
+	client := *c.Client
+	client.Timeout = c.Timeout
+
+	start := time.Now()
+	resp, err := client.Get(c.DownloadURL)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("Error downloading: %v", resp.Status)
+	}
+
+	r := &throttledReader{r: io.LimitReader(resp.Body, c.MaxBytes),
+		rate: c.MaxRate}
+	count, err := io.Copy(ioutil.Discard, r)
+	if err != nil && !(isTimeout(err) && count > 0) {
+		return 0, count, err
+	}
+
+	return bitsPerSec(count, time.Since(start)), count, nil
+}
+
+func (c BandwidthConfig) upload() (float64, int64, error) {
+	client := *c.Client
+	client.Timeout = c.Timeout
+
+	r := &throttledReader{r: io.LimitReader(zeroReader{}, c.MaxBytes),
+		rate: c.MaxRate}
+
+	req, err := http.NewRequest("POST", c.UploadURL, r)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.ContentLength = c.MaxBytes
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return 0, 0, fmt.Errorf("Error uploading: %v", resp.Status)
+	}
+
+	return bitsPerSec(r.count, time.Since(start)), r.count, nil
+}
+
+// RunBandwidthTest measures download and upload throughput
+func RunBandwidthTest(config BandwidthConfig) (BandwidthResult, error) {
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = 10 * 1024 * 1024
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = 30 * time.Second
+	}
+
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+
+	if config.DownloadURL == "" && config.UploadURL == "" {
+		return BandwidthResult{}, errors.New("no bandwidth test url")
+	}
+
+	ret := BandwidthResult{Time: time.Now()}
+	var err error
+
+	if config.DownloadURL != "" {
+		ret.Download, ret.DownloadBytes, err = config.download()
+		if err != nil {
+			return ret, fmt.Errorf("download test: %v", err)
+		}
+	}
+
+	if config.UploadURL != "" {
+		ret.Upload, ret.UploadBytes, err = config.upload()
+		if err != nil {
+			return ret, fmt.Errorf("upload test: %v", err)
+		}
+	}
+
+	return ret, nil
+}
+
+// BandwidthCommand runs a BandwidthTestCommand received from the server
+// using config for the defaults
+func BandwidthCommand(cmd data.DeviceCommand, config BandwidthConfig) (BandwidthResult, error) {
+	if cmd.Command != BandwidthTestCommand {
+		return BandwidthResult{}, fmt.Errorf("unexpected command: %v", cmd.Command)
+	}
+
+	if url := cmd.Args["url"]; url != "" {
+		config.DownloadURL = url
+	}
+
+	if url := cmd.Args["uploadUrl"]; url != "" {
+		config.UploadURL = url
+	}
+
+	if max := cmd.Args["maxBytes"]; max != "" {
+		v, err := strconv.ParseInt(max, 10, 64)
+		if err != nil {
+			return BandwidthResult{}, fmt.Errorf("Error parsing maxBytes: %v", err)
+		}
+
+		if v > 0 && (config.MaxBytes <= 0 || v < config.MaxBytes) {
+			config.MaxBytes = v
+		}
+	}
+
+	return RunBandwidthTest(config)
+}
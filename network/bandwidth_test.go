@@ -0,0 +1,135 @@
+package network
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// bandwidthServer serves size bytes on GET and counts bytes received on
+// POST. /missing is not found.
+func bandwidthServer(size int, received *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			http.NotFound(res, req)
+			return
+		}
+
+		switch req.Method {
+		case http.MethodGet:
+			res.Write(make([]byte, size))
+		case http.MethodPost:
+			*received, _ = io.Copy(ioutil.Discard, req.Body)
+		}
+	}))
+}
+
+func TestRunBandwidthTest(t *testing.T) {
+	var received int64
+	s := bandwidthServer(100000, &received)
+	defer s.Close()
+
+	result, err := RunBandwidthTest(BandwidthConfig{DownloadURL: s.URL,
+		UploadURL: s.URL, MaxBytes: 50000})
+	if err != nil {
+		t.Fatal("Error running bandwidth test: ", err)
+	}
+
+	if result.DownloadBytes != 50000 || result.UploadBytes != 50000 ||
+		received != 50000 {
+		t.Errorf("expected 50000 bytes each way, got %v, %v, %v",
+			result.DownloadBytes, result.UploadBytes, received)
+	}
+
+	if result.Download <= 0 || result.Upload <= 0 {
+		t.Errorf("expected rates, got %+v", result)
+	}
+
+	if samples := result.Samples("dev1"); len(samples) != 2 ||
+		samples[0].Type != "bwDownload" || samples[1].Type != "bwUpload" {
+		t.Errorf("unexpected samples: %+v", samples)
+	}
+
+	// only download
+	result, err = RunBandwidthTest(BandwidthConfig{DownloadURL: s.URL})
+	if err != nil || result.DownloadBytes != 100000 || result.UploadBytes != 0 {
+		t.Errorf("unexpected download only result: %+v (%v)", result, err)
+	}
+
+	if samples := result.Samples("dev1"); len(samples) != 1 {
+		t.Errorf("expected 1 sample, got %+v", samples)
+	}
+
+	if _, err := RunBandwidthTest(BandwidthConfig{}); err == nil {
+		t.Error("expected error without urls")
+	}
+
+	if _, err := RunBandwidthTest(BandwidthConfig{DownloadURL: s.URL + "/missing"}); err == nil {
+		t.Error("expected error for failed download")
+	}
+}
+
+func TestThrottledReader(t *testing.T) {
+	r := &throttledReader{r: bytes.NewReader(make([]byte, 10000)), rate: 100000}
+
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil || n != 10000 {
+		t.Fatalf("expected 10000 bytes, got %v (%v)", n, err)
+	}
+
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("read was not throttled: %v", d)
+	}
+
+	if rate := bitsPerSec(1000, time.Second); rate != 8000 {
+		t.Errorf("expected 8000 bits/sec, got %v", rate)
+	}
+
+	if rate := bitsPerSec(1000, 0); rate != 0 {
+		t.Errorf("expected 0 for no time, got %v", rate)
+	}
+}
+
+func TestBandwidthCommand(t *testing.T) {
+	var received int64
+	s := bandwidthServer(100000, &received)
+	defer s.Close()
+
+	config := BandwidthConfig{DownloadURL: "http://siot.invalid/", MaxBytes: 20000}
+
+	cases := []struct {
+		args  map[string]string
+		bytes int64
+		err   bool
+	}{
+		{map[string]string{"url": s.URL}, 20000, false},
+		{map[string]string{"url": s.URL, "maxBytes": "5000"}, 5000, false},
+		// maxBytes can only lower the cap
+		{map[string]string{"url": s.URL, "maxBytes": "50000"}, 20000, false},
+		{map[string]string{"url": s.URL, "maxBytes": "lots"}, 0, true},
+	}
+
+	for _, c := range cases {
+		result, err := BandwidthCommand(data.DeviceCommand{
+			Command: BandwidthTestCommand, Args: c.args}, config)
+		if (err != nil) != c.err {
+			t.Errorf("%v: unexpected error: %v", c.args, err)
+			continue
+		}
+
+		if result.DownloadBytes != c.bytes {
+			t.Errorf("%v: expected %v bytes, got %v", c.args, c.bytes, result.DownloadBytes)
+		}
+	}
+
+	if _, err := BandwidthCommand(data.DeviceCommand{Command: "reboot"}, config); err == nil {
+		t.Error("unexpected command accepted")
+	}
+}
@@ -0,0 +1,73 @@
+package network
+
+import (
+	"net/http"
+	"time"
+)
+
+// CaptiveProbeURL returns 204 with an empty body when there is no captive
+// portal. Portals redirect it or return a login page.
+var CaptiveProbeURL = "http://connectivitycheck.gstatic.com/generate_204"
+
+// captiveCheckInterval limits how often the probe is run
+const captiveCheckInterval = 5 * time.Minute
+
+// captiveRetry is how long the manager waits before failing back to an
+// interface that was behind a captive portal
+const captiveRetry = 30 * time.Minute
+
+var captiveClient = &http.Client{
+	Timeout: 10 * time.Second,
+	// a redirect is what we are looking for, so don't follow it
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// CheckCaptive returns true if HTTP requests are intercepted by a captive
+// portal (hotel or guest WiFi login page). An error is returned if the
+// probe fails, in which case the network is not usable either.
+func CheckCaptive() (bool, error) {
+	resp, err := captiveClient.Get(CaptiveProbeURL)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode != http.StatusNoContent, nil
+}
+
+// checkCaptive marks the status captive (and not connected) if a connected
+// interface is behind a captive portal. The probe is only run every
+// captiveCheckInterval while the interface stays connected.
+func (m *Manager) checkCaptive(status *InterfaceStatus) {
+	if !m.captiveDetect || !status.Connected {
+		m.captiveChecked = time.Time{}
+		m.captive = false
+		return
+	}
+
+	if m.now().Sub(m.captiveChecked) >= captiveCheckInterval {
+		m.captiveChecked = m.now()
+
+		captive, err := CheckCaptive()
+		if err != nil {
+			// don't fail over on a transient error, the watchdog handles
+			// networks that don't work at all
+			captive = m.captive
+		}
+
+		if captive && !m.captive {
+			m.captiveAt[m.interfaceIndex] = m.now()
+			m.sendEvent(EventCaptive, m.Desc(), "captive portal detected",
+				*status)
+		}
+
+		m.captive = captive
+	}
+
+	if m.captive {
+		status.Captive = true
+		status.Connected = false
+	}
+}
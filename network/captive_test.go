@@ -0,0 +1,99 @@
+package network
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// captiveServer returns a probe server that replies with the code in *code
+func captiveServer(code *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *code == http.StatusFound {
+			w.Header().Set("Location", "http://portal.example.com/login")
+		}
+		w.WriteHeader(*code)
+	}))
+}
+
+func TestCheckCaptive(t *testing.T) {
+	var code int
+	s := captiveServer(&code)
+	defer s.Close()
+
+	defer func(url string) { CaptiveProbeURL = url }(CaptiveProbeURL)
+	CaptiveProbeURL = s.URL
+
+	cases := []struct {
+		code    int
+		captive bool
+	}{
+		{http.StatusNoContent, false},
+		{http.StatusFound, true},
+		{http.StatusOK, true},
+	}
+
+	for _, c := range cases {
+		code = c.code
+		captive, err := CheckCaptive()
+		if err != nil {
+			t.Fatal("Error checking captive portal: ", err)
+		}
+
+		if captive != c.captive {
+			t.Errorf("%v: expected captive %v", c.code, c.captive)
+		}
+	}
+}
+
+func TestManagerCheckCaptive(t *testing.T) {
+	code := http.StatusFound
+	s := captiveServer(&code)
+	defer s.Close()
+
+	defer func(url string) { CaptiveProbeURL = url }(CaptiveProbeURL)
+	CaptiveProbeURL = s.URL
+
+	clock := &testClock{t: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	m := newManager(2, clock.now)
+	m.AddInterface(NewDummyInterface())
+
+	// disabled by default
+	status := InterfaceStatus{Connected: true}
+	m.checkCaptive(&status)
+	if status.Captive || !status.Connected {
+		t.Fatal("captive check ran while disabled")
+	}
+
+	m.SetCaptiveDetect(true)
+	status = InterfaceStatus{Connected: true}
+	m.checkCaptive(&status)
+	if !status.Captive || status.Connected {
+		t.Fatal("captive portal not detected")
+	}
+
+	if got := drainEvents(m); len(got) != 1 || got[0] != EventCaptive {
+		t.Errorf("expected captive event, got %v", got)
+	}
+
+	// the probe is not rerun until captiveCheckInterval has passed
+	code = http.StatusNoContent
+	clock.add(time.Minute)
+	status = InterfaceStatus{Connected: true}
+	m.checkCaptive(&status)
+	if !status.Captive {
+		t.Error("probe rerun before the check interval")
+	}
+
+	clock.add(captiveCheckInterval)
+	status = InterfaceStatus{Connected: true}
+	m.checkCaptive(&status)
+	if status.Captive || !status.Connected {
+		t.Error("captive portal not cleared")
+	}
+
+	if got := drainEvents(m); len(got) != 0 {
+		t.Errorf("expected no events, got %v", got)
+	}
+}
@@ -0,0 +1,104 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// ResolvConf is where managed DNS servers are written
+var ResolvConf = "/etc/resolv.conf"
+
+// DefaultDNSFallback are public resolvers used when the carrier DNS fails
+var DefaultDNSFallback = []string{"1.1.1.1", "8.8.8.8"}
+
+// WriteResolvConf writes the DNS servers to ResolvConf
+func WriteResolvConf(servers []string) error {
+	if len(servers) <= 0 {
+		return errors.New("no DNS servers")
+	}
+
+	resolv := ""
+	for _, s := range servers {
+		resolv += "nameserver " + s + "\n"
+	}
+
+	return ioutil.WriteFile(ResolvConf, []byte(resolv), 0644)
+}
+
+// CheckDNS resolves name using the system resolver
+func CheckDNS(name string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if len(addrs) <= 0 {
+		return errors.New("no addresses for " + name)
+	}
+
+	return nil
+}
+
+// SetDNS sets the DNS servers used while iface is active. If no servers are
+// set for an interface, resolv.conf is managed by the system (DHCP, pppd,
+// etc).
+func (m *Manager) SetDNS(iface Interface, servers []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.dns == nil {
+		m.dns = make(map[Interface][]string)
+	}
+
+	m.dns[iface] = servers
+}
+
+// SetDNSFallback sets the resolvers used by UseDNSFallback (default
+// DefaultDNSFallback)
+func (m *Manager) SetDNSFallback(servers []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.dnsFallback = servers
+}
+
+// UseDNSFallback switches to the fallback resolvers until the active
+// interface changes. This can be used as the watchdog DNS recovery.
+func (m *Manager) UseDNSFallback() error {
+	m.lock.Lock()
+	fallback := m.dnsFallback
+	m.lock.Unlock()
+
+	if len(fallback) <= 0 {
+		fallback = DefaultDNSFallback
+	}
+
+	netLog.Warn("using fallback DNS servers", "servers", fallback)
+	return WriteResolvConf(fallback)
+}
+
+// applyDNS writes the DNS servers for the active interface
+func (m *Manager) applyDNS() {
+	active := m.Active()
+	if active == nil {
+		return
+	}
+
+	m.lock.Lock()
+	servers := m.dns[active]
+	m.lock.Unlock()
+
+	if len(servers) <= 0 {
+		return
+	}
+
+	err := WriteResolvConf(servers)
+	if err != nil {
+		netLog.Error("error writing DNS servers", "error", err)
+	}
+}
@@ -0,0 +1,119 @@
+package network
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tempResolvConf points ResolvConf at a temp file and returns a function
+// that restores it
+func tempResolvConf(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "siot-dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolv := ResolvConf
+	ResolvConf = filepath.Join(dir, "resolv.conf")
+
+	return func() {
+		ResolvConf = resolv
+		os.RemoveAll(dir)
+	}
+}
+
+func readResolvConf(t *testing.T) string {
+	b, err := ioutil.ReadFile(ResolvConf)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+func TestWriteResolvConf(t *testing.T) {
+	defer tempResolvConf(t)()
+
+	if WriteResolvConf(nil) == nil {
+		t.Error("expected error without servers")
+	}
+
+	if err := WriteResolvConf([]string{"10.0.0.1", "2001:4860:4860::8888"}); err != nil {
+		t.Fatal("Error writing resolv.conf: ", err)
+	}
+
+	exp := "nameserver 10.0.0.1\nnameserver 2001:4860:4860::8888\n"
+	if got := readResolvConf(t); got != exp {
+		t.Errorf("expected %q, got %q", exp, got)
+	}
+}
+
+func TestManagerDNS(t *testing.T) {
+	defer tempResolvConf(t)()
+
+	m := newManager(2, time.Now)
+	eth := NewDummyInterface()
+	m.AddInterface(eth)
+
+	// managed by the system
+	m.applyDNS()
+	if got := readResolvConf(t); got != "" {
+		t.Errorf("resolv.conf written without servers: %q", got)
+	}
+
+	m.SetDNS(eth, []string{"10.0.0.1"})
+	m.applyDNS()
+	if got := readResolvConf(t); got != "nameserver 10.0.0.1\n" {
+		t.Errorf("interface servers not written: %q", got)
+	}
+
+	if err := m.UseDNSFallback(); err != nil {
+		t.Fatal("Error using fallback DNS: ", err)
+	}
+
+	if got := readResolvConf(t); got != "nameserver 1.1.1.1\nnameserver 8.8.8.8\n" {
+		t.Errorf("default fallback not written: %q", got)
+	}
+
+	m.SetDNSFallback([]string{"9.9.9.9"})
+	m.UseDNSFallback()
+	if got := readResolvConf(t); got != "nameserver 9.9.9.9\n" {
+		t.Errorf("fallback not written: %q", got)
+	}
+}
+
+func TestWatchdogRecoverDNS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	var recovered int
+	w := NewWatchdog(WatchdogConfig{
+		Targets:        []string{server.URL},
+		Timeout:        time.Second,
+		Failures:       1,
+		DNSNames:       []string{"localhost"},
+		RecoverDNS:     func() error { recovered++; return nil },
+		RestartSession: func() error { return nil },
+	})
+
+	w.run()
+	if recovered != 0 {
+		t.Fatal("DNS recovered while names resolve")
+	}
+
+	// .invalid never resolves
+	w.config.DNSNames = []string{"localhost", "siot.invalid"}
+	w.run()
+	if recovered != 1 {
+		t.Fatal("DNS not recovered")
+	}
+
+	if c := w.Counts(); c != (WatchdogCounts{RecoverDNS: 1}) {
+		t.Errorf("the link recovery ladder ran: %+v", c)
+	}
+}
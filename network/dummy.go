@@ -1,33 +1,172 @@
 package network
 
-// DummyInterface is an interface that always reports detected/connected
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DummyConfig scripts the behavior of a DummyInterface so the Manager,
+// watchdog, and uplink logic can be tested without hardware. The zero
+// value is an interface that is always connected.
+type DummyConfig struct {
+	// Desc defaults to net
+	Desc string
+	// NotDetected reports the interface as not detected
+	NotDetected bool
+	// StartDisconnected requires Connect to be called before the
+	// interface is connected
+	StartDisconnected bool
+	// ConnectFailures is the number of times Connect fails after each
+	// disconnect before it succeeds
+	ConnectFailures int
+	// DropAfter disconnects the interface this long after it connects
+	DropAfter time.Duration
+	// Latency is added to Connect and GetStatus, plus a random amount up
+	// to LatencyJitter. Seed makes the jitter repeatable.
+	Latency       time.Duration
+	LatencyJitter time.Duration
+	Seed          int64
+	// Now is used instead of time.Now if set, so tests can control time
+	Now func() time.Time
+}
+
+// DummyInterface is an interface that reports detected/connected as
+// scripted by DummyConfig
 type DummyInterface struct {
+	config      DummyConfig
+	lock        sync.Mutex
+	rand        *rand.Rand
+	connected   bool
+	connectedAt time.Time
+	failures    int
+	connects    int
+	resets      int
 }
 
-// NewDummyInterface constructor
+// NewDummyInterface constructor for an interface that is always connected
 func NewDummyInterface() *DummyInterface {
-	return &DummyInterface{}
+	return NewScriptedDummyInterface(DummyConfig{})
+}
+
+// NewScriptedDummyInterface constructor for an interface with scripted
+// faults
+func NewScriptedDummyInterface(config DummyConfig) *DummyInterface {
+	if config.Desc == "" {
+		config.Desc = "net"
+	}
+
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+
+	return &DummyInterface{
+		config:      config,
+		rand:        rand.New(rand.NewSource(config.Seed)),
+		connected:   !config.StartDisconnected,
+		connectedAt: config.Now(),
+	}
 }
 
 // Desc returns description
 func (d *DummyInterface) Desc() string {
-	return "net"
+	return d.config.Desc
 }
 
-// Connect stub
+// delay sleeps for the configured latency and returns it
+func (d *DummyInterface) delay() time.Duration {
+	latency := d.config.Latency
+	if d.config.LatencyJitter > 0 {
+		latency += time.Duration(d.rand.Int63n(int64(d.config.LatencyJitter)))
+	}
+
+	time.Sleep(latency)
+	return latency
+}
+
+// Connect fails ConnectFailures times after each disconnect, then connects
 func (d *DummyInterface) Connect() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.delay()
+
+	if d.connected {
+		return nil
+	}
+
+	if d.failures < d.config.ConnectFailures {
+		d.failures++
+		return errors.New("dummy connect failure")
+	}
+
+	d.failures = 0
+	d.connected = true
+	d.connectedAt = d.config.Now()
+	d.connects++
 	return nil
 }
 
 // GetStatus return interface status
 func (d *DummyInterface) GetStatus() (InterfaceStatus, error) {
-	return InterfaceStatus{
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	latency := d.delay()
+
+	if d.config.NotDetected {
+		return InterfaceStatus{}, nil
+	}
+
+	if d.connected && d.config.DropAfter > 0 &&
+		d.config.Now().Sub(d.connectedAt) >= d.config.DropAfter {
+		d.connected = false
+	}
+
+	ret := InterfaceStatus{
 		Detected:  true,
-		Connected: true,
-	}, nil
+		Connected: d.connected,
+	}
+
+	if latency > 0 {
+		ret.Latency = LinkStats{
+			Probes: 1,
+			RttAvg: latency,
+			RttMin: latency,
+			RttMax: latency,
+		}
+	}
+
+	return ret, nil
 }
 
-// Reset stub
+// Reset disconnects the interface
 func (d *DummyInterface) Reset() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.connected = false
+	d.resets++
 	return nil
 }
+
+// SetConnected connects or disconnects the interface, like a cable being
+// plugged in or unplugged
+func (d *DummyInterface) SetConnected(connected bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if connected && !d.connected {
+		d.connectedAt = d.config.Now()
+	}
+
+	d.connected = connected
+}
+
+// Counts returns the number of successful connects and resets
+func (d *DummyInterface) Counts() (connects, resets int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.connects, d.resets
+}
@@ -0,0 +1,89 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDummyInterface(t *testing.T) {
+	clock := &testClock{t: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	d := NewScriptedDummyInterface(DummyConfig{StartDisconnected: true,
+		ConnectFailures: 2, DropAfter: time.Minute, Now: clock.now})
+
+	if d.Desc() != "net" {
+		t.Errorf("expected default desc, got %v", d.Desc())
+	}
+
+	steps := []struct {
+		connect   bool
+		advance   time.Duration
+		err       bool
+		connected bool
+	}{
+		{false, 0, false, false},
+		{true, 0, true, false},
+		{true, 0, true, false},
+		{true, 0, false, true},
+		{false, 59 * time.Second, false, true},
+		// dropped
+		{false, time.Second, false, false},
+		// fails again after each disconnect
+		{true, 0, true, false},
+		{true, 0, true, false},
+		{true, 0, false, true},
+	}
+
+	for i, s := range steps {
+		clock.add(s.advance)
+
+		if s.connect {
+			if err := d.Connect(); (err != nil) != s.err {
+				t.Fatalf("step %v: unexpected connect error: %v", i, err)
+			}
+		}
+
+		status, _ := d.GetStatus()
+		if !status.Detected || status.Connected != s.connected {
+			t.Fatalf("step %v: expected connected %v, got %+v", i, s.connected, status)
+		}
+	}
+
+	d.Reset()
+	if connects, resets := d.Counts(); connects != 2 || resets != 1 {
+		t.Errorf("expected 2 connects and 1 reset, got %v and %v", connects, resets)
+	}
+}
+
+func TestDummyInterfaceNotDetected(t *testing.T) {
+	d := NewScriptedDummyInterface(DummyConfig{NotDetected: true})
+	if status, _ := d.GetStatus(); status.Detected || status.Connected {
+		t.Errorf("expected not detected, got %+v", status)
+	}
+}
+
+func TestDummyInterfaceLatency(t *testing.T) {
+	config := DummyConfig{Latency: time.Millisecond,
+		LatencyJitter: time.Millisecond, Seed: 3}
+
+	a := NewScriptedDummyInterface(config)
+	b := NewScriptedDummyInterface(config)
+
+	for i := 0; i < 3; i++ {
+		sa, _ := a.GetStatus()
+		sb, _ := b.GetStatus()
+
+		rtt := sa.Latency.RttAvg
+		if rtt < time.Millisecond || rtt >= 2*time.Millisecond {
+			t.Errorf("latency %v out of range", rtt)
+		}
+
+		// the jitter is repeatable for a seed
+		if rtt != sb.Latency.RttAvg {
+			t.Errorf("expected latency %v, got %v", rtt, sb.Latency.RttAvg)
+		}
+	}
+
+	if status, _ := NewDummyInterface().GetStatus(); status.Latency.Probes != 0 {
+		t.Errorf("expected no latency, got %+v", status.Latency)
+	}
+}
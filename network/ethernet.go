@@ -1,14 +1,26 @@
 package network
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"os/exec"
 	"strings"
+	"sync"
+
+	"github.com/simpleiot/simpleiot/data"
 )
 
 // Ethernet implements the Interface interface
 type Ethernet struct {
-	iface string
+	iface   string
+	usage   *UsageTracker
+	latency *LatencyMonitor
+	lock    sync.Mutex
+	// config is applied when configPending is set. If config is nil, the
+	// address is managed by the system.
+	config        *data.EthernetConfig
+	configPending bool
 }
 
 // NewEthernet contructor
@@ -18,28 +30,125 @@ func NewEthernet(iface string) *Ethernet {
 	}
 }
 
+// SetUsageTracker enables data usage tracking for the interface
+func (e *Ethernet) SetUsageTracker(usage *UsageTracker) {
+	e.usage = usage
+}
+
+// SetLatencyMonitor enables latency and packet loss monitoring for the
+// interface. The monitor must be started separately.
+func (e *Ethernet) SetLatencyMonitor(latency *LatencyMonitor) {
+	e.latency = latency
+}
+
+// SetConfig sets the DHCP or static address config. It is applied the next
+// time Connect is called.
+func (e *Ethernet) SetConfig(config data.EthernetConfig) error {
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.config = &config
+	e.configPending = true
+	return nil
+}
+
 // Desc returns a description of the interface
 func (e *Ethernet) Desc() string {
 	return fmt.Sprintf("Eth(%v)", e.iface)
 }
 
-// Connect network interface
+func (e *Ethernet) applyConfig(config data.EthernetConfig) error {
+	err := exec.Command("ip", "link", "set", e.iface, "up").Run()
+	if err != nil {
+		return fmt.Errorf("Error bringing up %v: %v", e.iface, err)
+	}
+
+	err = exec.Command("ip", "addr", "flush", "dev", e.iface).Run()
+	if err != nil {
+		return fmt.Errorf("Error flushing %v addresses: %v", e.iface, err)
+	}
+
+	if config.DHCP {
+		return exec.Command("udhcpc", "-q", "-n", "-i", e.iface).Run()
+	}
+
+	err = exec.Command("ip", "addr", "add", config.Address, "dev", e.iface).Run()
+	if err != nil {
+		return fmt.Errorf("Error setting %v address: %v", e.iface, err)
+	}
+
+	if config.Gateway != "" {
+		err = exec.Command("ip", "route", "replace", "default", "via",
+			config.Gateway, "dev", e.iface).Run()
+		if err != nil {
+			return fmt.Errorf("Error setting %v gateway: %v", e.iface, err)
+		}
+	}
+
+	if len(config.DNS) > 0 {
+		err = WriteResolvConf(config.DNS)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Connect applies the address config if it changed or the interface does
+// not have an address. If no config has been set, the address is managed
+// by the system.
 func (e *Ethernet) Connect() error {
-	// this is handled by system so no-op
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.config == nil {
+		return nil
+	}
+
+	if !e.carrier() {
+		return errors.New("no carrier")
+	}
+
+	_, err := GetIP(e.iface)
+	if !e.configPending && err == nil {
+		return nil
+	}
+
+	err = e.applyConfig(*e.config)
+	if err != nil {
+		return err
+	}
+
+	e.configPending = false
+
+	_, err = GetIP(e.iface)
+	if err != nil {
+		return fmt.Errorf("%v did not get an address", e.iface)
+	}
+
 	return nil
 }
 
-func (e *Ethernet) detected() bool {
+func (e *Ethernet) carrier() bool {
 	cnt, err := ioutil.ReadFile("/sys/class/net/" + e.iface + "/carrier")
 	if err != nil {
 		return false
 	}
 
-	if !strings.Contains(string(cnt), "1") {
+	return strings.Contains(string(cnt), "1")
+}
+
+func (e *Ethernet) detected() bool {
+	if !e.carrier() {
 		return false
 	}
 
-	cnt, err = ioutil.ReadFile("/sys/class/net/" + e.iface + "/operstate")
+	cnt, err := ioutil.ReadFile("/sys/class/net/" + e.iface + "/operstate")
 	if err != nil {
 		return false
 	}
@@ -68,14 +177,25 @@ func (e *Ethernet) connected() bool {
 // GetStatus returns ethernet interface status
 func (e *Ethernet) GetStatus() (InterfaceStatus, error) {
 	ip, _ := GetIP(e.iface)
-	return InterfaceStatus{
+	ret := InterfaceStatus{
 		Detected:  e.detected(),
+		Carrier:   e.carrier(),
 		Connected: e.connected(),
 		IP:        ip,
-	}, nil
+	}
+
+	linkInfo(e.iface, &ret)
+	e.usage.status(e.iface, &ret)
+	e.latency.status(&ret)
+
+	return ret, nil
 }
 
-// Reset interface. Currently no-op for ethernet
+// Reset interface. The address config is applied again the next time
+// Connect is called.
 func (e *Ethernet) Reset() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.configPending = true
 	return nil
 }
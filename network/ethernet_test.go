@@ -0,0 +1,34 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func TestEthernetConfig(t *testing.T) {
+	e := NewEthernet("siot-test0")
+
+	// the address is managed by the system until a config is set
+	if err := e.Connect(); err != nil {
+		t.Error("Error connecting without a config: ", err)
+	}
+
+	if e.SetConfig(data.EthernetConfig{Address: "10.0.0.2"}) == nil {
+		t.Error("invalid config was accepted")
+	}
+
+	if e.config != nil {
+		t.Error("invalid config was stored")
+	}
+
+	err := e.SetConfig(data.EthernetConfig{DHCP: true})
+	if err != nil || !e.configPending {
+		t.Fatal("config is not pending: ", err)
+	}
+
+	// the config is not applied without a carrier
+	if e.Connect() == nil || !e.configPending {
+		t.Error("config applied without a carrier")
+	}
+}
@@ -0,0 +1,107 @@
+package network
+
+import (
+	"time"
+
+	"github.com/simpleiot/simpleiot/bus"
+)
+
+// InterfaceEventType describes what happened to an interface
+type InterfaceEventType int
+
+// define interface event types
+const (
+	EventConnected InterfaceEventType = iota
+	EventDisconnected
+	EventFailover
+	EventSignalDegraded
+	EventDataCap
+	EventCaptive
+)
+
+func (t InterfaceEventType) String() string {
+	switch t {
+	case EventConnected:
+		return "connected"
+	case EventDisconnected:
+		return "disconnected"
+	case EventFailover:
+		return "failover"
+	case EventSignalDegraded:
+		return "signalDegraded"
+	case EventDataCap:
+		return "dataCap"
+	case EventCaptive:
+		return "captive"
+	default:
+		return "unknown"
+	}
+}
+
+// InterfaceEvent is sent by the Manager when an interface changes
+type InterfaceEvent struct {
+	Time time.Time
+	Type InterfaceEventType
+	// Iface is the description of the interface
+	Iface   string
+	Message string
+	Status  InterfaceStatus
+}
+
+// eventBufferSize is the number of events buffered for a slow reader.
+// Events are dropped if the buffer is full so the manager never blocks.
+const eventBufferSize = 20
+
+// Events returns a channel that receives interface events
+func (m *Manager) Events() <-chan InterfaceEvent {
+	return m.events
+}
+
+// SetBus publishes interface events to bus.TopicNetwork, in addition to
+// the Events channel
+func (m *Manager) SetBus(b *bus.Bus) {
+	m.bus = b
+}
+
+func (m *Manager) sendEvent(typ InterfaceEventType, iface, message string,
+	status InterfaceStatus) {
+	e := InterfaceEvent{
+		Time:    m.now(),
+		Type:    typ,
+		Iface:   iface,
+		Message: message,
+		Status:  status,
+	}
+
+	select {
+	case m.events <- e:
+	default:
+		netLog.Warn("event dropped", "type", typ)
+	}
+
+	if m.bus != nil {
+		m.bus.Publish(bus.Message{
+			Topic:   bus.TopicNetwork,
+			Type:    typ.String(),
+			Time:    e.Time,
+			Payload: e,
+		})
+	}
+}
+
+// checkEvents sends signal and data cap events for the active interface
+func (m *Manager) checkEvents(status InterfaceStatus) {
+	desc := m.Desc()
+
+	degraded := status.Signal != 0 && status.Signal < m.signalThreshold
+	if degraded && !m.signalDegraded {
+		m.sendEvent(EventSignalDegraded, desc, "signal below threshold", status)
+	}
+	m.signalDegraded = degraded
+
+	warned := &m.capWarned[m.interfaceIndex]
+	if status.Usage.Warned && !*warned {
+		m.sendEvent(EventDataCap, desc, "monthly data threshold reached", status)
+	}
+	*warned = status.Usage.Warned
+}
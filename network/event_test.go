@@ -0,0 +1,82 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+// drainEvents returns the types of the events waiting in the channel
+func drainEvents(m *Manager) []InterfaceEventType {
+	var ret []InterfaceEventType
+	for {
+		select {
+		case e := <-m.Events():
+			ret = append(ret, e.Type)
+		default:
+			return ret
+		}
+	}
+}
+
+func TestManagerEvents(t *testing.T) {
+	clock := &testClock{t: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	m := newManager(2, clock.now)
+	eth := NewScriptedDummyInterface(DummyConfig{Desc: "eth", ConnectFailures: 1000, Now: clock.now})
+	m.AddInterface(eth)
+	m.AddInterface(NewScriptedDummyInterface(DummyConfig{Desc: "wifi", Now: clock.now}))
+
+	last := m.runOnce(m.State())
+	eth.SetConnected(false)
+	for i := 0; i < 3; i++ {
+		clock.add(31 * time.Second)
+		last = m.runOnce(last)
+	}
+
+	exp := []InterfaceEventType{EventConnected, EventDisconnected, EventFailover,
+		EventConnected}
+	got := drainEvents(m)
+	if len(got) != len(exp) {
+		t.Fatalf("expected events %v, got %v", exp, got)
+	}
+
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Fatalf("expected events %v, got %v", exp, got)
+		}
+	}
+}
+
+func TestManagerCheckEvents(t *testing.T) {
+	m := newManager(2, time.Now)
+	m.AddInterface(NewDummyInterface())
+	m.SetSignalThreshold(-100)
+
+	steps := []struct {
+		status InterfaceStatus
+		events []InterfaceEventType
+	}{
+		{InterfaceStatus{Signal: -90}, nil},
+		{InterfaceStatus{Signal: -105}, []InterfaceEventType{EventSignalDegraded}},
+		// only sent when the signal drops below the threshold
+		{InterfaceStatus{Signal: -110}, nil},
+		// 0 is an unknown signal
+		{InterfaceStatus{}, nil},
+		{InterfaceStatus{Signal: -101}, []InterfaceEventType{EventSignalDegraded}},
+		{InterfaceStatus{Usage: UsageTotals{Warned: true}},
+			[]InterfaceEventType{EventDataCap}},
+		{InterfaceStatus{Usage: UsageTotals{Warned: true}}, nil},
+		// new month
+		{InterfaceStatus{}, nil},
+		{InterfaceStatus{Usage: UsageTotals{Warned: true}},
+			[]InterfaceEventType{EventDataCap}},
+	}
+
+	for i, s := range steps {
+		m.checkEvents(s.status)
+		got := drainEvents(m)
+		if len(got) != len(s.events) || len(got) > 0 && got[0] != s.events[0] {
+			t.Errorf("step %v: expected %v, got %v", i, s.events, got)
+		}
+	}
+}
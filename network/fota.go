@@ -0,0 +1,309 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// ModemFirmwareCommand is the device command used to update the modem
+// firmware. The url arg is the location of the delta package.
+const ModemFirmwareCommand = "modemFirmware"
+
+// FotaState is the state of a modem firmware update
+type FotaState string
+
+// define modem firmware update states
+const (
+	FotaIdle      FotaState = ""
+	FotaUploading FotaState = "uploading"
+	FotaUpdating  FotaState = "updating"
+	FotaDone      FotaState = "done"
+	// FotaRolledBack means the modem reported success, but is still
+	// running the old firmware
+	FotaRolledBack FotaState = "rolledBack"
+	FotaFailed     FotaState = "failed"
+)
+
+// FotaStatus is the progress of a modem firmware update
+type FotaStatus struct {
+	State FotaState
+	// Progress is 0-100 while uploading or updating
+	Progress int
+	Error    string
+	// FromVersion is the firmware before the update, and ToVersion after
+	FromVersion string
+	ToVersion   string
+}
+
+// fotaTimeout is how long the modem has to apply an update
+const fotaTimeout = 20 * time.Minute
+
+// fotaFile is where the package is uploaded on the modem file system, and
+// fotaPath is the same file as seen by the update procedure
+const (
+	fotaFile = "UFS:fota.zip"
+	fotaPath = "/usrdata/UFS/fota.zip"
+)
+
+// fotaProgress is shared by the update and status readers
+type fotaProgress struct {
+	lock   sync.Mutex
+	status FotaStatus
+}
+
+func (f *fotaProgress) get() FotaStatus {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.status
+}
+
+func (f *fotaProgress) set(fn func(s *FotaStatus)) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	fn(&f.status)
+}
+
+// uploadCounter reports upload progress as the package is written
+type uploadCounter struct {
+	w     io.Writer
+	size  int64
+	count int64
+	fota  *fotaProgress
+}
+
+func (u *uploadCounter) Write(p []byte) (int, error) {
+	n, err := u.w.Write(p)
+	u.count += int64(n)
+	u.fota.set(func(s *FotaStatus) {
+		s.Progress = int(u.count * 100 / u.size)
+	})
+	return n, err
+}
+
+// CmdQfupl uploads a file to the Quectel modem file system
+func CmdQfupl(port io.ReadWriter, name string, r io.Reader, size int64,
+	w io.Writer) error {
+	resp, err := Cmd(port, fmt.Sprintf("AT+QFUPL=\"%v\",%v,300", name, size))
+	if err != nil {
+		return err
+	}
+
+	if !strings.Contains(resp, "CONNECT") {
+		return fmt.Errorf("Error starting upload: %v", resp)
+	}
+
+	_, err = io.CopyN(w, r, size)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 256)
+	n, err := port.Read(buf)
+	if err != nil {
+		return err
+	}
+
+	resp = string(buf[:n])
+	if !strings.Contains(resp, "+QFUPL:") {
+		return fmt.Errorf("Error uploading file: %v", resp)
+	}
+
+	return nil
+}
+
+// +QIND: "FOTA","UPDATING",45
+// +QIND: "FOTA","END",0
+var reQindFota = regexp.MustCompile(`\+QIND:\s*"FOTA","(\w+)",?(\d*)`)
+
+// UpdateFirmware uploads a delta firmware package to the modem and applies
+// it with the vendor DFOTA procedure. This blocks until the update is
+// done, which can take many minutes, and the modem can't be used while it
+// runs. Progress is reported by FotaStatus. Only Quectel modems are
+// supported.
+func (m *Modem) UpdateFirmware(pkg io.Reader, size int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	err := m.updateFirmware(pkg, size)
+	if err != nil {
+		m.fota.set(func(s *FotaStatus) {
+			s.State = FotaFailed
+			s.Error = err.Error()
+		})
+	}
+
+	return err
+}
+
+func (m *Modem) updateFirmware(pkg io.Reader, size int64) error {
+	if m.config.Type == ModemSIM7600 {
+		return errors.New("firmware update not supported on SIM7600")
+	}
+
+	if err := m.openCmdPort(); err != nil {
+		return err
+	}
+
+	from, err := CmdGetFwVersion(m.atCmdPort)
+	if err != nil {
+		return err
+	}
+
+	m.fota.set(func(s *FotaStatus) {
+		*s = FotaStatus{State: FotaUploading, FromVersion: from}
+	})
+
+	// remove a package left from a failed update
+	CmdOK(m.atCmdPort, "AT+QFDEL=\""+fotaFile+"\"")
+
+	err = CmdQfupl(m.atCmdPort, fotaFile, pkg, size,
+		&uploadCounter{w: m.atCmdPort, size: size, fota: &m.fota})
+	if err != nil {
+		return err
+	}
+
+	m.fota.set(func(s *FotaStatus) {
+		s.State = FotaUpdating
+		s.Progress = 0
+	})
+
+	err = CmdOK(m.atCmdPort, "AT+QFOTADL=\""+fotaPath+"\"")
+	if err != nil {
+		return err
+	}
+
+	err = m.waitFota()
+	if err != nil {
+		return err
+	}
+
+	// the modem resets after the update
+	m.atCmdPort.Close()
+	m.atCmdPort = nil
+	m.profilePending = true
+	m.sim = SimStatus{}
+	m.ident = ModemIdentity{}
+
+	var to string
+	for start := time.Now(); time.Since(start) < time.Minute; time.Sleep(5 * time.Second) {
+		if err = m.openCmdPort(); err != nil {
+			continue
+		}
+
+		to, err = CmdGetFwVersion(m.atCmdPort)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading firmware version after update: %v", err)
+	}
+
+	m.fota.set(func(s *FotaStatus) {
+		s.ToVersion = to
+		s.Progress = 100
+		if to == from {
+			s.State = FotaRolledBack
+		} else {
+			s.State = FotaDone
+		}
+	})
+
+	return nil
+}
+
+// waitFota reads FOTA URCs until the update ends. The modem reboots
+// during the update, so the port is reopened on errors.
+func (m *Modem) waitFota() error {
+	buf := make([]byte, 512)
+
+	for start := time.Now(); time.Since(start) < fotaTimeout; {
+		if err := m.openCmdPort(); err != nil {
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		n, err := m.atCmdPort.Read(buf)
+		if err != nil && err != io.EOF {
+			m.atCmdPort.Close()
+			m.atCmdPort = nil
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			matches := reQindFota.FindStringSubmatch(line)
+			if len(matches) < 3 {
+				continue
+			}
+
+			v, _ := strconv.Atoi(matches[2])
+
+			switch matches[1] {
+			case "UPDATING":
+				m.fota.set(func(s *FotaStatus) { s.Progress = v })
+			case "END":
+				if v != 0 {
+					return fmt.Errorf("modem firmware update failed: %v", v)
+				}
+				return nil
+			}
+		}
+	}
+
+	return errors.New("timeout waiting for modem firmware update")
+}
+
+// FotaStatus returns the progress of the last firmware update
+func (m *Modem) FotaStatus() FotaStatus {
+	return m.fota.get()
+}
+
+// FirmwareCommand runs a ModemFirmwareCommand received from the server.
+// The package is downloaded from the url arg.
+func (m *Modem) FirmwareCommand(cmd data.DeviceCommand) error {
+	if cmd.Command != ModemFirmwareCommand {
+		return fmt.Errorf("unexpected command: %v", cmd.Command)
+	}
+
+	url := cmd.Args["url"]
+	if url == "" {
+		return errors.New("url arg is required")
+	}
+
+	if m.config.Maintenance != nil {
+		return m.config.Maintenance.Run("modem firmware update", func() error {
+			return m.downloadFirmware(url)
+		})
+	}
+
+	return m.downloadFirmware(url)
+}
+
+// downloadFirmware downloads a firmware package and updates the modem
+func (m *Modem) downloadFirmware(url string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error downloading modem firmware: %v", resp.Status)
+	}
+
+	if resp.ContentLength <= 0 {
+		return errors.New("modem firmware size not known")
+	}
+
+	return m.UpdateFirmware(resp.Body, resp.ContentLength)
+}
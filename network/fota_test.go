@@ -0,0 +1,136 @@
+package network
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// urcPort returns reads in order, like unsolicited messages from a modem
+type urcPort struct {
+	reads []string
+}
+
+func (p *urcPort) Read(b []byte) (int, error) {
+	if len(p.reads) <= 0 {
+		return 0, nil
+	}
+
+	n := copy(b, p.reads[0])
+	p.reads = p.reads[1:]
+	return n, nil
+}
+
+func (p *urcPort) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (p *urcPort) Close() error {
+	return nil
+}
+
+func TestCmdQfupl(t *testing.T) {
+	pkg := "delta package"
+	cmd := `AT+QFUPL="UFS:fota.zip",13,300`
+
+	cases := []struct {
+		name  string
+		reads []string
+		err   bool
+	}{
+		{"ok", []string{"CONNECT\r\n", "+QFUPL: 13,4e2\r\n\r\nOK\r\n"}, false},
+		{"no connect", []string{"+CME ERROR: 407\r\n"}, true},
+		{"upload error", []string{"CONNECT\r\n", "+CME ERROR: 409\r\n"}, true},
+	}
+
+	for _, c := range cases {
+		port := &urcPort{reads: c.reads}
+		var w bytes.Buffer
+		err := CmdQfupl(port, fotaFile, strings.NewReader(pkg), int64(len(pkg)), &w)
+		if (err != nil) != c.err {
+			t.Errorf("%v: unexpected error: %v", c.name, err)
+		}
+
+		if !c.err && w.String() != pkg {
+			t.Errorf("%v: expected %q uploaded, got %q", c.name, pkg, w.String())
+		}
+	}
+
+	// the command must match what the modem expects
+	fp := &fakePort{resp: map[string]string{cmd: "ERROR\r\n"}}
+	CmdQfupl(fp, fotaFile, strings.NewReader(pkg), int64(len(pkg)), &bytes.Buffer{})
+	if len(fp.cmds) <= 0 || fp.cmds[0] != cmd {
+		t.Errorf("expected %v, got %v", cmd, fp.cmds)
+	}
+}
+
+func TestUploadCounter(t *testing.T) {
+	var fota fotaProgress
+	u := &uploadCounter{w: &bytes.Buffer{}, size: 200, fota: &fota}
+
+	u.Write(make([]byte, 50))
+	if p := fota.get().Progress; p != 25 {
+		t.Errorf("expected 25%%, got %v", p)
+	}
+
+	u.Write(make([]byte, 150))
+	if p := fota.get().Progress; p != 100 {
+		t.Errorf("expected 100%%, got %v", p)
+	}
+}
+
+func TestModemWaitFota(t *testing.T) {
+	cases := []struct {
+		name     string
+		reads    []string
+		progress int
+		err      bool
+	}{
+		{"ok", []string{
+			"+QIND: \"FOTA\",\"START\"\r\n",
+			"+QIND: \"FOTA\",\"UPDATING\",45\r\n",
+			"\r\nRDY\r\n",
+			"+QIND: \"FOTA\",\"UPDATING\",90\r\n+QIND: \"FOTA\",\"END\",0\r\n",
+		}, 90, false},
+		{"failed", []string{
+			"+QIND: \"FOTA\",\"UPDATING\",10\r\n",
+			"+QIND: \"FOTA\",\"END\",504\r\n",
+		}, 10, true},
+	}
+
+	for _, c := range cases {
+		m := NewModem(ModemConfig{Type: ModemEC25})
+		m.atCmdPort = &urcPort{reads: c.reads}
+
+		err := m.waitFota()
+		if (err != nil) != c.err {
+			t.Errorf("%v: unexpected error: %v", c.name, err)
+		}
+
+		if p := m.FotaStatus().Progress; p != c.progress {
+			t.Errorf("%v: expected progress %v, got %v", c.name, c.progress, p)
+		}
+	}
+}
+
+func TestModemFirmwareCommand(t *testing.T) {
+	m := NewModem(ModemConfig{Type: ModemEC25})
+
+	cases := []data.DeviceCommand{
+		{Command: "reboot", Args: map[string]string{"url": "http://example.com/fw.zip"}},
+		{Command: ModemFirmwareCommand},
+	}
+
+	for _, c := range cases {
+		if err := m.FirmwareCommand(c); err == nil {
+			t.Errorf("%v: command accepted", c)
+		}
+	}
+
+	if err := NewModem(ModemConfig{Type: ModemSIM7600}).UpdateFirmware(
+		strings.NewReader(""), 0); err == nil {
+		t.Error("SIM7600 update accepted")
+	}
+}
@@ -0,0 +1,211 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	nmea "github.com/adrianmo/go-nmea"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// ErrNoFix is returned if the GPS does not have a position fix yet
+var ErrNoFix = errors.New("no GPS fix")
+
+// CmdQgpsEnable turns on the GPS in Quectel modems, and enables reading
+// NMEA sentences with AT+QGPSGNMEA
+func CmdQgpsEnable(port io.ReadWriter) error {
+	err := CmdOK(port, "AT+QGPSCFG=\"nmeasrc\",1")
+	if err != nil {
+		return err
+	}
+
+	resp, err := Cmd(port, "AT+QGPS=1")
+	if err != nil {
+		return err
+	}
+
+	// 504 is returned if the GPS is already running
+	if strings.Contains(resp, "+CME ERROR: 504") {
+		return nil
+	}
+
+	return checkRespOK(resp)
+}
+
+// CmdCgpsEnable turns on the GPS in SIMCom modems
+func CmdCgpsEnable(port io.ReadWriter) error {
+	resp, err := Cmd(port, "AT+CGPS?")
+	if err != nil {
+		return err
+	}
+
+	if strings.Contains(resp, "+CGPS: 1") {
+		return nil
+	}
+
+	return CmdOK(port, "AT+CGPS=1,1")
+}
+
+// +CGPSINFO: 3113.343286,N,12121.234064,E,250311,072809.3,44.1,0.0,0
+var reCgpsInfo = regexp.MustCompile(`\+CGPSINFO:\s*([\d.]*),([NS]?),([\d.]*),([EW]?),`)
+
+// CmdCgpsInfo returns the position from SIMCom modems. ErrNoFix is
+// returned if there is no fix.
+func CmdCgpsInfo(port io.ReadWriter) (data.GpsPos, error) {
+	resp, err := Cmd(port, "AT+CGPSINFO")
+	if err != nil {
+		return data.GpsPos{}, err
+	}
+
+	for _, line := range strings.Split(resp, "\n") {
+		matches := reCgpsInfo.FindStringSubmatch(line)
+		if len(matches) < 5 {
+			continue
+		}
+
+		if matches[1] == "" {
+			return data.GpsPos{}, ErrNoFix
+		}
+
+		var ret data.GpsPos
+		ret.Lat, err = nmea.ParseGPS(matches[1] + " " + matches[2])
+		if err != nil {
+			return ret, err
+		}
+
+		ret.Long, err = nmea.ParseGPS(matches[3] + " " + matches[4])
+		if err != nil {
+			return ret, err
+		}
+
+		ret.Fix = nmea.GPS
+		return ret, nil
+	}
+
+	return data.GpsPos{}, fmt.Errorf("Error parsing AT+CGPSINFO response: %v", resp)
+}
+
+// EnableGps turns on the GPS in the modem
+func (m *Modem) EnableGps() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.openCmdPort(); err != nil {
+		return err
+	}
+
+	if m.config.Type == ModemSIM7600 {
+		return CmdCgpsEnable(m.atCmdPort)
+	}
+
+	return CmdQgpsEnable(m.atCmdPort)
+}
+
+// GetPosition returns the current position from the modem GPS. ErrNoFix
+// is returned if there is no fix.
+func (m *Modem) GetPosition() (data.GpsPos, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.openCmdPort(); err != nil {
+		return data.GpsPos{}, err
+	}
+
+	if m.config.Type == ModemSIM7600 {
+		return CmdCgpsInfo(m.atCmdPort)
+	}
+
+	gga, err := CmdGGA(m.atCmdPort)
+	if err != nil {
+		return data.GpsPos{}, err
+	}
+
+	s, err := nmea.Parse(gga)
+	if err != nil {
+		return data.GpsPos{}, err
+	}
+
+	fix, ok := s.(nmea.GGA)
+	if !ok {
+		return data.GpsPos{}, fmt.Errorf("expected GGA sentence: %v", gga)
+	}
+
+	if fix.FixQuality == nmea.Invalid {
+		return data.GpsPos{}, ErrNoFix
+	}
+
+	return data.GpsPos{
+		Lat:    fix.Latitude,
+		Long:   fix.Longitude,
+		Fix:    fix.FixQuality,
+		NumSat: fix.NumSatellites,
+	}, nil
+}
+
+// ModemGps periodically reads the position from a modem GPS. Positions
+// are sent on the channel in the same way as gps.Gps so the two can be
+// used interchangeably.
+type ModemGps struct {
+	modem    *Modem
+	interval time.Duration
+	c        chan data.GpsPos
+	stop     chan struct{}
+}
+
+// NewModemGps creates a new modem GPS reader
+func NewModemGps(modem *Modem, interval time.Duration, c chan data.GpsPos) *ModemGps {
+	return &ModemGps{
+		modem:    modem,
+		interval: interval,
+		c:        c,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start enables the GPS and sends positions until Stop is called. Nothing
+// is sent while the GPS does not have a fix.
+func (g *ModemGps) Start() {
+	go func() {
+		ticker := time.NewTicker(g.interval)
+		defer ticker.Stop()
+
+		enabled := false
+
+		for {
+			select {
+			case <-ticker.C:
+				if !enabled {
+					err := g.modem.EnableGps()
+					if err != nil {
+						modemLog.Error("error enabling GPS", "error", err)
+						continue
+					}
+					enabled = true
+				}
+
+				pos, err := g.modem.GetPosition()
+				if err == ErrNoFix {
+					continue
+				} else if err != nil {
+					modemLog.Error("error reading GPS", "error", err)
+					// modem may have been reset
+					enabled = false
+					continue
+				}
+
+				g.c <- pos
+			case <-g.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops reading the GPS
+func (g *ModemGps) Stop() {
+	close(g.stop)
+}
@@ -0,0 +1,98 @@
+package network
+
+import (
+	"math"
+	"testing"
+
+	nmea "github.com/adrianmo/go-nmea"
+)
+
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) < 1e-7
+}
+
+func TestModemGetPosition(t *testing.T) {
+	cases := []struct {
+		name   string
+		mtype  ModemType
+		resp   map[string]string
+		lat    float64
+		long   float64
+		fix    string
+		numSat int64
+		err    error
+	}{
+		{name: "SIMCom fix", mtype: ModemSIM7600, resp: map[string]string{
+			"AT+CGPSINFO": "+CGPSINFO: 3113.343286,N,12121.234064,E,250311,072809.3,44.1,0.0,0\r\nOK\r\n",
+		}, lat: 31.2223881, long: 121.3539011, fix: nmea.GPS},
+		{name: "SIMCom south west", mtype: ModemSIM7600, resp: map[string]string{
+			"AT+CGPSINFO": "+CGPSINFO: 3351.000000,S,15112.000000,W,250311,072809.3,44.1,0.0,0\r\nOK\r\n",
+		}, lat: -33.85, long: -151.2, fix: nmea.GPS},
+		{name: "SIMCom no fix", mtype: ModemSIM7600, resp: map[string]string{
+			"AT+CGPSINFO": "+CGPSINFO: ,,,,,,,,\r\nOK\r\n",
+		}, err: ErrNoFix},
+		{name: "Quectel fix", mtype: ModemEC25, resp: map[string]string{
+			`AT+QGPSGNMEA="GGA"`: "+QGPSGNMEA: $GPGGA,172814.0,3723.46587704,N,12202.26957864,W,2,6,1.2,18.893,M,-25.669,M,2.0,0031*4F\r\nOK\r\n",
+		}, lat: 37.39109795, long: -122.03782631, fix: nmea.DGPS, numSat: 6},
+		{name: "Quectel no fix", mtype: ModemBG96, resp: map[string]string{
+			`AT+QGPSGNMEA="GGA"`: "+QGPSGNMEA: $GPGGA,,,,,,0,,,,,,,,*66\r\nOK\r\n",
+		}, err: ErrNoFix},
+	}
+
+	for _, c := range cases {
+		m := NewModem(ModemConfig{Type: c.mtype})
+		m.atCmdPort = &fakePort{resp: c.resp}
+
+		pos, err := m.GetPosition()
+		if err != c.err {
+			t.Errorf("%v: expected error %v, got %v", c.name, c.err, err)
+			continue
+		}
+
+		if !closeTo(pos.Lat, c.lat) || !closeTo(pos.Long, c.long) ||
+			pos.Fix != c.fix || pos.NumSat != c.numSat {
+			t.Errorf("%v: unexpected position %+v", c.name, pos)
+		}
+	}
+}
+
+func TestCmdQgpsEnable(t *testing.T) {
+	for _, resp := range []string{"\r\nOK\r\n", "\r\n+CME ERROR: 504\r\n"} {
+		port := &fakePort{resp: map[string]string{
+			`AT+QGPSCFG="nmeasrc",1`: "\r\nOK\r\n",
+			"AT+QGPS=1":              resp,
+		}}
+
+		if err := CmdQgpsEnable(port); err != nil {
+			t.Errorf("%q: error enabling GPS: %v", resp, err)
+		}
+	}
+
+	port := &fakePort{resp: map[string]string{
+		`AT+QGPSCFG="nmeasrc",1`: "\r\nOK\r\n",
+		"AT+QGPS=1":              "\r\n+CME ERROR: 505\r\n",
+	}}
+
+	if err := CmdQgpsEnable(port); err == nil {
+		t.Error("expected error for CME ERROR 505")
+	}
+}
+
+func TestCmdCgpsEnable(t *testing.T) {
+	port := &fakePort{resp: map[string]string{
+		"AT+CGPS?": "\r\n+CGPS: 1,1\r\nOK\r\n",
+	}}
+
+	if err := CmdCgpsEnable(port); err != nil || len(port.cmds) != 1 {
+		t.Errorf("running GPS was enabled again: %v, %v", err, port.cmds)
+	}
+
+	port = &fakePort{resp: map[string]string{
+		"AT+CGPS?":    "\r\n+CGPS: 0,1\r\nOK\r\n",
+		"AT+CGPS=1,1": "\r\nOK\r\n",
+	}}
+
+	if err := CmdCgpsEnable(port); err != nil || len(port.cmds) != 2 {
+		t.Errorf("GPS was not enabled: %v, %v", err, port.cmds)
+	}
+}
@@ -0,0 +1,230 @@
+package network
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// StatusSnapshot is an interface status at a point in time
+type StatusSnapshot struct {
+	Time   time.Time
+	Status InterfaceStatus
+}
+
+// IfaceHistory is the status history for one interface
+type IfaceHistory struct {
+	// Snapshots are the most recent status snapshots, oldest first
+	Snapshots []StatusSnapshot
+	// ConnectedTime is the total time the interface has been connected
+	// while it was active
+	ConnectedTime time.Duration
+	Connects      int
+	Disconnects   int
+	// LastFailure is the reason the manager last moved off the interface
+	LastFailure     string
+	LastFailureTime time.Time
+
+	connected bool
+	lastSeen  time.Time
+}
+
+// historyData is the persisted history
+type historyData struct {
+	Interfaces  map[string]*IfaceHistory
+	Transitions []Transition
+}
+
+// StatusHistory keeps a bounded history of status snapshots and
+// transitions for each interface so intermittent connectivity problems can
+// be analyzed after the fact. It is persisted to a file, and can be
+// queried over HTTP.
+type StatusHistory struct {
+	file         string
+	interval     time.Duration
+	maxSnapshots int
+	lock         sync.Mutex
+	data         historyData
+	lastSave     time.Time
+}
+
+// NewStatusHistory creates a status history that records a snapshot every
+// interval and keeps maxSnapshots for each interface. If file is blank, the
+// history is not persisted.
+func NewStatusHistory(file string, interval time.Duration,
+	maxSnapshots int) (*StatusHistory, error) {
+	ret := &StatusHistory{
+		file:         file,
+		interval:     interval,
+		maxSnapshots: maxSnapshots,
+		data: historyData{
+			Interfaces: make(map[string]*IfaceHistory),
+		},
+	}
+
+	if file == "" {
+		return ret, nil
+	}
+
+	d, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return ret, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(d, &ret.data)
+	if err != nil {
+		return nil, err
+	}
+
+	if ret.data.Interfaces == nil {
+		ret.data.Interfaces = make(map[string]*IfaceHistory)
+	}
+
+	return ret, nil
+}
+
+func (h *StatusHistory) iface(desc string) *IfaceHistory {
+	ih, ok := h.data.Interfaces[desc]
+	if !ok {
+		ih = &IfaceHistory{}
+		h.data.Interfaces[desc] = ih
+	}
+
+	return ih
+}
+
+// record adds the status of the active interface. h can be nil if history
+// is not being kept.
+func (h *StatusHistory) record(desc string, status InterfaceStatus) {
+	if h == nil {
+		return
+	}
+
+	now := time.Now()
+
+	h.lock.Lock()
+
+	ih := h.iface(desc)
+
+	if ih.connected && !ih.lastSeen.IsZero() {
+		ih.ConnectedTime += now.Sub(ih.lastSeen)
+	}
+
+	if status.Connected && !ih.connected {
+		ih.Connects++
+	} else if !status.Connected && ih.connected {
+		ih.Disconnects++
+	}
+
+	ih.connected = status.Connected
+	ih.lastSeen = now
+
+	n := len(ih.Snapshots)
+	if n <= 0 || now.Sub(ih.Snapshots[n-1].Time) >= h.interval {
+		ih.Snapshots = append(ih.Snapshots, StatusSnapshot{Time: now, Status: status})
+		if len(ih.Snapshots) > h.maxSnapshots {
+			ih.Snapshots = ih.Snapshots[len(ih.Snapshots)-h.maxSnapshots:]
+		}
+	}
+
+	save := now.Sub(h.lastSave) >= saveInterval
+	if save {
+		h.lastSave = now
+	}
+
+	h.lock.Unlock()
+
+	if save {
+		err := h.save()
+		if err != nil {
+			netLog.Error("error saving status history", "error", err)
+		}
+	}
+}
+
+// transition records the manager moving between interfaces
+func (h *StatusHistory) transition(t Transition) {
+	if h == nil {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	from := h.iface(t.From)
+	from.LastFailure = t.Reason
+	from.LastFailureTime = t.Time
+	// the interface is no longer active, so stop counting connected time
+	from.connected = false
+
+	h.data.Transitions = append(h.data.Transitions, t)
+	if len(h.data.Transitions) > maxTransitions {
+		h.data.Transitions = h.data.Transitions[len(h.data.Transitions)-maxTransitions:]
+	}
+}
+
+func (h *StatusHistory) save() error {
+	if h.file == "" {
+		return nil
+	}
+
+	h.lock.Lock()
+	d, err := json.Marshal(h.data)
+	h.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := h.file + ".tmp"
+	err = ioutil.WriteFile(tmp, d, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, h.file)
+}
+
+// Interface returns the history for an interface (by description)
+func (h *StatusHistory) Interface(desc string) IfaceHistory {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	ih, ok := h.data.Interfaces[desc]
+	if !ok {
+		return IfaceHistory{}
+	}
+
+	ret := *ih
+	ret.Snapshots = append([]StatusSnapshot{}, ih.Snapshots...)
+	return ret
+}
+
+// ServeHTTP returns the history as JSON. The iface query parameter returns
+// the history of a single interface.
+func (h *StatusHistory) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	en := json.NewEncoder(res)
+
+	if iface := req.URL.Query().Get("iface"); iface != "" {
+		en.Encode(h.Interface(iface))
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	en.Encode(h.data)
+}
+
+// SetStatusHistory enables status history for the managed interfaces
+func (m *Manager) SetStatusHistory(history *StatusHistory) {
+	m.statusHistory = history
+}
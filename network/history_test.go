@@ -0,0 +1,153 @@
+package network
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStatusHistory(t *testing.T) {
+	h, err := NewStatusHistory("", 0, 3)
+	if err != nil {
+		t.Fatal("Error creating history: ", err)
+	}
+
+	for _, c := range []bool{true, true, false, true, false} {
+		h.record("cell", InterfaceStatus{Connected: c})
+	}
+
+	ih := h.Interface("cell")
+	if ih.Connects != 2 || ih.Disconnects != 2 {
+		t.Errorf("expected 2 connects and disconnects, got %v and %v",
+			ih.Connects, ih.Disconnects)
+	}
+
+	// only the last maxSnapshots are kept
+	if len(ih.Snapshots) != 3 || !ih.Snapshots[1].Status.Connected ||
+		ih.Snapshots[2].Status.Connected {
+		t.Errorf("unexpected snapshots: %+v", ih.Snapshots)
+	}
+
+	h.record("cell", InterfaceStatus{Connected: true})
+	h.transition(Transition{Time: time.Now(), From: "cell", To: "wifi",
+		Reason: "connect timeout"})
+
+	// not counted while another interface is active
+	h.lock.Lock()
+	h.data.Interfaces["cell"].lastSeen = time.Now().Add(-time.Hour)
+	h.lock.Unlock()
+	h.record("cell", InterfaceStatus{})
+
+	ih = h.Interface("cell")
+	if ih.ConnectedTime >= time.Hour {
+		t.Errorf("connected time counted after transition: %v", ih.ConnectedTime)
+	}
+
+	if ih.LastFailure != "connect timeout" {
+		t.Errorf("expected last failure, got %q", ih.LastFailure)
+	}
+
+	if ih.Disconnects != 2 {
+		t.Errorf("transition counted as a disconnect")
+	}
+
+	if ih := h.Interface("eth"); ih.Connects != 0 || ih.Snapshots != nil {
+		t.Errorf("expected empty history, got %+v", ih)
+	}
+
+	// nil history is not kept
+	var nilHistory *StatusHistory
+	nilHistory.record("cell", InterfaceStatus{})
+	nilHistory.transition(Transition{})
+}
+
+func TestStatusHistoryInterval(t *testing.T) {
+	h, _ := NewStatusHistory("", time.Hour, 10)
+	h.record("cell", InterfaceStatus{Connected: true})
+	h.record("cell", InterfaceStatus{})
+
+	ih := h.Interface("cell")
+	if len(ih.Snapshots) != 1 {
+		t.Errorf("expected 1 snapshot, got %v", len(ih.Snapshots))
+	}
+
+	// counters are updated on every record
+	if ih.Disconnects != 1 {
+		t.Errorf("expected 1 disconnect, got %v", ih.Disconnects)
+	}
+}
+
+func TestStatusHistoryPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "history.json")
+	h, err := NewStatusHistory(file, 0, 10)
+	if err != nil {
+		t.Fatal("Error creating history: ", err)
+	}
+
+	h.transition(Transition{From: "cell", To: "wifi", Reason: "watchdog"})
+	h.record("wifi", InterfaceStatus{Connected: true})
+
+	h, err = NewStatusHistory(file, 0, 10)
+	if err != nil {
+		t.Fatal("Error loading history: ", err)
+	}
+
+	if ih := h.Interface("wifi"); ih.Connects != 1 || len(ih.Snapshots) != 1 {
+		t.Errorf("history not loaded: %+v", ih)
+	}
+
+	if len(h.data.Transitions) != 1 || h.data.Transitions[0].Reason != "watchdog" {
+		t.Errorf("transitions not loaded: %+v", h.data.Transitions)
+	}
+
+	ioutil.WriteFile(file, []byte("{"), 0644)
+	if _, err := NewStatusHistory(file, 0, 10); err == nil {
+		t.Error("expected error for a corrupt file")
+	}
+}
+
+func TestStatusHistoryHTTP(t *testing.T) {
+	h, _ := NewStatusHistory("", 0, 10)
+	h.record("cell", InterfaceStatus{Connected: true})
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/history?iface=cell", nil))
+
+	var ih IfaceHistory
+	if err := json.NewDecoder(rr.Body).Decode(&ih); err != nil {
+		t.Fatal("Error decoding history: ", err)
+	}
+
+	if ih.Connects != 1 {
+		t.Errorf("expected 1 connect, got %v", ih.Connects)
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/history", nil))
+
+	var d historyData
+	if err := json.NewDecoder(rr.Body).Decode(&d); err != nil {
+		t.Fatal("Error decoding history: ", err)
+	}
+
+	if d.Interfaces["cell"] == nil {
+		t.Errorf("interface missing from history: %+v", d)
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/history", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected %v, got %v", http.StatusMethodNotAllowed, rr.Code)
+	}
+}
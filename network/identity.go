@@ -0,0 +1,129 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ModemIdentity identifies the modem hardware and firmware
+type ModemIdentity struct {
+	Imei         string
+	Manufacturer string
+	Model        string
+	Firmware     string
+}
+
+// Tags returns the identity as device tags, so units can be found by
+// modem model or firmware version
+func (mi ModemIdentity) Tags() map[string]string {
+	ret := make(map[string]string)
+	for k, v := range map[string]string{
+		"imei":              mi.Imei,
+		"modemManufacturer": mi.Manufacturer,
+		"modemModel":        mi.Model,
+		"modemFirmware":     mi.Firmware,
+	} {
+		if v != "" {
+			ret[k] = v
+		}
+	}
+
+	return ret
+}
+
+// cmdInfo runs a command that returns a single line of information, like
+// AT+CGMI, and returns the line with prefix removed
+func cmdInfo(port io.ReadWriter, cmd string, prefixes ...string) (string, error) {
+	resp, err := Cmd(port, cmd)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(resp, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line == "OK" || line == cmd {
+			continue
+		}
+
+		if strings.Contains(line, "ERROR") {
+			break
+		}
+
+		for _, p := range prefixes {
+			line = strings.TrimSpace(strings.TrimPrefix(line, p))
+		}
+
+		return line, nil
+	}
+
+	return "", fmt.Errorf("Error parsing %v response: %v", cmd, resp)
+}
+
+// CmdGetManufacturer returns the modem manufacturer
+func CmdGetManufacturer(port io.ReadWriter) (string, error) {
+	return cmdInfo(port, "AT+CGMI", "+CGMI:")
+}
+
+// CmdGetModel returns the modem model
+func CmdGetModel(port io.ReadWriter) (string, error) {
+	return cmdInfo(port, "AT+CGMM", "+CGMM:")
+}
+
+// CmdGetFwVersion returns the modem firmware revision
+func CmdGetFwVersion(port io.ReadWriter) (string, error) {
+	return cmdInfo(port, "AT+CGMR", "+CGMR:", "Revision:")
+}
+
+// readIdentity reads the modem identity. Must be called with m.lock held
+// and the AT command port open.
+func (m *Modem) readIdentity() (ModemIdentity, error) {
+	var ret ModemIdentity
+	var err error
+
+	ret.Imei, err = CmdGetImei(m.atCmdPort)
+	if err != nil {
+		return ret, err
+	}
+
+	ret.Manufacturer, err = CmdGetManufacturer(m.atCmdPort)
+	if err != nil {
+		return ret, err
+	}
+
+	ret.Model, err = CmdGetModel(m.atCmdPort)
+	if err != nil {
+		return ret, err
+	}
+
+	ret.Firmware, err = CmdGetFwVersion(m.atCmdPort)
+	return ret, err
+}
+
+// identity returns the modem identity. It is read once after the modem is
+// reset since it only changes with a firmware update.
+func (m *Modem) identity() (ModemIdentity, error) {
+	if m.ident.Firmware != "" {
+		return m.ident, nil
+	}
+
+	ident, err := m.readIdentity()
+	if err != nil {
+		return ident, err
+	}
+
+	m.ident = ident
+	return ident, nil
+}
+
+// Identity returns the modem IMEI, model, and firmware version
+func (m *Modem) Identity() (ModemIdentity, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.openCmdPort(); err != nil {
+		return ModemIdentity{}, err
+	}
+
+	return m.identity()
+}
@@ -0,0 +1,94 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCmdInfo(t *testing.T) {
+	cases := []struct {
+		cmd  string
+		resp string
+		exp  string
+		err  bool
+	}{
+		{"AT+CGMI", "Quectel\r\n\r\nOK\r\n", "Quectel", false},
+		{"AT+CGMI", "AT+CGMI\r\nSIMCOM INCORPORATED\r\n\r\nOK\r\n", "SIMCOM INCORPORATED", false},
+		{"AT+CGMM", "+CGMM: SIMCOM_SIM7600G-H\r\n\r\nOK\r\n", "SIMCOM_SIM7600G-H", false},
+		{"AT+CGMR", "Revision: EC25EFAR06A06M4G\r\n\r\nOK\r\n", "EC25EFAR06A06M4G", false},
+		{"AT+CGMR", "+CGMR: LE20B04SIM7600G22\r\n\r\nOK\r\n", "LE20B04SIM7600G22", false},
+		{"AT+CGMR", "+CME ERROR: 3\r\n", "", true},
+		{"AT+CGMR", "OK\r\n", "", true},
+	}
+
+	for _, c := range cases {
+		port := &fakePort{resp: map[string]string{c.cmd: c.resp}}
+
+		var got string
+		var err error
+		switch c.cmd {
+		case "AT+CGMI":
+			got, err = CmdGetManufacturer(port)
+		case "AT+CGMM":
+			got, err = CmdGetModel(port)
+		case "AT+CGMR":
+			got, err = CmdGetFwVersion(port)
+		}
+
+		if (err != nil) != c.err {
+			t.Errorf("%q: unexpected error: %v", c.resp, err)
+			continue
+		}
+
+		if got != c.exp {
+			t.Errorf("%q: expected %q, got %q", c.resp, c.exp, got)
+		}
+	}
+}
+
+func TestModemIdentity(t *testing.T) {
+	port := &fakePort{resp: map[string]string{
+		"AT+CGSN": "866834040123456\r\n\r\nOK\r\n",
+		"AT+CGMI": "Quectel\r\n\r\nOK\r\n",
+		"AT+CGMM": "EC25\r\n\r\nOK\r\n",
+		"AT+CGMR": "Revision: EC25EFAR06A06M4G\r\n\r\nOK\r\n",
+	}}
+
+	m := NewModem(ModemConfig{Type: ModemEC25})
+	m.atCmdPort = port
+
+	ident, err := m.Identity()
+	if err != nil {
+		t.Fatal("Error reading identity: ", err)
+	}
+
+	exp := ModemIdentity{Imei: "866834040123456", Manufacturer: "Quectel",
+		Model: "EC25", Firmware: "EC25EFAR06A06M4G"}
+	if ident != exp {
+		t.Errorf("expected %+v, got %+v", exp, ident)
+	}
+
+	expTags := map[string]string{"imei": "866834040123456",
+		"modemManufacturer": "Quectel", "modemModel": "EC25",
+		"modemFirmware": "EC25EFAR06A06M4G"}
+	if tags := ident.Tags(); !reflect.DeepEqual(tags, expTags) {
+		t.Errorf("expected tags %v, got %v", expTags, tags)
+	}
+
+	// the identity is cached until the modem is reset
+	port.cmds = nil
+	if _, err := m.Identity(); err != nil {
+		t.Fatal("Error reading identity: ", err)
+	}
+
+	if len(port.cmds) != 0 {
+		t.Errorf("identity read again: %v", port.cmds)
+	}
+}
+
+func TestModemIdentityTags(t *testing.T) {
+	tags := ModemIdentity{Imei: "866834040123456"}.Tags()
+	if len(tags) != 1 || tags["imei"] != "866834040123456" {
+		t.Errorf("empty fields not omitted: %v", tags)
+	}
+}
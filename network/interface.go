@@ -1,14 +1,172 @@
 package network
 
-// InterfaceStatus defines the status of an interface
+import (
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// define access technologies
+const (
+	AccessTech2G    = "2G"
+	AccessTech3G    = "3G"
+	AccessTechLTE   = "LTE"
+	AccessTechLTEM  = "LTE-M"
+	AccessTechNBIoT = "NB-IoT"
+)
+
+// InterfaceStatus defines the status of an interface. The signal fields
+// are only set for cellular interfaces, and are 0 if not known.
 type InterfaceStatus struct {
-	Detected  bool
+	Detected bool
+	// Carrier is true if a wired interface has link
+	Carrier   bool
 	Connected bool
-	Operator  string
-	Signal    int
-	Rsrp      int
-	Rsrq      int
-	IP        string
+	// Captive is true if the interface is connected, but HTTP requests
+	// are intercepted by a captive portal. Connected is false in this
+	// case since the server can't be reached.
+	Captive  bool
+	Operator string
+	// SSID is the network a WiFi interface is connected to
+	SSID string
+	// AccessTech is one of the AccessTech* constants
+	AccessTech string
+	// Band (LTE BAND 4) and CellID (tracking area code-cell ID) describe
+	// the cell a cellular interface is on
+	Band   string
+	CellID string
+	// Signal is the RSSI in dBm
+	Signal int
+	// Rsrp (dBm), Rsrq (dB), and Sinr (dB) are LTE signal quality values
+	Rsrp int
+	Rsrq int
+	Sinr int
+	IP   string
+	// MAC, Speed (Mb/s), and Duplex (full or half) are set for wired and
+	// WiFi interfaces if the driver reports them
+	MAC    string
+	Speed  int
+	Duplex string
+	// Usage is only set if a UsageTracker is configured for the interface
+	Usage UsageTotals
+	// Latency is only set if a LatencyMonitor is configured for the
+	// interface
+	Latency LinkStats
+	// LastHandshake is the last handshake with the peer of a VPN tunnel
+	LastHandshake time.Time
+	// Roaming is true if a cellular interface is registered on a roaming
+	// network
+	Roaming bool
+	// Sim and Modem are only set for cellular interfaces
+	Sim   SimStatus
+	Modem ModemIdentity
+	// ProfileError is set if the APN/SIM profile could not be applied
+	ProfileError string
+}
+
+// Samples returns the interface status as samples so they can be sent to
+// the portal. id is used for the sample ID, and the operator and access
+// technology are added as tags.
+func (s InterfaceStatus) Samples(id string) []data.Sample {
+	now := time.Now()
+	connected := 0.0
+	if s.Connected {
+		connected = 1
+	}
+
+	ret := []data.Sample{{Type: "netConnected", ID: id, Value: connected, Time: now}}
+
+	if s.Speed > 0 {
+		ret = append(ret, data.Sample{Type: "linkSpeed", ID: id,
+			Value: float64(s.Speed), Time: now})
+	}
+
+	if s.Duplex != "" {
+		fullDuplex := 0.0
+		if s.Duplex == "full" {
+			fullDuplex = 1
+		}
+
+		ret = append(ret, data.Sample{Type: "fullDuplex", ID: id,
+			Value: fullDuplex, Time: now})
+	}
+
+	if s.Roaming {
+		ret = append(ret, data.Sample{Type: "roaming", ID: id, Value: 1, Time: now})
+	}
+
+	for _, v := range []struct {
+		typ   string
+		value int
+	}{
+		{"rssi", s.Signal},
+		{"rsrp", s.Rsrp},
+		{"rsrq", s.Rsrq},
+		{"sinr", s.Sinr},
+	} {
+		if v.value == 0 {
+			continue
+		}
+
+		ret = append(ret, data.Sample{
+			Type:  v.typ,
+			ID:    id,
+			Value: float64(v.value),
+			Time:  now,
+		})
+	}
+
+	if s.Usage.Month != "" {
+		for _, v := range []struct {
+			typ   string
+			value uint64
+		}{
+			{"rxBytesDaily", s.Usage.Daily.Rx},
+			{"txBytesDaily", s.Usage.Daily.Tx},
+			{"rxBytesMonthly", s.Usage.Monthly.Rx},
+			{"txBytesMonthly", s.Usage.Monthly.Tx},
+		} {
+			ret = append(ret, data.Sample{
+				Type:  v.typ,
+				ID:    id,
+				Value: float64(v.value),
+				Time:  now,
+			})
+		}
+	}
+
+	if s.Latency.Probes > 0 {
+		for _, v := range []struct {
+			typ   string
+			value float64
+		}{
+			{"rttAvg", s.Latency.RttAvg.Seconds() * 1000},
+			{"rttMax", s.Latency.RttMax.Seconds() * 1000},
+			{"packetLoss", s.Latency.Loss * 100},
+		} {
+			ret = append(ret, data.Sample{
+				Type:  v.typ,
+				ID:    id,
+				Value: v.value,
+				Time:  now,
+			})
+		}
+	}
+
+	if s.Operator != "" || s.AccessTech != "" {
+		for i := range ret {
+			ret[i].Tags = map[string]string{
+				"operator":   s.Operator,
+				"accessTech": s.AccessTech,
+			}
+		}
+	} else if s.SSID != "" {
+		for i := range ret {
+			ret[i].Tags = map[string]string{"ssid": s.SSID}
+		}
+	}
+
+	return ret
 }
 
 // Interface is an interface that network drivers implement
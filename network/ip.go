@@ -3,6 +3,7 @@ package network
 import (
 	"errors"
 	"net"
+	"strconv"
 )
 
 // GetIP returns the IP address for the itnerface
@@ -28,3 +29,22 @@ func GetIP(ifaceName string) (string, error) {
 
 	return "", errors.New("No IP address")
 }
+
+// netClassDir lists the kernel network interfaces
+var netClassDir = "/sys/class/net"
+
+// linkInfo fills in the MAC address, speed, and duplex of a network
+// interface from sysfs. Values the driver does not report are left blank.
+func linkInfo(iface string, status *InterfaceStatus) {
+	dir := netClassDir + "/" + iface + "/"
+	status.MAC = readSysfs(dir + "address")
+
+	// speed is -1 and duplex unknown when there is no link
+	if speed, err := strconv.Atoi(readSysfs(dir + "speed")); err == nil && speed > 0 {
+		status.Speed = speed
+	}
+
+	if duplex := readSysfs(dir + "duplex"); duplex == "full" || duplex == "half" {
+		status.Duplex = duplex
+	}
+}
@@ -0,0 +1,61 @@
+package network
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLinkInfo(t *testing.T) {
+	root, err := ioutil.TempDir("", "siot-net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	defer func(dir string) { netClassDir = dir }(netClassDir)
+	netClassDir = root
+
+	cases := []struct {
+		iface  string
+		files  map[string]string
+		status InterfaceStatus
+	}{
+		{"eth0", map[string]string{"address": "b8:27:eb:12:34:56\n",
+			"speed": "100\n", "duplex": "full\n"},
+			InterfaceStatus{MAC: "b8:27:eb:12:34:56", Speed: 100, Duplex: "full"}},
+		// no link
+		{"eth1", map[string]string{"address": "b8:27:eb:12:34:57\n",
+			"speed": "-1\n", "duplex": "unknown\n"},
+			InterfaceStatus{MAC: "b8:27:eb:12:34:57"}},
+		// not reported by the driver
+		{"wwan0", map[string]string{}, InterfaceStatus{}},
+	}
+
+	for _, c := range cases {
+		dir := filepath.Join(root, c.iface)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		for f, v := range c.files {
+			if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(v), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var status InterfaceStatus
+		linkInfo(c.iface, &status)
+		if status.MAC != c.status.MAC || status.Speed != c.status.Speed ||
+			status.Duplex != c.status.Duplex {
+			t.Errorf("%v: expected %+v, got %+v", c.iface, c.status, status)
+		}
+	}
+}
+
+func TestGetIP(t *testing.T) {
+	if _, err := GetIP("siot-none0"); err == nil {
+		t.Error("expected error for missing interface")
+	}
+}
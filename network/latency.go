@@ -0,0 +1,166 @@
+package network
+
+import (
+	"os/exec"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LinkStats are rolling round trip time and packet loss statistics
+type LinkStats struct {
+	// Probes is the number of probes the stats are computed from
+	Probes int
+	// RttAvg, RttMin, and RttMax are for the probes that got a reply
+	RttAvg time.Duration
+	RttMin time.Duration
+	RttMax time.Duration
+	// Loss is the fraction (0-1) of probes that did not get a reply
+	Loss float64
+}
+
+// LatencyMonitor periodically pings a target through an interface and
+// keeps rolling statistics over the last window probes, so degraded links
+// can be detected before they fail completely.
+type LatencyMonitor struct {
+	iface    string
+	target   string
+	interval time.Duration
+	window   int
+	lock     sync.Mutex
+	// rtts is a ring buffer, a 0 entry is a lost probe
+	rtts []time.Duration
+	next int
+	stop chan struct{}
+}
+
+// NewLatencyMonitor creates a monitor that pings target through iface
+// every interval, with stats over the last window probes
+func NewLatencyMonitor(iface, target string, interval time.Duration,
+	window int) *LatencyMonitor {
+	return &LatencyMonitor{
+		iface:    iface,
+		target:   target,
+		interval: interval,
+		window:   window,
+		stop:     make(chan struct{}),
+	}
+}
+
+// 64 bytes from 8.8.8.8: icmp_seq=1 ttl=117 time=23.4 ms
+var rePingTime = regexp.MustCompile(`time=([\d.]+) ms`)
+
+// Probe sends one ping and records the result
+func (l *LatencyMonitor) Probe() {
+	var rtt time.Duration
+
+	out, err := exec.Command("ping", "-c", "1", "-W", "5", "-I", l.iface,
+		l.target).Output()
+	if err == nil {
+		rtt = pingRtt(string(out))
+	}
+
+	l.add(rtt)
+}
+
+// pingRtt returns the round trip time in ping output, or 0 if there was
+// no reply
+func pingRtt(out string) time.Duration {
+	matches := rePingTime.FindStringSubmatch(out)
+	if len(matches) < 2 {
+		return 0
+	}
+
+	ms, _ := strconv.ParseFloat(matches[1], 64)
+	rtt := time.Duration(ms * float64(time.Millisecond))
+	if rtt <= 0 {
+		// don't count a very fast reply as lost
+		rtt = 1
+	}
+
+	return rtt
+}
+
+func (l *LatencyMonitor) add(rtt time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(l.rtts) < l.window {
+		l.rtts = append(l.rtts, rtt)
+		return
+	}
+
+	l.rtts[l.next] = rtt
+	l.next = (l.next + 1) % l.window
+}
+
+// Stats returns the rolling statistics
+func (l *LatencyMonitor) Stats() LinkStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	ret := LinkStats{Probes: len(l.rtts)}
+	if ret.Probes <= 0 {
+		return ret
+	}
+
+	var total time.Duration
+	replies := 0
+	for _, rtt := range l.rtts {
+		if rtt == 0 {
+			continue
+		}
+
+		if replies == 0 || rtt < ret.RttMin {
+			ret.RttMin = rtt
+		}
+
+		if rtt > ret.RttMax {
+			ret.RttMax = rtt
+		}
+
+		total += rtt
+		replies++
+	}
+
+	if replies > 0 {
+		ret.RttAvg = total / time.Duration(replies)
+	}
+
+	ret.Loss = float64(ret.Probes-replies) / float64(ret.Probes)
+
+	return ret
+}
+
+// Start probes until Stop is called
+func (l *LatencyMonitor) Start() {
+	go func() {
+		ticker := time.NewTicker(l.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				l.Probe()
+			case <-l.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops probing
+func (l *LatencyMonitor) Stop() {
+	close(l.stop)
+}
+
+// status fills in the link stats in status. l can be nil if latency is
+// not being monitored.
+func (l *LatencyMonitor) status(status *InterfaceStatus) {
+	if l == nil {
+		return
+	}
+
+	status.Latency = l.Stats()
+}
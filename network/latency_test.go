@@ -0,0 +1,63 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPingRtt(t *testing.T) {
+	cases := []struct {
+		out string
+		exp time.Duration
+	}{
+		{"PING 8.8.8.8 (8.8.8.8) from 10.0.0.2 wwan0: 56(84) bytes of data.\n" +
+			"64 bytes from 8.8.8.8: icmp_seq=1 ttl=117 time=23.4 ms\n",
+			23400 * time.Microsecond},
+		// busybox
+		{"64 bytes from 8.8.8.8: seq=0 ttl=117 time=112.052 ms\n",
+			112052 * time.Microsecond},
+		{"64 bytes from 127.0.0.1: icmp_seq=1 ttl=64 time=0.000 ms\n", 1},
+		{"1 packets transmitted, 0 received, 100% packet loss\n", 0},
+	}
+
+	for _, c := range cases {
+		if rtt := pingRtt(c.out); rtt != c.exp {
+			t.Errorf("%q: expected %v, got %v", c.out, c.exp, rtt)
+		}
+	}
+}
+
+func TestLatencyStats(t *testing.T) {
+	l := NewLatencyMonitor("wwan0", "8.8.8.8", time.Minute, 4)
+
+	if s := l.Stats(); s != (LinkStats{}) {
+		t.Errorf("expected no stats, got %+v", s)
+	}
+
+	for _, rtt := range []time.Duration{100, 0, 300, 200} {
+		l.add(rtt * time.Millisecond)
+	}
+
+	exp := LinkStats{Probes: 4, RttAvg: 200 * time.Millisecond,
+		RttMin: 100 * time.Millisecond, RttMax: 300 * time.Millisecond,
+		Loss: 0.25}
+	if s := l.Stats(); s != exp {
+		t.Errorf("expected %+v, got %+v", exp, s)
+	}
+
+	// the oldest probes are replaced
+	l.add(0)
+	l.add(0)
+	exp = LinkStats{Probes: 4, RttAvg: 250 * time.Millisecond,
+		RttMin: 200 * time.Millisecond, RttMax: 300 * time.Millisecond,
+		Loss: 0.5}
+	if s := l.Stats(); s != exp {
+		t.Errorf("expected %+v, got %+v", exp, s)
+	}
+
+	l.add(0)
+	l.add(0)
+	if s := l.Stats(); s.Loss != 1 || s.RttAvg != 0 {
+		t.Errorf("expected all probes lost, got %+v", s)
+	}
+}
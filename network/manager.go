@@ -2,10 +2,17 @@ package network
 
 import (
 	"errors"
-	"log"
+	"fmt"
+	"sync"
 	"time"
+
+	"github.com/simpleiot/simpleiot/bus"
+	"github.com/simpleiot/simpleiot/logging"
 )
 
+// netLog logs network manager, watchdog, and provisioning messages
+var netLog = logging.Module("network")
+
 // State is used to describe the network state
 type State int
 
@@ -25,13 +32,28 @@ func (s State) String() string {
 		return "Connecting"
 	case StateConnected:
 		return "Connected"
+	case StateError:
+		return "Error"
 	default:
 		return "unknown"
 	}
 }
 
+// Transition records a change in the active interface
+type Transition struct {
+	Time   time.Time
+	From   string
+	To     string
+	Reason string
+}
+
+// maxTransitions is the number of transitions kept in the history
+const maxTransitions = 50
+
 // Manager is used to configure the network and manage the
-// lifecycle.
+// lifecycle. If the active interface fails, the manager fails over to the
+// next interface. When a higher priority interface has been connected for
+// the failback delay, the manager fails back to it.
 type Manager struct {
 	state          State
 	stateStart     time.Time
@@ -39,27 +61,166 @@ type Manager struct {
 	errResetCnt    int
 	errCnt         int
 	interfaceIndex int
+	failbackDelay  time.Duration
+	betterSince    time.Time
+	// lock protects the fields that are read by other goroutines
+	lock    sync.Mutex
+	history []Transition
+	// backoff limits connect attempts for each interface, and resetBackoff
+	// limits how often all interfaces (and modems) are reset
+	backoffConfig BackoffConfig
+	backoff       []*Backoff
+	resetBackoff  *Backoff
+	// events are sent on this channel, and published to bus if it is set
+	events          chan InterfaceEvent
+	bus             *bus.Bus
+	signalThreshold int
+	signalDegraded  bool
+	capWarned       []bool
+	// captive portal detection
+	captiveDetect  bool
+	captive        bool
+	captiveChecked time.Time
+	captiveAt      []time.Time
+	// DNS servers for each interface
+	dns         map[Interface][]string
+	dnsFallback []string
+	// route metric management
+	routeMetrics    bool
+	routeMetricBase int
+	defaultRoute    string
+	statusHistory   *StatusHistory
+	// status of the active interface from the last Run
+	status    InterfaceStatus
+	failovers int
+	stop      chan struct{}
+	done      chan struct{}
+	stopOnce  sync.Once
+	// now is time.Now, except in tests
+	now func() time.Time
 }
 
 // NewManager constructor
 func NewManager(errResetCnt int) *Manager {
+	return newManager(errResetCnt, time.Now)
+}
+
+func newManager(errResetCnt int, now func() time.Time) *Manager {
 	return &Manager{
-		stateStart:  time.Now(),
-		errResetCnt: errResetCnt,
+		now:           now,
+		stateStart:    now(),
+		errResetCnt:   errResetCnt,
+		failbackDelay: time.Minute,
+		resetBackoff:  newBackoff(BackoffConfig{}, now),
+		events:        make(chan InterfaceEvent, eventBufferSize),
+		// -105dBm RSSI is a marginal cellular signal
+		signalThreshold: -105,
+	}
+}
+
+// SetCaptiveDetect enables captive portal detection. Interfaces behind a
+// captive portal are treated as not connected so the manager fails over
+// to the next interface.
+func (m *Manager) SetCaptiveDetect(enable bool) {
+	m.captiveDetect = enable
+}
+
+// SetSignalThreshold sets the signal (dBm) below which a signal degraded
+// event is sent
+func (m *Manager) SetSignalThreshold(dBm int) {
+	m.signalThreshold = dBm
+}
+
+// SetBackoff sets the backoff policy for connect retries and interface
+// resets. It should be called before interfaces are added.
+func (m *Manager) SetBackoff(config BackoffConfig) {
+	m.backoffConfig = config
+	m.resetBackoff = newBackoff(config, m.now)
+}
+
+// SetFailbackDelay sets how long a higher priority interface must be
+// connected before the manager switches back to it. This keeps the
+// manager from flapping between interfaces on a marginal link.
+func (m *Manager) SetFailbackDelay(delay time.Duration) {
+	m.failbackDelay = delay
+}
+
+// Active returns the active interface, or nil if there are no interfaces
+func (m *Manager) Active() Interface {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(m.interfaces) <= 0 {
+		return nil
+	}
+
+	return m.interfaces[m.interfaceIndex]
+}
+
+// State returns the current network state
+func (m *Manager) State() State {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.state
+}
+
+// History returns the most recent interface transitions, oldest first
+func (m *Manager) History() []Transition {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]Transition{}, m.history...)
+}
+
+// setInterface makes interface index active
+func (m *Manager) setInterface(index int, reason string) {
+	if index == m.interfaceIndex {
+		return
+	}
+
+	t := Transition{
+		Time:   m.now(),
+		From:   m.interfaces[m.interfaceIndex].Desc(),
+		To:     m.interfaces[index].Desc(),
+		Reason: reason,
 	}
+
+	netLog.Info("interface changed", "from", t.From, "to", t.To, "reason", t.Reason)
+
+	m.lock.Lock()
+	m.interfaceIndex = index
+	m.failovers++
+	m.betterSince = time.Time{}
+	m.signalDegraded = false
+	m.captive = false
+	m.captiveChecked = time.Time{}
+	m.history = append(m.history, t)
+	if len(m.history) > maxTransitions {
+		m.history = m.history[len(m.history)-maxTransitions:]
+	}
+	m.lock.Unlock()
+
+	m.statusHistory.transition(t)
+
+	m.sendEvent(EventFailover, t.To, fmt.Sprintf("%v -> %v (%v)", t.From,
+		t.To, t.Reason), InterfaceStatus{})
 }
 
 // AddInterface adds a network interface to the manager. Interfaces added first
 // have higher priority
 func (m *Manager) AddInterface(iface Interface) {
 	m.interfaces = append(m.interfaces, iface)
+	m.backoff = append(m.backoff, newBackoff(m.backoffConfig, m.now))
+	m.capWarned = append(m.capWarned, false)
+	m.captiveAt = append(m.captiveAt, time.Time{})
 }
 
 func (m *Manager) setState(state State) {
 	if state != m.state {
-		log.Printf("Network state: %v -> %v", m.state, state)
+		netLog.Info("state changed", "from", m.state, "to", state)
+		m.lock.Lock()
 		m.state = state
-		m.stateStart = time.Now()
+		m.lock.Unlock()
+		m.stateStart = m.now()
 	}
 }
 
@@ -68,38 +229,85 @@ func (m *Manager) getStatus() (InterfaceStatus, error) {
 		return InterfaceStatus{}, nil
 	}
 
-	return m.interfaces[m.interfaceIndex].GetStatus()
+	status, err := m.interfaces[m.interfaceIndex].GetStatus()
+	if err != nil {
+		return status, err
+	}
+
+	m.checkCaptive(&status)
+
+	return status, nil
 }
 
 // Desc returns current interface description
 func (m *Manager) Desc() string {
-	if len(m.interfaces) <= 0 {
+	active := m.Active()
+	if active == nil {
 		return "none"
 	}
 
-	return m.interfaces[m.interfaceIndex].Desc()
+	return active.Desc()
 }
 
 // nextInterface returns true if there is another interface to try, otherwise
 // resets to zero and returns false
-func (m *Manager) nextInterface() bool {
-	m.interfaceIndex++
-	if m.interfaceIndex >= len(m.interfaces) {
-		m.interfaceIndex = 0
-		log.Println("Network: no more interfaces to try")
+func (m *Manager) nextInterface(reason string) bool {
+	if m.interfaceIndex+1 >= len(m.interfaces) {
+		m.setInterface(0, reason)
+		netLog.Warn("no more interfaces to try")
 		return false
 	}
 
-	log.Println("Network: trying next interface: ", m.Desc())
+	m.setInterface(m.interfaceIndex+1, reason)
+	netLog.Info("trying next interface", "interface", m.Desc())
 	return true
 }
 
+// checkFailback returns true if the manager switched back to a higher
+// priority interface
+func (m *Manager) checkFailback() bool {
+	for i := 0; i < m.interfaceIndex; i++ {
+		if m.now().Sub(m.captiveAt[i]) < captiveRetry {
+			continue
+		}
+
+		status, err := m.interfaces[i].GetStatus()
+		if err != nil || !status.Connected {
+			continue
+		}
+
+		if m.betterSince.IsZero() {
+			m.betterSince = m.now()
+		}
+
+		if m.now().Sub(m.betterSince) < m.failbackDelay {
+			return false
+		}
+
+		m.setInterface(i, "failback")
+		return true
+	}
+
+	m.betterSince = time.Time{}
+	return false
+}
+
 func (m *Manager) connect() error {
 	if len(m.interfaces) <= 0 {
 		return errors.New("No interfaces to connect to")
 	}
 
-	return m.interfaces[m.interfaceIndex].Connect()
+	backoff := m.backoff[m.interfaceIndex]
+	if !backoff.Ready() {
+		return nil
+	}
+
+	err := m.interfaces[m.interfaceIndex].Connect()
+	if err != nil {
+		backoff.Failed()
+	}
+
+	return err
 }
 
 // Reset resets all network interfaces
@@ -107,7 +315,7 @@ func (m *Manager) Reset() {
 	for _, i := range m.interfaces {
 		err := i.Reset()
 		if err != nil {
-			log.Println("Error resetting interface: ", err)
+			netLog.Error("error resetting interface", "error", err)
 		}
 	}
 }
@@ -123,14 +331,14 @@ func (m *Manager) Run() (State, InterfaceStatus) {
 	for {
 		count++
 		if count > 10 {
-			log.Println("network state machine ran too many times")
+			netLog.Warn("state machine ran too many times")
 			return m.state, status
 		}
 
 		var err error
 		status, err = m.getStatus()
 		if err != nil {
-			log.Println("Error getting interface status: ", err)
+			netLog.Error("error getting interface status", "error", err)
 			continue
 		}
 
@@ -139,12 +347,12 @@ func (m *Manager) Run() (State, InterfaceStatus) {
 			// give ourselves 15 seconds or so in detecting state
 			// in case we just reset the devices
 			if status.Detected {
-				log.Printf("Network: %v detected\n", m.Desc())
+				netLog.Info("interface detected", "interface", m.Desc())
 				m.setState(StateConnecting)
 				continue
-			} else if time.Since(m.stateStart) > time.Second*15 {
-				log.Println("Network: timeout detecting: ", m.Desc())
-				if !m.nextInterface() {
+			} else if m.now().Sub(m.stateStart) > time.Second*15 {
+				netLog.Warn("timeout detecting", "interface", m.Desc())
+				if !m.nextInterface("not detected") {
 					m.setState(StateError)
 					break
 				}
@@ -153,17 +361,20 @@ func (m *Manager) Run() (State, InterfaceStatus) {
 			}
 		case StateConnecting:
 			if status.Connected {
-				log.Printf("Network: %v connected\n", m.Desc())
+				netLog.Info("interface connected", "interface", m.Desc())
+				m.backoff[m.interfaceIndex].Reset()
+				m.applyDNS()
 				m.setState(StateConnected)
+				m.sendEvent(EventConnected, m.Desc(), "", status)
 			} else {
-				if time.Since(m.stateStart) > time.Minute {
-					log.Println("Network: timeout connecting: ", m.Desc())
-					if !m.nextInterface() {
+				if m.now().Sub(m.stateStart) > time.Minute {
+					netLog.Warn("timeout connecting", "interface", m.Desc())
+					if !m.nextInterface("connect timeout") {
 						m.setState(StateError)
 						break
 					}
 
-					m.stateStart = time.Now()
+					m.stateStart = m.now()
 
 					continue
 				}
@@ -171,17 +382,21 @@ func (m *Manager) Run() (State, InterfaceStatus) {
 				// try again to connect
 				err := m.connect()
 				if err != nil {
-					log.Println("Error connecting: ", err)
+					netLog.Error("error connecting", "error", err)
 				}
 			}
 		case StateConnected:
 			if !status.Connected {
+				m.sendEvent(EventDisconnected, m.Desc(), "", status)
 				// try to reconnect
 				m.setState(StateConnecting)
+			} else if m.checkFailback() {
+				m.setState(StateConnecting)
+				continue
 			}
 		case StateError:
-			if time.Since(m.stateStart) > time.Minute {
-				log.Println("Network: trying again ...")
+			if m.now().Sub(m.stateStart) > time.Minute {
+				netLog.Info("trying again")
 				m.setState(StateNotDetected)
 			}
 		}
@@ -190,17 +405,29 @@ func (m *Manager) Run() (State, InterfaceStatus) {
 		break
 	}
 
+	if len(m.interfaces) > 0 {
+		m.checkEvents(status)
+		m.updateRoutes()
+		m.statusHistory.record(m.Desc(), status)
+
+		m.lock.Lock()
+		m.status = status
+		m.lock.Unlock()
+	}
+
 	return m.state, status
 }
 
 // Error is called any time there is a network error
 // after errResetCnt errors are reached, we reset all the interfaces and
-// start over
+// start over. Resets back off so modems are not power cycled continuously
+// during an outage.
 func (m *Manager) Error() {
 	m.errCnt++
 
-	if m.errCnt >= m.errResetCnt {
+	if m.errCnt >= m.errResetCnt && m.resetBackoff.Ready() {
 		m.Reset()
+		m.resetBackoff.Failed()
 		m.setState(StateNotDetected)
 		m.errCnt = 0
 	}
@@ -210,4 +437,76 @@ func (m *Manager) Error() {
 // so that we know to reset the internal error count
 func (m *Manager) Success() {
 	m.errCnt = 0
+	m.resetBackoff.Reset()
+}
+
+// Start calls Run every interval until Stop is called, so the manager owns
+// the interfaces instead of an external script. Each time every interface
+// has failed and the manager enters StateError counts as an Error, so all
+// interfaces are reset after errResetCnt of these failures in a row.
+// Connecting counts as a Success. Run should not be called while the
+// manager is started.
+func (m *Manager) Start(interval time.Duration) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	m.lock.Lock()
+	m.stop = stop
+	m.done = done
+	m.lock.Unlock()
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last := m.State()
+
+		for {
+			last = m.runOnce(last)
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// runOnce calls Run, and calls Success or Error if the state changed from
+// last to StateConnected or StateError. The state stays the same while the
+// manager waits to retry, so only changes are counted. It returns the
+// state to pass as last next time.
+func (m *Manager) runOnce(last State) State {
+	state, _ := m.Run()
+	if state != last {
+		switch state {
+		case StateConnected:
+			m.Success()
+		case StateError:
+			m.Error()
+		}
+	}
+
+	return m.State()
+}
+
+// Stop stops the manager started with Start, and waits for Run to
+// return. It does nothing if the manager was not started or is already
+// stopped.
+func (m *Manager) Stop() {
+	m.lock.Lock()
+	stop, done := m.stop, m.done
+	m.lock.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	m.stopOnce.Do(func() {
+		close(stop)
+	})
+
+	<-done
 }
@@ -0,0 +1,540 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/simpleiot/simpleiot/logging"
+)
+
+var mdnsLog = logging.Module("mdns")
+
+// MdnsService is the service type the SIOT server is advertised as
+const MdnsService = "_simpleiot._tcp.local."
+
+const (
+	mdnsAddr = "224.0.0.251:5353"
+	mdnsPort = 5353
+	mdnsTTL  = 120
+	// legacy unicast responses must use a short TTL
+	mdnsLegacyTTL = 10
+)
+
+// dns record types and classes
+const (
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+
+	dnsClassIN = 1
+	// dnsCacheFlush is set in the class of records only one host answers
+	// for, and the unicast response bit in the class of questions
+	dnsCacheFlush = 0x8000
+)
+
+type dnsQuestion struct {
+	name  string
+	qtype uint16
+}
+
+// dnsRecord is a resource record. Only the fields for rtype are used.
+type dnsRecord struct {
+	name   string
+	rtype  uint16
+	flush  bool
+	ttl    uint32
+	target string
+	port   uint16
+	ip     net.IP
+	txt    []string
+}
+
+type dnsMessage struct {
+	id        uint16
+	response  bool
+	questions []dnsQuestion
+	records   []dnsRecord
+}
+
+var errDNSShort = errors.New("dns message too short")
+
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// readName reads a possibly compressed name at off and returns the offset
+// after it
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+
+	// limit pointer loops
+	for jumps := 0; jumps < 64; {
+		if off >= len(msg) {
+			return "", 0, errDNSShort
+		}
+
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errDNSShort
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errDNSShort
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+
+	return "", 0, errors.New("dns name pointer loop")
+}
+
+func (r dnsRecord) rdata() []byte {
+	switch r.rtype {
+	case dnsTypeA:
+		return r.ip.To4()
+	case dnsTypePTR:
+		return appendName(nil, r.target)
+	case dnsTypeSRV:
+		b := make([]byte, 6)
+		binary.BigEndian.PutUint16(b[4:], r.port)
+		return appendName(b, r.target)
+	case dnsTypeTXT:
+		var b []byte
+		for _, t := range r.txt {
+			b = append(b, byte(len(t)))
+			b = append(b, t...)
+		}
+		if len(b) == 0 {
+			// a TXT record must contain at least one string
+			b = []byte{0}
+		}
+		return b
+	}
+	return nil
+}
+
+func (m dnsMessage) encode() []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b, m.id)
+	if m.response {
+		// QR and AA
+		binary.BigEndian.PutUint16(b[2:], 0x8400)
+	}
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.records)))
+
+	for _, q := range m.questions {
+		b = appendName(b, q.name)
+		b = append(b, 0, 0, 0, 0)
+		binary.BigEndian.PutUint16(b[len(b)-4:], q.qtype)
+		binary.BigEndian.PutUint16(b[len(b)-2:], dnsClassIN)
+	}
+
+	for _, r := range m.records {
+		class := uint16(dnsClassIN)
+		if r.flush {
+			class |= dnsCacheFlush
+		}
+
+		rdata := r.rdata()
+		b = appendName(b, r.name)
+		hdr := make([]byte, 10)
+		binary.BigEndian.PutUint16(hdr, r.rtype)
+		binary.BigEndian.PutUint16(hdr[2:], class)
+		binary.BigEndian.PutUint32(hdr[4:], r.ttl)
+		binary.BigEndian.PutUint16(hdr[8:], uint16(len(rdata)))
+		b = append(b, hdr...)
+		b = append(b, rdata...)
+	}
+
+	return b
+}
+
+func parseDNSMessage(msg []byte) (dnsMessage, error) {
+	var ret dnsMessage
+
+	if len(msg) < 12 {
+		return ret, errDNSShort
+	}
+
+	ret.id = binary.BigEndian.Uint16(msg)
+	ret.response = msg[2]&0x80 != 0
+	qdCount := int(binary.BigEndian.Uint16(msg[4:]))
+	// answer, authority, and additional records are treated the same
+	rrCount := int(binary.BigEndian.Uint16(msg[6:])) +
+		int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+	for i := 0; i < qdCount; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil {
+			return ret, err
+		}
+		if next+4 > len(msg) {
+			return ret, errDNSShort
+		}
+		ret.questions = append(ret.questions, dnsQuestion{name: name,
+			qtype: binary.BigEndian.Uint16(msg[next:])})
+		off = next + 4
+	}
+
+	for i := 0; i < rrCount; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil {
+			return ret, err
+		}
+		if next+10 > len(msg) {
+			return ret, errDNSShort
+		}
+
+		r := dnsRecord{
+			name:  name,
+			rtype: binary.BigEndian.Uint16(msg[next:]),
+			flush: binary.BigEndian.Uint16(msg[next+2:])&dnsCacheFlush != 0,
+			ttl:   binary.BigEndian.Uint32(msg[next+4:]),
+		}
+
+		start := next + 10
+		end := start + int(binary.BigEndian.Uint16(msg[next+8:]))
+		if end > len(msg) {
+			return ret, errDNSShort
+		}
+
+		switch r.rtype {
+		case dnsTypeA:
+			if end-start == 4 {
+				r.ip = net.IP(append([]byte(nil), msg[start:end]...))
+			}
+		case dnsTypePTR:
+			r.target, _, err = readName(msg, start)
+		case dnsTypeSRV:
+			if end-start < 7 {
+				return ret, errDNSShort
+			}
+			r.port = binary.BigEndian.Uint16(msg[start+4:])
+			r.target, _, err = readName(msg, start+6)
+		case dnsTypeTXT:
+			for p := start; p < end; {
+				l := int(msg[p])
+				if p+1+l > end {
+					return ret, errDNSShort
+				}
+				if l > 0 {
+					r.txt = append(r.txt, string(msg[p+1:p+1+l]))
+				}
+				p += 1 + l
+			}
+		}
+
+		if err != nil {
+			return ret, err
+		}
+
+		ret.records = append(ret.records, r)
+		off = end
+	}
+
+	return ret, nil
+}
+
+// MdnsAdvertiser advertises the SIOT server on the local network with mDNS
+// so devices can find it without a hard coded address
+type MdnsAdvertiser struct {
+	instance string
+	host     string
+	port     int
+	txt      []string
+	conn     *net.UDPConn
+}
+
+// NewMdnsAdvertiser creates an advertiser for a server listening on port.
+// instance is the name shown to users and defaults to the host name. txt
+// are optional key=value strings.
+func NewMdnsAdvertiser(instance string, port int, txt []string) *MdnsAdvertiser {
+	host, _ := os.Hostname()
+	host = strings.Split(host, ".")[0]
+	if host == "" {
+		host = "siot"
+	}
+
+	if instance == "" {
+		instance = host
+	}
+
+	return &MdnsAdvertiser{
+		// dots separate labels, so can't be used in the instance name
+		instance: strings.Replace(instance, ".", "-", -1),
+		host:     host + ".local.",
+		port:     port,
+		txt:      txt,
+	}
+}
+
+func (a *MdnsAdvertiser) instanceName() string {
+	return a.instance + "." + MdnsService
+}
+
+func (a *MdnsAdvertiser) records(ttl uint32) []dnsRecord {
+	ret := []dnsRecord{
+		{name: MdnsService, rtype: dnsTypePTR, ttl: ttl,
+			target: a.instanceName()},
+		{name: a.instanceName(), rtype: dnsTypeSRV, flush: true, ttl: ttl,
+			target: a.host, port: uint16(a.port)},
+		{name: a.instanceName(), rtype: dnsTypeTXT, flush: true, ttl: ttl,
+			txt: a.txt},
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		mdnsLog.Error("error getting addresses", "error", err)
+		return ret
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.To4() == nil {
+			continue
+		}
+
+		ret = append(ret, dnsRecord{name: a.host, rtype: dnsTypeA,
+			flush: true, ttl: ttl, ip: ipNet.IP.To4()})
+	}
+
+	return ret
+}
+
+// answers returns true if a question is for one of our records
+func (a *MdnsAdvertiser) answers(q dnsQuestion) bool {
+	match := func(name string, qtype uint16) bool {
+		return strings.EqualFold(q.name, name) &&
+			(q.qtype == qtype || q.qtype == dnsTypeANY)
+	}
+
+	return match(MdnsService, dnsTypePTR) ||
+		match(a.instanceName(), dnsTypeSRV) ||
+		match(a.instanceName(), dnsTypeTXT) ||
+		match(a.host, dnsTypeA)
+}
+
+// Start starts responding to queries until Stop is called
+func (a *MdnsAdvertiser) Start() error {
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return err
+	}
+
+	a.conn = conn
+
+	// announce so browsers that are already running see us
+	resp := dnsMessage{response: true, records: a.records(mdnsTTL)}
+	_, err = conn.WriteToUDP(resp.encode(), group)
+	if err != nil {
+		mdnsLog.Error("error announcing", "error", err)
+	}
+
+	go func() {
+		buf := make([]byte, 9000)
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				// closed by Stop
+				return
+			}
+
+			msg, err := parseDNSMessage(buf[:n])
+			if err != nil || msg.response {
+				continue
+			}
+
+			answer := false
+			for _, q := range msg.questions {
+				if a.answers(q) {
+					answer = true
+				}
+			}
+
+			if !answer {
+				continue
+			}
+
+			if src.Port != mdnsPort {
+				// legacy unicast query from a simple resolver
+				resp := dnsMessage{id: msg.id, response: true,
+					questions: msg.questions,
+					records:   a.records(mdnsLegacyTTL)}
+				_, err = conn.WriteToUDP(resp.encode(), src)
+			} else {
+				resp := dnsMessage{response: true, records: a.records(mdnsTTL)}
+				_, err = conn.WriteToUDP(resp.encode(), group)
+			}
+
+			if err != nil {
+				mdnsLog.Error("error responding", "error", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops responding to queries and tells browsers we are gone
+func (a *MdnsAdvertiser) Stop() {
+	if a.conn == nil {
+		return
+	}
+
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err == nil {
+		// a 0 TTL tells caches to remove the records
+		resp := dnsMessage{response: true, records: a.records(0)}
+		a.conn.WriteToUDP(resp.encode(), group)
+	}
+
+	a.conn.Close()
+}
+
+// MdnsEntry is a SIOT server found on the local network
+type MdnsEntry struct {
+	Instance string
+	Host     string
+	Port     int
+	IPs      []net.IP
+	Txt      []string
+}
+
+// URL returns the URL of the server, or blank if its address is not known
+func (e MdnsEntry) URL() string {
+	if len(e.IPs) <= 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("http://%v:%v", e.IPs[0], e.Port)
+}
+
+// DiscoverMdns looks for SIOT servers on the local network, waiting
+// timeout for responses
+func DiscoverMdns(timeout time.Duration) ([]MdnsEntry, error) {
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// queries from a port other than 5353 get unicast responses
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	query := dnsMessage{questions: []dnsQuestion{{name: MdnsService,
+		qtype: dnsTypePTR}}}
+	_, err = conn.WriteToUDP(query.encode(), group)
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []string
+	srv := make(map[string]dnsRecord)
+	txt := make(map[string][]string)
+	ips := make(map[string][]net.IP)
+
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return nil, err
+		}
+
+		msg, err := parseDNSMessage(buf[:n])
+		if err != nil || !msg.response {
+			continue
+		}
+
+		for _, r := range msg.records {
+			key := strings.ToLower(r.name)
+			switch r.rtype {
+			case dnsTypePTR:
+				if strings.EqualFold(r.name, MdnsService) && r.ttl > 0 {
+					instances = append(instances, r.target)
+				}
+			case dnsTypeSRV:
+				srv[key] = r
+			case dnsTypeTXT:
+				txt[key] = r.txt
+			case dnsTypeA:
+				if r.ip != nil {
+					ips[key] = append(ips[key], r.ip)
+				}
+			}
+		}
+	}
+
+	var ret []MdnsEntry
+	seen := make(map[string]bool)
+
+	for _, instance := range instances {
+		key := strings.ToLower(instance)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		s, ok := srv[key]
+		if !ok {
+			continue
+		}
+
+		ret = append(ret, MdnsEntry{
+			Instance: strings.TrimSuffix(instance, "."+MdnsService),
+			Host:     strings.TrimSuffix(s.target, "."),
+			Port:     int(s.port),
+			IPs:      ips[strings.ToLower(s.target)],
+			Txt:      txt[key],
+		})
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,126 @@
+package network
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestDNSMessageRoundTrip(t *testing.T) {
+	instance := "gateway." + MdnsService
+
+	msgs := []dnsMessage{
+		{questions: []dnsQuestion{{name: MdnsService, qtype: dnsTypePTR}}},
+		{id: 0x1234, response: true,
+			questions: []dnsQuestion{{name: "gateway.local.", qtype: dnsTypeA}},
+			records: []dnsRecord{
+				{name: MdnsService, rtype: dnsTypePTR, ttl: mdnsTTL,
+					target: instance},
+				{name: instance, rtype: dnsTypeSRV, flush: true, ttl: mdnsTTL,
+					target: "gateway.local.", port: 8080},
+				{name: instance, rtype: dnsTypeTXT, flush: true, ttl: mdnsTTL,
+					txt: []string{"version=1", "path=/"}},
+				{name: instance, rtype: dnsTypeTXT, ttl: 0},
+				{name: "gateway.local.", rtype: dnsTypeA, flush: true,
+					ttl: mdnsLegacyTTL, ip: net.IPv4(192, 168, 1, 10).To4()},
+			}},
+	}
+
+	for i, m := range msgs {
+		got, err := parseDNSMessage(m.encode())
+		if err != nil {
+			t.Fatalf("%v: error parsing: %v", i, err)
+		}
+
+		if !reflect.DeepEqual(got, m) {
+			t.Errorf("%v: expected\n%+v\ngot\n%+v", i, m, got)
+		}
+	}
+}
+
+func TestDNSCompression(t *testing.T) {
+	// a response with the answer name and PTR target compressed to point
+	// at the question name at offset 12
+	msg := []byte{
+		0, 0, 0x84, 0, 0, 1, 0, 1, 0, 0, 0, 0,
+		10, '_', 's', 'i', 'm', 'p', 'l', 'e', 'i', 'o', 't',
+		4, '_', 't', 'c', 'p', 5, 'l', 'o', 'c', 'a', 'l', 0,
+		0, dnsTypePTR, 0, dnsClassIN,
+		0xc0, 12, 0, dnsTypePTR, 0, dnsClassIN, 0, 0, 0, 120, 0, 5,
+		2, 'g', 'w', 0xc0, 12,
+	}
+
+	m, err := parseDNSMessage(msg)
+	if err != nil {
+		t.Fatal("Error parsing: ", err)
+	}
+
+	if len(m.questions) != 1 || m.questions[0].name != MdnsService {
+		t.Fatalf("wrong questions: %+v", m.questions)
+	}
+
+	if len(m.records) != 1 || m.records[0].name != MdnsService ||
+		m.records[0].target != "gw."+MdnsService || m.records[0].ttl != 120 {
+		t.Fatalf("wrong records: %+v", m.records)
+	}
+}
+
+func TestDNSParseErrors(t *testing.T) {
+	header := []byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+
+	cases := map[string][]byte{
+		"short header": {0, 0, 0},
+		"pointer to itself": append(header[:12:12],
+			0xc0, 12, 0, dnsTypeA, 0, dnsClassIN),
+		"pointer loop": append(header[:12:12],
+			1, 'a', 0xc0, 16, 1, 'b', 0xc0, 12, 0, dnsTypeA, 0, dnsClassIN),
+		"pointer past the end": append(header[:12:12],
+			0xc0, 200, 0, dnsTypeA, 0, dnsClassIN),
+		"label past the end": append(header[:12:12], 10, 'a', 'b'),
+	}
+
+	for name, msg := range cases {
+		if _, err := parseDNSMessage(msg); err == nil {
+			t.Errorf("%v: expected error", name)
+		}
+	}
+
+	// every truncation of a valid message is an error
+	full := dnsMessage{response: true, records: []dnsRecord{
+		{name: MdnsService, rtype: dnsTypePTR, target: "gw." + MdnsService},
+		{name: "gw." + MdnsService, rtype: dnsTypeSRV, target: "gw.local.",
+			port: 80},
+		{name: "gw." + MdnsService, rtype: dnsTypeTXT, txt: []string{"a=b"}},
+		{name: "gw.local.", rtype: dnsTypeA, ip: net.IPv4(10, 0, 0, 1).To4()},
+	}}.encode()
+
+	for i := 0; i < len(full); i++ {
+		if _, err := parseDNSMessage(full[:i]); err == nil {
+			t.Errorf("truncated to %v bytes: expected error", i)
+		}
+	}
+}
+
+func TestMdnsAnswers(t *testing.T) {
+	a := NewMdnsAdvertiser("my.gateway", 8080, nil)
+	a.host = "gw.local."
+
+	cases := []struct {
+		q   dnsQuestion
+		exp bool
+	}{
+		{dnsQuestion{MdnsService, dnsTypePTR}, true},
+		{dnsQuestion{"_SimpleIOT._tcp.local.", dnsTypeANY}, true},
+		{dnsQuestion{"my-gateway." + MdnsService, dnsTypeSRV}, true},
+		{dnsQuestion{"my-gateway." + MdnsService, dnsTypeTXT}, true},
+		{dnsQuestion{"gw.local.", dnsTypeA}, true},
+		{dnsQuestion{"gw.local.", dnsTypePTR}, false},
+		{dnsQuestion{"_http._tcp.local.", dnsTypePTR}, false},
+	}
+
+	for _, c := range cases {
+		if a.answers(c.q) != c.exp {
+			t.Errorf("%+v: expected %v", c.q, c.exp)
+		}
+	}
+}
@@ -4,33 +4,157 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os/exec"
+	"sync"
 	"time"
 
 	"github.com/jacobsa/go-serial/serial"
+	"github.com/simpleiot/simpleiot/data"
 	"github.com/simpleiot/simpleiot/file"
+	"github.com/simpleiot/simpleiot/logging"
 	"github.com/simpleiot/simpleiot/respreader"
+	"github.com/simpleiot/simpleiot/system"
 )
 
-// Modem is an interface that always reports detected/connected
+// module loggers for modems. Errors reading the modem status are logged at
+// debug level, and AT command traffic is logged by the at module at debug
+// level.
+var (
+	modemLog = logging.Module("modem")
+	atLog    = logging.Module("at")
+)
+
+// ModemType describes the modem hardware, which determines some of the AT
+// commands used
+type ModemType int
+
+// define supported modem types
+const (
+	ModemBG96 ModemType = iota
+	ModemEC25
+	ModemSIM7600
+)
+
+func (mt ModemType) String() string {
+	switch mt {
+	case ModemBG96:
+		return "BG96"
+	case ModemEC25:
+		return "EC25"
+	case ModemSIM7600:
+		return "SIM7600"
+	default:
+		return "unknown"
+	}
+}
+
+// ModemBringUp selects how the modem data session is started
+type ModemBringUp int
+
+// define supported data session types
+const (
+	// ModemBringUpPPP runs pppd, either using pon with a chat script or
+	// supervised by a PPP controller if ModemConfig.PPP is set
+	ModemBringUpPPP ModemBringUp = iota
+	// ModemBringUpQMI starts the session with qmicli and gets an
+	// address with udhcpc. This is faster than PPP on LTE modems.
+	ModemBringUpQMI
+)
+
+// ModemConfig describes the modem hardware and how to connect
+type ModemConfig struct {
+	Type    ModemType
+	BringUp ModemBringUp
+	// AtCmdPort is the serial port used for AT commands, like /dev/ttyUSB2
+	// or usb:2c7c:0125:2 (see system.ResolveSerialPort)
+	AtCmdPort string
+	// ChatScript is the pppd peers file used for PPP
+	ChatScript string
+	// PPP, if set, generates the pppd config and supervises pppd instead
+	// of using pon with ChatScript
+	PPP *PPPConfig
+	// QmiDevice is the QMI control device (default /dev/cdc-wdm0)
+	QmiDevice string
+	// Iface is the network interface the data session uses. Defaults to
+	// ppp0 for PPP and wwan0 for QMI.
+	Iface string
+	// APN, User, and Password are used to start QMI data sessions. For
+	// PPP, they are set in the chat script or PPP config.
+	APN      string
+	User     string
+	Password string
+	// DenyRoaming keeps the modem from starting a data session while
+	// roaming, to avoid roaming charges
+	DenyRoaming bool
+	// SimSlots is the priority list of SIM slots, or eUICC profiles if
+	// SelectSim is set. If the modem can't register for SimFailover
+	// (default 5m), it switches to the next SIM.
+	SimSlots    []int
+	SimFailover time.Duration
+	// SelectSim switches SIMs on modems that don't support AT+QDSIM,
+	// like eUICC profiles
+	SelectSim func(slot int) error
+	Reset     func() error
+	// Maintenance, if set, defers firmware updates from commands to a
+	// maintenance window
+	Maintenance *system.Maintenance
+}
+
+// Modem is a cellular modem interface
 type Modem struct {
-	iface         string
-	chatScript    string
-	reset         func() error
-	atCmdPortName string
-	atCmdPort     io.ReadWriteCloser
-	debug         bool
-	lastPPPRun    time.Time
+	config ModemConfig
+	iface  string
+	// lock protects the AT command port, which can be used by the
+	// network manager and SMS processing at the same time
+	lock       sync.Mutex
+	atCmdPort  io.ReadWriteCloser
+	lastPPPRun time.Time
+	usage      *UsageTracker
+	latency    *LatencyMonitor
+	smsQueue   []SMS
+	ppp        *PPP
+	// profile is applied to the modem when profilePending is set
+	profile        *data.CellularConfig
+	profilePending bool
+	profileErr     error
+	sim            SimStatus
+	ident          ModemIdentity
+	fota           fotaProgress
+	// simIndex is the index of the active SIM in SimSlots
+	simIndex    int
+	unregSince  time.Time
+	nitzEnabled bool
 }
 
 // NewModem constructor
-func NewModem(chatScript string, atCmdPortName string, reset func() error, debug bool) *Modem {
+func NewModem(config ModemConfig) *Modem {
 	ret := &Modem{
-		iface:         "ppp0",
-		chatScript:    chatScript,
-		reset:         reset,
-		atCmdPortName: atCmdPortName,
-		debug:         debug,
+		config:         config,
+		iface:          config.Iface,
+		profilePending: true,
+	}
+
+	if ret.iface == "" {
+		if config.BringUp == ModemBringUpQMI {
+			ret.iface = "wwan0"
+		} else {
+			ret.iface = "ppp0"
+		}
+	}
+
+	if config.QmiDevice == "" {
+		ret.config.QmiDevice = "/dev/cdc-wdm0"
+	}
+
+	if config.PPP != nil && config.BringUp == ModemBringUpPPP {
+		pppConfig := *config.PPP
+		if pppConfig.APN == "" {
+			pppConfig.APN = config.APN
+			pppConfig.User = config.User
+			pppConfig.Password = config.Password
+		}
+		ret.ppp = NewPPP(pppConfig)
 	}
 
 	return ret
@@ -41,8 +165,13 @@ func (m *Modem) openCmdPort() error {
 		return nil
 	}
 
+	portName, err := system.ResolveSerialPort(m.config.AtCmdPort)
+	if err != nil {
+		return err
+	}
+
 	options := serial.OpenOptions{
-		PortName:          m.atCmdPortName,
+		PortName:          portName,
 		BaudRate:          115200,
 		DataBits:          8,
 		StopBits:          1,
@@ -62,17 +191,36 @@ func (m *Modem) openCmdPort() error {
 	return nil
 }
 
+// SetUsageTracker enables data usage tracking for the modem data session
+func (m *Modem) SetUsageTracker(usage *UsageTracker) {
+	m.usage = usage
+}
+
+// SetLatencyMonitor enables latency and packet loss monitoring for the
+// interface. The monitor must be started separately.
+func (m *Modem) SetLatencyMonitor(latency *LatencyMonitor) {
+	m.latency = latency
+}
+
 // Desc returns description
 func (m *Modem) Desc() string {
-	return "modem"
+	return fmt.Sprintf("Modem(%v)", m.config.Type)
 }
 
 // detected returns true if modem detected
 func (m *Modem) detected() bool {
-	return file.Exists("/dev/ttyUSB2") && file.Exists("/dev/ttyUSB3")
+	if !file.Exists(m.config.AtCmdPort) {
+		return false
+	}
+
+	if m.config.BringUp == ModemBringUpQMI {
+		return file.Exists(m.config.QmiDevice)
+	}
+
+	return true
 }
 
-func (m *Modem) pppActive() bool {
+func (m *Modem) dataActive() bool {
 	if !m.detected() {
 		return false
 	}
@@ -85,71 +233,256 @@ func (m *Modem) pppActive() bool {
 	return false
 }
 
-// Connect stub
+// registered returns true if the modem is registered on a network
+func (m *Modem) registered() (bool, error) {
+	if m.config.Type == ModemBG96 {
+		// BG96 modems are only used for CAT-M1
+		sysMode, _, _, _, _, err := CmdQcsq(m.atCmdPort)
+		return sysMode == "CAT-M1", err
+	}
+
+	reg, err := CmdRegistered(m.atCmdPort, "AT+CEREG?")
+	if err != nil || reg {
+		return reg, err
+	}
+
+	// may be on 2G/3G
+	return CmdRegistered(m.atCmdPort, "AT+CGREG?")
+}
+
+// Connect starts a data session if the modem is registered on a network
 func (m *Modem) Connect() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
 	if err := m.openCmdPort(); err != nil {
 		return err
 	}
 
-	fmt.Println("Modem: starting PPP")
-	service, _, _, _, err := CmdQcsq(m.atCmdPort)
+	m.applyProfile()
+
+	sim, err := m.simStatus()
 	if err != nil {
 		return err
 	}
 
-	// TODO need to set APN, etc before we do this
-	// but eventually want to make sure we have service
-	// before running PPP
-	if !service {
+	if err := sim.Err(); err != nil {
+		return err
+	}
 
+	reg, err := m.registered()
+	if err != nil {
+		return err
+	}
+
+	if !reg {
+		return errors.New("modem not registered on a network")
+	}
+
+	roaming, err := m.roaming()
+	if err != nil {
+		return err
+	}
+
+	if roaming && m.config.DenyRoaming {
+		return ErrRoaming
 	}
 
 	if time.Since(m.lastPPPRun) < 30*time.Second {
-		return errors.New("only run PPP once every 30s")
+		return errors.New("only start data session once every 30s")
 	}
 
 	m.lastPPPRun = time.Now()
 
-	return exec.Command("pon", m.chatScript).Run()
+	if m.config.BringUp == ModemBringUpQMI {
+		modemLog.Info("starting QMI session")
+		return m.qmiConnect()
+	}
+
+	modemLog.Info("starting PPP")
+	if m.ppp != nil {
+		return m.ppp.Start()
+	}
+
+	return exec.Command("pon", m.config.ChatScript).Run()
+}
+
+func (m *Modem) qmiConnect() error {
+	// LTE modems only support raw IP
+	err := ioutil.WriteFile("/sys/class/net/"+m.iface+"/qmi/raw_ip",
+		[]byte("Y"), 0644)
+	if err != nil {
+		modemLog.Debug("error setting raw IP mode", "error", err)
+	}
+
+	err = exec.Command("ip", "link", "set", m.iface, "up").Run()
+	if err != nil {
+		return fmt.Errorf("Error bringing up %v: %v", m.iface, err)
+	}
+
+	network := fmt.Sprintf("--wds-start-network=apn='%v',ip-type=4", m.config.APN)
+	if m.config.User != "" {
+		network += fmt.Sprintf(",username='%v',password='%v',auth=both",
+			m.config.User, m.config.Password)
+	}
+
+	out, err := exec.Command("qmicli", "-p", "-d", m.config.QmiDevice,
+		network, "--client-no-release-cid").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Error starting QMI network: %v: %v", err,
+			string(out))
+	}
+
+	return exec.Command("udhcpc", "-q", "-n", "-i", m.iface).Run()
 }
 
 // GetStatus return interface status
 func (m *Modem) GetStatus() (InterfaceStatus, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.detected() {
+		return InterfaceStatus{}, nil
+	}
+
 	if err := m.openCmdPort(); err != nil {
 		return InterfaceStatus{}, err
 	}
 
 	var retError error
+
+	if m.ppp != nil {
+		reset, err := m.ppp.Supervise()
+		if reset {
+			modemLog.Warn("PPP keeps failing, resetting modem")
+			return InterfaceStatus{}, m.reset()
+		}
+
+		if err != nil {
+			retError = err
+		}
+	}
+
 	ip, _ := GetIP(m.iface)
 
-	service, rssi, rsrp, rsrq, err := CmdQcsq(m.atCmdPort)
+	m.applyProfile()
+
+	ret := InterfaceStatus{
+		Detected: true,
+		IP:       ip,
+	}
+
+	if m.profileErr != nil {
+		ret.ProfileError = m.profileErr.Error()
+	}
+
+	sim, err := m.simStatus()
+	if err != nil {
+		retError = err
+	}
+	ret.Sim = sim
+	ret.Sim.Slot = m.activeSim()
+
+	ret.Modem, err = m.identity()
+	if err != nil {
+		retError = err
+	}
+
+	reg, err := m.registered()
 	if err != nil {
 		retError = err
 	}
 
-	network, err := CmdQspn(m.atCmdPort)
+	m.checkSimFailover(reg && sim.Err() == nil)
+
+	ret.Roaming, err = m.roaming()
 	if err != nil {
 		retError = err
 	}
 
-	return InterfaceStatus{
-		Detected:  m.detected(),
-		Connected: m.pppActive() && service,
-		Operator:  network,
-		IP:        ip,
-		Signal:    rssi,
-		Rsrp:      rsrp,
-		Rsrq:      rsrq,
-	}, retError
+	ret.Connected = m.dataActive() && reg
+
+	if ret.Roaming && m.config.DenyRoaming && ret.Connected {
+		modemLog.Warn("roaming not allowed, stopping data session")
+		m.stopSession()
+		ret.Connected = false
+	}
+
+	if ret.Connected {
+		// the data session interface only exists while connected
+		m.usage.status(m.iface, &ret)
+	} else if m.usage != nil {
+		ret.Usage = m.usage.Totals(m.iface)
+	}
+
+	m.latency.status(&ret)
+
+	ret.Operator, ret.AccessTech, err = CmdCops(m.atCmdPort)
+	if err != nil {
+		retError = err
+	}
+
+	switch m.config.Type {
+	case ModemBG96, ModemEC25:
+		_, ret.Signal, ret.Rsrp, ret.Sinr, ret.Rsrq, err = CmdQcsq(m.atCmdPort)
+		if err != nil {
+			retError = err
+		}
+
+		if m.config.Type == ModemBG96 {
+			// QSPN returns the full operator name
+			ret.Operator, err = CmdQspn(m.atCmdPort)
+			if err != nil {
+				retError = err
+			}
+		}
+	case ModemSIM7600:
+		if ret.AccessTech == AccessTechLTE {
+			ret.Signal, ret.Rsrp, ret.Sinr, ret.Rsrq, err = CmdCpsi(m.atCmdPort)
+		} else {
+			ret.Signal, err = CmdCsq(m.atCmdPort)
+		}
+
+		if err != nil {
+			modemLog.Debug("error reading signal", "error", err)
+		}
+	}
+
+	if reg {
+		err = m.cellStatus(&ret)
+		if err != nil {
+			modemLog.Debug("error reading cell", "error", err)
+		}
+	}
+
+	return ret, retError
 }
 
-// Reset stub
+// Reset stops the data session and resets the modem
 func (m *Modem) Reset() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.reset()
+}
+
+func (m *Modem) reset() error {
 	if m.atCmdPort != nil {
 		m.atCmdPort.Close()
 		m.atCmdPort = nil
 	}
 
-	exec.Command("poff").Run()
-	return m.reset()
+	m.stopSession()
+
+	// the SIM PIN has to be entered again after a reset, and the SIM may
+	// have been changed
+	m.profilePending = true
+	m.sim = SimStatus{}
+	// the firmware may have been updated
+	m.ident = ModemIdentity{}
+
+	if m.config.Reset == nil {
+		return nil
+	}
+
+	return m.config.Reset()
 }
@@ -0,0 +1,111 @@
+package network
+
+import "testing"
+
+func TestCmdCsq(t *testing.T) {
+	cases := []struct {
+		resp string
+		rssi int
+		err  bool
+	}{
+		{resp: "+CSQ: 21,99", rssi: -71},
+		{resp: "+CSQ: 0,0", rssi: -113},
+		{resp: "+CSQ: 31,99", rssi: -51},
+		{resp: "+CSQ: 99,99", err: true},
+		{resp: "ERROR", err: true},
+	}
+
+	for _, c := range cases {
+		port := &fakePort{resp: map[string]string{
+			"AT+CSQ": "\r\n" + c.resp + "\r\n\r\nOK\r\n",
+		}}
+
+		rssi, err := CmdCsq(port)
+		if (err != nil) != c.err || rssi != c.rssi {
+			t.Errorf("%v: expected %v (error %v), got %v (%v)", c.resp, c.rssi,
+				c.err, rssi, err)
+		}
+	}
+}
+
+func TestCmdRegistered(t *testing.T) {
+	cases := []struct {
+		cmd  string
+		resp string
+		exp  bool
+	}{
+		{"AT+CEREG?", "+CEREG: 0,1", true},
+		{"AT+CEREG?", "+CEREG: 2,5,\"2D0B\",\"1521A0A\",7", true},
+		{"AT+CEREG?", "+CEREG: 0,2", false},
+		{"AT+CGREG?", "+CGREG: 0,3", false},
+		{"AT+CREG?", "+CREG: 0,0", false},
+		{"AT+CREG?", "+CREG: 0,5", true},
+	}
+
+	for _, c := range cases {
+		port := &fakePort{resp: map[string]string{
+			c.cmd: "\r\n" + c.resp + "\r\n\r\nOK\r\n",
+		}}
+
+		reg, err := CmdRegistered(port, c.cmd)
+		if err != nil || reg != c.exp {
+			t.Errorf("%v: expected %v, got %v (%v)", c.resp, c.exp, reg, err)
+		}
+	}
+}
+
+func TestModemRegistered(t *testing.T) {
+	cases := []struct {
+		name  string
+		mtype ModemType
+		resp  map[string]string
+		exp   bool
+	}{
+		{"BG96 on CAT-M1", ModemBG96, map[string]string{
+			"AT+QCSQ": `+QCSQ: "CAT-M1",-52,-81,195,-10` + "\r\nOK\r\n",
+		}, true},
+		{"BG96 on NB-IoT", ModemBG96, map[string]string{
+			"AT+QCSQ": `+QCSQ: "CAT-NB1",-52,-81,195,-10` + "\r\nOK\r\n",
+		}, false},
+		{"EC25 on LTE", ModemEC25, map[string]string{
+			"AT+CEREG?": "+CEREG: 0,1\r\nOK\r\n",
+		}, true},
+		{"SIM7600 on 3G", ModemSIM7600, map[string]string{
+			"AT+CEREG?": "+CEREG: 0,0\r\nOK\r\n",
+			"AT+CGREG?": "+CGREG: 0,5\r\nOK\r\n",
+		}, true},
+		{"EC25 not registered", ModemEC25, map[string]string{
+			"AT+CEREG?": "+CEREG: 0,2\r\nOK\r\n",
+			"AT+CGREG?": "+CGREG: 0,2\r\nOK\r\n",
+		}, false},
+	}
+
+	for _, c := range cases {
+		m := NewModem(ModemConfig{Type: c.mtype})
+		m.atCmdPort = &fakePort{resp: c.resp}
+
+		reg, err := m.registered()
+		if err != nil || reg != c.exp {
+			t.Errorf("%v: expected %v, got %v (%v)", c.name, c.exp, reg, err)
+		}
+	}
+}
+
+func TestNewModemIface(t *testing.T) {
+	cases := []struct {
+		config ModemConfig
+		iface  string
+	}{
+		{ModemConfig{}, "ppp0"},
+		{ModemConfig{BringUp: ModemBringUpQMI}, "wwan0"},
+		{ModemConfig{BringUp: ModemBringUpQMI, Iface: "usb0"}, "usb0"},
+	}
+
+	for _, c := range cases {
+		m := NewModem(c.config)
+		if m.iface != c.iface || m.config.QmiDevice != "/dev/cdc-wdm0" {
+			t.Errorf("%+v: got iface %v, qmi device %v", c.config, m.iface,
+				m.config.QmiDevice)
+		}
+	}
+}
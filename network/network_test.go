@@ -0,0 +1,360 @@
+package network
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is a clock that tests advance by hand
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time {
+	return c.t
+}
+
+func (c *testClock) add(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+// fakePort is a modem AT port that answers each command with a canned
+// response
+type fakePort struct {
+	resp map[string]string
+	cmds []string
+}
+
+func (p *fakePort) Write(b []byte) (int, error) {
+	p.cmds = append(p.cmds, strings.TrimSpace(string(b)))
+	return len(b), nil
+}
+
+func (p *fakePort) Read(b []byte) (int, error) {
+	if len(p.cmds) == 0 {
+		return 0, io.EOF
+	}
+
+	resp, ok := p.resp[p.cmds[len(p.cmds)-1]]
+	if !ok {
+		resp = "\r\nERROR\r\n"
+	}
+
+	return copy(b, resp), nil
+}
+
+func (p *fakePort) Close() error {
+	return nil
+}
+
+// countingInterface counts the GetStatus calls of a DummyInterface
+type countingInterface struct {
+	*DummyInterface
+	lock  sync.Mutex
+	calls int
+}
+
+func (c *countingInterface) GetStatus() (InterfaceStatus, error) {
+	c.lock.Lock()
+	c.calls++
+	c.lock.Unlock()
+	return c.DummyInterface.GetStatus()
+}
+
+func (c *countingInterface) count() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.calls
+}
+
+func TestATAllowed(t *testing.T) {
+	p := NewATPassthrough(nil, ATPassthroughConfig{})
+
+	cases := []struct {
+		cmd string
+		exp bool
+	}{
+		{"ATI", true},
+		{"ati", true},
+		{"AT+CSQ", true},
+		{"AT+CSQ=?", true},
+		{"AT+COPS?", true},
+		{`AT+QENG="servingcell"`, true},
+		{"AT+CCID?", true},
+		// basic commands chained without ;
+		{"ATI&F&W", false},
+		{"ATIZ", false},
+		{"ATI+CFUN=0", false},
+		{"ATI=1", false},
+		{"AT+COPS=0", false},
+		{"AT+CSQ&F", false},
+		{`AT+QENG="servingcell"&W`, false},
+		{"AT+CFUN=0", false},
+		{"AT+CSQ;+CFUN=0", false},
+		{"AT+CSQ\r\nAT+CFUN=0", false},
+	}
+
+	for _, c := range cases {
+		if p.allowed(c.cmd) != c.exp {
+			t.Errorf("%q: expected allowed %v", c.cmd, c.exp)
+		}
+	}
+}
+
+func TestManager(t *testing.T) {
+	type step struct {
+		advance time.Duration
+		// up connects or disconnects interfaces by Desc before Run
+		up     map[string]bool
+		state  State
+		active string
+		// resets of each interface
+		resets int
+	}
+
+	// eth can't reconnect once it is down, so the manager must fail over
+	eth := DummyConfig{Desc: "eth", ConnectFailures: 1000}
+	wifi := DummyConfig{Desc: "wifi"}
+
+	failover := []step{
+		{state: StateConnected, active: "eth"},
+		{up: map[string]bool{"eth": false}, state: StateConnecting, active: "eth"},
+		{advance: 30 * time.Second, state: StateConnecting, active: "eth"},
+		{advance: 31 * time.Second, state: StateConnected, active: "wifi"},
+	}
+
+	cases := []struct {
+		name   string
+		ifaces []DummyConfig
+		steps  []step
+	}{
+		{"failover", []DummyConfig{eth, wifi}, failover},
+		{"failback", []DummyConfig{eth, wifi}, append(failover[:len(failover):len(failover)],
+			step{up: map[string]bool{"eth": true}, state: StateConnected, active: "wifi"},
+			step{advance: 59 * time.Second, state: StateConnected, active: "wifi"},
+			step{advance: time.Second, state: StateConnected, active: "eth"},
+		)},
+		{"failback delay restarts if link drops", []DummyConfig{eth, wifi}, append(failover[:len(failover):len(failover)],
+			step{up: map[string]bool{"eth": true}, state: StateConnected, active: "wifi"},
+			step{advance: 50 * time.Second, up: map[string]bool{"eth": false}, state: StateConnected, active: "wifi"},
+			step{up: map[string]bool{"eth": true}, state: StateConnected, active: "wifi"},
+			step{advance: 50 * time.Second, state: StateConnected, active: "wifi"},
+			step{advance: 10 * time.Second, state: StateConnected, active: "eth"},
+		)},
+		{"error reset", []DummyConfig{
+			{Desc: "eth", NotDetected: true},
+			{Desc: "wifi", NotDetected: true},
+		}, []step{
+			{state: StateNotDetected, active: "eth"},
+			// both interfaces time out detecting
+			{advance: 16 * time.Second, state: StateError, active: "eth"},
+			{advance: 61 * time.Second, state: StateNotDetected, active: "eth"},
+			// second error in a row resets the interfaces
+			{advance: 16 * time.Second, state: StateNotDetected, active: "eth", resets: 1},
+			// the next reset waits for the reset backoff
+			{advance: 16 * time.Second, state: StateError, active: "eth", resets: 1},
+			{advance: 61 * time.Second, state: StateNotDetected, active: "eth", resets: 1},
+			{advance: 16 * time.Second, state: StateError, active: "eth", resets: 1},
+			{advance: 2 * time.Hour, state: StateNotDetected, active: "eth", resets: 1},
+			{advance: 16 * time.Second, state: StateNotDetected, active: "eth", resets: 2},
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			clock := &testClock{t: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+			m := newManager(2, clock.now)
+			m.SetBackoff(BackoffConfig{Initial: time.Hour})
+
+			ifaces := make(map[string]*DummyInterface)
+			for _, config := range c.ifaces {
+				config.Now = clock.now
+				iface := NewScriptedDummyInterface(config)
+				ifaces[config.Desc] = iface
+				m.AddInterface(iface)
+			}
+
+			last := m.State()
+			for i, s := range c.steps {
+				clock.add(s.advance)
+				for desc, up := range s.up {
+					ifaces[desc].SetConnected(up)
+				}
+
+				last = m.runOnce(last)
+
+				if last != s.state || m.Desc() != s.active {
+					t.Fatalf("step %v: expected %v on %v, got %v on %v",
+						i, s.state, s.active, last, m.Desc())
+				}
+
+				for desc, iface := range ifaces {
+					if _, resets := iface.Counts(); resets != s.resets {
+						t.Fatalf("step %v: expected %v resets of %v, got %v",
+							i, s.resets, desc, resets)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestManagerHistory(t *testing.T) {
+	clock := &testClock{t: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	m := newManager(2, clock.now)
+	eth := NewScriptedDummyInterface(DummyConfig{Desc: "eth", ConnectFailures: 1000, Now: clock.now})
+	wifi := NewScriptedDummyInterface(DummyConfig{Desc: "wifi", Now: clock.now})
+	m.AddInterface(eth)
+	m.AddInterface(wifi)
+
+	last := m.runOnce(m.State())
+	eth.SetConnected(false)
+	for i := 0; i < 3; i++ {
+		clock.add(31 * time.Second)
+		last = m.runOnce(last)
+	}
+
+	failover := clock.t
+	eth.SetConnected(true)
+	last = m.runOnce(last)
+	clock.add(time.Minute)
+	m.runOnce(last)
+
+	exp := []Transition{
+		{Time: failover, From: "eth", To: "wifi", Reason: "connect timeout"},
+		{Time: clock.t, From: "wifi", To: "eth", Reason: "failback"},
+	}
+
+	history := m.History()
+	if len(history) != len(exp) {
+		t.Fatalf("expected %v transitions, got %+v", len(exp), history)
+	}
+
+	for i := range exp {
+		if history[i] != exp[i] {
+			t.Errorf("transition %v: expected %+v, got %+v", i, exp[i], history[i])
+		}
+	}
+
+	// the history is capped
+	for i := 0; i < maxTransitions+10; i++ {
+		m.setInterface((m.interfaceIndex+1)%2, "test")
+	}
+
+	history = m.History()
+	if len(history) != maxTransitions || history[len(history)-1].Reason != "test" {
+		t.Errorf("expected %v transitions, got %v", maxTransitions, len(history))
+	}
+}
+
+func TestManagerStartStop(t *testing.T) {
+	m := NewManager(3)
+
+	// not started
+	m.Stop()
+
+	iface := &countingInterface{DummyInterface: NewDummyInterface()}
+	m.AddInterface(iface)
+
+	// Run is called before Start waits for the first tick, and Stop waits
+	// for it to return
+	m.Start(time.Millisecond)
+	m.Stop()
+	m.Stop()
+
+	if m.State() != StateConnected {
+		t.Fatalf("expected state %v, got %v", StateConnected, m.State())
+	}
+
+	calls := iface.count()
+	time.Sleep(10 * time.Millisecond)
+	if iface.count() != calls {
+		t.Error("Run was called after Stop")
+	}
+}
+
+func TestManagerRunOnce(t *testing.T) {
+	clock := &testClock{t: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	iface := NewScriptedDummyInterface(DummyConfig{NotDetected: true, Now: clock.now})
+
+	m := newManager(2, clock.now)
+	m.AddInterface(iface)
+
+	last := m.runOnce(m.State())
+	if last != StateNotDetected {
+		t.Fatalf("expected state %v, got %v", StateNotDetected, last)
+	}
+
+	clock.add(16 * time.Second)
+	last = m.runOnce(last)
+	if last != StateError {
+		t.Fatalf("expected state %v, got %v", StateError, last)
+	}
+
+	// waiting in the error state is one error, not one per run
+	for i := 0; i < 5; i++ {
+		last = m.runOnce(last)
+	}
+
+	if m.errCnt != 1 {
+		t.Errorf("expected 1 error, got %v", m.errCnt)
+	}
+
+	if _, resets := iface.Counts(); resets != 0 {
+		t.Errorf("expected no resets, got %v", resets)
+	}
+
+	// the second failure resets the interfaces
+	clock.add(61 * time.Second)
+	last = m.runOnce(last)
+	clock.add(16 * time.Second)
+	last = m.runOnce(last)
+
+	if _, resets := iface.Counts(); resets != 1 {
+		t.Errorf("expected 1 reset, got %v", resets)
+	}
+
+	if last != StateNotDetected || m.errCnt != 0 {
+		t.Errorf("expected state %v with no errors after reset, got %v with %v",
+			StateNotDetected, last, m.errCnt)
+	}
+}
+
+func TestManagerServeHTTP(t *testing.T) {
+	m := NewManager(3)
+	m.AddInterface(NewScriptedDummyInterface(DummyConfig{Desc: "eth0"}))
+	m.Run()
+
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %v, got %v", http.StatusOK, res.Code)
+	}
+
+	var status ManagerStatus
+	err := json.NewDecoder(res.Body).Decode(&status)
+	if err != nil {
+		t.Fatal("Error decoding status: ", err)
+	}
+
+	if status.State != StateConnected.String() || status.Active != "eth0" ||
+		!status.Status.Connected {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	res = httptest.NewRecorder()
+	m.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", nil))
+
+	if res.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %v, got %v", http.StatusMethodNotAllowed, res.Code)
+	}
+}
@@ -0,0 +1,95 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNoNetworkTime is returned when the modem has not received the time
+// from the network
+var ErrNoNetworkTime = errors.New("network time not available")
+
+// modem clocks start at a date like 1980/01/06 until they get the network
+// time, so earlier times are not valid
+var nitzMinTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// CmdEnableNitz enables updating the modem clock with the time provided
+// by the network (NITZ)
+func CmdEnableNitz(port io.ReadWriter) error {
+	return CmdOK(port, "AT+CTZU=1")
+}
+
+// +CCLK: "21/03/15,12:34:56+08"
+var reCclk = regexp.MustCompile(`\+CCLK:\s*"(\d+)/(\d+)/(\d+),(\d+):(\d+):(\d+)([+-]\d+)?"`)
+
+// CmdGetClock returns the modem clock. The modem reports local time with
+// the zone offset in quarter hours, which is converted to UTC.
+func CmdGetClock(port io.ReadWriter) (time.Time, error) {
+	resp, err := Cmd(port, "AT+CCLK?")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	for _, line := range strings.Split(resp, "\n") {
+		matches := reCclk.FindStringSubmatch(line)
+		if len(matches) < 8 {
+			continue
+		}
+
+		var v [6]int
+		for i := range v {
+			v[i], _ = strconv.Atoi(matches[i+1])
+		}
+
+		quarters, _ := strconv.Atoi(matches[7])
+
+		// the year has two digits, and an unsynced clock reports 80
+		year := 2000 + v[0]
+		if v[0] >= 70 {
+			year = 1900 + v[0]
+		}
+
+		t := time.Date(year, time.Month(v[1]), v[2], v[3], v[4], v[5],
+			0, time.UTC)
+
+		return t.Add(-time.Duration(quarters) * 15 * time.Minute), nil
+	}
+
+	return time.Time{}, fmt.Errorf("Error parsing AT+CCLK response: %v", resp)
+}
+
+// NetworkTime returns the time provided by the cellular network, so it can
+// be used to set the system time when NTP is not reachable. This can be
+// used as a system.TimeSource.
+func (m *Modem) NetworkTime() (time.Time, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.openCmdPort(); err != nil {
+		return time.Time{}, err
+	}
+
+	if !m.nitzEnabled {
+		// not all modems support this, in which case the clock may
+		// still be set by the modem firmware
+		if err := CmdEnableNitz(m.atCmdPort); err == nil {
+			m.nitzEnabled = true
+		}
+	}
+
+	t, err := CmdGetClock(m.atCmdPort)
+	if err != nil {
+		return t, err
+	}
+
+	if t.Before(nitzMinTime) {
+		return time.Time{}, ErrNoNetworkTime
+	}
+
+	return t, nil
+}
@@ -0,0 +1,53 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCmdGetClock(t *testing.T) {
+	cases := []struct {
+		name string
+		resp string
+		exp  time.Time
+	}{
+		{"unsynced", `+CCLK: "80/01/06,00:01:23+00"`,
+			time.Date(1980, 1, 6, 0, 1, 23, 0, time.UTC)},
+		{"unsynced no offset", `+CCLK: "80/01/06,00:01:23"`,
+			time.Date(1980, 1, 6, 0, 1, 23, 0, time.UTC)},
+		{"positive offset", `+CCLK: "21/03/15,12:34:56+08"`,
+			time.Date(2021, 3, 15, 10, 34, 56, 0, time.UTC)},
+		{"negative offset", `+CCLK: "21/03/15,12:34:56-20"`,
+			time.Date(2021, 3, 15, 17, 34, 56, 0, time.UTC)},
+		{"negative offset across midnight", `+CCLK: "20/12/31,22:00:00-16"`,
+			time.Date(2021, 1, 1, 2, 0, 0, 0, time.UTC)},
+		{"no offset", `+CCLK: "21/03/15,12:34:56"`,
+			time.Date(2021, 3, 15, 12, 34, 56, 0, time.UTC)},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			port := &fakePort{resp: map[string]string{
+				"AT+CCLK?": "\r\n" + c.resp + "\r\n\r\nOK\r\n",
+			}}
+
+			clock, err := CmdGetClock(port)
+			if err != nil {
+				t.Fatal("Error getting clock: ", err)
+			}
+
+			if !clock.Equal(c.exp) {
+				t.Errorf("expected %v, got %v", c.exp, clock)
+			}
+
+			if unsynced := clock.Before(nitzMinTime); unsynced != (c.exp.Year() < 2000) {
+				t.Errorf("expected unsynced %v", !unsynced)
+			}
+		})
+	}
+
+	port := &fakePort{resp: map[string]string{"AT+CCLK?": "\r\nOK\r\n"}}
+	if _, err := CmdGetClock(port); err == nil {
+		t.Error("expected error for missing +CCLK")
+	}
+}
@@ -0,0 +1,248 @@
+package network
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// NetworkManager D-Bus names
+const (
+	nmService       = "org.freedesktop.NetworkManager"
+	nmPath          = "/org/freedesktop/NetworkManager"
+	nmDevice        = nmService + ".Device"
+	nmWireless      = nmService + ".Device.Wireless"
+	nmAccessPoint   = nmService + ".AccessPoint"
+	nmStateActivate = 100
+)
+
+// busctl runs a D-Bus call on the system bus and returns the reply with
+// the type signature removed (`u 100` returns `100`)
+func busctl(args ...string) (string, error) {
+	out, err := exec.Command("busctl", append([]string{"--system"},
+		args...)...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("busctl %v: %v: %v", args[0], err,
+			strings.TrimSpace(string(out)))
+	}
+
+	return busctlValue(string(out)), nil
+}
+
+// busctlValue removes the type signature from a busctl reply
+func busctlValue(out string) string {
+	fields := strings.SplitN(strings.TrimSpace(out), " ", 2)
+	if len(fields) < 2 {
+		return ""
+	}
+
+	return fields[1]
+}
+
+// parseByteArray parses an ay value (the length, then the bytes) returned
+// by busctl, like `4 115 105 111 116`
+func parseByteArray(s string) ([]byte, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 1 {
+		return nil, nil
+	}
+
+	var ret []byte
+	for _, f := range fields[1:] {
+		v, err := strconv.Atoi(f)
+		if err != nil || v < 0 || v > 255 {
+			return nil, fmt.Errorf("Error parsing byte array: %v", s)
+		}
+		ret = append(ret, byte(v))
+	}
+
+	return ret, nil
+}
+
+// nmProperty reads a NetworkManager object property
+func nmProperty(path, iface, prop string) (string, error) {
+	return busctl("get-property", nmService, path, iface, prop)
+}
+
+func unquote(s string) string {
+	return strings.Trim(s, "\"")
+}
+
+// NMInterface implements the Interface interface using the NetworkManager
+// D-Bus API, for systems where NetworkManager owns the network config.
+// Connections are managed by NetworkManager, this only activates them
+// and reports status, so SIOT cooperates with the system network stack.
+type NMInterface struct {
+	iface string
+	// connection is the D-Bus path of the connection to activate. If
+	// blank, NetworkManager picks the best available connection.
+	connection string
+	usage      *UsageTracker
+	latency    *LatencyMonitor
+}
+
+// NewNMInterface constructor. connection is the D-Bus path of the
+// NetworkManager connection to activate on iface, and can be blank.
+func NewNMInterface(iface, connection string) *NMInterface {
+	if connection == "" {
+		connection = "/"
+	}
+
+	return &NMInterface{iface: iface, connection: connection}
+}
+
+// SetUsageTracker enables data usage tracking for the interface
+func (n *NMInterface) SetUsageTracker(usage *UsageTracker) {
+	n.usage = usage
+}
+
+// SetLatencyMonitor enables latency and packet loss monitoring for the
+// interface. The monitor must be started separately.
+func (n *NMInterface) SetLatencyMonitor(latency *LatencyMonitor) {
+	n.latency = latency
+}
+
+// Desc returns a description of the interface
+func (n *NMInterface) Desc() string {
+	return fmt.Sprintf("NM(%v)", n.iface)
+}
+
+// device returns the D-Bus path of the NetworkManager device for iface
+func (n *NMInterface) device() (string, error) {
+	dev, err := busctl("call", nmService, nmPath, nmService,
+		"GetDeviceByIpIface", "s", n.iface)
+	if err != nil {
+		return "", err
+	}
+
+	return unquote(dev), nil
+}
+
+func (n *NMInterface) state(dev string) (int, error) {
+	s, err := nmProperty(dev, nmDevice, "State")
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(s)
+}
+
+// Connect activates the connection on the device if it is not already
+// active
+func (n *NMInterface) Connect() error {
+	dev, err := n.device()
+	if err != nil {
+		return err
+	}
+
+	state, err := n.state(dev)
+	if err != nil {
+		return err
+	}
+
+	if state == nmStateActivate {
+		return nil
+	}
+
+	_, err = busctl("call", nmService, nmPath, nmService,
+		"ActivateConnection", "ooo", n.connection, dev, "/")
+	return err
+}
+
+// wifiStatus fills in the SSID and signal of the active access point
+func (n *NMInterface) wifiStatus(dev string, status *InterfaceStatus) error {
+	ap, err := nmProperty(dev, nmWireless, "ActiveAccessPoint")
+	if err != nil {
+		return err
+	}
+
+	ap = unquote(ap)
+	if ap == "/" {
+		return nil
+	}
+
+	// ay 4 115 105 111 116
+	ssid, err := nmProperty(ap, nmAccessPoint, "Ssid")
+	if err != nil {
+		return err
+	}
+
+	b, err := parseByteArray(ssid)
+	if err != nil {
+		return err
+	}
+	status.SSID = string(b)
+
+	strength, err := nmProperty(ap, nmAccessPoint, "Strength")
+	if err != nil {
+		return err
+	}
+
+	// NetworkManager reports strength as a percentage, which it computes
+	// from dBm as 2 * (dBm + 100)
+	s, err := strconv.Atoi(strength)
+	if err != nil {
+		return err
+	}
+	status.Signal = s/2 - 100
+
+	return nil
+}
+
+// GetStatus returns the interface status from NetworkManager
+func (n *NMInterface) GetStatus() (InterfaceStatus, error) {
+	dev, err := n.device()
+	if err != nil {
+		// device is not managed or not present
+		return InterfaceStatus{}, nil
+	}
+
+	ip, _ := GetIP(n.iface)
+	ret := InterfaceStatus{
+		Detected: true,
+		IP:       ip,
+	}
+
+	state, err := n.state(dev)
+	if err != nil {
+		return ret, err
+	}
+
+	ret.Connected = state == nmStateActivate && ip != ""
+
+	devType, err := nmProperty(dev, nmDevice, "DeviceType")
+	if err != nil {
+		return ret, err
+	}
+
+	// 2 is NM_DEVICE_TYPE_WIFI
+	if devType == "2" {
+		err = n.wifiStatus(dev, &ret)
+		if err != nil {
+			return ret, err
+		}
+	}
+
+	linkInfo(n.iface, &ret)
+	n.usage.status(n.iface, &ret)
+	n.latency.status(&ret)
+
+	return ret, nil
+}
+
+// Reset disconnects the device. NetworkManager will not auto connect it
+// again until Connect is called.
+func (n *NMInterface) Reset() error {
+	dev, err := n.device()
+	if err != nil {
+		return err
+	}
+
+	_, err = busctl("call", nmService, dev, nmDevice, "Disconnect")
+	if err != nil && !strings.Contains(err.Error(), "not active") {
+		return err
+	}
+
+	return nil
+}
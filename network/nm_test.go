@@ -0,0 +1,44 @@
+package network
+
+import "testing"
+
+func TestBusctlValue(t *testing.T) {
+	cases := []struct {
+		out string
+		exp string
+	}{
+		{"u 100\n", "100"},
+		{`o "/org/freedesktop/NetworkManager/Devices/3"`,
+			`"/org/freedesktop/NetworkManager/Devices/3"`},
+		{"ay 4 115 105 111 116", "4 115 105 111 116"},
+		{"", ""},
+	}
+
+	for _, c := range cases {
+		if v := busctlValue(c.out); v != c.exp {
+			t.Errorf("%q: expected %q, got %q", c.out, c.exp, v)
+		}
+	}
+}
+
+func TestParseByteArray(t *testing.T) {
+	cases := []struct {
+		s   string
+		exp string
+		err bool
+	}{
+		{"4 115 105 111 116", "siot", false},
+		{"0", "", false},
+		{"", "", false},
+		{"2 115 x", "", true},
+		{"1 256", "", true},
+	}
+
+	for _, c := range cases {
+		b, err := parseByteArray(c.s)
+		if (err != nil) != c.err || string(b) != c.exp {
+			t.Errorf("%q: expected %q (error %v), got %q (%v)", c.s, c.exp,
+				c.err, b, err)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/simpleiot/simpleiot/logging"
+)
+
+var pppLog = logging.Module("ppp")
+
+// pppExitPeerDead is the pppd exit status when the peer stops responding
+// to LCP echo requests
+const pppExitPeerDead = 15
+
+// PPPConfig describes a managed PPP session
+type PPPConfig struct {
+	// Name is the name of the peers file (default siot)
+	Name string
+	// Device is the modem data port (/dev/ttyUSB3)
+	Device string
+	// Baud defaults to 115200
+	Baud int
+	// APN, User, and Password are used to connect
+	APN      string
+	User     string
+	Password string
+	// PeersDir (default /etc/ppp/peers) and ChatDir (default
+	// /etc/chatscripts) are where the generated config is written
+	PeersDir string
+	ChatDir  string
+	// the session is considered dead after LcpEchoFailure echo requests
+	// sent every LcpEchoInterval seconds are not answered (default 10s, 3)
+	LcpEchoInterval int
+	LcpEchoFailure  int
+	// MaxRestarts is the number of times pppd is restarted before
+	// Supervise reports the modem should be reset (default 3)
+	MaxRestarts int
+}
+
+// PPP starts and supervises pppd. Dead sessions are detected by pppd with
+// LCP echo requests, which causes pppd to exit. Supervise restarts pppd,
+// and reports when the session keeps failing so the modem can be reset.
+type PPP struct {
+	config   PPPConfig
+	lock     sync.Mutex
+	cmd      *exec.Cmd
+	done     chan struct{}
+	wanted   bool
+	restarts int
+	lastExit error
+}
+
+// NewPPP creates a new PPP controller
+func NewPPP(config PPPConfig) *PPP {
+	if config.Name == "" {
+		config.Name = "siot"
+	}
+
+	if config.Baud == 0 {
+		config.Baud = 115200
+	}
+
+	if config.PeersDir == "" {
+		config.PeersDir = "/etc/ppp/peers"
+	}
+
+	if config.ChatDir == "" {
+		config.ChatDir = "/etc/chatscripts"
+	}
+
+	if config.LcpEchoInterval == 0 {
+		config.LcpEchoInterval = 10
+	}
+
+	if config.LcpEchoFailure == 0 {
+		config.LcpEchoFailure = 3
+	}
+
+	if config.MaxRestarts == 0 {
+		config.MaxRestarts = 3
+	}
+
+	return &PPP{config: config}
+}
+
+func (p *PPP) chatFile() string {
+	return path.Join(p.config.ChatDir, p.config.Name)
+}
+
+// WriteConfig writes the pppd peers file and chat script
+func (p *PPP) WriteConfig() error {
+	chat := fmt.Sprintf(`ABORT "BUSY"
+ABORT "NO CARRIER"
+ABORT "NO DIALTONE"
+ABORT "ERROR"
+ABORT "NO ANSWER"
+TIMEOUT 30
+"" AT
+OK ATE0
+OK AT+CGDCONT=1,"IP","%v"
+OK ATD*99#
+CONNECT ""
+`, p.config.APN)
+
+	peers := fmt.Sprintf(`%v
+%v
+connect "/usr/sbin/chat -v -f %v"
+noauth
+defaultroute
+replacedefaultroute
+usepeerdns
+persist
+maxfail 1
+crtscts
+lock
+noipdefault
+lcp-echo-interval %v
+lcp-echo-failure %v
+`, p.config.Device, p.config.Baud, p.chatFile(), p.config.LcpEchoInterval,
+		p.config.LcpEchoFailure)
+
+	if p.config.User != "" {
+		peers += fmt.Sprintf("user \"%v\"\npassword \"%v\"\n", p.config.User,
+			p.config.Password)
+	}
+
+	for _, dir := range []string{p.config.PeersDir, p.config.ChatDir} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := ioutil.WriteFile(p.chatFile(), []byte(chat), 0644)
+	if err != nil {
+		return err
+	}
+
+	// peers file can contain a password
+	return ioutil.WriteFile(path.Join(p.config.PeersDir, p.config.Name),
+		[]byte(peers), 0600)
+}
+
+// SetProfile sets the APN and credentials used the next time pppd is
+// started
+func (p *PPP) SetProfile(apn, user, password string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.config.APN = apn
+	p.config.User = user
+	p.config.Password = password
+}
+
+// SetDevice sets the modem data port used the next time pppd is started
+func (p *PPP) SetDevice(device string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.config.Device = device
+}
+
+// Running returns true if pppd is running
+func (p *PPP) Running() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.cmd != nil
+}
+
+// LastExit returns why pppd last exited
+func (p *PPP) LastExit() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.lastExit
+}
+
+// Start writes the config and starts pppd if it is not already running
+func (p *PPP) Start() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.wanted = true
+
+	if p.cmd != nil {
+		return nil
+	}
+
+	return p.startLocked()
+}
+
+func (p *PPP) startLocked() error {
+	err := p.WriteConfig()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("pppd", "call", p.config.Name, "nodetach")
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	pppLog.Info("started pppd")
+
+	done := make(chan struct{})
+	p.cmd = cmd
+	p.done = done
+
+	go func() {
+		err := cmd.Wait()
+
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok &&
+				status.ExitStatus() == pppExitPeerDead {
+				err = errors.New("peer not responding to LCP echo requests")
+			}
+		}
+
+		if err == nil {
+			err = errors.New("pppd exited")
+		}
+
+		pppLog.Warn("pppd stopped", "error", err)
+
+		p.lock.Lock()
+		p.cmd = nil
+		p.lastExit = err
+		p.lock.Unlock()
+		close(done)
+	}()
+
+	return nil
+}
+
+// Stop stops pppd and waits for it to exit
+func (p *PPP) Stop() error {
+	p.lock.Lock()
+	p.wanted = false
+	p.restarts = 0
+	cmd := p.cmd
+	done := p.done
+	p.lock.Unlock()
+
+	if cmd == nil {
+		return nil
+	}
+
+	err := cmd.Process.Signal(syscall.SIGTERM)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(10 * time.Second):
+		return cmd.Process.Kill()
+	}
+}
+
+// Supervise restarts pppd if it exited after Start was called, and should
+// be called periodically. reset is true if pppd has been restarted
+// MaxRestarts times without staying up until the next call, in which case
+// the caller should reset the modem.
+func (p *PPP) Supervise() (reset bool, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.wanted {
+		return false, nil
+	}
+
+	if p.cmd != nil {
+		p.restarts = 0
+		return false, nil
+	}
+
+	if p.restarts >= p.config.MaxRestarts {
+		p.restarts = 0
+		p.wanted = false
+		return true, nil
+	}
+
+	p.restarts++
+	pppLog.Info("restarting pppd", "restart", p.restarts, "max", p.config.MaxRestarts)
+	return false, p.startLocked()
+}
@@ -0,0 +1,104 @@
+package network
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestPPPWriteConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-ppp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := NewPPP(PPPConfig{
+		Device:   "/dev/ttyUSB3",
+		APN:      "hologram",
+		PeersDir: path.Join(dir, "peers"),
+		ChatDir:  path.Join(dir, "chatscripts"),
+	})
+	p.SetProfile("iot.example", "user", "secret")
+
+	err = p.WriteConfig()
+	if err != nil {
+		t.Fatal("Error writing config: ", err)
+	}
+
+	chat, err := ioutil.ReadFile(path.Join(dir, "chatscripts", "siot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(chat), `OK AT+CGDCONT=1,"IP","iot.example"`) {
+		t.Errorf("chat script does not set the APN:\n%s", chat)
+	}
+
+	peersFile := path.Join(dir, "peers", "siot")
+	peers, err := ioutil.ReadFile(peersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, exp := range []string{
+		"/dev/ttyUSB3\n115200\n",
+		"chat -v -f " + path.Join(dir, "chatscripts", "siot"),
+		"lcp-echo-interval 10\n",
+		"lcp-echo-failure 3\n",
+		"user \"user\"\npassword \"secret\"\n",
+	} {
+		if !strings.Contains(string(peers), exp) {
+			t.Errorf("peers file does not contain %q:\n%s", exp, peers)
+		}
+	}
+
+	info, err := os.Stat(peersFile)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("peers file with password is readable by others: %v", err)
+	}
+}
+
+func TestPPPSupervise(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-ppp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// pppd can't be found, so every start fails
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+
+	p := NewPPP(PPPConfig{PeersDir: dir, ChatDir: dir, MaxRestarts: 2})
+
+	reset, err := p.Supervise()
+	if reset || err != nil {
+		t.Fatalf("supervised before Start: %v, %v", reset, err)
+	}
+
+	if p.Start() == nil {
+		t.Fatal("expected error starting pppd")
+	}
+
+	for i := 0; i < 2; i++ {
+		reset, err = p.Supervise()
+		if reset || err == nil {
+			t.Fatalf("restart %v: expected a failed restart, got %v, %v", i,
+				reset, err)
+		}
+	}
+
+	reset, err = p.Supervise()
+	if !reset || err != nil {
+		t.Fatalf("expected a reset after %v restarts, got %v, %v", 2, reset, err)
+	}
+
+	// Start must be called again after a reset
+	reset, err = p.Supervise()
+	if reset || err != nil {
+		t.Errorf("supervised after reset: %v, %v", reset, err)
+	}
+}
@@ -0,0 +1,120 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// CmdSetOperator selects the operator by numeric ID. The modem falls back
+// to automatic selection if the operator is not available. If operator is
+// blank, automatic selection is used.
+func CmdSetOperator(port io.ReadWriter, operator string) error {
+	if operator == "" {
+		return CmdOK(port, "AT+COPS=0")
+	}
+
+	return CmdOK(port, "AT+COPS=4,2,\""+operator+"\"")
+}
+
+// SetProfile sets the APN and SIM profile. The profile is validated and
+// applied the next time the modem is detected, and again after every
+// reset. Errors applying the profile are reported in
+// InterfaceStatus.ProfileError. The data session is restarted so the new
+// APN is used.
+func (m *Modem) SetProfile(profile data.CellularConfig) error {
+	err := profile.Validate()
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.profile = &profile
+	m.profilePending = true
+	m.profileErr = nil
+
+	m.config.APN = profile.APN
+	m.config.User = profile.User
+	m.config.Password = profile.Password
+	m.config.DenyRoaming = profile.DenyRoaming
+	if m.ppp != nil {
+		m.ppp.SetProfile(profile.APN, profile.User, profile.Password)
+	}
+
+	m.stopSession()
+	m.lastPPPRun = time.Time{}
+
+	return nil
+}
+
+// applyProfile sends the profile and roaming policy to the modem if they
+// have not been applied yet. Must be called with m.lock held and the AT command port open.
+func (m *Modem) applyProfile() {
+	if !m.profilePending {
+		return
+	}
+
+	m.profilePending = false
+
+	if len(m.config.SimSlots) > 1 {
+		// the modem may have been left on another SIM
+		err := m.selectSim(m.activeSim())
+		if err != nil {
+			modemLog.Error("error selecting SIM", "error", err)
+		}
+	}
+
+	if m.profile != nil {
+		m.profileErr = m.sendProfile(*m.profile)
+	} else if m.config.DenyRoaming {
+		m.profileErr = m.sendRoaming()
+	}
+
+	if m.profileErr != nil {
+		modemLog.Error("error applying profile", "error", m.profileErr)
+	}
+}
+
+func (m *Modem) sendProfile(profile data.CellularConfig) error {
+	sim, err := m.simStatus()
+	if err != nil {
+		return err
+	}
+
+	if sim.State == SimPIN && profile.PIN != "" {
+		err = CmdEnterPin(m.atCmdPort, profile.PIN)
+		if err != nil {
+			return fmt.Errorf("SIM PIN rejected: %v", err)
+		}
+	} else if err := sim.Err(); err != nil {
+		return err
+	}
+
+	err = CmdSetOperator(m.atCmdPort, profile.Operator)
+	if err != nil {
+		return fmt.Errorf("Error selecting operator %v: %v", profile.Operator, err)
+	}
+
+	err = m.sendRoaming()
+	if err != nil {
+		return fmt.Errorf("Error setting roaming: %v", err)
+	}
+
+	return nil
+}
+
+// stopSession stops the data session
+func (m *Modem) stopSession() {
+	if m.config.BringUp == ModemBringUpQMI {
+		exec.Command("ip", "link", "set", m.iface, "down").Run()
+	} else if m.ppp != nil {
+		m.ppp.Stop()
+	} else {
+		exec.Command("poff").Run()
+	}
+}
@@ -0,0 +1,71 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func TestModemApplyProfile(t *testing.T) {
+	cases := []struct {
+		name    string
+		mtype   ModemType
+		profile data.CellularConfig
+		cpin    string
+		cmds    []string
+		err     bool
+	}{
+		{"operator and roaming", ModemEC25,
+			data.CellularConfig{APN: "a", Operator: "310410", DenyRoaming: true},
+			"+CPIN: READY",
+			[]string{"AT+CPIN?", "AT+QCCID", "AT+CIMI", `AT+COPS=4,2,"310410"`,
+				`AT+QCFG="roamservice",1,1`}, false},
+		{"PIN", ModemSIM7600,
+			data.CellularConfig{APN: "a", PIN: "1234"},
+			"+CPIN: SIM PIN",
+			[]string{"AT+CPIN?", `AT+CPIN="1234"`, "AT+COPS=0"}, false},
+		{"PIN required", ModemBG96,
+			data.CellularConfig{APN: "a"},
+			"+CPIN: SIM PIN",
+			[]string{"AT+CPIN?"}, true},
+		{"no SIM", ModemBG96,
+			data.CellularConfig{APN: "a", PIN: "1234"},
+			"+CME ERROR: 10",
+			[]string{"AT+CPIN?"}, true},
+	}
+
+	for _, c := range cases {
+		port := &fakePort{resp: map[string]string{
+			"AT+CPIN?":                  c.cpin + "\r\nOK\r\n",
+			"AT+QCCID":                  "+QCCID: 89014103211118510720\r\nOK\r\n",
+			"AT+CIMI":                   "310410123456789\r\nOK\r\n",
+			`AT+CPIN="1234"`:            "OK\r\n",
+			"AT+COPS=0":                 "OK\r\n",
+			`AT+COPS=4,2,"310410"`:      "OK\r\n",
+			`AT+QCFG="roamservice",1,1`: "OK\r\n",
+			`AT+QCFG="roamservice",2,1`: "OK\r\n",
+		}}
+
+		m := NewModem(ModemConfig{Type: c.mtype, DenyRoaming: c.profile.DenyRoaming})
+		m.atCmdPort = port
+		m.profile = &c.profile
+
+		m.applyProfile()
+
+		if (m.profileErr != nil) != c.err {
+			t.Errorf("%v: expected error %v, got %v", c.name, c.err, m.profileErr)
+		}
+
+		if !reflect.DeepEqual(port.cmds, c.cmds) {
+			t.Errorf("%v: expected commands %v, got %v", c.name, c.cmds, port.cmds)
+		}
+
+		// the profile is only applied once
+		port.cmds = nil
+		m.applyProfile()
+		if len(port.cmds) != 0 {
+			t.Errorf("%v: profile applied again: %v", c.name, port.cmds)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/system"
+)
+
+// ProvisionConfig describes the temporary access point used to provision
+// a device
+type ProvisionConfig struct {
+	// Iface is the WiFi interface (default wlan0)
+	Iface string
+	// SSID (default siot-setup) and Psk of the access point. If Psk is
+	// blank, the access point is open.
+	SSID string
+	Psk  string
+	// Address is the address of the device on the access point network
+	// (default 192.168.4.1). Clients are given addresses in the same /24.
+	Address string
+	// HostapdConf is where the hostapd config is written (default
+	// /tmp/siot-hostapd.conf)
+	HostapdConf string
+}
+
+// ProvisionResult is what the installer entered
+type ProvisionResult struct {
+	Wifi      data.WifiConfig
+	ServerURL string
+}
+
+// Provisioning runs a temporary WiFi access point (hostapd and dnsmasq)
+// with a small web page where an installer can enter WiFi credentials and
+// the server URL from a phone. This is typically started on first boot or
+// when a button is pressed. wpa_supplicant is disconnected while the
+// access point is up, and reconnected when it is stopped.
+type Provisioning struct {
+	config  ProvisionConfig
+	c       chan ProvisionResult
+	lock    sync.Mutex
+	server  *http.Server
+	hostapd *system.Process
+	dnsmasq *system.Process
+}
+
+// NewProvisioning creates a provisioning access point. Results are sent to
+// c when the installer submits the form. c should be buffered, results are
+// dropped if c is full.
+func NewProvisioning(config ProvisionConfig, c chan ProvisionResult) *Provisioning {
+	if config.Iface == "" {
+		config.Iface = "wlan0"
+	}
+
+	if config.SSID == "" {
+		config.SSID = "siot-setup"
+	}
+
+	if config.Address == "" {
+		config.Address = "192.168.4.1"
+	}
+
+	if config.HostapdConf == "" {
+		config.HostapdConf = "/tmp/siot-hostapd.conf"
+	}
+
+	return &Provisioning{config: config, c: c}
+}
+
+func (p *Provisioning) writeHostapdConf() error {
+	conf := fmt.Sprintf("interface=%v\ndriver=nl80211\nssid=%v\nhw_mode=g\nchannel=6\n",
+		p.config.Iface, p.config.SSID)
+
+	if p.config.Psk != "" {
+		conf += fmt.Sprintf("wpa=2\nwpa_key_mgmt=WPA-PSK\nrsn_pairwise=CCMP\nwpa_passphrase=%v\n",
+			p.config.Psk)
+	}
+
+	return ioutil.WriteFile(p.config.HostapdConf, []byte(conf), 0600)
+}
+
+// Start brings up the access point and provisioning web server
+func (p *Provisioning) Start() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.server != nil {
+		return nil
+	}
+
+	err := p.writeHostapdConf()
+	if err != nil {
+		return err
+	}
+
+	// the interface can't be a client and access point at the same time
+	exec.Command("wpa_cli", "-i", p.config.Iface, "disconnect").Run()
+
+	err = exec.Command("ip", "addr", "replace", p.config.Address+"/24", "dev",
+		p.config.Iface).Run()
+	if err != nil {
+		return fmt.Errorf("Error setting AP address: %v", err)
+	}
+
+	p.hostapd = system.NewProcess(system.ProcessConfig{
+		Command: "hostapd",
+		Args:    []string{p.config.HostapdConf},
+	})
+	err = p.hostapd.Start()
+	if err != nil {
+		p.hostapd = nil
+		return fmt.Errorf("Error starting hostapd: %v", err)
+	}
+
+	ip := p.config.Address
+	prefix := ip[:strings.LastIndex(ip, ".")]
+	p.dnsmasq = system.NewProcess(system.ProcessConfig{
+		Command: "dnsmasq",
+		Args: []string{"--no-daemon", "--bind-interfaces",
+			"--interface=" + p.config.Iface,
+			fmt.Sprintf("--dhcp-range=%v.100,%v.200,1h", prefix, prefix),
+			// send all names to the device so the page opens like a
+			// captive portal
+			"--address=/#/" + ip},
+	})
+	err = p.dnsmasq.Start()
+	if err != nil {
+		p.stopProcesses()
+		return fmt.Errorf("Error starting dnsmasq: %v", err)
+	}
+
+	p.server = &http.Server{Addr: ip + ":80", Handler: p}
+	go func(s *http.Server) {
+		err := s.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			netLog.Error("provisioning server error", "error", err)
+		}
+	}(p.server)
+
+	netLog.Info("provisioning AP started", "ssid", p.config.SSID)
+
+	return nil
+}
+
+func (p *Provisioning) stopProcesses() {
+	for _, proc := range []*system.Process{p.hostapd, p.dnsmasq} {
+		if proc != nil {
+			proc.Stop()
+		}
+	}
+
+	p.hostapd = nil
+	p.dnsmasq = nil
+}
+
+// Stop takes down the access point and switches back to client mode
+func (p *Provisioning) Stop() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.server == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p.server.Shutdown(ctx)
+	p.server = nil
+
+	p.stopProcesses()
+
+	exec.Command("ip", "addr", "del", p.config.Address+"/24", "dev",
+		p.config.Iface).Run()
+
+	return exec.Command("wpa_cli", "-i", p.config.Iface, "reconnect").Run()
+}
+
+var provisionPage = template.Must(template.New("provision").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Simple IoT Setup</title>
+</head>
+<body>
+<h1>Simple IoT Setup</h1>
+{{if .Error}}<p style="color:red">{{.Error}}</p>{{end}}
+{{if .Done}}<p>Settings saved, the device is connecting to {{.SSID}}.</p>{{else}}
+<form method="post">
+<p><label>WiFi network<br><input name="ssid" value="{{.SSID}}"></label></p>
+<p><label>Password<br><input name="psk" type="password"></label></p>
+<p><label>Server URL<br><input name="server" value="{{.Server}}"></label></p>
+<p><input type="submit" value="Save"></p>
+</form>{{end}}
+</body>
+</html>
+`))
+
+type provisionPageData struct {
+	SSID   string
+	Server string
+	Error  string
+	Done   bool
+}
+
+// ServeHTTP serves the provisioning page
+func (p *Provisioning) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	var d provisionPageData
+
+	if req.Method == http.MethodPost {
+		result := ProvisionResult{
+			Wifi: data.WifiConfig{
+				SSID: req.FormValue("ssid"),
+				Psk:  req.FormValue("psk"),
+			},
+			ServerURL: req.FormValue("server"),
+		}
+
+		d.SSID = result.Wifi.SSID
+		d.Server = result.ServerURL
+
+		err := result.Wifi.Validate()
+		if err == nil && result.ServerURL != "" {
+			var u *url.URL
+			u, err = url.Parse(result.ServerURL)
+			if err == nil && (u.Scheme != "http" && u.Scheme != "https" ||
+				u.Host == "") {
+				err = fmt.Errorf("server URL must be http(s)://host")
+			}
+		}
+
+		if err != nil {
+			res.WriteHeader(http.StatusBadRequest)
+			d.Error = err.Error()
+		} else {
+			d.Done = true
+			select {
+			case p.c <- result:
+			default:
+				netLog.Warn("provisioning result dropped, nobody listening")
+			}
+		}
+	}
+
+	res.Header().Set("Content-Type", "text/html")
+	provisionPage.Execute(res, d)
+}
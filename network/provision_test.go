@@ -0,0 +1,98 @@
+package network
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestProvisioningServeHTTP(t *testing.T) {
+	c := make(chan ProvisionResult, 1)
+	p := NewProvisioning(ProvisionConfig{}, c)
+
+	cases := []struct {
+		form   url.Values
+		status int
+		result *ProvisionResult
+	}{
+		{url.Values{"ssid": {"shop"}, "psk": {"12345678"},
+			"server": {"https://siot.example.com"}}, http.StatusOK,
+			&ProvisionResult{ServerURL: "https://siot.example.com"}},
+		{url.Values{"ssid": {"shop"}}, http.StatusOK, &ProvisionResult{}},
+		{url.Values{"ssid": {""}}, http.StatusBadRequest, nil},
+		{url.Values{"ssid": {"shop"}, "psk": {"short"}}, http.StatusBadRequest, nil},
+		{url.Values{"ssid": {"shop"}, "server": {"ftp://siot"}}, http.StatusBadRequest, nil},
+		{url.Values{"ssid": {"shop"}, "server": {"http://"}}, http.StatusBadRequest, nil},
+	}
+
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(tc.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res := httptest.NewRecorder()
+		p.ServeHTTP(res, req)
+
+		if res.Code != tc.status {
+			t.Errorf("%v: expected status %v, got %v", tc.form, tc.status, res.Code)
+		}
+
+		select {
+		case r := <-c:
+			if tc.result == nil {
+				t.Errorf("%v: unexpected result %+v", tc.form, r)
+			} else if r.Wifi.SSID != tc.form.Get("ssid") ||
+				r.Wifi.Psk != tc.form.Get("psk") || r.ServerURL != tc.result.ServerURL {
+				t.Errorf("%v: wrong result %+v", tc.form, r)
+			}
+		default:
+			if tc.result != nil {
+				t.Errorf("%v: no result", tc.form)
+			}
+		}
+	}
+
+	// the form is shown for GET
+	res := httptest.NewRecorder()
+	p.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/", nil))
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), "<form") {
+		t.Errorf("form not served: %v", res.Code)
+	}
+}
+
+func TestProvisioningHostapdConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-provision")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, psk := range []string{"", "setup1234"} {
+		conf := path.Join(dir, "hostapd.conf")
+		p := NewProvisioning(ProvisionConfig{Psk: psk, HostapdConf: conf}, nil)
+
+		err := p.writeHostapdConf()
+		if err != nil {
+			t.Fatal("Error writing config: ", err)
+		}
+
+		d, err := ioutil.ReadFile(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := string(d)
+		if !strings.Contains(s, "interface=wlan0\n") ||
+			!strings.Contains(s, "ssid=siot-setup\n") {
+			t.Errorf("missing defaults:\n%v", s)
+		}
+
+		if secured := strings.Contains(s, "wpa_passphrase=setup1234\n"); secured != (psk != "") {
+			t.Errorf("psk %q: wrong security:\n%v", psk, s)
+		}
+	}
+}
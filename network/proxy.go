@@ -0,0 +1,74 @@
+package network
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ProxyConfig is an outbound HTTP/HTTPS proxy used for upstream
+// connections, for networks that only allow egress through a proxy
+type ProxyConfig struct {
+	// URL of the proxy (http://proxy.example.com:3128)
+	URL string
+	// User and Password are used for proxy authentication. They can also
+	// be set in URL.
+	User     string
+	Password string
+	// NoProxy are hosts (or domain suffixes starting with .) that are
+	// connected to directly
+	NoProxy []string
+}
+
+func (c ProxyConfig) bypass(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for _, np := range c.NoProxy {
+		if host == np || strings.HasPrefix(np, ".") && strings.HasSuffix(host, np) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ProxyFunc returns a function that can be used for http.Transport.Proxy
+// and websocket.Dialer.Proxy
+func (c ProxyConfig) ProxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	proxyURL, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.User != "" {
+		proxyURL.User = url.UserPassword(c.User, c.Password)
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		if c.bypass(req.URL.Host) {
+			return nil, nil
+		}
+
+		return proxyURL, nil
+	}, nil
+}
+
+// Client returns an HTTP client that connects through the proxy. If URL is
+// blank, the client uses the proxy environment variables (HTTPS_PROXY,
+// etc) like the default client.
+func (c ProxyConfig) Client() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if c.URL != "" {
+		proxy, err := c.ProxyFunc()
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = proxy
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,76 @@
+package network
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyFunc(t *testing.T) {
+	c := ProxyConfig{URL: "http://proxy.example.com:3128", User: "siot",
+		Password: "secret", NoProxy: []string{"localhost", ".local"}}
+
+	proxy, err := c.ProxyFunc()
+	if err != nil {
+		t.Fatal("Error creating proxy func: ", err)
+	}
+
+	cases := []struct {
+		url    string
+		direct bool
+	}{
+		{"https://portal.simpleiot.org/v1/devices", false},
+		{"http://localhost:8080/", true},
+		{"http://gateway.local/", true},
+		{"http://gateway.local:8118/", true},
+		// suffixes must start with .
+		{"http://notlocalhost/", false},
+		{"http://local/", false},
+	}
+
+	for _, c := range cases {
+		u, err := proxy(httptest.NewRequest(http.MethodGet, c.url, nil))
+		if err != nil {
+			t.Fatal("Error getting proxy: ", err)
+		}
+
+		if c.direct {
+			if u != nil {
+				t.Errorf("%v: expected direct connection, got %v", c.url, u)
+			}
+			continue
+		}
+
+		if u == nil || u.Host != "proxy.example.com:3128" || u.User.String() != "siot:secret" {
+			t.Errorf("%v: unexpected proxy %v", c.url, u)
+		}
+	}
+
+	if _, err := (ProxyConfig{URL: "http://[::1"}).ProxyFunc(); err == nil {
+		t.Error("expected error for invalid URL")
+	}
+}
+
+func TestProxyClient(t *testing.T) {
+	// the proxy answers for every host
+	var hosts []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		hosts = append(hosts, req.Host)
+	}))
+	defer proxy.Close()
+
+	client, err := ProxyConfig{URL: proxy.URL}.Client()
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+
+	resp, err := client.Get("http://siot.invalid/v1/ping")
+	if err != nil {
+		t.Fatal("Error sending request through proxy: ", err)
+	}
+	resp.Body.Close()
+
+	if len(hosts) != 1 || hosts[0] != "siot.invalid" {
+		t.Errorf("request not sent through proxy: %v", hosts)
+	}
+}
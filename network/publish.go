@@ -0,0 +1,124 @@
+package network
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// Status returns the status of the active interface from the last Run
+func (m *Manager) Status() InterfaceStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.status
+}
+
+// Failovers returns the number of times the manager has changed the
+// active interface
+func (m *Manager) Failovers() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.failovers
+}
+
+// Samples returns the manager status as samples: the active interface
+// status, the network state, and the failover count. The active interface
+// is added as the iface tag.
+func (m *Manager) Samples(id string) []data.Sample {
+	now := m.now()
+	status := m.Status()
+
+	ret := status.Samples(id)
+	ret = append(ret,
+		data.Sample{Type: "netState", ID: id, Value: float64(m.State()), Time: now},
+		data.Sample{Type: "netFailovers", ID: id, Value: float64(m.Failovers()), Time: now},
+	)
+
+	desc := m.Desc()
+	for i := range ret {
+		if ret[i].Tags == nil {
+			ret[i].Tags = make(map[string]string)
+		}
+		ret[i].Tags["iface"] = desc
+	}
+
+	return ret
+}
+
+// ManagerStatus is the state of the manager returned by ServeHTTP
+type ManagerStatus struct {
+	State     string          `json:"state"`
+	Active    string          `json:"active"`
+	Status    InterfaceStatus `json:"status"`
+	Failovers int             `json:"failovers"`
+	History   []Transition    `json:"history"`
+}
+
+// ServeHTTP returns the manager state, the active interface and its status
+// (like signal levels for a modem), and recent failovers as JSON
+func (m *Manager) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	json.NewEncoder(res).Encode(ManagerStatus{
+		State:     m.State().String(),
+		Active:    m.Desc(),
+		Status:    m.Status(),
+		Failovers: m.Failovers(),
+		History:   m.History(),
+	})
+}
+
+// StatusPublisher periodically sends the network status as samples so
+// network health shows up in dashboards and rules like any other signal.
+// send is typically api.NewSendSamples, or IngestQueue.Enqueue when running
+// on the server.
+type StatusPublisher struct {
+	manager  *Manager
+	id       string
+	interval time.Duration
+	send     func([]data.Sample) error
+	stop     chan struct{}
+}
+
+// NewStatusPublisher creates a status publisher. id is used as the sample
+// ID.
+func NewStatusPublisher(manager *Manager, id string, interval time.Duration,
+	send func([]data.Sample) error) *StatusPublisher {
+	return &StatusPublisher{
+		manager:  manager,
+		id:       id,
+		interval: interval,
+		send:     send,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start sends status until Stop is called
+func (p *StatusPublisher) Start() {
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := p.send(p.manager.Samples(p.id))
+				if err != nil {
+					netLog.Error("error sending status", "error", err)
+				}
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops sending status
+func (p *StatusPublisher) Stop() {
+	close(p.stop)
+}
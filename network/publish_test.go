@@ -0,0 +1,102 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// sampleValues returns the sample values by type
+func sampleValues(samples []data.Sample) map[string]float64 {
+	ret := make(map[string]float64)
+	for _, s := range samples {
+		ret[s.Type] = s.Value
+	}
+
+	return ret
+}
+
+func TestInterfaceStatusSamples(t *testing.T) {
+	status := InterfaceStatus{
+		Connected:  true,
+		Signal:     -85,
+		Rsrq:       -11,
+		Roaming:    true,
+		Operator:   "AT&T",
+		AccessTech: AccessTechLTE,
+		Latency: LinkStats{Probes: 4, RttAvg: 80 * time.Millisecond,
+			RttMax: 120 * time.Millisecond, Loss: 0.25},
+	}
+
+	samples := status.Samples("dev1")
+	exp := map[string]float64{"netConnected": 1, "rssi": -85, "rsrq": -11,
+		"roaming": 1, "rttAvg": 80, "rttMax": 120, "packetLoss": 25}
+
+	values := sampleValues(samples)
+	if len(values) != len(exp) {
+		t.Errorf("expected %v, got %v", exp, values)
+	}
+
+	for k, v := range exp {
+		if values[k] != v {
+			t.Errorf("%v: expected %v, got %v", k, v, values[k])
+		}
+	}
+
+	for _, s := range samples {
+		if s.ID != "dev1" || s.Tags["operator"] != "AT&T" ||
+			s.Tags["accessTech"] != AccessTechLTE {
+			t.Errorf("unexpected sample ID or tags: %+v", s)
+		}
+	}
+
+	// only the connected state when nothing else is known
+	if samples := (InterfaceStatus{}).Samples("dev1"); len(samples) != 1 ||
+		samples[0].Value != 0 {
+		t.Errorf("expected only netConnected, got %+v", samples)
+	}
+}
+
+func TestManagerSamples(t *testing.T) {
+	clock := &testClock{t: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	m := newManager(2, clock.now)
+	m.AddInterface(NewScriptedDummyInterface(DummyConfig{Desc: "eth", Now: clock.now}))
+	m.runOnce(m.State())
+
+	samples := m.Samples("dev1")
+	values := sampleValues(samples)
+	if values["netConnected"] != 1 || values["netState"] != float64(StateConnected) ||
+		values["netFailovers"] != 0 {
+		t.Errorf("unexpected samples: %v", values)
+	}
+
+	for _, s := range samples {
+		if s.Tags["iface"] != "eth" {
+			t.Errorf("%v: expected iface tag, got %v", s.Type, s.Tags)
+		}
+	}
+}
+
+func TestStatusPublisher(t *testing.T) {
+	m := newManager(2, time.Now)
+	m.AddInterface(NewDummyInterface())
+
+	sent := make(chan []data.Sample, 10)
+	p := NewStatusPublisher(m, "dev1", time.Millisecond, func(s []data.Sample) error {
+		sent <- s
+		return nil
+	})
+
+	p.Start()
+	defer p.Stop()
+
+	select {
+	case s := <-sent:
+		if len(s) <= 0 || s[0].ID != "dev1" {
+			t.Errorf("unexpected samples: %+v", s)
+		}
+	case <-time.After(time.Second):
+		t.Error("timeout waiting for status")
+	}
+}
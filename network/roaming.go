@@ -0,0 +1,53 @@
+package network
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrRoaming is returned by Modem.Connect if the modem is roaming and
+// roaming is denied
+var ErrRoaming = errors.New("roaming not allowed")
+
+// CmdQcfgRoaming enables or disables roaming in Quectel modems. The
+// setting takes effect immediately.
+func CmdQcfgRoaming(port io.ReadWriter, allow bool) error {
+	if allow {
+		return CmdOK(port, "AT+QCFG=\"roamservice\",2,1")
+	}
+
+	return CmdOK(port, "AT+QCFG=\"roamservice\",1,1")
+}
+
+// roaming returns true if the modem is registered on a roaming network.
+// Must be called with m.lock held and the AT command port open.
+func (m *Modem) roaming() (bool, error) {
+	stat, err := CmdRegStatus(m.atCmdPort, "AT+CEREG?")
+	if err != nil || stat == RegRoaming || stat == RegHome {
+		return stat == RegRoaming, err
+	}
+
+	// may be on 2G/3G
+	stat, err = CmdRegStatus(m.atCmdPort, "AT+CGREG?")
+	return stat == RegRoaming, err
+}
+
+// sendRoaming sends the roaming policy to modems that can enforce it
+func (m *Modem) sendRoaming() error {
+	switch m.config.Type {
+	case ModemBG96, ModemEC25:
+		return CmdQcfgRoaming(m.atCmdPort, !m.config.DenyRoaming)
+	}
+
+	// other modems are enforced by not starting a data session
+	return nil
+}
+
+// SetDenyRoaming sets whether data sessions are allowed while roaming. If
+// roaming is denied and the modem is roaming, the data session is stopped.
+func (m *Modem) SetDenyRoaming(deny bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.config.DenyRoaming = deny
+	m.profilePending = true
+}
@@ -0,0 +1,73 @@
+package network
+
+import (
+	"testing"
+)
+
+func TestModemRoaming(t *testing.T) {
+	cases := []struct {
+		name  string
+		cereg string
+		cgreg string
+		exp   bool
+		err   bool
+	}{
+		{"LTE home", "+CEREG: 0,1", "", false, false},
+		{"LTE roaming", "+CEREG: 0,5", "", true, false},
+		{"3G roaming", "+CEREG: 0,0", "+CGREG: 0,5", true, false},
+		{"3G home", "+CEREG: 0,2", "+CGREG: 0,1", false, false},
+		{"not registered", "+CEREG: 0,0", "+CGREG: 0,0", false, false},
+		{"error", "+CEREG: 0,0", "", false, true},
+	}
+
+	for _, c := range cases {
+		resp := map[string]string{"AT+CEREG?": c.cereg + "\r\n\r\nOK\r\n"}
+		if c.cgreg != "" {
+			resp["AT+CGREG?"] = c.cgreg + "\r\n\r\nOK\r\n"
+		}
+
+		m := NewModem(ModemConfig{Type: ModemEC25})
+		m.atCmdPort = &fakePort{resp: resp}
+
+		roaming, err := m.roaming()
+		if (err != nil) != c.err {
+			t.Errorf("%v: unexpected error: %v", c.name, err)
+			continue
+		}
+
+		if roaming != c.exp {
+			t.Errorf("%v: expected roaming %v", c.name, c.exp)
+		}
+	}
+}
+
+func TestModemSendRoaming(t *testing.T) {
+	cases := []struct {
+		mtype ModemType
+		deny  bool
+		cmds  []string
+	}{
+		{ModemBG96, true, []string{`AT+QCFG="roamservice",1,1`}},
+		{ModemEC25, false, []string{`AT+QCFG="roamservice",2,1`}},
+		// enforced by not starting a data session
+		{ModemSIM7600, true, nil},
+	}
+
+	for _, c := range cases {
+		port := &fakePort{resp: map[string]string{
+			`AT+QCFG="roamservice",1,1`: "OK\r\n",
+			`AT+QCFG="roamservice",2,1`: "OK\r\n",
+		}}
+
+		m := NewModem(ModemConfig{Type: c.mtype, DenyRoaming: c.deny})
+		m.atCmdPort = port
+
+		if err := m.sendRoaming(); err != nil {
+			t.Errorf("%v: error sending roaming policy: %v", c.mtype, err)
+		}
+
+		if len(port.cmds) != len(c.cmds) || len(c.cmds) > 0 && port.cmds[0] != c.cmds[0] {
+			t.Errorf("%v: expected %v, got %v", c.mtype, c.cmds, port.cmds)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package network
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ifaceNamer is implemented by interfaces that have a kernel network
+// interface, so their routes can be managed
+type ifaceNamer interface {
+	IfaceName() string
+}
+
+// IfaceName returns the kernel interface name
+func (e *Ethernet) IfaceName() string { return e.iface }
+
+// IfaceName returns the kernel interface name
+func (w *Wifi) IfaceName() string { return w.iface }
+
+// IfaceName returns the kernel interface name of the data session
+func (m *Modem) IfaceName() string { return m.iface }
+
+// IfaceName returns the kernel interface name
+func (n *NMInterface) IfaceName() string { return n.iface }
+
+// defaultRoute is a parsed default route
+type defaultRoute struct {
+	via    string
+	dev    string
+	metric int
+}
+
+// defaultRoutes returns the default routes from ip route
+func defaultRoutes() ([]defaultRoute, error) {
+	out, err := exec.Command("ip", "route", "show", "default").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	return parseDefaultRoutes(string(out)), nil
+}
+
+// parseDefaultRoutes parses ip route show default output
+func parseDefaultRoutes(out string) []defaultRoute {
+	var ret []defaultRoute
+
+	// default via 192.168.1.1 dev eth0 proto dhcp metric 100
+	// default dev ppp0 scope link
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 1 || fields[0] != "default" {
+			continue
+		}
+
+		var r defaultRoute
+		for i := 1; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "via":
+				r.via = fields[i+1]
+			case "dev":
+				r.dev = fields[i+1]
+			case "metric":
+				r.metric, _ = strconv.Atoi(fields[i+1])
+			}
+		}
+
+		ret = append(ret, r)
+	}
+
+	return ret
+}
+
+func (r defaultRoute) String() string {
+	ret := "dev " + r.dev
+	if r.via != "" {
+		ret = "via " + r.via + " " + ret
+	}
+
+	return ret + " metric " + strconv.Itoa(r.metric)
+}
+
+// setMetric replaces a default route with one using metric
+func (r defaultRoute) setMetric(metric int) error {
+	args := []string{"route", "add", "default"}
+	if r.via != "" {
+		args = append(args, "via", r.via)
+	}
+	args = append(args, "dev", r.dev, "metric", strconv.Itoa(metric))
+
+	err := runCommand("ip", args...)
+	if err != nil {
+		return err
+	}
+
+	args = []string{"route", "del", "default"}
+	if r.via != "" {
+		args = append(args, "via", r.via)
+	}
+	args = append(args, "dev", r.dev, "metric", strconv.Itoa(r.metric))
+
+	return runCommand("ip", args...)
+}
+
+// SetRouteMetrics enables route metric management. The active interface
+// gets metric base, and the others base + 100 * (priority + 1), so traffic
+// only moves to a higher priority interface when the manager fails back
+// to it.
+func (m *Manager) SetRouteMetrics(enable bool, base int) {
+	m.routeMetrics = enable
+	m.routeMetricBase = base
+}
+
+// DefaultRoute returns the default route the kernel is using
+func (m *Manager) DefaultRoute() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.defaultRoute
+}
+
+// metric returns the route metric for interface index
+func (m *Manager) metric(index int) int {
+	if index == m.interfaceIndex {
+		return m.routeMetricBase
+	}
+
+	return m.routeMetricBase + 100*(index+1)
+}
+
+// updateRoutes sets the default route metrics and records the default
+// route in use
+func (m *Manager) updateRoutes() {
+	routes, err := defaultRoutes()
+	if err != nil {
+		netLog.Error("error reading routes", "error", err)
+		return
+	}
+
+	if m.routeMetrics {
+		for i, iface := range m.interfaces {
+			namer, ok := iface.(ifaceNamer)
+			if !ok {
+				continue
+			}
+
+			metric := m.metric(i)
+			for j, r := range routes {
+				if r.dev != namer.IfaceName() || r.metric == metric {
+					continue
+				}
+
+				err := r.setMetric(metric)
+				if err != nil {
+					netLog.Error("error setting route metric", "interface", r.dev,
+						"error", err)
+					continue
+				}
+
+				routes[j].metric = metric
+			}
+		}
+	}
+
+	active := activeRoute(routes)
+
+	m.lock.Lock()
+	m.defaultRoute = active
+	m.lock.Unlock()
+}
+
+// activeRoute returns the default route with the lowest metric, which is
+// the one the kernel uses
+func activeRoute(routes []defaultRoute) string {
+	var ret string
+	best := -1
+	for _, r := range routes {
+		if best < 0 || r.metric < best {
+			best = r.metric
+			ret = r.String()
+		}
+	}
+
+	return ret
+}
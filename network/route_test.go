@@ -0,0 +1,68 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseDefaultRoutes(t *testing.T) {
+	out := "default via 192.168.1.1 dev eth0 proto dhcp metric 100 \n" +
+		"default dev ppp0 scope link \n" +
+		"default via 10.64.64.64 dev wwan0 metric 300\n"
+
+	exp := []defaultRoute{
+		{via: "192.168.1.1", dev: "eth0", metric: 100},
+		{dev: "ppp0"},
+		{via: "10.64.64.64", dev: "wwan0", metric: 300},
+	}
+
+	routes := parseDefaultRoutes(out)
+	if !reflect.DeepEqual(routes, exp) {
+		t.Fatalf("expected %+v, got %+v", exp, routes)
+	}
+
+	if s := routes[0].String(); s != "via 192.168.1.1 dev eth0 metric 100" {
+		t.Errorf("unexpected route string: %v", s)
+	}
+
+	if s := routes[1].String(); s != "dev ppp0 metric 0" {
+		t.Errorf("unexpected route string: %v", s)
+	}
+
+	if routes := parseDefaultRoutes(""); len(routes) != 0 {
+		t.Errorf("expected no routes, got %+v", routes)
+	}
+}
+
+func TestActiveRoute(t *testing.T) {
+	routes := []defaultRoute{
+		{via: "192.168.1.1", dev: "eth0", metric: 200},
+		{via: "10.64.64.64", dev: "wwan0", metric: 100},
+		{via: "192.168.4.1", dev: "wlan0", metric: 100},
+	}
+
+	if r := activeRoute(routes); r != "via 10.64.64.64 dev wwan0 metric 100" {
+		t.Errorf("unexpected active route: %v", r)
+	}
+
+	if r := activeRoute(nil); r != "" {
+		t.Errorf("expected no active route, got %v", r)
+	}
+}
+
+func TestManagerMetric(t *testing.T) {
+	m := newManager(2, time.Now)
+	m.AddInterface(NewDummyInterface())
+	m.AddInterface(NewDummyInterface())
+	m.AddInterface(NewDummyInterface())
+	m.SetRouteMetrics(true, 50)
+	m.interfaceIndex = 1
+
+	exp := []int{150, 50, 350}
+	for i, e := range exp {
+		if metric := m.metric(i); metric != e {
+			t.Errorf("interface %v: expected metric %v, got %v", i, e, metric)
+		}
+	}
+}
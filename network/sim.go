@@ -0,0 +1,158 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// SIM states returned by CmdCpin
+const (
+	SimReady       = "READY"
+	SimPIN         = "SIM PIN"
+	SimPUK         = "SIM PUK"
+	SimNotInserted = "NOT INSERTED"
+)
+
+// define SIM errors returned by Modem.Connect
+var (
+	ErrNoSim       = errors.New("SIM not inserted")
+	ErrPINRequired = errors.New("SIM PIN required")
+	ErrPUKLocked   = errors.New("SIM PUK locked")
+)
+
+// SimStatus describes the SIM card in a modem
+type SimStatus struct {
+	Present bool
+	// State is one of the Sim* states
+	State string
+	Iccid string
+	Imsi  string
+	// Slot is the active SIM slot or eUICC profile
+	Slot int
+}
+
+// Err returns an error describing why the SIM can't be used, or nil if it
+// is ready
+func (s SimStatus) Err() error {
+	switch {
+	case !s.Present:
+		return ErrNoSim
+	case s.State == SimReady:
+		return nil
+	case s.State == SimPIN:
+		return ErrPINRequired
+	case s.State == SimPUK:
+		return ErrPUKLocked
+	default:
+		return fmt.Errorf("SIM not ready: %v", s.State)
+	}
+}
+
+// +CPIN: READY
+var reCpin = regexp.MustCompile(`\+CPIN:\s*(.+)`)
+
+// +CME ERROR: 10 or +CME ERROR: SIM not inserted
+var reCpinNoSim = regexp.MustCompile(`CME ERROR:\s*(10|SIM not inserted)`)
+
+// CmdCpin returns the SIM lock state (SimReady, SimPIN, SimPUK, etc).
+// SimNotInserted is returned if there is no SIM.
+func CmdCpin(port io.ReadWriter) (string, error) {
+	resp, err := Cmd(port, "AT+CPIN?")
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(resp, "\n") {
+		if reCpinNoSim.MatchString(line) {
+			return SimNotInserted, nil
+		}
+
+		matches := reCpin.FindStringSubmatch(line)
+		if len(matches) >= 2 {
+			return strings.TrimSpace(matches[1]), nil
+		}
+	}
+
+	return "", fmt.Errorf("Error parsing AT+CPIN response: %v", resp)
+}
+
+// CmdEnterPin unlocks the SIM
+func CmdEnterPin(port io.ReadWriter, pin string) error {
+	return CmdOK(port, "AT+CPIN=\""+pin+"\"")
+}
+
+// CmdGetIccid returns the SIM ICCID using AT+CICCID (SIMCom modems). Use
+// CmdGetSimBg96 for Quectel modems.
+func CmdGetIccid(port io.ReadWriter) (string, error) {
+	resp, err := Cmd(port, "AT+CICCID")
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(resp, "\n") {
+		matches := reCmdSim.FindStringSubmatch(line)
+		if len(matches) >= 2 {
+			return matches[1], nil
+		}
+	}
+
+	return "", fmt.Errorf("Error parsing AT+CICCID response: %v", resp)
+}
+
+// 310260123456789
+var reCimi = regexp.MustCompile(`^(\d{6,15})$`)
+
+// CmdGetImsi returns the SIM IMSI
+func CmdGetImsi(port io.ReadWriter) (string, error) {
+	resp, err := Cmd(port, "AT+CIMI")
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(resp, "\n") {
+		matches := reCimi.FindStringSubmatch(strings.TrimSpace(line))
+		if len(matches) >= 2 {
+			return matches[1], nil
+		}
+	}
+
+	return "", fmt.Errorf("Error parsing AT+CIMI response: %v", resp)
+}
+
+// simStatus reads the SIM status. The ICCID and IMSI are only read once
+// after the modem is reset. Must be called with m.lock held and the AT
+// command port open.
+func (m *Modem) simStatus() (SimStatus, error) {
+	state, err := CmdCpin(m.atCmdPort)
+	if err != nil {
+		return SimStatus{}, err
+	}
+
+	if state == SimNotInserted {
+		m.sim = SimStatus{State: state}
+		return m.sim, nil
+	}
+
+	m.sim.Present = true
+	m.sim.State = state
+
+	// the IMSI can't be read until the SIM is unlocked
+	if state != SimReady || m.sim.Iccid != "" {
+		return m.sim, nil
+	}
+
+	if m.config.Type == ModemSIM7600 {
+		m.sim.Iccid, err = CmdGetIccid(m.atCmdPort)
+	} else {
+		m.sim.Iccid, err = CmdGetSimBg96(m.atCmdPort)
+	}
+	if err != nil {
+		return m.sim, err
+	}
+
+	m.sim.Imsi, err = CmdGetImsi(m.atCmdPort)
+	return m.sim, err
+}
@@ -0,0 +1,109 @@
+package network
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCmdCpin(t *testing.T) {
+	cases := []struct {
+		resp  string
+		state string
+		err   bool
+	}{
+		{"+CPIN: READY\r\n\r\nOK\r\n", SimReady, false},
+		{"+CPIN: SIM PIN\r\n\r\nOK\r\n", SimPIN, false},
+		{"+CPIN: SIM PUK\r\n\r\nOK\r\n", SimPUK, false},
+		{"+CME ERROR: 10\r\n", SimNotInserted, false},
+		{"+CME ERROR: SIM not inserted\r\n", SimNotInserted, false},
+		{"+CME ERROR: 13\r\n", "", true},
+		{"ERROR\r\n", "", true},
+	}
+
+	for _, c := range cases {
+		state, err := CmdCpin(&fakePort{resp: map[string]string{"AT+CPIN?": c.resp}})
+		if (err != nil) != c.err {
+			t.Errorf("%q: unexpected error: %v", c.resp, err)
+			continue
+		}
+
+		if state != c.state {
+			t.Errorf("%q: expected %q, got %q", c.resp, c.state, state)
+		}
+	}
+}
+
+func TestSimStatusErr(t *testing.T) {
+	cases := []struct {
+		status SimStatus
+		err    error
+	}{
+		{SimStatus{State: SimNotInserted}, ErrNoSim},
+		{SimStatus{Present: true, State: SimReady}, nil},
+		{SimStatus{Present: true, State: SimPIN}, ErrPINRequired},
+		{SimStatus{Present: true, State: SimPUK}, ErrPUKLocked},
+	}
+
+	for _, c := range cases {
+		if err := c.status.Err(); !errors.Is(err, c.err) {
+			t.Errorf("%v: expected %v, got %v", c.status.State, c.err, err)
+		}
+	}
+
+	if (SimStatus{Present: true, State: "PH-SIM PIN"}).Err() == nil {
+		t.Error("expected error for unknown state")
+	}
+}
+
+func TestModemSimStatus(t *testing.T) {
+	cases := []struct {
+		mtype ModemType
+		iccid string
+	}{
+		{ModemSIM7600, "AT+CICCID"},
+		{ModemBG96, "AT+QCCID"},
+	}
+
+	for _, c := range cases {
+		port := &fakePort{resp: map[string]string{
+			"AT+CPIN?": "+CPIN: READY\r\nOK\r\n",
+			c.iccid:    "+ICCID: 89014103211118510720\r\nOK\r\n",
+			"AT+CIMI":  "310410123456789\r\nOK\r\n",
+		}}
+
+		m := NewModem(ModemConfig{Type: c.mtype})
+		m.atCmdPort = port
+
+		sim, err := m.simStatus()
+		if err != nil {
+			t.Fatal("Error reading SIM status: ", err)
+		}
+
+		exp := SimStatus{Present: true, State: SimReady,
+			Iccid: "89014103211118510720", Imsi: "310410123456789"}
+		if sim != exp {
+			t.Errorf("%v: expected %+v, got %+v", c.mtype, exp, sim)
+		}
+
+		// the ICCID and IMSI are only read once
+		port.cmds = nil
+		if _, err := m.simStatus(); err != nil {
+			t.Fatal("Error reading SIM status: ", err)
+		}
+
+		if len(port.cmds) != 1 || port.cmds[0] != "AT+CPIN?" {
+			t.Errorf("%v: expected only AT+CPIN?, got %v", c.mtype, port.cmds)
+		}
+
+		// removing the SIM clears the cached values
+		port.resp["AT+CPIN?"] = "+CME ERROR: 10\r\n"
+		sim, err = m.simStatus()
+		if err != nil {
+			t.Fatal("Error reading SIM status: ", err)
+		}
+
+		if sim.Present || sim.Iccid != "" || sim.Err() != ErrNoSim {
+			t.Errorf("%v: SIM removal not detected: %+v", c.mtype, sim)
+		}
+	}
+}
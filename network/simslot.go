@@ -0,0 +1,88 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// defaultSimFailover is how long the modem must be unable to register
+// before switching to the next SIM
+const defaultSimFailover = 5 * time.Minute
+
+// CmdQdsim selects the SIM slot (0 or 1) on Quectel dual SIM modems
+func CmdQdsim(port io.ReadWriter, slot int) error {
+	return CmdOK(port, "AT+QDSIM="+strconv.Itoa(slot))
+}
+
+// selectSim switches to SIM slot. Must be called with m.lock held and the
+// AT command port open.
+func (m *Modem) selectSim(slot int) error {
+	if m.config.SelectSim != nil {
+		return m.config.SelectSim(slot)
+	}
+
+	if m.config.Type == ModemSIM7600 {
+		return fmt.Errorf("SIM selection not supported on %v", m.config.Type)
+	}
+
+	return CmdQdsim(m.atCmdPort, slot)
+}
+
+// ActiveSim returns the active SIM slot or eUICC profile
+func (m *Modem) ActiveSim() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.activeSim()
+}
+
+func (m *Modem) activeSim() int {
+	if len(m.config.SimSlots) <= 0 {
+		return 0
+	}
+
+	return m.config.SimSlots[m.simIndex]
+}
+
+// checkSimFailover switches to the next SIM in the priority list if the
+// modem has not been able to register for SimFailover. Must be called
+// with m.lock held and the AT command port open.
+func (m *Modem) checkSimFailover(reg bool) {
+	if len(m.config.SimSlots) < 2 || reg {
+		m.unregSince = time.Time{}
+		return
+	}
+
+	if m.unregSince.IsZero() {
+		m.unregSince = time.Now()
+		return
+	}
+
+	failover := m.config.SimFailover
+	if failover == 0 {
+		failover = defaultSimFailover
+	}
+
+	if time.Since(m.unregSince) < failover {
+		return
+	}
+
+	m.unregSince = time.Time{}
+	from := m.activeSim()
+	m.simIndex = (m.simIndex + 1) % len(m.config.SimSlots)
+	to := m.activeSim()
+
+	modemLog.Warn("not registered, switching SIM", "from", from, "to", to)
+
+	err := m.selectSim(to)
+	if err != nil {
+		modemLog.Error("error selecting SIM", "error", err)
+		return
+	}
+
+	// the new SIM may need a PIN, and has a different ICCID
+	m.profilePending = true
+	m.sim = SimStatus{}
+	m.stopSession()
+}
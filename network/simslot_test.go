@@ -0,0 +1,87 @@
+package network
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestModemSelectSim(t *testing.T) {
+	port := &fakePort{resp: map[string]string{"AT+QDSIM=1": "OK\r\n"}}
+	m := NewModem(ModemConfig{Type: ModemEC25})
+	m.atCmdPort = port
+
+	if err := m.selectSim(1); err != nil {
+		t.Error("Error selecting SIM: ", err)
+	}
+
+	if err := NewModem(ModemConfig{Type: ModemSIM7600}).selectSim(1); err == nil {
+		t.Error("SIM7600 SIM selection accepted")
+	}
+}
+
+func TestModemSimFailover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// poff can't be found when the session is stopped
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+
+	var selected []int
+	m := NewModem(ModemConfig{Type: ModemSIM7600, SimSlots: []int{1, 0},
+		SimFailover: time.Minute,
+		SelectSim: func(slot int) error {
+			selected = append(selected, slot)
+			return nil
+		}})
+
+	if m.ActiveSim() != 1 {
+		t.Fatalf("expected SIM 1 active, got %v", m.ActiveSim())
+	}
+
+	// starts the timer
+	m.checkSimFailover(false)
+	m.checkSimFailover(false)
+	if len(selected) != 0 {
+		t.Fatal("switched SIM before the failover time")
+	}
+
+	// registering resets the timer
+	m.checkSimFailover(true)
+	if !m.unregSince.IsZero() {
+		t.Fatal("registration did not reset the failover timer")
+	}
+
+	m.checkSimFailover(false)
+	m.unregSince = m.unregSince.Add(-time.Minute)
+	m.sim = SimStatus{Present: true, State: SimReady, Iccid: "89014103211118510720"}
+	m.checkSimFailover(false)
+	if len(selected) != 1 || selected[0] != 0 || m.ActiveSim() != 0 {
+		t.Fatalf("expected switch to SIM 0, got %v", selected)
+	}
+
+	if m.sim.Iccid != "" || !m.profilePending {
+		t.Error("SIM status not reset after switching")
+	}
+
+	// wraps around to the first SIM
+	m.checkSimFailover(false)
+	m.unregSince = m.unregSince.Add(-time.Minute)
+	m.checkSimFailover(false)
+	if m.ActiveSim() != 1 {
+		t.Errorf("expected switch back to SIM 1, got %v", m.ActiveSim())
+	}
+}
+
+func TestModemSimFailoverSingle(t *testing.T) {
+	m := NewModem(ModemConfig{Type: ModemEC25, SimSlots: []int{0}})
+	m.checkSimFailover(false)
+	if !m.unregSince.IsZero() {
+		t.Error("failover timer started with one SIM")
+	}
+}
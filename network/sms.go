@@ -0,0 +1,387 @@
+package network
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// SMS is a text message
+type SMS struct {
+	// Number is the sender for received messages, and the recipient for
+	// sent messages
+	Number string
+	Time   time.Time
+	Text   string
+}
+
+// maxSMSLength is the max length of a single part text mode message
+const maxSMSLength = 160
+
+// gsm7 is the GSM 03.38 default alphabet. 0x1b is the escape to the
+// extension table.
+var gsm7 = []rune("@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞ\x1bÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà")
+
+var gsm7Ext = map[byte]rune{
+	0x0a: '\f',
+	0x14: '^',
+	0x28: '{',
+	0x29: '}',
+	0x2f: '\\',
+	0x3c: '[',
+	0x3d: '~',
+	0x3e: ']',
+	0x40: '|',
+	0x65: '€',
+}
+
+// unpackSeptets unpacks count 7 bit characters from data. fill is the
+// number of fill bits at the start of data.
+func unpackSeptets(data []byte, count, fill int) []byte {
+	ret := make([]byte, 0, count)
+	for i := 0; i < count; i++ {
+		bit := i*7 + fill
+		b := bit / 8
+		shift := uint(bit % 8)
+		if b >= len(data) {
+			break
+		}
+
+		v := data[b] >> shift
+		if shift > 1 && b+1 < len(data) {
+			v |= data[b+1] << (8 - shift)
+		}
+
+		ret = append(ret, v&0x7f)
+	}
+
+	return ret
+}
+
+func decodeGsm7(septets []byte) string {
+	var ret []rune
+	for i := 0; i < len(septets); i++ {
+		c := septets[i]
+		if c == 0x1b && i+1 < len(septets) {
+			i++
+			if r, ok := gsm7Ext[septets[i]]; ok {
+				ret = append(ret, r)
+			} else {
+				ret = append(ret, ' ')
+			}
+			continue
+		}
+
+		ret = append(ret, gsm7[c])
+	}
+
+	return string(ret)
+}
+
+// swapped returns the decimal value of a byte with swapped nibbles
+func swapped(b byte) int {
+	return int(b&0x0f)*10 + int(b>>4)
+}
+
+var errPDUShort = errors.New("PDU too short")
+
+// DecodePDU decodes a hex encoded SMS-DELIVER PDU (including the SMSC
+// address) as returned by AT+CMGL in PDU mode. Only the text of
+// concatenated messages is returned, they are not reassembled.
+func DecodePDU(pduHex string) (SMS, error) {
+	var ret SMS
+
+	pdu, err := hex.DecodeString(strings.TrimSpace(pduHex))
+	if err != nil {
+		return ret, err
+	}
+
+	if len(pdu) < 1 {
+		return ret, errPDUShort
+	}
+
+	// skip SMSC
+	i := 1 + int(pdu[0])
+	if len(pdu) < i+2 {
+		return ret, errPDUShort
+	}
+
+	first := pdu[i]
+	i++
+
+	if first&0x03 != 0 {
+		return ret, errors.New("not an SMS-DELIVER PDU")
+	}
+
+	udhi := first&0x40 != 0
+
+	// originating address, length is in digits
+	addrLen := int(pdu[i])
+	addrType := pdu[i+1]
+	i += 2
+	addrBytes := (addrLen + 1) / 2
+	if len(pdu) < i+addrBytes+9 {
+		return ret, errPDUShort
+	}
+
+	addr := pdu[i : i+addrBytes]
+	i += addrBytes
+
+	if addrType&0x70 == 0x50 {
+		// alphanumeric sender
+		ret.Number = decodeGsm7(unpackSeptets(addr, addrLen*4/7, 0))
+	} else {
+		digits := strings.ToUpper(hex.EncodeToString(addr))
+		var n []byte
+		for j := 0; j+1 < len(digits); j += 2 {
+			n = append(n, digits[j+1], digits[j])
+		}
+		ret.Number = strings.TrimRight(string(n), "F")
+		if addrType&0x70 == 0x10 {
+			ret.Number = "+" + ret.Number
+		}
+	}
+
+	// protocol identifier
+	i++
+	dcs := pdu[i]
+	i++
+
+	// service center time stamp, the time zone is in quarter hours with
+	// the sign in bit 3
+	ts := pdu[i : i+7]
+	i += 7
+	tz := swapped(ts[6]&^0x08) * 15 * 60
+	if ts[6]&0x08 != 0 {
+		tz = -tz
+	}
+	ret.Time = time.Date(2000+swapped(ts[0]), time.Month(swapped(ts[1])),
+		swapped(ts[2]), swapped(ts[3]), swapped(ts[4]), swapped(ts[5]), 0,
+		time.FixedZone("", tz))
+
+	if len(pdu) < i+1 {
+		return ret, errPDUShort
+	}
+
+	udl := int(pdu[i])
+	i++
+	ud := pdu[i:]
+
+	headerLen := 0
+	if udhi && len(ud) > 0 {
+		headerLen = int(ud[0]) + 1
+	}
+
+	switch dcs & 0x0c {
+	case 0x00:
+		// 7 bit, udl is in septets
+		fill := 0
+		skip := 0
+		if headerLen > 0 {
+			fill = (7 - (headerLen*8)%7) % 7
+			skip = (headerLen*8 + fill) / 7
+		}
+		if udl < skip {
+			return ret, errPDUShort
+		}
+		ret.Text = decodeGsm7(unpackSeptets(ud[headerLen:], udl-skip, fill))
+	case 0x08:
+		// UCS2
+		if len(ud) < udl || udl < headerLen {
+			return ret, errPDUShort
+		}
+		b := ud[headerLen:udl]
+		u := make([]uint16, len(b)/2)
+		for j := range u {
+			u[j] = uint16(b[j*2])<<8 | uint16(b[j*2+1])
+		}
+		ret.Text = string(utf16.Decode(u))
+	default:
+		// 8 bit data
+		if len(ud) < udl || udl < headerLen {
+			return ret, errPDUShort
+		}
+		ret.Text = string(ud[headerLen:udl])
+	}
+
+	return ret, nil
+}
+
+// CmdSendSMS sends a text mode SMS. port should be a RespReadWriter.
+func CmdSendSMS(port io.ReadWriter, to, text string) error {
+	if len(text) > maxSMSLength {
+		return fmt.Errorf("SMS longer than %v characters", maxSMSLength)
+	}
+
+	err := CmdOK(port, "AT+CMGF=1")
+	if err != nil {
+		return err
+	}
+
+	resp, err := Cmd(port, "AT+CMGS=\""+to+"\"")
+	if err != nil {
+		return err
+	}
+
+	if !strings.Contains(resp, ">") {
+		return fmt.Errorf("Error starting SMS: %v", resp)
+	}
+
+	// message is terminated with ctrl-z
+	resp, err = Cmd(port, text+"\x1a")
+	if err != nil {
+		return err
+	}
+
+	if !strings.Contains(resp, "+CMGS") {
+		return fmt.Errorf("Error sending SMS: %v", resp)
+	}
+
+	return nil
+}
+
+// +CMGL: 1,0,,24
+var reCmgl = regexp.MustCompile(`\+CMGL:\s*(\d+),`)
+
+// CmdReadSMS reads all received messages in PDU mode and deletes them from
+// the modem. Messages that can't be decoded are deleted and reported in
+// err.
+func CmdReadSMS(port io.ReadWriter) ([]SMS, error) {
+	err := CmdOK(port, "AT+CMGF=0")
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := Cmd(port, "AT+CMGL=4")
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []SMS
+	var retErr error
+	var indexes []int
+
+	lines := strings.Split(resp, "\n")
+	for i := 0; i < len(lines)-1; i++ {
+		matches := reCmgl.FindStringSubmatch(lines[i])
+		if len(matches) < 2 {
+			continue
+		}
+
+		index, _ := strconv.Atoi(matches[1])
+		indexes = append(indexes, index)
+
+		// PDU is on the next line
+		i++
+		sms, err := DecodePDU(lines[i])
+		if err != nil {
+			retErr = fmt.Errorf("Error decoding SMS %v: %v", index, err)
+			continue
+		}
+
+		ret = append(ret, sms)
+	}
+
+	for _, index := range indexes {
+		err := CmdOK(port, "AT+CMGD="+strconv.Itoa(index))
+		if err != nil {
+			return ret, err
+		}
+	}
+
+	return ret, retErr
+}
+
+// QueueSMS queues a message to be sent the next time ProcessSMS is called
+func (m *Modem) QueueSMS(to, text string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.smsQueue = append(m.smsQueue, SMS{Number: to, Time: time.Now(), Text: text})
+}
+
+// ProcessSMS sends queued messages and returns any messages that have been
+// received. This should be called periodically. Messages that fail to
+// send are left in the queue.
+func (m *Modem) ProcessSMS() ([]SMS, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.detected() {
+		return nil, errors.New("modem not detected")
+	}
+
+	if err := m.openCmdPort(); err != nil {
+		return nil, err
+	}
+
+	for len(m.smsQueue) > 0 {
+		sms := m.smsQueue[0]
+		err := CmdSendSMS(m.atCmdPort, sms.Number, sms.Text)
+		if err != nil {
+			return nil, err
+		}
+		m.smsQueue = m.smsQueue[1:]
+	}
+
+	return CmdReadSMS(m.atCmdPort)
+}
+
+// SMSCommandFunc handles a command received by SMS. args is the rest of
+// the message after the command. The returned reply is sent back to the
+// sender if it is not blank.
+type SMSCommandFunc func(from, args string) (reply string)
+
+// SMSCommands dispatches commands (reboot, status, etc) received by SMS.
+// Only messages from allowed numbers are processed.
+type SMSCommands struct {
+	allowed  map[string]bool
+	commands map[string]SMSCommandFunc
+}
+
+// NewSMSCommands creates a new command dispatcher that accepts commands
+// from the allowed numbers
+func NewSMSCommands(allowed []string) *SMSCommands {
+	ret := &SMSCommands{
+		allowed:  make(map[string]bool),
+		commands: make(map[string]SMSCommandFunc),
+	}
+
+	for _, n := range allowed {
+		ret.allowed[n] = true
+	}
+
+	return ret
+}
+
+// Register adds a command. Commands are not case sensitive.
+func (c *SMSCommands) Register(cmd string, fn SMSCommandFunc) {
+	c.commands[strings.ToLower(cmd)] = fn
+}
+
+// Handle runs the command in a received message and returns the reply.
+// ok is false if the sender is not allowed or the command is unknown.
+func (c *SMSCommands) Handle(sms SMS) (reply string, ok bool) {
+	if !c.allowed[sms.Number] {
+		return "", false
+	}
+
+	fields := strings.SplitN(strings.TrimSpace(sms.Text), " ", 2)
+	fn, ok := c.commands[strings.ToLower(fields[0])]
+	if !ok {
+		return "", false
+	}
+
+	args := ""
+	if len(fields) > 1 {
+		args = fields[1]
+	}
+
+	return fn(sms.Number, args), true
+}
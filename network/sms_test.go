@@ -0,0 +1,145 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecodePDU(t *testing.T) {
+	at := func(tz int) time.Time {
+		return time.Date(2021, 3, 15, 12, 34, 56, 0, time.FixedZone("", tz))
+	}
+
+	cases := []struct {
+		name   string
+		pdu    string
+		number string
+		text   string
+		time   time.Time
+	}{
+		{"7 bit", "07917283010010F5040BC87238880900F10000993092516195800AE8329BFD4697D9EC37",
+			"27838890001", "hellohello", time.Time{}},
+		{"7 bit with extension table", "07913121436587F9040B915155214365F700001230512143652312C8329BFD06DDDF723619B4416DCA9B14",
+			"+15551234567", "Hello world {€}", at(8 * 3600)},
+		{"7 bit with concatenation header", "07913121436587F9440B915155214365F700001230512143650A0F0500032A0201E061391DF4769701",
+			"+15551234567", "part one", at(-5 * 3600)},
+		{"UCS2", "07913121436587F9040B915155214365F700081230512143652312041F044004380432043504420020D83DDC4B",
+			"+15551234567", "Привет 👋", at(8 * 3600)},
+		{"alphanumeric sender", "07913121436587F90408D0C171BB0C00001230512143652309C337B90C8AC96634",
+			"Acme", "Code 1234", at(8 * 3600)},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sms, err := DecodePDU(c.pdu)
+			if err != nil {
+				t.Fatal("Error decoding PDU: ", err)
+			}
+
+			if sms.Number != c.number || sms.Text != c.text {
+				t.Errorf("expected %q from %q, got %q from %q", c.text, c.number,
+					sms.Text, sms.Number)
+			}
+
+			if !c.time.IsZero() && (!sms.Time.Equal(c.time) ||
+				timeOffset(sms.Time) != timeOffset(c.time)) {
+				t.Errorf("expected time %v, got %v", c.time, sms.Time)
+			}
+		})
+	}
+}
+
+func timeOffset(t time.Time) int {
+	_, offset := t.Zone()
+	return offset
+}
+
+func TestDecodePDUErrors(t *testing.T) {
+	for _, pdu := range []string{
+		"",
+		"zz",
+		"07917283010010",
+		// truncated in the time stamp
+		"07917283010010F5040BC87238880900F1000099309251",
+		// SMS-SUBMIT
+		"07917283010010F5010BC87238880900F10000993092516195800AE8329BFD4697D9EC37",
+		// UCS2 shorter than the user data length
+		"07913121436587F9040B915155214365F700081230512143652312041F0440",
+	} {
+		if _, err := DecodePDU(pdu); err == nil {
+			t.Errorf("%q: expected error", pdu)
+		}
+	}
+}
+
+func TestUnpackSeptets(t *testing.T) {
+	cases := []struct {
+		data  []byte
+		count int
+		fill  int
+		exp   string
+	}{
+		{[]byte{0xE8, 0x32, 0x9B, 0xFD, 0x06}, 5, 0, "hello"},
+		// one fill bit after a 6 byte header
+		{[]byte{0xD0, 0x65, 0x36, 0xFB, 0x0D}, 5, 1, "hello"},
+	}
+
+	for _, c := range cases {
+		got := decodeGsm7(unpackSeptets(c.data, c.count, c.fill))
+		if got != c.exp {
+			t.Errorf("%x fill %v: expected %q, got %q", c.data, c.fill, c.exp, got)
+		}
+	}
+}
+
+func TestSMSCommands(t *testing.T) {
+	c := NewSMSCommands([]string{"+15551234567"})
+	c.Register("Status", func(from, args string) string {
+		return "ok " + args
+	})
+
+	cases := []struct {
+		sms   SMS
+		reply string
+		ok    bool
+	}{
+		{SMS{Number: "+15551234567", Text: " STATUS now "}, "ok now", true},
+		{SMS{Number: "+15551234567", Text: "status"}, "ok ", true},
+		{SMS{Number: "+15551234567", Text: "reboot"}, "", false},
+		{SMS{Number: "+15550000000", Text: "status"}, "", false},
+	}
+
+	for _, tc := range cases {
+		reply, ok := c.Handle(tc.sms)
+		if reply != tc.reply || ok != tc.ok {
+			t.Errorf("%+v: expected %q %v, got %q %v", tc.sms, tc.reply, tc.ok,
+				reply, ok)
+		}
+	}
+}
+
+func TestCmdReadSMS(t *testing.T) {
+	port := &fakePort{resp: map[string]string{
+		"AT+CMGF=0": "\r\nOK\r\n",
+		"AT+CMGL=4": "\r\n+CMGL: 1,0,,33\r\n" +
+			"07917283010010F5040BC87238880900F10000993092516195800AE8329BFD4697D9EC37\r\n" +
+			"+CMGL: 4,0,,10\r\n0791\r\n\r\nOK\r\n",
+		"AT+CMGD=1": "\r\nOK\r\n",
+		"AT+CMGD=4": "\r\nOK\r\n",
+	}}
+
+	msgs, err := CmdReadSMS(port)
+	if err == nil {
+		t.Error("expected error for the bad PDU")
+	}
+
+	if len(msgs) != 1 || msgs[0].Text != "hellohello" {
+		t.Errorf("unexpected messages: %+v", msgs)
+	}
+
+	// both messages are deleted
+	cmds := port.cmds[len(port.cmds)-2:]
+	if cmds[0] != "AT+CMGD=1" || cmds[1] != "AT+CMGD=4" {
+		t.Errorf("messages were not deleted: %v", port.cmds)
+	}
+}
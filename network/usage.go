@@ -0,0 +1,256 @@
+package network
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DataUsage is the number of bytes received and sent on an interface
+type DataUsage struct {
+	Rx uint64
+	Tx uint64
+}
+
+// Total returns the total bytes received and sent
+func (du DataUsage) Total() uint64 {
+	return du.Rx + du.Tx
+}
+
+func (du *DataUsage) add(rx, tx uint64) {
+	du.Rx += rx
+	du.Tx += tx
+}
+
+// UsageTotals are the daily and monthly data usage for an interface
+type UsageTotals struct {
+	// Day (2006-01-02) and Month (2006-01) are the periods the totals are
+	// for
+	Day     string
+	Month   string
+	Daily   DataUsage
+	Monthly DataUsage
+	// Warned is true if the monthly threshold notification has been sent
+	// this month
+	Warned bool
+}
+
+// ifaceUsage tracks usage for one interface
+type ifaceUsage struct {
+	UsageTotals
+	// last kernel counter values, not persisted since the counters reset
+	// when the interface goes down
+	lastRx uint64
+	lastTx uint64
+	seen   bool
+}
+
+// UsageTracker keeps daily and monthly data usage totals for network
+// interfaces from the kernel counters in /sys/class/net. The totals are
+// persisted to a file so they survive reboots. Cellular plans are usually
+// billed monthly, so an optional monthly threshold can be set that calls a
+// notification function before the plan is exhausted.
+type UsageTracker struct {
+	file       string
+	lock       sync.Mutex
+	ifaces     map[string]*ifaceUsage
+	thresholds map[string]uint64
+	notify     func(iface string, totals UsageTotals, threshold uint64)
+	lastSave   time.Time
+}
+
+// saveInterval limits how often totals are written to flash
+const saveInterval = 10 * time.Minute
+
+// NewUsageTracker creates a usage tracker that persists totals to file. If
+// file is blank, totals are not persisted.
+func NewUsageTracker(file string) (*UsageTracker, error) {
+	ret := &UsageTracker{
+		file:       file,
+		ifaces:     make(map[string]*ifaceUsage),
+		thresholds: make(map[string]uint64),
+	}
+
+	if file == "" {
+		return ret, nil
+	}
+
+	d, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return ret, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var totals map[string]UsageTotals
+	err = json.Unmarshal(d, &totals)
+	if err != nil {
+		return nil, err
+	}
+
+	for iface, t := range totals {
+		ret.ifaces[iface] = &ifaceUsage{UsageTotals: t}
+	}
+
+	return ret, nil
+}
+
+// SetThreshold sets a monthly usage threshold (rx + tx bytes) for an
+// interface. notify is called once a month when the threshold is crossed.
+func (u *UsageTracker) SetThreshold(iface string, bytes uint64,
+	notify func(iface string, totals UsageTotals, threshold uint64)) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.thresholds[iface] = bytes
+	u.notify = notify
+}
+
+func readCounter(iface, name string) (uint64, error) {
+	d, err := ioutil.ReadFile("/sys/class/net/" + iface + "/statistics/" + name)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(d)), 10, 64)
+}
+
+// Update reads the kernel counters for iface and returns the updated totals
+func (u *UsageTracker) Update(iface string) (UsageTotals, error) {
+	rx, err := readCounter(iface, "rx_bytes")
+	if err != nil {
+		return u.Totals(iface), err
+	}
+
+	tx, err := readCounter(iface, "tx_bytes")
+	if err != nil {
+		return u.Totals(iface), err
+	}
+
+	return u.update(iface, rx, tx, time.Now())
+}
+
+func (u *UsageTracker) update(iface string, rx, tx uint64, now time.Time) (UsageTotals, error) {
+	u.lock.Lock()
+
+	iu, ok := u.ifaces[iface]
+	if !ok {
+		iu = &ifaceUsage{}
+		u.ifaces[iface] = iu
+	}
+
+	day := now.Format("2006-01-02")
+	month := now.Format("2006-01")
+
+	rollover := false
+	if iu.Day != day {
+		iu.Day = day
+		iu.Daily = DataUsage{}
+		rollover = true
+	}
+
+	if iu.Month != month {
+		iu.Month = month
+		iu.Monthly = DataUsage{}
+		iu.Warned = false
+	}
+
+	// the counters start over when an interface (like ppp0) is recreated
+	var drx, dtx uint64
+	if iu.seen && rx >= iu.lastRx && tx >= iu.lastTx {
+		drx, dtx = rx-iu.lastRx, tx-iu.lastTx
+	} else if iu.seen {
+		drx, dtx = rx, tx
+	}
+
+	iu.lastRx, iu.lastTx, iu.seen = rx, tx, true
+	iu.Daily.add(drx, dtx)
+	iu.Monthly.add(drx, dtx)
+
+	ret := iu.UsageTotals
+
+	var notify func()
+	threshold := u.thresholds[iface]
+	if threshold > 0 && !iu.Warned && iu.Monthly.Total() >= threshold &&
+		u.notify != nil {
+		iu.Warned = true
+		ret.Warned = true
+		n := u.notify
+		notify = func() { n(iface, ret, threshold) }
+	}
+
+	save := rollover || notify != nil || now.Sub(u.lastSave) >= saveInterval
+	if save {
+		u.lastSave = now
+	}
+
+	u.lock.Unlock()
+
+	if notify != nil {
+		notify()
+	}
+
+	if save {
+		return ret, u.save()
+	}
+
+	return ret, nil
+}
+
+// Totals returns the current totals for an interface
+func (u *UsageTracker) Totals(iface string) UsageTotals {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	iu, ok := u.ifaces[iface]
+	if !ok {
+		return UsageTotals{}
+	}
+
+	return iu.UsageTotals
+}
+
+func (u *UsageTracker) save() error {
+	if u.file == "" {
+		return nil
+	}
+
+	u.lock.Lock()
+	totals := make(map[string]UsageTotals)
+	for iface, iu := range u.ifaces {
+		totals[iface] = iu.UsageTotals
+	}
+	u.lock.Unlock()
+
+	d, err := json.Marshal(totals)
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file and rename so a power loss doesn't corrupt
+	// the totals
+	tmp := u.file + ".tmp"
+	err = ioutil.WriteFile(tmp, d, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, u.file)
+}
+
+// status fills in the usage for iface in status. u can be nil if usage is
+// not being tracked.
+func (u *UsageTracker) status(iface string, status *InterfaceStatus) {
+	if u == nil {
+		return
+	}
+
+	var err error
+	status.Usage, err = u.Update(iface)
+	if err != nil && status.Detected {
+		netLog.Error("error updating data usage", "interface", iface, "error", err)
+	}
+}
@@ -0,0 +1,86 @@
+package network
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestUsageTracker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "usage.json")
+
+	u, err := NewUsageTracker(file)
+	if err != nil {
+		t.Fatal("Error creating tracker: ", err)
+	}
+
+	var notified []UsageTotals
+	u.SetThreshold("ppp0", 1000, func(iface string, totals UsageTotals, threshold uint64) {
+		notified = append(notified, totals)
+	})
+
+	day := func(d, hour int) time.Time {
+		return time.Date(2021, 1, d, hour, 0, 0, 0, time.UTC)
+	}
+
+	steps := []struct {
+		rx, tx  uint64
+		now     time.Time
+		daily   DataUsage
+		monthly DataUsage
+		warned  bool
+	}{
+		// the first counters are the baseline
+		{100, 50, day(30, 1), DataUsage{}, DataUsage{}, false},
+		{300, 150, day(30, 2), DataUsage{200, 100}, DataUsage{200, 100}, false},
+		// new day
+		{400, 200, day(31, 0), DataUsage{100, 50}, DataUsage{300, 150}, false},
+		// ppp0 was recreated, so the counters started over
+		{50, 10, day(31, 1), DataUsage{150, 60}, DataUsage{350, 160}, false},
+		// crosses the monthly threshold
+		{550, 10, day(31, 2), DataUsage{650, 60}, DataUsage{850, 160}, true},
+		{650, 10, day(31, 3), DataUsage{750, 60}, DataUsage{950, 160}, true},
+		// new month
+		{700, 20, time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC),
+			DataUsage{50, 10}, DataUsage{50, 10}, false},
+	}
+
+	for i, s := range steps {
+		totals, err := u.update("ppp0", s.rx, s.tx, s.now)
+		if err != nil {
+			t.Fatalf("step %v: error updating: %v", i, err)
+		}
+
+		if totals.Daily != s.daily || totals.Monthly != s.monthly ||
+			totals.Warned != s.warned {
+			t.Errorf("step %v: unexpected totals: %+v", i, totals)
+		}
+	}
+
+	if len(notified) != 1 || notified[0].Monthly.Total() != 1010 {
+		t.Errorf("expected one notification, got %+v", notified)
+	}
+
+	// the totals are loaded from the file, but not the counters
+	u2, err := NewUsageTracker(file)
+	if err != nil {
+		t.Fatal("Error loading tracker: ", err)
+	}
+
+	if totals := u2.Totals("ppp0"); totals != u.Totals("ppp0") {
+		t.Errorf("expected loaded totals %+v, got %+v", u.Totals("ppp0"), totals)
+	}
+
+	totals, _ := u2.update("ppp0", 800, 30, time.Date(2021, 2, 1, 1, 0, 0, 0, time.UTC))
+	if totals.Monthly != (DataUsage{50, 10}) {
+		t.Errorf("counters were persisted: %+v", totals)
+	}
+}
@@ -0,0 +1,173 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UsbModemID identifies a USB modem and which of its USB interfaces are
+// the AT command and data (PPP) ports
+type UsbModemID struct {
+	Vendor        string
+	Product       string
+	AtInterface   int
+	DataInterface int
+}
+
+func (id UsbModemID) String() string {
+	return fmt.Sprintf("%v:%v", id.Vendor, id.Product)
+}
+
+// define USB IDs for supported modems
+var (
+	UsbBG96    = UsbModemID{"2c7c", "0296", 2, 3}
+	UsbEC25    = UsbModemID{"2c7c", "0125", 2, 3}
+	UsbSIM7600 = UsbModemID{"1e0e", "9001", 2, 3}
+)
+
+// usbSerialDir lists the USB serial ports
+var usbSerialDir = "/sys/bus/usb-serial/devices"
+
+func readSysfs(path string) string {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(d))
+}
+
+// FindUsbSerial returns the serial port (/dev/ttyUSB2) for a USB interface
+// of a device. The ttyUSB numbers change when a modem re-enumerates, so the
+// port is found from the USB IDs in sysfs.
+func FindUsbSerial(vendor, product string, iface int) (string, error) {
+	ports, err := ioutil.ReadDir(usbSerialDir)
+	if err != nil {
+		return "", err
+	}
+
+	for _, p := range ports {
+		// /sys/devices/.../1-1/1-1:1.2/ttyUSB2
+		devPath, err := filepath.EvalSymlinks(filepath.Join(usbSerialDir, p.Name()))
+		if err != nil {
+			continue
+		}
+
+		ifaceDir := filepath.Dir(devPath)
+		devDir := filepath.Dir(ifaceDir)
+
+		if readSysfs(filepath.Join(devDir, "idVendor")) != vendor ||
+			readSysfs(filepath.Join(devDir, "idProduct")) != product {
+			continue
+		}
+
+		n, err := strconv.ParseInt(readSysfs(filepath.Join(ifaceDir, "bInterfaceNumber")), 16, 32)
+		if err != nil || int(n) != iface {
+			continue
+		}
+
+		return "/dev/" + p.Name(), nil
+	}
+
+	return "", errors.New("USB serial port not found")
+}
+
+// SetPorts sets the serial ports after the modem re-enumerates. The
+// modem is treated as if it was reset. dataPort is only used for managed
+// PPP.
+func (m *Modem) SetPorts(atPort, dataPort string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.atCmdPort != nil {
+		m.atCmdPort.Close()
+		m.atCmdPort = nil
+	}
+
+	m.config.AtCmdPort = atPort
+
+	if m.ppp != nil && dataPort != "" {
+		m.ppp.SetDevice(dataPort)
+	}
+
+	m.profilePending = true
+	m.sim = SimStatus{}
+	m.ident = ModemIdentity{}
+	m.lastPPPRun = time.Time{}
+}
+
+// UsbWatcher watches for a USB modem being attached and detached by
+// polling sysfs. When the modem re-enumerates after a power cycle or
+// firmware reset, the serial ports are found again and the modem is
+// updated so the network manager can resume the data session without a
+// reboot.
+type UsbWatcher struct {
+	modem    *Modem
+	id       UsbModemID
+	interval time.Duration
+	stop     chan struct{}
+	atPort   string
+	dataPort string
+}
+
+// NewUsbWatcher creates a USB watcher for modem
+func NewUsbWatcher(modem *Modem, id UsbModemID, interval time.Duration) *UsbWatcher {
+	return &UsbWatcher{
+		modem:    modem,
+		id:       id,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+func (w *UsbWatcher) check() {
+	at, err := FindUsbSerial(w.id.Vendor, w.id.Product, w.id.AtInterface)
+	if err != nil {
+		if w.atPort != "" {
+			modemLog.Info("USB modem detached", "id", w.id)
+			w.atPort = ""
+		}
+		return
+	}
+
+	data, _ := FindUsbSerial(w.id.Vendor, w.id.Product, w.id.DataInterface)
+
+	if at == w.atPort && data == w.dataPort {
+		return
+	}
+
+	modemLog.Info("USB modem attached", "id", w.id, "at", at, "data", data)
+
+	w.atPort = at
+	w.dataPort = data
+	w.modem.SetPorts(at, data)
+}
+
+// Start watches until Stop is called
+func (w *UsbWatcher) Start() {
+	go func() {
+		w.check()
+
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				w.check()
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops watching
+func (w *UsbWatcher) Stop() {
+	close(w.stop)
+}
@@ -0,0 +1,122 @@
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeUsbModem creates the sysfs entries for a USB modem with serial
+// ports on interfaces 0-3 and points usbSerialDir at them
+func fakeUsbModem(t *testing.T, root string, id UsbModemID, first int) {
+	devDir := filepath.Join(root, "devices", "1-1")
+	serialDir := filepath.Join(root, "usb-serial")
+
+	files := map[string]string{
+		filepath.Join(devDir, "idVendor"):  id.Vendor + "\n",
+		filepath.Join(devDir, "idProduct"): id.Product + "\n",
+	}
+
+	for i := 0; i < 4; i++ {
+		tty := fmt.Sprintf("ttyUSB%v", first+i)
+		ifaceDir := filepath.Join(devDir, fmt.Sprintf("1-1:1.%v", i))
+		files[filepath.Join(ifaceDir, "bInterfaceNumber")] = fmt.Sprintf("%02x\n", i)
+
+		if err := os.MkdirAll(filepath.Join(ifaceDir, tty), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.MkdirAll(serialDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Symlink(filepath.Join(ifaceDir, tty),
+			filepath.Join(serialDir, tty)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for f, v := range files {
+		if err := ioutil.WriteFile(f, []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	usbSerialDir = serialDir
+}
+
+func TestFindUsbSerial(t *testing.T) {
+	root, err := ioutil.TempDir("", "siot-usb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	defer func(dir string) { usbSerialDir = dir }(usbSerialDir)
+	fakeUsbModem(t, root, UsbEC25, 0)
+
+	port, err := FindUsbSerial(UsbEC25.Vendor, UsbEC25.Product, UsbEC25.AtInterface)
+	if err != nil || port != "/dev/ttyUSB2" {
+		t.Errorf("expected /dev/ttyUSB2, got %v (%v)", port, err)
+	}
+
+	port, err = FindUsbSerial(UsbEC25.Vendor, UsbEC25.Product, UsbEC25.DataInterface)
+	if err != nil || port != "/dev/ttyUSB3" {
+		t.Errorf("expected /dev/ttyUSB3, got %v (%v)", port, err)
+	}
+
+	if _, err := FindUsbSerial(UsbSIM7600.Vendor, UsbSIM7600.Product, 2); err == nil {
+		t.Error("found port for a modem that is not attached")
+	}
+}
+
+func TestUsbWatcher(t *testing.T) {
+	root, err := ioutil.TempDir("", "siot-usb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	defer func(dir string) { usbSerialDir = dir }(usbSerialDir)
+	usbSerialDir = filepath.Join(root, "usb-serial")
+
+	m := NewModem(ModemConfig{Type: ModemEC25, AtCmdPort: "/dev/ttyUSB2"})
+	m.sim = SimStatus{Present: true, State: SimReady, Iccid: "89014103211118510720"}
+	m.lastPPPRun = time.Now()
+
+	w := NewUsbWatcher(m, UsbEC25, time.Second)
+
+	// not attached
+	w.check()
+	if m.config.AtCmdPort != "/dev/ttyUSB2" || m.sim.Iccid == "" {
+		t.Fatal("modem updated while detached")
+	}
+
+	// re-enumerated on different ports
+	fakeUsbModem(t, root, UsbEC25, 4)
+	w.check()
+	if m.config.AtCmdPort != "/dev/ttyUSB6" || w.dataPort != "/dev/ttyUSB7" {
+		t.Fatalf("expected /dev/ttyUSB6, got %v", m.config.AtCmdPort)
+	}
+
+	if m.sim.Iccid != "" || !m.profilePending || !m.lastPPPRun.IsZero() {
+		t.Error("modem not reset after re-enumerating")
+	}
+
+	// no change
+	m.profilePending = false
+	w.check()
+	if m.profilePending {
+		t.Error("modem reset without a change")
+	}
+
+	os.RemoveAll(usbSerialDir)
+	os.MkdirAll(usbSerialDir, 0755)
+	w.check()
+	if w.atPort != "" {
+		t.Error("detach not detected")
+	}
+}
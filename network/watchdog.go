@@ -0,0 +1,277 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecoveryLevel is a step in the watchdog recovery ladder
+type RecoveryLevel int
+
+// define recovery levels, in the order they are tried
+const (
+	RecoveryRestartSession RecoveryLevel = iota
+	RecoveryResetInterface
+	RecoveryPowerCycle
+	RecoveryReboot
+	recoveryLevels
+)
+
+func (l RecoveryLevel) String() string {
+	switch l {
+	case RecoveryRestartSession:
+		return "restart session"
+	case RecoveryResetInterface:
+		return "reset interface"
+	case RecoveryPowerCycle:
+		return "power cycle"
+	case RecoveryReboot:
+		return "reboot"
+	default:
+		return "unknown"
+	}
+}
+
+// WatchdogConfig configures the connectivity watchdog. Recovery functions
+// that are nil are skipped.
+type WatchdogConfig struct {
+	// Targets are pinged, or fetched if they start with http:// or
+	// https://. The connection is good if any target is reachable.
+	Targets []string
+	// Interval between checks (default 1m)
+	Interval time.Duration
+	// Timeout for each target (default 10s)
+	Timeout time.Duration
+	// Failures is the number of consecutive failed checks before each
+	// recovery step (default 3)
+	Failures int
+	// DNSNames are resolved after the targets are reachable. If they
+	// can't be resolved, RecoverDNS is called instead of running the
+	// recovery ladder, since the link itself works. Manager.UseDNSFallback
+	// is typically used.
+	DNSNames   []string
+	RecoverDNS func() error
+
+	RestartSession func() error
+	ResetInterface func() error
+	PowerCycle     func() error
+	// Reboot defaults to running reboot
+	Reboot func() error
+	// Paused, if set, skips recovery while it returns true, like while an
+	// OS update runs in a maintenance window (system.Maintenance.Busy)
+	Paused func() bool
+}
+
+// WatchdogCounts is the number of times each recovery step was run
+type WatchdogCounts struct {
+	RecoverDNS     int
+	RestartSession int
+	ResetInterface int
+	PowerCycle     int
+	Reboot         int
+}
+
+// Watchdog periodically checks that the internet is reachable, and runs
+// an escalating recovery ladder if it is not: restart the data session,
+// reset the interface, power cycle the modem, and finally reboot. The
+// ladder starts over once the connection is good again.
+type Watchdog struct {
+	config   WatchdogConfig
+	client   *http.Client
+	stop     chan struct{}
+	lock     sync.Mutex
+	failures int
+	level    RecoveryLevel
+	counts   WatchdogCounts
+}
+
+// NewWatchdog creates a connectivity watchdog
+func NewWatchdog(config WatchdogConfig) *Watchdog {
+	if config.Interval == 0 {
+		config.Interval = time.Minute
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	if config.Failures == 0 {
+		config.Failures = 3
+	}
+
+	if config.Reboot == nil {
+		config.Reboot = func() error {
+			return exec.Command("reboot").Run()
+		}
+	}
+
+	return &Watchdog{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		stop:   make(chan struct{}),
+	}
+}
+
+func (w *Watchdog) checkTarget(target string) error {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		resp, err := w.client.Get(target)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("%v returned %v", target, resp.Status)
+		}
+
+		return nil
+	}
+
+	secs := int(w.config.Timeout / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+
+	return exec.Command("ping", "-c", "1", "-W", strconv.Itoa(secs),
+		target).Run()
+}
+
+// Check returns nil if any of the targets are reachable
+func (w *Watchdog) Check() error {
+	if len(w.config.Targets) <= 0 {
+		return errors.New("no watchdog targets")
+	}
+
+	var err error
+	for _, t := range w.config.Targets {
+		err = w.checkTarget(t)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// CheckDNS returns nil if all of the DNS names resolve
+func (w *Watchdog) CheckDNS() error {
+	for _, name := range w.config.DNSNames {
+		err := CheckDNS(name, w.config.Timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Counts returns the number of times each recovery step was run
+func (w *Watchdog) Counts() WatchdogCounts {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.counts
+}
+
+func (w *Watchdog) recover(level RecoveryLevel) error {
+	var fn func() error
+	var count *int
+
+	switch level {
+	case RecoveryRestartSession:
+		fn, count = w.config.RestartSession, &w.counts.RestartSession
+	case RecoveryResetInterface:
+		fn, count = w.config.ResetInterface, &w.counts.ResetInterface
+	case RecoveryPowerCycle:
+		fn, count = w.config.PowerCycle, &w.counts.PowerCycle
+	case RecoveryReboot:
+		fn, count = w.config.Reboot, &w.counts.Reboot
+	}
+
+	if fn == nil {
+		return nil
+	}
+
+	netLog.Warn("watchdog recovering", "level", level)
+
+	w.lock.Lock()
+	*count++
+	w.lock.Unlock()
+
+	return fn()
+}
+
+// run does one check and recovers if needed
+func (w *Watchdog) run() {
+	err := w.Check()
+	if err == nil {
+		w.failures = 0
+		w.level = RecoveryRestartSession
+
+		err = w.CheckDNS()
+		if err != nil && w.config.RecoverDNS != nil {
+			netLog.Warn("watchdog DNS check failed", "error", err)
+			w.lock.Lock()
+			w.counts.RecoverDNS++
+			w.lock.Unlock()
+
+			err = w.config.RecoverDNS()
+			if err != nil {
+				netLog.Error("watchdog error recovering DNS", "error", err)
+			}
+		}
+
+		return
+	}
+
+	w.failures++
+	netLog.Warn("watchdog check failed", "failures", w.failures,
+		"max", w.config.Failures, "error", err)
+
+	if w.failures < w.config.Failures {
+		return
+	}
+
+	w.failures = 0
+
+	if w.config.Paused != nil && w.config.Paused() {
+		netLog.Info("watchdog paused, skipping recovery", "level", w.level)
+		return
+	}
+
+	err = w.recover(w.level)
+	if err != nil {
+		netLog.Error("watchdog recovery failed", "level", w.level, "error", err)
+	}
+
+	if w.level < recoveryLevels-1 {
+		w.level++
+	}
+}
+
+// Start starts the watchdog
+func (w *Watchdog) Start() {
+	go func() {
+		ticker := time.NewTicker(w.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				w.run()
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the watchdog
+func (w *Watchdog) Stop() {
+	close(w.stop)
+}
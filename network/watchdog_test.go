@@ -0,0 +1,92 @@
+package network
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatchdogLadder(t *testing.T) {
+	var up int32
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			res.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	var paused bool
+	w := NewWatchdog(WatchdogConfig{
+		Targets:        []string{server.URL},
+		Timeout:        time.Second,
+		Failures:       2,
+		RestartSession: func() error { return nil },
+		ResetInterface: func() error { return nil },
+		// no power cycle, so the step is skipped
+		Reboot: func() error { return nil },
+		Paused: func() bool { return paused },
+	})
+
+	steps := []struct {
+		up     bool
+		paused bool
+		counts WatchdogCounts
+	}{
+		{false, false, WatchdogCounts{}},
+		{false, false, WatchdogCounts{RestartSession: 1}},
+		{false, false, WatchdogCounts{RestartSession: 1}},
+		{false, false, WatchdogCounts{RestartSession: 1, ResetInterface: 1}},
+		// the connection recovered, so the ladder starts over
+		{true, false, WatchdogCounts{RestartSession: 1, ResetInterface: 1}},
+		{false, false, WatchdogCounts{RestartSession: 1, ResetInterface: 1}},
+		{false, false, WatchdogCounts{RestartSession: 2, ResetInterface: 1}},
+		{false, false, WatchdogCounts{RestartSession: 2, ResetInterface: 1}},
+		{false, false, WatchdogCounts{RestartSession: 2, ResetInterface: 2}},
+		{false, false, WatchdogCounts{RestartSession: 2, ResetInterface: 2}},
+		// power cycle is skipped
+		{false, false, WatchdogCounts{RestartSession: 2, ResetInterface: 2}},
+		{false, true, WatchdogCounts{RestartSession: 2, ResetInterface: 2}},
+		// recovery is skipped while paused
+		{false, true, WatchdogCounts{RestartSession: 2, ResetInterface: 2}},
+		{false, false, WatchdogCounts{RestartSession: 2, ResetInterface: 2}},
+		{false, false, WatchdogCounts{RestartSession: 2, ResetInterface: 2, Reboot: 1}},
+		// reboot is the last step, and is repeated
+		{false, false, WatchdogCounts{RestartSession: 2, ResetInterface: 2, Reboot: 1}},
+		{false, false, WatchdogCounts{RestartSession: 2, ResetInterface: 2, Reboot: 2}},
+	}
+
+	for i, s := range steps {
+		if s.up {
+			atomic.StoreInt32(&up, 1)
+		} else {
+			atomic.StoreInt32(&up, 0)
+		}
+		paused = s.paused
+
+		w.run()
+
+		if c := w.Counts(); c != s.counts {
+			t.Fatalf("step %v: expected %+v, got %+v", i, s.counts, c)
+		}
+	}
+}
+
+func TestWatchdogCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		// client errors mean the server was reached
+		res.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	w := NewWatchdog(WatchdogConfig{Targets: []string{"http://127.0.0.1:1", server.URL}})
+	if err := w.Check(); err != nil {
+		t.Error("Error checking targets: ", err)
+	}
+
+	w = NewWatchdog(WatchdogConfig{})
+	if w.Check() == nil {
+		t.Error("expected error without targets")
+	}
+}
@@ -0,0 +1,286 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/file"
+)
+
+// WifiScanResult is a network found by Wifi.Scan
+type WifiScanResult struct {
+	BSSID     string
+	Frequency int
+	// Signal is in dBm
+	Signal int
+	Flags  string
+	SSID   string
+}
+
+// Wifi implements the Interface interface for a WiFi client managed by
+// wpa_supplicant. wpa_supplicant must be running with a control interface
+// for iface.
+type Wifi struct {
+	iface   string
+	lock    sync.Mutex
+	usage   *UsageTracker
+	latency *LatencyMonitor
+	// config is sent to wpa_supplicant when configPending is set
+	config        *data.WifiConfig
+	configPending bool
+}
+
+// NewWifi constructor
+func NewWifi(iface string) *Wifi {
+	return &Wifi{
+		iface: iface,
+	}
+}
+
+// wpaCli runs a wpa_supplicant control command
+func (w *Wifi) wpaCli(args ...string) (string, error) {
+	out, err := exec.Command("wpa_cli", append([]string{"-i", w.iface},
+		args...)...).Output()
+	if err != nil {
+		return "", fmt.Errorf("wpa_cli %v: %v", args[0], err)
+	}
+
+	ret := strings.TrimSpace(string(out))
+	if strings.HasPrefix(ret, "FAIL") {
+		return "", fmt.Errorf("wpa_cli %v failed", args[0])
+	}
+
+	return ret, nil
+}
+
+// wpaValues parses key=value lines as returned by STATUS and SIGNAL_POLL
+func wpaValues(resp string) map[string]string {
+	ret := make(map[string]string)
+	for _, line := range strings.Split(resp, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) == 2 {
+			ret[kv[0]] = kv[1]
+		}
+	}
+
+	return ret
+}
+
+// SetUsageTracker enables data usage tracking for the interface
+func (w *Wifi) SetUsageTracker(usage *UsageTracker) {
+	w.usage = usage
+}
+
+// SetLatencyMonitor enables latency and packet loss monitoring for the
+// interface. The monitor must be started separately.
+func (w *Wifi) SetLatencyMonitor(latency *LatencyMonitor) {
+	w.latency = latency
+}
+
+// SetConfig sets the network to connect to. It is sent to wpa_supplicant
+// the next time Connect is called.
+func (w *Wifi) SetConfig(config data.WifiConfig) error {
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.config = &config
+	w.configPending = true
+	return nil
+}
+
+// Desc returns a description of the interface
+func (w *Wifi) Desc() string {
+	return fmt.Sprintf("Wifi(%v)", w.iface)
+}
+
+func (w *Wifi) detected() bool {
+	return file.Exists("/sys/class/net/" + w.iface)
+}
+
+// Scan scans for networks
+func (w *Wifi) Scan() ([]WifiScanResult, error) {
+	_, err := w.wpaCli("scan")
+	if err != nil {
+		return nil, err
+	}
+
+	// scan results are not available until the scan completes
+	time.Sleep(5 * time.Second)
+
+	resp, err := w.wpaCli("scan_results")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseScanResults(resp), nil
+}
+
+// parseScanResults parses the output of the scan_results command
+func parseScanResults(resp string) []WifiScanResult {
+	var ret []WifiScanResult
+
+	// bssid / frequency / signal level / flags / ssid
+	for _, line := range strings.Split(resp, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 5 {
+			continue
+		}
+
+		freq, err := strconv.Atoi(fields[1])
+		if err != nil {
+			// header line
+			continue
+		}
+
+		signal, _ := strconv.Atoi(fields[2])
+
+		ret = append(ret, WifiScanResult{
+			BSSID:     fields[0],
+			Frequency: freq,
+			Signal:    signal,
+			Flags:     fields[3],
+			SSID:      fields[4],
+		})
+	}
+
+	return ret
+}
+
+// sendConfig replaces the networks in wpa_supplicant with the configured
+// network
+func (w *Wifi) sendConfig(config data.WifiConfig) error {
+	_, err := w.wpaCli("remove_network", "all")
+	if err != nil {
+		return err
+	}
+
+	id, err := w.wpaCli("add_network")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.wpaCli("set_network", id, "ssid", "\""+config.SSID+"\"")
+	if err != nil {
+		return err
+	}
+
+	if config.Psk != "" {
+		_, err = w.wpaCli("set_network", id, "psk", "\""+config.Psk+"\"")
+	} else {
+		_, err = w.wpaCli("set_network", id, "key_mgmt", "NONE")
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = w.wpaCli("select_network", id)
+	if err != nil {
+		return err
+	}
+
+	// persist the network if wpa_supplicant allows it, not all setups do
+	w.wpaCli("save_config")
+
+	return nil
+}
+
+// Connect sends the network config to wpa_supplicant if it changed, and
+// gets an address once associated
+func (w *Wifi) Connect() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.detected() {
+		return errors.New("wifi interface not detected")
+	}
+
+	if w.config != nil && w.configPending {
+		err := w.sendConfig(*w.config)
+		if err != nil {
+			return err
+		}
+		w.configPending = false
+	}
+
+	resp, err := w.wpaCli("status")
+	if err != nil {
+		return err
+	}
+
+	if wpaValues(resp)["wpa_state"] != "COMPLETED" {
+		_, err := w.wpaCli("reconnect")
+		if err != nil {
+			return err
+		}
+
+		return errors.New("wifi not associated")
+	}
+
+	if _, err := GetIP(w.iface); err == nil {
+		return nil
+	}
+
+	return exec.Command("udhcpc", "-q", "-n", "-i", w.iface).Run()
+}
+
+// GetStatus returns the wifi interface status
+func (w *Wifi) GetStatus() (InterfaceStatus, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.detected() {
+		return InterfaceStatus{}, nil
+	}
+
+	ip, _ := GetIP(w.iface)
+	ret := InterfaceStatus{
+		Detected: true,
+		IP:       ip,
+	}
+
+	resp, err := w.wpaCli("status")
+	if err != nil {
+		return ret, err
+	}
+
+	status := wpaValues(resp)
+	ret.SSID = status["ssid"]
+	ret.Connected = status["wpa_state"] == "COMPLETED" && ip != ""
+
+	if ret.Connected {
+		resp, err := w.wpaCli("signal_poll")
+		if err != nil {
+			return ret, err
+		}
+
+		ret.Signal, _ = strconv.Atoi(wpaValues(resp)["RSSI"])
+	}
+
+	linkInfo(w.iface, &ret)
+	w.usage.status(w.iface, &ret)
+	w.latency.status(&ret)
+
+	return ret, nil
+}
+
+// Reset reloads the wpa_supplicant config and disassociates. The configured
+// network is sent again the next time Connect is called.
+func (w *Wifi) Reset() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.configPending = true
+
+	_, err := w.wpaCli("reconfigure")
+	return err
+}
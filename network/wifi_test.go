@@ -0,0 +1,41 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseScanResults(t *testing.T) {
+	resp := "bssid / frequency / signal level / flags / ssid\n" +
+		"f8:d1:11:23:c2:2f\t2412\t-45\t[WPA2-PSK-CCMP][ESS]\tshop floor\n" +
+		"00:1b:2f:45:3a:10\t5180\t-71\t[ESS]\t\n" +
+		"bad line\n"
+
+	exp := []WifiScanResult{
+		{BSSID: "f8:d1:11:23:c2:2f", Frequency: 2412, Signal: -45,
+			Flags: "[WPA2-PSK-CCMP][ESS]", SSID: "shop floor"},
+		{BSSID: "00:1b:2f:45:3a:10", Frequency: 5180, Signal: -71,
+			Flags: "[ESS]"},
+	}
+
+	got := parseScanResults(resp)
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %+v, got %+v", exp, got)
+	}
+}
+
+func TestWpaValues(t *testing.T) {
+	resp := "bssid=f8:d1:11:23:c2:2f\nfreq=2412\nssid=a=b\n" +
+		"wpa_state=COMPLETED\nip_address=192.168.1.20\nno value\n"
+
+	values := wpaValues(resp)
+	if values["wpa_state"] != "COMPLETED" || values["ssid"] != "a=b" ||
+		values["freq"] != "2412" || len(values) != 5 {
+		t.Errorf("unexpected values: %v", values)
+	}
+
+	signal := wpaValues("RSSI=-52\nLINKSPEED=65\nNOISE=9999\nFREQUENCY=2412\n")
+	if signal["RSSI"] != "-52" {
+		t.Errorf("unexpected signal values: %v", signal)
+	}
+}
@@ -0,0 +1,262 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/file"
+)
+
+// handshakeTimeout is how long after the last handshake a tunnel is
+// considered down. WireGuard handshakes every 2 minutes while there is
+// traffic, and persistent keepalives keep traffic flowing.
+const handshakeTimeout = 3 * time.Minute
+
+// WireGuardPeer is the server end of the tunnel, usually fetched from the
+// server
+type WireGuardPeer struct {
+	PublicKey  string   `json:"publicKey"`
+	Endpoint   string   `json:"endpoint"`
+	AllowedIPs []string `json:"allowedIPs"`
+	// PersistentKeepalive in seconds (default 25) keeps NAT mappings open
+	// so the server can reach the gateway
+	PersistentKeepalive int `json:"persistentKeepalive,omitempty"`
+}
+
+// WireGuardConfig describes a WireGuard tunnel
+type WireGuardConfig struct {
+	// Iface defaults to wg0
+	Iface string
+	// KeyFile is where the private key is stored. It is generated if it
+	// does not exist.
+	KeyFile string
+	// Address is the tunnel address in CIDR notation (10.8.0.2/24)
+	Address    string
+	ListenPort int
+}
+
+// WireGuard implements the Interface interface for a WireGuard VPN tunnel
+// using the wg and ip tools
+type WireGuard struct {
+	config WireGuardConfig
+	lock   sync.Mutex
+	peer   *WireGuardPeer
+}
+
+// NewWireGuard constructor
+func NewWireGuard(config WireGuardConfig) *WireGuard {
+	if config.Iface == "" {
+		config.Iface = "wg0"
+	}
+
+	return &WireGuard{config: config}
+}
+
+// Desc returns a description of the interface
+func (w *WireGuard) Desc() string {
+	return fmt.Sprintf("WireGuard(%v)", w.config.Iface)
+}
+
+// ensureKey generates the private key if it does not exist
+func (w *WireGuard) ensureKey() error {
+	if file.Exists(w.config.KeyFile) {
+		return nil
+	}
+
+	key, err := exec.Command("wg", "genkey").Output()
+	if err != nil {
+		return fmt.Errorf("Error generating WireGuard key: %v", err)
+	}
+
+	return ioutil.WriteFile(w.config.KeyFile, key, 0600)
+}
+
+// PublicKey returns the public key, generating a key pair if needed. This
+// is sent to the server so it can add the gateway as a peer.
+func (w *WireGuard) PublicKey() (string, error) {
+	err := w.ensureKey()
+	if err != nil {
+		return "", err
+	}
+
+	key, err := os.Open(w.config.KeyFile)
+	if err != nil {
+		return "", err
+	}
+	defer key.Close()
+
+	cmd := exec.Command("wg", "pubkey")
+	cmd.Stdin = key
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Error getting WireGuard public key: %v", err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// SetPeer sets the server peer. The tunnel is configured the next time
+// Connect is called.
+func (w *WireGuard) SetPeer(peer WireGuardPeer) error {
+	if peer.PublicKey == "" || peer.Endpoint == "" {
+		return errors.New("peer public key and endpoint are required")
+	}
+
+	if peer.PersistentKeepalive == 0 {
+		peer.PersistentKeepalive = 25
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.peer = &peer
+	return nil
+}
+
+func (w *WireGuard) exists() bool {
+	return file.Exists("/sys/class/net/" + w.config.Iface)
+}
+
+func runCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v %v: %v: %v", name, args[0], err,
+			strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// Connect creates the tunnel interface and configures the peer
+func (w *WireGuard) Connect() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.peer == nil {
+		return errors.New("no WireGuard peer configured")
+	}
+
+	err := w.ensureKey()
+	if err != nil {
+		return err
+	}
+
+	iface := w.config.Iface
+
+	if !w.exists() {
+		err = runCommand("ip", "link", "add", "dev", iface, "type", "wireguard")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = runCommand("wg", w.setArgs()...)
+	if err != nil {
+		return err
+	}
+
+	err = runCommand("ip", "addr", "replace", w.config.Address, "dev", iface)
+	if err != nil {
+		return err
+	}
+
+	return runCommand("ip", "link", "set", iface, "up")
+}
+
+// setArgs returns the wg set arguments that configure the tunnel and peer
+func (w *WireGuard) setArgs() []string {
+	args := []string{"set", w.config.Iface, "private-key", w.config.KeyFile}
+	if w.config.ListenPort != 0 {
+		args = append(args, "listen-port", strconv.Itoa(w.config.ListenPort))
+	}
+
+	return append(args, "peer", w.peer.PublicKey,
+		"endpoint", w.peer.Endpoint,
+		"allowed-ips", strings.Join(w.peer.AllowedIPs, ","),
+		"persistent-keepalive", strconv.Itoa(w.peer.PersistentKeepalive))
+}
+
+// lastHandshake returns the time of the last handshake with the peer
+func (w *WireGuard) lastHandshake() (time.Time, error) {
+	out, err := exec.Command("wg", "show", w.config.Iface,
+		"latest-handshakes").Output()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return parseHandshakes(string(out)), nil
+}
+
+// parseHandshakes returns the latest handshake in wg show latest-handshakes
+// output, or zero if there has not been one
+func parseHandshakes(out string) time.Time {
+	// <peer public key>\t<unix time>
+	var ret time.Time
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		secs, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || secs == 0 {
+			continue
+		}
+
+		t := time.Unix(secs, 0)
+		if t.After(ret) {
+			ret = t
+		}
+	}
+
+	return ret
+}
+
+// GetStatus returns the tunnel status. The tunnel is connected if there
+// has been a recent handshake with the peer.
+func (w *WireGuard) GetStatus() (InterfaceStatus, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.peer == nil {
+		return InterfaceStatus{}, nil
+	}
+
+	ret := InterfaceStatus{Detected: true}
+
+	if !w.exists() {
+		return ret, nil
+	}
+
+	ret.IP, _ = GetIP(w.config.Iface)
+
+	var err error
+	ret.LastHandshake, err = w.lastHandshake()
+	if err != nil {
+		return ret, err
+	}
+
+	ret.Connected = !ret.LastHandshake.IsZero() &&
+		time.Since(ret.LastHandshake) < handshakeTimeout
+
+	return ret, nil
+}
+
+// Reset removes the tunnel interface. It is created again the next time
+// Connect is called.
+func (w *WireGuard) Reset() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.exists() {
+		return nil
+	}
+
+	return runCommand("ip", "link", "del", "dev", w.config.Iface)
+}
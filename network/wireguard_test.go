@@ -0,0 +1,48 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWireGuardSetArgs(t *testing.T) {
+	w := NewWireGuard(WireGuardConfig{KeyFile: "/data/wg.key", ListenPort: 51820})
+
+	if w.SetPeer(WireGuardPeer{PublicKey: "abc="}) == nil {
+		t.Error("peer without an endpoint was accepted")
+	}
+
+	err := w.SetPeer(WireGuardPeer{PublicKey: "abc=", Endpoint: "vpn.example.com:51820",
+		AllowedIPs: []string{"10.8.0.0/24", "fd00::/64"}})
+	if err != nil {
+		t.Fatal("Error setting peer: ", err)
+	}
+
+	exp := []string{"set", "wg0", "private-key", "/data/wg.key",
+		"listen-port", "51820", "peer", "abc=", "endpoint", "vpn.example.com:51820",
+		"allowed-ips", "10.8.0.0/24,fd00::/64", "persistent-keepalive", "25"}
+
+	if args := w.setArgs(); !reflect.DeepEqual(args, exp) {
+		t.Errorf("expected %v, got %v", exp, args)
+	}
+}
+
+func TestParseHandshakes(t *testing.T) {
+	cases := []struct {
+		out string
+		exp time.Time
+	}{
+		{"abc=\t1614556800\n", time.Unix(1614556800, 0)},
+		{"abc=\t1614556800\ndef=\t1614556900\nghi=\t0\n", time.Unix(1614556900, 0)},
+		// no handshake yet
+		{"abc=\t0\n", time.Time{}},
+		{"", time.Time{}},
+	}
+
+	for _, c := range cases {
+		if got := parseHandshakes(c.out); !got.Equal(c.exp) {
+			t.Errorf("%q: expected %v, got %v", c.out, c.exp, got)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+// email TLS modes
+const (
+	// EmailStartTLS upgrades the connection with STARTTLS, which the server
+	// must support
+	EmailStartTLS = "starttls"
+	// EmailTLS connects with TLS, typically on port 465
+	EmailTLS = "tls"
+	// EmailNoTLS sends email without encryption, and should only be used
+	// with local relays
+	EmailNoTLS = "none"
+)
+
+// DefaultEmailSubject is the subject template used if none is configured
+const DefaultEmailSubject = `SIOT: {{.Message}}`
+
+// DefaultEmailBody is the body template used if none is configured
+const DefaultEmailBody = `{{.Message}}
+
+Time: {{.Time.Format "2006-01-02 15:04:05 MST"}}
+{{if .DeviceID}}Device: {{.DeviceID}}{{with .Device}}{{with .Config.Description}} ({{.}}){{end}}{{end}}
+{{end}}{{if .Samples}}
+Latest samples:
+{{range .Samples}}  {{.Type}}{{with .ID}} {{.}}{{end}}: {{.Value}}
+{{end}}{{end}}`
+
+// EmailConfig describes how email is sent
+type EmailConfig struct {
+	// Server is the SMTP server host:port
+	Server string
+	// TLS is starttls (default), tls, or none
+	TLS  string
+	User string
+	Pass string
+	From string
+	// To is who all notifications are sent to
+	To []string
+	// Groups are who notifications about devices in a group are sent to
+	Groups map[string][]string
+	// Subject and Body are text/template templates executed with a
+	// Context. The defaults are used if they are blank.
+	Subject string
+	Body    string
+	// Retries is how many times a failed send is retried, with the delay
+	// doubling each time starting at RetryDelay (default 1m)
+	Retries    int
+	RetryDelay time.Duration
+	// Timeout is the time allowed to send a message (default 30s)
+	Timeout time.Duration
+}
+
+// Validate checks the config is valid
+func (c EmailConfig) Validate() error {
+	if c.Server == "" {
+		return errors.New("email server is required")
+	}
+
+	_, _, err := net.SplitHostPort(c.Server)
+	if err != nil {
+		return fmt.Errorf("invalid email server: %v", c.Server)
+	}
+
+	switch c.TLS {
+	case "", EmailStartTLS, EmailTLS, EmailNoTLS:
+	default:
+		return fmt.Errorf("invalid email TLS mode: %v", c.TLS)
+	}
+
+	if c.From == "" {
+		return errors.New("email from address is required")
+	}
+
+	if len(c.To) <= 0 && len(c.Groups) <= 0 {
+		return errors.New("email recipients are required")
+	}
+
+	if c.Retries < 0 {
+		return errors.New("email retries can't be negative")
+	}
+
+	return nil
+}
+
+// Email sends notifications by email. Messages are sent in the background
+// and retried if sending fails.
+type Email struct {
+	db      *db.Db
+	config  EmailConfig
+	subject *template.Template
+	body    *template.Template
+	sender  *sender
+}
+
+// NewEmail creates an email notifier. The db is used to look up the device
+// context of notifications, and can be nil. Start starts sending.
+func NewEmail(dbInst *db.Db, config EmailConfig) (*Email, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.TLS == "" {
+		config.TLS = EmailStartTLS
+	}
+
+	if config.RetryDelay == 0 {
+		config.RetryDelay = time.Minute
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = 30 * time.Second
+	}
+
+	if config.Subject == "" {
+		config.Subject = DefaultEmailSubject
+	}
+
+	if config.Body == "" {
+		config.Body = DefaultEmailBody
+	}
+
+	subject, err := template.New("subject").Parse(config.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing email subject template: %v", err)
+	}
+
+	body, err := template.New("body").Parse(config.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing email body template: %v", err)
+	}
+
+	return &Email{
+		db:      dbInst,
+		config:  config,
+		subject: subject,
+		body:    body,
+		sender:  newSender("email", config.Retries, config.RetryDelay),
+	}, nil
+}
+
+// Start sends queued messages until Stop is called
+func (e *Email) Start() {
+	e.sender.start()
+}
+
+// Stop stops sending. Queued messages are dropped.
+func (e *Email) Stop() {
+	e.sender.close()
+}
+
+// Notify renders a notification and queues it to be sent. It does not
+// wait for the message to be sent.
+func (e *Email) Notify(n data.Notification) error {
+	ctx := newContext(e.db, n)
+
+	to := recipients(e.config.To, e.config.Groups, ctx.Device)
+	if len(to) <= 0 {
+		return ErrNoRecipients
+	}
+
+	msg, err := e.render(to, ctx)
+	if err != nil {
+		return err
+	}
+
+	return e.sender.enqueue(job{
+		desc: strings.Join(to, ", "),
+		send: func() error {
+			return e.send(to, msg)
+		},
+	})
+}
+
+// render returns the message with headers
+func (e *Email) render(to []string, ctx Context) ([]byte, error) {
+	var subject, body bytes.Buffer
+
+	err := e.subject.Execute(&subject, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Error executing email subject template: %v", err)
+	}
+
+	err = e.body.Execute(&body, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Error executing email body template: %v", err)
+	}
+
+	var msg bytes.Buffer
+	e.headers(&msg, to, subject.String(), ctx.Time)
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(crlf(body.String()))
+
+	return msg.Bytes(), nil
+}
+
+// headers writes the headers of a message, except for the content type
+func (e *Email) headers(msg *bytes.Buffer, to []string, subject string, date time.Time) {
+	header := func(k, v string) {
+		fmt.Fprintf(msg, "%v: %v\r\n", k, v)
+	}
+
+	header("From", e.config.From)
+	header("To", strings.Join(to, ", "))
+	// headers can't contain line breaks
+	header("Subject", strings.Join(strings.Fields(subject), " "))
+	header("Date", date.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+}
+
+// crlf returns text with CRLF line endings, which SMTP requires
+func crlf(text string) string {
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	return strings.Join(lines, "\r\n")
+}
+
+// Attachment is a file attached to an email
+type Attachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// Send queues an email with attachments to be sent to addresses, like a
+// report. The subject and body are not templates. It does not wait for
+// the message to be sent.
+func (e *Email) Send(to []string, subject, body string, attachments ...Attachment) error {
+	if len(to) <= 0 {
+		return ErrNoRecipients
+	}
+
+	var msg bytes.Buffer
+	e.headers(&msg, to, subject, time.Now())
+
+	w := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%v\r\n\r\n",
+		w.Boundary())
+
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return err
+	}
+	part.Write([]byte(crlf(body)))
+
+	for _, a := range attachments {
+		contentType := a.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		part, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Name})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return err
+		}
+
+		// base64 lines are limited to 76 characters
+		enc := base64.StdEncoding.EncodeToString(a.Data)
+		for len(enc) > 76 {
+			part.Write([]byte(enc[:76] + "\r\n"))
+			enc = enc[76:]
+		}
+		part.Write([]byte(enc + "\r\n"))
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	b := msg.Bytes()
+	return e.sender.enqueue(job{
+		desc: strings.Join(to, ", "),
+		send: func() error {
+			return e.send(to, b)
+		},
+	})
+}
+
+// send sends a message over SMTP
+func (e *Email) send(to []string, msg []byte) error {
+	c := e.config
+
+	host, _, err := net.SplitHostPort(c.Server)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig := &tls.Config{ServerName: host}
+	dialer := &net.Dialer{Timeout: c.Timeout}
+
+	var conn net.Conn
+	if c.TLS == EmailTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.Server, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", c.Server)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = conn.SetDeadline(time.Now().Add(c.Timeout))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if c.TLS == EmailStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("email server does not support STARTTLS")
+		}
+
+		err = client.StartTLS(tlsConfig)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.User != "" {
+		err = client.Auth(smtp.PlainAuth("", c.User, c.Pass, host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.Mail(c.From)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range to {
+		err = client.Rcpt(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
@@ -0,0 +1,291 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+// smtpMessage is a message received by the test server
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// smtpServer is a minimal SMTP server that fails the first failures
+// messages with a temporary error
+func smtpServer(t *testing.T, failures int) (string, <-chan smtpMessage, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening: ", err)
+	}
+
+	messages := make(chan smtpMessage, 10)
+
+	handle := func(conn net.Conn) {
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(s string) {
+			fmt.Fprintf(conn, "%v\r\n", s)
+		}
+
+		reply("220 test")
+
+		var m smtpMessage
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+			cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+			switch cmd {
+			case "EHLO", "HELO":
+				reply("250 test")
+			case "MAIL":
+				if failures > 0 {
+					failures--
+					reply("451 try again later")
+					continue
+				}
+				m.from = line
+				reply("250 ok")
+			case "RCPT":
+				m.to = append(m.to, line)
+				reply("250 ok")
+			case "DATA":
+				reply("354 go ahead")
+				var b strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+					b.WriteString(l)
+				}
+				m.data = b.String()
+				messages <- m
+				m = smtpMessage{}
+				reply("250 ok")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// connections are handled in order so failures are counted
+			// correctly
+			handle(conn)
+		}
+	}()
+
+	return l.Addr().String(), messages, func() { l.Close() }
+}
+
+func TestEmail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-notify-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbInst, err := db.NewDb(dir, nil)
+	if err != nil {
+		t.Fatal("Error opening db: ", err)
+	}
+	defer dbInst.Close()
+
+	err = dbInst.DeviceSample("1234", data.Sample{Type: "level", Value: 11,
+		Time: time.Now()})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	err = dbInst.DeviceUpdateConfig("1234", data.DeviceConfig{
+		Description: "north tank",
+		Groups:      []string{"field"},
+	})
+	if err != nil {
+		t.Fatal("Error updating device: ", err)
+	}
+
+	addr, messages, stop := smtpServer(t, 1)
+	defer stop()
+
+	e, err := NewEmail(dbInst, EmailConfig{
+		Server: addr,
+		TLS:    EmailNoTLS,
+		From:   "siot@example.com",
+		To:     []string{"ops@example.com"},
+		Groups: map[string][]string{
+			"field":  {"field@example.com", "ops@example.com"},
+			"office": {"office@example.com"},
+		},
+		Retries:    2,
+		RetryDelay: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("Error creating notifier: ", err)
+	}
+
+	e.Start()
+	defer e.Stop()
+
+	err = e.Notify(data.Notification{RuleID: 1, Description: "tank high",
+		DeviceID: "1234", Message: "tank high is active", Active: true,
+		Time: time.Now()})
+	if err != nil {
+		t.Fatal("Error sending notification: ", err)
+	}
+
+	var m smtpMessage
+	select {
+	case m = <-messages:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for email")
+	}
+
+	if len(m.to) != 2 || !strings.Contains(m.to[0], "ops@example.com") ||
+		!strings.Contains(m.to[1], "field@example.com") {
+		t.Error("wrong recipients: ", m.to)
+	}
+
+	for _, exp := range []string{
+		"Subject: SIOT: tank high is active\r\n",
+		"Device: 1234 (north tank)\r\n",
+		"  level: 11\r\n",
+	} {
+		if !strings.Contains(m.data, exp) {
+			t.Errorf("message does not contain %q:\n%v", exp, m.data)
+		}
+	}
+}
+
+func TestEmailTemplate(t *testing.T) {
+	e, err := NewEmail(nil, EmailConfig{
+		Server:  "localhost:25",
+		From:    "siot@example.com",
+		To:      []string{"ops@example.com"},
+		Subject: "{{if .Active}}ALERT{{else}}OK{{end}}\n{{.Description}}",
+		Body:    "{{.Message}}\n",
+	})
+	if err != nil {
+		t.Fatal("Error creating notifier: ", err)
+	}
+
+	msg, err := e.render([]string{"ops@example.com"}, Context{
+		Notification: data.Notification{Description: "pump", Message: "pump failed",
+			Active: true}})
+	if err != nil {
+		t.Fatal("Error rendering: ", err)
+	}
+
+	if !strings.Contains(string(msg), "Subject: ALERT pump\r\n") ||
+		!strings.HasSuffix(string(msg), "\r\n\r\npump failed\r\n") {
+		t.Errorf("wrong message:\n%v", string(msg))
+	}
+}
+
+func TestEmailAttachment(t *testing.T) {
+	addr, messages, stop := smtpServer(t, 0)
+	defer stop()
+
+	e, err := NewEmail(nil, EmailConfig{
+		Server: addr,
+		TLS:    EmailNoTLS,
+		From:   "siot@example.com",
+		To:     []string{"ops@example.com"},
+	})
+	if err != nil {
+		t.Fatal("Error creating notifier: ", err)
+	}
+
+	e.Start()
+	defer e.Stop()
+
+	csv := []byte(strings.Repeat("date,device,type,min,max,avg\n", 10))
+	err = e.Send([]string{"plant@example.com"}, "Daily report", "Report attached\n",
+		Attachment{Name: "daily.csv", ContentType: "text/csv", Data: csv})
+	if err != nil {
+		t.Fatal("Error sending email: ", err)
+	}
+
+	var m smtpMessage
+	select {
+	case m = <-messages:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for email")
+	}
+
+	if len(m.to) != 1 || !strings.Contains(m.to[0], "plant@example.com") {
+		t.Error("wrong recipients: ", m.to)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(m.data))
+	if err != nil {
+		t.Fatal("Error parsing message: ", err)
+	}
+
+	if msg.Header.Get("Subject") != "Daily report" {
+		t.Error("wrong subject: ", msg.Header.Get("Subject"))
+	}
+
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal("Error parsing content type: ", err)
+	}
+
+	r := multipart.NewReader(msg.Body, params["boundary"])
+
+	part, err := r.NextPart()
+	if err != nil {
+		t.Fatal("Error reading body: ", err)
+	}
+
+	body, _ := ioutil.ReadAll(part)
+	if string(body) != "Report attached\r\n" {
+		t.Errorf("wrong body: %q", body)
+	}
+
+	part, err = r.NextPart()
+	if err != nil {
+		t.Fatal("Error reading attachment: ", err)
+	}
+
+	if part.FileName() != "daily.csv" || part.Header.Get("Content-Type") != "text/csv" {
+		t.Error("wrong attachment header: ", part.Header)
+	}
+
+	enc, _ := ioutil.ReadAll(part)
+	dec, err := base64.StdEncoding.DecodeString(strings.Replace(string(enc), "\r\n", "", -1))
+	if err != nil || string(dec) != string(csv) {
+		t.Errorf("wrong attachment: %v %q", err, dec)
+	}
+}
@@ -0,0 +1,108 @@
+// Package notify sends rule notifications and system alerts to people over
+// channels like email, SMS, and chat tools. Notifiers render messages with templates that have
+// the context of the device the notification is about, and retry sends
+// that fail in the background.
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+// ErrNoRecipients is returned if a notification has nobody to send it to
+var ErrNoRecipients = errors.New("no notification recipients")
+
+// Notifier sends notifications over a channel
+type Notifier interface {
+	Notify(n data.Notification) error
+}
+
+// Channels sends notifications on named channels, like email and slack
+type Channels map[string]Notifier
+
+// Notify sends a notification on the channels it names, or on all
+// channels if it doesn't name any. The first error is returned.
+func (c Channels) Notify(n data.Notification) error {
+	names := n.Channels
+	if len(names) <= 0 {
+		for name := range c {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	var ret error
+	for _, name := range names {
+		notifier, ok := c[name]
+		if !ok {
+			if ret == nil {
+				ret = fmt.Errorf("notification channel %v is not configured", name)
+			}
+			continue
+		}
+
+		err := notifier.Notify(n)
+		if err != nil && ret == nil {
+			ret = err
+		}
+	}
+
+	return ret
+}
+
+// Context is the data message templates are executed with
+type Context struct {
+	data.Notification
+	// Device is the device the notification is about, if it exists
+	Device *data.Device `json:"device,omitempty"`
+	// Samples are the latest samples of the device
+	Samples []data.Sample `json:"samples,omitempty"`
+}
+
+// newContext looks up the device of a notification
+func newContext(dbInst *db.Db, n data.Notification) Context {
+	ret := Context{Notification: n}
+
+	if n.DeviceID == "" || dbInst == nil {
+		return ret
+	}
+
+	dev, err := dbInst.Device(n.DeviceID)
+	if err == nil {
+		ret.Device = &dev
+	}
+
+	ret.Samples, _ = dbInst.Latest(n.DeviceID)
+
+	return ret
+}
+
+// recipients returns the default recipients and the recipients of the
+// groups the device is a member of, without duplicates
+func recipients(to []string, groups map[string][]string, dev *data.Device) []string {
+	var ret []string
+	seen := make(map[string]bool)
+
+	add := func(rs []string) {
+		for _, r := range rs {
+			if !seen[r] {
+				seen[r] = true
+				ret = append(ret, r)
+			}
+		}
+	}
+
+	add(to)
+
+	if dev != nil {
+		for _, g := range dev.Groups() {
+			add(groups[g])
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,151 @@
+package notify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+// DefaultPushoverMessage is the message template used if none is configured
+const DefaultPushoverMessage = `{{.Message}}` +
+	`{{with .Device}}{{with .Config.Description}} ({{.}}){{end}}{{end}}`
+
+// PushoverConfig describes how notifications are sent with Pushover
+type PushoverConfig struct {
+	// Token is the application API token
+	Token string
+	// User is the user or group key notifications are sent to
+	User string
+	// Priority is the priority of active notifications, -2 to 1. Cleared
+	// notifications are sent with priority 0 if it is higher.
+	Priority int
+	// Message is a text/template template executed with a Context. The
+	// default is used if it is blank.
+	Message string
+	// URL is the Pushover API url (default
+	// https://api.pushover.net/1/messages.json)
+	URL string
+	// Retries is how many times a failed send is retried, with the delay
+	// doubling each time starting at RetryDelay (default 1m)
+	Retries    int
+	RetryDelay time.Duration
+	// Timeout is the time allowed to send a message (default 30s)
+	Timeout time.Duration
+}
+
+// Pushover sends notifications to phones with Pushover. Messages are sent
+// in the background and retried if sending fails.
+type Pushover struct {
+	db      *db.Db
+	config  PushoverConfig
+	message *template.Template
+	client  *http.Client
+	sender  *sender
+}
+
+// NewPushover creates a Pushover notifier. The db is used to look up the
+// device context of notifications, and can be nil. Start starts sending.
+func NewPushover(dbInst *db.Db, config PushoverConfig) (*Pushover, error) {
+	if config.Token == "" || config.User == "" {
+		return nil, errors.New("pushover token and user are required")
+	}
+
+	if config.Priority < -2 || config.Priority > 1 {
+		return nil, errors.New("pushover priority must be -2 to 1")
+	}
+
+	if config.URL == "" {
+		config.URL = "https://api.pushover.net/1/messages.json"
+	}
+
+	err := validateURL("pushover", config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	httpDefaults(&config.RetryDelay, &config.Timeout)
+
+	if config.Message == "" {
+		config.Message = DefaultPushoverMessage
+	}
+
+	message, err := template.New("message").Parse(config.Message)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing pushover template: %v", err)
+	}
+
+	return &Pushover{
+		db:      dbInst,
+		config:  config,
+		message: message,
+		client:  &http.Client{Timeout: config.Timeout},
+		sender:  newSender("pushover message", config.Retries, config.RetryDelay),
+	}, nil
+}
+
+// Start sends queued messages until Stop is called
+func (p *Pushover) Start() {
+	p.sender.start()
+}
+
+// Stop stops sending. Queued messages are dropped.
+func (p *Pushover) Stop() {
+	p.sender.close()
+}
+
+// Notify renders a notification and queues it to be sent. It does not wait
+// for the message to be sent.
+func (p *Pushover) Notify(n data.Notification) error {
+	var msg bytes.Buffer
+	err := p.message.Execute(&msg, newContext(p.db, n))
+	if err != nil {
+		return fmt.Errorf("Error executing pushover template: %v", err)
+	}
+
+	priority := p.config.Priority
+	if !n.Active && priority > 0 {
+		priority = 0
+	}
+
+	title := n.Description
+	if title == "" {
+		title = "SIOT"
+	}
+
+	form := url.Values{
+		"token":    {p.config.Token},
+		"user":     {p.config.User},
+		"title":    {title},
+		"message":  {msg.String()},
+		"priority": {strconv.Itoa(priority)},
+	}
+
+	if !n.Time.IsZero() {
+		form.Set("timestamp", strconv.FormatInt(n.Time.Unix(), 10))
+	}
+
+	body := form.Encode()
+
+	return p.sender.enqueue(job{
+		desc: host(p.config.URL),
+		send: func() error {
+			req, err := http.NewRequest(http.MethodPost, p.config.URL,
+				strings.NewReader(body))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			return post(p.client, req)
+		},
+	})
+}
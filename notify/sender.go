@@ -0,0 +1,103 @@
+package notify
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// job is a message waiting to be sent
+type job struct {
+	// desc describes the message in logs
+	desc     string
+	send     func() error
+	attempts int
+}
+
+// sender sends messages in the background, and retries failed sends with
+// the delay doubling each time
+type sender struct {
+	name    string
+	retries int
+	delay   time.Duration
+	queue   chan job
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newSender(name string, retries int, delay time.Duration) *sender {
+	return &sender{
+		name:    name,
+		retries: retries,
+		delay:   delay,
+		queue:   make(chan job, 100),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+func (s *sender) start() {
+	go s.run()
+}
+
+// close stops sending. Queued messages are dropped.
+func (s *sender) close() {
+	close(s.stop)
+	<-s.done
+}
+
+// enqueue queues a message to be sent as soon as possible
+func (s *sender) enqueue(j job) error {
+	select {
+	case s.queue <- j:
+		return nil
+	default:
+		return errors.New(s.name + " queue is full")
+	}
+}
+
+// later queues a message after a delay
+func (s *sender) later(j job, delay time.Duration) {
+	go func() {
+		select {
+		case <-time.After(delay):
+			select {
+			case s.queue <- j:
+			case <-s.stop:
+			}
+		case <-s.stop:
+		}
+	}()
+}
+
+func (s *sender) run() {
+	defer close(s.done)
+
+	for {
+		select {
+		case j := <-s.queue:
+			err := j.send()
+			if err != nil {
+				s.retry(j, err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// retry queues a message again after a delay, if it has retries left
+func (s *sender) retry(j job, err error) {
+	j.attempts++
+	if j.attempts > s.retries {
+		log.Printf("Error sending %v to %v, giving up: %v\n", s.name, j.desc,
+			err)
+		return
+	}
+
+	delay := s.delay << uint(j.attempts-1)
+	log.Printf("Error sending %v to %v, retrying in %v: %v\n", s.name, j.desc,
+		delay, err)
+
+	s.later(j, delay)
+}
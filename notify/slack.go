@@ -0,0 +1,109 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+// DefaultSlackText is the message template used if none is configured
+const DefaultSlackText = `{{if .Active}}:warning:{{else}}:white_check_mark:{{end}} {{.Message}}` +
+	`{{with .Device}}{{with .Config.Description}} ({{.}}){{end}}{{end}}`
+
+// SlackConfig describes how notifications are sent to Slack
+type SlackConfig struct {
+	// URL is the incoming webhook url of the channel
+	URL string
+	// Text is a text/template template executed with a Context. The
+	// default is used if it is blank.
+	Text string
+	// Retries is how many times a failed post is retried, with the delay
+	// doubling each time starting at RetryDelay (default 1m)
+	Retries    int
+	RetryDelay time.Duration
+	// Timeout is the time allowed to post a message (default 30s)
+	Timeout time.Duration
+}
+
+// Slack posts notifications to a Slack incoming webhook. Messages are
+// posted in the background and retried if posting fails.
+type Slack struct {
+	db     *db.Db
+	config SlackConfig
+	text   *template.Template
+	client *http.Client
+	sender *sender
+}
+
+// NewSlack creates a Slack notifier. The db is used to look up the device
+// context of notifications, and can be nil. Start starts posting.
+func NewSlack(dbInst *db.Db, config SlackConfig) (*Slack, error) {
+	err := validateURL("slack", config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	httpDefaults(&config.RetryDelay, &config.Timeout)
+
+	if config.Text == "" {
+		config.Text = DefaultSlackText
+	}
+
+	text, err := template.New("text").Parse(config.Text)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing slack template: %v", err)
+	}
+
+	return &Slack{
+		db:     dbInst,
+		config: config,
+		text:   text,
+		client: &http.Client{Timeout: config.Timeout},
+		sender: newSender("slack message", config.Retries, config.RetryDelay),
+	}, nil
+}
+
+// Start posts queued messages until Stop is called
+func (s *Slack) Start() {
+	s.sender.start()
+}
+
+// Stop stops posting. Queued messages are dropped.
+func (s *Slack) Stop() {
+	s.sender.close()
+}
+
+// Notify renders a notification and queues it to be posted. It does not
+// wait for the post.
+func (s *Slack) Notify(n data.Notification) error {
+	var text bytes.Buffer
+	err := s.text.Execute(&text, newContext(s.db, n))
+	if err != nil {
+		return fmt.Errorf("Error executing slack template: %v", err)
+	}
+
+	body, err := json.Marshal(map[string]string{"text": text.String()})
+	if err != nil {
+		return err
+	}
+
+	return s.sender.enqueue(job{
+		desc: host(s.config.URL),
+		send: func() error {
+			req, err := http.NewRequest(http.MethodPost, s.config.URL,
+				bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			return post(s.client, req)
+		},
+	})
+}
@@ -0,0 +1,523 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+// SMS providers
+const (
+	// SMSTwilio sends messages with the Twilio API
+	SMSTwilio = "twilio"
+	// SMSHTTP posts messages to a generic HTTP gateway as JSON with to,
+	// from, message, and statusUrl fields. The gateway can return the
+	// message id and status as JSON id and status fields.
+	SMSHTTP = "http"
+)
+
+// SMS delivery states, in addition to the states reported by the provider
+// (like sent, delivered, undelivered, and failed)
+const (
+	SMSPending     = "pending"
+	SMSHeld        = "held"
+	SMSRateLimited = "rateLimited"
+	SMSFailed      = "failed"
+)
+
+// DefaultSMSBody is the message template used if none is configured
+const DefaultSMSBody = `SIOT: {{.Message}}`
+
+// smsHistory is the number of message statuses that are kept
+const smsHistory = 200
+
+// SMSConfig describes how text messages are sent
+type SMSConfig struct {
+	// Provider is twilio or http
+	Provider string
+	// URL is the gateway URL of http providers, or the Twilio API URL
+	// (default https://api.twilio.com)
+	URL string
+	// User and Pass are the Twilio account SID and auth token, or the
+	// basic auth of http gateways if set
+	User string
+	Pass string
+	From string
+	// To is who all notifications are sent to
+	To []string
+	// Groups are who notifications about devices in a group are sent to
+	Groups map[string][]string
+	// Body is a text/template template executed with a Context. The
+	// default is used if it is blank.
+	Body string
+	// RateLimit is the max messages sent to a number per hour. Messages
+	// over the limit are dropped. 0 is unlimited.
+	RateLimit int
+	// QuietHours are windows when messages are held until the window ends,
+	// in the local time of Timezone (UTC if blank)
+	QuietHours []data.MaintenanceWindow
+	Timezone   string
+	// StatusURL is the public URL of the delivery status callback, which is
+	// sent to the provider if set
+	StatusURL string
+	// Retries is how many times a failed send is retried, with the delay
+	// doubling each time starting at RetryDelay (default 1m)
+	Retries    int
+	RetryDelay time.Duration
+	// Timeout is the time allowed to send a message (default 30s)
+	Timeout time.Duration
+}
+
+// Validate checks the config is valid
+func (c SMSConfig) Validate() error {
+	switch c.Provider {
+	case SMSTwilio:
+		if c.User == "" || c.Pass == "" {
+			return errors.New("twilio account SID and auth token are required")
+		}
+	case SMSHTTP:
+		if c.URL == "" {
+			return errors.New("SMS gateway url is required")
+		}
+	default:
+		return fmt.Errorf("unsupported SMS provider: %v", c.Provider)
+	}
+
+	if c.URL != "" {
+		_, err := url.Parse(c.URL)
+		if err != nil {
+			return fmt.Errorf("invalid SMS url: %v", err)
+		}
+	}
+
+	if c.From == "" {
+		return errors.New("SMS from number is required")
+	}
+
+	if len(c.To) <= 0 && len(c.Groups) <= 0 {
+		return errors.New("SMS recipients are required")
+	}
+
+	if c.RateLimit < 0 {
+		return errors.New("SMS rate limit can't be negative")
+	}
+
+	for _, w := range c.QuietHours {
+		err := w.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Timezone != "" {
+		err := data.ValidateTimezone(c.Timezone)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Retries < 0 {
+		return errors.New("SMS retries can't be negative")
+	}
+
+	return nil
+}
+
+// SMSStatus is the delivery status of a text message
+type SMSStatus struct {
+	// ID is assigned when the message is queued
+	ID uint64 `json:"id"`
+	// ProviderID is the id the provider assigned the message, and is used
+	// for status updates
+	ProviderID string `json:"providerId,omitempty"`
+	To         string `json:"to"`
+	Message    string `json:"message"`
+	// Status is pending, held, rateLimited, failed, or a state reported by
+	// the provider
+	Status  string    `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+	Updated time.Time `json:"updated"`
+}
+
+// SMS sends notifications as text messages, and tracks their delivery
+// status. Messages are sent in the background and retried if sending
+// fails.
+type SMS struct {
+	db       *db.Db
+	config   SMSConfig
+	loc      *time.Location
+	body     *template.Template
+	client   *http.Client
+	sender   *sender
+	lock     sync.Mutex
+	nextID   uint64
+	statuses []SMSStatus
+	// sent are the recent send times for each number, for rate limiting
+	sent map[string][]time.Time
+}
+
+// NewSMS creates an SMS notifier. The db is used to look up the device
+// context of notifications, and can be nil. Start starts sending.
+func NewSMS(dbInst *db.Db, config SMSConfig) (*SMS, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Provider == SMSTwilio && config.URL == "" {
+		config.URL = "https://api.twilio.com"
+	}
+
+	if config.RetryDelay == 0 {
+		config.RetryDelay = time.Minute
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = 30 * time.Second
+	}
+
+	if config.Body == "" {
+		config.Body = DefaultSMSBody
+	}
+
+	loc := time.UTC
+	if config.Timezone != "" {
+		loc, err = time.LoadLocation(config.Timezone)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	body, err := template.New("body").Parse(config.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing SMS template: %v", err)
+	}
+
+	return &SMS{
+		db:     dbInst,
+		config: config,
+		loc:    loc,
+		body:   body,
+		client: &http.Client{Timeout: config.Timeout},
+		sender: newSender("SMS", config.Retries, config.RetryDelay),
+		sent:   make(map[string][]time.Time),
+	}, nil
+}
+
+// Start sends queued messages until Stop is called
+func (s *SMS) Start() {
+	s.sender.start()
+}
+
+// Stop stops sending. Queued and held messages are dropped.
+func (s *SMS) Stop() {
+	s.sender.close()
+}
+
+// Notify renders a notification and queues a message for each recipient.
+// Messages are held during quiet hours, and dropped if a recipient is over
+// the rate limit. It does not wait for messages to be sent.
+func (s *SMS) Notify(n data.Notification) error {
+	ctx := newContext(s.db, n)
+
+	to := recipients(s.config.To, s.config.Groups, ctx.Device)
+	if len(to) <= 0 {
+		return ErrNoRecipients
+	}
+
+	var body bytes.Buffer
+	err := s.body.Execute(&body, ctx)
+	if err != nil {
+		return fmt.Errorf("Error executing SMS template: %v", err)
+	}
+	msg := strings.TrimSpace(body.String())
+
+	now := time.Now()
+
+	var hold time.Duration
+	if len(s.config.QuietHours) > 0 {
+		start, end, ok := data.NextMaintenance(s.config.QuietHours, now, s.loc)
+		if ok && !start.After(now) {
+			hold = end.Sub(now)
+		}
+	}
+
+	var ret error
+	for _, r := range to {
+		id, status := s.queued(r, msg, now, hold > 0)
+
+		j := job{
+			desc: r,
+			send: func(r string, id uint64) func() error {
+				return func() error {
+					return s.deliver(id, r, msg)
+				}
+			}(r, id),
+		}
+
+		switch status {
+		case SMSRateLimited:
+			log.Printf("SMS to %v dropped, over the rate limit\n", r)
+		case SMSHeld:
+			s.sender.later(j, hold)
+		default:
+			err := s.sender.enqueue(j)
+			if err != nil {
+				s.update(id, "", SMSFailed, err.Error())
+				if ret == nil {
+					ret = err
+				}
+			}
+		}
+	}
+
+	return ret
+}
+
+// queued records a new message and returns its id and status. Held
+// messages count toward the rate limit.
+func (s *SMS) queued(to, msg string, now time.Time, held bool) (uint64, string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	status := SMSPending
+	if held {
+		status = SMSHeld
+	}
+
+	if limit := s.config.RateLimit; limit > 0 {
+		var recent []time.Time
+		for _, t := range s.sent[to] {
+			if now.Sub(t) < time.Hour {
+				recent = append(recent, t)
+			}
+		}
+
+		if len(recent) >= limit {
+			status = SMSRateLimited
+		} else {
+			recent = append(recent, now)
+		}
+
+		s.sent[to] = recent
+	}
+
+	s.nextID++
+	s.statuses = append(s.statuses, SMSStatus{
+		ID:      s.nextID,
+		To:      to,
+		Message: msg,
+		Status:  status,
+		Time:    now,
+		Updated: now,
+	})
+
+	if len(s.statuses) > smsHistory {
+		s.statuses = s.statuses[len(s.statuses)-smsHistory:]
+	}
+
+	return s.nextID, status
+}
+
+// update sets the status of a message. Statuses of messages that are no
+// longer in the history are ignored.
+func (s *SMS) update(id uint64, providerID, status, errMsg string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := range s.statuses {
+		st := &s.statuses[i]
+		if st.ID != id {
+			continue
+		}
+
+		if providerID != "" {
+			st.ProviderID = providerID
+		}
+		st.Status = status
+		st.Error = errMsg
+		st.Updated = time.Now()
+		return
+	}
+}
+
+// Statuses returns the delivery status of recent messages, newest first
+func (s *SMS) Statuses() []SMSStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ret := make([]SMSStatus, len(s.statuses))
+	for i, st := range s.statuses {
+		ret[len(ret)-1-i] = st
+	}
+
+	return ret
+}
+
+// UpdateStatus sets the status of a message from a provider status
+// callback. It returns false if the message is unknown.
+func (s *SMS) UpdateStatus(providerID, status, errMsg string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := range s.statuses {
+		st := &s.statuses[i]
+		if st.ProviderID != "" && st.ProviderID == providerID {
+			st.Status = status
+			st.Error = errMsg
+			st.Updated = time.Now()
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidSignature checks the X-Twilio-Signature of a status callback with
+// form params. Callbacks from http gateways are not signed.
+func (s *SMS) ValidSignature(params url.Values, signature string) bool {
+	if s.config.Provider != SMSTwilio {
+		return true
+	}
+
+	// the signature is of the url followed by the sorted params and
+	// their values
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	mac := hmac.New(sha1.New, []byte(s.config.Pass))
+	mac.Write([]byte(s.config.StatusURL))
+	for _, k := range keys {
+		for _, v := range params[k] {
+			mac.Write([]byte(k + v))
+		}
+	}
+
+	exp := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(exp), []byte(signature))
+}
+
+// smsResponse is the response of the provider to a send
+type smsResponse struct {
+	// Twilio fields
+	Sid          string `json:"sid"`
+	ErrorMessage string `json:"error_message"`
+	Message      string `json:"message"`
+	// http gateway fields
+	ID string `json:"id"`
+	// Status is used by both
+	Status string `json:"status"`
+}
+
+// deliver sends a message and records the result
+func (s *SMS) deliver(id uint64, to, msg string) error {
+	resp, err := s.send(to, msg)
+	if err != nil {
+		s.update(id, "", SMSFailed, err.Error())
+		return err
+	}
+
+	status := resp.Status
+	if status == "" {
+		status = "sent"
+	}
+
+	providerID := resp.Sid
+	if providerID == "" {
+		providerID = resp.ID
+	}
+
+	s.update(id, providerID, status, resp.ErrorMessage)
+	return nil
+}
+
+// send sends a message with the provider
+func (s *SMS) send(to, msg string) (smsResponse, error) {
+	c := s.config
+
+	var req *http.Request
+	var err error
+
+	switch c.Provider {
+	case SMSTwilio:
+		form := url.Values{"To": {to}, "From": {c.From}, "Body": {msg}}
+		if c.StatusURL != "" {
+			form.Set("StatusCallback", c.StatusURL)
+		}
+
+		u := fmt.Sprintf("%v/2010-04-01/Accounts/%v/Messages.json",
+			strings.TrimRight(c.URL, "/"), url.PathEscape(c.User))
+
+		req, err = http.NewRequest(http.MethodPost, u,
+			strings.NewReader(form.Encode()))
+		if err != nil {
+			return smsResponse{}, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	default:
+		body, err := json.Marshal(map[string]string{
+			"to":        to,
+			"from":      c.From,
+			"message":   msg,
+			"statusUrl": c.StatusURL,
+		})
+		if err != nil {
+			return smsResponse{}, err
+		}
+
+		req, err = http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(body))
+		if err != nil {
+			return smsResponse{}, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if c.User != "" {
+		req.SetBasicAuth(c.User, c.Pass)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return smsResponse{}, err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return smsResponse{}, err
+	}
+
+	var ret smsResponse
+	// gateways aren't required to return JSON
+	_ = json.Unmarshal(b, &ret)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		if ret.Message != "" {
+			return ret, fmt.Errorf("SMS provider returned %v: %v",
+				res.StatusCode, ret.Message)
+		}
+		return ret, fmt.Errorf("SMS provider returned %v", res.StatusCode)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,160 @@
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func TestSMSTwilio(t *testing.T) {
+	requests := make(chan url.Values, 10)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		user, pass, _ := req.BasicAuth()
+		if req.URL.Path != "/2010-04-01/Accounts/AC123/Messages.json" ||
+			user != "AC123" || pass != "token" {
+			http.Error(res, `{"message": "bad request"}`, http.StatusBadRequest)
+			return
+		}
+
+		req.ParseForm()
+		requests <- req.PostForm
+		res.WriteHeader(http.StatusCreated)
+		fmt.Fprint(res, `{"sid": "SM1", "status": "queued"}`)
+	}))
+	defer ts.Close()
+
+	s, err := NewSMS(nil, SMSConfig{
+		Provider:  SMSTwilio,
+		URL:       ts.URL,
+		User:      "AC123",
+		Pass:      "token",
+		From:      "+15550001",
+		To:        []string{"+15550002"},
+		RateLimit: 1,
+		StatusURL: "https://siot.example.com/v1/notifications/sms/status",
+	})
+	if err != nil {
+		t.Fatal("Error creating notifier: ", err)
+	}
+
+	s.Start()
+	defer s.Stop()
+
+	n := data.Notification{Message: "pump failed", Active: true, Time: time.Now()}
+	err = s.Notify(n)
+	if err != nil {
+		t.Fatal("Error sending notification: ", err)
+	}
+
+	select {
+	case form := <-requests:
+		if form.Get("To") != "+15550002" || form.Get("From") != "+15550001" ||
+			form.Get("Body") != "SIOT: pump failed" ||
+			form.Get("StatusCallback") == "" {
+			t.Error("wrong request: ", form)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for message")
+	}
+
+	// over the rate limit
+	err = s.Notify(n)
+	if err != nil {
+		t.Fatal("Error sending notification: ", err)
+	}
+
+	var statuses []SMSStatus
+	for start := time.Now(); time.Since(start) < 2*time.Second; {
+		statuses = s.Statuses()
+		if len(statuses) == 2 && statuses[1].Status != SMSPending {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(statuses) != 2 || statuses[0].Status != SMSRateLimited ||
+		statuses[1].Status != "queued" || statuses[1].ProviderID != "SM1" {
+		t.Fatalf("wrong statuses: %+v", statuses)
+	}
+
+	params := url.Values{"MessageSid": {"SM1"}, "MessageStatus": {"delivered"}}
+	mac := hmac.New(sha1.New, []byte("token"))
+	mac.Write([]byte("https://siot.example.com/v1/notifications/sms/status" +
+		"MessageSidSM1MessageStatusdelivered"))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	if !s.ValidSignature(params, sig) {
+		t.Error("valid signature failed")
+	}
+
+	if s.ValidSignature(params, "bogus") {
+		t.Error("invalid signature passed")
+	}
+
+	if !s.UpdateStatus("SM1", "delivered", "") || s.UpdateStatus("SM9", "sent", "") {
+		t.Error("wrong status update result")
+	}
+
+	if st := s.Statuses()[1]; st.Status != "delivered" {
+		t.Error("status was not updated: ", st.Status)
+	}
+
+	select {
+	case <-requests:
+		t.Error("rate limited message was sent")
+	default:
+	}
+}
+
+func TestSMSQuietHours(t *testing.T) {
+	sent := make(chan struct{}, 10)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		sent <- struct{}{}
+		fmt.Fprint(res, `{"id": "1"}`)
+	}))
+	defer ts.Close()
+
+	now := time.Now().UTC()
+
+	s, err := NewSMS(nil, SMSConfig{
+		Provider: SMSHTTP,
+		URL:      ts.URL,
+		From:     "siot",
+		To:       []string{"+15550002"},
+		QuietHours: []data.MaintenanceWindow{{
+			Start:    now.Add(-time.Hour).Format("15:04"),
+			Duration: "3h",
+		}},
+	})
+	if err != nil {
+		t.Fatal("Error creating notifier: ", err)
+	}
+
+	s.Start()
+	defer s.Stop()
+
+	err = s.Notify(data.Notification{Message: "tank low", Time: now})
+	if err != nil {
+		t.Fatal("Error sending notification: ", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if len(sent) != 0 {
+		t.Error("message was sent during quiet hours")
+	}
+
+	if st := s.Statuses(); len(st) != 1 || st[0].Status != SMSHeld {
+		t.Errorf("wrong statuses: %+v", st)
+	}
+}
@@ -0,0 +1,175 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+// webhook signature headers
+const (
+	WebhookTimestampHeader = "X-Siot-Timestamp"
+	WebhookSignatureHeader = "X-Siot-Signature"
+)
+
+// WebhookConfig describes where notifications are posted
+type WebhookConfig struct {
+	URL string
+	// Secret signs requests if set
+	Secret string
+	// Retries is how many times a failed post is retried, with the delay
+	// doubling each time starting at RetryDelay (default 1m)
+	Retries    int
+	RetryDelay time.Duration
+	// Timeout is the time allowed to post a notification (default 30s)
+	Timeout time.Duration
+}
+
+// Webhook posts notifications as JSON, with the device context. Requests
+// are signed with the secret, so receivers can check they came from SIOT.
+// Notifications are posted in the background and retried if posting
+// fails.
+type Webhook struct {
+	db     *db.Db
+	config WebhookConfig
+	client *http.Client
+	sender *sender
+}
+
+// NewWebhook creates a webhook notifier. The db is used to look up the
+// device context of notifications, and can be nil. Start starts posting.
+func NewWebhook(dbInst *db.Db, config WebhookConfig) (*Webhook, error) {
+	err := validateURL("webhook", config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	httpDefaults(&config.RetryDelay, &config.Timeout)
+
+	return &Webhook{
+		db:     dbInst,
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		sender: newSender("webhook", config.Retries, config.RetryDelay),
+	}, nil
+}
+
+// Start posts queued notifications until Stop is called
+func (w *Webhook) Start() {
+	w.sender.start()
+}
+
+// Stop stops posting. Queued notifications are dropped.
+func (w *Webhook) Stop() {
+	w.sender.close()
+}
+
+// WebhookSignature returns the signature of a request, which is the hex
+// encoded HMAC-SHA256 of the timestamp header, '.', and the body
+func WebhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notify queues a notification to be posted. It does not wait for the post.
+func (w *Webhook) Notify(n data.Notification) error {
+	body, err := json.Marshal(newContext(w.db, n))
+	if err != nil {
+		return err
+	}
+
+	return w.sender.enqueue(job{
+		desc: host(w.config.URL),
+		send: func() error {
+			req, err := http.NewRequest(http.MethodPost, w.config.URL,
+				bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			// the timestamp lets receivers reject replayed requests
+			if w.config.Secret != "" {
+				ts := strconv.FormatInt(time.Now().Unix(), 10)
+				req.Header.Set(WebhookTimestampHeader, ts)
+				req.Header.Set(WebhookSignatureHeader,
+					WebhookSignature(w.config.Secret, ts, body))
+			}
+
+			return post(w.client, req)
+		},
+	})
+}
+
+// httpDefaults sets the default retry delay and timeout of notifiers that
+// post to a url
+func httpDefaults(retryDelay, timeout *time.Duration) {
+	if *retryDelay == 0 {
+		*retryDelay = time.Minute
+	}
+
+	if *timeout == 0 {
+		*timeout = 30 * time.Second
+	}
+}
+
+// validateURL checks a notifier url is set and valid
+func validateURL(name, u string) error {
+	if u == "" {
+		return fmt.Errorf("%v url is required", name)
+	}
+
+	pu, err := url.Parse(u)
+	if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") {
+		return fmt.Errorf("invalid %v url: %v", name, u)
+	}
+
+	return nil
+}
+
+// host returns the host of a url, which is used in logs because the rest of
+// webhook urls is often secret
+func host(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	return pu.Host
+}
+
+// post sends a request and returns an error if it was not successful
+func post(client *http.Client, req *http.Request) error {
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		msg := strings.TrimSpace(string(body))
+		if msg == "" {
+			msg = res.Status
+		}
+		return fmt.Errorf("%v returned %v: %v", req.URL.Host, res.StatusCode,
+			msg)
+	}
+
+	return nil
+}
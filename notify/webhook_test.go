@@ -0,0 +1,153 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// testServer returns a server that sends requests to a channel
+func testServer() (*httptest.Server, <-chan *http.Request, <-chan []byte) {
+	requests := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		requests <- req
+		bodies <- body
+	}))
+
+	return ts, requests, bodies
+}
+
+func receive(t *testing.T, requests <-chan *http.Request, bodies <-chan []byte) (*http.Request, []byte) {
+	select {
+	case req := <-requests:
+		return req, <-bodies
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for request")
+	}
+	return nil, nil
+}
+
+func TestWebhook(t *testing.T) {
+	ts, requests, bodies := testServer()
+	defer ts.Close()
+
+	w, err := NewWebhook(nil, WebhookConfig{URL: ts.URL + "/hook", Secret: "s3cret"})
+	if err != nil {
+		t.Fatal("Error creating notifier: ", err)
+	}
+
+	w.Start()
+	defer w.Stop()
+
+	err = w.Notify(data.Notification{RuleID: 2, Message: "tank high",
+		DeviceID: "1234", Active: true})
+	if err != nil {
+		t.Fatal("Error sending notification: ", err)
+	}
+
+	req, body := receive(t, requests, bodies)
+
+	ts1 := req.Header.Get(WebhookTimestampHeader)
+	if req.Header.Get(WebhookSignatureHeader) != WebhookSignature("s3cret", ts1, body) {
+		t.Error("wrong signature")
+	}
+
+	var n data.Notification
+	err = json.Unmarshal(body, &n)
+	if err != nil || n.RuleID != 2 || n.Message != "tank high" || !n.Active {
+		t.Errorf("wrong notification: %+v, %v", n, err)
+	}
+}
+
+func TestSlack(t *testing.T) {
+	ts, requests, bodies := testServer()
+	defer ts.Close()
+
+	s, err := NewSlack(nil, SlackConfig{URL: ts.URL})
+	if err != nil {
+		t.Fatal("Error creating notifier: ", err)
+	}
+
+	s.Start()
+	defer s.Stop()
+
+	err = s.Notify(data.Notification{Message: "tank ok"})
+	if err != nil {
+		t.Fatal("Error sending notification: ", err)
+	}
+
+	_, body := receive(t, requests, bodies)
+
+	var msg map[string]string
+	err = json.Unmarshal(body, &msg)
+	if err != nil || msg["text"] != ":white_check_mark: tank ok" {
+		t.Errorf("wrong message: %v, %v", string(body), err)
+	}
+}
+
+func TestPushover(t *testing.T) {
+	ts, requests, bodies := testServer()
+	defer ts.Close()
+
+	p, err := NewPushover(nil, PushoverConfig{URL: ts.URL, Token: "app",
+		User: "user", Priority: 1})
+	if err != nil {
+		t.Fatal("Error creating notifier: ", err)
+	}
+
+	p.Start()
+	defer p.Stop()
+
+	err = p.Notify(data.Notification{Description: "pump", Message: "pump failed",
+		Active: true, Time: time.Unix(1000, 0)})
+	if err != nil {
+		t.Fatal("Error sending notification: ", err)
+	}
+
+	_, body := receive(t, requests, bodies)
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil || form.Get("token") != "app" || form.Get("user") != "user" ||
+		form.Get("title") != "pump" || form.Get("message") != "pump failed" ||
+		form.Get("priority") != "1" || form.Get("timestamp") != "1000" {
+		t.Errorf("wrong form: %v, %v", form, err)
+	}
+}
+
+type testNotifier []data.Notification
+
+func (t *testNotifier) Notify(n data.Notification) error {
+	*t = append(*t, n)
+	return nil
+}
+
+func TestChannels(t *testing.T) {
+	var email, slack testNotifier
+	c := Channels{data.ChannelEmail: &email, data.ChannelSlack: &slack}
+
+	err := c.Notify(data.Notification{Message: "all"})
+	if err != nil || len(email) != 1 || len(slack) != 1 {
+		t.Error("notification was not sent on all channels: ", err)
+	}
+
+	err = c.Notify(data.Notification{Message: "slack",
+		Channels: []string{data.ChannelSlack}})
+	if err != nil || len(email) != 1 || len(slack) != 2 {
+		t.Error("notification was not sent on its channel: ", err)
+	}
+
+	err = c.Notify(data.Notification{Message: "sms",
+		Channels: []string{data.ChannelSMS, data.ChannelEmail}})
+	if err == nil || len(email) != 2 {
+		t.Error("unconfigured channel should be an error, and others sent")
+	}
+}
@@ -0,0 +1,284 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// clockSkew is how far the provider's clock can be off
+const clockSkew = time.Minute
+
+// keyRefetch is the shortest time between fetches of the provider keys,
+// so tokens with unknown key IDs can't be used to flood the provider
+const keyRefetch = time.Minute
+
+// Claims are the claims of an ID token
+type Claims map[string]interface{}
+
+// String returns a string claim
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns a claim that is a string or list of strings
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var ret []string
+		for _, i := range v {
+			if s, ok := i.(string); ok {
+				ret = append(ret, s)
+			}
+		}
+		return ret
+	}
+
+	return nil
+}
+
+// time returns a NumericDate claim
+func (c Claims) time(name string) (time.Time, bool) {
+	v, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(v), 0), true
+}
+
+// jwk is a JSON web key
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
+
+// publicKey returns the RSA or P-256 public key of a JWK
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid RSA exponent")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve: %v", k.Crv)
+		}
+
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC key")
+		}
+
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type: %v", k.Kty)
+}
+
+// key returns the provider signing key with an ID. The keys are fetched
+// again if the ID is not known, since providers rotate their keys.
+func (p *Provider) key(kid string) (interface{}, error) {
+	p.lock.Lock()
+	key, ok := p.keys[kid]
+	fetch := time.Since(p.fetched) > keyRefetch
+	p.lock.Unlock()
+
+	if ok {
+		return key, nil
+	}
+
+	if !fetch {
+		return nil, fmt.Errorf("unknown signing key: %v", kid)
+	}
+
+	d, err := p.metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	err = p.getJSON(d.JwksURI, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		pub, err := k.publicKey()
+		if err != nil {
+			// skip keys we can't use
+			continue
+		}
+
+		keys[k.Kid] = pub
+	}
+
+	p.lock.Lock()
+	p.keys = keys
+	p.fetched = time.Now()
+	p.lock.Unlock()
+
+	key, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key: %v", kid)
+	}
+
+	return key, nil
+}
+
+// verify checks the signature and claims of an ID token, and returns the
+// claims
+func (p *Provider) verify(token, nonce string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	h, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed ID token header")
+	}
+
+	err = json.Unmarshal(h, &header)
+	if err != nil {
+		return nil, errors.New("malformed ID token header")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ID token signature")
+	}
+
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	switch header.Alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("ID token algorithm does not match key")
+		}
+
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+		if err != nil {
+			return nil, errors.New("invalid ID token signature")
+		}
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return nil, errors.New("ID token algorithm does not match key")
+		}
+
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return nil, errors.New("invalid ID token signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported ID token algorithm: %v", header.Alg)
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed ID token claims")
+	}
+
+	var claims Claims
+	err = json.Unmarshal(b, &claims)
+	if err != nil {
+		return nil, errors.New("malformed ID token claims")
+	}
+
+	if strings.TrimRight(claims.String("iss"), "/") != p.config.Issuer {
+		return nil, errors.New("ID token has the wrong issuer")
+	}
+
+	aud := claims.Strings("aud")
+	found := false
+	for _, a := range aud {
+		if a == p.config.ClientID {
+			found = true
+		}
+	}
+
+	if !found {
+		return nil, errors.New("ID token has the wrong audience")
+	}
+
+	now := time.Now()
+	exp, ok := claims.time("exp")
+	if !ok || now.After(exp.Add(clockSkew)) {
+		return nil, errors.New("ID token has expired")
+	}
+
+	if iat, ok := claims.time("iat"); ok && iat.After(now.Add(clockSkew)) {
+		return nil, errors.New("ID token is from the future")
+	}
+
+	if claims.String("nonce") != nonce {
+		return nil, errors.New("ID token has the wrong nonce")
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,352 @@
+// Package oidc implements OpenID Connect single sign-on with the
+// authorization code flow. Users log in at an identity provider like
+// Google, Azure AD, or Keycloak, and the groups in their ID token are
+// mapped to SIOT roles.
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// ErrNoRole is returned when a user is not in any group that maps to a
+// role, and there is no default role
+var ErrNoRole = errors.New("user is not allowed to log in")
+
+// Config describes an identity provider
+type Config struct {
+	// Issuer is the issuer URL of the provider. The endpoints are read
+	// from <Issuer>/.well-known/openid-configuration.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the callback URL registered with the provider
+	RedirectURL string
+	// Scopes requested (default openid, email, and profile)
+	Scopes []string
+	// UsernameClaim is the ID token claim used as the username (default
+	// email)
+	UsernameClaim string
+	// GroupsClaim is the ID token claim that lists the groups of the user
+	// (default groups)
+	GroupsClaim string
+	// Roles maps groups to roles, see ParseRoles
+	Roles Roles
+	// Client is used to reach the provider (default http.DefaultClient
+	// with a timeout)
+	Client *http.Client
+}
+
+// Identity is a user that logged in at the provider
+type Identity struct {
+	Username string
+	Role     string
+	Groups   []string
+}
+
+// discovery is the provider metadata
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// Provider logs users in at an identity provider. The provider metadata
+// is read on first use, so the server can start while the provider is
+// down.
+type Provider struct {
+	config Config
+
+	lock      sync.Mutex
+	discovery *discovery
+	keys      map[string]interface{}
+	fetched   time.Time
+}
+
+// New creates a new provider
+func New(config Config) (*Provider, error) {
+	if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return nil, errors.New("issuer, client ID, and redirect URL are required")
+	}
+
+	config.Issuer = strings.TrimRight(config.Issuer, "/")
+
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "email"
+	}
+
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	return &Provider{config: config}, nil
+}
+
+// getJSON reads a JSON document from the provider
+func (p *Provider) getJSON(u string, ret interface{}) error {
+	resp, err := p.config.Client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("OIDC provider error: %v %v", resp.Status, u)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(ret)
+}
+
+// metadata returns the provider metadata, reading it if needed
+func (p *Provider) metadata() (*discovery, error) {
+	p.lock.Lock()
+	d := p.discovery
+	p.lock.Unlock()
+
+	if d != nil {
+		return d, nil
+	}
+
+	d = &discovery{}
+	err := p.getJSON(p.config.Issuer+"/.well-known/openid-configuration", d)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimRight(d.Issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("OIDC issuer mismatch: %v", d.Issuer)
+	}
+
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JwksURI == "" {
+		return nil, errors.New("OIDC provider metadata is incomplete")
+	}
+
+	p.lock.Lock()
+	p.discovery = d
+	p.lock.Unlock()
+
+	return d, nil
+}
+
+// randomString returns a random URL safe string
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Login is a login in progress. State is sent to the provider and
+// returned to the callback, where it is used to find the login.
+type Login struct {
+	State    string
+	Nonce    string
+	Verifier string
+	// URL is where the user is redirected to log in
+	URL string
+}
+
+// Login starts a login
+func (p *Provider) Login() (ret Login, err error) {
+	d, err := p.metadata()
+	if err != nil {
+		return ret, err
+	}
+
+	for _, s := range []*string{&ret.State, &ret.Nonce, &ret.Verifier} {
+		*s, err = randomString()
+		if err != nil {
+			return ret, err
+		}
+	}
+
+	// PKCE, so a stolen code can't be exchanged
+	challenge := sha256.Sum256([]byte(ret.Verifier))
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.config.ClientID)
+	v.Set("redirect_uri", p.config.RedirectURL)
+	v.Set("scope", strings.Join(p.config.Scopes, " "))
+	v.Set("state", ret.State)
+	v.Set("nonce", ret.Nonce)
+	v.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	ret.URL = d.AuthorizationEndpoint + sep + v.Encode()
+	return ret, nil
+}
+
+// tokenResponse is returned by the token endpoint
+type tokenResponse struct {
+	IDToken string `json:"id_token"`
+	Error   string `json:"error"`
+	Desc    string `json:"error_description"`
+}
+
+// Exchange exchanges the code returned to the callback for an ID token,
+// verifies it, and returns the identity of the user. ErrNoRole is
+// returned if the user's groups don't map to a role.
+func (p *Provider) Exchange(login Login, code string) (ret Identity, err error) {
+	d, err := p.metadata()
+	if err != nil {
+		return ret, err
+	}
+
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", p.config.RedirectURL)
+	v.Set("code_verifier", login.Verifier)
+
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint,
+		strings.NewReader(v.Encode()))
+	if err != nil {
+		return ret, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID),
+		url.QueryEscape(p.config.ClientSecret))
+
+	resp, err := p.config.Client.Do(req)
+	if err != nil {
+		return ret, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ret, err
+	}
+
+	var t tokenResponse
+	err = json.Unmarshal(body, &t)
+	if err != nil {
+		return ret, fmt.Errorf("OIDC token error: %v", resp.Status)
+	}
+
+	if t.Error != "" {
+		return ret, fmt.Errorf("OIDC token error: %v %v", t.Error, t.Desc)
+	}
+
+	if resp.StatusCode != http.StatusOK || t.IDToken == "" {
+		return ret, fmt.Errorf("OIDC token error: %v", resp.Status)
+	}
+
+	claims, err := p.verify(t.IDToken, login.Nonce)
+	if err != nil {
+		return ret, err
+	}
+
+	ret.Username = claims.String(p.config.UsernameClaim)
+	if ret.Username == "" {
+		return ret, fmt.Errorf("ID token has no %v claim", p.config.UsernameClaim)
+	}
+
+	// an unverified email could belong to anyone
+	if p.config.UsernameClaim == "email" {
+		if v, ok := claims["email_verified"].(bool); ok && !v {
+			return ret, errors.New("email is not verified")
+		}
+	}
+
+	ret.Groups = claims.Strings(p.config.GroupsClaim)
+	ret.Role = p.config.Roles.Role(ret.Groups)
+	if ret.Role == "" {
+		return ret, ErrNoRole
+	}
+
+	return ret, nil
+}
+
+// Roles maps the groups of identity provider users to roles
+type Roles struct {
+	Groups map[string]string
+	// Default is the role of users in no mapped group. If it is blank,
+	// those users can't log in.
+	Default string
+}
+
+// roleRank orders roles by privilege
+var roleRank = map[string]int{
+	data.UserRoleViewer: 1,
+	data.UserRoleUser:   2,
+	data.UserRoleAdmin:  3,
+}
+
+// ParseRoles parses group to role mappings like
+// "siot-admins=admin,staff=user". The default role can be blank.
+func ParseRoles(s, defaultRole string) (ret Roles, err error) {
+	if defaultRole != "" && roleRank[defaultRole] == 0 {
+		return ret, fmt.Errorf("unknown role: %v", defaultRole)
+	}
+
+	ret.Default = defaultRole
+	ret.Groups = make(map[string]string)
+
+	for _, m := range strings.Split(s, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+
+		i := strings.LastIndex(m, "=")
+		if i <= 0 {
+			return ret, fmt.Errorf("invalid role mapping: %q", m)
+		}
+
+		group, role := strings.TrimSpace(m[:i]), strings.TrimSpace(m[i+1:])
+		if roleRank[role] == 0 {
+			return ret, fmt.Errorf("unknown role: %v", role)
+		}
+
+		ret.Groups[group] = role
+	}
+
+	return ret, nil
+}
+
+// Role returns the most privileged role of the groups, or the default
+// role
+func (r Roles) Role(groups []string) string {
+	ret := r.Default
+	for _, g := range groups {
+		role := r.Groups[g]
+		if roleRank[role] > roleRank[ret] {
+			ret = role
+		}
+	}
+
+	return ret
+}
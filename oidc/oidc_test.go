@@ -0,0 +1,268 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// testProvider is a fake identity provider
+type testProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+	// alg is the algorithm tokens are signed with
+	alg string
+	// claims are returned in the next ID token
+	claims map[string]interface{}
+	// code is the expected authorization code, and verifier the expected
+	// PKCE verifier
+	code     string
+	verifier string
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Error generating key: ", err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Error generating key: ", err)
+	}
+
+	p := &testProvider{t: t, rsa: rsaKey, ec: ecKey, alg: "RS256"}
+	p.server = httptest.NewServer(http.HandlerFunc(p.serve))
+	return p
+}
+
+func (p *testProvider) serve(res http.ResponseWriter, req *http.Request) {
+	en := json.NewEncoder(res)
+
+	switch req.URL.Path {
+	case "/.well-known/openid-configuration":
+		en.Encode(discovery{
+			Issuer:                p.server.URL,
+			AuthorizationEndpoint: p.server.URL + "/auth",
+			TokenEndpoint:         p.server.URL + "/token",
+			JwksURI:               p.server.URL + "/keys",
+		})
+	case "/keys":
+		en.Encode(map[string]interface{}{"keys": []jwk{
+			{Kty: "RSA", Kid: "rsa", N: b64(p.rsa.N.Bytes()),
+				E: b64(big.NewInt(int64(p.rsa.E)).Bytes())},
+			{Kty: "EC", Kid: "ec", Crv: "P-256", X: b64(p.ec.X.Bytes()),
+				Y: b64(p.ec.Y.Bytes())},
+		}})
+	case "/token":
+		id, secret, _ := req.BasicAuth()
+		if id != "siot" || secret != "secret" {
+			res.WriteHeader(http.StatusUnauthorized)
+			en.Encode(tokenResponse{Error: "invalid_client"})
+			return
+		}
+
+		if req.FormValue("code") != p.code ||
+			req.FormValue("code_verifier") != p.verifier {
+			res.WriteHeader(http.StatusBadRequest)
+			en.Encode(tokenResponse{Error: "invalid_grant"})
+			return
+		}
+
+		en.Encode(tokenResponse{IDToken: p.token()})
+	default:
+		http.Error(res, "Not Found", http.StatusNotFound)
+	}
+}
+
+// token returns an ID token with the claims
+func (p *testProvider) token() string {
+	header := map[string]string{"alg": p.alg, "kid": "rsa"}
+	if p.alg == "ES256" {
+		header["kid"] = "ec"
+	}
+
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(p.claims)
+	signed := b64(h) + "." + b64(c)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	if p.alg == "ES256" {
+		r, s, err := ecdsa.Sign(rand.Reader, p.ec, digest[:])
+		if err != nil {
+			p.t.Fatal("Error signing: ", err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	} else {
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, p.rsa, crypto.SHA256, digest[:])
+		if err != nil {
+			p.t.Fatal("Error signing: ", err)
+		}
+	}
+
+	return signed + "." + b64(sig)
+}
+
+func TestProvider(t *testing.T) {
+	idp := newTestProvider(t)
+	defer idp.server.Close()
+
+	roles, err := ParseRoles("siot-admins=admin, staff=user", "")
+	if err != nil {
+		t.Fatal("Error parsing roles: ", err)
+	}
+
+	p, err := New(Config{
+		Issuer:       idp.server.URL,
+		ClientID:     "siot",
+		ClientSecret: "secret",
+		RedirectURL:  "https://siot.example.com/v1/auth/oidc/callback",
+		Roles:        roles,
+	})
+	if err != nil {
+		t.Fatal("Error creating provider: ", err)
+	}
+
+	login, err := p.Login()
+	if err != nil {
+		t.Fatal("Error starting login: ", err)
+	}
+
+	u, err := url.Parse(login.URL)
+	if err != nil {
+		t.Fatal("Error parsing login URL: ", err)
+	}
+
+	q := u.Query()
+	if u.Path != "/auth" || q.Get("client_id") != "siot" ||
+		q.Get("state") != login.State || q.Get("nonce") != login.Nonce ||
+		q.Get("code_challenge_method") != "S256" {
+		t.Error("wrong login URL: ", login.URL)
+	}
+
+	idp.code = "abc"
+	idp.verifier = login.Verifier
+
+	claims := func(mod func(c map[string]interface{})) {
+		idp.claims = map[string]interface{}{
+			"iss":    idp.server.URL,
+			"aud":    "siot",
+			"sub":    "1234",
+			"email":  "sam@example.com",
+			"groups": []string{"staff", "other"},
+			"nonce":  login.Nonce,
+			"iat":    time.Now().Unix(),
+			"exp":    time.Now().Add(time.Hour).Unix(),
+		}
+		if mod != nil {
+			mod(idp.claims)
+		}
+	}
+
+	for _, alg := range []string{"RS256", "ES256"} {
+		idp.alg = alg
+		claims(nil)
+
+		id, err := p.Exchange(login, "abc")
+		if err != nil {
+			t.Fatalf("Error exchanging code with %v: %v", alg, err)
+		}
+
+		if id.Username != "sam@example.com" || id.Role != data.UserRoleUser {
+			t.Error("wrong identity: ", id)
+		}
+	}
+
+	idp.alg = "RS256"
+
+	_, err = p.Exchange(login, "wrong")
+	if err == nil {
+		t.Error("exchanged wrong code")
+	}
+
+	for name, mod := range map[string]func(c map[string]interface{}){
+		"nonce":    func(c map[string]interface{}) { c["nonce"] = "replayed" },
+		"audience": func(c map[string]interface{}) { c["aud"] = []string{"other"} },
+		"issuer":   func(c map[string]interface{}) { c["iss"] = "https://evil" },
+		"expired": func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-time.Hour).Unix()
+		},
+		"unverified": func(c map[string]interface{}) { c["email_verified"] = false },
+	} {
+		claims(mod)
+		_, err := p.Exchange(login, "abc")
+		if err == nil {
+			t.Errorf("accepted ID token with bad %v", name)
+		}
+	}
+
+	claims(func(c map[string]interface{}) { c["groups"] = []string{"other"} })
+	_, err = p.Exchange(login, "abc")
+	if err != ErrNoRole {
+		t.Error("expected no role error, got: ", err)
+	}
+
+	// a token signed by another key
+	claims(nil)
+	idp.rsa, _ = rsa.GenerateKey(rand.Reader, 2048)
+	_, err = p.Exchange(login, "abc")
+	if err == nil {
+		t.Error("accepted ID token with bad signature")
+	}
+}
+
+func TestRoles(t *testing.T) {
+	roles, err := ParseRoles("admins=admin,staff=user,ops=viewer", "viewer")
+	if err != nil {
+		t.Fatal("Error parsing roles: ", err)
+	}
+
+	for _, c := range []struct {
+		groups []string
+		exp    string
+	}{
+		{nil, data.UserRoleViewer},
+		{[]string{"staff"}, data.UserRoleUser},
+		{[]string{"ops", "admins", "staff"}, data.UserRoleAdmin},
+	} {
+		role := roles.Role(c.groups)
+		if role != c.exp {
+			t.Errorf("groups %v got role %v, expected %v", c.groups, role, c.exp)
+		}
+	}
+
+	for _, s := range []string{"admins", "admins=root", "=admin"} {
+		_, err := ParseRoles(s, "")
+		if err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+
+	_, err = ParseRoles("", "owner")
+	if err == nil {
+		t.Error("expected error for unknown default role")
+	}
+}
@@ -0,0 +1,1064 @@
+// Package opcua is an OPC UA client for the binary TCP protocol (opc.tcp).
+// It can read, write, browse, and subscribe to node values on PLCs and
+// other industrial servers. Only SecurityPolicy None is supported, so it
+// should be used on trusted control networks.
+package opcua
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// binary encoding IDs of service requests and responses
+const (
+	idAnonymousIdentity     = 321
+	idUserNameIdentity      = 324
+	idServiceFault          = 397
+	idOpenChannelRequest    = 446
+	idOpenChannelResponse   = 449
+	idCloseChannelRequest   = 452
+	idCreateSessionRequest  = 461
+	idCreateSessionResponse = 464
+	idActivateRequest       = 467
+	idActivateResponse      = 470
+	idCloseSessionRequest   = 473
+	idCloseSessionResponse  = 476
+	idBrowseRequest         = 527
+	idBrowseResponse        = 530
+	idBrowseNextRequest     = 533
+	idBrowseNextResponse    = 536
+	idReadRequest           = 631
+	idReadResponse          = 634
+	idWriteRequest          = 673
+	idWriteResponse         = 676
+	idMonitorRequest        = 751
+	idMonitorResponse       = 754
+	idDataChange            = 811
+	idSubscriptionRequest   = 787
+	idSubscriptionResponse  = 790
+	idPublishRequest        = 826
+	idPublishResponse       = 829
+)
+
+const (
+	securityPolicyNone = "http://opcfoundation.org/UA/SecurityPolicy#None"
+	// attributeValue is the value attribute of a variable node
+	attributeValue = 13
+	// receiveBufferSize is the largest message chunk the client accepts
+	receiveBufferSize = 1 << 16
+	// maxMessageSize is the largest message the client accepts
+	maxMessageSize = 1 << 24
+	// channelLifetime is how long a secure channel token is valid in ms.
+	// It is renewed after 3/4 of the lifetime.
+	channelLifetime = 3600000
+	// sessionTimeout is how long the server keeps the session after the
+	// connection is lost in ms
+	sessionTimeout = 60000
+	// publishKeepAlive is the number of publishing intervals the server
+	// can go without sending a notification
+	publishKeepAlive = 10
+)
+
+// ErrClosed is returned by requests after the client is closed
+var ErrClosed = errors.New("opcua client closed")
+
+// errTimeout is returned when the server doesn't respond to a request
+var errTimeout = errors.New("opcua request timeout")
+
+// Config describes how the client connects to a server
+type Config struct {
+	// User and Password are used to log in, or anonymous login is used if
+	// User is blank. The password is sent in plain text, so servers have
+	// to allow this.
+	User     string
+	Password string
+	// Timeout is how long the server has to respond to requests
+	// (default 10s)
+	Timeout time.Duration
+}
+
+// response is a message received from the server
+type response struct {
+	body []byte
+	err  error
+}
+
+// Client is a connection to an OPC UA server. Its methods can be called
+// concurrently.
+type Client struct {
+	conn     net.Conn
+	endpoint string
+	config   Config
+
+	// writeLock is held while a message is written, and guards the
+	// channel and sequence numbers
+	writeLock sync.Mutex
+	channelID uint32
+	tokenID   uint32
+	seq       uint32
+	maxSend   uint32
+
+	lock        sync.Mutex
+	requestID   uint32
+	pending     map[uint32]chan response
+	chunks      map[uint32][]byte
+	authToken   NodeID
+	renewAt     time.Time
+	renewing    bool
+	err         error
+	closing     bool
+	done        chan struct{}
+	subs        map[uint32]subscription
+	publishWait time.Duration
+}
+
+type subscription struct {
+	nodes []NodeID
+	fn    func(i int, v DataValue)
+}
+
+// Dial connects to a server at an endpoint like opc.tcp://plc:4840, and
+// creates and activates a session
+func Dial(endpoint string, config Config) (*Client, error) {
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	if !strings.HasPrefix(endpoint, "opc.tcp://") {
+		return nil, fmt.Errorf("invalid opcua endpoint: %v", endpoint)
+	}
+
+	addr := strings.TrimPrefix(endpoint, "opc.tcp://")
+	if i := strings.IndexByte(addr, '/'); i >= 0 {
+		addr = addr[:i]
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "4840")
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		conn:     conn,
+		endpoint: endpoint,
+		config:   config,
+		pending:  make(map[uint32]chan response),
+		chunks:   make(map[uint32][]byte),
+		done:     make(chan struct{}),
+		subs:     make(map[uint32]subscription),
+	}
+
+	err = c.hello()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go c.readLoop()
+
+	err = c.openChannel(0)
+	if err == nil {
+		err = c.createSession()
+	}
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// hello exchanges buffer sizes with the server
+func (c *Client) hello() error {
+	var e encoder
+	e.b = append(e.b, "HELF\x00\x00\x00\x00"...)
+	e.uint32(0)
+	e.uint32(receiveBufferSize)
+	e.uint32(receiveBufferSize)
+	e.uint32(maxMessageSize)
+	e.uint32(0)
+	e.string(c.endpoint)
+	binary.LittleEndian.PutUint32(e.b[4:], uint32(len(e.b)))
+
+	c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	_, err := c.conn.Write(e.b)
+	if err != nil {
+		return err
+	}
+
+	typ, body, err := c.readChunk()
+	if err != nil {
+		return err
+	}
+
+	d := decoder{b: body}
+	switch typ {
+	case "ACKF":
+		d.uint32()
+		c.maxSend = d.uint32()
+		return d.err
+	case "ERRF":
+		return readError(&d)
+	}
+	return fmt.Errorf("unexpected opcua message: %v", typ)
+}
+
+// readError decodes the body of an error or abort message
+func readError(d *decoder) error {
+	code := StatusCode(d.uint32())
+	reason := d.string()
+	if d.err != nil {
+		return d.err
+	}
+	if reason == "" {
+		return code
+	}
+	return fmt.Errorf("%v: %v", code, reason)
+}
+
+// readChunk reads a message chunk and returns its type and chunk type,
+// like MSGF, and its body
+func (c *Client) readChunk() (string, []byte, error) {
+	var header [8]byte
+	_, err := io.ReadFull(c.conn, header[:])
+	if err != nil {
+		return "", nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(header[4:])
+	if size < 8 || size > receiveBufferSize {
+		return "", nil, errDecode
+	}
+
+	body := make([]byte, size-8)
+	_, err = io.ReadFull(c.conn, body)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return string(header[:4]), body, nil
+}
+
+// readLoop reads responses and passes them to the waiting requests until
+// the connection fails
+func (c *Client) readLoop() {
+	for {
+		typ, body, err := c.readChunk()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		d := decoder{b: body}
+		switch typ[:3] {
+		case "ERR":
+			c.fail(readError(&d))
+			return
+		case "OPN":
+			d.uint32()
+			d.string()
+			d.bytes()
+			d.bytes()
+		case "MSG":
+			d.uint32()
+			d.uint32()
+		default:
+			c.fail(fmt.Errorf("unexpected opcua message: %v", typ))
+			return
+		}
+
+		d.uint32()
+		id := d.uint32()
+		if d.err != nil {
+			c.fail(d.err)
+			return
+		}
+
+		c.lock.Lock()
+		var r *response
+		switch typ[3] {
+		case 'C':
+			c.chunks[id] = append(c.chunks[id], d.b...)
+			if len(c.chunks[id]) > maxMessageSize {
+				delete(c.chunks, id)
+				r = &response{err: errors.New("opcua response is too large")}
+			}
+		case 'A':
+			delete(c.chunks, id)
+			r = &response{err: readError(&d)}
+		default:
+			r = &response{body: append(c.chunks[id], d.b...)}
+			delete(c.chunks, id)
+		}
+
+		if ch, ok := c.pending[id]; ok && r != nil {
+			delete(c.pending, id)
+			ch <- *r
+		}
+		c.lock.Unlock()
+	}
+}
+
+// fail closes the connection, and returns err for any pending and future
+// requests
+func (c *Client) fail(err error) {
+	c.lock.Lock()
+	if c.err == nil {
+		c.err = err
+		for id, ch := range c.pending {
+			ch <- response{err: err}
+			delete(c.pending, id)
+		}
+		close(c.done)
+	}
+	c.lock.Unlock()
+
+	c.conn.Close()
+}
+
+// Done is closed when the connection fails or the client is closed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection failed, or ErrClosed
+func (c *Client) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// send writes a request as a single chunk
+func (c *Client) send(msgType string, requestID, typeID uint32, body []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.seq++
+
+	var e encoder
+	e.b = append(e.b, msgType...)
+	e.b = append(e.b, 'F', 0, 0, 0, 0)
+	e.uint32(c.channelID)
+	if msgType == "OPN" {
+		e.string(securityPolicyNone)
+		e.bytes(nil)
+		e.bytes(nil)
+	} else {
+		e.uint32(c.tokenID)
+	}
+	e.uint32(c.seq)
+	e.uint32(requestID)
+	e.nodeID(NodeID{Numeric: typeID})
+	e.b = append(e.b, body...)
+
+	if c.maxSend != 0 && len(e.b) > int(c.maxSend) {
+		return errors.New("opcua request is too large")
+	}
+
+	binary.LittleEndian.PutUint32(e.b[4:], uint32(len(e.b)))
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.config.Timeout))
+	_, err := c.conn.Write(e.b)
+	return err
+}
+
+// header returns a request header. timeout is the timeout hint for the
+// server.
+func (c *Client) header(timeout time.Duration) *encoder {
+	c.lock.Lock()
+	token := c.authToken
+	c.requestID++
+	handle := c.requestID
+	c.lock.Unlock()
+
+	var e encoder
+	e.nodeID(token)
+	e.time(time.Now())
+	e.uint32(handle)
+	e.uint32(0)
+	e.string("")
+	e.uint32(uint32(timeout / time.Millisecond))
+	e.extensionObject(0, nil)
+	return &e
+}
+
+// call sends a request and waits up to wait for the response. The
+// returned decoder is positioned after the response header.
+func (c *Client) call(msgType string, reqType, respType uint32, body []byte, wait time.Duration) (*decoder, error) {
+	if msgType == "MSG" {
+		err := c.renew()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return nil, c.err
+	}
+	c.requestID++
+	id := c.requestID
+	ch := make(chan response, 1)
+	c.pending[id] = ch
+	c.lock.Unlock()
+
+	err := c.send(msgType, id, reqType, body)
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	var r response
+	select {
+	case r = <-ch:
+	case <-timer.C:
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+		return nil, errTimeout
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	d := &decoder{b: r.body}
+	typ := d.nodeID().Numeric
+	status := d.responseHeader()
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if status.Bad() {
+		return nil, status
+	}
+
+	if typ != respType {
+		return nil, fmt.Errorf("unexpected opcua response: %v", typ)
+	}
+
+	return d, nil
+}
+
+// responseHeader returns the service result of a response
+func (d *decoder) responseHeader() StatusCode {
+	d.time()
+	d.uint32()
+	status := StatusCode(d.uint32())
+	d.diagnosticInfo()
+	d.strings()
+	d.extensionObject()
+	return status
+}
+
+// openChannel issues (requestType 0) or renews (1) the secure channel
+// token
+func (c *Client) openChannel(requestType uint32) error {
+	var e encoder
+	e.nodeID(NodeID{})
+	e.time(time.Now())
+	e.uint32(0)
+	e.uint32(0)
+	e.string("")
+	e.uint32(0)
+	e.extensionObject(0, nil)
+
+	e.uint32(0)
+	e.uint32(requestType)
+	// security mode None
+	e.uint32(1)
+	e.bytes(nil)
+	e.uint32(channelLifetime)
+
+	d, err := c.call("OPN", idOpenChannelRequest, idOpenChannelResponse, e.b,
+		c.config.Timeout)
+	if err != nil {
+		return err
+	}
+
+	d.uint32()
+	channelID := d.uint32()
+	tokenID := d.uint32()
+	d.time()
+	lifetime := d.uint32()
+	if d.err != nil {
+		return d.err
+	}
+
+	c.writeLock.Lock()
+	c.channelID = channelID
+	c.tokenID = tokenID
+	c.writeLock.Unlock()
+
+	c.lock.Lock()
+	c.renewAt = time.Now().Add(time.Duration(lifetime) * time.Millisecond * 3 / 4)
+	c.lock.Unlock()
+
+	return nil
+}
+
+// renew renews the secure channel token if it is about to expire
+func (c *Client) renew() error {
+	c.lock.Lock()
+	if c.renewing || c.renewAt.IsZero() || time.Now().Before(c.renewAt) {
+		c.lock.Unlock()
+		return nil
+	}
+	c.renewing = true
+	c.lock.Unlock()
+
+	err := c.openChannel(1)
+
+	c.lock.Lock()
+	c.renewing = false
+	c.lock.Unlock()
+
+	return err
+}
+
+// userTokenPolicy is a way the server allows users to log in
+type userTokenPolicy struct {
+	policyID  string
+	tokenType uint32
+}
+
+// createSession creates and activates a session
+func (c *Client) createSession() error {
+	nonce := make([]byte, 32)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+
+	e := c.header(c.config.Timeout)
+	// client application description
+	e.string("urn:simpleiot:client")
+	e.string("urn:simpleiot")
+	e.localizedText("Simple IoT")
+	e.uint32(1)
+	e.string("")
+	e.string("")
+	e.strings(nil)
+
+	e.string("")
+	e.string(c.endpoint)
+	e.string("siot")
+	e.bytes(nonce)
+	e.bytes(nil)
+	e.double(sessionTimeout)
+	e.uint32(0)
+
+	d, err := c.call("MSG", idCreateSessionRequest, idCreateSessionResponse,
+		e.b, c.config.Timeout)
+	if err != nil {
+		return err
+	}
+
+	d.nodeID()
+	token := d.nodeID()
+	d.double()
+	d.bytes()
+	d.bytes()
+
+	// user token policies of endpoints without security
+	var policies []userTokenPolicy
+	n := d.arrayLen()
+	for i := 0; i < n && d.err == nil; i++ {
+		d.string()
+		d.string()
+		d.string()
+		d.localizedText()
+		d.uint32()
+		d.string()
+		d.string()
+		d.strings()
+		d.bytes()
+		mode := d.uint32()
+		d.string()
+
+		tokens := d.arrayLen()
+		for j := 0; j < tokens && d.err == nil; j++ {
+			p := userTokenPolicy{policyID: d.string(), tokenType: d.uint32()}
+			d.string()
+			d.string()
+			policy := d.string()
+			if mode == 1 && (policy == "" || policy == securityPolicyNone) {
+				policies = append(policies, p)
+			}
+		}
+
+		d.string()
+		d.byte()
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+
+	c.lock.Lock()
+	c.authToken = token
+	c.lock.Unlock()
+
+	return c.activateSession(policies)
+}
+
+func (c *Client) activateSession(policies []userTokenPolicy) error {
+	var tokenType uint32
+	if c.config.User != "" {
+		tokenType = 1
+	}
+
+	var policyID string
+	found := false
+	for _, p := range policies {
+		if p.tokenType == tokenType {
+			policyID = p.policyID
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		if tokenType == 1 {
+			return errors.New("opcua server does not allow user login without security")
+		}
+		return errors.New("opcua server does not allow anonymous login without security")
+	}
+
+	var identity encoder
+	identity.string(policyID)
+	identityType := uint32(idAnonymousIdentity)
+	if tokenType == 1 {
+		identity.string(c.config.User)
+		identity.bytes([]byte(c.config.Password))
+		identity.string("")
+		identityType = idUserNameIdentity
+	}
+
+	e := c.header(c.config.Timeout)
+	e.string("")
+	e.bytes(nil)
+	e.uint32(0)
+	e.strings(nil)
+	e.extensionObject(identityType, identity.b)
+	e.string("")
+	e.bytes(nil)
+
+	_, err := c.call("MSG", idActivateRequest, idActivateResponse, e.b,
+		c.config.Timeout)
+	return err
+}
+
+// Close closes the session and connection
+func (c *Client) Close() error {
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return nil
+	}
+	c.closing = true
+	c.lock.Unlock()
+
+	// delete subscriptions
+	e := c.header(c.config.Timeout)
+	e.bool(true)
+	_, err := c.call("MSG", idCloseSessionRequest, idCloseSessionResponse,
+		e.b, c.config.Timeout)
+
+	// the server closes the connection without responding
+	e = c.header(0)
+	c.send("CLO", 0, idCloseChannelRequest, e.b)
+
+	c.fail(ErrClosed)
+	return err
+}
+
+// readValueID encodes the node and attribute to read or monitor
+func (e *encoder) readValueID(node NodeID) {
+	e.nodeID(node)
+	e.uint32(attributeValue)
+	e.string("")
+	e.uint16(0)
+	e.string("")
+}
+
+// Read reads the values of nodes
+func (c *Client) Read(nodes ...NodeID) ([]DataValue, error) {
+	e := c.header(c.config.Timeout)
+	e.double(0)
+	// return source and server timestamps
+	e.uint32(2)
+	e.uint32(uint32(len(nodes)))
+	for _, n := range nodes {
+		e.readValueID(n)
+	}
+
+	d, err := c.call("MSG", idReadRequest, idReadResponse, e.b, c.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	n := d.arrayLen()
+	var ret []DataValue
+	for i := 0; i < n && d.err == nil; i++ {
+		ret = append(ret, d.dataValue())
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if len(ret) != len(nodes) {
+		return nil, errDecode
+	}
+
+	return ret, nil
+}
+
+// Write writes the value of a node. The type of value must match the
+// data type of the node, so it is often converted with FromFloat using the
+// type of the value read from the node.
+func (c *Client) Write(node NodeID, value interface{}) error {
+	e := c.header(c.config.Timeout)
+	e.uint32(1)
+	e.nodeID(node)
+	e.uint32(attributeValue)
+	e.string("")
+	err := e.dataValue(DataValue{Value: value})
+	if err != nil {
+		return err
+	}
+
+	d, err := c.call("MSG", idWriteRequest, idWriteResponse, e.b, c.config.Timeout)
+	if err != nil {
+		return err
+	}
+
+	results := d.statusCodes()
+	if d.err != nil {
+		return d.err
+	}
+
+	if len(results) != 1 {
+		return errDecode
+	}
+
+	if results[0].Bad() {
+		return results[0]
+	}
+
+	return nil
+}
+
+// NodeClass is the kind of a node
+type NodeClass uint32
+
+// Node classes
+const (
+	NodeClassObject        NodeClass = 1
+	NodeClassVariable      NodeClass = 2
+	NodeClassMethod        NodeClass = 4
+	NodeClassObjectType    NodeClass = 8
+	NodeClassVariableType  NodeClass = 16
+	NodeClassReferenceType NodeClass = 32
+	NodeClassDataType      NodeClass = 64
+	NodeClassView          NodeClass = 128
+)
+
+var nodeClassNames = map[NodeClass]string{
+	NodeClassObject:        "object",
+	NodeClassVariable:      "variable",
+	NodeClassMethod:        "method",
+	NodeClassObjectType:    "objectType",
+	NodeClassVariableType:  "variableType",
+	NodeClassReferenceType: "referenceType",
+	NodeClassDataType:      "dataType",
+	NodeClassView:          "view",
+}
+
+func (n NodeClass) String() string {
+	if name, ok := nodeClassNames[n]; ok {
+		return name
+	}
+	return fmt.Sprintf("nodeClass(%v)", uint32(n))
+}
+
+// Reference is a child of a browsed node
+type Reference struct {
+	NodeID      NodeID
+	BrowseName  string
+	DisplayName string
+	NodeClass   NodeClass
+}
+
+// ObjectsFolder is the node where browsing usually starts
+var ObjectsFolder = NodeID{Numeric: 85}
+
+// browseResult decodes a browse result and returns the continuation point
+// if there are more references
+func (d *decoder) browseResult() ([]Reference, []byte, error) {
+	status := StatusCode(d.uint32())
+	cont := d.bytes()
+
+	var ret []Reference
+	n := d.arrayLen()
+	for i := 0; i < n && d.err == nil; i++ {
+		d.nodeID()
+		d.bool()
+		r := Reference{NodeID: d.expandedNodeID()}
+		r.BrowseName = d.qualifiedName()
+		r.DisplayName = d.localizedText()
+		r.NodeClass = NodeClass(d.uint32())
+		d.expandedNodeID()
+		ret = append(ret, r)
+	}
+
+	if d.err != nil {
+		return nil, nil, d.err
+	}
+
+	if status.Bad() {
+		return nil, nil, status
+	}
+
+	return ret, cont, nil
+}
+
+// Browse returns the children of a node, which are the targets of its
+// forward hierarchical references
+func (c *Client) Browse(node NodeID) ([]Reference, error) {
+	e := c.header(c.config.Timeout)
+	// default view
+	e.nodeID(NodeID{})
+	e.time(time.Time{})
+	e.uint32(0)
+	e.uint32(0)
+	e.uint32(1)
+	e.nodeID(node)
+	// forward HierarchicalReferences and subtypes, all node classes and
+	// result fields
+	e.uint32(0)
+	e.nodeID(NodeID{Numeric: 33})
+	e.bool(true)
+	e.uint32(0)
+	e.uint32(0x3f)
+
+	d, err := c.call("MSG", idBrowseRequest, idBrowseResponse, e.b, c.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []Reference
+	for {
+		if d.arrayLen() != 1 {
+			if d.err != nil {
+				return nil, d.err
+			}
+			return nil, errDecode
+		}
+
+		refs, cont, err := d.browseResult()
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, refs...)
+
+		if len(cont) == 0 {
+			return ret, nil
+		}
+
+		e := c.header(c.config.Timeout)
+		e.bool(false)
+		e.uint32(1)
+		e.bytes(cont)
+
+		d, err = c.call("MSG", idBrowseNextRequest, idBrowseNextResponse, e.b,
+			c.config.Timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Subscribe monitors the values of nodes, which are sampled at interval,
+// and calls fn with the index of the node when a value changes, starting
+// with the current values. fn is called from a single goroutine until the
+// client is closed or the connection fails, so Done can be used to tell
+// when to reconnect.
+func (c *Client) Subscribe(interval time.Duration, nodes []NodeID, fn func(i int, v DataValue)) error {
+	ms := float64(interval / time.Millisecond)
+
+	e := c.header(c.config.Timeout)
+	e.double(ms)
+	e.uint32(publishKeepAlive * 3)
+	e.uint32(publishKeepAlive)
+	e.uint32(0)
+	e.bool(true)
+	e.byte(0)
+
+	d, err := c.call("MSG", idSubscriptionRequest, idSubscriptionResponse, e.b,
+		c.config.Timeout)
+	if err != nil {
+		return err
+	}
+
+	id := d.uint32()
+	revised := d.double()
+	d.uint32()
+	keepAlive := d.uint32()
+	if d.err != nil {
+		return d.err
+	}
+
+	e = c.header(c.config.Timeout)
+	e.uint32(id)
+	e.uint32(2)
+	e.uint32(uint32(len(nodes)))
+	for i, n := range nodes {
+		e.readValueID(n)
+		// reporting mode
+		e.uint32(2)
+		e.uint32(uint32(i))
+		e.double(ms)
+		e.extensionObject(0, nil)
+		e.uint32(1)
+		e.bool(true)
+	}
+
+	d, err = c.call("MSG", idMonitorRequest, idMonitorResponse, e.b,
+		c.config.Timeout)
+	if err != nil {
+		return err
+	}
+
+	if d.arrayLen() != len(nodes) {
+		return errDecode
+	}
+
+	for _, n := range nodes {
+		status := StatusCode(d.uint32())
+		d.uint32()
+		d.double()
+		d.uint32()
+		d.extensionObject()
+		if d.err != nil {
+			return d.err
+		}
+		if status.Bad() {
+			return fmt.Errorf("error monitoring %v: %w", n, status)
+		}
+	}
+
+	// the server can wait up to the keep alive period to respond to
+	// publish requests
+	wait := time.Duration(revised*float64(keepAlive)) * time.Millisecond
+
+	c.lock.Lock()
+	c.subs[id] = subscription{nodes: nodes, fn: fn}
+	start := len(c.subs) == 1
+	if wait > c.publishWait {
+		c.publishWait = wait
+	}
+	c.lock.Unlock()
+
+	if start {
+		go c.publish()
+	}
+
+	return nil
+}
+
+// ack acknowledges a notification message
+type ack struct {
+	subscription uint32
+	seq          uint32
+}
+
+// publish sends publish requests, which the server responds to with value
+// changes, until the client fails
+func (c *Client) publish() {
+	var acks []ack
+
+	for {
+		c.lock.Lock()
+		wait := c.publishWait + c.config.Timeout
+		c.lock.Unlock()
+
+		e := c.header(wait)
+		e.uint32(uint32(len(acks)))
+		for _, a := range acks {
+			e.uint32(a.subscription)
+			e.uint32(a.seq)
+		}
+
+		d, err := c.call("MSG", idPublishRequest, idPublishResponse, e.b, wait)
+		if err != nil {
+			c.lock.Lock()
+			closing := c.closing
+			c.lock.Unlock()
+			if !closing {
+				c.fail(fmt.Errorf("opcua publish: %w", err))
+			}
+			return
+		}
+
+		id := d.uint32()
+		n := d.arrayLen()
+		for i := 0; i < n; i++ {
+			d.uint32()
+		}
+		d.bool()
+		seq := d.uint32()
+		d.time()
+
+		// keep alive messages have no notifications and are not acked
+		acks = nil
+		notifications := d.arrayLen()
+		if notifications > 0 {
+			acks = []ack{{id, seq}}
+		}
+
+		c.lock.Lock()
+		sub := c.subs[id]
+		c.lock.Unlock()
+
+		for i := 0; i < notifications && d.err == nil; i++ {
+			typ, body := d.extensionObject()
+			if typ != idDataChange {
+				continue
+			}
+
+			nd := decoder{b: body}
+			items := nd.arrayLen()
+			for j := 0; j < items && nd.err == nil; j++ {
+				handle := int(nd.uint32())
+				v := nd.dataValue()
+				if nd.err == nil && handle < len(sub.nodes) {
+					sub.fn(handle, v)
+				}
+			}
+		}
+
+		if d.err != nil {
+			c.fail(d.err)
+			return
+		}
+	}
+}
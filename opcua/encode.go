@@ -0,0 +1,593 @@
+package opcua
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// errDecode is returned when a message can't be decoded
+var errDecode = errors.New("invalid opcua message")
+
+// maxArray limits the length of decoded arrays, so a bad length can't
+// allocate a huge slice
+const maxArray = 1 << 16
+
+// Variant types
+const (
+	typeBoolean         = 1
+	typeSByte           = 2
+	typeByte            = 3
+	typeInt16           = 4
+	typeUInt16          = 5
+	typeInt32           = 6
+	typeUInt32          = 7
+	typeInt64           = 8
+	typeUInt64          = 9
+	typeFloat           = 10
+	typeDouble          = 11
+	typeString          = 12
+	typeDateTime        = 13
+	typeGUID            = 14
+	typeByteString      = 15
+	typeXMLElement      = 16
+	typeNodeID          = 17
+	typeExpandedNodeID  = 18
+	typeStatusCode      = 19
+	typeQualifiedName   = 20
+	typeLocalizedText   = 21
+	typeExtensionObject = 22
+	typeDataValue       = 23
+	typeVariant         = 24
+	typeDiagnosticInfo  = 25
+)
+
+// DataValue is the value of a node attribute
+type DataValue struct {
+	// Value is a bool, int8, uint8, int16, uint16, int32, uint32, int64,
+	// uint64, float32, float64, string, time.Time, []byte, NodeID,
+	// StatusCode, or []interface{} of these for arrays. Other types are
+	// decoded as their name or text, or nil.
+	Value      interface{}
+	Status     StatusCode
+	SourceTime time.Time
+	ServerTime time.Time
+}
+
+// epochOffset is the number of seconds from the start of OPC UA time in
+// 1601 to the Unix epoch. OPC UA times are in 100ns ticks.
+const epochOffset = 11644473600
+
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) byte(v byte) {
+	e.b = append(e.b, v)
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.byte(1)
+	} else {
+		e.byte(0)
+	}
+}
+
+func (e *encoder) uint16(v uint16) {
+	e.b = append(e.b, byte(v), byte(v>>8))
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.b = append(e.b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (e *encoder) uint64(v uint64) {
+	e.uint32(uint32(v))
+	e.uint32(uint32(v >> 32))
+}
+
+func (e *encoder) double(v float64) {
+	e.uint64(math.Float64bits(v))
+}
+
+// string and bytes encode empty values as null
+func (e *encoder) string(s string) {
+	if s == "" {
+		e.uint32(math.MaxUint32)
+		return
+	}
+	e.uint32(uint32(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *encoder) bytes(b []byte) {
+	if b == nil {
+		e.uint32(math.MaxUint32)
+		return
+	}
+	e.uint32(uint32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+func (e *encoder) strings(s []string) {
+	e.uint32(uint32(len(s)))
+	for _, v := range s {
+		e.string(v)
+	}
+}
+
+func (e *encoder) time(t time.Time) {
+	if t.IsZero() {
+		e.uint64(0)
+		return
+	}
+	e.uint64(uint64((t.Unix()+epochOffset)*1e7 + int64(t.Nanosecond()/100)))
+}
+
+func (e *encoder) nodeID(id NodeID) {
+	switch id.Type {
+	case 0, NodeNumeric:
+		switch {
+		case id.Namespace == 0 && id.Numeric < 256:
+			e.b = append(e.b, 0, byte(id.Numeric))
+		case id.Namespace < 256 && id.Numeric < 65536:
+			e.b = append(e.b, 1, byte(id.Namespace))
+			e.uint16(uint16(id.Numeric))
+		default:
+			e.byte(2)
+			e.uint16(id.Namespace)
+			e.uint32(id.Numeric)
+		}
+	case NodeString:
+		e.byte(3)
+		e.uint16(id.Namespace)
+		e.string(id.Name)
+	case NodeGUID:
+		e.byte(4)
+		e.uint16(id.Namespace)
+		var g [16]byte
+		copy(g[:], id.Bytes)
+		e.b = append(e.b, g[:]...)
+	case NodeOpaque:
+		e.byte(5)
+		e.uint16(id.Namespace)
+		e.bytes(id.Bytes)
+	}
+}
+
+// localizedText encodes text without a locale
+func (e *encoder) localizedText(s string) {
+	if s == "" {
+		e.byte(0)
+		return
+	}
+	e.byte(2)
+	e.string(s)
+}
+
+// extensionObject encodes a binary body. Objects with a type of 0 are
+// null.
+func (e *encoder) extensionObject(typeID uint32, body []byte) {
+	e.nodeID(NodeID{Numeric: typeID})
+	if typeID == 0 {
+		e.byte(0)
+		return
+	}
+	e.byte(1)
+	e.bytes(body)
+}
+
+// variant encodes a scalar value
+func (e *encoder) variant(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		e.byte(0)
+	case bool:
+		e.byte(typeBoolean)
+		e.bool(v)
+	case int8:
+		e.byte(typeSByte)
+		e.byte(byte(v))
+	case uint8:
+		e.byte(typeByte)
+		e.byte(v)
+	case int16:
+		e.byte(typeInt16)
+		e.uint16(uint16(v))
+	case uint16:
+		e.byte(typeUInt16)
+		e.uint16(v)
+	case int32:
+		e.byte(typeInt32)
+		e.uint32(uint32(v))
+	case uint32:
+		e.byte(typeUInt32)
+		e.uint32(v)
+	case int64:
+		e.byte(typeInt64)
+		e.uint64(uint64(v))
+	case uint64:
+		e.byte(typeUInt64)
+		e.uint64(v)
+	case float32:
+		e.byte(typeFloat)
+		e.uint32(math.Float32bits(v))
+	case float64:
+		e.byte(typeDouble)
+		e.double(v)
+	case string:
+		e.byte(typeString)
+		e.string(v)
+	case time.Time:
+		e.byte(typeDateTime)
+		e.time(v)
+	case []byte:
+		e.byte(typeByteString)
+		e.bytes(v)
+	case NodeID:
+		e.byte(typeNodeID)
+		e.nodeID(v)
+	case StatusCode:
+		e.byte(typeStatusCode)
+		e.uint32(uint32(v))
+	default:
+		return fmt.Errorf("unsupported opcua value type: %T", v)
+	}
+	return nil
+}
+
+func (e *encoder) dataValue(v DataValue) error {
+	var mask byte = 0x01
+	if v.Status != 0 {
+		mask |= 0x02
+	}
+	if !v.SourceTime.IsZero() {
+		mask |= 0x04
+	}
+	if !v.ServerTime.IsZero() {
+		mask |= 0x08
+	}
+
+	e.byte(mask)
+	err := e.variant(v.Value)
+	if err != nil {
+		return err
+	}
+
+	if mask&0x02 != 0 {
+		e.uint32(uint32(v.Status))
+	}
+	if mask&0x04 != 0 {
+		e.time(v.SourceTime)
+	}
+	if mask&0x08 != 0 {
+		e.time(v.ServerTime)
+	}
+	return nil
+}
+
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || n < 0 || len(d.b) < n {
+		d.err = errDecode
+		return nil
+	}
+	ret := d.b[:n]
+	d.b = d.b[n:]
+	return ret
+}
+
+func (d *decoder) byte() byte {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) bool() bool {
+	return d.byte() != 0
+}
+
+func (d *decoder) uint16() uint16 {
+	b := d.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (d *decoder) uint64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (d *decoder) double() float64 {
+	return math.Float64frombits(d.uint64())
+}
+
+func (d *decoder) bytes() []byte {
+	n := int32(d.uint32())
+	if n < 0 {
+		return nil
+	}
+	b := d.next(int(n))
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+// arrayLen returns the length of an array, which is 0 for null arrays
+func (d *decoder) arrayLen() int {
+	n := int32(d.uint32())
+	if n < 0 {
+		return 0
+	}
+	// every element is at least a byte
+	if n > maxArray || int(n) > len(d.b) {
+		d.err = errDecode
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) strings() []string {
+	n := d.arrayLen()
+	var ret []string
+	for i := 0; i < n && d.err == nil; i++ {
+		ret = append(ret, d.string())
+	}
+	return ret
+}
+
+func (d *decoder) time() time.Time {
+	v := int64(d.uint64())
+	if v <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(v/1e7-epochOffset, v%1e7*100).UTC()
+}
+
+func (d *decoder) nodeID() NodeID {
+	switch d.byte() {
+	case 0:
+		return NodeID{Type: NodeNumeric, Numeric: uint32(d.byte())}
+	case 1:
+		ns := uint16(d.byte())
+		return NodeID{Type: NodeNumeric, Namespace: ns, Numeric: uint32(d.uint16())}
+	case 2:
+		ns := d.uint16()
+		return NodeID{Type: NodeNumeric, Namespace: ns, Numeric: d.uint32()}
+	case 3:
+		ns := d.uint16()
+		return NodeID{Type: NodeString, Namespace: ns, Name: d.string()}
+	case 4:
+		ns := d.uint16()
+		return NodeID{Type: NodeGUID, Namespace: ns,
+			Bytes: append([]byte{}, d.next(16)...)}
+	case 5:
+		ns := d.uint16()
+		return NodeID{Type: NodeOpaque, Namespace: ns, Bytes: d.bytes()}
+	}
+	d.err = errDecode
+	return NodeID{}
+}
+
+// expandedNodeID decodes an expanded node ID, and drops the namespace URI
+// and server index
+func (d *decoder) expandedNodeID() NodeID {
+	if len(d.b) < 1 {
+		d.err = errDecode
+		return NodeID{}
+	}
+
+	flags := d.b[0]
+	d.b[0] &= 0x3f
+	id := d.nodeID()
+	if flags&0x80 != 0 {
+		d.string()
+	}
+	if flags&0x40 != 0 {
+		d.uint32()
+	}
+	return id
+}
+
+func (d *decoder) qualifiedName() string {
+	d.uint16()
+	return d.string()
+}
+
+func (d *decoder) localizedText() string {
+	mask := d.byte()
+	if mask&0x01 != 0 {
+		d.string()
+	}
+	if mask&0x02 != 0 {
+		return d.string()
+	}
+	return ""
+}
+
+// extensionObject returns the type and body of a binary encoded object.
+// XML bodies are returned with a type of 0.
+func (d *decoder) extensionObject() (typeID uint32, body []byte) {
+	id := d.nodeID()
+	switch d.byte() {
+	case 0:
+		return 0, nil
+	case 1:
+		return id.Numeric, d.bytes()
+	case 2:
+		d.bytes()
+		return 0, nil
+	}
+	d.err = errDecode
+	return 0, nil
+}
+
+func (d *decoder) diagnosticInfo() {
+	mask := d.byte()
+	for _, bit := range []byte{0x01, 0x02, 0x04, 0x08} {
+		if mask&bit != 0 {
+			d.uint32()
+		}
+	}
+	if mask&0x10 != 0 {
+		d.string()
+	}
+	if mask&0x20 != 0 {
+		d.uint32()
+	}
+	if mask&0x40 != 0 && d.err == nil {
+		d.diagnosticInfo()
+	}
+}
+
+func (d *decoder) diagnosticInfos() {
+	n := d.arrayLen()
+	for i := 0; i < n && d.err == nil; i++ {
+		d.diagnosticInfo()
+	}
+}
+
+func (d *decoder) statusCodes() []StatusCode {
+	n := d.arrayLen()
+	var ret []StatusCode
+	for i := 0; i < n && d.err == nil; i++ {
+		ret = append(ret, StatusCode(d.uint32()))
+	}
+	return ret
+}
+
+// scalar decodes a single value of a variant type
+func (d *decoder) scalar(t byte) interface{} {
+	switch t {
+	case 0:
+		return nil
+	case typeBoolean:
+		return d.bool()
+	case typeSByte:
+		return int8(d.byte())
+	case typeByte:
+		return d.byte()
+	case typeInt16:
+		return int16(d.uint16())
+	case typeUInt16:
+		return d.uint16()
+	case typeInt32:
+		return int32(d.uint32())
+	case typeUInt32:
+		return d.uint32()
+	case typeInt64:
+		return int64(d.uint64())
+	case typeUInt64:
+		return d.uint64()
+	case typeFloat:
+		return math.Float32frombits(d.uint32())
+	case typeDouble:
+		return d.double()
+	case typeString:
+		return d.string()
+	case typeDateTime:
+		return d.time()
+	case typeGUID:
+		return formatGUID(d.next(16))
+	case typeByteString, typeXMLElement:
+		return d.bytes()
+	case typeNodeID:
+		return d.nodeID()
+	case typeExpandedNodeID:
+		return d.expandedNodeID()
+	case typeStatusCode:
+		return StatusCode(d.uint32())
+	case typeQualifiedName:
+		return d.qualifiedName()
+	case typeLocalizedText:
+		return d.localizedText()
+	case typeExtensionObject:
+		d.extensionObject()
+		return nil
+	case typeDataValue:
+		return d.dataValue().Value
+	case typeVariant:
+		return d.variant()
+	case typeDiagnosticInfo:
+		d.diagnosticInfo()
+		return nil
+	}
+	d.err = errDecode
+	return nil
+}
+
+func (d *decoder) variant() interface{} {
+	mask := d.byte()
+	t := mask & 0x3f
+
+	if mask&0x80 == 0 {
+		return d.scalar(t)
+	}
+
+	n := d.arrayLen()
+	ret := make([]interface{}, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		ret = append(ret, d.scalar(t))
+	}
+
+	// multi dimensional arrays are returned flattened
+	if mask&0x40 != 0 {
+		dims := d.arrayLen()
+		for i := 0; i < dims; i++ {
+			d.uint32()
+		}
+	}
+
+	return ret
+}
+
+func (d *decoder) dataValue() DataValue {
+	var ret DataValue
+	mask := d.byte()
+	if mask&0x01 != 0 {
+		ret.Value = d.variant()
+	}
+	if mask&0x02 != 0 {
+		ret.Status = StatusCode(d.uint32())
+	}
+	if mask&0x04 != 0 {
+		ret.SourceTime = d.time()
+	}
+	if mask&0x10 != 0 {
+		d.uint16()
+	}
+	if mask&0x08 != 0 {
+		ret.ServerTime = d.time()
+	}
+	if mask&0x20 != 0 {
+		d.uint16()
+	}
+	return ret
+}
@@ -0,0 +1,153 @@
+package opcua
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Node ID types
+const (
+	NodeNumeric = 'i'
+	NodeString  = 's'
+	NodeGUID    = 'g'
+	NodeOpaque  = 'b'
+)
+
+// NodeID identifies a node in a server's address space
+type NodeID struct {
+	Namespace uint16
+	// Type is NodeNumeric (default), NodeString, NodeGUID, or NodeOpaque
+	Type byte
+	// Numeric and Name are the IDs of numeric and string node IDs
+	Numeric uint32
+	Name    string
+	// Bytes is the 16 byte GUID or opaque ID
+	Bytes []byte
+}
+
+// ParseNodeID parses a node ID in the standard string format, like
+// ns=2;s=Tank.Level, i=2253, or ns=1;g=09087e75-8e5e-499b-954f-f2a9603db28a
+func ParseNodeID(s string) (NodeID, error) {
+	var id NodeID
+
+	rest := s
+	if strings.HasPrefix(rest, "ns=") {
+		i := strings.IndexByte(rest, ';')
+		if i < 0 {
+			return id, fmt.Errorf("invalid node id: %v", s)
+		}
+
+		ns, err := strconv.ParseUint(rest[3:i], 10, 16)
+		if err != nil {
+			return id, fmt.Errorf("invalid node id namespace: %v", s)
+		}
+
+		id.Namespace = uint16(ns)
+		rest = rest[i+1:]
+	}
+
+	if len(rest) < 2 || rest[1] != '=' {
+		return id, fmt.Errorf("invalid node id: %v", s)
+	}
+
+	id.Type = rest[0]
+	v := rest[2:]
+
+	var err error
+	switch id.Type {
+	case NodeNumeric:
+		var n uint64
+		n, err = strconv.ParseUint(v, 10, 32)
+		id.Numeric = uint32(n)
+	case NodeString:
+		id.Name = v
+	case NodeGUID:
+		id.Bytes, err = parseGUID(v)
+	case NodeOpaque:
+		id.Bytes, err = base64.StdEncoding.DecodeString(v)
+	default:
+		return id, fmt.Errorf("invalid node id type: %v", s)
+	}
+
+	if err != nil {
+		return id, fmt.Errorf("invalid node id: %v", s)
+	}
+
+	return id, nil
+}
+
+// String returns the node ID in the format used by ParseNodeID
+func (id NodeID) String() string {
+	var ns string
+	if id.Namespace != 0 {
+		ns = fmt.Sprintf("ns=%v;", id.Namespace)
+	}
+
+	switch id.Type {
+	case NodeString:
+		return ns + "s=" + id.Name
+	case NodeGUID:
+		return ns + "g=" + formatGUID(id.Bytes)
+	case NodeOpaque:
+		return ns + "b=" + base64.StdEncoding.EncodeToString(id.Bytes)
+	}
+	return ns + "i=" + strconv.FormatUint(uint64(id.Numeric), 10)
+}
+
+// GUIDs are encoded with the first three groups little endian
+func parseGUID(s string) ([]byte, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 5 || len(s) != 36 {
+		return nil, fmt.Errorf("invalid guid: %v", s)
+	}
+
+	b, err := hex.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	binary.LittleEndian.PutUint32(b, binary.BigEndian.Uint32(b))
+	binary.LittleEndian.PutUint16(b[4:], binary.BigEndian.Uint16(b[4:]))
+	binary.LittleEndian.PutUint16(b[6:], binary.BigEndian.Uint16(b[6:]))
+	return b, nil
+}
+
+func formatGUID(b []byte) string {
+	if len(b) != 16 {
+		return ""
+	}
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x", binary.LittleEndian.Uint32(b),
+		binary.LittleEndian.Uint16(b[4:]), binary.LittleEndian.Uint16(b[6:]),
+		b[8:10], b[10:])
+}
+
+// StatusCode is the result of an operation. Codes with the high bit set
+// are bad, and are returned as errors.
+type StatusCode uint32
+
+var statusNames = map[StatusCode]string{
+	0x800a0000: "BadTimeout",
+	0x801f0000: "BadUserAccessDenied",
+	0x80200000: "BadIdentityTokenInvalid",
+	0x80210000: "BadIdentityTokenRejected",
+	0x80250000: "BadSessionIdInvalid",
+	0x80340000: "BadNodeIdUnknown",
+	0x803b0000: "BadNotWritable",
+	0x80740000: "BadTypeMismatch",
+}
+
+// Bad returns true if the code is an error
+func (s StatusCode) Bad() bool {
+	return s&0x80000000 != 0
+}
+
+func (s StatusCode) Error() string {
+	if name, ok := statusNames[s]; ok {
+		return fmt.Sprintf("opcua status %v (0x%08x)", name, uint32(s))
+	}
+	return fmt.Sprintf("opcua status 0x%08x", uint32(s))
+}
@@ -0,0 +1,627 @@
+package opcua
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNodeID(t *testing.T) {
+	for _, s := range []string{"i=85", "ns=2;s=Tank.Level", "ns=1;i=70000",
+		"ns=3;g=09087e75-8e5e-499b-954f-f2a9603db28a", "ns=4;b=AQID"} {
+		id, err := ParseNodeID(s)
+		if err != nil {
+			t.Errorf("Error parsing %v: %v", s, err)
+			continue
+		}
+
+		if id.String() != s {
+			t.Errorf("node id %v formatted as %v", s, id)
+		}
+
+		var e encoder
+		e.nodeID(id)
+		d := decoder{b: e.b}
+		if d.nodeID().String() != s || d.err != nil || len(d.b) != 0 {
+			t.Errorf("node id %v encoding didn't round trip", s)
+		}
+	}
+
+	for _, s := range []string{"", "85", "ns=2", "ns=x;i=1", "ns=2;x=1",
+		"i=-1", "g=1234", "b=!"} {
+		_, err := ParseNodeID(s)
+		if err == nil {
+			t.Errorf("expected error for %v", s)
+		}
+	}
+}
+
+func TestVariant(t *testing.T) {
+	for _, v := range []interface{}{nil, true, int8(-3), uint8(200), int16(-300),
+		uint16(60000), int32(-70000), uint32(4000000000), int64(-1 << 40),
+		uint64(1 << 63), float32(1.5), 2.25, "pump", []byte{1, 2},
+		time.Date(2022, 7, 18, 9, 34, 15, 0, time.UTC),
+		NodeID{Type: NodeString, Namespace: 2, Name: "x"}, StatusCode(0x80340000)} {
+		var e encoder
+		err := e.dataValue(DataValue{Value: v})
+		if err != nil {
+			t.Errorf("Error encoding %v: %v", v, err)
+			continue
+		}
+
+		d := decoder{b: e.b}
+		dv := d.dataValue()
+		if d.err != nil || !reflect.DeepEqual(dv.Value, v) {
+			t.Errorf("variant %#v decoded as %#v", v, dv.Value)
+		}
+	}
+
+	// array of int16 with dimensions
+	d := decoder{b: []byte{0xc4, 2, 0, 0, 0, 1, 0, 0xff, 0xff, 1, 0, 0, 0, 2, 0, 0, 0}}
+	v := d.variant()
+	if d.err != nil || !reflect.DeepEqual(v, []interface{}{int16(1), int16(-1)}) {
+		t.Errorf("wrong array: %#v", v)
+	}
+}
+
+func TestFromFloat(t *testing.T) {
+	for _, c := range []struct {
+		f    float64
+		like interface{}
+		exp  interface{}
+	}{
+		{1, false, true},
+		{2.6, int16(0), int16(3)},
+		{-1, int32(0), int32(-1)},
+		{1.25, float32(0), float32(1.25)},
+		{300, uint8(0), nil},
+		{-1, uint16(0), nil},
+		{1, "on", nil},
+	} {
+		v, err := FromFloat(c.f, c.like)
+		if c.exp == nil {
+			if err == nil {
+				t.Errorf("expected error for %v as %T", c.f, c.like)
+			}
+			continue
+		}
+
+		if err != nil || v != c.exp {
+			t.Errorf("%v as %T is %#v, %v", c.f, c.like, v, err)
+		}
+
+		f, ok := ToFloat(v)
+		if !ok || (f != c.f && f != 1 && f != 3) {
+			t.Errorf("%#v converted to %v", v, f)
+		}
+	}
+}
+
+// testServer is a minimal OPC UA server with variables in a folder
+type testServer struct {
+	t        *testing.T
+	listener net.Listener
+	lock     sync.Mutex
+	values   map[string]interface{}
+	monitor  []NodeID
+	changes  chan int
+	acks     chan uint32
+}
+
+func newTestServer(t *testing.T) *testServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening: ", err)
+	}
+
+	s := &testServer{
+		t:        t,
+		listener: l,
+		values: map[string]interface{}{
+			"ns=2;s=Tank.Level": 42.5,
+			"ns=2;s=Pump.On":    false,
+			"ns=2;s=Setpoint":   int16(10),
+		},
+		changes: make(chan int, 10),
+		acks:    make(chan uint32, 10),
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *testServer) endpoint() string {
+	return "opc.tcp://" + s.listener.Addr().String() + "/siot"
+}
+
+func writeChunk(conn net.Conn, lock *sync.Mutex, typ string, id uint32, body []byte) {
+	var e encoder
+	e.b = append(e.b, typ...)
+	e.b = append(e.b, 'F', 0, 0, 0, 0)
+	if typ != "ACK" {
+		e.uint32(1)
+		if typ == "OPN" {
+			e.string(securityPolicyNone)
+			e.bytes(nil)
+			e.bytes(nil)
+		} else {
+			e.uint32(1)
+		}
+		e.uint32(id)
+		e.uint32(id)
+	}
+	e.b = append(e.b, body...)
+	binary.LittleEndian.PutUint32(e.b[4:], uint32(len(e.b)))
+
+	lock.Lock()
+	conn.Write(e.b)
+	lock.Unlock()
+}
+
+// testResponse returns an encoded response with a header
+func testResponse(typ uint32, status StatusCode) *encoder {
+	var e encoder
+	e.nodeID(NodeID{Numeric: typ})
+	e.time(time.Now())
+	e.uint32(0)
+	e.uint32(uint32(status))
+	e.byte(0)
+	e.uint32(0)
+	e.extensionObject(0, nil)
+	return &e
+}
+
+func (s *testServer) dataChange(handles []int) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var e encoder
+	e.uint32(uint32(len(handles)))
+	for _, h := range handles {
+		e.uint32(uint32(h))
+		e.dataValue(DataValue{Value: s.values[s.monitor[h].String()]})
+	}
+	e.uint32(0)
+	return e.b
+}
+
+func (s *testServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var writeLock sync.Mutex
+	seq := uint32(0)
+
+	for {
+		var header [8]byte
+		_, err := io.ReadFull(conn, header[:])
+		if err != nil {
+			return
+		}
+
+		body := make([]byte, binary.LittleEndian.Uint32(header[4:])-8)
+		_, err = io.ReadFull(conn, body)
+		if err != nil {
+			return
+		}
+
+		d := &decoder{b: body}
+		typ := string(header[:3])
+		switch typ {
+		case "HEL":
+			var e encoder
+			for _, v := range []uint32{0, receiveBufferSize, receiveBufferSize, 0, 0} {
+				e.uint32(v)
+			}
+			writeChunk(conn, &writeLock, "ACK", 0, e.b)
+			continue
+		case "CLO":
+			return
+		case "OPN":
+			d.uint32()
+			d.string()
+			d.bytes()
+			d.bytes()
+		default:
+			d.uint32()
+			d.uint32()
+		}
+
+		d.uint32()
+		id := d.uint32()
+		reqType := d.nodeID().Numeric
+
+		// request header
+		token := d.nodeID()
+		d.time()
+		d.uint32()
+		d.uint32()
+		d.string()
+		d.uint32()
+		d.extensionObject()
+
+		if reqType != idOpenChannelRequest && reqType != idCreateSessionRequest &&
+			token.Numeric != 99 {
+			s.t.Error("wrong session token: ", token)
+		}
+
+		var e *encoder
+		switch reqType {
+		case idOpenChannelRequest:
+			e = testResponse(idOpenChannelResponse, 0)
+			e.uint32(0)
+			e.uint32(1)
+			e.uint32(1)
+			e.time(time.Now())
+			e.uint32(channelLifetime)
+			e.bytes(nil)
+
+		case idCreateSessionRequest:
+			e = testResponse(idCreateSessionResponse, 0)
+			e.nodeID(NodeID{Numeric: 98})
+			e.nodeID(NodeID{Numeric: 99})
+			e.double(sessionTimeout)
+			e.bytes(nil)
+			e.bytes(nil)
+			// one endpoint without security
+			e.uint32(1)
+			e.string(s.endpoint())
+			e.string("urn:test")
+			e.string("")
+			e.localizedText("test")
+			e.uint32(0)
+			e.string("")
+			e.string("")
+			e.strings(nil)
+			e.bytes(nil)
+			e.uint32(1)
+			e.string(securityPolicyNone)
+			e.uint32(2)
+			for _, p := range []userTokenPolicy{{"anon", 0}, {"user", 1}} {
+				e.string(p.policyID)
+				e.uint32(p.tokenType)
+				e.string("")
+				e.string("")
+				e.string("")
+			}
+			e.string("")
+			e.byte(0)
+			e.uint32(0)
+			e.string("")
+			e.bytes(nil)
+			e.uint32(0)
+
+		case idActivateRequest:
+			d.string()
+			d.bytes()
+			d.arrayLen()
+			d.strings()
+			identity, b := d.extensionObject()
+			id := decoder{b: b}
+			policy := id.string()
+
+			status := StatusCode(0x801f0000)
+			switch identity {
+			case idAnonymousIdentity:
+				if policy == "anon" {
+					status = 0
+				}
+			case idUserNameIdentity:
+				if policy == "user" && id.string() == "admin" &&
+					string(id.bytes()) == "secret" {
+					status = 0
+				}
+			}
+
+			e = testResponse(idActivateResponse, status)
+			e.bytes(nil)
+			e.uint32(0)
+			e.uint32(0)
+
+		case idReadRequest:
+			d.double()
+			d.uint32()
+			n := d.arrayLen()
+			e = testResponse(idReadResponse, 0)
+			e.uint32(uint32(n))
+			for i := 0; i < n; i++ {
+				node := d.nodeID()
+				d.uint32()
+				d.string()
+				d.qualifiedName()
+
+				s.lock.Lock()
+				v, ok := s.values[node.String()]
+				s.lock.Unlock()
+				if ok {
+					e.dataValue(DataValue{Value: v, SourceTime: time.Now()})
+				} else {
+					e.byte(0x02)
+					e.uint32(0x80340000)
+				}
+			}
+			e.uint32(0)
+
+		case idWriteRequest:
+			d.arrayLen()
+			node := d.nodeID()
+			d.uint32()
+			d.string()
+			v := d.dataValue().Value
+
+			status := StatusCode(0)
+			s.lock.Lock()
+			old, ok := s.values[node.String()]
+			if !ok {
+				status = 0x80340000
+			} else if reflect.TypeOf(old) != reflect.TypeOf(v) {
+				status = 0x80740000
+			} else {
+				s.values[node.String()] = v
+			}
+			s.lock.Unlock()
+
+			if status == 0 {
+				for i, m := range s.monitor {
+					if m.String() == node.String() {
+						s.changes <- i
+					}
+				}
+			}
+
+			e = testResponse(idWriteResponse, 0)
+			e.uint32(1)
+			e.uint32(uint32(status))
+			e.uint32(0)
+
+		case idBrowseRequest, idBrowseNextRequest:
+			// the folder is returned one reference at a time
+			var ref string
+			var cont []byte
+			if reqType == idBrowseRequest {
+				ref = "Tank.Level"
+				cont = []byte{1}
+				e = testResponse(idBrowseResponse, 0)
+			} else {
+				ref = "Pump.On"
+				e = testResponse(idBrowseNextResponse, 0)
+			}
+
+			e.uint32(1)
+			e.uint32(0)
+			e.bytes(cont)
+			e.uint32(1)
+			e.nodeID(NodeID{Numeric: 47})
+			e.bool(true)
+			e.nodeID(NodeID{Namespace: 2, Type: NodeString, Name: ref})
+			e.uint16(2)
+			e.string(ref)
+			e.localizedText(ref)
+			e.uint32(uint32(NodeClassVariable))
+			e.nodeID(NodeID{Numeric: 63})
+			e.uint32(0)
+
+		case idSubscriptionRequest:
+			interval := d.double()
+			e = testResponse(idSubscriptionResponse, 0)
+			e.uint32(7)
+			e.double(interval)
+			e.uint32(30)
+			e.uint32(10)
+
+		case idMonitorRequest:
+			d.uint32()
+			d.uint32()
+			n := d.arrayLen()
+			e = testResponse(idMonitorResponse, 0)
+			e.uint32(uint32(n))
+			for i := 0; i < n; i++ {
+				node := d.nodeID()
+				d.uint32()
+				d.string()
+				d.qualifiedName()
+				d.uint32()
+				d.uint32()
+				d.double()
+				d.extensionObject()
+				d.uint32()
+				d.bool()
+
+				s.lock.Lock()
+				_, ok := s.values[node.String()]
+				s.monitor = append(s.monitor, node)
+				s.lock.Unlock()
+
+				status := StatusCode(0)
+				if !ok {
+					status = 0x80340000
+				}
+				e.uint32(uint32(status))
+				e.uint32(uint32(i))
+				e.double(100)
+				e.uint32(1)
+				e.extensionObject(0, nil)
+			}
+			e.uint32(0)
+
+		case idPublishRequest:
+			n := d.arrayLen()
+			for i := 0; i < n; i++ {
+				d.uint32()
+				s.acks <- d.uint32()
+			}
+
+			seq++
+			var handles []int
+			if seq == 1 {
+				// initial values
+				for i := range s.monitor {
+					handles = append(handles, i)
+				}
+			}
+
+			go func(seq uint32) {
+				if handles == nil {
+					select {
+					case h := <-s.changes:
+						handles = []int{h}
+					case <-time.After(5 * time.Second):
+						return
+					}
+				}
+
+				e := testResponse(idPublishResponse, 0)
+				e.uint32(7)
+				e.uint32(0)
+				e.bool(false)
+				e.uint32(seq)
+				e.time(time.Now())
+				e.uint32(1)
+				e.extensionObject(idDataChange, s.dataChange(handles))
+				e.uint32(0)
+				e.uint32(0)
+				writeChunk(conn, &writeLock, "MSG", id, e.b)
+			}(seq)
+			continue
+
+		case idCloseSessionRequest:
+			e = testResponse(idCloseSessionResponse, 0)
+
+		default:
+			e = testResponse(idServiceFault, 0x80000000)
+		}
+
+		if d.err != nil {
+			s.t.Errorf("Error decoding request %v: %v", reqType, d.err)
+		}
+
+		msgType := "MSG"
+		if reqType == idOpenChannelRequest {
+			msgType = "OPN"
+		}
+		writeChunk(conn, &writeLock, msgType, id, e.b)
+	}
+}
+
+func TestClient(t *testing.T) {
+	s := newTestServer(t)
+	defer s.listener.Close()
+
+	_, err := Dial(s.endpoint(), Config{User: "admin", Password: "wrong"})
+	if !errors.Is(err, StatusCode(0x801f0000)) {
+		t.Error("expected access denied, got: ", err)
+	}
+
+	c, err := Dial(s.endpoint(), Config{User: "admin", Password: "secret"})
+	if err != nil {
+		t.Fatal("Error dialing: ", err)
+	}
+	defer c.Close()
+
+	level, _ := ParseNodeID("ns=2;s=Tank.Level")
+	on, _ := ParseNodeID("ns=2;s=Pump.On")
+	setpoint, _ := ParseNodeID("ns=2;s=Setpoint")
+	missing, _ := ParseNodeID("ns=2;s=Missing")
+
+	values, err := c.Read(level, missing)
+	if err != nil {
+		t.Fatal("Error reading: ", err)
+	}
+
+	if values[0].Value != 42.5 || values[0].SourceTime.IsZero() ||
+		values[1].Status != 0x80340000 {
+		t.Errorf("wrong values: %+v", values)
+	}
+
+	err = c.Write(setpoint, 20.0)
+	if !errors.Is(err, StatusCode(0x80740000)) {
+		t.Error("expected type mismatch, got: ", err)
+	}
+
+	refs, err := c.Browse(ObjectsFolder)
+	if err != nil {
+		t.Fatal("Error browsing: ", err)
+	}
+
+	if len(refs) != 2 || refs[0].NodeID.String() != level.String() ||
+		refs[1].BrowseName != "Pump.On" || refs[1].NodeClass != NodeClassVariable {
+		t.Errorf("wrong references: %+v", refs)
+	}
+
+	changes := make(chan DataValue, 10)
+	err = c.Subscribe(100*time.Millisecond, []NodeID{level, on},
+		func(i int, v DataValue) {
+			if i == 1 {
+				changes <- v
+			}
+		})
+	if err != nil {
+		t.Fatal("Error subscribing: ", err)
+	}
+
+	next := func() interface{} {
+		select {
+		case v := <-changes:
+			return v.Value
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for change")
+		}
+		return nil
+	}
+
+	if v := next(); v != false {
+		t.Error("wrong initial value: ", v)
+	}
+
+	err = c.Write(on, true)
+	if err != nil {
+		t.Fatal("Error writing: ", err)
+	}
+
+	if v := next(); v != true {
+		t.Error("wrong changed value: ", v)
+	}
+
+	// the initial values are acked by the next publish request
+	select {
+	case seq := <-s.acks:
+		if seq != 1 {
+			t.Error("wrong ack: ", seq)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for ack")
+	}
+
+	err = c.Close()
+	if err != nil {
+		t.Error("Error closing: ", err)
+	}
+
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("client not done after close")
+	}
+
+	if c.Err() != ErrClosed {
+		t.Error("wrong error after close: ", c.Err())
+	}
+
+	_, err = c.Read(level)
+	if err != ErrClosed {
+		t.Error("expected closed error, got: ", err)
+	}
+}
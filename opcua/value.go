@@ -0,0 +1,89 @@
+package opcua
+
+import (
+	"fmt"
+	"math"
+)
+
+// ToFloat converts a numeric or boolean value to a float. ok is false for
+// other types.
+func ToFloat(v interface{}) (f float64, ok bool) {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case int8:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// FromFloat converts a float to the type of like, which is usually the
+// current value of the node being written. Integers are rounded, and an
+// error is returned if they are out of range.
+func FromFloat(f float64, like interface{}) (interface{}, error) {
+	if _, ok := like.(bool); ok {
+		return f != 0, nil
+	}
+
+	switch like.(type) {
+	case float32:
+		return float32(f), nil
+	case float64:
+		return f, nil
+	}
+
+	r := math.Round(f)
+	inRange := func(min, max float64) bool {
+		return r >= min && r <= max
+	}
+
+	var ret interface{}
+	var ok bool
+	switch like.(type) {
+	case int8:
+		ret, ok = int8(r), inRange(math.MinInt8, math.MaxInt8)
+	case uint8:
+		ret, ok = uint8(r), inRange(0, math.MaxUint8)
+	case int16:
+		ret, ok = int16(r), inRange(math.MinInt16, math.MaxInt16)
+	case uint16:
+		ret, ok = uint16(r), inRange(0, math.MaxUint16)
+	case int32:
+		ret, ok = int32(r), inRange(math.MinInt32, math.MaxInt32)
+	case uint32:
+		ret, ok = uint32(r), inRange(0, math.MaxUint32)
+	case int64:
+		ret, ok = int64(r), inRange(math.MinInt64, math.MaxInt64)
+	case uint64:
+		ret, ok = uint64(r), inRange(0, math.MaxUint64)
+	default:
+		return nil, fmt.Errorf("can't write a number to a %T value", like)
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("value %v is out of range for %T", f, like)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,241 @@
+// Package ota runs firmware rollouts. Rollouts send signed application
+// firmware to the devices in a set of groups in stages, starting with a few
+// canary devices, and are halted automatically if too many installs fail.
+// Rollouts are stored in the db and can be changed while the manager is
+// running.
+package ota
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+// Config describes how rollouts are run
+type Config struct {
+	// Interval is how often rollouts are checked for new devices in their
+	// groups (default 1m). Rollouts are also checked when they change and
+	// when devices report progress.
+	Interval time.Duration
+}
+
+// Manager sends the firmware of active rollouts to devices, and halts
+// rollouts when too many installs fail
+type Manager struct {
+	db     *db.Db
+	config Config
+	events <-chan db.Event
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewManager creates a rollout manager. Start starts running rollouts.
+func NewManager(dbInst *db.Db, config Config) *Manager {
+	if config.Interval == 0 {
+		config.Interval = time.Minute
+	}
+
+	return &Manager{
+		db:     dbInst,
+		config: config,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start runs rollouts until Stop is called
+func (m *Manager) Start() {
+	m.events = m.db.Subscribe(db.EventFilter{
+		Types: []db.EventType{db.EventRolloutChanged, db.EventDeviceCreated},
+	})
+
+	go m.run()
+}
+
+// Stop stops running rollouts
+func (m *Manager) Stop() {
+	close(m.stop)
+	<-m.done
+	m.db.Unsubscribe(m.events)
+}
+
+func (m *Manager) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+
+	m.check(0)
+
+	for {
+		select {
+		case e, ok := <-m.events:
+			if !ok {
+				return
+			}
+
+			switch {
+			case e.Rollout != nil:
+				m.check(e.Rollout.ID)
+			case e.Install != nil:
+				m.check(e.Install.RolloutID)
+			default:
+				m.check(0)
+			}
+		case <-ticker.C:
+			m.check(0)
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// check runs a rollout, or all rollouts if id is 0
+func (m *Manager) check(id uint64) {
+	var rollouts []data.Rollout
+	if id != 0 {
+		r, err := m.db.Rollout(id)
+		if err != nil {
+			// the rollout was deleted
+			return
+		}
+		rollouts = []data.Rollout{r}
+	} else {
+		var err error
+		rollouts, err = m.db.Rollouts()
+		if err != nil {
+			log.Println("Error loading rollouts: ", err)
+			return
+		}
+	}
+
+	for _, r := range rollouts {
+		if r.State != data.RolloutActive {
+			continue
+		}
+
+		err := m.runRollout(r)
+		if err != nil {
+			log.Printf("Error running rollout %v: %v", r.ID, err)
+		}
+	}
+}
+
+func (m *Manager) runRollout(r data.Rollout) error {
+	fw, err := m.db.Firmware(r.FirmwareID)
+	if err != nil {
+		return fmt.Errorf("Error loading firmware %v: %v", r.FirmwareID, err)
+	}
+
+	devices, err := m.db.RolloutDevices(r)
+	if err != nil {
+		return err
+	}
+
+	list, err := m.db.FirmwareInstalls(r.ID)
+	if err != nil {
+		return err
+	}
+
+	installs := make(map[string]data.FirmwareInstall)
+	for _, i := range list {
+		installs[i.DeviceID] = i
+	}
+
+	p := plan(r, devices, installs)
+
+	if p.halt != "" {
+		log.Printf("Halting rollout %v: %v", r.ID, p.halt)
+		return m.db.RolloutSetState(r.ID, data.RolloutHalted, p.halt)
+	}
+
+	for _, id := range p.send {
+		err := m.db.FirmwareDispatch(r, fw, id)
+		if err != nil {
+			return fmt.Errorf("Error sending firmware to %v: %v", id, err)
+		}
+	}
+
+	if p.done {
+		log.Printf("Rollout %v is done", r.ID)
+		return m.db.RolloutSetState(r.ID, data.RolloutDone, "")
+	}
+
+	return nil
+}
+
+// rolloutPlan is what to do next in a rollout
+type rolloutPlan struct {
+	// send are the devices to send the firmware to
+	send []string
+	// halt is the reason to halt the rollout, if it should be halted
+	halt string
+	// done is true if all devices finished
+	done bool
+}
+
+// plan decides which devices get the firmware next. devices are the
+// devices in the rollout groups, in rollout order, and installs are the
+// installs already sent, by device ID.
+func plan(r data.Rollout, devices []string, installs map[string]data.FirmwareInstall) rolloutPlan {
+	var ret rolloutPlan
+
+	finished, failed := 0, 0
+	for _, i := range installs {
+		if i.Finished() {
+			finished++
+		}
+		if i.State == data.InstallFailed {
+			failed++
+		}
+	}
+
+	min := r.MinInstalls
+	if min <= 0 {
+		min = 1
+	}
+
+	if finished >= min && float64(failed)/float64(finished) > r.MaxFailures {
+		ret.halt = fmt.Sprintf("%v of %v installs failed", failed, finished)
+		return ret
+	}
+
+	canary := r.Canary
+	if canary > len(devices) {
+		canary = len(devices)
+	}
+
+	// the rest of the devices wait until the canaries finished
+	target := canary
+	canariesDone := true
+	for _, id := range devices[:canary] {
+		if !installs[id].Finished() {
+			canariesDone = false
+		}
+	}
+
+	if canariesDone {
+		n := (len(devices)*r.Percent + 99) / 100
+		if n > target {
+			target = n
+		}
+	}
+
+	allDone := len(devices) > 0
+	for i, id := range devices {
+		install, ok := installs[id]
+		if !ok && i < target {
+			ret.send = append(ret.send, id)
+		}
+
+		if !install.Finished() {
+			allDone = false
+		}
+	}
+
+	ret.done = allDone && canariesDone && r.Percent >= 100
+	return ret
+}
@@ -0,0 +1,168 @@
+package ota
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/db/dbtest"
+)
+
+func TestPlan(t *testing.T) {
+	devices := []string{"d0", "d1", "d2", "d3", "d4", "d5", "d6", "d7", "d8", "d9"}
+	installs := func(states ...string) map[string]data.FirmwareInstall {
+		ret := make(map[string]data.FirmwareInstall)
+		for i, s := range states {
+			ret[devices[i]] = data.FirmwareInstall{DeviceID: devices[i], State: s}
+		}
+		return ret
+	}
+
+	done, failed, pending := data.InstallDone, data.InstallFailed, data.InstallPending
+
+	for i, tc := range []struct {
+		rollout  data.Rollout
+		installs map[string]data.FirmwareInstall
+		send     int
+		halt     bool
+		done     bool
+	}{
+		// canaries first
+		{data.Rollout{Canary: 2, Percent: 50}, installs(), 2, false, false},
+		{data.Rollout{Canary: 2, Percent: 50}, installs(done, pending), 0, false, false},
+		// then the percent
+		{data.Rollout{Canary: 2, Percent: 50}, installs(done, done), 3, false, false},
+		{data.Rollout{Canary: 2, Percent: 100}, installs(done, done, pending), 7, false, false},
+		{data.Rollout{Percent: 25}, installs(), 3, false, false},
+		// failures over the limit halt the rollout
+		{data.Rollout{Canary: 2, Percent: 50}, installs(done, failed), 0, true, false},
+		{data.Rollout{Canary: 2, Percent: 50, MaxFailures: 0.5},
+			installs(done, failed), 3, false, false},
+		{data.Rollout{Percent: 50, MinInstalls: 3}, installs(failed, done), 3, false, false},
+		{data.Rollout{Percent: 100, MaxFailures: 0.2},
+			installs(done, done, done, done, done, done, done, done, done, failed),
+			0, false, true},
+	} {
+		p := plan(tc.rollout, devices, tc.installs)
+		if len(p.send) != tc.send || (p.halt != "") != tc.halt || p.done != tc.done {
+			t.Errorf("%v: wrong plan: %+v", i, p)
+		}
+	}
+
+	if p := plan(data.Rollout{Canary: 2, Percent: 100}, nil, nil); p.done || len(p.send) != 0 {
+		t.Errorf("wrong plan for no devices: %+v", p)
+	}
+}
+
+// wait waits for cond to be true
+func wait(t *testing.T, what string, cond func() bool) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("timeout waiting for ", what)
+}
+
+func TestManager(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	for i := 0; i < 4; i++ {
+		id := fmt.Sprintf("pump%v", i)
+		err := dbInst.DeviceSample(id, data.Sample{Type: "temp", Value: 20})
+		if err != nil {
+			t.Fatal("Error creating device: ", err)
+		}
+
+		err = dbInst.DeviceUpdateConfig(id, data.DeviceConfig{Groups: []string{"pumps"}})
+		if err != nil {
+			t.Fatal("Error updating config: ", err)
+		}
+	}
+
+	// not in the rollout groups
+	err := dbInst.DeviceSample("tank", data.Sample{Type: "level", Value: 2})
+	if err != nil {
+		t.Fatal("Error creating device: ", err)
+	}
+
+	fw, err := dbInst.FirmwareAdd(data.Firmware{Name: "pump", Version: "1.1"},
+		[]byte("firmware"))
+	if err != nil {
+		t.Fatal("Error adding firmware: ", err)
+	}
+
+	m := NewManager(dbInst, Config{})
+	m.Start()
+	defer m.Stop()
+
+	r, err := dbInst.RolloutInsert(data.Rollout{FirmwareID: fw.ID,
+		Groups: []string{"pumps"}, Canary: 1, Percent: 100, State: data.RolloutActive})
+	if err != nil {
+		t.Fatal("Error creating rollout: ", err)
+	}
+
+	installs := func(n int) []data.FirmwareInstall {
+		var ret []data.FirmwareInstall
+		wait(t, fmt.Sprintf("%v installs", n), func() bool {
+			ret, _ = dbInst.FirmwareInstalls(r.ID)
+			return len(ret) == n
+		})
+		return ret
+	}
+
+	canary := installs(1)[0]
+	cmds, err := dbInst.DeviceCommands(canary.DeviceID)
+	if err != nil || len(cmds) != 1 || cmds[0].Command != data.FirmwareCommand ||
+		cmds[0].Args["sha256"] != fw.SHA256 {
+		t.Fatalf("wrong commands: %+v, %v", cmds, err)
+	}
+
+	_, err = dbInst.FirmwareReport(canary.DeviceID, data.FirmwareReport{
+		RolloutID: r.ID, State: data.InstallDone, Progress: 100, Version: "1.1"})
+	if err != nil {
+		t.Fatal("Error reporting install: ", err)
+	}
+
+	// the rest of the group gets the firmware
+	for _, i := range installs(4) {
+		if i.DeviceID == "tank" {
+			t.Error("device outside the rollout groups updated")
+		}
+
+		if i.DeviceID == canary.DeviceID {
+			continue
+		}
+
+		_, err = dbInst.FirmwareReport(i.DeviceID, data.FirmwareReport{
+			RolloutID: r.ID, State: data.InstallFailed, Error: "disk full"})
+		if err != nil {
+			t.Fatal("Error reporting install: ", err)
+		}
+	}
+
+	wait(t, "rollout to halt", func() bool {
+		r, _ := dbInst.Rollout(r.ID)
+		return r.State == data.RolloutHalted && r.Reason != ""
+	})
+
+	status, err := dbInst.RolloutStatus(r)
+	if err != nil || status.Devices != 4 || status.Installs[data.InstallFailed] != 3 {
+		t.Errorf("wrong status: %+v, %v", status, err)
+	}
+
+	_, err = dbInst.FirmwareReport("tank", data.FirmwareReport{RolloutID: r.ID,
+		State: data.InstallDone})
+	if err == nil {
+		t.Error("expected error for device not in the rollout")
+	}
+
+	if err := dbInst.FirmwareDelete(fw.ID); err != db.ErrFirmwareInUse {
+		t.Error("expected firmware in use, got: ", err)
+	}
+}
@@ -0,0 +1,324 @@
+package particle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/donovanhide/eventsource"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/logging"
+)
+
+var particleLog = logging.Module("particle")
+
+// DefaultURL is the Particle cloud API
+const DefaultURL = "https://api.particle.io"
+
+// Config describes how the integration connects to the Particle cloud
+type Config struct {
+	// Token is the Particle access token that events are streamed and
+	// functions are called with. If it is blank, events are only received
+	// with webhooks, and commands are not sent.
+	Token string
+	// Prefix is the prefix of the names of the events that are read
+	// (default sample)
+	Prefix string
+	// WebhookToken is required in the Authorization header of webhooks.
+	// Webhooks are disabled if it is blank.
+	WebhookToken string
+	// URL is the Particle API (default DefaultURL)
+	URL string
+	// Write stores samples from devices, typically api.WriteSamples or
+	// db.IngestQueue.Enqueue
+	Write func(id string, samples []data.Sample) error
+}
+
+// Integration receives events published by Particle devices, from the
+// event stream of the Particle cloud or from webhooks, and writes the
+// samples in them. The Particle device ID is the device ID. Commands queued
+// for devices that have published events call the Particle function with
+// the name of the command, with the arg arg of the command.
+type Integration struct {
+	db     *db.Db
+	config Config
+	client *http.Client
+	lock   sync.Mutex
+	// devices are the devices events were received from, which commands
+	// are sent to
+	devices map[string]bool
+	// cmdLock keeps a command from being sent twice
+	cmdLock sync.Mutex
+	stream  *eventsource.Stream
+	// cancel closes the connection of the stream, which the eventsource
+	// package does not do
+	cancel context.CancelFunc
+	events <-chan db.Event
+	stop   chan struct{}
+}
+
+// NewIntegration creates an integration
+func NewIntegration(dbInst *db.Db, config Config) *Integration {
+	if config.Prefix == "" {
+		config.Prefix = "sample"
+	}
+
+	if config.URL == "" {
+		config.URL = DefaultURL
+	}
+
+	return &Integration{
+		db:      dbInst,
+		config:  config,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		devices: make(map[string]bool),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start streams events and sends queued commands until Stop is called.
+// Nothing is started without a token.
+func (i *Integration) Start() error {
+	if i.config.Token == "" {
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, i.config.URL+"/v1/devices/events/"+
+		neturl.PathEscape(i.config.Prefix), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+i.config.Token)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	i.stream, err = eventsource.SubscribeWithRequest("", req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return err
+	}
+	i.cancel = cancel
+
+	i.events = i.db.Subscribe(db.EventFilter{
+		Types: []db.EventType{db.EventCommandQueued},
+	})
+
+	go func() {
+		for {
+			select {
+			case ev, ok := <-i.stream.Events:
+				if !ok {
+					return
+				}
+
+				var e Event
+				err := json.Unmarshal([]byte(ev.Data()), &e)
+				if err != nil {
+					particleLog.Warn("error decoding event", "err", err)
+					continue
+				}
+
+				e.Name = ev.Event()
+				err = i.HandleEvent(e)
+				if err != nil {
+					particleLog.Warn("error handling event", "device", e.CoreID,
+						"event", e.Name, "err", err)
+				}
+			case err, ok := <-i.stream.Errors:
+				if !ok {
+					return
+				}
+
+				particleLog.Warn("event stream error", "err", err)
+			case e, ok := <-i.events:
+				if !ok {
+					return
+				}
+
+				// the command may have been sent by sendPending before
+				// the event was received
+				i.cmdLock.Lock()
+				queued, err := i.db.CommandQueued(*e.Command)
+				if err == nil && queued {
+					err = i.sendCommand(*e.Command)
+				}
+				i.cmdLock.Unlock()
+				if err != nil && err != errUnknownDevice {
+					particleLog.Error("error sending command", "device", e.DeviceID,
+						"err", err)
+				}
+			case <-i.stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the integration
+func (i *Integration) Stop() {
+	close(i.stop)
+	if i.stream != nil {
+		i.stream.Close()
+		i.cancel()
+		i.db.Unsubscribe(i.events)
+	}
+}
+
+// ValidToken checks the token of a webhook request. Webhooks are disabled
+// if the token is not configured.
+func (i *Integration) ValidToken(token string) bool {
+	return data.TokenEqual(token, i.config.WebhookToken)
+}
+
+// HandleEvent writes the samples of an event, and sends the commands queued
+// for the device. Events that don't start with the prefix are ignored.
+func (i *Integration) HandleEvent(e Event) error {
+	if e.CoreID == "" {
+		return errors.New("event has no device ID")
+	}
+
+	if !strings.HasPrefix(e.Name, i.config.Prefix) {
+		return nil
+	}
+
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+
+	samples, err := e.Samples(i.config.Prefix)
+	if err != nil {
+		return fmt.Errorf("error decoding event from %v: %v", e.CoreID, err)
+	}
+
+	if len(samples) > 0 {
+		err = i.config.Write(e.CoreID, samples)
+		if err != nil {
+			return err
+		}
+	}
+
+	i.lock.Lock()
+	i.devices[e.CoreID] = true
+	i.lock.Unlock()
+
+	if i.config.Token != "" {
+		// the device is online, so this is a good time to send
+		// commands that were queued before
+		go i.sendPending(e.CoreID)
+	}
+
+	return nil
+}
+
+var errUnknownDevice = errors.New("no event received from device")
+
+// functionResponse is the response of a function call
+type functionResponse struct {
+	Connected   bool   `json:"connected"`
+	ReturnValue int    `json:"return_value"`
+	Error       string `json:"error"`
+}
+
+// Call calls a function of a device with an argument, and returns the
+// return value of the function
+func (i *Integration) Call(id, function, arg string) (int, error) {
+	form := neturl.Values{"arg": {arg}}
+	req, err := http.NewRequest(http.MethodPost, i.config.URL+"/v1/devices/"+
+		neturl.PathEscape(id)+"/"+neturl.PathEscape(function),
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+i.config.Token)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := i.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	var r functionResponse
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err != nil {
+		return 0, err
+	}
+	json.Unmarshal(body, &r)
+
+	if res.StatusCode != http.StatusOK {
+		return 0, &CallError{StatusCode: res.StatusCode, Message: r.Error}
+	}
+
+	return r.ReturnValue, nil
+}
+
+// CallError is returned by Call when the Particle cloud rejects a function
+// call
+type CallError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("function call failed with status %v: %v", e.StatusCode,
+		e.Message)
+}
+
+// sendCommand calls the function of a command and removes it from the
+// queue. Commands stay queued if the device is offline, and are removed if
+// the function does not exist. i.cmdLock must be held.
+func (i *Integration) sendCommand(cmd data.DeviceCommand) error {
+	i.lock.Lock()
+	ok := i.devices[cmd.DeviceID]
+	i.lock.Unlock()
+
+	if !ok {
+		return errUnknownDevice
+	}
+
+	ret, err := i.Call(cmd.DeviceID, cmd.Command, cmd.Args["arg"])
+	var callErr *CallError
+	if errors.As(err, &callErr) && callErr.StatusCode == http.StatusNotFound {
+		particleLog.Warn("dropping command", "id", cmd.ID, "device",
+			cmd.DeviceID, "command", cmd.Command, "err", err)
+		return i.db.CommandDelete(cmd.ID)
+	}
+	if err != nil {
+		return err
+	}
+
+	particleLog.Debug("called function", "device", cmd.DeviceID, "function",
+		cmd.Command, "return", ret)
+
+	return i.db.CommandDelete(cmd.ID)
+}
+
+func (i *Integration) sendPending(id string) {
+	i.cmdLock.Lock()
+	defer i.cmdLock.Unlock()
+
+	cmds, err := i.db.DeviceCommands(id)
+	if err != nil {
+		particleLog.Error("error reading commands", "device", id, "err", err)
+		return
+	}
+
+	for _, cmd := range cmds {
+		err := i.sendCommand(cmd)
+		if err != nil {
+			// the device is probably offline again
+			particleLog.Warn("error sending command", "device", id, "err", err)
+			return
+		}
+	}
+}
@@ -2,7 +2,11 @@ package particle
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/donovanhide/eventsource"
@@ -11,12 +15,90 @@ import (
 
 // Event from particle
 type Event struct {
+	// Name is the event name, which is only sent in webhooks. It is the
+	// SSE event type of streamed events.
+	Name      string    `json:"event"`
 	Data      string    `json:"data"`
 	TTL       uint32    `json:"ttl"`
 	Timestamp time.Time `json:"published_at"`
 	CoreID    string    `json:"coreid"`
 }
 
+// Samples returns the samples published in an event. The data of the event
+// is one of:
+//
+//	a JSON array of samples
+//	a JSON object of variable values, like {"temp": 23.5, "on": true}
+//	a single value, like 23.5, which is named after the event with prefix
+//	removed, like sample/temp
+//
+// Variables that are not numbers or booleans are skipped. Samples without
+// a time get the publish time of the event.
+func (e Event) Samples(prefix string) ([]data.Sample, error) {
+	var samples []data.Sample
+
+	d := strings.TrimSpace(e.Data)
+	switch {
+	case strings.HasPrefix(d, "["):
+		err := json.Unmarshal([]byte(d), &samples)
+		if err != nil {
+			return nil, err
+		}
+	case strings.HasPrefix(d, "{"):
+		var vars map[string]interface{}
+		err := json.Unmarshal([]byte(d), &vars)
+		if err != nil {
+			return nil, err
+		}
+
+		names := make([]string, 0, len(vars))
+		for name := range vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			switch v := vars[name].(type) {
+			case float64:
+				samples = append(samples, data.Sample{Type: name, Value: v})
+			case bool:
+				s := data.Sample{Type: name}
+				if v {
+					s.Value = 1
+				}
+				samples = append(samples, s)
+			}
+		}
+	default:
+		name := strings.TrimPrefix(strings.TrimPrefix(e.Name, prefix), "/")
+		if name == "" {
+			return nil, errors.New("event data must be samples or variables")
+		}
+
+		v, err := strconv.ParseFloat(d, 64)
+		if err != nil {
+			b, err := strconv.ParseBool(d)
+			if err != nil {
+				return nil, errors.New("event data must be a number")
+			}
+
+			v = 0
+			if b {
+				v = 1
+			}
+		}
+		samples = []data.Sample{{Type: name, Value: v}}
+	}
+
+	for i := range samples {
+		if samples[i].Time.IsZero() {
+			samples[i].Time = e.Timestamp
+		}
+	}
+
+	return samples, nil
+}
+
 const url string = "https://api.particle.io/v1/devices/events/"
 
 // SampleReader does a streaming http read and returns when the connection closes
@@ -39,8 +121,8 @@ func SampleReader(eventPrefix, token string, callback func(string, []data.Sample
 				continue
 			}
 
-			var samples []data.Sample
-			err = json.Unmarshal([]byte(pEvent.Data), &samples)
+			pEvent.Name = event.Event()
+			samples, err := pEvent.Samples(eventPrefix)
 			if err != nil {
 				log.Println("Got error decoding samples: ", err)
 				continue
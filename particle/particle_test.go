@@ -0,0 +1,174 @@
+package particle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+func TestSamples(t *testing.T) {
+	published := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	sampleTime := time.Date(2021, 5, 1, 9, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name string
+		data string
+		exp  []data.Sample
+	}{
+		{"sample", `[{"type": "temp", "value": 21, "time": "2021-05-01T09:00:00Z"}]`,
+			[]data.Sample{{Type: "temp", Value: 21, Time: sampleTime}}},
+		{"sample", `{"temp": 23.5, "on": true, "status": "ok"}`,
+			[]data.Sample{{Type: "on", Value: 1, Time: published},
+				{Type: "temp", Value: 23.5, Time: published}}},
+		{"sample/level", "7", []data.Sample{{Type: "level", Value: 7, Time: published}}},
+		{"sample/door", "false", []data.Sample{{Type: "door", Time: published}}},
+	} {
+		e := Event{Name: tc.name, Data: tc.data, Timestamp: published}
+		samples, err := e.Samples("sample")
+		if err != nil {
+			t.Errorf("Error decoding %v: %v", tc.data, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(samples, tc.exp) {
+			t.Errorf("wrong samples for %v: %+v", tc.data, samples)
+		}
+	}
+
+	for _, e := range []Event{
+		{Name: "sample", Data: "7"},
+		{Name: "sample/level", Data: "high"},
+		{Name: "sample", Data: "[1, 2]"},
+	} {
+		_, err := e.Samples("sample")
+		if err == nil {
+			t.Errorf("%+v should be invalid", e)
+		}
+	}
+}
+
+func TestIntegration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-particle-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbInst, err := db.NewDb(dir, nil)
+	if err != nil {
+		t.Fatal("Error opening db: ", err)
+	}
+	defer dbInst.Close()
+
+	var lock sync.Mutex
+	var calls []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(res, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		switch req.URL.Path {
+		case "/v1/devices/events/sample":
+			res.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(res, "event: sample/temp\n"+
+				`data: {"data":"21.5","ttl":60,"published_at":"2021-05-01T10:00:00Z","coreid":"e00fce68"}`+"\n\n")
+			res.(http.Flusher).Flush()
+			<-req.Context().Done()
+		case "/v1/devices/e00fce68/led":
+			lock.Lock()
+			calls = append(calls, req.FormValue("arg"))
+			lock.Unlock()
+			fmt.Fprint(res, `{"id": "e00fce68", "connected": true, "return_value": 1}`)
+		default:
+			res.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(res, `{"ok": false, "error": "Function not found"}`)
+		}
+	}))
+	defer server.Close()
+
+	i := NewIntegration(dbInst, Config{
+		Token:        "secret",
+		WebhookToken: "hook",
+		URL:          server.URL,
+		Write: func(id string, samples []data.Sample) error {
+			for _, s := range samples {
+				err := dbInst.DeviceSample(id, s)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+
+	err = i.Start()
+	if err != nil {
+		t.Fatal("Error starting integration: ", err)
+	}
+	defer i.Stop()
+
+	wait := func(check func() bool) bool {
+		for start := time.Now(); time.Since(start) < 2*time.Second; {
+			if check() {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	if !wait(func() bool {
+		s, ok := dbInst.LatestValue("e00fce68", "temp", "")
+		return ok && s.Value == 21.5
+	}) {
+		t.Fatal("streamed sample was not written")
+	}
+
+	for _, cmd := range []data.DeviceCommand{
+		{DeviceID: "e00fce68", Command: "led", Args: map[string]string{"arg": "on"}},
+		{DeviceID: "e00fce68", Command: "missing"},
+	} {
+		_, err := dbInst.CommandEnqueue(cmd)
+		if err != nil {
+			t.Fatal("Error queueing command: ", err)
+		}
+	}
+
+	if !wait(func() bool {
+		cmds, _ := dbInst.DeviceCommands("e00fce68")
+		return len(cmds) == 0
+	}) {
+		t.Error("commands were not removed")
+	}
+
+	lock.Lock()
+	if !reflect.DeepEqual(calls, []string{"on"}) {
+		t.Errorf("wrong function calls: %v", calls)
+	}
+	lock.Unlock()
+
+	// commands for devices that have not sent events stay queued
+	_, err = dbInst.CommandEnqueue(data.DeviceCommand{DeviceID: "other", Command: "led"})
+	if err != nil {
+		t.Fatal("Error queueing command: ", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if cmds, _ := dbInst.DeviceCommands("other"); len(cmds) != 1 {
+		t.Error("command for unknown device was removed")
+	}
+
+	if i.ValidToken("") || i.ValidToken("secret") || !i.ValidToken("hook") {
+		t.Error("wrong webhook token check")
+	}
+}
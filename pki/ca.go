@@ -0,0 +1,160 @@
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// caValidity is how long the built-in CA certificate is valid
+const caValidity = 20 * 365 * 24 * time.Hour
+
+// CA is the built-in CA. Its key and certificate are stored in a
+// directory, and created the first time the CA is loaded.
+type CA struct {
+	cert     *x509.Certificate
+	certPEM  []byte
+	key      *ecdsa.PrivateKey
+	validity time.Duration
+}
+
+// LoadCA loads the CA in dir, or creates it if it does not exist. Device
+// certificates are valid for validity.
+func LoadCA(dir string, validity time.Duration) (*CA, error) {
+	if validity <= 0 {
+		return nil, errors.New("certificate validity is required")
+	}
+
+	certFile := filepath.Join(dir, "ca.pem")
+	keyFile := filepath.Join(dir, "ca-key.pem")
+
+	certPEM, err := ioutil.ReadFile(certFile)
+	if os.IsNotExist(err) {
+		err = createCA(dir, certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		certPEM, err = ioutil.ReadFile(certFile)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("invalid CA certificate")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("invalid CA key")
+	}
+
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CA{cert: cert, certPEM: certPEM, key: key, validity: validity}, nil
+}
+
+// serialNumber returns a random certificate serial number
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func createCA(dir, certFile, keyFile string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "SIOT device CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}, &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "SIOT device CA"},
+	}, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	// the key is written first, so a CA certificate is never left
+	// without its key
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(certFile, EncodeCert(der), 0644)
+}
+
+// Sign issues a client certificate for a device. The subject is the
+// device ID, whatever the CSR asks for.
+func (ca *CA) Sign(csr *x509.CertificateRequest, deviceID string) ([]byte, error) {
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: deviceID},
+		// allow for devices with clocks that are a little behind
+		NotBefore:   now.Add(-5 * time.Minute),
+		NotAfter:    now.Add(ca.validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca.cert, csr.PublicKey, ca.key)
+}
+
+// CACert returns the PEM encoded CA certificate
+func (ca *CA) CACert() []byte {
+	return ca.certPEM
+}
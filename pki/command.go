@@ -0,0 +1,91 @@
+package pki
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// commandTimeout is how long a sign command can run
+const commandTimeout = time.Minute
+
+// CommandSigner has device certificates signed by an external CA. The
+// command is run with sh, with the PEM encoded CSR on stdin and the device
+// ID in the SIOT_DEVICE_ID environment variable, and must print the PEM
+// encoded certificate. The certificate is checked before it is used.
+type CommandSigner struct {
+	command string
+	caPEM   []byte
+	roots   *x509.CertPool
+}
+
+// NewCommandSigner creates a signer that runs command. caPEM is the
+// certificate of the external CA.
+func NewCommandSigner(command string, caPEM []byte) (*CommandSigner, error) {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("invalid CA certificate")
+	}
+
+	return &CommandSigner{command: command, caPEM: caPEM, roots: roots}, nil
+}
+
+// Sign runs the command to sign a CSR
+func (s *CommandSigner) Sign(csr *x509.CertificateRequest, deviceID string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", s.command)
+	cmd.Env = append(os.Environ(), "SIOT_DEVICE_ID="+deviceID)
+	cmd.Stdin = bytes.NewReader(pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE REQUEST", Bytes: csr.Raw}))
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("sign command failed: %v %v", err,
+			strings.TrimSpace(stderr.String()))
+	}
+
+	block, _ := pem.Decode(stdout.Bytes())
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("sign command did not print a certificate")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if DeviceID(cert) != deviceID {
+		return nil, fmt.Errorf("signed certificate is for %q", DeviceID(cert))
+	}
+
+	if !bytes.Equal(cert.RawSubjectPublicKeyInfo, csr.RawSubjectPublicKeyInfo) {
+		return nil, errors.New("signed certificate has the wrong key")
+	}
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     s.roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return block.Bytes, nil
+}
+
+// CACert returns the PEM encoded certificate of the external CA
+func (s *CommandSigner) CACert() []byte {
+	return s.caPEM
+}
@@ -0,0 +1,117 @@
+// Package pki issues the client certificates devices use to authenticate
+// with mutual TLS. Certificates are signed by a built-in CA, or by an
+// external CA through a command. A device sends a certificate signing
+// request (CSR) when it registers, so its private key never leaves the
+// device, and sends a new CSR to rotate its certificate before it expires.
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"time"
+)
+
+// Signer signs device certificates
+type Signer interface {
+	// Sign issues a client certificate for a device from a CSR, and
+	// returns it DER encoded
+	Sign(csr *x509.CertificateRequest, deviceID string) ([]byte, error)
+	// CACert returns the PEM encoded certificate of the CA that signs
+	// device certificates
+	CACert() []byte
+}
+
+// ParseCSR parses and checks a PEM encoded CSR
+func ParseCSR(csrPEM []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("CSR must be PEM encoded")
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = csr.CheckSignature()
+	if err != nil {
+		return nil, err
+	}
+
+	return csr, nil
+}
+
+// NewCSR generates a P-256 key and a CSR for a device. Both are PEM
+// encoded.
+func NewCSR(deviceID string) (keyPEM, csrPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+	der, err = x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: deviceID},
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	csrPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	return keyPEM, csrPEM, nil
+}
+
+// EncodeCert PEM encodes a DER certificate
+func EncodeCert(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// DeviceID returns the ID of the device a certificate was issued to
+func DeviceID(cert *x509.Certificate) string {
+	return cert.Subject.CommonName
+}
+
+// Serial returns the serial number of a certificate as hex
+func Serial(cert *x509.Certificate) string {
+	return hex.EncodeToString(cert.SerialNumber.Bytes())
+}
+
+// NeedsRotation returns true if less than a third of the lifetime of a
+// certificate is left
+func NeedsRotation(cert *x509.Certificate, now time.Time) bool {
+	life := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotAfter.Sub(now) < life/3
+}
+
+// ServerTLSConfig returns the TLS config of a server that verifies the
+// client certificates devices send. Clients without a certificate can
+// connect, so devices can register before they have one.
+func ServerTLSConfig(signer Signer) (*tls.Config, error) {
+	if signer == nil {
+		return nil, errors.New("a certificate signer is required")
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(signer.CACert()) {
+		return nil, errors.New("invalid CA certificate")
+	}
+
+	return &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  pool,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
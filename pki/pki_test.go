@@ -0,0 +1,132 @@
+package pki
+
+import (
+	"bytes"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newCSR(t *testing.T, id string) *x509.CertificateRequest {
+	_, csrPEM, err := NewCSR(id)
+	if err != nil {
+		t.Fatal("Error creating CSR: ", err)
+	}
+
+	csr, err := ParseCSR(csrPEM)
+	if err != nil {
+		t.Fatal("Error parsing CSR: ", err)
+	}
+
+	return csr
+}
+
+func TestCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-pki-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, err := LoadCA(dir, 24*time.Hour)
+	if err != nil {
+		t.Fatal("Error creating CA: ", err)
+	}
+
+	// the CA is loaded again, not recreated
+	ca2, err := LoadCA(dir, 24*time.Hour)
+	if err != nil {
+		t.Fatal("Error loading CA: ", err)
+	}
+
+	if !bytes.Equal(ca.CACert(), ca2.CACert()) {
+		t.Error("CA was recreated")
+	}
+
+	// the device ID wins over the CSR subject
+	der, err := ca.Sign(newCSR(t, "other"), "dev1")
+	if err != nil {
+		t.Fatal("Error signing: ", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("Error parsing cert: ", err)
+	}
+
+	if DeviceID(cert) != "dev1" {
+		t.Error("wrong device ID: ", DeviceID(cert))
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.CACert())
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if err != nil {
+		t.Error("cert does not verify: ", err)
+	}
+
+	now := time.Now()
+	if NeedsRotation(cert, now) {
+		t.Error("new cert needs rotation")
+	}
+
+	if !NeedsRotation(cert, now.Add(17*time.Hour)) {
+		t.Error("old cert does not need rotation")
+	}
+
+	_, err = ParseCSR([]byte("bogus"))
+	if err == nil {
+		t.Error("parsed bogus CSR")
+	}
+}
+
+func TestCommandSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-pki-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the built-in CA stands in for an external CA
+	ca, err := LoadCA(filepath.Join(dir, "ca"), time.Hour)
+	if err != nil {
+		t.Fatal("Error creating CA: ", err)
+	}
+
+	csr := newCSR(t, "dev1")
+	der, err := ca.Sign(csr, "dev1")
+	if err != nil {
+		t.Fatal("Error signing: ", err)
+	}
+
+	certFile := filepath.Join(dir, "dev1.pem")
+	err = ioutil.WriteFile(certFile, EncodeCert(der), 0644)
+	if err != nil {
+		t.Fatal("Error writing cert: ", err)
+	}
+
+	s, err := NewCommandSigner(`test "$SIOT_DEVICE_ID" = dev1 && cat `+certFile,
+		ca.CACert())
+	if err != nil {
+		t.Fatal("Error creating signer: ", err)
+	}
+
+	signed, err := s.Sign(csr, "dev1")
+	if err != nil || !bytes.Equal(signed, der) {
+		t.Error("Error signing with command: ", err)
+	}
+
+	_, err = s.Sign(csr, "dev2")
+	if err == nil {
+		t.Error("signed with failing command")
+	}
+
+	_, err = s.Sign(newCSR(t, "dev1"), "dev1")
+	if err == nil {
+		t.Error("accepted cert for another key")
+	}
+}
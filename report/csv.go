@@ -0,0 +1,52 @@
+package report
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// WriteCSV writes a report as CSV with a row for each point of each device
+// and day. The uptime and alerts of a device are repeated on each row of
+// the day, and days without samples have a row with blank point columns.
+func WriteCSV(w io.Writer, s *Summary) error {
+	cw := csv.NewWriter(w)
+
+	err := cw.Write([]string{"date", "device", "description", "uptime",
+		"alerts", "type", "id", "count", "min", "max", "avg"})
+	if err != nil {
+		return err
+	}
+
+	for _, d := range s.Devices {
+		for _, day := range d.Days {
+			row := []string{day.Date, d.ID, d.Description,
+				strconv.FormatFloat(day.Uptime, 'f', 2, 64),
+				strconv.Itoa(day.Alerts)}
+
+			if len(day.Points) <= 0 {
+				err := cw.Write(append(row, "", "", "0", "", "", ""))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			for _, p := range day.Points {
+				err := cw.Write(append(row[:5:5], p.Type, p.ID,
+					strconv.Itoa(p.Count), formatFloat(p.Min),
+					formatFloat(p.Max), formatFloat(p.Avg)))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,152 @@
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// PDF page layout, in points. Pages are US letter, and text is 8 point
+// Courier, so columns line up without font metrics.
+const (
+	pdfWidth        = 612
+	pdfHeight       = 792
+	pdfMargin       = 36
+	pdfLeading      = 10
+	pdfLinesPerPage = (pdfHeight - 2*pdfMargin) / pdfLeading
+)
+
+// pdfEscape escapes a PDF string. Characters the standard fonts can't show
+// without an encoding are replaced with ?.
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func pdfValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', 6, 64)
+}
+
+// pdfLines returns the lines of text of a report
+func pdfLines(s *Summary) []string {
+	ret := []string{s.Title(), ""}
+
+	if s.Report.Group != "" {
+		ret = append(ret, "Group: "+s.Report.Group)
+	}
+	ret = append(ret, fmt.Sprintf("Period: %v to %v", s.Start.Format("2006-01-02 15:04 MST"),
+		s.End.Format("2006-01-02 15:04 MST")), "")
+
+	header := fmt.Sprintf("%-10s %7s %6s  %-24s %7s %11s %11s %11s", "Date",
+		"Uptime", "Alerts", "Point", "Count", "Min", "Max", "Avg")
+
+	for _, d := range s.Devices {
+		name := "Device: " + d.ID
+		if d.Description != "" {
+			name += " (" + d.Description + ")"
+		}
+		ret = append(ret, name, header)
+
+		for _, day := range d.Days {
+			prefix := fmt.Sprintf("%-10s %6.2f%% %6d", day.Date, day.Uptime,
+				day.Alerts)
+
+			if len(day.Points) <= 0 {
+				ret = append(ret, prefix+"  no samples")
+				continue
+			}
+
+			for i, p := range day.Points {
+				point := p.Type
+				if p.ID != "" {
+					point += " " + p.ID
+				}
+
+				if i > 0 {
+					prefix = strings.Repeat(" ", len(prefix))
+				}
+
+				ret = append(ret, fmt.Sprintf("%v  %-24.24s %7d %11s %11s %11s",
+					prefix, point, p.Count, pdfValue(p.Min), pdfValue(p.Max),
+					pdfValue(p.Avg)))
+			}
+		}
+
+		ret = append(ret, "")
+	}
+
+	return ret
+}
+
+// WritePDF writes a report as a PDF with a table of each device
+func WritePDF(w io.Writer, s *Summary) error {
+	lines := pdfLines(s)
+
+	var pages [][]string
+	for len(lines) > pdfLinesPerPage {
+		pages = append(pages, lines[:pdfLinesPerPage])
+		lines = lines[pdfLinesPerPage:]
+	}
+	pages = append(pages, lines)
+
+	var b bytes.Buffer
+	var offsets []int
+	obj := func(body string) {
+		offsets = append(offsets, b.Len())
+		fmt.Fprintf(&b, "%v 0 obj\n%v\nendobj\n", len(offsets), body)
+	}
+
+	b.WriteString("%PDF-1.4\n")
+
+	// objects 1 to 3 are the catalog, page tree, and font, and then each
+	// page has a page object and a content stream
+	var kids []string
+	for i := range pages {
+		kids = append(kids, fmt.Sprintf("%v 0 R", 4+2*i))
+	}
+
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%v] /Count %v >>",
+		strings.Join(kids, " "), len(pages)))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>")
+
+	for i, page := range pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %v %v] "+
+			"/Resources << /Font << /F1 3 0 R >> >> /Contents %v 0 R >>",
+			pdfWidth, pdfHeight, 5+2*i))
+
+		var c strings.Builder
+		fmt.Fprintf(&c, "BT\n/F1 8 Tf\n%v TL\n%v %v Td\n", pdfLeading, pdfMargin,
+			pdfHeight-pdfMargin)
+		for _, l := range page {
+			fmt.Fprintf(&c, "(%v) Tj T*\n", pdfEscape(l))
+		}
+		c.WriteString("ET")
+
+		obj(fmt.Sprintf("<< /Length %v >>\nstream\n%v\nendstream", c.Len(), c.String()))
+	}
+
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %v\n0000000000 65535 f \n", len(offsets)+1)
+	for _, o := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %v /Root 1 0 R >>\nstartxref\n%v\n%%%%EOF\n",
+		len(offsets)+1, xref)
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
@@ -0,0 +1,446 @@
+// Package report generates scheduled reports of device data, like a daily
+// summary for a utility or facilities customer. For each device in a group
+// and each day, a report has the min, max, and average of each point, the
+// uptime, and the number of alerts raised. Reports are written as CSV or
+// PDF, and are emailed, stored in the db for download, or both. Reports
+// are stored in the db and can be changed while the reporter is running.
+package report
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/notify"
+)
+
+// ErrNoMail is returned when a report has email addresses and email is
+// not configured
+var ErrNoMail = errors.New("email is not configured")
+
+// Config describes how reports are run
+type Config struct {
+	// Mail sends email with attachments, like notify.Email.Send. Reports
+	// with email addresses fail if it is nil.
+	Mail func(to []string, subject, body string, attachments ...notify.Attachment) error
+	// Interval is how often report schedules are checked (default 1m)
+	Interval time.Duration
+}
+
+// Reporter runs reports on their schedules
+type Reporter struct {
+	db     *db.Db
+	config Config
+	// next is when each report runs next, and schedules are the schedules
+	// next was computed for, so changed schedules are noticed
+	next      map[uint64]time.Time
+	schedules map[uint64]string
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewReporter creates a reporter. Start starts running reports.
+func NewReporter(dbInst *db.Db, config Config) *Reporter {
+	if config.Interval == 0 {
+		config.Interval = time.Minute
+	}
+
+	return &Reporter{
+		db:        dbInst,
+		config:    config,
+		next:      make(map[uint64]time.Time),
+		schedules: make(map[uint64]string),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start runs reports until Stop is called
+func (r *Reporter) Start() {
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(r.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			err := r.Check(time.Now())
+			if err != nil {
+				log.Println("Error checking reports: ", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops running reports
+func (r *Reporter) Stop() {
+	close(r.stop)
+	<-r.done
+}
+
+// Check runs the reports that are due at now. A report that was due while
+// the reporter was not running runs once when it starts.
+func (r *Reporter) Check(now time.Time) error {
+	reports, err := r.db.Reports()
+	if err != nil {
+		return err
+	}
+
+	for _, rep := range reports {
+		if rep.Disabled {
+			delete(r.next, rep.ID)
+			continue
+		}
+
+		loc := rep.Location()
+		schedule := rep.Cron + "/" + rep.Timezone
+		next, ok := r.next[rep.ID]
+		if !ok || r.schedules[rep.ID] != schedule {
+			from := now
+			if !rep.LastRun.IsZero() {
+				from = rep.LastRun
+			}
+			next = rep.CronValue().Next(from, loc)
+			r.next[rep.ID] = next
+			r.schedules[rep.ID] = schedule
+		}
+
+		if next.IsZero() || now.Before(next) {
+			continue
+		}
+
+		_, err := r.run(rep, now)
+		if err != nil {
+			log.Printf("Error running report %v: %v\n", rep.ID, err)
+		}
+
+		r.next[rep.ID] = rep.CronValue().Next(now, loc)
+	}
+
+	return nil
+}
+
+// Run runs a report now, and returns the stored file if the report is
+// stored
+func (r *Reporter) Run(id uint64) (*data.ReportFile, error) {
+	rep, err := r.db.Report(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.run(rep, time.Now())
+}
+
+// run generates and delivers a report, and records the run
+func (r *Reporter) run(rep data.Report, now time.Time) (*data.ReportFile, error) {
+	f, err := r.deliver(rep, now)
+
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+
+	setErr := r.db.ReportSetRun(rep.ID, now, msg)
+	if err == nil {
+		err = setErr
+	}
+
+	return f, err
+}
+
+func (r *Reporter) deliver(rep data.Report, now time.Time) (*data.ReportFile, error) {
+	if len(rep.Email) > 0 && r.config.Mail == nil {
+		return nil, ErrNoMail
+	}
+
+	s, err := Generate(r.db, rep, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	contentType := "text/csv"
+	if rep.FormatValue() == data.ReportPDF {
+		contentType = "application/pdf"
+		err = WritePDF(&buf, s)
+	} else {
+		err = WriteCSV(&buf, s)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	name := s.FileName()
+
+	var ret *data.ReportFile
+	if rep.Store {
+		f, err := r.db.ReportFileAdd(data.ReportFile{
+			ReportID: rep.ID,
+			Name:     name,
+			Format:   rep.FormatValue(),
+			Start:    s.Start,
+			End:      s.End,
+			Created:  now,
+		}, buf.Bytes(), rep.KeepValue())
+		if err != nil {
+			return nil, err
+		}
+		ret = &f
+	}
+
+	if len(rep.Email) > 0 {
+		err := r.config.Mail(rep.Email, s.Title(), s.Text(),
+			notify.Attachment{Name: name, ContentType: contentType, Data: buf.Bytes()})
+		if err != nil {
+			return ret, err
+		}
+	}
+
+	return ret, nil
+}
+
+// Point is the summary of a point of a device for a day
+type Point struct {
+	Type  string  `json:"type"`
+	ID    string  `json:"id,omitempty"`
+	Count int     `json:"count"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+}
+
+// Day is the summary of a device for a day
+type Day struct {
+	// Date is the day, like 2020-01-02
+	Date string `json:"date"`
+	// Uptime is the percent of the day the device was sending samples
+	Uptime float64 `json:"uptime"`
+	// Alerts is the number of alerts raised for the device
+	Alerts int     `json:"alerts"`
+	Points []Point `json:"points"`
+}
+
+// Device is the summary of a device
+type Device struct {
+	ID          string `json:"id"`
+	Description string `json:"description,omitempty"`
+	Days        []Day  `json:"days"`
+}
+
+// Summary is a generated report
+type Summary struct {
+	Report data.Report `json:"report"`
+	// Start and End are the times the report covers
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Devices []Device  `json:"devices"`
+}
+
+// Title returns the title of the report, which is the email subject
+func (s *Summary) Title() string {
+	name := s.Report.Description
+	if name == "" {
+		name = fmt.Sprintf("Report %v", s.Report.ID)
+	}
+
+	last := s.End.AddDate(0, 0, -1)
+	if s.Report.DaysValue() == 1 {
+		return fmt.Sprintf("%v: %v", name, last.Format("2006-01-02"))
+	}
+
+	return fmt.Sprintf("%v: %v to %v", name, s.Start.Format("2006-01-02"),
+		last.Format("2006-01-02"))
+}
+
+// FileName returns the file name of the report, like
+// report-3-2020-01-02.csv
+func (s *Summary) FileName() string {
+	return fmt.Sprintf("report-%v-%v.%v", s.Report.ID,
+		s.End.AddDate(0, 0, -1).Format("2006-01-02"), s.Report.FormatValue())
+}
+
+// Text returns a short text summary, which is the email body
+func (s *Summary) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v\n\n", s.Title())
+
+	if s.Report.Group != "" {
+		fmt.Fprintf(&b, "Group: %v\n", s.Report.Group)
+	}
+	fmt.Fprintf(&b, "Devices: %v\n", len(s.Devices))
+
+	alerts := 0
+	for _, d := range s.Devices {
+		for _, day := range d.Days {
+			alerts += day.Alerts
+		}
+	}
+	fmt.Fprintf(&b, "Alerts: %v\n\nThe full report is attached.\n", alerts)
+
+	return b.String()
+}
+
+// Period returns the start and end of the days a report covers when it
+// runs at now. The report ends at the start of the day of now.
+func Period(rep data.Report, now time.Time) (time.Time, time.Time) {
+	t := now.In(rep.Location())
+	end := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return end.AddDate(0, 0, -rep.DaysValue()), end
+}
+
+// Generate generates the summary of a report that runs at now from the
+// sample history and alerts in the db
+func Generate(dbInst *db.Db, rep data.Report, now time.Time) (*Summary, error) {
+	start, end := Period(rep, now)
+	ret := &Summary{Report: rep, Start: start, End: end}
+
+	devices, err := dbInst.Devices()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+
+	alerts, err := dbInst.Alerts("")
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := rep.OfflineTimeoutValue()
+
+	for _, dev := range devices {
+		if rep.Group != "" && !inGroup(dev, rep.Group) {
+			continue
+		}
+
+		// samples before the start show if the device was up at the start
+		samples, err := dbInst.SampleHistory(dev.ID, start.Add(-timeout), end,
+			db.ResolutionRaw)
+		if err != nil {
+			return nil, err
+		}
+
+		d := Device{ID: dev.ID, Description: dev.Config.Description}
+
+		for dayStart := start; dayStart.Before(end); dayStart = dayStart.AddDate(0, 0, 1) {
+			dayEnd := dayStart.AddDate(0, 0, 1)
+			day := Day{
+				Date:   dayStart.Format("2006-01-02"),
+				Uptime: uptime(samples, dayStart, dayEnd, timeout),
+				Points: points(samples, dayStart, dayEnd),
+			}
+
+			for _, a := range alerts {
+				if a.DeviceID == dev.ID && !a.Raised.Before(dayStart) &&
+					a.Raised.Before(dayEnd) {
+					day.Alerts++
+				}
+			}
+
+			d.Days = append(d.Days, day)
+		}
+
+		ret.Devices = append(ret.Devices, d)
+	}
+
+	return ret, nil
+}
+
+func inGroup(dev data.Device, group string) bool {
+	for _, g := range dev.Groups() {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// points returns the min, max, and average of each point between start and
+// end, sorted by type and ID
+func points(samples []data.Sample, start, end time.Time) []Point {
+	index := make(map[string]int)
+	var ret []Point
+
+	for _, s := range samples {
+		if s.Time.Before(start) || !s.Time.Before(end) {
+			continue
+		}
+
+		key := s.Type + "/" + s.ID
+		i, ok := index[key]
+		if !ok {
+			i = len(ret)
+			index[key] = i
+			ret = append(ret, Point{Type: s.Type, ID: s.ID, Min: s.Value,
+				Max: s.Value})
+		}
+
+		p := &ret[i]
+		if s.Value < p.Min {
+			p.Min = s.Value
+		}
+		if s.Value > p.Max {
+			p.Max = s.Value
+		}
+		// Avg is the sum until the end
+		p.Avg += s.Value
+		p.Count++
+	}
+
+	for i := range ret {
+		ret[i].Avg /= float64(ret[i].Count)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Type != ret[j].Type {
+			return ret[i].Type < ret[j].Type
+		}
+		return ret[i].ID < ret[j].ID
+	})
+
+	return ret
+}
+
+// uptime returns the percent of the time between start and end the device
+// was up. A device is up for timeout after each sample. samples must be
+// sorted by time.
+func uptime(samples []data.Sample, start, end time.Time, timeout time.Duration) float64 {
+	var up time.Duration
+	// upTo is the end of the up time counted so far
+	upTo := start
+
+	for _, s := range samples {
+		if !s.Time.Before(end) {
+			break
+		}
+
+		from := s.Time
+		if from.Before(upTo) {
+			from = upTo
+		}
+
+		to := s.Time.Add(timeout)
+		if to.After(end) {
+			to = end
+		}
+
+		if to.After(from) {
+			up += to.Sub(from)
+			upTo = to
+		}
+	}
+
+	return 100 * float64(up) / float64(end.Sub(start))
+}
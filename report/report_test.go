@@ -0,0 +1,282 @@
+package report
+
+import (
+	"bytes"
+	"encoding/csv"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/db/dbtest"
+	"github.com/simpleiot/simpleiot/notify"
+)
+
+// day is the day the test reports cover
+var day = time.Date(2020, 3, 10, 0, 0, 0, 0, time.UTC)
+
+// addTestData adds a device in the plant group that sent samples from midnight
+// to 6:00 on day, and a device in another group
+func addTestData(t *testing.T, dbInst *db.Db) {
+	// a sample every 10 minutes, and the first is before the day
+	for m := -5; m < 6*60; m += 10 {
+		tm := day.Add(time.Duration(m) * time.Minute)
+		err := dbInst.DeviceSample("pump1", data.Sample{Type: "temp",
+			Value: float64(20 + m%3), Time: tm})
+		if err != nil {
+			t.Fatal("Error writing sample: ", err)
+		}
+	}
+
+	err := dbInst.DeviceSample("pump1", data.Sample{Type: "flow", ID: "in",
+		Value: 4, Time: day.Add(time.Hour)})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	// devices are created by their first sample
+	err = dbInst.DeviceSample("pump2", data.Sample{Type: "temp", Value: 20,
+		Time: day.Add(-48 * time.Hour)})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	for _, c := range []struct {
+		id, group string
+	}{{"pump1", "plant"}, {"pump2", "office"}} {
+		err := dbInst.DeviceUpdateConfig(c.id, data.DeviceConfig{
+			Description: c.id + " desc", Groups: []string{c.group}})
+		if err != nil {
+			t.Fatal("Error updating config: ", err)
+		}
+	}
+
+	for _, raised := range []time.Time{day.Add(time.Hour), day.Add(-time.Hour)} {
+		_, err = dbInst.AlertRaise(data.Alert{RuleID: 1, DeviceID: "pump1",
+			Message: "pump hot", Raised: raised})
+		if err != nil {
+			t.Fatal("Error raising alert: ", err)
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	addTestData(t, dbInst)
+
+	s, err := Generate(dbInst, data.Report{ID: 3, Group: "plant",
+		Description: "Plant"}, day.Add(25*time.Hour))
+	if err != nil {
+		t.Fatal("Error generating report: ", err)
+	}
+
+	if !s.Start.Equal(day) || !s.End.Equal(day.AddDate(0, 0, 1)) {
+		t.Error("Wrong period: ", s.Start, s.End)
+	}
+
+	if len(s.Devices) != 1 || s.Devices[0].ID != "pump1" || len(s.Devices[0].Days) != 1 {
+		t.Fatalf("Wrong devices: %+v", s.Devices)
+	}
+
+	d := s.Devices[0].Days[0]
+
+	// up from midnight to 6:10, 15 minutes after the last sample
+	if math.Abs(d.Uptime-100*(6*60+10)/(24*60.0)) > 0.01 {
+		t.Error("Wrong uptime: ", d.Uptime)
+	}
+
+	if d.Alerts != 1 {
+		t.Error("Wrong alerts: ", d.Alerts)
+	}
+
+	if len(d.Points) != 2 {
+		t.Fatalf("Wrong points: %+v", d.Points)
+	}
+
+	flow, temp := d.Points[0], d.Points[1]
+	if flow.Type != "flow" || flow.ID != "in" || flow.Count != 1 || flow.Avg != 4 {
+		t.Errorf("Wrong flow: %+v", flow)
+	}
+
+	// the sample before the day is not counted
+	if temp.Type != "temp" || temp.Count != 36 || temp.Min != 20 || temp.Max != 22 {
+		t.Errorf("Wrong temp: %+v", temp)
+	}
+
+	if s.Title() != "Plant: 2020-03-10" || s.FileName() != "report-3-2020-03-10.csv" {
+		t.Error("Wrong title or file name: ", s.Title(), s.FileName())
+	}
+
+	// days in the report time zone
+	s, err = Generate(dbInst, data.Report{Timezone: "America/Chicago", Days: 2},
+		day.Add(25*time.Hour))
+	if err != nil {
+		t.Fatal("Error generating report: ", err)
+	}
+
+	if len(s.Devices) != 2 || len(s.Devices[0].Days) != 2 ||
+		s.Devices[0].Days[0].Date != "2020-03-08" ||
+		s.Start.UTC() != time.Date(2020, 3, 8, 6, 0, 0, 0, time.UTC) {
+		t.Errorf("Wrong report in time zone: %v %+v", s.Start.UTC(), s.Devices)
+	}
+}
+
+func TestFormats(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	addTestData(t, dbInst)
+
+	s, err := Generate(dbInst, data.Report{Description: "All"}, day.Add(25*time.Hour))
+	if err != nil {
+		t.Fatal("Error generating report: ", err)
+	}
+
+	var buf bytes.Buffer
+	err = WriteCSV(&buf, s)
+	if err != nil {
+		t.Fatal("Error writing CSV: ", err)
+	}
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal("Error reading CSV: ", err)
+	}
+
+	// header, 2 points of pump1, and pump2 without samples
+	if len(rows) != 4 {
+		t.Fatal("Wrong rows: ", rows)
+	}
+
+	if strings.Join(rows[1], ",") != "2020-03-10,pump1,pump1 desc,25.69,1,flow,in,1,4,4,4" ||
+		strings.Join(rows[3], ",") != "2020-03-10,pump2,pump2 desc,0.00,0,,,0,,," {
+		t.Error("Wrong rows: ", rows)
+	}
+
+	buf.Reset()
+	err = WritePDF(&buf, s)
+	if err != nil {
+		t.Fatal("Error writing PDF: ", err)
+	}
+
+	pdf := buf.String()
+	if !strings.HasPrefix(pdf, "%PDF-1.4\n") || !strings.HasSuffix(pdf, "%%EOF\n") ||
+		!strings.Contains(pdf, "(Device: pump1 \\(pump1 desc\\)) Tj") ||
+		!strings.Contains(pdf, "/Count 1") {
+		t.Error("Wrong PDF: ", pdf)
+	}
+
+	// long reports have several pages
+	for i := 0; i < 5; i++ {
+		s.Devices = append(s.Devices, s.Devices...)
+	}
+
+	buf.Reset()
+	WritePDF(&buf, s)
+	if strings.Contains(buf.String(), "/Count 1 ") {
+		t.Error("Long report has one page")
+	}
+}
+
+func TestReporter(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	addTestData(t, dbInst)
+
+	type mail struct {
+		to          []string
+		subject     string
+		attachments []notify.Attachment
+	}
+	mails := make(chan mail, 10)
+
+	rep, err := dbInst.ReportInsert(data.Report{Description: "Plant",
+		Group: "plant", Cron: "0 6 * * *", Format: data.ReportPDF,
+		Email: []string{"plant@example.com"}, Store: true, Keep: 2})
+	if err != nil {
+		t.Fatal("Error inserting report: ", err)
+	}
+
+	r := NewReporter(dbInst, Config{
+		Mail: func(to []string, subject, body string, a ...notify.Attachment) error {
+			mails <- mail{to, subject, a}
+			return nil
+		},
+	})
+
+	// not due yet
+	start := day.Add(25 * time.Hour)
+	err = r.Check(start)
+	if err != nil {
+		t.Fatal("Error checking reports: ", err)
+	}
+
+	if len(mails) != 0 {
+		t.Fatal("Report ran before it was due")
+	}
+
+	for i := 0; i < 3; i++ {
+		err = r.Check(start.Add(5*time.Hour + time.Duration(i)*24*time.Hour))
+		if err != nil {
+			t.Fatal("Error checking reports: ", err)
+		}
+	}
+
+	if len(mails) != 3 {
+		t.Fatal("Wrong number of mails: ", len(mails))
+	}
+
+	m := <-mails
+	if m.to[0] != "plant@example.com" || m.subject != "Plant: 2020-03-10" ||
+		len(m.attachments) != 1 || m.attachments[0].ContentType != "application/pdf" ||
+		m.attachments[0].Name != "report-1-2020-03-10.pdf" {
+		t.Errorf("Wrong mail: %+v", m)
+	}
+
+	files, err := dbInst.ReportFiles(rep.ID)
+	if err != nil {
+		t.Fatal("Error reading files: ", err)
+	}
+
+	// only the last 2 are kept
+	if len(files) != 2 || files[0].Name != "report-1-2020-03-12.pdf" {
+		t.Fatalf("Wrong files: %+v", files)
+	}
+
+	b, err := dbInst.ReportFileData(files[1].ID)
+	if err != nil || files[1].Size != len(b) || !bytes.HasPrefix(b, []byte("%PDF")) {
+		t.Error("Wrong file data: ", err, len(b))
+	}
+
+	rep, _ = dbInst.Report(rep.ID)
+	if rep.LastRun.IsZero() || rep.Error != "" {
+		t.Errorf("Wrong last run: %+v", rep)
+	}
+
+	// errors are recorded
+	r = NewReporter(dbInst, Config{})
+	_, err = r.Run(rep.ID)
+	if err != ErrNoMail {
+		t.Error("Expected no mail error: ", err)
+	}
+
+	rep, _ = dbInst.Report(rep.ID)
+	if rep.Error != ErrNoMail.Error() {
+		t.Error("Error was not recorded: ", rep.Error)
+	}
+
+	err = dbInst.ReportDelete(rep.ID)
+	if err != nil {
+		t.Fatal("Error deleting report: ", err)
+	}
+
+	files, _ = dbInst.ReportFiles(rep.ID)
+	if len(files) != 0 {
+		t.Error("Files were not deleted")
+	}
+}
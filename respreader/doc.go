@@ -77,6 +77,16 @@ Example using a serial port:
 	port.Close()
 
 
+For devices that pause in the middle of a response, like modems that send
+unsolicited result codes between lines, a response can instead end on a
+delimiter or after a fixed number of bytes:
+
+	port = respreader.NewResponseReadWriteCloser(port, time.Second,
+	time.Millisecond * 50, respreader.Delimiter([]byte("\r\nOK\r\n")))
+
+ReadContext can be used instead of Read to cancel a read in progress, and
+Close makes a read in progress return io.EOF.
+
 Three types are provided for convenience that wrap io.Reader, io.ReadWriter, and io.ReadWriteCloser.
 */
 package respreader
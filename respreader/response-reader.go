@@ -1,14 +1,39 @@
 package respreader
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"io"
+	"sync"
 	"time"
 )
 
 // ErrorTimeout indicates the reader timed out
 var ErrorTimeout = errors.New("timeout")
 
+// Option sets how a ResponseReader frames responses. By default, a response
+// ends when no data is received for chunkTimeout.
+type Option func(*ResponseReader)
+
+// Delimiter ends a response after delim, like "\r\nOK\r\n" for modems or
+// "\r\n" for Modbus ASCII. Gaps in the response are ignored, so devices
+// that pause in the middle of a response are supported. Data after delim
+// is returned by the next Read.
+func Delimiter(delim []byte) Option {
+	return func(rr *ResponseReader) {
+		rr.delimiter = append([]byte{}, delim...)
+	}
+}
+
+// Length ends a response after n bytes. Gaps in the response are ignored.
+// Data after n bytes is returned by the next Read.
+func Length(n int) Option {
+	return func(rr *ResponseReader) {
+		rr.length = n
+	}
+}
+
 // ResponseReadWriteCloser is a convenience type that implements io.ReadWriteCloser.
 // Write calls flush reader before writing the prompt.
 type ResponseReadWriteCloser struct {
@@ -25,11 +50,11 @@ type ResponseReadWriteCloser struct {
 // chunkTimeout is used to specify the max timeout between chunks of data once
 // the response is started. If a delay of chunkTimeout is encountered, the response
 // is considered finished and the Read returns.
-func NewResponseReadWriteCloser(iorw io.ReadWriteCloser, timeout time.Duration, chunkTimeout time.Duration) *ResponseReadWriteCloser {
+func NewResponseReadWriteCloser(iorw io.ReadWriteCloser, timeout time.Duration, chunkTimeout time.Duration, opts ...Option) *ResponseReadWriteCloser {
 	return &ResponseReadWriteCloser{
 		closer: iorw,
 		writer: iorw,
-		reader: NewResponseReader(iorw, timeout, chunkTimeout),
+		reader: NewResponseReader(iorw, timeout, chunkTimeout, opts...),
 	}
 }
 
@@ -38,6 +63,12 @@ func (rrwc *ResponseReadWriteCloser) Read(buffer []byte) (int, error) {
 	return rrwc.reader.Read(buffer)
 }
 
+// ReadContext reads a response like Read, and returns early with the
+// context error if ctx is done
+func (rrwc *ResponseReadWriteCloser) ReadContext(ctx context.Context, buffer []byte) (int, error) {
+	return rrwc.reader.ReadContext(ctx, buffer)
+}
+
 // Write flushes all data from reader, and then passes through write call.
 func (rrwc *ResponseReadWriteCloser) Write(buffer []byte) (int, error) {
 	n, err := rrwc.reader.Flush()
@@ -48,9 +79,9 @@ func (rrwc *ResponseReadWriteCloser) Write(buffer []byte) (int, error) {
 	return rrwc.writer.Write(buffer)
 }
 
-// Close is a passthrough call.
+// Close closes the underlying port. A Read in progress returns io.EOF.
 func (rrwc *ResponseReadWriteCloser) Close() error {
-	rrwc.reader.closed = true
+	rrwc.reader.close()
 	return rrwc.closer.Close()
 }
 
@@ -69,10 +100,10 @@ type ResponseReadCloser struct {
 // chunkTimeout is used to specify the max timeout between chunks of data once
 // the response is started. If a delay of chunkTimeout is encountered, the response
 // is considered finished and the Read returns.
-func NewResponseReadCloser(iorw io.ReadCloser, timeout time.Duration, chunkTimeout time.Duration) *ResponseReadCloser {
+func NewResponseReadCloser(iorw io.ReadCloser, timeout time.Duration, chunkTimeout time.Duration, opts ...Option) *ResponseReadCloser {
 	return &ResponseReadCloser{
 		closer: iorw,
-		reader: NewResponseReader(iorw, timeout, chunkTimeout),
+		reader: NewResponseReader(iorw, timeout, chunkTimeout, opts...),
 	}
 }
 
@@ -81,9 +112,15 @@ func (rrwc *ResponseReadCloser) Read(buffer []byte) (int, error) {
 	return rrwc.reader.Read(buffer)
 }
 
-// Close is a passthrough call.
+// ReadContext reads a response like Read, and returns early with the
+// context error if ctx is done
+func (rrwc *ResponseReadCloser) ReadContext(ctx context.Context, buffer []byte) (int, error) {
+	return rrwc.reader.ReadContext(ctx, buffer)
+}
+
+// Close closes the underlying port. A Read in progress returns io.EOF.
 func (rrwc *ResponseReadCloser) Close() error {
-	rrwc.reader.closed = true
+	rrwc.reader.close()
 	return rrwc.closer.Close()
 }
 
@@ -95,10 +132,10 @@ type ResponseReadWriter struct {
 }
 
 // NewResponseReadWriter creates a new response reader
-func NewResponseReadWriter(iorw io.ReadWriter, timeout time.Duration, chunkTimeout time.Duration) *ResponseReadWriter {
+func NewResponseReadWriter(iorw io.ReadWriter, timeout time.Duration, chunkTimeout time.Duration, opts ...Option) *ResponseReadWriter {
 	return &ResponseReadWriter{
 		writer: iorw,
-		reader: NewResponseReader(iorw, timeout, chunkTimeout),
+		reader: NewResponseReader(iorw, timeout, chunkTimeout, opts...),
 	}
 }
 
@@ -107,6 +144,12 @@ func (rrw *ResponseReadWriter) Read(buffer []byte) (int, error) {
 	return rrw.reader.Read(buffer)
 }
 
+// ReadContext reads a response like Read, and returns early with the
+// context error if ctx is done
+func (rrw *ResponseReadWriter) ReadContext(ctx context.Context, buffer []byte) (int, error) {
+	return rrw.reader.ReadContext(ctx, buffer)
+}
+
 // Write flushes all data from reader, and then passes through write call.
 func (rrw *ResponseReadWriter) Write(buffer []byte) (int, error) {
 	n, err := rrw.reader.Flush()
@@ -128,9 +171,14 @@ type ResponseReader struct {
 	reader       io.Reader
 	timeout      time.Duration
 	chunkTimeout time.Duration
+	delimiter    []byte
+	length       int
 	size         int
 	dataChan     chan []byte
-	closed       bool
+	// pending is data received after the end of the last response
+	pending   []byte
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // NewResponseReader creates a new response reader.
@@ -140,15 +188,22 @@ type ResponseReader struct {
 //
 // chunkTimeout is used to specify the max timeout between chunks of data once
 // the response is started. If a delay of chunkTimeout is encountered, the response
-// is considered finished and the Read returns.
-func NewResponseReader(reader io.Reader, timeout time.Duration, chunkTimeout time.Duration) *ResponseReader {
+// is considered finished and the Read returns. chunkTimeout is not used
+// if the Delimiter or Length options are given.
+func NewResponseReader(reader io.Reader, timeout time.Duration, chunkTimeout time.Duration, opts ...Option) *ResponseReader {
 	rr := ResponseReader{
 		reader:       reader,
 		timeout:      timeout,
 		chunkTimeout: chunkTimeout,
 		size:         128,
 		dataChan:     make(chan []byte),
+		done:         make(chan struct{}),
 	}
+
+	for _, o := range opts {
+		o(&rr)
+	}
+
 	// we have to start a reader goroutine here that lives for the life
 	// of the reader because there is no
 	// way to stop a blocked goroutine
@@ -158,43 +213,109 @@ func NewResponseReader(reader io.Reader, timeout time.Duration, chunkTimeout tim
 
 // Read response
 func (rr *ResponseReader) Read(buffer []byte) (int, error) {
+	return rr.ReadContext(context.Background(), buffer)
+}
+
+// ReadContext reads a response like Read, and returns early with the
+// context error if ctx is done. Data received before ctx is done is
+// returned with the error.
+func (rr *ResponseReader) ReadContext(ctx context.Context, buffer []byte) (int, error) {
 	if len(buffer) <= 0 {
 		return 0, errors.New("must supply non-zero length buffer")
 	}
 
+	if rr.length > len(buffer) {
+		return 0, io.ErrShortBuffer
+	}
+
 	timeout := time.NewTimer(rr.timeout)
-	count := 0
+	defer timeout.Stop()
+
+	data := rr.pending
+	rr.pending = nil
+
+	// ret returns the first n bytes of data, and keeps the rest for the
+	// next Read
+	ret := func(n int, err error) (int, error) {
+		n = copy(buffer, data[:n])
+		rr.pending = append(rr.pending, data[n:]...)
+		return n, err
+	}
 
 	for {
+		if n := rr.frame(data); n > 0 {
+			return ret(n, nil)
+		}
+
+		if len(data) >= len(buffer) {
+			// a full buffer ends the response
+			return ret(len(buffer), nil)
+		}
+
 		select {
 		case newData, ok := <-rr.dataChan:
-			// copy data from chan buffer to Read() buf
-			for i := 0; count < len(buffer) && i < len(newData); i++ {
-				buffer[count] = newData[i]
-				count++
-			}
+			data = append(data, newData...)
 
 			if !ok {
-				return count, io.EOF
+				return ret(len(data), io.EOF)
 			}
 
-			timeout.Reset(rr.chunkTimeout)
+			if rr.delimiter == nil && rr.length == 0 {
+				resetTimer(timeout, rr.chunkTimeout)
+			}
 
 		case <-timeout.C:
-			if count > 0 {
-				return count, nil
+			if len(data) > 0 && rr.delimiter == nil && rr.length == 0 {
+				return ret(len(data), nil)
 			}
 
-			return count, ErrorTimeout
+			// a partial response is returned with the error
+			return ret(len(data), ErrorTimeout)
+
+		case <-ctx.Done():
+			return ret(len(data), ctx.Err())
+
+		case <-rr.done:
+			return ret(len(data), io.EOF)
+		}
+	}
+}
 
+// resetTimer resets a timer that may have fired, so a stale time in its
+// channel does not end the next wait early
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
 		}
 	}
+	t.Reset(d)
+}
+
+// frame returns the length of the response at the start of data, or 0 if
+// the response is not complete
+func (rr *ResponseReader) frame(data []byte) int {
+	if rr.length > 0 && len(data) >= rr.length {
+		return rr.length
+	}
+
+	if len(rr.delimiter) > 0 {
+		if i := bytes.Index(data, rr.delimiter); i >= 0 {
+			return i + len(rr.delimiter)
+		}
+	}
+
+	return 0
 }
 
 // Flush is used to flush any input data
 func (rr *ResponseReader) Flush() (int, error) {
 	timeout := time.NewTimer(rr.chunkTimeout)
-	count := 0
+	defer timeout.Stop()
+
+	count := len(rr.pending)
+	rr.pending = nil
 
 	for {
 		select {
@@ -204,26 +325,44 @@ func (rr *ResponseReader) Flush() (int, error) {
 				return count, io.EOF
 			}
 
-			timeout.Reset(rr.chunkTimeout)
+			resetTimer(timeout, rr.chunkTimeout)
 
 		case <-timeout.C:
 			return count, nil
+
+		case <-rr.done:
+			return count, io.EOF
 		}
 	}
 }
 
+// close stops the reader goroutine once the underlying Read returns, and
+// makes Read return io.EOF
+func (rr *ResponseReader) close() {
+	rr.closeOnce.Do(func() {
+		close(rr.done)
+	})
+}
+
 // readInput is used by a goroutine to read data from the underlying io.Reader
 func (rr *ResponseReader) readInput() {
+	defer close(rr.dataChan)
+
 	for {
-		tmp := make([]byte, rr.size)
-		if rr.closed {
-			break
+		select {
+		case <-rr.done:
+			return
+		default:
 		}
+
+		tmp := make([]byte, rr.size)
 		length, _ := rr.reader.Read(tmp)
 		if length > 0 {
-			tmp = tmp[0:length]
-			rr.dataChan <- tmp
+			select {
+			case rr.dataChan <- tmp[0:length]:
+			case <-rr.done:
+				return
+			}
 		}
 	}
-	close(rr.dataChan)
 }
@@ -1,6 +1,7 @@
 package respreader
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -333,3 +334,123 @@ func TestResponseReaderWrite(t *testing.T) {
 		t.Error("write data is not correct")
 	}
 }
+
+// dataSourceChunks returns each chunk after a delay, and then blocks
+type dataSourceChunks struct {
+	chunks [][]byte
+	delay  time.Duration
+}
+
+func (ds *dataSourceChunks) Read(data []byte) (int, error) {
+	if len(ds.chunks) == 0 {
+		time.Sleep(1000 * time.Hour)
+	}
+
+	time.Sleep(ds.delay)
+	n := copy(data, ds.chunks[0])
+	ds.chunks = ds.chunks[1:]
+	return n, nil
+}
+
+func (ds *dataSourceChunks) Close() error {
+	return nil
+}
+
+func TestResponseReaderDelimiter(t *testing.T) {
+	// the modem pauses for longer than chunkTimeout in the response
+	source := &dataSourceChunks{
+		chunks: [][]byte{[]byte("\r\n+CSQ: 20,99"), []byte("\r\n\r\nOK\r\n+CREG")},
+		delay:  50 * time.Millisecond,
+	}
+	reader := NewResponseReader(source, time.Second, 10*time.Millisecond,
+		Delimiter([]byte("\r\nOK\r\n")))
+
+	data := make([]byte, 100)
+	count, err := reader.Read(data)
+	if err != nil {
+		t.Fatal("read failed: ", err)
+	}
+
+	if string(data[:count]) != "\r\n+CSQ: 20,99\r\n\r\nOK\r\n" {
+		t.Errorf("wrong response: %q", data[:count])
+	}
+
+	// the rest is returned with the timeout as the delimiter is missing
+	count, err = reader.Read(data)
+	if err != ErrorTimeout || string(data[:count]) != "+CREG" {
+		t.Errorf("wrong partial response %q: %v", data[:count], err)
+	}
+}
+
+func TestResponseReaderLength(t *testing.T) {
+	source := &dataSourceChunks{
+		chunks: [][]byte{{1, 2}, {3, 4, 5}},
+		delay:  50 * time.Millisecond,
+	}
+	reader := NewResponseReader(source, time.Second, 10*time.Millisecond,
+		Length(4))
+
+	data := make([]byte, 100)
+	count, err := reader.Read(data)
+	if err != nil {
+		t.Fatal("read failed: ", err)
+	}
+
+	if !reflect.DeepEqual(data[:count], []byte{1, 2, 3, 4}) {
+		t.Errorf("wrong response: %v", data[:count])
+	}
+
+	_, err = reader.Read(make([]byte, 3))
+	if err != io.ErrShortBuffer {
+		t.Error("expected short buffer error: ", err)
+	}
+}
+
+func TestResponseReaderContext(t *testing.T) {
+	reader := NewResponseReadCloser(&dataSourceChunks{}, time.Hour,
+		10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := reader.ReadContext(ctx, make([]byte, 10))
+	if err != context.DeadlineExceeded {
+		t.Error("expected deadline error: ", err)
+	}
+
+	// Close unblocks a read
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		reader.Close()
+	}()
+
+	start := time.Now()
+	_, err = reader.Read(make([]byte, 10))
+	if err != io.EOF {
+		t.Error("expected EOF: ", err)
+	}
+
+	if time.Since(start) > time.Second {
+		t.Error("read was not unblocked by close")
+	}
+}
+
+func TestResponseReaderChunkGaps(t *testing.T) {
+	// each gap is just under chunkTimeout, so the response is not split
+	var chunks [][]byte
+	for i := 0; i < 10; i++ {
+		chunks = append(chunks, []byte{byte(i)})
+	}
+	source := &dataSourceChunks{chunks: chunks, delay: 35 * time.Millisecond}
+	reader := NewResponseReader(source, time.Second, 50*time.Millisecond)
+
+	data := make([]byte, 100)
+	count, err := reader.Read(data)
+	if err != nil {
+		t.Fatal("read failed: ", err)
+	}
+
+	if count != 10 {
+		t.Errorf("response was split: %v", data[:count])
+	}
+}
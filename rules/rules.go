@@ -0,0 +1,582 @@
+// Package rules evaluates user defined rules against the sample stream and
+// runs their actions. A rule is active while all of its conditions are
+// true, and its actions run when it becomes active or inactive. Rules are
+// stored in the db and can be changed while the engine is running.
+//
+// Rules with notify actions raise an alert when they become active, which
+// is cleared when the rule is no longer active. Until the alert is
+// acknowledged, the notifications are repeated and escalated as the rule
+// describes.
+package rules
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/trace"
+)
+
+// Config describes how the engine runs actions
+type Config struct {
+	// Write stores samples for setState actions, typically
+	// api.WriteSamples or db.IngestQueue.Enqueue
+	Write func(id string, samples []data.Sample) error
+	// Notify sends notifications. Notifications are logged if it is nil.
+	Notify func(n data.Notification) error
+	// Interval is how often time based conditions like minimum durations,
+	// schedules, and offline devices are checked (default 10s)
+	Interval time.Duration
+	// Now returns the current time (default time.Now). Tests set it, and
+	// Tick, to a fake clock.
+	Now func() time.Time
+	// Tick replaces the Interval ticker if it is set. Rules are checked at
+	// the time received.
+	Tick <-chan time.Time
+}
+
+// conditionState tracks a condition between evaluations
+type conditionState struct {
+	// met is true if the condition was met the last time it was checked,
+	// and is used for hysteresis
+	met bool
+	// since is when the condition was first met
+	since time.Time
+}
+
+// track is the last location of a device, which the speed of the device is
+// calculated from
+type track struct {
+	loc   data.Location
+	time  time.Time
+	speed float64
+	// moved is true once the speed is known
+	moved bool
+}
+
+type ruleState struct {
+	rule       data.Rule
+	conditions []conditionState
+}
+
+// Engine evaluates rules
+type Engine struct {
+	db     *db.Db
+	config Config
+	lock   sync.Mutex
+	rules  map[uint64]*ruleState
+	tracks map[string]*track
+	events <-chan db.Event
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewEngine creates a rules engine. Start starts evaluating rules.
+func NewEngine(dbInst *db.Db, config Config) *Engine {
+	if config.Interval == 0 {
+		config.Interval = 10 * time.Second
+	}
+
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+
+	return &Engine{
+		db:     dbInst,
+		config: config,
+		rules:  make(map[uint64]*ruleState),
+		tracks: make(map[string]*track),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start loads the rules and evaluates them as samples are written
+func (e *Engine) Start() error {
+	e.events = e.db.Subscribe(db.EventFilter{
+		Types: []db.EventType{db.EventSampleWritten, db.EventRuleChanged},
+	})
+
+	err := e.load()
+	if err != nil {
+		e.db.Unsubscribe(e.events)
+		return err
+	}
+
+	go e.run()
+
+	return nil
+}
+
+// Stop stops evaluating rules
+func (e *Engine) Stop() {
+	close(e.stop)
+	<-e.done
+	e.db.Unsubscribe(e.events)
+}
+
+// load reads the rules from the db. The state of rules that did not change
+// is kept.
+func (e *Engine) load() error {
+	rules, err := e.db.Rules()
+	if err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	old := e.rules
+	e.rules = make(map[uint64]*ruleState)
+
+	for _, r := range rules {
+		if s, ok := old[r.ID]; ok && rulesEqual(s.rule, r) {
+			e.rules[r.ID] = s
+			continue
+		}
+
+		s := &ruleState{
+			rule:       r,
+			conditions: make([]conditionState, len(r.Conditions)),
+		}
+
+		// an active rule stays active after a restart if its conditions
+		// are still met
+		if r.Active {
+			for i := range s.conditions {
+				s.conditions[i] = conditionState{met: true, since: r.Changed}
+			}
+		}
+
+		e.rules[r.ID] = s
+	}
+
+	return nil
+}
+
+// rulesEqual compares the definitions of rules, ignoring their state
+func rulesEqual(a, b data.Rule) bool {
+	a.Active, a.Changed = false, time.Time{}
+	b.Active, b.Changed = false, time.Time{}
+	return reflect.DeepEqual(a, b)
+}
+
+func (e *Engine) run() {
+	defer close(e.done)
+
+	tick := e.config.Tick
+	if tick == nil {
+		ticker := time.NewTicker(e.config.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	e.evaluate("", e.config.Now())
+
+	for {
+		select {
+		case ev, ok := <-e.events:
+			if !ok {
+				return
+			}
+			e.handle(ev, e.config.Now())
+		case now := <-tick:
+			// changes from before the tick are handled first, so they
+			// are seen at the time of the tick
+			for pending := true; pending; {
+				select {
+				case ev, ok := <-e.events:
+					if !ok {
+						return
+					}
+					e.handle(ev, now)
+				default:
+					pending = false
+				}
+			}
+
+			e.evaluate("", now)
+			e.escalate(now)
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// handle evaluates the rules affected by a change event
+func (e *Engine) handle(ev db.Event, now time.Time) {
+	if ev.Type == db.EventRuleChanged {
+		err := e.load()
+		if err != nil {
+			log.Println("Error loading rules: ", err)
+		}
+		e.evaluate("", now)
+	} else {
+		e.evaluate(ev.DeviceID, now)
+	}
+}
+
+// uses returns true if a rule has a condition on a device
+func uses(r data.Rule, id string) bool {
+	for _, c := range r.Conditions {
+		if c.DeviceID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate checks the rules with conditions on a device, or all rules if
+// id is blank, and runs the actions of rules that change state
+func (e *Engine) evaluate(id string, now time.Time) {
+	_, span := trace.Start(context.Background(), "rules.evaluate",
+		trace.KindInternal, trace.Attr{Key: "device", Value: id})
+	defer span.End(nil)
+
+	e.lock.Lock()
+	var changed []data.Rule
+	for _, s := range e.rules {
+		if s.rule.Disabled || (id != "" && !uses(s.rule, id)) {
+			continue
+		}
+
+		active := true
+		for i, c := range s.rule.Conditions {
+			if !e.check(c, &s.conditions[i], now) {
+				active = false
+			}
+		}
+
+		if active != s.rule.Active {
+			s.rule.Active = active
+			s.rule.Changed = now
+			changed = append(changed, s.rule)
+		}
+	}
+	e.lock.Unlock()
+
+	span.SetAttr("changed", len(changed))
+
+	for _, r := range changed {
+		err := e.db.RuleSetState(r.ID, r.Active, r.Changed)
+		if err != nil {
+			log.Printf("Error saving state of rule %v: %v\n", r.ID, err)
+		}
+
+		var alertID uint64
+		if r.Active && r.Notifies() {
+			alert, err := e.db.AlertRaise(data.Alert{
+				RuleID:      r.ID,
+				Description: r.Description,
+				DeviceID:    deviceID(r),
+				Message:     message(r, r.Actions[notifyAction(r)]),
+				Raised:      r.Changed,
+			})
+			if err != nil {
+				log.Printf("Error raising alert of rule %v: %v\n", r.ID, err)
+			}
+			alertID = alert.ID
+		} else if !r.Active {
+			err := e.db.AlertClear(r.ID, r.Changed)
+			if err != nil {
+				log.Printf("Error clearing alerts of rule %v: %v\n", r.ID, err)
+			}
+		}
+
+		actions := r.Actions
+		if !r.Active {
+			actions = r.InactiveActions
+		}
+
+		for _, a := range actions {
+			err := e.runAction(r, a, alertID)
+			if err != nil {
+				log.Printf("Error running %v action of rule %v: %v\n", a.Type,
+					r.ID, err)
+			}
+		}
+	}
+}
+
+// check returns true if a condition is true, and has been for its minimum
+// duration
+func (e *Engine) check(c data.RuleCondition, s *conditionState, now time.Time) bool {
+	met := false
+
+	switch c.Type {
+	case data.RuleConditionValue:
+		sample, ok := e.db.LatestValue(c.DeviceID, c.SampleType, c.SampleID)
+		met = ok && c.Compare(sample.Value, s.met)
+	case data.RuleConditionSchedule:
+		loc := time.UTC
+		if c.Timezone != "" {
+			var err error
+			loc, err = time.LoadLocation(c.Timezone)
+			if err != nil {
+				return false
+			}
+		}
+		met = data.InMaintenance(c.Windows, now, loc)
+	case data.RuleConditionOffline:
+		met = now.Sub(e.lastSample(c.DeviceID)) > c.TimeoutValue()
+	case data.RuleConditionGeofence:
+		loc, _, ok := e.location(c.DeviceID, c.SampleID)
+		met = ok && c.Area.Contains(loc) == (c.Geofence == data.GeofenceInside)
+	case data.RuleConditionSpeed:
+		speed, ok := e.speed(c.DeviceID, c.SampleID)
+		met = ok && c.Compare(speed, s.met)
+	}
+
+	if !met {
+		*s = conditionState{}
+		return false
+	}
+
+	if !s.met {
+		s.met = true
+		s.since = now
+	}
+
+	return now.Sub(s.since) >= c.MinDurationValue()
+}
+
+// lastSample returns the time of the newest sample from a device
+func (e *Engine) lastSample(id string) time.Time {
+	var ret time.Time
+
+	samples, err := e.db.Latest(id)
+	if err != nil {
+		return ret
+	}
+
+	for _, s := range samples {
+		if s.Time.After(ret) {
+			ret = s.Time
+		}
+	}
+
+	return ret
+}
+
+// location returns the latest location of a device from its latitude and
+// longitude samples, and the time of the newest of them
+func (e *Engine) location(id, sampleID string) (data.Location, time.Time, bool) {
+	lat, ok := e.db.LatestValue(id, data.SampleTypeLatitude, sampleID)
+	if !ok {
+		return data.Location{}, time.Time{}, false
+	}
+
+	long, ok := e.db.LatestValue(id, data.SampleTypeLongitude, sampleID)
+	if !ok {
+		return data.Location{}, time.Time{}, false
+	}
+
+	t := lat.Time
+	if long.Time.After(t) {
+		t = long.Time
+	}
+
+	return data.Location{Lat: lat.Value, Long: long.Value}, t, true
+}
+
+// speed returns the speed of a device in km/h between its last two
+// locations. It is only known once the device has sent two locations.
+func (e *Engine) speed(id, sampleID string) (float64, bool) {
+	loc, t, ok := e.location(id, sampleID)
+	if !ok {
+		return 0, false
+	}
+
+	key := id + "/" + sampleID
+	tr, ok := e.tracks[key]
+	if !ok {
+		e.tracks[key] = &track{loc: loc, time: t}
+		return 0, false
+	}
+
+	if t.After(tr.time) {
+		tr.speed = data.Distance(tr.loc, loc) / t.Sub(tr.time).Seconds() * 3.6
+		tr.loc, tr.time, tr.moved = loc, t, true
+	}
+
+	return tr.speed, tr.moved
+}
+
+func (e *Engine) runAction(r data.Rule, a data.RuleAction, alertID uint64) error {
+	switch a.Type {
+	case data.RuleActionNotify:
+		return e.notify(r, a, alertID)
+	case data.RuleActionCommand:
+		_, err := e.db.CommandEnqueue(data.DeviceCommand{
+			DeviceID: a.DeviceID,
+			Command:  a.Command,
+			Args:     a.Args,
+		})
+		return err
+	case data.RuleActionOutput:
+		_, err := e.db.CommandEnqueue(data.DeviceCommand{
+			DeviceID: a.DeviceID,
+			Command:  data.RuleActionOutput,
+			Args: map[string]string{
+				"id":    a.SampleID,
+				"type":  a.SampleType,
+				"value": strconv.FormatFloat(a.Value, 'g', -1, 64),
+			},
+		})
+		return err
+	case data.RuleActionState:
+		return e.config.Write(a.DeviceID, []data.Sample{{
+			Type:  a.SampleType,
+			ID:    a.SampleID,
+			Value: a.Value,
+			Time:  e.config.Now(),
+		}})
+	}
+
+	return fmt.Errorf("unsupported rule action type: %v", a.Type)
+}
+
+// deviceID returns the device of the first condition with a device, which
+// notifications are about
+func deviceID(r data.Rule) string {
+	for _, c := range r.Conditions {
+		if c.DeviceID != "" {
+			return c.DeviceID
+		}
+	}
+	return ""
+}
+
+// notifyAction returns the index of the first notify action
+func notifyAction(r data.Rule) int {
+	for i, a := range r.Actions {
+		if a.Type == data.RuleActionNotify {
+			return i
+		}
+	}
+	return -1
+}
+
+// message returns the message of a notify action
+func message(r data.Rule, a data.RuleAction) string {
+	if a.Message != "" {
+		return a.Message
+	}
+
+	state := "cleared"
+	if r.Active {
+		state = "active"
+	}
+	return fmt.Sprintf("%v is %v", r.Description, state)
+}
+
+func (e *Engine) notify(r data.Rule, a data.RuleAction, alertID uint64) error {
+	return e.send(data.Notification{
+		RuleID:      r.ID,
+		AlertID:     alertID,
+		Description: r.Description,
+		DeviceID:    deviceID(r),
+		Message:     message(r, a),
+		Active:      r.Active,
+		Time:        r.Changed,
+		Channels:    a.Channels,
+	})
+}
+
+func (e *Engine) send(n data.Notification) error {
+	if e.config.Notify == nil {
+		log.Println("Rule notification: ", n.Message)
+		return nil
+	}
+
+	return e.config.Notify(n)
+}
+
+// escalate notifies active alerts again and sends their escalations when
+// they are due. Alerts of rules that were deleted are cleared.
+func (e *Engine) escalate(now time.Time) {
+	alerts, err := e.db.Alerts(data.AlertActive)
+	if err != nil {
+		log.Println("Error getting alerts: ", err)
+		return
+	}
+
+	for _, a := range alerts {
+		e.lock.Lock()
+		s, ok := e.rules[a.RuleID]
+		var r data.Rule
+		if ok {
+			r = s.rule
+		}
+		e.lock.Unlock()
+
+		if !ok {
+			err := e.db.AlertClear(a.RuleID, now)
+			if err != nil {
+				log.Printf("Error clearing alerts of rule %v: %v\n", a.RuleID, err)
+			}
+			continue
+		}
+
+		if !r.Active {
+			continue
+		}
+
+		level := a.Level
+		notified := a.Notified
+
+		for level < len(r.Escalations) &&
+			now.Sub(a.Raised) >= r.Escalations[level].AfterValue() {
+			esc := r.Escalations[level]
+			level++
+			notified = now
+
+			msg := esc.Message
+			if msg == "" {
+				msg = "Not acknowledged: " + a.Message
+			}
+
+			err := e.send(data.Notification{
+				RuleID:      r.ID,
+				AlertID:     a.ID,
+				Description: r.Description,
+				DeviceID:    a.DeviceID,
+				Message:     msg,
+				Active:      true,
+				Time:        now,
+				Channels:    esc.Channels,
+			})
+			if err != nil {
+				log.Printf("Error escalating alert %v: %v\n", a.ID, err)
+			}
+		}
+
+		if repeat := r.RepeatValue(); repeat > 0 && now.Sub(notified) >= repeat {
+			notified = now
+
+			for _, act := range r.Actions {
+				if act.Type != data.RuleActionNotify {
+					continue
+				}
+
+				err := e.notify(r, act, a.ID)
+				if err != nil {
+					log.Printf("Error repeating alert %v: %v\n", a.ID, err)
+				}
+			}
+		}
+
+		if level != a.Level || !notified.Equal(a.Notified) {
+			err := e.db.AlertNotified(a.ID, level, notified)
+			if err != nil {
+				log.Printf("Error saving alert %v: %v\n", a.ID, err)
+			}
+		}
+	}
+}
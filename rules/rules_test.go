@@ -0,0 +1,325 @@
+package rules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db/dbtest"
+)
+
+func TestCompare(t *testing.T) {
+	c := data.RuleCondition{Operator: ">", Value: 10, Hysteresis: 2}
+
+	for _, tc := range []struct {
+		v       float64
+		wasTrue bool
+		exp     bool
+	}{
+		{11, false, true},
+		{9, false, false},
+		{9, true, true},
+		{8, true, false},
+	} {
+		if c.Compare(tc.v, tc.wasTrue) != tc.exp {
+			t.Errorf("%v (was %v) should be %v", tc.v, tc.wasTrue, tc.exp)
+		}
+	}
+}
+
+func TestEngine(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	notifications := make(chan data.Notification, 10)
+
+	write := func(id string, samples []data.Sample) error {
+		for _, s := range samples {
+			err := dbInst.DeviceSample(id, s)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	e := NewEngine(dbInst, Config{
+		Write: write,
+		Notify: func(n data.Notification) error {
+			notifications <- n
+			return nil
+		},
+		Interval: 10 * time.Millisecond,
+	})
+
+	err := e.Start()
+	if err != nil {
+		t.Fatal("Error starting engine: ", err)
+	}
+	defer e.Stop()
+
+	rule, err := dbInst.RuleInsert(data.Rule{
+		Description: "tank high",
+		Conditions: []data.RuleCondition{{Type: data.RuleConditionValue,
+			DeviceID: "1234", SampleType: "level", Operator: ">", Value: 10,
+			Hysteresis: 2, MinDuration: "50ms"}},
+		// actions run in order, so the notification is last
+		Actions: []data.RuleAction{
+			{Type: data.RuleActionOutput, DeviceID: "1234", SampleType: "pump",
+				Value: 0},
+			{Type: data.RuleActionState, DeviceID: "1234", SampleType: "alarm",
+				Value: 1},
+			{Type: data.RuleActionNotify},
+		},
+		InactiveActions: []data.RuleAction{
+			{Type: data.RuleActionNotify, Message: "tank ok"},
+		},
+	})
+	if err != nil {
+		t.Fatal("Error inserting rule: ", err)
+	}
+
+	wait := func(exp bool) data.Notification {
+		select {
+		case n := <-notifications:
+			if n.Active != exp || n.RuleID != rule.ID || n.DeviceID != "1234" {
+				t.Fatalf("wrong notification: %+v", n)
+			}
+			return n
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for notification")
+		}
+		return data.Notification{}
+	}
+
+	start := time.Now()
+	write("1234", []data.Sample{{Type: "level", Value: 11}})
+
+	n := wait(true)
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("rule was active before the min duration")
+	}
+
+	if n.Message != "tank high is active" {
+		t.Error("wrong message: ", n.Message)
+	}
+
+	cmds, _ := dbInst.DeviceCommands("1234")
+	if len(cmds) != 1 || cmds[0].Command != "setOutput" ||
+		cmds[0].Args["type"] != "pump" || cmds[0].Args["value"] != "0" {
+		t.Errorf("wrong commands: %+v", cmds)
+	}
+
+	if s, ok := dbInst.LatestValue("1234", "alarm", ""); !ok || s.Value != 1 {
+		t.Error("state was not set")
+	}
+
+	stored, _ := dbInst.Rule(rule.ID)
+	if !stored.Active {
+		t.Error("rule state was not saved")
+	}
+
+	// within the hysteresis
+	write("1234", []data.Sample{{Type: "level", Value: 9}})
+	time.Sleep(50 * time.Millisecond)
+	if len(notifications) > 0 {
+		t.Fatal("rule cleared within hysteresis")
+	}
+
+	write("1234", []data.Sample{{Type: "level", Value: 7}})
+	if n := wait(false); n.Message != "tank ok" {
+		t.Error("wrong message: ", n.Message)
+	}
+}
+
+func TestOffline(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	err := dbInst.DeviceSample("1234", data.Sample{Type: "temp", Value: 1,
+		Time: time.Now()})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	_, err = dbInst.RuleInsert(data.Rule{
+		Description: "offline",
+		Conditions: []data.RuleCondition{{Type: data.RuleConditionOffline,
+			DeviceID: "1234", Timeout: "100ms"}},
+		Actions: []data.RuleAction{{Type: data.RuleActionCommand,
+			DeviceID: "1234", Command: "reboot"}},
+	})
+	if err != nil {
+		t.Fatal("Error inserting rule: ", err)
+	}
+
+	e := NewEngine(dbInst, Config{Interval: 10 * time.Millisecond})
+	err = e.Start()
+	if err != nil {
+		t.Fatal("Error starting engine: ", err)
+	}
+	defer e.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+	cmds, _ := dbInst.DeviceCommands("1234")
+	if len(cmds) != 0 {
+		t.Fatal("device was offline too soon")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	cmds, _ = dbInst.DeviceCommands("1234")
+	if len(cmds) != 1 || cmds[0].Command != "reboot" {
+		t.Errorf("wrong commands: %+v", cmds)
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	notifications := make(chan data.Notification, 10)
+
+	e := NewEngine(dbInst, Config{
+		Notify: func(n data.Notification) error {
+			notifications <- n
+			return nil
+		},
+		Interval: 10 * time.Millisecond,
+	})
+
+	err := e.Start()
+	if err != nil {
+		t.Fatal("Error starting engine: ", err)
+	}
+	defer e.Stop()
+
+	_, err = dbInst.RuleInsert(data.Rule{
+		Description: "tank high",
+		Conditions: []data.RuleCondition{{Type: data.RuleConditionValue,
+			DeviceID: "1234", SampleType: "level", Operator: ">", Value: 10}},
+		Actions: []data.RuleAction{{Type: data.RuleActionNotify,
+			Channels: []string{data.ChannelEmail}}},
+		Repeat: "200ms",
+		Escalations: []data.Escalation{{After: "50ms",
+			Channels: []string{data.ChannelSMS}}},
+	})
+	if err != nil {
+		t.Fatal("Error inserting rule: ", err)
+	}
+
+	wait := func(channel string) data.Notification {
+		select {
+		case n := <-notifications:
+			if len(n.Channels) != 1 || n.Channels[0] != channel {
+				t.Fatalf("wrong notification: %+v", n)
+			}
+			return n
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for notification")
+		}
+		return data.Notification{}
+	}
+
+	dbInst.DeviceSample("1234", data.Sample{Type: "level", Value: 11})
+
+	n := wait(data.ChannelEmail)
+	if n.AlertID == 0 {
+		t.Fatal("alert was not raised")
+	}
+
+	if n := wait(data.ChannelSMS); n.Message != "Not acknowledged: tank high is active" {
+		t.Error("wrong escalation message: ", n.Message)
+	}
+
+	// repeat
+	wait(data.ChannelEmail)
+
+	alert, err := dbInst.AlertAck(n.AlertID, "sam")
+	if err != nil || alert.Level != 1 {
+		t.Fatalf("wrong alert: %+v, %v", alert, err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if len(notifications) > 0 {
+		t.Fatal("acknowledged alert was repeated")
+	}
+
+	dbInst.DeviceSample("1234", data.Sample{Type: "level", Value: 9})
+	time.Sleep(50 * time.Millisecond)
+
+	alert, _ = dbInst.Alert(n.AlertID)
+	if alert.State != data.AlertCleared {
+		t.Error("alert was not cleared: ", alert.State)
+	}
+}
+
+func TestGeofence(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	e := NewEngine(dbInst, Config{Interval: time.Hour})
+	err := e.Start()
+	if err != nil {
+		t.Fatal("Error starting engine: ", err)
+	}
+	defer e.Stop()
+
+	site := &data.Area{Center: &data.Location{Lat: 45, Long: -93}, Radius: 1000}
+	for _, r := range []data.Rule{
+		{
+			Description: "left site",
+			Conditions: []data.RuleCondition{{Type: data.RuleConditionGeofence,
+				DeviceID: "1234", Area: site, Geofence: data.GeofenceOutside}},
+			Actions: []data.RuleAction{{Type: data.RuleActionCommand,
+				DeviceID: "1234", Command: "lock"}},
+		},
+		{
+			Description: "speeding",
+			Conditions: []data.RuleCondition{{Type: data.RuleConditionSpeed,
+				DeviceID: "1234", Operator: ">", Value: 50}},
+			Actions: []data.RuleAction{{Type: data.RuleActionCommand,
+				DeviceID: "1234", Command: "slow"}},
+		},
+	} {
+		_, err := dbInst.RuleInsert(r)
+		if err != nil {
+			t.Fatal("Error inserting rule: ", err)
+		}
+	}
+
+	start := time.Now()
+	move := func(lat float64, d time.Duration) {
+		pos := data.GpsPos{Lat: lat, Long: -93}
+		samples := pos.Samples("")
+		for i := range samples {
+			samples[i].Time = start.Add(d)
+		}
+		_, err := dbInst.DeviceSamples("1234", samples)
+		if err != nil {
+			t.Fatal("Error writing samples: ", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	commands := func() []string {
+		cmds, _ := dbInst.DeviceCommands("1234")
+		var ret []string
+		for _, c := range cmds {
+			ret = append(ret, c.Command)
+		}
+		return ret
+	}
+
+	// 0.005° of latitude is about 556m, so 40km/h over a minute
+	move(45, 0)
+	move(45.005, time.Minute)
+	if cmds := commands(); len(cmds) != 0 {
+		t.Fatalf("wrong commands inside the site: %v", cmds)
+	}
+
+	// 1.1km in a minute is 67km/h
+	move(45.015, 2*time.Minute)
+	if cmds := commands(); len(cmds) != 2 || cmds[0] == cmds[1] {
+		t.Errorf("wrong commands outside the site: %v", cmds)
+	}
+}
@@ -0,0 +1,384 @@
+package script
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+// Config describes how the engine runs scripts
+type Config struct {
+	// Write stores samples written by scripts, typically
+	// api.WriteSamples or db.IngestQueue.Enqueue
+	Write func(id string, samples []data.Sample) error
+	// Notify sends notifications. Notifications are logged if it is nil.
+	Notify func(n data.Notification) error
+	// MaxSteps limits the statements and calls each run of a script can
+	// use (default DefaultMaxSteps)
+	MaxSteps int
+	// MaxAlloc limits the bytes each run of a script can allocate for
+	// strings and tables (default DefaultMaxAlloc)
+	MaxAlloc int
+	// MaxRetained limits the bytes a script can keep in its globals
+	// between runs (default DefaultMaxRetained). Scripts over the limit
+	// are stopped until they are changed.
+	MaxRetained int
+}
+
+// loaded is a script that was parsed and run
+type loaded struct {
+	def    data.Script
+	script *Script
+	// failed is true if the last run had an error
+	failed bool
+}
+
+// Engine runs the scripts in the db when samples are written
+type Engine struct {
+	db      *db.Db
+	config  Config
+	lock    sync.Mutex
+	scripts map[uint64]*loaded
+	events  <-chan db.Event
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewEngine creates a script engine. Start starts running scripts.
+func NewEngine(dbInst *db.Db, config Config) *Engine {
+	if config.MaxSteps == 0 {
+		config.MaxSteps = DefaultMaxSteps
+	}
+
+	if config.MaxAlloc == 0 {
+		config.MaxAlloc = DefaultMaxAlloc
+	}
+
+	if config.MaxRetained == 0 {
+		config.MaxRetained = DefaultMaxRetained
+	}
+
+	return &Engine{
+		db:      dbInst,
+		config:  config,
+		scripts: make(map[uint64]*loaded),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Start loads the scripts and runs them as samples are written
+func (e *Engine) Start() error {
+	e.events = e.db.Subscribe(db.EventFilter{
+		Types: []db.EventType{db.EventSampleWritten, db.EventScriptChanged},
+	})
+
+	err := e.load()
+	if err != nil {
+		e.db.Unsubscribe(e.events)
+		return err
+	}
+
+	go e.run()
+
+	return nil
+}
+
+// Stop stops running scripts
+func (e *Engine) Stop() {
+	close(e.stop)
+	<-e.done
+	e.db.Unsubscribe(e.events)
+}
+
+// scriptsEqual compares the definitions of scripts, ignoring their errors
+func scriptsEqual(a, b data.Script) bool {
+	a.Error, a.ErrorTime = "", time.Time{}
+	b.Error, b.ErrorTime = "", time.Time{}
+	return reflect.DeepEqual(a, b)
+}
+
+// load reads the scripts from the db. Scripts that changed are parsed and
+// their top level is run, and the globals of scripts that did not change
+// are kept.
+func (e *Engine) load() error {
+	defs, err := e.db.Scripts()
+	if err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	old := e.scripts
+	e.scripts = make(map[uint64]*loaded)
+
+	for _, def := range defs {
+		if l, ok := old[def.ID]; ok && scriptsEqual(l.def, def) {
+			e.scripts[def.ID] = l
+			continue
+		}
+
+		l := &loaded{def: def}
+		e.scripts[def.ID] = l
+
+		if def.Disabled {
+			continue
+		}
+
+		l.script, err = e.open(def)
+		e.result(l, err)
+	}
+
+	return nil
+}
+
+// open parses a script, defines the functions it can use to access the
+// db, and runs its top level
+func (e *Engine) open(def data.Script) (*Script, error) {
+	s, err := Parse("script "+strconv.FormatUint(def.ID, 10), def.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	s.MaxSteps = e.config.MaxSteps
+	s.MaxAlloc = e.config.MaxAlloc
+	s.MaxRetained = e.config.MaxRetained
+	s.Print = func(msg string) {
+		log.Printf("Script %v: %v\n", def.ID, msg)
+	}
+
+	for name, fn := range e.functions(def) {
+		s.Set(name, NewFunction(name, fn))
+	}
+
+	_, err = s.Run()
+	return s, err
+}
+
+// result records the result of running a script. Errors are saved in the
+// db so users can see them, and cleared after the next successful run.
+// Scripts that keep too much memory are dropped, so their globals are
+// freed, until they are changed.
+func (e *Engine) result(l *loaded, err error) {
+	if errors.Is(err, ErrRetainedLimit) {
+		l.script = nil
+	}
+
+	if err == nil && !l.failed {
+		return
+	}
+
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+		log.Printf("Error running script %v: %v\n", l.def.ID, err)
+	}
+	l.failed = err != nil
+
+	err = e.db.ScriptSetError(l.def.ID, msg, time.Now())
+	if err != nil {
+		log.Printf("Error saving error of script %v: %v\n", l.def.ID, err)
+	}
+}
+
+func (e *Engine) run() {
+	defer close(e.done)
+
+	for {
+		select {
+		case ev, ok := <-e.events:
+			if !ok {
+				return
+			}
+
+			if ev.Type == db.EventScriptChanged {
+				err := e.load()
+				if err != nil {
+					log.Println("Error loading scripts: ", err)
+				}
+			} else if ev.Sample != nil {
+				e.sample(ev.DeviceID, *ev.Sample)
+			}
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// SampleValue returns the table passed to on_sample for a sample
+func SampleValue(deviceID string, s data.Sample) *Table {
+	t := NewTable()
+	t.Set("deviceId", deviceID)
+	t.Set("type", s.Type)
+	t.Set("id", s.ID)
+	t.Set("value", s.Value)
+	t.Set("time", float64(s.Time.UnixNano())/1e9)
+	if len(s.Tags) > 0 {
+		t.Set("tags", ToValue(s.Tags))
+	}
+	return t
+}
+
+// sample runs the on_sample function of the scripts for a device
+func (e *Engine) sample(deviceID string, s data.Sample) {
+	if s.Tags[data.ScriptTag] != "" {
+		return
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for _, l := range e.scripts {
+		if l.script == nil || !l.def.Runs(deviceID) {
+			continue
+		}
+
+		if l.script.Get("on_sample") == nil {
+			continue
+		}
+
+		_, err := l.script.Call("on_sample", SampleValue(deviceID, s))
+		e.result(l, err)
+	}
+}
+
+// stringArg returns a string argument. It is an error if it is blank and
+// required.
+func stringArg(args []Value, i int, name string, required bool) (string, error) {
+	switch v := arg(args, i).(type) {
+	case nil:
+		if !required {
+			return "", nil
+		}
+	case string:
+		if v != "" || !required {
+			return v, nil
+		}
+	case float64:
+		return formatNumber(v), nil
+	}
+	return "", fmt.Errorf("%v must be a string", name)
+}
+
+// functions returns the functions scripts use to access the db
+func (e *Engine) functions(def data.Script) map[string]func(args []Value) ([]Value, error) {
+	return map[string]func(args []Value) ([]Value, error){
+		// latest(deviceId, type, [id]) returns the latest value of a
+		// sample, or nil
+		"latest": func(args []Value) ([]Value, error) {
+			deviceID, err := stringArg(args, 0, "device id", true)
+			if err != nil {
+				return nil, err
+			}
+			typ, err := stringArg(args, 1, "sample type", true)
+			if err != nil {
+				return nil, err
+			}
+			id, err := stringArg(args, 2, "sample id", false)
+			if err != nil {
+				return nil, err
+			}
+
+			s, ok := e.db.LatestValue(deviceID, typ, id)
+			if !ok {
+				return []Value{nil}, nil
+			}
+			return []Value{s.Value}, nil
+		},
+
+		// write(deviceId, type, value, [id]) writes a sample
+		"write": func(args []Value) ([]Value, error) {
+			deviceID, err := stringArg(args, 0, "device id", true)
+			if err != nil {
+				return nil, err
+			}
+			typ, err := stringArg(args, 1, "sample type", true)
+			if err != nil {
+				return nil, err
+			}
+			value, ok := ToNumber(arg(args, 2))
+			if !ok {
+				return nil, errors.New("value must be a number")
+			}
+			id, err := stringArg(args, 3, "sample id", false)
+			if err != nil {
+				return nil, err
+			}
+
+			if e.config.Write == nil {
+				return nil, errors.New("writing samples is not supported")
+			}
+
+			return nil, e.config.Write(deviceID, []data.Sample{{
+				Type:  typ,
+				ID:    id,
+				Value: value,
+				Time:  time.Now(),
+				Tags:  map[string]string{data.ScriptTag: strconv.FormatUint(def.ID, 10)},
+			}})
+		},
+
+		// notify(message, [deviceId]) sends a notification
+		"notify": func(args []Value) ([]Value, error) {
+			msg, err := stringArg(args, 0, "message", true)
+			if err != nil {
+				return nil, err
+			}
+			deviceID, err := stringArg(args, 1, "device id", false)
+			if err != nil {
+				return nil, err
+			}
+
+			n := data.Notification{
+				Description: def.Description,
+				DeviceID:    deviceID,
+				Message:     msg,
+				Active:      true,
+				Time:        time.Now(),
+			}
+
+			if e.config.Notify == nil {
+				log.Println("Script notification: ", n.Message)
+				return nil, nil
+			}
+			return nil, e.config.Notify(n)
+		},
+
+		// command(deviceId, command, [args]) queues a device command
+		"command": func(args []Value) ([]Value, error) {
+			deviceID, err := stringArg(args, 0, "device id", true)
+			if err != nil {
+				return nil, err
+			}
+			command, err := stringArg(args, 1, "command", true)
+			if err != nil {
+				return nil, err
+			}
+
+			var cmdArgs map[string]string
+			if t, ok := arg(args, 2).(*Table); ok {
+				cmdArgs = make(map[string]string)
+				k, v, _ := t.Next(nil)
+				for k != nil {
+					cmdArgs[ToString(k)] = ToString(v)
+					k, v, _ = t.Next(k)
+				}
+			}
+
+			_, err = e.db.CommandEnqueue(data.DeviceCommand{
+				DeviceID: deviceID,
+				Command:  command,
+				Args:     cmdArgs,
+			})
+			return nil, err
+		},
+	}
+}
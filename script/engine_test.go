@@ -0,0 +1,125 @@
+package script
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db/dbtest"
+)
+
+const testScript = `
+count = 0
+
+function on_sample(s)
+  if s.type ~= "temp" then
+    return
+  end
+
+  count = count + 1
+  write(s.deviceId, "count", count)
+
+  local setpoint = latest("1234", "setpoint") or 20
+  if s.value > setpoint + 5 then
+    command(s.deviceId, "setOutput", {id = "fan", value = 1})
+    notify(string.format("%s is %.1f C", s.deviceId, s.value), s.deviceId)
+  end
+end
+`
+
+func TestEngine(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	notifications := make(chan data.Notification, 10)
+
+	write := func(id string, samples []data.Sample) error {
+		for _, s := range samples {
+			err := dbInst.DeviceSample(id, s)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	e := NewEngine(dbInst, Config{
+		Write: write,
+		Notify: func(n data.Notification) error {
+			notifications <- n
+			return nil
+		},
+	})
+
+	err := e.Start()
+	if err != nil {
+		t.Fatal("Error starting engine: ", err)
+	}
+	defer e.Stop()
+
+	s, err := dbInst.ScriptInsert(data.Script{
+		Description: "fan control",
+		DeviceIDs:   []string{"1234"},
+		Source:      testScript,
+	})
+	if err != nil {
+		t.Fatal("Error inserting script: ", err)
+	}
+
+	// wait for the script to load
+	time.Sleep(50 * time.Millisecond)
+
+	write("1234", []data.Sample{{Type: "setpoint", Value: 10, Time: time.Now()}})
+	write("5678", []data.Sample{{Type: "temp", Value: 30, Time: time.Now()}})
+	write("1234", []data.Sample{{Type: "temp", Value: 16, Time: time.Now()}})
+
+	select {
+	case n := <-notifications:
+		if n.Message != "1234 is 16.0 C" || n.DeviceID != "1234" ||
+			n.Description != "fan control" {
+			t.Errorf("wrong notification: %+v", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for notification")
+	}
+
+	cmds, _ := dbInst.DeviceCommands("1234")
+	if len(cmds) != 1 || cmds[0].Command != "setOutput" ||
+		cmds[0].Args["id"] != "fan" || cmds[0].Args["value"] != "1" {
+		t.Errorf("wrong commands: %+v", cmds)
+	}
+
+	// the script only ran for the temp sample of its device, and not for
+	// the count sample it wrote
+	count, ok := dbInst.LatestValue("1234", "count", "")
+	if !ok || count.Value != 1 || count.Tags[data.ScriptTag] == "" {
+		t.Errorf("wrong count: %+v", count)
+	}
+
+	// runtime errors are saved
+	s.Source = "function on_sample(s) error('broken') end"
+	err = dbInst.ScriptUpdate(s)
+	if err != nil {
+		t.Fatal("Error updating script: ", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	write("1234", []data.Sample{{Type: "temp", Value: 16, Time: time.Now()}})
+
+	start := time.Now()
+	for {
+		s, err = dbInst.Script(s.ID)
+		if err != nil {
+			t.Fatal("Error getting script: ", err)
+		}
+		if s.Error != "" || time.Since(start) > 2*time.Second {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !strings.Contains(s.Error, "broken") {
+		t.Error("wrong error: ", s.Error)
+	}
+}
@@ -0,0 +1,956 @@
+// Package script runs user scripts for site specific logic that rules
+// can't express. Scripts are written in a subset of Lua 5.1: there are no
+// metatables, coroutines, or goto, numbers are always floats, and
+// string.find only finds plain text. Scripts can't access files or the
+// OS, and each run is limited in how many steps it can take, how deep it
+// can call, how large its strings and tables can be, and how much memory
+// it can allocate in total. The memory a script keeps in its globals
+// between runs is limited too.
+//
+// The Engine runs the scripts in the db when samples are written, and
+// gives them functions to read and write samples, send notifications, and
+// queue device commands.
+package script
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// limits that keep scripts from using too much of the server
+const (
+	// DefaultMaxSteps is the default number of statements and calls a
+	// script can run per Run or Call
+	DefaultMaxSteps = 100000
+	// DefaultMaxAlloc is the default number of bytes a script can
+	// allocate for strings and tables per Run or Call
+	DefaultMaxAlloc = 64 << 20
+	// DefaultMaxRetained is the default number of bytes of strings and
+	// tables a script can keep in its globals between runs
+	DefaultMaxRetained = 16 << 20
+	maxDepth           = 200
+	maxStringLen       = 1 << 20
+	maxTableSize       = 1 << 16
+	// tableCost and tableEntryCost are the approximate bytes used by a
+	// table and each entry, not counting the strings in it
+	tableCost      = 64
+	tableEntryCost = 32
+)
+
+// ErrStepLimit is returned when a script runs more than its MaxSteps
+var ErrStepLimit = errors.New("script exceeded step limit")
+
+// ErrAllocLimit is returned when a script allocates more than its MaxAlloc
+var ErrAllocLimit = errors.New("script exceeded memory limit")
+
+// ErrRetainedLimit is returned when a script keeps more than its
+// MaxRetained in its globals after a run
+var ErrRetainedLimit = errors.New("script exceeded retained memory limit")
+
+// Error is a script error
+type Error struct {
+	Script string
+	Line   int
+	// Value is the value passed to the error function
+	Value Value
+	// Err is the error from a Go function or limit
+	Err error
+}
+
+func (e *Error) Error() string {
+	msg := ToString(e.Value)
+	if e.Err != nil {
+		msg = e.Err.Error()
+	}
+	if e.Line > 0 {
+		return fmt.Sprintf("%v:%v: %v", e.Script, e.Line, msg)
+	}
+	return fmt.Sprintf("%v: %v", e.Script, msg)
+}
+
+// Unwrap returns Err
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// fatal returns true for errors that scripts can't catch with pcall
+func (e *Error) fatal() bool {
+	return e.Err == ErrStepLimit || e.Err == ErrAllocLimit
+}
+
+// scope is a block of local variables
+type scope struct {
+	vars   map[string]*Value
+	parent *scope
+	// varargs are the extra arguments of the function the scope is in
+	varargs []Value
+}
+
+func newScope(parent *scope) *scope {
+	s := &scope{parent: parent}
+	if parent != nil {
+		s.varargs = parent.varargs
+	}
+	return s
+}
+
+func (s *scope) define(name string, v Value) {
+	if s.vars == nil {
+		s.vars = make(map[string]*Value)
+	}
+	s.vars[name] = &v
+}
+
+func (s *scope) lookup(name string) *Value {
+	for ; s != nil; s = s.parent {
+		if v, ok := s.vars[name]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+// control flow results of statements
+const (
+	ctlNone = iota
+	ctlBreak
+	ctlReturn
+)
+
+// Script is a parsed script and its global variables, which are kept
+// between calls. A script is not safe for concurrent use.
+type Script struct {
+	name    string
+	main    *funcExpr
+	globals *Table
+	strings *Table
+	// MaxSteps limits the statements and calls run by each Run or Call
+	MaxSteps int
+	// MaxAlloc limits the bytes allocated for strings and tables by each
+	// Run or Call, even if they are no longer used. The per value limits
+	// alone would let a script fill a large table with long strings.
+	MaxAlloc int
+	// MaxRetained limits the bytes of strings and tables reachable from
+	// the globals after each Run or Call, which MaxAlloc does not limit
+	// since globals are kept between runs
+	MaxRetained int
+	// Print is called by the print function. Messages are logged if it is
+	// nil.
+	Print func(msg string)
+	steps int
+	alloc int
+	depth int
+	// retained is at least the bytes reachable from the globals: their
+	// size when last measured, plus the bytes allocated since
+	retained int
+}
+
+// Parse parses a script. name is used in error messages. Run runs the top
+// level of the script.
+func Parse(name, src string) (*Script, error) {
+	main, err := parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+
+	s := &Script{
+		name:        name,
+		main:        main,
+		globals:     NewTable(),
+		MaxSteps:    DefaultMaxSteps,
+		MaxAlloc:    DefaultMaxAlloc,
+		MaxRetained: DefaultMaxRetained,
+	}
+	s.openLibs()
+
+	return s, nil
+}
+
+// Set sets a global variable
+func (s *Script) Set(name string, v Value) {
+	s.globals.Set(name, v)
+}
+
+// Get returns a global variable
+func (s *Script) Get(name string) Value {
+	return s.globals.Get(name)
+}
+
+// Run runs the top level of the script, which typically defines functions
+func (s *Script) Run(args ...Value) ([]Value, error) {
+	return s.start(&closure{fn: s.main}, args)
+}
+
+// Call calls a global function
+func (s *Script) Call(name string, args ...Value) ([]Value, error) {
+	fn := s.globals.Get(name)
+	if fn == nil {
+		return nil, &Error{Script: s.name,
+			Err: fmt.Errorf("function %v is not defined", name)}
+	}
+	return s.start(fn, args)
+}
+
+func (s *Script) start(fn Value, args []Value) ([]Value, error) {
+	s.steps = 0
+	s.alloc = 0
+	s.depth = 0
+	ret, err := s.call(fn, args, 0)
+
+	// the globals are only measured when what the run allocated could
+	// put them over the limit
+	s.retained += s.alloc
+	if s.MaxRetained > 0 && s.retained > s.MaxRetained {
+		s.retained = s.retainedSize()
+		if s.retained > s.MaxRetained {
+			return ret, &Error{Script: s.name, Err: ErrRetainedLimit}
+		}
+	}
+
+	return ret, err
+}
+
+// retainedSize returns the approximate bytes of the strings and tables
+// reachable from the globals, including the locals kept by closures
+func (s *Script) retainedSize() int {
+	size := 0
+	seen := make(map[interface{}]bool)
+	stack := []Value{s.globals}
+
+	for len(stack) > 0 {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		switch x := v.(type) {
+		case string:
+			size += len(x)
+		case *Table:
+			if seen[x] {
+				continue
+			}
+			seen[x] = true
+			size += tableCost + len(x.entries)*tableEntryCost
+			for _, e := range x.entries {
+				stack = append(stack, e.key, e.value)
+			}
+		case *closure:
+			for sc := x.scope; sc != nil && !seen[sc]; sc = sc.parent {
+				seen[sc] = true
+				for _, p := range sc.vars {
+					stack = append(stack, *p)
+				}
+				stack = append(stack, sc.varargs...)
+			}
+		}
+	}
+
+	return size
+}
+
+func (s *Script) errorf(line int, format string, args ...interface{}) error {
+	return &Error{Script: s.name, Line: line, Err: fmt.Errorf(format, args...)}
+}
+
+func (s *Script) step(line int) error {
+	s.steps++
+	if s.MaxSteps > 0 && s.steps > s.MaxSteps {
+		return &Error{Script: s.name, Line: line, Err: ErrStepLimit}
+	}
+	return nil
+}
+
+// allocate counts n bytes against MaxAlloc
+func (s *Script) allocate(n int, line int) error {
+	s.alloc += n
+	if s.MaxAlloc > 0 && s.alloc > s.MaxAlloc {
+		return &Error{Script: s.name, Line: line, Err: ErrAllocLimit}
+	}
+	return nil
+}
+
+func (s *Script) call(fn Value, args []Value, line int) ([]Value, error) {
+	err := s.step(line)
+	if err != nil {
+		return nil, err
+	}
+
+	switch f := fn.(type) {
+	case *Function:
+		ret, err := f.Fn(args)
+		if err != nil {
+			e, ok := err.(*Error)
+			if !ok {
+				err = &Error{Script: s.name, Line: line, Err: err}
+			} else if e.Line == 0 {
+				e.Line = line
+			}
+			return ret, err
+		}
+
+		// strings returned by library functions, like string.rep, are
+		// new
+		for _, v := range ret {
+			if str, ok := v.(string); ok {
+				err := s.allocate(len(str), line)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		return ret, nil
+
+	case *closure:
+		if s.depth >= maxDepth {
+			return nil, s.errorf(line, "stack overflow")
+		}
+		s.depth++
+		defer func() { s.depth-- }()
+
+		sc := &scope{parent: f.scope}
+		for i, p := range f.fn.params {
+			var v Value
+			if i < len(args) {
+				v = args[i]
+			}
+			sc.define(p, v)
+		}
+		if f.fn.vararg && len(args) > len(f.fn.params) {
+			sc.varargs = args[len(f.fn.params):]
+		}
+
+		_, ret, err := s.exec(f.fn.body, sc)
+		return ret, err
+	}
+
+	return nil, s.errorf(line, "attempt to call a %v value", TypeName(fn))
+}
+
+func (s *Script) exec(b *block, parent *scope) (int, []Value, error) {
+	sc := newScope(parent)
+
+	for _, st := range b.stmts {
+		ctl, ret, err := s.execStmt(st, sc)
+		if err != nil || ctl != ctlNone {
+			return ctl, ret, err
+		}
+	}
+
+	return ctlNone, nil, nil
+}
+
+func (s *Script) execStmt(st stmt, sc *scope) (int, []Value, error) {
+	err := s.step(0)
+	if err != nil {
+		return ctlNone, nil, err
+	}
+
+	switch st := st.(type) {
+	case *localStmt:
+		values, err := s.evalList(st.exprs, sc)
+		if err != nil {
+			return ctlNone, nil, err
+		}
+		for i, n := range st.names {
+			var v Value
+			if i < len(values) {
+				v = values[i]
+			}
+			sc.define(n, v)
+		}
+
+	case *localFuncStmt:
+		// defined first so the function can call itself
+		sc.define(st.name, nil)
+		*sc.lookup(st.name) = &closure{fn: st.fn, scope: sc}
+
+	case *assignStmt:
+		values, err := s.evalList(st.exprs, sc)
+		if err != nil {
+			return ctlNone, nil, err
+		}
+		for i, t := range st.targets {
+			var v Value
+			if i < len(values) {
+				v = values[i]
+			}
+			err := s.assign(t, v, sc)
+			if err != nil {
+				return ctlNone, nil, err
+			}
+		}
+
+	case *callStmt:
+		_, err := s.evalCall(st.call, sc)
+		if err != nil {
+			return ctlNone, nil, err
+		}
+
+	case *doStmt:
+		return s.exec(st.body, sc)
+
+	case *whileStmt:
+		for {
+			err := s.step(0)
+			if err != nil {
+				return ctlNone, nil, err
+			}
+			cond, err := s.eval(st.cond, sc)
+			if err != nil {
+				return ctlNone, nil, err
+			}
+			if !Truthy(cond) {
+				break
+			}
+			ctl, ret, err := s.exec(st.body, sc)
+			if err != nil || ctl == ctlReturn {
+				return ctl, ret, err
+			}
+			if ctl == ctlBreak {
+				break
+			}
+		}
+
+	case *repeatStmt:
+		for {
+			err := s.step(0)
+			if err != nil {
+				return ctlNone, nil, err
+			}
+			// the condition can use locals of the body
+			body := newScope(sc)
+			ctl := ctlNone
+			var ret []Value
+			for _, bs := range st.body.stmts {
+				ctl, ret, err = s.execStmt(bs, body)
+				if err != nil || ctl != ctlNone {
+					break
+				}
+			}
+			if err != nil || ctl == ctlReturn {
+				return ctl, ret, err
+			}
+			if ctl == ctlBreak {
+				break
+			}
+
+			cond, err := s.eval(st.cond, body)
+			if err != nil {
+				return ctlNone, nil, err
+			}
+			if Truthy(cond) {
+				break
+			}
+		}
+
+	case *ifStmt:
+		for i, c := range st.conds {
+			cond, err := s.eval(c, sc)
+			if err != nil {
+				return ctlNone, nil, err
+			}
+			if Truthy(cond) {
+				return s.exec(st.blocks[i], sc)
+			}
+		}
+		if st.els != nil {
+			return s.exec(st.els, sc)
+		}
+
+	case *numForStmt:
+		return s.numFor(st, sc)
+
+	case *genForStmt:
+		return s.genFor(st, sc)
+
+	case *returnStmt:
+		values, err := s.evalList(st.exprs, sc)
+		return ctlReturn, values, err
+
+	case *breakStmt:
+		return ctlBreak, nil, nil
+	}
+
+	return ctlNone, nil, nil
+}
+
+func (s *Script) numFor(st *numForStmt, sc *scope) (int, []Value, error) {
+	var params [3]float64
+	params[2] = 1
+
+	for i, e := range []expr{st.start, st.limit, st.step} {
+		if e == nil {
+			continue
+		}
+		v, err := s.eval(e, sc)
+		if err != nil {
+			return ctlNone, nil, err
+		}
+		n, ok := ToNumber(v)
+		if !ok {
+			return ctlNone, nil, s.errorf(st.line, "'for' value must be a number")
+		}
+		params[i] = n
+	}
+
+	start, limit, step := params[0], params[1], params[2]
+	if step == 0 {
+		return ctlNone, nil, s.errorf(st.line, "'for' step is zero")
+	}
+
+	for i := start; (step > 0 && i <= limit) || (step < 0 && i >= limit); i += step {
+		err := s.step(st.line)
+		if err != nil {
+			return ctlNone, nil, err
+		}
+		body := newScope(sc)
+		body.define(st.name, i)
+		ctl, ret, err := s.exec(st.body, body)
+		if err != nil || ctl == ctlReturn {
+			return ctl, ret, err
+		}
+		if ctl == ctlBreak {
+			break
+		}
+	}
+
+	return ctlNone, nil, nil
+}
+
+func (s *Script) genFor(st *genForStmt, sc *scope) (int, []Value, error) {
+	values, err := s.evalList(st.exprs, sc)
+	if err != nil {
+		return ctlNone, nil, err
+	}
+
+	values = append(values, nil, nil, nil)
+	fn, state, ctl := values[0], values[1], values[2]
+
+	for {
+		ret, err := s.call(fn, []Value{state, ctl}, st.line)
+		if err != nil {
+			return ctlNone, nil, err
+		}
+		if len(ret) == 0 || ret[0] == nil {
+			break
+		}
+		ctl = ret[0]
+
+		body := newScope(sc)
+		for i, n := range st.names {
+			var v Value
+			if i < len(ret) {
+				v = ret[i]
+			}
+			body.define(n, v)
+		}
+
+		c, r, err := s.exec(st.body, body)
+		if err != nil || c == ctlReturn {
+			return c, r, err
+		}
+		if c == ctlBreak {
+			break
+		}
+	}
+
+	return ctlNone, nil, nil
+}
+
+func (s *Script) assign(target expr, v Value, sc *scope) error {
+	switch t := target.(type) {
+	case *nameExpr:
+		if p := sc.lookup(t.name); p != nil {
+			*p = v
+			return nil
+		}
+		s.globals.Set(t.name, v)
+		return nil
+
+	case *indexExpr:
+		obj, err := s.eval(t.obj, sc)
+		if err != nil {
+			return err
+		}
+		key, err := s.eval(t.key, sc)
+		if err != nil {
+			return err
+		}
+		return s.setIndex(obj, key, v, t.line)
+	}
+
+	return s.errorf(0, "cannot assign")
+}
+
+func (s *Script) setIndex(obj, key, v Value, line int) error {
+	t, ok := obj.(*Table)
+	if !ok {
+		return s.errorf(line, "attempt to index a %v value", TypeName(obj))
+	}
+
+	size := t.Size()
+	err := t.Set(key, v)
+	if err != nil {
+		return s.errorf(line, "%v", err)
+	}
+
+	if t.Size() > maxTableSize {
+		return s.errorf(line, "table is too large")
+	}
+
+	if t.Size() > size {
+		return s.allocate(tableEntryCost, line)
+	}
+
+	return nil
+}
+
+func (s *Script) index(obj, key Value, line int) (Value, error) {
+	switch o := obj.(type) {
+	case *Table:
+		return o.Get(key), nil
+	case string:
+		// string values have the string library functions as methods
+		return s.strings.Get(key), nil
+	}
+
+	return nil, s.errorf(line, "attempt to index a %v value", TypeName(obj))
+}
+
+// evalList evaluates expressions. All the values of the last expression
+// are used.
+func (s *Script) evalList(exprs []expr, sc *scope) ([]Value, error) {
+	var ret []Value
+	for i, e := range exprs {
+		if i == len(exprs)-1 {
+			values, err := s.evalMulti(e, sc)
+			if err != nil {
+				return nil, err
+			}
+			return append(ret, values...), nil
+		}
+
+		v, err := s.eval(e, sc)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
+// evalMulti evaluates an expression that can have multiple values
+func (s *Script) evalMulti(e expr, sc *scope) ([]Value, error) {
+	switch x := e.(type) {
+	case *callExpr:
+		return s.evalCall(x, sc)
+	case *varargExpr:
+		return sc.varargs, nil
+	}
+
+	v, err := s.eval(e, sc)
+	if err != nil {
+		return nil, err
+	}
+	return []Value{v}, nil
+}
+
+func (s *Script) evalCall(c *callExpr, sc *scope) ([]Value, error) {
+	fn, err := s.eval(c.fn, sc)
+	if err != nil {
+		return nil, err
+	}
+
+	var args []Value
+	if c.method != "" {
+		obj := fn
+		fn, err = s.index(obj, c.method, c.line)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, obj)
+	}
+
+	values, err := s.evalList(c.args, sc)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, values...)
+
+	switch fn.(type) {
+	case *Function, *closure:
+	default:
+		desc := ""
+		switch {
+		case c.method != "":
+			desc = fmt.Sprintf(" (method '%v')", c.method)
+		default:
+			if n, ok := c.fn.(*nameExpr); ok {
+				desc = fmt.Sprintf(" ('%v')", n.name)
+			}
+		}
+		return nil, s.errorf(c.line, "attempt to call a %v value%v", TypeName(fn), desc)
+	}
+
+	return s.call(fn, args, c.line)
+}
+
+func (s *Script) eval(e expr, sc *scope) (Value, error) {
+	switch x := e.(type) {
+	case *constExpr:
+		return x.v, nil
+
+	case *nameExpr:
+		if p := sc.lookup(x.name); p != nil {
+			return *p, nil
+		}
+		return s.globals.Get(x.name), nil
+
+	case *indexExpr:
+		obj, err := s.eval(x.obj, sc)
+		if err != nil {
+			return nil, err
+		}
+		key, err := s.eval(x.key, sc)
+		if err != nil {
+			return nil, err
+		}
+		return s.index(obj, key, x.line)
+
+	case *callExpr:
+		values, err := s.evalCall(x, sc)
+		if err != nil || len(values) == 0 {
+			return nil, err
+		}
+		return values[0], nil
+
+	case *varargExpr:
+		if len(sc.varargs) == 0 {
+			return nil, nil
+		}
+		return sc.varargs[0], nil
+
+	case *parenExpr:
+		return s.eval(x.e, sc)
+
+	case *funcExpr:
+		return &closure{fn: x, scope: sc}, nil
+
+	case *tableExpr:
+		err := s.allocate(tableCost, x.line)
+		if err != nil {
+			return nil, err
+		}
+		t := NewTable()
+		n := 0
+		for i, item := range x.items {
+			if item.key != nil {
+				key, err := s.eval(item.key, sc)
+				if err != nil {
+					return nil, err
+				}
+				v, err := s.eval(item.value, sc)
+				if err != nil {
+					return nil, err
+				}
+				err = s.setIndex(t, key, v, x.line)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			values := []Value{nil}
+			var err error
+			if i == len(x.items)-1 {
+				values, err = s.evalMulti(item.value, sc)
+			} else {
+				values[0], err = s.eval(item.value, sc)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			for _, v := range values {
+				n++
+				err := s.setIndex(t, float64(n), v, x.line)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		return t, nil
+
+	case *unExpr:
+		v, err := s.eval(x.e, sc)
+		if err != nil {
+			return nil, err
+		}
+		return s.unary(x.op, v, x.line)
+
+	case *binExpr:
+		l, err := s.eval(x.l, sc)
+		if err != nil {
+			return nil, err
+		}
+
+		switch x.op {
+		case "and":
+			if !Truthy(l) {
+				return l, nil
+			}
+			return s.eval(x.r, sc)
+		case "or":
+			if Truthy(l) {
+				return l, nil
+			}
+			return s.eval(x.r, sc)
+		}
+
+		r, err := s.eval(x.r, sc)
+		if err != nil {
+			return nil, err
+		}
+		return s.binary(x.op, l, r, x.line)
+	}
+
+	return nil, s.errorf(0, "unsupported expression")
+}
+
+func (s *Script) unary(op string, v Value, line int) (Value, error) {
+	switch op {
+	case "not":
+		return !Truthy(v), nil
+	case "-":
+		n, ok := ToNumber(v)
+		if !ok {
+			return nil, s.errorf(line, "attempt to perform arithmetic on a %v value",
+				TypeName(v))
+		}
+		return -n, nil
+	case "#":
+		switch x := v.(type) {
+		case string:
+			return float64(len(x)), nil
+		case *Table:
+			return float64(x.Len()), nil
+		}
+		return nil, s.errorf(line, "attempt to get length of a %v value", TypeName(v))
+	}
+	return nil, s.errorf(line, "unsupported operator %v", op)
+}
+
+func (s *Script) binary(op string, l, r Value, line int) (Value, error) {
+	switch op {
+	case "==":
+		return l == r, nil
+	case "~=":
+		return l != r, nil
+	case "<", "<=", ">", ">=":
+		return s.compare(op, l, r, line)
+	case "..":
+		ls, lok := concatString(l)
+		rs, rok := concatString(r)
+		if !lok || !rok {
+			bad := l
+			if lok {
+				bad = r
+			}
+			return nil, s.errorf(line, "attempt to concatenate a %v value", TypeName(bad))
+		}
+		if len(ls)+len(rs) > maxStringLen {
+			return nil, s.errorf(line, "string is too long")
+		}
+		err := s.allocate(len(ls)+len(rs), line)
+		if err != nil {
+			return nil, err
+		}
+		return ls + rs, nil
+	}
+
+	a, aok := ToNumber(l)
+	b, bok := ToNumber(r)
+	if !aok || !bok {
+		bad := l
+		if aok {
+			bad = r
+		}
+		return nil, s.errorf(line, "attempt to perform arithmetic on a %v value",
+			TypeName(bad))
+	}
+
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		return a / b, nil
+	case "//":
+		return math.Floor(a / b), nil
+	case "%":
+		return a - math.Floor(a/b)*b, nil
+	case "^":
+		return math.Pow(a, b), nil
+	}
+
+	return nil, s.errorf(line, "unsupported operator %v", op)
+}
+
+func concatString(v Value) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, true
+	case float64:
+		return formatNumber(x), true
+	}
+	return "", false
+}
+
+func (s *Script) compare(op string, l, r Value, line int) (Value, error) {
+	var c int
+
+	switch a := l.(type) {
+	case float64:
+		b, ok := r.(float64)
+		if !ok {
+			break
+		}
+		switch {
+		case a < b:
+			c = -1
+		case a > b:
+			c = 1
+		case a != b:
+			// NaN
+			return false, nil
+		}
+		return compareResult(op, c), nil
+	case string:
+		b, ok := r.(string)
+		if !ok {
+			break
+		}
+		return compareResult(op, strings.Compare(a, b)), nil
+	}
+
+	if TypeName(l) == TypeName(r) {
+		return nil, s.errorf(line, "attempt to compare two %v values", TypeName(l))
+	}
+	return nil, s.errorf(line, "attempt to compare %v with %v", TypeName(l), TypeName(r))
+}
+
+func compareResult(op string, c int) bool {
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
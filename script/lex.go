@@ -0,0 +1,304 @@
+package script
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// token types. Keywords and operators use tokOp with the text in token.s.
+const (
+	tokEOF = iota
+	tokName
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	typ  int
+	s    string
+	n    float64
+	line int
+}
+
+var keywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "if": true,
+	"in": true, "local": true, "nil": true, "not": true, "or": true,
+	"repeat": true, "return": true, "then": true, "true": true,
+	"until": true, "while": true,
+}
+
+// operators, longest first so they match before their prefixes
+var operators = []string{
+	"...", "..", "//", "==", "~=", "<=", ">=",
+	"+", "-", "*", "/", "%", "^", "#", "<", ">", "=", "(", ")", "{", "}",
+	"[", "]", ";", ":", ",", ".",
+}
+
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isName(c byte) bool {
+	return isNameStart(c) || isDigit(c)
+}
+
+// lex splits a script into tokens
+func lex(src string) ([]token, error) {
+	l := &lexer{src: src, line: 1}
+
+	var ret []token
+	for {
+		t, err := l.next()
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", l.line, err)
+		}
+		ret = append(ret, t)
+		if t.typ == tokEOF {
+			return ret, nil
+		}
+	}
+}
+
+// skip skips white space and comments
+func (l *lexer) skip() error {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case strings.HasPrefix(l.src[l.pos:], "--"):
+			l.pos += 2
+			if level := l.longBracket(); level >= 0 {
+				_, err := l.longString(level)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// longBracket returns the level of a long bracket like [[ or [==[ at the
+// current position, or -1
+func (l *lexer) longBracket() int {
+	if l.pos >= len(l.src) || l.src[l.pos] != '[' {
+		return -1
+	}
+	i := l.pos + 1
+	for i < len(l.src) && l.src[i] == '=' {
+		i++
+	}
+	if i < len(l.src) && l.src[i] == '[' {
+		return i - l.pos - 1
+	}
+	return -1
+}
+
+// longString reads a long bracket string at the current position
+func (l *lexer) longString(level int) (string, error) {
+	l.pos += level + 2
+	// a newline right after the opening bracket is skipped
+	if strings.HasPrefix(l.src[l.pos:], "\r\n") {
+		l.pos += 2
+		l.line++
+	} else if strings.HasPrefix(l.src[l.pos:], "\n") {
+		l.pos++
+		l.line++
+	}
+
+	end := "]" + strings.Repeat("=", level) + "]"
+	i := strings.Index(l.src[l.pos:], end)
+	if i < 0 {
+		return "", fmt.Errorf("unfinished long string")
+	}
+
+	s := l.src[l.pos : l.pos+i]
+	l.line += strings.Count(s, "\n")
+	l.pos += i + len(end)
+	return s, nil
+}
+
+func (l *lexer) next() (token, error) {
+	err := l.skip()
+	if err != nil {
+		return token{}, err
+	}
+
+	if l.pos >= len(l.src) {
+		return token{typ: tokEOF, line: l.line}, nil
+	}
+
+	c := l.src[l.pos]
+	start := l.pos
+
+	switch {
+	case isNameStart(c):
+		for l.pos < len(l.src) && isName(l.src[l.pos]) {
+			l.pos++
+		}
+		s := l.src[start:l.pos]
+		if keywords[s] {
+			return token{typ: tokOp, s: s, line: l.line}, nil
+		}
+		return token{typ: tokName, s: s, line: l.line}, nil
+
+	case isDigit(c) || (c == '.' && l.pos+1 < len(l.src) && isDigit(l.src[l.pos+1])):
+		return l.number()
+
+	case c == '"' || c == '\'':
+		s, err := l.quoted(c)
+		return token{typ: tokString, s: s, line: l.line}, err
+
+	case c == '[':
+		if level := l.longBracket(); level >= 0 {
+			line := l.line
+			s, err := l.longString(level)
+			return token{typ: tokString, s: s, line: line}, err
+		}
+	}
+
+	for _, op := range operators {
+		if strings.HasPrefix(l.src[l.pos:], op) {
+			l.pos += len(op)
+			return token{typ: tokOp, s: op, line: l.line}, nil
+		}
+	}
+
+	return token{}, fmt.Errorf("unexpected character %q", c)
+}
+
+func (l *lexer) number() (token, error) {
+	start := l.pos
+
+	if strings.HasPrefix(l.src[l.pos:], "0x") || strings.HasPrefix(l.src[l.pos:], "0X") {
+		l.pos += 2
+		for l.pos < len(l.src) && strings.IndexByte("0123456789abcdefABCDEF", l.src[l.pos]) >= 0 {
+			l.pos++
+		}
+		n, err := strconv.ParseUint(l.src[start+2:l.pos], 16, 64)
+		if err != nil {
+			return token{}, fmt.Errorf("invalid number %v", l.src[start:l.pos])
+		}
+		return token{typ: tokNumber, n: float64(n), line: l.line}, nil
+	}
+
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if isDigit(c) || c == '.' {
+			l.pos++
+		} else if (c == 'e' || c == 'E') && l.pos+1 < len(l.src) {
+			l.pos++
+			if l.src[l.pos] == '+' || l.src[l.pos] == '-' {
+				l.pos++
+			}
+		} else {
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(l.src[start:l.pos], 64)
+	if err != nil || (l.pos < len(l.src) && isNameStart(l.src[l.pos])) {
+		return token{}, fmt.Errorf("invalid number %v", l.src[start:l.pos])
+	}
+
+	return token{typ: tokNumber, n: n, line: l.line}, nil
+}
+
+func (l *lexer) quoted(quote byte) (string, error) {
+	l.pos++
+
+	var b strings.Builder
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' {
+			return "", fmt.Errorf("unfinished string")
+		}
+
+		c := l.src[l.pos]
+		l.pos++
+
+		if c == quote {
+			return b.String(), nil
+		}
+
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+
+		if l.pos >= len(l.src) {
+			return "", fmt.Errorf("unfinished string")
+		}
+
+		c = l.src[l.pos]
+		l.pos++
+
+		switch c {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'v':
+			b.WriteByte('\v')
+		case '\\', '"', '\'':
+			b.WriteByte(c)
+		case '\n':
+			b.WriteByte('\n')
+			l.line++
+		case 'x':
+			if l.pos+2 > len(l.src) {
+				return "", fmt.Errorf("invalid escape")
+			}
+			n, err := strconv.ParseUint(l.src[l.pos:l.pos+2], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid escape")
+			}
+			b.WriteByte(byte(n))
+			l.pos += 2
+		default:
+			if !isDigit(c) {
+				return "", fmt.Errorf("invalid escape \\%c", c)
+			}
+			// up to 3 decimal digits
+			start := l.pos - 1
+			for l.pos < len(l.src) && l.pos-start < 3 && isDigit(l.src[l.pos]) {
+				l.pos++
+			}
+			n, err := strconv.Atoi(l.src[start:l.pos])
+			if err != nil || n > 255 {
+				return "", fmt.Errorf("invalid escape")
+			}
+			b.WriteByte(byte(n))
+		}
+	}
+}
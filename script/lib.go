@@ -0,0 +1,792 @@
+package script
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+// openLibs defines the standard functions. Functions that access files,
+// the OS, or load code are not available.
+func (s *Script) openLibs() {
+	fns := map[string]func(args []Value) ([]Value, error){
+		"print":    s.print,
+		"type":     libType,
+		"tostring": libToString,
+		"tonumber": libToNumber,
+		"pairs":    libPairs,
+		"ipairs":   libIpairs,
+		"next":     libNext,
+		"select":   libSelect,
+		"error":    s.libError,
+		"assert":   s.libAssert,
+		"pcall":    s.pcall,
+		"unpack":   libUnpack,
+	}
+	for name, fn := range fns {
+		s.Set(name, NewFunction(name, fn))
+	}
+
+	s.Set("math", newLib("math", map[string]func(args []Value) ([]Value, error){
+		"abs":    mathFn(math.Abs),
+		"ceil":   mathFn(math.Ceil),
+		"floor":  mathFn(math.Floor),
+		"sqrt":   mathFn(math.Sqrt),
+		"exp":    mathFn(math.Exp),
+		"sin":    mathFn(math.Sin),
+		"cos":    mathFn(math.Cos),
+		"tan":    mathFn(math.Tan),
+		"log":    mathLog,
+		"fmod":   mathFmod,
+		"max":    mathMax,
+		"min":    mathMin,
+		"random": mathRandom,
+	}, map[string]Value{"pi": math.Pi, "huge": math.Inf(1)}))
+
+	s.strings = newLib("string", map[string]func(args []Value) ([]Value, error){
+		"len":     strLen,
+		"sub":     strSub,
+		"upper":   strUpper,
+		"lower":   strLower,
+		"rep":     strRep,
+		"reverse": strReverse,
+		"byte":    strByte,
+		"char":    strChar,
+		"find":    strFind,
+		"format":  strFormat,
+	}, nil)
+	s.Set("string", s.strings)
+
+	s.Set("table", newLib("table", map[string]func(args []Value) ([]Value, error){
+		"insert": s.tableInsert,
+		"remove": tableRemove,
+		"concat": tableConcat,
+		"unpack": libUnpack,
+		"sort":   s.tableSort,
+	}, nil))
+
+	s.Set("os", newLib("os", map[string]func(args []Value) ([]Value, error){
+		"time": osTime,
+	}, nil))
+}
+
+func newLib(name string, fns map[string]func(args []Value) ([]Value, error),
+	values map[string]Value) *Table {
+	t := NewTable()
+
+	names := make([]string, 0, len(fns))
+	for n := range fns {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		t.Set(n, NewFunction(name+"."+n, fns[n]))
+	}
+	for n, v := range values {
+		t.Set(n, v)
+	}
+
+	return t
+}
+
+// arg returns an argument, or nil if it is missing
+func arg(args []Value, i int) Value {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+func numArg(args []Value, i int) (float64, error) {
+	n, ok := ToNumber(arg(args, i))
+	if !ok {
+		return 0, fmt.Errorf("bad argument #%v (number expected, got %v)", i+1,
+			TypeName(arg(args, i)))
+	}
+	return n, nil
+}
+
+// optNumArg returns a number argument, or def if it is nil
+func optNumArg(args []Value, i int, def float64) (float64, error) {
+	if arg(args, i) == nil {
+		return def, nil
+	}
+	return numArg(args, i)
+}
+
+func strArg(args []Value, i int) (string, error) {
+	switch v := arg(args, i).(type) {
+	case string:
+		return v, nil
+	case float64:
+		return formatNumber(v), nil
+	}
+	return "", fmt.Errorf("bad argument #%v (string expected, got %v)", i+1,
+		TypeName(arg(args, i)))
+}
+
+func tableArg(args []Value, i int) (*Table, error) {
+	t, ok := arg(args, i).(*Table)
+	if !ok {
+		return nil, fmt.Errorf("bad argument #%v (table expected, got %v)", i+1,
+			TypeName(arg(args, i)))
+	}
+	return t, nil
+}
+
+func (s *Script) print(args []Value) ([]Value, error) {
+	parts := make([]string, len(args))
+	for i, a := range args {
+		parts[i] = ToString(a)
+	}
+	msg := strings.Join(parts, "\t")
+
+	if s.Print != nil {
+		s.Print(msg)
+	} else {
+		log.Printf("%v: %v\n", s.name, msg)
+	}
+	return nil, nil
+}
+
+func libType(args []Value) ([]Value, error) {
+	if len(args) == 0 {
+		return nil, errors.New("bad argument #1 (value expected)")
+	}
+	return []Value{TypeName(args[0])}, nil
+}
+
+func libToString(args []Value) ([]Value, error) {
+	return []Value{ToString(arg(args, 0))}, nil
+}
+
+func libToNumber(args []Value) ([]Value, error) {
+	if n, ok := ToNumber(arg(args, 0)); ok {
+		return []Value{n}, nil
+	}
+	return []Value{nil}, nil
+}
+
+var nextFunction = NewFunction("next", libNext)
+
+func libNext(args []Value) ([]Value, error) {
+	t, err := tableArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	k, v, ok := t.Next(arg(args, 1))
+	if !ok {
+		return nil, errors.New("invalid key to 'next'")
+	}
+	if k == nil {
+		return []Value{nil}, nil
+	}
+	return []Value{k, v}, nil
+}
+
+func libPairs(args []Value) ([]Value, error) {
+	t, err := tableArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return []Value{nextFunction, t, nil}, nil
+}
+
+var ipairsIterator = NewFunction("ipairs", func(args []Value) ([]Value, error) {
+	t, err := tableArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	i, _ := ToNumber(arg(args, 1))
+	v := t.Get(i + 1)
+	if v == nil {
+		return []Value{nil}, nil
+	}
+	return []Value{i + 1, v}, nil
+})
+
+func libIpairs(args []Value) ([]Value, error) {
+	t, err := tableArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return []Value{ipairsIterator, t, 0.0}, nil
+}
+
+func libSelect(args []Value) ([]Value, error) {
+	if s, ok := arg(args, 0).(string); ok && s == "#" {
+		return []Value{float64(len(args) - 1)}, nil
+	}
+
+	n, err := numArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	i := int(n)
+	if i < 0 {
+		i = len(args) + i
+	}
+	if i < 1 {
+		return nil, errors.New("bad argument #1 (index out of range)")
+	}
+	if i >= len(args) {
+		return nil, nil
+	}
+	return args[i:], nil
+}
+
+func (s *Script) libError(args []Value) ([]Value, error) {
+	return nil, &Error{Script: s.name, Value: arg(args, 0)}
+}
+
+func (s *Script) libAssert(args []Value) ([]Value, error) {
+	if Truthy(arg(args, 0)) {
+		return args, nil
+	}
+
+	msg := arg(args, 1)
+	if msg == nil {
+		msg = "assertion failed!"
+	}
+	return nil, &Error{Script: s.name, Value: msg}
+}
+
+// pcall calls a function and returns false and the error instead of
+// stopping the script. Limit errors can't be caught.
+func (s *Script) pcall(args []Value) ([]Value, error) {
+	if len(args) == 0 {
+		return nil, errors.New("bad argument #1 (value expected)")
+	}
+
+	depth := s.depth
+	ret, err := s.call(args[0], args[1:], 0)
+	if err == nil {
+		return append([]Value{true}, ret...), nil
+	}
+	s.depth = depth
+
+	e, ok := err.(*Error)
+	if !ok {
+		return []Value{false, err.Error()}, nil
+	}
+	if e.fatal() {
+		return nil, err
+	}
+	if e.Err == nil {
+		if msg, ok := e.Value.(string); ok && e.Line > 0 {
+			return []Value{false, fmt.Sprintf("%v:%v: %v", e.Script, e.Line, msg)}, nil
+		}
+		return []Value{false, e.Value}, nil
+	}
+	return []Value{false, e.Error()}, nil
+}
+
+func libUnpack(args []Value) ([]Value, error) {
+	t, err := tableArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := optNumArg(args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	j, err := optNumArg(args, 2, float64(t.Len()))
+	if err != nil {
+		return nil, err
+	}
+	if j-i >= maxTableSize {
+		return nil, errors.New("too many results to unpack")
+	}
+
+	var ret []Value
+	for ; i <= j; i++ {
+		ret = append(ret, t.Get(i))
+	}
+	return ret, nil
+}
+
+func mathFn(fn func(float64) float64) func(args []Value) ([]Value, error) {
+	return func(args []Value) ([]Value, error) {
+		n, err := numArg(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return []Value{fn(n)}, nil
+	}
+}
+
+func mathLog(args []Value) ([]Value, error) {
+	n, err := numArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	if arg(args, 1) == nil {
+		return []Value{math.Log(n)}, nil
+	}
+	base, err := numArg(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return []Value{math.Log(n) / math.Log(base)}, nil
+}
+
+func mathFmod(args []Value) ([]Value, error) {
+	a, err := numArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	b, err := numArg(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return []Value{math.Mod(a, b)}, nil
+}
+
+func mathMax(args []Value) ([]Value, error) {
+	ret, err := numArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(args); i++ {
+		n, err := numArg(args, i)
+		if err != nil {
+			return nil, err
+		}
+		ret = math.Max(ret, n)
+	}
+	return []Value{ret}, nil
+}
+
+func mathMin(args []Value) ([]Value, error) {
+	ret, err := numArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(args); i++ {
+		n, err := numArg(args, i)
+		if err != nil {
+			return nil, err
+		}
+		ret = math.Min(ret, n)
+	}
+	return []Value{ret}, nil
+}
+
+// mathRandom returns a number in [0,1), or an integer in [1,m] or [m,n]
+func mathRandom(args []Value) ([]Value, error) {
+	if len(args) == 0 {
+		return []Value{rand.Float64()}, nil
+	}
+
+	lo, hi := 1.0, 0.0
+	var err error
+	if len(args) == 1 {
+		hi, err = numArg(args, 0)
+	} else {
+		lo, err = numArg(args, 0)
+		if err == nil {
+			hi, err = numArg(args, 1)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if hi < lo {
+		return nil, errors.New("bad argument to 'random' (interval is empty)")
+	}
+	return []Value{lo + math.Floor(rand.Float64()*(hi-lo+1))}, nil
+}
+
+// strIndex converts a Lua string index, which starts at 1 and can be
+// negative from the end, to a Go index
+func strIndex(i float64, n int) int {
+	switch {
+	case i > 0:
+		return int(i)
+	case i == 0:
+		return 1
+	case -i > float64(n):
+		return 1
+	}
+	return n + int(i) + 1
+}
+
+func strLen(args []Value) ([]Value, error) {
+	str, err := strArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return []Value{float64(len(str))}, nil
+}
+
+func strSub(args []Value) ([]Value, error) {
+	str, err := strArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	i, err := optNumArg(args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	j, err := optNumArg(args, 2, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	start := strIndex(i, len(str))
+	end := len(str)
+	if j >= 0 || -j <= float64(len(str)) {
+		end = strIndex(j, len(str))
+	} else {
+		end = 0
+	}
+	if end > len(str) {
+		end = len(str)
+	}
+	if start > end {
+		return []Value{""}, nil
+	}
+	return []Value{str[start-1 : end]}, nil
+}
+
+func strUpper(args []Value) ([]Value, error) {
+	str, err := strArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return []Value{strings.ToUpper(str)}, nil
+}
+
+func strLower(args []Value) ([]Value, error) {
+	str, err := strArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return []Value{strings.ToLower(str)}, nil
+}
+
+func strRep(args []Value) ([]Value, error) {
+	str, err := strArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	n, err := numArg(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return []Value{""}, nil
+	}
+	if float64(len(str))*n > maxStringLen {
+		return nil, errors.New("string is too long")
+	}
+	return []Value{strings.Repeat(str, int(n))}, nil
+}
+
+func strReverse(args []Value) ([]Value, error) {
+	str, err := strArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	b := []byte(str)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return []Value{string(b)}, nil
+}
+
+func strByte(args []Value) ([]Value, error) {
+	str, err := strArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	i, err := optNumArg(args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	j, err := optNumArg(args, 2, i)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []Value
+	for k := strIndex(i, len(str)); k <= strIndex(j, len(str)) && k <= len(str); k++ {
+		ret = append(ret, float64(str[k-1]))
+	}
+	return ret, nil
+}
+
+func strChar(args []Value) ([]Value, error) {
+	b := make([]byte, len(args))
+	for i := range args {
+		n, err := numArg(args, i)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || n > 255 {
+			return nil, fmt.Errorf("bad argument #%v (value out of range)", i+1)
+		}
+		b[i] = byte(n)
+	}
+	return []Value{string(b)}, nil
+}
+
+// strFind finds plain text in a string. Patterns are not supported.
+func strFind(args []Value) ([]Value, error) {
+	str, err := strArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := strArg(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	init, err := optNumArg(args, 2, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	start := strIndex(init, len(str))
+	if start > len(str)+1 {
+		return []Value{nil}, nil
+	}
+
+	i := strings.Index(str[start-1:], sub)
+	if i < 0 {
+		return []Value{nil}, nil
+	}
+	i += start
+	return []Value{float64(i), float64(i + len(sub) - 1)}, nil
+}
+
+// strFormat supports the %d, %i, %u, %c, %x, %X, %o, %e, %E, %f, %g, %G,
+// %q, %s, and %% verbs with flags, width, and precision
+func strFormat(args []Value) ([]Value, error) {
+	format, err := strArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	n := 1
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+
+		j := i + 1
+		for j < len(format) && strings.IndexByte("-+ #0123456789.", format[j]) >= 0 {
+			j++
+		}
+		if j >= len(format) {
+			return nil, errors.New("invalid format string")
+		}
+
+		spec := format[i:j]
+		verb := format[j]
+		i = j
+
+		if verb == '%' {
+			b.WriteByte('%')
+			continue
+		}
+
+		if n >= len(args) {
+			return nil, fmt.Errorf("bad argument #%v (no value)", n+1)
+		}
+
+		switch verb {
+		case 'd', 'i', 'u', 'c', 'x', 'X', 'o':
+			v, err := numArg(args, n)
+			if err != nil {
+				return nil, err
+			}
+			switch verb {
+			case 'i', 'u':
+				verb = 'd'
+			case 'c':
+				b.WriteByte(byte(v))
+				n++
+				continue
+			}
+			fmt.Fprintf(&b, spec+string(verb), int64(v))
+		case 'e', 'E', 'f', 'g', 'G':
+			v, err := numArg(args, n)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&b, spec+string(verb), v)
+		case 's':
+			fmt.Fprintf(&b, spec+"s", ToString(args[n]))
+		case 'q':
+			fmt.Fprintf(&b, "%q", ToString(args[n]))
+		default:
+			return nil, fmt.Errorf("invalid conversion '%v' to 'format'", spec+string(verb))
+		}
+		n++
+
+		if b.Len() > maxStringLen {
+			return nil, errors.New("string is too long")
+		}
+	}
+
+	return []Value{b.String()}, nil
+}
+
+func (s *Script) tableInsert(args []Value) ([]Value, error) {
+	t, err := tableArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.allocate(tableEntryCost, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(args) {
+	case 2:
+		if t.Size() >= maxTableSize {
+			return nil, errors.New("table is too large")
+		}
+		return nil, t.Append(args[1])
+	case 3:
+		pos, err := numArg(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		n := t.Len()
+		if pos < 1 || pos > float64(n+1) {
+			return nil, errors.New("bad argument #2 to 'insert' (position out of bounds)")
+		}
+		if t.Size() >= maxTableSize {
+			return nil, errors.New("table is too large")
+		}
+		for i := float64(n); i >= pos; i-- {
+			t.Set(i+1, t.Get(i))
+		}
+		return nil, t.Set(pos, args[2])
+	}
+
+	return nil, errors.New("wrong number of arguments to 'insert'")
+}
+
+func tableRemove(args []Value) ([]Value, error) {
+	t, err := tableArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	n := float64(t.Len())
+	pos, err := optNumArg(args, 1, n)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 && arg(args, 1) == nil {
+		return []Value{nil}, nil
+	}
+	if pos < 1 || pos > n+1 {
+		return nil, errors.New("bad argument #2 to 'remove' (position out of bounds)")
+	}
+
+	v := t.Get(pos)
+	for i := pos; i < n; i++ {
+		t.Set(i, t.Get(i+1))
+	}
+	if pos <= n {
+		t.Set(n, nil)
+	}
+	return []Value{v}, nil
+}
+
+func tableConcat(args []Value) ([]Value, error) {
+	t, err := tableArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	sep := ""
+	if arg(args, 1) != nil {
+		sep, err = strArg(args, 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var b strings.Builder
+	n := t.Len()
+	for i := 1; i <= n; i++ {
+		s, ok := concatString(t.Get(float64(i)))
+		if !ok {
+			return nil, fmt.Errorf("invalid value (at index %v) in table for 'concat'", i)
+		}
+		if i > 1 {
+			b.WriteString(sep)
+		}
+		b.WriteString(s)
+		if b.Len() > maxStringLen {
+			return nil, errors.New("string is too long")
+		}
+	}
+	return []Value{b.String()}, nil
+}
+
+func (s *Script) tableSort(args []Value) ([]Value, error) {
+	t, err := tableArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	less := arg(args, 1)
+
+	n := t.Len()
+	values := make([]Value, n)
+	for i := range values {
+		values[i] = t.Get(float64(i + 1))
+	}
+
+	var sortErr error
+	sort.SliceStable(values, func(i, j int) bool {
+		if sortErr != nil {
+			return false
+		}
+
+		if less == nil {
+			r, err := s.compare("<", values[i], values[j], 0)
+			if err != nil {
+				sortErr = err
+				return false
+			}
+			return r.(bool)
+		}
+
+		ret, err := s.call(less, []Value{values[i], values[j]}, 0)
+		if err != nil {
+			sortErr = err
+			return false
+		}
+		return len(ret) > 0 && Truthy(ret[0])
+	})
+	if sortErr != nil {
+		return nil, sortErr
+	}
+
+	for i, v := range values {
+		t.Set(float64(i+1), v)
+	}
+	return nil, nil
+}
+
+func osTime(args []Value) ([]Value, error) {
+	return []Value{float64(time.Now().Unix())}, nil
+}
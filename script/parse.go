@@ -0,0 +1,669 @@
+package script
+
+import "fmt"
+
+type expr interface{}
+
+type stmt interface{}
+
+type block struct {
+	stmts []stmt
+}
+
+type constExpr struct {
+	v Value
+}
+
+type varargExpr struct {
+	line int
+}
+
+type nameExpr struct {
+	name string
+	line int
+}
+
+type indexExpr struct {
+	obj, key expr
+	line     int
+}
+
+type callExpr struct {
+	fn expr
+	// method is set for obj:method() calls
+	method string
+	args   []expr
+	line   int
+}
+
+type funcExpr struct {
+	name   string
+	params []string
+	vararg bool
+	body   *block
+}
+
+type binExpr struct {
+	op   string
+	l, r expr
+	line int
+}
+
+type unExpr struct {
+	op   string
+	e    expr
+	line int
+}
+
+type tableItem struct {
+	// key is nil for positional items
+	key   expr
+	value expr
+}
+
+type tableExpr struct {
+	items []tableItem
+	line  int
+}
+
+// parenExpr truncates multiple values to one
+type parenExpr struct {
+	e expr
+}
+
+type localStmt struct {
+	names []string
+	exprs []expr
+}
+
+type assignStmt struct {
+	targets []expr
+	exprs   []expr
+	line    int
+}
+
+type callStmt struct {
+	call *callExpr
+}
+
+type doStmt struct {
+	body *block
+}
+
+type whileStmt struct {
+	cond expr
+	body *block
+}
+
+type repeatStmt struct {
+	body *block
+	cond expr
+}
+
+type ifStmt struct {
+	conds  []expr
+	blocks []*block
+	// els is nil if there is no else
+	els *block
+}
+
+type numForStmt struct {
+	name               string
+	start, limit, step expr
+	body               *block
+	line               int
+}
+
+type genForStmt struct {
+	names []string
+	exprs []expr
+	body  *block
+	line  int
+}
+
+type localFuncStmt struct {
+	name string
+	fn   *funcExpr
+}
+
+type returnStmt struct {
+	exprs []expr
+}
+
+type breakStmt struct{}
+
+type parser struct {
+	tokens []token
+	pos    int
+	// vararg is true if the function being parsed takes ...
+	vararg bool
+	// depth is the nesting of the block or expression being parsed, which
+	// is limited to maxDepth so deeply nested scripts can't overflow the
+	// stack of the parser or interpreter
+	depth int
+}
+
+// parse parses a script into the body of its top level function
+func parse(src string) (*funcExpr, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens, vararg: true}
+
+	var ret *funcExpr
+	err = p.catch(func() {
+		body := p.block()
+		if p.peek().typ != tokEOF {
+			p.fail("unexpected %v", p.describe(p.peek()))
+		}
+		ret = &funcExpr{name: "main chunk", vararg: true, body: body}
+	})
+
+	return ret, err
+}
+
+// parseError is used to unwind the parser on errors
+type parseError struct {
+	err error
+}
+
+func (p *parser) catch(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			pe, ok := r.(parseError)
+			if !ok {
+				panic(r)
+			}
+			err = pe.err
+		}
+	}()
+
+	f()
+	return nil
+}
+
+func (p *parser) fail(format string, args ...interface{}) {
+	panic(parseError{fmt.Errorf("line %v: %v", p.peek().line,
+		fmt.Sprintf(format, args...))})
+}
+
+// enter starts a nested block or expression
+func (p *parser) enter() {
+	p.depth++
+	if p.depth > maxDepth {
+		p.fail("script is nested too deeply")
+	}
+}
+
+func (p *parser) describe(t token) string {
+	switch t.typ {
+	case tokEOF:
+		return "end of script"
+	case tokName:
+		return "'" + t.s + "'"
+	case tokNumber:
+		return "number"
+	case tokString:
+		return "string"
+	}
+	return "'" + t.s + "'"
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) advance() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// is returns true if the next token is the keyword or operator op
+func (p *parser) is(op string) bool {
+	t := p.peek()
+	return t.typ == tokOp && t.s == op
+}
+
+// accept skips the next token if it is op
+func (p *parser) accept(op string) bool {
+	if p.is(op) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) token {
+	if !p.is(op) {
+		p.fail("'%v' expected near %v", op, p.describe(p.peek()))
+	}
+	return p.advance()
+}
+
+func (p *parser) name() string {
+	t := p.peek()
+	if t.typ != tokName {
+		p.fail("name expected near %v", p.describe(t))
+	}
+	p.pos++
+	return t.s
+}
+
+// blockEnd returns true if the next token ends a block
+func (p *parser) blockEnd() bool {
+	t := p.peek()
+	if t.typ == tokEOF {
+		return true
+	}
+	if t.typ != tokOp {
+		return false
+	}
+	switch t.s {
+	case "end", "else", "elseif", "until":
+		return true
+	}
+	return false
+}
+
+func (p *parser) block() *block {
+	p.enter()
+	defer func() { p.depth-- }()
+
+	b := &block{}
+	for !p.blockEnd() {
+		if p.is("return") {
+			p.advance()
+			var exprs []expr
+			if !p.blockEnd() && !p.is(";") {
+				exprs = p.exprList()
+			}
+			p.accept(";")
+			b.stmts = append(b.stmts, &returnStmt{exprs: exprs})
+			if !p.blockEnd() {
+				p.fail("'end' expected near %v", p.describe(p.peek()))
+			}
+			break
+		}
+
+		s := p.statement()
+		if s != nil {
+			b.stmts = append(b.stmts, s)
+		}
+	}
+	return b
+}
+
+func (p *parser) statement() stmt {
+	t := p.peek()
+	line := t.line
+
+	if t.typ == tokOp {
+		switch t.s {
+		case ";":
+			p.advance()
+			return nil
+		case "break":
+			p.advance()
+			return &breakStmt{}
+		case "do":
+			p.advance()
+			body := p.block()
+			p.expect("end")
+			return &doStmt{body: body}
+		case "while":
+			p.advance()
+			cond := p.expr()
+			p.expect("do")
+			body := p.block()
+			p.expect("end")
+			return &whileStmt{cond: cond, body: body}
+		case "repeat":
+			p.advance()
+			body := p.block()
+			p.expect("until")
+			return &repeatStmt{body: body, cond: p.expr()}
+		case "if":
+			return p.ifStatement()
+		case "for":
+			return p.forStatement()
+		case "function":
+			p.advance()
+			var target expr = &nameExpr{name: p.name(), line: line}
+			name := target.(*nameExpr).name
+			method := false
+			for p.is(".") || p.is(":") {
+				method = p.advance().s == ":"
+				key := p.name()
+				name += "." + key
+				target = &indexExpr{obj: target, key: &constExpr{key}, line: line}
+				if method {
+					break
+				}
+			}
+			fn := p.funcBody(name, method)
+			return &assignStmt{targets: []expr{target}, exprs: []expr{fn}, line: line}
+		case "local":
+			p.advance()
+			if p.accept("function") {
+				name := p.name()
+				return &localFuncStmt{name: name, fn: p.funcBody(name, false)}
+			}
+			names := []string{p.name()}
+			for p.accept(",") {
+				names = append(names, p.name())
+			}
+			var exprs []expr
+			if p.accept("=") {
+				exprs = p.exprList()
+			}
+			return &localStmt{names: names, exprs: exprs}
+		}
+	}
+
+	e := p.suffixedExpr()
+	if p.is("=") || p.is(",") {
+		targets := []expr{e}
+		for p.accept(",") {
+			targets = append(targets, p.suffixedExpr())
+		}
+		for _, t := range targets {
+			switch t.(type) {
+			case *nameExpr, *indexExpr:
+			default:
+				p.fail("cannot assign to expression")
+			}
+		}
+		p.expect("=")
+		return &assignStmt{targets: targets, exprs: p.exprList(), line: line}
+	}
+
+	call, ok := e.(*callExpr)
+	if !ok {
+		p.fail("syntax error near %v", p.describe(p.peek()))
+	}
+	return &callStmt{call: call}
+}
+
+func (p *parser) ifStatement() stmt {
+	s := &ifStmt{}
+	p.advance()
+	for {
+		s.conds = append(s.conds, p.expr())
+		p.expect("then")
+		s.blocks = append(s.blocks, p.block())
+		if p.accept("elseif") {
+			continue
+		}
+		if p.accept("else") {
+			s.els = p.block()
+		}
+		p.expect("end")
+		return s
+	}
+}
+
+func (p *parser) forStatement() stmt {
+	line := p.advance().line
+	name := p.name()
+
+	if p.accept("=") {
+		s := &numForStmt{name: name, line: line}
+		s.start = p.expr()
+		p.expect(",")
+		s.limit = p.expr()
+		if p.accept(",") {
+			s.step = p.expr()
+		}
+		p.expect("do")
+		s.body = p.block()
+		p.expect("end")
+		return s
+	}
+
+	s := &genForStmt{names: []string{name}, line: line}
+	for p.accept(",") {
+		s.names = append(s.names, p.name())
+	}
+	p.expect("in")
+	s.exprs = p.exprList()
+	p.expect("do")
+	s.body = p.block()
+	p.expect("end")
+	return s
+}
+
+// funcBody parses the parameters and body of a function. Methods have a
+// self parameter.
+func (p *parser) funcBody(name string, method bool) *funcExpr {
+	fn := &funcExpr{name: name}
+	if method {
+		fn.params = append(fn.params, "self")
+	}
+
+	p.expect("(")
+	if !p.is(")") {
+		for {
+			if p.accept("...") {
+				fn.vararg = true
+				break
+			}
+			fn.params = append(fn.params, p.name())
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	p.expect(")")
+
+	vararg := p.vararg
+	p.vararg = fn.vararg
+	fn.body = p.block()
+	p.vararg = vararg
+
+	p.expect("end")
+	return fn
+}
+
+func (p *parser) exprList() []expr {
+	exprs := []expr{p.expr()}
+	for p.accept(",") {
+		exprs = append(exprs, p.expr())
+	}
+	return exprs
+}
+
+// binary operator precedence, left and right
+var precedence = map[string][2]int{
+	"or": {1, 1}, "and": {2, 2},
+	"<": {3, 3}, ">": {3, 3}, "<=": {3, 3}, ">=": {3, 3}, "~=": {3, 3}, "==": {3, 3},
+	"..": {9, 8},
+	"+":  {10, 10}, "-": {10, 10},
+	"*": {11, 11}, "/": {11, 11}, "//": {11, 11}, "%": {11, 11},
+	"^": {14, 13},
+}
+
+const unaryPrecedence = 12
+
+func (p *parser) expr() expr {
+	return p.subExpr(0)
+}
+
+// subExpr parses an expression with binary operators that bind tighter
+// than limit
+func (p *parser) subExpr(limit int) expr {
+	// each binary operator below nests the expression on its left
+	depth := p.depth
+	defer func() { p.depth = depth }()
+	p.enter()
+
+	var e expr
+
+	t := p.peek()
+	if t.typ == tokOp && (t.s == "not" || t.s == "-" || t.s == "#") {
+		p.advance()
+		operand := p.subExpr(unaryPrecedence)
+		if c, ok := operand.(*constExpr); ok && t.s == "-" {
+			if n, ok := c.v.(float64); ok {
+				operand = &constExpr{-n}
+				e = operand
+			}
+		}
+		if e == nil {
+			e = &unExpr{op: t.s, e: operand, line: t.line}
+		}
+	} else {
+		e = p.simpleExpr()
+	}
+
+	for {
+		t := p.peek()
+		prec, ok := precedence[t.s]
+		if t.typ != tokOp || !ok || prec[0] <= limit {
+			return e
+		}
+		p.advance()
+		p.enter()
+		r := p.subExpr(prec[1])
+		e = &binExpr{op: t.s, l: e, r: r, line: t.line}
+	}
+}
+
+func (p *parser) simpleExpr() expr {
+	t := p.peek()
+
+	switch t.typ {
+	case tokNumber:
+		p.advance()
+		return &constExpr{t.n}
+	case tokString:
+		p.advance()
+		return &constExpr{t.s}
+	case tokOp:
+		switch t.s {
+		case "nil":
+			p.advance()
+			return &constExpr{nil}
+		case "true":
+			p.advance()
+			return &constExpr{true}
+		case "false":
+			p.advance()
+			return &constExpr{false}
+		case "...":
+			if !p.vararg {
+				p.fail("cannot use '...' outside a vararg function")
+			}
+			p.advance()
+			return &varargExpr{line: t.line}
+		case "function":
+			p.advance()
+			return p.funcBody("anonymous", false)
+		case "{":
+			return p.table()
+		}
+	}
+
+	return p.suffixedExpr()
+}
+
+func (p *parser) primaryExpr() expr {
+	t := p.peek()
+	if t.typ == tokName {
+		p.advance()
+		return &nameExpr{name: t.s, line: t.line}
+	}
+
+	if p.accept("(") {
+		e := p.expr()
+		p.expect(")")
+		switch e.(type) {
+		case *callExpr, *varargExpr:
+			return &parenExpr{e}
+		}
+		return e
+	}
+
+	p.fail("unexpected %v", p.describe(t))
+	return nil
+}
+
+func (p *parser) suffixedExpr() expr {
+	depth := p.depth
+	defer func() { p.depth = depth }()
+
+	e := p.primaryExpr()
+
+	for {
+		p.enter()
+		t := p.peek()
+		switch {
+		case p.accept("."):
+			e = &indexExpr{obj: e, key: &constExpr{p.name()}, line: t.line}
+		case p.accept("["):
+			key := p.expr()
+			p.expect("]")
+			e = &indexExpr{obj: e, key: key, line: t.line}
+		case p.accept(":"):
+			method := p.name()
+			e = &callExpr{fn: e, method: method, args: p.callArgs(), line: t.line}
+		case p.is("(") || p.is("{") || t.typ == tokString:
+			e = &callExpr{fn: e, args: p.callArgs(), line: t.line}
+		default:
+			return e
+		}
+	}
+}
+
+func (p *parser) callArgs() []expr {
+	t := p.peek()
+	switch {
+	case t.typ == tokString:
+		p.advance()
+		return []expr{&constExpr{t.s}}
+	case p.is("{"):
+		return []expr{p.table()}
+	}
+
+	p.expect("(")
+	if p.accept(")") {
+		return nil
+	}
+	args := p.exprList()
+	p.expect(")")
+	return args
+}
+
+func (p *parser) table() expr {
+	t := p.expect("{")
+	e := &tableExpr{line: t.line}
+
+	for !p.is("}") {
+		switch {
+		case p.is("["):
+			p.advance()
+			key := p.expr()
+			p.expect("]")
+			p.expect("=")
+			e.items = append(e.items, tableItem{key: key, value: p.expr()})
+		case p.peek().typ == tokName && p.tokens[p.pos+1].typ == tokOp &&
+			p.tokens[p.pos+1].s == "=":
+			key := p.name()
+			p.advance()
+			e.items = append(e.items, tableItem{key: &constExpr{key}, value: p.expr()})
+		default:
+			e.items = append(e.items, tableItem{value: p.expr()})
+		}
+
+		if !p.accept(",") && !p.accept(";") {
+			break
+		}
+	}
+
+	p.expect("}")
+	return e
+}
@@ -0,0 +1,309 @@
+package script
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func run(t *testing.T, src string) []Value {
+	s, err := Parse("test", src)
+	if err != nil {
+		t.Fatal("Error parsing: ", err)
+	}
+
+	ret, err := s.Run()
+	if err != nil {
+		t.Fatal("Error running: ", err)
+	}
+	return ret
+}
+
+func TestScript(t *testing.T) {
+	for _, c := range []struct {
+		src string
+		exp []Value
+	}{
+		{"return 1 + 2 * 3 ^ 2, 7 // 2, -7 % 3, 2 ^ 3 ^ 2", []Value{19.0, 3.0, 2.0, 512.0}},
+		{"return 'a' .. 1 .. 'b', #'hello', 10 / 4", []Value{"a1b", 5.0, 2.5}},
+		{"return 1 < 2, 'a' < 'b', 1 == 1, 'x' ~= 'x', not nil", []Value{true, true, true, false, true}},
+		{"return nil or 'default', false and 1, 1 and 2", []Value{"default", false, 2.0}},
+		{"local a, b = 1; return a, b", []Value{1.0, nil}},
+		{"local t = {1, 2, 3, x = 'y', ['z'] = 4}; return #t, t.x, t.z, t[2]",
+			[]Value{3.0, "y", 4.0, 2.0}},
+		{`local s = 0
+		  for i = 1, 10 do s = s + i end
+		  for i = 10, 1, -3 do s = s + i end
+		  return s`, []Value{77.0}},
+		{`local keys = {}
+		  for k, v in pairs({a = 1, b = 2, c = 3}) do keys[#keys + 1] = k .. v end
+		  local sum = 0
+		  for i, v in ipairs({5, 6, nil, 8}) do sum = sum + v end
+		  return table.concat(keys, ","), sum`, []Value{"a1,b2,c3", 11.0}},
+		{`local i = 0
+		  while true do
+		    i = i + 1
+		    if i > 5 then break end
+		  end
+		  repeat local j = i; i = i - 1 until j < 3
+		  return i`, []Value{1.0}},
+		{`local function fib(n)
+		    if n < 2 then return n end
+		    return fib(n - 1) + fib(n - 2)
+		  end
+		  return fib(15)`, []Value{610.0}},
+		{`local function counter()
+		    local n = 0
+		    return function() n = n + 1; return n end
+		  end
+		  local c = counter()
+		  c(); c()
+		  return c()`, []Value{3.0}},
+		{`local obj = {n = 2}
+		  function obj:double() return self.n * 2 end
+		  return obj:double()`, []Value{4.0}},
+		{`local function sum(...)
+		    local s = 0
+		    for _, v in ipairs({...}) do s = s + v end
+		    return s, select('#', ...)
+		  end
+		  return sum(1, 2, 3)`, []Value{6.0, 3.0}},
+		{`local function two() return 1, 2 end
+		  local t = {two(), two()}
+		  return #t, (two())`, []Value{3.0, 1.0}},
+		{`if false then return 1 elseif nil then return 2 else return 3 end`, []Value{3.0}},
+		{`return string.format("%5.1f|%d|%s|%x|%%", 3.14159, 42.9, "hi", 255)`,
+			[]Value{"  3.1|42|hi|ff|%"}},
+		{`local s = "Hello"
+		  return s:upper(), s:sub(2, -2), s:len(), ("x"):rep(3), s:find("ll")`,
+			[]Value{"HELLO", "ell", 5.0, "xxx", 3.0, 4.0}},
+		{`local t = {3, 1, 2}
+		  table.sort(t)
+		  table.insert(t, 1, 0)
+		  local last = table.remove(t)
+		  table.sort(t, function(a, b) return a > b end)
+		  return table.concat(t, " "), last`, []Value{"2 1 0", 3.0}},
+		{`return math.floor(2.7), math.max(1, 5, 3), math.min(4, 2), math.abs(-1)`,
+			[]Value{2.0, 5.0, 2.0, 1.0}},
+		{`return tostring(1.5), tostring(10), tonumber("0x10"), tonumber("abc"), type({})`,
+			[]Value{"1.5", "10", 16.0, nil, "table"}},
+		{`local ok, err = pcall(function() error("bad") end)
+		  local ok2, v = pcall(function() return 5 end)
+		  return ok, err, ok2, v`, []Value{false, "test:1: bad", true, 5.0}},
+		{`--[[ long
+		  comment ]] local s = [[
+line]] -- comment
+		  return s, "tab\there\65"`, []Value{"line", "tab\thereA"}},
+	} {
+		ret := run(t, c.src)
+		if !reflect.DeepEqual(ret, c.exp) {
+			t.Errorf("%v\nreturned %#v, expected %#v", c.src, ret, c.exp)
+		}
+	}
+}
+
+func TestScriptErrors(t *testing.T) {
+	for _, src := range []string{
+		"x = ",
+		"local 1 = 2",
+		"if x then",
+		"return 1 return 2",
+		"x = 'unfinished",
+		"f() = 1",
+		"local function f() return ... end",
+		// nesting that would overflow the stack
+		"return " + strings.Repeat("(", 10000) + "1" + strings.Repeat(")", 10000),
+		"return " + strings.Repeat("{", 10000) + strings.Repeat("}", 10000),
+		"return " + strings.Repeat("not ", 10000) + "1",
+		"return 1" + strings.Repeat(" + 1", 10000),
+		"return x" + strings.Repeat(".x", 10000),
+		strings.Repeat("do ", 10000) + strings.Repeat("end ", 10000),
+	} {
+		_, err := Parse("test", src)
+		if err == nil {
+			t.Errorf("expected parse error for %q", src)
+		}
+	}
+
+	for _, c := range []struct {
+		src, err string
+	}{
+		{"return 1 + {}", "test:1: attempt to perform arithmetic on a table value"},
+		{"local x\nx.y = 1", "test:2: attempt to index a nil value"},
+		{"undefined()", "test:1: attempt to call a nil value ('undefined')"},
+		{"return 1 < 'a'", "test:1: attempt to compare number with string"},
+		{"error('failed')", "test:1: failed"},
+		{"local function f() return f() + 1 end return f()", "stack overflow"},
+	} {
+		s, err := Parse("test", c.src)
+		if err != nil {
+			t.Fatal("Error parsing: ", err)
+		}
+
+		_, err = s.Run()
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q returned error %v, expected %v", c.src, err, c.err)
+		}
+	}
+}
+
+func TestScriptLimits(t *testing.T) {
+	s, err := Parse("test", "while true do end")
+	if err != nil {
+		t.Fatal("Error parsing: ", err)
+	}
+	s.MaxSteps = 1000
+
+	_, err = s.Run()
+	if !errors.Is(err, ErrStepLimit) {
+		t.Error("expected step limit error, got: ", err)
+	}
+
+	// the limit can't be caught
+	s, err = Parse("test", "pcall(function() while true do end end) return 1")
+	if err != nil {
+		t.Fatal("Error parsing: ", err)
+	}
+
+	_, err = s.Run()
+	if !errors.Is(err, ErrStepLimit) {
+		t.Error("expected step limit error, got: ", err)
+	}
+
+	s, err = Parse("test", "local s = 'x' while true do s = s .. s end")
+	if err != nil {
+		t.Fatal("Error parsing: ", err)
+	}
+
+	_, err = s.Run()
+	if err == nil || !strings.Contains(err.Error(), "string is too long") {
+		t.Error("expected string length error, got: ", err)
+	}
+
+	// many long strings that are each within the limits, even if the
+	// error is caught
+	s, err = Parse("test", `
+local big = string.rep("x", 1000000)
+local t = {}
+pcall(function()
+  for i = 1, 65536 do t[i] = big .. i end
+end)
+return #t`)
+	if err != nil {
+		t.Fatal("Error parsing: ", err)
+	}
+	s.MaxSteps = 0
+
+	_, err = s.Run()
+	if !errors.Is(err, ErrAllocLimit) {
+		t.Error("expected memory limit error, got: ", err)
+	}
+
+	// the budget is per run
+	s, err = Parse("test", `function f() return string.rep("x", 1000000) .. "y" end`)
+	if err != nil {
+		t.Fatal("Error parsing: ", err)
+	}
+	s.MaxAlloc = 3 << 20
+
+	_, err = s.Run()
+	if err != nil {
+		t.Fatal("Error running: ", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err = s.Call("f")
+		if err != nil {
+			t.Fatal("Error calling: ", err)
+		}
+	}
+
+	// globals are kept between runs, so the memory they keep is limited
+	s, err = Parse("test", `t = {} function f() t[#t + 1] = string.rep("x", 100000) end`)
+	if err != nil {
+		t.Fatal("Error parsing: ", err)
+	}
+	s.MaxRetained = 1 << 20
+
+	_, err = s.Run()
+	if err != nil {
+		t.Fatal("Error running: ", err)
+	}
+
+	for i := 0; i < 20 && err == nil; i++ {
+		_, err = s.Call("f")
+	}
+
+	if !errors.Is(err, ErrRetainedLimit) {
+		t.Error("expected retained memory limit error, got: ", err)
+	}
+
+	// memory that is not kept does not count
+	s, err = Parse("test", `function f() local s = string.rep("x", 100000) end`)
+	if err != nil {
+		t.Fatal("Error parsing: ", err)
+	}
+	s.MaxRetained = 1 << 20
+
+	_, err = s.Run()
+	if err != nil {
+		t.Fatal("Error running: ", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		_, err = s.Call("f")
+		if err != nil {
+			t.Fatal("Error calling: ", err)
+		}
+	}
+
+	// there is no access to the OS
+	ret := run(t, "return io, os.execute, load, require, dofile")
+	for _, v := range ret {
+		if v != nil {
+			t.Errorf("unexpected value: %v", ret)
+		}
+	}
+}
+
+func TestScriptCall(t *testing.T) {
+	s, err := Parse("test", `
+count = 0
+function on_event(name, t)
+  count = count + 1
+  return greet(name) .. " " .. t.value
+end`)
+	if err != nil {
+		t.Fatal("Error parsing: ", err)
+	}
+
+	s.Set("greet", NewFunction("greet", func(args []Value) ([]Value, error) {
+		return []Value{"hello " + ToString(args[0])}, nil
+	}))
+
+	_, err = s.Run()
+	if err != nil {
+		t.Fatal("Error running: ", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		ret, err := s.Call("on_event", "world", ToValue(map[string]interface{}{"value": 5}))
+		if err != nil {
+			t.Fatal("Error calling: ", err)
+		}
+		if !reflect.DeepEqual(ret, []Value{"hello world 5"}) {
+			t.Errorf("wrong result: %v", ret)
+		}
+	}
+
+	// globals are kept between calls
+	if s.Get("count") != 2.0 {
+		t.Error("wrong count: ", s.Get("count"))
+	}
+
+	_, err = s.Call("missing")
+	if err == nil {
+		t.Error("expected error calling missing function")
+	}
+}
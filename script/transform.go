@@ -0,0 +1,237 @@
+package script
+
+import (
+	"errors"
+	"log"
+	"math"
+	"sync"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// maxExpressionSteps limits the steps of transform expressions, which run
+// for every sample they match
+const maxExpressionSteps = 1000
+
+// maxExpressions limits the parsed expressions cached by a transformer.
+// The cache is cleared when it is full.
+const maxExpressions = 1000
+
+// ParseExpression parses a transform expression
+func ParseExpression(expr string) (*Script, error) {
+	s, err := Parse("expression", "return "+expr)
+	if err != nil {
+		return nil, err
+	}
+	s.MaxSteps = maxExpressionSteps
+	return s, nil
+}
+
+// Transformer applies the transforms in device configs to samples as they
+// are written. Parsed expressions are cached. It is safe for concurrent
+// use.
+type Transformer struct {
+	lock  sync.Mutex
+	exprs map[string]*Script
+}
+
+// NewTransformer creates a transformer
+func NewTransformer() *Transformer {
+	return &Transformer{exprs: make(map[string]*Script)}
+}
+
+// Apply transforms samples written by a device, and computes the virtual
+// points of the device whose inputs were written. Samples that don't match
+// a transform, samples written by scripts, and samples synced from an edge
+// server are not changed. If a
+// transform or virtual point fails, it is logged and skipped.
+func (t *Transformer) Apply(dev data.Device, samples []data.Sample) []data.Sample {
+	if len(dev.Config.Transforms) == 0 && len(dev.Config.Virtual) == 0 {
+		return samples
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	ret := make([]data.Sample, 0, len(samples))
+
+	// sample returns the latest value of a sample, looking at the samples
+	// already transformed before the device state
+	sample := func(typ, id string) (float64, bool) {
+		for i := len(ret) - 1; i >= 0; i-- {
+			if ret[i].Type == typ && ret[i].ID == id {
+				return ret[i].Value, true
+			}
+		}
+		for _, s := range dev.State.Ios {
+			if s.Type == typ && s.ID == id {
+				return s.Value, true
+			}
+		}
+		return 0, false
+	}
+
+	for _, s := range samples {
+		if s.Tags[data.ScriptTag] != "" || s.Tags[data.SyncTag] != "" {
+			ret = append(ret, s)
+			continue
+		}
+
+		var derived []data.Sample
+
+		for _, tr := range dev.Config.Transforms {
+			if !tr.Matches(s) {
+				continue
+			}
+
+			v, err := t.value(tr, s.Value, sample)
+			if err != nil {
+				log.Printf("Error transforming %v sample of device %v: %v\n",
+					s.Type, dev.ID, err)
+				continue
+			}
+
+			if tr.OutputType == "" {
+				s.Value = v
+				continue
+			}
+
+			d := s
+			d.Type = tr.OutputType
+			d.ID = tr.OutputID
+			d.Value = v
+			derived = append(derived, d)
+		}
+
+		ret = append(ret, s)
+		ret = append(ret, derived...)
+	}
+
+	// virtual points are computed in order, so a point can be the input
+	// of a later one
+	for _, p := range dev.Config.Virtual {
+		var last *data.Sample
+		for i := range ret {
+			if ret[i].Tags[data.ScriptTag] == "" && ret[i].Tags[data.SyncTag] == "" &&
+				p.Matches(ret[i]) &&
+				(last == nil || ret[i].Time.After(last.Time)) {
+				last = &ret[i]
+			}
+		}
+
+		if last == nil {
+			continue
+		}
+
+		v, ok, err := t.virtual(p, sample)
+		if err != nil {
+			log.Printf("Error computing virtual point %v of device %v: %v\n",
+				p.Type, dev.ID, err)
+			continue
+		}
+
+		if !ok {
+			continue
+		}
+
+		ret = append(ret, data.Sample{
+			Type:  p.Type,
+			ID:    p.ID,
+			Value: v,
+			Time:  last.Time,
+		})
+	}
+
+	return ret
+}
+
+// value runs the steps of a transform on a value
+func (t *Transformer) value(tr data.Transform, v float64,
+	sample func(typ, id string) (float64, bool)) (float64, error) {
+	v = tr.Linear(v)
+
+	if tr.Expression != "" {
+		var err error
+		v, err = t.eval(tr.Expression, v, sample)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return tr.Clamp(v), nil
+}
+
+// virtual computes a virtual point. It returns false if an input does not
+// have a value yet.
+func (t *Transformer) virtual(p data.VirtualPoint,
+	sample func(typ, id string) (float64, bool)) (float64, bool, error) {
+	var v float64
+	for i, in := range p.Inputs {
+		iv, ok := sample(in.Type, in.ID)
+		if !ok {
+			return 0, false, nil
+		}
+
+		if i == 0 {
+			v = iv
+		}
+	}
+
+	v = p.Interpolate(v)
+
+	if p.Expression != "" {
+		var err error
+		v, err = t.eval(p.Expression, v, sample)
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
+	return v, true, nil
+}
+
+// eval evaluates an expression
+func (t *Transformer) eval(expr string, v float64,
+	sample func(typ, id string) (float64, bool)) (float64, error) {
+	s, ok := t.exprs[expr]
+	if !ok {
+		var err error
+		s, err = ParseExpression(expr)
+		if err != nil {
+			return 0, err
+		}
+		if len(t.exprs) >= maxExpressions {
+			t.exprs = make(map[string]*Script)
+		}
+		t.exprs[expr] = s
+	}
+
+	s.Set("value", v)
+	s.Set("sample", NewFunction("sample", func(args []Value) ([]Value, error) {
+		typ, err := stringArg(args, 0, "sample type", true)
+		if err != nil {
+			return nil, err
+		}
+		id, err := stringArg(args, 1, "sample id", false)
+		if err != nil {
+			return nil, err
+		}
+
+		if v, ok := sample(typ, id); ok {
+			return []Value{v}, nil
+		}
+		return []Value{nil}, nil
+	}))
+
+	ret, err := s.Run()
+	if err != nil {
+		return 0, err
+	}
+
+	n, ok := ToNumber(arg(ret, 0))
+	if !ok || math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, errors.New("expression did not return a number")
+	}
+
+	return n, nil
+}
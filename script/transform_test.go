@@ -0,0 +1,117 @@
+package script
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func TestTransformer(t *testing.T) {
+	max := 50.0
+
+	dev := data.Device{
+		ID: "1234",
+		Config: data.DeviceConfig{
+			Transforms: []data.Transform{
+				{Type: "temp", From: "c", To: "k"},
+				{Type: "pressure", ID: "in", Offset: -1, Max: &max},
+				// dew point approximation from temp and humidity
+				{Type: "humidity", Expression: `sample("tempC") - (100 - value) / 5`,
+					OutputType: "dewPoint"},
+				{Type: "raw", Expression: "value / 0"},
+			},
+		},
+		State: data.DeviceState{
+			Ios: []data.Sample{{Type: "tempC", Value: 20}},
+		},
+	}
+
+	tr := NewTransformer()
+
+	ret := tr.Apply(dev, []data.Sample{
+		{Type: "temp", Value: 10},
+		{Type: "pressure", ID: "in", Value: 20},
+		{Type: "pressure", ID: "out", Value: 20},
+		{Type: "pressure", ID: "in", Value: 80},
+		{Type: "tempC", Value: 25},
+		{Type: "humidity", Value: 50},
+		{Type: "raw", Value: 1},
+		{Type: "temp", Value: 100, Tags: map[string]string{data.ScriptTag: "1"}},
+		{Type: "temp", Value: 100, Tags: map[string]string{data.SyncTag: "edge1"}},
+	})
+
+	exp := []data.Sample{
+		{Type: "temp", Value: 283.15},
+		{Type: "pressure", ID: "in", Value: 19},
+		{Type: "pressure", ID: "out", Value: 20},
+		{Type: "pressure", ID: "in", Value: 50},
+		{Type: "tempC", Value: 25},
+		{Type: "humidity", Value: 50},
+		{Type: "dewPoint", Value: 15},
+		{Type: "raw", Value: 1},
+		{Type: "temp", Value: 100, Tags: map[string]string{data.ScriptTag: "1"}},
+		{Type: "temp", Value: 100, Tags: map[string]string{data.SyncTag: "edge1"}},
+	}
+
+	if !reflect.DeepEqual(ret, exp) {
+		t.Errorf("wrong samples:\n%+v\nexpected:\n%+v", ret, exp)
+	}
+
+	_, err := ParseExpression("value +")
+	if err == nil {
+		t.Error("expected error parsing bad expression")
+	}
+}
+
+func TestVirtualPoints(t *testing.T) {
+	now := time.Now()
+
+	dev := data.Device{
+		ID: "1234",
+		Config: data.DeviceConfig{
+			Transforms: []data.Transform{
+				{Type: "current", Scale: 0.1},
+			},
+			Virtual: []data.VirtualPoint{
+				{Type: "power", Inputs: []data.VirtualInput{{Type: "voltage"}, {Type: "current"}},
+					Expression: "sample('voltage') * sample('current')"},
+				{Type: "energyRate", Inputs: []data.VirtualInput{{Type: "power"}},
+					Expression: "value / 1000"},
+				{Type: "volume", Inputs: []data.VirtualInput{{Type: "level", ID: "tank"}},
+					Table: []data.TableEntry{{In: 0, Out: 0}, {In: 10, Out: 100}}},
+			},
+		},
+		State: data.DeviceState{
+			Ios: []data.Sample{{Type: "voltage", Value: 120}},
+		},
+	}
+
+	tr := NewTransformer()
+
+	ret := tr.Apply(dev, []data.Sample{
+		{Type: "current", Value: 50, Time: now},
+		{Type: "level", ID: "tank", Value: 2.5, Time: now},
+	})
+
+	exp := []data.Sample{
+		{Type: "current", Value: 5, Time: now},
+		{Type: "level", ID: "tank", Value: 2.5, Time: now},
+		{Type: "power", Value: 600, Time: now},
+		{Type: "energyRate", Value: 0.6, Time: now},
+		{Type: "volume", Value: 25, Time: now},
+	}
+
+	if !reflect.DeepEqual(ret, exp) {
+		t.Errorf("wrong samples:\n%+v\nexpected:\n%+v", ret, exp)
+	}
+
+	// points aren't computed until all of the inputs have values, or if
+	// none of their inputs changed
+	dev.State.Ios = nil
+	ret = tr.Apply(dev, []data.Sample{{Type: "current", Value: 50, Time: now}})
+	if len(ret) != 1 {
+		t.Errorf("wrong samples: %+v", ret)
+	}
+}
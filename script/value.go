@@ -0,0 +1,315 @@
+package script
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Value is a script value: nil, bool, float64, string, *Table, *Function,
+// or *closure
+type Value interface{}
+
+// Function is a Go function that scripts can call
+type Function struct {
+	Name string
+	Fn   func(args []Value) ([]Value, error)
+}
+
+// NewFunction creates a function scripts can call
+func NewFunction(name string, fn func(args []Value) ([]Value, error)) *Function {
+	return &Function{Name: name, Fn: fn}
+}
+
+// closure is a script function and the scope it was defined in
+type closure struct {
+	fn    *funcExpr
+	scope *scope
+}
+
+type tableEntry struct {
+	key, value Value
+}
+
+// Table is a script table. Keys are iterated in the order they were added.
+type Table struct {
+	entries []tableEntry
+	index   map[Value]int
+	// removed is the number of entries with nil values
+	removed int
+	// border is the last length, which Len starts from
+	border int
+}
+
+// NewTable creates an empty table
+func NewTable() *Table {
+	return &Table{index: make(map[Value]int)}
+}
+
+// normalizeKey converts keys to the types used in the index, and returns
+// false for keys that can't be used
+func normalizeKey(k Value) (Value, bool) {
+	switch v := k.(type) {
+	case nil:
+		return nil, false
+	case float64:
+		if math.IsNaN(v) {
+			return nil, false
+		}
+	case int:
+		return float64(v), true
+	}
+	return k, true
+}
+
+// Get returns the value of a key, or nil
+func (t *Table) Get(k Value) Value {
+	k, ok := normalizeKey(k)
+	if !ok {
+		return nil
+	}
+	i, ok := t.index[k]
+	if !ok {
+		return nil
+	}
+	return t.entries[i].value
+}
+
+// Set sets the value of a key. Setting a key to nil removes it.
+func (t *Table) Set(k, v Value) error {
+	k, ok := normalizeKey(k)
+	if !ok {
+		return fmt.Errorf("table index is %v", TypeName(k))
+	}
+
+	if i, ok := t.index[k]; ok {
+		old := t.entries[i].value
+		t.entries[i].value = v
+		switch {
+		case old == nil && v != nil:
+			t.removed--
+		case old != nil && v == nil:
+			t.removed++
+			t.compact()
+		}
+		return nil
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	t.index[k] = len(t.entries)
+	t.entries = append(t.entries, tableEntry{k, v})
+	return nil
+}
+
+// compact drops removed entries once they are most of the table
+func (t *Table) compact() {
+	if t.removed < 16 || t.removed < len(t.entries)/2 {
+		return
+	}
+
+	entries := make([]tableEntry, 0, len(t.entries)-t.removed)
+	for _, e := range t.entries {
+		if e.value != nil {
+			t.index[e.key] = len(entries)
+			entries = append(entries, e)
+		} else {
+			delete(t.index, e.key)
+		}
+	}
+	t.entries = entries
+	t.removed = 0
+}
+
+// Len returns the length of the sequence from key 1
+func (t *Table) Len() int {
+	n := t.border
+	for n > 0 && t.Get(float64(n)) == nil {
+		n--
+	}
+	for t.Get(float64(n+1)) != nil {
+		n++
+	}
+	t.border = n
+	return n
+}
+
+// Size returns the number of keys
+func (t *Table) Size() int {
+	return len(t.entries) - t.removed
+}
+
+// Append adds a value to the end of the sequence
+func (t *Table) Append(v Value) error {
+	return t.Set(float64(t.Len()+1), v)
+}
+
+// Next returns the key and value after k, or the first if k is nil. ok is
+// false if k is not in the table.
+func (t *Table) Next(k Value) (key, value Value, ok bool) {
+	i := 0
+	if k != nil {
+		k, _ = normalizeKey(k)
+		j, found := t.index[k]
+		if !found {
+			return nil, nil, false
+		}
+		i = j + 1
+	}
+
+	for ; i < len(t.entries); i++ {
+		if t.entries[i].value != nil {
+			return t.entries[i].key, t.entries[i].value, true
+		}
+	}
+
+	return nil, nil, true
+}
+
+// TypeName returns the script type name of a value
+func TypeName(v Value) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *Table:
+		return "table"
+	case *Function, *closure:
+		return "function"
+	}
+	return "userdata"
+}
+
+// Truthy returns false for nil and false, and true for other values
+func Truthy(v Value) bool {
+	switch b := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return b
+	}
+	return true
+}
+
+// formatNumber formats numbers like Lua, with integers without a decimal
+// point
+func formatNumber(n float64) string {
+	if n == math.Trunc(n) && math.Abs(n) < 1e15 {
+		return strconv.FormatFloat(n, 'f', 0, 64)
+	}
+	switch {
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case math.IsNaN(n):
+		return "nan"
+	}
+	return strconv.FormatFloat(n, 'g', 14, 64)
+}
+
+// ToString converts a value to a string like the tostring function
+func ToString(v Value) string {
+	switch x := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		if x {
+			return "true"
+		}
+		return "false"
+	case float64:
+		return formatNumber(x)
+	case string:
+		return x
+	case *Function:
+		return "function: builtin: " + x.Name
+	case *closure:
+		return fmt.Sprintf("function: %p", x)
+	case *Table:
+		return fmt.Sprintf("table: %p", x)
+	}
+	return fmt.Sprint(v)
+}
+
+// ToNumber converts numbers and numeric strings to numbers
+func ToNumber(v Value) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case string:
+		s := strings.TrimSpace(x)
+		if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+			n, err := strconv.ParseUint(s[2:], 16, 64)
+			return float64(n), err == nil
+		}
+		n, err := strconv.ParseFloat(s, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// ToValue converts Go values like ints, maps, and slices to script values
+func ToValue(v interface{}) Value {
+	switch x := v.(type) {
+	case nil, bool, float64, string, *Table, *Function:
+		return x
+	case int:
+		return float64(x)
+	case int64:
+		return float64(x)
+	case uint64:
+		return float64(x)
+	case float32:
+		return float64(x)
+	case []string:
+		t := NewTable()
+		for _, s := range x {
+			t.Append(s)
+		}
+		return t
+	case map[string]string:
+		t := NewTable()
+		for _, k := range sortedKeys(x) {
+			t.Set(k, x[k])
+		}
+		return t
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		t := NewTable()
+		for _, k := range keys {
+			t.Set(k, ToValue(x[k]))
+		}
+		return t
+	case []interface{}:
+		t := NewTable()
+		for _, s := range x {
+			t.Append(ToValue(s))
+		}
+		return t
+	}
+	return fmt.Sprint(v)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
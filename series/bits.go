@@ -0,0 +1,78 @@
+package series
+
+import "errors"
+
+var errEndOfStream = errors.New("unexpected end of bit stream")
+
+// bitWriter writes a stream of bits, most significant bit first
+type bitWriter struct {
+	buf []byte
+	// free is the number of unused bits in the last byte of buf
+	free uint8
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.free == 0 {
+		w.buf = append(w.buf, 0)
+		w.free = 8
+	}
+
+	w.free--
+	if bit {
+		w.buf[len(w.buf)-1] |= 1 << w.free
+	}
+}
+
+// writeBits writes the n least significant bits of v
+func (w *bitWriter) writeBits(v uint64, n uint8) {
+	for n > 0 {
+		n--
+		w.writeBit((v>>n)&1 == 1)
+	}
+}
+
+// bitReader reads a stream of bits written by bitWriter
+type bitReader struct {
+	buf []byte
+	pos int
+	// bit is the next bit to read in buf[pos], 7 is the msb
+	bit uint8
+}
+
+func newBitReader(buf []byte) *bitReader {
+	return &bitReader{buf: buf, bit: 7}
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= len(r.buf) {
+		return false, errEndOfStream
+	}
+
+	ret := (r.buf[r.pos]>>r.bit)&1 == 1
+
+	if r.bit == 0 {
+		r.bit = 7
+		r.pos++
+	} else {
+		r.bit--
+	}
+
+	return ret, nil
+}
+
+func (r *bitReader) readBits(n uint8) (uint64, error) {
+	var ret uint64
+	for ; n > 0; n-- {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+
+		ret <<= 1
+		if bit {
+			ret |= 1
+		}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,287 @@
+// Package series implements Gorilla style compression of time series data
+// (see "Gorilla: A Fast, Scalable, In-Memory Time Series Database",
+// Facebook 2015). Timestamps are stored as delta-of-deltas and values are
+// XORed with the previous value, so regularly sampled and slowly changing
+// data compresses to a few bits per point.
+//
+// Timestamps are stored with millisecond resolution.
+package series
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// Point is a single time/value pair
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// Encoder compresses points. Points should be appended in time order for
+// the best compression, but out of order points are supported.
+type Encoder struct {
+	w     bitWriter
+	count int
+
+	tPrev  int64
+	tDelta int64
+
+	vPrev    uint64
+	leading  uint8
+	trailing uint8
+}
+
+// NewEncoder creates a new encoder
+func NewEncoder() *Encoder {
+	return &Encoder{}
+}
+
+func toMs(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMs(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// Append adds a point to the series
+func (e *Encoder) Append(t time.Time, v float64) {
+	ts := toMs(t)
+	vb := math.Float64bits(v)
+
+	if e.count == 0 {
+		e.w.writeBits(uint64(ts), 64)
+		e.w.writeBits(vb, 64)
+		e.tPrev = ts
+		e.vPrev = vb
+		e.count++
+		return
+	}
+
+	e.appendTime(ts)
+	e.appendValue(vb)
+	e.count++
+}
+
+func (e *Encoder) appendTime(ts int64) {
+	delta := ts - e.tPrev
+	dod := delta - e.tDelta
+
+	switch {
+	case dod == 0:
+		e.w.writeBit(false)
+	case dod >= -64 && dod <= 63:
+		e.w.writeBits(0x2, 2)
+		e.w.writeBits(uint64(dod), 7)
+	case dod >= -256 && dod <= 255:
+		e.w.writeBits(0x6, 3)
+		e.w.writeBits(uint64(dod), 9)
+	case dod >= -2048 && dod <= 2047:
+		e.w.writeBits(0xe, 4)
+		e.w.writeBits(uint64(dod), 12)
+	default:
+		e.w.writeBits(0xf, 4)
+		e.w.writeBits(uint64(dod), 64)
+	}
+
+	e.tPrev = ts
+	e.tDelta = delta
+}
+
+func (e *Encoder) appendValue(vb uint64) {
+	xor := vb ^ e.vPrev
+	e.vPrev = vb
+
+	if xor == 0 {
+		e.w.writeBit(false)
+		return
+	}
+
+	e.w.writeBit(true)
+
+	leading := uint8(bits.LeadingZeros64(xor))
+	trailing := uint8(bits.TrailingZeros64(xor))
+
+	// leading zero count is stored in 5 bits
+	if leading > 31 {
+		leading = 31
+	}
+
+	if e.count > 1 && leading >= e.leading && trailing >= e.trailing {
+		// meaningful bits fit in the previous window
+		e.w.writeBit(false)
+		e.w.writeBits(xor>>e.trailing, 64-e.leading-e.trailing)
+		return
+	}
+
+	e.leading, e.trailing = leading, trailing
+	sigbits := 64 - leading - trailing
+
+	e.w.writeBit(true)
+	e.w.writeBits(uint64(leading), 5)
+	// 64 significant bits is stored as 0
+	e.w.writeBits(uint64(sigbits), 6)
+	e.w.writeBits(xor>>trailing, sigbits)
+}
+
+// Count returns the number of points in the series
+func (e *Encoder) Count() int {
+	return e.count
+}
+
+// Bytes returns the encoded series. The encoder can continue to be used
+// after Bytes is called.
+func (e *Encoder) Bytes() []byte {
+	header := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(header, uint64(e.count))
+	return append(header[:n], e.w.buf...)
+}
+
+// ErrInvalidSeries is returned if encoded data can't be decoded
+var ErrInvalidSeries = errors.New("invalid series data")
+
+// Decode decompresses a series encoded with Encoder
+func Decode(data []byte) ([]Point, error) {
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, ErrInvalidSeries
+	}
+
+	// the first point takes 128 bits and each point after it at least 2,
+	// so a count the data can't hold is rejected before it is used to
+	// size the result
+	bits := uint64(len(data)-n) * 8
+	if count > 0 && (bits < 128 || count-1 > (bits-128)/2) {
+		return nil, ErrInvalidSeries
+	}
+
+	r := newBitReader(data[n:])
+	ret := make([]Point, 0, count)
+
+	var ts, tDelta int64
+	var vb uint64
+	var leading, trailing uint8
+
+	for i := uint64(0); i < count; i++ {
+		if i == 0 {
+			t, err := r.readBits(64)
+			if err != nil {
+				return nil, ErrInvalidSeries
+			}
+
+			v, err := r.readBits(64)
+			if err != nil {
+				return nil, ErrInvalidSeries
+			}
+
+			ts, vb = int64(t), v
+			ret = append(ret, Point{fromMs(ts), math.Float64frombits(vb)})
+			continue
+		}
+
+		dod, err := readDod(r)
+		if err != nil {
+			return nil, ErrInvalidSeries
+		}
+
+		tDelta += dod
+		ts += tDelta
+
+		vb, leading, trailing, err = readValue(r, vb, leading, trailing)
+		if err != nil {
+			return nil, ErrInvalidSeries
+		}
+
+		ret = append(ret, Point{fromMs(ts), math.Float64frombits(vb)})
+	}
+
+	return ret, nil
+}
+
+// signExtend converts the n bit two's complement value v to an int64
+func signExtend(v uint64, n uint8) int64 {
+	shift := 64 - n
+	return int64(v<<shift) >> shift
+}
+
+func readDod(r *bitReader) (int64, error) {
+	// count the number of leading 1 bits in the control prefix (max 4)
+	var prefix int
+	for prefix < 4 {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			break
+		}
+		prefix++
+	}
+
+	var n uint8
+	switch prefix {
+	case 0:
+		return 0, nil
+	case 1:
+		n = 7
+	case 2:
+		n = 9
+	case 3:
+		n = 12
+	default:
+		n = 64
+	}
+
+	v, err := r.readBits(n)
+	if err != nil {
+		return 0, err
+	}
+
+	return signExtend(v, n), nil
+}
+
+func readValue(r *bitReader, prev uint64, leading, trailing uint8) (uint64, uint8, uint8, error) {
+	bit, err := r.readBit()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	if !bit {
+		return prev, leading, trailing, nil
+	}
+
+	bit, err = r.readBit()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	if bit {
+		l, err := r.readBits(5)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		sig, err := r.readBits(6)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		if sig == 0 {
+			sig = 64
+		}
+
+		leading = uint8(l)
+		trailing = 64 - leading - uint8(sig)
+	}
+
+	v, err := r.readBits(64 - leading - trailing)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return prev ^ (v << trailing), leading, trailing, nil
+}
@@ -0,0 +1,136 @@
+package series
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testRoundTrip(t *testing.T, points []Point) []byte {
+	e := NewEncoder()
+	for _, p := range points {
+		e.Append(p.Time, p.Value)
+	}
+
+	d := e.Bytes()
+
+	decoded, err := Decode(d)
+	if err != nil {
+		t.Fatal("Error decoding: ", err)
+	}
+
+	if len(decoded) != len(points) {
+		t.Fatalf("expected %v points, got %v", len(points), len(decoded))
+	}
+
+	for i := range points {
+		if !decoded[i].Time.Equal(points[i].Time) ||
+			math.Float64bits(decoded[i].Value) != math.Float64bits(points[i].Value) {
+			t.Fatalf("point %v: expected %v, got %v", i, points[i], decoded[i])
+		}
+	}
+
+	return d
+}
+
+func TestRegular(t *testing.T) {
+	start := time.Date(2019, 10, 1, 10, 0, 0, 0, time.UTC)
+	var points []Point
+
+	for i := 0; i < 1000; i++ {
+		points = append(points, Point{
+			Time:  start.Add(time.Duration(i) * 10 * time.Second),
+			Value: 20 + float64(i%10)/2,
+		})
+	}
+
+	d := testRoundTrip(t, points)
+
+	// 16 bytes per point uncompressed
+	if len(d) > len(points)*16/8 {
+		t.Errorf("poor compression, %v bytes for %v points", len(d), len(points))
+	}
+}
+
+func TestIrregular(t *testing.T) {
+	start := time.Date(2019, 10, 1, 10, 0, 0, 0, time.UTC)
+	points := []Point{
+		{start, 0},
+		{start.Add(time.Millisecond), -1.5},
+		{start.Add(time.Hour * 24 * 30), math.MaxFloat64},
+		{start.Add(time.Second), math.SmallestNonzeroFloat64},
+		{start.Add(time.Second * 2), math.Inf(-1)},
+		{start.Add(time.Second * 100), 1e-300},
+		{start.Add(time.Second * 99), 12345.678},
+		{start.Add(time.Second * 99), 12345.678},
+	}
+
+	testRoundTrip(t, points)
+}
+
+func TestDodBoundaries(t *testing.T) {
+	start := time.Date(2019, 10, 1, 10, 0, 0, 0, time.UTC)
+
+	// the edges of each delta-of-delta bucket
+	for _, dod := range []int64{-65, -64, -63, 63, 64, 65, -257, -256, -255,
+		255, 256, 257, -2049, -2048, -2047, 2047, 2048, 2049} {
+		points := []Point{
+			{start, 1},
+			{start.Add(10 * time.Second), 2},
+			{start.Add(20*time.Second + time.Duration(dod)*time.Millisecond), 3},
+		}
+
+		testRoundTrip(t, points)
+	}
+}
+
+func TestRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	ts := time.Date(2019, 10, 1, 10, 0, 0, 0, time.UTC)
+	var points []Point
+
+	for i := 0; i < 10000; i++ {
+		// mostly small jitter, with some large and negative steps
+		step := time.Duration(r.Intn(5000)-1000) * time.Millisecond
+		if r.Intn(20) == 0 {
+			step = time.Duration(r.Int63n(int64(48*time.Hour))) - 24*time.Hour
+		}
+		ts = ts.Add(step).Truncate(time.Millisecond)
+
+		v := math.Float64frombits(r.Uint64())
+		if r.Intn(2) == 0 {
+			v = float64(r.Intn(100)) / 4
+		}
+
+		points = append(points, Point{ts, v})
+	}
+
+	testRoundTrip(t, points)
+}
+
+func TestEmpty(t *testing.T) {
+	points, err := Decode(NewEncoder().Bytes())
+	if err != nil || len(points) != 0 {
+		t.Error("expected empty series: ", points, err)
+	}
+
+	_, err = Decode([]byte{5, 1, 2})
+	if err != ErrInvalidSeries {
+		t.Error("expected invalid series error, got: ", err)
+	}
+
+	// a huge count must not be used to allocate the result
+	huge := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(huge, math.MaxUint64)
+	_, err = Decode(append(huge[:n], make([]byte, 16)...))
+	if err != ErrInvalidSeries {
+		t.Error("expected invalid series error for huge count, got: ", err)
+	}
+
+	if !reflect.DeepEqual(NewEncoder().Bytes(), []byte{0}) {
+		t.Error("wrong encoding for empty series")
+	}
+}
@@ -1,49 +1,335 @@
 package sim
 
 import (
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/simpleiot/simpleiot/api"
+	"github.com/simpleiot/simpleiot/client"
 	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/system"
 )
 
-func packetDelay() {
-	time.Sleep(5 * time.Second)
+// SetpointCommand sets a setpoint of a simulated device. The id arg is the
+// sample ID, and the value arg is the new value.
+const SetpointCommand = "setpoint"
+
+// RebootCommand restarts a simulated device
+const RebootCommand = "reboot"
+
+// Config describes a simulated device
+type Config struct {
+	// ID is the device ID
+	ID string
+	// Server, NATS, and MQTT are the server URLs, like in client.Config
+	Server string
+	NATS   string
+	MQTT   string
+	// Key is the device key, which NATS and MQTT need. The HTTP API does
+	// not check keys.
+	Key string
+	// Interval is how often samples are sent (default 10s)
+	Interval time.Duration
+	// Points are the simulated samples (default DefaultPoints). Points for
+	// the sensors and 1-Wire probes in the device config are added.
+	Points func() []Point
+	// Seed seeds the random values. If 0, it is generated from the ID, so
+	// a device always generates the same values.
+	Seed int64
+}
+
+// Device simulates a device. It sends samples with realistic patterns,
+// simulates the sensors and 1-Wire probes in its config, runs its
+// schedules, and runs gpio, setpoint, and reboot commands.
+type Device struct {
+	// sent is first so it is aligned for atomic access on 32 bit systems
+	sent      uint64
+	config    Config
+	client    *client.Client
+	scheduler *system.Scheduler
+
+	lock   sync.Mutex
+	rand   *rand.Rand
+	base   []Point
+	points []Point
+	// gens keeps the generators of config points by type and id, so they
+	// continue when the config changes
+	gens    map[string]Generator
+	outputs map[string]float64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewDevice creates a simulated device. Start connects it to the server.
+func NewDevice(config Config) (*Device, error) {
+	if config.ID == "" {
+		return nil, errors.New("device id is required")
+	}
+
+	if config.Interval == 0 {
+		config.Interval = 10 * time.Second
+	}
+
+	if config.Points == nil {
+		config.Points = DefaultPoints
+	}
+
+	if config.Seed == 0 {
+		h := fnv.New64a()
+		h.Write([]byte(config.ID))
+		config.Seed = int64(h.Sum64())
+	}
+
+	points := config.Points()
+
+	d := &Device{
+		config:  config,
+		rand:    rand.New(rand.NewSource(config.Seed)),
+		base:    points,
+		points:  points,
+		gens:    make(map[string]Generator),
+		outputs: make(map[string]float64),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	key := config.Key
+	if key == "" {
+		key = config.ID
+	}
+
+	var err error
+	d.client, err = client.New(client.Config{
+		ID:        config.ID,
+		Key:       key,
+		Server:    config.Server,
+		NATS:      config.NATS,
+		MQTT:      config.MQTT,
+		OnConfig:  d.apply,
+		OnCommand: d.Command,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	d.scheduler = system.NewScheduler(d.Command)
+
+	return d, nil
 }
 
-// DeviceSim simulates a simple device
-func DeviceSim(portal, deviceID string) {
-	log.Printf("starting simulator: ID: %v, portal: %v\n", deviceID, portal)
+// Start connects to the server and sends samples until Stop is called.
+// The first samples are sent after delay, so a fleet of devices can
+// spread their load.
+func (d *Device) Start(delay time.Duration) {
+	d.client.Start()
+	d.send([]data.Sample{{Type: data.SampleTypeStartSystem, Value: 1}})
 
-	sendSamples := api.NewSendSamples(portal, deviceID, time.Second*10, false)
-	tempSim := NewSim(72, 0.2, 70, 75)
-	voltSim := NewSim(2, 0.1, 1, 5)
-	voltSim2 := NewSim(5, 0.5, 1, 10)
+	go func() {
+		defer close(d.done)
 
-	for {
-		samples := make([]data.Sample, 3)
-		samples[0] = data.Sample{
-			Type:  "temp",
-			Value: tempSim.Sim(),
+		select {
+		case <-time.After(delay):
+		case <-d.stop:
+			return
 		}
 
-		samples[1] = data.Sample{
-			ID:    "V0",
-			Type:  "volt",
-			Value: voltSim.Sim(),
+		ticker := time.NewTicker(d.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			d.send(d.Samples(time.Now()))
+
+			select {
+			case <-ticker.C:
+			case <-d.stop:
+				return
+			}
 		}
+	}()
+}
+
+// Stop disconnects the device from the server
+func (d *Device) Stop() {
+	close(d.stop)
+	<-d.done
+	d.scheduler.Stop()
+	d.client.Stop()
+}
+
+// Sent returns the number of samples the device generated
+func (d *Device) Sent() uint64 {
+	return atomic.LoadUint64(&d.sent)
+}
+
+// Buffered returns the number of samples waiting to be sent
+func (d *Device) Buffered() int {
+	return d.client.Buffered()
+}
 
-		samples[2] = data.Sample{
-			ID:    "V1",
-			Type:  "volt",
-			Value: voltSim2.Sim(),
+func (d *Device) send(samples []data.Sample) {
+	atomic.AddUint64(&d.sent, uint64(len(samples)))
+	d.client.Send(samples...)
+}
+
+// Samples returns the values of the points and outputs at t
+func (d *Device) Samples(t time.Time) []data.Sample {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	ret := make([]data.Sample, 0, len(d.points)+len(d.outputs))
+	for _, p := range d.points {
+		ret = append(ret, data.Sample{
+			Type:  p.Type,
+			ID:    p.ID,
+			Value: p.Gen.Value(t, d.rand),
+			Time:  t,
+		})
+	}
+
+	names := make([]string, 0, len(d.outputs))
+	for name := range d.outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		ret = append(ret, data.Sample{
+			Type:  system.SampleTypeDigitalOutput,
+			ID:    name,
+			Value: d.outputs[name],
+			Time:  t,
+		})
+	}
+
+	return ret
+}
+
+// generator returns the generator of a config point, creating it with gen
+// the first time
+func (d *Device) generator(typ, id string, gen func() Generator) Point {
+	k := typ + "." + id
+	g, ok := d.gens[k]
+	if !ok {
+		g = gen()
+		d.gens[k] = g
+	}
+	return Point{Type: typ, ID: id, Gen: g}
+}
+
+// apply applies a device config and reports it to the server
+func (d *Device) apply(config data.DeviceConfig) {
+	d.lock.Lock()
+
+	points := append([]Point{}, d.base...)
+
+	for _, s := range config.Sensors {
+		switch s.Type {
+		case data.SensorBME280:
+			points = append(points,
+				d.generator("temp", s.ID, func() Generator {
+					return &Daily{Mean: 21, Amplitude: 2, Peak: 16, Noise: 0.05}
+				}),
+				d.generator("humidity", s.ID, func() Generator {
+					return &Walk{Start: 45, Step: 0.5, Min: 30, Max: 60}
+				}),
+				d.generator("pressure", s.ID, func() Generator {
+					return &Walk{Start: 1013, Step: 0.2, Min: 990, Max: 1030}
+				}))
+		case data.SensorADS1115:
+			max := s.Range
+			if max == 0 {
+				max = 2.048
+			}
+			points = append(points, d.generator("voltage", s.ID, func() Generator {
+				return &Walk{Start: max / 2, Step: 0.01, Min: 0, Max: max}
+			}))
 		}
+	}
 
-		err := sendSamples(samples)
+	if config.OneWire != nil {
+		for _, p := range config.OneWire.Probes {
+			points = append(points, d.generator("temp", p.ID, func() Generator {
+				return &Daily{Mean: 4 + p.Offset, Amplitude: 1, Peak: 14, Noise: 0.05}
+			}))
+		}
+	}
+
+	d.points = points
+	d.lock.Unlock()
+
+	d.scheduler.Update(config)
+	d.client.ReportConfig(config, nil)
+}
+
+// Command runs a command from the server or a schedule
+func (d *Device) Command(cmd data.DeviceCommand) error {
+	switch cmd.Command {
+	case system.GpioCommand:
+		name := cmd.Args["name"]
+		if name == "" {
+			return errors.New("name arg is required")
+		}
+
+		d.lock.Lock()
+		v := d.outputs[name]
+		switch cmd.Args["value"] {
+		case "1", "true", "on":
+			v = 1
+		case "0", "false", "off":
+			v = 0
+		case "toggle":
+			v = 1 - v
+		default:
+			d.lock.Unlock()
+			return errors.New("value arg must be 1, 0, or toggle")
+		}
+		d.outputs[name] = v
+		d.lock.Unlock()
+
+		d.send([]data.Sample{{Type: system.SampleTypeDigitalOutput, ID: name,
+			Value: v}})
+
+	case SetpointCommand:
+		v, err := strconv.ParseFloat(cmd.Args["value"], 64)
 		if err != nil {
-			log.Println("Error sending samples: ", err)
+			return fmt.Errorf("invalid setpoint value: %v", cmd.Args["value"])
 		}
-		packetDelay()
+
+		d.send([]data.Sample{{Type: "setpoint", ID: cmd.Args["id"], Value: v}})
+
+	case RebootCommand:
+		log.Println("Simulated device rebooting: ", d.config.ID)
+
+		d.lock.Lock()
+		d.outputs = make(map[string]float64)
+		d.lock.Unlock()
+
+		d.send([]data.Sample{{Type: data.SampleTypeStartSystem, Value: 1}})
+
+	case data.PollCommand:
+		var samples []data.Sample
+		for _, s := range d.Samples(time.Now()) {
+			if s.Type == cmd.Args["type"] && (cmd.Args["id"] == "" || s.ID == cmd.Args["id"]) {
+				samples = append(samples, s)
+			}
+		}
+
+		if len(samples) == 0 {
+			return fmt.Errorf("no simulated point for %v", cmd.Args["type"])
+		}
+
+		d.send(samples)
+
+	default:
+		return fmt.Errorf("unsupported command: %v", cmd.Command)
 	}
+
+	return nil
 }
@@ -0,0 +1,107 @@
+// Package sim simulates devices for demos, frontend development, and
+// load testing a server. Simulated devices connect with the client
+// package like real devices, send samples with realistic patterns, and
+// follow their config and commands.
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Fleet is a group of simulated devices
+type Fleet struct {
+	devices  []*Device
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewFleet creates count simulated devices with config. If count is more
+// than 1, -<n> is appended to the config ID for each device.
+func NewFleet(config Config, count int) (*Fleet, error) {
+	if count < 1 {
+		return nil, errors.New("device count must be at least 1")
+	}
+
+	f := &Fleet{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	for i := 1; i <= count; i++ {
+		c := config
+		if count > 1 {
+			c.ID = fmt.Sprintf("%v-%v", config.ID, i)
+		}
+
+		d, err := NewDevice(c)
+		if err != nil {
+			return nil, err
+		}
+
+		f.devices = append(f.devices, d)
+		f.interval = d.config.Interval
+	}
+
+	return f, nil
+}
+
+// Start starts the devices. Their first samples are spread over the
+// sample interval, so the server load is even. If report is not 0, the
+// number of samples sent is logged every report interval.
+func (f *Fleet) Start(report time.Duration) {
+	log.Printf("Starting %v simulated devices\n", len(f.devices))
+
+	for i, d := range f.devices {
+		d.Start(f.interval * time.Duration(i) / time.Duration(len(f.devices)))
+	}
+
+	go func() {
+		defer close(f.done)
+
+		if report == 0 {
+			<-f.stop
+			return
+		}
+
+		ticker := time.NewTicker(report)
+		defer ticker.Stop()
+
+		last := uint64(0)
+		for {
+			select {
+			case <-ticker.C:
+				sent, buffered := f.Stats()
+				log.Printf("Simulator: %v samples/s, %v sent, %v buffered\n",
+					float64(sent-last)/report.Seconds(), sent, buffered)
+				last = sent
+			case <-f.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the devices
+func (f *Fleet) Stop() {
+	close(f.stop)
+	<-f.done
+
+	for _, d := range f.devices {
+		d.Stop()
+	}
+}
+
+// Stats returns the number of samples the devices generated, and the
+// number waiting to be sent. Buffered samples build up when the server
+// can't keep up.
+func (f *Fleet) Stats() (sent uint64, buffered int) {
+	for _, d := range f.devices {
+		sent += d.Sent()
+		buffered += d.Buffered()
+	}
+	return
+}
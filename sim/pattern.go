@@ -0,0 +1,131 @@
+package sim
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/simpleiot/simpleiot/system"
+)
+
+// Generator generates the values of a simulated point
+type Generator interface {
+	// Value returns the value at t. It is called at increasing times, and
+	// r is the random source of the device.
+	Value(t time.Time, r *rand.Rand) float64
+}
+
+// Walk is a random walk between Min and Max, like a slowly drifting
+// voltage. Each value moves up to Step from the last.
+type Walk struct {
+	Start, Step, Min, Max float64
+
+	v       float64
+	started bool
+}
+
+// Value returns the next value of the walk
+func (w *Walk) Value(t time.Time, r *rand.Rand) float64 {
+	if !w.started {
+		w.v = w.Start
+		w.started = true
+	}
+
+	w.v += (r.Float64()*2 - 1) * w.Step
+	w.v = math.Max(w.Min, math.Min(w.Max, w.v))
+	return w.v
+}
+
+// Daily is a daily cycle with noise, like outdoor temperature. The value
+// is highest at the Peak hour of the day in local time.
+type Daily struct {
+	Mean, Amplitude float64
+	Peak            float64
+	Noise           float64
+}
+
+// Value returns the value of the cycle at t
+func (d *Daily) Value(t time.Time, r *rand.Rand) float64 {
+	hour := float64(t.Hour()) + float64(t.Minute())/60 + float64(t.Second())/3600
+	v := d.Mean + d.Amplitude*math.Cos((hour-d.Peak)/24*2*math.Pi)
+	return v + r.NormFloat64()*d.Noise
+}
+
+// Counter is a value that increases at Rate per hour with random
+// variation, like an energy meter
+type Counter struct {
+	Start, Rate float64
+
+	v    float64
+	last time.Time
+}
+
+// Value returns the counter value at t
+func (c *Counter) Value(t time.Time, r *rand.Rand) float64 {
+	if c.last.IsZero() {
+		c.v = c.Start
+	} else if t.After(c.last) {
+		c.v += t.Sub(c.last).Hours() * c.Rate * r.Float64() * 2
+	}
+
+	c.last = t
+	return c.v
+}
+
+// Toggle is a digital value that switches between 0 and 1, like a door
+// contact. On and Off are the average times it stays on and off.
+type Toggle struct {
+	On, Off time.Duration
+
+	v    float64
+	next time.Time
+}
+
+// Value returns the state at t
+func (g *Toggle) Value(t time.Time, r *rand.Rand) float64 {
+	if g.next.IsZero() {
+		g.next = t.Add(g.duration(r))
+	}
+
+	for !t.Before(g.next) {
+		g.v = 1 - g.v
+		g.next = g.next.Add(g.duration(r))
+	}
+
+	return g.v
+}
+
+// duration returns a random time to stay in the current state
+func (g *Toggle) duration(r *rand.Rand) time.Duration {
+	mean := g.Off
+	if g.v != 0 {
+		mean = g.On
+	}
+
+	d := time.Duration(r.ExpFloat64() * float64(mean))
+	if d < time.Second {
+		d = time.Second
+	}
+	return d
+}
+
+// Point is a sample type simulated by a device
+type Point struct {
+	Type string
+	ID   string
+	Gen  Generator
+}
+
+// DefaultPoints returns the points simulated devices report if no points
+// are configured
+func DefaultPoints() []Point {
+	return []Point{
+		{Type: "temp", Gen: &Daily{Mean: 22, Amplitude: 3, Peak: 15, Noise: 0.1}},
+		{Type: "humidity", Gen: &Daily{Mean: 45, Amplitude: -10, Peak: 15, Noise: 0.5}},
+		{Type: "volt", ID: "V0", Gen: &Walk{Start: 2, Step: 0.1, Min: 1, Max: 5}},
+		{Type: "volt", ID: "V1", Gen: &Walk{Start: 5, Step: 0.5, Min: 1, Max: 10}},
+		{Type: "energy", Gen: &Counter{Rate: 1.5}},
+		{Type: system.SampleTypeDigitalInput, ID: "door",
+			Gen: &Toggle{On: 2 * time.Minute, Off: 30 * time.Minute}},
+	}
+}
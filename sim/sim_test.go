@@ -0,0 +1,140 @@
+package sim
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/system"
+)
+
+func TestPatterns(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	walk := &Walk{Start: 5, Step: 1, Min: 0, Max: 10}
+	daily := &Daily{Mean: 20, Amplitude: 5, Peak: 15}
+	counter := &Counter{Start: 100, Rate: 10}
+	toggle := &Toggle{On: time.Minute, Off: time.Minute}
+
+	last := 0.0
+	prev := 0.0
+	changes := 0
+	for i := 0; i < 24*60; i++ {
+		now := start.Add(time.Duration(i) * time.Minute)
+
+		if v := walk.Value(now, r); v < 0 || v > 10 {
+			t.Fatal("walk out of range: ", v)
+		}
+
+		c := counter.Value(now, r)
+		if c < last {
+			t.Fatal("counter decreased: ", c)
+		}
+		last = c
+
+		v := toggle.Value(now, r)
+		if v != 0 && v != 1 {
+			t.Fatal("toggle not digital: ", v)
+		}
+		if v != prev {
+			changes++
+		}
+		prev = v
+	}
+
+	if v := daily.Value(start.Add(15*time.Hour), r); v != 25 {
+		t.Error("daily peak is ", v)
+	}
+
+	if v := daily.Value(start.Add(27*time.Hour), r); v != 15 {
+		t.Error("daily low is ", v)
+	}
+
+	if changes < 100 {
+		t.Error("toggle changed too few times: ", changes)
+	}
+
+	if last < 150 || last > 350 {
+		t.Error("counter rate is wrong: ", last)
+	}
+}
+
+func TestDevice(t *testing.T) {
+	var lock sync.Mutex
+	var samples []data.Sample
+	reported := make(chan data.ConfigReport, 10)
+
+	config := data.DeviceConfig{
+		Sensors: []data.SensorConfig{{ID: "room", Type: data.SensorBME280}},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/samples"):
+			var s []data.Sample
+			json.NewDecoder(req.Body).Decode(&s)
+			lock.Lock()
+			samples = append(samples, s...)
+			lock.Unlock()
+		case strings.HasSuffix(req.URL.Path, "/config/reported"):
+			var r data.ConfigReport
+			json.NewDecoder(req.Body).Decode(&r)
+			reported <- r
+		case strings.HasSuffix(req.URL.Path, "/cmd"):
+			json.NewEncoder(res).Encode([]data.DeviceCommand{})
+		default:
+			json.NewEncoder(res).Encode(data.Device{ID: "sim", Config: config})
+		}
+	}))
+	defer server.Close()
+
+	d, err := NewDevice(Config{ID: "sim", Server: server.URL,
+		Interval: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal("Error creating device: ", err)
+	}
+
+	d.Start(0)
+	defer d.Stop()
+
+	select {
+	case <-reported:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for config report")
+	}
+
+	err = d.Command(data.DeviceCommand{Command: system.GpioCommand,
+		Args: map[string]string{"name": "fan", "value": "1"}})
+	if err != nil {
+		t.Fatal("Error running command: ", err)
+	}
+
+	err = d.Command(data.DeviceCommand{Command: "selfDestruct"})
+	if err == nil {
+		t.Error("expected error for unsupported command")
+	}
+
+	types := make(map[string]bool)
+	for start := time.Now(); time.Since(start) < 5*time.Second; {
+		lock.Lock()
+		for _, s := range samples {
+			types[s.Type+"."+s.ID] = true
+		}
+		lock.Unlock()
+
+		if types["humidity.room"] && types["digitalOutput.fan"] &&
+			types["startSystem."] && types["volt.V0"] {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Errorf("missing samples: %v", types)
+}
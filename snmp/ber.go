@@ -0,0 +1,393 @@
+package snmp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// errDecode is returned when a message can't be decoded
+var errDecode = errors.New("invalid snmp message")
+
+// BER and SNMP value types
+const (
+	TypeInteger        = 0x02
+	TypeOctetString    = 0x04
+	TypeNull           = 0x05
+	TypeOID            = 0x06
+	TypeIPAddress      = 0x40
+	TypeCounter32      = 0x41
+	TypeGauge32        = 0x42
+	TypeTimeTicks      = 0x43
+	TypeOpaque         = 0x44
+	TypeCounter64      = 0x46
+	TypeNoSuchObject   = 0x80
+	TypeNoSuchInstance = 0x81
+	TypeEndOfMibView   = 0x82
+
+	typeSequence = 0x30
+)
+
+// PDU types
+const (
+	pduGet      = 0xa0
+	pduResponse = 0xa2
+	pduTrapV1   = 0xa4
+	pduInform   = 0xa6
+	pduTrap     = 0xa7
+	pduReport   = 0xa8
+)
+
+// Variable is an OID and its value
+type Variable struct {
+	OID  string
+	Type byte
+	// Value is an int64 for integers, uint64 for counters, gauges, and
+	// time ticks, []byte for strings and opaque values, string for OIDs,
+	// net.IP for IP addresses, and nil for null or missing values
+	Value interface{}
+}
+
+// Float returns the value of a numeric variable, or a string that
+// contains a number. ok is false for other values.
+func (v Variable) Float() (f float64, ok bool) {
+	switch val := v.Value.(type) {
+	case int64:
+		return float64(val), true
+	case uint64:
+		return float64(val), true
+	case []byte:
+		if v.Type == TypeOctetString {
+			f, err := strconv.ParseFloat(strings.TrimSpace(string(val)), 64)
+			return f, err == nil
+		}
+	}
+	return 0, false
+}
+
+func (v Variable) String() string {
+	switch val := v.Value.(type) {
+	case nil:
+		switch v.Type {
+		case TypeNoSuchObject:
+			return "noSuchObject"
+		case TypeNoSuchInstance:
+			return "noSuchInstance"
+		case TypeEndOfMibView:
+			return "endOfMibView"
+		}
+		return "null"
+	case []byte:
+		if v.Type == TypeOctetString && isPrintable(val) {
+			return string(val)
+		}
+		return fmt.Sprintf("%x", val)
+	}
+	return fmt.Sprint(v.Value)
+}
+
+func isPrintable(b []byte) bool {
+	for _, c := range b {
+		if (c < 0x20 || c > 0x7e) && c != '\n' && c != '\r' && c != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// tlv encodes a type, length, and value
+func tlv(tag byte, content []byte) []byte {
+	n := len(content)
+	ret := []byte{tag}
+	switch {
+	case n < 0x80:
+		ret = append(ret, byte(n))
+	case n < 0x100:
+		ret = append(ret, 0x81, byte(n))
+	case n < 0x10000:
+		ret = append(ret, 0x82, byte(n>>8), byte(n))
+	default:
+		ret = append(ret, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(ret, content...)
+}
+
+func seq(items ...[]byte) []byte {
+	var content []byte
+	for _, i := range items {
+		content = append(content, i...)
+	}
+	return tlv(typeSequence, content)
+}
+
+// encInt encodes a signed integer in the fewest bytes
+func encInt(tag byte, v int64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		if (v >= -0x80 && v < 0x80) || len(b) == 8 {
+			break
+		}
+		v >>= 8
+	}
+	return tlv(tag, b)
+}
+
+// encUint encodes an unsigned integer, with a leading zero if the high bit
+// is set
+func encUint(tag byte, v uint64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+		if v == 0 {
+			break
+		}
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return tlv(tag, b)
+}
+
+func encString(v []byte) []byte {
+	return tlv(TypeOctetString, v)
+}
+
+// encOID encodes a dotted OID like 1.3.6.1.2.1.1.3.0
+func encOID(oid string) ([]byte, error) {
+	parts := strings.Split(strings.TrimPrefix(oid, "."), ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid oid: %v", oid)
+	}
+
+	ids := make([]uint64, len(parts))
+	for i, p := range parts {
+		v, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid oid: %v", oid)
+		}
+		ids[i] = v
+	}
+
+	if ids[0] > 2 || (ids[0] < 2 && ids[1] >= 40) {
+		return nil, fmt.Errorf("invalid oid: %v", oid)
+	}
+
+	var b []byte
+	ids = append([]uint64{ids[0]*40 + ids[1]}, ids[2:]...)
+	for _, id := range ids {
+		var sub []byte
+		sub = append(sub, byte(id&0x7f))
+		for id >>= 7; id > 0; id >>= 7 {
+			sub = append([]byte{byte(id&0x7f) | 0x80}, sub...)
+		}
+		b = append(b, sub...)
+	}
+
+	return tlv(TypeOID, b), nil
+}
+
+// encVariable encodes a variable binding
+func encVariable(v Variable) ([]byte, error) {
+	oid, err := encOID(v.OID)
+	if err != nil {
+		return nil, err
+	}
+
+	var value []byte
+	switch val := v.Value.(type) {
+	case nil:
+		tag := v.Type
+		if tag == 0 {
+			tag = TypeNull
+		}
+		value = tlv(tag, nil)
+	case int64:
+		value = encInt(TypeInteger, val)
+	case uint64:
+		value = encUint(v.Type, val)
+	case []byte:
+		tag := v.Type
+		if tag == 0 {
+			tag = TypeOctetString
+		}
+		value = tlv(tag, val)
+	case string:
+		value, err = encOID(val)
+		if err != nil {
+			return nil, err
+		}
+	case net.IP:
+		value = tlv(TypeIPAddress, val.To4())
+	default:
+		return nil, fmt.Errorf("unsupported snmp value type: %T", val)
+	}
+
+	return seq(oid, value), nil
+}
+
+// reader reads BER encoded values
+type reader struct {
+	b   []byte
+	err error
+}
+
+// next reads a value and returns its tag and content
+func (r *reader) next() (byte, []byte) {
+	if r.err != nil {
+		return 0, nil
+	}
+
+	if len(r.b) < 2 {
+		r.err = errDecode
+		return 0, nil
+	}
+
+	tag := r.b[0]
+	n := int(r.b[1])
+	b := r.b[2:]
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 3 || len(b) < size {
+			r.err = errDecode
+			return 0, nil
+		}
+		n = 0
+		for _, v := range b[:size] {
+			n = n<<8 | int(v)
+		}
+		b = b[size:]
+	}
+
+	if len(b) < n {
+		r.err = errDecode
+		return 0, nil
+	}
+
+	r.b = b[n:]
+	return tag, b[:n]
+}
+
+// expect reads a value with a tag
+func (r *reader) expect(tag byte) []byte {
+	t, content := r.next()
+	if r.err == nil && t != tag {
+		r.err = errDecode
+	}
+	return content
+}
+
+// sub reads a constructed value with a tag and returns a reader for its
+// content
+func (r *reader) sub(tag byte) *reader {
+	return &reader{b: r.expect(tag), err: r.err}
+}
+
+func (r *reader) int() int64 {
+	return decInt(r.expect(TypeInteger))
+}
+
+func (r *reader) string() []byte {
+	return r.expect(TypeOctetString)
+}
+
+func decInt(b []byte) int64 {
+	if len(b) == 0 || len(b) > 8 {
+		return 0
+	}
+	v := int64(int8(b[0]))
+	for _, c := range b[1:] {
+		v = v<<8 | int64(c)
+	}
+	return v
+}
+
+func decUint(b []byte) uint64 {
+	if len(b) > 9 {
+		return 0
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func decOID(b []byte) (string, error) {
+	if len(b) == 0 {
+		return "", errDecode
+	}
+
+	var ids []string
+	var id uint64
+	first := true
+	for i, c := range b {
+		id = id<<7 | uint64(c&0x7f)
+		if c&0x80 != 0 {
+			if i == len(b)-1 || id > 1<<32 {
+				return "", errDecode
+			}
+			continue
+		}
+
+		if first {
+			first = false
+			x, y := id/40, id%40
+			if x > 2 {
+				x, y = 2, id-80
+			}
+			ids = append(ids, strconv.FormatUint(x, 10), strconv.FormatUint(y, 10))
+		} else {
+			ids = append(ids, strconv.FormatUint(id, 10))
+		}
+		id = 0
+	}
+
+	return strings.Join(ids, "."), nil
+}
+
+// variables decodes a list of variable bindings
+func (r *reader) variables() []Variable {
+	list := r.sub(typeSequence)
+	var ret []Variable
+	for list.err == nil && len(list.b) > 0 {
+		vb := list.sub(typeSequence)
+		oid, err := decOID(vb.expect(TypeOID))
+		if err != nil && vb.err == nil {
+			vb.err = err
+		}
+
+		tag, content := vb.next()
+		if vb.err != nil {
+			r.err = vb.err
+			return nil
+		}
+
+		v := Variable{OID: oid, Type: tag}
+		switch tag {
+		case TypeInteger:
+			v.Value = decInt(content)
+		case TypeOctetString, TypeOpaque:
+			v.Value = append([]byte{}, content...)
+		case TypeOID:
+			v.Value, err = decOID(content)
+			if err != nil {
+				r.err = err
+				return nil
+			}
+		case TypeIPAddress:
+			v.Value = net.IP(append([]byte{}, content...))
+		case TypeCounter32, TypeGauge32, TypeTimeTicks, TypeCounter64:
+			v.Value = decUint(content)
+		}
+		ret = append(ret, v)
+	}
+
+	if list.err != nil {
+		r.err = list.err
+	}
+	return ret
+}
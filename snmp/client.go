@@ -0,0 +1,309 @@
+// Package snmp is an SNMP manager for polling agents like UPSs, switches,
+// and radios with v1, v2c, or v3 get requests, and receiving v1 and v2c
+// traps and informs. v3 supports MD5 and SHA authentication, and DES and
+// AES-128 privacy.
+package snmp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxOIDs is the most OIDs requested at once, to keep responses small
+const maxOIDs = 32
+
+// errTimeout is returned when an agent does not respond
+var errTimeout = errors.New("snmp request timeout")
+
+// Config describes how to connect to an agent
+type Config struct {
+	// Version is 1, 2c (default), or 3
+	Version string
+	// Community is used for v1 and v2c (default public)
+	Community string
+	// User is the v3 user. AuthProtocol is md5, sha, or blank for no
+	// authentication, and PrivProtocol is des, aes, or blank for no
+	// privacy.
+	User         string
+	AuthProtocol string
+	AuthPassword string
+	PrivProtocol string
+	PrivPassword string
+	// Timeout is how long the agent has to respond (default 5s)
+	Timeout time.Duration
+	// Retries is how many times a request is resent after a timeout
+	Retries int
+}
+
+// Validate checks the config is valid
+func (c Config) Validate() error {
+	switch c.Version {
+	case "", "1", "2c":
+	case "3":
+		if c.User == "" {
+			return errors.New("snmp v3 user is required")
+		}
+
+		switch c.AuthProtocol {
+		case "", "md5", "sha":
+		default:
+			return fmt.Errorf("unsupported snmp auth protocol: %v", c.AuthProtocol)
+		}
+
+		switch c.PrivProtocol {
+		case "", "des", "aes":
+		default:
+			return fmt.Errorf("unsupported snmp privacy protocol: %v", c.PrivProtocol)
+		}
+
+		if c.PrivProtocol != "" && c.AuthProtocol == "" {
+			return errors.New("snmp privacy requires authentication")
+		}
+
+		// RFC 3414 requires at least 8 characters
+		if (c.AuthProtocol != "" && len(c.AuthPassword) < 8) ||
+			(c.PrivProtocol != "" && len(c.PrivPassword) < 8) {
+			return errors.New("snmp v3 passwords must be at least 8 characters")
+		}
+	default:
+		return fmt.Errorf("unsupported snmp version: %v", c.Version)
+	}
+
+	return nil
+}
+
+// Client polls an agent. Its methods can be called concurrently, and
+// requests are sent one at a time.
+type Client struct {
+	conn      net.Conn
+	config    Config
+	usm       *usm
+	lock      sync.Mutex
+	requestID int32
+}
+
+// Dial creates a client for the agent at address. The port defaults to
+// 161.
+func Dial(address string, config Config) (*Client, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Community == "" {
+		config.Community = "public"
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "161")
+	}
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{conn: conn, config: config,
+		requestID: int32(time.Now().UnixNano() & 0x7fffffff)}
+
+	if config.Version == "3" {
+		c.usm = &usm{
+			user:     config.User,
+			auth:     config.AuthProtocol,
+			authPass: config.AuthPassword,
+			priv:     config.PrivProtocol,
+			privPass: config.PrivPassword,
+			salt:     uint64(time.Now().UnixNano()),
+		}
+	}
+
+	return c, nil
+}
+
+// Close closes the client
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Get returns the values of OIDs, like 1.3.6.1.2.1.1.3.0. OIDs the agent
+// doesn't have are returned with a nil value, and a type of
+// TypeNoSuchObject or TypeNoSuchInstance for v2c and v3 agents. v1 agents
+// return an ErrorStatus instead.
+func (c *Client) Get(oids ...string) ([]Variable, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var ret []Variable
+	for i := 0; i < len(oids); i += maxOIDs {
+		end := i + maxOIDs
+		if end > len(oids) {
+			end = len(oids)
+		}
+
+		vars, err := c.get(oids[i:end])
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, vars...)
+	}
+
+	return ret, nil
+}
+
+func (c *Client) get(oids []string) ([]Variable, error) {
+	req := pdu{tag: pduGet}
+	for _, o := range oids {
+		req.vars = append(req.vars, Variable{OID: o})
+	}
+
+	resp, err := c.request(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.errorStatus != 0 {
+		e := ErrorStatus{Status: resp.errorStatus}
+		if resp.errorIndex > 0 && resp.errorIndex <= len(oids) {
+			e.OID = oids[resp.errorIndex-1]
+		}
+		return nil, e
+	}
+
+	if len(resp.vars) != len(oids) {
+		return nil, errDecode
+	}
+
+	return resp.vars, nil
+}
+
+// request sends a request PDU and returns the response
+func (c *Client) request(req pdu) (pdu, error) {
+	c.requestID = (c.requestID + 1) & 0x7fffffff
+	req.requestID = c.requestID
+
+	if c.usm == nil {
+		version := version2c
+		if c.config.Version == "1" {
+			version = version1
+		}
+
+		msg, err := encodeCommunity(version, c.config.Community, req)
+		if err != nil {
+			return pdu{}, err
+		}
+
+		var resp pdu
+		err = c.exchange(msg, func(b []byte) bool {
+			m, err := decodeMessage(b, nil)
+			if err != nil || m.pdu.requestID != req.requestID ||
+				m.community != c.config.Community {
+				return false
+			}
+			resp = m.pdu
+			return true
+		})
+		return resp, err
+	}
+
+	if len(c.usm.engineID) == 0 {
+		err := c.discover()
+		if err != nil {
+			return pdu{}, err
+		}
+	}
+
+	// the request is retried once if the engine was reset
+	for i := 0; ; i++ {
+		resp, h, err := c.requestV3(c.usm.flags()|flagReportable, req)
+		if err != nil {
+			return pdu{}, err
+		}
+
+		if resp.tag != pduReport {
+			return resp, nil
+		}
+
+		if i == 0 && len(resp.vars) > 0 {
+			switch resp.vars[0].OID {
+			case oidNotInTimeWindow, oidUnknownEngineID:
+				c.usm.setEngine(h.engineID, h.boots, h.time)
+				continue
+			}
+		}
+
+		return pdu{}, reportError(resp)
+	}
+}
+
+func (c *Client) requestV3(flags byte, req pdu) (pdu, header, error) {
+	c.requestID = (c.requestID + 1) & 0x7fffffff
+	msgID := c.requestID
+
+	msg, err := c.usm.encode(msgID, flags, req)
+	if err != nil {
+		return pdu{}, header{}, err
+	}
+
+	var resp message
+	err = c.exchange(msg, func(b []byte) bool {
+		m, err := decodeMessage(b, c.usm)
+		if err != nil || m.header.msgID != msgID {
+			return false
+		}
+		resp = m
+		return true
+	})
+	return resp.pdu, resp.header, err
+}
+
+// discover finds the engine ID and clock of a v3 agent
+func (c *Client) discover() error {
+	resp, h, err := c.requestV3(flagReportable, pdu{tag: pduGet})
+	if err != nil {
+		return err
+	}
+
+	if resp.tag != pduReport || len(h.engineID) == 0 {
+		return errors.New("snmp engine discovery failed")
+	}
+
+	c.usm.setEngine(h.engineID, h.boots, h.time)
+	return nil
+}
+
+// exchange sends a message until match returns true for a received
+// message, or the retries run out
+func (c *Client) exchange(msg []byte, match func([]byte) bool) error {
+	buf := make([]byte, maxMessageSize)
+
+	for i := 0; i <= c.config.Retries; i++ {
+		_, err := c.conn.Write(msg)
+		if err != nil {
+			return err
+		}
+
+		c.conn.SetReadDeadline(time.Now().Add(c.config.Timeout))
+		for {
+			n, err := c.conn.Read(buf)
+			if err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					break
+				}
+				return err
+			}
+
+			if match(buf[:n]) {
+				return nil
+			}
+		}
+	}
+
+	return errTimeout
+}
@@ -0,0 +1,524 @@
+package snmp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SNMP versions as encoded in messages
+const (
+	version1  = 0
+	version2c = 1
+	version3  = 3
+)
+
+// pdu is a protocol data unit. Trap fields are only used for v1 traps.
+type pdu struct {
+	tag         byte
+	requestID   int32
+	errorStatus int
+	errorIndex  int
+	vars        []Variable
+
+	enterprise string
+	agent      net.IP
+	generic    int
+	specific   int
+	timestamp  uint64
+}
+
+func (p pdu) encode() ([]byte, error) {
+	var vars []byte
+	for _, v := range p.vars {
+		b, err := encVariable(v)
+		if err != nil {
+			return nil, err
+		}
+		vars = append(vars, b...)
+	}
+
+	var content []byte
+	if p.tag == pduTrapV1 {
+		enterprise, err := encOID(p.enterprise)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, enterprise...)
+		content = append(content, tlv(TypeIPAddress, p.agent.To4())...)
+		content = append(content, encInt(TypeInteger, int64(p.generic))...)
+		content = append(content, encInt(TypeInteger, int64(p.specific))...)
+		content = append(content, encUint(TypeTimeTicks, p.timestamp)...)
+	} else {
+		content = append(content, encInt(TypeInteger, int64(p.requestID))...)
+		content = append(content, encInt(TypeInteger, int64(p.errorStatus))...)
+		content = append(content, encInt(TypeInteger, int64(p.errorIndex))...)
+	}
+
+	content = append(content, tlv(typeSequence, vars)...)
+	return tlv(p.tag, content), nil
+}
+
+func decodePDU(r *reader) (pdu, error) {
+	tag, content := r.next()
+	if r.err != nil {
+		return pdu{}, r.err
+	}
+
+	p := pdu{tag: tag}
+	pr := &reader{b: content}
+
+	if tag == pduTrapV1 {
+		var err error
+		p.enterprise, err = decOID(pr.expect(TypeOID))
+		if err != nil {
+			return p, err
+		}
+		p.agent = net.IP(append([]byte{}, pr.expect(TypeIPAddress)...))
+		p.generic = int(pr.int())
+		p.specific = int(pr.int())
+		p.timestamp = decUint(pr.expect(TypeTimeTicks))
+	} else {
+		p.requestID = int32(pr.int())
+		p.errorStatus = int(pr.int())
+		p.errorIndex = int(pr.int())
+	}
+
+	p.vars = pr.variables()
+	return p, pr.err
+}
+
+// encodeCommunity encodes a v1 or v2c message
+func encodeCommunity(version int, community string, p pdu) ([]byte, error) {
+	b, err := p.encode()
+	if err != nil {
+		return nil, err
+	}
+	return seq(encInt(TypeInteger, int64(version)), encString([]byte(community)), b), nil
+}
+
+// message is a decoded message. community is only set for v1 and v2c
+// messages, and header for v3.
+type message struct {
+	version   int
+	community string
+	header    header
+	pdu       pdu
+}
+
+// header is the header and security parameters of a v3 message
+type header struct {
+	msgID    int32
+	flags    byte
+	engineID []byte
+	boots    int32
+	time     int32
+	user     string
+}
+
+// decodeMessage decodes a message. u is used to authenticate and decrypt
+// v3 messages, and v3 messages are not supported if it is nil.
+func decodeMessage(b []byte, u *usm) (message, error) {
+	r := reader{b: b}
+	m := r.sub(typeSequence)
+	version := int(m.int())
+	if m.err != nil {
+		return message{}, errDecode
+	}
+
+	switch version {
+	case version1, version2c:
+		community := string(m.string())
+		p, err := decodePDU(m)
+		return message{version: version, community: community, pdu: p}, err
+	case version3:
+		if u == nil {
+			return message{}, errors.New("snmp v3 is not supported")
+		}
+		h, p, err := u.decode(b)
+		return message{version: version, header: h, pdu: p}, err
+	}
+
+	return message{}, fmt.Errorf("unsupported snmp version: %v", version)
+}
+
+// v3 message flags
+const (
+	flagAuth       = 0x01
+	flagPriv       = 0x02
+	flagReportable = 0x04
+)
+
+// maxMessageSize is the largest message that is sent or received
+const maxMessageSize = 65507
+
+// usm is the v3 user based security model of a user on an agent. Keys are
+// localized to the agent's engine ID, which is discovered with the first
+// request.
+type usm struct {
+	user     string
+	auth     string
+	priv     string
+	authPass string
+	privPass string
+
+	engineID []byte
+	authKey  []byte
+	privKey  []byte
+	boots    int32
+	time     int32
+	// timeAt is when the engine time was received
+	timeAt time.Time
+	salt   uint64
+}
+
+func (u *usm) hash() func() hash.Hash {
+	if u.auth == "sha" {
+		return sha1.New
+	}
+	return md5.New
+}
+
+// passwordKey localizes a password to an engine ID as in RFC 3414 A.2
+func passwordKey(h func() hash.Hash, password string, engineID []byte) []byte {
+	d := h()
+	if len(password) > 0 {
+		const size = 1 << 20
+		buf := make([]byte, 64)
+		for i := 0; i < size; i += len(buf) {
+			for j := range buf {
+				buf[j] = password[(i+j)%len(password)]
+			}
+			d.Write(buf)
+		}
+	}
+	key := d.Sum(nil)
+
+	d = h()
+	d.Write(key)
+	d.Write(engineID)
+	d.Write(key)
+	return d.Sum(nil)
+}
+
+// setEngine sets the agent engine ID and clock
+func (u *usm) setEngine(id []byte, boots, t int32) {
+	if !bytes.Equal(id, u.engineID) {
+		u.engineID = append([]byte{}, id...)
+		u.authKey, u.privKey = nil, nil
+		if u.auth != "" {
+			u.authKey = passwordKey(u.hash(), u.authPass, u.engineID)
+		}
+		if u.priv != "" {
+			u.privKey = passwordKey(u.hash(), u.privPass, u.engineID)
+		}
+	}
+
+	u.boots = boots
+	u.time = t
+	u.timeAt = time.Now()
+}
+
+// clock returns the estimated engine boots and time
+func (u *usm) clock() (int32, int32) {
+	if u.timeAt.IsZero() {
+		return u.boots, u.time
+	}
+	return u.boots, u.time + int32(time.Since(u.timeAt)/time.Second)
+}
+
+func (u *usm) flags() byte {
+	var flags byte
+	if u.auth != "" {
+		flags |= flagAuth
+		if u.priv != "" {
+			flags |= flagPriv
+		}
+	}
+	return flags
+}
+
+// mac returns the truncated HMAC of a message
+func (u *usm) mac(msg []byte) []byte {
+	m := hmac.New(u.hash(), u.authKey)
+	m.Write(msg)
+	return m.Sum(nil)[:12]
+}
+
+// encrypt encrypts a scoped PDU and returns it with the privacy
+// parameters
+func (u *usm) encrypt(b []byte, boots, t int32) ([]byte, []byte, error) {
+	u.salt++
+	params := make([]byte, 8)
+
+	if u.priv == "des" {
+		binary.BigEndian.PutUint32(params, uint32(boots))
+		binary.BigEndian.PutUint32(params[4:], uint32(u.salt))
+
+		block, err := des.NewCipher(u.privKey[:8])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = u.privKey[8+i] ^ params[i]
+		}
+
+		if len(b)%8 != 0 {
+			b = append(b, make([]byte, 8-len(b)%8)...)
+		}
+		ret := make([]byte, len(b))
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(ret, b)
+		return ret, params, nil
+	}
+
+	binary.BigEndian.PutUint64(params, u.salt)
+	block, err := aes.NewCipher(u.privKey[:16])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ret := make([]byte, len(b))
+	cipher.NewCFBEncrypter(block, aesIV(boots, t, params)).XORKeyStream(ret, b)
+	return ret, params, nil
+}
+
+func aesIV(boots, t int32, params []byte) []byte {
+	iv := make([]byte, 16)
+	binary.BigEndian.PutUint32(iv, uint32(boots))
+	binary.BigEndian.PutUint32(iv[4:], uint32(t))
+	copy(iv[8:], params)
+	return iv
+}
+
+func (u *usm) decrypt(b, params []byte, boots, t int32) ([]byte, error) {
+	if len(params) != 8 {
+		return nil, errDecode
+	}
+
+	if u.priv == "des" {
+		if len(b)%8 != 0 {
+			return nil, errDecode
+		}
+
+		block, err := des.NewCipher(u.privKey[:8])
+		if err != nil {
+			return nil, err
+		}
+
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = u.privKey[8+i] ^ params[i]
+		}
+
+		ret := make([]byte, len(b))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(ret, b)
+		return ret, nil
+	}
+
+	block, err := aes.NewCipher(u.privKey[:16])
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]byte, len(b))
+	cipher.NewCFBDecrypter(block, aesIV(boots, t, params)).XORKeyStream(ret, b)
+	return ret, nil
+}
+
+// encode encodes a v3 message. reportable is set for requests, and
+// security is not used for engine discovery.
+func (u *usm) encode(msgID int32, flags byte, p pdu) ([]byte, error) {
+	pduBytes, err := p.encode()
+	if err != nil {
+		return nil, err
+	}
+
+	scoped := seq(encString(u.engineID), encString(nil), pduBytes)
+	boots, t := u.clock()
+
+	data := scoped
+	var privParams, authParams []byte
+	if flags&flagPriv != 0 {
+		var enc []byte
+		enc, privParams, err = u.encrypt(scoped, boots, t)
+		if err != nil {
+			return nil, err
+		}
+		data = encString(enc)
+	}
+
+	if flags&flagAuth != 0 {
+		authParams = make([]byte, 12)
+	}
+
+	user := u.user
+	if flags&flagAuth == 0 && len(u.engineID) == 0 {
+		// discovery
+		user = ""
+	}
+
+	// the fields before the auth params
+	secFields := [][]byte{encString(u.engineID),
+		encInt(TypeInteger, int64(boots)), encInt(TypeInteger, int64(t)),
+		encString([]byte(user))}
+	var secContent []byte
+	for _, f := range secFields {
+		secContent = append(secContent, f...)
+	}
+	authAt := len(secContent) + 2
+	secContent = append(secContent, encString(authParams)...)
+	secContent = append(secContent, encString(privParams)...)
+
+	sec := tlv(typeSequence, secContent)
+	authAt += len(sec) - len(secContent)
+	secString := encString(sec)
+	authAt += len(secString) - len(sec)
+
+	version := encInt(TypeInteger, version3)
+	global := seq(encInt(TypeInteger, int64(msgID)),
+		encInt(TypeInteger, maxMessageSize), encString([]byte{flags}),
+		encInt(TypeInteger, 3))
+	authAt += len(version) + len(global)
+
+	content := append(append(append(version, global...), secString...), data...)
+	msg := tlv(typeSequence, content)
+	authAt += len(msg) - len(content)
+
+	if flags&flagAuth != 0 {
+		copy(msg[authAt:], u.mac(msg))
+	}
+
+	return msg, nil
+}
+
+// decode decodes, authenticates, and decrypts a v3 message
+func (u *usm) decode(b []byte) (header, pdu, error) {
+	var h header
+
+	r := reader{b: b}
+	m := r.sub(typeSequence)
+	m.int()
+
+	g := m.sub(typeSequence)
+	h.msgID = int32(g.int())
+	g.int()
+	flags := g.string()
+	g.int()
+
+	s := (&reader{b: m.string(), err: m.err}).sub(typeSequence)
+	h.engineID = append([]byte{}, s.string()...)
+	h.boots = int32(s.int())
+	h.time = int32(s.int())
+	h.user = string(s.string())
+	authParams := s.string()
+	privParams := s.string()
+
+	if g.err != nil || s.err != nil || len(flags) != 1 {
+		return h, pdu{}, errDecode
+	}
+	h.flags = flags[0]
+
+	if h.flags&flagAuth != 0 {
+		if u.authKey == nil || !bytes.Equal(h.engineID, u.engineID) ||
+			len(authParams) != 12 {
+			return h, pdu{}, errors.New("snmp message authentication failed")
+		}
+
+		// authParams is part of b, so the offset can be found from the
+		// capacity
+		at := cap(b) - cap(authParams)
+		msg := append([]byte{}, b...)
+		copy(msg[at:at+12], make([]byte, 12))
+		if !hmac.Equal(u.mac(msg), authParams) {
+			return h, pdu{}, errors.New("snmp message authentication failed")
+		}
+	}
+
+	var scoped *reader
+	if h.flags&flagPriv != 0 {
+		if u.privKey == nil || h.flags&flagAuth == 0 {
+			return h, pdu{}, errors.New("snmp message decryption failed")
+		}
+
+		data, err := u.decrypt(m.string(), privParams, h.boots, h.time)
+		if err != nil {
+			return h, pdu{}, err
+		}
+		scoped = (&reader{b: data, err: m.err}).sub(typeSequence)
+	} else {
+		scoped = m.sub(typeSequence)
+	}
+
+	scoped.string()
+	scoped.string()
+	if scoped.err != nil {
+		return h, pdu{}, errDecode
+	}
+
+	p, err := decodePDU(scoped)
+	return h, p, err
+}
+
+// usm statistics OIDs, which are returned in reports
+var usmErrors = map[string]string{
+	"1.3.6.1.6.3.15.1.1.1.0": "unsupported security level",
+	"1.3.6.1.6.3.15.1.1.2.0": "not in time window",
+	"1.3.6.1.6.3.15.1.1.3.0": "unknown user name",
+	"1.3.6.1.6.3.15.1.1.4.0": "unknown engine id",
+	"1.3.6.1.6.3.15.1.1.5.0": "wrong digest",
+	"1.3.6.1.6.3.15.1.1.6.0": "decryption error",
+}
+
+const (
+	oidNotInTimeWindow = "1.3.6.1.6.3.15.1.1.2.0"
+	oidUnknownEngineID = "1.3.6.1.6.3.15.1.1.4.0"
+)
+
+// reportError returns the error of a report PDU
+func reportError(p pdu) error {
+	if len(p.vars) > 0 {
+		if e, ok := usmErrors[p.vars[0].OID]; ok {
+			return errors.New("snmp " + e)
+		}
+		return errors.New("snmp report " + p.vars[0].OID)
+	}
+	return errors.New("snmp report")
+}
+
+// error status names
+var errorStatuses = []string{"noError", "tooBig", "noSuchName", "badValue",
+	"readOnly", "genErr", "noAccess", "wrongType", "wrongLength",
+	"wrongEncoding", "wrongValue", "noCreation", "inconsistentValue",
+	"resourceUnavailable", "commitFailed", "undoFailed", "authorizationError",
+	"notWritable", "inconsistentName"}
+
+// ErrorStatus is returned when an agent responds with an error
+type ErrorStatus struct {
+	Status int
+	// OID is the variable that caused the error, if known
+	OID string
+}
+
+func (e ErrorStatus) Error() string {
+	name := strconv.Itoa(e.Status)
+	if e.Status >= 0 && e.Status < len(errorStatuses) {
+		name = errorStatuses[e.Status]
+	}
+	if e.OID != "" {
+		return fmt.Sprintf("snmp error %v for %v", name, e.OID)
+	}
+	return "snmp error " + name
+}
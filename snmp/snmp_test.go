@@ -0,0 +1,338 @@
+package snmp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBER(t *testing.T) {
+	oid, err := encOID("1.3.6.1.2.1.1.3.0")
+	if err != nil || !bytes.Equal(oid, []byte{6, 8, 0x2b, 6, 1, 2, 1, 1, 3, 0}) {
+		t.Errorf("wrong oid encoding: %x, %v", oid, err)
+	}
+
+	for _, o := range []string{"1.3.6.1.4.1.318.1.1.1.2.2.1.0", "2.999.1", "0.0"} {
+		b, err := encOID(o)
+		if err != nil {
+			t.Errorf("Error encoding %v: %v", o, err)
+			continue
+		}
+		d, err := decOID(b[2:])
+		if err != nil || d != o {
+			t.Errorf("oid %v decoded as %v, %v", o, d, err)
+		}
+	}
+
+	for _, o := range []string{"", "1", "1.x", "3.1", "1.40"} {
+		_, err := encOID(o)
+		if err == nil {
+			t.Errorf("expected error for oid %v", o)
+		}
+	}
+
+	for _, c := range []struct {
+		v   int64
+		exp string
+	}{{0, "020100"}, {127, "02017f"}, {128, "02020080"}, {-129, "0202ff7f"},
+		{-1, "0201ff"}} {
+		b := encInt(TypeInteger, c.v)
+		if hex.EncodeToString(b) != c.exp {
+			t.Errorf("%v encoded as %x", c.v, b)
+		}
+		if decInt(b[2:]) != c.v {
+			t.Errorf("%v decoded as %v", c.v, decInt(b[2:]))
+		}
+	}
+
+	vars := []Variable{
+		{OID: "1.3.6.1.2.1.1.1.0", Type: TypeOctetString, Value: []byte("UPS")},
+		{OID: "1.3.6.1.2.1.1.3.0", Type: TypeTimeTicks, Value: uint64(4000000000)},
+		{OID: "1.3.6.1.2.1.2.2.1.10.1", Type: TypeCounter64, Value: uint64(1 << 63)},
+		{OID: "1.3.6.1.2.1.1.2.0", Type: TypeOID, Value: "1.3.6.1.4.1.318"},
+		{OID: "1.3.6.1.2.1.4.20.1.1.1", Type: TypeIPAddress, Value: net.IP{10, 0, 0, 1}},
+		{OID: "1.3.6.1.2.1.33.1.2.3.0", Type: TypeInteger, Value: int64(-40)},
+		{OID: "1.3.6.1.2.1.1.9.0", Type: TypeNoSuchObject},
+	}
+
+	p := pdu{tag: pduResponse, requestID: 1234, vars: vars}
+	b, err := encodeCommunity(version2c, "public", p)
+	if err != nil {
+		t.Fatal("Error encoding: ", err)
+	}
+
+	m, err := decodeMessage(b, nil)
+	if err != nil {
+		t.Fatal("Error decoding: ", err)
+	}
+
+	if m.community != "public" || !reflect.DeepEqual(m.pdu, p) {
+		t.Errorf("wrong message: %+v", m)
+	}
+
+	f, ok := Variable{Type: TypeOctetString, Value: []byte(" 230.5")}.Float()
+	if !ok || f != 230.5 {
+		t.Error("wrong string value: ", f, ok)
+	}
+}
+
+// passwordKey test vectors from RFC 3414 A.3
+func TestPasswordKey(t *testing.T) {
+	engineID := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}
+
+	key := passwordKey(md5.New, "maplesyrup", engineID)
+	if hex.EncodeToString(key) != "526f5eed9fcce26f8964c2930787d82b" {
+		t.Errorf("wrong md5 key: %x", key)
+	}
+
+	key = passwordKey(sha1.New, "maplesyrup", engineID)
+	if hex.EncodeToString(key) != "6695febc9288e36282235fc7151f128497b38f3f" {
+		t.Errorf("wrong sha key: %x", key)
+	}
+}
+
+// testAgent responds to get requests with values from a map. v3 requests
+// use agentUSM.
+type testAgent struct {
+	conn     net.PacketConn
+	values   map[string]Variable
+	agentUSM *usm
+}
+
+func newTestAgent(t *testing.T, u *usm) *testAgent {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening: ", err)
+	}
+
+	a := &testAgent{
+		conn: conn,
+		values: map[string]Variable{
+			"1.3.6.1.2.1.1.5.0": {OID: "1.3.6.1.2.1.1.5.0", Type: TypeOctetString,
+				Value: []byte("ups-1")},
+			"1.3.6.1.2.1.33.1.2.4.0": {OID: "1.3.6.1.2.1.33.1.2.4.0",
+				Type: TypeInteger, Value: int64(97)},
+		},
+		agentUSM: u,
+	}
+
+	go a.serve()
+	return a
+}
+
+func (a *testAgent) response(req pdu) pdu {
+	resp := pdu{tag: pduResponse, requestID: req.requestID}
+	for _, v := range req.vars {
+		value, ok := a.values[v.OID]
+		if !ok {
+			value = Variable{OID: v.OID, Type: TypeNoSuchObject}
+		}
+		resp.vars = append(resp.vars, value)
+	}
+	return resp
+}
+
+func (a *testAgent) serve() {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := a.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		m, err := decodeMessage(buf[:n], a.agentUSM)
+
+		var b []byte
+		switch {
+		case m.version == version3 && (err != nil || len(m.header.engineID) == 0):
+			// reports are sent for discovery and authentication errors
+			oid := oidUnknownEngineID
+			if err != nil {
+				oid = "1.3.6.1.6.3.15.1.1.5.0"
+			}
+			report := pdu{tag: pduReport, requestID: m.pdu.requestID,
+				vars: []Variable{{OID: oid, Type: TypeCounter32, Value: uint64(1)}}}
+			b, err = a.agentUSM.encode(m.header.msgID, 0, report)
+		case err != nil:
+			continue
+		case m.version == version3:
+			b, err = a.agentUSM.encode(m.header.msgID, m.header.flags&^flagReportable,
+				a.response(m.pdu))
+		default:
+			if m.community != "public" {
+				continue
+			}
+			b, err = encodeCommunity(m.version, m.community, a.response(m.pdu))
+		}
+
+		if err == nil {
+			a.conn.WriteTo(b, addr)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	a := newTestAgent(t, nil)
+	defer a.conn.Close()
+
+	c, err := Dial(a.conn.LocalAddr().String(), Config{})
+	if err != nil {
+		t.Fatal("Error dialing: ", err)
+	}
+	defer c.Close()
+
+	vars, err := c.Get("1.3.6.1.2.1.33.1.2.4.0", "1.3.6.1.2.1.1.5.0",
+		"1.3.6.1.2.1.1.9.0")
+	if err != nil {
+		t.Fatal("Error getting: ", err)
+	}
+
+	if vars[0].Value != int64(97) || vars[1].String() != "ups-1" ||
+		vars[2].Type != TypeNoSuchObject || vars[2].Value != nil {
+		t.Errorf("wrong values: %+v", vars)
+	}
+
+	// the agent ignores requests with the wrong community
+	c, err = Dial(a.conn.LocalAddr().String(), Config{Community: "private",
+		Timeout: 50 * time.Millisecond, Retries: 1})
+	if err != nil {
+		t.Fatal("Error dialing: ", err)
+	}
+	defer c.Close()
+
+	_, err = c.Get("1.3.6.1.2.1.1.5.0")
+	if err != errTimeout {
+		t.Error("expected timeout, got: ", err)
+	}
+}
+
+func TestClientV3(t *testing.T) {
+	for _, c := range []struct{ auth, priv string }{
+		{"md5", "aes"}, {"sha", "des"}, {"sha", ""},
+	} {
+		agentUSM := &usm{user: "siot", auth: c.auth, authPass: "authpass1",
+			priv: c.priv, privPass: "privpass1"}
+		agentUSM.setEngine([]byte{0x80, 0, 0x1f, 0x88, 4, 't', 'e', 's', 't'}, 5, 1000)
+
+		a := newTestAgent(t, agentUSM)
+		defer a.conn.Close()
+
+		config := Config{Version: "3", User: "siot", AuthProtocol: c.auth,
+			AuthPassword: "authpass1", PrivProtocol: c.priv,
+			PrivPassword: "privpass1", Timeout: time.Second}
+
+		client, err := Dial(a.conn.LocalAddr().String(), config)
+		if err != nil {
+			t.Fatal("Error dialing: ", err)
+		}
+		defer client.Close()
+
+		vars, err := client.Get("1.3.6.1.2.1.33.1.2.4.0")
+		if err != nil {
+			t.Errorf("Error getting with %v/%v: %v", c.auth, c.priv, err)
+			continue
+		}
+
+		if vars[0].Value != int64(97) {
+			t.Errorf("wrong value with %v/%v: %+v", c.auth, c.priv, vars)
+		}
+
+		config.AuthPassword = "wrongpass"
+		client, err = Dial(a.conn.LocalAddr().String(), config)
+		if err != nil {
+			t.Fatal("Error dialing: ", err)
+		}
+		defer client.Close()
+
+		_, err = client.Get("1.3.6.1.2.1.33.1.2.4.0")
+		if err == nil || err.Error() != "snmp wrong digest" {
+			t.Error("expected wrong digest error, got: ", err)
+		}
+	}
+}
+
+func TestTraps(t *testing.T) {
+	traps := make(chan Trap, 10)
+	l, err := ListenTraps("127.0.0.1:0", "public", func(trap Trap) {
+		traps <- trap
+	})
+	if err != nil {
+		t.Fatal("Error listening: ", err)
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Error dialing: ", err)
+	}
+	defer conn.Close()
+
+	ifIndex := Variable{OID: "1.3.6.1.2.1.2.2.1.1.3", Type: TypeInteger, Value: int64(3)}
+
+	send := func(version int, community string, p pdu) {
+		b, err := encodeCommunity(version, community, p)
+		if err != nil {
+			t.Fatal("Error encoding trap: ", err)
+		}
+		_, err = conn.Write(b)
+		if err != nil {
+			t.Fatal("Error sending trap: ", err)
+		}
+	}
+
+	next := func() Trap {
+		select {
+		case trap := <-traps:
+			return trap
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for trap")
+		}
+		return Trap{}
+	}
+
+	// linkDown as a v1 trap
+	send(version1, "public", pdu{tag: pduTrapV1, enterprise: "1.3.6.1.4.1.9",
+		agent: net.IP{10, 0, 0, 2}, generic: 2, timestamp: 100,
+		vars: []Variable{ifIndex}})
+
+	trap := next()
+	exp := Trap{Address: "127.0.0.1", Version: "1", Community: "public",
+		OID: "1.3.6.1.6.3.1.1.5.3", Uptime: 100, Variables: []Variable{ifIndex}}
+	if !reflect.DeepEqual(trap, exp) {
+		t.Errorf("wrong v1 trap: %+v", trap)
+	}
+
+	// traps with the wrong community are dropped
+	send(version2c, "private", pdu{tag: pduTrap})
+
+	// an enterprise specific v2c inform
+	send(version2c, "public", pdu{tag: pduInform, requestID: 77,
+		vars: []Variable{
+			{OID: oidSysUpTime, Type: TypeTimeTicks, Value: uint64(200)},
+			{OID: oidTrapOID, Type: TypeOID, Value: "1.3.6.1.4.1.318.0.5"},
+			ifIndex,
+		}})
+
+	trap = next()
+	if trap.Version != "2c" || trap.OID != "1.3.6.1.4.1.318.0.5" ||
+		trap.Uptime != 200 || !reflect.DeepEqual(trap.Variables, []Variable{ifIndex}) {
+		t.Errorf("wrong v2c trap: %+v", trap)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal("Error reading inform response: ", err)
+	}
+
+	m, err := decodeMessage(buf[:n], nil)
+	if err != nil || m.pdu.tag != pduResponse || m.pdu.requestID != 77 {
+		t.Errorf("wrong inform response: %+v, %v", m, err)
+	}
+}
@@ -0,0 +1,130 @@
+package snmp
+
+import (
+	"net"
+	"strconv"
+)
+
+const (
+	oidSysUpTime = "1.3.6.1.2.1.1.3.0"
+	oidTrapOID   = "1.3.6.1.6.3.1.1.4.1.0"
+	// oidGenericTraps is the prefix of the OIDs of the v1 generic traps,
+	// like coldStart
+	oidGenericTraps = "1.3.6.1.6.3.1.1.5."
+)
+
+// Trap is a notification sent by an agent
+type Trap struct {
+	// Address is the IP address the trap was received from
+	Address string
+	// Version is 1 or 2c
+	Version   string
+	Community string
+	// OID identifies the trap, like 1.3.6.1.6.3.1.1.5.3 for linkDown. v1
+	// traps are converted as in RFC 3584.
+	OID string
+	// Uptime is the agent's uptime in hundredths of a second
+	Uptime    uint64
+	Variables []Variable
+}
+
+// ParseTrap decodes a v1 or v2c trap or inform
+func ParseTrap(b []byte) (Trap, error) {
+	t, _, err := parseTrap(b)
+	return t, err
+}
+
+// parseTrap returns the message so informs can be acknowledged
+func parseTrap(b []byte) (Trap, message, error) {
+	m, err := decodeMessage(b, nil)
+	if err != nil {
+		return Trap{}, m, err
+	}
+
+	t := Trap{Version: "2c", Community: m.community}
+	p := m.pdu
+
+	switch p.tag {
+	case pduTrapV1:
+		t.Version = "1"
+		if p.generic < 6 {
+			t.OID = oidGenericTraps + strconv.Itoa(p.generic+1)
+		} else {
+			t.OID = p.enterprise + ".0." + strconv.Itoa(p.specific)
+		}
+		t.Uptime = p.timestamp
+		t.Variables = p.vars
+	case pduTrap, pduInform:
+		for _, v := range p.vars {
+			switch {
+			case v.OID == oidSysUpTime && t.Uptime == 0:
+				t.Uptime, _ = v.Value.(uint64)
+			case v.OID == oidTrapOID && t.OID == "":
+				t.OID, _ = v.Value.(string)
+			default:
+				t.Variables = append(t.Variables, v)
+			}
+		}
+	default:
+		return Trap{}, m, errDecode
+	}
+
+	return t, m, nil
+}
+
+// TrapListener receives traps
+type TrapListener struct {
+	conn net.PacketConn
+}
+
+// ListenTraps receives traps on a UDP address, like :162, and calls fn
+// for each one until the listener is closed. Traps that don't match
+// community are dropped, unless it is blank. Informs are acknowledged.
+func ListenTraps(address, community string, fn func(Trap)) (*TrapListener, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			t, m, err := parseTrap(buf[:n])
+			if err != nil || (community != "" && t.Community != community) {
+				continue
+			}
+
+			if m.pdu.tag == pduInform {
+				resp := m.pdu
+				resp.tag = pduResponse
+				b, err := encodeCommunity(m.version, m.community, resp)
+				if err == nil {
+					conn.WriteTo(b, addr)
+				}
+			}
+
+			if a, ok := addr.(*net.UDPAddr); ok {
+				t.Address = a.IP.String()
+			}
+
+			fn(t)
+		}
+	}()
+
+	return &TrapListener{conn: conn}, nil
+}
+
+// Addr returns the address the listener is receiving on
+func (l *TrapListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Close stops the listener
+func (l *TrapListener) Close() error {
+	return l.conn.Close()
+}
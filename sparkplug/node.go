@@ -0,0 +1,470 @@
+// Package sparkplug publishes SIOT devices as a Sparkplug B edge node, so
+// SCADA systems like Ignition can use them. Each SIOT device is a
+// Sparkplug device, and each sample type of a device is a metric.
+package sparkplug
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/logging"
+	"github.com/simpleiot/simpleiot/mqtt"
+)
+
+var spLog = logging.Module("sparkplug")
+
+// namespace is the first level of Sparkplug B topics
+const namespace = "spBv1.0"
+
+// rebirthMetric is the node metric hosts set to request births
+const rebirthMetric = "Node Control/Rebirth"
+
+// Config describes the edge node
+type Config struct {
+	// GroupID is the Sparkplug group of the node
+	GroupID string
+	// NodeID is the edge node ID
+	NodeID string
+	// PrimaryHost is the ID of the primary host application. If it is set,
+	// the node only publishes while the host is online. It is blank to
+	// always publish.
+	PrimaryHost string
+}
+
+// metricInfo is a metric of a device
+type metricInfo struct {
+	alias      uint64
+	sampleType string
+	sampleID   string
+}
+
+// Node is a Sparkplug B edge node. Births are published each time the node
+// connects, when a host requests a rebirth, and when the primary host comes
+// online. A device is reborn when it sends a sample type that was not in
+// its birth. Metrics of devices are doubles, and DCMD messages queue
+// setOutput commands.
+type Node struct {
+	client *mqtt.Client
+	db     *db.Db
+	config Config
+	lock   sync.Mutex
+	// bdSeq is the birth/death sequence number of the current session, and
+	// nextBdSeq is the one in the will of the next session
+	bdSeq     uint64
+	nextBdSeq uint64
+	seq       uint64
+	// born is true once the node birth is published, until the session
+	// ends or the primary host goes offline
+	born       bool
+	hostOnline bool
+	// devices are the metrics of devices by name, which keep their aliases
+	// across births
+	devices   map[string]map[string]metricInfo
+	nextAlias uint64
+	// births are the devices born in the current birth of the node
+	births map[string]bool
+	events <-chan db.Event
+	stop   chan struct{}
+}
+
+// NewNode creates an edge node that connects to a broker with a client
+// config. The will and OnConnect of the config are set by the node.
+func NewNode(dbInst *db.Db, clientConfig mqtt.ClientConfig, config Config) *Node {
+	n := &Node{
+		db:        dbInst,
+		config:    config,
+		devices:   make(map[string]map[string]metricInfo),
+		nextAlias: 1,
+		births:    make(map[string]bool),
+		stop:      make(chan struct{}),
+	}
+
+	clientConfig.Will = n.death(0)
+	clientConfig.OnConnect = n.connected
+	n.client = mqtt.NewClient(clientConfig)
+
+	return n
+}
+
+func (n *Node) topic(msgType string, device string) string {
+	t := namespace + "/" + n.config.GroupID + "/" + msgType + "/" + n.config.NodeID
+	if device != "" {
+		t += "/" + device
+	}
+	return t
+}
+
+// death returns the NDEATH message of a session
+func (n *Node) death(bdSeq uint64) *mqtt.Message {
+	p, _ := Payload{
+		Timestamp: now(),
+		Metrics:   []Metric{{Name: "bdSeq", Datatype: TypeUInt64, Value: bdSeq}},
+		Seq:       -1,
+	}.Encode()
+
+	return &mqtt.Message{Topic: n.topic("NDEATH", ""), Payload: p, QoS: 1}
+}
+
+func now() uint64 {
+	return uint64(time.Now().UnixNano() / int64(time.Millisecond))
+}
+
+// Start connects to the broker, and publishes samples until Stop is called
+func (n *Node) Start() error {
+	err := n.client.Subscribe(n.topic("NCMD", ""), 1, n.handleNodeCommand)
+	if err != nil {
+		return err
+	}
+
+	err = n.client.Subscribe(n.topic("DCMD", "+"), 1, n.handleDeviceCommand)
+	if err != nil {
+		return err
+	}
+
+	if n.config.PrimaryHost != "" {
+		// Sparkplug 3.0 and 2.2 state topics
+		for _, t := range []string{namespace + "/STATE/" + n.config.PrimaryHost,
+			"STATE/" + n.config.PrimaryHost} {
+			err = n.client.Subscribe(t, 1, n.handleState)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	n.events = n.db.Subscribe(db.EventFilter{
+		Types: []db.EventType{db.EventSampleWritten, db.EventDeviceDeleted},
+	})
+
+	go func() {
+		for {
+			select {
+			case e, ok := <-n.events:
+				if !ok {
+					return
+				}
+
+				n.lock.Lock()
+				switch e.Type {
+				case db.EventSampleWritten:
+					n.publishSample(e.DeviceID, *e.Sample)
+				case db.EventDeviceDeleted:
+					n.publishDeviceDeath(e.DeviceID)
+				}
+				n.lock.Unlock()
+			case <-n.stop:
+				return
+			}
+		}
+	}()
+
+	n.client.Start()
+	return nil
+}
+
+// Stop publishes the node death and disconnects
+func (n *Node) Stop() {
+	close(n.stop)
+	n.db.Unsubscribe(n.events)
+
+	n.lock.Lock()
+	born := n.born
+	n.born = false
+	death := n.death(n.bdSeq)
+	n.lock.Unlock()
+
+	// the broker does not publish the will on a clean disconnect
+	if born {
+		n.client.Publish(death.Topic, death.Payload, death.QoS, false)
+	}
+
+	n.client.Stop()
+}
+
+// connected starts a session
+func (n *Node) connected() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.bdSeq = n.nextBdSeq
+	n.nextBdSeq = (n.nextBdSeq + 1) % 256
+	n.client.SetWill(n.death(n.nextBdSeq))
+
+	n.rebirth()
+}
+
+// publish publishes a message with the next sequence number. n.lock must be
+// held.
+func (n *Node) publish(topic string, p Payload) error {
+	p.Seq = int64(n.seq)
+	p.Timestamp = now()
+
+	b, err := p.Encode()
+	if err != nil {
+		return err
+	}
+
+	n.seq = (n.seq + 1) % 256
+	return n.client.Publish(topic, b, 0, false)
+}
+
+// rebirth publishes the node birth and the births of all devices. n.lock
+// must be held.
+func (n *Node) rebirth() {
+	if n.config.PrimaryHost != "" && !n.hostOnline {
+		return
+	}
+
+	n.born = false
+	n.births = make(map[string]bool)
+	n.seq = 0
+
+	err := n.publish(n.topic("NBIRTH", ""), Payload{Metrics: []Metric{
+		{Name: "bdSeq", Datatype: TypeUInt64, Value: n.bdSeq},
+		{Name: rebirthMetric, Datatype: TypeBoolean, Value: false},
+	}})
+	if err != nil {
+		n.logError("NBIRTH", "", err)
+		return
+	}
+
+	n.born = true
+
+	devices, err := n.db.Devices()
+	if err != nil {
+		spLog.Error("error reading devices", "err", err)
+		return
+	}
+
+	for _, dev := range devices {
+		n.publishDeviceBirth(dev.ID)
+	}
+}
+
+// metricName returns the metric name of a sample
+func metricName(s data.Sample) string {
+	if s.ID != "" {
+		return s.Type + "/" + s.ID
+	}
+	return s.Type
+}
+
+// publishDeviceBirth publishes the birth of a device with its latest
+// samples. Metrics keep their aliases. n.lock must be held.
+func (n *Node) publishDeviceBirth(id string) {
+	samples, err := n.db.Latest(id)
+	if err != nil {
+		spLog.Error("error reading samples", "device", id, "err", err)
+		return
+	}
+
+	sort.Slice(samples, func(i, j int) bool {
+		return metricName(samples[i]) < metricName(samples[j])
+	})
+
+	metrics, ok := n.devices[id]
+	if !ok {
+		metrics = make(map[string]metricInfo)
+	}
+
+	p := Payload{}
+	for _, s := range samples {
+		name := metricName(s)
+		info, ok := metrics[name]
+		if !ok {
+			info = metricInfo{alias: n.nextAlias, sampleType: s.Type,
+				sampleID: s.ID}
+			n.nextAlias++
+			metrics[name] = info
+		}
+
+		p.Metrics = append(p.Metrics, Metric{Name: name, Alias: info.alias,
+			Timestamp: uint64(s.Time.UnixNano() / int64(time.Millisecond)),
+			Datatype:  TypeDouble, Value: s.Value})
+	}
+
+	n.devices[id] = metrics
+	n.births[id] = true
+
+	err = n.publish(n.topic("DBIRTH", id), p)
+	if err != nil {
+		n.logError("DBIRTH", id, err)
+	}
+}
+
+// publishSample publishes a sample in DDATA, or a new device birth if the
+// device has not been born with its metric. n.lock must be held.
+func (n *Node) publishSample(id string, s data.Sample) {
+	if !n.born {
+		return
+	}
+
+	info, ok := n.devices[id][metricName(s)]
+	if !ok || !n.births[id] {
+		n.publishDeviceBirth(id)
+		return
+	}
+
+	err := n.publish(n.topic("DDATA", id), Payload{Metrics: []Metric{{
+		Alias:     info.alias,
+		Timestamp: uint64(s.Time.UnixNano() / int64(time.Millisecond)),
+		Datatype:  TypeDouble,
+		Value:     s.Value,
+	}}})
+	if err != nil {
+		n.logError("DDATA", id, err)
+	}
+}
+
+// publishDeviceDeath publishes DDEATH for a deleted device. n.lock must be
+// held.
+func (n *Node) publishDeviceDeath(id string) {
+	born := n.births[id]
+	delete(n.devices, id)
+	delete(n.births, id)
+
+	if !born || !n.born {
+		return
+	}
+
+	err := n.publish(n.topic("DDEATH", id), Payload{})
+	if err != nil {
+		n.logError("DDEATH", id, err)
+	}
+}
+
+func (n *Node) logError(msgType, id string, err error) {
+	if err != mqtt.ErrNotConnected {
+		spLog.Warn("error publishing", "type", msgType, "device", id, "err", err)
+	}
+}
+
+// handleNodeCommand publishes births if a host sets the rebirth metric.
+// Messages are handled in a new goroutine, as publishing from the client
+// read loop blocks it.
+func (n *Node) handleNodeCommand(msg mqtt.Message) {
+	p, err := Decode(msg.Payload)
+	if err != nil {
+		spLog.Warn("invalid NCMD", "err", err)
+		return
+	}
+
+	for _, m := range p.Metrics {
+		if m.Name == rebirthMetric && m.Value == true {
+			go func() {
+				n.lock.Lock()
+				defer n.lock.Unlock()
+				n.rebirth()
+			}()
+		}
+	}
+}
+
+// hostState is the Sparkplug 3.0 STATE payload
+type hostState struct {
+	Online bool `json:"online"`
+}
+
+// handleState tracks if the primary host is online, and publishes births
+// when it comes online
+func (n *Node) handleState(msg mqtt.Message) {
+	var online bool
+	switch s := strings.TrimSpace(string(msg.Payload)); s {
+	case "ONLINE":
+		online = true
+	case "OFFLINE":
+	default:
+		var state hostState
+		err := json.Unmarshal(msg.Payload, &state)
+		if err != nil {
+			spLog.Warn("invalid STATE", "host", n.config.PrimaryHost, "err", err)
+			return
+		}
+		online = state.Online
+	}
+
+	go func() {
+		n.lock.Lock()
+		defer n.lock.Unlock()
+
+		if online == n.hostOnline {
+			return
+		}
+
+		n.hostOnline = online
+		spLog.Info("primary host state changed", "host", n.config.PrimaryHost,
+			"online", online)
+
+		if online {
+			n.rebirth()
+		} else {
+			// data is not published while the host is offline
+			n.born = false
+		}
+	}()
+}
+
+// handleDeviceCommand queues a setOutput command for each metric of a DCMD
+func (n *Node) handleDeviceCommand(msg mqtt.Message) {
+	id := msg.Topic[strings.LastIndex(msg.Topic, "/")+1:]
+
+	p, err := Decode(msg.Payload)
+	if err != nil {
+		spLog.Warn("invalid DCMD", "device", id, "err", err)
+		return
+	}
+
+	for _, m := range p.Metrics {
+		n.lock.Lock()
+		info, ok := metricInfo{}, false
+		for name, i := range n.devices[id] {
+			if name == m.Name || (m.Name == "" && i.alias == m.Alias) {
+				info, ok = i, true
+			}
+		}
+		n.lock.Unlock()
+
+		if !ok {
+			if m.Name == "" {
+				spLog.Warn("DCMD for unknown alias", "device", id, "alias", m.Alias)
+				continue
+			}
+			info.sampleType = m.Name
+		}
+
+		var value string
+		switch v := m.Value.(type) {
+		case float64:
+			value = strconv.FormatFloat(v, 'g', -1, 64)
+		case bool:
+			value = "0"
+			if v {
+				value = "1"
+			}
+		case string:
+			value = v
+		default:
+			value = fmt.Sprint(v)
+		}
+
+		_, err := n.db.CommandEnqueue(data.DeviceCommand{
+			DeviceID: id,
+			Command:  data.RuleActionOutput,
+			Args: map[string]string{
+				"id":    info.sampleID,
+				"type":  info.sampleType,
+				"value": value,
+			},
+		})
+		if err != nil {
+			spLog.Error("error queueing command", "device", id, "err", err)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package sparkplug
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Sparkplug B payloads are encoded as protobuf messages by hand, like
+// data.SamplesToPb, so the server does not depend on a protobuf library.
+// Only the fields of sparkplug_b.proto that metrics with scalar values use
+// are supported. Datasets, templates, and metadata are skipped.
+
+// Metric data types
+const (
+	TypeInt8     = 1
+	TypeInt16    = 2
+	TypeInt32    = 3
+	TypeInt64    = 4
+	TypeUInt8    = 5
+	TypeUInt16   = 6
+	TypeUInt32   = 7
+	TypeUInt64   = 8
+	TypeFloat    = 9
+	TypeDouble   = 10
+	TypeBoolean  = 11
+	TypeString   = 12
+	TypeDateTime = 13
+	TypeText     = 14
+)
+
+// Payload is a Sparkplug B payload
+type Payload struct {
+	// Timestamp is the time of the message in ms since the epoch
+	Timestamp uint64
+	Metrics   []Metric
+	// Seq is the sequence number of the message, or negative for messages
+	// without one, like NDEATH
+	Seq int64
+}
+
+// Metric is a value in a payload. Metrics in births have a name and alias,
+// and data messages only use the alias.
+type Metric struct {
+	Name string
+	// Alias is the alias of the metric, or 0 if it has none
+	Alias     uint64
+	Timestamp uint64
+	Datatype  uint32
+	IsNull    bool
+	// Value is a float64, bool, or string. Integer and float values are
+	// decoded as float64. Encoded values use the type of Datatype.
+	Value interface{}
+}
+
+// errPb is returned when a payload can't be decoded
+var errPb = errors.New("invalid Sparkplug payload")
+
+// protobuf wire types
+const (
+	pbVarint = 0
+	pb64     = 1
+	pbBytes  = 2
+	pb32     = 5
+)
+
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) varint(v uint64) {
+	for v >= 0x80 {
+		e.b = append(e.b, byte(v)|0x80)
+		v >>= 7
+	}
+	e.b = append(e.b, byte(v))
+}
+
+func (e *encoder) key(field int, wire int) {
+	e.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (e *encoder) uint(field int, v uint64) {
+	e.key(field, pbVarint)
+	e.varint(v)
+}
+
+func (e *encoder) bytes(field int, b []byte) {
+	e.key(field, pbBytes)
+	e.varint(uint64(len(b)))
+	e.b = append(e.b, b...)
+}
+
+func (e *encoder) fixed32(field int, v uint32) {
+	e.key(field, pb32)
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+func (e *encoder) fixed64(field int, v uint64) {
+	e.key(field, pb64)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+// toFloat converts the numeric values metrics are encoded from
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func encodeMetric(m Metric) ([]byte, error) {
+	var e encoder
+	if m.Name != "" {
+		e.bytes(1, []byte(m.Name))
+	}
+	if m.Alias != 0 {
+		e.uint(2, m.Alias)
+	}
+	if m.Timestamp != 0 {
+		e.uint(3, m.Timestamp)
+	}
+	e.uint(4, uint64(m.Datatype))
+
+	if m.IsNull || m.Value == nil {
+		e.uint(7, 1)
+		return e.b, nil
+	}
+
+	if s, ok := m.Value.(string); ok {
+		if m.Datatype != TypeString && m.Datatype != TypeText {
+			return nil, fmt.Errorf("metric %v: string value for type %v", m.Name,
+				m.Datatype)
+		}
+		e.bytes(15, []byte(s))
+		return e.b, nil
+	}
+
+	v, ok := toFloat(m.Value)
+	if !ok {
+		return nil, fmt.Errorf("metric %v: unsupported value %T", m.Name, m.Value)
+	}
+
+	switch m.Datatype {
+	case TypeInt8, TypeInt16, TypeInt32:
+		e.uint(10, uint64(uint32(int32(v))))
+	case TypeUInt8, TypeUInt16, TypeUInt32:
+		e.uint(10, uint64(uint32(v)))
+	case TypeInt64:
+		e.uint(11, uint64(int64(v)))
+	case TypeUInt64, TypeDateTime:
+		e.uint(11, uint64(v))
+	case TypeFloat:
+		e.fixed32(12, math.Float32bits(float32(v)))
+	case TypeDouble:
+		e.fixed64(13, math.Float64bits(v))
+	case TypeBoolean:
+		var b uint64
+		if v != 0 {
+			b = 1
+		}
+		e.uint(14, b)
+	default:
+		return nil, fmt.Errorf("metric %v: unsupported type %v", m.Name, m.Datatype)
+	}
+
+	return e.b, nil
+}
+
+// Encode encodes a payload
+func (p Payload) Encode() ([]byte, error) {
+	var e encoder
+	if p.Timestamp != 0 {
+		e.uint(1, p.Timestamp)
+	}
+
+	for _, m := range p.Metrics {
+		b, err := encodeMetric(m)
+		if err != nil {
+			return nil, err
+		}
+		e.bytes(2, b)
+	}
+
+	if p.Seq >= 0 {
+		e.uint(3, uint64(p.Seq))
+	}
+
+	return e.b, nil
+}
+
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) varint() uint64 {
+	var v uint64
+	for i := 0; i < 10; i++ {
+		if len(d.b) < 1 {
+			break
+		}
+		c := d.b[0]
+		d.b = d.b[1:]
+		v |= uint64(c&0x7f) << (7 * uint(i))
+		if c < 0x80 {
+			return v
+		}
+	}
+	d.err = errPb
+	return 0
+}
+
+// next returns the field and wire type of the next value
+func (d *decoder) next() (int, int) {
+	k := d.varint()
+	return int(k >> 3), int(k & 7)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.varint()
+	if d.err != nil || uint64(len(d.b)) < n {
+		d.err = errPb
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) fixed(n int) []byte {
+	if len(d.b) < n {
+		d.err = errPb
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) skip(wire int) {
+	switch wire {
+	case pbVarint:
+		d.varint()
+	case pb64:
+		d.fixed(8)
+	case pbBytes:
+		d.bytes()
+	case pb32:
+		d.fixed(4)
+	default:
+		d.err = errPb
+	}
+}
+
+// signed returns an integer value of a signed type, which is encoded as
+// two's complement in int_value or long_value
+func signed(datatype uint32, v uint64) float64 {
+	switch datatype {
+	case TypeInt8, TypeInt16, TypeInt32:
+		return float64(int32(uint32(v)))
+	case TypeInt64:
+		return float64(int64(v))
+	}
+	return float64(v)
+}
+
+func decodeMetric(b []byte) (Metric, error) {
+	var m Metric
+	var intValue uint64
+	hasInt := false
+
+	d := decoder{b: b}
+	for len(d.b) > 0 && d.err == nil {
+		field, wire := d.next()
+		switch {
+		case field == 1 && wire == pbBytes:
+			m.Name = string(d.bytes())
+		case field == 2 && wire == pbVarint:
+			m.Alias = d.varint()
+		case field == 3 && wire == pbVarint:
+			m.Timestamp = d.varint()
+		case field == 4 && wire == pbVarint:
+			m.Datatype = uint32(d.varint())
+		case field == 7 && wire == pbVarint:
+			m.IsNull = d.varint() != 0
+		case (field == 10 || field == 11) && wire == pbVarint:
+			intValue = d.varint()
+			hasInt = true
+		case field == 12 && wire == pb32:
+			if v := d.fixed(4); v != nil {
+				m.Value = float64(math.Float32frombits(binary.LittleEndian.Uint32(v)))
+			}
+		case field == 13 && wire == pb64:
+			if v := d.fixed(8); v != nil {
+				m.Value = math.Float64frombits(binary.LittleEndian.Uint64(v))
+			}
+		case field == 14 && wire == pbVarint:
+			m.Value = d.varint() != 0
+		case field == 15 && wire == pbBytes:
+			m.Value = string(d.bytes())
+		default:
+			d.skip(wire)
+		}
+	}
+
+	// the datatype may come after the value
+	if hasInt {
+		m.Value = signed(m.Datatype, intValue)
+	}
+
+	return m, d.err
+}
+
+// Decode decodes a payload
+func Decode(b []byte) (Payload, error) {
+	p := Payload{Seq: -1}
+
+	d := decoder{b: b}
+	for len(d.b) > 0 && d.err == nil {
+		field, wire := d.next()
+		switch {
+		case field == 1 && wire == pbVarint:
+			p.Timestamp = d.varint()
+		case field == 2 && wire == pbBytes:
+			m, err := decodeMetric(d.bytes())
+			if err != nil {
+				return p, err
+			}
+			p.Metrics = append(p.Metrics, m)
+		case field == 3 && wire == pbVarint:
+			p.Seq = int64(d.varint())
+		default:
+			d.skip(wire)
+		}
+	}
+
+	return p, d.err
+}
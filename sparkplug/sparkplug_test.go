@@ -0,0 +1,212 @@
+package sparkplug
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/mqtt"
+)
+
+func TestPayload(t *testing.T) {
+	p := Payload{
+		Timestamp: 1600000000000,
+		Seq:       0,
+		Metrics: []Metric{
+			{Name: "bdSeq", Datatype: TypeUInt64, Value: float64(3)},
+			{Name: "temp", Alias: 1, Datatype: TypeDouble, Value: 21.5},
+			{Alias: 2, Datatype: TypeFloat, Value: 0.5},
+			{Name: "offset", Datatype: TypeInt32, Value: float64(-4)},
+			{Name: "on", Datatype: TypeBoolean, Value: true},
+			{Name: "mode", Datatype: TypeString, Value: "auto"},
+			{Name: "level", Datatype: TypeDouble, IsNull: true},
+		},
+	}
+
+	b, err := p.Encode()
+	if err != nil {
+		t.Fatal("Error encoding: ", err)
+	}
+
+	ret, err := Decode(b)
+	if err != nil {
+		t.Fatal("Error decoding: ", err)
+	}
+
+	if !reflect.DeepEqual(ret, p) {
+		t.Errorf("payload changed:\n%+v\n%+v", p, ret)
+	}
+
+	// deaths have no sequence number
+	b, _ = Payload{Seq: -1}.Encode()
+	if ret, _ := Decode(b); ret.Seq != -1 {
+		t.Error("seq should not be encoded")
+	}
+
+	_, err = Payload{Metrics: []Metric{{Datatype: TypeDouble, Value: "x"}}}.Encode()
+	if err == nil {
+		t.Error("string value of a double should fail")
+	}
+
+	_, err = Decode([]byte{0x12, 0x10, 0x01})
+	if err == nil {
+		t.Error("truncated payload should fail")
+	}
+}
+
+func TestNode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-sparkplug-test")
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbInst, err := db.NewDb(dir, nil)
+	if err != nil {
+		t.Fatal("Error opening db: ", err)
+	}
+	defer dbInst.Close()
+
+	err = dbInst.DeviceSample("1234", data.Sample{Type: "temp", Value: 21})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening: ", err)
+	}
+
+	broker := mqtt.NewBroker(mqtt.BrokerConfig{})
+	go broker.Serve(l)
+	defer broker.Close()
+
+	messages := make(chan mqtt.Message, 20)
+	err = broker.Subscribe("spBv1.0/#", 1, func(msg mqtt.Message) {
+		if !strings.Contains(msg.Topic, "CMD") && !strings.Contains(msg.Topic, "STATE") {
+			messages <- msg
+		}
+	})
+	if err != nil {
+		t.Fatal("Error subscribing: ", err)
+	}
+
+	// the primary host is online
+	broker.Publish("spBv1.0/STATE/scada", []byte(`{"online": true, "timestamp": 1}`), 1, true)
+
+	n := NewNode(dbInst, mqtt.ClientConfig{
+		Broker:   "tcp://" + l.Addr().String(),
+		ClientID: "edge",
+	}, Config{GroupID: "plant", NodeID: "edge", PrimaryHost: "scada"})
+
+	err = n.Start()
+	if err != nil {
+		t.Fatal("Error starting node: ", err)
+	}
+
+	wait := func(topic string) Payload {
+		t.Helper()
+		select {
+		case msg := <-messages:
+			if msg.Topic != topic {
+				t.Fatalf("got %v, expected %v", msg.Topic, topic)
+			}
+
+			p, err := Decode(msg.Payload)
+			if err != nil {
+				t.Fatal("Error decoding payload: ", err)
+			}
+			return p
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for ", topic)
+		}
+		return Payload{}
+	}
+
+	p := wait("spBv1.0/plant/NBIRTH/edge")
+	if p.Seq != 0 || p.Metrics[0].Name != "bdSeq" || p.Metrics[0].Value != float64(0) {
+		t.Errorf("wrong NBIRTH: %+v", p)
+	}
+
+	p = wait("spBv1.0/plant/DBIRTH/edge/1234")
+	if p.Seq != 1 || len(p.Metrics) != 1 || p.Metrics[0].Name != "temp" ||
+		p.Metrics[0].Alias != 1 || p.Metrics[0].Value != float64(21) {
+		t.Errorf("wrong DBIRTH: %+v", p)
+	}
+
+	// known metrics are published by alias
+	dbInst.DeviceSample("1234", data.Sample{Type: "temp", Value: 22})
+	p = wait("spBv1.0/plant/DDATA/edge/1234")
+	if p.Seq != 2 || p.Metrics[0].Name != "" || p.Metrics[0].Alias != 1 ||
+		p.Metrics[0].Value != float64(22) {
+		t.Errorf("wrong DDATA: %+v", p)
+	}
+
+	// new metrics rebirth the device
+	dbInst.DeviceSample("1234", data.Sample{Type: "pump", ID: "2", Value: 1})
+	p = wait("spBv1.0/plant/DBIRTH/edge/1234")
+	if len(p.Metrics) != 2 || p.Metrics[0].Name != "pump/2" || p.Metrics[0].Alias != 2 ||
+		p.Metrics[1].Alias != 1 {
+		t.Errorf("wrong DBIRTH: %+v", p)
+	}
+
+	// hosts can request a rebirth
+	cmd, _ := Payload{Seq: -1, Metrics: []Metric{{Name: rebirthMetric,
+		Datatype: TypeBoolean, Value: true}}}.Encode()
+	broker.Publish("spBv1.0/plant/NCMD/edge", cmd, 0, false)
+
+	if p := wait("spBv1.0/plant/NBIRTH/edge"); p.Seq != 0 {
+		t.Errorf("wrong NBIRTH: %+v", p)
+	}
+	wait("spBv1.0/plant/DBIRTH/edge/1234")
+
+	// device commands queue setOutput commands
+	cmd, _ = Payload{Seq: -1, Metrics: []Metric{{Alias: 2, Datatype: TypeBoolean,
+		Value: false}}}.Encode()
+	broker.Publish("spBv1.0/plant/DCMD/edge/1234", cmd, 0, false)
+
+	var cmds []data.DeviceCommand
+	for start := time.Now(); len(cmds) == 0 && time.Since(start) < 2*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		cmds, _ = dbInst.DeviceCommands("1234")
+	}
+
+	exp := map[string]string{"type": "pump", "id": "2", "value": "0"}
+	if len(cmds) != 1 || cmds[0].Command != data.RuleActionOutput ||
+		!reflect.DeepEqual(cmds[0].Args, exp) {
+		t.Errorf("wrong commands: %+v", cmds)
+	}
+
+	// nothing is published while the host is offline
+	broker.Publish("spBv1.0/STATE/scada", []byte(`{"online": false, "timestamp": 2}`), 1, true)
+	time.Sleep(50 * time.Millisecond)
+	dbInst.DeviceSample("1234", data.Sample{Type: "temp", Value: 23})
+
+	select {
+	case msg := <-messages:
+		t.Error("published while host offline: ", msg.Topic)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	broker.Publish("spBv1.0/STATE/scada", []byte(`{"online": true, "timestamp": 3}`), 1, true)
+	wait("spBv1.0/plant/NBIRTH/edge")
+	wait("spBv1.0/plant/DBIRTH/edge/1234")
+
+	err = dbInst.DeviceDelete("1234")
+	if err != nil {
+		t.Fatal("Error deleting device: ", err)
+	}
+	wait("spBv1.0/plant/DDEATH/edge/1234")
+
+	n.Stop()
+	p = wait("spBv1.0/plant/NDEATH/edge")
+	if p.Seq != -1 || p.Metrics[0].Value != float64(0) {
+		t.Errorf("wrong NDEATH: %+v", p)
+	}
+}
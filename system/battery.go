@@ -0,0 +1,391 @@
+package system
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// PowerSupplyDir is where the kernel power supply class devices are
+var PowerSupplyDir = "/sys/class/power_supply"
+
+// define battery sources
+const (
+	// BatterySysfs reads a battery from the kernel power supply class
+	BatterySysfs = "sysfs"
+	// BatteryMax17048 reads a MAX17048/MAX17049 I2C fuel gauge
+	BatteryMax17048 = "max17048"
+	// BatteryNut reads a UPS from a Network UPS Tools (NUT) server
+	BatteryNut = "nut"
+)
+
+// BatteryStatus is the state of a battery or UPS
+type BatteryStatus struct {
+	// Charge is the state of charge in percent
+	Charge float64
+	// OnBattery is true when external power is lost
+	OnBattery bool
+	// LowBattery is true when the battery or UPS reports it is low
+	LowBattery bool
+	// Voltage is the battery voltage, 0 if not known
+	Voltage float64
+	// Runtime is the estimated time left on battery, 0 if not known
+	Runtime time.Duration
+}
+
+// Samples returns the status as samples
+func (s BatteryStatus) Samples(id string) []data.Sample {
+	now := time.Now()
+
+	onBattery := 0.0
+	if s.OnBattery {
+		onBattery = 1
+	}
+
+	ret := []data.Sample{
+		{Type: "batteryCharge", ID: id, Value: s.Charge, Time: now},
+		{Type: "onBattery", ID: id, Value: onBattery, Time: now},
+	}
+
+	if s.Voltage > 0 {
+		ret = append(ret, data.Sample{Type: "batteryVoltage", ID: id,
+			Value: s.Voltage, Time: now})
+	}
+
+	if s.Runtime > 0 {
+		ret = append(ret, data.Sample{Type: "batteryRuntime", ID: id,
+			Value: s.Runtime.Seconds(), Time: now})
+	}
+
+	return ret
+}
+
+// BatteryConfig describes the battery or UPS that is monitored
+type BatteryConfig struct {
+	// Source is BatterySysfs, BatteryMax17048, or BatteryNut (default
+	// BatterySysfs)
+	Source string
+	// Name is the power supply in PowerSupplyDir (default is the first
+	// battery), or the UPS name for NUT (default ups)
+	Name string
+	// Bus (like /dev/i2c-1) and Address (default 0x36) of a fuel gauge
+	Bus     string
+	Address int
+	// PowerGood reads true while external power is present. Fuel gauges
+	// don't know if the device is on battery, so OnBattery is always false
+	// for a fuel gauge without PowerGood.
+	PowerGood *Gpio
+	// NutAddr is the address of the NUT server (default localhost:3493)
+	NutAddr string
+	// Interval is how often the battery is read (default 30s)
+	Interval time.Duration
+	// ShutdownCharge is the charge in percent at which the device is shut
+	// down while on battery. 0 disables the shutdown.
+	ShutdownCharge float64
+	// Shutdown is called once when the charge drops below ShutdownCharge,
+	// typically Power.Shutdown
+	Shutdown func(reason string) error
+	// ID is used as the sample ID
+	ID string
+	// Send is called with the battery samples after each read
+	Send func([]data.Sample) error
+}
+
+// BatteryMonitor periodically reports the state of a battery or UPS, and
+// shuts down cleanly before the battery is empty
+type BatteryMonitor struct {
+	config   BatteryConfig
+	gauge    *I2C
+	lock     sync.Mutex
+	status   BatteryStatus
+	shutdown bool
+	stop     chan struct{}
+}
+
+// NewBatteryMonitor creates a battery monitor
+func NewBatteryMonitor(config BatteryConfig) (*BatteryMonitor, error) {
+	if config.Source == "" {
+		config.Source = BatterySysfs
+	}
+
+	if config.Address == 0 {
+		config.Address = 0x36
+	}
+
+	if config.NutAddr == "" {
+		config.NutAddr = "localhost:3493"
+	}
+
+	if config.Interval == 0 {
+		config.Interval = 30 * time.Second
+	}
+
+	b := &BatteryMonitor{config: config, stop: make(chan struct{})}
+
+	switch config.Source {
+	case BatterySysfs, BatteryNut:
+	case BatteryMax17048:
+		var err error
+		b.gauge, err = OpenI2C(config.Bus, config.Address)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown battery source: %v", config.Source)
+	}
+
+	return b, nil
+}
+
+// Read returns the current battery state, and shuts down the device if the
+// charge is below ShutdownCharge
+func (b *BatteryMonitor) Read() (BatteryStatus, error) {
+	var s BatteryStatus
+	var err error
+
+	switch b.config.Source {
+	case BatterySysfs:
+		s, err = readPowerSupply(b.config.Name)
+	case BatteryMax17048:
+		s, err = readMax17048(b.gauge)
+		if err == nil && b.config.PowerGood != nil {
+			var good bool
+			good, err = b.config.PowerGood.Read()
+			s.OnBattery = !good
+		}
+	case BatteryNut:
+		name := b.config.Name
+		if name == "" {
+			name = "ups"
+		}
+		s, err = readNut(b.config.NutAddr, name)
+	}
+
+	if err != nil {
+		return s, err
+	}
+
+	b.lock.Lock()
+	b.status = s
+	doShutdown := false
+	if !s.OnBattery {
+		b.shutdown = false
+	} else if b.config.ShutdownCharge > 0 && !b.shutdown &&
+		(s.Charge <= b.config.ShutdownCharge || s.LowBattery) {
+		b.shutdown = true
+		doShutdown = true
+	}
+	b.lock.Unlock()
+
+	if doShutdown && b.config.Shutdown != nil {
+		reason := fmt.Sprintf("battery low (%.0f%%)", s.Charge)
+		log.Println("Shutting down: ", reason)
+		err := b.config.Shutdown(reason)
+		if err != nil {
+			log.Println("Error shutting down for low battery: ", err)
+		}
+	}
+
+	return s, nil
+}
+
+// Status returns the state from the last read
+func (b *BatteryMonitor) Status() BatteryStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.status
+}
+
+// Start reads the battery until Stop is called
+func (b *BatteryMonitor) Start() {
+	go func() {
+		ticker := time.NewTicker(b.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			s, err := b.Read()
+			if err != nil {
+				log.Println("Error reading battery: ", err)
+			}
+
+			if err == nil && b.config.Send != nil {
+				err := b.config.Send(s.Samples(b.config.ID))
+				if err != nil {
+					log.Println("Error sending battery state: ", err)
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops reading the battery
+func (b *BatteryMonitor) Stop() {
+	close(b.stop)
+	if b.gauge != nil {
+		b.gauge.Close()
+	}
+}
+
+// readPowerSupply reads a battery from the power supply class. The device
+// is on battery if the battery is discharging and no mains or USB supply
+// is online.
+func readPowerSupply(name string) (BatteryStatus, error) {
+	var ret BatteryStatus
+
+	infos, err := ioutil.ReadDir(PowerSupplyDir)
+	if err != nil {
+		return ret, err
+	}
+
+	battery := ""
+	external := false
+
+	for _, fi := range infos {
+		dir := path.Join(PowerSupplyDir, fi.Name())
+		switch readSysfs(path.Join(dir, "type")) {
+		case "Battery":
+			if battery == "" && (name == "" || name == fi.Name()) {
+				battery = dir
+			}
+		case "Mains", "USB", "USB_C", "USB_PD":
+			if readSysfs(path.Join(dir, "online")) == "1" {
+				external = true
+			}
+		}
+	}
+
+	if battery == "" {
+		return ret, fmt.Errorf("no battery found in %v", PowerSupplyDir)
+	}
+
+	ret.Charge, err = strconv.ParseFloat(readSysfs(path.Join(battery, "capacity")), 64)
+	if err != nil {
+		return ret, fmt.Errorf("Error reading battery capacity: %v", err)
+	}
+
+	ret.OnBattery = !external &&
+		readSysfs(path.Join(battery, "status")) == "Discharging"
+
+	ret.LowBattery = readSysfs(path.Join(battery, "capacity_level")) == "Critical"
+
+	// µV
+	if v, err := strconv.ParseFloat(readSysfs(path.Join(battery, "voltage_now")), 64); err == nil {
+		ret.Voltage = v / 1e6
+	}
+
+	// seconds
+	if v, err := strconv.Atoi(readSysfs(path.Join(battery, "time_to_empty_now"))); err == nil {
+		ret.Runtime = time.Duration(v) * time.Second
+	}
+
+	return ret, nil
+}
+
+// MAX17048 registers
+const (
+	max17048VCell = 0x02
+	max17048Soc   = 0x04
+)
+
+func readMax17048(d *I2C) (BatteryStatus, error) {
+	var ret BatteryStatus
+
+	b := make([]byte, 2)
+	err := d.ReadReg(max17048VCell, b)
+	if err != nil {
+		return ret, err
+	}
+	// 78.125µV per bit
+	ret.Voltage = float64(uint16(b[0])<<8|uint16(b[1])) * 78.125e-6
+
+	err = d.ReadReg(max17048Soc, b)
+	if err != nil {
+		return ret, err
+	}
+	// 1/256% per bit
+	ret.Charge = float64(b[0]) + float64(b[1])/256
+	if ret.Charge > 100 {
+		ret.Charge = 100
+	}
+
+	return ret, nil
+}
+
+// readNut reads UPS variables from a NUT server
+func readNut(addr, ups string) (BatteryStatus, error) {
+	var ret BatteryStatus
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return ret, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	_, err = fmt.Fprintf(conn, "LIST VAR %v\n", ups)
+	if err != nil {
+		return ret, err
+	}
+
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "ERR ") {
+			return ret, fmt.Errorf("NUT error: %v", strings.TrimPrefix(line, "ERR "))
+		}
+
+		if strings.HasPrefix(line, "END LIST VAR") {
+			break
+		}
+
+		// VAR ups battery.charge "100"
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) == 4 && fields[0] == "VAR" {
+			vars[fields[2]] = strings.Trim(fields[3], "\"")
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return ret, err
+	}
+
+	ret.Charge, err = strconv.ParseFloat(vars["battery.charge"], 64)
+	if err != nil {
+		return ret, fmt.Errorf("Error reading UPS charge: %v", err)
+	}
+
+	// ups.status is flags like "OL", "OB LB", or "OL CHRG"
+	for _, flag := range strings.Fields(vars["ups.status"]) {
+		switch flag {
+		case "OB":
+			ret.OnBattery = true
+		case "LB":
+			ret.LowBattery = true
+		}
+	}
+
+	ret.Voltage, _ = strconv.ParseFloat(vars["battery.voltage"], 64)
+
+	if v, err := strconv.ParseFloat(vars["battery.runtime"], 64); err == nil {
+		ret.Runtime = time.Duration(v * float64(time.Second))
+	}
+
+	return ret, nil
+}
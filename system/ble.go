@@ -0,0 +1,508 @@
+package system
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// BlueZ D-Bus names
+const (
+	bluezService        = "org.bluez"
+	bluezAdapter        = "org.bluez.Adapter1"
+	bluezDevice         = "org.bluez.Device1"
+	bluezCharacteristic = "org.bluez.GattCharacteristic1"
+	dbusProperties      = "org.freedesktop.DBus.Properties"
+	dbusObjectManager   = "org.freedesktop.DBus.ObjectManager"
+)
+
+// manufacturer IDs of BLE advertisements
+const (
+	bleApple = 0x004c
+	bleRuuvi = 0x0499
+)
+
+// bleReportInterval is how often presence and advertised readings are sent
+const bleReportInterval = 10 * time.Second
+
+// busValue is a D-Bus value in the busctl JSON output
+type busValue struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// busMessage is a D-Bus message from busctl monitor
+type busMessage struct {
+	Type      string   `json:"type"`
+	Path      string   `json:"path"`
+	Interface string   `json:"interface"`
+	Member    string   `json:"member"`
+	Payload   busValue `json:"payload"`
+}
+
+// busctlJSON runs a D-Bus call on the system bus and decodes the reply
+// values into ret
+func busctlJSON(ret interface{}, args ...string) error {
+	out, err := exec.Command("busctl", append([]string{"--system",
+		"--json=short"}, args...)...).Output()
+	if err != nil {
+		return fmt.Errorf("busctl %v: %v", args[0], err)
+	}
+
+	var v busValue
+	err = json.Unmarshal(out, &v)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(v.Data, ret)
+}
+
+// bleDevice is the last advertisement received from a device
+type bleDevice struct {
+	address      string
+	rssi         float64
+	seen         time.Time
+	manufacturer map[uint16][]byte
+}
+
+// update applies org.bluez.Device1 properties. Any RSSI or advertising
+// data means an advertisement was received.
+func (d *bleDevice) update(props map[string]busValue) {
+	if v, ok := props["Address"]; ok {
+		json.Unmarshal(v.Data, &d.address)
+	}
+
+	if v, ok := props["RSSI"]; ok {
+		if json.Unmarshal(v.Data, &d.rssi) == nil {
+			d.seen = time.Now()
+		}
+	}
+
+	if v, ok := props["ManufacturerData"]; ok {
+		var m map[string]busValue
+		if json.Unmarshal(v.Data, &m) == nil {
+			d.manufacturer = make(map[uint16][]byte)
+			for k, b := range m {
+				id, err := strconv.ParseUint(k, 10, 16)
+				if err != nil {
+					continue
+				}
+				var bytes []byte
+				if json.Unmarshal(b.Data, &bytes) == nil {
+					d.manufacturer[uint16(id)] = bytes
+				}
+			}
+			d.seen = time.Now()
+		}
+	}
+}
+
+// parseIBeacon returns the UUID, major, and minor of an iBeacon
+// advertisement
+func parseIBeacon(m []byte) (uuid string, major, minor int, ok bool) {
+	if len(m) < 22 || m[0] != 0x02 || m[1] != 0x15 {
+		return "", 0, 0, false
+	}
+
+	h := hex.EncodeToString(m[2:18])
+	uuid = h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+	return uuid, int(binary.BigEndian.Uint16(m[18:])),
+		int(binary.BigEndian.Uint16(m[20:])), true
+}
+
+// parseRuuvi returns the readings of a RuuviTag data format 5
+// advertisement
+func parseRuuvi(id string, m []byte) []data.Sample {
+	if len(m) < 15 || m[0] != 5 {
+		return nil
+	}
+
+	var ret []data.Sample
+	add := func(typ string, raw, invalid uint16, v float64) {
+		// the maximum value of each field means it is not available
+		if raw != invalid {
+			ret = append(ret, data.Sample{Type: typ, ID: id, Value: v})
+		}
+	}
+
+	temp := binary.BigEndian.Uint16(m[1:])
+	add("temp", temp, 0x8000, float64(int16(temp))*0.005)
+	hum := binary.BigEndian.Uint16(m[3:])
+	add("humidity", hum, 0xffff, float64(hum)*0.0025)
+	pressure := binary.BigEndian.Uint16(m[5:])
+	add("pressure", pressure, 0xffff, (float64(pressure)+50000)/100)
+	power := binary.BigEndian.Uint16(m[13:])
+	add("battery", power>>5, 0x7ff, (float64(power>>5)+1600)/1000)
+
+	return ret
+}
+
+// BleScanner scans for the BLE sensors in a device config with BlueZ,
+// and sends their readings as samples
+type BleScanner struct {
+	send    func([]data.Sample) error
+	adapter string
+	lock    sync.Mutex
+	sensors []data.BleSensor
+	stop    chan struct{}
+}
+
+// NewBleScanner creates a BLE scanner. adapter is the BlueZ adapter, like
+// hci0 (the default), and send is typically api.NewSendSamples.
+func NewBleScanner(adapter string, send func([]data.Sample) error) *BleScanner {
+	if adapter == "" {
+		adapter = "hci0"
+	}
+
+	return &BleScanner{send: send, adapter: "/org/bluez/" + adapter}
+}
+
+// devicePath returns the D-Bus path of a device address
+func (bs *BleScanner) devicePath(address string) string {
+	return bs.adapter + "/dev_" + strings.ToUpper(strings.Replace(address, ":", "_", -1))
+}
+
+// monitor reads BlueZ signals and updates devices until stop is closed
+func (bs *BleScanner) monitor(devices map[string]*bleDevice, lock *sync.Mutex, stop chan struct{}) {
+	for {
+		cmd := exec.Command("busctl", "--system", "--json=short", "monitor",
+			bluezService)
+		out, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+
+		if err != nil {
+			log.Println("Error monitoring BlueZ: ", err)
+		} else {
+			done := make(chan struct{})
+			go func() {
+				select {
+				case <-stop:
+					cmd.Process.Kill()
+				case <-done:
+				}
+			}()
+
+			scanner := bufio.NewScanner(out)
+			scanner.Buffer(nil, 1<<20)
+			for scanner.Scan() {
+				var msg busMessage
+				if json.Unmarshal(scanner.Bytes(), &msg) != nil ||
+					msg.Type != "signal" {
+					continue
+				}
+
+				var path string
+				var props map[string]busValue
+
+				switch msg.Member {
+				case "PropertiesChanged":
+					// payload is the interface, changed properties, and
+					// invalidated properties
+					var p []json.RawMessage
+					var iface string
+					if json.Unmarshal(msg.Payload.Data, &p) != nil || len(p) < 2 ||
+						json.Unmarshal(p[0], &iface) != nil || iface != bluezDevice {
+						continue
+					}
+					path = msg.Path
+					json.Unmarshal(p[1], &props)
+				case "InterfacesAdded":
+					// payload is the object path and its interfaces
+					var p []json.RawMessage
+					var ifaces map[string]map[string]busValue
+					if json.Unmarshal(msg.Payload.Data, &p) != nil || len(p) < 2 ||
+						json.Unmarshal(p[0], &path) != nil ||
+						json.Unmarshal(p[1], &ifaces) != nil {
+						continue
+					}
+					props = ifaces[bluezDevice]
+				}
+
+				if props == nil || !strings.HasPrefix(path, bs.adapter+"/dev_") {
+					continue
+				}
+
+				lock.Lock()
+				d := devices[path]
+				if d == nil {
+					d = &bleDevice{}
+					devices[path] = d
+				}
+				d.update(props)
+				lock.Unlock()
+			}
+
+			close(done)
+			cmd.Wait()
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// startDiscovery starts an LE scan that reports every advertisement, so
+// the RSSI stays current
+func (bs *BleScanner) startDiscovery() error {
+	_, err := busctl("call", bluezService, bs.adapter, bluezAdapter,
+		"SetDiscoveryFilter", "a{sv}", "2", "Transport", "s", "le",
+		"DuplicateData", "b", "true")
+	if err != nil {
+		return err
+	}
+
+	_, err = busctl("call", bluezService, bs.adapter, bluezAdapter,
+		"StartDiscovery")
+	return err
+}
+
+// samples returns the presence, rssi, and advertised readings of sensors
+func (bs *BleScanner) samples(sensors []data.BleSensor, devices map[string]*bleDevice) []data.Sample {
+	now := time.Now()
+	var ret []data.Sample
+
+	for _, s := range sensors {
+		var d *bleDevice
+		if s.Format == data.BleIBeacon {
+			// the beacon that was seen last
+			for _, dev := range devices {
+				uuid, major, minor, ok := parseIBeacon(dev.manufacturer[bleApple])
+				if ok && strings.EqualFold(uuid, s.UUID) &&
+					(s.Major == 0 || s.Major == major) &&
+					(s.Minor == 0 || s.Minor == minor) &&
+					(d == nil || dev.seen.After(d.seen)) {
+					d = dev
+				}
+			}
+		} else {
+			d = devices[bs.devicePath(s.Address)]
+		}
+
+		timeout := time.Duration(s.Timeout) * time.Second
+		if timeout == 0 {
+			timeout = time.Minute
+		}
+
+		if d == nil || now.Sub(d.seen) > timeout {
+			ret = append(ret, data.Sample{Type: "presence", ID: s.ID, Time: now})
+			continue
+		}
+
+		ret = append(ret,
+			data.Sample{Type: "presence", ID: s.ID, Value: 1, Time: now},
+			data.Sample{Type: "rssi", ID: s.ID, Value: d.rssi, Time: d.seen})
+
+		if s.Format == data.BleRuuvi {
+			for _, r := range parseRuuvi(s.ID, d.manufacturer[bleRuuvi]) {
+				r.Time = d.seen
+				ret = append(ret, r)
+			}
+		}
+	}
+
+	return ret
+}
+
+// readGatt connects to a sensor and reads its characteristics
+func (bs *BleScanner) readGatt(s data.BleSensor) ([]data.Sample, error) {
+	path := bs.devicePath(s.Address)
+
+	_, err := busctl("call", bluezService, path, bluezDevice, "Connect")
+	if err != nil {
+		return nil, err
+	}
+	defer busctl("call", bluezService, path, bluezDevice, "Disconnect")
+
+	// characteristics are available once services are resolved
+	for i := 0; ; i++ {
+		v, err := busctl("get-property", bluezService, path, bluezDevice,
+			"ServicesResolved")
+		if err == nil && v == "true" {
+			break
+		}
+
+		if i >= 20 {
+			return nil, fmt.Errorf("timeout resolving services of %v", s.Address)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	var objects []map[string]map[string]map[string]busValue
+	err = busctlJSON(&objects, "call", bluezService, "/", dbusObjectManager,
+		"GetManagedObjects")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("no BlueZ objects")
+	}
+
+	// characteristic paths by UUID
+	chars := make(map[string]string)
+	for p, ifaces := range objects[0] {
+		c, ok := ifaces[bluezCharacteristic]
+		if !ok || !strings.HasPrefix(p, path+"/") {
+			continue
+		}
+
+		var uuid string
+		if json.Unmarshal(c["UUID"].Data, &uuid) == nil {
+			chars[strings.ToLower(uuid)] = p
+		}
+	}
+
+	now := time.Now()
+	var ret []data.Sample
+
+	for _, c := range s.Characteristics {
+		p, ok := chars[strings.ToLower(c.UUID)]
+		if !ok {
+			return nil, fmt.Errorf("characteristic %v not found", c.UUID)
+		}
+
+		var value [][]byte
+		err := busctlJSON(&value, "call", bluezService, p, bluezCharacteristic,
+			"ReadValue", "a{sv}", "0")
+		if err != nil {
+			return nil, err
+		}
+
+		if len(value) == 0 {
+			return nil, fmt.Errorf("no value for characteristic %v", c.UUID)
+		}
+
+		v, ok := c.Value(value[0])
+		if !ok {
+			return nil, fmt.Errorf("characteristic %v value is too short", c.UUID)
+		}
+
+		ret = append(ret, data.Sample{Type: c.Type, ID: s.ID, Value: v, Time: now})
+	}
+
+	return ret, nil
+}
+
+// pollGatt reads a gatt sensor every interval until stop is closed
+func (bs *BleScanner) pollGatt(s data.BleSensor, stop chan struct{}) {
+	interval := time.Duration(s.Interval) * time.Second
+	if interval == 0 {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		samples, err := bs.readGatt(s)
+		if err != nil {
+			log.Printf("Error reading BLE sensor %v: %v", s.ID, err)
+		} else {
+			err := bs.send(samples)
+			if err != nil {
+				log.Println("Error sending BLE samples: ", err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// run scans for sensors until stop is closed
+func (bs *BleScanner) run(sensors []data.BleSensor, stop chan struct{}) {
+	devices := make(map[string]*bleDevice)
+	var lock sync.Mutex
+
+	go bs.monitor(devices, &lock, stop)
+
+	for _, s := range sensors {
+		if s.Format == data.BleGatt {
+			go bs.pollGatt(s, stop)
+		}
+	}
+
+	ticker := time.NewTicker(bleReportInterval)
+	defer ticker.Stop()
+
+	discovering := false
+
+	for {
+		// discovery stops if the adapter is reset or another client stops
+		// it, so check it is still running
+		v, err := busctl("get-property", bluezService, bs.adapter,
+			bluezAdapter, "Discovering")
+		if err != nil || v != "true" {
+			err := bs.startDiscovery()
+			if err != nil && discovering {
+				log.Println("Error starting BLE discovery: ", err)
+			}
+			discovering = err == nil
+		}
+
+		lock.Lock()
+		samples := bs.samples(sensors, devices)
+		lock.Unlock()
+
+		err = bs.send(samples)
+		if err != nil {
+			log.Println("Error sending BLE samples: ", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			busctl("call", bluezService, bs.adapter, bluezAdapter,
+				"StopDiscovery")
+			return
+		}
+	}
+}
+
+// Update starts scanning for the sensors in a device config. It should be
+// called when the device config changes.
+func (bs *BleScanner) Update(sensors []data.BleSensor) {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	if reflect.DeepEqual(sensors, bs.sensors) {
+		return
+	}
+
+	if bs.stop != nil {
+		close(bs.stop)
+		bs.stop = nil
+	}
+
+	bs.sensors = append([]data.BleSensor{}, sensors...)
+
+	if len(sensors) > 0 {
+		bs.stop = make(chan struct{})
+		go bs.run(bs.sensors, bs.stop)
+	}
+}
+
+// Stop stops scanning
+func (bs *BleScanner) Stop() {
+	bs.Update(nil)
+}
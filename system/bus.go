@@ -0,0 +1,101 @@
+package system
+
+import (
+	"errors"
+	"os"
+)
+
+// I2C is a device on an I2C bus
+type I2C struct {
+	file *os.File
+}
+
+// OpenI2C opens the device at addr on bus, like /dev/i2c-1
+func OpenI2C(bus string, addr int) (*I2C, error) {
+	f, err := os.OpenFile(bus, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	err = i2cSetAddress(f, addr)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &I2C{file: f}, nil
+}
+
+// Write writes b to the device
+func (d *I2C) Write(b []byte) error {
+	_, err := d.file.Write(b)
+	return err
+}
+
+// Read reads len(b) bytes from the device
+func (d *I2C) Read(b []byte) error {
+	n, err := d.file.Read(b)
+	if err == nil && n != len(b) {
+		err = errors.New("short I2C read")
+	}
+	return err
+}
+
+// WriteReg writes values starting at register reg
+func (d *I2C) WriteReg(reg byte, values ...byte) error {
+	return d.Write(append([]byte{reg}, values...))
+}
+
+// ReadReg reads len(b) bytes starting at register reg
+func (d *I2C) ReadReg(reg byte, b []byte) error {
+	err := d.Write([]byte{reg})
+	if err != nil {
+		return err
+	}
+
+	return d.Read(b)
+}
+
+// Close closes the device
+func (d *I2C) Close() error {
+	return d.file.Close()
+}
+
+// SPI is a device on an SPI bus
+type SPI struct {
+	file  *os.File
+	speed uint32
+}
+
+// OpenSPI opens an spidev device, like /dev/spidev0.0, with the SPI mode
+// (0-3) and clock speed in Hz
+func OpenSPI(dev string, mode uint8, speed uint32) (*SPI, error) {
+	f, err := os.OpenFile(dev, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	err = spiSetup(f, mode, speed)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &SPI{file: f, speed: speed}, nil
+}
+
+// Transfer writes tx while reading the same number of bytes
+func (d *SPI) Transfer(tx []byte) ([]byte, error) {
+	if len(tx) <= 0 {
+		return nil, nil
+	}
+
+	rx := make([]byte, len(tx))
+	err := spiTransfer(d.file, d.speed, tx, rx)
+	return rx, err
+}
+
+// Close closes the device
+func (d *SPI) Close() error {
+	return d.file.Close()
+}
@@ -0,0 +1,79 @@
+package system
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// i2c and spidev ioctls
+const (
+	i2cSlave           = 0x0703
+	spiIocMessage1     = 0x40206b00
+	spiIocWrMode       = 0x40016b01
+	spiIocWrBitsPerWrd = 0x40016b03
+	spiIocWrMaxSpeedHz = 0x40046b04
+)
+
+func i2cSetAddress(f *os.File, addr int) error {
+	// the address is passed as the ioctl arg rather than a pointer
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), i2cSlave,
+		uintptr(addr))
+	if errno != 0 {
+		return os.NewSyscallError("I2C_SLAVE", errno)
+	}
+	return nil
+}
+
+// spi_ioc_transfer from linux/spi/spidev.h
+type spiIocTransfer struct {
+	txBuf       uint64
+	rxBuf       uint64
+	len         uint32
+	speedHz     uint32
+	delayUsecs  uint16
+	bitsPerWord uint8
+	csChange    uint8
+	txNbits     uint8
+	rxNbits     uint8
+	wordDelay   uint8
+	pad         uint8
+}
+
+func spiSetup(f *os.File, mode uint8, speed uint32) error {
+	bits := uint8(8)
+
+	err := ioctl(f.Fd(), spiIocWrMode, unsafe.Pointer(&mode))
+	if err == nil {
+		err = ioctl(f.Fd(), spiIocWrBitsPerWrd, unsafe.Pointer(&bits))
+	}
+	if err == nil {
+		err = ioctl(f.Fd(), spiIocWrMaxSpeedHz, unsafe.Pointer(&speed))
+	}
+
+	if err != nil {
+		return os.NewSyscallError("SPI setup", err)
+	}
+	return nil
+}
+
+func spiTransfer(f *os.File, speed uint32, tx, rx []byte) error {
+	tr := spiIocTransfer{
+		txBuf:       uint64(uintptr(unsafe.Pointer(&tx[0]))),
+		rxBuf:       uint64(uintptr(unsafe.Pointer(&rx[0]))),
+		len:         uint32(len(tx)),
+		speedHz:     speed,
+		bitsPerWord: 8,
+	}
+
+	err := ioctl(f.Fd(), spiIocMessage1, unsafe.Pointer(&tr))
+	// the buffers are only referenced by address in the transfer
+	runtime.KeepAlive(tx)
+	runtime.KeepAlive(rx)
+
+	if err != nil {
+		return os.NewSyscallError("SPI_IOC_MESSAGE", err)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package system
+
+import "os"
+
+func i2cSetAddress(f *os.File, addr int) error {
+	return errUnsupported
+}
+
+func spiSetup(f *os.File, mode uint8, speed uint32) error {
+	return errUnsupported
+}
+
+func spiTransfer(f *os.File, speed uint32, tx, rx []byte) error {
+	return errUnsupported
+}
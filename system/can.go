@@ -0,0 +1,171 @@
+package system
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/can"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// CanReader reads the CAN buses in a device config, and sends the latest
+// values of the selected signals as samples at their intervals
+type CanReader struct {
+	send    func([]data.Sample) error
+	lock    sync.Mutex
+	configs []data.CanConfig
+	stops   []chan struct{}
+}
+
+// NewCanReader creates a CAN reader. send is typically
+// api.NewSendSamples.
+func NewCanReader(send func([]data.Sample) error) *CanReader {
+	return &CanReader{send: send}
+}
+
+// canSignalMatch returns the index of the config signal for a decoded
+// value, or -1
+func canSignalMatch(signals []data.CanSignal, v can.Value) int {
+	for i, s := range signals {
+		if s.Signal == v.Signal && (s.Message == "" || s.Message == v.Message) {
+			return i
+		}
+	}
+	return -1
+}
+
+// read reads a bus until there is an error or stop is closed
+func (cr *CanReader) read(config data.CanConfig, stop chan struct{}) error {
+	f, err := os.Open(config.Dbc)
+	if err != nil {
+		return err
+	}
+
+	db, err := can.ParseDBC(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	bus, err := can.Open(config.Interface)
+	if err != nil {
+		return err
+	}
+
+	decoder := can.NewDecoder(db, config.J1939)
+
+	// latest values, and if they changed since they were last sent
+	var lock sync.Mutex
+	values := make([]float64, len(config.Signals))
+	updated := make([]bool, len(config.Signals))
+
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			frame, err := bus.Read()
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			lock.Lock()
+			for _, v := range decoder.Decode(frame) {
+				i := canSignalMatch(config.Signals, v)
+				if i >= 0 {
+					values[i] = v.Value
+					updated[i] = true
+				}
+			}
+			lock.Unlock()
+		}
+	}()
+
+	interval := time.Duration(config.Interval) * time.Second
+	if interval == 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			var samples []data.Sample
+			lock.Lock()
+			for i, s := range config.Signals {
+				if updated[i] {
+					samples = append(samples, data.Sample{Type: s.Type, ID: s.ID,
+						Value: values[i], Time: time.Now()})
+					updated[i] = false
+				}
+			}
+			lock.Unlock()
+
+			if len(samples) > 0 {
+				err := cr.send(samples)
+				if err != nil {
+					log.Println("Error sending can samples: ", err)
+				}
+			}
+		case err := <-errs:
+			bus.Close()
+			return err
+		case <-stop:
+			bus.Close()
+			return nil
+		}
+	}
+}
+
+// run reads a bus until stop is closed, and retries on errors
+func (cr *CanReader) run(config data.CanConfig, stop chan struct{}) {
+	for {
+		err := cr.read(config, stop)
+		if err == nil {
+			return
+		}
+
+		log.Printf("Error reading can %v: %v\n", config.Interface, err)
+
+		timer := time.NewTimer(10 * time.Second)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Update starts reading the CAN buses in configs, and stops reading any
+// that were removed. It should be called when the device config changes.
+func (cr *CanReader) Update(configs []data.CanConfig) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	if reflect.DeepEqual(configs, cr.configs) {
+		return
+	}
+
+	for _, stop := range cr.stops {
+		close(stop)
+	}
+
+	cr.configs = append([]data.CanConfig{}, configs...)
+	cr.stops = nil
+
+	for _, c := range configs {
+		stop := make(chan struct{})
+		cr.stops = append(cr.stops, stop)
+		go cr.run(c, stop)
+	}
+}
+
+// Stop stops reading all CAN buses
+func (cr *CanReader) Stop() {
+	cr.Update(nil)
+}
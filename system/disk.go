@@ -0,0 +1,298 @@
+package system
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// DiskUsage is the space and inode usage of a mounted filesystem. Sizes are
+// in bytes.
+type DiskUsage struct {
+	Mount      string
+	Total      uint64
+	Used       uint64
+	Free       uint64
+	Inodes     uint64
+	InodesFree uint64
+}
+
+// UsedPercent returns the percent of the space that is used. Space
+// reserved for root is counted as used.
+func (d DiskUsage) UsedPercent() float64 {
+	if d.Total == 0 {
+		return 0
+	}
+	return float64(d.Total-d.Free) * 100 / float64(d.Total)
+}
+
+// InodesUsedPercent returns the percent of the inodes that are used
+func (d DiskUsage) InodesUsedPercent() float64 {
+	if d.Inodes == 0 {
+		// some filesystems don't have a fixed number of inodes
+		return 0
+	}
+	return float64(d.Inodes-d.InodesFree) * 100 / float64(d.Inodes)
+}
+
+// statfs is a variable so tests can replace it
+var statfs = platformStatfs
+
+// DiskStat returns the usage of the filesystem mounted at mount
+func DiskStat(mount string) (DiskUsage, error) {
+	return statfs(mount)
+}
+
+// pseudoFilesystems don't use disk space
+var pseudoFilesystems = map[string]bool{
+	"proc": true, "sysfs": true, "devtmpfs": true, "devpts": true,
+	"tmpfs": true, "cgroup": true, "cgroup2": true, "securityfs": true,
+	"debugfs": true, "tracefs": true, "pstore": true, "bpf": true,
+	"configfs": true, "mqueue": true, "hugetlbfs": true, "fusectl": true,
+	"autofs": true, "binfmt_misc": true, "overlay": true, "squashfs": true,
+	"nsfs": true, "efivarfs": true, "rpc_pipefs": true,
+}
+
+// Mounts returns the mount points of filesystems that store data, from
+// /proc/mounts. Pseudo and read only image filesystems are skipped.
+func Mounts() ([]string, error) {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ret []string
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || pseudoFilesystems[fields[2]] || seen[fields[1]] {
+			continue
+		}
+
+		seen[fields[1]] = true
+		ret = append(ret, fields[1])
+	}
+
+	return ret, scanner.Err()
+}
+
+// DiskMonitorConfig describes what disk usage is monitored
+type DiskMonitorConfig struct {
+	// Mounts to check (default all filesystems that store data)
+	Mounts []string
+	// Files are reported by size, like the database file
+	Files []string
+	// Interval is how often usage is checked (default 5m)
+	Interval time.Duration
+	// Threshold is the used percent of space or inodes at which Cleanup
+	// is called (default 90)
+	Threshold float64
+	// Cleanup is called with the usage of a filesystem over Threshold, and
+	// should free space, like pruning logs or history
+	Cleanup func(DiskUsage) error
+	// Alert is called with the usage of a filesystem that is still over
+	// Threshold after Cleanup. It is not called again for the filesystem
+	// until the usage drops Hysteresis percent below Threshold (default
+	// 5).
+	Alert      func(DiskUsage)
+	Hysteresis float64
+	// ID is used as the sample ID
+	ID string
+	// Send is called with the usage samples after each check
+	Send func([]data.Sample) error
+}
+
+// DiskMonitor periodically reports disk usage and frees space before
+// filesystems fill up
+type DiskMonitor struct {
+	config DiskMonitorConfig
+	lock   sync.Mutex
+	usage  []DiskUsage
+	files  map[string]int64
+	// alerted are the mounts Alert was called for
+	alerted map[string]bool
+	stop    chan struct{}
+}
+
+// NewDiskMonitor creates a disk monitor
+func NewDiskMonitor(config DiskMonitorConfig) *DiskMonitor {
+	if config.Interval == 0 {
+		config.Interval = 5 * time.Minute
+	}
+
+	if config.Threshold == 0 {
+		config.Threshold = 90
+	}
+
+	if config.Hysteresis == 0 {
+		config.Hysteresis = 5
+	}
+
+	return &DiskMonitor{
+		config:  config,
+		alerted: make(map[string]bool),
+		stop:    make(chan struct{}),
+	}
+}
+
+func (dm *DiskMonitor) over(d DiskUsage) bool {
+	return d.UsedPercent() >= dm.config.Threshold ||
+		d.InodesUsedPercent() >= dm.config.Threshold
+}
+
+// cleared returns true if the usage is far enough below the threshold to
+// alert again
+func (dm *DiskMonitor) cleared(d DiskUsage) bool {
+	limit := dm.config.Threshold - dm.config.Hysteresis
+	return d.UsedPercent() < limit && d.InodesUsedPercent() < limit
+}
+
+// shouldAlert records whether a filesystem is over the threshold, and
+// returns true if it just went over
+func (dm *DiskMonitor) shouldAlert(d DiskUsage) bool {
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+
+	if dm.over(d) {
+		alert := !dm.alerted[d.Mount]
+		dm.alerted[d.Mount] = true
+		return alert
+	}
+
+	if dm.cleared(d) {
+		delete(dm.alerted, d.Mount)
+	}
+
+	return false
+}
+
+// Check reads the current usage, runs Cleanup for filesystems over the
+// threshold, and runs Alert when a filesystem goes over the threshold
+func (dm *DiskMonitor) Check() ([]DiskUsage, error) {
+	mounts := dm.config.Mounts
+	if len(mounts) <= 0 {
+		var err error
+		mounts, err = Mounts()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var usage []DiskUsage
+	for _, mount := range mounts {
+		d, err := DiskStat(mount)
+		if err != nil {
+			log.Printf("Error reading disk usage for %v: %v", mount, err)
+			continue
+		}
+
+		if dm.over(d) && dm.config.Cleanup != nil {
+			log.Printf("Disk %v is %.0f%% full, cleaning up", mount, d.UsedPercent())
+			err := dm.config.Cleanup(d)
+			if err != nil {
+				log.Println("Error cleaning up disk: ", err)
+			}
+
+			d, err = DiskStat(mount)
+			if err != nil {
+				continue
+			}
+		}
+
+		if dm.shouldAlert(d) && dm.config.Alert != nil {
+			dm.config.Alert(d)
+		}
+
+		usage = append(usage, d)
+	}
+
+	files := make(map[string]int64)
+	for _, file := range dm.config.Files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		files[file] = fi.Size()
+	}
+
+	dm.lock.Lock()
+	dm.usage = usage
+	dm.files = files
+	dm.lock.Unlock()
+
+	return usage, nil
+}
+
+// Samples returns the usage from the last check as samples tagged with the
+// mount point or file name
+func (dm *DiskMonitor) Samples(id string) []data.Sample {
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+
+	now := time.Now()
+	var ret []data.Sample
+
+	for _, d := range dm.usage {
+		tags := map[string]string{"mount": d.Mount}
+		ret = append(ret,
+			data.Sample{Type: "diskUsed", ID: id, Value: d.UsedPercent(),
+				Time: now, Tags: tags},
+			data.Sample{Type: "diskFree", ID: id, Value: float64(d.Free),
+				Time: now, Tags: tags},
+		)
+
+		if d.Inodes > 0 {
+			ret = append(ret, data.Sample{Type: "inodesUsed", ID: id,
+				Value: d.InodesUsedPercent(), Time: now, Tags: tags})
+		}
+	}
+
+	for file, size := range dm.files {
+		ret = append(ret, data.Sample{Type: "fileSize", ID: id,
+			Value: float64(size), Time: now,
+			Tags: map[string]string{"file": file}})
+	}
+
+	return ret
+}
+
+// Start checks usage until Stop is called
+func (dm *DiskMonitor) Start() {
+	go func() {
+		ticker := time.NewTicker(dm.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			_, err := dm.Check()
+			if err != nil {
+				log.Println("Error checking disk usage: ", err)
+			}
+
+			if err == nil && dm.config.Send != nil {
+				err := dm.config.Send(dm.Samples(dm.config.ID))
+				if err != nil {
+					log.Println("Error sending disk usage: ", err)
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-dm.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops checking usage
+func (dm *DiskMonitor) Stop() {
+	close(dm.stop)
+}
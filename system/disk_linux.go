@@ -0,0 +1,24 @@
+package system
+
+import "syscall"
+
+func platformStatfs(mount string) (DiskUsage, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(mount, &st)
+	if err != nil {
+		return DiskUsage{}, err
+	}
+
+	bsize := uint64(st.Bsize)
+
+	return DiskUsage{
+		Mount: mount,
+		Total: st.Blocks * bsize,
+		// Bavail is what is available to unprivileged users, and Bfree
+		// includes the blocks reserved for root
+		Used:       (st.Blocks - st.Bfree) * bsize,
+		Free:       st.Bavail * bsize,
+		Inodes:     st.Files,
+		InodesFree: st.Ffree,
+	}, nil
+}
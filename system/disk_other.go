@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package system
+
+func platformStatfs(mount string) (DiskUsage, error) {
+	return DiskUsage{}, errUnsupported
+}
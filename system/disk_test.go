@@ -0,0 +1,105 @@
+package system
+
+import "testing"
+
+func TestDiskUsagePercent(t *testing.T) {
+	tests := []struct {
+		usage  DiskUsage
+		used   float64
+		inodes float64
+	}{
+		{DiskUsage{}, 0, 0},
+		// reserved blocks are counted as used
+		{DiskUsage{Total: 1000, Used: 800, Free: 150, Inodes: 100,
+			InodesFree: 25}, 85, 75},
+		{DiskUsage{Total: 1000, Free: 1000}, 0, 0},
+	}
+
+	for _, test := range tests {
+		if u := test.usage.UsedPercent(); u != test.used {
+			t.Errorf("%+v: used is %v, expected %v", test.usage, u, test.used)
+		}
+
+		if u := test.usage.InodesUsedPercent(); u != test.inodes {
+			t.Errorf("%+v: inodes used is %v, expected %v", test.usage, u,
+				test.inodes)
+		}
+	}
+}
+
+func TestDiskMonitor(t *testing.T) {
+	// free space and free inodes of the stubbed filesystem, out of 100
+	var free, inodesFree uint64
+
+	oldStatfs := statfs
+	defer func() { statfs = oldStatfs }()
+	statfs = func(mount string) (DiskUsage, error) {
+		return DiskUsage{Mount: mount, Total: 100, Used: 100 - free, Free: free,
+			Inodes: 100, InodesFree: inodesFree}, nil
+	}
+
+	var cleanups, alerts int
+	// cleanupFree is the free space after a cleanup
+	var cleanupFree uint64
+
+	dm := NewDiskMonitor(DiskMonitorConfig{
+		Mounts: []string{"/data"},
+		Cleanup: func(d DiskUsage) error {
+			cleanups++
+			free = cleanupFree
+			return nil
+		},
+		Alert: func(d DiskUsage) {
+			alerts++
+		},
+	})
+
+	steps := []struct {
+		name        string
+		free        uint64
+		inodesFree  uint64
+		cleanupFree uint64
+		cleanups    int
+		alerts      int
+	}{
+		{"under threshold", 50, 50, 0, 0, 0},
+		{"cleanup frees space", 5, 50, 50, 1, 0},
+		{"still full after cleanup", 5, 50, 5, 2, 1},
+		// only alert once while over the threshold
+		{"still full", 5, 50, 5, 3, 1},
+		// under the threshold, but within the hysteresis
+		{"under threshold", 12, 50, 12, 3, 1},
+		{"full again", 8, 50, 8, 4, 1},
+		// clears the alert
+		{"cleared", 20, 50, 20, 4, 1},
+		{"full again", 8, 50, 8, 5, 2},
+		{"cleared", 50, 50, 50, 5, 2},
+		// inodes count toward the threshold too
+		{"inodes full", 50, 10, 50, 6, 3},
+	}
+
+	for _, s := range steps {
+		free, inodesFree, cleanupFree = s.free, s.inodesFree, s.cleanupFree
+
+		usage, err := dm.Check()
+		if err != nil {
+			t.Fatal("Error checking disk usage: ", err)
+		}
+
+		if cleanups != s.cleanups || alerts != s.alerts {
+			t.Errorf("%v: cleanups/alerts are %v/%v, expected %v/%v", s.name,
+				cleanups, alerts, s.cleanups, s.alerts)
+		}
+
+		// the usage is read again after a cleanup
+		if len(usage) != 1 || usage[0].Free != free {
+			t.Errorf("%v: usage is %+v, expected free %v", s.name, usage, free)
+		}
+	}
+
+	samples := dm.Samples("dev")
+	if len(samples) != 3 || samples[0].Type != "diskUsed" ||
+		samples[0].Tags["mount"] != "/data" || samples[2].Value != 90 {
+		t.Errorf("wrong samples: %+v", samples)
+	}
+}
@@ -0,0 +1,207 @@
+package system
+
+import (
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/go-serial/serial"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/dnp3"
+)
+
+// dnp3Timeout is how long an outstation has to respond
+const dnp3Timeout = 5 * time.Second
+
+// OpenDnp3 opens a client for the serial port or network address in a
+// DNP3 config
+func OpenDnp3(config data.Dnp3Config) (*dnp3.Client, error) {
+	cc := dnp3.Config{
+		Master:     uint16(config.Master),
+		Outstation: uint16(config.Outstation),
+		Timeout:    dnp3Timeout,
+	}
+
+	if config.Address != "" {
+		return dnp3.DialTCP(config.Address, cc)
+	}
+
+	portName, err := ResolveSerialPort(config.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	baud := config.Baud
+	if baud == 0 {
+		baud = 9600
+	}
+
+	port, err := serial.Open(serial.OpenOptions{
+		PortName:              portName,
+		BaudRate:              uint(baud),
+		DataBits:              8,
+		StopBits:              1,
+		MinimumReadSize:       0,
+		InterCharacterTimeout: 100,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return dnp3.NewClient(port, cc), nil
+}
+
+// Dnp3Samples returns the samples for the points in a DNP3 config. Points
+// that are not in the config or are offline are skipped. Events keep the
+// time the outstation recorded.
+func Dnp3Samples(config data.Dnp3Config, points []dnp3.Point) []data.Sample {
+	now := time.Now()
+	var ret []data.Sample
+
+	for _, p := range points {
+		if !p.Online() {
+			continue
+		}
+
+		for _, cp := range config.Points {
+			if cp.Object != string(p.Type) || cp.Index != p.Index {
+				continue
+			}
+
+			t := p.Time
+			if t.IsZero() {
+				t = now
+			}
+
+			ret = append(ret, data.Sample{Type: cp.Type, ID: cp.ID,
+				Value: cp.Value(p.Value), Time: t})
+		}
+	}
+
+	return ret
+}
+
+// Dnp3Scheduler polls the DNP3 outstations in a device config for events
+// at their intervals, with periodic integrity polls, and sends the readings
+// as samples. Each outstation uses its own connection.
+type Dnp3Scheduler struct {
+	send    func([]data.Sample) error
+	lock    sync.Mutex
+	configs []data.Dnp3Config
+	stops   []chan struct{}
+}
+
+// NewDnp3Scheduler creates a DNP3 scheduler. send is typically
+// api.NewSendSamples.
+func NewDnp3Scheduler(send func([]data.Sample) error) *Dnp3Scheduler {
+	return &Dnp3Scheduler{send: send}
+}
+
+// run polls an outstation until stop is closed
+func (ds *Dnp3Scheduler) run(config data.Dnp3Config, stop chan struct{}) {
+	interval := time.Duration(config.Interval) * time.Second
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+
+	integrityInterval := time.Duration(config.IntegrityInterval) * time.Second
+	if integrityInterval == 0 {
+		integrityInterval = time.Hour
+	}
+
+	var client *dnp3.Client
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+	}()
+
+	var integrity time.Time
+	restarts := 0
+
+	for {
+		var err error
+		if client == nil {
+			client, err = OpenDnp3(config)
+			if err != nil {
+				log.Printf("Error opening dnp3 outstation %v: %v\n",
+					config.Outstation, err)
+			}
+			// values may have changed while disconnected
+			integrity = time.Time{}
+		}
+
+		if client != nil {
+			var points []dnp3.Point
+			if time.Since(integrity) >= integrityInterval {
+				points, err = client.IntegrityPoll()
+				if err == nil {
+					integrity = time.Now()
+				}
+			} else {
+				points, err = client.Read(1, 2, 3)
+			}
+
+			// events lost in a restart are made up for by an integrity
+			// poll
+			if client.Restarts() != restarts {
+				restarts = client.Restarts()
+				integrity = time.Time{}
+			}
+
+			if samples := Dnp3Samples(config, points); len(samples) > 0 {
+				err := ds.send(samples)
+				if err != nil {
+					log.Println("Error sending dnp3 samples: ", err)
+				}
+			}
+
+			if err != nil {
+				log.Printf("Error reading dnp3 outstation %v: %v\n",
+					config.Outstation, err)
+				client.Close()
+				client = nil
+				restarts = 0
+			}
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Update starts polling the DNP3 outstations in configs, and stops polling
+// any that were removed. It should be called when the device config
+// changes.
+func (ds *Dnp3Scheduler) Update(configs []data.Dnp3Config) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	if reflect.DeepEqual(configs, ds.configs) {
+		return
+	}
+
+	for _, stop := range ds.stops {
+		close(stop)
+	}
+
+	ds.configs = append([]data.Dnp3Config{}, configs...)
+	ds.stops = nil
+
+	for _, c := range configs {
+		stop := make(chan struct{})
+		ds.stops = append(ds.stops, stop)
+		go ds.run(c, stop)
+	}
+}
+
+// Stop stops polling all DNP3 outstations
+func (ds *Dnp3Scheduler) Stop() {
+	ds.Update(nil)
+}
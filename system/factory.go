@@ -0,0 +1,181 @@
+package system
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// FactoryResetCommand is the device command used to reset the device. The
+// first command returns a confirmation token, and a second command with
+// the token arg does the reset.
+const FactoryResetCommand = "factoryReset"
+
+// factoryTokenTimeout is how long a confirmation token is valid
+const factoryTokenTimeout = 5 * time.Minute
+
+// ErrFactoryToken is returned when the confirmation token is missing,
+// wrong, or expired
+var ErrFactoryToken = errors.New("invalid or expired factory reset token")
+
+// FactoryResetConfig describes what a factory reset removes
+type FactoryResetConfig struct {
+	// Paths are removed by the reset, like the data directory, device
+	// credentials, network provisioning, and logs
+	Paths []string
+	// Before is called before anything is removed, and should stop
+	// anything using the paths, like closing the database
+	Before func() error
+	// Reboot is called after the reset so the device starts in the
+	// provisioning state, typically Power.Reboot
+	Reboot func(reason string) error
+}
+
+// FactoryReset returns the device to the state it shipped in, so it can be
+// claimed and provisioned again
+type FactoryReset struct {
+	config       FactoryResetConfig
+	lock         sync.Mutex
+	token        string
+	tokenExpires time.Time
+	stop         chan struct{}
+}
+
+// NewFactoryReset creates a factory reset controller
+func NewFactoryReset(config FactoryResetConfig) *FactoryReset {
+	return &FactoryReset{config: config, stop: make(chan struct{})}
+}
+
+// Token returns a new confirmation token that must be passed to Reset
+// within 5 minutes
+func (f *FactoryReset) Token() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.token = hex.EncodeToString(b)
+	f.tokenExpires = time.Now().Add(factoryTokenTimeout)
+
+	return f.token, nil
+}
+
+// Reset does the factory reset if token is the last token returned by
+// Token
+func (f *FactoryReset) Reset(token string) error {
+	f.lock.Lock()
+	valid := time.Now().Before(f.tokenExpires) && data.TokenEqual(token, f.token)
+	// a token can only be used once
+	f.token = ""
+	f.lock.Unlock()
+
+	if !valid {
+		return ErrFactoryToken
+	}
+
+	return f.reset("factory reset")
+}
+
+func (f *FactoryReset) reset(reason string) error {
+	log.Println("Factory reset: ", reason)
+
+	if f.config.Before != nil {
+		err := f.config.Before()
+		if err != nil {
+			return fmt.Errorf("Error preparing for factory reset: %v", err)
+		}
+	}
+
+	var ret error
+	for _, p := range f.config.Paths {
+		err := os.RemoveAll(p)
+		if err != nil {
+			log.Println("Error removing during factory reset: ", err)
+			ret = err
+		}
+	}
+
+	if ret != nil {
+		return ret
+	}
+
+	if f.config.Reboot != nil {
+		return f.config.Reboot(reason)
+	}
+
+	return nil
+}
+
+// Command runs a FactoryResetCommand received from the server. If the
+// command does not have a token arg, a token is returned that must be sent
+// in a second command to confirm the reset.
+func (f *FactoryReset) Command(cmd data.DeviceCommand) (token string, err error) {
+	if cmd.Command != FactoryResetCommand {
+		return "", fmt.Errorf("unexpected command: %v", cmd.Command)
+	}
+
+	if t := cmd.Args["token"]; t != "" {
+		return "", f.Reset(t)
+	}
+
+	return f.Token()
+}
+
+// WatchButton resets the device when button reads true for hold. Holding
+// the button shows physical presence, so no token is needed.
+func (f *FactoryReset) WatchButton(button *Gpio, hold time.Duration) {
+	go func() {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+
+		var pressed time.Time
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-f.stop:
+				return
+			}
+
+			v, err := button.Read()
+			if err != nil || !v {
+				pressed = time.Time{}
+				continue
+			}
+
+			if pressed.IsZero() {
+				pressed = time.Now()
+				continue
+			}
+
+			if time.Since(pressed) >= hold {
+				err := f.reset("factory reset button")
+				if err != nil {
+					log.Println("Factory reset failed: ", err)
+				}
+				// wait for the button to be released
+				pressed = time.Time{}
+				for v && err == nil {
+					time.Sleep(100 * time.Millisecond)
+					v, err = button.Read()
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops watching the button
+func (f *FactoryReset) Stop() {
+	close(f.stop)
+}
@@ -0,0 +1,358 @@
+package system
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// FirmwareConfig describes how application firmware is updated
+type FirmwareConfig struct {
+	// Server is the HTTP URL of the SIOT server, like
+	// https://siot.example.com
+	Server string
+	// HTTPClient is used for downloads. http.DefaultClient is used if nil.
+	HTTPClient *http.Client
+	// Keys are the public keys firmware must be signed with
+	Keys []ed25519.PublicKey
+	// DownloadDir keeps partial downloads across restarts, so they can be
+	// resumed (default /var/lib/siot/firmware)
+	DownloadDir string
+	// Retries is how many times a download is resumed after it fails,
+	// like when a cellular link drops (default 10)
+	Retries int
+	// RetryDelay is the delay before resuming a download (default 30s)
+	RetryDelay time.Duration
+	// Install installs a firmware file that was downloaded and verified,
+	// like by replacing the application binary. The file is removed after
+	// Install returns.
+	Install func(file, version string) error
+	// Report sends install progress to the server, typically
+	// client.Client.ReportFirmware. Errors are logged.
+	Report func(data.FirmwareReport) error
+	// Maintenance, if set, defers installs to a maintenance window.
+	// Downloads start right away.
+	Maintenance *Maintenance
+}
+
+// Firmware downloads application firmware sent by a rollout, checks its
+// signature, and installs it
+type Firmware struct {
+	config FirmwareConfig
+	lock   sync.Mutex
+	// running are the rollouts being installed
+	running map[string]bool
+}
+
+// NewFirmware creates an application firmware updater
+func NewFirmware(config FirmwareConfig) (*Firmware, error) {
+	if config.Server == "" {
+		return nil, errors.New("server url is required")
+	}
+
+	if len(config.Keys) <= 0 {
+		return nil, errors.New("firmware keys are required")
+	}
+
+	if config.Install == nil {
+		return nil, errors.New("install function is required")
+	}
+
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+
+	if config.DownloadDir == "" {
+		config.DownloadDir = "/var/lib/siot/firmware"
+	}
+
+	if config.Retries == 0 {
+		config.Retries = 10
+	}
+
+	if config.RetryDelay == 0 {
+		config.RetryDelay = 30 * time.Second
+	}
+
+	return &Firmware{config: config, running: make(map[string]bool)}, nil
+}
+
+// firmwareUpdate is a firmware command from a rollout
+type firmwareUpdate struct {
+	rollout   uint64
+	version   string
+	size      int64
+	sha256    string
+	signature string
+	url       string
+}
+
+func (f *Firmware) report(u firmwareUpdate, state string, progress int, err error) {
+	if f.config.Report == nil {
+		return
+	}
+
+	r := data.FirmwareReport{
+		RolloutID: u.rollout,
+		State:     state,
+		Progress:  progress,
+	}
+
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	if state == data.InstallDone {
+		r.Version = u.version
+	}
+
+	rerr := f.config.Report(r)
+	if rerr != nil {
+		log.Println("Error reporting firmware progress: ", rerr)
+	}
+}
+
+// downloadCounter reports download progress in steps, so progress
+// reports don't use much of a slow link
+type downloadCounter struct {
+	count   int64
+	size    int64
+	last    int
+	percent func(int)
+}
+
+func (d *downloadCounter) Write(b []byte) (int, error) {
+	d.count += int64(len(b))
+	if d.size > 0 {
+		p := int(d.count * 100 / d.size)
+		if p >= d.last+10 {
+			d.last = p
+			d.percent(p)
+		}
+	}
+	return len(b), nil
+}
+
+// resume downloads the rest of the file after the bytes already in it.
+// The file is started over if the server does not support ranges or the
+// firmware changed.
+func (f *Firmware) resume(u firmwareUpdate, file *os.File, counter *downloadCounter) error {
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	if offset >= u.size {
+		return nil
+	}
+
+	url := strings.TrimRight(f.config.Server, "/") + u.url
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+		req.Header.Set("If-Range", `"`+u.sha256+`"`)
+	}
+
+	resp, err := f.config.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		offset = 0
+		err = file.Truncate(0)
+		if err != nil {
+			return err
+		}
+
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Error downloading firmware: %v", resp.Status)
+	}
+
+	counter.count = offset
+	_, err = io.Copy(io.MultiWriter(file, counter), resp.Body)
+	return err
+}
+
+// validSHA256 returns true if s is a hex encoded SHA-256 digest
+func validSHA256(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+// download downloads the firmware, resuming after errors, and checks the
+// digest and signature. The name of the file is returned.
+func (f *Firmware) download(u firmwareUpdate) (string, error) {
+	err := os.MkdirAll(f.config.DownloadDir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	// named by digest, so a download is resumed after a restart. The
+	// digest is checked here too, as it becomes part of a path.
+	if !validSHA256(u.sha256) {
+		return "", errors.New("invalid sha256")
+	}
+
+	name := filepath.Join(f.config.DownloadDir, u.sha256+".part")
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	counter := &downloadCounter{size: u.size, percent: func(p int) {
+		f.report(u, data.InstallDownloading, p, nil)
+	}}
+
+	for attempt := 0; ; attempt++ {
+		err = f.resume(u, file, counter)
+		if err == nil {
+			break
+		}
+
+		if attempt >= f.config.Retries {
+			return "", err
+		}
+
+		log.Printf("Firmware download failed, resuming in %v: %v",
+			f.config.RetryDelay, err)
+		time.Sleep(f.config.RetryDelay)
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	digest := hash.Sum(nil)
+	if hex.EncodeToString(digest) != strings.ToLower(u.sha256) {
+		os.Remove(name)
+		return "", errors.New("firmware digest does not match")
+	}
+
+	err = data.VerifyFirmware(f.config.Keys, digest, u.signature)
+	if err != nil {
+		os.Remove(name)
+		return "", err
+	}
+
+	return name, nil
+}
+
+// Update downloads and installs firmware
+func (f *Firmware) update(u firmwareUpdate) error {
+	f.report(u, data.InstallDownloading, 0, nil)
+
+	file, err := f.download(u)
+	if err != nil {
+		f.report(u, data.InstallFailed, 0, err)
+		return err
+	}
+	defer os.Remove(file)
+
+	install := func() error {
+		f.report(u, data.InstallInstalling, 100, nil)
+		return f.config.Install(file, u.version)
+	}
+
+	if f.config.Maintenance != nil {
+		err = f.config.Maintenance.Run("firmware update", install)
+	} else {
+		err = install()
+	}
+
+	if err != nil {
+		f.report(u, data.InstallFailed, 100, err)
+		return err
+	}
+
+	f.report(u, data.InstallDone, 100, nil)
+	return nil
+}
+
+// Command runs a data.FirmwareCommand received from the server. The update
+// runs in the background, and progress is reported with Report.
+func (f *Firmware) Command(cmd data.DeviceCommand) error {
+	if cmd.Command != data.FirmwareCommand {
+		return fmt.Errorf("unexpected command: %v", cmd.Command)
+	}
+
+	rollout, err := strconv.ParseUint(cmd.Args["rolloutId"], 10, 64)
+	if err != nil {
+		return errors.New("invalid rolloutId arg")
+	}
+
+	size, err := strconv.ParseInt(cmd.Args["size"], 10, 64)
+	if err != nil {
+		return errors.New("invalid size arg")
+	}
+
+	u := firmwareUpdate{
+		rollout:   rollout,
+		version:   cmd.Args["version"],
+		size:      size,
+		sha256:    strings.ToLower(cmd.Args["sha256"]),
+		signature: cmd.Args["signature"],
+		url:       cmd.Args["url"],
+	}
+
+	if u.url == "" || u.signature == "" {
+		return errors.New("url, sha256, and signature args are required")
+	}
+
+	if !validSHA256(u.sha256) {
+		return errors.New("sha256 arg must be 64 hex characters")
+	}
+
+	f.lock.Lock()
+	if f.running[u.sha256] {
+		f.lock.Unlock()
+		return nil
+	}
+	f.running[u.sha256] = true
+	f.lock.Unlock()
+
+	go func() {
+		err := f.update(u)
+		if err != nil {
+			log.Println("Firmware update failed: ", err)
+		}
+
+		f.lock.Lock()
+		delete(f.running, u.sha256)
+		f.lock.Unlock()
+	}()
+
+	return nil
+}
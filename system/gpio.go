@@ -0,0 +1,267 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// GpioCommand is the device command used to set an output. The name arg is
+// the output name, and the value arg is 1, 0, or toggle.
+const GpioCommand = "gpio"
+
+// sample types used for GPIO lines. The sample ID is the line name.
+const (
+	SampleTypeDigitalInput  = "digitalInput"
+	SampleTypeDigitalOutput = "digitalOutput"
+)
+
+// GpioConfig describes a GPIO line
+type GpioConfig struct {
+	// Name is used as the sample ID and in commands
+	Name string
+	// Chip is the GPIO character device (default /dev/gpiochip0)
+	Chip string
+	// Line is the offset of the line on the chip
+	Line int
+	// Output lines are driven, and start at Initial
+	Output  bool
+	Initial bool
+	// ActiveLow inverts the line value
+	ActiveLow bool
+}
+
+// Gpio is a GPIO line accessed through the kernel GPIO character device,
+// like libgpiod
+type Gpio struct {
+	config GpioConfig
+	lock   sync.Mutex
+	file   *os.File
+	value  bool
+}
+
+// OpenGpio requests a GPIO line from the kernel
+func OpenGpio(config GpioConfig) (*Gpio, error) {
+	if config.Chip == "" {
+		config.Chip = "/dev/gpiochip0"
+	}
+
+	f, err := gpioRequest(config)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening GPIO %v: %v", config.Name, err)
+	}
+
+	return &Gpio{config: config, file: f, value: config.Initial}, nil
+}
+
+// Name returns the line name
+func (g *Gpio) Name() string {
+	return g.config.Name
+}
+
+// Read returns the line value. Outputs return the last value written.
+func (g *Gpio) Read() (bool, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.config.Output {
+		return g.value, nil
+	}
+
+	return gpioGet(g.file)
+}
+
+// Write sets an output
+func (g *Gpio) Write(v bool) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if !g.config.Output {
+		return fmt.Errorf("GPIO %v is not an output", g.config.Name)
+	}
+
+	err := gpioSet(g.file, v)
+	if err != nil {
+		return err
+	}
+
+	g.value = v
+	return nil
+}
+
+// Close releases the line
+func (g *Gpio) Close() error {
+	return g.file.Close()
+}
+
+// GpioBank is a set of GPIO lines that are reported as samples and
+// controlled by device commands
+type GpioBank struct {
+	lines []*Gpio
+	lock  sync.Mutex
+	last  map[string]bool
+	stop  chan struct{}
+}
+
+// NewGpioBank opens the configured lines
+func NewGpioBank(configs []GpioConfig) (*GpioBank, error) {
+	b := &GpioBank{last: make(map[string]bool), stop: make(chan struct{})}
+
+	for _, c := range configs {
+		g, err := OpenGpio(c)
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+
+		b.lines = append(b.lines, g)
+	}
+
+	return b, nil
+}
+
+// Line returns the line with name, or nil if there is none
+func (b *GpioBank) Line(name string) *Gpio {
+	for _, g := range b.lines {
+		if g.Name() == name {
+			return g
+		}
+	}
+
+	return nil
+}
+
+// Samples returns the value of all lines
+func (b *GpioBank) Samples() ([]data.Sample, error) {
+	now := time.Now()
+	var ret []data.Sample
+
+	for _, g := range b.lines {
+		v, err := g.Read()
+		if err != nil {
+			return nil, err
+		}
+
+		t := SampleTypeDigitalInput
+		if g.config.Output {
+			t = SampleTypeDigitalOutput
+		}
+
+		value := 0.0
+		if v {
+			value = 1
+		}
+
+		ret = append(ret, data.Sample{Type: t, ID: g.Name(), Value: value,
+			Time: now})
+	}
+
+	return ret, nil
+}
+
+// changed returns the samples that changed since the last call, or all if
+// force is set
+func (b *GpioBank) changed(samples []data.Sample, force bool) []data.Sample {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var ret []data.Sample
+	for _, s := range samples {
+		v := s.Value != 0
+		if last, ok := b.last[s.ID]; force || !ok || last != v {
+			ret = append(ret, s)
+		}
+		b.last[s.ID] = v
+	}
+
+	return ret
+}
+
+// Command runs a GpioCommand received from the server
+func (b *GpioBank) Command(cmd data.DeviceCommand) error {
+	if cmd.Command != GpioCommand {
+		return fmt.Errorf("unexpected command: %v", cmd.Command)
+	}
+
+	g := b.Line(cmd.Args["name"])
+	if g == nil {
+		return fmt.Errorf("unknown GPIO: %v", cmd.Args["name"])
+	}
+
+	var v bool
+	switch cmd.Args["value"] {
+	case "1", "true", "on":
+		v = true
+	case "0", "false", "off":
+	case "toggle":
+		cur, err := g.Read()
+		if err != nil {
+			return err
+		}
+		v = !cur
+	default:
+		return errors.New("value arg must be 1, 0, or toggle")
+	}
+
+	return g.Write(v)
+}
+
+// Start polls the lines every interval and sends samples for lines that
+// changed. All lines are sent every report interval, and when Start is
+// called.
+func (b *GpioBank) Start(interval, report time.Duration,
+	send func([]data.Sample) error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		lastReport := time.Time{}
+
+		for {
+			samples, err := b.Samples()
+			if err != nil {
+				log.Println("Error reading GPIO: ", err)
+			} else {
+				force := time.Since(lastReport) >= report
+				if force {
+					lastReport = time.Now()
+				}
+
+				if changed := b.changed(samples, force); len(changed) > 0 {
+					err := send(changed)
+					if err != nil {
+						log.Println("Error sending GPIO samples: ", err)
+					}
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops polling the lines
+func (b *GpioBank) Stop() {
+	close(b.stop)
+}
+
+// Close releases all lines
+func (b *GpioBank) Close() error {
+	var ret error
+	for _, g := range b.lines {
+		err := g.Close()
+		if err != nil {
+			ret = err
+		}
+	}
+	return ret
+}
@@ -0,0 +1,94 @@
+package system
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// gpiohandle_request from linux/gpio.h (v1 ABI)
+type gpioHandleRequest struct {
+	lineOffsets   [64]uint32
+	flags         uint32
+	defaultValues [64]uint8
+	consumer      [32]byte
+	lines         uint32
+	fd            int32
+}
+
+// gpiohandle_data from linux/gpio.h
+type gpioHandleData struct {
+	values [64]uint8
+}
+
+// gpio ioctls and request flags
+const (
+	gpioGetLineHandle   = 0xc16cb403
+	gpioGetLineValues   = 0xc040b408
+	gpioSetLineValues   = 0xc040b409
+	gpioHandleInput     = 1 << 0
+	gpioHandleOutput    = 1 << 1
+	gpioHandleActiveLow = 1 << 2
+)
+
+func ioctl(fd, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func gpioRequest(config GpioConfig) (*os.File, error) {
+	chip, err := os.Open(config.Chip)
+	if err != nil {
+		return nil, err
+	}
+	defer chip.Close()
+
+	req := gpioHandleRequest{lines: 1}
+	req.lineOffsets[0] = uint32(config.Line)
+	copy(req.consumer[:len(req.consumer)-1], "siot")
+
+	if config.Output {
+		req.flags = gpioHandleOutput
+		if config.Initial {
+			req.defaultValues[0] = 1
+		}
+	} else {
+		req.flags = gpioHandleInput
+	}
+
+	if config.ActiveLow {
+		req.flags |= gpioHandleActiveLow
+	}
+
+	err = ioctl(chip.Fd(), gpioGetLineHandle, unsafe.Pointer(&req))
+	if err != nil {
+		return nil, os.NewSyscallError("GPIO_GET_LINEHANDLE", err)
+	}
+
+	return os.NewFile(uintptr(req.fd), config.Name), nil
+}
+
+func gpioGet(f *os.File) (bool, error) {
+	var d gpioHandleData
+	err := ioctl(f.Fd(), gpioGetLineValues, unsafe.Pointer(&d))
+	if err != nil {
+		return false, os.NewSyscallError("GPIOHANDLE_GET_LINE_VALUES", err)
+	}
+	return d.values[0] != 0, nil
+}
+
+func gpioSet(f *os.File, v bool) error {
+	var d gpioHandleData
+	if v {
+		d.values[0] = 1
+	}
+
+	err := ioctl(f.Fd(), gpioSetLineValues, unsafe.Pointer(&d))
+	if err != nil {
+		return os.NewSyscallError("GPIOHANDLE_SET_LINE_VALUES", err)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package system
+
+import "os"
+
+func gpioRequest(config GpioConfig) (*os.File, error) {
+	return nil, errUnsupported
+}
+
+func gpioGet(f *os.File) (bool, error) {
+	return false, errUnsupported
+}
+
+func gpioSet(f *os.File, v bool) error {
+	return errUnsupported
+}
@@ -0,0 +1,177 @@
+package system
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// files updated by SetHostname
+var (
+	hostnameFile = "/etc/hostname"
+	hostsFile    = "/etc/hosts"
+)
+
+// SetHostname sets the system host name, and saves it in /etc/hostname and
+// /etc/hosts so it is kept after a reboot
+func SetHostname(name string) error {
+	err := data.ValidateHostname(name)
+	if err != nil {
+		return err
+	}
+
+	err = sethostname(name)
+	if err == errUnsupported {
+		err = exec.Command("hostname", name).Run()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(hostnameFile, []byte(name+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+
+	return updateHosts(name)
+}
+
+// updateHosts points the 127.0.1.1 entry in /etc/hosts at name, so the
+// host name resolves
+func updateHosts(name string) error {
+	b, err := ioutil.ReadFile(hostsFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	entry := "127.0.1.1\t" + name
+	var lines []string
+	found := false
+
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		if strings.HasPrefix(line, "127.0.1.1") {
+			if found {
+				continue
+			}
+			line = entry
+			found = true
+		}
+		lines = append(lines, line)
+	}
+
+	if !found {
+		lines = append(lines, entry)
+	}
+
+	return ioutil.WriteFile(hostsFile, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// MachineID identifies the hardware a device runs on
+type MachineID struct {
+	// Source is where the ID came from: cpu, devicetree, mac, or
+	// machine-id
+	Source string
+	ID     string
+}
+
+// Serial : 00000000a1b2c3d4
+var reCPUSerial = regexp.MustCompile(`^Serial\s*:\s*([0-9a-fA-F]+)`)
+
+func cpuSerial() string {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		matches := reCPUSerial.FindStringSubmatch(scanner.Text())
+		if len(matches) >= 2 && strings.Trim(matches[1], "0") != "" {
+			return strings.ToLower(matches[1])
+		}
+	}
+
+	return ""
+}
+
+// primaryMAC returns the MAC of the first physical interface by name, so
+// the result does not change with interface order
+func primaryMAC() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+
+	sort.Slice(ifaces, func(i, j int) bool {
+		return ifaces[i].Name < ifaces[j].Name
+	})
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) != 6 {
+			continue
+		}
+
+		// skip virtual interfaces like bridges, tunnels, and containers
+		if _, err := os.Stat("/sys/class/net/" + iface.Name + "/device"); err != nil {
+			continue
+		}
+
+		// skip locally administered (random) addresses
+		if iface.HardwareAddr[0]&0x02 != 0 {
+			continue
+		}
+
+		return strings.Replace(iface.HardwareAddr.String(), ":", "", -1)
+	}
+
+	return ""
+}
+
+// GetMachineID returns a stable ID for the hardware. IDs that are part of
+// the hardware (CPU serial, device tree serial, primary MAC) are preferred
+// over /etc/machine-id, which changes when the device is re-flashed.
+func GetMachineID() (MachineID, error) {
+	if s := cpuSerial(); s != "" {
+		return MachineID{Source: "cpu", ID: s}, nil
+	}
+
+	if b, err := ioutil.ReadFile("/sys/firmware/devicetree/base/serial-number"); err == nil {
+		s := strings.TrimSpace(strings.Trim(string(b), "\x00"))
+		if s != "" {
+			return MachineID{Source: "devicetree", ID: s}, nil
+		}
+	}
+
+	if mac := primaryMAC(); mac != "" {
+		return MachineID{Source: "mac", ID: mac}, nil
+	}
+
+	for _, file := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		if s := strings.TrimSpace(string(b)); s != "" {
+			return MachineID{Source: "machine-id", ID: s}, nil
+		}
+	}
+
+	return MachineID{}, errors.New("no machine id found")
+}
+
+// DefaultDeviceID returns the ID a device uses if one is not configured
+func DefaultDeviceID() (string, error) {
+	id, err := GetMachineID()
+	return id.ID, err
+}
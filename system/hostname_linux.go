@@ -0,0 +1,7 @@
+package system
+
+import "syscall"
+
+func sethostname(name string) error {
+	return syscall.Sethostname([]byte(name))
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package system
+
+func sethostname(name string) error {
+	return errUnsupported
+}
@@ -0,0 +1,22 @@
+package system
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// KeyringSecret reads a secret of the "user" type from the Linux kernel
+// user keyring with keyctl. Kernel keyrings are not persistent, so the
+// secret must be added at boot, like with
+// `keyctl padd user <description> @u < key`.
+func KeyringSecret(description string) ([]byte, error) {
+	id, err := exec.Command("keyctl", "search", "@u", "user", description).Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return nil, ErrSecretNotFound
+		}
+		return nil, err
+	}
+
+	return exec.Command("keyctl", "pipe", strings.TrimSpace(string(id))).Output()
+}
@@ -0,0 +1,313 @@
+package system
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sync"
+)
+
+// define key store types
+const (
+	KeyStoreFile     = "file"
+	KeyStoreTPM2     = "tpm2"
+	KeyStoreATECC608 = "atecc608"
+)
+
+// ErrSecretNotFound is returned when a secret has not been stored
+var ErrSecretNotFound = errors.New("secret not found")
+
+// KeyStore stores device private keys and secrets like API tokens. Keys
+// in a TPM or secure element can be used but not read, so they can't be
+// copied off a stolen SD card.
+type KeyStore interface {
+	// Type returns the key store type, like KeyStoreTPM2
+	Type() string
+	// Signer returns a private key. An ECDSA P-256 key is created if it
+	// does not exist and the store can create keys.
+	Signer(name string) (crypto.Signer, error)
+	// Secret returns a secret, or ErrSecretNotFound
+	Secret(name string) ([]byte, error)
+	// SetSecret stores a secret
+	SetSecret(name string, secret []byte) error
+}
+
+// KeyStoreConfig describes where keys are stored
+type KeyStoreConfig struct {
+	// Type is KeyStoreFile, KeyStoreTPM2, or KeyStoreATECC608. If blank, a
+	// TPM is used if present, then an ATECC608 if Bus is set, then files.
+	Type string
+	// Dir is where keys are stored for the file store, and where key
+	// blobs (which can only be used with the same TPM or secure element)
+	// are stored for the other stores (default /var/lib/siot/keys)
+	Dir string
+	// TPMDevice is the TPM resource manager (default /dev/tpmrm0)
+	TPMDevice string
+	// Bus (like /dev/i2c-1) and Address (default 0x60) of an ATECC608
+	Bus     string
+	Address int
+	// KeySlots maps key names to ATECC608 slots. The keys are generated
+	// when the secure element is provisioned.
+	KeySlots map[string]int
+	// SecretSlot is the ATECC608 slot of a key used to derive the key
+	// that encrypts secrets. The slot must allow ECDH with the result
+	// output in the clear.
+	SecretSlot int
+}
+
+// OpenKeyStore opens the key store described by config
+func OpenKeyStore(config KeyStoreConfig) (KeyStore, error) {
+	if config.Dir == "" {
+		config.Dir = "/var/lib/siot/keys"
+	}
+
+	if config.TPMDevice == "" {
+		config.TPMDevice = "/dev/tpmrm0"
+	}
+
+	if config.Address == 0 {
+		config.Address = 0x60
+	}
+
+	err := os.MkdirAll(config.Dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	typ := config.Type
+	if typ == "" {
+		switch {
+		case tpmAvailable(config.TPMDevice):
+			typ = KeyStoreTPM2
+		case config.Bus != "":
+			typ = KeyStoreATECC608
+		default:
+			typ = KeyStoreFile
+		}
+	}
+
+	switch typ {
+	case KeyStoreFile:
+		return &fileKeyStore{dir: config.Dir}, nil
+	case KeyStoreTPM2:
+		return newTPMKeyStore(config)
+	case KeyStoreATECC608:
+		return newATECCKeyStore(config)
+	}
+
+	return nil, fmt.Errorf("unknown key store type: %v", typ)
+}
+
+var reKeyName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func checkKeyName(name string) error {
+	if !reKeyName.MatchString(name) {
+		return fmt.Errorf("invalid key name: %v", name)
+	}
+	return nil
+}
+
+// writeFileAtomic writes a file so it is never left partly written
+func writeFileAtomic(file string, b []byte, perm os.FileMode) error {
+	tmp := file + ".tmp"
+	err := ioutil.WriteFile(tmp, b, perm)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+// fileKeyStore stores keys and secrets in files only readable by root. It
+// is used when there is no TPM or secure element.
+type fileKeyStore struct {
+	dir  string
+	lock sync.Mutex
+}
+
+func (s *fileKeyStore) Type() string {
+	return KeyStoreFile
+}
+
+func (s *fileKeyStore) Signer(name string) (crypto.Signer, error) {
+	err := checkKeyName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	file := path.Join(s.dir, name+".key")
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+
+		err = writeFileAtomic(file, pem.EncodeToMemory(&pem.Block{
+			Type: "PRIVATE KEY", Bytes: der}), 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		return key, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("invalid key file: %v", file)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("key can't sign: %v", file)
+	}
+
+	return signer, nil
+}
+
+func (s *fileKeyStore) Secret(name string) ([]byte, error) {
+	err := checkKeyName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(path.Join(s.dir, name+".secret"))
+	if os.IsNotExist(err) {
+		return nil, ErrSecretNotFound
+	}
+
+	return b, err
+}
+
+func (s *fileKeyStore) SetSecret(name string, secret []byte) error {
+	err := checkKeyName(name)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path.Join(s.dir, name+".secret"), secret, 0600)
+}
+
+// seal encrypts b with AES-GCM
+func seal(key, b []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, b, nil), nil
+}
+
+// unseal decrypts data encrypted by seal
+func unseal(key, b []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < gcm.NonceSize() {
+		return nil, errors.New("sealed data is too short")
+	}
+
+	return gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+}
+
+// TLSCertificate returns a certificate for mutual TLS that uses a key in
+// the key store. certFile is the PEM certificate chain issued for the key.
+func TLSCertificate(ks KeyStore, keyName, certFile string) (tls.Certificate, error) {
+	var ret tls.Certificate
+
+	signer, err := ks.Signer(keyName)
+	if err != nil {
+		return ret, err
+	}
+
+	b, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return ret, err
+	}
+
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+
+		if block.Type == "CERTIFICATE" {
+			ret.Certificate = append(ret.Certificate, block.Bytes)
+		}
+	}
+
+	if len(ret.Certificate) <= 0 {
+		return ret, fmt.Errorf("no certificates in %v", certFile)
+	}
+
+	ret.PrivateKey = signer
+	return ret, nil
+}
+
+// CertificateRequest returns a PEM certificate signing request for a key
+// in the key store, so the server can issue a device certificate
+func CertificateRequest(ks KeyStore, keyName, commonName string) ([]byte, error) {
+	signer, err := ks.Signer(keyName)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
@@ -0,0 +1,365 @@
+package system
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// ATECC608 command opcodes
+const (
+	ateccNonce  = 0x16
+	ateccGenKey = 0x40
+	ateccSign   = 0x41
+	ateccECDH   = 0x43
+)
+
+// ateccKeyStore uses keys in an ATECC608 secure element on an I2C bus.
+// Keys must be generated in the slots when the secure element is
+// provisioned and can't be created later. Secrets are encrypted with a key
+// derived with ECDH from the key in SecretSlot, so they can only be read
+// with the same secure element.
+type ateccKeyStore struct {
+	bus        string
+	addr       int
+	dir        string
+	slots      map[string]int
+	secretSlot int
+	lock       sync.Mutex
+	public     map[string]crypto.PublicKey
+}
+
+func newATECCKeyStore(config KeyStoreConfig) (*ateccKeyStore, error) {
+	if config.Bus == "" {
+		return nil, errors.New("ATECC608 bus is required")
+	}
+
+	s := &ateccKeyStore{
+		bus:        config.Bus,
+		addr:       config.Address,
+		dir:        config.Dir,
+		slots:      config.KeySlots,
+		secretSlot: config.SecretSlot,
+		public:     make(map[string]crypto.PublicKey),
+	}
+
+	// make sure the secure element is there
+	dev, err := s.wake()
+	if err != nil {
+		return nil, err
+	}
+	s.idle(dev)
+
+	return s, nil
+}
+
+func (s *ateccKeyStore) Type() string {
+	return KeyStoreATECC608
+}
+
+// ateccCRC is the CRC-16 used by ATECC608 packets (poly 0x8005, data bits
+// processed LSB first, no reflection of the result)
+func ateccCRC(b []byte) []byte {
+	var crc uint16
+	for _, c := range b {
+		for bit := byte(1); bit != 0; bit <<= 1 {
+			dataBit := c&bit != 0
+			crcBit := crc&0x8000 != 0
+			crc <<= 1
+			if dataBit != crcBit {
+				crc ^= 0x8005
+			}
+		}
+	}
+
+	return []byte{byte(crc), byte(crc >> 8)}
+}
+
+// wake wakes the secure element and returns the opened device
+func (s *ateccKeyStore) wake() (*I2C, error) {
+	// SDA is held low long enough to wake the device by writing to
+	// address 0. The write is not acknowledged, so errors are ignored.
+	if gc, err := OpenI2C(s.bus, 0); err == nil {
+		gc.Write([]byte{0})
+		gc.Close()
+	}
+
+	time.Sleep(2 * time.Millisecond)
+
+	dev, err := OpenI2C(s.bus, s.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, 4)
+	err = dev.Read(resp)
+	if err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("Error waking ATECC608: %v", err)
+	}
+
+	if !bytes.Equal(resp, []byte{0x04, 0x11, 0x33, 0x43}) {
+		dev.Close()
+		return nil, fmt.Errorf("unexpected ATECC608 wake response: % x", resp)
+	}
+
+	return dev, nil
+}
+
+// idle puts the secure element in idle mode, which keeps TempKey, and
+// closes the device
+func (s *ateccKeyStore) idle(dev *I2C) {
+	dev.Write([]byte{0x02})
+	dev.Close()
+}
+
+// command sends a command and returns the response data. execTime is the
+// max execution time of the command.
+func (s *ateccKeyStore) command(dev *I2C, opcode, param1 byte, param2 uint16,
+	data []byte, execTime time.Duration, respLen int) ([]byte, error) {
+	packet := []byte{byte(7 + len(data)), opcode, param1, 0, 0}
+	binary.LittleEndian.PutUint16(packet[3:], param2)
+	packet = append(packet, data...)
+	packet = append(packet, ateccCRC(packet)...)
+
+	err := dev.Write(append([]byte{0x03}, packet...))
+	if err != nil {
+		return nil, err
+	}
+
+	// the device does not acknowledge reads until the command is done
+	resp := make([]byte, respLen+3)
+	deadline := time.Now().Add(execTime)
+	for {
+		time.Sleep(2 * time.Millisecond)
+		err = dev.Read(resp)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("ATECC608 command %#x timed out", opcode)
+		}
+	}
+
+	count := int(resp[0])
+	if count < 4 || count > len(resp) {
+		return nil, fmt.Errorf("invalid ATECC608 response length: %v", count)
+	}
+
+	if !bytes.Equal(ateccCRC(resp[:count-2]), resp[count-2:count]) {
+		return nil, errors.New("ATECC608 response CRC error")
+	}
+
+	// a 1 byte response is a status, which is 0 for success
+	if count == 4 && (respLen != 1 || resp[1] != 0) {
+		return nil, fmt.Errorf("ATECC608 command %#x error: %#x", opcode, resp[1])
+	}
+
+	if count != respLen+3 {
+		return nil, fmt.Errorf("unexpected ATECC608 response length: %v", count)
+	}
+
+	return resp[1 : count-2], nil
+}
+
+func (s *ateccKeyStore) slot(name string) (int, error) {
+	err := checkKeyName(name)
+	if err != nil {
+		return 0, err
+	}
+
+	slot, ok := s.slots[name]
+	if !ok {
+		return 0, fmt.Errorf("no ATECC608 slot for key: %v", name)
+	}
+
+	return slot, nil
+}
+
+func (s *ateccKeyStore) Signer(name string) (crypto.Signer, error) {
+	slot, err := s.slot(name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if pub, ok := s.public[name]; ok {
+		return &ateccSigner{store: s, slot: slot, public: pub}, nil
+	}
+
+	dev, err := s.wake()
+	if err != nil {
+		return nil, err
+	}
+	defer s.idle(dev)
+
+	// mode 0 returns the public key of the private key in the slot
+	resp, err := s.command(dev, ateccGenKey, 0x00, uint16(slot), nil,
+		120*time.Millisecond, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	pub := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(resp[:32]),
+		Y:     new(big.Int).SetBytes(resp[32:]),
+	}
+
+	s.public[name] = pub
+	return &ateccSigner{store: s, slot: slot, public: pub}, nil
+}
+
+// secretPoint is a P-256 point that nobody knows the private key of. It is
+// found by hashing a fixed seed until the hash is a valid x coordinate.
+func secretPoint() (x, y *big.Int) {
+	params := elliptic.P256().Params()
+	three := big.NewInt(3)
+
+	for i := 0; ; i++ {
+		h := sha256.Sum256([]byte(fmt.Sprintf("siot secret key %v", i)))
+		x = new(big.Int).SetBytes(h[:])
+		if x.Cmp(params.P) >= 0 {
+			continue
+		}
+
+		// y² = x³ - 3x + b
+		y2 := new(big.Int).Exp(x, three, params.P)
+		y2.Sub(y2, new(big.Int).Mul(three, x))
+		y2.Add(y2, params.B)
+		y2.Mod(y2, params.P)
+
+		y = new(big.Int).ModSqrt(y2, params.P)
+		if y != nil {
+			return x, y
+		}
+	}
+}
+
+// secretKey derives the key that encrypts secrets
+func (s *ateccKeyStore) secretKey() ([]byte, error) {
+	dev, err := s.wake()
+	if err != nil {
+		return nil, err
+	}
+	defer s.idle(dev)
+
+	x, y := secretPoint()
+	point := make([]byte, 64)
+	xb, yb := x.Bytes(), y.Bytes()
+	copy(point[32-len(xb):], xb)
+	copy(point[64-len(yb):], yb)
+
+	// mode 0x0C outputs the shared secret in the clear
+	shared, err := s.command(dev, ateccECDH, 0x0C, uint16(s.secretSlot), point,
+		60*time.Millisecond, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	key := sha256.Sum256(shared)
+	return key[:], nil
+}
+
+func (s *ateccKeyStore) Secret(name string) ([]byte, error) {
+	err := checkKeyName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(path.Join(s.dir, name+".sealed"))
+	if os.IsNotExist(err) {
+		return nil, ErrSecretNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key, err := s.secretKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return unseal(key, b)
+}
+
+func (s *ateccKeyStore) SetSecret(name string, secret []byte) error {
+	err := checkKeyName(name)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key, err := s.secretKey()
+	if err != nil {
+		return err
+	}
+
+	b, err := seal(key, secret)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path.Join(s.dir, name+".sealed"), b, 0600)
+}
+
+// ateccSigner signs with a key in a ATECC608 slot
+type ateccSigner struct {
+	store  *ateccKeyStore
+	slot   int
+	public crypto.PublicKey
+}
+
+func (a *ateccSigner) Public() crypto.PublicKey {
+	return a.public
+}
+
+// Sign signs a SHA-256 digest
+func (a *ateccSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 || len(digest) != 32 {
+		return nil, fmt.Errorf("unsupported hash: %v", opts.HashFunc())
+	}
+
+	a.store.lock.Lock()
+	defer a.store.lock.Unlock()
+
+	dev, err := a.store.wake()
+	if err != nil {
+		return nil, err
+	}
+	defer a.store.idle(dev)
+
+	// load the digest into TempKey, then sign it
+	_, err = a.store.command(dev, ateccNonce, 0x03, 0, digest,
+		10*time.Millisecond, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := a.store.command(dev, ateccSign, 0x80, uint16(a.slot), nil,
+		80*time.Millisecond, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return ecdsaSignature(sig, a.public)
+}
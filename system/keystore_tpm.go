@@ -0,0 +1,298 @@
+package system
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+)
+
+// tpmAvailable returns true if there is a TPM and the tpm2-tools are
+// installed
+func tpmAvailable(device string) bool {
+	if _, err := os.Stat(device); err != nil {
+		return false
+	}
+
+	_, err := exec.LookPath("tpm2_createprimary")
+	return err == nil
+}
+
+// tpmKeyStore stores keys and sealed secrets in a TPM 2.0 using the
+// tpm2-tools. Keys are created under the owner hierarchy primary key, which
+// is derived from the TPM seed each time it is used, and only the wrapped
+// key blobs are stored in files. The blobs can't be used without the TPM.
+type tpmKeyStore struct {
+	dir    string
+	tcti   string
+	lock   sync.Mutex
+	public map[string]crypto.PublicKey
+}
+
+func newTPMKeyStore(config KeyStoreConfig) (*tpmKeyStore, error) {
+	if !tpmAvailable(config.TPMDevice) {
+		return nil, errors.New("TPM or tpm2-tools not found")
+	}
+
+	return &tpmKeyStore{
+		dir:    config.Dir,
+		tcti:   "device:" + config.TPMDevice,
+		public: make(map[string]crypto.PublicKey),
+	}, nil
+}
+
+func (s *tpmKeyStore) Type() string {
+	return KeyStoreTPM2
+}
+
+// tpm runs a tpm2-tools command and returns stdout
+func (s *tpmKeyStore) tpm(stdin io.Reader, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Env = append(os.Environ(), "TPM2TOOLS_TCTI="+s.tcti)
+	cmd.Stdin = stdin
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v: %v", name, err,
+			strings.TrimSpace(stderr.String()))
+	}
+
+	return out, nil
+}
+
+// withPrimary creates the primary key in a temp dir and calls f with the
+// dir. Object contexts are only kept in the temp dir, which is removed
+// after f returns.
+func (s *tpmKeyStore) withPrimary(f func(tmp string) error) error {
+	tmp, err := ioutil.TempDir("", "siot-tpm")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	_, err = s.tpm(nil, "tpm2_createprimary", "-Q", "-C", "o", "-g", "sha256",
+		"-G", "ecc", "-c", path.Join(tmp, "primary.ctx"))
+	if err != nil {
+		return err
+	}
+
+	return f(tmp)
+}
+
+// load loads the key blobs with prefix into the TPM, and returns the
+// context file
+func (s *tpmKeyStore) load(tmp, prefix string) (string, error) {
+	ctx := path.Join(tmp, "object.ctx")
+	_, err := s.tpm(nil, "tpm2_load", "-Q", "-C", path.Join(tmp, "primary.ctx"),
+		"-u", prefix+".pub", "-r", prefix+".priv", "-c", ctx)
+	return ctx, err
+}
+
+func (s *tpmKeyStore) Signer(name string) (crypto.Signer, error) {
+	err := checkKeyName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	prefix := path.Join(s.dir, "key-"+name)
+
+	if pub, ok := s.public[name]; ok {
+		return &tpmSigner{store: s, prefix: prefix, public: pub}, nil
+	}
+
+	err = s.withPrimary(func(tmp string) error {
+		if _, err := os.Stat(prefix + ".pub"); os.IsNotExist(err) {
+			_, err := s.tpm(nil, "tpm2_create", "-Q", "-C",
+				path.Join(tmp, "primary.ctx"), "-G", "ecc256:ecdsa-sha256",
+				"-u", prefix+".pub", "-r", prefix+".priv")
+			if err != nil {
+				return err
+			}
+		}
+
+		ctx, err := s.load(tmp, prefix)
+		if err != nil {
+			return err
+		}
+
+		pemFile := path.Join(tmp, "public.pem")
+		_, err = s.tpm(nil, "tpm2_readpublic", "-Q", "-c", ctx, "-f", "pem",
+			"-o", pemFile)
+		if err != nil {
+			return err
+		}
+
+		b, err := ioutil.ReadFile(pemFile)
+		if err != nil {
+			return err
+		}
+
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return errors.New("invalid TPM public key")
+		}
+
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+
+		s.public[name] = pub
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &tpmSigner{store: s, prefix: prefix, public: s.public[name]}, nil
+}
+
+func (s *tpmKeyStore) Secret(name string) ([]byte, error) {
+	err := checkKeyName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := path.Join(s.dir, "secret-"+name)
+	if _, err := os.Stat(prefix + ".pub"); os.IsNotExist(err) {
+		return nil, ErrSecretNotFound
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var ret []byte
+	err = s.withPrimary(func(tmp string) error {
+		ctx, err := s.load(tmp, prefix)
+		if err != nil {
+			return err
+		}
+
+		ret, err = s.tpm(nil, "tpm2_unseal", "-c", ctx)
+		return err
+	})
+
+	return ret, err
+}
+
+func (s *tpmKeyStore) SetSecret(name string, secret []byte) error {
+	err := checkKeyName(name)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	prefix := path.Join(s.dir, "secret-"+name)
+
+	return s.withPrimary(func(tmp string) error {
+		// write the new blobs next to the old ones so a failure does not
+		// lose the old secret
+		_, err := s.tpm(bytes.NewReader(secret), "tpm2_create", "-Q", "-C",
+			path.Join(tmp, "primary.ctx"), "-i", "-",
+			"-u", prefix+".pub.tmp", "-r", prefix+".priv.tmp")
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(prefix+".priv.tmp", prefix+".priv")
+		if err != nil {
+			return err
+		}
+
+		return os.Rename(prefix+".pub.tmp", prefix+".pub")
+	})
+}
+
+// tpmSigner signs with a key in the TPM
+type tpmSigner struct {
+	store  *tpmKeyStore
+	prefix string
+	public crypto.PublicKey
+}
+
+func (t *tpmSigner) Public() crypto.PublicKey {
+	return t.public
+}
+
+// Sign signs a SHA-256 digest
+func (t *tpmSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("unsupported hash: %v", opts.HashFunc())
+	}
+
+	t.store.lock.Lock()
+	defer t.store.lock.Unlock()
+
+	var sig []byte
+	err := t.store.withPrimary(func(tmp string) error {
+		ctx, err := t.store.load(tmp, t.prefix)
+		if err != nil {
+			return err
+		}
+
+		digestFile := path.Join(tmp, "digest")
+		err = ioutil.WriteFile(digestFile, digest, 0600)
+		if err != nil {
+			return err
+		}
+
+		sigFile := path.Join(tmp, "sig")
+		_, err = t.store.tpm(nil, "tpm2_sign", "-Q", "-c", ctx, "-g", "sha256",
+			"-d", "-f", "plain", "-o", sigFile, digestFile)
+		if err != nil {
+			return err
+		}
+
+		sig, err = ioutil.ReadFile(sigFile)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ecdsaSignature(sig, t.public)
+}
+
+// ecdsaSignature returns an ASN.1 ECDSA signature from a signature that is
+// either already ASN.1 or raw r || s
+func ecdsaSignature(sig []byte, pub crypto.PublicKey) ([]byte, error) {
+	var rs struct{ R, S *big.Int }
+	if rest, err := asn1.Unmarshal(sig, &rs); err == nil && len(rest) == 0 {
+		return sig, nil
+	}
+
+	size := 32
+	if p, ok := pub.(*ecdsa.PublicKey); ok {
+		size = (p.Curve.Params().BitSize + 7) / 8
+	}
+
+	if len(sig) != 2*size {
+		return nil, errors.New("invalid signature")
+	}
+
+	rs.R = new(big.Int).SetBytes(sig[:size])
+	rs.S = new(big.Int).SetBytes(sig[size:])
+	return asn1.Marshal(rs)
+}
@@ -0,0 +1,149 @@
+package system
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LedDir is where the kernel LED class devices are
+var LedDir = "/sys/class/leds"
+
+// LedState is a system state shown on the status LEDs
+type LedState string
+
+// define status LED states
+const (
+	LedBooting   LedState = "booting"
+	LedNoNetwork LedState = "noNetwork"
+	LedConnected LedState = "connected"
+	LedUpdating  LedState = "updating"
+	LedError     LedState = "error"
+)
+
+// LedPattern is a blink pattern. An LED with Off 0 is solid on, and On 0 is
+// off.
+type LedPattern struct {
+	On  time.Duration
+	Off time.Duration
+}
+
+// common patterns
+var (
+	LedOff       = LedPattern{}
+	LedOn        = LedPattern{On: time.Second}
+	LedBlinkFast = LedPattern{On: 100 * time.Millisecond, Off: 100 * time.Millisecond}
+	LedBlinkSlow = LedPattern{On: time.Second, Off: time.Second}
+	// LedBlip is a short flash every couple seconds
+	LedBlip = LedPattern{On: 50 * time.Millisecond, Off: 1950 * time.Millisecond}
+)
+
+// LedConfig maps states to patterns for one LED
+type LedConfig struct {
+	// Name is the LED in LedDir, like "green:status"
+	Name string
+	// Patterns for each state. The LED is off for states without a
+	// pattern.
+	Patterns map[LedState]LedPattern
+}
+
+// DefaultLedConfig returns patterns for a board with a single status LED
+func DefaultLedConfig(name string) LedConfig {
+	return LedConfig{
+		Name: name,
+		Patterns: map[LedState]LedPattern{
+			LedBooting:   LedBlinkFast,
+			LedNoNetwork: LedBlinkSlow,
+			LedConnected: LedOn,
+			LedUpdating:  {On: 250 * time.Millisecond, Off: 250 * time.Millisecond},
+			LedError:     LedBlip,
+		},
+	}
+}
+
+// StatusLeds shows the system state on one or more LEDs so installers get
+// feedback on site without a screen. Blinking is done by the kernel timer
+// trigger, so no goroutine is needed.
+type StatusLeds struct {
+	leds  []LedConfig
+	lock  sync.Mutex
+	state LedState
+}
+
+// NewStatusLeds creates a status LED controller
+func NewStatusLeds(leds []LedConfig) *StatusLeds {
+	return &StatusLeds{leds: leds}
+}
+
+func writeLed(name, attr, value string) error {
+	return ioutil.WriteFile(path.Join(LedDir, name, attr), []byte(value), 0644)
+}
+
+// setLed applies a pattern to an LED
+func setLed(name string, p LedPattern) error {
+	if p.On > 0 && p.Off > 0 {
+		err := writeLed(name, "trigger", "timer")
+		if err != nil {
+			return err
+		}
+
+		// delay_on and delay_off are created by the timer trigger
+		err = writeLed(name, "delay_on", strconv.Itoa(int(p.On/time.Millisecond)))
+		if err != nil {
+			return err
+		}
+
+		return writeLed(name, "delay_off", strconv.Itoa(int(p.Off/time.Millisecond)))
+	}
+
+	err := writeLed(name, "trigger", "none")
+	if err != nil {
+		return err
+	}
+
+	brightness := "0"
+	if p.On > 0 {
+		b, err := ioutil.ReadFile(path.Join(LedDir, name, "max_brightness"))
+		if err != nil {
+			return err
+		}
+		brightness = strings.TrimSpace(string(b))
+	}
+
+	return writeLed(name, "brightness", brightness)
+}
+
+// Set shows state on the LEDs
+func (s *StatusLeds) Set(state LedState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if state == s.state {
+		return nil
+	}
+
+	var ret error
+	for _, led := range s.leds {
+		err := setLed(led.Name, led.Patterns[state])
+		if err != nil {
+			ret = fmt.Errorf("Error setting LED %v: %v", led.Name, err)
+		}
+	}
+
+	if ret == nil {
+		s.state = state
+	}
+
+	return ret
+}
+
+// State returns the state shown on the LEDs
+func (s *StatusLeds) State() LedState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state
+}
@@ -0,0 +1,305 @@
+package system
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// SupportArchiveCommand is the device command used to upload a support
+// archive of the application logs. The optional since arg (Go duration,
+// default 24h) limits the archive to recent logs.
+const SupportArchiveCommand = "supportArchive"
+
+// LogFileConfig describes where application logs are written and how long
+// they are kept
+type LogFileConfig struct {
+	Dir string
+	// Name is the name of the current log file (default siot.log)
+	Name string
+	// MaxSize is the size in bytes at which the file is rotated (default
+	// 10MB)
+	MaxSize int64
+	// MaxAge is how long rotated files are kept (default 7 days)
+	MaxAge time.Duration
+	// MaxFiles is the number of rotated files kept (default 10)
+	MaxFiles int
+}
+
+// LogFile is a log writer that writes structured (JSON lines) entries to a
+// file that is rotated when it gets too big. It is typically used with
+// log.SetOutput.
+type LogFile struct {
+	config LogFileConfig
+	lock   sync.Mutex
+	file   *os.File
+	size   int64
+}
+
+// logLine is a structured log entry
+type logLine struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"msg"`
+}
+
+// NewLogFile opens the log file, creating Dir if needed
+func NewLogFile(config LogFileConfig) (*LogFile, error) {
+	if config.Name == "" {
+		config.Name = "siot.log"
+	}
+
+	if config.MaxSize == 0 {
+		config.MaxSize = 10 * 1024 * 1024
+	}
+
+	if config.MaxAge == 0 {
+		config.MaxAge = 7 * 24 * time.Hour
+	}
+
+	if config.MaxFiles == 0 {
+		config.MaxFiles = 10
+	}
+
+	err := os.MkdirAll(config.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &LogFile{config: config}
+	err = l.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *LogFile) current() string {
+	return path.Join(l.config.Dir, l.config.Name)
+}
+
+func (l *LogFile) open() error {
+	f, err := os.OpenFile(l.current(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.file = f
+	l.size = fi.Size()
+	return nil
+}
+
+// logLevel guesses the level of a log message, since the standard logger
+// does not have levels
+func logLevel(msg string) string {
+	lower := strings.ToLower(msg)
+	switch {
+	case strings.Contains(lower, "error") || strings.Contains(lower, "fail"):
+		return "error"
+	case strings.Contains(lower, "warn"):
+		return "warning"
+	}
+	return "info"
+}
+
+// Write writes log output as a structured entry
+func (l *LogFile) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	j, err := json.Marshal(logLine{Time: time.Now(), Level: logLevel(msg),
+		Message: msg})
+	if err != nil {
+		return 0, err
+	}
+	j = append(j, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.size+int64(len(j)) > l.config.MaxSize && l.size > 0 {
+		err := l.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := l.file.Write(j)
+	l.size += int64(n)
+	if err != nil {
+		return 0, err
+	}
+
+	// report the input length so the logger does not see a short write
+	return len(p), nil
+}
+
+// rotate renames the current file and removes old files. Must be called
+// with the lock held.
+func (l *LogFile) rotate() error {
+	err := l.file.Close()
+	if err != nil {
+		return err
+	}
+
+	ext := path.Ext(l.config.Name)
+	base := strings.TrimSuffix(l.config.Name, ext)
+	rotated := path.Join(l.config.Dir, fmt.Sprintf("%v-%v%v", base,
+		time.Now().Format("20060102-150405.000"), ext))
+
+	err = os.Rename(l.current(), rotated)
+	if err != nil {
+		return err
+	}
+
+	l.prune()
+	return l.open()
+}
+
+// rotatedFiles returns the rotated files, newest first
+func (l *LogFile) rotatedFiles() []os.FileInfo {
+	infos, err := ioutil.ReadDir(l.config.Dir)
+	if err != nil {
+		return nil
+	}
+
+	ext := path.Ext(l.config.Name)
+	prefix := strings.TrimSuffix(l.config.Name, ext) + "-"
+
+	var ret []os.FileInfo
+	for _, fi := range infos {
+		if !fi.IsDir() && strings.HasPrefix(fi.Name(), prefix) &&
+			strings.HasSuffix(fi.Name(), ext) {
+			ret = append(ret, fi)
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name() > ret[j].Name()
+	})
+
+	return ret
+}
+
+func (l *LogFile) prune() {
+	for i, fi := range l.rotatedFiles() {
+		if i >= l.config.MaxFiles || time.Since(fi.ModTime()) > l.config.MaxAge {
+			os.Remove(path.Join(l.config.Dir, fi.Name()))
+		}
+	}
+}
+
+// Archive writes a gzipped tar of the log files modified since a time
+func (l *LogFile) Archive(w io.Writer, since time.Time) error {
+	// don't hold the lock while writing the archive, as the writer may
+	// log
+	l.lock.Lock()
+	err := l.file.Sync()
+	files := l.rotatedFiles()
+	if fi, err := os.Stat(l.current()); err == nil {
+		files = append(files, fi)
+	}
+	l.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	for _, fi := range files {
+		if fi.ModTime().Before(since) {
+			continue
+		}
+
+		err := addToTar(tw, path.Join(l.config.Dir, fi.Name()), fi)
+		if os.IsNotExist(err) {
+			// rotated or pruned since the list was read
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+func addToTar(tw *tar.Writer, file string, fi os.FileInfo) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	// the current file may grow while it is copied
+	_, err = io.CopyN(tw, f, fi.Size())
+	return err
+}
+
+// Command runs a SupportArchiveCommand received from the server. The
+// archive is passed to upload, typically api.NewSendSupportArchive.
+func (l *LogFile) Command(cmd data.DeviceCommand, upload func(io.Reader) error) error {
+	if cmd.Command != SupportArchiveCommand {
+		return fmt.Errorf("unexpected command: %v", cmd.Command)
+	}
+
+	since := 24 * time.Hour
+	if v := cmd.Args["since"]; v != "" {
+		var err error
+		since, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("Error parsing since: %v", err)
+		}
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(l.Archive(w, time.Now().Add(-since)))
+	}()
+
+	err := upload(r)
+	// unblock the archive writer if the upload stopped early
+	r.Close()
+	return err
+}
+
+// Close closes the log file
+func (l *LogFile) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,408 @@
+package system
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// UploadLogsCommand is the device command used to upload the collected log
+// entries
+const UploadLogsCommand = "uploadLogs"
+
+// syslog priorities
+const (
+	PriorityCrit    = 2
+	PriorityErr     = 3
+	PriorityWarning = 4
+	PriorityInfo    = 6
+)
+
+// LogCollectorConfig describes which log entries are collected
+type LogCollectorConfig struct {
+	// Units are the systemd units (or syslog tags) to collect (default
+	// all)
+	Units []string
+	// MaxPriority is the least important priority collected (default
+	// PriorityWarning)
+	MaxPriority int
+	// SyslogFile is read if journald is not available (default
+	// /var/log/messages)
+	SyslogFile string
+	// BufferSize is the number of entries kept before the oldest are
+	// dropped (default 1000)
+	BufferSize int
+	// ErrorThreshold uploads the entries when this many error entries are
+	// collected in a minute. Uploads are at most every 5m. 0 disables.
+	ErrorThreshold int
+	// Upload sends entries to the server, typically api.NewSendLogs
+	Upload func([]data.LogEntry) error
+}
+
+// LogCollector collects system log entries from journald or syslog and
+// buffers them until they are uploaded, so logs can be retrieved from
+// devices that can't be reached directly
+type LogCollector struct {
+	config     LogCollectorConfig
+	lock       sync.Mutex
+	entries    []data.LogEntry
+	errTimes   []time.Time
+	lastUpload time.Time
+	cmd        *exec.Cmd
+	stop       chan struct{}
+}
+
+// NewLogCollector creates a log collector
+func NewLogCollector(config LogCollectorConfig) *LogCollector {
+	if config.MaxPriority == 0 {
+		config.MaxPriority = PriorityWarning
+	}
+
+	if config.SyslogFile == "" {
+		config.SyslogFile = "/var/log/messages"
+	}
+
+	if config.BufferSize == 0 {
+		config.BufferSize = 1000
+	}
+
+	return &LogCollector{config: config, stop: make(chan struct{})}
+}
+
+func (c *LogCollector) wantUnit(unit string) bool {
+	if len(c.config.Units) <= 0 {
+		return true
+	}
+
+	for _, u := range c.config.Units {
+		if u == unit || u+".service" == unit {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *LogCollector) add(e data.LogEntry) {
+	if e.Priority > c.config.MaxPriority || !c.wantUnit(e.Unit) {
+		return
+	}
+
+	c.lock.Lock()
+
+	c.entries = append(c.entries, e)
+	if len(c.entries) > c.config.BufferSize {
+		c.entries = c.entries[len(c.entries)-c.config.BufferSize:]
+	}
+
+	upload := false
+	if c.config.ErrorThreshold > 0 && e.Priority <= PriorityErr {
+		now := time.Now()
+		c.errTimes = append(c.errTimes, now)
+		for len(c.errTimes) > 0 && now.Sub(c.errTimes[0]) > time.Minute {
+			c.errTimes = c.errTimes[1:]
+		}
+
+		if len(c.errTimes) >= c.config.ErrorThreshold &&
+			now.Sub(c.lastUpload) > 5*time.Minute {
+			upload = true
+			// set now so only one upload is triggered
+			c.lastUpload = now
+			c.errTimes = nil
+		}
+	}
+
+	c.lock.Unlock()
+
+	if upload {
+		go func() {
+			err := c.Upload()
+			if err != nil {
+				log.Println("Error uploading logs: ", err)
+			}
+		}()
+	}
+}
+
+// Entries returns the buffered entries
+func (c *LogCollector) Entries() []data.LogEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]data.LogEntry{}, c.entries...)
+}
+
+// Upload sends the buffered entries to the server, and removes them from
+// the buffer if successful
+func (c *LogCollector) Upload() error {
+	if c.config.Upload == nil {
+		return errors.New("no log upload configured")
+	}
+
+	entries := c.Entries()
+	if len(entries) <= 0 {
+		return nil
+	}
+
+	err := c.config.Upload(entries)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// entries may have been added or dropped during the upload
+	last := entries[len(entries)-1]
+	for i := len(c.entries) - 1; i >= 0; i-- {
+		if c.entries[i] == last {
+			c.entries = c.entries[i+1:]
+			break
+		}
+	}
+
+	c.lastUpload = time.Now()
+	return nil
+}
+
+// Command runs an UploadLogsCommand received from the server
+func (c *LogCollector) Command(cmd data.DeviceCommand) error {
+	if cmd.Command != UploadLogsCommand {
+		return fmt.Errorf("unexpected command: %v", cmd.Command)
+	}
+
+	return c.Upload()
+}
+
+// journalEntry is a journalctl -o json entry. MESSAGE is an array of bytes
+// if it is not valid UTF-8.
+type journalEntry struct {
+	Timestamp  string          `json:"__REALTIME_TIMESTAMP"`
+	Unit       string          `json:"_SYSTEMD_UNIT"`
+	Identifier string          `json:"SYSLOG_IDENTIFIER"`
+	Priority   string          `json:"PRIORITY"`
+	Message    json.RawMessage `json:"MESSAGE"`
+}
+
+func parseJournalEntry(line []byte) (data.LogEntry, error) {
+	var je journalEntry
+	err := json.Unmarshal(line, &je)
+	if err != nil {
+		return data.LogEntry{}, err
+	}
+
+	e := data.LogEntry{Unit: je.Unit, Priority: PriorityInfo}
+	if e.Unit == "" {
+		e.Unit = je.Identifier
+	}
+
+	if us, err := strconv.ParseInt(je.Timestamp, 10, 64); err == nil {
+		e.Time = time.Unix(0, us*1000)
+	}
+
+	if p, err := strconv.Atoi(je.Priority); err == nil {
+		e.Priority = p
+	}
+
+	if json.Unmarshal(je.Message, &e.Message) != nil {
+		var b []byte
+		json.Unmarshal(je.Message, &b)
+		e.Message = string(b)
+	}
+
+	return e, nil
+}
+
+// Mar 15 12:34:56 host tag[123]: message
+var reSyslog = regexp.MustCompile(`^(\w{3}\s+\d+ \d+:\d+:\d+) \S+ ([^:\[\s]+)(\[\d+\])?: (.*)`)
+
+var syslogKeywords = []struct {
+	re       *regexp.Regexp
+	priority int
+}{
+	{regexp.MustCompile(`(?i)crit|panic|fatal`), PriorityCrit},
+	{regexp.MustCompile(`(?i)err|fail`), PriorityErr},
+	{regexp.MustCompile(`(?i)warn`), PriorityWarning},
+}
+
+// parseSyslogLine parses a syslog file line. Syslog files don't record the
+// priority, so it is estimated from keywords in the message.
+func parseSyslogLine(line string) (data.LogEntry, bool) {
+	matches := reSyslog.FindStringSubmatch(line)
+	if len(matches) < 5 {
+		return data.LogEntry{}, false
+	}
+
+	e := data.LogEntry{Unit: matches[2], Message: matches[4],
+		Priority: PriorityInfo}
+
+	now := time.Now()
+	t, err := time.ParseInLocation(time.Stamp, matches[1], time.Local)
+	if err == nil {
+		e.Time = t.AddDate(now.Year(), 0, 0)
+		if e.Time.After(now.Add(24 * time.Hour)) {
+			// from last year
+			e.Time = e.Time.AddDate(-1, 0, 0)
+		}
+	} else {
+		e.Time = now
+	}
+
+	for _, k := range syslogKeywords {
+		if k.re.MatchString(e.Message) {
+			e.Priority = k.priority
+			break
+		}
+	}
+
+	return e, true
+}
+
+func (c *LogCollector) readJournal() error {
+	args := []string{"-f", "-o", "json", "-n", "0", "-p",
+		strconv.Itoa(c.config.MaxPriority)}
+	for _, u := range c.config.Units {
+		args = append(args, "-u", u)
+	}
+
+	cmd := exec.Command("journalctl", args...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	c.cmd = cmd
+	c.lock.Unlock()
+
+	go func() {
+		scanner := bufio.NewScanner(out)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			e, err := parseJournalEntry(scanner.Bytes())
+			if err != nil {
+				continue
+			}
+			c.add(e)
+		}
+
+		err := cmd.Wait()
+		select {
+		case <-c.stop:
+		default:
+			log.Println("journalctl exited: ", err)
+		}
+	}()
+
+	return nil
+}
+
+func (c *LogCollector) tailSyslog() error {
+	f, err := os.Open(c.config.SyslogFile)
+	if err != nil {
+		return err
+	}
+
+	// only collect new entries
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	go func() {
+		defer func() { f.Close() }()
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		var partial string
+		buf := make([]byte, 32*1024)
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-c.stop:
+				return
+			}
+
+			fi, err := os.Stat(c.config.SyslogFile)
+			if err != nil {
+				continue
+			}
+
+			if fi.Size() < offset || !sameFile(f, fi) {
+				// the file was rotated or truncated
+				nf, err := os.Open(c.config.SyslogFile)
+				if err != nil {
+					continue
+				}
+				f.Close()
+				f = nf
+				offset = 0
+				partial = ""
+			}
+
+			for {
+				n, err := f.Read(buf)
+				offset += int64(n)
+				lines := strings.Split(partial+string(buf[:n]), "\n")
+				partial = lines[len(lines)-1]
+				for _, line := range lines[:len(lines)-1] {
+					if e, ok := parseSyslogLine(line); ok {
+						c.add(e)
+					}
+				}
+
+				if err != nil || n == 0 {
+					break
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func sameFile(f *os.File, fi os.FileInfo) bool {
+	cur, err := f.Stat()
+	return err == nil && os.SameFile(cur, fi)
+}
+
+// Start collects entries until Stop is called. journald is used if
+// journalctl is installed, otherwise SyslogFile is read.
+func (c *LogCollector) Start() error {
+	if _, err := exec.LookPath("journalctl"); err == nil {
+		return c.readJournal()
+	}
+
+	return c.tailSyslog()
+}
+
+// Stop stops collecting entries
+func (c *LogCollector) Stop() {
+	close(c.stop)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.cmd != nil && c.cmd.Process != nil {
+		c.cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,191 @@
+package system
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// maintenanceTask is an operation waiting for a maintenance window
+type maintenanceTask struct {
+	name string
+	fn   func() error
+}
+
+// Maintenance defers disruptive operations like OS updates, reboots, modem
+// firmware updates, and db compaction to the maintenance windows in the
+// device config. Operations run right away if there are no windows.
+type Maintenance struct {
+	lock    sync.Mutex
+	windows []data.MaintenanceWindow
+	loc     *time.Location
+	pending []maintenanceTask
+	timer   *time.Timer
+	// runner is true while runPending is running
+	runner  bool
+	running int
+}
+
+// NewMaintenance creates a maintenance scheduler with no windows
+func NewMaintenance() *Maintenance {
+	return &Maintenance{loc: time.Local}
+}
+
+// SetWindows sets the windows, which are typically DeviceConfig.Maintenance.
+// timezone is the tzdata name the windows are in, or the system time zone
+// if blank.
+func (m *Maintenance) SetWindows(windows []data.MaintenanceWindow, timezone string) error {
+	loc := time.Local
+	if timezone != "" {
+		var err error
+		loc, err = time.LoadLocation(timezone)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, w := range windows {
+		err := w.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	m.lock.Lock()
+	m.windows = windows
+	m.loc = loc
+	m.schedule()
+	m.lock.Unlock()
+
+	return nil
+}
+
+// Open returns true if operations can run now
+func (m *Maintenance) Open() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return data.InMaintenance(m.windows, time.Now(), m.loc)
+}
+
+// Busy returns true while an operation started by Run is running, so
+// other subsystems like the network watchdog can hold off on recovery
+func (m *Maintenance) Busy() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.running > 0
+}
+
+// Pending returns the names of the operations waiting for a window
+func (m *Maintenance) Pending() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var ret []string
+	for _, t := range m.pending {
+		ret = append(ret, t.name)
+	}
+	return ret
+}
+
+// Next returns the start of the next window. ok is false if there are no
+// windows.
+func (m *Maintenance) Next() (start time.Time, ok bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	start, _, ok = data.NextMaintenance(m.windows, time.Now(), m.loc)
+	return
+}
+
+// Run runs fn now if a window is open and returns its error. Otherwise fn
+// is run at the start of the next window, and errors are logged.
+func (m *Maintenance) Run(name string, fn func() error) error {
+	m.lock.Lock()
+	if data.InMaintenance(m.windows, time.Now(), m.loc) {
+		m.running++
+		m.lock.Unlock()
+
+		err := fn()
+
+		m.lock.Lock()
+		m.running--
+		m.lock.Unlock()
+		return err
+	}
+
+	m.pending = append(m.pending, maintenanceTask{name: name, fn: fn})
+	m.schedule()
+	m.lock.Unlock()
+
+	start, _ := m.Next()
+	log.Printf("%v deferred to maintenance window at %v\n", name, start)
+	return nil
+}
+
+// schedule sets the timer for the next window if operations are pending.
+// m.lock must be held.
+func (m *Maintenance) schedule() {
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+
+	// the runner picks up new operations
+	if len(m.pending) <= 0 || m.runner {
+		return
+	}
+
+	start, _, ok := data.NextMaintenance(m.windows, time.Now(), m.loc)
+	delay := time.Until(start)
+	if !ok || delay < 0 {
+		// no windows, or a window is open
+		delay = 0
+	}
+
+	m.timer = time.AfterFunc(delay, m.runPending)
+}
+
+// runPending runs the pending operations in order while the window is
+// open
+func (m *Maintenance) runPending() {
+	m.lock.Lock()
+	if m.runner {
+		m.lock.Unlock()
+		return
+	}
+	m.runner = true
+	m.lock.Unlock()
+
+	for {
+		m.lock.Lock()
+		if len(m.pending) <= 0 {
+			m.runner = false
+			m.lock.Unlock()
+			return
+		}
+
+		if !data.InMaintenance(m.windows, time.Now(), m.loc) {
+			// the window closed, so wait for the next one
+			m.runner = false
+			m.schedule()
+			m.lock.Unlock()
+			return
+		}
+
+		task := m.pending[0]
+		m.pending = m.pending[1:]
+		m.running++
+		m.lock.Unlock()
+
+		log.Println("Maintenance: running ", task.name)
+		err := task.fn()
+		if err != nil {
+			log.Printf("Maintenance: error running %v: %v\n", task.name, err)
+		}
+
+		m.lock.Lock()
+		m.running--
+		m.lock.Unlock()
+	}
+}
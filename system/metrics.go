@@ -0,0 +1,346 @@
+package system
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// Temperature is a temperature sensor reading
+type Temperature struct {
+	// Sensor is the thermal zone type or hwmon name and label
+	Sensor string
+	// Value is in degrees C
+	Value float64
+}
+
+// HostMetrics is the load and resource usage of the host
+type HostMetrics struct {
+	Load1  float64
+	Load5  float64
+	Load15 float64
+	// CPU is the total busy percent, and Cores per core, since the last
+	// read. These are not set on the first read.
+	CPU   float64
+	Cores []float64
+	// Memory and swap are in bytes. MemAvailable includes caches that can
+	// be freed.
+	MemTotal     uint64
+	MemAvailable uint64
+	SwapTotal    uint64
+	SwapFree     uint64
+	Temperatures []Temperature
+}
+
+// MemUsedPercent returns the percent of memory in use
+func (m HostMetrics) MemUsedPercent() float64 {
+	if m.MemTotal == 0 {
+		return 0
+	}
+	return float64(m.MemTotal-m.MemAvailable) * 100 / float64(m.MemTotal)
+}
+
+// SwapUsedPercent returns the percent of swap in use
+func (m HostMetrics) SwapUsedPercent() float64 {
+	if m.SwapTotal == 0 {
+		return 0
+	}
+	return float64(m.SwapTotal-m.SwapFree) * 100 / float64(m.SwapTotal)
+}
+
+// Samples returns the metrics as samples. Per core and temperature samples
+// are tagged with the core or sensor.
+func (m HostMetrics) Samples(id string, cpuValid bool) []data.Sample {
+	now := time.Now()
+
+	ret := []data.Sample{
+		{Type: "load1", ID: id, Value: m.Load1, Time: now},
+		{Type: "load5", ID: id, Value: m.Load5, Time: now},
+		{Type: "load15", ID: id, Value: m.Load15, Time: now},
+		{Type: "memUsed", ID: id, Value: m.MemUsedPercent(), Time: now},
+		{Type: "memAvailable", ID: id, Value: float64(m.MemAvailable), Time: now},
+	}
+
+	if m.SwapTotal > 0 {
+		ret = append(ret, data.Sample{Type: "swapUsed", ID: id,
+			Value: m.SwapUsedPercent(), Time: now})
+	}
+
+	if cpuValid {
+		ret = append(ret, data.Sample{Type: "cpu", ID: id, Value: m.CPU,
+			Time: now})
+
+		for i, c := range m.Cores {
+			ret = append(ret, data.Sample{Type: "cpuCore", ID: id, Value: c,
+				Time: now, Tags: map[string]string{"core": strconv.Itoa(i)}})
+		}
+	}
+
+	for _, t := range m.Temperatures {
+		ret = append(ret, data.Sample{Type: "temp", ID: id, Value: t.Value,
+			Time: now, Tags: map[string]string{"sensor": t.Sensor}})
+	}
+
+	return ret
+}
+
+// cpuTimes are the busy and total jiffies of a CPU from /proc/stat
+type cpuTimes struct {
+	busy, total uint64
+}
+
+func readLoad() (l1, l5, l15 float64, err error) {
+	b, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return
+	}
+
+	_, err = fmt.Sscan(string(b), &l1, &l5, &l15)
+	return
+}
+
+// readCPUTimes returns the total followed by each core
+func readCPUTimes() ([]cpuTimes, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ret []cpuTimes
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+
+		var t cpuTimes
+		for i, f := range fields[1:] {
+			v, _ := strconv.ParseUint(f, 10, 64)
+			// guest time is already included in user time
+			if i >= 8 {
+				break
+			}
+			t.total += v
+			// idle and iowait
+			if i != 3 && i != 4 {
+				t.busy += v
+			}
+		}
+
+		ret = append(ret, t)
+	}
+
+	if len(ret) <= 0 {
+		return nil, errors.New("no cpu stats")
+	}
+
+	return ret, scanner.Err()
+}
+
+func busyPercent(prev, cur cpuTimes) float64 {
+	if cur.total <= prev.total {
+		return 0
+	}
+	return float64(cur.busy-prev.busy) * 100 / float64(cur.total-prev.total)
+}
+
+func readMeminfo(m *HostMetrics) error {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fields := map[string]*uint64{
+		"MemTotal":     &m.MemTotal,
+		"MemAvailable": &m.MemAvailable,
+		"SwapTotal":    &m.SwapTotal,
+		"SwapFree":     &m.SwapFree,
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// MemTotal:        8039360 kB
+		parts := strings.Fields(scanner.Text())
+		if len(parts) < 2 {
+			continue
+		}
+
+		p, ok := fields[strings.TrimSuffix(parts[0], ":")]
+		if !ok {
+			continue
+		}
+
+		v, _ := strconv.ParseUint(parts[1], 10, 64)
+		*p = v * 1024
+	}
+
+	return scanner.Err()
+}
+
+func readSysfs(file string) string {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// readMilliC reads a temperature file in millidegrees C
+func readMilliC(file string) (float64, bool) {
+	v, err := strconv.Atoi(readSysfs(file))
+	if err != nil {
+		return 0, false
+	}
+	return float64(v) / 1000, true
+}
+
+// ReadTemperatures returns the SoC and board temperatures from thermal
+// zones and hwmon sensors
+func ReadTemperatures() []Temperature {
+	var ret []Temperature
+
+	zones, _ := filepath.Glob("/sys/class/thermal/thermal_zone*")
+	for _, zone := range zones {
+		v, ok := readMilliC(path.Join(zone, "temp"))
+		if !ok {
+			continue
+		}
+
+		name := readSysfs(path.Join(zone, "type"))
+		if name == "" {
+			name = path.Base(zone)
+		}
+
+		ret = append(ret, Temperature{Sensor: name, Value: v})
+	}
+
+	inputs, _ := filepath.Glob("/sys/class/hwmon/hwmon*/temp*_input")
+	for _, input := range inputs {
+		v, ok := readMilliC(input)
+		if !ok {
+			continue
+		}
+
+		dir := path.Dir(input)
+		name := readSysfs(path.Join(dir, "name"))
+		if name == "" {
+			name = path.Base(dir)
+		}
+
+		label := readSysfs(strings.TrimSuffix(input, "_input") + "_label")
+		if label == "" {
+			label = strings.TrimSuffix(path.Base(input), "_input")
+		}
+
+		ret = append(ret, Temperature{Sensor: name + "/" + label, Value: v})
+	}
+
+	return ret
+}
+
+// HostMetricsCollector periodically reads host metrics and sends them as
+// samples
+type HostMetricsCollector struct {
+	id       string
+	interval time.Duration
+	send     func([]data.Sample) error
+	lock     sync.Mutex
+	prev     []cpuTimes
+	stop     chan struct{}
+}
+
+// NewHostMetricsCollector creates a collector. id is used as the sample
+// ID, and send is typically api.NewSendSamples.
+func NewHostMetricsCollector(id string, interval time.Duration,
+	send func([]data.Sample) error) *HostMetricsCollector {
+	return &HostMetricsCollector{
+		id:       id,
+		interval: interval,
+		send:     send,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Read returns the current metrics. CPU usage is computed since the last
+// call, and valid is false on the first call.
+func (c *HostMetricsCollector) Read() (m HostMetrics, cpuValid bool, err error) {
+	m.Load1, m.Load5, m.Load15, err = readLoad()
+	if err != nil {
+		return
+	}
+
+	err = readMeminfo(&m)
+	if err != nil {
+		return
+	}
+
+	m.Temperatures = ReadTemperatures()
+
+	times, err := readCPUTimes()
+	if err != nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// the number of cores can change with hotplug
+	if len(c.prev) == len(times) {
+		cpuValid = true
+		m.CPU = busyPercent(c.prev[0], times[0])
+		for i := 1; i < len(times); i++ {
+			m.Cores = append(m.Cores, busyPercent(c.prev[i], times[i]))
+		}
+	}
+
+	c.prev = times
+	return
+}
+
+// Start sends metrics until Stop is called
+func (c *HostMetricsCollector) Start() {
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		// prime the cpu usage
+		c.Read()
+
+		for {
+			select {
+			case <-ticker.C:
+				m, cpuValid, err := c.Read()
+				if err != nil {
+					log.Println("Error reading host metrics: ", err)
+					continue
+				}
+
+				err = c.send(m.Samples(c.id, cpuValid))
+				if err != nil {
+					log.Println("Error sending host metrics: ", err)
+				}
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops sending metrics
+func (c *HostMetricsCollector) Stop() {
+	close(c.stop)
+}
@@ -0,0 +1,276 @@
+package system
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/go-serial/serial"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/modbus"
+	"github.com/simpleiot/simpleiot/respreader"
+)
+
+// modbusTimeout is how long a Modbus device has to respond
+const modbusTimeout = time.Second
+
+// OpenModbus opens a client for the serial port or network address in a
+// Modbus config
+func OpenModbus(config data.ModbusConfig) (*modbus.Client, error) {
+	if config.Address != "" {
+		return modbus.DialTCP(config.Address, modbusTimeout)
+	}
+
+	portName, err := ResolveSerialPort(config.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	baud := config.Baud
+	if baud == 0 {
+		baud = 9600
+	}
+
+	port, err := serial.Open(serial.OpenOptions{
+		PortName:              portName,
+		BaudRate:              uint(baud),
+		DataBits:              8,
+		StopBits:              1,
+		MinimumReadSize:       0,
+		InterCharacterTimeout: 100,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return modbus.NewRTUClient(respreader.NewResponseReadWriteCloser(port,
+		modbusTimeout, 50*time.Millisecond)), nil
+}
+
+// ReadModbus reads the registers in a Modbus config and returns them as
+// samples
+func ReadModbus(client *modbus.Client, config data.ModbusConfig) ([]data.Sample, error) {
+	unit := byte(config.UnitID)
+	var ret []data.Sample
+
+	for _, r := range config.Registers {
+		addr := uint16(r.Address)
+		count := uint16(r.Count())
+
+		var regs []uint16
+		var bits []bool
+		var err error
+
+		switch r.Table {
+		case data.ModbusCoil:
+			bits, err = client.ReadCoils(unit, addr, 1)
+		case data.ModbusDiscreteInput:
+			bits, err = client.ReadDiscreteInputs(unit, addr, 1)
+		case data.ModbusHolding:
+			regs, err = client.ReadHoldingRegisters(unit, addr, count)
+		case data.ModbusInput:
+			regs, err = client.ReadInputRegisters(unit, addr, count)
+		default:
+			err = fmt.Errorf("unsupported modbus table: %v", r.Table)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("register %v: %w", r.ID, err)
+		}
+
+		if bits != nil {
+			regs = []uint16{0}
+			if bits[0] {
+				regs[0] = 1
+			}
+		}
+
+		ret = append(ret, data.Sample{Type: r.Type, ID: r.ID,
+			Value: r.Value(regs), Time: time.Now()})
+	}
+
+	return ret, nil
+}
+
+// ModbusScheduler polls the Modbus devices in a device config at their
+// intervals and sends the readings as samples. Devices that share a serial
+// port or address are polled one at a time on the same connection.
+type ModbusScheduler struct {
+	send    func([]data.Sample) error
+	lock    sync.Mutex
+	configs []data.ModbusConfig
+	stops   []chan struct{}
+	// groups are the devices polled on each connection, and polls wake up
+	// the connection to poll its devices now
+	groups [][]data.ModbusConfig
+	polls  []chan struct{}
+}
+
+// NewModbusScheduler creates a Modbus scheduler. send is typically
+// api.NewSendSamples.
+func NewModbusScheduler(send func([]data.Sample) error) *ModbusScheduler {
+	return &ModbusScheduler{send: send}
+}
+
+// run polls devices on the same port or address until stop is closed. All
+// the devices are polled right away when poll receives.
+func (ms *ModbusScheduler) run(configs []data.ModbusConfig, poll, stop chan struct{}) {
+	var client *modbus.Client
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+	}()
+
+	next := make([]time.Time, len(configs))
+
+	for {
+		now := time.Now()
+		var samples []data.Sample
+
+		for i, c := range configs {
+			if now.Before(next[i]) {
+				continue
+			}
+
+			next[i] = now.Add(time.Duration(c.Interval) * time.Second)
+
+			var err error
+			if client == nil {
+				client, err = OpenModbus(c)
+				if err != nil {
+					log.Printf("Error opening modbus %v%v: %v", c.Port,
+						c.Address, err)
+					continue
+				}
+			}
+
+			s, err := ReadModbus(client, c)
+			if err != nil {
+				log.Printf("Error reading modbus %v%v unit %v: %v", c.Port,
+					c.Address, c.UnitID, err)
+				// TCP connections are reopened in case the device closed
+				// them
+				if c.Address != "" {
+					client.Close()
+					client = nil
+				}
+				continue
+			}
+
+			samples = append(samples, s...)
+		}
+
+		if len(samples) > 0 {
+			err := ms.send(samples)
+			if err != nil {
+				log.Println("Error sending modbus samples: ", err)
+			}
+		}
+
+		wait := next[0]
+		for _, n := range next[1:] {
+			if n.Before(wait) {
+				wait = n
+			}
+		}
+
+		timer := time.NewTimer(time.Until(wait))
+		select {
+		case <-timer.C:
+		case <-poll:
+			timer.Stop()
+			for i := range next {
+				next[i] = time.Time{}
+			}
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Poll reads the Modbus devices that have a register for a sample type now,
+// instead of waiting for their interval. If id is set, the register ID
+// must match too. The readings are sent like other readings.
+func (ms *ModbusScheduler) Poll(sampleType, id string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	found := false
+	for i, group := range ms.groups {
+		match := false
+		for _, c := range group {
+			for _, r := range c.Registers {
+				if r.Type == sampleType && (id == "" || r.ID == id) {
+					match = true
+				}
+			}
+		}
+
+		if !match {
+			continue
+		}
+
+		found = true
+		select {
+		case ms.polls[i] <- struct{}{}:
+		default:
+			// a poll is already pending
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("no modbus register for %v %v", sampleType, id)
+	}
+
+	return nil
+}
+
+// Update starts polling the Modbus devices in configs, and stops polling
+// any that were removed. It should be called when the device config
+// changes.
+func (ms *ModbusScheduler) Update(configs []data.ModbusConfig) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if reflect.DeepEqual(configs, ms.configs) {
+		return
+	}
+
+	for _, stop := range ms.stops {
+		close(stop)
+	}
+
+	ms.configs = append([]data.ModbusConfig{}, configs...)
+	ms.stops = nil
+	ms.groups = nil
+	ms.polls = nil
+
+	// group the devices by connection
+	var keys []string
+	groups := make(map[string][]data.ModbusConfig)
+	for _, c := range configs {
+		key := c.Port + c.Address
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], c)
+	}
+
+	for _, key := range keys {
+		stop := make(chan struct{})
+		poll := make(chan struct{}, 1)
+		ms.stops = append(ms.stops, stop)
+		ms.groups = append(ms.groups, groups[key])
+		ms.polls = append(ms.polls, poll)
+		go ms.run(groups[key], poll, stop)
+	}
+}
+
+// Stop stops polling all Modbus devices
+func (ms *ModbusScheduler) Stop() {
+	ms.Update(nil)
+}
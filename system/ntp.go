@@ -0,0 +1,341 @@
+package system
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// seconds between the NTP epoch (1900) and the unix epoch
+const ntpEpochOffset = 2208988800
+
+// NtpResult is the result of an NTP query
+type NtpResult struct {
+	// Offset is how far the system clock is behind the server
+	Offset  time.Duration
+	Rtt     time.Duration
+	Stratum int
+}
+
+func ntpTime(b []byte) time.Time {
+	sec := binary.BigEndian.Uint32(b)
+	frac := binary.BigEndian.Uint32(b[4:])
+	nsec := (int64(frac) * 1e9) >> 32
+	return time.Unix(int64(sec)-ntpEpochOffset, nsec)
+}
+
+func putNtpTime(b []byte, t time.Time) {
+	binary.BigEndian.PutUint32(b, uint32(t.Unix()+ntpEpochOffset))
+	binary.BigEndian.PutUint32(b[4:], uint32((int64(t.Nanosecond())<<32)/1e9))
+}
+
+// NtpQuery gets the clock offset from an NTP server (host or host:port)
+func NtpQuery(server string, timeout time.Duration) (NtpResult, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return NtpResult{}, err
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return NtpResult{}, err
+	}
+
+	req := make([]byte, 48)
+	// LI 0, version 4, client mode
+	req[0] = 0x23
+	t1 := time.Now()
+	putNtpTime(req[40:], t1)
+
+	_, err = conn.Write(req)
+	if err != nil {
+		return NtpResult{}, err
+	}
+
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	t4 := time.Now()
+	if err != nil {
+		return NtpResult{}, err
+	}
+
+	if n < 48 {
+		return NtpResult{}, errors.New("short NTP response")
+	}
+
+	if resp[0]&0x7 != 4 {
+		return NtpResult{}, errors.New("NTP response is not from a server")
+	}
+
+	// the server returns our transmit time so we know the response is
+	// for our request
+	for i := 0; i < 8; i++ {
+		if resp[24+i] != req[40+i] {
+			return NtpResult{}, errors.New("NTP response does not match request")
+		}
+	}
+
+	stratum := int(resp[1])
+	if stratum == 0 || stratum > 15 {
+		return NtpResult{}, fmt.Errorf("NTP server is not synchronized (stratum %v)", stratum)
+	}
+
+	if resp[0]>>6 == 3 {
+		return NtpResult{}, errors.New("NTP server clock is not synchronized")
+	}
+
+	t2 := ntpTime(resp[32:])
+	t3 := ntpTime(resp[40:])
+
+	return NtpResult{
+		Offset:  (t2.Sub(t1) + t3.Sub(t4)) / 2,
+		Rtt:     t4.Sub(t1) - t3.Sub(t2),
+		Stratum: stratum,
+	}, nil
+}
+
+// HTTPTimeSource returns a time source that uses the Date header of a
+// server response, for networks that block NTP. The time is only accurate
+// to about a second.
+func HTTPTimeSource(client *http.Client, url string) TimeSource {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return func() (time.Time, error) {
+		start := time.Now()
+		resp, err := client.Head(url)
+		if err != nil {
+			return time.Time{}, err
+		}
+		resp.Body.Close()
+
+		t, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Error parsing Date header: %v", err)
+		}
+
+		// the header is truncated to the second
+		return t.Add(500*time.Millisecond + time.Since(start)/2), nil
+	}
+}
+
+// FallbackTime is a time source used when no NTP server can be reached
+type FallbackTime struct {
+	Name   string
+	Source TimeSource
+}
+
+// TimeSyncConfig describes how the system time is kept synced
+type TimeSyncConfig struct {
+	// Servers are NTP servers tried in order (default pool.ntp.org)
+	Servers []string
+	// Interval is how often the time is synced (default 1h)
+	Interval time.Duration
+	// MaxOffset is how far the clock can drift before it is set (default
+	// 500ms)
+	MaxOffset time.Duration
+	// Timeout for each NTP query (default 5s)
+	Timeout time.Duration
+	// Fallbacks are tried in order when no NTP server can be reached, like
+	// the server Date header or cellular network time. Fallbacks are
+	// assumed to be less accurate, so the clock is only set when it is off
+	// by more than FallbackMaxOffset (default 5s).
+	Fallbacks         []FallbackTime
+	FallbackMaxOffset time.Duration
+}
+
+// TimeSyncStatus is the state of time sync
+type TimeSyncStatus struct {
+	Synced bool
+	// Source is the NTP server or fallback name of the last sync
+	Source string
+	// Offset is how far the clock was off at the last sync
+	Offset time.Duration
+	// Stratum is only set when synced with NTP
+	Stratum  int
+	LastSync time.Time
+	Error    string
+}
+
+// Samples returns the time sync status as samples
+func (s TimeSyncStatus) Samples(id string) []data.Sample {
+	now := time.Now()
+	synced := 0.0
+	if s.Synced {
+		synced = 1
+	}
+
+	ret := []data.Sample{
+		{Type: "timeSynced", ID: id, Value: synced, Time: now},
+	}
+
+	if !s.LastSync.IsZero() {
+		ret = append(ret,
+			data.Sample{Type: "timeOffset", ID: id, Value: s.Offset.Seconds(),
+				Time: now},
+			data.Sample{Type: "timeLastSync", ID: id,
+				Value: float64(s.LastSync.Unix()), Time: now},
+		)
+	}
+
+	if s.Stratum > 0 {
+		ret = append(ret, data.Sample{Type: "timeStratum", ID: id,
+			Value: float64(s.Stratum), Time: now})
+	}
+
+	return ret
+}
+
+// TimeSync keeps the system time synced with NTP servers, falling back to
+// other time sources when NTP is blocked. It should not be used on systems
+// that run another NTP client like chrony or systemd-timesyncd.
+type TimeSync struct {
+	config TimeSyncConfig
+	lock   sync.Mutex
+	status TimeSyncStatus
+	stop   chan struct{}
+}
+
+// NewTimeSync creates a new time sync
+func NewTimeSync(config TimeSyncConfig) *TimeSync {
+	if len(config.Servers) <= 0 {
+		config.Servers = []string{"pool.ntp.org"}
+	}
+
+	if config.Interval == 0 {
+		config.Interval = time.Hour
+	}
+
+	if config.MaxOffset == 0 {
+		config.MaxOffset = 500 * time.Millisecond
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+
+	if config.FallbackMaxOffset == 0 {
+		config.FallbackMaxOffset = 5 * time.Second
+	}
+
+	return &TimeSync{config: config, stop: make(chan struct{})}
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// Sync syncs the time now
+func (ts *TimeSync) Sync() error {
+	var errs []error
+
+	for _, server := range ts.config.Servers {
+		res, err := NtpQuery(server, ts.config.Timeout)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", server, err))
+			continue
+		}
+
+		return ts.adjust(server, res.Offset, res.Stratum, ts.config.MaxOffset)
+	}
+
+	for _, f := range ts.config.Fallbacks {
+		t, err := f.Source()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", f.Name, err))
+			continue
+		}
+
+		return ts.adjust(f.Name, time.Until(t), 0, ts.config.FallbackMaxOffset)
+	}
+
+	err := fmt.Errorf("time sync failed: %v", errs)
+
+	ts.lock.Lock()
+	ts.status.Synced = false
+	ts.status.Error = err.Error()
+	ts.lock.Unlock()
+
+	return err
+}
+
+func (ts *TimeSync) adjust(source string, offset time.Duration, stratum int,
+	maxOffset time.Duration) error {
+	var err error
+	if abs(offset) > maxOffset {
+		log.Printf("Time sync: setting time from %v, offset %v", source, offset)
+		err = SetTime(time.Now().Add(offset))
+		// boards without an RTC still have the system time set
+		if errors.Is(err, ErrNoRTC) {
+			err = nil
+		}
+	}
+
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	ts.status = TimeSyncStatus{
+		Synced:   err == nil,
+		Source:   source,
+		Offset:   offset,
+		Stratum:  stratum,
+		LastSync: time.Now(),
+	}
+
+	if err != nil {
+		ts.status.Error = err.Error()
+	}
+
+	return err
+}
+
+// Status returns the result of the last sync
+func (ts *TimeSync) Status() TimeSyncStatus {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	return ts.status
+}
+
+// Start syncs the time every Interval until Stop is called. Failed syncs
+// are retried every minute.
+func (ts *TimeSync) Start() {
+	go func() {
+		for {
+			wait := ts.config.Interval
+			err := ts.Sync()
+			if err != nil {
+				log.Println(err)
+				if wait > time.Minute {
+					wait = time.Minute
+				}
+			}
+
+			select {
+			case <-time.After(wait):
+			case <-ts.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops syncing the time
+func (ts *TimeSync) Stop() {
+	close(ts.stop)
+}
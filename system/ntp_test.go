@@ -0,0 +1,167 @@
+package system
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNtpTime(t *testing.T) {
+	cases := []struct {
+		b []byte
+		t time.Time
+	}{
+		{[]byte{0, 0, 0, 0, 0, 0, 0, 0}, time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{[]byte{0x83, 0xaa, 0x7e, 0x80, 0, 0, 0, 0}, time.Unix(0, 0)},
+		{[]byte{0x83, 0xaa, 0x7e, 0x80, 0x80, 0, 0, 0}, time.Unix(0, 5e8)},
+		// 2020-01-01 00:00:00.25 UTC
+		{[]byte{0xe1, 0xb6, 0x5f, 0x80, 0x40, 0, 0, 0},
+			time.Date(2020, 1, 1, 0, 0, 0, 25e7, time.UTC)},
+	}
+
+	for _, c := range cases {
+		if got := ntpTime(c.b); !got.Equal(c.t) {
+			t.Errorf("% x: expected %v, got %v", c.b, c.t, got)
+		}
+
+		// times before 1970 can't be sent
+		if c.t.Before(time.Unix(0, 0)) {
+			continue
+		}
+
+		b := make([]byte, 8)
+		putNtpTime(b, c.t)
+		if !bytes.Equal(b, c.b) {
+			t.Errorf("%v: expected % x, got % x", c.t, c.b, b)
+		}
+	}
+
+	// the fraction has sub nanosecond resolution, but is truncated
+	b := make([]byte, 8)
+	now := time.Unix(1577836800, 123456789)
+	putNtpTime(b, now)
+	if d := now.Sub(ntpTime(b)); d < 0 || d > time.Nanosecond {
+		t.Errorf("round trip error %v", d)
+	}
+}
+
+// startTimeServer serves NTP on a local port and returns the address
+func startTimeServer(t *testing.T, s *TimeServer) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening: ", err)
+	}
+
+	go s.Serve(conn)
+
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+func TestNtpQuery(t *testing.T) {
+	s := NewTimeServer(TimeServerConfig{Status: func() TimeSyncStatus {
+		return TimeSyncStatus{Synced: true, Stratum: 1, LastSync: time.Now()}
+	}})
+
+	addr, stop := startTimeServer(t, s)
+	defer stop()
+
+	res, err := NtpQuery(addr, time.Second)
+	if err != nil {
+		t.Fatal("Error querying NTP: ", err)
+	}
+
+	if res.Stratum != 2 || abs(res.Offset) > 10*time.Millisecond ||
+		res.Rtt < 0 || res.Rtt > time.Second {
+		t.Errorf("unexpected result: %+v", res)
+	}
+
+	if s.Served() != 1 {
+		t.Errorf("expected 1 request served, got %v", s.Served())
+	}
+
+	// clients must not sync to an unsynced server
+	unsynced := NewTimeServer(TimeServerConfig{Status: func() TimeSyncStatus {
+		return TimeSyncStatus{}
+	}})
+
+	addr, stop = startTimeServer(t, unsynced)
+	defer stop()
+
+	if _, err := NtpQuery(addr, time.Second); err == nil {
+		t.Error("expected error for unsynced server")
+	}
+}
+
+func TestTimeSync(t *testing.T) {
+	// served as stratum 2 without a Status func
+	s := NewTimeServer(TimeServerConfig{})
+	addr, stop := startTimeServer(t, s)
+	defer stop()
+
+	// nothing listens on the first server
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.LocalAddr().String()
+	closed.Close()
+
+	ts := NewTimeSync(TimeSyncConfig{Servers: []string{closedAddr, addr},
+		Timeout: 100 * time.Millisecond})
+
+	// the clock is within MaxOffset, so it is not set
+	if err := ts.Sync(); err != nil {
+		t.Fatal("Error syncing: ", err)
+	}
+
+	status := ts.Status()
+	if !status.Synced || status.Source != addr || status.Stratum != 2 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestTimeSyncFallback(t *testing.T) {
+	ts := httptest.NewServer(NewTimeServer(TimeServerConfig{}))
+	defer ts.Close()
+
+	sync := NewTimeSync(TimeSyncConfig{Servers: []string{"127.0.0.1:1"},
+		Timeout: 100 * time.Millisecond,
+		Fallbacks: []FallbackTime{
+			{"broken", func() (time.Time, error) { return time.Time{}, errors.New("no signal") }},
+			{"http", HTTPTimeSource(nil, ts.URL)},
+		}})
+
+	if err := sync.Sync(); err != nil {
+		t.Fatal("Error syncing: ", err)
+	}
+
+	// the Date header is truncated to the second
+	status := sync.Status()
+	if !status.Synced || status.Source != "http" || status.Stratum != 0 ||
+		abs(status.Offset) > time.Second {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	samples := status.Samples("dev1")
+	if len(samples) != 3 || samples[0].Type != "timeSynced" || samples[0].Value != 1 {
+		t.Errorf("unexpected samples: %+v", samples)
+	}
+
+	sync = NewTimeSync(TimeSyncConfig{Servers: []string{"127.0.0.1:1"},
+		Timeout: 100 * time.Millisecond})
+	if sync.Sync() == nil {
+		t.Fatal("expected error without a time source")
+	}
+
+	if status := sync.Status(); status.Synced || status.Error == "" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	if samples := sync.Status().Samples("dev1"); len(samples) != 1 ||
+		samples[0].Value != 0 {
+		t.Errorf("unexpected samples: %+v", samples)
+	}
+}
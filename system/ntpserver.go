@@ -0,0 +1,251 @@
+package system
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// fallbackStratum is the stratum served when the clock was synced from a
+// fallback source like cellular network time, which is less accurate than
+// NTP
+const fallbackStratum = 10
+
+// TimeServerConfig describes how the time is served to local devices
+type TimeServerConfig struct {
+	// Addr is the UDP address NTP is served on (default :123)
+	Addr string
+	// HTTPAddr is the address the time is served over HTTP on, for
+	// devices that can't use NTP. HTTP is disabled if it is blank.
+	HTTPAddr string
+	// Status returns the sync state of the system clock, typically
+	// TimeSync.Status. If nil, the clock is assumed to be synced by
+	// another NTP client and is served as stratum 2.
+	Status func() TimeSyncStatus
+	// MaxAge is how long after the last sync the clock is still served
+	// as synced (default 24h). Clients ignore unsynced servers.
+	MaxAge time.Duration
+}
+
+// TimeServer serves the system time to devices on isolated networks, like
+// sensors and PLCs on an OT network behind a gateway, over NTP and HTTP.
+// The gateway itself syncs with TimeSync.
+type TimeServer struct {
+	config TimeServerConfig
+	lock   sync.Mutex
+	conn   net.PacketConn
+	server *http.Server
+	served uint64
+}
+
+// NewTimeServer creates a new time server
+func NewTimeServer(config TimeServerConfig) *TimeServer {
+	if config.Addr == "" {
+		config.Addr = ":123"
+	}
+
+	if config.MaxAge == 0 {
+		config.MaxAge = 24 * time.Hour
+	}
+
+	return &TimeServer{config: config}
+}
+
+// status returns the stratum and reference of the served time, and the
+// time of the last sync. Stratum 16 means the clock is not synced.
+func (s *TimeServer) status() (stratum int, ref []byte, lastSync time.Time) {
+	ref = make([]byte, 4)
+
+	if s.config.Status == nil {
+		return 2, ref, time.Now()
+	}
+
+	st := s.config.Status()
+	if !st.Synced || time.Since(st.LastSync) > s.config.MaxAge {
+		return 16, ref, st.LastSync
+	}
+
+	if st.Stratum <= 0 {
+		copy(ref, "LOCL")
+		return fallbackStratum, ref, st.LastSync
+	}
+
+	// the reference ID of a stratum 2+ server is the IPv4 address of its
+	// upstream server
+	host, _, err := net.SplitHostPort(st.Source)
+	if err != nil {
+		host = st.Source
+	}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		copy(ref, ip)
+	}
+
+	stratum = st.Stratum + 1
+	if stratum > 15 {
+		stratum = 15
+	}
+
+	return stratum, ref, st.LastSync
+}
+
+// ntpResponse returns the response to an NTP client request received at
+// rx, or nil if req is not a client request
+func (s *TimeServer) ntpResponse(req []byte, rx time.Time) []byte {
+	if len(req) < 48 || req[0]&0x7 != 3 {
+		return nil
+	}
+
+	stratum, ref, lastSync := s.status()
+
+	var leap byte
+	if stratum == 16 {
+		leap = 3
+	}
+
+	version := (req[0] >> 3) & 0x7
+	resp := make([]byte, 48)
+	resp[0] = leap<<6 | version<<3 | 4
+	resp[1] = byte(stratum)
+	// poll interval of the client
+	resp[2] = req[2]
+	// precision of about a microsecond
+	resp[3] = 0xec
+	copy(resp[12:], ref)
+	if !lastSync.IsZero() {
+		putNtpTime(resp[16:], lastSync)
+	}
+	// the origin time is the transmit time of the client, which it uses
+	// to match the response to its request
+	copy(resp[24:32], req[40:48])
+	putNtpTime(resp[32:], rx)
+	putNtpTime(resp[40:], time.Now())
+
+	return resp
+}
+
+// Serve answers NTP requests on conn until it is closed
+func (s *TimeServer) Serve(conn net.PacketConn) error {
+	buf := make([]byte, 512)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		rx := time.Now()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		resp := s.ntpResponse(buf[:n], rx)
+		if resp == nil {
+			continue
+		}
+
+		_, err = conn.WriteTo(resp, addr)
+		if err != nil {
+			log.Printf("Error sending NTP response to %v: %v\n", addr, err)
+			continue
+		}
+
+		s.lock.Lock()
+		s.served++
+		s.lock.Unlock()
+	}
+}
+
+// Served returns the number of NTP requests answered
+func (s *TimeServer) Served() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.served
+}
+
+type timeResponse struct {
+	Time    time.Time `json:"time"`
+	Synced  bool      `json:"synced"`
+	Stratum int       `json:"stratum"`
+}
+
+// ServeHTTP returns the time as JSON. The Date header is also set, so
+// HTTPTimeSource can be pointed at the server.
+func (s *TimeServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(res, "only GET and HEAD are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stratum, _, _ := s.status()
+	now := time.Now()
+
+	res.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+	res.Header().Set("Cache-Control", "no-store")
+	res.Header().Set("Content-Type", "application/json")
+
+	if req.Method == http.MethodHead {
+		return
+	}
+
+	json.NewEncoder(res).Encode(timeResponse{
+		Time:    now,
+		Synced:  stratum < 16,
+		Stratum: stratum,
+	})
+}
+
+// Start serves the time until Stop is called
+func (s *TimeServer) Start() error {
+	conn, err := net.ListenPacket("udp", s.config.Addr)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.conn = conn
+	go func() {
+		err := s.Serve(conn)
+
+		s.lock.Lock()
+		stopped := s.conn != conn
+		s.lock.Unlock()
+
+		if !stopped {
+			log.Println("NTP server error: ", err)
+		}
+	}()
+
+	if s.config.HTTPAddr != "" {
+		s.server = &http.Server{Addr: s.config.HTTPAddr, Handler: s}
+		go func(server *http.Server) {
+			err := server.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Println("HTTP time server error: ", err)
+			}
+		}(s.server)
+	}
+
+	return nil
+}
+
+// Stop stops serving the time
+func (s *TimeServer) Stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	if s.server != nil {
+		s.server.Close()
+		s.server = nil
+	}
+}
@@ -0,0 +1,151 @@
+package system
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// ntpRequest returns an NTP v4 client request
+func ntpRequest(tx time.Time) []byte {
+	req := make([]byte, 48)
+	req[0] = 0x23
+	req[2] = 6
+	putNtpTime(req[40:], tx)
+	return req
+}
+
+func TestNtpResponse(t *testing.T) {
+	lastSync := time.Now().Add(-time.Hour)
+
+	cases := []struct {
+		name    string
+		status  func() TimeSyncStatus
+		leap    byte
+		stratum byte
+		ref     []byte
+	}{
+		{"no status", nil, 0, 2, []byte{0, 0, 0, 0}},
+		{"ntp", func() TimeSyncStatus {
+			return TimeSyncStatus{Synced: true, Source: "192.0.2.10:123",
+				Stratum: 2, LastSync: lastSync}
+		}, 0, 3, []byte{192, 0, 2, 10}},
+		// hostnames are not resolved
+		{"ntp host", func() TimeSyncStatus {
+			return TimeSyncStatus{Synced: true, Source: "pool.ntp.org",
+				Stratum: 15, LastSync: lastSync}
+		}, 0, 15, []byte{0, 0, 0, 0}},
+		{"fallback", func() TimeSyncStatus {
+			return TimeSyncStatus{Synced: true, Source: "cellular",
+				LastSync: lastSync}
+		}, 0, fallbackStratum, []byte("LOCL")},
+		{"not synced", func() TimeSyncStatus {
+			return TimeSyncStatus{Source: "pool.ntp.org"}
+		}, 3, 16, []byte{0, 0, 0, 0}},
+		{"stale", func() TimeSyncStatus {
+			return TimeSyncStatus{Synced: true, Source: "192.0.2.10", Stratum: 1,
+				LastSync: time.Now().Add(-25 * time.Hour)}
+		}, 3, 16, []byte{0, 0, 0, 0}},
+	}
+
+	for _, c := range cases {
+		s := NewTimeServer(TimeServerConfig{Status: c.status})
+
+		rx := time.Now()
+		req := ntpRequest(rx.Add(-time.Millisecond))
+		resp := s.ntpResponse(req, rx)
+		if len(resp) != 48 {
+			t.Fatalf("%v: expected 48 byte response, got %v", c.name, len(resp))
+		}
+
+		// version 4, server mode
+		if resp[0] != c.leap<<6|0x24 {
+			t.Errorf("%v: expected first byte 0x%x, got 0x%x", c.name,
+				c.leap<<6|0x24, resp[0])
+		}
+
+		if resp[1] != c.stratum {
+			t.Errorf("%v: expected stratum %v, got %v", c.name, c.stratum, resp[1])
+		}
+
+		if resp[2] != req[2] {
+			t.Errorf("%v: poll interval not copied", c.name)
+		}
+
+		if !bytes.Equal(resp[12:16], c.ref) {
+			t.Errorf("%v: expected ref % x, got % x", c.name, c.ref, resp[12:16])
+		}
+
+		if !bytes.Equal(resp[24:32], req[40:48]) {
+			t.Errorf("%v: origin time is not the client transmit time", c.name)
+		}
+
+		if d := rx.Sub(ntpTime(resp[32:])); d < 0 || d > time.Nanosecond {
+			t.Errorf("%v: expected receive time %v, got %v", c.name, rx,
+				ntpTime(resp[32:]))
+		}
+
+		if tx := ntpTime(resp[40:]); tx.Before(ntpTime(resp[32:])) {
+			t.Errorf("%v: transmit time before receive time", c.name)
+		}
+	}
+}
+
+func TestNtpResponseIgnored(t *testing.T) {
+	s := NewTimeServer(TimeServerConfig{})
+
+	// server mode
+	req := ntpRequest(time.Now())
+	req[0] = 0x24
+	if s.ntpResponse(req, time.Now()) != nil {
+		t.Error("responded to a server packet")
+	}
+
+	if s.ntpResponse(ntpRequest(time.Now())[:47], time.Now()) != nil {
+		t.Error("responded to a short packet")
+	}
+
+	// NTP v3 clients get a v3 response
+	req = ntpRequest(time.Now())
+	req[0] = 0x1b
+	if resp := s.ntpResponse(req, time.Now()); resp == nil || resp[0] != 0x1c {
+		t.Errorf("unexpected v3 response: % x", resp)
+	}
+}
+
+func TestTimeServerHTTP(t *testing.T) {
+	s := NewTimeServer(TimeServerConfig{Status: func() TimeSyncStatus {
+		return TimeSyncStatus{Synced: true, Stratum: 1, LastSync: time.Now()}
+	}})
+
+	res := httptest.NewRecorder()
+	s.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/time", nil))
+
+	var tr timeResponse
+	if err := json.NewDecoder(res.Body).Decode(&tr); err != nil {
+		t.Fatal("Error decoding response: ", err)
+	}
+
+	if !tr.Synced || tr.Stratum != 2 || time.Since(tr.Time) > time.Second {
+		t.Errorf("unexpected response: %+v", tr)
+	}
+
+	if _, err := http.ParseTime(res.Header().Get("Date")); err != nil {
+		t.Error("Error parsing Date header: ", err)
+	}
+
+	res = httptest.NewRecorder()
+	s.ServeHTTP(res, httptest.NewRequest(http.MethodHead, "/time", nil))
+	if res.Body.Len() != 0 || res.Header().Get("Date") == "" {
+		t.Errorf("unexpected HEAD response: %q", res.Body.String())
+	}
+
+	res = httptest.NewRecorder()
+	s.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/time", nil))
+	if res.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected %v, got %v", http.StatusMethodNotAllowed, res.Code)
+	}
+}
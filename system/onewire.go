@@ -0,0 +1,225 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// W1DevicesDir is where the kernel w1 driver lists 1-Wire devices
+var W1DevicesDir = "/sys/bus/w1/devices"
+
+// oneWireFamilies are the family codes of supported temperature probes
+var oneWireFamilies = map[string]string{
+	"10": "DS18S20",
+	"22": "DS1822",
+	"28": "DS18B20",
+	"3b": "DS1825",
+	"42": "DS28EA00",
+}
+
+// errOneWireCRC is returned when a probe reading fails the CRC check
+var errOneWireCRC = errors.New("1-wire crc error")
+
+// OneWireProbes returns the addresses of the temperature probes found by
+// the w1 driver
+func OneWireProbes() ([]string, error) {
+	files, err := ioutil.ReadDir(W1DevicesDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var ret []string
+	for _, f := range files {
+		name := f.Name()
+		if len(name) < 3 || name[2] != '-' {
+			continue
+		}
+		if _, ok := oneWireFamilies[name[:2]]; ok {
+			ret = append(ret, name)
+		}
+	}
+
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// ReadOneWireTemp reads the temperature of a probe in C
+func ReadOneWireTemp(address string) (float64, error) {
+	b, err := ioutil.ReadFile(path.Join(W1DevicesDir, address, "w1_slave"))
+	if err != nil {
+		return 0, err
+	}
+
+	// the first line is the scratchpad and CRC check, and the second has
+	// the temperature in millidegrees, like:
+	// 72 01 4b 46 7f ff 0e 10 57 : crc=57 YES
+	// 72 01 4b 46 7f ff 0e 10 57 t=23125
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) < 2 {
+		return 0, fmt.Errorf("invalid 1-wire reading: %q", b)
+	}
+
+	if !strings.HasSuffix(strings.TrimSpace(lines[0]), "YES") {
+		return 0, errOneWireCRC
+	}
+
+	i := strings.LastIndex(lines[1], "t=")
+	if i < 0 {
+		return 0, fmt.Errorf("invalid 1-wire reading: %q", b)
+	}
+
+	t, err := strconv.Atoi(strings.TrimSpace(lines[1][i+2:]))
+	if err != nil {
+		return 0, fmt.Errorf("invalid 1-wire temperature: %v", err)
+	}
+
+	// 85 C is the power on reset value, which is read if the conversion
+	// didn't run
+	if t == 85000 {
+		return 0, errors.New("1-wire probe was reset")
+	}
+
+	return float64(t) / 1000, nil
+}
+
+// OneWireReader reads the 1-Wire temperature probes found on a device at
+// an interval and sends the readings as samples
+type OneWireReader struct {
+	send   func([]data.Sample) error
+	lock   sync.Mutex
+	config *data.OneWireConfig
+	stop   chan struct{}
+}
+
+// NewOneWireReader creates a 1-Wire reader. send is typically
+// api.NewSendSamples.
+func NewOneWireReader(send func([]data.Sample) error) *OneWireReader {
+	return &OneWireReader{send: send}
+}
+
+// read reads the probes in config. Errors are logged once per probe until
+// it is read again.
+func (r *OneWireReader) read(config data.OneWireConfig, found map[string]bool,
+	failed map[string]bool) []data.Sample {
+	addresses, err := OneWireProbes()
+	if err != nil {
+		log.Println("Error finding 1-wire probes: ", err)
+		return nil
+	}
+
+	probes := make(map[string]data.OneWireProbe)
+	for _, p := range config.Probes {
+		probes[p.Address] = p
+	}
+
+	var ret []data.Sample
+	for _, a := range addresses {
+		p, ok := probes[a]
+		if !ok {
+			if config.Listed {
+				continue
+			}
+			p = data.OneWireProbe{Address: a, ID: a}
+		}
+
+		if !found[a] {
+			log.Printf("Found 1-wire %v probe %v\n", oneWireFamilies[a[:2]], a)
+			found[a] = true
+		}
+
+		// a CRC error is usually noise, so try again
+		t, err := ReadOneWireTemp(a)
+		if err == errOneWireCRC {
+			t, err = ReadOneWireTemp(a)
+		}
+
+		if err != nil {
+			if !failed[a] {
+				log.Printf("Error reading 1-wire probe %v: %v\n", a, err)
+				failed[a] = true
+			}
+			continue
+		}
+		failed[a] = false
+
+		ret = append(ret, data.Sample{Type: "temp", ID: p.ID,
+			Value: t + p.Offset, Time: time.Now()})
+	}
+
+	return ret
+}
+
+func (r *OneWireReader) run(config data.OneWireConfig, stop chan struct{}) {
+	interval := time.Duration(config.Interval) * time.Second
+	if interval == 0 {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	found := make(map[string]bool)
+	failed := make(map[string]bool)
+
+	for {
+		samples := r.read(config, found, failed)
+		if len(samples) > 0 {
+			err := r.send(samples)
+			if err != nil {
+				log.Println("Error sending 1-wire samples: ", err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Update starts reading probes if config is set, and stops if it is nil.
+// It should be called when the device config changes.
+func (r *OneWireReader) Update(config *data.OneWireConfig) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if reflect.DeepEqual(config, r.config) {
+		return
+	}
+
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+
+	r.config = nil
+	if config == nil {
+		return
+	}
+
+	c := *config
+	r.config = &c
+	r.stop = make(chan struct{})
+	go r.run(c, r.stop)
+}
+
+// Stop stops reading probes
+func (r *OneWireReader) Stop() {
+	r.Update(nil)
+}
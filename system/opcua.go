@@ -0,0 +1,295 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/opcua"
+)
+
+// OpcuaWriteCommand is the device command used to write a value to an OPC
+// UA node. The id arg is the sample ID of a writable node, and value is
+// the number to write, which is converted to the node's data type.
+const OpcuaWriteCommand = "opcuaWrite"
+
+// opcuaRetry is how long to wait before reconnecting to a server
+const opcuaRetry = 10 * time.Second
+
+// OpcuaScheduler subscribes to the nodes of the OPC UA servers in a device
+// config, and sends value changes as samples. Connections are retried
+// until the config changes.
+type OpcuaScheduler struct {
+	send    func([]data.Sample) error
+	lock    sync.Mutex
+	configs []data.OpcuaConfig
+	stops   []chan struct{}
+	// clients are the connected servers by config index
+	clients map[int]*opcua.Client
+}
+
+// NewOpcuaScheduler creates an OPC UA scheduler. send is typically
+// api.NewSendSamples.
+func NewOpcuaScheduler(send func([]data.Sample) error) *OpcuaScheduler {
+	return &OpcuaScheduler{send: send, clients: make(map[int]*opcua.Client)}
+}
+
+// opcuaSample converts the value of a node to a sample
+func opcuaSample(config data.OpcuaConfig, n data.OpcuaNode, v opcua.DataValue) (data.Sample, error) {
+	if v.Status.Bad() {
+		return data.Sample{}, fmt.Errorf("OPC UA %v node %v: %v", config.Endpoint,
+			n.NodeID, v.Status)
+	}
+
+	f, ok := opcua.ToFloat(v.Value)
+	if !ok {
+		return data.Sample{}, fmt.Errorf("OPC UA %v node %v is not a number: %T",
+			config.Endpoint, n.NodeID, v.Value)
+	}
+
+	t := v.SourceTime
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	return data.Sample{Type: n.Type, ID: n.ID, Value: f, Time: t}, nil
+}
+
+// subscribe connects to a server and subscribes to its nodes. The client
+// is returned so it can be closed.
+func (o *OpcuaScheduler) subscribe(config data.OpcuaConfig) (*opcua.Client, error) {
+	nodes := make([]opcua.NodeID, len(config.Nodes))
+	for i, n := range config.Nodes {
+		var err error
+		nodes[i], err = opcua.ParseNodeID(n.NodeID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := opcua.Dial(config.Endpoint, opcua.Config{
+		User:     config.User,
+		Password: config.Password,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	interval := config.Interval
+	if interval == 0 {
+		interval = 1000
+	}
+
+	err = client.Subscribe(time.Duration(interval)*time.Millisecond, nodes,
+		func(i int, v opcua.DataValue) {
+			s, err := opcuaSample(config, config.Nodes[i], v)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+
+			err = o.send([]data.Sample{s})
+			if err != nil {
+				log.Println("Error sending OPC UA samples: ", err)
+			}
+		})
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// run keeps a subscription to a server until stop is closed
+func (o *OpcuaScheduler) run(index int, config data.OpcuaConfig, stop chan struct{}) {
+	for {
+		client, err := o.subscribe(config)
+		if err != nil {
+			log.Printf("Error subscribing to OPC UA %v: %v\n", config.Endpoint, err)
+		} else {
+			// stop is closed with the lock held, so a stopped client can't
+			// replace the client of a new config
+			o.lock.Lock()
+			select {
+			case <-stop:
+			default:
+				o.clients[index] = client
+			}
+			o.lock.Unlock()
+
+			select {
+			case <-client.Done():
+				log.Printf("OPC UA %v disconnected: %v\n", config.Endpoint,
+					client.Err())
+			case <-stop:
+			}
+
+			o.lock.Lock()
+			if o.clients[index] == client {
+				delete(o.clients, index)
+			}
+			o.lock.Unlock()
+			client.Close()
+		}
+
+		timer := time.NewTimer(opcuaRetry)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Update subscribes to the OPC UA servers in configs, and disconnects
+// from any that were removed. It should be called when the device config
+// changes.
+func (o *OpcuaScheduler) Update(configs []data.OpcuaConfig) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if reflect.DeepEqual(configs, o.configs) {
+		return
+	}
+
+	for _, stop := range o.stops {
+		close(stop)
+	}
+
+	o.configs = append([]data.OpcuaConfig{}, configs...)
+	o.stops = nil
+	// indexes of new clients may not match the old configs
+	o.clients = make(map[int]*opcua.Client)
+
+	for i, c := range configs {
+		stop := make(chan struct{})
+		o.stops = append(o.stops, stop)
+		go o.run(i, c, stop)
+	}
+}
+
+// Stop disconnects from all OPC UA servers
+func (o *OpcuaScheduler) Stop() {
+	o.Update(nil)
+}
+
+// Poll reads the nodes for a sample type now and sends their values, so a
+// fresh reading does not have to wait for a value change. If id is set,
+// the node ID must match too.
+func (o *OpcuaScheduler) Poll(sampleType, id string) error {
+	type read struct {
+		config data.OpcuaConfig
+		node   data.OpcuaNode
+		client *opcua.Client
+	}
+
+	o.lock.Lock()
+	var reads []read
+	for i, c := range o.configs {
+		for _, n := range c.Nodes {
+			if n.Type == sampleType && (id == "" || n.ID == id) {
+				reads = append(reads, read{c, n, o.clients[i]})
+			}
+		}
+	}
+	o.lock.Unlock()
+
+	if len(reads) == 0 {
+		return fmt.Errorf("no opcua node for %v %v", sampleType, id)
+	}
+
+	var samples []data.Sample
+	for _, r := range reads {
+		if r.client == nil {
+			return fmt.Errorf("opcua server %v is not connected", r.config.Endpoint)
+		}
+
+		nodeID, err := opcua.ParseNodeID(r.node.NodeID)
+		if err != nil {
+			return err
+		}
+
+		values, err := r.client.Read(nodeID)
+		if err != nil {
+			return err
+		}
+
+		s, err := opcuaSample(r.config, r.node, values[0])
+		if err != nil {
+			return err
+		}
+
+		samples = append(samples, s)
+	}
+
+	return o.send(samples)
+}
+
+// Command runs an OpcuaWriteCommand received from the server. The node
+// is read first to find its data type.
+func (o *OpcuaScheduler) Command(cmd data.DeviceCommand) error {
+	if cmd.Command != OpcuaWriteCommand {
+		return fmt.Errorf("unexpected command: %v", cmd.Command)
+	}
+
+	id := cmd.Args["id"]
+	if id == "" {
+		return errors.New("id arg is required")
+	}
+
+	value, err := strconv.ParseFloat(cmd.Args["value"], 64)
+	if err != nil {
+		return errors.New("value arg must be a number")
+	}
+
+	o.lock.Lock()
+	var client *opcua.Client
+	var node data.OpcuaNode
+	found := false
+	for i, c := range o.configs {
+		for _, n := range c.Nodes {
+			if n.ID == id && n.Writable {
+				client = o.clients[i]
+				node = n
+				found = true
+			}
+		}
+	}
+	o.lock.Unlock()
+
+	if !found {
+		return fmt.Errorf("no writable opcua node with id %v", id)
+	}
+
+	if client == nil {
+		return fmt.Errorf("opcua server for %v is not connected", id)
+	}
+
+	nodeID, err := opcua.ParseNodeID(node.NodeID)
+	if err != nil {
+		return err
+	}
+
+	values, err := client.Read(nodeID)
+	if err != nil {
+		return err
+	}
+
+	if values[0].Status.Bad() {
+		return values[0].Status
+	}
+
+	v, err := opcua.FromFloat(value, values[0].Value)
+	if err != nil {
+		return err
+	}
+
+	return client.Write(nodeID, v)
+}
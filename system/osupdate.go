@@ -0,0 +1,508 @@
+package system
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// OSUpdateCommand is the device command used to update the OS. The url arg
+// is the location of the update bundle, and the optional sha256 arg is
+// checked after the download. Bundle signatures are checked by the update
+// tool.
+const OSUpdateCommand = "osUpdate"
+
+// OSUpdateBackend is the tool used to install updates
+type OSUpdateBackend string
+
+// define supported update tools
+const (
+	BackendRauc     OSUpdateBackend = "rauc"
+	BackendSwupdate OSUpdateBackend = "swupdate"
+	BackendMender   OSUpdateBackend = "mender"
+)
+
+// OSUpdateState is the state of an OS update
+type OSUpdateState string
+
+// define OS update states
+const (
+	OSUpdateIdle        OSUpdateState = ""
+	OSUpdateDownloading OSUpdateState = "downloading"
+	OSUpdateInstalling  OSUpdateState = "installing"
+	// OSUpdateRebooting means the update is installed and the system is
+	// rebooting into it
+	OSUpdateRebooting OSUpdateState = "rebooting"
+	OSUpdateDone      OSUpdateState = "done"
+	// OSUpdateRolledBack means the new OS failed its health check or did
+	// not boot, and the old OS is running
+	OSUpdateRolledBack OSUpdateState = "rolledBack"
+	OSUpdateFailed     OSUpdateState = "failed"
+)
+
+// OSUpdateStatus is the progress of an OS update
+type OSUpdateStatus struct {
+	State OSUpdateState `json:"state"`
+	// Progress is 0-100 while downloading or installing
+	Progress int    `json:"progress"`
+	Error    string `json:"error,omitempty"`
+	// FromVersion is the OS version before the update, and ToVersion after
+	FromVersion string `json:"fromVersion,omitempty"`
+	ToVersion   string `json:"toVersion,omitempty"`
+}
+
+// osUpdateStates is used to report the state as a sample value
+var osUpdateStates = []OSUpdateState{OSUpdateIdle, OSUpdateDownloading,
+	OSUpdateInstalling, OSUpdateRebooting, OSUpdateDone, OSUpdateRolledBack,
+	OSUpdateFailed}
+
+// Samples returns the update status as samples. The osUpdateState value
+// is the index of the state in: idle, downloading, installing, rebooting,
+// done, rolledBack, failed.
+func (s OSUpdateStatus) Samples(id string) []data.Sample {
+	now := time.Now()
+	state := 0
+	for i, st := range osUpdateStates {
+		if st == s.State {
+			state = i
+		}
+	}
+
+	return []data.Sample{
+		{Type: "osUpdateState", ID: id, Value: float64(state), Time: now},
+		{Type: "osUpdateProgress", ID: id, Value: float64(s.Progress), Time: now},
+	}
+}
+
+// OSUpdateConfig describes how the OS is updated
+type OSUpdateConfig struct {
+	Backend OSUpdateBackend
+	// DownloadDir is where bundles are downloaded (default /tmp)
+	DownloadDir string
+	// StateFile keeps the update state across the reboot (default
+	// /var/lib/siot/osupdate.json)
+	StateFile string
+	// HealthCheck is run after booting into a new OS. If it fails, the
+	// update is rolled back.
+	HealthCheck func() error
+	// Reboot is used to boot into the new OS, typically Power.Reboot
+	Reboot func(reason string) error
+	// Notify is called when the status changes. Errors are logged.
+	Notify func(OSUpdateStatus) error
+	// Maintenance, if set, defers updates from commands to a maintenance
+	// window
+	Maintenance *Maintenance
+}
+
+// OSUpdate downloads OS update bundles and installs them to the inactive
+// slot of an A/B system with RAUC, swupdate, or Mender. After rebooting,
+// CheckBoot confirms the new OS or rolls it back.
+type OSUpdate struct {
+	config OSUpdateConfig
+	lock   sync.Mutex
+	status OSUpdateStatus
+}
+
+// NewOSUpdate creates an OS update controller. The state saved before the
+// last reboot is loaded.
+func NewOSUpdate(config OSUpdateConfig) (*OSUpdate, error) {
+	switch config.Backend {
+	case BackendRauc, BackendSwupdate, BackendMender:
+	default:
+		return nil, fmt.Errorf("unsupported OS update backend: %v", config.Backend)
+	}
+
+	if config.DownloadDir == "" {
+		config.DownloadDir = os.TempDir()
+	}
+
+	if config.StateFile == "" {
+		config.StateFile = "/var/lib/siot/osupdate.json"
+	}
+
+	u := &OSUpdate{config: config}
+
+	j, err := ioutil.ReadFile(config.StateFile)
+	if err == nil {
+		err = json.Unmarshal(j, &u.status)
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// Status returns the progress of the last update
+func (u *OSUpdate) Status() OSUpdateStatus {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.status
+}
+
+func (u *OSUpdate) set(update func(s *OSUpdateStatus)) {
+	u.lock.Lock()
+	prev := u.status
+	update(&u.status)
+	status := u.status
+	u.lock.Unlock()
+
+	if status == prev {
+		return
+	}
+
+	if status.State != prev.State {
+		// only save state changes, not progress
+		err := u.save(status)
+		if err != nil {
+			log.Println("Error saving OS update state: ", err)
+		}
+	}
+
+	if u.config.Notify != nil {
+		err := u.config.Notify(status)
+		if err != nil {
+			log.Println("Error sending OS update status: ", err)
+		}
+	}
+}
+
+func (u *OSUpdate) save(status OSUpdateStatus) error {
+	j, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(path.Dir(u.config.StateFile), 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(u.config.StateFile, j, 0644)
+}
+
+func (u *OSUpdate) fail(err error) error {
+	u.set(func(s *OSUpdateStatus) {
+		s.State = OSUpdateFailed
+		s.Error = err.Error()
+	})
+	return err
+}
+
+var reOSVersion = regexp.MustCompile(`^(VERSION_ID|VERSION)="?([^"]*)"?`)
+
+// OSVersion returns the version from /etc/os-release
+func OSVersion() (string, error) {
+	f, err := os.Open("/etc/os-release")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var version string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		matches := reOSVersion.FindStringSubmatch(scanner.Text())
+		if len(matches) < 3 {
+			continue
+		}
+
+		// prefer VERSION_ID
+		if matches[1] == "VERSION_ID" || version == "" {
+			version = matches[2]
+		}
+	}
+
+	return version, scanner.Err()
+}
+
+// progressWriter reports download progress
+type progressWriter struct {
+	total   int64
+	count   int64
+	percent func(int)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.count += int64(len(b))
+	if p.total > 0 {
+		p.percent(int(p.count * 100 / p.total))
+	}
+	return len(b), nil
+}
+
+func (u *OSUpdate) download(url, sum string) (string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Error downloading OS update: %v", resp.Status)
+	}
+
+	f, err := ioutil.TempFile(u.config.DownloadDir, "siot-osupdate-")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	progress := &progressWriter{total: resp.ContentLength, percent: func(p int) {
+		u.set(func(s *OSUpdateStatus) { s.Progress = p })
+	}}
+
+	_, err = io.Copy(io.MultiWriter(f, hash, progress), resp.Body)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	if sum != "" && !strings.EqualFold(hex.EncodeToString(hash.Sum(nil)), sum) {
+		os.Remove(f.Name())
+		return "", errors.New("OS update checksum does not match")
+	}
+
+	return f.Name(), nil
+}
+
+var rePercent = regexp.MustCompile(`(\d+)%`)
+
+// install runs the update tool and reports progress from its output
+func (u *OSUpdate) install(file string) error {
+	var cmd *exec.Cmd
+	switch u.config.Backend {
+	case BackendRauc:
+		cmd = exec.Command("rauc", "install", file)
+	case BackendSwupdate:
+		cmd = exec.Command("swupdate", "-v", "-i", file)
+	case BackendMender:
+		cmd = exec.Command("mender", "install", file)
+	}
+
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	var last string
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			last = line
+		}
+
+		matches := rePercent.FindStringSubmatch(line)
+		if len(matches) < 2 {
+			continue
+		}
+
+		p, _ := strconv.Atoi(matches[1])
+		u.set(func(s *OSUpdateStatus) { s.Progress = p })
+	}
+
+	err = cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("%v install failed: %v: %v", u.config.Backend, err, last)
+	}
+
+	return nil
+}
+
+// Update downloads and installs an update bundle, then reboots into the
+// new OS
+func (u *OSUpdate) Update(url, sum string) error {
+	u.lock.Lock()
+	switch u.status.State {
+	case OSUpdateDownloading, OSUpdateInstalling, OSUpdateRebooting:
+		u.lock.Unlock()
+		return errors.New("OS update already in progress")
+	}
+	u.lock.Unlock()
+
+	version, err := OSVersion()
+	if err != nil {
+		log.Println("Error reading OS version: ", err)
+	}
+
+	u.set(func(s *OSUpdateStatus) {
+		*s = OSUpdateStatus{State: OSUpdateDownloading, FromVersion: version}
+	})
+
+	file, err := u.download(url, sum)
+	if err != nil {
+		return u.fail(err)
+	}
+	defer os.Remove(file)
+
+	u.set(func(s *OSUpdateStatus) {
+		s.State = OSUpdateInstalling
+		s.Progress = 0
+	})
+
+	err = u.install(file)
+	if err != nil {
+		return u.fail(err)
+	}
+
+	u.set(func(s *OSUpdateStatus) {
+		s.State = OSUpdateRebooting
+		s.Progress = 100
+	})
+
+	if u.config.Reboot == nil {
+		return nil
+	}
+
+	err = u.config.Reboot("OS update")
+	if err != nil {
+		return u.fail(err)
+	}
+
+	return nil
+}
+
+// markGood confirms the running OS so the bootloader does not roll back
+func (u *OSUpdate) markGood() error {
+	switch u.config.Backend {
+	case BackendRauc:
+		return exec.Command("rauc", "status", "mark-good").Run()
+	case BackendSwupdate:
+		return exec.Command("fw_setenv", "ustate", "0").Run()
+	case BackendMender:
+		return exec.Command("mender", "commit").Run()
+	}
+	return nil
+}
+
+// rollback switches back to the previous OS on the next boot
+func (u *OSUpdate) rollback() error {
+	switch u.config.Backend {
+	case BackendRauc:
+		return exec.Command("rauc", "status", "mark-bad").Run()
+	case BackendSwupdate:
+		// the bootloader falls back when the boot count limit is reached
+		// without ustate being cleared
+		return exec.Command("fw_setenv", "ustate", "3").Run()
+	case BackendMender:
+		return exec.Command("mender", "rollback").Run()
+	}
+	return nil
+}
+
+// CheckBoot should be called at startup. If an update was installed before
+// the last reboot, the health check is run, and the new OS is confirmed or
+// rolled back. If the OS version did not change, the bootloader already
+// rolled back the update.
+func (u *OSUpdate) CheckBoot() error {
+	status := u.Status()
+	if status.State != OSUpdateRebooting {
+		return nil
+	}
+
+	version, err := OSVersion()
+	if err != nil {
+		log.Println("Error reading OS version: ", err)
+	}
+
+	if version != "" && version == status.FromVersion {
+		u.set(func(s *OSUpdateStatus) {
+			s.State = OSUpdateRolledBack
+			s.Error = "new OS did not boot"
+		})
+		return errors.New("OS update was rolled back by the bootloader")
+	}
+
+	if u.config.HealthCheck != nil {
+		err = u.config.HealthCheck()
+	}
+
+	if err == nil {
+		err = u.markGood()
+		if err == nil {
+			u.set(func(s *OSUpdateStatus) {
+				s.State = OSUpdateDone
+				s.ToVersion = version
+			})
+			return nil
+		}
+	}
+
+	checkErr := err
+	u.set(func(s *OSUpdateStatus) {
+		s.State = OSUpdateRolledBack
+		s.Error = checkErr.Error()
+	})
+
+	err = u.rollback()
+	if err != nil {
+		return fmt.Errorf("Error rolling back OS update: %v", err)
+	}
+
+	if u.config.Reboot != nil {
+		err = u.config.Reboot("OS update health check failed")
+		if err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("OS update health check failed: %v", checkErr)
+}
+
+// Command runs an OSUpdateCommand received from the server. The update
+// runs in the background, and progress is reported with Notify.
+func (u *OSUpdate) Command(cmd data.DeviceCommand) error {
+	if cmd.Command != OSUpdateCommand {
+		return fmt.Errorf("unexpected command: %v", cmd.Command)
+	}
+
+	url := cmd.Args["url"]
+	if url == "" {
+		return errors.New("url arg is required")
+	}
+
+	update := func() error {
+		return u.Update(url, cmd.Args["sha256"])
+	}
+
+	go func() {
+		var err error
+		if u.config.Maintenance != nil {
+			err = u.config.Maintenance.Run("OS update", update)
+		} else {
+			err = update()
+		}
+
+		if err != nil {
+			log.Println("OS update failed: ", err)
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,295 @@
+package system
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// device commands handled by Power.Command. The delay arg is a Go
+// duration, and the reason arg is recorded. If the now arg is true, the
+// maintenance window is ignored.
+const (
+	RebootCommand      = "reboot"
+	ShutdownCommand    = "shutdown"
+	CancelPowerCommand = "cancelPower"
+)
+
+const defaultPowerDelay = time.Minute
+
+// PowerAction is a reboot or shutdown
+type PowerAction string
+
+// define power actions
+const (
+	PowerReboot   PowerAction = "reboot"
+	PowerShutdown PowerAction = "shutdown"
+)
+
+// ErrNoPowerAction is returned by Cancel when nothing is scheduled
+var ErrNoPowerAction = errors.New("no reboot or shutdown scheduled")
+
+// PowerEvent is a scheduled or completed reboot or shutdown
+type PowerEvent struct {
+	Action PowerAction `json:"action"`
+	Reason string      `json:"reason"`
+	Time   time.Time   `json:"time"`
+}
+
+// PowerConfig describes how the system is rebooted or shut down
+type PowerConfig struct {
+	// Flush is called before rebooting to save state, like closing the
+	// database
+	Flush func() error
+	// Notify is called when an action is scheduled, canceled (Action is
+	// blank), and right before it happens, so the server knows the device
+	// is going offline on purpose. Errors are logged.
+	Notify func(PowerEvent) error
+	// ReasonFile records the last action so the reason can be reported
+	// after boot (default /var/lib/siot/power.json)
+	ReasonFile string
+	// Maintenance, if set, defers reboots and shutdowns from commands to a
+	// maintenance window
+	Maintenance *Maintenance
+}
+
+// Power reboots or shuts down the system after a delay, giving users a
+// window to cancel the action
+type Power struct {
+	config  PowerConfig
+	lock    sync.Mutex
+	pending *PowerEvent
+	timer   *time.Timer
+	// command and now are replaced in tests
+	command func(name string) error
+	now     func() time.Time
+}
+
+// NewPower creates a new power controller
+func NewPower(config PowerConfig) *Power {
+	if config.ReasonFile == "" {
+		config.ReasonFile = "/var/lib/siot/power.json"
+	}
+
+	return &Power{
+		config: config,
+		command: func(name string) error {
+			return exec.Command(name).Run()
+		},
+		now: time.Now,
+	}
+}
+
+func (p *Power) notify(ev PowerEvent) {
+	if p.config.Notify == nil {
+		return
+	}
+
+	err := p.config.Notify(ev)
+	if err != nil {
+		log.Println("Error sending power notification: ", err)
+	}
+}
+
+func (p *Power) schedule(action PowerAction, reason string, delay time.Duration) error {
+	p.lock.Lock()
+
+	if p.pending != nil {
+		p.lock.Unlock()
+		return fmt.Errorf("%v already scheduled at %v", p.pending.Action,
+			p.pending.Time)
+	}
+
+	ev := PowerEvent{Action: action, Reason: reason, Time: p.now().Add(delay)}
+	p.pending = &ev
+	p.timer = time.AfterFunc(delay, func() {
+		err := p.run(ev)
+		if err != nil {
+			log.Printf("Error running %v: %v", ev.Action, err)
+		}
+	})
+
+	p.lock.Unlock()
+
+	log.Printf("%v scheduled at %v: %v", action, ev.Time, reason)
+	p.notify(ev)
+
+	return nil
+}
+
+func (p *Power) run(ev PowerEvent) error {
+	p.lock.Lock()
+	if p.pending == nil || *p.pending != ev {
+		// canceled
+		p.lock.Unlock()
+		return nil
+	}
+	p.lock.Unlock()
+
+	ev.Time = p.now()
+	p.notify(ev)
+
+	err := p.writeReason(ev)
+	if err != nil {
+		log.Println("Error recording power reason: ", err)
+	}
+
+	if p.config.Flush != nil {
+		err := p.config.Flush()
+		if err != nil {
+			log.Println("Error flushing before power action: ", err)
+		}
+	}
+
+	cmd := "reboot"
+	if ev.Action == PowerShutdown {
+		cmd = "poweroff"
+	}
+
+	err = p.command(cmd)
+
+	p.lock.Lock()
+	p.pending = nil
+	p.lock.Unlock()
+
+	return err
+}
+
+func (p *Power) writeReason(ev PowerEvent) error {
+	j, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(path.Dir(p.config.ReasonFile), 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(p.config.ReasonFile, j, 0644)
+}
+
+// Reboot reboots the system after delay. reason is recorded and sent to
+// the server.
+func (p *Power) Reboot(reason string, delay time.Duration) error {
+	return p.schedule(PowerReboot, reason, delay)
+}
+
+// Shutdown powers off the system after delay. reason is recorded and sent
+// to the server.
+func (p *Power) Shutdown(reason string, delay time.Duration) error {
+	return p.schedule(PowerShutdown, reason, delay)
+}
+
+// Cancel cancels a scheduled reboot or shutdown
+func (p *Power) Cancel() error {
+	p.lock.Lock()
+
+	if p.pending == nil || !p.timer.Stop() {
+		p.lock.Unlock()
+		return ErrNoPowerAction
+	}
+
+	ev := *p.pending
+	p.pending = nil
+	p.lock.Unlock()
+
+	log.Printf("%v canceled", ev.Action)
+	p.notify(PowerEvent{Reason: ev.Reason, Time: p.now()})
+
+	return nil
+}
+
+// Pending returns the scheduled action, or nil if there is none
+func (p *Power) Pending() *PowerEvent {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.pending == nil {
+		return nil
+	}
+
+	ev := *p.pending
+	return &ev
+}
+
+// LastEvent returns the action recorded before the last reboot or
+// shutdown. A nil event is returned if the system was not rebooted with
+// Power, like after a power failure.
+func (p *Power) LastEvent() (*PowerEvent, error) {
+	j, err := ioutil.ReadFile(p.config.ReasonFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var ev PowerEvent
+	err = json.Unmarshal(j, &ev)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ev, nil
+}
+
+// ClearLastEvent removes the recorded action, and should be called after
+// it is reported so an unexpected reboot is not reported with the old
+// reason
+func (p *Power) ClearLastEvent() error {
+	err := os.Remove(p.config.ReasonFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Command runs a RebootCommand, ShutdownCommand, or CancelPowerCommand
+// received from the server
+func (p *Power) Command(cmd data.DeviceCommand) error {
+	if cmd.Command == CancelPowerCommand {
+		return p.Cancel()
+	}
+
+	delay := defaultPowerDelay
+	if v := cmd.Args["delay"]; v != "" {
+		var err error
+		delay, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("Error parsing delay: %v", err)
+		}
+	}
+
+	reason := cmd.Args["reason"]
+	if reason == "" {
+		reason = "remote " + cmd.Command
+	}
+
+	var run func() error
+
+	switch cmd.Command {
+	case RebootCommand:
+		run = func() error { return p.Reboot(reason, delay) }
+	case ShutdownCommand:
+		run = func() error { return p.Shutdown(reason, delay) }
+	default:
+		return fmt.Errorf("unexpected command: %v", cmd.Command)
+	}
+
+	if p.config.Maintenance != nil && cmd.Args["now"] != "true" {
+		return p.config.Maintenance.Run(cmd.Command, run)
+	}
+
+	return run()
+}
@@ -0,0 +1,233 @@
+package system
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// testPower is a Power that records the commands it runs and the
+// notifications it sends instead of rebooting
+type testPower struct {
+	*Power
+	lock     sync.Mutex
+	events   []PowerEvent
+	flushed  int
+	commands chan string
+}
+
+func newTestPower(dir string) *testPower {
+	tp := &testPower{commands: make(chan string, 10)}
+
+	tp.Power = NewPower(PowerConfig{
+		ReasonFile: path.Join(dir, "power.json"),
+		Notify: func(ev PowerEvent) error {
+			tp.lock.Lock()
+			defer tp.lock.Unlock()
+			tp.events = append(tp.events, ev)
+			return nil
+		},
+		Flush: func() error {
+			tp.lock.Lock()
+			defer tp.lock.Unlock()
+			tp.flushed++
+			return nil
+		},
+	})
+
+	tp.command = func(name string) error {
+		tp.commands <- name
+		return nil
+	}
+
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	tp.now = func() time.Time { return now }
+
+	return tp
+}
+
+func (tp *testPower) Events() []PowerEvent {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	return append([]PowerEvent{}, tp.events...)
+}
+
+func TestPowerCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-power")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := newTestPower(dir)
+
+	err = p.Cancel()
+	if err != ErrNoPowerAction {
+		t.Error("expected no power action, got: ", err)
+	}
+
+	err = p.Reboot("update", time.Hour)
+	if err != nil {
+		t.Fatal("Error scheduling reboot: ", err)
+	}
+
+	exp := PowerEvent{Action: PowerReboot, Reason: "update",
+		Time: p.now().Add(time.Hour)}
+
+	if pending := p.Pending(); pending == nil || *pending != exp {
+		t.Errorf("pending is %v, expected %v", pending, exp)
+	}
+
+	// only one action can be scheduled at a time
+	if p.Shutdown("maintenance", time.Minute) == nil {
+		t.Error("expected error scheduling a second action")
+	}
+
+	err = p.Cancel()
+	if err != nil {
+		t.Fatal("Error canceling reboot: ", err)
+	}
+
+	if pending := p.Pending(); pending != nil {
+		t.Error("action still pending after cancel: ", pending)
+	}
+
+	events := p.Events()
+	if len(events) != 2 || events[0] != exp ||
+		events[1] != (PowerEvent{Reason: "update", Time: p.now()}) {
+		t.Error("wrong notifications: ", events)
+	}
+
+	select {
+	case cmd := <-p.commands:
+		t.Error("canceled action ran: ", cmd)
+	default:
+	}
+}
+
+func TestPowerRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-power")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		action PowerAction
+		cmd    string
+	}{
+		{PowerReboot, "reboot"},
+		{PowerShutdown, "poweroff"},
+	}
+
+	for _, test := range tests {
+		p := newTestPower(dir)
+
+		err := p.schedule(test.action, "test", 10*time.Millisecond)
+		if err != nil {
+			t.Fatal("Error scheduling action: ", err)
+		}
+
+		select {
+		case cmd := <-p.commands:
+			if cmd != test.cmd {
+				t.Errorf("%v ran %v, expected %v", test.action, cmd, test.cmd)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for ", test.action)
+		}
+
+		// wait for run to finish after the command
+		start := time.Now()
+		for p.Pending() != nil {
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("action still pending after it ran")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		// the cancel window is over
+		err = p.Cancel()
+		if err != ErrNoPowerAction {
+			t.Errorf("%v: expected no power action after it ran, got %v",
+				test.action, err)
+		}
+
+		exp := PowerEvent{Action: test.action, Reason: "test", Time: p.now()}
+
+		events := p.Events()
+		if len(events) != 2 || events[1] != exp {
+			t.Errorf("%v: wrong notifications: %v", test.action, events)
+		}
+
+		if p.flushed != 1 {
+			t.Errorf("%v: flushed %v times", test.action, p.flushed)
+		}
+
+		last, err := p.LastEvent()
+		if err != nil || last == nil || !last.Time.Equal(exp.Time) ||
+			last.Action != exp.Action || last.Reason != exp.Reason {
+			t.Errorf("%v: last event is %v, %v, expected %v", test.action,
+				last, err, exp)
+		}
+
+		err = p.ClearLastEvent()
+		if err != nil {
+			t.Error("Error clearing last event: ", err)
+		}
+
+		last, err = p.LastEvent()
+		if last != nil || err != nil {
+			t.Error("last event not cleared: ", last, err)
+		}
+	}
+}
+
+func TestPowerCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-power")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := newTestPower(dir)
+
+	tests := []struct {
+		cmd data.DeviceCommand
+		exp *PowerEvent
+		err bool
+	}{
+		{data.DeviceCommand{Command: RebootCommand},
+			&PowerEvent{Action: PowerReboot, Reason: "remote reboot",
+				Time: p.now().Add(defaultPowerDelay)}, false},
+		{data.DeviceCommand{Command: CancelPowerCommand}, nil, false},
+		{data.DeviceCommand{Command: ShutdownCommand,
+			Args: map[string]string{"delay": "5m", "reason": "storm"}},
+			&PowerEvent{Action: PowerShutdown, Reason: "storm",
+				Time: p.now().Add(5 * time.Minute)}, false},
+		{data.DeviceCommand{Command: CancelPowerCommand}, nil, false},
+		{data.DeviceCommand{Command: CancelPowerCommand}, nil, true},
+		{data.DeviceCommand{Command: RebootCommand,
+			Args: map[string]string{"delay": "soon"}}, nil, true},
+		{data.DeviceCommand{Command: "dance"}, nil, true},
+	}
+
+	for _, test := range tests {
+		err := p.Command(test.cmd)
+		if (err != nil) != test.err {
+			t.Errorf("%+v: error is %v", test.cmd, err)
+		}
+
+		pending := p.Pending()
+		if (pending == nil) != (test.exp == nil) ||
+			(pending != nil && *pending != *test.exp) {
+			t.Errorf("%+v: pending is %v, expected %v", test.cmd, pending,
+				test.exp)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package system
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// minRateElapsed is how long the RTC must run after it was set before the
+// drift rate is measured, as the RTC only has 1s resolution
+const minRateElapsed = 6 * time.Hour
+
+// RTCDriftConfig describes how the RTC drift is tracked
+type RTCDriftConfig struct {
+	// StateFile keeps the drift across reboots (default
+	// /var/lib/siot/rtc-drift.json)
+	StateFile string
+	// Interval is how often the RTC is compared to the system time
+	// (default 1h)
+	Interval time.Duration
+	// MaxDrift is how far the RTC can be off before it is set from the
+	// system time (default 2s)
+	MaxDrift time.Duration
+	// Synced returns true if the system time has been synced, typically
+	// from TimeSync.Status. The RTC is only measured and set when synced.
+	// If nil, the system time is assumed to be synced.
+	Synced func() bool
+	// ID is used as the sample ID
+	ID string
+	// Send is called with the drift samples after each measurement
+	Send func([]data.Sample) error
+}
+
+// RTCDriftState is the drift information kept across reboots
+type RTCDriftState struct {
+	// LastSet is when the RTC was last set from synced time
+	LastSet time.Time `json:"lastSet"`
+	// Rate is how fast the RTC gains (positive) or loses time, in ppm
+	Rate float64 `json:"rate"`
+	// Drift is how far the RTC was off at the last measurement
+	Drift time.Duration `json:"drift"`
+}
+
+// Samples returns the drift as samples
+func (s RTCDriftState) Samples(id string) []data.Sample {
+	now := time.Now()
+	return []data.Sample{
+		{Type: "rtcDrift", ID: id, Value: s.Drift.Seconds(), Time: now},
+		{Type: "rtcDriftRate", ID: id, Value: s.Rate, Time: now},
+	}
+}
+
+// RTCDrift measures how fast the RTC drifts while the system time is
+// synced, and keeps the RTC close to the synced time. The measured rate is
+// used to correct the time read from the RTC at boot when NTP is not
+// reachable.
+type RTCDrift struct {
+	config RTCDriftConfig
+	lock   sync.Mutex
+	state  RTCDriftState
+	stop   chan struct{}
+}
+
+// NewRTCDrift creates an RTC drift tracker, loading the state from the last
+// boot
+func NewRTCDrift(config RTCDriftConfig) (*RTCDrift, error) {
+	if config.StateFile == "" {
+		config.StateFile = "/var/lib/siot/rtc-drift.json"
+	}
+
+	if config.Interval == 0 {
+		config.Interval = time.Hour
+	}
+
+	if config.MaxDrift == 0 {
+		config.MaxDrift = 2 * time.Second
+	}
+
+	r := &RTCDrift{config: config, stop: make(chan struct{})}
+
+	j, err := ioutil.ReadFile(config.StateFile)
+	if err == nil {
+		err = json.Unmarshal(j, &r.state)
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *RTCDrift) save() error {
+	j, err := json.Marshal(r.state)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(path.Dir(r.config.StateFile), 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(r.config.StateFile, j, 0644)
+}
+
+// State returns the drift from the last measurement
+func (r *RTCDrift) State() RTCDriftState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.state
+}
+
+// Measure compares the RTC to the system time, which must be synced, and
+// updates the drift rate. The RTC is set if it is off by more than
+// MaxDrift.
+func (r *RTCDrift) Measure() (RTCDriftState, error) {
+	rtc, err := ReadRTC()
+	if err != nil {
+		return RTCDriftState{}, err
+	}
+
+	now := timeNow()
+	drift := rtc.Sub(now)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.state.Drift = drift
+
+	if !r.state.LastSet.IsZero() {
+		elapsed := now.Sub(r.state.LastSet)
+		if elapsed >= minRateElapsed {
+			r.state.Rate = float64(drift) / float64(elapsed) * 1e6
+		}
+	}
+
+	if r.state.LastSet.IsZero() || drift > r.config.MaxDrift ||
+		drift < -r.config.MaxDrift {
+		err := SetRTC(now)
+		if err != nil {
+			return r.state, err
+		}
+		r.state.LastSet = now
+	}
+
+	return r.state, r.save()
+}
+
+// Time returns the RTC time corrected with the measured drift rate. It can
+// be used as a TimeSource.
+func (r *RTCDrift) Time() (time.Time, error) {
+	rtc, err := ReadRTC()
+	if err != nil {
+		return rtc, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.state.LastSet.IsZero() {
+		return rtc, nil
+	}
+
+	elapsed := rtc.Sub(r.state.LastSet)
+	return rtc.Add(-time.Duration(float64(elapsed) * r.state.Rate / 1e6)), nil
+}
+
+// CorrectSystemTime sets the system time from the corrected RTC time, and
+// should be called at boot before the time is synced. The RTC is not
+// changed so the drift can still be measured from when it was last set.
+func (r *RTCDrift) CorrectSystemTime() (time.Time, error) {
+	t, err := r.Time()
+	if err != nil {
+		return t, err
+	}
+
+	return t, setSystemTime(t)
+}
+
+// Start measures the drift until Stop is called
+func (r *RTCDrift) Start() {
+	go func() {
+		ticker := time.NewTicker(r.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-r.stop:
+				return
+			}
+
+			if r.config.Synced != nil && !r.config.Synced() {
+				continue
+			}
+
+			state, err := r.Measure()
+			if errors.Is(err, ErrNoRTC) {
+				log.Println("RTC drift: no RTC, stopping")
+				return
+			}
+
+			if err != nil {
+				log.Println("Error measuring RTC drift: ", err)
+				continue
+			}
+
+			if r.config.Send != nil {
+				err := r.config.Send(state.Samples(r.config.ID))
+				if err != nil {
+					log.Println("Error sending RTC drift: ", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops measuring the drift
+func (r *RTCDrift) Stop() {
+	close(r.stop)
+}
@@ -0,0 +1,131 @@
+package system
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRTCDrift(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-rtc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldSetClock, oldSetRTC, oldReadRTC, oldTimeNow := setClock, setRTC, readRTC, timeNow
+	defer func() {
+		setClock, setRTC, readRTC, timeNow = oldSetClock, oldSetRTC, oldReadRTC, oldTimeNow
+	}()
+
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	// the system time, and how far the RTC is ahead of it
+	var now time.Time
+	var rtcAhead time.Duration
+	var rtcSet time.Time
+
+	timeNow = func() time.Time { return now }
+	readRTC = func() (time.Time, error) { return now.Add(rtcAhead), nil }
+	setRTC = func(t time.Time) error {
+		rtcSet = t
+		rtcAhead = 0
+		return nil
+	}
+
+	stateFile := path.Join(dir, "rtc-drift.json")
+	r, err := NewRTCDrift(RTCDriftConfig{StateFile: stateFile})
+	if err != nil {
+		t.Fatal("Error creating RTC drift: ", err)
+	}
+
+	steps := []struct {
+		name     string
+		elapsed  time.Duration
+		ahead    time.Duration
+		set      bool
+		expRate  float64
+		expDrift time.Duration
+	}{
+		// the RTC is always set the first time to start measuring
+		{"first", 0, time.Second, true, 0, time.Second},
+		// too soon to measure the rate, and within MaxDrift
+		{"1h", time.Hour, time.Second, false, 0, time.Second},
+		{"12h", 12 * time.Hour, -1800 * time.Millisecond, false, -1.8 / 43200 * 1e6,
+			-1800 * time.Millisecond},
+		// over MaxDrift, so the RTC is set again
+		{"24h", 24 * time.Hour, 3 * time.Second, true, 3.0 / 86400 * 1e6,
+			3 * time.Second},
+	}
+
+	var lastSet time.Time
+
+	for _, s := range steps {
+		now = start.Add(s.elapsed)
+		rtcAhead = s.ahead
+		rtcSet = time.Time{}
+
+		state, err := r.Measure()
+		if err != nil {
+			t.Fatalf("%v: Error measuring: %v", s.name, err)
+		}
+
+		if s.set {
+			lastSet = now
+		}
+
+		if s.set != rtcSet.Equal(now) {
+			t.Errorf("%v: RTC set to %v, expected set: %v", s.name, rtcSet, s.set)
+		}
+
+		if state.Drift != s.expDrift || !state.LastSet.Equal(lastSet) ||
+			math.Abs(state.Rate-s.expRate) > 0.001 {
+			t.Errorf("%v: state is %+v, expected drift %v, rate %v, last set %v",
+				s.name, state, s.expDrift, s.expRate, lastSet)
+		}
+	}
+
+	// the state is kept across reboots
+	r, err = NewRTCDrift(RTCDriftConfig{StateFile: stateFile})
+	if err != nil {
+		t.Fatal("Error loading RTC drift: ", err)
+	}
+
+	state := r.State()
+	if !state.LastSet.Equal(lastSet) || state.Drift != 3*time.Second {
+		t.Errorf("state not loaded: %+v", state)
+	}
+
+	// after a day, the RTC has gained 3s, which is corrected
+	now = lastSet.Add(24 * time.Hour)
+	rtcAhead = 3 * time.Second
+
+	var clockSet time.Time
+	setClock = func(t time.Time) error {
+		clockSet = t
+		return nil
+	}
+
+	corrected, err := r.CorrectSystemTime()
+	if err != nil {
+		t.Fatal("Error correcting system time: ", err)
+	}
+
+	if d := corrected.Sub(now); d < -time.Millisecond || d > time.Millisecond {
+		t.Errorf("corrected time is off by %v", d)
+	}
+
+	if !clockSet.Equal(corrected) {
+		t.Errorf("system time set to %v, expected %v", clockSet, corrected)
+	}
+
+	readRTC = func() (time.Time, error) { return time.Time{}, errUnsupported }
+
+	_, err = r.Measure()
+	if err != ErrNoRTC {
+		t.Error("expected no RTC error, got: ", err)
+	}
+}
@@ -0,0 +1,188 @@
+package system
+
+import (
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// scheduleLate is how late a schedule can run, like when the device was
+// busy. Runs missed by more, like when the clock jumps, are skipped.
+const scheduleLate = 2 * time.Minute
+
+// scheduleConfig is the part of the device config schedules use
+type scheduleConfig struct {
+	schedules []data.Schedule
+	timezone  string
+	location  *data.Location
+}
+
+// Scheduler runs the schedules in a device config. Schedules are evaluated
+// locally, so they keep running when the device is offline.
+type Scheduler struct {
+	run    func(data.DeviceCommand) error
+	lock   sync.Mutex
+	config scheduleConfig
+	stop   chan struct{}
+}
+
+// NewScheduler creates a scheduler. run is called with the command of each
+// schedule when it is due, and typically dispatches it to the same handlers
+// as commands from the server, like GpioBank.Command.
+func NewScheduler(run func(data.DeviceCommand) error) *Scheduler {
+	return &Scheduler{run: run}
+}
+
+// scheduleTimes tracks when each schedule runs next
+type scheduleTimes struct {
+	config scheduleConfig
+	loc    *time.Location
+	next   []time.Time
+	last   time.Time
+}
+
+func newScheduleTimes(config scheduleConfig, loc *time.Location,
+	now time.Time) *scheduleTimes {
+	st := &scheduleTimes{
+		config: config,
+		loc:    loc,
+		next:   make([]time.Time, len(config.schedules)),
+		last:   now,
+	}
+
+	for i := range config.schedules {
+		st.update(i, now)
+	}
+
+	return st
+}
+
+func (st *scheduleTimes) update(i int, now time.Time) {
+	st.next[i] = st.config.schedules[i].Next(now, st.loc, st.config.location)
+}
+
+// wait returns how long until the next schedule is due. It is at most a
+// minute so clock changes are noticed.
+func (st *scheduleTimes) wait() time.Duration {
+	ret := time.Minute
+	for _, n := range st.next {
+		if !n.IsZero() && n.Sub(st.last) < ret {
+			ret = n.Sub(st.last)
+		}
+	}
+
+	return ret
+}
+
+// due returns the schedules that are due at now, and advances them to
+// their next time. If the clock went back, the times are recalculated and
+// nothing runs.
+func (st *scheduleTimes) due(now time.Time) []data.Schedule {
+	back := now.Before(st.last)
+	st.last = now
+
+	var ret []data.Schedule
+
+	for i, sched := range st.config.schedules {
+		if st.next[i].IsZero() || back {
+			st.update(i, now)
+			continue
+		}
+
+		if st.next[i].After(now) {
+			continue
+		}
+
+		if late := now.Sub(st.next[i]); late > scheduleLate {
+			log.Printf("Skipping schedule %v, missed by %v", sched.ID,
+				late.Round(time.Second))
+		} else {
+			ret = append(ret, sched)
+		}
+
+		st.update(i, now)
+	}
+
+	return ret
+}
+
+func (s *Scheduler) loop(config scheduleConfig, stop chan struct{}) {
+	loc := time.UTC
+	if config.timezone != "" {
+		l, err := time.LoadLocation(config.timezone)
+		if err != nil {
+			log.Printf("Error loading time zone %v, using UTC: %v",
+				config.timezone, err)
+		} else {
+			loc = l
+		}
+	}
+
+	st := newScheduleTimes(config, loc, time.Now().Round(0))
+
+	for {
+		timer := time.NewTimer(st.wait())
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+
+		// compare wall clock times, so clock jumps are seen
+		now := time.Now().Round(0)
+
+		for _, sched := range st.due(now) {
+			err := s.run(data.DeviceCommand{
+				Command: sched.Command,
+				Args:    sched.Args,
+				Created: now,
+			})
+			if err != nil {
+				log.Printf("Error running schedule %v: %v", sched.ID, err)
+			}
+		}
+	}
+}
+
+// Update runs the schedules in a device config, replacing the current
+// schedules if they changed. The timezone and location are also used.
+func (s *Scheduler) Update(config data.DeviceConfig) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c := scheduleConfig{
+		timezone: config.Timezone,
+		location: config.Location,
+	}
+
+	for _, sched := range config.Schedules {
+		if !sched.Disabled {
+			c.schedules = append(c.schedules, sched)
+		}
+	}
+
+	if reflect.DeepEqual(c, s.config) {
+		return
+	}
+
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+
+	s.config = c
+
+	if len(c.schedules) > 0 {
+		s.stop = make(chan struct{})
+		go s.loop(c, s.stop)
+	}
+}
+
+// Stop stops running all schedules
+func (s *Scheduler) Stop() {
+	s.Update(data.DeviceConfig{})
+}
@@ -0,0 +1,128 @@
+package system
+
+import (
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func TestScheduleTimes(t *testing.T) {
+	config := scheduleConfig{schedules: []data.Schedule{
+		{ID: "poll", Type: data.ScheduleCron, Cron: "*/15 * * * *", Command: "poll"},
+		{ID: "pump", Type: data.ScheduleCron, Cron: "0 6 * * *", Command: "gpio"},
+		// never runs without a location
+		{ID: "lights", Type: data.ScheduleSunset, Command: "gpio"},
+	}}
+
+	at := func(day, hour, min, sec int) time.Time {
+		return time.Date(2020, 3, day, hour, min, sec, 0, time.UTC)
+	}
+
+	st := newScheduleTimes(config, time.UTC, at(6, 12, 0, 30))
+	if w := st.wait(); w != time.Minute {
+		t.Errorf("expected to wait 1m, got %v", w)
+	}
+
+	steps := []struct {
+		now time.Time
+		run []string
+	}{
+		{at(6, 12, 14, 0), nil},
+		{at(6, 12, 15, 0), []string{"poll"}},
+		// a little late
+		{at(6, 12, 31, 30), []string{"poll"}},
+		// missed
+		{at(6, 12, 48, 0), nil},
+		// the clock went back, so times are recalculated
+		{at(6, 12, 0, 0), nil},
+		{at(6, 12, 15, 0), []string{"poll"}},
+		// the clock jumped ahead, so poll is skipped
+		{at(7, 6, 1, 0), []string{"pump"}},
+		{at(7, 6, 15, 0), []string{"poll"}},
+	}
+
+	for i, s := range steps {
+		due := st.due(s.now)
+
+		var run []string
+		for _, sched := range due {
+			run = append(run, sched.ID)
+		}
+
+		if len(run) != len(s.run) || len(run) > 0 && run[0] != s.run[0] {
+			t.Errorf("step %v: expected %v to run, got %v", i, s.run, run)
+		}
+	}
+
+	if w := st.wait(); w != time.Minute {
+		t.Errorf("expected to wait 1m, got %v", w)
+	}
+
+	st.due(at(7, 6, 59, 30))
+	if w := st.wait(); w != 30*time.Second {
+		t.Errorf("expected to wait 30s, got %v", w)
+	}
+}
+
+func TestScheduleTimesSun(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("tzdata not available: ", err)
+	}
+
+	config := scheduleConfig{
+		schedules: []data.Schedule{{ID: "lights", Type: data.ScheduleSunset,
+			Offset: "-30m", Command: "gpio"}},
+		location: &data.Location{Lat: 40.71, Long: -74.01},
+	}
+
+	st := newScheduleTimes(config, loc, time.Date(2021, 3, 20, 12, 0, 0, 0, loc))
+
+	// sunset is about 19:09
+	if due := st.due(time.Date(2021, 3, 20, 18, 30, 0, 0, loc)); len(due) != 0 {
+		t.Errorf("ran before sunset: %v", due)
+	}
+
+	if due := st.due(time.Date(2021, 3, 20, 18, 40, 0, 0, loc)); len(due) != 1 {
+		t.Errorf("did not run 30m before sunset")
+	}
+
+	// runs the next day
+	if next := st.next[0]; next.In(loc).Day() != 21 {
+		t.Errorf("expected next run on the 21st, got %v", next.In(loc))
+	}
+}
+
+func TestSchedulerUpdate(t *testing.T) {
+	s := NewScheduler(func(data.DeviceCommand) error { return nil })
+
+	config := data.DeviceConfig{Schedules: []data.Schedule{
+		{ID: "poll", Type: data.ScheduleCron, Cron: "*/15 * * * *", Command: "poll"},
+		{ID: "off", Type: data.ScheduleCron, Cron: "0 0 * * *", Command: "gpio",
+			Disabled: true},
+	}}
+
+	s.Update(config)
+	if len(s.config.schedules) != 1 || s.config.schedules[0].ID != "poll" {
+		t.Fatalf("disabled schedule not removed: %+v", s.config.schedules)
+	}
+
+	// not restarted if nothing changed
+	stop := s.stop
+	s.Update(config)
+	if s.stop != stop {
+		t.Error("scheduler restarted without a change")
+	}
+
+	config.Timezone = "America/Denver"
+	s.Update(config)
+	if s.stop == stop {
+		t.Error("scheduler not restarted after the time zone changed")
+	}
+
+	s.Stop()
+	if s.stop != nil {
+		t.Error("scheduler not stopped")
+	}
+}
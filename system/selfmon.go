@@ -0,0 +1,182 @@
+package system
+
+import (
+	"io/ioutil"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// ProcessMetrics is the resource usage of the SIOT process
+type ProcessMetrics struct {
+	Goroutines int
+	// HeapAlloc is the bytes of allocated heap objects
+	HeapAlloc uint64
+	// OpenFDs is -1 if it can't be read on this platform
+	OpenFDs int
+	// QueueDepth is the bytes in the ingest queue that have not been
+	// processed
+	QueueDepth int64
+}
+
+// Samples returns the metrics as samples
+func (m ProcessMetrics) Samples(id string) []data.Sample {
+	now := time.Now()
+
+	ret := []data.Sample{
+		{Type: "goroutines", ID: id, Value: float64(m.Goroutines), Time: now},
+		{Type: "heapAlloc", ID: id, Value: float64(m.HeapAlloc), Time: now},
+		{Type: "ingestQueue", ID: id, Value: float64(m.QueueDepth), Time: now},
+	}
+
+	if m.OpenFDs >= 0 {
+		ret = append(ret, data.Sample{Type: "openFDs", ID: id,
+			Value: float64(m.OpenFDs), Time: now})
+	}
+
+	return ret
+}
+
+// openFDs returns the number of open file descriptors of this process
+func openFDs() int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	// don't count the fd used to read the dir
+	return len(fds) - 1
+}
+
+// SelfMonitorConfig describes how the SIOT process is monitored. Limits
+// that are 0 are not checked.
+type SelfMonitorConfig struct {
+	// ID is the sample ID
+	ID       string
+	Interval time.Duration
+	// MaxGoroutines, MaxHeap (bytes), MaxFDs, and MaxQueueDepth (bytes) are
+	// the limits where a warning is sent
+	MaxGoroutines int
+	MaxHeap       uint64
+	MaxFDs        int
+	MaxQueueDepth int64
+	// QueueDepth returns the ingest queue depth, if there is a queue
+	QueueDepth func() int64
+	// Send is typically api.NewSendSamples
+	Send func([]data.Sample) error
+}
+
+// SelfMonitor periodically sends the resource usage of the SIOT process,
+// and a resourceWarning sample tagged with the resource when a limit is
+// crossed (value 1) and when usage drops back below 90% of the limit
+// (value 0). Slow leaks are then caught before the process is killed.
+type SelfMonitor struct {
+	config   SelfMonitorConfig
+	lock     sync.Mutex
+	warnings map[string]bool
+	stop     chan struct{}
+}
+
+// NewSelfMonitor creates a self monitor
+func NewSelfMonitor(config SelfMonitorConfig) *SelfMonitor {
+	return &SelfMonitor{
+		config:   config,
+		warnings: make(map[string]bool),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Read returns the current process metrics
+func (s *SelfMonitor) Read() ProcessMetrics {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	m := ProcessMetrics{
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  mem.HeapAlloc,
+		OpenFDs:    openFDs(),
+	}
+
+	if s.config.QueueDepth != nil {
+		m.QueueDepth = s.config.QueueDepth()
+	}
+
+	return m
+}
+
+// check returns a warning sample if the state of a limit changed
+func (s *SelfMonitor) check(resource string, value, limit float64) []data.Sample {
+	if limit <= 0 || value < 0 {
+		return nil
+	}
+
+	warned := s.warnings[resource]
+
+	switch {
+	case !warned && value > limit:
+		log.Printf("Warning: %v is %v, limit is %v\n", resource, value, limit)
+	case warned && value < limit*0.9:
+		log.Printf("%v is back to %v, limit is %v\n", resource, value, limit)
+	default:
+		return nil
+	}
+
+	s.warnings[resource] = !warned
+
+	v := 0.0
+	if !warned {
+		v = 1
+	}
+
+	return []data.Sample{{Type: "resourceWarning", ID: s.config.ID, Value: v,
+		Time: time.Now(), Tags: map[string]string{"resource": resource}}}
+}
+
+// Samples reads the metrics and returns them as samples, including
+// warnings for limits that were crossed since the last call
+func (s *SelfMonitor) Samples() []data.Sample {
+	m := s.Read()
+	c := s.config
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ret := m.Samples(c.ID)
+	ret = append(ret, s.check("goroutines", float64(m.Goroutines),
+		float64(c.MaxGoroutines))...)
+	ret = append(ret, s.check("heapAlloc", float64(m.HeapAlloc),
+		float64(c.MaxHeap))...)
+	ret = append(ret, s.check("openFDs", float64(m.OpenFDs),
+		float64(c.MaxFDs))...)
+	ret = append(ret, s.check("ingestQueue", float64(m.QueueDepth),
+		float64(c.MaxQueueDepth))...)
+
+	return ret
+}
+
+// Start sends samples until Stop is called
+func (s *SelfMonitor) Start() {
+	go func() {
+		ticker := time.NewTicker(s.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := s.config.Send(s.Samples())
+				if err != nil {
+					log.Println("Error sending process metrics: ", err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops sending samples
+func (s *SelfMonitor) Stop() {
+	close(s.stop)
+}
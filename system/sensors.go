@@ -0,0 +1,423 @@
+package system
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// Sensor is a sensor that is read on a schedule
+type Sensor interface {
+	// Read returns the sensor readings as samples with the sensor ID
+	Read() ([]data.Sample, error)
+	Close() error
+}
+
+// OpenSensor opens the sensor described by config
+func OpenSensor(config data.SensorConfig) (Sensor, error) {
+	switch config.Type {
+	case data.SensorBME280:
+		return OpenBME280(config)
+	case data.SensorADS1115:
+		return OpenADS1115(config)
+	}
+
+	return nil, fmt.Errorf("unsupported sensor type: %v", config.Type)
+}
+
+// bme280 registers
+const (
+	bme280ChipID    = 0x60
+	bme280RegID     = 0xd0
+	bme280RegCalib1 = 0x88
+	bme280RegCalib2 = 0xe1
+	bme280RegHum    = 0xf2
+	bme280RegStatus = 0xf3
+	bme280RegMeas   = 0xf4
+	bme280RegData   = 0xf7
+)
+
+// bme280Calib is the factory calibration used to compensate readings
+type bme280Calib struct {
+	t1             uint16
+	t2, t3         int16
+	p1             uint16
+	p2, p3, p4, p5 int16
+	p6, p7, p8, p9 int16
+	h1, h3         uint8
+	h2, h4, h5     int16
+	h6             int8
+}
+
+// BME280 is a Bosch temperature, humidity, and pressure sensor on I2C
+type BME280 struct {
+	id    string
+	dev   *I2C
+	calib bme280Calib
+}
+
+// OpenBME280 opens a BME280 and reads its calibration
+func OpenBME280(config data.SensorConfig) (*BME280, error) {
+	addr := config.Address
+	if addr == 0 {
+		addr = 0x76
+	}
+
+	dev, err := OpenI2C(config.Bus, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &BME280{id: config.ID, dev: dev}
+
+	err = s.init()
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *BME280) init() error {
+	id := make([]byte, 1)
+	err := s.dev.ReadReg(bme280RegID, id)
+	if err != nil {
+		return err
+	}
+
+	if id[0] != bme280ChipID {
+		return fmt.Errorf("not a BME280, chip id: 0x%x", id[0])
+	}
+
+	c1 := make([]byte, 26)
+	err = s.dev.ReadReg(bme280RegCalib1, c1)
+	if err != nil {
+		return err
+	}
+
+	c2 := make([]byte, 7)
+	err = s.dev.ReadReg(bme280RegCalib2, c2)
+	if err != nil {
+		return err
+	}
+
+	s.calib = parseBME280Calib(c1, c2)
+	return nil
+}
+
+// parseBME280Calib parses the calibration registers at 0x88 (26 bytes) and
+// 0xe1 (7 bytes)
+func parseBME280Calib(c1, c2 []byte) bme280Calib {
+	u16 := func(b []byte) uint16 { return binary.LittleEndian.Uint16(b) }
+	i16 := func(b []byte) int16 { return int16(u16(b)) }
+
+	return bme280Calib{
+		t1: u16(c1[0:]), t2: i16(c1[2:]), t3: i16(c1[4:]),
+		p1: u16(c1[6:]), p2: i16(c1[8:]), p3: i16(c1[10:]),
+		p4: i16(c1[12:]), p5: i16(c1[14:]), p6: i16(c1[16:]),
+		p7: i16(c1[18:]), p8: i16(c1[20:]), p9: i16(c1[22:]),
+		h1: c1[25],
+		h2: i16(c2[0:]),
+		h3: c2[2],
+		// h4 and h5 are 12 bit values that share a byte
+		h4: int16(int8(c2[3]))<<4 | int16(c2[4]&0x0f),
+		h5: int16(int8(c2[5]))<<4 | int16(c2[4]>>4),
+		h6: int8(c2[6]),
+	}
+}
+
+// Read does a forced measurement and returns temp (C), humidity (%), and
+// pressure (hPa) samples
+func (s *BME280) Read() ([]data.Sample, error) {
+	// humidity x1 must be written before ctrl_meas
+	err := s.dev.WriteReg(bme280RegHum, 0x01)
+	if err != nil {
+		return nil, err
+	}
+
+	// temp x1, pressure x1, forced mode
+	err = s.dev.WriteReg(bme280RegMeas, 0x25)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]byte, 1)
+	for i := 0; ; i++ {
+		time.Sleep(10 * time.Millisecond)
+		err = s.dev.ReadReg(bme280RegStatus, status)
+		if err != nil {
+			return nil, err
+		}
+
+		if status[0]&0x08 == 0 {
+			break
+		}
+
+		if i >= 10 {
+			return nil, errors.New("timeout waiting for BME280 measurement")
+		}
+	}
+
+	b := make([]byte, 8)
+	err = s.dev.ReadReg(bme280RegData, b)
+	if err != nil {
+		return nil, err
+	}
+
+	adcP := float64(int32(b[0])<<12 | int32(b[1])<<4 | int32(b[2])>>4)
+	adcT := float64(int32(b[3])<<12 | int32(b[4])<<4 | int32(b[5])>>4)
+	adcH := float64(int32(b[6])<<8 | int32(b[7]))
+
+	temp, press, hum := s.calib.compensate(adcT, adcP, adcH)
+
+	now := time.Now()
+	return []data.Sample{
+		{Type: "temp", ID: s.id, Value: temp, Time: now},
+		{Type: "humidity", ID: s.id, Value: hum, Time: now},
+		{Type: "pressure", ID: s.id, Value: press / 100, Time: now},
+	}, nil
+}
+
+// compensate converts the raw readings to C, Pa, and %RH using the floating
+// point formulas from the datasheet
+func (c bme280Calib) compensate(adcT, adcP, adcH float64) (temp, press, hum float64) {
+	v1 := (adcT/16384 - float64(c.t1)/1024) * float64(c.t2)
+	v2 := adcT/131072 - float64(c.t1)/8192
+	v2 = v2 * v2 * float64(c.t3)
+	tFine := v1 + v2
+	temp = tFine / 5120
+
+	v1 = tFine/2 - 64000
+	v2 = v1 * v1 * float64(c.p6) / 32768
+	v2 = v2 + v1*float64(c.p5)*2
+	v2 = v2/4 + float64(c.p4)*65536
+	v1 = (float64(c.p3)*v1*v1/524288 + float64(c.p2)*v1) / 524288
+	v1 = (1 + v1/32768) * float64(c.p1)
+	if v1 != 0 {
+		p := 1048576 - adcP
+		p = (p - v2/4096) * 6250 / v1
+		v1 = float64(c.p9) * p * p / 2147483648
+		v2 = p * float64(c.p8) / 32768
+		press = p + (v1+v2+float64(c.p7))/16
+	}
+
+	h := tFine - 76800
+	h = (adcH - (float64(c.h4)*64 + float64(c.h5)/16384*h)) *
+		(float64(c.h2) / 65536 * (1 + float64(c.h6)/67108864*h*
+			(1+float64(c.h3)/67108864*h)))
+	h = h * (1 - float64(c.h1)*h/524288)
+
+	switch {
+	case h > 100:
+		h = 100
+	case h < 0:
+		h = 0
+	}
+
+	return temp, press, h
+}
+
+// Close closes the sensor
+func (s *BME280) Close() error {
+	return s.dev.Close()
+}
+
+// ads1115 gain settings by full scale voltage
+var ads1115Ranges = map[float64]uint16{
+	6.144: 0, 4.096: 1, 2.048: 2, 1.024: 3, 0.512: 4, 0.256: 5,
+}
+
+// ADS1115 is a TI 16 bit ADC on I2C. One input is read per sensor.
+type ADS1115 struct {
+	id      string
+	dev     *I2C
+	channel int
+	fsr     float64
+}
+
+// OpenADS1115 opens an ADS1115
+func OpenADS1115(config data.SensorConfig) (*ADS1115, error) {
+	addr := config.Address
+	if addr == 0 {
+		addr = 0x48
+	}
+
+	fsr := config.Range
+	if fsr == 0 {
+		fsr = 2.048
+	}
+
+	if _, ok := ads1115Ranges[fsr]; !ok {
+		return nil, fmt.Errorf("invalid ads1115 range: %v", fsr)
+	}
+
+	dev, err := OpenI2C(config.Bus, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ADS1115{id: config.ID, dev: dev, channel: config.Channel, fsr: fsr}, nil
+}
+
+// Read does a single shot conversion and returns a voltage sample
+func (s *ADS1115) Read() ([]data.Sample, error) {
+	config := ads1115Config(s.channel, s.fsr)
+	err := s.dev.WriteReg(0x01, byte(config>>8), byte(config))
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 2)
+	for i := 0; ; i++ {
+		time.Sleep(10 * time.Millisecond)
+		err = s.dev.ReadReg(0x01, b)
+		if err != nil {
+			return nil, err
+		}
+
+		// the start bit reads 1 when the conversion is done
+		if b[0]&0x80 != 0 {
+			break
+		}
+
+		if i >= 10 {
+			return nil, errors.New("timeout waiting for ADS1115 conversion")
+		}
+	}
+
+	err = s.dev.ReadReg(0x00, b)
+	if err != nil {
+		return nil, err
+	}
+
+	return []data.Sample{{Type: "voltage", ID: s.id,
+		Value: ads1115Volts(b, s.fsr), Time: time.Now()}}, nil
+}
+
+// ads1115Config returns the config register that starts a conversion on
+// channel
+func ads1115Config(channel int, fsr float64) uint16 {
+	// start, single ended input, gain, single shot, 128SPS, comparator off
+	return uint16(1<<15) | uint16(4+channel)<<12 |
+		ads1115Ranges[fsr]<<9 | 1<<8 | 4<<5 | 3
+}
+
+// ads1115Volts converts the conversion register to volts
+func ads1115Volts(b []byte, fsr float64) float64 {
+	raw := int16(binary.BigEndian.Uint16(b))
+	return float64(raw) * fsr / 32768
+}
+
+// Close closes the sensor
+func (s *ADS1115) Close() error {
+	return s.dev.Close()
+}
+
+// SensorScheduler reads the sensors in a device config at their intervals
+// and sends the readings as samples
+type SensorScheduler struct {
+	send    func([]data.Sample) error
+	lock    sync.Mutex
+	configs []data.SensorConfig
+	stops   []chan struct{}
+}
+
+// NewSensorScheduler creates a sensor scheduler. send is typically
+// api.NewSendSamples.
+func NewSensorScheduler(send func([]data.Sample) error) *SensorScheduler {
+	return &SensorScheduler{send: send}
+}
+
+func (ss *SensorScheduler) run(config data.SensorConfig, stop chan struct{}) {
+	var sensor Sensor
+	defer func() {
+		if sensor != nil {
+			sensor.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(time.Duration(config.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		if sensor == nil {
+			sensor, err = OpenSensor(config)
+			if err != nil {
+				log.Printf("Error opening sensor %v: %v", config.ID, err)
+			}
+		}
+
+		if sensor != nil {
+			var samples []data.Sample
+			samples, err = sensor.Read()
+			if err != nil {
+				log.Printf("Error reading sensor %v: %v", config.ID, err)
+				// reopen in case the sensor was reset
+				sensor.Close()
+				sensor = nil
+			} else {
+				err := ss.send(samples)
+				if err != nil {
+					log.Println("Error sending sensor samples: ", err)
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func sensorConfigsEqual(a, b []data.SensorConfig) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Update starts reading the sensors in configs, and stops reading any
+// sensors that were removed. It should be called when the device config
+// changes.
+func (ss *SensorScheduler) Update(configs []data.SensorConfig) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	if sensorConfigsEqual(configs, ss.configs) {
+		return
+	}
+
+	for _, stop := range ss.stops {
+		close(stop)
+	}
+
+	ss.configs = append([]data.SensorConfig{}, configs...)
+	ss.stops = nil
+
+	for _, c := range configs {
+		stop := make(chan struct{})
+		ss.stops = append(ss.stops, stop)
+		go ss.run(c, stop)
+	}
+}
+
+// Stop stops reading all sensors
+func (ss *SensorScheduler) Stop() {
+	ss.Update(nil)
+}
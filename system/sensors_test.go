@@ -0,0 +1,108 @@
+package system
+
+import (
+	"math"
+	"testing"
+)
+
+// bme280DatasheetCalib is the temperature and pressure calibration from
+// the compensation example in the Bosch datasheet. The humidity values
+// are from a production part.
+var bme280DatasheetCalib = bme280Calib{
+	t1: 27504, t2: 26435, t3: -1000,
+	p1: 36477, p2: -10685, p3: 3024, p4: 2855, p5: 140, p6: -7,
+	p7: 15500, p8: -14600, p9: 6000,
+	h1: 75, h2: 362, h3: 0, h4: 313, h5: 50, h6: 30,
+}
+
+func TestParseBME280Calib(t *testing.T) {
+	c1 := []byte{0x70, 0x6b, 0x43, 0x67, 0x18, 0xfc, 0x7d, 0x8e, 0x43, 0xd6,
+		0xd0, 0x0b, 0x27, 0x0b, 0x8c, 0x00, 0xf9, 0xff, 0x8c, 0x3c, 0xf8, 0xc6,
+		0x70, 0x17, 0x00, 0x4b}
+	c2 := []byte{0x6a, 0x01, 0x00, 0x13, 0x29, 0x03, 0x1e}
+
+	if c := parseBME280Calib(c1, c2); c != bme280DatasheetCalib {
+		t.Errorf("expected %+v, got %+v", bme280DatasheetCalib, c)
+	}
+
+	// h4 and h5 are signed
+	c := parseBME280Calib(c1, []byte{0x6a, 0x01, 0x00, 0xf9, 0x2c, 0xfe, 0x1e})
+	if c.h4 != -100 || c.h5 != -30 {
+		t.Errorf("expected h4 -100 and h5 -30, got %v and %v", c.h4, c.h5)
+	}
+}
+
+func TestBME280Compensate(t *testing.T) {
+	cases := []struct {
+		adcT, adcP, adcH float64
+		temp, press, hum float64
+	}{
+		// datasheet example: 25.08 C, 100653.27 Pa. The humidity was checked
+		// against the datasheet's fixed point formula.
+		{519888, 415148, 30000, 25.08, 100653.27, 55.00},
+		// clamped
+		{519888, 415148, 65535, 25.08, 100653.27, 100},
+		{519888, 415148, 0, 25.08, 100653.27, 0},
+	}
+
+	for _, c := range cases {
+		temp, press, hum := bme280DatasheetCalib.compensate(c.adcT, c.adcP, c.adcH)
+		if math.Abs(temp-c.temp) > 0.005 {
+			t.Errorf("expected temp %v, got %v", c.temp, temp)
+		}
+
+		if math.Abs(press-c.press) > 0.005 {
+			t.Errorf("expected pressure %v, got %v", c.press, press)
+		}
+
+		if math.Abs(hum-c.hum) > 0.01 {
+			t.Errorf("expected humidity %v, got %v", c.hum, hum)
+		}
+	}
+
+	// no calibration, so pressure can't be computed
+	if _, press, _ := (bme280Calib{}).compensate(519888, 415148, 30000); press != 0 {
+		t.Errorf("expected 0 pressure without calibration, got %v", press)
+	}
+}
+
+func TestADS1115Config(t *testing.T) {
+	cases := []struct {
+		channel int
+		fsr     float64
+		config  uint16
+	}{
+		// AIN0 to GND, +/-2.048V, single shot, 128SPS, comparator off
+		{0, 2.048, 0xc583},
+		{1, 2.048, 0xd583},
+		{3, 6.144, 0xf183},
+		{2, 0.256, 0xeb83},
+	}
+
+	for _, c := range cases {
+		if config := ads1115Config(c.channel, c.fsr); config != c.config {
+			t.Errorf("channel %v, %vV: expected 0x%04x, got 0x%04x", c.channel,
+				c.fsr, c.config, config)
+		}
+	}
+}
+
+func TestADS1115Volts(t *testing.T) {
+	cases := []struct {
+		b     []byte
+		fsr   float64
+		volts float64
+	}{
+		{[]byte{0x7f, 0xff}, 2.048, 2.048 * 32767 / 32768},
+		{[]byte{0x40, 0x00}, 4.096, 2.048},
+		{[]byte{0x00, 0x01}, 0.256, 0.0000078125},
+		{[]byte{0xff, 0xff}, 2.048, -0.0000625},
+		{[]byte{0x80, 0x00}, 2.048, -2.048},
+	}
+
+	for _, c := range cases {
+		if v := ads1115Volts(c.b, c.fsr); math.Abs(v-c.volts) > 1e-9 {
+			t.Errorf("% x: expected %v, got %v", c.b, c.volts, v)
+		}
+	}
+}
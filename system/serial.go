@@ -0,0 +1,259 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// SerialPortsCommand is the device command used to report the serial ports
+// of a device
+const SerialPortsCommand = "serialPorts"
+
+// directories used to find serial ports
+var (
+	ttyClassDir     = "/sys/class/tty"
+	serialByIDDir   = "/dev/serial/by-id"
+	serialByPathDir = "/dev/serial/by-path"
+)
+
+// SerialPort is a serial port. The USB fields are only set for USB serial
+// adapters and modems.
+type SerialPort struct {
+	// Device is the kernel device, like /dev/ttyUSB0. It can change when
+	// devices are plugged in or re-enumerate.
+	Device string
+	// ByID is the stable udev path, like
+	// /dev/serial/by-id/usb-FTDI_FT232R_USB_UART_A50285BI-if00-port0
+	ByID string
+	// ByPath is the udev path for the physical USB port
+	ByPath string
+	// Driver is the kernel driver, like ftdi_sio or cdc_acm
+	Driver string
+	// Vendor and Product are the USB IDs in hex, like 0403 and 6001
+	Vendor       string
+	Product      string
+	Serial       string
+	Manufacturer string
+	Description  string
+	// Interface is the USB interface number, -1 if not USB
+	Interface int
+}
+
+// Sample returns the port as a sample with the port info in the tags
+func (p SerialPort) Sample() data.Sample {
+	tags := map[string]string{}
+	for k, v := range map[string]string{
+		"byId":         p.ByID,
+		"byPath":       p.ByPath,
+		"driver":       p.Driver,
+		"vendor":       p.Vendor,
+		"product":      p.Product,
+		"serial":       p.Serial,
+		"manufacturer": p.Manufacturer,
+		"description":  p.Description,
+	} {
+		if v != "" {
+			tags[k] = v
+		}
+	}
+
+	if p.Interface >= 0 {
+		tags["interface"] = strconv.Itoa(p.Interface)
+	}
+
+	return data.Sample{Type: "serialPort", ID: p.Device, Value: 1, Tags: tags}
+}
+
+// udevLinks returns the device each link in dir points to
+func udevLinks(dir string) map[string]string {
+	ret := make(map[string]string)
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ret
+	}
+
+	for _, fi := range infos {
+		link := filepath.Join(dir, fi.Name())
+		dev, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			continue
+		}
+		ret[dev] = link
+	}
+
+	return ret
+}
+
+// usbInfo fills in the USB fields by walking up from the tty device to the
+// USB interface and device
+func usbInfo(devPath string, p *SerialPort) {
+	for dir := devPath; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		n := readSysfs(filepath.Join(dir, "bInterfaceNumber"))
+		if n == "" {
+			continue
+		}
+
+		iface, err := strconv.ParseInt(n, 16, 32)
+		if err != nil {
+			return
+		}
+
+		usbDir := filepath.Dir(dir)
+		p.Interface = int(iface)
+		p.Vendor = readSysfs(filepath.Join(usbDir, "idVendor"))
+		p.Product = readSysfs(filepath.Join(usbDir, "idProduct"))
+		p.Serial = readSysfs(filepath.Join(usbDir, "serial"))
+		p.Manufacturer = readSysfs(filepath.Join(usbDir, "manufacturer"))
+		p.Description = readSysfs(filepath.Join(usbDir, "product"))
+		return
+	}
+}
+
+// serialDriver returns the driver of a tty device. Newer kernels add serial
+// core controller and port devices between the tty and the UART.
+func serialDriver(devPath string) string {
+	dir := devPath
+	for i := 0; i < 3; i++ {
+		driverPath, err := filepath.EvalSymlinks(filepath.Join(dir, "driver"))
+		if err == nil {
+			driver := filepath.Base(driverPath)
+			if driver != "port" && driver != "ctrl" {
+				return driver
+			}
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	return ""
+}
+
+// SerialPorts returns the serial ports on the system. Legacy 8250 ports
+// that are not backed by hardware are skipped.
+func SerialPorts() ([]SerialPort, error) {
+	infos, err := ioutil.ReadDir(ttyClassDir)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := udevLinks(serialByIDDir)
+	byPath := udevLinks(serialByPathDir)
+
+	var ret []SerialPort
+	for _, fi := range infos {
+		// virtual terminals and ptys don't have a device
+		devPath, err := filepath.EvalSymlinks(filepath.Join(ttyClassDir,
+			fi.Name(), "device"))
+		if err != nil {
+			continue
+		}
+
+		// 8250 ports without a UART have type 0 (PORT_UNKNOWN)
+		if readSysfs(filepath.Join(ttyClassDir, fi.Name(), "type")) == "0" {
+			continue
+		}
+
+		dev := "/dev/" + fi.Name()
+		p := SerialPort{
+			Device:    dev,
+			ByID:      byID[dev],
+			ByPath:    byPath[dev],
+			Driver:    serialDriver(devPath),
+			Interface: -1,
+		}
+
+		usbInfo(devPath, &p)
+		ret = append(ret, p)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Device < ret[j].Device
+	})
+
+	return ret, nil
+}
+
+// ResolveSerialPort returns the device for a serial port spec, so configs
+// can name a port by what is plugged in instead of a ttyUSB number that
+// changes. spec is one of:
+//
+//	/dev/ttyUSB0 or /dev/serial/by-id/...: used as is
+//	usb:<vendor>:<product>[:<interface>]: first port of a USB device, like
+//	  usb:2c7c:0125:2 for the AT port of a Quectel EC25
+//	serial:<serial>[:<interface>]: port of the USB device with a serial
+//	  number, for telling identical adapters apart
+func ResolveSerialPort(spec string) (string, error) {
+	if !strings.HasPrefix(spec, "usb:") && !strings.HasPrefix(spec, "serial:") {
+		return spec, nil
+	}
+
+	fields := strings.Split(spec, ":")
+
+	var match func(p SerialPort) bool
+	iface := -1
+	ifaceField := 0
+
+	switch {
+	case fields[0] == "usb" && (len(fields) == 3 || len(fields) == 4):
+		match = func(p SerialPort) bool {
+			return strings.EqualFold(p.Vendor, fields[1]) &&
+				strings.EqualFold(p.Product, fields[2])
+		}
+		ifaceField = 3
+	case fields[0] == "serial" && (len(fields) == 2 || len(fields) == 3):
+		match = func(p SerialPort) bool {
+			return p.Serial == fields[1]
+		}
+		ifaceField = 2
+	default:
+		return "", fmt.Errorf("invalid serial port: %v", spec)
+	}
+
+	if len(fields) > ifaceField {
+		var err error
+		iface, err = strconv.Atoi(fields[ifaceField])
+		if err != nil {
+			return "", fmt.Errorf("invalid serial port interface: %v", spec)
+		}
+	}
+
+	ports, err := SerialPorts()
+	if err != nil {
+		return "", err
+	}
+
+	for _, p := range ports {
+		if match(p) && (iface < 0 || p.Interface == iface) {
+			return p.Device, nil
+		}
+	}
+
+	return "", errors.New("serial port not found: " + spec)
+}
+
+// ReportSerialPorts runs a SerialPortsCommand received from the server and
+// returns the ports as samples
+func ReportSerialPorts(cmd data.DeviceCommand) ([]data.Sample, error) {
+	if cmd.Command != SerialPortsCommand {
+		return nil, fmt.Errorf("unexpected command: %v", cmd.Command)
+	}
+
+	ports, err := SerialPorts()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]data.Sample, len(ports))
+	for i, p := range ports {
+		ret[i] = p.Sample()
+	}
+
+	return ret, nil
+}
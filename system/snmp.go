@@ -0,0 +1,233 @@
+package system
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/snmp"
+)
+
+// SnmpTrapUnit is the unit of log entries for received traps
+const SnmpTrapUnit = "snmptrap"
+
+// snmpClientConfig returns the client config for an agent
+func snmpClientConfig(c data.SnmpConfig) snmp.Config {
+	return snmp.Config{
+		Version:      c.Version,
+		Community:    c.Community,
+		User:         c.User,
+		AuthProtocol: c.AuthProtocol,
+		AuthPassword: c.AuthPassword,
+		PrivProtocol: c.PrivProtocol,
+		PrivPassword: c.PrivPassword,
+		Retries:      2,
+	}
+}
+
+// ReadSnmp reads the OIDs in an SNMP config and returns them as samples.
+// OIDs that are missing or not numbers are skipped.
+func ReadSnmp(client *snmp.Client, config data.SnmpConfig) ([]data.Sample, error) {
+	oids := make([]string, len(config.Oids))
+	for i, o := range config.Oids {
+		oids[i] = o.OID
+	}
+
+	vars, err := client.Get(oids...)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []data.Sample
+	for i, v := range vars {
+		o := config.Oids[i]
+		f, ok := v.Float()
+		if !ok {
+			log.Printf("SNMP %v oid %v is not a number: %v\n", config.Address,
+				o.OID, v)
+			continue
+		}
+
+		ret = append(ret, data.Sample{Type: o.Type, ID: o.ID, Value: o.Value(f),
+			Time: time.Now()})
+	}
+
+	return ret, nil
+}
+
+// SnmpScheduler polls the SNMP agents in a device config at their
+// intervals and sends the readings as samples
+type SnmpScheduler struct {
+	send    func([]data.Sample) error
+	lock    sync.Mutex
+	configs []data.SnmpConfig
+	stops   []chan struct{}
+}
+
+// NewSnmpScheduler creates an SNMP scheduler. send is typically
+// api.NewSendSamples.
+func NewSnmpScheduler(send func([]data.Sample) error) *SnmpScheduler {
+	return &SnmpScheduler{send: send}
+}
+
+// run polls an agent until stop is closed
+func (ss *SnmpScheduler) run(config data.SnmpConfig, stop chan struct{}) {
+	interval := time.Duration(config.Interval) * time.Second
+	if interval == 0 {
+		interval = time.Minute
+	}
+
+	var client *snmp.Client
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+	}()
+
+	for {
+		var err error
+		if client == nil {
+			client, err = snmp.Dial(config.Address, snmpClientConfig(config))
+			if err != nil {
+				log.Printf("Error opening snmp %v: %v\n", config.Address, err)
+			}
+		}
+
+		if client != nil {
+			samples, err := ReadSnmp(client, config)
+			if err != nil {
+				log.Printf("Error reading snmp %v: %v\n", config.Address, err)
+			} else if len(samples) > 0 {
+				err := ss.send(samples)
+				if err != nil {
+					log.Println("Error sending snmp samples: ", err)
+				}
+			}
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Update starts polling the SNMP agents in configs, and stops polling
+// any that were removed. It should be called when the device config
+// changes.
+func (ss *SnmpScheduler) Update(configs []data.SnmpConfig) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	if reflect.DeepEqual(configs, ss.configs) {
+		return
+	}
+
+	for _, stop := range ss.stops {
+		close(stop)
+	}
+
+	ss.configs = append([]data.SnmpConfig{}, configs...)
+	ss.stops = nil
+
+	for _, c := range configs {
+		stop := make(chan struct{})
+		ss.stops = append(ss.stops, stop)
+		go ss.run(c, stop)
+	}
+}
+
+// Stop stops polling all SNMP agents
+func (ss *SnmpScheduler) Stop() {
+	ss.Update(nil)
+}
+
+// SnmpTrapReceiver receives traps from SNMP agents and sends them as log
+// entries with the SnmpTrapUnit unit
+type SnmpTrapReceiver struct {
+	upload   func([]data.LogEntry) error
+	lock     sync.Mutex
+	config   *data.SnmpTrapConfig
+	listener *snmp.TrapListener
+}
+
+// NewSnmpTrapReceiver creates a trap receiver. upload is typically
+// api.NewSendLogs.
+func NewSnmpTrapReceiver(upload func([]data.LogEntry) error) *SnmpTrapReceiver {
+	return &SnmpTrapReceiver{upload: upload}
+}
+
+// TrapLogEntry returns the log entry for a trap
+func TrapLogEntry(t snmp.Trap) data.LogEntry {
+	vars := make([]string, len(t.Variables))
+	for i, v := range t.Variables {
+		vars[i] = v.OID + "=" + v.String()
+	}
+
+	msg := fmt.Sprintf("trap %v from %v", t.OID, t.Address)
+	if len(vars) > 0 {
+		msg += ": " + strings.Join(vars, ", ")
+	}
+
+	return data.LogEntry{
+		Time:     time.Now(),
+		Unit:     SnmpTrapUnit,
+		Priority: PriorityWarning,
+		Message:  msg,
+	}
+}
+
+// Update starts receiving traps if config is set, and stops if it is
+// nil. It should be called when the device config changes.
+func (r *SnmpTrapReceiver) Update(config *data.SnmpTrapConfig) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if reflect.DeepEqual(config, r.config) {
+		return nil
+	}
+
+	if r.listener != nil {
+		r.listener.Close()
+		r.listener = nil
+	}
+
+	r.config = nil
+	if config == nil {
+		return nil
+	}
+
+	port := config.Port
+	if port == 0 {
+		port = 162
+	}
+
+	l, err := snmp.ListenTraps(":"+strconv.Itoa(port), config.Community,
+		func(t snmp.Trap) {
+			err := r.upload([]data.LogEntry{TrapLogEntry(t)})
+			if err != nil {
+				log.Println("Error uploading snmp trap: ", err)
+			}
+		})
+	if err != nil {
+		return err
+	}
+
+	c := *config
+	r.config = &c
+	r.listener = l
+	return nil
+}
+
+// Stop stops receiving traps
+func (r *SnmpTrapReceiver) Stop() {
+	r.Update(nil)
+}
@@ -0,0 +1,473 @@
+package system
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// RestartPolicy describes when a supervised process is restarted
+type RestartPolicy string
+
+// define restart policies
+const (
+	RestartNever     RestartPolicy = "never"
+	RestartOnFailure RestartPolicy = "onFailure"
+	RestartAlways    RestartPolicy = "always"
+)
+
+// ProcessConfig describes a helper process like pppd, gpsd, or a vendor
+// daemon
+type ProcessConfig struct {
+	// Name is used in logs and sample tags (default is Command)
+	Name    string
+	Command string
+	Args    []string
+	// Env is added to the environment of SIOT
+	Env []string
+	Dir string
+	// Restart is the restart policy (default RestartOnFailure)
+	Restart RestartPolicy
+	// RestartDelay is the delay before the first restart (default 1s). The
+	// delay doubles each time the process exits quickly, up to
+	// MaxRestartDelay (default 1m).
+	RestartDelay    time.Duration
+	MaxRestartDelay time.Duration
+	// MaxRestarts is the number of times in a row the process is restarted
+	// without staying up for MaxRestartDelay before the supervisor gives
+	// up. 0 is no limit.
+	MaxRestarts int
+	// StopTimeout is how long Stop waits after SIGTERM before the process
+	// is killed (default 10s)
+	StopTimeout time.Duration
+	// Output receives stdout and stderr (default is the log, prefixed with
+	// Name)
+	Output io.Writer
+}
+
+// ProcessStatus is the state of a supervised process
+type ProcessStatus struct {
+	Name    string
+	Running bool
+	Pid     int
+	// Restarts is the number of times the process has been restarted
+	Restarts  int
+	StartTime time.Time
+	// ExitCode is the code the process last exited with. It is -1 if the
+	// process was killed by a signal.
+	ExitCode int
+	LastExit time.Time
+	// Error is the last start or exit error
+	Error string
+}
+
+// Samples returns the status as samples tagged with the process name
+func (s ProcessStatus) Samples(id string) []data.Sample {
+	now := time.Now()
+	tags := map[string]string{"process": s.Name}
+
+	running := 0.0
+	if s.Running {
+		running = 1
+	}
+
+	return []data.Sample{
+		{Type: "procRunning", ID: id, Value: running, Time: now, Tags: tags},
+		{Type: "procRestarts", ID: id, Value: float64(s.Restarts), Time: now,
+			Tags: tags},
+		{Type: "procExitCode", ID: id, Value: float64(s.ExitCode), Time: now,
+			Tags: tags},
+	}
+}
+
+// Process runs a helper process and restarts it according to its restart
+// policy
+type Process struct {
+	config ProcessConfig
+	lock   sync.Mutex
+	cmd    *exec.Cmd
+	status ProcessStatus
+	// stop and done are set while the process is supervised
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewProcess creates a supervised process. The process is not started
+// until Start is called.
+func NewProcess(config ProcessConfig) *Process {
+	if config.Name == "" {
+		config.Name = config.Command
+	}
+
+	if config.Restart == "" {
+		config.Restart = RestartOnFailure
+	}
+
+	if config.RestartDelay == 0 {
+		config.RestartDelay = time.Second
+	}
+
+	if config.MaxRestartDelay == 0 {
+		config.MaxRestartDelay = time.Minute
+	}
+
+	if config.StopTimeout == 0 {
+		config.StopTimeout = 10 * time.Second
+	}
+
+	if config.Output == nil {
+		config.Output = &lineLogger{prefix: config.Name + ": "}
+	}
+
+	return &Process{config: config, status: ProcessStatus{Name: config.Name}}
+}
+
+// Start starts the process if it is not already running or waiting to be
+// restarted. An error is returned if the process can't be started, and it
+// is not retried.
+func (p *Process) Start() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.stop != nil {
+		select {
+		case <-p.done:
+			// the process exited and was not restarted
+		default:
+			return nil
+		}
+	}
+
+	cmd, err := p.startLocked()
+	if err != nil {
+		return err
+	}
+
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go p.run(cmd, p.stop, p.done)
+
+	return nil
+}
+
+func (p *Process) startLocked() (*exec.Cmd, error) {
+	cmd := exec.Command(p.config.Command, p.config.Args...)
+	cmd.Dir = p.config.Dir
+	if len(p.config.Env) > 0 {
+		cmd.Env = append(os.Environ(), p.config.Env...)
+	}
+	cmd.Stdout = p.config.Output
+	cmd.Stderr = p.config.Output
+
+	err := cmd.Start()
+	if err != nil {
+		p.status.Error = err.Error()
+		return nil, err
+	}
+
+	p.cmd = cmd
+	p.status.Running = true
+	p.status.Pid = cmd.Process.Pid
+	p.status.StartTime = time.Now()
+	p.status.Error = ""
+
+	log.Printf("%v: started (pid %v)", p.config.Name, cmd.Process.Pid)
+
+	return cmd, nil
+}
+
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+
+	if err != nil {
+		return -1
+	}
+
+	return 0
+}
+
+func (p *Process) shouldRestart(code int) bool {
+	switch p.config.Restart {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return code != 0
+	}
+	return false
+}
+
+// run waits for the process to exit and restarts it until stop is closed
+func (p *Process) run(cmd *exec.Cmd, stop, done chan struct{}) {
+	defer close(done)
+
+	delay := p.config.RestartDelay
+	failures := 0
+
+	for {
+		err := cmd.Wait()
+		code := exitCode(err)
+
+		p.lock.Lock()
+		uptime := time.Since(p.status.StartTime)
+		p.cmd = nil
+		p.status.Running = false
+		p.status.Pid = 0
+		p.status.ExitCode = code
+		p.status.LastExit = time.Now()
+		p.status.Error = ""
+		if err != nil {
+			p.status.Error = err.Error()
+		}
+		p.lock.Unlock()
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if !p.shouldRestart(code) {
+			log.Printf("%v: exited with code %v", p.config.Name, code)
+			return
+		}
+
+		// a process that stayed up for a while is not failing repeatedly
+		if uptime >= p.config.MaxRestartDelay {
+			delay = p.config.RestartDelay
+			failures = 0
+		}
+
+		for {
+			failures++
+			if p.config.MaxRestarts > 0 && failures > p.config.MaxRestarts {
+				log.Printf("%v: exited %v times, not restarting",
+					p.config.Name, p.config.MaxRestarts)
+				return
+			}
+
+			log.Printf("%v: exited with code %v, restarting in %v",
+				p.config.Name, code, delay)
+
+			select {
+			case <-time.After(delay):
+			case <-stop:
+				return
+			}
+
+			delay *= 2
+			if delay > p.config.MaxRestartDelay {
+				delay = p.config.MaxRestartDelay
+			}
+
+			p.lock.Lock()
+			// Stop closes stop with the lock held, so a process is
+			// never started after Stop
+			select {
+			case <-stop:
+				p.lock.Unlock()
+				return
+			default:
+			}
+
+			p.status.Restarts++
+			cmd, err = p.startLocked()
+			p.lock.Unlock()
+
+			if err == nil {
+				break
+			}
+
+			log.Printf("%v: error restarting: %v", p.config.Name, err)
+		}
+	}
+}
+
+// Stop stops supervising the process, then stops it with SIGTERM, or kills
+// it if it does not exit within StopTimeout
+func (p *Process) Stop() error {
+	p.lock.Lock()
+	if p.stop == nil {
+		p.lock.Unlock()
+		return nil
+	}
+
+	close(p.stop)
+	p.stop = nil
+	cmd := p.cmd
+	done := p.done
+	p.lock.Unlock()
+
+	if cmd == nil {
+		// not running, or waiting to be restarted
+		<-done
+		return nil
+	}
+
+	err := cmd.Process.Signal(syscall.SIGTERM)
+	if err != nil {
+		// signals other than kill are not supported on all platforms
+		cmd.Process.Kill()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(p.config.StopTimeout):
+	}
+
+	log.Printf("%v: did not exit, killing", p.config.Name)
+	err = cmd.Process.Kill()
+	<-done
+	return err
+}
+
+// Status returns the state of the process
+func (p *Process) Status() ProcessStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.status
+}
+
+// lineLogger writes process output to the log a line at a time
+type lineLogger struct {
+	prefix string
+	buf    []byte
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		log.Print(l.prefix + string(l.buf[:i]))
+		l.buf = l.buf[i+1:]
+	}
+
+	// don't buffer forever if the process does not write newlines
+	if len(l.buf) > 4096 {
+		log.Print(l.prefix + string(l.buf))
+		l.buf = nil
+	}
+
+	return len(p), nil
+}
+
+// Supervisor runs a set of helper processes and reports their status
+type Supervisor struct {
+	lock  sync.Mutex
+	procs []*Process
+	stop  chan struct{}
+}
+
+// NewSupervisor creates a process supervisor
+func NewSupervisor() *Supervisor {
+	return &Supervisor{stop: make(chan struct{})}
+}
+
+// Add adds a process to the supervisor. The process is not started until
+// its Start method is called.
+func (s *Supervisor) Add(config ProcessConfig) *Process {
+	p := NewProcess(config)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.procs = append(s.procs, p)
+
+	return p
+}
+
+// Process returns a process by name, or nil if it was not added
+func (s *Supervisor) Process(name string) *Process {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, p := range s.procs {
+		if p.config.Name == name {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// Status returns the state of all processes
+func (s *Supervisor) Status() []ProcessStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ret := make([]ProcessStatus, len(s.procs))
+	for i, p := range s.procs {
+		ret[i] = p.Status()
+	}
+
+	return ret
+}
+
+// Samples returns the status of all processes as samples
+func (s *Supervisor) Samples(id string) []data.Sample {
+	var ret []data.Sample
+	for _, st := range s.Status() {
+		ret = append(ret, st.Samples(id)...)
+	}
+	return ret
+}
+
+// Report sends the status of all processes every interval until Stop is
+// called. send is typically api.NewSendSamples.
+func (s *Supervisor) Report(id string, interval time.Duration,
+	send func([]data.Sample) error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				samples := s.Samples(id)
+				if len(samples) <= 0 {
+					continue
+				}
+
+				err := send(samples)
+				if err != nil {
+					log.Println("Error sending process status: ", err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops reporting and stops all processes
+func (s *Supervisor) Stop() error {
+	close(s.stop)
+
+	s.lock.Lock()
+	procs := s.procs
+	s.lock.Unlock()
+
+	var ret error
+	for _, p := range procs {
+		err := p.Stop()
+		if err != nil {
+			ret = err
+		}
+	}
+
+	return ret
+}
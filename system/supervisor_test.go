@@ -0,0 +1,242 @@
+//go:build !windows
+// +build !windows
+
+package system
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// shProcess returns a process that runs script with sh
+func shProcess(script string, config ProcessConfig) *Process {
+	config.Command = "sh"
+	config.Args = []string{"-c", script}
+	config.Output = ioutil.Discard
+	return NewProcess(config)
+}
+
+// waitDone waits until a process is no longer supervised
+func waitDone(t *testing.T, p *Process) {
+	select {
+	case <-p.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for process supervision to end")
+	}
+}
+
+// captureLog sends the log to a buffer, and returns a function that
+// restores it
+func captureLog() (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	return &buf, func() { log.SetOutput(os.Stderr) }
+}
+
+var reRestartDelay = regexp.MustCompile(`restarting in (\S+)`)
+
+// restartDelays returns the restart delays that were logged
+func restartDelays(t *testing.T, logs string) []time.Duration {
+	var ret []time.Duration
+	for _, m := range reRestartDelay.FindAllStringSubmatch(logs, -1) {
+		d, err := time.ParseDuration(m[1])
+		if err != nil {
+			t.Fatal("Error parsing restart delay: ", err)
+		}
+		ret = append(ret, d)
+	}
+	return ret
+}
+
+func TestProcessRestartPolicy(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+
+	tests := []struct {
+		restart     RestartPolicy
+		script      string
+		expRestarts int
+		expCode     int
+		expError    string
+	}{
+		{RestartNever, "exit 1", 0, 1, "exit status 1"},
+		{RestartOnFailure, "exit 0", 0, 0, ""},
+		{RestartOnFailure, "exit 3", 2, 3, "exit status 3"},
+		{RestartAlways, "exit 0", 2, 0, ""},
+	}
+
+	for _, test := range tests {
+		p := shProcess(test.script, ProcessConfig{
+			Restart:      test.restart,
+			RestartDelay: time.Millisecond,
+			MaxRestarts:  2,
+		})
+
+		err := p.Start()
+		if err != nil {
+			t.Fatal("Error starting process: ", err)
+		}
+
+		waitDone(t, p)
+
+		s := p.Status()
+		if s.Running || s.Restarts != test.expRestarts ||
+			s.ExitCode != test.expCode || s.Error != test.expError {
+			t.Errorf("%v %q: status is %+v", test.restart, test.script, s)
+		}
+	}
+}
+
+func TestProcessCleanExitClearsError(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+
+	dir, err := ioutil.TempDir("", "siot-supervisor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// fails the first time, then exits cleanly
+	flag := path.Join(dir, "ran")
+	p := shProcess("if [ -e "+flag+" ]; then exit 0; fi; touch "+flag+"; exit 1",
+		ProcessConfig{RestartDelay: time.Millisecond})
+
+	err = p.Start()
+	if err != nil {
+		t.Fatal("Error starting process: ", err)
+	}
+
+	waitDone(t, p)
+
+	s := p.Status()
+	if s.Restarts != 1 || s.ExitCode != 0 || s.Error != "" {
+		t.Errorf("status is %+v, expected 1 restart and no error", s)
+	}
+}
+
+func TestProcessRestartDelay(t *testing.T) {
+	logs, restore := captureLog()
+	defer restore()
+
+	p := shProcess("exit 1", ProcessConfig{
+		RestartDelay:    25 * time.Millisecond,
+		MaxRestartDelay: 200 * time.Millisecond,
+		MaxRestarts:     5,
+	})
+
+	err := p.Start()
+	if err != nil {
+		t.Fatal("Error starting process: ", err)
+	}
+
+	waitDone(t, p)
+
+	ms := time.Millisecond
+	exp := []time.Duration{25 * ms, 50 * ms, 100 * ms, 200 * ms, 200 * ms}
+	delays := restartDelays(t, logs.String())
+	if len(delays) != len(exp) {
+		t.Fatalf("restart delays are %v, expected %v", delays, exp)
+	}
+
+	for i := range exp {
+		if delays[i] != exp[i] {
+			t.Errorf("restart delays are %v, expected %v", delays, exp)
+			break
+		}
+	}
+
+	if s := p.Status(); s.Restarts != 5 {
+		t.Errorf("process restarted %v times, expected 5", s.Restarts)
+	}
+}
+
+func TestProcessRestartReset(t *testing.T) {
+	logs, restore := captureLog()
+	defer restore()
+
+	// the process stays up longer than MaxRestartDelay, so the delay and
+	// restart count are reset every time and MaxRestarts is not reached
+	p := shProcess("sleep 0.1; exit 1", ProcessConfig{
+		RestartDelay:    10 * time.Millisecond,
+		MaxRestartDelay: 50 * time.Millisecond,
+		MaxRestarts:     1,
+	})
+
+	err := p.Start()
+	if err != nil {
+		t.Fatal("Error starting process: ", err)
+	}
+
+	start := time.Now()
+	for p.Status().Restarts < 3 {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timeout waiting for restarts: ", p.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = p.Stop()
+	if err != nil {
+		t.Error("Error stopping process: ", err)
+	}
+
+	for _, d := range restartDelays(t, logs.String()) {
+		if d != 10*time.Millisecond {
+			t.Errorf("restart delay is %v, expected it to be reset to 10ms", d)
+		}
+	}
+}
+
+func TestProcessStop(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+
+	tests := []struct {
+		name   string
+		script string
+		min    time.Duration
+		max    time.Duration
+	}{
+		// exits on SIGTERM
+		{"term", "exec sleep 10", 0, time.Second},
+		// ignores SIGTERM, so it is killed after StopTimeout
+		{"kill", "trap '' TERM; exec sleep 10", 200 * time.Millisecond,
+			2 * time.Second},
+	}
+
+	for _, test := range tests {
+		p := shProcess(test.script, ProcessConfig{
+			Restart:     RestartAlways,
+			StopTimeout: 200 * time.Millisecond,
+		})
+
+		err := p.Start()
+		if err != nil {
+			t.Fatal("Error starting process: ", err)
+		}
+
+		// give sh time to set up the trap
+		time.Sleep(100 * time.Millisecond)
+
+		start := time.Now()
+		p.Stop()
+		elapsed := time.Since(start)
+
+		if elapsed < test.min || elapsed > test.max {
+			t.Errorf("%v: stop took %v, expected %v to %v", test.name,
+				elapsed, test.min, test.max)
+		}
+
+		s := p.Status()
+		if s.Running || s.Restarts != 0 || s.ExitCode != -1 {
+			t.Errorf("%v: status after stop is %+v", test.name, s)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// UnitCommand is the device command used to control a systemd unit. The
+// name arg is the unit, and the action arg is status, start, stop,
+// restart, enable, or disable.
+const UnitCommand = "unit"
+
+const (
+	systemdService = "org.freedesktop.systemd1"
+	systemdPath    = "/org/freedesktop/systemd1"
+	systemdManager = "org.freedesktop.systemd1.Manager"
+	systemdUnit    = "org.freedesktop.systemd1.Unit"
+	systemdSvc     = "org.freedesktop.systemd1.Service"
+)
+
+// busctl runs a D-Bus call on the system bus and returns the reply with
+// the type signature removed (`s "active"` returns `"active"`)
+func busctl(args ...string) (string, error) {
+	out, err := exec.Command("busctl", append([]string{"--system"},
+		args...)...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("busctl %v: %v: %v", args[0], err,
+			strings.TrimSpace(string(out)))
+	}
+
+	fields := strings.SplitN(strings.TrimSpace(string(out)), " ", 2)
+	if len(fields) < 2 {
+		return "", nil
+	}
+
+	return fields[1], nil
+}
+
+func unquote(s string) string {
+	return strings.Trim(s, "\"")
+}
+
+// UnitStatus is the state of a systemd unit
+type UnitStatus struct {
+	Name string
+	// ActiveState is active, inactive, failed, activating, etc
+	ActiveState string
+	// SubState is unit type specific, like running or exited
+	SubState string
+	// UnitFileState is enabled, disabled, static, etc
+	UnitFileState string
+	// ExitStatus is the exit status of the main process of a service
+	ExitStatus int
+	// Restarts is the number of times systemd restarted a service
+	Restarts int
+}
+
+// unitPath returns the D-Bus path of a unit, loading it if needed
+func unitPath(name string) (string, error) {
+	path, err := busctl("call", systemdService, systemdPath, systemdManager,
+		"LoadUnit", "s", name)
+	if err != nil {
+		return "", err
+	}
+
+	return unquote(path), nil
+}
+
+// GetUnitStatus returns the state of a systemd unit
+func GetUnitStatus(name string) (UnitStatus, error) {
+	ret := UnitStatus{Name: name}
+
+	path, err := unitPath(name)
+	if err != nil {
+		return ret, err
+	}
+
+	for prop, v := range map[string]*string{
+		"ActiveState":   &ret.ActiveState,
+		"SubState":      &ret.SubState,
+		"UnitFileState": &ret.UnitFileState,
+	} {
+		s, err := busctl("get-property", systemdService, path, systemdUnit, prop)
+		if err != nil {
+			return ret, err
+		}
+		*v = unquote(s)
+	}
+
+	if strings.HasSuffix(name, ".service") {
+		for prop, v := range map[string]*int{
+			"ExecMainStatus": &ret.ExitStatus,
+			"NRestarts":      &ret.Restarts,
+		} {
+			s, err := busctl("get-property", systemdService, path, systemdSvc, prop)
+			if err != nil {
+				// NRestarts is not available on older systemd
+				continue
+			}
+			*v, _ = strconv.Atoi(s)
+		}
+	}
+
+	return ret, nil
+}
+
+// StartUnit starts a systemd unit
+func StartUnit(name string) error {
+	_, err := busctl("call", systemdService, systemdPath, systemdManager,
+		"StartUnit", "ss", name, "replace")
+	return err
+}
+
+// StopUnit stops a systemd unit
+func StopUnit(name string) error {
+	_, err := busctl("call", systemdService, systemdPath, systemdManager,
+		"StopUnit", "ss", name, "replace")
+	return err
+}
+
+// RestartUnit restarts a systemd unit, starting it if it is not running
+func RestartUnit(name string) error {
+	_, err := busctl("call", systemdService, systemdPath, systemdManager,
+		"RestartUnit", "ss", name, "replace")
+	return err
+}
+
+// EnableUnit enables a systemd unit so it starts at boot
+func EnableUnit(name string) error {
+	_, err := busctl("call", systemdService, systemdPath, systemdManager,
+		"EnableUnitFiles", "asbb", "1", name, "false", "true")
+	if err != nil {
+		return err
+	}
+
+	return reloadSystemd()
+}
+
+// DisableUnit disables a systemd unit so it does not start at boot
+func DisableUnit(name string) error {
+	_, err := busctl("call", systemdService, systemdPath, systemdManager,
+		"DisableUnitFiles", "asb", "1", name, "false")
+	if err != nil {
+		return err
+	}
+
+	return reloadSystemd()
+}
+
+func reloadSystemd() error {
+	_, err := busctl("call", systemdService, systemdPath, systemdManager,
+		"Reload")
+	return err
+}
+
+// UnitCommandRunner runs UnitCommands for an allowed set of units, so a
+// device command can't be used to stop arbitrary system services
+type UnitCommandRunner struct {
+	allowed map[string]bool
+}
+
+// NewUnitCommandRunner creates a runner for the allowed units. If units is
+// empty, all units are allowed.
+func NewUnitCommandRunner(units []string) *UnitCommandRunner {
+	r := &UnitCommandRunner{allowed: make(map[string]bool)}
+	for _, u := range units {
+		r.allowed[u] = true
+	}
+	return r
+}
+
+// Command runs a UnitCommand received from the server and returns the unit
+// status after the action, so the result can be reported to the server
+func (r *UnitCommandRunner) Command(cmd data.DeviceCommand) (UnitStatus, error) {
+	if cmd.Command != UnitCommand {
+		return UnitStatus{}, fmt.Errorf("unexpected command: %v", cmd.Command)
+	}
+
+	name := cmd.Args["name"]
+	if name == "" {
+		return UnitStatus{}, errors.New("name arg is required")
+	}
+
+	if len(r.allowed) > 0 && !r.allowed[name] {
+		return UnitStatus{}, fmt.Errorf("unit not allowed: %v", name)
+	}
+
+	var err error
+	switch cmd.Args["action"] {
+	case "", "status":
+	case "start":
+		err = StartUnit(name)
+	case "stop":
+		err = StopUnit(name)
+	case "restart":
+		err = RestartUnit(name)
+	case "enable":
+		err = EnableUnit(name)
+	case "disable":
+		err = DisableUnit(name)
+	default:
+		return UnitStatus{}, fmt.Errorf("invalid action: %v", cmd.Args["action"])
+	}
+
+	if err != nil {
+		return UnitStatus{}, err
+	}
+
+	return GetUnitStatus(name)
+}
@@ -1,27 +1,124 @@
 package system
 
 import (
-	"os/exec"
+	"errors"
+	"os"
+	"syscall"
 	"time"
 )
 
-// SetTime sets the system time to the
-// parameter t with the date command
-func SetTime(t time.Time) (err error) {
+// ErrPermission is returned when the process is not allowed to set the time
+var ErrPermission = errors.New("not permitted to set the time")
 
-	tStr := t.Format("2006-01-02 15:04:05")
+// ErrNoRTC is returned by SetTime when the system time was set, but there
+// is no real-time clock to save it in
+var ErrNoRTC = errors.New("no real-time clock")
 
-	err = exec.Command("date", "-s", tStr).Run()
+// ErrTimeUnsupported is returned when the time can't be set on this
+// platform, like macOS, which is only used for development
+var ErrTimeUnsupported = errors.New("setting the time is not supported on this platform")
+
+// errUnsupported is returned by the platform code when something is not
+// supported with syscalls on the platform
+var errUnsupported = errors.New("not supported")
+
+// RTCDevice is the real-time clock set by SetTime
+var RTCDevice = "/dev/rtc0"
+
+// the platform clock functions and the time source are variables so tests
+// can replace them
+var (
+	setClock = platformSetClock
+	setRTC   = platformSetRTC
+	readRTC  = platformReadRTC
+	timeNow  = time.Now
+)
+
+// SetTime sets the system time to the parameter t and saves it in the
+// real-time clock (RTC). The time is set with settimeofday and the RTC ioctl
+// on Linux, falling back to the date and hwclock commands if they fail for
+// reasons other than permissions or a missing RTC, and SetSystemTime on
+// Windows, which also updates the RTC.
+// ErrTimeUnsupported is returned on other platforms.
+func SetTime(t time.Time) error {
+	err := setSystemTime(t)
 	if err != nil {
 		return err
 	}
 
-	// Sync the real-time clock (RTC)
-	// Always store time in UTC on the RTC
-	err = exec.Command("hwclock", "-w", "-u").Run()
+	return SetRTC(t)
+}
+
+// setSystemTime sets the system time without changing the RTC
+func setSystemTime(t time.Time) error {
+	err := setClock(t)
+	if err == errUnsupported {
+		return ErrTimeUnsupported
+	}
+
+	if errors.Is(err, syscall.EPERM) {
+		return ErrPermission
+	}
+
+	return err
+}
+
+// SetRTC saves t in the real-time clock. The RTC always stores UTC.
+func SetRTC(t time.Time) error {
+	err := setRTC(t)
+
+	switch {
+	case err == errUnsupported:
+		return ErrTimeUnsupported
+	case errors.Is(err, os.ErrNotExist):
+		return ErrNoRTC
+	case errors.Is(err, os.ErrPermission):
+		return ErrPermission
+	}
+
+	return err
+}
+
+// ReadRTC returns the time in the real-time clock
+func ReadRTC() (time.Time, error) {
+	t, err := readRTC()
+
+	switch {
+	case errors.Is(err, os.ErrNotExist), err == errUnsupported:
+		return t, ErrNoRTC
+	case errors.Is(err, os.ErrPermission):
+		return t, ErrPermission
+	}
+
+	return t, err
+}
+
+// TimeSource returns the current time from a source other than the system
+// clock, like the cellular network
+type TimeSource func() (time.Time, error)
+
+// SetTimeFrom sets the system time from source if the system time is off
+// by more than maxDrift. set is true if the system time was changed, which
+// is also the case when ErrNoRTC is returned.
+func SetTimeFrom(source TimeSource, maxDrift time.Duration) (set bool, err error) {
+	t, err := source()
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	drift := timeNow().Sub(t)
+	if drift < 0 {
+		drift = -drift
+	}
+
+	if drift <= maxDrift {
+		return false, nil
+	}
+
+	err = SetTime(t)
+	if err != nil && err != ErrNoRTC {
+		return false, err
 	}
 
-	return nil
+	return true, err
 }
@@ -0,0 +1,90 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// settimeofday is a variable so tests can replace it
+var settimeofday = syscall.Settimeofday
+
+func platformSetClock(t time.Time) error {
+	tv := syscall.NsecToTimeval(t.UnixNano())
+	err := settimeofday(&tv)
+	if err == nil || errors.Is(err, syscall.EPERM) {
+		return err
+	}
+
+	// use UTC as the busybox and coreutils date commands parse the local
+	// time differently
+	tStr := t.UTC().Format("2006-01-02 15:04:05")
+	if cmdErr := exec.Command("date", "-u", "-s", tStr).Run(); cmdErr != nil {
+		return fmt.Errorf("settimeofday: %w, date: %v", err, cmdErr)
+	}
+
+	return nil
+}
+
+func platformSetRTC(t time.Time) error {
+	err := setRTCIoctl(t)
+	if err == nil || errors.Is(err, os.ErrNotExist) ||
+		errors.Is(err, os.ErrPermission) {
+		return err
+	}
+
+	// hwclock reads the system time, which SetTime has already set
+	if cmdErr := exec.Command("hwclock", "-w", "-u", "-f", RTCDevice).Run(); cmdErr != nil {
+		return fmt.Errorf("%w, hwclock: %v", err, cmdErr)
+	}
+
+	return nil
+}
+
+func setRTCIoctl(t time.Time) error {
+	f, err := os.OpenFile(RTCDevice, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	t = t.UTC()
+	rt := unix.RTCTime{
+		Sec:  int32(t.Second()),
+		Min:  int32(t.Minute()),
+		Hour: int32(t.Hour()),
+		Mday: int32(t.Day()),
+		Mon:  int32(t.Month()) - 1,
+		Year: int32(t.Year()) - 1900,
+		Wday: int32(t.Weekday()),
+		Yday: int32(t.YearDay()) - 1,
+	}
+
+	err = unix.IoctlSetRTCTime(int(f.Fd()), &rt)
+	if err != nil {
+		return os.NewSyscallError("RTC_SET_TIME", err)
+	}
+
+	return nil
+}
+
+func platformReadRTC() (time.Time, error) {
+	f, err := os.Open(RTCDevice)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	rt, err := unix.IoctlGetRTCTime(int(f.Fd()))
+	if err != nil {
+		return time.Time{}, os.NewSyscallError("RTC_RD_TIME", err)
+	}
+
+	return time.Date(int(rt.Year)+1900, time.Month(rt.Mon+1), int(rt.Mday),
+		int(rt.Hour), int(rt.Min), int(rt.Sec), 0, time.UTC), nil
+}
@@ -0,0 +1,98 @@
+package system
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeCommands writes scripts to dir that record their args in dir/calls
+func fakeCommands(t *testing.T, dir string, names ...string) {
+	for _, name := range names {
+		script := "#!/bin/sh\necho " + name + " \"$@\" >> " +
+			path.Join(dir, "calls") + "\n"
+		err := ioutil.WriteFile(path.Join(dir, name), []byte(script), 0755)
+		if err != nil {
+			t.Fatal("Error writing script: ", err)
+		}
+	}
+}
+
+func TestSetTimeFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siot-time")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fakeCommands(t, dir, "date", "hwclock")
+
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+
+	oldSettimeofday := settimeofday
+	defer func() { settimeofday = oldSettimeofday }()
+
+	oldRTCDevice := RTCDevice
+	defer func() { RTCDevice = oldRTCDevice }()
+
+	// a regular file is not an RTC, so the ioctl fails with ENOTTY and
+	// hwclock is used
+	rtc := path.Join(dir, "rtc0")
+	err = ioutil.WriteFile(rtc, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tm := time.Date(2020, 6, 1, 12, 30, 45, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		tvErr  error
+		rtc    string
+		exp    error
+		expCmd string
+	}{
+		{"settimeofday ok", nil, rtc, nil,
+			"hwclock -w -u -f " + rtc + "\n"},
+		{"no permission", syscall.EPERM, rtc, ErrPermission, ""},
+		{"settimeofday fails", syscall.EINVAL, rtc, nil,
+			"date -u -s 2020-06-01 12:30:45\nhwclock -w -u -f " + rtc + "\n"},
+		{"no rtc", syscall.EINVAL, path.Join(dir, "missing"), ErrNoRTC,
+			"date -u -s 2020-06-01 12:30:45\n"},
+	}
+
+	for _, test := range tests {
+		os.Remove(path.Join(dir, "calls"))
+
+		tvErr := test.tvErr
+		settimeofday = func(tv *syscall.Timeval) error { return tvErr }
+		RTCDevice = test.rtc
+
+		err := SetTime(tm)
+		if err != test.exp {
+			t.Errorf("%v: SetTime returned %v, expected %v", test.name, err,
+				test.exp)
+		}
+
+		calls, _ := ioutil.ReadFile(path.Join(dir, "calls"))
+		if string(calls) != test.expCmd {
+			t.Errorf("%v: commands run:\n%s\nexpected:\n%v", test.name, calls,
+				test.expCmd)
+		}
+	}
+
+	// the ioctl and hwclock both fail
+	os.Remove(path.Join(dir, "hwclock"))
+	settimeofday = func(tv *syscall.Timeval) error { return nil }
+	RTCDevice = rtc
+
+	err = SetTime(tm)
+	if err == nil || !strings.Contains(err.Error(), "hwclock") {
+		t.Error("expected hwclock error, got: ", err)
+	}
+}
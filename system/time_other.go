@@ -0,0 +1,18 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package system
+
+import "time"
+
+func platformSetClock(t time.Time) error {
+	return errUnsupported
+}
+
+func platformSetRTC(t time.Time) error {
+	return errUnsupported
+}
+
+func platformReadRTC() (time.Time, error) {
+	return time.Time{}, errUnsupported
+}
@@ -0,0 +1,149 @@
+package system
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// stubClock replaces the platform clock functions, and returns a function
+// that restores them
+func stubClock(clockErr, rtcErr error) func() {
+	oldSetClock, oldSetRTC, oldReadRTC := setClock, setRTC, readRTC
+
+	setClock = func(t time.Time) error { return clockErr }
+	setRTC = func(t time.Time) error { return rtcErr }
+	readRTC = func() (time.Time, error) { return time.Time{}, rtcErr }
+
+	return func() {
+		setClock, setRTC, readRTC = oldSetClock, oldSetRTC, oldReadRTC
+	}
+}
+
+func TestSetTimeErrors(t *testing.T) {
+	notExist := &os.PathError{Op: "open", Path: "/dev/rtc0", Err: os.ErrNotExist}
+	denied := &os.PathError{Op: "open", Path: "/dev/rtc0", Err: os.ErrPermission}
+	other := errors.New("other")
+
+	tests := []struct {
+		name     string
+		clockErr error
+		rtcErr   error
+		exp      error
+	}{
+		{"ok", nil, nil, nil},
+		{"clock unsupported", errUnsupported, nil, ErrTimeUnsupported},
+		{"clock EPERM", syscall.EPERM, nil, ErrPermission},
+		{"clock wrapped EPERM", os.NewSyscallError("settimeofday", syscall.EPERM),
+			nil, ErrPermission},
+		{"clock other", other, nil, other},
+		{"rtc unsupported", nil, errUnsupported, ErrTimeUnsupported},
+		{"no rtc", nil, notExist, ErrNoRTC},
+		{"rtc denied", nil, denied, ErrPermission},
+		{"rtc other", nil, other, other},
+		// the RTC is not set if the system time can't be set
+		{"clock and rtc", syscall.EPERM, notExist, ErrPermission},
+	}
+
+	for _, test := range tests {
+		restore := stubClock(test.clockErr, test.rtcErr)
+		err := SetTime(time.Now())
+		restore()
+
+		if err != test.exp {
+			t.Errorf("%v: SetTime returned %v, expected %v", test.name, err,
+				test.exp)
+		}
+	}
+}
+
+func TestReadRTCErrors(t *testing.T) {
+	tests := []struct {
+		rtcErr error
+		exp    error
+	}{
+		{nil, nil},
+		{errUnsupported, ErrNoRTC},
+		{&os.PathError{Op: "open", Path: "/dev/rtc0", Err: os.ErrNotExist}, ErrNoRTC},
+		{&os.PathError{Op: "open", Path: "/dev/rtc0", Err: os.ErrPermission}, ErrPermission},
+	}
+
+	for _, test := range tests {
+		restore := stubClock(nil, test.rtcErr)
+		_, err := ReadRTC()
+		restore()
+
+		if err != test.exp {
+			t.Errorf("rtc error %v: ReadRTC returned %v, expected %v",
+				test.rtcErr, err, test.exp)
+		}
+	}
+}
+
+func TestSetTimeFrom(t *testing.T) {
+	oldSetClock, oldSetRTC, oldTimeNow := setClock, setRTC, timeNow
+	defer func() {
+		setClock, setRTC, timeNow = oldSetClock, oldSetRTC, oldTimeNow
+	}()
+
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+
+	notExist := &os.PathError{Op: "open", Path: "/dev/rtc0", Err: os.ErrNotExist}
+	errSource := errors.New("no network time")
+
+	tests := []struct {
+		name      string
+		offset    time.Duration
+		sourceErr error
+		clockErr  error
+		rtcErr    error
+		expSet    bool
+		expErr    error
+		expClock  bool
+		expRTC    bool
+	}{
+		{"within drift", 4 * time.Second, nil, nil, nil, false, nil, false, false},
+		{"at drift", -5 * time.Second, nil, nil, nil, false, nil, false, false},
+		{"ahead", 6 * time.Second, nil, nil, nil, true, nil, true, true},
+		{"behind", -time.Minute, nil, nil, nil, true, nil, true, true},
+		{"source error", time.Minute, errSource, nil, nil, false, errSource, false, false},
+		{"no permission", time.Minute, nil, syscall.EPERM, nil, false, ErrPermission, true, false},
+		// the system time is still set on boards without an RTC
+		{"no rtc", time.Minute, nil, nil, notExist, true, ErrNoRTC, true, true},
+	}
+
+	for _, test := range tests {
+		var clockSet, rtcSet time.Time
+		clockErr, rtcErr := test.clockErr, test.rtcErr
+		setClock = func(t time.Time) error {
+			clockSet = t
+			return clockErr
+		}
+		setRTC = func(t time.Time) error {
+			rtcSet = t
+			return rtcErr
+		}
+
+		source := now.Add(test.offset)
+		sourceErr := test.sourceErr
+		set, err := SetTimeFrom(func() (time.Time, error) {
+			return source, sourceErr
+		}, 5*time.Second)
+
+		if set != test.expSet || err != test.expErr {
+			t.Errorf("%v: SetTimeFrom returned %v, %v, expected %v, %v",
+				test.name, set, err, test.expSet, test.expErr)
+		}
+
+		if test.expClock != clockSet.Equal(source) {
+			t.Errorf("%v: system time set to %v", test.name, clockSet)
+		}
+
+		if test.expRTC != rtcSet.Equal(source) {
+			t.Errorf("%v: RTC set to %v", test.name, rtcSet)
+		}
+	}
+}
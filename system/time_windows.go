@@ -0,0 +1,50 @@
+package system
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// systemTime is SYSTEMTIME from minwinbase.h
+type systemTime struct {
+	year, month, dayOfWeek, day, hour, minute, second, milliseconds uint16
+}
+
+// ERROR_PRIVILEGE_NOT_HELD
+const errPrivilegeNotHeld = syscall.Errno(1314)
+
+var procSetSystemTime = syscall.NewLazyDLL("kernel32.dll").NewProc("SetSystemTime")
+
+func platformSetClock(t time.Time) error {
+	t = t.UTC()
+	st := systemTime{
+		year:         uint16(t.Year()),
+		month:        uint16(t.Month()),
+		dayOfWeek:    uint16(t.Weekday()),
+		day:          uint16(t.Day()),
+		hour:         uint16(t.Hour()),
+		minute:       uint16(t.Minute()),
+		second:       uint16(t.Second()),
+		milliseconds: uint16(t.Nanosecond() / int(time.Millisecond)),
+	}
+
+	r, _, err := procSetSystemTime.Call(uintptr(unsafe.Pointer(&st)))
+	if r == 0 {
+		if err == errPrivilegeNotHeld {
+			return ErrPermission
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Windows saves the system time in the RTC
+func platformSetRTC(t time.Time) error {
+	return nil
+}
+
+func platformReadRTC() (time.Time, error) {
+	return time.Time{}, errUnsupported
+}
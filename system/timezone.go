@@ -1,14 +1,19 @@
 package system
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"regexp"
+	"strings"
 )
 
 // ReadTimezones returns a list of possible time zones
 // from the system
 // Possible arguments for zoneInfoDir:
+//
 //	"" (root dir)
 //	"US"
 //	"posix/America"
@@ -62,24 +67,76 @@ func GetTimezone() (zoneInfoDir, zone string, err error) {
 
 // SetTimezone sets the current system time zone
 func SetTimezone(zoneInfoDir, zone string) (err error) {
+	return SetTimezoneName(path.Join(zoneInfoDir, zone))
+}
 
-	if _, err := os.Lstat(zoneLink); err == nil {
-		err := os.Remove(zoneLink)
-		if err != nil {
-			return err
-		}
+// GetTimezoneName returns the current system timezone as a tzdata name
+// like America/New_York
+func GetTimezoneName() (string, error) {
+	zoneInfoDir, zone, err := GetTimezone()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(zoneInfoDir, zone), nil
+}
+
+// ValidateTimezone returns an error if name is not a time zone in the
+// system tzdata database
+func ValidateTimezone(name string) error {
+	if name == "" || path.IsAbs(name) || path.Clean(name) != name ||
+		strings.HasPrefix(name, "..") {
+		return fmt.Errorf("invalid time zone: %v", name)
 	}
 
-	err = os.Symlink(path.Join(zoneInfoPath, zoneInfoDir, zone), zoneLink)
+	f, err := os.Open(path.Join(zoneInfoPath, name))
 	if err != nil {
-		return err
+		return fmt.Errorf("unknown time zone: %v", name)
+	}
+	defer f.Close()
+
+	// tzdata files start with a magic number
+	magic := make([]byte, 4)
+	_, err = io.ReadFull(f, magic)
+	if err != nil || string(magic) != "TZif" {
+		return fmt.Errorf("unknown time zone: %v", name)
 	}
 
 	return nil
 }
 
+// SetTimezoneName sets the current system time zone to a tzdata name like
+// America/New_York. /etc/localtime is linked to the zone file and the name
+// is written to /etc/timezone.
+func SetTimezoneName(name string) error {
+	err := ValidateTimezone(name)
+	if err != nil {
+		return err
+	}
+
+	// replace the link atomically so there is always a valid time zone
+	tmp := zoneLink + ".tmp"
+	os.Remove(tmp)
+
+	err = os.Symlink(path.Join(zoneInfoPath, name), tmp)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, zoneLink)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return ioutil.WriteFile(zoneFile, []byte(name+"\n"), 0644)
+}
+
 // Path to zoneinfo
 const zoneInfoPath = "/usr/share/zoneinfo/"
 
 // Symbolic link for the system timezone
 const zoneLink = "/etc/localtime"
+
+// File with the name of the system timezone
+const zoneFile = "/etc/timezone"
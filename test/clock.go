@@ -0,0 +1,72 @@
+package test
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a fake clock for the rules engine. Time only moves when Advance
+// is called, so time based conditions can be tested without sleeping.
+type Clock struct {
+	lock sync.Mutex
+	now  time.Time
+	tick chan time.Time
+	stop chan struct{}
+}
+
+// NewClock returns a clock set to now
+func NewClock(now time.Time) *Clock {
+	return &Clock{
+		now:  now,
+		tick: make(chan time.Time),
+		stop: make(chan struct{}),
+	}
+}
+
+// Now returns the time of the clock
+func (c *Clock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// Tick returns the channel that receives a tick each time the clock is
+// advanced
+func (c *Clock) Tick() <-chan time.Time {
+	return c.tick
+}
+
+// Advance ticks at the current time, so the rules engine sees what was
+// written before, then moves the clock forward by d and ticks again. It
+// returns once the ticks have been received, or the clock is stopped.
+func (c *Clock) Advance(d time.Duration) {
+	c.lock.Lock()
+	now := c.now
+	c.lock.Unlock()
+
+	if !c.send(now) {
+		return
+	}
+
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	now = c.now
+	c.lock.Unlock()
+
+	c.send(now)
+}
+
+func (c *Clock) send(now time.Time) bool {
+	select {
+	case c.tick <- now:
+		return true
+	case <-c.stop:
+		return false
+	}
+}
+
+// Stop stops the clock, so Advance no longer waits for the tick to be
+// received
+func (c *Clock) Stop() {
+	close(c.stop)
+}
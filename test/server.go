@@ -0,0 +1,233 @@
+// Package test runs a SIOT server in the test process, so adapter and
+// client authors can write integration tests for claiming, ingest,
+// commands, and rules without external services. The store is a db in a
+// temp dir, HTTP and NATS listen on the loopback interface, and the rules
+// engine runs on a fake clock. Tests wait for changes with a Watcher
+// instead of sleeping.
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"github.com/simpleiot/simpleiot/api"
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/nats"
+	"github.com/simpleiot/simpleiot/rules"
+)
+
+// Timeout is how long a Watcher waits for an event before giving up
+var Timeout = 5 * time.Second
+
+// Server is a SIOT server for tests
+type Server struct {
+	// Db is the server database
+	Db *db.Db
+	// Clock is the clock of the rules engine
+	Clock *Clock
+	// URL is the HTTP URL of the server, used as client.Config.Server
+	URL string
+	// NATS is the NATS URL of the server, used as client.Config.NATS
+	NATS string
+	// Notifications receives the notifications sent by rules
+	Notifications chan data.Notification
+
+	dir    string
+	http   *httptest.Server
+	nats   *nats.Server
+	bridge *nats.Bridge
+	engine *rules.Engine
+}
+
+// NewServer starts a server. Close must be called when the test is done.
+func NewServer() (*Server, error) {
+	dir, err := ioutil.TempDir("", "siot-test")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Clock:         NewClock(time.Now()),
+		Notifications: make(chan data.Notification, 100),
+		dir:           dir,
+	}
+
+	s.Db, err = db.NewDb(dir, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	s.http = httptest.NewServer(http.StripPrefix("/v1",
+		api.NewV1Handler(api.ServerArgs{DbInst: s.Db})))
+	s.URL = s.http.URL
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	s.nats = nats.NewServer(nats.ServerConfig{})
+	go s.nats.Serve(l)
+	s.NATS = "nats://" + l.Addr().String()
+
+	s.bridge = nats.NewBridge(s.nats, s.Db, nats.BridgeConfig{
+		Write: s.writeContext,
+		WriteBatch: func(ctx context.Context, id string, batch data.SampleBatch) error {
+			return api.WriteBatchContext(ctx, s.Db, nil, id, batch)
+		},
+	})
+	err = s.bridge.Start()
+	if err != nil {
+		s.bridge = nil
+		s.Close()
+		return nil, err
+	}
+
+	s.engine = rules.NewEngine(s.Db, rules.Config{
+		Write: s.Write,
+		Notify: func(n data.Notification) error {
+			select {
+			case s.Notifications <- n:
+				return nil
+			default:
+				return errors.New("too many notifications")
+			}
+		},
+		Now:  s.Clock.Now,
+		Tick: s.Clock.Tick(),
+	})
+	err = s.engine.Start()
+	if err != nil {
+		s.engine = nil
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Close stops the server and removes its data
+func (s *Server) Close() {
+	s.Clock.Stop()
+
+	if s.engine != nil {
+		s.engine.Stop()
+	}
+
+	if s.bridge != nil {
+		s.bridge.Stop()
+	}
+
+	if s.nats != nil {
+		s.nats.Close()
+	}
+
+	if s.http != nil {
+		s.http.Close()
+	}
+
+	if s.Db != nil {
+		s.Db.Close()
+	}
+
+	os.RemoveAll(s.dir)
+}
+
+// Write stores samples from a device, like they were sent by the device
+func (s *Server) Write(id string, samples []data.Sample) error {
+	return s.writeContext(context.Background(), id, samples)
+}
+
+func (s *Server) writeContext(ctx context.Context, id string, samples []data.Sample) error {
+	return api.WriteSamplesContext(ctx, s.Db, nil, id, samples)
+}
+
+// Claim claims a device with its claim code. The device does not need to
+// have registered yet, it gets its key the next time it registers. Claim
+// is called once for each device.
+func (s *Server) Claim(id, code string) error {
+	_, err := s.Db.Register(id, code, "")
+	if err != db.ErrNotClaimed {
+		if err == nil {
+			err = fmt.Errorf("device %v was already claimed", id)
+		}
+		return err
+	}
+
+	return s.Db.RegistrationClaim(id, code)
+}
+
+// Command queues a command for a device
+func (s *Server) Command(id, command string, args map[string]string) (data.DeviceCommand, error) {
+	return s.Db.CommandEnqueue(data.DeviceCommand{
+		DeviceID: id,
+		Command:  command,
+		Args:     args,
+	})
+}
+
+// ClientConfig returns the config of a client connected to the server, with
+// short intervals so tests don't wait. The device registers with code.
+func (s *Server) ClientConfig(id, code string) client.Config {
+	return client.Config{
+		ID:              id,
+		ClaimCode:       code,
+		Server:          s.URL,
+		NATS:            s.NATS,
+		BacklogInterval: 10 * time.Millisecond,
+		FlushInterval:   10 * time.Millisecond,
+		PollInterval:    10 * time.Millisecond,
+		KeyInterval:     10 * time.Millisecond,
+		RetryInterval:   10 * time.Millisecond,
+	}
+}
+
+// Watcher receives the change events of the server db. Create the watcher
+// before the change it waits for.
+type Watcher struct {
+	db     *db.Db
+	events <-chan db.Event
+}
+
+// Watch returns a watcher for the events matching filter
+func (s *Server) Watch(filter db.EventFilter) *Watcher {
+	return &Watcher{db: s.Db, events: s.Db.Subscribe(filter)}
+}
+
+// Next waits for an event that cond returns true for, or any event if cond
+// is nil. Returns an error after Timeout.
+func (w *Watcher) Next(cond func(e db.Event) bool) (db.Event, error) {
+	timeout := time.NewTimer(Timeout)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case e, ok := <-w.events:
+			if !ok {
+				return db.Event{}, errors.New("watcher closed")
+			}
+
+			if cond == nil || cond(e) {
+				return e, nil
+			}
+		case <-timeout.C:
+			return db.Event{}, errors.New("timeout waiting for event")
+		}
+	}
+}
+
+// Close stops the watcher
+func (w *Watcher) Close() {
+	w.db.Unsubscribe(w.events)
+}
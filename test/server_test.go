@@ -0,0 +1,140 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+func TestServer(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal("Error starting server: ", err)
+	}
+	defer s.Close()
+
+	err = s.Claim("dev1", "code1")
+	if err != nil {
+		t.Fatal("Error claiming device: ", err)
+	}
+
+	commands := make(chan data.DeviceCommand, 10)
+	config := s.ClientConfig("dev1", "code1")
+	config.OnCommand = func(cmd data.DeviceCommand) error {
+		commands <- cmd
+		return nil
+	}
+
+	c, err := client.New(config)
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+
+	samples := s.Watch(db.EventFilter{DeviceID: "dev1",
+		Types: []db.EventType{db.EventSampleWritten}})
+	defer samples.Close()
+
+	c.Start()
+	defer c.Stop()
+
+	c.Send(data.Sample{Type: "temp", Value: 21})
+
+	e, err := samples.Next(nil)
+	if err != nil {
+		t.Fatal("Error waiting for sample: ", err)
+	}
+
+	if e.Sample.Type != "temp" || e.Sample.Value != 21 {
+		t.Errorf("wrong sample: %+v", e.Sample)
+	}
+
+	_, err = s.Command("dev1", "reboot", nil)
+	if err != nil {
+		t.Fatal("Error queuing command: ", err)
+	}
+
+	select {
+	case cmd := <-commands:
+		if cmd.Command != "reboot" {
+			t.Error("wrong command: ", cmd)
+		}
+	case <-time.After(Timeout):
+		t.Fatal("timeout waiting for command")
+	}
+
+	rule, err := s.Db.RuleInsert(data.Rule{
+		Description: "too hot",
+		Conditions: []data.RuleCondition{{Type: data.RuleConditionValue,
+			DeviceID: "dev1", SampleType: "temp", Operator: ">", Value: 30,
+			MinDuration: "10m"}},
+		Actions: []data.RuleAction{{Type: data.RuleActionNotify}},
+	})
+	if err != nil {
+		t.Fatal("Error inserting rule: ", err)
+	}
+
+	alerts := s.Watch(db.EventFilter{Types: []db.EventType{db.EventAlertChanged}})
+	defer alerts.Close()
+
+	err = s.Write("dev1", []data.Sample{{Type: "temp", Value: 35}})
+	if err != nil {
+		t.Fatal("Error writing sample: ", err)
+	}
+
+	// not active until the condition has been met for 10m
+	s.Clock.Advance(5 * time.Minute)
+	s.Clock.Advance(5 * time.Minute)
+
+	e, err = alerts.Next(func(e db.Event) bool {
+		return e.Alert.RuleID == rule.ID
+	})
+	if err != nil {
+		t.Fatal("Error waiting for alert: ", err)
+	}
+
+	if !e.Alert.Raised.Equal(s.Clock.Now()) {
+		t.Errorf("alert raised at %v, expected %v", e.Alert.Raised, s.Clock.Now())
+	}
+
+	select {
+	case n := <-s.Notifications:
+		if !n.Active || n.RuleID != rule.ID || n.DeviceID != "dev1" {
+			t.Errorf("wrong notification: %+v", n)
+		}
+	case <-time.After(Timeout):
+		t.Fatal("timeout waiting for notification")
+	}
+}
+
+func TestClock(t *testing.T) {
+	start := time.Now()
+	c := NewClock(start)
+
+	var ticks []time.Time
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2; i++ {
+			ticks = append(ticks, <-c.Tick())
+		}
+		close(done)
+	}()
+
+	c.Advance(time.Minute)
+	<-done
+
+	if len(ticks) != 2 || !ticks[0].Equal(start) ||
+		!ticks[1].Equal(start.Add(time.Minute)) {
+		t.Errorf("wrong ticks: %v", ticks)
+	}
+
+	if !c.Now().Equal(start.Add(time.Minute)) {
+		t.Error("wrong time: ", c.Now())
+	}
+
+	// Advance does not block once the clock is stopped
+	c.Stop()
+	c.Advance(time.Minute)
+}
@@ -0,0 +1,19 @@
+package trace
+
+import (
+	"context"
+	"net/http"
+)
+
+// Inject adds the traceparent of the span in ctx to HTTP headers
+func Inject(ctx context.Context, h http.Header) {
+	if v := Traceparent(ctx); v != "" {
+		h.Set(TraceparentHeader, v)
+	}
+}
+
+// Extract returns a context with the remote parent in HTTP headers, if
+// they have a valid traceparent
+func Extract(ctx context.Context, h http.Header) context.Context {
+	return ContextWithTraceparent(ctx, h.Get(TraceparentHeader))
+}
@@ -0,0 +1,335 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// define OTLP exporter defaults
+const (
+	otlpQueueSize     = 2048
+	otlpBatchSize     = 512
+	otlpFlushInterval = 5 * time.Second
+	otlpTimeout       = 10 * time.Second
+)
+
+// OTLPConfig describes an OTLP exporter
+type OTLPConfig struct {
+	// Endpoint is the base URL of the collector, like
+	// http://localhost:4318. Spans are posted to Endpoint/v1/traces.
+	Endpoint string
+	// Service is the service.name resource attribute
+	Service string
+	// Headers are added to requests, like for collector authentication
+	Headers map[string]string
+	// Client is the HTTP client, or nil for a default client
+	Client *http.Client
+	// FlushInterval is how often spans are sent. Spans are also sent when
+	// a full batch is queued.
+	FlushInterval time.Duration
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector with OTLP/HTTP in
+// JSON encoding. Spans are queued and sent in batches, and are dropped if
+// the queue is full, so a slow or missing collector does not slow down
+// the application.
+type OTLPExporter struct {
+	config OTLPConfig
+	url    string
+	queue  chan SpanData
+	stop   chan struct{}
+	done   chan struct{}
+
+	lock     sync.Mutex
+	stopped  bool
+	dropped  uint64
+	exported uint64
+}
+
+// NewOTLPExporter returns an exporter and starts sending spans
+func NewOTLPExporter(config OTLPConfig) *OTLPExporter {
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: otlpTimeout}
+	}
+
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = otlpFlushInterval
+	}
+
+	if config.Service == "" {
+		config.Service = "siot"
+	}
+
+	e := &OTLPExporter{
+		config: config,
+		url:    strings.TrimRight(config.Endpoint, "/") + "/v1/traces",
+		queue:  make(chan SpanData, otlpQueueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go e.run()
+
+	return e
+}
+
+// Export queues a span to be sent
+func (e *OTLPExporter) Export(s SpanData) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.stopped {
+		return
+	}
+
+	select {
+	case e.queue <- s:
+	default:
+		e.dropped++
+	}
+}
+
+// Stats returns the number of spans sent to the collector, and dropped
+// because the queue was full
+func (e *OTLPExporter) Stats() (exported, dropped uint64) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.exported, e.dropped
+}
+
+// Stop sends queued spans and stops the exporter
+func (e *OTLPExporter) Stop() {
+	e.lock.Lock()
+	if e.stopped {
+		e.lock.Unlock()
+		return
+	}
+	e.stopped = true
+	e.lock.Unlock()
+
+	close(e.stop)
+	<-e.done
+}
+
+func (e *OTLPExporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.config.FlushInterval)
+	defer ticker.Stop()
+
+	var batch []SpanData
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		err := e.send(batch)
+		if err != nil {
+			log.Printf("trace: error exporting %v spans: %v\n", len(batch), err)
+		} else {
+			e.lock.Lock()
+			e.exported += uint64(len(batch))
+			e.lock.Unlock()
+		}
+
+		batch = nil
+	}
+
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= otlpBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.stop:
+			for {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *OTLPExporter) send(spans []SpanData) error {
+	body, err := json.Marshal(otlpRequest(e.config.Service, spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("collector error: %v %v", resp.Status,
+			strings.TrimSpace(string(b)))
+	}
+
+	return nil
+}
+
+// the types below are the OTLP JSON encoding of an export request
+
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              Kind       `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+// status codes
+const (
+	otlpStatusUnset = 0
+	otlpStatusError = 2
+)
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue is an attribute value. 64 bit integers are strings in OTLP
+// JSON.
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func newOtlpValue(v interface{}) otlpValue {
+	var i int64
+	switch v := v.(type) {
+	case string:
+		return otlpValue{StringValue: &v}
+	case bool:
+		return otlpValue{BoolValue: &v}
+	case float64:
+		return otlpValue{DoubleValue: &v}
+	case float32:
+		f := float64(v)
+		return otlpValue{DoubleValue: &f}
+	case int:
+		i = int64(v)
+	case int32:
+		i = int64(v)
+	case int64:
+		i = v
+	case uint32:
+		i = int64(v)
+	case uint64:
+		s := strconv.FormatUint(v, 10)
+		return otlpValue{IntValue: &s}
+	default:
+		s := fmt.Sprint(v)
+		return otlpValue{StringValue: &s}
+	}
+
+	s := strconv.FormatInt(i, 10)
+	return otlpValue{IntValue: &s}
+}
+
+func otlpAttrs(attrs []Attr) []otlpAttr {
+	var ret []otlpAttr
+	for _, a := range attrs {
+		ret = append(ret, otlpAttr{Key: a.Key, Value: newOtlpValue(a.Value)})
+	}
+	return ret
+}
+
+func otlpRequest(service string, spans []SpanData) otlpExport {
+	ss := otlpScopeSpans{Scope: otlpScope{Name: "github.com/simpleiot/simpleiot/trace"}}
+
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.TraceID.String(),
+			SpanID:            s.SpanID.String(),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttrs(s.Attrs),
+			Status:            otlpStatus{Code: otlpStatusUnset},
+		}
+
+		if s.Parent != (SpanID{}) {
+			span.ParentSpanID = s.Parent.String()
+		}
+
+		if s.Error != "" {
+			span.Status = otlpStatus{Code: otlpStatusError, Message: s.Error}
+		}
+
+		ss.Spans = append(ss.Spans, span)
+	}
+
+	return otlpExport{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttrs([]Attr{
+			{"service.name", service},
+		})},
+		ScopeSpans: []otlpScopeSpans{ss},
+	}}}
+}
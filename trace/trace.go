@@ -0,0 +1,388 @@
+// Package trace records spans for operations like sample ingest and store
+// writes, so slow requests can be followed end to end. Spans are exported
+// with the OpenTelemetry protocol (OTLP), and span contexts are propagated
+// with the W3C traceparent header.
+//
+// Tracing is off until a Tracer is set with SetTracer. While it is off,
+// Start returns a nil span, and all span methods can be called on a nil
+// span, so instrumented code does not need to check.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceID identifies all spans of a trace
+type TraceID [16]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// SpanID identifies a span in a trace
+type SpanID [8]byte
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// SpanContext is the part of a span that is propagated to child spans,
+// including spans in other processes
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Sampled is true if the trace is recorded
+	Sampled bool
+}
+
+// IsValid returns true if the trace and span IDs are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Kind describes the relationship of a span to its parent and children.
+// The values match OTLP.
+type Kind int
+
+// define span kinds
+const (
+	KindInternal Kind = iota + 1
+	KindServer
+	KindClient
+	KindProducer
+	KindConsumer
+)
+
+// Attr is a span attribute. Values can be strings, bools, integers or
+// floats.
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+// SpanData is a finished span, as passed to the exporter
+type SpanData struct {
+	SpanContext
+	Parent SpanID
+	Name   string
+	Kind   Kind
+	Start  time.Time
+	End    time.Time
+	Attrs  []Attr
+	// Error is the error the span ended with, or blank
+	Error string
+}
+
+// Exporter sends finished spans to a collector. Export is called when a
+// span ends, so it should not block.
+type Exporter interface {
+	Export(s SpanData)
+}
+
+// Tracer creates spans and passes them to an exporter
+type Tracer struct {
+	exporter Exporter
+	ratio    float64
+
+	lock sync.Mutex
+	rand *mrand.Rand
+}
+
+// NewTracer returns a tracer that samples ratio (0 to 1) of new traces.
+// Spans with a parent are sampled if the parent is, so traces are
+// recorded completely or not at all.
+func NewTracer(exporter Exporter, ratio float64) *Tracer {
+	var seed int64
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err == nil {
+		seed = int64(binary.BigEndian.Uint64(b[:]))
+	} else {
+		seed = time.Now().UnixNano()
+	}
+
+	return &Tracer{
+		exporter: exporter,
+		ratio:    ratio,
+		rand:     mrand.New(mrand.NewSource(seed)),
+	}
+}
+
+// sample decides if a new trace is recorded
+func (t *Tracer) sample() bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	if t.ratio <= 0 {
+		return false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.rand.Float64() < t.ratio
+}
+
+func (t *Tracer) randBytes(b []byte) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.rand.Read(b)
+}
+
+func (t *Tracer) newSpanID() SpanID {
+	var id SpanID
+	for id == (SpanID{}) {
+		t.randBytes(id[:])
+	}
+	return id
+}
+
+func (t *Tracer) newTraceID() TraceID {
+	var id TraceID
+	for id == (TraceID{}) {
+		t.randBytes(id[:])
+	}
+	return id
+}
+
+var (
+	globalLock sync.RWMutex
+	global     *Tracer
+)
+
+// SetTracer sets the tracer used by Start. A nil tracer turns tracing off.
+func SetTracer(t *Tracer) {
+	globalLock.Lock()
+	defer globalLock.Unlock()
+	global = t
+}
+
+func tracer() *Tracer {
+	globalLock.RLock()
+	defer globalLock.RUnlock()
+	return global
+}
+
+// Span is an operation in a trace. A nil span is valid and does nothing.
+type Span struct {
+	tracer *Tracer
+	data   SpanData
+
+	lock  sync.Mutex
+	ended bool
+}
+
+type spanKey struct{}
+
+// remoteKey is used for a span context from another process
+type remoteKey struct{}
+
+// Start starts a span that is a child of the span in ctx, if any, and
+// returns a context with the new span. The span must be ended with End.
+// Start returns a nil span if tracing is off.
+func Start(ctx context.Context, name string, kind Kind, attrs ...Attr) (context.Context, *Span) {
+	t := tracer()
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &Span{tracer: t, data: SpanData{
+		Name:  name,
+		Kind:  kind,
+		Start: time.Now(),
+		Attrs: attrs,
+	}}
+
+	if parent := SpanContextFrom(ctx); parent.IsValid() {
+		s.data.TraceID = parent.TraceID
+		s.data.Parent = parent.SpanID
+		s.data.Sampled = parent.Sampled
+	} else {
+		s.data.TraceID = t.newTraceID()
+		s.data.Sampled = t.sample()
+	}
+
+	s.data.SpanID = t.newSpanID()
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// FromContext returns the span in ctx, or nil
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// SpanContextFrom returns the context of the span in ctx, or of a remote
+// parent added with ContextWithRemote. It is not valid if there is
+// neither.
+func SpanContextFrom(ctx context.Context) SpanContext {
+	if s := FromContext(ctx); s != nil {
+		return s.data.SpanContext
+	}
+
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+// ContextWithRemote returns a context with a parent span from another
+// process, so spans started with it continue that trace
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Context returns the context of the span
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.SpanContext
+}
+
+// SetName changes the name of the span, for names that aren't known
+// until the operation is done
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data.Name = name
+}
+
+// SetAttr sets an attribute of the span
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil || !s.data.Sampled {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data.Attrs = append(s.data.Attrs, Attr{key, value})
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data.Error = err.Error()
+}
+
+// End ends the span and exports it if the trace is sampled. If err is not
+// nil and points to an error, the span is marked as failed. It is designed
+// to be deferred with a named error return:
+//
+//	ctx, span := trace.Start(ctx, "Op", trace.KindInternal)
+//	defer span.End(&err)
+func (s *Span) End(err *error) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	if err != nil && *err != nil {
+		s.data.Error = (*err).Error()
+	}
+	d := s.data
+	s.lock.Unlock()
+
+	if d.Sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.Export(d)
+	}
+}
+
+// TraceparentHeader is the W3C trace context header
+const TraceparentHeader = "traceparent"
+
+// Format returns sc as a W3C traceparent value, or blank if sc is not
+// valid
+func Format(sc SpanContext) string {
+	if !sc.IsValid() {
+		return ""
+	}
+
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+
+	return fmt.Sprintf("00-%v-%v-%v", sc.TraceID, sc.SpanID, flags)
+}
+
+var errTraceparent = errors.New("invalid traceparent")
+
+// Parse parses a W3C traceparent value
+func Parse(v string) (SpanContext, error) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		(parts[0] == "00" && len(parts) != 4) {
+		return sc, errTraceparent
+	}
+
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, errTraceparent
+	}
+
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, errTraceparent
+	}
+
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, errTraceparent
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, errTraceparent
+	}
+	sc.Sampled = flags[0]&1 == 1
+
+	if !sc.IsValid() {
+		return sc, errTraceparent
+	}
+
+	return sc, nil
+}
+
+// Traceparent returns the traceparent value of the span in ctx, or blank
+func Traceparent(ctx context.Context) string {
+	return Format(SpanContextFrom(ctx))
+}
+
+// ContextWithTraceparent returns a context with the remote parent in a
+// traceparent value. ctx is returned if the value is blank or invalid.
+func ContextWithTraceparent(ctx context.Context, v string) context.Context {
+	if v == "" {
+		return ctx
+	}
+
+	sc, err := Parse(v)
+	if err != nil {
+		return ctx
+	}
+
+	return ContextWithRemote(ctx, sc)
+}
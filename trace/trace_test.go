@@ -0,0 +1,233 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testExporter struct {
+	lock  sync.Mutex
+	spans []SpanData
+}
+
+func (e *testExporter) Export(s SpanData) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+func TestSpans(t *testing.T) {
+	// spans are nil and do nothing when tracing is off
+	ctx, span := Start(context.Background(), "off", KindInternal)
+	if span != nil {
+		t.Fatal("Expected nil span when tracing is off")
+	}
+	span.SetAttr("a", 1)
+	span.End(nil)
+	if Traceparent(ctx) != "" {
+		t.Error("Expected no traceparent when tracing is off")
+	}
+
+	exp := &testExporter{}
+	SetTracer(NewTracer(exp, 1))
+	defer SetTracer(nil)
+
+	ctx, root := Start(context.Background(), "root", KindServer)
+	_, child := Start(ctx, "child", KindInternal, Attr{"device", "1234"})
+
+	err := errors.New("failed")
+	child.End(&err)
+	root.End(nil)
+	root.End(nil)
+
+	if len(exp.spans) != 2 {
+		t.Fatal("Expected 2 spans, got: ", len(exp.spans))
+	}
+
+	c, r := exp.spans[0], exp.spans[1]
+	if c.TraceID != r.TraceID || c.Parent != r.SpanID {
+		t.Error("Child is not in the root trace")
+	}
+
+	if r.Parent != (SpanID{}) {
+		t.Error("Root has a parent")
+	}
+
+	if c.Error != "failed" || r.Error != "" {
+		t.Errorf("Wrong errors: %q %q", c.Error, r.Error)
+	}
+
+	if len(c.Attrs) != 1 || c.Attrs[0].Value != "1234" {
+		t.Error("Wrong attributes: ", c.Attrs)
+	}
+
+	// unsampled traces are propagated but not exported
+	exp.spans = nil
+	SetTracer(NewTracer(exp, 0))
+
+	ctx, root = Start(context.Background(), "root", KindServer)
+	_, child = Start(ctx, "child", KindInternal)
+	child.End(nil)
+	root.End(nil)
+
+	if len(exp.spans) != 0 {
+		t.Error("Unsampled spans were exported")
+	}
+
+	if child.Context().TraceID != root.Context().TraceID {
+		t.Error("Unsampled child is not in the root trace")
+	}
+
+	// a sampled remote parent is followed even if new traces are not
+	// sampled
+	remote := SpanContext{TraceID: TraceID{1}, SpanID: SpanID{2}, Sampled: true}
+	_, span = Start(ContextWithRemote(context.Background(), remote), "remote",
+		KindServer)
+	span.End(nil)
+
+	if len(exp.spans) != 1 || exp.spans[0].TraceID != remote.TraceID ||
+		exp.spans[0].Parent != remote.SpanID {
+		t.Error("Remote parent was not followed: ", exp.spans)
+	}
+}
+
+func TestTraceparent(t *testing.T) {
+	sc := SpanContext{
+		TraceID: TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6,
+			0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+		SpanID:  SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		Sampled: true,
+	}
+
+	v := Format(sc)
+	if v != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Fatal("Wrong traceparent: ", v)
+	}
+
+	parsed, err := Parse(v)
+	if err != nil {
+		t.Fatal("Error parsing: ", err)
+	}
+
+	if parsed != sc {
+		t.Error("Parsed context does not match")
+	}
+
+	for _, v := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		_, err := Parse(v)
+		if err == nil {
+			t.Errorf("Expected error parsing %q", v)
+		}
+	}
+
+	// future versions can have more fields
+	_, err = Parse("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	if err != nil {
+		t.Error("Error parsing future version: ", err)
+	}
+
+	h := http.Header{}
+	Inject(ContextWithRemote(context.Background(), sc), h)
+	if SpanContextFrom(Extract(context.Background(), h)) != sc {
+		t.Error("Context was not propagated in headers")
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	requests := make(chan otlpExport, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/traces" || req.Header.Get("X-Token") != "secret" {
+			http.Error(res, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		var r otlpExport
+		err := json.NewDecoder(req.Body).Decode(&r)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		requests <- r
+	}))
+	defer server.Close()
+
+	exp := NewOTLPExporter(OTLPConfig{
+		Endpoint:      server.URL + "/",
+		Service:       "test",
+		Headers:       map[string]string{"X-Token": "secret"},
+		FlushInterval: time.Hour,
+	})
+
+	start := time.Unix(10, 5)
+	exp.Export(SpanData{
+		SpanContext: SpanContext{TraceID: TraceID{1}, SpanID: SpanID{2},
+			Sampled: true},
+		Parent: SpanID{3},
+		Name:   "op",
+		Kind:   KindConsumer,
+		Start:  start,
+		End:    start.Add(time.Second),
+		Attrs:  []Attr{{"count", 3}, {"device", "1234"}, {"ok", true}},
+		Error:  "failed",
+	})
+
+	// queued spans are sent when the exporter stops
+	exp.Stop()
+
+	var r otlpExport
+	select {
+	case r = <-requests:
+	default:
+		t.Fatal("Spans were not sent")
+	}
+
+	if exported, dropped := exp.Stats(); exported != 1 || dropped != 0 {
+		t.Errorf("Wrong stats: %v %v", exported, dropped)
+	}
+
+	res := r.ResourceSpans[0]
+	if *res.Resource.Attributes[0].Value.StringValue != "test" {
+		t.Error("Wrong service name")
+	}
+
+	s := res.ScopeSpans[0].Spans[0]
+	if s.TraceID != "01000000000000000000000000000000" ||
+		s.SpanID != "0200000000000000" || s.ParentSpanID != "0300000000000000" {
+		t.Error("Wrong IDs: ", s.TraceID, s.SpanID, s.ParentSpanID)
+	}
+
+	if s.StartTimeUnixNano != "10000000005" ||
+		s.EndTimeUnixNano != "11000000005" {
+		t.Error("Wrong times: ", s.StartTimeUnixNano, s.EndTimeUnixNano)
+	}
+
+	if s.Kind != KindConsumer || s.Status.Code != otlpStatusError ||
+		s.Status.Message != "failed" {
+		t.Error("Wrong kind or status: ", s.Kind, s.Status)
+	}
+
+	if *s.Attributes[0].Value.IntValue != "3" ||
+		*s.Attributes[1].Value.StringValue != "1234" ||
+		!*s.Attributes[2].Value.BoolValue {
+		t.Error("Wrong attributes: ", s.Attributes)
+	}
+
+	// spans after Stop are ignored
+	exp.Export(SpanData{Name: "late"})
+}
@@ -0,0 +1,87 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// conn is an engineer connection to a device port
+type conn struct {
+	ws        *websocket.Conn
+	readLock  sync.Mutex
+	reader    io.Reader
+	writeLock sync.Mutex
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	for {
+		if c.reader == nil {
+			_, r, err := c.ws.NextReader()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return 0, io.EOF
+			} else if err != nil {
+				return 0, err
+			}
+			c.reader = r
+		}
+
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	err := c.ws.WriteMessage(websocket.BinaryMessage, b)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (c *conn) Close() error {
+	return c.ws.Close()
+}
+
+// Connect connects to the device port of a tunnel session through the
+// admin API of server, like https://siot.example.com. The device must be
+// connected to the session. The connection can be used like a TCP
+// connection to the port, like for an SSH ProxyCommand. dialer is used if
+// it is not nil.
+func Connect(server, adminToken string, id uint64, dialer *websocket.Dialer) (io.ReadWriteCloser, error) {
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+adminToken)
+
+	ws, resp, err := dialer.Dial(wsURL(server,
+		fmt.Sprintf("/admin/tunnels/%v/connect", id)), header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("Error connecting to tunnel: %v", resp.Status)
+		}
+		return nil, err
+	}
+
+	return &conn{ws: ws}, nil
+}
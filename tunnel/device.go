@@ -0,0 +1,269 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// DeviceConfig describes which tunnels a device accepts
+type DeviceConfig struct {
+	// Server is the HTTP URL of the SIOT server, like
+	// https://siot.example.com
+	Server string
+	// Ports are the local TCP ports engineers can connect to, like 22.
+	// Tunnels to other ports are refused, so tunnels are disabled if it is
+	// empty.
+	Ports []int
+	// Dialer is used to connect to the server, like to connect through a
+	// proxy. websocket.DefaultDialer is used if nil.
+	Dialer *websocket.Dialer
+}
+
+// Device opens tunnels to the server when it is sent a data.TunnelCommand
+type Device struct {
+	config DeviceConfig
+	lock   sync.Mutex
+	// running are the sessions with a connection to the server
+	running map[uint64]bool
+}
+
+// NewDevice creates the device side of tunnels
+func NewDevice(config DeviceConfig) (*Device, error) {
+	if config.Server == "" {
+		return nil, errors.New("server url is required")
+	}
+
+	if config.Dialer == nil {
+		config.Dialer = websocket.DefaultDialer
+	}
+
+	return &Device{config: config, running: make(map[uint64]bool)}, nil
+}
+
+// deviceTunnel is a tunnel from a data.TunnelCommand
+type deviceTunnel struct {
+	session uint64
+	port    int
+	token   string
+	ends    time.Time
+
+	ws        *websocket.Conn
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	conns     map[uint32]net.Conn
+}
+
+// Command runs a data.TunnelCommand received from the server. The tunnel
+// runs in the background until the server closes it or it ends.
+func (d *Device) Command(cmd data.DeviceCommand) error {
+	if cmd.Command != data.TunnelCommand {
+		return fmt.Errorf("unexpected command: %v", cmd.Command)
+	}
+
+	session, err := strconv.ParseUint(cmd.Args["sessionId"], 10, 64)
+	if err != nil {
+		return errors.New("invalid sessionId arg")
+	}
+
+	port, err := strconv.Atoi(cmd.Args["port"])
+	if err != nil {
+		return errors.New("invalid port arg")
+	}
+
+	allowed := false
+	for _, p := range d.config.Ports {
+		if p == port {
+			allowed = true
+		}
+	}
+
+	if !allowed {
+		return fmt.Errorf("tunnels to port %v are not allowed", port)
+	}
+
+	ends, err := time.Parse(time.RFC3339, cmd.Args["ends"])
+	if err != nil {
+		return errors.New("invalid ends arg")
+	}
+
+	if time.Now().After(ends) {
+		return errors.New("tunnel session ended")
+	}
+
+	t := &deviceTunnel{
+		session: session,
+		port:    port,
+		token:   cmd.Args["token"],
+		ends:    ends,
+		conns:   make(map[uint32]net.Conn),
+	}
+
+	d.lock.Lock()
+	if d.running[session] {
+		d.lock.Unlock()
+		return nil
+	}
+	d.running[session] = true
+	d.lock.Unlock()
+
+	go func() {
+		err := d.run(t)
+		if err != nil {
+			log.Printf("Tunnel %v: %v", session, err)
+		}
+
+		d.lock.Lock()
+		delete(d.running, session)
+		d.lock.Unlock()
+	}()
+
+	return nil
+}
+
+// wsURL returns the websocket URL for a server path
+func wsURL(server, path string) string {
+	u := strings.TrimRight(server, "/") + path
+	if strings.HasPrefix(u, "https://") {
+		return "wss://" + u[len("https://"):]
+	}
+	if strings.HasPrefix(u, "http://") {
+		return "ws://" + u[len("http://"):]
+	}
+	return u
+}
+
+func (d *Device) run(t *deviceTunnel) error {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+t.token)
+
+	ws, _, err := d.config.Dialer.Dial(wsURL(d.config.Server, fmt.Sprintf("/v1/tunnels/%v", t.session)), header)
+	if err != nil {
+		return err
+	}
+
+	t.ws = ws
+	defer t.close()
+
+	// the server closes the tunnel at the time limit, but don't depend on
+	// it
+	timer := time.AfterFunc(time.Until(t.ends), func() { ws.Close() })
+	defer timer.Stop()
+
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return nil
+			}
+			return err
+		}
+
+		ft, stream, payload, err := decodeFrame(msg)
+		if err != nil {
+			return err
+		}
+
+		switch ft {
+		case frameOpen:
+			t.open(stream)
+		case frameData:
+			t.lock.Lock()
+			c := t.conns[stream]
+			t.lock.Unlock()
+
+			if c != nil {
+				_, err := c.Write(payload)
+				if err != nil {
+					t.closeStream(stream, true)
+				}
+			}
+		case frameClose:
+			t.closeStream(stream, false)
+		}
+	}
+}
+
+func (t *deviceTunnel) send(ft byte, stream uint32, payload []byte) error {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	return t.ws.WriteMessage(websocket.BinaryMessage,
+		encodeFrame(ft, stream, payload))
+}
+
+// open connects a stream to the local port. It runs before more frames
+// are read, so no data for the stream is lost.
+func (t *deviceTunnel) open(stream uint32) {
+	c, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1",
+		strconv.Itoa(t.port)), 10*time.Second)
+	if err != nil {
+		log.Printf("Tunnel %v: %v", t.session, err)
+		t.send(frameClose, stream, nil)
+		return
+	}
+
+	t.lock.Lock()
+	t.conns[stream] = c
+	t.lock.Unlock()
+
+	go t.forward(stream, c)
+}
+
+// forward sends the data of a local connection to the server
+func (t *deviceTunnel) forward(stream uint32, c net.Conn) {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := c.Read(buf)
+		if n > 0 {
+			if t.send(frameData, stream, buf[:n]) != nil {
+				break
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	t.closeStream(stream, true)
+}
+
+// closeStream closes the local connection of a stream, and tells the
+// server if notify is true and the stream was still open
+func (t *deviceTunnel) closeStream(stream uint32, notify bool) {
+	t.lock.Lock()
+	c, ok := t.conns[stream]
+	delete(t.conns, stream)
+	t.lock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	c.Close()
+	if notify {
+		t.send(frameClose, stream, nil)
+	}
+}
+
+// close closes the server connection and all local connections
+func (t *deviceTunnel) close() {
+	t.ws.Close()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for id, c := range t.conns {
+		c.Close()
+		delete(t.conns, id)
+	}
+}
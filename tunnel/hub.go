@@ -0,0 +1,389 @@
+package tunnel
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  32 << 10,
+	WriteBufferSize: 32 << 10,
+}
+
+// Config describes how tunnel sessions are run
+type Config struct {
+	// Interval is how often sessions are checked for their time limit
+	// (default 10s)
+	Interval time.Duration
+}
+
+// Hub connects engineer connections to device tunnels. The http handlers
+// are served by the api package.
+type Hub struct {
+	db       *db.Db
+	config   Config
+	lock     sync.Mutex
+	sessions map[uint64]*session
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// session is a tunnel session the device connected to. It is kept when
+// the device disconnects, so traffic is counted for the whole session.
+type session struct {
+	id uint64
+	// in and out are the bytes sent to and from the device
+	in  int64
+	out int64
+
+	lock    sync.Mutex
+	device  *websocket.Conn
+	streams map[uint32]*websocket.Conn
+	next    uint32
+
+	// writeLock serializes writes to the device
+	writeLock sync.Mutex
+}
+
+// NewHub creates a tunnel hub. Start enforces session time limits.
+func NewHub(dbInst *db.Db, config Config) *Hub {
+	if config.Interval == 0 {
+		config.Interval = 10 * time.Second
+	}
+
+	return &Hub{
+		db:       dbInst,
+		config:   config,
+		sessions: make(map[uint64]*session),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start closes sessions at their time limit until Stop is called
+func (h *Hub) Start() {
+	go h.run()
+}
+
+// Stop stops checking sessions and disconnects all tunnels
+func (h *Hub) Stop() {
+	close(h.stop)
+	<-h.done
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for id, s := range h.sessions {
+		s.disconnect()
+		delete(h.sessions, id)
+	}
+}
+
+func (h *Hub) run() {
+	defer close(h.done)
+
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+
+	h.check()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.check()
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// check closes sessions past their time limit, and marks sessions that
+// lost their device connection, like after a restart, as pending
+func (h *Hub) check() {
+	sessions, err := h.db.Tunnels()
+	if err != nil {
+		log.Println("Error loading tunnel sessions: ", err)
+		return
+	}
+
+	now := time.Now()
+	for _, s := range sessions {
+		switch {
+		case s.State == data.TunnelClosed:
+		case now.After(s.Ends):
+			err = h.Close(s.ID, "time limit")
+		case s.State == data.TunnelConnected && !h.connected(s.ID):
+			err = h.db.TunnelSetState(s.ID, data.TunnelPending)
+		}
+
+		if err != nil {
+			log.Printf("Error checking tunnel session %v: %v", s.ID, err)
+		}
+	}
+}
+
+func (h *Hub) session(id uint64) *session {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.sessions[id]
+}
+
+// connected returns true if the device of a session is connected
+func (h *Hub) connected(id uint64) bool {
+	s := h.session(id)
+	if s == nil {
+		return false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.device != nil
+}
+
+// Close closes a session and disconnects its tunnel
+func (h *Hub) Close(id uint64, reason string) error {
+	h.lock.Lock()
+	s := h.sessions[id]
+	delete(h.sessions, id)
+	h.lock.Unlock()
+
+	var in, out int64
+	if s != nil {
+		s.disconnect()
+		in, out = atomic.LoadInt64(&s.in), atomic.LoadInt64(&s.out)
+	}
+
+	return h.db.TunnelClose(id, reason, in, out)
+}
+
+// ServeDevice serves the websocket of a device that was sent a
+// data.TunnelCommand. The token from the command must be in an
+// "Authorization: Bearer <token>" header.
+func (h *Hub) ServeDevice(res http.ResponseWriter, req *http.Request, id uint64) {
+	token := req.Header.Get("Authorization")
+	if len(token) < 7 || token[:7] != "Bearer " {
+		http.Error(res, "not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	_, err := h.db.TunnelAuth(id, token[7:])
+	switch err {
+	case nil:
+	case db.ErrInvalidKey:
+		http.Error(res, "not authorized", http.StatusUnauthorized)
+		return
+	case db.ErrTunnelClosed:
+		http.Error(res, err.Error(), http.StatusGone)
+		return
+	default:
+		http.Error(res, "tunnel session not found", http.StatusNotFound)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(res, req, nil)
+	if err != nil {
+		return
+	}
+
+	h.lock.Lock()
+	s := h.sessions[id]
+	if s == nil {
+		s = &session{id: id, streams: make(map[uint32]*websocket.Conn)}
+		h.sessions[id] = s
+	}
+	h.lock.Unlock()
+
+	s.attach(ws)
+
+	err = h.db.TunnelSetState(id, data.TunnelConnected)
+	if err != nil {
+		log.Println("Error setting tunnel state: ", err)
+	}
+
+	s.readDevice(ws)
+
+	if s.detach(ws) && h.session(id) == s {
+		err := h.db.TunnelSetState(id, data.TunnelPending)
+		if err != nil {
+			log.Println("Error setting tunnel state: ", err)
+		}
+	}
+}
+
+// ServeClient serves the websocket of an engineer connection. The
+// connection is forwarded to the device port as a new stream. The caller
+// must check the connection is authorized.
+func (h *Hub) ServeClient(res http.ResponseWriter, req *http.Request, id uint64) {
+	s := h.session(id)
+	if s == nil || !h.connected(id) {
+		http.Error(res, "device is not connected", http.StatusConflict)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(res, req, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	stream, err := s.open(ws)
+	if err != nil {
+		return
+	}
+	defer s.closeStream(stream, true)
+
+	err = h.db.TunnelConnection(id, req.RemoteAddr)
+	if err != nil {
+		log.Println("Error recording tunnel connection: ", err)
+	}
+
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		err = s.send(frameData, stream, msg)
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&s.in, int64(len(msg)))
+	}
+}
+
+// attach makes ws the device connection, replacing an old connection
+func (s *session) attach(ws *websocket.Conn) {
+	s.disconnect()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.device = ws
+}
+
+// detach removes ws if it is still the device connection. Returns true if
+// it was.
+func (s *session) detach(ws *websocket.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.device != ws {
+		return false
+	}
+
+	s.device = nil
+	for id, c := range s.streams {
+		c.Close()
+		delete(s.streams, id)
+	}
+
+	return true
+}
+
+// disconnect closes the device connection and all streams
+func (s *session) disconnect() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.device != nil {
+		s.device.Close()
+		s.device = nil
+	}
+
+	for id, c := range s.streams {
+		c.Close()
+		delete(s.streams, id)
+	}
+}
+
+// send sends a frame to the device
+func (s *session) send(t byte, stream uint32, payload []byte) error {
+	s.lock.Lock()
+	device := s.device
+	s.lock.Unlock()
+
+	if device == nil {
+		return websocket.ErrCloseSent
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return device.WriteMessage(websocket.BinaryMessage,
+		encodeFrame(t, stream, payload))
+}
+
+// open starts a stream for an engineer connection
+func (s *session) open(ws *websocket.Conn) (uint32, error) {
+	s.lock.Lock()
+	s.next++
+	stream := s.next
+	s.streams[stream] = ws
+	s.lock.Unlock()
+
+	err := s.send(frameOpen, stream, nil)
+	if err != nil {
+		s.closeStream(stream, false)
+	}
+
+	return stream, err
+}
+
+// closeStream removes a stream, and tells the device if notify is true
+// and the stream was still open
+func (s *session) closeStream(stream uint32, notify bool) {
+	s.lock.Lock()
+	c, ok := s.streams[stream]
+	delete(s.streams, stream)
+	s.lock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	c.Close()
+	if notify {
+		s.send(frameClose, stream, nil)
+	}
+}
+
+// readDevice forwards data from the device to the engineer connections
+// until the device connection ends
+func (s *session) readDevice(ws *websocket.Conn) {
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		t, stream, payload, err := decodeFrame(msg)
+		if err != nil {
+			log.Printf("Tunnel %v: %v", s.id, err)
+			return
+		}
+
+		s.lock.Lock()
+		c := s.streams[stream]
+		s.lock.Unlock()
+
+		if c == nil {
+			continue
+		}
+
+		switch t {
+		case frameData:
+			atomic.AddInt64(&s.out, int64(len(payload)))
+			err := c.WriteMessage(websocket.BinaryMessage, payload)
+			if err != nil {
+				s.closeStream(stream, true)
+			}
+		case frameClose:
+			s.closeStream(stream, false)
+		}
+	}
+}
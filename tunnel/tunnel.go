@@ -0,0 +1,43 @@
+// Package tunnel lets support engineers connect to a TCP port on a device,
+// like SSH, through the server. The device opens an outbound websocket to
+// the server when it gets a data.TunnelCommand, so it does not need to be
+// reachable, and each engineer connection is multiplexed over it as a
+// stream. Sessions are opened with the admin API, are audited, and end at
+// their time limit.
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// frame types sent over the device websocket
+const (
+	// frameOpen is sent by the server to open a stream to the device port
+	frameOpen byte = iota + 1
+	// frameData carries stream data in either direction
+	frameData
+	// frameClose is sent by either side when a stream ends
+	frameClose
+)
+
+// frameHeader is the size of the type and stream ID of a frame
+const frameHeader = 5
+
+// encodeFrame returns a websocket message with a frame
+func encodeFrame(t byte, stream uint32, payload []byte) []byte {
+	b := make([]byte, frameHeader+len(payload))
+	b[0] = t
+	binary.BigEndian.PutUint32(b[1:], stream)
+	copy(b[frameHeader:], payload)
+	return b
+}
+
+// decodeFrame returns the type, stream ID, and payload of a frame
+func decodeFrame(b []byte) (byte, uint32, []byte, error) {
+	if len(b) < frameHeader {
+		return 0, 0, nil, errors.New("tunnel frame is too short")
+	}
+
+	return b[0], binary.BigEndian.Uint32(b[1:]), b[frameHeader:], nil
+}
@@ -0,0 +1,223 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/db"
+	"github.com/simpleiot/simpleiot/db/dbtest"
+)
+
+// wait waits for cond to be true
+func wait(t *testing.T, what string, cond func() bool) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("timeout waiting for ", what)
+}
+
+// echoServer echoes data on a local port, like a device service
+func echoServer(t *testing.T) (int, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening: ", err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr).Port, func() { l.Close() }
+}
+
+// testServer serves the hub like the api package
+func testServer(hub *Hub) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+		id, _ := strconv.ParseUint(parts[2], 10, 64)
+		if parts[0] == "admin" {
+			hub.ServeClient(res, req, id)
+		} else {
+			hub.ServeDevice(res, req, id)
+		}
+	}))
+}
+
+func TestTunnel(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	port, stop := echoServer(t)
+	defer stop()
+
+	hub := NewHub(dbInst, Config{Interval: 10 * time.Millisecond})
+	hub.Start()
+	defer hub.Stop()
+
+	ts := testServer(hub)
+	defer ts.Close()
+
+	s, token, err := dbInst.TunnelCreate(data.TunnelSession{DeviceID: "pump",
+		Port: port, User: "sam", Ends: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal("Error creating session: ", err)
+	}
+
+	cmds, err := dbInst.DeviceCommands("pump")
+	if err != nil || len(cmds) != 1 || cmds[0].Args["token"] != token {
+		t.Fatalf("wrong commands: %+v, %v", cmds, err)
+	}
+
+	// tunnels are opt in by port
+	d, err := NewDevice(DeviceConfig{Server: ts.URL, Ports: []int{port + 1}})
+	if err != nil {
+		t.Fatal("Error creating device: ", err)
+	}
+
+	if d.Command(cmds[0]) == nil {
+		t.Fatal("expected error for port that is not allowed")
+	}
+
+	// engineers can't connect before the device
+	if _, err := Connect(ts.URL, "", s.ID, nil); err == nil {
+		t.Fatal("expected error connecting before the device")
+	}
+
+	d, err = NewDevice(DeviceConfig{Server: ts.URL, Ports: []int{port}})
+	if err != nil {
+		t.Fatal("Error creating device: ", err)
+	}
+
+	err = d.run(&deviceTunnel{session: s.ID, token: "bad"})
+	if err == nil {
+		t.Fatal("expected error for bad token")
+	}
+
+	err = d.Command(cmds[0])
+	if err != nil {
+		t.Fatal("Error running command: ", err)
+	}
+
+	wait(t, "device connection", func() bool {
+		s, _ := dbInst.Tunnel(s.ID)
+		return s.State == data.TunnelConnected
+	})
+
+	// connections are multiplexed over the device connection
+	var conns []io.ReadWriteCloser
+	for i := 0; i < 2; i++ {
+		c, err := Connect(ts.URL, "", s.ID, nil)
+		if err != nil {
+			t.Fatal("Error connecting: ", err)
+		}
+		defer c.Close()
+		conns = append(conns, c)
+	}
+
+	for i, c := range conns {
+		msg := fmt.Sprintf("hello %v", i)
+		_, err := c.Write([]byte(msg))
+		if err != nil {
+			t.Fatal("Error writing: ", err)
+		}
+
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(c, buf)
+		if err != nil || string(buf) != msg {
+			t.Fatalf("wrong echo: %q, %v", buf, err)
+		}
+	}
+
+	err = hub.Close(s.ID, "done")
+	if err != nil {
+		t.Fatal("Error closing session: ", err)
+	}
+
+	if _, err := conns[0].Read(make([]byte, 10)); err == nil {
+		t.Error("connection not closed with the session")
+	}
+
+	s, err = dbInst.Tunnel(s.ID)
+	if err != nil || s.State != data.TunnelClosed || s.CloseReason != "done" ||
+		s.Connections != 2 || s.BytesIn != 14 || s.BytesOut != 14 {
+		t.Errorf("wrong session: %+v, %v", s, err)
+	}
+
+	// closed sessions can't be used again
+	if _, err := dbInst.TunnelAuth(s.ID, token); err != db.ErrTunnelClosed {
+		t.Error("expected closed error: ", err)
+	}
+
+	audit, err := dbInst.Audit("pump")
+	if err != nil || len(audit) < 4 {
+		t.Errorf("missing audit records: %+v, %v", audit, err)
+	}
+}
+
+func TestTunnelTimeLimit(t *testing.T) {
+	dbInst, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	port, stop := echoServer(t)
+	defer stop()
+
+	hub := NewHub(dbInst, Config{Interval: 10 * time.Millisecond})
+	hub.Start()
+	defer hub.Stop()
+
+	ts := testServer(hub)
+	defer ts.Close()
+
+	s, _, err := dbInst.TunnelCreate(data.TunnelSession{DeviceID: "pump",
+		Port: port, User: "sam", Ends: time.Now().Add(2 * time.Second)})
+	if err != nil {
+		t.Fatal("Error creating session: ", err)
+	}
+
+	cmds, err := dbInst.DeviceCommands("pump")
+	if err != nil || len(cmds) != 1 {
+		t.Fatalf("wrong commands: %+v, %v", cmds, err)
+	}
+
+	d, err := NewDevice(DeviceConfig{Server: ts.URL, Ports: []int{port}})
+	if err != nil {
+		t.Fatal("Error creating device: ", err)
+	}
+
+	err = d.Command(cmds[0])
+	if err != nil {
+		t.Fatal("Error running command: ", err)
+	}
+
+	wait(t, "session to end", func() bool {
+		s, _ := dbInst.Tunnel(s.ID)
+		return s.State == data.TunnelClosed && s.CloseReason == "time limit"
+	})
+
+	wait(t, "device to disconnect", func() bool {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		return len(d.running) == 0
+	})
+}